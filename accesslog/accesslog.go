@@ -0,0 +1,148 @@
+// Package accesslog logs API requests as JSON lines that log pipelines can
+// parse, and keeps request latency histograms per route for Prometheus.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/chip/conveyor/config"
+	"github.com/gin-gonic/gin"
+)
+
+// Entry is the access log line of a request
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	// Route is the path template the request matched, such as
+	// /api/pipelines/:id, and empty when it matched none
+	Route     string  `json:"route"`
+	Path      string  `json:"path,omitempty"`
+	Status    int     `json:"status"`
+	LatencyMS float64 `json:"latencyMs"`
+	Principal string  `json:"principal,omitempty"`
+	Bytes     int     `json:"bytes"`
+	ClientIP  string  `json:"clientIp"`
+}
+
+// Logger writes access log lines and records request metrics
+type Logger struct {
+	mu         sync.Mutex
+	out        io.Writer
+	enabled    bool
+	sampleRate float64
+	slow       time.Duration
+	exclude    map[string]bool
+
+	metrics *Metrics
+	// sample returns a number in [0, 1) requests are sampled with
+	sample func() float64
+}
+
+// New returns a logger writing to out, and recording into metrics unless
+// it is nil. It logs nothing until configured.
+func New(out io.Writer, metrics *Metrics) *Logger {
+	return &Logger{out: out, metrics: metrics, sampleRate: 1, sample: rand.Float64}
+}
+
+// Configure replaces the logger's settings
+func (l *Logger) Configure(settings config.AccessLog) error {
+	var slow time.Duration
+	if settings.Slow != "" {
+		d, err := time.ParseDuration(settings.Slow)
+		if err != nil {
+			return fmt.Errorf("invalid access log slow %q: %w", settings.Slow, err)
+		}
+		slow = d
+	}
+	exclude := make(map[string]bool, len(settings.Exclude))
+	for _, route := range settings.Exclude {
+		exclude[route] = true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enabled = settings.Enabled
+	l.sampleRate = settings.SampleRate
+	l.slow = slow
+	l.exclude = exclude
+	return nil
+}
+
+// Enabled reports whether requests are logged
+func (l *Logger) Enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enabled
+}
+
+// Handler logs and measures requests. principal names the authenticated
+// principal of a request, if any.
+func (l *Logger) Handler(principal func(*gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		latency := time.Since(start)
+
+		route := c.FullPath()
+		status := c.Writer.Status()
+		bytes := c.Writer.Size()
+		if bytes < 0 {
+			bytes = 0
+		}
+		if l.metrics != nil {
+			l.metrics.Observe(c.Request.Method, route, status, latency, bytes)
+		}
+		if !l.logs(route, status, latency) {
+			return
+		}
+
+		entry := Entry{
+			Time:      start.UTC(),
+			Method:    c.Request.Method,
+			Route:     route,
+			Status:    status,
+			LatencyMS: float64(latency.Microseconds()) / 1000,
+			Bytes:     bytes,
+			ClientIP:  c.ClientIP(),
+		}
+		// Requests matching no route are logged with their path, which
+		// shows what is being probed
+		if route == "" {
+			entry.Path = c.Request.URL.Path
+		}
+		if principal != nil {
+			entry.Principal = principal(c)
+		}
+		l.write(entry)
+	}
+}
+
+// logs reports whether a request is logged: failed and slow requests
+// always are, others at the sample rate
+func (l *Logger) logs(route string, status int, latency time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.enabled || l.exclude[route] {
+		return false
+	}
+	if status >= 400 || l.slow > 0 && latency >= l.slow {
+		return true
+	}
+	return l.sampleRate >= 1 || l.sample() < l.sampleRate
+}
+
+// write writes an entry as a line of JSON
+func (l *Logger) write(entry Entry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+}
@@ -0,0 +1,159 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chip/conveyor/config"
+	"github.com/gin-gonic/gin"
+)
+
+func newTestRouter(t *testing.T, settings config.AccessLog) (*gin.Engine, *Logger, *bytes.Buffer, *Metrics) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	var out bytes.Buffer
+	metrics := NewMetrics([]float64{0.1, 1})
+	logger := New(&out, metrics)
+	if err := logger.Configure(settings); err != nil {
+		t.Fatalf("Configure() error = %v", err)
+	}
+	router := gin.New()
+	router.Use(logger.Handler(func(c *gin.Context) string { return c.GetHeader("X-User") }))
+	router.GET("/api/pipelines/:id", func(c *gin.Context) {
+		c.String(http.StatusOK, "pipeline")
+	})
+	router.GET("/api/health", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	return router, logger, &out, metrics
+}
+
+func request(router http.Handler, path string) {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("X-User", "alice")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func entries(t *testing.T, out *bytes.Buffer) []Entry {
+	t.Helper()
+	var logged []Entry
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("line %q is not JSON: %v", line, err)
+		}
+		logged = append(logged, entry)
+	}
+	return logged
+}
+
+func TestHandler_LogsRequests(t *testing.T) {
+	router, _, out, _ := newTestRouter(t, config.AccessLog{Enabled: true, SampleRate: 1, Exclude: []string{"/api/health"}})
+
+	request(router, "/api/pipelines/build")
+	request(router, "/api/health")
+	request(router, "/wp-login.php")
+
+	logged := entries(t, out)
+	if len(logged) != 2 {
+		t.Fatalf("logged %d requests, want 2: %s", len(logged), out)
+	}
+	got := logged[0]
+	if got.Method != "GET" || got.Route != "/api/pipelines/:id" || got.Status != 200 || got.Principal != "alice" || got.Bytes != len("pipeline") || got.Path != "" {
+		t.Errorf("entry = %+v", got)
+	}
+	if logged[1].Route != "" || logged[1].Path != "/wp-login.php" || logged[1].Status != 404 {
+		t.Errorf("unmatched entry = %+v, want its path and 404", logged[1])
+	}
+}
+
+func TestHandler_Sampling(t *testing.T) {
+	router, logger, out, metrics := newTestRouter(t, config.AccessLog{Enabled: true, SampleRate: 0.5})
+	samples := []float64{0.7, 0.2}
+	logger.sample = func() float64 {
+		s := samples[0]
+		samples = samples[1:]
+		return s
+	}
+
+	request(router, "/api/pipelines/build")
+	request(router, "/api/pipelines/build")
+	// Failed requests are logged without sampling
+	request(router, "/missing")
+
+	logged := entries(t, out)
+	if len(logged) != 2 || logged[0].Route != "/api/pipelines/:id" || logged[1].Status != 404 {
+		t.Errorf("logged %+v, want the second request and the failed one", logged)
+	}
+
+	// Metrics count every request
+	var b strings.Builder
+	metrics.Write(&b)
+	if !strings.Contains(b.String(), `conveyor_http_request_duration_seconds_count{method="GET",route="/api/pipelines/:id",status="200"} 2`) {
+		t.Errorf("metrics don't count both sampled requests:\n%s", b.String())
+	}
+}
+
+func TestHandler_Disabled(t *testing.T) {
+	router, logger, out, _ := newTestRouter(t, config.AccessLog{SampleRate: 1})
+	request(router, "/api/pipelines/build")
+	if out.Len() != 0 || logger.Enabled() {
+		t.Errorf("disabled logger wrote %q", out)
+	}
+}
+
+func TestMetrics_Write(t *testing.T) {
+	metrics := NewMetrics([]float64{0.1, 1})
+	metrics.Observe("GET", "/api/jobs", 200, 50*time.Millisecond, 10)
+	metrics.Observe("GET", "/api/jobs", 200, 500*time.Millisecond, 20)
+	metrics.Observe("GET", "/api/jobs", 200, 2*time.Second, 30)
+	metrics.Observe("GET", "", 404, time.Millisecond, 0)
+	metrics.Observe("PROBE1", "", 404, time.Millisecond, 0)
+	metrics.Observe("PROBE2", "", 404, time.Millisecond, 0)
+
+	var b strings.Builder
+	if err := metrics.Write(&b); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	for _, want := range []string{
+		"# TYPE conveyor_http_request_duration_seconds histogram",
+		`conveyor_http_request_duration_seconds_bucket{method="GET",route="/api/jobs",status="200",le="0.1"} 1`,
+		`conveyor_http_request_duration_seconds_bucket{method="GET",route="/api/jobs",status="200",le="1"} 2`,
+		`conveyor_http_request_duration_seconds_bucket{method="GET",route="/api/jobs",status="200",le="+Inf"} 3`,
+		`conveyor_http_request_duration_seconds_sum{method="GET",route="/api/jobs",status="200"} 2.55`,
+		`conveyor_http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`,
+		`conveyor_http_request_duration_seconds_count{method="OTHER",route="unmatched",status="404"} 2`,
+		`conveyor_http_response_size_bytes_total{method="GET",route="/api/jobs",status="200"} 60`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestMetrics_Token(t *testing.T) {
+	metrics := NewMetrics(nil)
+	metrics.Token = "scrape"
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status without token = %d, want 401", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scrape")
+	rec = httptest.NewRecorder()
+	metrics.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("status with token = %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
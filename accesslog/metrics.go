@@ -0,0 +1,176 @@
+package accesslog
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chip/conveyor/auth"
+)
+
+// DefaultBuckets are the upper bounds of the latency histograms in seconds
+// when none are configured, Prometheus' defaults
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// unmatchedRoute labels requests that matched no route, so probing random
+// paths doesn't add series
+const unmatchedRoute = "unmatched"
+
+// otherMethod labels requests of methods outside the standard ones, which
+// clients can make up as freely as paths
+const otherMethod = "OTHER"
+
+// standardMethods are the methods metrics label by name
+var standardMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// Metrics keeps request counts, latency histograms and response sizes per
+// method, route and status, and serves them in the Prometheus text format
+type Metrics struct {
+	// Token is the bearer token scrapers must send, if set
+	Token string
+
+	mu      sync.Mutex
+	buckets []float64
+	series  map[seriesKey]*series
+}
+
+// seriesKey identifies the requests of a method, route and status
+type seriesKey struct {
+	method string
+	route  string
+	status int
+}
+
+// series is the histogram of the requests of a seriesKey. counts[i] are
+// the requests no slower than buckets[i], not cumulated.
+type series struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+	bytes  uint64
+}
+
+// NewMetrics returns empty metrics with histograms of buckets, or
+// DefaultBuckets when none are given
+func NewMetrics(buckets []float64) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	return &Metrics{buckets: buckets, series: make(map[seriesKey]*series)}
+}
+
+// Observe records a request
+func (m *Metrics) Observe(method, route string, status int, latency time.Duration, bytes int) {
+	if route == "" {
+		route = unmatchedRoute
+	}
+	if !standardMethods[method] {
+		method = otherMethod
+	}
+	seconds := latency.Seconds()
+	key := seriesKey{method: method, route: route, status: status}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.series[key]
+	if s == nil {
+		s = &series{counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	if i := sort.SearchFloat64s(m.buckets, seconds); i < len(m.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += seconds
+	s.bytes += uint64(bytes)
+}
+
+// ServeHTTP serves the metrics to scrapers
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.Token != "" && !auth.TokenEqual(auth.BearerToken(r.Header.Get("Authorization")), m.Token) {
+		http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.Write(w)
+}
+
+// Write writes the metrics in the Prometheus text format, series sorted by
+// route, method and status
+func (m *Metrics) Write(w io.Writer) error {
+	m.mu.Lock()
+	keys := make([]seriesKey, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	snapshot := make([]series, len(keys))
+	for i, key := range keys {
+		s := m.series[key]
+		snapshot[i] = series{counts: append([]uint64(nil), s.counts...), count: s.count, sum: s.sum, bytes: s.bytes}
+	}
+	m.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP conveyor_http_request_duration_seconds Latency of HTTP requests by route.\n")
+	b.WriteString("# TYPE conveyor_http_request_duration_seconds histogram\n")
+	for i, key := range keys {
+		s := snapshot[i]
+		labels := key.labels()
+		var cumulative uint64
+		for j, bound := range m.buckets {
+			cumulative += s.counts[j]
+			fmt.Fprintf(&b, "conveyor_http_request_duration_seconds_bucket{%s,le=%q} %d\n", labels, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(&b, "conveyor_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, s.count)
+		fmt.Fprintf(&b, "conveyor_http_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(s.sum))
+		fmt.Fprintf(&b, "conveyor_http_request_duration_seconds_count{%s} %d\n", labels, s.count)
+	}
+	b.WriteString("# HELP conveyor_http_response_size_bytes_total Bytes of HTTP response bodies by route.\n")
+	b.WriteString("# TYPE conveyor_http_response_size_bytes_total counter\n")
+	for i, key := range keys {
+		fmt.Fprintf(&b, "conveyor_http_response_size_bytes_total{%s} %d\n", key.labels(), snapshot[i].bytes)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// labels formats the labels of a series
+func (k seriesKey) labels() string {
+	return fmt.Sprintf("method=%s,route=%s,status=\"%d\"", labelValue(k.method), labelValue(k.route), k.status)
+}
+
+// labelValue quotes a label value, escaping backslashes, quotes and
+// newlines
+func labelValue(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return `"` + value + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
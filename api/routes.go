@@ -2,26 +2,47 @@ package api
 
 import (
 	"github.com/chip/conveyor/api/routes"
+	"github.com/chip/conveyor/config"
 	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/depcache"
+	"github.com/chip/conveyor/export"
 	"github.com/gin-gonic/gin"
 )
 
 // SetupRoutes sets up all API routes
 func SetupRoutes(r *gin.Engine, engine *core.PipelineEngine, pipelineLoader interface {
 	LoadFromBytes([]byte, string) (*core.Pipeline, []string, error)
-}) {
+}, gitops *routes.GitOpsConfig, discovery *routes.DiscoveryConfig, securityScans *routes.SecurityScans, authConfig *routes.AuthConfig, plugins *routes.PluginSource, settings *config.Settings, exporter *export.Exporter, cache *depcache.Cache, allowOrigins []string) {
 	// API group
 	api := r.Group("/api")
+	api.Use(routes.Localize(), routes.DisplayTimezone())
+	if authConfig != nil && authConfig.Enabled {
+		api.Use(routes.RequireAuth(authConfig, engine))
+	}
+	if engine.ReadOnly() {
+		api.Use(routes.ReadOnlyServer())
+	}
 
-	// Health endpoint
+	// Health endpoint. ?details=true adds the feature flags for debugging.
 	api.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{
-			"status": "ok",
-		})
+		health := gin.H{
+			"status":   "ok",
+			"fips":     engine.CryptoMode().FIPS,
+			"readOnly": engine.ReadOnly(),
+			// The time zone of schedules without one
+			"timezone": engine.ScheduleLocation().String(),
+		}
+		if c.Query("details") == "true" {
+			health["features"] = engine.FeatureFlags()
+		}
+		c.JSON(200, health)
 	})
 
 	// Pipeline routes
 	pipelineRoutes := api.Group("/pipelines")
+	if gitops != nil && gitops.Syncer.ReadOnly() {
+		pipelineRoutes.Use(routes.ReadOnlyPipelines())
+	}
 	routes.RegisterPipelineRoutes(pipelineRoutes, engine)
 
 	// Pipeline import route (needs loader)
@@ -29,20 +50,114 @@ func SetupRoutes(r *gin.Engine, engine *core.PipelineEngine, pipelineLoader inte
 		routes.RegisterPipelineImportRoute(pipelineRoutes, pipelineLoader)
 	}
 
+	// GitOps sync routes (only when pipeline sync is enabled)
+	if gitops != nil {
+		routes.RegisterGitOpsRoutes(api.Group("/gitops"), gitops)
+	}
+
+	// Project discovery routes (only when discovery is enabled)
+	if discovery != nil {
+		routes.RegisterDiscoveryRoutes(api.Group("/discovery"), discovery)
+	}
+
 	// Job routes
 	jobRoutes := api.Group("/jobs")
 	routes.RegisterJobRoutes(jobRoutes, engine)
 
+	// Artifact storage routes
+	routes.RegisterArtifactRoutes(api.Group("/artifacts"), engine)
+
+	// Promoted releases
+	routes.RegisterReleaseRoutes(api.Group("/releases"), engine)
+
+	// Runner and label capacity routes
+	routes.RegisterRunnerRoutes(api.Group("/runners"), engine)
+
+	// Named locks on external resources and the steps waiting for them
+	routes.RegisterLockRoutes(api.Group("/locks"), engine)
+
+	// Notification conditions tested against past jobs
+	routes.RegisterNotificationRoutes(api.Group("/notifications"), engine)
+
+	// Agent tokens and the routes ephemeral agents take steps on
+	routes.RegisterAgentRoutes(api.Group("/agents"), engine)
+
+	// Cost and usage reports
+	routes.RegisterReportRoutes(api.Group("/reports"), engine)
+
+	// Events of every replica, from a position
+	routes.RegisterEventRoutes(api.Group("/events"), engine)
+	upgrader := routes.NewUpgrader(allowOrigins)
+	routes.RegisterEventSocket(api.Group("/ws"), engine, upgrader)
+
+	// Time series for Grafana dashboards
+	routes.RegisterGrafanaRoutes(api.Group("/grafana"), engine)
+
+	// Warm workspace routes
+	routes.RegisterWorkspaceRoutes(api.Group("/workspaces"), engine)
+
+	// Maintenance windows and the triggers they hold
+	routes.RegisterMaintenanceRoutes(api.Group("/maintenance"), engine)
+
+	// Incidents and the deploys they freeze
+	routes.RegisterIncidentRoutes(api.Group("/incidents"), engine)
+
+	// Forecast of scheduled runs
+	routes.RegisterScheduleRoutes(api.Group("/schedule"), engine)
+
+	// Debug sessions of failed steps
+	routes.RegisterDebugRoutes(api.Group("/debug"), engine, upgrader)
+
+	// Secret routes
+	routes.RegisterSecretRoutes(api.Group("/secrets"), engine)
+
 	// Plugin routes
 	pluginRoutes := api.Group("/plugins")
-	routes.RegisterPluginRoutes(pluginRoutes)
+	routes.RegisterPluginRoutes(pluginRoutes, plugins)
 
 	// Security routes
 	securityRoutes := api.Group("/security")
-	routes.RegisterSecurityRoutes(securityRoutes, engine)
+	routes.RegisterSecurityRoutes(securityRoutes, engine, securityScans)
+
+	// Token and role binding routes, and SCIM provisioning of users and teams
+	if authConfig != nil {
+		routes.RegisterAuthRoutes(api.Group("/auth"), authConfig.Directory)
+		// Read-only servers don't provision users
+		if authConfig.SCIMToken != "" && !engine.ReadOnly() {
+			routes.RegisterSCIMRoutes(r.Group("/scim/v2"), authConfig.Directory, authConfig.SCIMToken)
+		}
+	}
+
+	// Runtime feature flag toggles
+	routes.RegisterFeatureRoutes(api.Group("/admin/features"), engine)
+
+	// Server settings, when the server manages its configuration file
+	if settings != nil {
+		routes.RegisterSettingsRoutes(api.Group("/admin/settings"), settings)
+	}
+
+	// Warehouse exports, when exporting is configured
+	if exporter != nil {
+		routes.RegisterExportRoutes(api.Group("/admin/exports"), exporter)
+	}
+
+	// Dependency cache statistics, and the cache steps download Go modules
+	// and npm packages through. The cache is unauthenticated, like the
+	// registries it mirrors.
+	if cache != nil {
+		routes.RegisterDependencyCacheRoutes(api.Group("/dependencies/cache"), cache)
+		r.Any(depcache.Prefix+"/*path", gin.WrapH(cache))
+	}
 
 	// System stats routes
 	api.GET("/system/stats", func(c *gin.Context) {
 		routes.GetSystemStats(c)
 	})
+	api.GET("/system/crypto", func(c *gin.Context) {
+		c.JSON(200, engine.CryptoMode())
+	})
+	// Protocols the server speaks and the agents and plugins to upgrade
+	api.GET("/system/compatibility", func(c *gin.Context) {
+		c.JSON(200, engine.Compatibility())
+	})
 }
@@ -0,0 +1,205 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/chip/conveyor/auth"
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+// maxAgentWait is the longest an agent's request for work is held open
+const maxAgentWait = time.Minute
+
+// RegisterAgentRoutes registers the routes minting agent tokens and the
+// routes ephemeral agents register, take steps and report results on.
+// Agents authenticate with their token, then with the secret they got at
+// registration, instead of an API token.
+func RegisterAgentRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
+	// Registered agents, and agents done in the last hour
+	router.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.Agents())
+	})
+
+	router.GET("/:id", func(c *gin.Context) {
+		agent, err := engine.Agent(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, agent)
+	})
+
+	// Let an agent finish its job and take no other
+	router.POST("/:id/drain", func(c *gin.Context) {
+		agentOperation(c, func() (core.Agent, error) { return engine.DrainAgent(c.Param("id")) })
+	})
+
+	// Deregister an agent right away; the steps it runs are re-dispatched
+	router.POST("/:id/disconnect", func(c *gin.Context) {
+		agentOperation(c, func() (core.Agent, error) { return engine.DisconnectAgent(c.Param("id")) })
+	})
+
+	// Put an agent in or take it out of maintenance
+	router.PUT("/:id/maintenance", func(c *gin.Context) {
+		var req struct {
+			Enabled bool   `json:"enabled"`
+			Reason  string `json:"reason"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		agentOperation(c, func() (core.Agent, error) { return engine.SetAgentMaintenance(c.Param("id"), req.Enabled, req.Reason) })
+	})
+
+	router.GET("/tokens", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.AgentTokens())
+	})
+
+	// Mint a token for one agent of a project; the secret is only returned
+	// here
+	router.POST("/tokens", func(c *gin.Context) {
+		var req struct {
+			Project string   `json:"project"`
+			Labels  []string `json:"labels"`
+			TTL     string   `json:"ttl"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			parsed, err := time.ParseDuration(req.TTL)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ttl: " + err.Error()})
+				return
+			}
+			ttl = parsed
+		}
+		token, secret, err := engine.MintAgentToken(req.Project, req.Labels, ttl)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"token": token, "secret": secret})
+	})
+
+	router.DELETE("/tokens/:id", func(c *gin.Context) {
+		if err := engine.RevokeAgentToken(c.Param("id")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "revoked"})
+	})
+
+	// Register with an agent token, which can't be used again. Agents
+	// without a protocol in common with the server get a 426.
+	router.POST("/register", func(c *gin.Context) {
+		var req struct {
+			core.AgentInfo
+			Token string `json:"token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		agent, secret, err := engine.RegisterAgent(req.Token, req.AgentInfo)
+		if errors.Is(err, core.ErrIncompatibleProtocol) {
+			c.JSON(http.StatusUpgradeRequired, gin.H{"error": err.Error(), "agentProtocols": core.ProtocolRange{Min: core.MinAgentProtocol, Current: core.AgentProtocol}})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"agent": agent, "secret": secret})
+	})
+
+	// Wait up to ?wait= (default 30s) for the next step. 204 means no step
+	// yet, and 410 that the agent is done and should exit.
+	router.GET("/:id/work", func(c *gin.Context) {
+		wait := 30 * time.Second
+		if value := c.Query("wait"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid wait"})
+				return
+			}
+			wait = parsed
+		}
+		if wait > maxAgentWait {
+			wait = maxAgentWait
+		}
+		assignment, err := engine.NextAssignment(c.Request.Context(), c.Param("id"), auth.BearerToken(c.GetHeader("Authorization")), wait)
+		if err != nil {
+			agentError(c, err)
+			return
+		}
+		if assignment == nil {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		c.JSON(http.StatusOK, assignment)
+	})
+
+	router.POST("/:id/work/:assignment", func(c *gin.Context) {
+		var result core.StepResult
+		if err := c.ShouldBindJSON(&result); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := engine.CompleteAssignment(c.Param("id"), auth.BearerToken(c.GetHeader("Authorization")), c.Param("assignment"), result); err != nil {
+			agentError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "accepted"})
+	})
+
+	// Heartbeat of an agent running a long step
+	router.POST("/:id/heartbeat", func(c *gin.Context) {
+		if err := engine.AgentHeartbeat(c.Param("id"), auth.BearerToken(c.GetHeader("Authorization"))); err != nil {
+			agentError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// Deregister before the agent's job finished
+	router.DELETE("/:id", func(c *gin.Context) {
+		if err := engine.DeregisterAgent(c.Param("id"), auth.BearerToken(c.GetHeader("Authorization"))); err != nil {
+			agentError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "deregistered"})
+	})
+}
+
+// agentOperation responds with the agent an admin operation returns, or
+// its error
+func agentOperation(c *gin.Context, operation func() (core.Agent, error)) {
+	agent, err := operation()
+	switch {
+	case errors.Is(err, core.ErrAgentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, agent)
+	}
+}
+
+// agentError responds with the status of an agent error
+func agentError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, core.ErrAgentNotFound):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, core.ErrAgentDone):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,111 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+// legalHoldRequest places a legal hold on a job
+type legalHoldRequest struct {
+	Reason string `json:"reason"`
+}
+
+// RegisterArtifactRoutes registers the routes reporting artifact storage
+// and expiring artifacts
+func RegisterArtifactRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
+	// Storage used by artifacts, in total and per pipeline
+	router.GET("/usage", func(c *gin.Context) {
+		usage, err := engine.ArtifactUsage()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, usage)
+	})
+
+	// Expire artifacts now instead of waiting for the next scheduled run
+	router.POST("/expire", func(c *gin.Context) {
+		expired, err := engine.ExpireArtifacts(time.Now())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "expired": expired})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"expired": expired})
+	})
+}
+
+// getJobArtifacts lists the stored artifacts of a job
+func getJobArtifacts(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		artifacts, err := engine.JobArtifacts(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, artifacts)
+	}
+}
+
+// downloadArtifact streams an artifact as a gzipped tarball
+func downloadArtifact(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		jobID, name := c.Param("id"), c.Param("name")
+		artifacts, err := engine.JobArtifacts(jobID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		found := false
+		for _, artifact := range artifacts {
+			found = found || artifact.Name == name
+		}
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("artifact %s of job %s not found", name, jobID)})
+			return
+		}
+
+		c.Header("Content-Type", "application/gzip")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", jobID+"-"+name+".tar.gz"))
+		if err := engine.ArchiveArtifact(jobID, name, c.Writer); err != nil {
+			c.Error(err)
+		}
+	}
+}
+
+// setLegalHold exempts a job's artifacts from expiry
+func setLegalHold(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req legalHoldRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		hold := &core.LegalHold{Reason: req.Reason}
+		if principal := PrincipalFrom(c); principal != nil {
+			hold.By = principal.Name()
+		}
+		job, err := engine.SetLegalHold(c.Param("id"), hold)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	}
+}
+
+// releaseLegalHold makes a job's artifacts subject to retention again
+func releaseLegalHold(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job, err := engine.SetLegalHold(c.Param("id"), nil)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	}
+}
@@ -0,0 +1,357 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chip/conveyor/auth"
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+// principalKey is the gin context key of the authenticated principal, and
+// authConfigKey of the AuthConfig that authenticated it
+const (
+	principalKey  = "principal"
+	authConfigKey = "authConfig"
+)
+
+// AuthConfig configures authentication of API requests and SCIM
+// provisioning
+type AuthConfig struct {
+	Directory *auth.Directory
+	// Enabled requires a bearer token on API requests
+	Enabled bool
+	// AdminToken is a bootstrap token with the admin role
+	AdminToken string
+	// SCIMToken authenticates the identity provider on the SCIM endpoints.
+	// When empty, SCIM endpoints are not registered.
+	SCIMToken string
+
+	// policy, if set, decides on every request RBAC allows, or on every
+	// request with replaceRBAC. It is replaced on reloads.
+	mu          sync.RWMutex
+	policy      *auth.Policy
+	replaceRBAC bool
+}
+
+// SetPolicy sets the external authorization policy, or removes it when
+// policy is nil
+func (cfg *AuthConfig) SetPolicy(policy *auth.Policy, replaceRBAC bool) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.policy, cfg.replaceRBAC = policy, replaceRBAC && policy != nil
+}
+
+// decide returns whether a principal may perform an action on a pipeline,
+// given whether its role bindings allow it. The external policy, if any,
+// has the last word, except on the bootstrap admin token. When the policy
+// fails, the error is returned with its fail-open or fail-closed decision.
+func (cfg *AuthConfig) decide(c *gin.Context, principal *auth.Principal, action auth.Action, pipelineID string, allowed bool) (bool, error) {
+	cfg.mu.RLock()
+	policy, replaceRBAC := cfg.policy, cfg.replaceRBAC
+	cfg.mu.RUnlock()
+	if policy == nil || principal.User == nil || !allowed && !replaceRBAC {
+		return allowed, nil
+	}
+
+	resource := auth.PolicyResource{Pipeline: pipelineID, Method: c.Request.Method, Route: c.FullPath()}
+	decision, err := policy.Decide(c.Request.Context(), auth.NewPolicyInput(principal, action, resource))
+	if err != nil {
+		log.Printf("auth policy: %s %s for %s: %v", c.Request.Method, c.FullPath(), principal.Name(), err)
+	}
+	return decision, err
+}
+
+// authorized reports whether the principal of a request may perform an
+// action on a pipeline, by its role bindings and the external policy.
+// Handlers use it to filter what they return; requests without a
+// principal, when authentication is off, may do anything.
+func authorized(c *gin.Context, action auth.Action, pipelineID string) bool {
+	principal := PrincipalFrom(c)
+	if principal == nil {
+		return true
+	}
+	value, ok := c.Get(authConfigKey)
+	if !ok {
+		return principal.Can(action, pipelineID)
+	}
+	allowed, _ := value.(*AuthConfig).decide(c, principal, action, pipelineID, principal.Can(action, pipelineID))
+	return allowed
+}
+
+// tokenRequest issues an API token. Only admins may issue tokens for
+// other users.
+type tokenRequest struct {
+	UserID    string `json:"userId"`
+	Name      string `json:"name" binding:"required"`
+	ExpiresIn string `json:"expiresIn"`
+}
+
+// PrincipalFrom returns the principal of an authenticated request, or nil
+// when authentication is disabled
+func PrincipalFrom(c *gin.Context) *auth.Principal {
+	if value, ok := c.Get(principalKey); ok {
+		return value.(*auth.Principal)
+	}
+	return nil
+}
+
+// RequireAuth authenticates API requests by bearer token and checks the
+// principal's role bindings. Reads need the viewer role and changes, as
+// well as debug terminals, the developer role, on the pipeline the request
+// is about; managing users, tokens of others, bindings, secrets, legal
+// holds, maintenance windows and incidents needs the admin role. The
+// external policy, if any, then decides on requests other than the
+// bootstrap admin token's.
+func RequireAuth(cfg *AuthConfig, engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.FullPath()
+		// Health checks, webhooks and agents, which verify their own secret
+		if path == "/api/health" || path == "/api/gitops/webhook" || agentPath(c) {
+			c.Next()
+			return
+		}
+
+		token := auth.BearerToken(c.GetHeader("Authorization"))
+		if token == "" {
+			token = socketToken(c)
+		}
+		if token == "" {
+			localizedError(c, http.StatusUnauthorized, "missing_token", "missing bearer token")
+			return
+		}
+
+		var principal *auth.Principal
+		if auth.TokenEqual(token, cfg.AdminToken) {
+			principal = auth.AdminPrincipal()
+		} else {
+			p, err := cfg.Directory.Authenticate(token)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				return
+			}
+			principal = p
+		}
+
+		// Event streams deliver only the events of pipelines the principal
+		// can read, and comment searches and incidents only their comments
+		// and jobs, so reading any pipeline is enough to open one. The
+		// external policy is asked about opening one with no pipeline, and
+		// about each pipeline's events, comments or jobs through authorized.
+		var allowed bool
+		action, pipelineID := auth.ActionRead, ""
+		if eventPath(path) || path == "/api/jobs/comments" || strings.HasPrefix(path, "/api/incidents") && c.Request.Method == http.MethodGet {
+			allowed = principal.CanAny(auth.ActionRead)
+		} else {
+			action, pipelineID = requiredAction(c), requestPipeline(c, engine)
+			allowed = principal.Can(action, pipelineID)
+		}
+		allowed, err := cfg.decide(c, principal, action, pipelineID, allowed)
+		if err != nil && !allowed {
+			localizedError(c, http.StatusServiceUnavailable, "policy_unavailable", "authorization policy unavailable")
+			return
+		}
+		if !allowed {
+			localizedError(c, http.StatusForbidden, "permission_denied", "permission denied")
+			return
+		}
+
+		c.Set(principalKey, principal)
+		c.Set(authConfigKey, cfg)
+		c.Next()
+	}
+}
+
+// eventPath reports whether a path streams or reads events
+func eventPath(path string) bool {
+	return path == "/api/ws" || path == "/api/events" || path == "/api/events/stream"
+}
+
+// agentPath reports whether a request is made by an ephemeral agent, which
+// authenticates with its agent token or secret
+func agentPath(c *gin.Context) bool {
+	switch c.FullPath() {
+	case "/api/agents/register", "/api/agents/:id/work", "/api/agents/:id/work/:assignment", "/api/agents/:id/heartbeat":
+		return true
+	case "/api/agents/:id":
+		return c.Request.Method == http.MethodDelete
+	}
+	return false
+}
+
+// requiredAction returns the action a request performs
+func requiredAction(c *gin.Context) auth.Action {
+	path := c.FullPath()
+	switch {
+	case path == "/api/auth/me" || strings.HasPrefix(path, "/api/auth/tokens"):
+		// Handlers restrict non-admins to their own tokens
+		return auth.ActionRead
+	case strings.HasPrefix(path, "/api/auth/"), strings.HasPrefix(path, "/api/admin/"):
+		return auth.ActionAdmin
+	}
+
+	if path == "/api/debug/:id/terminal" {
+		// Terminals run commands in the failed step's environment
+		return auth.ActionWrite
+	}
+	if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+		return auth.ActionRead
+	}
+	if strings.HasPrefix(path, "/api/grafana/") {
+		// The Grafana datasource queries with POST
+		return auth.ActionRead
+	}
+	if strings.HasPrefix(path, "/api/secrets") || strings.HasPrefix(path, "/api/maintenance") || strings.HasPrefix(path, "/api/incidents") || strings.HasPrefix(path, "/api/agents") || path == "/api/security/sla" || strings.HasPrefix(path, "/api/security/vex") || path == "/api/jobs/:id/hold" || path == "/api/artifacts/expire" {
+		return auth.ActionAdmin
+	}
+	return auth.ActionWrite
+}
+
+// requestPipeline returns the pipeline a request is about, or "" when it is
+// not about a single pipeline
+func requestPipeline(c *gin.Context, engine *core.PipelineEngine) string {
+	path := c.FullPath()
+	switch {
+	case strings.HasPrefix(path, "/api/pipelines/:id"):
+		return c.Param("id")
+	case strings.HasPrefix(path, "/api/jobs/:id"):
+		if job, err := engine.FindJob(c.Param("id")); err == nil {
+			return job.PipelineID
+		}
+	case path == "/api/security/pipelines/:id/scan":
+		return c.Param("id")
+	case strings.HasPrefix(path, "/api/debug/:id"):
+		if session, err := engine.GetDebugSession(c.Param("id")); err == nil {
+			return session.PipelineID
+		}
+	case path == "/api/reports/costs", path == "/api/reports/failures", path == "/api/reports/infrastructure", path == "/api/grafana/series",
+		path == "/api/maintenance", path == "/api/maintenance/upcoming", path == "/api/maintenance/held":
+		return c.Query("pipeline")
+	}
+	return ""
+}
+
+// RegisterAuthRoutes registers the routes managing API tokens and role
+// bindings. Users and teams are provisioned through SCIM.
+func RegisterAuthRoutes(router *gin.RouterGroup, dir *auth.Directory) {
+	// The caller's identity, teams and bindings
+	router.GET("/me", func(c *gin.Context) {
+		principal := PrincipalFrom(c)
+		if principal == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "authentication is disabled"})
+			return
+		}
+		c.JSON(http.StatusOK, principal)
+	})
+
+	router.GET("/users", func(c *gin.Context) {
+		c.JSON(http.StatusOK, dir.ListUsers())
+	})
+
+	router.GET("/teams", func(c *gin.Context) {
+		c.JSON(http.StatusOK, dir.ListTeams())
+	})
+
+	router.GET("/tokens", func(c *gin.Context) {
+		userID := c.Query("userId")
+		if principal := PrincipalFrom(c); principal != nil && !authorized(c, auth.ActionAdmin, "") {
+			userID = principal.User.ID
+		}
+		c.JSON(http.StatusOK, dir.ListTokens(userID))
+	})
+
+	// Issue a token; the secret is only returned here
+	router.POST("/tokens", func(c *gin.Context) {
+		var req tokenRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if principal := PrincipalFrom(c); principal != nil && !authorized(c, auth.ActionAdmin, "") {
+			if req.UserID != "" && req.UserID != principal.User.ID {
+				c.JSON(http.StatusForbidden, gin.H{"error": "permission denied"})
+				return
+			}
+			req.UserID = principal.User.ID
+		}
+
+		var ttl time.Duration
+		if req.ExpiresIn != "" {
+			parsed, err := core.ParseDuration(req.ExpiresIn)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			ttl = parsed
+		}
+
+		token, secret, err := dir.IssueToken(req.UserID, req.Name, ttl)
+		if err != nil {
+			c.JSON(authErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"token": token, "secret": secret})
+	})
+
+	router.DELETE("/tokens/:id", func(c *gin.Context) {
+		if principal := PrincipalFrom(c); principal != nil && !authorized(c, auth.ActionAdmin, "") {
+			owned := false
+			for _, token := range dir.ListTokens(principal.User.ID) {
+				owned = owned || token.ID == c.Param("id")
+			}
+			if !owned {
+				c.JSON(http.StatusNotFound, gin.H{"error": "token not found"})
+				return
+			}
+		}
+		if err := dir.RevokeToken(c.Param("id")); err != nil {
+			c.JSON(authErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "revoked"})
+	})
+
+	router.GET("/bindings", func(c *gin.Context) {
+		c.JSON(http.StatusOK, dir.ListBindings())
+	})
+
+	router.POST("/bindings", func(c *gin.Context) {
+		var binding auth.Binding
+		if err := c.ShouldBindJSON(&binding); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		created, err := dir.CreateBinding(binding)
+		if err != nil {
+			c.JSON(authErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, created)
+	})
+
+	router.DELETE("/bindings/:id", func(c *gin.Context) {
+		if err := dir.DeleteBinding(c.Param("id")); err != nil {
+			c.JSON(authErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	})
+}
+
+// authErrorStatus maps directory errors to HTTP status codes
+func authErrorStatus(err error) int {
+	var notFound *auth.NotFoundError
+	var conflict *auth.ConflictError
+	switch {
+	case errors.As(err, &notFound):
+		return http.StatusNotFound
+	case errors.As(err, &conflict):
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
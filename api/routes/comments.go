@@ -0,0 +1,99 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/chip/conveyor/auth"
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+// commentRequest is a comment on a job, or on one of its steps
+type commentRequest struct {
+	Text   string `json:"text"`
+	StepID string `json:"stepId"`
+}
+
+// addComment adds a comment to a job or one of its steps, by the
+// authenticated user
+func addComment(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req commentRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if _, err := engine.FindJob(c.Param("id")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		author := ""
+		if principal := PrincipalFrom(c); principal != nil {
+			author = principal.Name()
+		}
+		comment, err := engine.AddJobComment(c.Param("id"), req.StepID, req.Text, author)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, comment)
+	}
+}
+
+// deleteComment removes a comment. Only its author and admins can.
+func deleteComment(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job, err := engine.JobSnapshot(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if principal := PrincipalFrom(c); principal != nil && !authorized(c, auth.ActionAdmin, job.PipelineID) {
+			for _, comment := range job.Comments {
+				if comment.ID == c.Param("commentId") && comment.Author != principal.Name() {
+					c.JSON(http.StatusForbidden, gin.H{"error": "only the author or an admin can delete a comment"})
+					return
+				}
+			}
+		}
+
+		comment, err := engine.DeleteJobComment(job.ID, c.Param("commentId"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, comment)
+	}
+}
+
+// searchComments finds comments on jobs of the pipelines the caller can
+// read by ?q= words, ?author=, ?pipeline= and ?step=, newest first
+func searchComments(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := core.CommentQuery{
+			Text:       c.Query("q"),
+			Author:     c.Query("author"),
+			PipelineID: c.Query("pipeline"),
+			StepID:     c.Query("step"),
+			Limit:      100,
+		}
+		if value := c.Query("limit"); value != "" {
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number"})
+				return
+			}
+			query.Limit = limit
+		}
+
+		if principal := PrincipalFrom(c); principal != nil {
+			query.Visible = func(pipelineID string) bool {
+				return authorized(c, auth.ActionRead, pipelineID)
+			}
+		}
+		matches := engine.SearchComments(query)
+		c.JSON(http.StatusOK, matches)
+	}
+}
@@ -0,0 +1,134 @@
+package routes
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// RegisterDebugRoutes registers the routes inspecting and attaching to
+// debug sessions of failed steps. Terminals are upgraded by upgrader.
+func RegisterDebugRoutes(router *gin.RouterGroup, engine *core.PipelineEngine, upgrader websocket.Upgrader) {
+	router.GET("/:id", func(c *gin.Context) {
+		session, err := engine.GetDebugSession(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, session)
+	})
+
+	router.GET("/:id/audit", func(c *gin.Context) {
+		audit, err := engine.DebugAudit(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, audit)
+	})
+
+	// Attach a web terminal: messages from the client are the terminal's
+	// input, and its output is sent back as binary messages
+	router.GET("/:id/terminal", func(c *gin.Context) {
+		id := c.Param("id")
+		if _, err := engine.GetDebugSession(id); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		out := &terminalWriter{conn: conn}
+		err = engine.AttachDebugSession(c.Request.Context(), id, debugUser(c), &terminalReader{conn: conn}, out)
+		message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		if err != nil {
+			message = websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error())
+		}
+		out.mu.Lock()
+		conn.WriteMessage(websocket.CloseMessage, message)
+		out.mu.Unlock()
+	})
+
+	// End the session and release the step's environment
+	router.DELETE("/:id", func(c *gin.Context) {
+		if err := engine.CloseDebugSession(c.Param("id"), debugUser(c)); err != nil {
+			status := http.StatusConflict
+			if errors.Is(err, core.ErrDebugSessionNotFound) {
+				status = http.StatusNotFound
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": core.DebugClosed})
+	})
+}
+
+// getJobDebugSessions lists the debug sessions of a job
+func getJobDebugSessions(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job, err := engine.FindJob(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, engine.DebugSessions(job.ID))
+	}
+}
+
+// debugUser returns the name recorded in the debug audit trail
+func debugUser(c *gin.Context) string {
+	if principal := PrincipalFrom(c); principal != nil {
+		return principal.Name()
+	}
+	return "anonymous"
+}
+
+// terminalReader reads the terminal input from websocket messages
+type terminalReader struct {
+	conn    *websocket.Conn
+	message io.Reader
+}
+
+func (r *terminalReader) Read(p []byte) (int, error) {
+	for {
+		if r.message == nil {
+			_, message, err := r.conn.NextReader()
+			if err != nil {
+				return 0, io.EOF
+			}
+			r.message = message
+		}
+		n, err := r.message.Read(p)
+		if err == io.EOF {
+			r.message = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// terminalWriter sends terminal output as binary websocket messages
+type terminalWriter struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (w *terminalWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,18 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/chip/conveyor/depcache"
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterDependencyCacheRoutes registers the route reporting the
+// dependency cache's statistics
+func RegisterDependencyCacheRoutes(router *gin.RouterGroup, cache *depcache.Cache) {
+	// Requests, hits, misses and stale copies served, and what is cached,
+	// per ecosystem
+	router.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"offline": cache.Offline, "ecosystems": cache.Stats()})
+	})
+}
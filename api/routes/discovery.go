@@ -0,0 +1,47 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/chip/conveyor/core/loader"
+	"github.com/gin-gonic/gin"
+)
+
+// ProjectDiscoverer generates pipelines for the projects found in a
+// repository
+type ProjectDiscoverer interface {
+	Discover() (*loader.DiscoveryReport, error)
+	Report() loader.DiscoveryReport
+}
+
+// DiscoveryConfig configures the project discovery routes
+type DiscoveryConfig struct {
+	Discoverer ProjectDiscoverer
+	// Syncer applies the generated files when pipeline sync is enabled.
+	// Otherwise they are loaded on the next restart.
+	Syncer PipelineSyncer
+}
+
+// RegisterDiscoveryRoutes registers the routes reporting discovered
+// projects and their generated and manually edited pipelines
+func RegisterDiscoveryRoutes(router *gin.RouterGroup, cfg *DiscoveryConfig) {
+	router.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, cfg.Discoverer.Report())
+	})
+
+	// Discover projects now and return the report
+	router.POST("", func(c *gin.Context) {
+		var err error
+		if cfg.Syncer != nil {
+			// Syncs discover projects before applying the files
+			err = cfg.Syncer.Sync()
+		} else {
+			_, err = cfg.Discoverer.Discover()
+		}
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "report": cfg.Discoverer.Report()})
+			return
+		}
+		c.JSON(http.StatusOK, cfg.Discoverer.Report())
+	})
+}
@@ -0,0 +1,202 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chip/conveyor/auth"
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// maxEventWait bounds how long a read waits for new events
+const maxEventWait = time.Minute
+
+// eventKeepAlive is how often an idle event stream sends a comment so
+// proxies keep the connection open
+const eventKeepAlive = 15 * time.Second
+
+// RegisterEventRoutes registers reads of the events of every replica from
+// a position, as JSON pages and as a server-sent event stream
+func RegisterEventRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
+	// A page of events after ?after=, or from the oldest kept, waiting up
+	// to ?wait= for one. next is the ?after= of the next page.
+	router.GET("", func(c *gin.Context) {
+		limit := 100
+		if value := c.Query("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed <= 0 || parsed > 1000 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid limit %q, want 1 to 1000", value)})
+				return
+			}
+			limit = parsed
+		}
+		var wait time.Duration
+		if value := c.Query("wait"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed < 0 || parsed > maxEventWait {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid wait %q, want at most %s", value, maxEventWait)})
+				return
+			}
+			wait = parsed
+		}
+		after := c.Query("after")
+		events, err := engine.ReadEvents(c.Request.Context(), after, limit, wait)
+		if err != nil {
+			eventError(c, err)
+			return
+		}
+		next := after
+		if len(events) > 0 {
+			next = events[len(events)-1].Position
+		}
+		c.JSON(http.StatusOK, gin.H{"events": visibleEvents(c, engine, events), "next": next})
+	})
+
+	// Events as they are emitted, from ?after= or the Last-Event-ID of a
+	// reconnecting EventSource, or else from now
+	router.GET("/stream", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		position := c.Query("after")
+		if position == "" {
+			position = c.GetHeader("Last-Event-ID")
+		}
+		if position == "" {
+			last, err := engine.LastEventPosition(ctx)
+			if err != nil {
+				eventError(c, err)
+				return
+			}
+			position = last
+		}
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		extendStreamWrite(c.Request)
+		c.Writer.Flush()
+		for {
+			events, err := engine.ReadEvents(ctx, position, 100, eventKeepAlive)
+			extendStreamWrite(c.Request)
+			if err != nil {
+				if ctx.Err() == nil {
+					fmt.Fprintf(c.Writer, "event: error\ndata: %s\n\n", err)
+					c.Writer.Flush()
+				}
+				return
+			}
+			if len(events) == 0 {
+				fmt.Fprint(c.Writer, ": keep-alive\n\n")
+				c.Writer.Flush()
+				continue
+			}
+			for _, event := range visibleEvents(c, engine, events) {
+				data, _ := json.Marshal(event)
+				fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", event.Position, event.Type, data)
+			}
+			position = events[len(events)-1].Position
+			c.Writer.Flush()
+		}
+	})
+}
+
+// RegisterEventSocket registers a WebSocket streaming events as JSON
+// messages, from ?after= or else from now. Messages from the client are
+// ignored.
+func RegisterEventSocket(router *gin.RouterGroup, engine *core.PipelineEngine, upgrader websocket.Upgrader) {
+	router.GET("", func(c *gin.Context) {
+		position := c.Query("after")
+		if position == "" {
+			last, err := engine.LastEventPosition(c.Request.Context())
+			if err != nil {
+				eventError(c, err)
+				return
+			}
+			position = last
+		}
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// The stream ends when the client goes away or stops answering
+		// pings
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+		conn.SetReadDeadline(time.Now().Add(2 * eventKeepAlive))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2 * eventKeepAlive))
+		})
+		go func() {
+			defer cancel()
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		for {
+			events, err := engine.ReadEvents(ctx, position, 100, eventKeepAlive)
+			if err != nil {
+				if ctx.Err() == nil {
+					conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error()))
+				}
+				return
+			}
+			conn.SetWriteDeadline(streamDeadline(c.Request))
+			if len(events) == 0 {
+				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					return
+				}
+				continue
+			}
+			for _, event := range visibleEvents(c, engine, events) {
+				if err := conn.WriteJSON(event); err != nil {
+					return
+				}
+			}
+			position = events[len(events)-1].Position
+		}
+	})
+}
+
+// visibleEvents returns the events of pipelines the request's principal
+// can read, as the external policy decides too. Events of no pipeline need
+// read access to every pipeline.
+func visibleEvents(c *gin.Context, engine *core.PipelineEngine, events []core.Event) []core.Event {
+	principal := PrincipalFrom(c)
+	if principal == nil {
+		return events
+	}
+	visible := make([]core.Event, 0, len(events))
+	for _, event := range events {
+		pipelineID := event.PipelineID
+		if pipelineID == "" && event.JobID != "" {
+			if job, err := engine.FindJob(event.JobID); err == nil {
+				pipelineID = job.PipelineID
+			}
+		}
+		if authorized(c, auth.ActionRead, pipelineID) {
+			visible = append(visible, event)
+		}
+	}
+	return visible
+}
+
+// eventError responds with a read error of the event bus
+func eventError(c *gin.Context, err error) {
+	status := http.StatusServiceUnavailable
+	if errors.Is(err, core.ErrInvalidEventPosition) {
+		status = http.StatusBadRequest
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
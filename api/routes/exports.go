@@ -0,0 +1,40 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/chip/conveyor/export"
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterExportRoutes registers the admin routes reporting and running
+// exports of jobs, steps and findings to the warehouse path
+func RegisterExportRoutes(router *gin.RouterGroup, exporter *export.Exporter) {
+	// Where records are exported, how far the periodic export got and the
+	// last export
+	router.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, exporter.Status())
+	})
+
+	// Export the jobs that ended between since and until now, with an
+	// optional {"since", "until", "format"} body
+	router.POST("", func(c *gin.Context) {
+		var req export.Request
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if err := req.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		result, err := exporter.Export(c.Request.Context(), req)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "result": result})
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+}
@@ -0,0 +1,50 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterFeatureRoutes registers the admin routes toggling feature flags
+// at runtime. Changes last until the configuration is reloaded.
+func RegisterFeatureRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
+	router.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.FeatureFlags())
+	})
+
+	router.GET("/:name", func(c *gin.Context) {
+		state, err := engine.FeatureFlag(c.Param("name"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, state)
+	})
+
+	router.PUT("/:name", func(c *gin.Context) {
+		var flag core.FeatureFlag
+		if err := c.ShouldBindJSON(&flag); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		flag.Name = c.Param("name")
+		state, err := engine.SetFeatureFlag(flag)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, state)
+	})
+
+	// Return a flag to its default state
+	router.DELETE("/:name", func(c *gin.Context) {
+		state, err := engine.ResetFeatureFlag(c.Param("name"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, state)
+	})
+}
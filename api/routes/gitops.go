@@ -0,0 +1,116 @@
+package routes
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/chip/conveyor/core/loader"
+	"github.com/gin-gonic/gin"
+)
+
+// PipelineSyncer reconciles pipelines with a watched directory or repository
+type PipelineSyncer interface {
+	Sync() error
+	Status() loader.SyncStatus
+	ReadOnly() bool
+}
+
+// GitOpsConfig configures the GitOps routes
+type GitOpsConfig struct {
+	Syncer PipelineSyncer
+	// WebhookSecret verifies push webhooks. GitHub-style signatures
+	// (X-Hub-Signature-256) and GitLab tokens (X-Gitlab-Token) are accepted.
+	// When empty, webhooks are not verified.
+	WebhookSecret string
+}
+
+// RegisterGitOpsRoutes registers the routes reporting and triggering
+// pipeline sync, including drift between the files and the engine
+func RegisterGitOpsRoutes(router *gin.RouterGroup, cfg *GitOpsConfig) {
+	// Sync status: applied commit, drift and errors
+	router.GET("/status", func(c *gin.Context) {
+		c.JSON(http.StatusOK, cfg.Syncer.Status())
+	})
+
+	// Sync now and return the resulting status
+	router.POST("/sync", func(c *gin.Context) {
+		if err := cfg.Syncer.Sync(); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "status": cfg.Syncer.Status()})
+			return
+		}
+
+		c.JSON(http.StatusOK, cfg.Syncer.Status())
+	})
+
+	// Push webhook from the git host, triggers a sync in the background
+	router.POST("/webhook", func(c *gin.Context) {
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20)) // 1MB limit
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+			return
+		}
+
+		if !verifyWebhook(c.Request, body, cfg.WebhookSecret) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid webhook signature"})
+			return
+		}
+
+		go func() {
+			if err := cfg.Syncer.Sync(); err != nil {
+				log.Printf("Webhook-triggered pipeline sync failed: %v", err)
+			}
+		}()
+
+		c.JSON(http.StatusAccepted, gin.H{"status": "syncing"})
+	})
+}
+
+// verifyWebhook checks a webhook request against the shared secret
+func verifyWebhook(r *http.Request, body []byte, secret string) bool {
+	if secret == "" {
+		return true
+	}
+
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+
+	signature := strings.TrimPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// ReadOnlyPipelines rejects changes to pipeline definitions through the API
+// when they are managed by GitOps sync. Executing pipelines, retrying jobs
+// and clearing cached results are still allowed.
+func ReadOnlyPipelines() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			c.Next()
+			return
+		}
+
+		path := c.FullPath()
+		if strings.HasSuffix(path, "/execute") || strings.HasSuffix(path, "/retry") || strings.HasSuffix(path, "/cache") {
+			c.Next()
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": "pipelines are managed by GitOps sync and are read-only; change the pipeline files instead",
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+// grafanaQuery is a query of the Grafana SimpleJSON datasource
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMs    int64 `json:"intervalMs"`
+	MaxDataPoints int64 `json:"maxDataPoints"`
+	Targets       []struct {
+		// Target is a metric, or metric:pipeline for one pipeline's jobs
+		Target string `json:"target"`
+		RefID  string `json:"refId"`
+	} `json:"targets"`
+}
+
+// grafanaSeries is a time series in the SimpleJSON format: points of
+// [value, milliseconds since the epoch]
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// RegisterGrafanaRoutes registers the time series of job counts,
+// durations, success rates and queue depth in the format of the Grafana
+// SimpleJSON datasource, and as plain JSON for the Infinity datasource
+func RegisterGrafanaRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
+	// SimpleJSON tests the connection with this route
+	router.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	// The metrics, and the metric:pipeline target of each job metric and
+	// pipeline
+	router.POST("/search", func(c *gin.Context) {
+		targets := core.Metrics()
+		for _, pipeline := range engine.ListPipelines() {
+			for _, metric := range core.Metrics() {
+				if metric != core.MetricQueueDepth {
+					targets = append(targets, metric+":"+pipeline.ID)
+				}
+			}
+		}
+		c.JSON(http.StatusOK, targets)
+	})
+
+	router.POST("/query", func(c *gin.Context) {
+		var query grafanaQuery
+		if err := c.ShouldBindJSON(&query); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		interval := time.Duration(query.IntervalMs) * time.Millisecond
+		if query.MaxDataPoints > 0 {
+			if least := query.Range.To.Sub(query.Range.From) / time.Duration(query.MaxDataPoints); interval < least {
+				interval = least
+			}
+		}
+		interval = metricInterval(interval)
+
+		result := make([]grafanaSeries, 0, len(query.Targets))
+		for _, target := range query.Targets {
+			metric, pipelineID := target.Target, ""
+			if i := strings.Index(metric, ":"); i >= 0 {
+				metric, pipelineID = metric[:i], metric[i+1:]
+			}
+			series, err := engine.QueryMetric(core.MetricQuery{Metric: metric, PipelineID: pipelineID, From: query.Range.From, To: query.Range.To, Interval: interval})
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: %v", target.Target, err)})
+				return
+			}
+			points := make([][2]float64, 0, len(series.Points))
+			for _, point := range series.Points {
+				points = append(points, [2]float64{point.Value, float64(point.At.UnixNano() / int64(time.Millisecond))})
+			}
+			result = append(result, grafanaSeries{Target: target.Target, Datapoints: points})
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	// A metric as plain JSON for the Infinity datasource: ?metric=,
+	// ?pipeline=, ?from= and ?to= (RFC 3339 or milliseconds since the
+	// epoch, as in ${__from}) and ?interval= (1m by default)
+	router.GET("/series", func(c *gin.Context) {
+		to := time.Now()
+		from := to.Add(-24 * time.Hour)
+		for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+			if value := c.Query(name); value != "" {
+				parsed, err := parseGrafanaTime(value)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid %s %q", name, value)})
+					return
+				}
+				*t = parsed
+			}
+		}
+		interval := time.Minute
+		if value := c.Query("interval"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid interval %q", value)})
+				return
+			}
+			interval = parsed
+		}
+		series, err := engine.QueryMetric(core.MetricQuery{Metric: c.Query("metric"), PipelineID: c.Query("pipeline"), From: from, To: to, Interval: metricInterval(interval)})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, series)
+	})
+}
+
+// metricInterval rounds an interval up to a whole second, at least one
+func metricInterval(interval time.Duration) time.Duration {
+	if interval < time.Second {
+		return time.Second
+	}
+	return (interval + time.Second - 1).Truncate(time.Second)
+}
+
+// parseGrafanaTime parses an RFC 3339 time or milliseconds since the epoch
+func parseGrafanaTime(value string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,38 @@
+package routes
+
+import (
+	"github.com/chip/conveyor/i18n"
+	"github.com/gin-gonic/gin"
+)
+
+// langKey is the gin context key of the negotiated language
+const langKey = "lang"
+
+// Localize negotiates the language of human-readable strings from ?lang=
+// or Accept-Language and reports it in Content-Language
+func Localize() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		lang := i18n.Negotiate(c.Query("lang"))
+		if c.Query("lang") == "" {
+			lang = i18n.Negotiate(c.GetHeader("Accept-Language"))
+		}
+		c.Set(langKey, lang)
+		c.Header("Content-Language", lang)
+		c.Next()
+	}
+}
+
+// Lang returns the language negotiated for a request, or the default
+// outside of Localize
+func Lang(c *gin.Context) string {
+	if lang := c.GetString(langKey); lang != "" {
+		return lang
+	}
+	return i18n.Default
+}
+
+// localizedError responds with an error message in the request's language
+// and its code, which is never translated
+func localizedError(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": i18n.Sprintf(Lang(c), "error."+code, message), "code": code})
+}
@@ -0,0 +1,107 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/chip/conveyor/auth"
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+// incidentRequest declares an incident
+type incidentRequest struct {
+	Title     string `json:"title"`
+	Reference string `json:"reference"`
+	// Environments whose deploys are frozen, or all of them when empty
+	Environments []string `json:"environments"`
+}
+
+// incidentJobRequest links a job to an incident
+type incidentJobRequest struct {
+	JobID string `json:"jobId" binding:"required"`
+}
+
+// RegisterIncidentRoutes registers the routes declaring and resolving
+// incidents, which freeze deploys while active, and listing the jobs
+// linked to them for postmortems
+func RegisterIncidentRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
+	// Incidents, newest first, or only the active ones with ?active=true
+	router.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.Incidents(c.Query("active") == "true"))
+	})
+
+	router.POST("", func(c *gin.Context) {
+		var req incidentRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		incident := &core.Incident{Title: req.Title, Reference: req.Reference, Environments: req.Environments}
+		if principal := PrincipalFrom(c); principal != nil {
+			incident.DeclaredBy = principal.Name()
+		}
+		declared, err := engine.DeclareIncident(incident)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, declared)
+	})
+
+	router.GET("/:id", func(c *gin.Context) {
+		incident, err := engine.GetIncident(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, incident)
+	})
+
+	// Resolve an incident, letting the deploys it held continue
+	router.POST("/:id/resolve", func(c *gin.Context) {
+		if _, err := engine.GetIncident(c.Param("id")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		by := ""
+		if principal := PrincipalFrom(c); principal != nil {
+			by = principal.Name()
+		}
+		incident, err := engine.ResolveIncident(c.Param("id"), by)
+		if err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, incident)
+	})
+
+	// Jobs linked to an incident, of the pipelines the caller can read
+	router.GET("/:id/jobs", func(c *gin.Context) {
+		jobs, err := engine.IncidentJobs(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		visible := make([]*core.Job, 0, len(jobs))
+		for _, job := range jobs {
+			if authorized(c, auth.ActionRead, job.PipelineID) {
+				visible = append(visible, job)
+			}
+		}
+		c.JSON(http.StatusOK, visible)
+	})
+
+	// Link a job to an incident, such as the deploy that caused it
+	router.POST("/:id/jobs", func(c *gin.Context) {
+		var req incidentJobRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := engine.LinkIncidentJob(c.Param("id"), req.JobID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "linked"})
+	})
+}
@@ -1,13 +1,20 @@
 package routes
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/chip/conveyor/core"
 	"github.com/gin-gonic/gin"
 )
 
+// maxJobWait is the longest a client can long-poll a job
+const maxJobWait = 5 * time.Minute
+
 // JobPayload represents a job creation payload
 type JobPayload struct {
 	PipelineID string                 `json:"pipelineId" binding:"required"`
@@ -18,7 +25,7 @@ type JobPayload struct {
 type JobResponse struct {
 	ID         string                 `json:"id"`
 	PipelineID string                 `json:"pipelineId"`
-	Status     string                 `json:"status"`
+	Status     core.Status            `json:"status"`
 	StartedAt  time.Time              `json:"startedAt"`
 	EndedAt    time.Time              `json:"endedAt,omitempty"`
 	Steps      []core.StepStatus      `json:"steps,omitempty"`
@@ -29,9 +36,28 @@ type JobResponse struct {
 // RegisterJobRoutes registers job routes
 func RegisterJobRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
 	router.POST("", createJob(engine))
+	router.GET("/statuses", getStatuses())
+	router.GET("/concurrency", getConcurrencyGroups(engine))
+	router.GET("/queue", getJobQueue(engine))
+	router.GET("/comments", searchComments(engine))
 	router.GET("/:id", getJob(engine))
+	router.GET("/:id/timeline", getJobTimeline(engine))
+	router.GET("/:id/events", getJobEvents(engine))
+	router.GET("/:id/cost", getJobCost(engine))
+	router.GET("/:id/annotations", getJobAnnotations(engine))
+	router.GET("/:id/tests", getJobTestReports(engine))
+	router.GET("/:id/debug", getJobDebugSessions(engine))
 	router.POST("/:id/retry", retryJob(engine))
 	router.POST("/:id/cancel", cancelJob(engine))
+	router.GET("/:id/steps/:stepId/output", getStepOutput(engine))
+	router.POST("/:id/steps/:stepId/replay", replayStep(engine))
+	router.GET("/:id/artifacts", getJobArtifacts(engine))
+	router.GET("/:id/artifacts/:name", downloadArtifact(engine))
+	router.POST("/:id/promote", promoteJob(engine))
+	router.PUT("/:id/hold", setLegalHold(engine))
+	router.DELETE("/:id/hold", releaseLegalHold(engine))
+	router.POST("/:id/comments", addComment(engine))
+	router.DELETE("/:id/comments/:commentId", deleteComment(engine))
 }
 
 // createJob creates a new job
@@ -42,47 +68,155 @@ func createJob(engine *core.PipelineEngine) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		
+
 		// In a real implementation, we would validate the pipeline ID and create a job
 		// For now, just return a placeholder
 		c.JSON(http.StatusAccepted, gin.H{
 			"id":         "job-" + time.Now().Format("20060102150405"),
 			"pipelineId": payload.PipelineID,
-			"status":     "pending",
+			"status":     core.StatusPending,
 			"startedAt":  time.Now(),
 		})
 	}
 }
 
-// getJob retrieves a job by ID
+// getStatuses describes the job status state machine
+func getStatuses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		statuses := make([]gin.H, 0, len(core.Statuses()))
+		for _, status := range core.Statuses() {
+			statuses = append(statuses, gin.H{
+				"status":      status,
+				"terminal":    status.IsTerminal(),
+				"transitions": status.AllowedTransitions(),
+			})
+		}
+
+		c.JSON(http.StatusOK, statuses)
+	}
+}
+
+// getJob returns a job. With ?wait=60s, it long-polls until the job meets
+// ?until=, by default completed, or the wait elapses, and sets
+// X-Conveyor-Condition-Met to whether the job met it.
 func getJob(engine *core.PipelineEngine) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id := c.Param("id")
-		pipelineID := c.DefaultQuery("pipelineId", "")
-		
-		// In a real implementation, we would validate the IDs and get the job
-		// For now, just return a placeholder
-		c.JSON(http.StatusOK, gin.H{
-			"id":         id,
-			"pipelineId": pipelineID,
-			"status":     "running",
-			"startedAt":  time.Now().Add(-5 * time.Minute),
-			"steps": []gin.H{
-				{
-					"id":        "step-1",
-					"name":      "Build",
-					"status":    "success",
-					"startedAt": time.Now().Add(-5 * time.Minute),
-					"endedAt":   time.Now().Add(-4 * time.Minute),
-				},
-				{
-					"id":        "step-2",
-					"name":      "Test",
-					"status":    "running",
-					"startedAt": time.Now().Add(-3 * time.Minute),
-				},
-			},
-		})
+		if pipelineID := c.Query("pipelineId"); pipelineID != "" {
+			if _, err := engine.GetJob(pipelineID, id); err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		wait := c.Query("wait")
+		if wait == "" {
+			job, err := engine.JobSnapshot(id)
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, job)
+			return
+		}
+
+		timeout, err := time.ParseDuration(wait)
+		if err != nil || timeout <= 0 || timeout > maxJobWait {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("wait must be a duration up to %s", maxJobWait)})
+			return
+		}
+		cond, err := core.ParseJobCondition(c.Query("until"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		job, met, err := engine.WaitJob(ctx, id, cond)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("X-Conveyor-Condition-Met", strconv.FormatBool(met))
+		c.JSON(http.StatusOK, job)
+	}
+}
+
+// getJobTimeline breaks down where a job spent its time
+func getJobTimeline(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timeline, err := engine.JobTimeline(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, timeline)
+	}
+}
+
+// getJobEvents returns the events of a job, as engine events or, with
+// ?format=cloudevents, as a batch of CloudEvents
+func getJobEvents(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format := c.DefaultQuery("format", "native")
+		if format != "native" && format != "cloudevents" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be native or cloudevents"})
+			return
+		}
+		events, err := engine.JobEvents(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		if format == "cloudevents" {
+			c.Header("Content-Type", core.CloudEventsBatchContentType)
+			c.JSON(http.StatusOK, core.NewCloudEvents(events))
+			return
+		}
+		c.JSON(http.StatusOK, events)
+	}
+}
+
+// getJobCost returns the estimated cost of a job
+func getJobCost(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cost, err := engine.JobCost(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, cost)
+	}
+}
+
+// getJobAnnotations returns the problems the job's steps found in the
+// source, such as linter violations
+func getJobAnnotations(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		annotations, err := engine.JobAnnotations(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, annotations)
+	}
+}
+
+// getJobTestReports returns the test reports of the job's steps
+func getJobTestReports(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		reports, err := engine.JobTestReports(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, reports)
 	}
 }
 
@@ -91,13 +225,13 @@ func retryJob(engine *core.PipelineEngine) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id := c.Param("id")
 		pipelineID := c.DefaultQuery("pipelineId", "")
-		
+
 		// In a real implementation, we would validate the IDs and retry the job
 		// For now, just return a placeholder
 		c.JSON(http.StatusAccepted, gin.H{
 			"id":         "job-" + time.Now().Format("20060102150405"),
 			"pipelineId": pipelineID,
-			"status":     "pending",
+			"status":     core.StatusPending,
 			"startedAt":  time.Now(),
 			"metadata": gin.H{
 				"retryOf": id,
@@ -106,20 +240,58 @@ func retryJob(engine *core.PipelineEngine) gin.HandlerFunc {
 	}
 }
 
-// cancelJob cancels a job
+// cancelJob cancels a pending or running job
 func cancelJob(engine *core.PipelineEngine) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id := c.Param("id")
-		pipelineID := c.DefaultQuery("pipelineId", "")
-		
-		// In a real implementation, we would validate the IDs and cancel the job
-		// For now, just return a placeholder
-		c.JSON(http.StatusOK, gin.H{
-			"id":         id,
-			"pipelineId": pipelineID,
-			"status":     "cancelled",
-			"startedAt":  time.Now().Add(-5 * time.Minute),
-			"endedAt":    time.Now(),
-		})
+		job, err := engine.FindJob(id)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err := engine.CancelJob(job.PipelineID, id); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"status": "cancelling", "jobId": id})
 	}
-} 
\ No newline at end of file
+}
+
+// replayStep re-executes a recorded step of a job in isolation
+func replayStep(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if _, err := engine.FindJob(id); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		replay, err := engine.ReplayStep(c.Request.Context(), id, c.Param("stepId"))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, core.ErrStepNotRecorded) {
+				status = http.StatusNotFound
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, replay)
+	}
+}
+
+// getJobQueue reports the limit on jobs running at once and the jobs
+// waiting for it
+func getJobQueue(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.JobQueue())
+	}
+}
+
+// getConcurrencyGroups lists the concurrency groups with a running or
+// pending job
+func getConcurrencyGroups(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.ConcurrencyGroups())
+	}
+}
@@ -0,0 +1,22 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterLockRoutes registers the routes reporting the named locks steps
+// hold on external resources and the steps waiting for them
+func RegisterLockRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
+	// Locks that are held or waited for
+	router.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.Locks())
+	})
+
+	// A lock's holder and queue; free locks have neither
+	router.GET("/:name", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.Lock(c.Param("name")))
+	})
+}
@@ -0,0 +1,91 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultMaintenanceHorizon is how far ahead upcoming maintenance periods
+// are listed without ?until=
+const defaultMaintenanceHorizon = 7 * 24 * time.Hour
+
+// RegisterMaintenanceRoutes registers the routes managing maintenance
+// windows and the scheduled and webhook triggers they hold
+func RegisterMaintenanceRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
+	// Maintenance windows, of one pipeline and the global ones with
+	// ?pipeline=
+	router.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.MaintenanceWindows(c.Query("pipeline")))
+	})
+
+	router.POST("", func(c *gin.Context) {
+		var window core.MaintenanceWindow
+		if err := c.ShouldBindJSON(&window); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		created, err := engine.CreateMaintenanceWindow(&window)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, created)
+	})
+
+	router.DELETE("/:id", func(c *gin.Context) {
+		if err := engine.DeleteMaintenanceWindow(c.Param("id")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	})
+
+	// Maintenance periods open now or starting before ?until= (RFC 3339,
+	// a week ahead by default), filtered by ?pipeline=
+	router.GET("/upcoming", func(c *gin.Context) {
+		now := time.Now()
+		until := now.Add(defaultMaintenanceHorizon)
+		if value := c.Query("until"); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "until must be an RFC 3339 time"})
+				return
+			}
+			until = parsed
+		}
+		c.JSON(http.StatusOK, engine.UpcomingMaintenance(c.Query("pipeline"), now, until))
+	})
+
+	// Triggers held by maintenance windows, filtered by ?pipeline=
+	router.GET("/held", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.HeldTriggers(c.Query("pipeline")))
+	})
+
+	// Start held triggers of pipelines out of maintenance, or all of them
+	// with ?force=true, filtered by ?pipeline=
+	router.POST("/held/flush", func(c *gin.Context) {
+		jobs, err := engine.FlushHeldTriggers(context.Background(), c.Query("pipeline"), c.Query("force") == "true")
+		ids := make([]string, 0, len(jobs))
+		for _, job := range jobs {
+			ids = append(ids, job.ID)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "jobIds": ids})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "flushed", "jobIds": ids})
+	})
+
+	// Drop a held trigger without running it
+	router.DELETE("/held/:id", func(c *gin.Context) {
+		if err := engine.DiscardHeldTrigger(c.Param("id")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "discarded"})
+	})
+}
@@ -0,0 +1,53 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterNotificationRoutes registers the route testing notification
+// conditions against past jobs
+func RegisterNotificationRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
+	// Dry-evaluate a condition against the jobs that finished within since,
+	// 7d by default, of one pipeline when pipelineId is set
+	router.POST("/evaluate", func(c *gin.Context) {
+		var req struct {
+			When       string `json:"when"`
+			PipelineID string `json:"pipelineId"`
+			Since      string `json:"since"`
+			Limit      int    `json:"limit"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		since := 7 * 24 * time.Hour
+		if req.Since != "" {
+			parsed, err := core.ParseDuration(req.Since)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			since = parsed
+		}
+		if req.Limit <= 0 {
+			req.Limit = 100
+		}
+
+		jobs, err := engine.ConditionMatches(req.When, req.PipelineID, time.Now().Add(-since), req.Limit)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		matched := 0
+		for _, job := range jobs {
+			if job.Matched {
+				matched++
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"evaluated": len(jobs), "matched": matched, "jobs": jobs})
+	})
+}
@@ -0,0 +1,79 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+// getStepOutput returns the raw output of a step. Clients accepting JSON get
+// the output as UTF-8 text, or base64 encoded when it isn't valid text;
+// everyone else gets the bytes with a content type for text or binary
+// output. ?download=true serves it as an attachment.
+func getStepOutput(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		jobID, stepID := c.Param("id"), c.Param("stepId")
+		output, err := engine.StepOutput(jobID, stepID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		if c.NegotiateFormat(gin.MIMEPlain, "application/octet-stream", gin.MIMEJSON) == gin.MIMEJSON {
+			var buf bytes.Buffer
+			if err := engine.WriteStepOutput(jobID, stepID, &buf); err != nil {
+				c.JSON(stepOutputStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			content, encoding := buf.String(), "utf-8"
+			if output.Binary || !utf8.Valid(buf.Bytes()) {
+				content, encoding = base64.StdEncoding.EncodeToString(buf.Bytes()), "base64"
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"jobId":    jobID,
+				"stepId":   stepID,
+				"binary":   output.Binary,
+				"size":     buf.Len(),
+				"encoding": encoding,
+				"content":  content,
+			})
+			return
+		}
+
+		contentType, ext := "text/plain; charset=utf-8", ".log"
+		if output.Binary {
+			contentType, ext = "application/octet-stream", ".bin"
+		} else if output.Sanitized {
+			contentType = "text/plain"
+		}
+		c.Header("Content-Type", contentType)
+		c.Header("X-Content-Type-Options", "nosniff")
+		if c.Query("download") == "true" {
+			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", jobID+"-"+stepID+ext))
+		}
+		if err := engine.WriteStepOutput(jobID, stepID, c.Writer); err != nil {
+			if c.Writer.Written() {
+				c.Error(err)
+				return
+			}
+			c.Writer.Header().Del("Content-Type")
+			c.Writer.Header().Del("Content-Disposition")
+			c.JSON(stepOutputStatus(err), gin.H{"error": err.Error()})
+		}
+	}
+}
+
+// stepOutputStatus returns the response status for an error reading step
+// output
+func stepOutputStatus(err error) int {
+	if errors.Is(err, core.ErrStepOutputNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
@@ -1,31 +1,107 @@
 package routes
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/chip/conveyor/auth"
 	"github.com/chip/conveyor/core"
 	"github.com/gin-gonic/gin"
 )
 
+// executeRequest is the optional body of a pipeline execution
+type executeRequest struct {
+	// Trigger describes what triggered the run, such as {"pr": "42"}
+	Trigger map[string]string `json:"trigger"`
+	// Revision is the code the run is for
+	Revision *core.Revision `json:"revision"`
+	// Source is manual, schedule or webhook. Scheduled and webhook runs are
+	// held during maintenance windows, and webhook runs are debounced by
+	// triggers that set a debounce window.
+	Source string `json:"source"`
+}
+
+// jobFilter reads the ?repo=, ?branch=, ?commit=, ?author= and ?pr= filters
+// of a job listing
+func jobFilter(c *gin.Context) (core.JobFilter, error) {
+	filter := core.JobFilter{
+		Repo:   c.Query("repo"),
+		Branch: c.Query("branch"),
+		Commit: c.Query("commit"),
+		Author: c.Query("author"),
+	}
+	if pr := c.Query("pr"); pr != "" {
+		n, err := strconv.Atoi(pr)
+		if err != nil || n <= 0 {
+			return filter, fmt.Errorf("invalid pull request number %q", pr)
+		}
+		filter.PullRequest = n
+	}
+	return filter, nil
+}
+
+// asOf reads the ?asOf= time of a listing of past state. ok is false
+// without one.
+func asOf(c *gin.Context) (at time.Time, ok bool, err error) {
+	value := c.Query("asOf")
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+	at, err = time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid asOf time %q, want RFC 3339", value)
+	}
+	return at, true, nil
+}
+
 // RegisterPipelineRoutes registers all pipeline-related routes
 func RegisterPipelineRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
-	// Get all pipelines
+	// Get all pipelines, or the pipelines as they were ?asOf= a time
 	router.GET("", func(c *gin.Context) {
+		at, past, err := asOf(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if past {
+			pipelines, err := engine.PipelinesAsOf(at)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, pipelines)
+			return
+		}
+
 		pipelines := engine.ListPipelines()
 		c.JSON(http.StatusOK, pipelines)
 	})
 
-	// Get a single pipeline
+	// Get a single pipeline, optionally as it was ?asOf= a time
 	router.GET("/:id", func(c *gin.Context) {
 		id := c.Param("id")
-		pipeline, err := engine.GetPipeline(id)
+		at, past, err := asOf(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var pipeline *core.Pipeline
+		if past {
+			pipeline, err = engine.PipelineAsOf(id, at)
+		} else {
+			pipeline, err = engine.GetPipeline(id)
+		}
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			return
 		}
-		
+
 		c.JSON(http.StatusOK, pipeline)
 	})
 
@@ -36,61 +112,61 @@ func RegisterPipelineRoutes(router *gin.RouterGroup, engine *core.PipelineEngine
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		
+
 		now := time.Now()
 		pipeline.CreatedAt = now
 		pipeline.UpdatedAt = now
-		
+
 		err := engine.CreatePipeline(&pipeline)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		
+
 		c.JSON(http.StatusCreated, pipeline)
 	})
 
 	// Update a pipeline
 	router.PUT("/:id", func(c *gin.Context) {
 		id := c.Param("id")
-		
+
 		var pipeline core.Pipeline
 		if err := c.ShouldBindJSON(&pipeline); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		
+
 		// Ensure the ID matches
 		if pipeline.ID != id {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "pipeline ID in URL does not match payload"})
 			return
 		}
-		
+
 		// Get the existing pipeline
 		existing, err := engine.GetPipeline(id)
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			return
 		}
-		
+
 		// Delete the old pipeline
 		err = engine.DeletePipeline(id)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		
+
 		// Preserve creation time
 		pipeline.CreatedAt = existing.CreatedAt
 		pipeline.UpdatedAt = time.Now()
-		
+
 		// Create the updated pipeline
 		err = engine.CreatePipeline(&pipeline)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		
+
 		c.JSON(http.StatusOK, pipeline)
 	})
 
@@ -102,60 +178,328 @@ func RegisterPipelineRoutes(router *gin.RouterGroup, engine *core.PipelineEngine
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			return
 		}
-		
+
 		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
 	})
 
-	// Execute a pipeline
+	// Execute a pipeline. ?noCache=true runs memoized steps even if their
+	// inputs are unchanged. An optional body of {"trigger": {...},
+	// "revision": {...}, "source": "webhook"} records what triggered the run
+	// and the code it is for. Scheduled and webhook runs during a
+	// maintenance window are held instead. Admins can run outside the
+	// pipeline's budget with ?overrideBudget=true.
 	router.POST("/:id/execute", func(c *gin.Context) {
 		id := c.Param("id")
-		err := engine.ExecutePipeline(id)
+
+		opts, ok := budgetOverride(c, id)
+		if !ok {
+			return
+		}
+		if c.Query("noCache") == "true" {
+			opts = append(opts, core.WithoutCache())
+		}
+		if value := c.Query("debugOnFailure"); value != "" {
+			ttl, err := core.ParseDebugTTL(value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			opts = append(opts, core.WithDebugOnFailure(ttl))
+		}
+		if c.Request.ContentLength > 0 {
+			var req executeRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			opts = append(opts, core.WithTrigger(req.Trigger))
+			if req.Revision != nil {
+				opts = append(opts, core.WithRevision(*req.Revision))
+			}
+			switch req.Source {
+			case "", core.TriggerManual, core.TriggerSchedule, core.TriggerWebhook:
+				opts = append(opts, core.WithSource(req.Source))
+			default:
+				c.JSON(http.StatusBadRequest, gin.H{"error": "source must be manual, schedule or webhook"})
+				return
+			}
+		}
+
+		if principal := PrincipalFrom(c); principal != nil {
+			opts = append(opts, core.WithTriggeredBy(principal.Name()))
+		}
+
+		job, held, err := engine.Dispatch(context.Background(), id, opts...)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		
-		c.JSON(http.StatusAccepted, gin.H{"status": "executing"})
+		if held != nil && held.Until != nil {
+			c.JSON(http.StatusAccepted, gin.H{"status": "debounced", "triggerId": held.ID, "until": held.Until, "skipped": held.Skipped})
+			return
+		}
+		if held != nil {
+			c.JSON(http.StatusAccepted, gin.H{"status": "held", "triggerId": held.ID, "windowId": held.WindowID})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"status": "executing", "jobId": job.ID})
+	})
+
+	// Run a pipeline for a range of commits, {"from": ..., "to": ...} or
+	// {"commits": [...]}, or for a schedule pipeline for the times its cron
+	// fired, {"since": ..., "until": ...}, "concurrency" jobs at a time
+	router.POST("/:id/backfill", func(c *gin.Context) {
+		var req core.BackfillRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var createdBy string
+		if principal := PrincipalFrom(c); principal != nil {
+			createdBy = principal.Name()
+		}
+
+		id := c.Param("id")
+		if _, err := engine.GetPipeline(id); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		backfill, err := engine.StartBackfill(id, req, createdBy)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, backfill)
+	})
+
+	// List the backfills of a pipeline, newest first
+	router.GET("/:id/backfill", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.Backfills(c.Param("id")))
+	})
+
+	// Get the progress of a backfill
+	router.GET("/:id/backfill/:backfillId", func(c *gin.Context) {
+		backfill, err := engine.GetBackfill(c.Param("id"), c.Param("backfillId"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, backfill)
+	})
+
+	// Cancel the runs of a backfill that haven't started
+	router.POST("/:id/backfill/:backfillId/cancel", func(c *gin.Context) {
+		backfill, err := engine.CancelBackfill(c.Param("id"), c.Param("backfillId"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, backfill)
+	})
+
+	// Try redaction patterns on sample text: {"text": ..., "patterns": [...]}
+	// applies the patterns given, and without them the pipeline's, and the
+	// patterns of "step" when set
+	router.POST("/:id/redactions/test", func(c *gin.Context) {
+		var req struct {
+			Text     string   `json:"text"`
+			Patterns []string `json:"patterns"`
+			Step     string   `json:"step"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		id := c.Param("id")
+		if _, err := engine.GetPipeline(id); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		test, err := engine.TestRedactions(id, req.Step, req.Patterns, req.Text)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, test)
+	})
+
+	// Clear memoized step results so the next run executes every step
+	router.DELETE("/:id/cache", func(c *gin.Context) {
+		id := c.Param("id")
+		removed, err := engine.ClearCache(id)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "cleared", "removed": removed})
+	})
+
+	// Delete the idle warm workspaces of a pipeline
+	router.DELETE("/:id/workspaces", func(c *gin.Context) {
+		id := c.Param("id")
+		if _, err := engine.GetPipeline(id); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "cleared", "removed": engine.ClearWorkspaces(id)})
+	})
+
+	// Get the versions of a pipeline's definition
+	router.GET("/:id/versions", func(c *gin.Context) {
+		versions, err := engine.PipelineVersions(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, versions)
+	})
+
+	// Get a pipeline's readme and on-call information, optionally as they
+	// were ?asOf= a time, and rendered as a page with ?format=html
+	router.GET("/:id/readme", func(c *gin.Context) {
+		id := c.Param("id")
+		at, past, err := asOf(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var pipeline *core.Pipeline
+		if past {
+			pipeline, err = engine.PipelineAsOf(id, at)
+		} else {
+			pipeline, err = engine.GetPipeline(id)
+		}
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		readme := core.ReadmeOf(pipeline)
+		switch c.Query("format") {
+		case "", "json":
+			c.JSON(http.StatusOK, readme)
+		case "html":
+			c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(readme.HTML(pipeline.Name)))
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or html"})
+		}
+	})
+
+	// Replace a pipeline's readme and on-call information, recording a new
+	// version of the pipeline
+	router.PUT("/:id/readme", func(c *gin.Context) {
+		var req struct {
+			Readme string             `json:"readme"`
+			Info   *core.PipelineInfo `json:"info"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if _, err := engine.GetPipeline(c.Param("id")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		pipeline, err := engine.SetPipelineReadme(c.Param("id"), req.Readme, req.Info)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, core.ReadmeOf(pipeline))
 	})
 
-	// Get pipeline jobs
+	// Get pipeline jobs, optionally filtered by revision or as they were
+	// ?asOf= a time
 	router.GET("/:id/jobs", func(c *gin.Context) {
 		id := c.Param("id")
-		jobs, err := engine.ListJobs(id)
+		filter, err := jobFilter(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		at, past, err := asOf(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var jobs []*core.Job
+		if past {
+			jobs, err = engine.JobsAsOf(id, at)
+		} else {
+			jobs, err = engine.ListJobs(id)
+		}
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			return
 		}
-		
-		c.JSON(http.StatusOK, jobs)
+
+		matched := make([]*core.Job, 0, len(jobs))
+		for _, job := range jobs {
+			if filter.Match(job) {
+				matched = append(matched, job)
+			}
+		}
+		c.JSON(http.StatusOK, matched)
 	})
 
 	// Get a specific job
 	router.GET("/:id/jobs/:jobId", func(c *gin.Context) {
 		pipelineID := c.Param("id")
 		jobID := c.Param("jobId")
-		
+
 		job, err := engine.GetJob(pipelineID, jobID)
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			return
 		}
-		
+
 		c.JSON(http.StatusOK, job)
 	})
 
-	// Retry a job
+	// Retry a job. Retries over the pipeline's daily budget are refused
+	// unless an admin passes ?overrideBudget=true.
 	router.POST("/:id/jobs/:jobId/retry", func(c *gin.Context) {
 		pipelineID := c.Param("id")
 		jobID := c.Param("jobId")
 
-		err := engine.RetryJob(pipelineID, jobID)
+		opts, ok := budgetOverride(c, pipelineID)
+		if !ok {
+			return
+		}
+		job, err := engine.Retry(context.Background(), pipelineID, jobID, opts...)
+		if errors.Is(err, core.ErrBudgetExceeded) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			return
 		}
 
-		c.JSON(http.StatusAccepted, gin.H{"status": "retrying"})
+		c.JSON(http.StatusAccepted, gin.H{"status": "retrying", "jobId": job.ID})
+	})
+
+	// Cancel a job
+	router.POST("/:id/jobs/:jobId/cancel", func(c *gin.Context) {
+		pipelineID := c.Param("id")
+		jobID := c.Param("jobId")
+
+		if _, err := engine.GetJob(pipelineID, jobID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err := engine.CancelJob(pipelineID, jobID); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"status": "cancelling", "jobId": jobID})
 	})
 }
 
@@ -187,4 +531,22 @@ func RegisterPipelineImportRoute(router *gin.RouterGroup, pipelineLoader interfa
 			"warnings": warnings,
 		})
 	})
-} 
\ No newline at end of file
+}
+
+// budgetOverride returns the option running a job outside its pipeline's
+// budget when the request asks for it with ?overrideBudget=true, which
+// only admins may. It responds with 403 and returns false otherwise.
+func budgetOverride(c *gin.Context, pipelineID string) ([]core.RunOption, bool) {
+	if c.Query("overrideBudget") != "true" {
+		return nil, true
+	}
+	by := "api"
+	if principal := PrincipalFrom(c); principal != nil {
+		if !authorized(c, auth.ActionAdmin, pipelineID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only admins can override the pipeline's budget"})
+			return nil, false
+		}
+		by = principal.Name()
+	}
+	return []core.RunOption{core.WithBudgetOverride(by)}, true
+}
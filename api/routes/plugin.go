@@ -1,14 +1,28 @@
 package routes
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/chip/conveyor/core"
 	"github.com/gin-gonic/gin"
 )
 
-// RegisterPluginRoutes registers all plugin-related routes
-func RegisterPluginRoutes(router *gin.RouterGroup) {
+// PluginSource is where plugins are installed from. With a Mirror, plugins
+// are installed from its <name>/manifest.json; offline servers without one
+// can't install plugins.
+type PluginSource struct {
+	Offline bool
+	Mirror  string
+}
+
+// RegisterPluginRoutes registers all plugin-related routes. source may be
+// nil to install plugins from the public registry.
+func RegisterPluginRoutes(router *gin.RouterGroup, source *PluginSource) {
 	// Get all plugins
 	router.GET("", func(c *gin.Context) {
 		// This would load from a plugin registry in a real implementation
@@ -131,6 +145,29 @@ func RegisterPluginRoutes(router *gin.RouterGroup) {
 	// Install a plugin
 	router.POST("/:name/install", func(c *gin.Context) {
 		name := c.Param("name")
+		if source != nil && (source.Offline || source.Mirror != "") {
+			manifest, err := source.mirrored(name)
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			if _, err := core.NegotiatePluginProtocol(manifest); err != nil {
+				c.JSON(http.StatusUpgradeRequired, gin.H{"error": err.Error(), "pluginProtocols": core.ProtocolRange{Min: core.MinPluginProtocol, Current: core.PluginProtocol}})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"name":        manifest.Name,
+				"version":     manifest.Version,
+				"description": manifest.Description,
+				"author":      manifest.Author,
+				"protocol":    manifest.Protocol,
+				"installed":   true,
+				"enabled":     true,
+				"source":      "mirror",
+				"installedAt": time.Now().Format(time.RFC3339),
+			})
+			return
+		}
 
 		// In a real implementation, this would install a plugin
 		// For now, we'll return a mock response
@@ -214,4 +251,26 @@ func RegisterPluginRoutes(router *gin.RouterGroup) {
 
 		c.JSON(http.StatusOK, settings)
 	})
-} 
\ No newline at end of file
+}
+
+// mirrored reads the manifest of a plugin in the mirror
+func (s *PluginSource) mirrored(name string) (core.PluginManifest, error) {
+	var manifest core.PluginManifest
+	if s.Mirror == "" {
+		return manifest, fmt.Errorf("offline mode only installs plugins from a local mirror, and none is configured")
+	}
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return manifest, fmt.Errorf("invalid plugin name %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(s.Mirror, name, "manifest.json"))
+	if err != nil {
+		return manifest, fmt.Errorf("plugin %s is not in the local mirror", name)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid manifest of plugin %s in the local mirror: %w", name, err)
+	}
+	if manifest.Name == "" {
+		manifest.Name = name
+	}
+	return manifest, nil
+}
@@ -0,0 +1,38 @@
+package routes
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readOnlyQueries are the POST routes that only read, such as Grafana
+// queries, and stay available on read-only servers
+var readOnlyQueries = []string{"/grafana/search", "/grafana/query", "/notifications/evaluate"}
+
+// ReadOnlyServer rejects every request that would change something on a
+// server in read-only observer mode, which shares the data directory of
+// the server that runs the jobs
+func ReadOnlyServer() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			c.Next()
+			return
+		}
+
+		path := c.FullPath()
+		for _, query := range readOnlyQueries {
+			if strings.HasSuffix(path, query) {
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": "the server is in read-only observer mode; make changes on the server that runs the jobs",
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterReleaseRoutes registers the routes reading promoted releases.
+// Releases are created with POST /api/jobs/:id/promote and can't be
+// changed or deleted.
+func RegisterReleaseRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
+	router.GET("", func(c *gin.Context) {
+		releases, err := engine.Releases()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, releases)
+	})
+
+	router.GET("/:name", func(c *gin.Context) {
+		release, err := engine.GetRelease(c.Param("name"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, release)
+	})
+
+	// Check that the release's artifacts are unchanged since promotion
+	router.GET("/:name/verify", func(c *gin.Context) {
+		release, err := engine.GetRelease(c.Param("name"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err := engine.VerifyRelease(release); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"verified": false, "error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"verified": true})
+	})
+
+	// Download a verified artifact of the release as a gzipped tarball
+	router.GET("/:name/artifacts/:artifact", func(c *gin.Context) {
+		name, artifactName := c.Param("name"), c.Param("artifact")
+		release, err := engine.GetRelease(name)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err := engine.VerifyRelease(release); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Header("Content-Type", "application/gzip")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"-"+artifactName+".tar.gz"))
+		if err := engine.ArchiveReleaseArtifact(name, artifactName, c.Writer); err != nil {
+			c.Error(err)
+		}
+	})
+}
+
+// promoteJob promotes a job's artifacts as an immutable release
+func promoteJob(engine *core.PipelineEngine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req core.PromoteRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if _, err := engine.FindJob(c.Param("id")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if principal := PrincipalFrom(c); principal != nil {
+			req.By = principal.Name()
+		}
+
+		release, err := engine.Promote(c.Param("id"), req)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, core.ErrReleaseExists) {
+				status = http.StatusConflict
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, release)
+	}
+}
@@ -0,0 +1,67 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterReportRoutes registers the routes reporting estimated job costs,
+// step output truncation, load test trends, failure classes, infrastructure
+// failures and disk quotas
+func RegisterReportRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
+	// Estimated costs per pipeline, team and month, filtered by ?pipeline=,
+	// ?team= and ?month=2006-01
+	router.GET("/costs", func(c *gin.Context) {
+		filter := core.CostFilter{
+			PipelineID: c.Query("pipeline"),
+			Team:       c.Query("team"),
+			Month:      c.Query("month"),
+		}
+		if filter.Month != "" {
+			if _, err := time.Parse("2006-01", filter.Month); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "month must be in the form YYYY-MM"})
+				return
+			}
+		}
+		c.JSON(http.StatusOK, engine.CostReport(filter))
+	})
+
+	// How often step output was truncated per pipeline since startup
+	router.GET("/output", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.OutputStats())
+	})
+
+	// Step duration baselines and the anomalies flagged against them since
+	// startup, filtered by ?pipeline=
+	router.GET("/durations", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.DurationStats(c.Query("pipeline")))
+	})
+
+	// Load test metrics of the jobs' steps, oldest first, filtered by
+	// ?pipeline= and ?step=
+	router.GET("/load-tests", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.LoadTestTrend(c.Query("pipeline"), c.Query("step")))
+	})
+
+	// Failed steps per failure class, warnings, skips and retries per
+	// pipeline, filtered by ?pipeline=
+	router.GET("/failures", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.FailureStats(c.Query("pipeline")))
+	})
+
+	// Infrastructure failures, re-dispatches and their outcomes per pipeline
+	// since startup, filtered by ?pipeline=
+	router.GET("/infrastructure", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.InfraStats(c.Query("pipeline")))
+	})
+
+	// Steps stopped over their job's disk quota or the server's disk
+	// reserve, and peak job disk usage per pipeline since startup,
+	// filtered by ?pipeline=
+	router.GET("/disk", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.DiskStats(c.Query("pipeline")))
+	})
+}
@@ -0,0 +1,30 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterRunnerRoutes registers the routes reporting runners, the
+// capacity available per label, the steps queued for them and autoscaling
+func RegisterRunnerRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
+	// Runners with their labels and running steps, and capacity per label
+	router.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"runners": engine.Runners(),
+			"labels":  engine.LabelCapacities(),
+		})
+	})
+
+	// Queue policy and the waiting steps and wait times of every project
+	router.GET("/queue", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.Queue())
+	})
+
+	// Autoscaling policy, recommended capacity and recent scaling signals
+	router.GET("/scaling", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.ScalingStatus())
+	})
+}
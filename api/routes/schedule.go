@@ -0,0 +1,48 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultCalendarRange is the span of a calendar without ?to=
+	defaultCalendarRange = 7 * 24 * time.Hour
+	// maxCalendarRange bounds the span of a calendar
+	maxCalendarRange = 93 * 24 * time.Hour
+)
+
+// RegisterScheduleRoutes registers the routes forecasting scheduled runs
+func RegisterScheduleRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
+	// Scheduled runs between ?from= and ?to= (RFC 3339, from now for a week
+	// by default) with maintenance holds, concurrency queuing and overlaps,
+	// and the density of jobs that already ran, filtered by ?pipeline=
+	router.GET("/calendar", func(c *gin.Context) {
+		from := time.Now()
+		if value := c.Query("from"); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 time"})
+				return
+			}
+			from = parsed
+		}
+		to := from.Add(defaultCalendarRange)
+		if value := c.Query("to"); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "to must be an RFC 3339 time"})
+				return
+			}
+			to = parsed
+		}
+		if !to.After(from) || to.Sub(from) > maxCalendarRange {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be after from and at most 93 days later"})
+			return
+		}
+		c.JSON(http.StatusOK, engine.ScheduleCalendar(c.Query("pipeline"), from, to))
+	})
+}
@@ -0,0 +1,225 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/chip/conveyor/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// scimContentType is the media type of SCIM requests and responses
+const scimContentType = "application/scim+json"
+
+// RegisterSCIMRoutes registers SCIM 2.0 Users and Groups endpoints so an
+// identity provider can keep users, teams and membership in sync. Requests
+// must carry the configured bearer token.
+func RegisterSCIMRoutes(router *gin.RouterGroup, dir *auth.Directory, token string) {
+	scim := auth.NewSCIM(dir)
+	router.Use(func(c *gin.Context) {
+		c.Header("Content-Type", scimContentType)
+		if !auth.TokenEqual(auth.BearerToken(c.GetHeader("Authorization")), token) {
+			scimError(c, auth.NewSCIMError(http.StatusUnauthorized, "", "invalid bearer token"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	})
+
+	router.GET("/ServiceProviderConfig", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"schemas":        []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+			"patch":          gin.H{"supported": true},
+			"bulk":           gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+			"filter":         gin.H{"supported": true, "maxResults": 1000},
+			"changePassword": gin.H{"supported": false},
+			"sort":           gin.H{"supported": false},
+			"etag":           gin.H{"supported": false},
+			"authenticationSchemes": []gin.H{{
+				"type":        "oauthbearertoken",
+				"name":        "Bearer Token",
+				"description": "Authentication with the configured SCIM token",
+			}},
+		})
+	})
+
+	router.GET("/ResourceTypes", func(c *gin.Context) {
+		c.JSON(http.StatusOK, []gin.H{
+			{"schemas": []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"}, "id": "User", "name": "User", "endpoint": "/Users", "schema": auth.SchemaUser},
+			{"schemas": []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"}, "id": "Group", "name": "Group", "endpoint": "/Groups", "schema": auth.SchemaGroup},
+		})
+	})
+
+	users := router.Group("/Users")
+	users.GET("", func(c *gin.Context) {
+		startIndex, count := scimPage(c)
+		list, err := scim.ListUsers(c.Query("filter"), startIndex, count, scimBaseURL(c, router))
+		if err != nil {
+			scimError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	users.GET("/:id", func(c *gin.Context) {
+		user, err := scim.GetUser(c.Param("id"), scimBaseURL(c, router))
+		if err != nil {
+			scimError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, user)
+	})
+
+	users.POST("", func(c *gin.Context) {
+		var resource auth.SCIMUser
+		if err := c.ShouldBindJSON(&resource); err != nil {
+			scimError(c, auth.NewSCIMError(http.StatusBadRequest, "invalidSyntax", err.Error()))
+			return
+		}
+		user, err := scim.CreateUser(resource, scimBaseURL(c, router))
+		if err != nil {
+			scimError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, user)
+	})
+
+	users.PUT("/:id", func(c *gin.Context) {
+		var resource auth.SCIMUser
+		if err := c.ShouldBindJSON(&resource); err != nil {
+			scimError(c, auth.NewSCIMError(http.StatusBadRequest, "invalidSyntax", err.Error()))
+			return
+		}
+		user, err := scim.ReplaceUser(c.Param("id"), resource, scimBaseURL(c, router))
+		if err != nil {
+			scimError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, user)
+	})
+
+	// Identity providers deactivate users with {"op": "replace", "path": "active", "value": false}
+	users.PATCH("/:id", func(c *gin.Context) {
+		var req auth.SCIMPatchRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			scimError(c, auth.NewSCIMError(http.StatusBadRequest, "invalidSyntax", err.Error()))
+			return
+		}
+		user, err := scim.PatchUser(c.Param("id"), req, scimBaseURL(c, router))
+		if err != nil {
+			scimError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, user)
+	})
+
+	users.DELETE("/:id", func(c *gin.Context) {
+		if err := scim.DeleteUser(c.Param("id")); err != nil {
+			scimError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	groups := router.Group("/Groups")
+	groups.GET("", func(c *gin.Context) {
+		startIndex, count := scimPage(c)
+		list, err := scim.ListGroups(c.Query("filter"), startIndex, count, scimBaseURL(c, router))
+		if err != nil {
+			scimError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	groups.GET("/:id", func(c *gin.Context) {
+		group, err := scim.GetGroup(c.Param("id"), scimBaseURL(c, router))
+		if err != nil {
+			scimError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, group)
+	})
+
+	groups.POST("", func(c *gin.Context) {
+		var resource auth.SCIMGroup
+		if err := c.ShouldBindJSON(&resource); err != nil {
+			scimError(c, auth.NewSCIMError(http.StatusBadRequest, "invalidSyntax", err.Error()))
+			return
+		}
+		group, err := scim.CreateGroup(resource, scimBaseURL(c, router))
+		if err != nil {
+			scimError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, group)
+	})
+
+	groups.PUT("/:id", func(c *gin.Context) {
+		var resource auth.SCIMGroup
+		if err := c.ShouldBindJSON(&resource); err != nil {
+			scimError(c, auth.NewSCIMError(http.StatusBadRequest, "invalidSyntax", err.Error()))
+			return
+		}
+		group, err := scim.ReplaceGroup(c.Param("id"), resource, scimBaseURL(c, router))
+		if err != nil {
+			scimError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, group)
+	})
+
+	groups.PATCH("/:id", func(c *gin.Context) {
+		var req auth.SCIMPatchRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			scimError(c, auth.NewSCIMError(http.StatusBadRequest, "invalidSyntax", err.Error()))
+			return
+		}
+		group, err := scim.PatchGroup(c.Param("id"), req, scimBaseURL(c, router))
+		if err != nil {
+			scimError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, group)
+	})
+
+	groups.DELETE("/:id", func(c *gin.Context) {
+		if err := scim.DeleteGroup(c.Param("id")); err != nil {
+			scimError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
+
+// scimError writes an error in SCIM representation
+func scimError(c *gin.Context, err error) {
+	scimErr := auth.AsSCIMError(err)
+	c.JSON(scimErr.Code(), scimErr)
+}
+
+// scimPage reads the 1-based startIndex and count query parameters. A
+// missing count returns every result.
+func scimPage(c *gin.Context) (int, int) {
+	startIndex, err := strconv.Atoi(c.Query("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(c.Query("count"))
+	if err != nil {
+		count = -1
+	}
+	return startIndex, count
+}
+
+// scimBaseURL returns the URL the SCIM endpoints are served at
+func scimBaseURL(c *gin.Context, router *gin.RouterGroup) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host + router.BasePath()
+}
@@ -0,0 +1,114 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+// secretRequest sets a secret's value and expiry settings. An empty value
+// keeps the current value of an existing secret.
+type secretRequest struct {
+	Value        string    `json:"value"`
+	Description  string    `json:"description"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	RotateEvery  string    `json:"rotateEvery"`
+	RemindBefore string    `json:"remindBefore"`
+	OnExpiry     string    `json:"onExpiry"`
+}
+
+// RegisterSecretRoutes registers the routes managing secrets. Secret values
+// are write-only and never returned.
+func RegisterSecretRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
+	router.GET("", func(c *gin.Context) {
+		secrets, err := engine.Secrets(false)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, secrets)
+	})
+
+	// Secrets that are expiring or already expired
+	router.GET("/expiring", func(c *gin.Context) {
+		secrets, err := engine.Secrets(true)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, secrets)
+	})
+
+	// Secrets no pipeline lists, or that no step read within ?since=,
+	// 30 days by default
+	router.GET("/unused", func(c *gin.Context) {
+		since := 30 * 24 * time.Hour
+		if value := c.Query("since"); value != "" {
+			d, err := core.ParseDuration(value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			since = d
+		}
+		secrets, err := engine.UnusedSecrets(time.Now().Add(-since))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, secrets)
+	})
+
+	router.GET("/:name", func(c *gin.Context) {
+		secret, err := engine.Secret(c.Param("name"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, secret)
+	})
+
+	// The pipelines and steps that list and read a secret
+	router.GET("/:name/usage", func(c *gin.Context) {
+		usage, err := engine.SecretUsage(c.Param("name"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, usage)
+	})
+
+	// Create, update or rotate a secret
+	router.PUT("/:name", func(c *gin.Context) {
+		var req secretRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		secret, err := engine.SetSecret(core.Secret{
+			Name:         c.Param("name"),
+			Value:        req.Value,
+			Description:  req.Description,
+			ExpiresAt:    req.ExpiresAt,
+			RotateEvery:  req.RotateEvery,
+			RemindBefore: req.RemindBefore,
+			OnExpiry:     req.OnExpiry,
+		})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, secret)
+	})
+
+	router.DELETE("/:name", func(c *gin.Context) {
+		if err := engine.DeleteSecret(c.Param("name")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	})
+}
@@ -1,26 +1,46 @@
 package routes
 
 import (
+	"context"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/plugins/security"
 	"github.com/gin-gonic/gin"
 )
 
 // SecurityRequest represents a request to run a security scan
 type SecurityRequest struct {
-	PipelineID       string   `json:"pipelineId"`
-	TargetDir        string   `json:"targetDir"`
-	ScanTypes        []string `json:"scanTypes"`
-	SeverityThreshold string  `json:"severityThreshold"`
-	FailOnViolation  bool     `json:"failOnViolation"`
-	GenerateSBOM     bool     `json:"generateSBOM"`
-	CustomRules      []map[string]interface{} `json:"customRules"`
+	PipelineID        string                   `json:"pipelineId"`
+	TargetDir         string                   `json:"targetDir"`
+	ScanTypes         []string                 `json:"scanTypes"`
+	SeverityThreshold string                   `json:"severityThreshold"`
+	FailOnViolation   bool                     `json:"failOnViolation"`
+	GenerateSBOM      bool                     `json:"generateSBOM"`
+	CustomRules       []map[string]interface{} `json:"customRules"`
+}
+
+// SecurityScans gives the security routes access to the scan history and
+// the scheduled scans. Schedule routes are only registered with a Scheduler,
+// pipeline definition scans and running scan routes with a Plugin, SLA
+// routes with SLAs, and VEX routes with VEX.
+type SecurityScans struct {
+	History   *security.History
+	Scheduler *security.Scheduler
+	Plugin    *security.SecurityPlugin
+	SLAs      *security.SLAs
+	VEX       *security.VEX
 }
 
 // RegisterSecurityRoutes registers all security-related routes
-func RegisterSecurityRoutes(router *gin.RouterGroup, pipelineEngine *core.PipelineEngine) {
+func RegisterSecurityRoutes(router *gin.RouterGroup, pipelineEngine *core.PipelineEngine, scans *SecurityScans) {
+	if scans == nil {
+		scans = &SecurityScans{History: security.NewMemoryHistory()}
+	}
+
 	// Get security configuration
 	router.GET("/config", func(c *gin.Context) {
 		// In a real implementation, we would get this from the security plugin
@@ -56,33 +76,13 @@ func RegisterSecurityRoutes(router *gin.RouterGroup, pipelineEngine *core.Pipeli
 		c.JSON(http.StatusOK, config)
 	})
 
-	// Get all security scans
+	// Get all security scans, optionally filtered by pipeline, schedule or type
 	router.GET("/scans", func(c *gin.Context) {
-		// In a real implementation, we would get this from storage
-		// For now, we'll return a mock response
-		c.JSON(http.StatusOK, []gin.H{
-			{
-				"id":            "scan-1",
-				"timestamp":     time.Now().Add(-24 * time.Hour),
-				"type":          "vulnerability",
-				"pipelineId":    "pipeline-1",
-				"jobId":         "job-1",
-				"status":        "completed",
-				"findingsCount": 3,
-				"highCount":     1,
-				"mediumCount":   2,
-				"lowCount":      0,
-			},
-			{
-				"id":            "scan-2",
-				"timestamp":     time.Now().Add(-12 * time.Hour),
-				"type":          "secret",
-				"pipelineId":    "pipeline-1",
-				"jobId":         "job-2",
-				"status":        "completed",
-				"findingsCount": 1,
-			},
-		})
+		c.JSON(http.StatusOK, localizeScans(scans.History.List(security.ScanFilter{
+			PipelineID: c.Query("pipelineId"),
+			ScheduleID: c.Query("scheduleId"),
+			Type:       c.Query("type"),
+		}), Lang(c)))
 	})
 
 	// Create a new security scan
@@ -112,91 +112,171 @@ func RegisterSecurityRoutes(router *gin.RouterGroup, pipelineEngine *core.Pipeli
 
 	// Get a specific security scan
 	router.GET("/scans/:id", func(c *gin.Context) {
-		id := c.Param("id")
+		scan, ok := scans.History.Get(c.Param("id"))
+		if !ok {
+			localizedError(c, http.StatusNotFound, "scan_not_found", "Scan not found")
+			return
+		}
+		c.JSON(http.StatusOK, scan.Localize(Lang(c)))
+	})
 
-		// In a real implementation, we would get this from storage
-		// For now, we'll return a mock response based on the ID
-		c.JSON(http.StatusOK, gin.H{
-			"id":            id,
-			"timestamp":     time.Now().Add(-6 * time.Hour),
-			"type":          "vulnerability",
-			"pipelineId":    "pipeline-1",
-			"jobId":         "job-3",
-			"status":        "completed",
-			"findingsCount": 5,
-			"highCount":     2,
-			"mediumCount":   2,
-			"lowCount":      1,
-			"findings": []gin.H{
-				{
-					"id":          "CVE-2021-1234",
-					"severity":    "high",
-					"package":     "lodash",
-					"version":     "4.17.20",
-					"description": "Prototype pollution vulnerability in lodash",
-					"fixVersion":  "4.17.21",
-				},
-				{
-					"id":          "CVE-2021-5678",
-					"severity":    "high",
-					"package":     "express",
-					"version":     "4.17.1",
-					"description": "Memory leak in Express.js",
-					"fixVersion":  "4.17.2",
-				},
-			},
+	// A printable HTML report of a scan in the request's language and display
+	// time zone
+	router.GET("/scans/:id/report", func(c *gin.Context) {
+		scan, ok := scans.History.Get(c.Param("id"))
+		if !ok {
+			localizedError(c, http.StatusNotFound, "scan_not_found", "Scan not found")
+			return
+		}
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		if err := security.WriteReport(c.Writer, scan, Lang(c), Location(c)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+	})
+
+	// Aggregate open findings, vulnerable components, failing pipelines and
+	// SLA breaches across all pipelines
+	router.GET("/overview", func(c *gin.Context) {
+		limit := 10
+		if value := c.Query("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a non-negative number"})
+				return
+			}
+			limit = n
+		}
+		policies := security.DefaultSLAPolicies
+		if scans.SLAs != nil {
+			policies = scans.SLAs.Policies()
+		}
+		c.JSON(http.StatusOK, scans.History.Overview(policies, limit, time.Now()))
+	})
+
+	// Get findings tracked across scans, optionally filtered by scope
+	// ("pipeline:<id>", "schedule:<id>" or "target:<dir>"), type or status
+	router.GET("/findings", func(c *gin.Context) {
+		scope := c.Query("scope")
+		if pipelineID := c.Query("pipelineId"); pipelineID != "" {
+			scope = "pipeline:" + pipelineID
+		}
+		findings := scans.History.Findings(security.FindingFilter{
+			Scope:    scope,
+			ScanType: c.Query("type"),
+			Status:   c.Query("status"),
 		})
+		for i := range findings {
+			findings[i].Finding = findings[i].Finding.Localize(Lang(c))
+		}
+		c.JSON(http.StatusOK, findings)
+	})
+
+	router.GET("/findings/:id", func(c *gin.Context) {
+		finding, ok := scans.History.Finding(c.Param("id"))
+		if !ok {
+			localizedError(c, http.StatusNotFound, "finding_not_found", "Finding not found")
+			return
+		}
+		finding.Finding = finding.Finding.Localize(Lang(c))
+		c.JSON(http.StatusOK, finding)
+	})
+
+	// Triage a finding, which it keeps in later scans
+	router.PUT("/findings/:id/triage", func(c *gin.Context) {
+		var triage security.Triage
+		if err := c.ShouldBindJSON(&triage); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if _, ok := scans.History.Finding(c.Param("id")); !ok {
+			localizedError(c, http.StatusNotFound, "finding_not_found", "Finding not found")
+			return
+		}
+		triage.At = time.Time{}
+		if principal := PrincipalFrom(c); principal != nil {
+			triage.By = principal.Name()
+		}
+		finding, err := scans.History.SetTriage(c.Param("id"), &triage)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, finding)
+	})
+
+	router.DELETE("/findings/:id/triage", func(c *gin.Context) {
+		finding, err := scans.History.SetTriage(c.Param("id"), nil)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, finding)
 	})
 
 	// Get scan history for a pipeline
 	router.GET("/history/:pipelineId", func(c *gin.Context) {
-		pipelineID := c.Param("pipelineId")
-		
-		// This would load from a database in a real implementation
-		// For now, we'll return a mock response
-		history := []map[string]interface{}{
-			{
-				"id": "scan-123",
-				"pipelineId": pipelineID,
-				"timestamp": time.Now().Add(-24 * time.Hour).Format(time.RFC3339),
-				"status": "success",
-				"findings": 5,
-				"duration": "4.2s",
-			},
-			{
-				"id": "scan-124",
-				"pipelineId": pipelineID,
-				"timestamp": time.Now().Add(-12 * time.Hour).Format(time.RFC3339),
-				"status": "failed",
-				"findings": 12,
-				"duration": "3.8s",
-			},
-			{
-				"id": "scan-125",
-				"pipelineId": pipelineID,
-				"timestamp": time.Now().Add(-2 * time.Hour).Format(time.RFC3339),
-				"status": "success",
-				"findings": 3,
-				"duration": "4.5s",
-			},
-		}
-		
-		c.JSON(http.StatusOK, history)
+		c.JSON(http.StatusOK, localizeScans(scans.History.List(security.ScanFilter{PipelineID: c.Param("pipelineId")}), Lang(c)))
 	})
 
+	if scans.Scheduler != nil {
+		registerScheduleRoutes(router.Group("/schedules"), scans)
+	}
+	if scans.SLAs != nil {
+		registerSLARoutes(router.Group("/sla"), pipelineEngine, scans.SLAs)
+	}
+	if scans.VEX != nil {
+		registerVEXRoutes(router.Group("/vex"), scans.VEX)
+	}
+
+	// Scan a pipeline's definition for risky patterns
+	if scans.Plugin != nil {
+		router.POST("/pipelines/:id/scan", func(c *gin.Context) {
+			pipeline, err := pipelineEngine.GetPipeline(c.Param("id"))
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			scan, err := scans.Plugin.ScanPipeline(pipeline)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, scan.Localize(Lang(c)))
+		})
+
+		// Get the progress of a running scan
+		router.GET("/scans/:id/progress", func(c *gin.Context) {
+			progress, ok := scans.Plugin.ScanProgress(c.Param("id"))
+			if !ok {
+				scanNotRunning(c, scans.History)
+				return
+			}
+			c.JSON(http.StatusOK, progress)
+		})
+
+		// Cancel a running scan, which is recorded with its partial results
+		router.POST("/scans/:id/cancel", func(c *gin.Context) {
+			if err := scans.Plugin.CancelScan(c.Param("id")); err != nil {
+				scanNotRunning(c, scans.History)
+				return
+			}
+			c.JSON(http.StatusAccepted, gin.H{"status": "canceling", "scanId": c.Param("id")})
+		})
+	}
+
 	// Get a specific scan result
 	router.GET("/scan/:scanId", func(c *gin.Context) {
 		scanID := c.Param("scanId")
-		
+
 		// In a real implementation, this would load the scan result from a database
 		// For now, we'll simulate finding a report file
-		
+
 		// Simulated file reading error
 		if scanID == "invalid" {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Scan report not found"})
 			return
 		}
-		
+
 		// For demo purposes, return mock data
 		mockData := generateMockScanResult(scanID)
 		c.JSON(http.StatusOK, mockData)
@@ -205,12 +285,210 @@ func RegisterSecurityRoutes(router *gin.RouterGroup, pipelineEngine *core.Pipeli
 	// Get the latest scan for a pipeline
 	router.GET("/latest/:pipelineId", func(c *gin.Context) {
 		pipelineID := c.Param("pipelineId")
-		
+
 		// In a real implementation, this would query the most recent scan
 		// For now, we'll return mock data
 		mockData := generateMockScanResult("latest-" + pipelineID)
+		if scans.VEX != nil {
+			mockData["vex"] = scans.VEX.Document(pipelineID)
+		}
 		c.JSON(http.StatusOK, mockData)
 	})
+
+	// Get the VEX document that goes with the latest SBOM of a pipeline
+	if scans.VEX != nil {
+		router.GET("/latest/:pipelineId/vex", func(c *gin.Context) {
+			c.JSON(http.StatusOK, scans.VEX.Document(c.Param("pipelineId")))
+		})
+	}
+}
+
+// localizeScans returns copies of scans with their findings in lang
+func localizeScans(scans []security.Scan, lang string) []security.Scan {
+	localized := make([]security.Scan, len(scans))
+	for i, scan := range scans {
+		localized[i] = scan.Localize(lang)
+	}
+	return localized
+}
+
+// registerVEXRoutes registers the routes that import and author VEX
+// documents
+func registerVEXRoutes(router *gin.RouterGroup, vex *security.VEX) {
+	router.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, vex.List())
+	})
+
+	router.POST("", func(c *gin.Context) {
+		var doc security.VEXDocument
+		if err := c.ShouldBindJSON(&doc); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		author := ""
+		if principal := PrincipalFrom(c); principal != nil {
+			author = principal.Name()
+		}
+		entry, err := vex.Put(doc, author)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, entry)
+	})
+
+	router.GET("/:key", func(c *gin.Context) {
+		doc, ok := vex.Get(c.Param("key"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "VEX document not found"})
+			return
+		}
+		c.JSON(http.StatusOK, doc)
+	})
+
+	router.DELETE("/:key", func(c *gin.Context) {
+		if err := vex.Delete(c.Param("key")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	})
+}
+
+// scanNotRunning responds that the scan in the request isn't running,
+// with its status when it has finished
+func scanNotRunning(c *gin.Context, history *security.History) {
+	scan, ok := history.Get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scan not found"})
+		return
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": "scan is not running", "status": scan.Status})
+}
+
+// registerSLARoutes registers the routes that manage remediation SLAs and
+// report compliance with them
+func registerSLARoutes(router *gin.RouterGroup, pipelineEngine *core.PipelineEngine, slas *security.SLAs) {
+	router.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, slas.Policies())
+	})
+
+	router.PUT("", func(c *gin.Context) {
+		var policies []security.SLAPolicy
+		if err := c.ShouldBindJSON(&policies); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := slas.SetPolicies(policies); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, slas.Policies())
+	})
+
+	router.GET("/breaches", func(c *gin.Context) {
+		c.JSON(http.StatusOK, slas.Breaches(time.Now()))
+	})
+
+	// Compliance of each pipeline, or of each team owning pipelines
+	router.GET("/compliance", func(c *gin.Context) {
+		by := c.DefaultQuery("by", "pipeline")
+		if by != "pipeline" && by != "team" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "by must be pipeline or team"})
+			return
+		}
+		c.JSON(http.StatusOK, slas.Compliance(time.Now(), func(scope string) string {
+			if !strings.HasPrefix(scope, "pipeline:") {
+				return ""
+			}
+			pipelineID := strings.TrimPrefix(scope, "pipeline:")
+			if by == "pipeline" {
+				return pipelineID
+			}
+			if pipeline, err := pipelineEngine.GetPipeline(pipelineID); err == nil {
+				return pipeline.Team
+			}
+			return ""
+		}))
+	})
+}
+
+// registerScheduleRoutes registers the routes that manage scheduled scans
+func registerScheduleRoutes(router *gin.RouterGroup, scans *SecurityScans) {
+	router.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, scans.Scheduler.List())
+	})
+
+	router.POST("", func(c *gin.Context) {
+		var schedule security.ScanSchedule
+		if err := c.ShouldBindJSON(&schedule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		created, err := scans.Scheduler.Create(schedule)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, created)
+	})
+
+	router.GET("/:id", func(c *gin.Context) {
+		schedule, ok := scans.Scheduler.Get(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+			return
+		}
+		c.JSON(http.StatusOK, schedule)
+	})
+
+	router.PUT("/:id", func(c *gin.Context) {
+		if _, ok := scans.Scheduler.Get(c.Param("id")); !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+			return
+		}
+
+		var schedule security.ScanSchedule
+		if err := c.ShouldBindJSON(&schedule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		updated, err := scans.Scheduler.Update(c.Param("id"), schedule)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, updated)
+	})
+
+	router.DELETE("/:id", func(c *gin.Context) {
+		if err := scans.Scheduler.Delete(c.Param("id")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	})
+
+	// Run a schedule now, outside its cron schedule
+	router.POST("/:id/run", func(c *gin.Context) {
+		id := c.Param("id")
+		if _, ok := scans.Scheduler.Get(id); !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+			return
+		}
+		if err := scans.Scheduler.Trigger(context.Background(), id); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"status": "running", "scheduleId": id})
+	})
+
+	// Get the scans a schedule has run
+	router.GET("/:id/scans", func(c *gin.Context) {
+		c.JSON(http.StatusOK, scans.History.List(security.ScanFilter{ScheduleID: c.Param("id")}))
+	})
 }
 
 // generateMockScanResult creates mock scan data for demonstration purposes
@@ -313,11 +591,11 @@ func generateMockScanResult(scanID string) map[string]interface{} {
 	}
 
 	return map[string]interface{}{
-		"id":        scanID,
-		"timestamp": time.Now().Format(time.RFC3339),
+		"id":          scanID,
+		"timestamp":   time.Now().Format(time.RFC3339),
 		"environment": "development",
-		"duration":  "5.2s",
-		"findings":  findings,
+		"duration":    "5.2s",
+		"findings":    findings,
 		"summary": map[string]interface{}{
 			"totalFiles":         120,
 			"filesScanned":       98,
@@ -332,4 +610,4 @@ func generateMockScanResult(scanID string) map[string]interface{} {
 			"version":    "1.0",
 		},
 	}
-} 
\ No newline at end of file
+}
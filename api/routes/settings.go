@@ -0,0 +1,69 @@
+package routes
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/chip/conveyor/config"
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterSettingsRoutes registers the admin routes reading and updating
+// the server configuration
+func RegisterSettingsRoutes(router *gin.RouterGroup, settings *config.Settings) {
+	// The configuration in effect. Secrets are never included.
+	router.GET("", func(c *gin.Context) {
+		cfg, err := settings.Get()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, cfg)
+	})
+
+	// Merge settings into the configuration file and apply them. The
+	// response lists the changed settings and those needing a restart.
+	router.PATCH("", func(c *gin.Context) {
+		patch, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		by := ""
+		if principal := PrincipalFrom(c); principal != nil {
+			by = principal.Name()
+		}
+		change, err := settings.Update(patch, by)
+		switch {
+		case errors.Is(err, config.ErrNoConfigFile):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case err != nil && change != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		case err != nil:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusOK, change)
+		}
+	})
+
+	// Changes to the settings, newest first, limited by ?limit=
+	router.GET("/audit", func(c *gin.Context) {
+		limit := 0
+		if value := c.Query("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a non-negative number"})
+				return
+			}
+			limit = parsed
+		}
+		changes, err := settings.Audit(limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, changes)
+	})
+}
@@ -0,0 +1,49 @@
+package routes
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// streamConnKey is the context key of a request's connection
+type streamConnKey struct{}
+
+// streamConn is a connection and how long each write of a stream on it
+// may take
+type streamConn struct {
+	conn         net.Conn
+	writeTimeout time.Duration
+}
+
+// WithStreamConn is the ConnContext of servers protecting event streams
+// from slow clients. Streams are exempt from the server's WriteTimeout,
+// but each write must finish within writeTimeout, or the connection is
+// closed. Without it, streams end at the server's WriteTimeout.
+func WithStreamConn(ctx context.Context, conn net.Conn, writeTimeout time.Duration) context.Context {
+	return context.WithValue(ctx, streamConnKey{}, &streamConn{conn: conn, writeTimeout: writeTimeout})
+}
+
+// extendStreamWrite gives the next write of a streaming response its own
+// deadline in place of the server's WriteTimeout. HTTP/2 connections are
+// shared by requests, so their streams keep the server's WriteTimeout and
+// clients resume from their last event.
+func extendStreamWrite(r *http.Request) {
+	if sc, ok := r.Context().Value(streamConnKey{}).(*streamConn); ok && r.ProtoMajor == 1 {
+		sc.conn.SetWriteDeadline(streamDeadline(r))
+	}
+}
+
+// streamDeadline returns the deadline of the next write of a stream, or
+// zero for none
+func streamDeadline(r *http.Request) time.Time {
+	timeout := eventKeepAlive
+	if sc, ok := r.Context().Value(streamConnKey{}).(*streamConn); ok {
+		timeout = sc.writeTimeout
+	}
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
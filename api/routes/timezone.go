@@ -0,0 +1,146 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tzKey is the gin context key of the display time zone
+const tzKey = "tz"
+
+// DisplayTimezone shows the timestamps of JSON responses in the IANA time
+// zone of ?tz=, such as "America/Chicago". Timestamps are stored in UTC and
+// every one carries its offset, so clients can always tell the instant.
+func DisplayTimezone() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Query("tz")
+		if name == "" {
+			c.Next()
+			return
+		}
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown time zone %q", name)})
+			return
+		}
+		c.Set(tzKey, loc)
+		c.Header("Time-Zone", loc.String())
+
+		writer := &zoneWriter{ResponseWriter: c.Writer, loc: loc}
+		c.Writer = writer
+		c.Next()
+		writer.finish()
+	}
+}
+
+// Location returns the display time zone of a request, or UTC outside of
+// DisplayTimezone
+func Location(c *gin.Context) *time.Location {
+	if loc, ok := c.Value(tzKey).(*time.Location); ok {
+		return loc
+	}
+	return time.UTC
+}
+
+// zoneWriter holds back JSON responses to rewrite their timestamps. Other
+// responses, such as logs and event streams, pass straight through.
+type zoneWriter struct {
+	gin.ResponseWriter
+	loc     *time.Location
+	status  int
+	decided bool
+	body    *bytes.Buffer
+}
+
+func (w *zoneWriter) WriteHeader(code int) {
+	w.status = code
+}
+
+func (w *zoneWriter) Status() int {
+	if w.status != 0 && !w.decided {
+		return w.status
+	}
+	return w.ResponseWriter.Status()
+}
+
+func (w *zoneWriter) Written() bool {
+	return w.decided || w.ResponseWriter.Written()
+}
+
+func (w *zoneWriter) Write(data []byte) (int, error) {
+	if w.decide() {
+		return w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *zoneWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// decide picks, on the first write, whether the response is held back, and
+// otherwise sends its status
+func (w *zoneWriter) decide() bool {
+	if !w.decided {
+		w.decided = true
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			w.body = &bytes.Buffer{}
+		} else if w.status != 0 {
+			w.ResponseWriter.WriteHeader(w.status)
+		}
+	}
+	return w.body != nil
+}
+
+// finish sends a held back response with its timestamps in the display
+// time zone
+func (w *zoneWriter) finish() {
+	if w.status != 0 && !w.decided {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if w.body == nil {
+		return
+	}
+	data := w.body.Bytes()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err == nil {
+		if converted, err := json.Marshal(inZone(value, w.loc)); err == nil {
+			data = converted
+		}
+	}
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	w.ResponseWriter.Write(data)
+}
+
+// inZone converts the RFC 3339 timestamps in a decoded JSON value to loc.
+// Zero times are left alone.
+func inZone(value interface{}, loc *time.Location) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = inZone(item, loc)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = inZone(item, loc)
+		}
+	case string:
+		if len(v) < len("2006-01-02T15:04:05Z") || v[4] != '-' || v[10] != 'T' {
+			return v
+		}
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil && !t.IsZero() {
+			return t.In(loc).Format(time.RFC3339Nano)
+		}
+	}
+	return value
+}
@@ -0,0 +1,68 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// socketProtocol is the WebSocket subprotocol the server selects. Browsers
+// can't set an Authorization header on WebSockets, so they offer it
+// together with a bearer.<token> subprotocol carrying the API token.
+const socketProtocol = "conveyor"
+
+// bearerProtocol prefixes the API token in a WebSocket subprotocol
+const bearerProtocol = "bearer."
+
+// NewUpgrader returns the upgrader of the API's WebSockets. Browsers may
+// only open them from the server's own origin or allowOrigins, where "*"
+// allows any origin.
+func NewUpgrader(allowOrigins []string) websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		Subprotocols:    []string{socketProtocol},
+		CheckOrigin:     allowOrigin(allowOrigins),
+	}
+}
+
+// allowOrigin accepts requests without an Origin, which don't come from
+// browsers, and from the request's host or an allowed origin
+func allowOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		if strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		for _, a := range allowed {
+			if a == "*" || strings.EqualFold(a, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// socketToken returns the API token a WebSocket upgrade request offers as
+// a subprotocol, or ""
+func socketToken(c *gin.Context) string {
+	if !websocket.IsWebSocketUpgrade(c.Request) {
+		return ""
+	}
+	for _, protocol := range websocket.Subprotocols(c.Request) {
+		if strings.HasPrefix(protocol, bearerProtocol) {
+			return protocol[len(bearerProtocol):]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,17 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/chip/conveyor/core"
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterWorkspaceRoutes registers the route reporting warm workspace
+// reuse
+func RegisterWorkspaceRoutes(router *gin.RouterGroup, engine *core.PipelineEngine) {
+	// Workspace hits, misses, evictions and disk usage per pipeline
+	router.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, engine.WorkspaceStats())
+	})
+}
@@ -10,7 +10,6 @@ import (
 	"github.com/chip/conveyor/core"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
 )
 
 // Server represents the API server
@@ -18,7 +17,6 @@ type Server struct {
 	router         *gin.Engine
 	httpServer     *http.Server
 	pipelineEngine *core.PipelineEngine
-	upgrader       websocket.Upgrader
 }
 
 // NewServer creates a new API server
@@ -38,13 +36,6 @@ func NewServer(pipelineEngine *core.PipelineEngine) *Server {
 	server := &Server{
 		router:         router,
 		pipelineEngine: pipelineEngine,
-		upgrader: websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
-		},
 	}
 
 	// Register routes
@@ -64,12 +55,15 @@ func (s *Server) Start(addr string) error {
 	return s.httpServer.ListenAndServe()
 }
 
-// Shutdown gracefully shuts down the API server
+// Shutdown gracefully shuts down the API server, then drains running jobs
+// from the pipeline engine until ctx expires
 func (s *Server) Shutdown(ctx context.Context) error {
 	if s.httpServer != nil {
-		return s.httpServer.Shutdown(ctx)
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			return err
+		}
 	}
-	return nil
+	return s.pipelineEngine.Shutdown(ctx)
 }
 
 // registerRoutes registers all API routes
@@ -88,77 +82,34 @@ func (s *Server) registerRoutes() {
 
 	// API routes
 	api := s.router.Group("/api")
-	
+
 	// API health endpoint
 	api.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"status": "ok",
 		})
 	})
-	
+
 	// Pipeline routes
 	pipelineRoutes := api.Group("/pipelines")
 	routes.RegisterPipelineRoutes(pipelineRoutes, s.pipelineEngine)
-	
+
 	// Job routes
 	jobRoutes := api.Group("/jobs")
 	routes.RegisterJobRoutes(jobRoutes, s.pipelineEngine)
-	
+
 	// Plugin routes
 	pluginRoutes := api.Group("/plugins")
-	routes.RegisterPluginRoutes(pluginRoutes)
-	
+	routes.RegisterPluginRoutes(pluginRoutes, nil)
+
 	// Security routes
 	securityRoutes := api.Group("/security")
-	routes.RegisterSecurityRoutes(securityRoutes, s.pipelineEngine)
-	
-	// WebSocket route for real-time updates
-	s.router.GET("/ws", s.handleWebSocket)
+	routes.RegisterSecurityRoutes(securityRoutes, s.pipelineEngine, nil)
+
+	// WebSocket route for real-time updates. This server has no
+	// authentication, so only same-origin browsers may connect.
+	routes.RegisterEventSocket(s.router.Group("/ws"), s.pipelineEngine, routes.NewUpgrader(nil))
 
 	// Static files for UI
 	s.router.Static("/ui", "./ui/dist")
 }
-
-// handleWebSocket handles WebSocket connections
-func (s *Server) handleWebSocket(c *gin.Context) {
-	// Upgrade the HTTP connection to a WebSocket connection
-	conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		log.Printf("Error upgrading connection: %v", err)
-		return
-	}
-	defer conn.Close()
-
-	// Create a channel for events
-	eventCh := make(chan core.Event, 100)
-
-	// Register the event listener
-	s.pipelineEngine.RegisterEventListener(c.ClientIP(), eventCh)
-	defer s.pipelineEngine.UnregisterEventListener(c.ClientIP())
-
-	// Write events to the WebSocket
-	go func() {
-		for event := range eventCh {
-			err := conn.WriteJSON(event)
-			if err != nil {
-				log.Printf("Error writing to WebSocket: %v", err)
-				return
-			}
-		}
-	}()
-
-	// Read messages from the WebSocket (just ping-pong for now)
-	for {
-		messageType, p, err := conn.ReadMessage()
-		if err != nil {
-			log.Printf("Error reading from WebSocket: %v", err)
-			return
-		}
-
-		// Echo the message back for now
-		if err := conn.WriteMessage(messageType, p); err != nil {
-			log.Printf("Error writing to WebSocket: %v", err)
-			return
-		}
-	}
-} 
\ No newline at end of file
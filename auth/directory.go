@@ -0,0 +1,612 @@
+// Package auth manages users, teams, API tokens and role bindings, and
+// decides what an authenticated principal may do.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// User is a person who can hold API tokens and role bindings
+type User struct {
+	ID          string    `json:"id"`
+	ExternalID  string    `json:"externalId,omitempty"`
+	UserName    string    `json:"userName"`
+	DisplayName string    `json:"displayName,omitempty"`
+	GivenName   string    `json:"givenName,omitempty"`
+	FamilyName  string    `json:"familyName,omitempty"`
+	Email       string    `json:"email,omitempty"`
+	Active      bool      `json:"active"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// Team is a group of users that role bindings can be granted to
+type Team struct {
+	ID         string    `json:"id"`
+	ExternalID string    `json:"externalId,omitempty"`
+	Name       string    `json:"name"`
+	Members    []string  `json:"members"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// Token is an API token of a user. Only a hash of the token is kept.
+type Token struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"userId"`
+	Name       string    `json:"name"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt  time.Time `json:"revokedAt,omitempty"`
+}
+
+// Binding grants a role to a user or team, on one pipeline or on all of
+// them when Pipeline is empty
+type Binding struct {
+	ID string `json:"id"`
+	// Subject is "user:<id>" or "team:<id>"
+	Subject   string    `json:"subject"`
+	Role      Role      `json:"role"`
+	Pipeline  string    `json:"pipeline,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// storedToken is the on-disk form of a token
+type storedToken struct {
+	Token
+	Hash string `json:"hash"`
+}
+
+// state is everything the directory persists
+type state struct {
+	Users    []*User        `json:"users"`
+	Teams    []*Team        `json:"teams"`
+	Tokens   []*storedToken `json:"tokens"`
+	Bindings []*Binding     `json:"bindings"`
+}
+
+// Directory stores users, teams, tokens and bindings in a JSON file.
+// Deactivating or deleting a user revokes their tokens and removes their
+// bindings; deleting a team removes its bindings.
+type Directory struct {
+	path     string
+	mu       sync.RWMutex
+	users    map[string]*User
+	teams    map[string]*Team
+	tokens   map[string]*storedToken
+	bindings map[string]*Binding
+}
+
+// Subject helpers for bindings
+func UserSubject(id string) string { return "user:" + id }
+func TeamSubject(id string) string { return "team:" + id }
+
+// NewDirectory opens the directory persisted in dir, creating it if needed
+func NewDirectory(dir string) (*Directory, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create auth directory: %w", err)
+	}
+
+	d := &Directory{path: filepath.Join(dir, "auth.json")}
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Reload replaces the directory with what its file holds, such as changes
+// another server made to a shared data directory
+func (d *Directory) Reload() error {
+	var s state
+	data, err := os.ReadFile(d.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read auth directory: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return fmt.Errorf("failed to decode auth directory: %w", err)
+		}
+	}
+
+	users := make(map[string]*User, len(s.Users))
+	for _, u := range s.Users {
+		users[u.ID] = u
+	}
+	teams := make(map[string]*Team, len(s.Teams))
+	for _, t := range s.Teams {
+		teams[t.ID] = t
+	}
+	tokens := make(map[string]*storedToken, len(s.Tokens))
+	for _, t := range s.Tokens {
+		tokens[t.ID] = t
+	}
+	bindings := make(map[string]*Binding, len(s.Bindings))
+	for _, b := range s.Bindings {
+		bindings[b.ID] = b
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.users, d.teams, d.tokens, d.bindings = users, teams, tokens, bindings
+	return nil
+}
+
+// newID returns a random identifier with a prefix
+func newID(prefix string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return prefix + "-" + hex.EncodeToString(b)
+}
+
+// ListUsers returns every user ordered by user name
+func (d *Directory) ListUsers() []User {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	users := make([]User, 0, len(d.users))
+	for _, u := range d.users {
+		users = append(users, *u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].UserName < users[j].UserName })
+	return users
+}
+
+// GetUser returns a user by ID
+func (d *Directory) GetUser(id string) (User, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	u, ok := d.users[id]
+	if !ok {
+		return User{}, false
+	}
+	return *u, true
+}
+
+// CreateUser adds a user. User names are unique, ignoring case.
+func (d *Directory) CreateUser(u User) (User, error) {
+	if strings.TrimSpace(u.UserName) == "" {
+		return User{}, fmt.Errorf("userName is required")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.userNameTaken(u.UserName, "") {
+		return User{}, &ConflictError{fmt.Sprintf("user %s already exists", u.UserName)}
+	}
+	now := time.Now()
+	u.ID = newID("user")
+	u.CreatedAt = now
+	u.UpdatedAt = now
+	d.users[u.ID] = &u
+	return u, d.save()
+}
+
+// ReplaceUser replaces the attributes of a user. Deactivating the user
+// revokes their tokens and bindings.
+func (d *Directory) ReplaceUser(id string, u User) (User, error) {
+	if strings.TrimSpace(u.UserName) == "" {
+		return User{}, fmt.Errorf("userName is required")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	existing, ok := d.users[id]
+	if !ok {
+		return User{}, &NotFoundError{fmt.Sprintf("user %s not found", id)}
+	}
+	if d.userNameTaken(u.UserName, id) {
+		return User{}, &ConflictError{fmt.Sprintf("user %s already exists", u.UserName)}
+	}
+
+	u.ID = id
+	u.CreatedAt = existing.CreatedAt
+	u.UpdatedAt = time.Now()
+	if existing.Active && !u.Active {
+		d.revokeAccess(id)
+	}
+	d.users[id] = &u
+	return u, d.save()
+}
+
+// DeleteUser removes a user, their team memberships, tokens and bindings
+func (d *Directory) DeleteUser(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.users[id]; !ok {
+		return &NotFoundError{fmt.Sprintf("user %s not found", id)}
+	}
+	d.revokeAccess(id)
+	for _, t := range d.teams {
+		t.Members = without(t.Members, id)
+	}
+	delete(d.users, id)
+	return d.save()
+}
+
+// userNameTaken reports whether another user has the name. Callers must
+// hold d.mu.
+func (d *Directory) userNameTaken(name, exceptID string) bool {
+	for _, u := range d.users {
+		if u.ID != exceptID && strings.EqualFold(u.UserName, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// revokeAccess revokes a user's tokens and removes their bindings. Callers
+// must hold d.mu.
+func (d *Directory) revokeAccess(userID string) {
+	now := time.Now()
+	for _, t := range d.tokens {
+		if t.UserID == userID && t.RevokedAt.IsZero() {
+			t.RevokedAt = now
+		}
+	}
+	subject := UserSubject(userID)
+	for id, b := range d.bindings {
+		if b.Subject == subject {
+			delete(d.bindings, id)
+		}
+	}
+}
+
+// ListTeams returns every team ordered by name
+func (d *Directory) ListTeams() []Team {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	teams := make([]Team, 0, len(d.teams))
+	for _, t := range d.teams {
+		teams = append(teams, copyTeam(t))
+	}
+	sort.Slice(teams, func(i, j int) bool { return teams[i].Name < teams[j].Name })
+	return teams
+}
+
+// GetTeam returns a team by ID
+func (d *Directory) GetTeam(id string) (Team, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	t, ok := d.teams[id]
+	if !ok {
+		return Team{}, false
+	}
+	return copyTeam(t), true
+}
+
+// TeamsOf returns the IDs of the teams a user belongs to
+func (d *Directory) TeamsOf(userID string) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.teamsOf(userID)
+}
+
+// teamsOf returns a user's team IDs. Callers must hold d.mu.
+func (d *Directory) teamsOf(userID string) []string {
+	var ids []string
+	for _, t := range d.teams {
+		for _, member := range t.Members {
+			if member == userID {
+				ids = append(ids, t.ID)
+				break
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// CreateTeam adds a team. Team names are unique, ignoring case.
+func (d *Directory) CreateTeam(t Team) (Team, error) {
+	if strings.TrimSpace(t.Name) == "" {
+		return Team{}, fmt.Errorf("team name is required")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.teamNameTaken(t.Name, "") {
+		return Team{}, &ConflictError{fmt.Sprintf("team %s already exists", t.Name)}
+	}
+	if err := d.checkMembers(t.Members); err != nil {
+		return Team{}, err
+	}
+	now := time.Now()
+	t.ID = newID("team")
+	t.Members = unique(t.Members)
+	t.CreatedAt = now
+	t.UpdatedAt = now
+	d.teams[t.ID] = &t
+	return copyTeam(&t), d.save()
+}
+
+// ReplaceTeam replaces the name and members of a team
+func (d *Directory) ReplaceTeam(id string, t Team) (Team, error) {
+	if strings.TrimSpace(t.Name) == "" {
+		return Team{}, fmt.Errorf("team name is required")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	existing, ok := d.teams[id]
+	if !ok {
+		return Team{}, &NotFoundError{fmt.Sprintf("team %s not found", id)}
+	}
+	if d.teamNameTaken(t.Name, id) {
+		return Team{}, &ConflictError{fmt.Sprintf("team %s already exists", t.Name)}
+	}
+	if err := d.checkMembers(t.Members); err != nil {
+		return Team{}, err
+	}
+	t.ID = id
+	t.Members = unique(t.Members)
+	t.CreatedAt = existing.CreatedAt
+	t.UpdatedAt = time.Now()
+	d.teams[id] = &t
+	return copyTeam(&t), d.save()
+}
+
+// DeleteTeam removes a team and its bindings
+func (d *Directory) DeleteTeam(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.teams[id]; !ok {
+		return &NotFoundError{fmt.Sprintf("team %s not found", id)}
+	}
+	subject := TeamSubject(id)
+	for bindingID, b := range d.bindings {
+		if b.Subject == subject {
+			delete(d.bindings, bindingID)
+		}
+	}
+	delete(d.teams, id)
+	return d.save()
+}
+
+// teamNameTaken reports whether another team has the name. Callers must
+// hold d.mu.
+func (d *Directory) teamNameTaken(name, exceptID string) bool {
+	for _, t := range d.teams {
+		if t.ID != exceptID && strings.EqualFold(t.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMembers returns an error for member IDs that are not users. Callers
+// must hold d.mu.
+func (d *Directory) checkMembers(members []string) error {
+	for _, id := range members {
+		if _, ok := d.users[id]; !ok {
+			return fmt.Errorf("member %s is not a user", id)
+		}
+	}
+	return nil
+}
+
+// IssueToken creates an API token for an active user and returns it with
+// its secret value, which is not stored and cannot be retrieved later. A
+// zero ttl creates a token that does not expire.
+func (d *Directory) IssueToken(userID, name string, ttl time.Duration) (Token, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	u, ok := d.users[userID]
+	if !ok {
+		return Token{}, "", &NotFoundError{fmt.Sprintf("user %s not found", userID)}
+	}
+	if !u.Active {
+		return Token{}, "", fmt.Errorf("user %s is not active", u.UserName)
+	}
+
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return Token{}, "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	secret := "cvy_" + hex.EncodeToString(raw)
+
+	now := time.Now()
+	token := &storedToken{
+		Token: Token{ID: newID("token"), UserID: userID, Name: name, CreatedAt: now},
+		Hash:  hashToken(secret),
+	}
+	if ttl > 0 {
+		token.ExpiresAt = now.Add(ttl)
+	}
+	d.tokens[token.ID] = token
+	return token.Token, secret, d.save()
+}
+
+// ListTokens returns the tokens of a user, or of every user when userID is
+// empty, newest first
+func (d *Directory) ListTokens(userID string) []Token {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	tokens := []Token{}
+	for _, t := range d.tokens {
+		if userID == "" || t.UserID == userID {
+			tokens = append(tokens, t.Token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+	return tokens
+}
+
+// RevokeToken revokes a token
+func (d *Directory) RevokeToken(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.tokens[id]
+	if !ok {
+		return &NotFoundError{fmt.Sprintf("token %s not found", id)}
+	}
+	if t.RevokedAt.IsZero() {
+		t.RevokedAt = time.Now()
+	}
+	return d.save()
+}
+
+// ListBindings returns every binding ordered by subject
+func (d *Directory) ListBindings() []Binding {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	bindings := make([]Binding, 0, len(d.bindings))
+	for _, b := range d.bindings {
+		bindings = append(bindings, *b)
+	}
+	sort.Slice(bindings, func(i, j int) bool {
+		if bindings[i].Subject != bindings[j].Subject {
+			return bindings[i].Subject < bindings[j].Subject
+		}
+		return bindings[i].CreatedAt.Before(bindings[j].CreatedAt)
+	})
+	return bindings
+}
+
+// CreateBinding grants a role to an existing user or team
+func (d *Directory) CreateBinding(b Binding) (Binding, error) {
+	if !b.Role.Valid() {
+		return Binding{}, fmt.Errorf("unknown role %q", b.Role)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(b.Subject, "user:"):
+		u, ok := d.users[strings.TrimPrefix(b.Subject, "user:")]
+		if !ok {
+			return Binding{}, fmt.Errorf("subject %s is not a user", b.Subject)
+		}
+		if !u.Active {
+			return Binding{}, fmt.Errorf("user %s is not active", u.UserName)
+		}
+	case strings.HasPrefix(b.Subject, "team:"):
+		if _, ok := d.teams[strings.TrimPrefix(b.Subject, "team:")]; !ok {
+			return Binding{}, fmt.Errorf("subject %s is not a team", b.Subject)
+		}
+	default:
+		return Binding{}, fmt.Errorf("subject must be user:<id> or team:<id>")
+	}
+
+	b.ID = newID("binding")
+	b.CreatedAt = time.Now()
+	d.bindings[b.ID] = &b
+	return b, d.save()
+}
+
+// DeleteBinding removes a binding
+func (d *Directory) DeleteBinding(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.bindings[id]; !ok {
+		return &NotFoundError{fmt.Sprintf("binding %s not found", id)}
+	}
+	delete(d.bindings, id)
+	return d.save()
+}
+
+// save writes the directory to disk. Callers must hold d.mu for writing.
+func (d *Directory) save() error {
+	s := state{
+		Users:    make([]*User, 0, len(d.users)),
+		Teams:    make([]*Team, 0, len(d.teams)),
+		Tokens:   make([]*storedToken, 0, len(d.tokens)),
+		Bindings: make([]*Binding, 0, len(d.bindings)),
+	}
+	for _, u := range d.users {
+		s.Users = append(s.Users, u)
+	}
+	for _, t := range d.teams {
+		s.Teams = append(s.Teams, t)
+	}
+	for _, t := range d.tokens {
+		s.Tokens = append(s.Tokens, t)
+	}
+	for _, b := range d.bindings {
+		s.Bindings = append(s.Bindings, b)
+	}
+	sort.Slice(s.Users, func(i, j int) bool { return s.Users[i].ID < s.Users[j].ID })
+	sort.Slice(s.Teams, func(i, j int) bool { return s.Teams[i].ID < s.Teams[j].ID })
+	sort.Slice(s.Tokens, func(i, j int) bool { return s.Tokens[i].ID < s.Tokens[j].ID })
+	sort.Slice(s.Bindings, func(i, j int) bool { return s.Bindings[i].ID < s.Bindings[j].ID })
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode auth directory: %w", err)
+	}
+	tmp := d.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write auth directory: %w", err)
+	}
+	return os.Rename(tmp, d.path)
+}
+
+// hashToken returns the stored form of a token secret
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func copyTeam(t *Team) Team {
+	copied := *t
+	copied.Members = append([]string{}, t.Members...)
+	return copied
+}
+
+func unique(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	result := []string{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+func without(ids []string, id string) []string {
+	result := ids[:0]
+	for _, existing := range ids {
+		if existing != id {
+			result = append(result, existing)
+		}
+	}
+	return result
+}
+
+// NotFoundError reports a missing user, team, token or binding
+type NotFoundError struct{ msg string }
+
+func (e *NotFoundError) Error() string { return e.msg }
+
+// ConflictError reports a user or team name that is already taken
+type ConflictError struct{ msg string }
+
+func (e *ConflictError) Error() string { return e.msg }
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestDirectory(t *testing.T) *Directory {
+	t.Helper()
+	dir, err := NewDirectory(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDirectory() error = %v", err)
+	}
+	return dir
+}
+
+func createUser(t *testing.T, dir *Directory, name string) User {
+	t.Helper()
+	u, err := dir.CreateUser(User{UserName: name, Active: true})
+	if err != nil {
+		t.Fatalf("CreateUser(%s) error = %v", name, err)
+	}
+	return u
+}
+
+func TestAuthenticate_Bindings(t *testing.T) {
+	dir := newTestDirectory(t)
+	alice := createUser(t, dir, "alice")
+	team, err := dir.CreateTeam(Team{Name: "platform", Members: []string{alice.ID}})
+	if err != nil {
+		t.Fatalf("CreateTeam() error = %v", err)
+	}
+	if _, err := dir.CreateBinding(Binding{Subject: TeamSubject(team.ID), Role: RoleViewer}); err != nil {
+		t.Fatalf("CreateBinding() error = %v", err)
+	}
+	if _, err := dir.CreateBinding(Binding{Subject: UserSubject(alice.ID), Role: RoleDeveloper, Pipeline: "deploy"}); err != nil {
+		t.Fatalf("CreateBinding() error = %v", err)
+	}
+
+	_, secret, err := dir.IssueToken(alice.ID, "laptop", 0)
+	if err != nil {
+		t.Fatalf("IssueToken() error = %v", err)
+	}
+	p, err := dir.Authenticate(secret)
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+
+	tests := []struct {
+		action   Action
+		pipeline string
+		want     bool
+	}{
+		{ActionRead, "build", true},
+		{ActionWrite, "build", false},
+		{ActionWrite, "deploy", true},
+		{ActionAdmin, "deploy", false},
+	}
+	for _, tt := range tests {
+		if got := p.Can(tt.action, tt.pipeline); got != tt.want {
+			t.Errorf("Can(%s, %s) = %v, want %v", tt.action, tt.pipeline, got, tt.want)
+		}
+	}
+	if !p.CanAny(ActionWrite) || p.CanAny(ActionAdmin) {
+		t.Errorf("CanAny() = %v, %v, want write on a pipeline but no admin", p.CanAny(ActionWrite), p.CanAny(ActionAdmin))
+	}
+
+	if _, err := dir.Authenticate("cvy_wrong"); err == nil {
+		t.Error("Authenticate() with unknown token expected error")
+	}
+}
+
+func TestDeactivateUser_RevokesAccess(t *testing.T) {
+	dir := newTestDirectory(t)
+	bob := createUser(t, dir, "bob")
+	token, secret, err := dir.IssueToken(bob.ID, "ci", 0)
+	if err != nil {
+		t.Fatalf("IssueToken() error = %v", err)
+	}
+	if _, err := dir.CreateBinding(Binding{Subject: UserSubject(bob.ID), Role: RoleAdmin}); err != nil {
+		t.Fatalf("CreateBinding() error = %v", err)
+	}
+
+	bob.Active = false
+	if _, err := dir.ReplaceUser(bob.ID, bob); err != nil {
+		t.Fatalf("ReplaceUser() error = %v", err)
+	}
+
+	if _, err := dir.Authenticate(secret); err == nil {
+		t.Error("Authenticate() succeeded for deactivated user")
+	}
+	tokens := dir.ListTokens(bob.ID)
+	if len(tokens) != 1 || tokens[0].ID != token.ID || tokens[0].RevokedAt.IsZero() {
+		t.Errorf("tokens = %+v, want token %s revoked", tokens, token.ID)
+	}
+	if bindings := dir.ListBindings(); len(bindings) != 0 {
+		t.Errorf("bindings = %+v, want none after deactivation", bindings)
+	}
+
+	// Reactivation does not restore access
+	bob.Active = true
+	if _, err := dir.ReplaceUser(bob.ID, bob); err != nil {
+		t.Fatalf("ReplaceUser() error = %v", err)
+	}
+	if _, err := dir.Authenticate(secret); err == nil {
+		t.Error("Authenticate() succeeded with token revoked before reactivation")
+	}
+}
+
+func TestDeleteUserAndTeam(t *testing.T) {
+	dir := newTestDirectory(t)
+	carol := createUser(t, dir, "carol")
+	team, err := dir.CreateTeam(Team{Name: "release", Members: []string{carol.ID}})
+	if err != nil {
+		t.Fatalf("CreateTeam() error = %v", err)
+	}
+	if _, err := dir.CreateBinding(Binding{Subject: TeamSubject(team.ID), Role: RoleDeveloper}); err != nil {
+		t.Fatalf("CreateBinding() error = %v", err)
+	}
+
+	if err := dir.DeleteUser(carol.ID); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	if got, _ := dir.GetTeam(team.ID); len(got.Members) != 0 {
+		t.Errorf("team members = %v, want none after deleting the user", got.Members)
+	}
+
+	if err := dir.DeleteTeam(team.ID); err != nil {
+		t.Fatalf("DeleteTeam() error = %v", err)
+	}
+	if bindings := dir.ListBindings(); len(bindings) != 0 {
+		t.Errorf("bindings = %+v, want none after deleting the team", bindings)
+	}
+}
+
+func TestDirectory_Persistence(t *testing.T) {
+	path := t.TempDir()
+	dir, err := NewDirectory(path)
+	if err != nil {
+		t.Fatalf("NewDirectory() error = %v", err)
+	}
+	dave := createUser(t, dir, "dave")
+	_, secret, err := dir.IssueToken(dave.ID, "expiring", time.Hour)
+	if err != nil {
+		t.Fatalf("IssueToken() error = %v", err)
+	}
+	if _, err := dir.CreateUser(User{UserName: "DAVE", Active: true}); err == nil {
+		t.Error("CreateUser() with duplicate user name expected error")
+	}
+
+	reopened, err := NewDirectory(path)
+	if err != nil {
+		t.Fatalf("NewDirectory() reopen error = %v", err)
+	}
+	p, err := reopened.Authenticate(secret)
+	if err != nil {
+		t.Fatalf("Authenticate() after reopen error = %v", err)
+	}
+	if p.User.UserName != "dave" {
+		t.Errorf("principal = %s, want dave", p.User.UserName)
+	}
+}
+
+func TestDirectory_Reload(t *testing.T) {
+	path := t.TempDir()
+	writer, err := NewDirectory(path)
+	if err != nil {
+		t.Fatalf("NewDirectory() error = %v", err)
+	}
+	erin := createUser(t, writer, "erin")
+	frank := createUser(t, writer, "frank")
+	token, secret, _ := writer.IssueToken(erin.ID, "laptop", 0)
+	_, frankSecret, _ := writer.IssueToken(frank.ID, "ci", 0)
+
+	observer, err := NewDirectory(path)
+	if err != nil {
+		t.Fatalf("NewDirectory() observer error = %v", err)
+	}
+	if _, err := observer.Authenticate(secret); err != nil {
+		t.Fatalf("observer Authenticate() error = %v", err)
+	}
+
+	// A token revoked and a user deactivated by the writer are rejected
+	// once the observer reloads
+	if err := writer.RevokeToken(token.ID); err != nil {
+		t.Fatalf("RevokeToken() error = %v", err)
+	}
+	frank.Active = false
+	if _, err := writer.ReplaceUser(frank.ID, frank); err != nil {
+		t.Fatalf("ReplaceUser() error = %v", err)
+	}
+	if err := observer.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if _, err := observer.Authenticate(secret); err == nil {
+		t.Error("observer Authenticate() succeeded with a revoked token")
+	}
+	if _, err := observer.Authenticate(frankSecret); err == nil {
+		t.Error("observer Authenticate() succeeded for a deactivated user")
+	}
+}
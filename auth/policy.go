@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxPolicyDecisions bounds the decisions a policy caches
+const maxPolicyDecisions = 10000
+
+// PolicyInput is what a policy service decides on: whether a principal may
+// perform an action on a resource
+type PolicyInput struct {
+	Principal PolicyPrincipal `json:"principal"`
+	Action    Action          `json:"action"`
+	Resource  PolicyResource  `json:"resource"`
+}
+
+// PolicyPrincipal describes the caller of a request to a policy service
+type PolicyPrincipal struct {
+	Name     string    `json:"name"`
+	UserID   string    `json:"userId,omitempty"`
+	Email    string    `json:"email,omitempty"`
+	Teams    []string  `json:"teams,omitempty"`
+	Bindings []Binding `json:"bindings"`
+}
+
+// PolicyResource is what a request is about. Pipeline is empty for
+// requests about no pipeline or all of them.
+type PolicyResource struct {
+	Pipeline string `json:"pipeline,omitempty"`
+	Method   string `json:"method"`
+	Route    string `json:"route"`
+}
+
+// NewPolicyInput returns the input of a principal's request
+func NewPolicyInput(p *Principal, action Action, resource PolicyResource) PolicyInput {
+	input := PolicyInput{
+		Principal: PolicyPrincipal{Name: p.Name(), Teams: p.Teams, Bindings: p.Bindings},
+		Action:    action,
+		Resource:  resource,
+	}
+	if p.User != nil {
+		input.Principal.UserID = p.User.ID
+		input.Principal.Email = p.User.Email
+	}
+	return input
+}
+
+// Policy delegates authorization decisions to an external service. A plain
+// HTTP service is posted the input and answers {"allow": bool}; an OPA
+// decision endpoint is posted {"input": ...} and answers {"result": bool}
+// or {"result": {"allow": bool}}. Decisions are cached for CacheTTL.
+type Policy struct {
+	URL string
+	// OPA selects the OPA request and response format
+	OPA bool
+	// Token is sent as a bearer token, if set
+	Token string
+	// FailOpen allows requests the service fails to decide on, which are
+	// denied otherwise
+	FailOpen bool
+	CacheTTL time.Duration
+	Client   *http.Client
+
+	mu        sync.Mutex
+	decisions map[string]policyDecision
+}
+
+// policyDecision is a cached decision
+type policyDecision struct {
+	allow   bool
+	expires time.Time
+}
+
+// Decide reports whether the policy allows a request. When the service
+// fails, it returns the error along with FailOpen as the decision.
+func (p *Policy) Decide(ctx context.Context, input PolicyInput) (bool, error) {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return p.FailOpen, err
+	}
+	key := string(body)
+	if allow, ok := p.cached(key); ok {
+		return allow, nil
+	}
+
+	if p.OPA {
+		body, err = json.Marshal(map[string]PolicyInput{"input": input})
+		if err != nil {
+			return p.FailOpen, err
+		}
+	}
+	allow, err := p.query(ctx, body)
+	if err != nil {
+		return p.FailOpen, err
+	}
+	p.cache(key, allow)
+	return allow, nil
+}
+
+// query posts a request body to the service and returns its decision
+func (p *Policy) query(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("policy service: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return false, fmt.Errorf("policy service: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("policy service returned %s", resp.Status)
+	}
+
+	if !p.OPA {
+		var decision struct {
+			Allow *bool `json:"allow"`
+		}
+		if err := json.Unmarshal(data, &decision); err != nil || decision.Allow == nil {
+			return false, fmt.Errorf("policy service answered without an allow decision")
+		}
+		return *decision.Allow, nil
+	}
+
+	// OPA answers without a result when the policy is undefined
+	var decision struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(data, &decision); err != nil || len(decision.Result) == 0 {
+		return false, fmt.Errorf("policy service answered without a result")
+	}
+	var allow bool
+	if err := json.Unmarshal(decision.Result, &allow); err == nil {
+		return allow, nil
+	}
+	var result struct {
+		Allow *bool `json:"allow"`
+	}
+	if err := json.Unmarshal(decision.Result, &result); err != nil || result.Allow == nil {
+		return false, fmt.Errorf("policy service result has no allow decision")
+	}
+	return *result.Allow, nil
+}
+
+// cached returns the unexpired decision on an input, if any
+func (p *Policy) cached(key string) (allow, ok bool) {
+	if p.CacheTTL <= 0 {
+		return false, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d, ok := p.decisions[key]
+	if !ok || time.Now().After(d.expires) {
+		return false, false
+	}
+	return d.allow, true
+}
+
+// cache keeps a decision for CacheTTL. When the cache is full, expired
+// decisions are dropped, and all of them if none has expired.
+func (p *Policy) cache(key string, allow bool) {
+	if p.CacheTTL <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if len(p.decisions) >= maxPolicyDecisions {
+		for k, d := range p.decisions {
+			if now.After(d.expires) {
+				delete(p.decisions, k)
+			}
+		}
+	}
+	if p.decisions == nil || len(p.decisions) >= maxPolicyDecisions {
+		p.decisions = make(map[string]policyDecision)
+	}
+	p.decisions[key] = policyDecision{allow: allow, expires: now.Add(p.CacheTTL)}
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func policyInput(pipeline string) PolicyInput {
+	alice := &Principal{User: &User{ID: "u1", UserName: "alice"}, Teams: []string{"platform"}}
+	return NewPolicyInput(alice, ActionWrite, PolicyResource{Pipeline: pipeline, Method: "POST", Route: "/api/pipelines/:id/run"})
+}
+
+func TestPolicy_Decide(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var input PolicyInput
+		json.NewDecoder(r.Body).Decode(&input)
+		allow := input.Principal.Name == "alice" && input.Resource.Pipeline == "build"
+		json.NewEncoder(w).Encode(map[string]bool{"allow": allow})
+	}))
+	defer server.Close()
+
+	policy := &Policy{URL: server.URL, Token: "secret", CacheTTL: time.Minute}
+	for _, tt := range []struct {
+		pipeline string
+		want     bool
+	}{{"build", true}, {"deploy", false}, {"build", true}, {"deploy", false}} {
+		allow, err := policy.Decide(context.Background(), policyInput(tt.pipeline))
+		if err != nil || allow != tt.want {
+			t.Errorf("Decide(%s) = %v, %v, want %v", tt.pipeline, allow, err, tt.want)
+		}
+	}
+	// Both decisions are cached
+	if calls != 2 {
+		t.Errorf("policy service called %d times, want 2", calls)
+	}
+}
+
+func TestPolicy_OPA(t *testing.T) {
+	results := []string{`{"result": true}`, `{"result": {"allow": false}}`, `{}`}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]PolicyInput
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["input"].Action != ActionWrite {
+			t.Errorf("request body isn't an OPA input: %v", err)
+		}
+		w.Write([]byte(results[0]))
+		results = results[1:]
+	}))
+	defer server.Close()
+
+	policy := &Policy{URL: server.URL, OPA: true}
+	if allow, err := policy.Decide(context.Background(), policyInput("build")); !allow || err != nil {
+		t.Errorf("Decide() = %v, %v, want a boolean result allowed", allow, err)
+	}
+	if allow, err := policy.Decide(context.Background(), policyInput("build")); allow || err != nil {
+		t.Errorf("Decide() = %v, %v, want an allow: false result denied", allow, err)
+	}
+	// An undefined decision is an error
+	if _, err := policy.Decide(context.Background(), policyInput("build")); err == nil {
+		t.Error("Decide() without a result error = nil")
+	}
+}
+
+func TestPolicy_Failure(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	closed := &Policy{URL: server.URL, CacheTTL: time.Minute}
+	if allow, err := closed.Decide(context.Background(), policyInput("build")); allow || err == nil {
+		t.Errorf("fail-closed Decide() = %v, %v, want denied with an error", allow, err)
+	}
+	open := &Policy{URL: server.URL, CacheTTL: time.Minute, FailOpen: true}
+	if allow, err := open.Decide(context.Background(), policyInput("build")); !allow || err == nil {
+		t.Errorf("fail-open Decide() = %v, %v, want allowed with an error", allow, err)
+	}
+	// Failures aren't cached
+	open.Decide(context.Background(), policyInput("build"))
+	if calls != 3 {
+		t.Errorf("policy service called %d times, want 3", calls)
+	}
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Role is a built-in set of permissions
+type Role string
+
+const (
+	// RoleViewer can read pipelines, jobs and logs
+	RoleViewer Role = "viewer"
+	// RoleDeveloper can also run, cancel and edit pipelines
+	RoleDeveloper Role = "developer"
+	// RoleAdmin can also manage tokens, bindings and server settings
+	RoleAdmin Role = "admin"
+)
+
+// Action is what a request does
+type Action string
+
+const (
+	ActionRead  Action = "read"
+	ActionWrite Action = "write"
+	ActionAdmin Action = "admin"
+)
+
+// Valid reports whether the role is a built-in role
+func (r Role) Valid() bool {
+	switch r {
+	case RoleViewer, RoleDeveloper, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+// Allows reports whether the role permits an action
+func (r Role) Allows(action Action) bool {
+	switch r {
+	case RoleAdmin:
+		return true
+	case RoleDeveloper:
+		return action == ActionRead || action == ActionWrite
+	case RoleViewer:
+		return action == ActionRead
+	}
+	return false
+}
+
+// Principal is the caller of an authenticated request
+type Principal struct {
+	// User is empty for the bootstrap admin token
+	User     *User     `json:"user,omitempty"`
+	Teams    []string  `json:"teams,omitempty"`
+	Bindings []Binding `json:"bindings"`
+	TokenID  string    `json:"tokenId,omitempty"`
+}
+
+// Name identifies the principal in logs and audit records
+func (p *Principal) Name() string {
+	if p.User == nil {
+		return "admin"
+	}
+	return p.User.UserName
+}
+
+// Can reports whether the principal may perform an action on a pipeline.
+// An empty pipelineID asks for permission across all pipelines.
+func (p *Principal) Can(action Action, pipelineID string) bool {
+	for _, b := range p.Bindings {
+		if b.Pipeline != "" && b.Pipeline != pipelineID {
+			continue
+		}
+		if b.Role.Allows(action) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAny reports whether the principal may perform an action on at least
+// one pipeline
+func (p *Principal) CanAny(action Action) bool {
+	for _, b := range p.Bindings {
+		if b.Role.Allows(action) {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminPrincipal is the principal of the bootstrap admin token
+func AdminPrincipal() *Principal {
+	return &Principal{Bindings: []Binding{{Subject: "admin", Role: RoleAdmin}}}
+}
+
+// Authenticate resolves an API token to its principal. Revoked and expired
+// tokens and tokens of inactive users are rejected.
+func (d *Directory) Authenticate(secret string) (*Principal, error) {
+	hash := hashToken(secret)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var token *storedToken
+	for _, t := range d.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			token = t
+			break
+		}
+	}
+	if token == nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	now := time.Now()
+	if !token.RevokedAt.IsZero() {
+		return nil, fmt.Errorf("token has been revoked")
+	}
+	if !token.ExpiresAt.IsZero() && now.After(token.ExpiresAt) {
+		return nil, fmt.Errorf("token has expired")
+	}
+	u, ok := d.users[token.UserID]
+	if !ok || !u.Active {
+		return nil, fmt.Errorf("user is not active")
+	}
+
+	// Last use is tracked in memory and persisted with the next change
+	token.LastUsedAt = now
+
+	user := *u
+	p := &Principal{User: &user, Teams: d.teamsOf(u.ID), TokenID: token.ID, Bindings: []Binding{}}
+	subjects := map[string]bool{UserSubject(u.ID): true}
+	for _, teamID := range p.Teams {
+		subjects[TeamSubject(teamID)] = true
+	}
+	for _, b := range d.bindings {
+		if subjects[b.Subject] {
+			p.Bindings = append(p.Bindings, *b)
+		}
+	}
+	return p, nil
+}
+
+// BearerToken extracts the token of an "Authorization: Bearer" header
+func BearerToken(header string) string {
+	const prefix = "bearer "
+	if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+		return strings.TrimSpace(header[len(prefix):])
+	}
+	return ""
+}
+
+// TokenEqual compares a presented token with a configured one in constant
+// time
+func TokenEqual(presented, configured string) bool {
+	if presented == "" || configured == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(configured)) == 1
+}
@@ -0,0 +1,680 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCIM 2.0 schema URNs
+const (
+	SchemaUser         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SchemaGroup        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	SchemaListResponse = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SchemaPatchOp      = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SchemaError        = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// SCIMMeta is the meta attribute of a SCIM resource
+type SCIMMeta struct {
+	ResourceType string `json:"resourceType"`
+	Created      string `json:"created,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Location     string `json:"location,omitempty"`
+}
+
+// SCIMName is the name attribute of a SCIM user
+type SCIMName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// SCIMValue is an entry of a multi-valued SCIM attribute
+type SCIMValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+// SCIMUser is a user in SCIM 2.0 representation
+type SCIMUser struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	Name        *SCIMName   `json:"name,omitempty"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Emails      []SCIMValue `json:"emails,omitempty"`
+	Active      *bool       `json:"active,omitempty"`
+	Groups      []SCIMValue `json:"groups,omitempty"`
+	Meta        *SCIMMeta   `json:"meta,omitempty"`
+}
+
+// SCIMGroup is a team in SCIM 2.0 representation
+type SCIMGroup struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	DisplayName string      `json:"displayName"`
+	Members     []SCIMValue `json:"members"`
+	Meta        *SCIMMeta   `json:"meta,omitempty"`
+}
+
+// SCIMListResponse is a page of SCIM resources
+type SCIMListResponse struct {
+	Schemas      []string    `json:"schemas"`
+	TotalResults int         `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	ItemsPerPage int         `json:"itemsPerPage"`
+	Resources    interface{} `json:"Resources"`
+}
+
+// SCIMPatchOperation is a single operation of a SCIM PATCH request
+type SCIMPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// SCIMPatchRequest is the body of a SCIM PATCH request
+type SCIMPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []SCIMPatchOperation `json:"Operations"`
+}
+
+// SCIMError is an error in SCIM 2.0 representation
+type SCIMError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+	code     int
+}
+
+func (e *SCIMError) Error() string { return e.Detail }
+
+// Code returns the HTTP status code of the error
+func (e *SCIMError) Code() int { return e.code }
+
+// NewSCIMError creates a SCIM error with a status code and scimType
+func NewSCIMError(code int, scimType, detail string) *SCIMError {
+	return &SCIMError{
+		Schemas:  []string{SchemaError},
+		Status:   strconv.Itoa(code),
+		ScimType: scimType,
+		Detail:   detail,
+		code:     code,
+	}
+}
+
+// AsSCIMError converts a directory error to a SCIM error
+func AsSCIMError(err error) *SCIMError {
+	var scimErr *SCIMError
+	var notFound *NotFoundError
+	var conflict *ConflictError
+	switch {
+	case errors.As(err, &scimErr):
+		return scimErr
+	case errors.As(err, &notFound):
+		return NewSCIMError(http.StatusNotFound, "", err.Error())
+	case errors.As(err, &conflict):
+		return NewSCIMError(http.StatusConflict, "uniqueness", err.Error())
+	default:
+		return NewSCIMError(http.StatusBadRequest, "invalidValue", err.Error())
+	}
+}
+
+// SCIM serves the users and teams of a directory as SCIM 2.0 resources.
+// baseURL arguments are the URL the SCIM endpoints are served at and are
+// used for resource locations.
+type SCIM struct {
+	dir *Directory
+}
+
+// NewSCIM creates a SCIM service for a directory
+func NewSCIM(dir *Directory) *SCIM {
+	return &SCIM{dir: dir}
+}
+
+// ListUsers returns the users matching a SCIM filter. startIndex is 1-based;
+// a negative count returns every match.
+func (s *SCIM) ListUsers(filter string, startIndex, count int, baseURL string) (*SCIMListResponse, error) {
+	match, err := parseFilter(filter, map[string]func(interface{}) string{
+		"id":          func(r interface{}) string { return r.(User).ID },
+		"username":    func(r interface{}) string { return r.(User).UserName },
+		"externalid":  func(r interface{}) string { return r.(User).ExternalID },
+		"displayname": func(r interface{}) string { return r.(User).DisplayName },
+		"emails.value": func(r interface{}) string {
+			return r.(User).Email
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	teams := s.dir.ListTeams()
+	resources := []SCIMUser{}
+	for _, u := range s.dir.ListUsers() {
+		if match(u) {
+			resources = append(resources, toSCIMUser(u, teams, baseURL))
+		}
+	}
+	total := len(resources)
+	start, end := page(total, startIndex, count)
+	return listResponse(total, startIndex, resources[start:end], end-start), nil
+}
+
+// GetUser returns a user as a SCIM resource
+func (s *SCIM) GetUser(id, baseURL string) (*SCIMUser, error) {
+	u, ok := s.dir.GetUser(id)
+	if !ok {
+		return nil, &NotFoundError{fmt.Sprintf("user %s not found", id)}
+	}
+	resource := toSCIMUser(u, s.dir.ListTeams(), baseURL)
+	return &resource, nil
+}
+
+// CreateUser provisions a user. Users are active unless the resource says
+// otherwise.
+func (s *SCIM) CreateUser(resource SCIMUser, baseURL string) (*SCIMUser, error) {
+	u, err := s.dir.CreateUser(fromSCIMUser(resource))
+	if err != nil {
+		return nil, err
+	}
+	return s.GetUser(u.ID, baseURL)
+}
+
+// ReplaceUser replaces a user. Setting active to false deactivates the
+// user, which revokes their tokens and role bindings.
+func (s *SCIM) ReplaceUser(id string, resource SCIMUser, baseURL string) (*SCIMUser, error) {
+	if _, err := s.dir.ReplaceUser(id, fromSCIMUser(resource)); err != nil {
+		return nil, err
+	}
+	return s.GetUser(id, baseURL)
+}
+
+// PatchUser applies SCIM PATCH operations to a user
+func (s *SCIM) PatchUser(id string, req SCIMPatchRequest, baseURL string) (*SCIMUser, error) {
+	u, ok := s.dir.GetUser(id)
+	if !ok {
+		return nil, &NotFoundError{fmt.Sprintf("user %s not found", id)}
+	}
+
+	for _, op := range req.Operations {
+		if err := patchUser(&u, op); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := s.dir.ReplaceUser(id, u); err != nil {
+		return nil, err
+	}
+	return s.GetUser(id, baseURL)
+}
+
+// DeleteUser deprovisions a user
+func (s *SCIM) DeleteUser(id string) error {
+	return s.dir.DeleteUser(id)
+}
+
+// ListGroups returns the teams matching a SCIM filter
+func (s *SCIM) ListGroups(filter string, startIndex, count int, baseURL string) (*SCIMListResponse, error) {
+	match, err := parseFilter(filter, map[string]func(interface{}) string{
+		"id":          func(r interface{}) string { return r.(Team).ID },
+		"displayname": func(r interface{}) string { return r.(Team).Name },
+		"externalid":  func(r interface{}) string { return r.(Team).ExternalID },
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	names := s.userNames()
+	resources := []SCIMGroup{}
+	for _, t := range s.dir.ListTeams() {
+		if match(t) {
+			resources = append(resources, toSCIMGroup(t, names, baseURL))
+		}
+	}
+	total := len(resources)
+	start, end := page(total, startIndex, count)
+	return listResponse(total, startIndex, resources[start:end], end-start), nil
+}
+
+// GetGroup returns a team as a SCIM resource
+func (s *SCIM) GetGroup(id, baseURL string) (*SCIMGroup, error) {
+	t, ok := s.dir.GetTeam(id)
+	if !ok {
+		return nil, &NotFoundError{fmt.Sprintf("group %s not found", id)}
+	}
+	resource := toSCIMGroup(t, s.userNames(), baseURL)
+	return &resource, nil
+}
+
+// CreateGroup provisions a team
+func (s *SCIM) CreateGroup(resource SCIMGroup, baseURL string) (*SCIMGroup, error) {
+	t, err := s.dir.CreateTeam(fromSCIMGroup(resource))
+	if err != nil {
+		return nil, err
+	}
+	return s.GetGroup(t.ID, baseURL)
+}
+
+// ReplaceGroup replaces a team's name and members
+func (s *SCIM) ReplaceGroup(id string, resource SCIMGroup, baseURL string) (*SCIMGroup, error) {
+	if _, err := s.dir.ReplaceTeam(id, fromSCIMGroup(resource)); err != nil {
+		return nil, err
+	}
+	return s.GetGroup(id, baseURL)
+}
+
+// PatchGroup applies SCIM PATCH operations to a team
+func (s *SCIM) PatchGroup(id string, req SCIMPatchRequest, baseURL string) (*SCIMGroup, error) {
+	t, ok := s.dir.GetTeam(id)
+	if !ok {
+		return nil, &NotFoundError{fmt.Sprintf("group %s not found", id)}
+	}
+
+	for _, op := range req.Operations {
+		if err := patchGroup(&t, op); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := s.dir.ReplaceTeam(id, t); err != nil {
+		return nil, err
+	}
+	return s.GetGroup(id, baseURL)
+}
+
+// DeleteGroup deprovisions a team and its role bindings
+func (s *SCIM) DeleteGroup(id string) error {
+	return s.dir.DeleteTeam(id)
+}
+
+// userNames maps user IDs to user names for group member display values
+func (s *SCIM) userNames() map[string]string {
+	names := make(map[string]string)
+	for _, u := range s.dir.ListUsers() {
+		names[u.ID] = u.UserName
+	}
+	return names
+}
+
+func toSCIMUser(u User, teams []Team, baseURL string) SCIMUser {
+	active := u.Active
+	resource := SCIMUser{
+		Schemas:     []string{SchemaUser},
+		ID:          u.ID,
+		ExternalID:  u.ExternalID,
+		UserName:    u.UserName,
+		DisplayName: u.DisplayName,
+		Active:      &active,
+		Meta:        meta("User", u.CreatedAt, u.UpdatedAt, baseURL+"/Users/"+u.ID),
+	}
+	if u.GivenName != "" || u.FamilyName != "" {
+		resource.Name = &SCIMName{
+			Formatted:  strings.TrimSpace(u.GivenName + " " + u.FamilyName),
+			GivenName:  u.GivenName,
+			FamilyName: u.FamilyName,
+		}
+	}
+	if u.Email != "" {
+		resource.Emails = []SCIMValue{{Value: u.Email, Type: "work", Primary: true}}
+	}
+	for _, t := range teams {
+		for _, member := range t.Members {
+			if member == u.ID {
+				resource.Groups = append(resource.Groups, SCIMValue{
+					Value:   t.ID,
+					Display: t.Name,
+					Ref:     baseURL + "/Groups/" + t.ID,
+				})
+				break
+			}
+		}
+	}
+	return resource
+}
+
+func fromSCIMUser(resource SCIMUser) User {
+	u := User{
+		ExternalID:  resource.ExternalID,
+		UserName:    resource.UserName,
+		DisplayName: resource.DisplayName,
+		Email:       primaryEmail(resource.Emails),
+		Active:      resource.Active == nil || *resource.Active,
+	}
+	if resource.Name != nil {
+		u.GivenName = resource.Name.GivenName
+		u.FamilyName = resource.Name.FamilyName
+	}
+	return u
+}
+
+func toSCIMGroup(t Team, names map[string]string, baseURL string) SCIMGroup {
+	resource := SCIMGroup{
+		Schemas:     []string{SchemaGroup},
+		ID:          t.ID,
+		ExternalID:  t.ExternalID,
+		DisplayName: t.Name,
+		Members:     []SCIMValue{},
+		Meta:        meta("Group", t.CreatedAt, t.UpdatedAt, baseURL+"/Groups/"+t.ID),
+	}
+	for _, id := range t.Members {
+		resource.Members = append(resource.Members, SCIMValue{
+			Value:   id,
+			Display: names[id],
+			Ref:     baseURL + "/Users/" + id,
+		})
+	}
+	return resource
+}
+
+func fromSCIMGroup(resource SCIMGroup) Team {
+	return Team{
+		ExternalID: resource.ExternalID,
+		Name:       resource.DisplayName,
+		Members:    memberIDs(resource.Members),
+	}
+}
+
+func meta(resourceType string, created, modified time.Time, location string) *SCIMMeta {
+	return &SCIMMeta{
+		ResourceType: resourceType,
+		Created:      created.UTC().Format(time.RFC3339),
+		LastModified: modified.UTC().Format(time.RFC3339),
+		Location:     location,
+	}
+}
+
+func listResponse(total, startIndex int, resources interface{}, items int) *SCIMListResponse {
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	return &SCIMListResponse{
+		Schemas:      []string{SchemaListResponse},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: items,
+		Resources:    resources,
+	}
+}
+
+// page returns the slice bounds of a 1-based SCIM page
+func page(total, startIndex, count int) (int, int) {
+	start := startIndex - 1
+	if start < 0 {
+		start = 0
+	}
+	if start > total {
+		start = total
+	}
+	end := total
+	if count >= 0 && start+count < end {
+		end = start + count
+	}
+	return start, end
+}
+
+func primaryEmail(emails []SCIMValue) string {
+	for _, e := range emails {
+		if e.Primary {
+			return e.Value
+		}
+	}
+	if len(emails) > 0 {
+		return emails[0].Value
+	}
+	return ""
+}
+
+func memberIDs(members []SCIMValue) []string {
+	ids := make([]string, 0, len(members))
+	for _, m := range members {
+		ids = append(ids, m.Value)
+	}
+	return ids
+}
+
+var filterPattern = regexp.MustCompile(`^\s*([A-Za-z.]+)\s+(?i:eq)\s+"((?:[^"\\]|\\.)*)"\s*$`)
+
+// parseFilter supports the `attribute eq "value"` filters identity
+// providers use to look up resources before provisioning them. Values are
+// compared ignoring case.
+func parseFilter(filter string, attrs map[string]func(interface{}) string) (func(interface{}) bool, error) {
+	if strings.TrimSpace(filter) == "" {
+		return func(interface{}) bool { return true }, nil
+	}
+
+	m := filterPattern.FindStringSubmatch(filter)
+	if m == nil {
+		return nil, NewSCIMError(http.StatusBadRequest, "invalidFilter", fmt.Sprintf("unsupported filter %q", filter))
+	}
+	get, ok := attrs[strings.ToLower(m[1])]
+	if !ok {
+		return nil, NewSCIMError(http.StatusBadRequest, "invalidFilter", fmt.Sprintf("unsupported filter attribute %q", m[1]))
+	}
+	value, err := strconv.Unquote(`"` + m[2] + `"`)
+	if err != nil {
+		return nil, NewSCIMError(http.StatusBadRequest, "invalidFilter", fmt.Sprintf("invalid filter value %q", m[2]))
+	}
+	return func(r interface{}) bool { return strings.EqualFold(get(r), value) }, nil
+}
+
+// attributePath strips the schema URN from a PATCH path
+func attributePath(path, schema string) string {
+	if strings.HasPrefix(strings.ToLower(path), strings.ToLower(schema)+":") {
+		path = path[len(schema)+1:]
+	}
+	return strings.TrimSpace(path)
+}
+
+// patchUser applies one PATCH operation to a user. Attributes conveyor
+// does not store, such as enterprise extension attributes, are ignored so
+// identity providers can sync them without errors.
+func patchUser(u *User, op SCIMPatchOperation) error {
+	kind := strings.ToLower(op.Op)
+	if kind != "add" && kind != "replace" && kind != "remove" {
+		return NewSCIMError(http.StatusBadRequest, "invalidSyntax", fmt.Sprintf("unsupported patch op %q", op.Op))
+	}
+
+	path := attributePath(op.Path, SchemaUser)
+	if path == "" {
+		if kind == "remove" {
+			return NewSCIMError(http.StatusBadRequest, "noTarget", "remove requires a path")
+		}
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &values); err != nil {
+			return NewSCIMError(http.StatusBadRequest, "invalidValue", "patch value must be an object when path is omitted")
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := setUserAttribute(u, attributePath(key, SchemaUser), values[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if kind == "remove" {
+		return setUserAttribute(u, path, nil)
+	}
+	return setUserAttribute(u, path, op.Value)
+}
+
+// setUserAttribute sets a user attribute from a JSON value, or clears it
+// when value is nil
+func setUserAttribute(u *User, path string, value json.RawMessage) error {
+	lower := strings.ToLower(path)
+	switch {
+	case lower == "active":
+		if value == nil {
+			return nil
+		}
+		active, err := parseBool(value)
+		if err != nil {
+			return err
+		}
+		u.Active = active
+	case lower == "username":
+		if value == nil {
+			return NewSCIMError(http.StatusBadRequest, "mutability", "userName cannot be removed")
+		}
+		return decodeString(value, &u.UserName)
+	case lower == "displayname":
+		return decodeString(value, &u.DisplayName)
+	case lower == "externalid":
+		return decodeString(value, &u.ExternalID)
+	case lower == "name.givenname":
+		return decodeString(value, &u.GivenName)
+	case lower == "name.familyname":
+		return decodeString(value, &u.FamilyName)
+	case lower == "name":
+		var name SCIMName
+		if value != nil {
+			if err := json.Unmarshal(value, &name); err != nil {
+				return NewSCIMError(http.StatusBadRequest, "invalidValue", "name must be an object")
+			}
+		}
+		u.GivenName = name.GivenName
+		u.FamilyName = name.FamilyName
+	case lower == "emails":
+		var emails []SCIMValue
+		if value != nil {
+			if err := json.Unmarshal(value, &emails); err != nil {
+				return NewSCIMError(http.StatusBadRequest, "invalidValue", "emails must be a list")
+			}
+		}
+		u.Email = primaryEmail(emails)
+	case strings.HasPrefix(lower, "emails[") && strings.HasSuffix(lower, "].value"):
+		return decodeString(value, &u.Email)
+	}
+	return nil
+}
+
+// patchGroup applies one PATCH operation to a team
+func patchGroup(t *Team, op SCIMPatchOperation) error {
+	kind := strings.ToLower(op.Op)
+	path := attributePath(op.Path, SchemaGroup)
+	lower := strings.ToLower(path)
+
+	switch {
+	case kind != "add" && kind != "replace" && kind != "remove":
+		return NewSCIMError(http.StatusBadRequest, "invalidSyntax", fmt.Sprintf("unsupported patch op %q", op.Op))
+
+	case path == "":
+		if kind == "remove" {
+			return NewSCIMError(http.StatusBadRequest, "noTarget", "remove requires a path")
+		}
+		var values struct {
+			DisplayName *string      `json:"displayName"`
+			ExternalID  *string      `json:"externalId"`
+			Members     *[]SCIMValue `json:"members"`
+		}
+		if err := json.Unmarshal(op.Value, &values); err != nil {
+			return NewSCIMError(http.StatusBadRequest, "invalidValue", "patch value must be an object when path is omitted")
+		}
+		if values.DisplayName != nil {
+			t.Name = *values.DisplayName
+		}
+		if values.ExternalID != nil {
+			t.ExternalID = *values.ExternalID
+		}
+		if values.Members != nil {
+			ids := memberIDs(*values.Members)
+			if kind == "add" {
+				ids = append(t.Members, ids...)
+			}
+			t.Members = unique(ids)
+		}
+
+	case lower == "displayname":
+		if kind == "remove" {
+			return NewSCIMError(http.StatusBadRequest, "mutability", "displayName cannot be removed")
+		}
+		return decodeString(op.Value, &t.Name)
+
+	case lower == "externalid":
+		if kind == "remove" {
+			t.ExternalID = ""
+			return nil
+		}
+		return decodeString(op.Value, &t.ExternalID)
+
+	case lower == "members":
+		var members []SCIMValue
+		if op.Value != nil {
+			if err := json.Unmarshal(op.Value, &members); err != nil {
+				return NewSCIMError(http.StatusBadRequest, "invalidValue", "members must be a list")
+			}
+		}
+		ids := memberIDs(members)
+		switch kind {
+		case "add":
+			t.Members = unique(append(t.Members, ids...))
+		case "replace":
+			t.Members = unique(ids)
+		case "remove":
+			if op.Value == nil {
+				t.Members = []string{}
+			}
+			for _, id := range ids {
+				t.Members = without(t.Members, id)
+			}
+		}
+
+	case strings.HasPrefix(lower, "members["):
+		// members[value eq "user-id"]
+		m := memberFilterPattern.FindStringSubmatch(path)
+		if m == nil || kind != "remove" {
+			return NewSCIMError(http.StatusBadRequest, "invalidPath", fmt.Sprintf("unsupported path %q", op.Path))
+		}
+		t.Members = without(t.Members, m[1])
+
+	default:
+		return NewSCIMError(http.StatusBadRequest, "invalidPath", fmt.Sprintf("unsupported path %q", op.Path))
+	}
+	return nil
+}
+
+var memberFilterPattern = regexp.MustCompile(`^(?i:members)\[\s*(?i:value)\s+(?i:eq)\s+"([^"]+)"\s*\]$`)
+
+// parseBool accepts JSON booleans and the "True"/"False" strings some
+// identity providers send
+func parseBool(value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		if b, err := strconv.ParseBool(strings.ToLower(s)); err == nil {
+			return b, nil
+		}
+	}
+	return false, NewSCIMError(http.StatusBadRequest, "invalidValue", "active must be a boolean")
+}
+
+// decodeString sets a string attribute from a JSON value, or clears it when
+// value is nil
+func decodeString(value json.RawMessage, target *string) error {
+	if value == nil {
+		*target = ""
+		return nil
+	}
+	if err := json.Unmarshal(value, target); err != nil {
+		return NewSCIMError(http.StatusBadRequest, "invalidValue", "value must be a string")
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+const testBaseURL = "https://ci.example.com/scim/v2"
+
+func patchRequest(t *testing.T, body string) SCIMPatchRequest {
+	t.Helper()
+	var req SCIMPatchRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("invalid patch request: %v", err)
+	}
+	return req
+}
+
+func TestSCIM_UserLifecycle(t *testing.T) {
+	dir := newTestDirectory(t)
+	scim := NewSCIM(dir)
+
+	created, err := scim.CreateUser(SCIMUser{
+		Schemas:    []string{SchemaUser},
+		UserName:   "erin@example.com",
+		ExternalID: "00u1",
+		Name:       &SCIMName{GivenName: "Erin", FamilyName: "Doe"},
+		Emails:     []SCIMValue{{Value: "erin@example.com", Primary: true}},
+	}, testBaseURL)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if created.Active == nil || !*created.Active {
+		t.Error("created user is not active by default")
+	}
+	if created.Meta.Location != testBaseURL+"/Users/"+created.ID {
+		t.Errorf("location = %s", created.Meta.Location)
+	}
+
+	list, err := scim.ListUsers(`userName eq "ERIN@example.com"`, 1, -1, testBaseURL)
+	if err != nil {
+		t.Fatalf("ListUsers() error = %v", err)
+	}
+	if list.TotalResults != 1 {
+		t.Errorf("TotalResults = %d, want 1", list.TotalResults)
+	}
+	if _, err := scim.ListUsers(`userName co "erin"`, 1, -1, testBaseURL); AsSCIMError(err).ScimType != "invalidFilter" {
+		t.Errorf("ListUsers() with unsupported filter error = %v, want invalidFilter", err)
+	}
+
+	_, secret, err := dir.IssueToken(created.ID, "cli", 0)
+	if err != nil {
+		t.Fatalf("IssueToken() error = %v", err)
+	}
+	if _, err := dir.CreateBinding(Binding{Subject: UserSubject(created.ID), Role: RoleDeveloper}); err != nil {
+		t.Fatalf("CreateBinding() error = %v", err)
+	}
+
+	// Azure AD sends active as a string
+	patched, err := scim.PatchUser(created.ID, patchRequest(t, `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [
+			{"op": "Replace", "path": "active", "value": "False"},
+			{"op": "replace", "path": "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department", "value": "Ops"}
+		]
+	}`), testBaseURL)
+	if err != nil {
+		t.Fatalf("PatchUser() error = %v", err)
+	}
+	if *patched.Active {
+		t.Error("user still active after patch")
+	}
+	if _, err := dir.Authenticate(secret); err == nil {
+		t.Error("token still valid after SCIM deactivation")
+	}
+	if len(dir.ListBindings()) != 0 {
+		t.Error("bindings remain after SCIM deactivation")
+	}
+
+	if err := scim.DeleteUser(created.ID); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	if _, err := scim.GetUser(created.ID, testBaseURL); AsSCIMError(err).Code() != http.StatusNotFound {
+		t.Errorf("GetUser() after delete error = %v, want 404", err)
+	}
+}
+
+func TestSCIM_GroupMembership(t *testing.T) {
+	dir := newTestDirectory(t)
+	scim := NewSCIM(dir)
+	frank := createUser(t, dir, "frank")
+	grace := createUser(t, dir, "grace")
+
+	group, err := scim.CreateGroup(SCIMGroup{
+		DisplayName: "Deployers",
+		Members:     []SCIMValue{{Value: frank.ID}},
+	}, testBaseURL)
+	if err != nil {
+		t.Fatalf("CreateGroup() error = %v", err)
+	}
+	if _, err := scim.CreateGroup(SCIMGroup{DisplayName: "deployers"}, testBaseURL); AsSCIMError(err).Code() != http.StatusConflict {
+		t.Errorf("CreateGroup() duplicate error = %v, want 409", err)
+	}
+
+	group, err = scim.PatchGroup(group.ID, patchRequest(t, `{"Operations": [
+		{"op": "add", "path": "members", "value": [{"value": "`+grace.ID+`"}]},
+		{"op": "remove", "path": "members[value eq \"`+frank.ID+`\"]"},
+		{"op": "replace", "value": {"displayName": "Release Managers"}}
+	]}`), testBaseURL)
+	if err != nil {
+		t.Fatalf("PatchGroup() error = %v", err)
+	}
+	if group.DisplayName != "Release Managers" {
+		t.Errorf("displayName = %s, want Release Managers", group.DisplayName)
+	}
+	if len(group.Members) != 1 || group.Members[0].Value != grace.ID || group.Members[0].Display != "grace" {
+		t.Errorf("members = %+v, want only grace", group.Members)
+	}
+
+	user, err := scim.GetUser(grace.ID, testBaseURL)
+	if err != nil {
+		t.Fatalf("GetUser() error = %v", err)
+	}
+	if len(user.Groups) != 1 || user.Groups[0].Display != "Release Managers" {
+		t.Errorf("groups = %+v, want Release Managers", user.Groups)
+	}
+
+	if _, err := scim.PatchGroup(group.ID, patchRequest(t, `{"Operations": [
+		{"op": "add", "path": "members", "value": [{"value": "user-missing"}]}
+	]}`), testBaseURL); err == nil {
+		t.Error("PatchGroup() with unknown member expected error")
+	}
+}
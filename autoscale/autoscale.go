@@ -0,0 +1,164 @@
+// Package autoscale applies runner scaling signals by calling a webhook,
+// resizing a Kubernetes workload or setting the desired capacity of an AWS
+// Auto Scaling group.
+package autoscale
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chip/conveyor/config"
+	"github.com/chip/conveyor/core"
+)
+
+// serviceAccountDir holds the token and CA of a pod's service account
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// New creates the scaler of a provider, or nil for a dry run without one
+func New(settings config.Autoscaling) (core.Scaler, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	switch settings.Provider {
+	case "":
+		return nil, nil
+	case "webhook":
+		return &WebhookScaler{URL: settings.URL, Client: client}, nil
+	case "kubernetes":
+		return newKubernetesScaler(settings.Kubernetes)
+	case "aws":
+		return &AWSScaler{
+			Region:          settings.AWS.Region,
+			Group:           settings.AWS.Group,
+			Endpoint:        settings.AWS.Endpoint,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			Client:          client,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported autoscaling provider %q", settings.Provider)
+	}
+}
+
+// WebhookScaler posts scaling signals as JSON to a URL
+type WebhookScaler struct {
+	URL    string
+	Client *http.Client
+}
+
+// Scale posts the signal to the webhook
+func (s *WebhookScaler) Scale(ctx context.Context, signal core.ScalingSignal) error {
+	body, err := json.Marshal(signal)
+	if err != nil {
+		return fmt.Errorf("failed to encode scaling signal: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create scaling request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return do(s.Client, req, "scaling webhook")
+}
+
+// KubernetesScaler sets the replicas of a deployment or statefulset through
+// its scale subresource
+type KubernetesScaler struct {
+	APIServer string
+	Namespace string
+	// Kind is "deployment" or "statefulset"
+	Kind   string
+	Name   string
+	Token  string
+	Client *http.Client
+}
+
+// newKubernetesScaler creates a Kubernetes scaler, defaulting the API
+// server, namespace, token and CA to the pod's service account
+func newKubernetesScaler(settings config.KubernetesScaling) (*KubernetesScaler, error) {
+	s := &KubernetesScaler{APIServer: settings.APIServer, Namespace: settings.Namespace, Kind: settings.Kind, Name: settings.Name}
+	if s.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			return nil, fmt.Errorf("kubernetes autoscaling requires an apiServer outside a cluster")
+		}
+		s.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if s.Namespace == "" {
+		namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes autoscaling requires a namespace: %w", err)
+		}
+		s.Namespace = strings.TrimSpace(string(namespace))
+	}
+	if s.Kind == "" {
+		s.Kind = "deployment"
+	}
+	tokenFile, caFile := settings.TokenFile, settings.CAFile
+	if tokenFile == "" {
+		tokenFile = serviceAccountDir + "/token"
+	}
+	if caFile == "" {
+		caFile = serviceAccountDir + "/ca.crt"
+	}
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubernetes token: %w", err)
+	}
+	s.Token = strings.TrimSpace(string(token))
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if ca, err := os.ReadFile(caFile); err == nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in kubernetes CA %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	} else if settings.CAFile != "" {
+		return nil, fmt.Errorf("failed to read kubernetes CA: %w", err)
+	}
+	s.Client = &http.Client{Timeout: 30 * time.Second, Transport: transport}
+	return s, nil
+}
+
+// Scale sets the workload's replicas to the desired runners
+func (s *KubernetesScaler) Scale(ctx context.Context, signal core.ScalingSignal) error {
+	url := fmt.Sprintf("%s/apis/apps/v1/namespaces/%s/%ss/%s/scale", strings.TrimSuffix(s.APIServer, "/"), s.Namespace, s.Kind, s.Name)
+	body := fmt.Sprintf(`{"spec":{"replicas":%d}}`, signal.Desired)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, url, strings.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create scaling request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	return do(s.Client, req, fmt.Sprintf("kubernetes %s %s/%s", s.Kind, s.Namespace, s.Name))
+}
+
+// do sends a scaling request and reports responses other than 2xx with the
+// start of their body
+func do(client *http.Client, req *http.Request, target string) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to scale %s: %w", target, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", target, resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
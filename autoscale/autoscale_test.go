@@ -0,0 +1,82 @@
+package autoscale
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/chip/conveyor/core"
+)
+
+func TestAWSScaler(t *testing.T) {
+	var form url.Values
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		form, _ = url.ParseQuery(string(body))
+		auth = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	scaler := &AWSScaler{Region: "eu-west-1", Group: "runners", Endpoint: server.URL, AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	if err := scaler.Scale(context.Background(), core.ScalingSignal{Direction: core.ScaleUp, Desired: 6}); err != nil {
+		t.Fatalf("Scale() error = %v", err)
+	}
+	if form.Get("Action") != "SetDesiredCapacity" || form.Get("AutoScalingGroupName") != "runners" || form.Get("DesiredCapacity") != "6" {
+		t.Errorf("form = %v, want SetDesiredCapacity of runners to 6", form)
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/eu-west-1/autoscaling/aws4_request") {
+		t.Errorf("Authorization = %s, want a signature for autoscaling in eu-west-1", auth)
+	}
+
+	scaler.SecretAccessKey = ""
+	if err := scaler.Scale(context.Background(), core.ScalingSignal{Desired: 6}); err == nil {
+		t.Error("Scale() without credentials error = nil, want error")
+	}
+}
+
+func TestKubernetesScaler(t *testing.T) {
+	var path, patch, auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		path, patch, auth = r.Method+" "+r.URL.Path, string(body), r.Header.Get("Authorization")
+		if strings.Contains(r.URL.Path, "missing") {
+			http.Error(w, `deployments.apps "missing" not found`, http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	scaler := &KubernetesScaler{APIServer: server.URL, Namespace: "ci", Kind: "statefulset", Name: "runners", Token: "sa-token"}
+	if err := scaler.Scale(context.Background(), core.ScalingSignal{Direction: core.ScaleDown, Desired: 2}); err != nil {
+		t.Fatalf("Scale() error = %v", err)
+	}
+	if path != "PATCH /apis/apps/v1/namespaces/ci/statefulsets/runners/scale" || patch != `{"spec":{"replicas":2}}` || auth != "Bearer sa-token" {
+		t.Errorf("request = %s %s (%s), want a replicas patch of the statefulset's scale", path, patch, auth)
+	}
+
+	scaler.Name = "missing"
+	if err := scaler.Scale(context.Background(), core.ScalingSignal{Desired: 2}); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Scale() error = %v, want the API server's not found error", err)
+	}
+}
+
+func TestWebhookScaler(t *testing.T) {
+	var signal core.ScalingSignal
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&signal)
+	}))
+	defer server.Close()
+
+	scaler := &WebhookScaler{URL: server.URL}
+	if err := scaler.Scale(context.Background(), core.ScalingSignal{Direction: core.ScaleUp, Runners: 2, Desired: 3, Waiting: 4}); err != nil {
+		t.Fatalf("Scale() error = %v", err)
+	}
+	if signal.Direction != core.ScaleUp || signal.Desired != 3 || signal.Waiting != 4 {
+		t.Errorf("webhook got %+v, want the scale up signal", signal)
+	}
+}
@@ -0,0 +1,54 @@
+package autoscale
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/internal/sigv4"
+)
+
+// AWSScaler sets the desired capacity of an Auto Scaling group with a
+// Signature Version 4 signed request
+type AWSScaler struct {
+	Region string
+	Group  string
+	// Endpoint overrides https://autoscaling.<region>.amazonaws.com
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Client          *http.Client
+}
+
+// Scale sets the group's desired capacity to the desired runners
+func (s *AWSScaler) Scale(ctx context.Context, signal core.ScalingSignal) error {
+	if s.AccessKeyID == "" || s.SecretAccessKey == "" {
+		return fmt.Errorf("AWS credentials are not set")
+	}
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://autoscaling.%s.amazonaws.com", s.Region)
+	}
+	form := url.Values{
+		"Action":               {"SetDesiredCapacity"},
+		"Version":              {"2011-01-01"},
+		"AutoScalingGroupName": {s.Group},
+		"DesiredCapacity":      {strconv.Itoa(signal.Desired)},
+		"HonorCooldown":        {"false"},
+	}
+	body := form.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", strings.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create scaling request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	sigv4.Sign(req, []byte(body), "autoscaling", s.Region, s.AccessKeyID, s.SecretAccessKey, s.SessionToken, time.Now())
+	return do(s.Client, req, "Auto Scaling group "+s.Group)
+}
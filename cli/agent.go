@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/logging"
+)
+
+const (
+	// agentWait is how long an agent's request for work is held open
+	agentWait = 30 * time.Second
+	// agentHeartbeat is how often an agent running a step tells the server
+	// it is alive
+	agentHeartbeat = 30 * time.Second
+)
+
+// agentClient talks to the server's agent routes as a registered agent
+type agentClient struct {
+	server string
+	id     string
+	secret string
+	client *http.Client
+	// heartbeats is whether the server takes heartbeats
+	heartbeats bool
+}
+
+// runAgent registers an ephemeral agent with a token, runs the steps of
+// one job and exits when the server reports the job finished
+func runAgent(args []string) error {
+	flags := flag.NewFlagSet("agent", flag.ContinueOnError)
+	server := flags.String("server", os.Getenv("CONVEYOR_SERVER"), "URL of the Conveyor server")
+	token := flags.String("token", os.Getenv("CONVEYOR_AGENT_TOKEN"), "agent token to register with")
+	name := flags.String("name", "", "name of the agent (default the host name)")
+	shell := flags.String("shell", "", "shell steps run with (default sh)")
+	dir := flags.String("dir", "", "directory steps run in (default the current directory)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *server == "" || *token == "" {
+		return fmt.Errorf("the agent needs --server and --token")
+	}
+	if *name == "" {
+		*name, _ = os.Hostname()
+	}
+
+	a := &agentClient{server: strings.TrimSuffix(*server, "/"), client: &http.Client{Timeout: agentWait + 30*time.Second}}
+	var registered struct {
+		Agent  core.Agent `json:"agent"`
+		Secret string     `json:"secret"`
+	}
+	if err := a.call(context.Background(), http.MethodPost, "/api/agents/register", map[string]interface{}{
+		"token":       *token,
+		"name":        *name,
+		"version":     version,
+		"protocol":    core.AgentProtocol,
+		"minProtocol": core.MinAgentProtocol,
+	}, &registered); err != nil {
+		return fmt.Errorf("failed to register: %w", err)
+	}
+	a.id, a.secret = registered.Agent.ID, registered.Secret
+	// Servers before protocol 2 take no heartbeats
+	a.heartbeats = registered.Agent.Negotiated >= 2
+	logging.Infof("Registered as agent %s for project %s (protocol %d)", a.id, registered.Agent.Project, registered.Agent.Negotiated)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	executor := &core.ShellExecutor{Shell: *shell, Dir: *dir}
+	for {
+		var assignment core.AgentAssignment
+		err := a.call(ctx, http.MethodGet, fmt.Sprintf("/api/agents/%s/work?wait=%s", a.id, agentWait), nil, &assignment)
+		switch {
+		case err == errAgentDone:
+			logging.Infof("Job finished, agent %s exiting", a.id)
+			return nil
+		case ctx.Err() != nil:
+			logging.Infof("Deregistering agent %s", a.id)
+			if err := a.call(context.Background(), http.MethodDelete, "/api/agents/"+a.id, nil, nil); err != nil && err != errAgentDone {
+				return err
+			}
+			return nil
+		case err != nil:
+			return err
+		case assignment.ID == "":
+			continue
+		}
+
+		logging.Infof("Running step %s of job %s", assignment.Step.ID, assignment.JobID)
+		result, err := a.execute(ctx, executor, assignment)
+		if err != nil {
+			result = &core.StepResult{ExitCode: 1, Output: err.Error()}
+		}
+		if err := a.call(context.Background(), http.MethodPost, fmt.Sprintf("/api/agents/%s/work/%s", a.id, assignment.ID), result, nil); err != nil {
+			return fmt.Errorf("failed to report step %s: %w", assignment.Step.ID, err)
+		}
+	}
+}
+
+// execute runs an assigned step, sending heartbeats while it runs. The
+// step is stopped when the server reports the agent was disconnected.
+func (a *agentClient) execute(ctx context.Context, executor core.StepExecutor, assignment core.AgentAssignment) (*core.StepResult, error) {
+	if !a.heartbeats {
+		return executor.Execute(ctx, assignment.Step, assignment.Env)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(agentHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := a.call(ctx, http.MethodPost, fmt.Sprintf("/api/agents/%s/heartbeat", a.id), nil, nil)
+			if err == errAgentDone {
+				logging.Warnf("Agent %s was disconnected, stopping step %s", a.id, assignment.Step.ID)
+				cancel()
+				return
+			}
+			if err != nil && ctx.Err() == nil {
+				logging.Warnf("Heartbeat failed: %v", err)
+			}
+		}
+	}()
+	return executor.Execute(ctx, assignment.Step, assignment.Env)
+}
+
+// errAgentDone is returned when the server reports the agent is done
+var errAgentDone = errors.New("agent is done")
+
+// call sends a request with a JSON body to the server and decodes the
+// response into out. A 204 leaves out untouched.
+func (a *agentClient) call(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, a.server+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+a.secret)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		return errAgentDone
+	case resp.StatusCode >= 300:
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, apiErr.Error)
+	case resp.StatusCode == http.StatusNoContent || out == nil:
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
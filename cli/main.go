@@ -1,87 +1,55 @@
 package main
 
 import (
-	"context"
-	"log"
-	"net/http"
+	"fmt"
 	"os"
-	"os/signal"
-	"syscall"
-	"time"
+	"strings"
 
-	"github.com/chip/conveyor/api"
-	"github.com/chip/conveyor/core"
-	"github.com/chip/conveyor/core/loader"
-	"github.com/chip/conveyor/plugins/security"
-	"github.com/gin-contrib/cors"
-	"github.com/gin-gonic/gin"
+	// Schedule time zones resolve on hosts without a zoneinfo database
+	_ "time/tzdata"
 )
 
-func main() {
-	// Set up the pipeline engine
-	engine := core.NewPipelineEngine()
-
-	// Register plugins
-	securityPlugin := security.NewSecurityPlugin()
-	engine.RegisterPlugin(securityPlugin)
-
-	// Load pipelines from YAML directory
-	pipelineLoader := loader.NewPipelineLoader(engine, "pipelines")
-	result, err := pipelineLoader.LoadDirectory()
-	if err != nil {
-		log.Fatalf("Failed to scan pipeline directory: %v", err)
-	}
-	for file, warnings := range result.Warnings {
-		for _, w := range warnings {
-			log.Printf("WARN [%s]: %s", file, w)
-		}
-	}
-	for file, loadErr := range result.Errors {
-		log.Printf("ERROR [%s]: %s", file, loadErr)
-	}
-	log.Printf("Loaded %d pipelines from YAML", len(result.Loaded))
+// version is the version of the build, set with
+// -ldflags "-X main.version=<version>"
+var version = "dev"
 
-	// Create the router
-	router := gin.Default()
+const usage = `Usage: conveyor <command> [flags]
 
-	// Configure CORS
-	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Content-Length", "Accept-Encoding", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	}))
+Commands:
+  server     Run the Conveyor server (default)
+  service    Manage the Windows service (install, uninstall, start, stop)
+  agent      Run an ephemeral agent that registers with a token and runs one job
+  bundle-databases
+             Fetch the scanner databases for offline mode
 
-	// Register API routes
-	api.SetupRoutes(router, engine, pipelineLoader)
+Run "conveyor <command> -h" for the flags of a command.
+`
 
-	// Start the server
-	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: router,
+func main() {
+	command, args := "server", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
 
-	// Run the server in a goroutine
-	go func() {
-		log.Println("Server starting on :8080")
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
-		}
-	}()
-
-	// Set up graceful shutdown
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Println("Shutting down server...")
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
+	var err error
+	switch command {
+	case "server":
+		err = runServer(args)
+	case "service":
+		err = runService(args)
+	case "agent":
+		err = runAgent(args)
+	case "bundle-databases":
+		err = runBundleDatabases(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
 	}
 
-	log.Println("Server exiting")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chip/conveyor/config"
+	"github.com/chip/conveyor/logging"
+	"github.com/chip/conveyor/plugins/security"
+)
+
+// staleBundleAge is how old a database bundle gets before the server warns
+// that it should be refreshed
+const staleBundleAge = 30 * 24 * time.Hour
+
+// egressGuard is the HTTP transport of offline mode. It only lets requests
+// reach loopback and the allowed hosts, blocking and logging the rest.
+type egressGuard struct {
+	next    http.RoundTripper
+	allow   []string
+	blocked uint64
+}
+
+// RoundTrip sends requests to allowed hosts
+func (g *egressGuard) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !g.allowed(req.URL.Hostname()) {
+		atomic.AddUint64(&g.blocked, 1)
+		logging.Warnf("Offline mode blocked %s %s", req.Method, req.URL.Redacted())
+		return nil, fmt.Errorf("offline mode blocks requests to %s", req.URL.Host)
+	}
+	return g.next.RoundTrip(req)
+}
+
+// allowed reports whether host is loopback, an allowed host, or a
+// subdomain of an allowed ".domain"
+func (g *egressGuard) allowed(host string) bool {
+	host = strings.ToLower(host)
+	if host == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, allowed := range g.allow {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, ".") && (strings.HasSuffix(host, allowed) || host == allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// enableOffline blocks the server's HTTP requests to external hosts and
+// opens the enricher on the database bundle, failing when the bundle is
+// missing or corrupt
+func enableOffline(cfg config.Offline) (*security.Enricher, error) {
+	http.DefaultTransport = &egressGuard{next: http.DefaultTransport, allow: cfg.AllowHosts}
+
+	manifest, err := security.ReadBundle(cfg.Bundle)
+	if err != nil {
+		return nil, fmt.Errorf("offline mode needs a database bundle from \"conveyor bundle-databases\": %w", err)
+	}
+	age := time.Since(manifest.CreatedAt)
+	logging.Infof("Offline mode: using the database bundle in %s from %s", cfg.Bundle, manifest.CreatedAt.Format(time.RFC3339))
+	if age > staleBundleAge {
+		logging.Warnf("The database bundle is %d days old; refresh it with \"conveyor bundle-databases\"", int(age.Hours()/24))
+	}
+	enricher, err := security.NewEnricher(cfg.Bundle, nil)
+	if err != nil {
+		return nil, err
+	}
+	enricher.Offline = true
+	return enricher, nil
+}
+
+// runBundleDatabases fetches the databases offline mode scans with into a
+// directory to carry into the air-gapped environment
+func runBundleDatabases(args []string) error {
+	flags := flag.NewFlagSet("bundle-databases", flag.ContinueOnError)
+	out := flags.String("out", "conveyor-bundle", "directory to write the database bundle to")
+	configPath := flags.String("config", os.Getenv("CONVEYOR_CONFIG"), "server configuration whose dependencies proxy is used")
+	epssFeed := flags.String("epss-feed", security.DefaultEPSSFeedURL, "URL of the gzipped CSV of every EPSS score")
+	kevURL := flags.String("kev-url", security.DefaultKEVURL, "URL of the CISA KEV catalog")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var proxy config.Proxy
+	if *configPath != "" {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			return err
+		}
+		proxy = cfg.Dependencies.Proxy
+	}
+	client := security.HTTPClient(proxy)
+	client.Timeout = 10 * time.Minute
+	enricher, err := security.NewEnricher(*out, client)
+	if err != nil {
+		return err
+	}
+	enricher.EPSSFeedURL, enricher.KEVURL = *epssFeed, *kevURL
+
+	manifest, err := enricher.Bundle(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, db := range manifest.Databases {
+		fmt.Printf("%-5s %8d entries  %s\n", db.Name, db.Entries, db.File)
+	}
+	fmt.Printf("Bundle written to %s; copy it to the offline server and set offline.bundle\n", *out)
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEgressGuard(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	guard := &egressGuard{next: http.DefaultTransport, allow: []string{"artifactory.example.com", ".corp.example.com"}}
+	client := &http.Client{Transport: guard}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get(loopback) error = %v", err)
+	}
+	resp.Body.Close()
+
+	if _, err := client.Get("https://api.first.org/data/v1/epss"); err == nil {
+		t.Error("Get(external) expected the request blocked")
+	}
+	if guard.blocked != 1 {
+		t.Errorf("blocked = %d, want 1", guard.blocked)
+	}
+
+	for host, want := range map[string]bool{
+		"localhost":               true,
+		"::1":                     true,
+		"artifactory.example.com": true,
+		"git.corp.example.com":    true,
+		"example.com":             false,
+		"hooks.slack.com":         false,
+	} {
+		if got := guard.allowed(host); got != want {
+			t.Errorf("allowed(%s) = %v, want %v", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// writePIDFile records the current process ID in path. It refuses to
+// overwrite the PID file of a server that is still running.
+func writePIDFile(path string) error {
+	if pid, err := readPIDFile(path); err == nil && pid != os.Getpid() && processAlive(pid) {
+		return fmt.Errorf("server is already running with pid %d (%s)", pid, path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create pid file directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write pid file: %w", err)
+	}
+	return nil
+}
+
+// readPIDFile returns the process ID stored in path
+func readPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid file %s: %w", path, err)
+	}
+	return pid, nil
+}
+
+// removePIDFile deletes path if it still belongs to the current process
+func removePIDFile(path string) {
+	if pid, err := readPIDFile(path); err == nil && pid == os.Getpid() {
+		os.Remove(path)
+	}
+}
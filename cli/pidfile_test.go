@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestWritePIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "conveyor.pid")
+
+	if err := writePIDFile(path); err != nil {
+		t.Fatalf("writePIDFile() error = %v", err)
+	}
+	pid, err := readPIDFile(path)
+	if err != nil {
+		t.Fatalf("readPIDFile() error = %v", err)
+	}
+	if pid != os.Getpid() {
+		t.Errorf("pid = %d, want %d", pid, os.Getpid())
+	}
+
+	removePIDFile(path)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("pid file still exists after removePIDFile")
+	}
+}
+
+func TestWritePIDFile_Stale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conveyor.pid")
+	// PIDs this large are above the kernel limit and never alive
+	if err := os.WriteFile(path, []byte(strconv.Itoa(1<<30)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writePIDFile(path); err != nil {
+		t.Fatalf("writePIDFile() over stale file error = %v", err)
+	}
+}
+
+func TestWritePIDFile_Running(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conveyor.pid")
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getppid())), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writePIDFile(path); err == nil {
+		t.Fatal("writePIDFile() expected error for a running process")
+	}
+}
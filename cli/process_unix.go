@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// processAlive reports whether a process with the given pid exists
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// daemonize starts the server again as a detached background process with
+// the same arguments and returns once it has started. Output the daemon
+// writes before it opens its own log file is appended to logFile.
+func daemonize(args []string, logFile string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	output, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer output.Close()
+
+	cmd := exec.Command(exe, append([]string{"server"}, args...)...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start daemon: %w", err)
+	}
+
+	fmt.Printf("Conveyor server started in the background (pid %d)\n", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
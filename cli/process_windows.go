@@ -0,0 +1,33 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// stillActive is the exit code Windows reports for a running process
+const stillActive = 259
+
+// processAlive reports whether a process with the given pid exists
+func processAlive(pid int) bool {
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(handle)
+
+	var code uint32
+	if err := windows.GetExitCodeProcess(handle, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
+
+// daemonize is not supported on Windows, where the server runs as a service
+func daemonize(args []string, logFile string) error {
+	return errors.New("--daemon is not supported on Windows; install the server with \"conveyor service install\" instead")
+}
@@ -0,0 +1,54 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// sdNotify sends a state notification to systemd when the server runs as a
+// Type=notify unit. It does nothing when $NOTIFY_SOCKET is not set.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract socket names are announced with a leading @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdNotifyReady tells systemd the server has started or finished reloading
+func sdNotifyReady() error {
+	return sdNotify("READY=1")
+}
+
+// sdNotifyReloading tells systemd the server is reloading its configuration.
+// Type=notify-reload units require the monotonic timestamp.
+func sdNotifyReloading() error {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return sdNotify("RELOADING=1")
+	}
+	return sdNotify(fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", ts.Nano()/1000))
+}
+
+// sdNotifyStopping tells systemd the server is shutting down
+func sdNotifyStopping() error {
+	return sdNotify("STOPPING=1")
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// systemd notifications only exist on Linux
+
+func sdNotifyReady() error     { return nil }
+func sdNotifyReloading() error { return nil }
+func sdNotifyStopping() error  { return nil }
@@ -0,0 +1,873 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/chip/conveyor/accesslog"
+	"github.com/chip/conveyor/api"
+	"github.com/chip/conveyor/api/routes"
+	"github.com/chip/conveyor/auth"
+	"github.com/chip/conveyor/autoscale"
+	"github.com/chip/conveyor/config"
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/core/loader"
+	"github.com/chip/conveyor/depcache"
+	"github.com/chip/conveyor/eventbus"
+	"github.com/chip/conveyor/export"
+	"github.com/chip/conveyor/functions"
+	"github.com/chip/conveyor/logging"
+	"github.com/chip/conveyor/notify"
+	"github.com/chip/conveyor/plugins/bluegreen"
+	"github.com/chip/conveyor/plugins/canary"
+	"github.com/chip/conveyor/plugins/e2e"
+	"github.com/chip/conveyor/plugins/loadtest"
+	"github.com/chip/conveyor/plugins/migrate"
+	"github.com/chip/conveyor/plugins/quality"
+	"github.com/chip/conveyor/plugins/release"
+	"github.com/chip/conveyor/plugins/security"
+	"github.com/chip/conveyor/plugins/signing"
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/mem"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// daemonEnv is set in the environment of the background process started by
+// --daemon so it does not daemonize again
+const daemonEnv = "CONVEYOR_DAEMONIZED"
+
+const (
+	// scheduleInterval is how often due security scan schedules and
+	// pipeline schedule triggers are started
+	scheduleInterval = 30 * time.Second
+	// secretCheckInterval is how often secrets are checked for expiry
+	secretCheckInterval = time.Hour
+	// artifactExpiryInterval is how often expired artifacts are deleted
+	artifactExpiryInterval = time.Hour
+	// jobWorkspaceCleanupInterval is how often the directories of
+	// finished jobs past their retention are deleted
+	jobWorkspaceCleanupInterval = 10 * time.Minute
+	// slaCheckInterval is how often findings are checked against their
+	// remediation SLAs
+	slaCheckInterval = time.Hour
+	// scalingInterval is how often the runners are checked against the
+	// load for autoscaling
+	scalingInterval = 30 * time.Second
+	// agentCheckInterval is how often agents are checked for missed
+	// heartbeats
+	agentCheckInterval = 30 * time.Second
+	// storeRefreshInterval is how often read-only servers reload the jobs,
+	// other engine state and auth directory of the data directory
+	storeRefreshInterval = 10 * time.Second
+)
+
+// runServer runs the server in the foreground, as a daemon or as a Windows
+// service, depending on flags and how the process was started
+func runServer(args []string) error {
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("CONVEYOR_CONFIG"), "path to the server configuration file")
+	daemon := flags.Bool("daemon", false, "run the server in the background")
+	pidFile := flags.String("pid-file", "", "write the server process ID to this file (default conveyor.pid with --daemon)")
+	logFile := flags.String("log-file", "", "write logs to this file (default conveyor.log with --daemon)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *daemon {
+		if *pidFile == "" {
+			*pidFile = "conveyor.pid"
+		}
+		if *logFile == "" {
+			*logFile = "conveyor.log"
+		}
+		if os.Getenv(daemonEnv) == "" {
+			if pid, err := readPIDFile(*pidFile); err == nil && processAlive(pid) {
+				return fmt.Errorf("server is already running with pid %d (%s)", pid, *pidFile)
+			}
+			return daemonize(args, *logFile)
+		}
+	}
+
+	if *logFile != "" {
+		file, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		defer file.Close()
+		log.SetOutput(file)
+		gin.DefaultWriter = file
+		gin.DefaultErrorWriter = file
+	}
+
+	if *pidFile != "" {
+		if err := writePIDFile(*pidFile); err != nil {
+			return err
+		}
+		defer removePIDFile(*pidFile)
+	}
+
+	if isWindowsService() {
+		return runWindowsService(*configPath)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	srv, err := newServer(*configPath)
+	if err != nil {
+		return err
+	}
+	srv.start()
+
+	if err := sdNotifyReady(); err != nil {
+		logging.Warnf("Failed to notify systemd: %v", err)
+	}
+
+	for {
+		select {
+		case err := <-srv.errs:
+			srv.stop()
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				sdNotifyReloading()
+				if err := srv.reload(); err != nil {
+					logging.Errorf("Failed to reload configuration: %v", err)
+				}
+				sdNotifyReady()
+				continue
+			}
+			sdNotifyStopping()
+			return srv.stop()
+		}
+	}
+}
+
+// server is a running Conveyor server and the state needed to reload or
+// stop it
+type server struct {
+	configPath     string
+	config         *config.Config
+	engine         *core.PipelineEngine
+	watcher        *loader.Watcher
+	scheduler      *security.Scheduler
+	slas           *security.SLAs
+	exporter       *export.Exporter
+	notifications  *notify.Dispatcher
+	subscription   *core.Subscription
+	functions      *functions.Dispatcher
+	invocations    *core.Subscription
+	access         *accesslog.Logger
+	auth           *routes.AuthConfig
+	directory      *auth.Directory
+	security       *security.SecurityPlugin
+	egress         *core.Subscription
+	stopBackground context.CancelFunc
+	http           *http.Server
+	errs           chan error
+	// reloadMu serializes reloads from signals and the settings API
+	reloadMu sync.Mutex
+}
+
+// newServer loads the configuration, pipelines and previous jobs and builds
+// the HTTP server
+func newServer(configPath string) (*server, error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	level, err := logging.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	logging.SetLevel(level)
+	if cfg.Crypto.FIPS {
+		if err := core.VerifyFIPS(); err != nil {
+			return nil, err
+		}
+		logging.Infof("FIPS mode: using the BoringCrypto module")
+	}
+
+	// Schedules without a time zone are read in the configured or host time
+	// zone. Everything else is timestamped, and so stored, in UTC.
+	scheduleZone := time.Local
+	if cfg.Timezone != "" {
+		if scheduleZone, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	time.Local = time.UTC
+
+	// Open the job store
+	store, err := core.NewFileStore(cfg.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data directory: %w", err)
+	}
+
+	// Security scans from pipelines and schedules share one history
+	securityPlugin := security.NewSecurityPlugin()
+	securityConfig := securityPlugin.GetConfig()
+	securityConfig.Dependencies = cfg.Dependencies
+	securityConfig.Offline = cfg.Offline.Enabled
+	securityPlugin.UpdateConfig(securityConfig)
+	scanHistory, err := security.NewHistory(filepath.Join(cfg.DataDir, "security", "scans"))
+	if err != nil {
+		return nil, err
+	}
+	securityPlugin.UseHistory(scanHistory)
+	vex, err := security.NewVEX(filepath.Join(cfg.DataDir, "security", "vex"))
+	if err != nil {
+		return nil, err
+	}
+	securityPlugin.UseVEX(vex)
+	var enricher *security.Enricher
+	if cfg.Offline.Enabled {
+		enricher, err = enableOffline(cfg.Offline)
+	} else {
+		enricher, err = security.NewEnricher(filepath.Join(cfg.DataDir, "security", "enrichment"), security.HTTPClient(cfg.Dependencies.Proxy))
+	}
+	if err != nil {
+		return nil, err
+	}
+	securityPlugin.UseEnricher(enricher)
+
+	// Open the encrypted secret store
+	secretKey, err := core.SecretKey(cfg.SecretKey, filepath.Join(cfg.DataDir, "secrets.key"), filepath.Join(cfg.DataDir, "secrets.salt"))
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := core.NewFileSecretStore(cfg.DataDir, secretKey, core.LegacySecretKeys(cfg.SecretKey)...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Users, teams, API tokens and role bindings
+	directory, err := auth.NewDirectory(cfg.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Shell runners steps are scheduled on by label. Without configured
+	// runners, steps run on a local runner sized to this host.
+	runners := make([]core.Runner, 0, len(cfg.Runners))
+	for _, r := range cfg.Runners {
+		resources, err := core.ParseResources(r.CPU, r.Memory)
+		if err != nil {
+			return nil, err
+		}
+		runners = append(runners, core.Runner{
+			Name:      r.Name,
+			Labels:    r.Labels,
+			Capacity:  r.Capacity,
+			Resources: resources,
+			Executor:  &core.ShellExecutor{Shell: r.Shell, Dir: r.Dir, Resume: cfg.ResumeJobs},
+		})
+	}
+	if len(runners) == 0 {
+		runners = append(runners, core.Runner{
+			Name:      "local",
+			Labels:    core.DefaultRunnerLabels(),
+			Resources: hostResources(),
+		})
+	}
+
+	// Set up the pipeline engine with the built-in plugins
+	engineOpts := []core.Option{
+		core.WithVersion(version),
+		core.WithPlugins(securityPlugin, release.NewReleasePlugin(), quality.NewQualityPlugin(), canary.NewCanaryPlugin(), bluegreen.NewBlueGreenPlugin(), migrate.NewMigratePlugin(), loadtest.NewLoadTestPlugin(), e2e.NewE2EPlugin(), signing.NewSigningPlugin()),
+		core.WithStore(store),
+		core.WithSecrets(secrets),
+		core.WithReleaseSigningKey(secretKey, core.LegacySecretKeys(cfg.SecretKey)...),
+		core.WithCrypto(cfg.Crypto.FIPS, cfg.Crypto.ChecksumAlgorithm),
+		core.WithArtifactRetention(cfg.ArtifactRetention),
+		core.WithFeatureFlags(cfg.EngineFeatureFlags()...),
+		core.WithScheduleLocation(scheduleZone),
+		core.WithDurationAnomalies(core.DurationAnomalyPolicy(cfg.DurationAnomalies)),
+		core.WithExecutor(&core.ShellExecutor{Resume: cfg.ResumeJobs}),
+		core.WithRunners(runners...),
+		core.WithQueuePolicy(cfg.Queue.Policy, cfg.Queue.Weights),
+		core.WithMaxConcurrentJobs(cfg.Queue.MaxJobs),
+		core.WithCostRates(costRates(cfg.Costs)),
+		core.WithOutputLimit(cfg.OutputLimit()),
+		core.WithInfraRetries(cfg.InfraRetries.Max, cfg.InfraRetryDelay()),
+		core.WithDiskQuotas(cfg.DiskQuotaPolicy()),
+	}
+	if cfg.ReadOnly {
+		engineOpts = append(engineOpts, core.WithReadOnly())
+		logging.Infof("Read-only observer mode: serving %s without running jobs", cfg.DataDir)
+	}
+	if cfg.Workspaces.Enabled {
+		engineOpts = append(engineOpts, core.WithWorkspaces(filepath.Join(cfg.DataDir, "workspaces"), core.WorkspacePolicy{
+			MaxAge:         cfg.WorkspaceMaxAge(),
+			MaxBytes:       cfg.Workspaces.MaxSizeMB << 20,
+			MaxPerPipeline: cfg.Workspaces.MaxPerPipeline,
+		}))
+	}
+	if cfg.JobWorkspaces.Enabled {
+		engineOpts = append(engineOpts, core.WithJobWorkspaces(filepath.Join(cfg.DataDir, "job-workspaces"), cfg.JobWorkspaceRetention()))
+	}
+	if cfg.Containers.Enabled {
+		engineOpts = append(engineOpts, core.WithContainerExecutor(&core.ContainerExecutor{
+			Binary:  cfg.Containers.Binary,
+			Network: cfg.Containers.Network,
+			User:    cfg.Containers.User,
+			Pull:    cfg.Containers.Pull,
+		}))
+	}
+	if cfg.Autoscaling.Enabled && !cfg.ReadOnly {
+		scaler, err := autoscale.New(cfg.Autoscaling)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up autoscaling: %w", err)
+		}
+		engineOpts = append(engineOpts, core.WithAutoscaling(cfg.AutoscalePolicy(), scaler))
+	}
+	if cfg.EventBus.Enabled {
+		bus, err := eventbus.NewRedis(cfg.EventBus)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up the event bus: %w", err)
+		}
+		replica := cfg.EventBus.Replica
+		if replica == "" {
+			replica, _ = os.Hostname()
+		}
+		engineOpts = append(engineOpts, core.WithEventBus(bus, replica))
+	}
+	var cache *depcache.Cache
+	if cfg.DependencyCache.Enabled && !cfg.ReadOnly {
+		client := security.HTTPClient(cfg.Dependencies.Proxy)
+		// Module zips and tarballs can be large
+		client.Timeout = 10 * time.Minute
+		cache, err = depcache.New(cfg.DependencyCache, filepath.Join(cfg.DataDir, "depcache"), client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up the dependency cache: %w", err)
+		}
+		cache.TTL = cfg.DependencyCacheTTL()
+		cache.Offline = cfg.Offline.Enabled
+		engineOpts = append(engineOpts, core.WithDefaultEnvironment(depcache.Environment(dependencyCacheURL(cfg))))
+	}
+	engine := core.NewPipelineEngine(engineOpts...)
+
+	// Load pipelines from YAML directory, or keep them in sync with it
+	pipelineLoader := loader.NewPipelineLoader(engine, cfg.PipelinesDir)
+	var watcher *loader.Watcher
+	var gitops *routes.GitOpsConfig
+	var discovery *routes.DiscoveryConfig
+	var discoverer *loader.Discoverer
+	if cfg.Discovery.Enabled && !cfg.ReadOnly {
+		discoverer, err = loader.NewDiscoverer(loader.DiscoveryOptions{
+			Root:      cfg.Discovery.Root,
+			Dir:       cfg.PipelinesDir,
+			Templates: cfg.Discovery.Templates,
+			Exclude:   cfg.Discovery.Exclude,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up project discovery: %w", err)
+		}
+		discovery = &routes.DiscoveryConfig{Discoverer: discoverer}
+	}
+	if cfg.PipelineSync.Enabled && !cfg.ReadOnly {
+		watcher = loader.NewWatcher(engine, cfg.PipelinesDir, loader.WatchOptions{
+			Interval:   cfg.SyncInterval(),
+			SelfHeal:   cfg.PipelineSync.SelfHeal,
+			ReadOnly:   cfg.PipelineSync.ReadOnly,
+			Repo:       cfg.PipelineSync.Repo,
+			Branch:     cfg.PipelineSync.Branch,
+			Discoverer: discoverer,
+		})
+		if err := watcher.Sync(); err != nil {
+			return nil, fmt.Errorf("failed to sync pipeline directory: %w", err)
+		}
+		status := watcher.Status()
+		for file, syncErr := range status.Errors {
+			logging.Errorf("[%s]: %s", file, syncErr)
+		}
+		logging.Infof("Syncing %d pipelines from %s (interval %s)", len(status.Files), cfg.PipelinesDir, cfg.SyncInterval())
+		gitops = &routes.GitOpsConfig{Syncer: watcher, WebhookSecret: cfg.PipelineSync.WebhookSecret}
+		if discovery != nil {
+			discovery.Syncer = watcher
+		}
+	} else {
+		if discoverer != nil {
+			if _, err := discoverer.Discover(); err != nil {
+				logging.Errorf("Project discovery failed: %v", err)
+			}
+		}
+		result, err := pipelineLoader.LoadDirectory()
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan pipeline directory: %w", err)
+		}
+		for file, warnings := range result.Warnings {
+			for _, w := range warnings {
+				logging.Warnf("[%s]: %s", file, w)
+			}
+		}
+		for file, loadErr := range result.Errors {
+			logging.Errorf("[%s]: %s", file, loadErr)
+		}
+		logging.Infof("Loaded %d pipelines from YAML", len(result.Loaded))
+	}
+	if discoverer != nil {
+		report := discoverer.Report()
+		logging.Infof("Discovered %d projects in %s", len(report.Projects), cfg.Discovery.Root)
+	}
+
+	// Restore jobs from the previous run, recovering any it left unfinished
+	if err := engine.RestoreJobs(); err != nil {
+		return nil, fmt.Errorf("failed to restore jobs: %w", err)
+	}
+	if err := engine.RestoreMaintenance(); err != nil {
+		return nil, fmt.Errorf("failed to restore maintenance windows: %w", err)
+	}
+	if err := engine.RestoreIncidents(); err != nil {
+		return nil, fmt.Errorf("failed to restore incidents: %w", err)
+	}
+	if err := engine.RestoreSecretUsage(); err != nil {
+		return nil, fmt.Errorf("failed to restore secret usage: %w", err)
+	}
+
+	notifications := notify.NewDispatcher()
+	if err := notifications.Configure(cfg.Notifications); err != nil {
+		return nil, err
+	}
+	notifications.SetJobs(engine.JobSnapshot)
+	invoker := functions.NewDispatcher(engine)
+	if err := invoker.Configure(cfg.Functions); err != nil {
+		return nil, err
+	}
+
+	scheduler, err := security.NewScheduler(securityPlugin, filepath.Join(cfg.DataDir, "security"), regressionAlert(notifications))
+	if err != nil {
+		return nil, err
+	}
+	if err := scheduler.SetLocation(scheduleZone); err != nil {
+		return nil, err
+	}
+	slas, err := security.NewSLAs(filepath.Join(cfg.DataDir, "security"), scanHistory, slaEscalation(notifications))
+	if err != nil {
+		return nil, err
+	}
+
+	var exporter *export.Exporter
+	if cfg.Export.Enabled && !cfg.ReadOnly {
+		exporter, err = export.New(cfg.Export, filepath.Join(cfg.DataDir, "export"), engine, scanHistory)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up exports: %w", err)
+		}
+	}
+
+	// Create the router. Requests are logged as JSON lines when the access
+	// log is enabled, and as text otherwise.
+	var metrics *accesslog.Metrics
+	if cfg.Metrics.Enabled {
+		metrics = accesslog.NewMetrics(cfg.Metrics.Buckets)
+		metrics.Token = cfg.Metrics.Token
+	}
+	access := accesslog.New(gin.DefaultWriter, metrics)
+	if err := access.Configure(cfg.AccessLog); err != nil {
+		return nil, err
+	}
+	router := gin.New()
+	router.Use(access.Handler(principalName), requestLogger(access), gin.Recovery())
+	if metrics != nil {
+		router.GET("/metrics", gin.WrapH(metrics))
+	}
+
+	// Configure CORS
+	allowOrigins := cfg.CORS.AllowOrigins
+	if len(allowOrigins) == 0 {
+		allowOrigins = []string{"*"}
+	}
+	router.Use(cors.New(cors.Config{
+		AllowOrigins:     allowOrigins,
+		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Content-Length", "Accept-Encoding", "Authorization"},
+		ExposeHeaders:    []string{"Content-Length"},
+		AllowCredentials: true,
+		MaxAge:           12 * time.Hour,
+	}))
+
+	// Settings changed through the API are applied like a reload
+	var srv *server
+	settings := config.NewSettings(configPath, filepath.Join(cfg.DataDir, "audit", "settings.jsonl"), func() error {
+		return srv.reload()
+	})
+
+	// An external policy service decides on requests RBAC allows
+	authConfig := &routes.AuthConfig{
+		Directory:  directory,
+		Enabled:    cfg.Auth.Enabled,
+		AdminToken: cfg.Auth.AdminToken,
+		SCIMToken:  cfg.Auth.SCIMToken,
+	}
+	authConfig.SetPolicy(newAuthPolicy(cfg.Auth.Policy), cfg.Auth.Policy.ReplaceRBAC)
+
+	// Register API routes
+	api.SetupRoutes(router, engine, pipelineLoader, gitops, discovery, &routes.SecurityScans{
+		History:   scanHistory,
+		Scheduler: scheduler,
+		Plugin:    securityPlugin,
+		SLAs:      slas,
+		VEX:       vex,
+	}, authConfig, &routes.PluginSource{
+		Offline: cfg.Offline.Enabled,
+		Mirror:  cfg.Offline.PluginMirror,
+	}, settings, exporter, cache, cfg.CORS.AllowOrigins)
+
+	srv = &server{
+		configPath:    configPath,
+		config:        cfg,
+		engine:        engine,
+		watcher:       watcher,
+		scheduler:     scheduler,
+		slas:          slas,
+		exporter:      exporter,
+		notifications: notifications,
+		subscription:  engine.Subscribe(1000),
+		functions:     invoker,
+		access:        access,
+		auth:          authConfig,
+		directory:     directory,
+		invocations:   engine.Subscribe(1000),
+		security:      securityPlugin,
+		egress:        engine.Subscribe(1000),
+		http:          httpServer(cfg, router),
+		errs:          make(chan error, 1),
+	}
+	return srv, nil
+}
+
+// dependencyCacheURL returns where steps reach the dependency cache: its
+// configured URL, or this server
+func dependencyCacheURL(cfg *config.Config) string {
+	if cfg.DependencyCache.URL != "" {
+		return cfg.DependencyCache.URL
+	}
+	scheme, host := "http", "localhost"
+	if cfg.HTTP.TLS.CertFile != "" {
+		scheme = "https"
+	}
+	if ip := net.ParseIP(cfg.Host); ip != nil && !ip.IsUnspecified() {
+		host = cfg.Host
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, strconv.Itoa(cfg.Port)), depcache.Prefix)
+}
+
+// httpServer returns the server of the router with the configured timeouts
+// and HTTP/2 settings
+func httpServer(cfg *config.Config, handler http.Handler) *http.Server {
+	timeouts := cfg.HTTP.Timeouts()
+	h2 := &http2.Server{
+		MaxConcurrentStreams: cfg.HTTP.HTTP2.ConcurrentStreams(),
+		MaxReadFrameSize:     cfg.HTTP.HTTP2.ReadFrameSize(),
+		IdleTimeout:          timeouts.Idle,
+	}
+	if cfg.HTTP.HTTP2.H2C && !cfg.HTTP.HTTP2.Disabled {
+		handler = h2c.NewHandler(handler, h2)
+	}
+	srv := &http.Server{
+		Addr:              cfg.Addr(),
+		Handler:           handler,
+		ReadHeaderTimeout: timeouts.ReadHeader,
+		ReadTimeout:       timeouts.Read,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
+		MaxHeaderBytes:    cfg.HTTP.HeaderBytes(),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return routes.WithStreamConn(ctx, c, timeouts.StreamWrite)
+		},
+	}
+	if cfg.HTTP.HTTP2.Disabled {
+		// A non-nil map turns off HTTP/2 over TLS
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	} else if err := http2.ConfigureServer(srv, h2); err != nil {
+		logging.Warnf("Failed to configure HTTP/2: %v", err)
+	}
+	return srv
+}
+
+// start serves HTTP and delivers notifications in the background. Listen
+// errors are reported on s.errs.
+func (s *server) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopBackground = cancel
+
+	go s.engine.RunEventBus(ctx)
+	if s.config.ReadOnly {
+		// Observers follow the jobs of the server writing the data
+		// directory, which does the notifying, scanning and expiring
+		go s.engine.WatchStore(ctx, storeRefreshInterval)
+		go watchDirectory(ctx, s.directory, storeRefreshInterval)
+	} else {
+		go s.notifications.Run(context.Background(), s.subscription.Events())
+		go s.functions.Run(context.Background(), s.invocations.Events())
+		go recordEgress(s.engine, s.security, s.egress.Events())
+		go s.scheduler.Run(ctx, scheduleInterval)
+		go s.slas.Run(ctx, slaCheckInterval)
+		go s.engine.WatchSchedules(ctx, scheduleInterval)
+		go s.engine.WatchSecrets(ctx, secretCheckInterval)
+		go s.engine.WatchArtifacts(ctx, artifactExpiryInterval)
+		go s.engine.WatchJobWorkspaces(ctx, jobWorkspaceCleanupInterval)
+		go s.engine.WatchScaling(ctx, scalingInterval)
+		go s.engine.WatchAgents(ctx, agentCheckInterval)
+	}
+	if s.exporter != nil {
+		go s.exporter.Run(ctx, s.config.ExportInterval())
+	}
+	if s.watcher != nil {
+		go s.watcher.Run(ctx)
+	}
+
+	// Event streams end when the server stops rather than holding up the
+	// shutdown
+	s.http.BaseContext = func(net.Listener) context.Context { return ctx }
+	go func() {
+		logging.Infof("Server starting on %s", s.http.Addr)
+		var err error
+		if certs := s.config.HTTP.TLS; certs.CertFile != "" {
+			err = s.http.ListenAndServeTLS(certs.CertFile, certs.KeyFile)
+		} else {
+			err = s.http.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			s.errs <- fmt.Errorf("listen: %w", err)
+		}
+	}()
+}
+
+// reload re-reads the configuration file and applies the settings that can
+// change without a restart
+func (s *server) reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	cfg, err := config.Load(s.configPath)
+	if err != nil {
+		return err
+	}
+	level, err := logging.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	if err := s.notifications.Configure(cfg.Notifications); err != nil {
+		return err
+	}
+	if err := s.functions.Configure(cfg.Functions); err != nil {
+		return err
+	}
+	if err := s.access.Configure(cfg.AccessLog); err != nil {
+		return err
+	}
+	logging.SetLevel(level)
+
+	for _, field := range s.config.RestartRequired(cfg) {
+		logging.Warnf("Configuration change to %s requires a restart", field)
+	}
+	s.engine.SetArtifactRetention(cfg.ArtifactRetention)
+	s.engine.ReplaceFeatureFlags(cfg.EngineFeatureFlags())
+	s.engine.SetDurationAnomalyPolicy(core.DurationAnomalyPolicy(cfg.DurationAnomalies))
+	s.engine.SetQueuePolicy(cfg.Queue.Policy, cfg.Queue.Weights)
+	s.engine.SetMaxConcurrentJobs(cfg.Queue.MaxJobs)
+	s.auth.SetPolicy(newAuthPolicy(cfg.Auth.Policy), cfg.Auth.Policy.ReplaceRBAC)
+	s.config.LogLevel = cfg.LogLevel
+	s.config.Notifications = cfg.Notifications
+	s.config.Functions = cfg.Functions
+	s.config.ArtifactRetention = cfg.ArtifactRetention
+	s.config.FeatureFlags = cfg.FeatureFlags
+	s.config.DurationAnomalies = cfg.DurationAnomalies
+	s.config.Queue = cfg.Queue
+	s.config.AccessLog = cfg.AccessLog
+	s.config.Auth.Policy = cfg.Auth.Policy
+
+	logging.Infof("Configuration reloaded (log level %s, %d notification channels)", level, len(cfg.Notifications))
+	return nil
+}
+
+// watchDirectory reloads the auth directory another server writes every
+// interval until ctx is done, so the tokens it revokes and the users it
+// deactivates stop working here too
+func watchDirectory(ctx context.Context, directory *auth.Directory, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := directory.Reload(); err != nil {
+			logging.Errorf("Failed to reload the auth directory: %v", err)
+		}
+	}
+}
+
+// newAuthPolicy returns the external authorization policy of the config, or
+// nil when there is none. Its decision cache starts empty.
+func newAuthPolicy(cfg config.AuthPolicy) *auth.Policy {
+	if cfg.URL == "" {
+		return nil
+	}
+	timeout, cacheTTL := cfg.Timeouts()
+	return &auth.Policy{
+		URL:      cfg.URL,
+		OPA:      cfg.Type == "opa",
+		Token:    cfg.Token,
+		FailOpen: cfg.FailOpen,
+		CacheTTL: cacheTTL,
+		Client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// stop shuts down the HTTP server and waits for running jobs to drain
+func (s *server) stop() error {
+	logging.Infof("Shutting down server...")
+	if s.stopBackground != nil {
+		s.stopBackground()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.http.Shutdown(ctx); err != nil {
+		logging.Errorf("Server forced to shutdown: %v", err)
+	}
+
+	// Let running jobs finish before interrupting them
+	drainTimeout := s.config.DrainTimeoutDuration()
+	logging.Infof("Waiting up to %s for running jobs to finish...", drainTimeout)
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancelDrain()
+	if err := s.engine.Shutdown(drainCtx); err != nil {
+		logging.Warnf("Interrupted running jobs: %v", err)
+	}
+
+	s.subscription.Close()
+	s.egress.Close()
+	logging.Infof("Server exiting")
+	return nil
+}
+
+// recordEgress records the connections network policies blocked in each
+// finished job as security findings of the job's pipeline
+func recordEgress(engine *core.PipelineEngine, plugin *security.SecurityPlugin, events <-chan core.Event) {
+	for event := range events {
+		if event.Type != "job.egress" {
+			continue
+		}
+		job, err := engine.JobSnapshot(event.JobID)
+		if err != nil {
+			logging.Warnf("Failed to record blocked connections of job %s: %v", event.JobID, err)
+			continue
+		}
+		if _, err := plugin.RecordEgress(job); err != nil {
+			logging.Warnf("Job %s: %v", event.JobID, err)
+		}
+	}
+}
+
+// regressionAlert notifies the configured channels about new findings of a
+// scheduled security scan, and about infrastructure drift as drift
+func regressionAlert(notifications *notify.Dispatcher) func(security.Regression) {
+	return func(r security.Regression) {
+		status := "regression"
+		text := fmt.Sprintf("Scheduled %s scan of %s found %d new findings (scan %s)", r.ScanType, r.Target, len(r.NewFindings), r.ScanID)
+		if r.ScanType == "drift" {
+			status = "drift"
+			text = fmt.Sprintf("Terraform drift in %s: %d resources no longer match their configuration (scan %s)", r.Target, len(r.NewFindings), r.ScanID)
+		}
+		logging.Warnf("%s", text)
+		notifications.Dispatch(context.Background(), notify.Message{
+			Status:    status,
+			Text:      text,
+			Timestamp: r.Timestamp,
+		})
+	}
+}
+
+// slaEscalation notifies of findings open longer than their SLA allows
+func slaEscalation(notifications *notify.Dispatcher) func(security.SLABreach) {
+	return func(b security.SLABreach) {
+		text := fmt.Sprintf("%s finding %s in %s has been open %d days, past its %d day SLA", strings.ToUpper(b.Severity), b.Rule, b.Scope, b.AgeDays, b.TargetDays)
+		logging.Warnf("%s", text)
+		notifications.Dispatch(context.Background(), notify.Message{
+			Status:    "sla_breach",
+			Text:      text,
+			Timestamp: time.Now(),
+		})
+	}
+}
+
+// requestLogger logs requests as text unless the access log is enabled or
+// the log level is above info
+func requestLogger(access *accesslog.Logger) gin.HandlerFunc {
+	logger := gin.Logger()
+	return func(c *gin.Context) {
+		if !access.Enabled() && logging.Enabled(logging.LevelInfo) {
+			logger(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// principalName names the authenticated principal of a request in the
+// access log
+func principalName(c *gin.Context) string {
+	if principal := routes.PrincipalFrom(c); principal != nil {
+		return principal.Name()
+	}
+	return ""
+}
+
+// hostResources returns the logical CPUs and total memory of this host.
+// Values that can't be read are left unaccounted.
+func hostResources() core.Resources {
+	var resources core.Resources
+	if count, err := cpu.Counts(true); err != nil {
+		log.Printf("Failed to count CPUs, not accounting CPU requests: %v", err)
+	} else {
+		resources.CPU = float64(count)
+	}
+	if stats, err := mem.VirtualMemory(); err != nil {
+		log.Printf("Failed to read memory size, not accounting memory requests: %v", err)
+	} else {
+		resources.Memory = int64(stats.Total)
+	}
+	return resources
+}
+
+// costRates converts the configured cost rates and carbon factors
+func costRates(costs config.Costs) core.CostRates {
+	rates := core.CostRates{
+		Currency:  costs.Currency,
+		CPUMinute: costs.CPUMinute,
+		GBMinute:  costs.GBMinute,
+		Runners:   costs.Runners,
+	}
+	if carbon := costs.Carbon; carbon != nil {
+		rates.Carbon = &core.CarbonFactors{
+			GridIntensity: carbon.GridIntensity,
+			Runners:       carbon.Runners,
+			CPUWatts:      carbon.CPUWatts,
+			GBWatts:       carbon.GBWatts,
+			PUE:           carbon.PUE,
+		}
+	}
+	return rates
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "errors"
+
+// isWindowsService reports whether the process was started by the Windows
+// service manager
+func isWindowsService() bool {
+	return false
+}
+
+// runWindowsService is only reachable on Windows
+func runWindowsService(configPath string) error {
+	return errors.New("not running as a Windows service")
+}
+
+// runService explains how to run the server as a service on this platform
+func runService(args []string) error {
+	return errors.New("service management is only available on Windows; on Linux install scripts/conveyor.service as a systemd unit")
+}
@@ -0,0 +1,170 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/chip/conveyor/logging"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name the server is registered under with the Windows
+// service manager
+const serviceName = "Conveyor"
+
+// isWindowsService reports whether the process was started by the Windows
+// service manager
+func isWindowsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// runWindowsService runs the server under the Windows service manager until
+// the service is stopped
+func runWindowsService(configPath string) error {
+	return svc.Run(serviceName, &windowsService{configPath: configPath})
+}
+
+// windowsService adapts the server to the Windows service control protocol
+type windowsService struct {
+	configPath string
+}
+
+// Execute starts the server and handles service control requests. A
+// parameter change request reloads the configuration like SIGHUP on Unix.
+func (ws *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	srv, err := newServer(ws.configPath)
+	if err != nil {
+		logging.Errorf("Failed to start server: %v", err)
+		return true, 1
+	}
+	srv.start()
+
+	accepts := svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+
+	for {
+		select {
+		case err := <-srv.errs:
+			logging.Errorf("Server failed: %v", err)
+			status <- svc.Status{State: svc.StopPending}
+			srv.stop()
+			return true, 1
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.ParamChange:
+				if err := srv.reload(); err != nil {
+					logging.Errorf("Failed to reload configuration: %v", err)
+				}
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				srv.stop()
+				return false, 0
+			}
+		}
+	}
+}
+
+// runService installs, removes, starts or stops the Windows service
+func runService(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: conveyor service <install|uninstall|start|stop> [flags]")
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	switch args[0] {
+	case "install":
+		return installService(m, args[1:])
+	case "uninstall":
+		return withService(m, func(s *mgr.Service) error { return s.Delete() })
+	case "start":
+		return withService(m, func(s *mgr.Service) error { return s.Start() })
+	case "stop":
+		return withService(m, func(s *mgr.Service) error {
+			_, err := s.Control(svc.Stop)
+			return err
+		})
+	default:
+		return fmt.Errorf("unknown service command %q", args[0])
+	}
+}
+
+// installService registers the current executable as an automatically
+// started service
+func installService(m *mgr.Mgr, args []string) error {
+	flags := flag.NewFlagSet("service install", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path to the server configuration file")
+	logFile := flags.String("log-file", "", "write logs to this file (default conveyor.log next to the executable)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+	if *logFile == "" {
+		*logFile = filepath.Join(filepath.Dir(exe), "conveyor.log")
+	}
+
+	serviceArgs := []string{"server", "--log-file", *logFile}
+	if *configPath != "" {
+		path, err := filepath.Abs(*configPath)
+		if err != nil {
+			return err
+		}
+		serviceArgs = append(serviceArgs, "--config", path)
+	}
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s is already installed", serviceName)
+	}
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Conveyor CI/CD",
+		Description: "Runs the Conveyor pipeline server",
+		StartType:   mgr.StartAutomatic,
+	}, serviceArgs...)
+	if err != nil {
+		return fmt.Errorf("failed to install service: %w", err)
+	}
+	defer s.Close()
+
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 10 * time.Second},
+	}, uint32((24 * time.Hour).Seconds()))
+	if err != nil {
+		logging.Warnf("Failed to set service recovery actions: %v", err)
+	}
+
+	fmt.Printf("Service %s installed\n", serviceName)
+	return nil
+}
+
+// withService opens the installed service and runs fn on it
+func withService(m *mgr.Mgr, fn func(s *mgr.Service) error) error {
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %w", serviceName, err)
+	}
+	defer s.Close()
+	return fn(s)
+}
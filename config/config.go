@@ -0,0 +1,1324 @@
+// Package config loads the Conveyor server configuration.
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the server configuration. Values are read from an optional YAML
+// file and then overridden by CONVEYOR_* environment variables.
+type Config struct {
+	Host         string `yaml:"host" json:"host"`
+	Port         int    `yaml:"port" json:"port"`
+	DataDir      string `yaml:"dataDir" json:"dataDir"`
+	PipelinesDir string `yaml:"pipelinesDir" json:"pipelinesDir"`
+	LogLevel     string `yaml:"logLevel" json:"logLevel"`
+	// Timezone is the IANA time zone of cron triggers, maintenance windows
+	// and scan schedules that do not name one. Defaults to the host's.
+	Timezone      string         `yaml:"timezone,omitempty" json:"timezone,omitempty"`
+	DrainTimeout  string         `yaml:"drainTimeout" json:"drainTimeout"`
+	ResumeJobs    bool           `yaml:"resumeJobs" json:"resumeJobs"`
+	PipelineSync  PipelineSync   `yaml:"pipelineSync" json:"pipelineSync"`
+	Notifications []Notification `yaml:"notifications" json:"notifications"`
+	// Functions are serverless functions invoked with job and step
+	// payloads at lifecycle events
+	Functions []Function `yaml:"functions,omitempty" json:"functions,omitempty"`
+	// SecretKey is a passphrase the secret store key is derived from. When
+	// empty, a random key is generated in the data directory.
+	SecretKey string `yaml:"secretKey,omitempty" json:"-"`
+	Auth      Auth   `yaml:"auth" json:"auth"`
+	// HTTP tunes the server's timeouts, TLS and HTTP/2
+	HTTP HTTP `yaml:"http" json:"http"`
+	// CORS is the browser origins allowed to call the API
+	CORS CORS `yaml:"cors" json:"cors"`
+	// AccessLog writes a JSON line for each request in place of the text
+	// request log
+	AccessLog AccessLog `yaml:"accessLog" json:"accessLog"`
+	// Metrics serves request latency histograms per route to Prometheus
+	Metrics Metrics `yaml:"metrics" json:"metrics"`
+	// Runners are the shell runners steps are scheduled on by label. When
+	// empty, steps run on a single local runner.
+	Runners []Runner `yaml:"runners,omitempty" json:"runners,omitempty"`
+	// Queue is the order steps waiting for a runner get one, and how many
+	// jobs run at once
+	Queue Queue `yaml:"queue" json:"queue"`
+	// Autoscaling signals when runners should be added or removed
+	Autoscaling Autoscaling `yaml:"autoscaling" json:"autoscaling"`
+	// Workspaces keeps warm workspaces in dataDir/workspaces for pipelines
+	// that configure a workspace
+	Workspaces Workspaces `yaml:"workspaces" json:"workspaces"`
+	// JobWorkspaces runs the steps of other jobs in a directory of their
+	// own in dataDir/job-workspaces
+	JobWorkspaces JobWorkspaces `yaml:"jobWorkspaces" json:"jobWorkspaces"`
+	// Containers runs the steps that name an image in a container of it
+	Containers Containers `yaml:"containers" json:"containers"`
+	// DiskQuotas bounds the disk jobs use and keeps space free for the
+	// server
+	DiskQuotas DiskQuotas `yaml:"diskQuotas" json:"diskQuotas"`
+	// Costs are the rates job costs are estimated with
+	Costs Costs `yaml:"costs" json:"costs"`
+	// Discovery generates pipelines for the projects in a monorepo
+	Discovery Discovery `yaml:"discovery" json:"discovery"`
+	// StepOutputLimit is the size step output is truncated to, such as
+	// "4Mi". Steps can override it with output_limit.
+	StepOutputLimit string `yaml:"stepOutputLimit,omitempty" json:"stepOutputLimit,omitempty"`
+	// InfraRetries re-dispatches steps failing with infrastructure failures
+	InfraRetries InfraRetries `yaml:"infraRetries" json:"infraRetries"`
+	// DurationAnomalies flags steps that take much longer or shorter than
+	// usual
+	DurationAnomalies DurationAnomalies `yaml:"durationAnomalies" json:"durationAnomalies"`
+	// Dependencies are where dependency scanners resolve packages
+	Dependencies Dependencies `yaml:"dependencies" json:"dependencies"`
+	// Offline runs the server air-gapped
+	Offline Offline `yaml:"offline" json:"offline"`
+	// ArtifactRetention is the retention of the artifacts of pipelines
+	// without their own artifact_retention
+	ArtifactRetention *core.RetentionPolicy `yaml:"artifactRetention,omitempty" json:"artifactRetention,omitempty"`
+	// FeatureFlags turn engine behaviors on and off, for every pipeline
+	// or targeted ones
+	FeatureFlags []FeatureFlag `yaml:"featureFlags,omitempty" json:"featureFlags,omitempty"`
+	// Crypto restricts and selects the server's cryptographic algorithms
+	Crypto Crypto `yaml:"crypto" json:"crypto"`
+	// Export writes job, step and finding records for analytics
+	// warehouses
+	Export Export `yaml:"export" json:"export"`
+	// EventBus shares events between the replicas of a server
+	EventBus EventBus `yaml:"eventBus" json:"eventBus"`
+	// DependencyCache caches the Go modules and npm packages steps download
+	DependencyCache DependencyCache `yaml:"dependencyCache" json:"dependencyCache"`
+	// ReadOnly runs an observer of the data directory of another server.
+	// It serves the API without changes, runs no jobs and doesn't start
+	// background work that writes the data directory.
+	ReadOnly bool `yaml:"readOnly" json:"readOnly"`
+}
+
+// FeatureFlag sets the state of a feature flag. Pipelines and
+// ExceptPipelines are pipeline ID patterns the feature is turned on and
+// off for whatever Enabled is.
+type FeatureFlag struct {
+	Name            string   `yaml:"name" json:"name"`
+	Enabled         bool     `yaml:"enabled" json:"enabled"`
+	Pipelines       []string `yaml:"pipelines,omitempty" json:"pipelines,omitempty"`
+	ExceptPipelines []string `yaml:"exceptPipelines,omitempty" json:"exceptPipelines,omitempty"`
+}
+
+// EngineFeatureFlags returns the feature flags for the engine
+func (c *Config) EngineFeatureFlags() []core.FeatureFlag {
+	flags := make([]core.FeatureFlag, 0, len(c.FeatureFlags))
+	for _, flag := range c.FeatureFlags {
+		flags = append(flags, core.FeatureFlag(flag))
+	}
+	return flags
+}
+
+// Crypto configures the server's cryptography. FIPS mode requires a
+// BoringCrypto build, restricts checksums to FIPS-approved hashes, and
+// requires the generated secret key file rather than a secretKey
+// passphrase.
+type Crypto struct {
+	FIPS bool `yaml:"fips" json:"fips"`
+	// ChecksumAlgorithm is the hash release artifacts are checksummed
+	// with, sha256 by default
+	ChecksumAlgorithm string `yaml:"checksumAlgorithm,omitempty" json:"checksumAlgorithm,omitempty"`
+}
+
+// Export periodically writes the jobs, steps and tracked security findings
+// recorded since the last export as Format files under Path, partitioned by
+// date. Path is a directory, such as a mounted bucket, or an
+// s3://bucket/prefix URL; S3 credentials are read from the AWS_*
+// environment variables.
+type Export struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Path    string `yaml:"path" json:"path"`
+	// Format is csv, the default, or parquet
+	Format string `yaml:"format,omitempty" json:"format,omitempty"`
+	// Interval is how often records are exported, 1h by default
+	Interval string `yaml:"interval,omitempty" json:"interval,omitempty"`
+	// Region is the bucket's region, and Endpoint overrides
+	// https://s3.<region>.amazonaws.com for S3-compatible stores
+	Region   string `yaml:"region,omitempty" json:"region,omitempty"`
+	Endpoint string `yaml:"endpoint,omitempty" json:"endpoint,omitempty"`
+}
+
+// EventBus publishes events to a Redis stream the replicas of a server
+// share, so listeners of any replica read the events of all of them and
+// catch up from their last position. Without it events are kept in memory.
+type EventBus struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// URL is a redis:// or rediss:// URL, such as
+	// redis://:password@localhost:6379/0
+	URL string `yaml:"url" json:"url"`
+	// Stream is the stream key, conveyor:events by default
+	Stream string `yaml:"stream,omitempty" json:"stream,omitempty"`
+	// MaxLen is about how many events the stream keeps, 100000 by default
+	MaxLen int `yaml:"maxLen,omitempty" json:"maxLen,omitempty"`
+	// Replica names this server in the events it emits, the hostname by
+	// default
+	Replica string `yaml:"replica,omitempty" json:"replica,omitempty"`
+}
+
+// DependencyCache is a pull-through cache of the Go module proxy and the
+// npm registry, served at /depcache/go and /depcache/npm. Steps are pointed
+// at it with GOPROXY and npm_config_registry unless they set their own.
+// Cached copies are served when the upstream is down, and in offline mode
+// the upstream is never contacted. Allow and Deny are glob patterns of
+// module paths and package names, such as "github.com/acme/*" or "@acme/*";
+// Deny wins, and an empty Allow allows everything.
+type DependencyCache struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// URL is where steps reach the cache, such as
+	// http://conveyor.internal:8080/depcache, the local server by default.
+	// Set it when steps run on agents.
+	URL string `yaml:"url,omitempty" json:"url,omitempty"`
+	// GoProxy and NpmRegistry are the upstreams, https://proxy.golang.org
+	// and https://registry.npmjs.org by default
+	GoProxy     string   `yaml:"goProxy,omitempty" json:"goProxy,omitempty"`
+	NpmRegistry string   `yaml:"npmRegistry,omitempty" json:"npmRegistry,omitempty"`
+	Allow       []string `yaml:"allow,omitempty" json:"allow,omitempty"`
+	Deny        []string `yaml:"deny,omitempty" json:"deny,omitempty"`
+	// MetadataTTL is how long version lists and npm package documents are
+	// served before being refreshed, 5m by default. Module and package
+	// files never change and are kept.
+	MetadataTTL string `yaml:"metadataTTL,omitempty" json:"metadataTTL,omitempty"`
+}
+
+// Offline is the air-gapped mode. Scanners use the databases of the bundle
+// made by "conveyor bundle-databases", plugins are installed from the
+// plugin mirror, and HTTP requests from the server to hosts other than
+// loopback and AllowHosts are blocked and logged.
+type Offline struct {
+	Enabled      bool     `yaml:"enabled" json:"enabled"`
+	Bundle       string   `yaml:"bundle,omitempty" json:"bundle,omitempty"`
+	PluginMirror string   `yaml:"pluginMirror,omitempty" json:"pluginMirror,omitempty"`
+	AllowHosts   []string `yaml:"allowHosts,omitempty" json:"allowHosts,omitempty"`
+}
+
+// Dependencies are the private registries dependency and vulnerability
+// scanners resolve packages through, and the proxy they reach the network
+// through
+type Dependencies struct {
+	Registries []Registry `yaml:"registries,omitempty" json:"registries,omitempty"`
+	Proxy      Proxy      `yaml:"proxy,omitempty" json:"proxy,omitempty"`
+}
+
+// Registry is a package registry of an ecosystem (npm, pypi or go).
+// Packages matching one of its scopes, such as "@acme" or
+// "github.com/acme/", resolve through it; a registry without scopes
+// replaces the ecosystem's public registry. The token is read from the
+// TokenEnv variable of the step or server.
+type Registry struct {
+	Name      string   `yaml:"name" json:"name"`
+	Ecosystem string   `yaml:"ecosystem" json:"ecosystem"`
+	URL       string   `yaml:"url" json:"url"`
+	Scopes    []string `yaml:"scopes,omitempty" json:"scopes,omitempty"`
+	Username  string   `yaml:"username,omitempty" json:"username,omitempty"`
+	TokenEnv  string   `yaml:"tokenEnv,omitempty" json:"tokenEnv,omitempty"`
+}
+
+// Proxy is the HTTP proxy scanners use. NoProxy lists hosts, domain
+// suffixes such as ".corp.example.com", and "*" reached directly.
+type Proxy struct {
+	HTTP    string `yaml:"http,omitempty" json:"http,omitempty"`
+	HTTPS   string `yaml:"https,omitempty" json:"https,omitempty"`
+	NoProxy string `yaml:"noProxy,omitempty" json:"noProxy,omitempty"`
+}
+
+// registryEcosystems are the ecosystems registries can be configured for
+var registryEcosystems = map[string]bool{"npm": true, "pypi": true, "go": true}
+
+// InfraRetries configures how often, and after how long, steps failing with
+// an infrastructure failure are re-dispatched, preferably to another
+// runner, without using their retry budget. A max of 0 disables it.
+type InfraRetries struct {
+	Max   int    `yaml:"max" json:"max"`
+	Delay string `yaml:"delay" json:"delay"`
+}
+
+// Queue orders steps waiting for a runner. Policy "fifo", the default,
+// starts them in the order they started waiting; "fair" interleaves them
+// across projects by weighted round-robin. A project is a pipeline's team,
+// or the pipeline itself without one, and Weights gives projects a larger
+// share of the runners than the default 1. MaxJobs limits the jobs running
+// at once; other jobs wait in line. Zero runs every job right away.
+type Queue struct {
+	Policy  string         `yaml:"policy,omitempty" json:"policy,omitempty"`
+	Weights map[string]int `yaml:"weights,omitempty" json:"weights,omitempty"`
+	MaxJobs int            `yaml:"maxJobs,omitempty" json:"maxJobs,omitempty"`
+}
+
+// Autoscaling signals scale-up when QueueDepth steps wait for runners and
+// scale-down when runners have been idle for IdleAfter, at most once per
+// Cooldown. Provider "webhook" posts signals to URL, "kubernetes" sets the
+// replicas of a deployment or statefulset and "aws" the desired capacity
+// of an Auto Scaling group. DryRun only reports the recommended capacity.
+type Autoscaling struct {
+	Enabled    bool              `yaml:"enabled" json:"enabled"`
+	DryRun     bool              `yaml:"dryRun" json:"dryRun"`
+	Provider   string            `yaml:"provider,omitempty" json:"provider,omitempty"`
+	URL        string            `yaml:"url,omitempty" json:"url,omitempty"`
+	QueueDepth int               `yaml:"queueDepth,omitempty" json:"queueDepth,omitempty"`
+	IdleAfter  string            `yaml:"idleAfter,omitempty" json:"idleAfter,omitempty"`
+	Cooldown   string            `yaml:"cooldown,omitempty" json:"cooldown,omitempty"`
+	MinRunners int               `yaml:"minRunners,omitempty" json:"minRunners,omitempty"`
+	MaxRunners int               `yaml:"maxRunners,omitempty" json:"maxRunners,omitempty"`
+	Kubernetes KubernetesScaling `yaml:"kubernetes,omitempty" json:"kubernetes,omitempty"`
+	AWS        AWSScaling        `yaml:"aws,omitempty" json:"aws,omitempty"`
+}
+
+// KubernetesScaling is the workload whose replicas are the runners. The
+// API server, token and CA default to the pod's service account.
+type KubernetesScaling struct {
+	APIServer string `yaml:"apiServer,omitempty" json:"apiServer,omitempty"`
+	Namespace string `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	// Kind is "deployment", the default, or "statefulset"
+	Kind      string `yaml:"kind,omitempty" json:"kind,omitempty"`
+	Name      string `yaml:"name" json:"name"`
+	TokenFile string `yaml:"tokenFile,omitempty" json:"tokenFile,omitempty"`
+	CAFile    string `yaml:"caFile,omitempty" json:"caFile,omitempty"`
+}
+
+// AWSScaling is the Auto Scaling group whose instances are the runners.
+// Credentials come from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables.
+type AWSScaling struct {
+	Region string `yaml:"region" json:"region"`
+	Group  string `yaml:"group" json:"group"`
+	// Endpoint overrides the regional Auto Scaling endpoint
+	Endpoint string `yaml:"endpoint,omitempty" json:"endpoint,omitempty"`
+}
+
+// DurationAnomalies flags a step duration more than StdDevs standard
+// deviations or Percent percent from the mean of the step's last Window
+// successful durations, once there are MinSamples of them. Zero StdDevs and
+// Percent turn the alerts off.
+type DurationAnomalies struct {
+	StdDevs    float64 `yaml:"stdDevs" json:"stdDevs"`
+	Percent    float64 `yaml:"percent" json:"percent"`
+	MinSamples int     `yaml:"minSamples" json:"minSamples"`
+	Window     int     `yaml:"window" json:"window"`
+}
+
+// Discovery scans root for projects (go.mod, package.json, pom.xml,
+// Dockerfile) and generates a pipeline per project in the pipelines
+// directory. Templates replace the built-in template of a project kind.
+type Discovery struct {
+	Enabled   bool              `yaml:"enabled" json:"enabled"`
+	Root      string            `yaml:"root" json:"root"`
+	Templates map[string]string `yaml:"templates,omitempty" json:"templates,omitempty"`
+	Exclude   []string          `yaml:"exclude,omitempty" json:"exclude,omitempty"`
+}
+
+// Costs prices the CPU and memory steps request per minute, and runner time
+// per minute by runner name or label
+type Costs struct {
+	Currency  string             `yaml:"currency,omitempty" json:"currency,omitempty"`
+	CPUMinute float64            `yaml:"cpuMinute,omitempty" json:"cpuMinute,omitempty"`
+	GBMinute  float64            `yaml:"gbMinute,omitempty" json:"gbMinute,omitempty"`
+	Runners   map[string]float64 `yaml:"runners,omitempty" json:"runners,omitempty"`
+	// Carbon enables energy and gCO2e estimates alongside costs
+	Carbon *Carbon `yaml:"carbon,omitempty" json:"carbon,omitempty"`
+}
+
+// Carbon configures the grid intensity, in gCO2e per kWh, by default and per
+// runner name or label, and the power draw steps are estimated with
+type Carbon struct {
+	GridIntensity float64            `yaml:"gridIntensity" json:"gridIntensity"`
+	Runners       map[string]float64 `yaml:"runners,omitempty" json:"runners,omitempty"`
+	CPUWatts      float64            `yaml:"cpuWatts,omitempty" json:"cpuWatts,omitempty"`
+	GBWatts       float64            `yaml:"gbWatts,omitempty" json:"gbWatts,omitempty"`
+	PUE           float64            `yaml:"pue,omitempty" json:"pue,omitempty"`
+}
+
+// Workspaces configures warm workspaces and their eviction. Workspaces
+// unused for maxAge are evicted, then the least recently used ones while
+// the total is over maxSizeMB. Zero values are unlimited.
+type Workspaces struct {
+	Enabled        bool   `yaml:"enabled" json:"enabled"`
+	MaxAge         string `yaml:"maxAge,omitempty" json:"maxAge,omitempty"`
+	MaxSizeMB      int64  `yaml:"maxSizeMB,omitempty" json:"maxSizeMB,omitempty"`
+	MaxPerPipeline int    `yaml:"maxPerPipeline,omitempty" json:"maxPerPipeline,omitempty"`
+}
+
+// JobWorkspaces gives every job its own directory to run in instead of the
+// server's working directory. The directories of finished jobs are kept
+// for Retention, such as "24h", and deleted right away when it is "0".
+type JobWorkspaces struct {
+	Enabled   bool   `yaml:"enabled" json:"enabled"`
+	Retention string `yaml:"retention,omitempty" json:"retention,omitempty"`
+}
+
+// AccessLog logs each request as a JSON line with its method, route
+// template, status, latency, principal and response size. Only SampleRate
+// of the requests that succeed faster than Slow, such as "1s", are logged,
+// all of them by default; failed and slow requests always are. Requests to
+// the route templates in Exclude, such as "/api/health", are not logged.
+type AccessLog struct {
+	Enabled    bool     `yaml:"enabled" json:"enabled"`
+	SampleRate float64  `yaml:"sampleRate" json:"sampleRate"`
+	Slow       string   `yaml:"slow,omitempty" json:"slow,omitempty"`
+	Exclude    []string `yaml:"exclude,omitempty" json:"exclude,omitempty"`
+}
+
+// Metrics serves request counts and latencies per route at /metrics in the
+// Prometheus text format. Scrapers send Token as a bearer token when it is
+// set. Buckets are the upper bounds of the latency histograms in seconds.
+type Metrics struct {
+	Enabled bool      `yaml:"enabled" json:"enabled"`
+	Token   string    `yaml:"token,omitempty" json:"-"`
+	Buckets []float64 `yaml:"buckets,omitempty" json:"buckets,omitempty"`
+}
+
+// Containers runs the steps that name an image in a container of it with
+// the docker CLI. Network, for steps without services, defaults to docker's
+// "bridge" network, User runs commands as another user such as
+// "1000:1000", and Pull is missing, always or never.
+type Containers struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Binary  string `yaml:"binary,omitempty" json:"binary,omitempty"`
+	Network string `yaml:"network,omitempty" json:"network,omitempty"`
+	User    string `yaml:"user,omitempty" json:"user,omitempty"`
+	Pull    string `yaml:"pull,omitempty" json:"pull,omitempty"`
+}
+
+// DiskQuotas bounds the disk jobs use. Steps whose job directory grows over
+// JobQuota, such as "20Gi", are stopped; pipelines can set their own
+// disk_quota. Steps don't start, and running ones are stopped, while less
+// than Reserve is free on the filesystem of the data directory. Usage is
+// measured every Interval, 5s by default.
+type DiskQuotas struct {
+	JobQuota string `yaml:"jobQuota,omitempty" json:"jobQuota,omitempty"`
+	Reserve  string `yaml:"reserve,omitempty" json:"reserve,omitempty"`
+	Interval string `yaml:"interval,omitempty" json:"interval,omitempty"`
+}
+
+// Runner configures a shell runner that runs steps selecting its labels
+type Runner struct {
+	Name   string   `yaml:"name" json:"name"`
+	Labels []string `yaml:"labels" json:"labels"`
+	// Capacity is the number of steps the runner runs at once; 0 is unlimited
+	Capacity int `yaml:"capacity" json:"capacity"`
+	// CPU, in cores or millicores such as "500m", and Memory, such as
+	// "8Gi", are the resources steps can reserve. Empty is not accounted.
+	CPU    string `yaml:"cpu,omitempty" json:"cpu,omitempty"`
+	Memory string `yaml:"memory,omitempty" json:"memory,omitempty"`
+	Dir    string `yaml:"dir,omitempty" json:"dir,omitempty"`
+	Shell  string `yaml:"shell,omitempty" json:"shell,omitempty"`
+}
+
+// Auth configures API authentication and SCIM provisioning of users and
+// teams. When enabled, API requests need the bearer token of an active user
+// or the admin token.
+type Auth struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// AdminToken is a bootstrap token with the admin role
+	AdminToken string `yaml:"adminToken,omitempty" json:"-"`
+	// SCIMToken authenticates the identity provider on /scim/v2. SCIM is
+	// disabled when it is empty.
+	SCIMToken string `yaml:"scimToken,omitempty" json:"-"`
+	// Policy delegates authorization decisions to an external service
+	Policy AuthPolicy `yaml:"policy" json:"policy"`
+}
+
+// AuthPolicy asks an external policy service at URL whether to allow each
+// request RBAC allows, or every request when ReplaceRBAC is set. Type
+// "opa" queries an OPA decision, others a plain HTTP endpoint; Token is
+// sent as a bearer token. Decisions are cached for CacheTTL, 30s by
+// default, and the service is given Timeout, 2s by default, to answer.
+// Requests are denied while it fails, unless FailOpen is set.
+type AuthPolicy struct {
+	URL         string `yaml:"url,omitempty" json:"url,omitempty"`
+	Type        string `yaml:"type,omitempty" json:"type,omitempty"`
+	Token       string `yaml:"token,omitempty" json:"-"`
+	Timeout     string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	CacheTTL    string `yaml:"cacheTTL,omitempty" json:"cacheTTL,omitempty"`
+	FailOpen    bool   `yaml:"failOpen" json:"failOpen"`
+	ReplaceRBAC bool   `yaml:"replaceRBAC" json:"replaceRBAC"`
+}
+
+// Timeouts returns how long the policy service has to answer, and how long
+// its decisions are cached
+func (p AuthPolicy) Timeouts() (timeout, cacheTTL time.Duration) {
+	return httpDuration(p.Timeout, 2*time.Second), httpDuration(p.CacheTTL, 30*time.Second)
+}
+
+// HTTP tunes how the server reads requests and writes responses. Durations
+// left empty take secure defaults; "0" disables a timeout.
+type HTTP struct {
+	// ReadHeaderTimeout bounds reading request headers, 10s by default
+	ReadHeaderTimeout string `yaml:"readHeaderTimeout,omitempty" json:"readHeaderTimeout,omitempty"`
+	// ReadTimeout bounds reading a whole request, including uploads, 10m
+	// by default
+	ReadTimeout string `yaml:"readTimeout,omitempty" json:"readTimeout,omitempty"`
+	// WriteTimeout bounds writing a response, 10m by default. Keep it above
+	// the longest long poll, 5m.
+	WriteTimeout string `yaml:"writeTimeout,omitempty" json:"writeTimeout,omitempty"`
+	// IdleTimeout closes keep-alive connections idle this long, 2m by
+	// default
+	IdleTimeout string `yaml:"idleTimeout,omitempty" json:"idleTimeout,omitempty"`
+	// StreamWriteTimeout bounds each write of an event stream or
+	// WebSocket, which have no overall timeout, 30s by default
+	StreamWriteTimeout string `yaml:"streamWriteTimeout,omitempty" json:"streamWriteTimeout,omitempty"`
+	// MaxHeaderBytes bounds the size of request headers, such as "64Ki",
+	// 256Ki by default
+	MaxHeaderBytes string `yaml:"maxHeaderBytes,omitempty" json:"maxHeaderBytes,omitempty"`
+	// TLS serves HTTPS, and HTTP/2 with it, from a certificate and key
+	TLS   TLS   `yaml:"tls" json:"tls"`
+	HTTP2 HTTP2 `yaml:"http2" json:"http2"`
+}
+
+// TLS is the server's certificate and key files in PEM
+type TLS struct {
+	CertFile string `yaml:"certFile,omitempty" json:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty" json:"keyFile,omitempty"`
+}
+
+// HTTP2 tunes HTTP/2, which is served over TLS unless Disabled, and over
+// plain connections when H2C is set, such as behind a proxy terminating TLS
+type HTTP2 struct {
+	Disabled bool `yaml:"disabled" json:"disabled"`
+	H2C      bool `yaml:"h2c" json:"h2c"`
+	// MaxConcurrentStreams bounds the requests of a connection in flight
+	// at once, 250 by default
+	MaxConcurrentStreams uint32 `yaml:"maxConcurrentStreams,omitempty" json:"maxConcurrentStreams,omitempty"`
+	// MaxReadFrameSize bounds the frames clients may send, such as "1Mi",
+	// 1Mi by default
+	MaxReadFrameSize string `yaml:"maxReadFrameSize,omitempty" json:"maxReadFrameSize,omitempty"`
+}
+
+// HTTPTimeouts are the server's timeouts, with defaults for those not set
+type HTTPTimeouts struct {
+	ReadHeader  time.Duration
+	Read        time.Duration
+	Write       time.Duration
+	Idle        time.Duration
+	StreamWrite time.Duration
+}
+
+// Timeouts returns the server's timeouts
+func (h HTTP) Timeouts() HTTPTimeouts {
+	return HTTPTimeouts{
+		ReadHeader:  httpDuration(h.ReadHeaderTimeout, 10*time.Second),
+		Read:        httpDuration(h.ReadTimeout, 10*time.Minute),
+		Write:       httpDuration(h.WriteTimeout, 10*time.Minute),
+		Idle:        httpDuration(h.IdleTimeout, 2*time.Minute),
+		StreamWrite: httpDuration(h.StreamWriteTimeout, 30*time.Second),
+	}
+}
+
+// HeaderBytes returns the most bytes of request headers
+func (h HTTP) HeaderBytes() int {
+	if size, err := core.ParseMemory(h.MaxHeaderBytes); err == nil && size > 0 {
+		return int(size)
+	}
+	return 256 << 10
+}
+
+// ReadFrameSize returns the largest HTTP/2 frame clients may send
+func (h HTTP2) ReadFrameSize() uint32 {
+	if size, err := core.ParseMemory(h.MaxReadFrameSize); err == nil && size > 0 {
+		return uint32(size)
+	}
+	return 1 << 20
+}
+
+// ConcurrentStreams returns the most HTTP/2 requests of a connection in
+// flight at once
+func (h HTTP2) ConcurrentStreams() uint32 {
+	if h.MaxConcurrentStreams > 0 {
+		return h.MaxConcurrentStreams
+	}
+	return 250
+}
+
+func httpDuration(value string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return fallback
+	}
+	return d
+}
+
+func (h HTTP) validate() []string {
+	var errs []string
+	for name, value := range map[string]string{
+		"readHeaderTimeout":  h.ReadHeaderTimeout,
+		"readTimeout":        h.ReadTimeout,
+		"writeTimeout":       h.WriteTimeout,
+		"idleTimeout":        h.IdleTimeout,
+		"streamWriteTimeout": h.StreamWriteTimeout,
+	} {
+		if d, err := time.ParseDuration(value); value != "" && (err != nil || d < 0) {
+			errs = append(errs, fmt.Sprintf("http: invalid %s %q", name, value))
+		}
+	}
+	if h.MaxHeaderBytes != "" {
+		if size, err := core.ParseMemory(h.MaxHeaderBytes); err != nil || size < 1<<10 || size > 64<<20 {
+			errs = append(errs, fmt.Sprintf("http: invalid maxHeaderBytes %q, want 1Ki to 64Mi", h.MaxHeaderBytes))
+		}
+	}
+	if h.HTTP2.MaxReadFrameSize != "" {
+		// The limits of SETTINGS_MAX_FRAME_SIZE
+		if size, err := core.ParseMemory(h.HTTP2.MaxReadFrameSize); err != nil || size < 16<<10 || size > 1<<24-1 {
+			errs = append(errs, fmt.Sprintf("http: invalid http2 maxReadFrameSize %q, want 16Ki to 16Mi", h.HTTP2.MaxReadFrameSize))
+		}
+	}
+	if (h.TLS.CertFile == "") != (h.TLS.KeyFile == "") {
+		errs = append(errs, "http: tls requires both certFile and keyFile")
+	}
+	sort.Strings(errs)
+	return errs
+}
+
+// CORS lists the origins, such as https://ci.example.com, browsers may call
+// the API and open WebSockets from. "*" allows any origin. Without a list
+// any origin may call the API, but WebSockets are only accepted from the
+// server's own origin.
+type CORS struct {
+	AllowOrigins []string `yaml:"allowOrigins,omitempty" json:"allowOrigins,omitempty"`
+}
+
+func (c CORS) validate() []string {
+	var errs []string
+	for _, origin := range c.AllowOrigins {
+		if u, err := url.Parse(origin); origin != "*" && (err != nil || !validHTTPURL(origin) || u.Path != "") {
+			errs = append(errs, fmt.Sprintf("cors: invalid origin %q, want a scheme and host or *", origin))
+		}
+	}
+	return errs
+}
+
+// PipelineSync configures watching the pipelines directory, or a git
+// repository cloned into it, and reconciling the engine with its files.
+// An interval of 0 disables polling so syncs only happen on webhooks.
+type PipelineSync struct {
+	Enabled  bool   `yaml:"enabled" json:"enabled"`
+	Interval string `yaml:"interval" json:"interval"`
+	SelfHeal bool   `yaml:"selfHeal" json:"selfHeal"`
+	ReadOnly bool   `yaml:"readOnly" json:"readOnly"`
+	Repo     string `yaml:"repo,omitempty" json:"repo,omitempty"`
+	Branch   string `yaml:"branch,omitempty" json:"branch,omitempty"`
+	// WebhookSecret verifies push webhooks that trigger a sync
+	WebhookSecret string `yaml:"webhookSecret,omitempty" json:"-"`
+}
+
+// Notification configures a notification channel for job events. Events
+// filters jobs by status, or for the cloudevents type engine events by type.
+type Notification struct {
+	Type       string   `yaml:"type" json:"type"`
+	URL        string   `yaml:"url,omitempty" json:"url,omitempty"`
+	Channel    string   `yaml:"channel,omitempty" json:"channel,omitempty"`
+	Recipients []string `yaml:"recipients,omitempty" json:"recipients,omitempty"`
+	Events     []string `yaml:"events,omitempty" json:"events,omitempty"`
+	// FailureClasses limits failed job notifications to failures of these
+	// classes, such as infrastructure
+	FailureClasses []string `yaml:"failureClasses,omitempty" json:"failureClasses,omitempty"`
+	// When limits notifications to those meeting a condition, such as
+	// job.status == 'failed' && job.durationMinutes > 30
+	When string `yaml:"when,omitempty" json:"when,omitempty"`
+}
+
+// Function types
+const (
+	FunctionLambda = "lambda"
+	FunctionGCF    = "gcf"
+	FunctionHTTP   = "http"
+)
+
+// Function is a serverless function invoked with the payload of a job or
+// step when one of Events is emitted. Lambda functions are invoked with
+// the AWS credentials of the server's environment; Cloud Functions and
+// other HTTP functions are posted to at URL, with the bearer token in the
+// TokenEnv environment variable when set.
+type Function struct {
+	Name string `yaml:"name" json:"name"`
+	// Type is lambda, gcf or http
+	Type string `yaml:"type" json:"type"`
+	// Function is the name or ARN of a Lambda function, and Region its
+	// region, AWS_REGION by default
+	Function string `yaml:"function,omitempty" json:"function,omitempty"`
+	Region   string `yaml:"region,omitempty" json:"region,omitempty"`
+	// URL is where Cloud Functions and HTTP functions are posted to. For
+	// Lambda it replaces the regional endpoint, such as for LocalStack.
+	URL      string `yaml:"url,omitempty" json:"url,omitempty"`
+	TokenEnv string `yaml:"tokenEnv,omitempty" json:"tokenEnv,omitempty"`
+	// Events are the event types the function is invoked on, such as
+	// job.started or step.completed, job.completed by default
+	Events []string `yaml:"events,omitempty" json:"events,omitempty"`
+	// Pipelines are glob patterns of the pipeline IDs the function is
+	// invoked for, every pipeline by default
+	Pipelines []string `yaml:"pipelines,omitempty" json:"pipelines,omitempty"`
+	// Retries is how often a failed invocation is retried, 2 by default
+	Retries *int `yaml:"retries,omitempty" json:"retries,omitempty"`
+	// Timeout bounds each invocation, 30s by default
+	Timeout string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// Capture records the function's response in the job's metadata
+	Capture bool `yaml:"capture,omitempty" json:"capture,omitempty"`
+}
+
+func (f Function) validate(i int) []string {
+	var errs []string
+	prefix := fmt.Sprintf("function %d", i+1)
+	if f.Name != "" {
+		prefix = fmt.Sprintf("function %s", f.Name)
+	} else {
+		errs = append(errs, fmt.Sprintf("%s: name is required", prefix))
+	}
+	switch f.Type {
+	case FunctionLambda:
+		if f.Function == "" {
+			errs = append(errs, fmt.Sprintf("%s: lambda requires a function", prefix))
+		}
+		if u, err := url.Parse(f.URL); f.URL != "" && (err != nil || u.Host == "") {
+			errs = append(errs, fmt.Sprintf("%s: invalid lambda endpoint %q", prefix, f.URL))
+		}
+	case FunctionGCF, FunctionHTTP:
+		if u, err := url.Parse(f.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("%s: %s requires an http or https url", prefix, f.Type))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("%s: unsupported type %q, want lambda, gcf or http", prefix, f.Type))
+	}
+	for _, pattern := range f.Pipelines {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: invalid pipeline pattern %q", prefix, pattern))
+		}
+	}
+	if f.Retries != nil && *f.Retries < 0 {
+		errs = append(errs, fmt.Sprintf("%s: retries must not be negative", prefix))
+	}
+	if d, err := time.ParseDuration(f.Timeout); f.Timeout != "" && (err != nil || d <= 0) {
+		errs = append(errs, fmt.Sprintf("%s: invalid timeout %q", prefix, f.Timeout))
+	}
+	return errs
+}
+
+// reloadable lists the fields that can change without restarting the server
+var reloadable = map[string]bool{
+	"LogLevel":          true,
+	"Notifications":     true,
+	"Functions":         true,
+	"ArtifactRetention": true,
+	"FeatureFlags":      true,
+	"DurationAnomalies": true,
+	"Queue":             true,
+	"AccessLog":         true,
+}
+
+// Default returns the configuration used when nothing else is specified
+func Default() *Config {
+	return &Config{
+		Host:              "",
+		Port:              8080,
+		DataDir:           "data",
+		PipelinesDir:      "pipelines",
+		LogLevel:          "info",
+		DrainTimeout:      "30s",
+		PipelineSync:      PipelineSync{Interval: "10s"},
+		JobWorkspaces:     JobWorkspaces{Enabled: true, Retention: "24h"},
+		Containers:        Containers{Enabled: true},
+		AccessLog:         AccessLog{SampleRate: 1},
+		InfraRetries:      InfraRetries{Max: 2, Delay: "5s"},
+		DurationAnomalies: DurationAnomalies(core.DefaultDurationAnomalyPolicy),
+	}
+}
+
+// Load reads the configuration from path, if set, and applies environment
+// overrides on top of it
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config: %w", err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config: %w", err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// applyEnv overrides configuration values from CONVEYOR_* variables
+func (c *Config) applyEnv() error {
+	if value := os.Getenv("CONVEYOR_HOST"); value != "" {
+		c.Host = value
+	}
+	if value := os.Getenv("CONVEYOR_PORT"); value != "" {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid CONVEYOR_PORT %q: %w", value, err)
+		}
+		c.Port = port
+	}
+	if value := os.Getenv("CONVEYOR_DATA_DIR"); value != "" {
+		c.DataDir = value
+	}
+	if value := os.Getenv("CONVEYOR_PIPELINES_DIR"); value != "" {
+		c.PipelinesDir = value
+	}
+	if value := os.Getenv("CONVEYOR_PIPELINE_SYNC"); value != "" {
+		c.PipelineSync.Enabled = value == "true"
+	}
+	if value := os.Getenv("CONVEYOR_GITOPS_WEBHOOK_SECRET"); value != "" {
+		c.PipelineSync.WebhookSecret = value
+	}
+	if value := os.Getenv("CONVEYOR_LOG_LEVEL"); value != "" {
+		c.LogLevel = value
+	}
+	if value := os.Getenv("CONVEYOR_TIMEZONE"); value != "" {
+		c.Timezone = value
+	}
+	if value := os.Getenv("CONVEYOR_QUEUE_POLICY"); value != "" {
+		c.Queue.Policy = value
+	}
+	if value := os.Getenv("CONVEYOR_DRAIN_TIMEOUT"); value != "" {
+		c.DrainTimeout = value
+	}
+	if value := os.Getenv("CONVEYOR_RESUME_JOBS"); value != "" {
+		c.ResumeJobs = value == "true"
+	}
+	if value := os.Getenv("CONVEYOR_SECRET_KEY"); value != "" {
+		c.SecretKey = value
+	}
+	if value := os.Getenv("CONVEYOR_AUTH"); value != "" {
+		c.Auth.Enabled = value == "true"
+	}
+	if value := os.Getenv("CONVEYOR_ADMIN_TOKEN"); value != "" {
+		c.Auth.AdminToken = value
+	}
+	if value := os.Getenv("CONVEYOR_SCIM_TOKEN"); value != "" {
+		c.Auth.SCIMToken = value
+	}
+	if value := os.Getenv("CONVEYOR_OFFLINE"); value != "" {
+		c.Offline.Enabled = value == "true"
+	}
+	if value := os.Getenv("CONVEYOR_FIPS"); value != "" {
+		c.Crypto.FIPS = value == "true"
+	}
+	if value := os.Getenv("CONVEYOR_READ_ONLY"); value != "" {
+		c.ReadOnly = value == "true"
+	}
+	return nil
+}
+
+// Validate checks the configuration for invalid values
+func (c *Config) Validate() error {
+	var errs []string
+
+	if c.Port <= 0 || c.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("port %d is out of range", c.Port))
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Sprintf("unknown log level %q", c.LogLevel))
+	}
+	if _, err := time.ParseDuration(c.DrainTimeout); err != nil {
+		errs = append(errs, fmt.Sprintf("invalid drain timeout %q", c.DrainTimeout))
+	}
+	if _, err := time.ParseDuration(c.PipelineSync.Interval); err != nil {
+		errs = append(errs, fmt.Sprintf("invalid pipeline sync interval %q", c.PipelineSync.Interval))
+	}
+	for i, n := range c.Notifications {
+		switch n.Type {
+		case "webhook", "slack", "cloudevents":
+			if n.URL == "" {
+				errs = append(errs, fmt.Sprintf("notification %d: %s requires a url", i+1, n.Type))
+			}
+		default:
+			errs = append(errs, fmt.Sprintf("notification %d: unsupported type %q", i+1, n.Type))
+		}
+		if n.When != "" {
+			if n.Type == "cloudevents" {
+				errs = append(errs, fmt.Sprintf("notification %d: when doesn't apply to cloudevents", i+1))
+			} else if err := core.ValidateCondition(n.When); err != nil {
+				errs = append(errs, fmt.Sprintf("notification %d: %v", i+1, err))
+			}
+		}
+	}
+	if c.Auth.Enabled && c.Auth.AdminToken == "" {
+		errs = append(errs, "auth requires an admin token")
+	}
+	if policy := c.Auth.Policy; policy.URL != "" {
+		if !c.Auth.Enabled {
+			errs = append(errs, "auth policy requires auth to be enabled")
+		}
+		if !validHTTPURL(policy.URL) {
+			errs = append(errs, fmt.Sprintf("invalid auth policy url %q", policy.URL))
+		}
+		switch policy.Type {
+		case "", "http", "opa":
+		default:
+			errs = append(errs, fmt.Sprintf("invalid auth policy type %q, want http or opa", policy.Type))
+		}
+		for name, value := range map[string]string{"timeout": policy.Timeout, "cacheTTL": policy.CacheTTL} {
+			if d, err := time.ParseDuration(value); value != "" && (err != nil || d < 0) {
+				errs = append(errs, fmt.Sprintf("invalid auth policy %s %q", name, value))
+			}
+		}
+	} else if policy.ReplaceRBAC {
+		errs = append(errs, "auth policy replaceRBAC requires a url")
+	}
+	if c.Workspaces.MaxAge != "" {
+		if d, err := time.ParseDuration(c.Workspaces.MaxAge); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("invalid workspace max age %q", c.Workspaces.MaxAge))
+		}
+	}
+	if d, err := time.ParseDuration(c.JobWorkspaces.Retention); c.JobWorkspaces.Retention != "" && (err != nil || d < 0) {
+		errs = append(errs, fmt.Sprintf("invalid job workspace retention %q", c.JobWorkspaces.Retention))
+	}
+	switch c.Containers.Pull {
+	case "", "missing", "always", "never":
+	default:
+		errs = append(errs, fmt.Sprintf("invalid container pull policy %q", c.Containers.Pull))
+	}
+	if c.Workspaces.MaxSizeMB < 0 || c.Workspaces.MaxPerPipeline < 0 {
+		errs = append(errs, "workspace limits must not be negative")
+	}
+	if c.Costs.CPUMinute < 0 || c.Costs.GBMinute < 0 {
+		errs = append(errs, "cost rates must not be negative")
+	}
+	for name, rate := range c.Costs.Runners {
+		if rate < 0 {
+			errs = append(errs, fmt.Sprintf("cost rate of runner %q must not be negative", name))
+		}
+	}
+	if carbon := c.Costs.Carbon; carbon != nil {
+		if carbon.GridIntensity < 0 || carbon.CPUWatts < 0 || carbon.GBWatts < 0 {
+			errs = append(errs, "carbon factors must not be negative")
+		}
+		if carbon.PUE != 0 && carbon.PUE < 1 {
+			errs = append(errs, fmt.Sprintf("carbon pue %v must be at least 1", carbon.PUE))
+		}
+		for name, intensity := range carbon.Runners {
+			if intensity < 0 {
+				errs = append(errs, fmt.Sprintf("grid intensity of runner %q must not be negative", name))
+			}
+		}
+	}
+	if c.StepOutputLimit != "" {
+		if err := core.ValidateOutputLimit(c.StepOutputLimit); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if c.InfraRetries.Max < 0 {
+		errs = append(errs, "infraRetries max must not be negative")
+	}
+	if c.InfraRetries.Delay != "" {
+		if delay, err := time.ParseDuration(c.InfraRetries.Delay); err != nil || delay < 0 {
+			errs = append(errs, fmt.Sprintf("invalid infraRetries delay %q", c.InfraRetries.Delay))
+		}
+	}
+	if a := c.DurationAnomalies; a.StdDevs < 0 || a.Percent < 0 || a.MinSamples < 0 || a.Window < 0 {
+		errs = append(errs, "durationAnomalies values must not be negative")
+	}
+	switch c.Queue.Policy {
+	case "", core.QueueFIFO, core.QueueFair:
+	default:
+		errs = append(errs, fmt.Sprintf("invalid queue policy %q, want %s or %s", c.Queue.Policy, core.QueueFIFO, core.QueueFair))
+	}
+	for project, weight := range c.Queue.Weights {
+		if weight <= 0 {
+			errs = append(errs, fmt.Sprintf("queue weight of %q must be positive", project))
+		}
+	}
+	if c.Queue.MaxJobs < 0 {
+		errs = append(errs, "queue maxJobs must not be negative")
+	}
+	if c.AccessLog.SampleRate < 0 || c.AccessLog.SampleRate > 1 {
+		errs = append(errs, "accessLog sampleRate must be between 0 and 1")
+	}
+	if c.AccessLog.Slow != "" {
+		if slow, err := time.ParseDuration(c.AccessLog.Slow); err != nil || slow < 0 {
+			errs = append(errs, fmt.Sprintf("invalid accessLog slow %q", c.AccessLog.Slow))
+		}
+	}
+	for i, bound := range c.Metrics.Buckets {
+		if bound <= 0 || i > 0 && bound <= c.Metrics.Buckets[i-1] {
+			errs = append(errs, "metrics buckets must be positive and increasing")
+			break
+		}
+	}
+	names := make(map[string]bool, len(c.Functions))
+	for i, f := range c.Functions {
+		errs = append(errs, f.validate(i)...)
+		if f.Name != "" && names[f.Name] {
+			errs = append(errs, fmt.Sprintf("function %s is configured twice", f.Name))
+		}
+		names[f.Name] = true
+	}
+	errs = append(errs, c.Autoscaling.validate()...)
+	errs = append(errs, c.Export.validate()...)
+	errs = append(errs, c.EventBus.validate()...)
+	errs = append(errs, c.DependencyCache.validate()...)
+	errs = append(errs, c.DiskQuotas.validate()...)
+	errs = append(errs, c.CORS.validate()...)
+	errs = append(errs, c.HTTP.validate()...)
+	errs = append(errs, c.Dependencies.validate()...)
+	if c.Offline.Enabled && c.Offline.Bundle == "" {
+		errs = append(errs, "offline mode requires a database bundle directory")
+	}
+	if r := c.ArtifactRetention; r != nil && (r.Days < 0 || r.Count < 0) {
+		errs = append(errs, "artifactRetention days and count must not be negative")
+	}
+	flags := make(map[string]bool)
+	for _, flag := range c.EngineFeatureFlags() {
+		if err := core.ValidateFeatureFlag(flag); err != nil {
+			errs = append(errs, err.Error())
+		}
+		if flags[flag.Name] {
+			errs = append(errs, fmt.Sprintf("duplicate feature flag %q", flag.Name))
+		}
+		flags[flag.Name] = true
+	}
+	if err := core.ValidateTimezone(c.Timezone); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if c.Crypto.ChecksumAlgorithm != "" {
+		if err := core.ValidateHashAlgorithm(c.Crypto.ChecksumAlgorithm, c.Crypto.FIPS); err != nil {
+			errs = append(errs, "crypto: "+err.Error())
+		}
+	}
+	if c.Discovery.Enabled && c.Discovery.Root == "" {
+		errs = append(errs, "discovery requires a root directory")
+	}
+	runners := make(map[string]bool)
+	for i, r := range c.Runners {
+		switch {
+		case r.Name == "":
+			errs = append(errs, fmt.Sprintf("runner %d: name is required", i+1))
+		case runners[r.Name]:
+			errs = append(errs, fmt.Sprintf("runner %d: duplicate name %q", i+1, r.Name))
+		}
+		runners[r.Name] = true
+		if r.Capacity < 0 {
+			errs = append(errs, fmt.Sprintf("runner %d: capacity must not be negative", i+1))
+		}
+		if _, err := core.ParseResources(r.CPU, r.Memory); err != nil {
+			errs = append(errs, fmt.Sprintf("runner %d: %v", i+1, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(errs, "\n  - "))
+	}
+	return nil
+}
+
+// validate checks the registries and proxy, returning every problem
+func (d Dependencies) validate() []string {
+	var errs []string
+	names := make(map[string]bool)
+	defaults := make(map[string]bool)
+	for i, r := range d.Registries {
+		switch {
+		case r.Name == "":
+			errs = append(errs, fmt.Sprintf("registry %d: name is required", i+1))
+		case names[r.Name]:
+			errs = append(errs, fmt.Sprintf("registry %d: duplicate name %q", i+1, r.Name))
+		}
+		names[r.Name] = true
+		if !registryEcosystems[r.Ecosystem] {
+			errs = append(errs, fmt.Sprintf("registry %d: unsupported ecosystem %q, want npm, pypi or go", i+1, r.Ecosystem))
+		}
+		if !validHTTPURL(r.URL) {
+			errs = append(errs, fmt.Sprintf("registry %d: invalid url %q", i+1, r.URL))
+		}
+		if len(r.Scopes) == 0 {
+			if defaults[r.Ecosystem] {
+				errs = append(errs, fmt.Sprintf("registry %d: more than one %s registry without scopes", i+1, r.Ecosystem))
+			}
+			defaults[r.Ecosystem] = true
+		}
+		if r.Username != "" && r.TokenEnv == "" {
+			errs = append(errs, fmt.Sprintf("registry %d: username requires a tokenEnv", i+1))
+		}
+	}
+	if d.Proxy.HTTP != "" && !validHTTPURL(d.Proxy.HTTP) {
+		errs = append(errs, fmt.Sprintf("invalid http proxy %q", d.Proxy.HTTP))
+	}
+	if d.Proxy.HTTPS != "" && !validHTTPURL(d.Proxy.HTTPS) {
+		errs = append(errs, fmt.Sprintf("invalid https proxy %q", d.Proxy.HTTPS))
+	}
+	return errs
+}
+
+// validate returns the problems of an enabled autoscaling configuration
+func (a Autoscaling) validate() []string {
+	if !a.Enabled {
+		return nil
+	}
+	var errs []string
+	switch a.Provider {
+	case "":
+		if !a.DryRun {
+			errs = append(errs, "autoscaling requires a provider unless dryRun is set")
+		}
+	case "webhook":
+		if !validHTTPURL(a.URL) {
+			errs = append(errs, fmt.Sprintf("autoscaling: invalid webhook url %q", a.URL))
+		}
+	case "kubernetes":
+		if a.Kubernetes.Name == "" {
+			errs = append(errs, "autoscaling: kubernetes requires the name of a deployment or statefulset")
+		}
+		if kind := a.Kubernetes.Kind; kind != "" && kind != "deployment" && kind != "statefulset" {
+			errs = append(errs, fmt.Sprintf("autoscaling: unsupported kubernetes kind %q, want deployment or statefulset", kind))
+		}
+	case "aws":
+		if a.AWS.Region == "" || a.AWS.Group == "" {
+			errs = append(errs, "autoscaling: aws requires a region and an Auto Scaling group")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("autoscaling: unsupported provider %q, want webhook, kubernetes or aws", a.Provider))
+	}
+	for name, value := range map[string]string{"idleAfter": a.IdleAfter, "cooldown": a.Cooldown} {
+		if d, err := time.ParseDuration(value); value != "" && (err != nil || d <= 0) {
+			errs = append(errs, fmt.Sprintf("autoscaling: invalid %s %q", name, value))
+		}
+	}
+	if a.QueueDepth < 0 || a.MinRunners < 0 || a.MaxRunners < 0 {
+		errs = append(errs, "autoscaling: queueDepth, minRunners and maxRunners must not be negative")
+	}
+	if a.MaxRunners > 0 && a.MinRunners > a.MaxRunners {
+		errs = append(errs, fmt.Sprintf("autoscaling: minRunners %d is more than maxRunners %d", a.MinRunners, a.MaxRunners))
+	}
+	return errs
+}
+
+// validate returns the problems of an enabled export configuration
+func (e Export) validate() []string {
+	if !e.Enabled {
+		return nil
+	}
+	var errs []string
+	if e.Path == "" {
+		errs = append(errs, "export requires a path")
+	} else if strings.HasPrefix(e.Path, "s3://") {
+		if u, err := url.Parse(e.Path); err != nil || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("export: invalid s3 path %q", e.Path))
+		}
+		if e.Region == "" {
+			errs = append(errs, "export: s3 requires a region")
+		}
+	}
+	if e.Format != "" && e.Format != "csv" && e.Format != "parquet" {
+		errs = append(errs, fmt.Sprintf("export: unsupported format %q, want csv or parquet", e.Format))
+	}
+	if d, err := time.ParseDuration(e.Interval); e.Interval != "" && (err != nil || d <= 0) {
+		errs = append(errs, fmt.Sprintf("export: invalid interval %q", e.Interval))
+	}
+	if e.Endpoint != "" && !validHTTPURL(e.Endpoint) {
+		errs = append(errs, fmt.Sprintf("export: invalid endpoint %q", e.Endpoint))
+	}
+	return errs
+}
+
+// validHTTPURL reports whether value is an absolute http or https URL
+func validHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Addr returns the listen address for the HTTP server
+func (c *Config) Addr() string {
+	return fmt.Sprintf("%s:%d", c.Host, c.Port)
+}
+
+// DrainTimeoutDuration returns the drain timeout as a duration
+func (c *Config) DrainTimeoutDuration() time.Duration {
+	timeout, err := time.ParseDuration(c.DrainTimeout)
+	if err != nil {
+		return 30 * time.Second
+	}
+	return timeout
+}
+
+// OutputLimit returns the step output limit in bytes, or zero for the
+// engine's default
+func (c *Config) OutputLimit() int64 {
+	limit, err := core.ParseMemory(c.StepOutputLimit)
+	if err != nil {
+		return 0
+	}
+	return limit
+}
+
+// AutoscalePolicy returns the engine's autoscale policy
+func (c *Config) AutoscalePolicy() core.AutoscalePolicy {
+	a := c.Autoscaling
+	policy := core.AutoscalePolicy{QueueDepth: a.QueueDepth, MinRunners: a.MinRunners, MaxRunners: a.MaxRunners, DryRun: a.DryRun}
+	policy.IdleAfter, _ = time.ParseDuration(a.IdleAfter)
+	policy.Cooldown, _ = time.ParseDuration(a.Cooldown)
+	return policy
+}
+
+func (b EventBus) validate() []string {
+	if !b.Enabled {
+		return nil
+	}
+	var errs []string
+	if u, err := url.Parse(b.URL); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		errs = append(errs, fmt.Sprintf("eventBus: invalid url %q, want redis:// or rediss://", b.URL))
+	}
+	if b.MaxLen < 0 {
+		errs = append(errs, fmt.Sprintf("eventBus: invalid maxLen %d", b.MaxLen))
+	}
+	return errs
+}
+
+func (d DependencyCache) validate() []string {
+	if !d.Enabled {
+		return nil
+	}
+	var errs []string
+	for _, field := range [][2]string{{"url", d.URL}, {"goProxy", d.GoProxy}, {"npmRegistry", d.NpmRegistry}} {
+		name, value := field[0], field[1]
+		if u, err := url.Parse(value); value != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			errs = append(errs, fmt.Sprintf("dependencyCache: invalid %s %q, want an http or https URL", name, value))
+		}
+	}
+	for _, pattern := range append(append([]string{}, d.Allow...), d.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			errs = append(errs, fmt.Sprintf("dependencyCache: invalid pattern %q", pattern))
+		}
+	}
+	if ttl, err := time.ParseDuration(d.MetadataTTL); d.MetadataTTL != "" && (err != nil || ttl < 0) {
+		errs = append(errs, fmt.Sprintf("dependencyCache: invalid metadataTTL %q", d.MetadataTTL))
+	}
+	return errs
+}
+
+func (d DiskQuotas) validate() []string {
+	var errs []string
+	if d.JobQuota != "" {
+		if err := core.ValidateDiskQuota(d.JobQuota); err != nil {
+			errs = append(errs, fmt.Sprintf("diskQuotas: %v", err))
+		}
+	}
+	if size, err := core.ParseMemory(d.Reserve); d.Reserve != "" && (err != nil || size <= 0) {
+		errs = append(errs, fmt.Sprintf("diskQuotas: invalid reserve %q", d.Reserve))
+	}
+	if interval, err := time.ParseDuration(d.Interval); d.Interval != "" && (err != nil || interval <= 0) {
+		errs = append(errs, fmt.Sprintf("diskQuotas: invalid interval %q", d.Interval))
+	}
+	return errs
+}
+
+// DiskQuotaPolicy returns the engine's disk quota policy, keeping the
+// reserve free on the filesystem of the data directory
+func (c *Config) DiskQuotaPolicy() core.DiskQuotaPolicy {
+	policy := core.DiskQuotaPolicy{ReserveDir: c.DataDir}
+	policy.JobBytes, _ = core.ParseMemory(c.DiskQuotas.JobQuota)
+	policy.ReserveBytes, _ = core.ParseMemory(c.DiskQuotas.Reserve)
+	policy.Interval, _ = time.ParseDuration(c.DiskQuotas.Interval)
+	return policy
+}
+
+// DependencyCacheTTL returns how long cached dependency metadata is served
+// before being refreshed
+func (c *Config) DependencyCacheTTL() time.Duration {
+	ttl, err := time.ParseDuration(c.DependencyCache.MetadataTTL)
+	if err != nil || ttl < 0 {
+		return 5 * time.Minute
+	}
+	return ttl
+}
+
+// ExportInterval returns how often records are exported
+func (c *Config) ExportInterval() time.Duration {
+	interval, err := time.ParseDuration(c.Export.Interval)
+	if err != nil || interval <= 0 {
+		return time.Hour
+	}
+	return interval
+}
+
+// InfraRetryDelay returns the delay before re-dispatching a step after an
+// infrastructure failure
+func (c *Config) InfraRetryDelay() time.Duration {
+	delay, err := time.ParseDuration(c.InfraRetries.Delay)
+	if err != nil || delay < 0 {
+		return 5 * time.Second
+	}
+	return delay
+}
+
+// SyncInterval returns the pipeline sync interval as a duration
+func (c *Config) SyncInterval() time.Duration {
+	interval, err := time.ParseDuration(c.PipelineSync.Interval)
+	if err != nil || interval < 0 {
+		return 10 * time.Second
+	}
+	return interval
+}
+
+// WorkspaceMaxAge returns the workspace max age as a duration, or zero when
+// it is unlimited
+func (c *Config) WorkspaceMaxAge() time.Duration {
+	maxAge, err := time.ParseDuration(c.Workspaces.MaxAge)
+	if err != nil || maxAge < 0 {
+		return 0
+	}
+	return maxAge
+}
+
+// JobWorkspaceRetention returns how long the directories of finished jobs
+// are kept, or zero when they are deleted right away
+func (c *Config) JobWorkspaceRetention() time.Duration {
+	retention, err := time.ParseDuration(c.JobWorkspaces.Retention)
+	if err != nil || retention < 0 {
+		return 0
+	}
+	return retention
+}
+
+// RestartRequired returns the names of fields that differ between c and next
+// and only take effect after a restart. The auth policy is reloadable, unlike
+// the rest of Auth.
+func (c *Config) RestartRequired(next *Config) []string {
+	var fields []string
+
+	currentAuth, nextAuth := c.Auth, next.Auth
+	currentAuth.Policy, nextAuth.Policy = AuthPolicy{}, AuthPolicy{}
+	current := reflect.ValueOf(c).Elem()
+	updated := reflect.ValueOf(next).Elem()
+	for i := 0; i < current.NumField(); i++ {
+		name := current.Type().Field(i).Name
+		if reloadable[name] {
+			continue
+		}
+		if name == "Auth" {
+			if !reflect.DeepEqual(currentAuth, nextAuth) {
+				fields = append(fields, name)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(current.Field(i).Interface(), updated.Field(i).Interface()) {
+			fields = append(fields, name)
+		}
+	}
+
+	return fields
+}
@@ -0,0 +1,572 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "conveyor.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Addr() != ":8080" {
+		t.Errorf("Addr() = %q, want %q", cfg.Addr(), ":8080")
+	}
+	if cfg.LogLevel != "info" {
+		t.Errorf("LogLevel = %q, want %q", cfg.LogLevel, "info")
+	}
+}
+
+func TestLoad_FileAndEnv(t *testing.T) {
+	path := writeConfig(t, `
+port: 9090
+logLevel: debug
+notifications:
+  - type: slack
+    url: https://hooks.example.com/x
+    events: [failed]
+`)
+	os.Setenv("CONVEYOR_PORT", "9191")
+	defer os.Unsetenv("CONVEYOR_PORT")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Port != 9191 {
+		t.Errorf("Port = %d, want 9191 from environment", cfg.Port)
+	}
+	if cfg.LogLevel != "debug" {
+		t.Errorf("LogLevel = %q, want %q", cfg.LogLevel, "debug")
+	}
+	if len(cfg.Notifications) != 1 || cfg.Notifications[0].Type != "slack" {
+		t.Errorf("Notifications = %+v, want one slack notification", cfg.Notifications)
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	path := writeConfig(t, `
+logLevel: loud
+notifications:
+  - type: pager
+`)
+	if _, err := Load(path); err == nil {
+		t.Fatal("Load() expected validation error, got nil")
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	current := Default()
+	next := Default()
+	next.LogLevel = "debug"
+	next.Notifications = []Notification{{Type: "webhook", URL: "http://x"}}
+	next.Auth.Policy = AuthPolicy{URL: "http://opa:8181/v1/data/conveyor/allow", Type: "opa"}
+
+	if fields := current.RestartRequired(next); len(fields) != 0 {
+		t.Errorf("RestartRequired() = %v, want none for reloadable fields", fields)
+	}
+
+	next.Port = 9000
+	next.DataDir = "/var/lib/conveyor"
+	next.Auth.Enabled = true
+	want := []string{"Port", "DataDir", "Auth"}
+	if fields := current.RestartRequired(next); !reflect.DeepEqual(fields, want) {
+		t.Errorf("RestartRequired() = %v, want %v", fields, want)
+	}
+}
+
+func TestLoad_AuthRequiresAdminToken(t *testing.T) {
+	path := writeConfig(t, `
+auth:
+  enabled: true
+`)
+	if _, err := Load(path); err == nil {
+		t.Fatal("Load() expected error for auth without admin token, got nil")
+	}
+
+	os.Setenv("CONVEYOR_ADMIN_TOKEN", "bootstrap")
+	defer os.Unsetenv("CONVEYOR_ADMIN_TOKEN")
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !cfg.Auth.Enabled || cfg.Auth.AdminToken != "bootstrap" {
+		t.Errorf("Auth = %+v, want enabled with admin token from environment", cfg.Auth)
+	}
+}
+
+func TestLoad_Runners(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+runners:
+  - name: builder
+    labels: [linux, docker]
+    capacity: 2
+    cpu: "8"
+    memory: 16Gi
+`))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(cfg.Runners) != 1 || cfg.Runners[0].Capacity != 2 || len(cfg.Runners[0].Labels) != 2 {
+		t.Errorf("Runners = %+v, want builder with two labels and capacity 2", cfg.Runners)
+	}
+
+	_, err = Load(writeConfig(t, `
+runners:
+  - name: builder
+  - name: builder
+    capacity: -1
+    memory: 16GB
+`))
+	if err == nil || !strings.Contains(err.Error(), "duplicate name") || !strings.Contains(err.Error(), "must not be negative") ||
+		!strings.Contains(err.Error(), `invalid memory quantity "16GB"`) {
+		t.Errorf("Load() error = %v, want duplicate name, capacity and memory errors", err)
+	}
+}
+
+func TestLoad_Queue(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "queue:\n  policy: fair\n  weights:\n    platform: 3\n  maxJobs: 8\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Queue.Policy != "fair" || cfg.Queue.Weights["platform"] != 3 || cfg.Queue.MaxJobs != 8 {
+		t.Errorf("Queue = %+v, want fair with platform weighted 3 and 8 jobs at once", cfg.Queue)
+	}
+
+	_, err = Load(writeConfig(t, "queue:\n  policy: random\n  weights:\n    platform: 0\n  maxJobs: -1\n"))
+	if err == nil || !strings.Contains(err.Error(), `invalid queue policy "random"`) || !strings.Contains(err.Error(), `queue weight of "platform" must be positive`) ||
+		!strings.Contains(err.Error(), "queue maxJobs must not be negative") {
+		t.Errorf("Load() error = %v, want policy, weight and maxJobs errors", err)
+	}
+}
+
+func TestLoad_Autoscaling(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "autoscaling:\n  enabled: true\n  provider: aws\n  aws:\n    region: eu-west-1\n    group: runners\n  idleAfter: 15m\n  maxRunners: 10\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if policy := cfg.AutoscalePolicy(); policy.IdleAfter != 15*time.Minute || policy.MaxRunners != 10 || policy.Cooldown != 0 {
+		t.Errorf("AutoscalePolicy() = %+v, want 15m idle, 10 runners at most and the default cooldown", policy)
+	}
+
+	_, err = Load(writeConfig(t, "autoscaling:\n  enabled: true\n  provider: kubernetes\n  cooldown: soon\n  minRunners: 5\n  maxRunners: 2\n"))
+	if err == nil || !strings.Contains(err.Error(), "requires the name") || !strings.Contains(err.Error(), `invalid cooldown "soon"`) ||
+		!strings.Contains(err.Error(), "minRunners 5 is more than maxRunners 2") {
+		t.Errorf("Load() error = %v, want name, cooldown and runner bound errors", err)
+	}
+}
+
+func TestLoad_Export(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "export:\n  enabled: true\n  path: s3://warehouse/ci\n  region: eu-west-1\n  format: parquet\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if interval := cfg.ExportInterval(); interval != time.Hour {
+		t.Errorf("ExportInterval() = %s, want the default 1h", interval)
+	}
+
+	_, err = Load(writeConfig(t, "export:\n  enabled: true\n  path: s3://warehouse\n  format: avro\n  interval: daily\n"))
+	if err == nil || !strings.Contains(err.Error(), "requires a region") || !strings.Contains(err.Error(), `unsupported format "avro"`) ||
+		!strings.Contains(err.Error(), `invalid interval "daily"`) {
+		t.Errorf("Load() error = %v, want region, format and interval errors", err)
+	}
+}
+
+func TestLoad_EventBus(t *testing.T) {
+	if _, err := Load(writeConfig(t, "eventBus:\n  enabled: true\n  url: rediss://:secret@redis:6380/2\n")); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	_, err := Load(writeConfig(t, "eventBus:\n  enabled: true\n  url: nats://bus:4222\n  maxLen: -1\n"))
+	if err == nil || !strings.Contains(err.Error(), `invalid url "nats://bus:4222"`) || !strings.Contains(err.Error(), "invalid maxLen -1") {
+		t.Errorf("Load() error = %v, want url and maxLen errors", err)
+	}
+}
+
+func TestLoad_DependencyCache(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "dependencyCache:\n  enabled: true\n  url: http://conveyor.internal:8080/depcache\n  deny: [\"@evil/*\"]\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.DependencyCacheTTL() != 5*time.Minute {
+		t.Errorf("DependencyCacheTTL() = %s, want 5m", cfg.DependencyCacheTTL())
+	}
+	_, err = Load(writeConfig(t, "dependencyCache:\n  enabled: true\n  goProxy: proxy.golang.org\n  allow: [\"[acme\"]\n  metadataTTL: -1m\n"))
+	if err == nil || !strings.Contains(err.Error(), `invalid goProxy "proxy.golang.org"`) || !strings.Contains(err.Error(), `invalid pattern "[acme"`) ||
+		!strings.Contains(err.Error(), `invalid metadataTTL "-1m"`) {
+		t.Errorf("Load() error = %v, want goProxy, pattern and metadataTTL errors", err)
+	}
+}
+
+func TestLoad_DiskQuotas(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "dataDir: /var/lib/conveyor\ndiskQuotas:\n  jobQuota: 20Gi\n  reserve: 5Gi\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	policy := cfg.DiskQuotaPolicy()
+	if policy.JobBytes != 20<<30 || policy.ReserveBytes != 5<<30 || policy.ReserveDir != "/var/lib/conveyor" || policy.Interval != 0 {
+		t.Errorf("DiskQuotaPolicy() = %+v", policy)
+	}
+	_, err = Load(writeConfig(t, "diskQuotas:\n  jobQuota: 1Ki\n  reserve: lots\n  interval: 0s\n"))
+	if err == nil || !strings.Contains(err.Error(), "must be at least 1Mi") || !strings.Contains(err.Error(), `invalid reserve "lots"`) || !strings.Contains(err.Error(), `invalid interval "0s"`) {
+		t.Errorf("Load() error = %v, want jobQuota, reserve and interval errors", err)
+	}
+}
+
+func TestLoad_CORS(t *testing.T) {
+	if _, err := Load(writeConfig(t, "cors:\n  allowOrigins: [\"https://ci.example.com\", \"*\"]\n")); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	_, err := Load(writeConfig(t, "cors:\n  allowOrigins: [ci.example.com, \"https://ci.example.com/ui\"]\n"))
+	if err == nil || !strings.Contains(err.Error(), `invalid origin "ci.example.com"`) || !strings.Contains(err.Error(), `invalid origin "https://ci.example.com/ui"`) {
+		t.Errorf("Load() error = %v, want both origins rejected", err)
+	}
+}
+
+func TestLoad_HTTP(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "http:\n  writeTimeout: \"0\"\n  maxHeaderBytes: 64Ki\n  http2:\n    h2c: true\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	timeouts := cfg.HTTP.Timeouts()
+	if timeouts.ReadHeader != 10*time.Second || timeouts.Write != 0 || timeouts.StreamWrite != 30*time.Second {
+		t.Errorf("Timeouts() = %+v, want defaults with the write timeout disabled", timeouts)
+	}
+	if cfg.HTTP.HeaderBytes() != 64<<10 || cfg.HTTP.HTTP2.ReadFrameSize() != 1<<20 || cfg.HTTP.HTTP2.ConcurrentStreams() != 250 {
+		t.Errorf("HeaderBytes() = %d, ReadFrameSize() = %d, ConcurrentStreams() = %d", cfg.HTTP.HeaderBytes(), cfg.HTTP.HTTP2.ReadFrameSize(), cfg.HTTP.HTTP2.ConcurrentStreams())
+	}
+
+	_, err = Load(writeConfig(t, "http:\n  idleTimeout: forever\n  maxHeaderBytes: 10\n  tls:\n    certFile: server.pem\n  http2:\n    maxReadFrameSize: 1Gi\n"))
+	if err == nil || !strings.Contains(err.Error(), `invalid idleTimeout "forever"`) || !strings.Contains(err.Error(), `invalid maxHeaderBytes "10"`) ||
+		!strings.Contains(err.Error(), "requires both certFile and keyFile") || !strings.Contains(err.Error(), `invalid http2 maxReadFrameSize "1Gi"`) {
+		t.Errorf("Load() error = %v, want timeout, size and tls errors", err)
+	}
+}
+
+func TestLoad_Costs(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+costs:
+  currency: EUR
+  cpuMinute: 0.0006
+  runners:
+    gpu: 0.04
+`))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Costs.Currency != "EUR" || cfg.Costs.CPUMinute != 0.0006 || cfg.Costs.Runners["gpu"] != 0.04 {
+		t.Errorf("Costs = %+v, want EUR rates with a gpu runner rate", cfg.Costs)
+	}
+
+	_, err = Load(writeConfig(t, `
+costs:
+  gbMinute: -1
+  runners:
+    gpu: -0.5
+  carbon:
+    gridIntensity: 300
+    pue: 0.8
+`))
+	if err == nil || !strings.Contains(err.Error(), "cost rates must not be negative") || !strings.Contains(err.Error(), `runner "gpu"`) ||
+		!strings.Contains(err.Error(), "pue 0.8 must be at least 1") {
+		t.Errorf("Load() error = %v, want negative rate and pue errors", err)
+	}
+}
+
+func TestLoad_StepOutputLimit(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "stepOutputLimit: 16Mi\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.OutputLimit() != 16<<20 {
+		t.Errorf("OutputLimit() = %d, want 16Mi", cfg.OutputLimit())
+	}
+
+	if _, err := Load(writeConfig(t, "stepOutputLimit: 100\n")); err == nil || !strings.Contains(err.Error(), "at least 1Ki") {
+		t.Errorf("Load() error = %v, want a minimum output limit error", err)
+	}
+}
+
+func TestLoad_InfraRetries(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "infraRetries:\n  max: 3\n  delay: 1m\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.InfraRetries.Max != 3 || cfg.InfraRetryDelay() != time.Minute {
+		t.Errorf("InfraRetries = %+v, want 3 after 1m", cfg.InfraRetries)
+	}
+
+	if _, err := Load(writeConfig(t, "infraRetries:\n  max: -1\n  delay: soon\n")); err == nil || !strings.Contains(err.Error(), "infraRetries delay") {
+		t.Errorf("Load() error = %v, want invalid infraRetries", err)
+	}
+}
+
+func TestLoad_Dependencies(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+dependencies:
+  registries:
+    - name: artifactory
+      ecosystem: npm
+      url: https://artifactory.example.com/api/npm/npm
+      scopes: ["@acme"]
+      username: ci
+      tokenEnv: ARTIFACTORY_TOKEN
+  proxy:
+    https: http://proxy.example.com:3128
+    noProxy: .example.com
+`))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(cfg.Dependencies.Registries) != 1 || cfg.Dependencies.Registries[0].Scopes[0] != "@acme" || cfg.Dependencies.Proxy.NoProxy != ".example.com" {
+		t.Errorf("Dependencies = %+v", cfg.Dependencies)
+	}
+
+	_, err = Load(writeConfig(t, `
+dependencies:
+  registries:
+    - name: a
+      ecosystem: npm
+      url: https://a.example.com
+    - name: b
+      ecosystem: npm
+      url: a.example.com
+    - name: c
+      ecosystem: maven
+      url: https://c.example.com
+      username: ci
+  proxy:
+    http: proxy:3128
+`))
+	for _, want := range []string{"more than one npm registry", `invalid url "a.example.com"`, `unsupported ecosystem "maven"`, "username requires a tokenEnv", "invalid http proxy"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Load() error = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestLoad_ReadOnly(t *testing.T) {
+	os.Setenv("CONVEYOR_READ_ONLY", "true")
+	defer os.Unsetenv("CONVEYOR_READ_ONLY")
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !cfg.ReadOnly {
+		t.Error("ReadOnly = false, want it set from the environment")
+	}
+}
+
+func TestLoad_Offline(t *testing.T) {
+	os.Setenv("CONVEYOR_OFFLINE", "true")
+	defer os.Unsetenv("CONVEYOR_OFFLINE")
+	if _, err := Load(""); err == nil || !strings.Contains(err.Error(), "database bundle") {
+		t.Errorf("Load() error = %v, want a missing bundle error", err)
+	}
+
+	cfg, err := Load(writeConfig(t, "offline:\n  bundle: /opt/conveyor/bundle\n  allowHosts: [artifactory.example.com]\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !cfg.Offline.Enabled || cfg.Offline.Bundle != "/opt/conveyor/bundle" || len(cfg.Offline.AllowHosts) != 1 {
+		t.Errorf("Offline = %+v, want it enabled from the environment", cfg.Offline)
+	}
+}
+
+func TestLoad_Crypto(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "crypto:\n  fips: true\n  checksumAlgorithm: sha384\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !cfg.Crypto.FIPS || cfg.Crypto.ChecksumAlgorithm != "sha384" {
+		t.Errorf("Crypto = %+v, want FIPS with sha384", cfg.Crypto)
+	}
+
+	for _, content := range []string{
+		"crypto:\n  fips: true\n  checksumAlgorithm: sha1\n",
+		"crypto:\n  checksumAlgorithm: md5\n",
+	} {
+		if _, err := Load(writeConfig(t, content)); err == nil {
+			t.Errorf("Load(%q) error = nil, want error", content)
+		}
+	}
+}
+
+func TestLoad_FeatureFlags(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "featureFlags:\n  - name: speculative-stages\n    enabled: false\n    pipelines: [payments-*]\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	flags := cfg.EngineFeatureFlags()
+	if len(flags) != 1 || flags[0].Enabled || flags[0].Pipelines[0] != "payments-*" {
+		t.Errorf("EngineFeatureFlags() = %+v, want speculative stages for payments pipelines", flags)
+	}
+
+	for _, content := range []string{
+		"featureFlags:\n  - name: warp-drive\n",
+		"featureFlags:\n  - name: semgrep-scans\n  - name: semgrep-scans\n",
+	} {
+		if _, err := Load(writeConfig(t, content)); err == nil {
+			t.Errorf("Load(%q) error = nil, want error", content)
+		}
+	}
+}
+
+func TestLoad_Timezone(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "timezone: America/Chicago\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Timezone != "America/Chicago" {
+		t.Errorf("Timezone = %q, want America/Chicago", cfg.Timezone)
+	}
+
+	if _, err := Load(writeConfig(t, "timezone: Mars/Olympus_Mons\n")); err == nil {
+		t.Error("Load() with an unknown time zone error = nil, want error")
+	}
+}
+
+func TestLoad_DurationAnomalies(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "durationAnomalies:\n  percent: 50\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if a := cfg.DurationAnomalies; a.Percent != 50 || a.StdDevs != 3 || a.Window != 20 {
+		t.Errorf("DurationAnomalies = %+v, want percent 50 over the defaults", a)
+	}
+
+	if _, err := Load(writeConfig(t, "durationAnomalies:\n  stdDevs: -1\n")); err == nil {
+		t.Error("Load() with negative stdDevs error = nil, want error")
+	}
+}
+
+func TestLoad_NotificationConditions(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "notifications:\n  - type: webhook\n    url: https://hooks.example.com\n    when: job.status == 'failed' && job.durationMinutes > 30\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Notifications[0].When == "" {
+		t.Error("When not loaded")
+	}
+	_, err = Load(writeConfig(t, "notifications:\n  - type: webhook\n    url: https://hooks.example.com\n    when: job.status = 'failed'\n  - type: cloudevents\n    url: https://broker.example.com\n    when: job.status == 'failed'\n"))
+	if err == nil || !strings.Contains(err.Error(), "notification 1: invalid condition") || !strings.Contains(err.Error(), "notification 2: when doesn't apply to cloudevents") {
+		t.Errorf("Load() error = %v, want both conditions rejected", err)
+	}
+}
+
+func TestLoad_Functions(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "functions:\n  - name: approve\n    type: lambda\n    function: approve-release\n    region: eu-west-1\n    events: [job.completed]\n    retries: 0\n    capture: true\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if f := cfg.Functions[0]; f.Function != "approve-release" || f.Retries == nil || *f.Retries != 0 || !f.Capture {
+		t.Errorf("Functions[0] = %+v, want the lambda settings", f)
+	}
+
+	_, err = Load(writeConfig(t, "functions:\n  - name: hook\n    type: gcf\n  - name: hook\n    type: ftp\n    timeout: soon\n"))
+	for _, want := range []string{"function hook: gcf requires an http or https url", "unsupported type \"ftp\"", "invalid timeout", "configured twice"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Load() error = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestLoad_JobWorkspaces(t *testing.T) {
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !cfg.JobWorkspaces.Enabled || cfg.JobWorkspaceRetention() != 24*time.Hour {
+		t.Errorf("JobWorkspaces = %+v, want enabled for 24h by default", cfg.JobWorkspaces)
+	}
+
+	if _, err := Load(writeConfig(t, "jobWorkspaces:\n  retention: a week\n")); err == nil {
+		t.Error("Load() with an invalid retention error = nil, want error")
+	}
+}
+
+func TestLoad_Containers(t *testing.T) {
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !cfg.Containers.Enabled {
+		t.Error("Containers.Enabled = false, want true by default")
+	}
+
+	cfg, err = Load(writeConfig(t, "containers:\n  enabled: true\n  pull: always\n  user: 1000:1000\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Containers.Pull != "always" || cfg.Containers.User != "1000:1000" {
+		t.Errorf("Containers = %+v", cfg.Containers)
+	}
+
+	if _, err := Load(writeConfig(t, "containers:\n  pull: sometimes\n")); err == nil {
+		t.Error("Load() with an invalid pull policy error = nil, want error")
+	}
+}
+
+func TestLoad_AccessLog(t *testing.T) {
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.AccessLog.Enabled || cfg.AccessLog.SampleRate != 1 {
+		t.Errorf("AccessLog = %+v, want disabled, logging every request", cfg.AccessLog)
+	}
+
+	cfg, err = Load(writeConfig(t, "accessLog:\n  enabled: true\n  slow: 500ms\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !cfg.AccessLog.Enabled || cfg.AccessLog.SampleRate != 1 || cfg.AccessLog.Slow != "500ms" {
+		t.Errorf("AccessLog = %+v", cfg.AccessLog)
+	}
+
+	for _, content := range []string{
+		"accessLog:\n  sampleRate: 1.5\n",
+		"accessLog:\n  slow: soon\n",
+		"metrics:\n  buckets: [0.5, 0.1]\n",
+	} {
+		if _, err := Load(writeConfig(t, content)); err == nil {
+			t.Errorf("Load(%q) error = nil, want error", content)
+		}
+	}
+}
+
+func TestLoad_AuthPolicy(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "auth:\n  enabled: true\n  adminToken: bootstrap\n  policy:\n    url: http://opa:8181/v1/data/conveyor/allow\n    type: opa\n    cacheTTL: 1m\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	timeout, cacheTTL := cfg.Auth.Policy.Timeouts()
+	if cfg.Auth.Policy.Type != "opa" || timeout != 2*time.Second || cacheTTL != time.Minute || cfg.Auth.Policy.FailOpen {
+		t.Errorf("Policy = %+v with timeout %s and cache TTL %s", cfg.Auth.Policy, timeout, cacheTTL)
+	}
+
+	for _, content := range []string{
+		"auth:\n  enabled: true\n  adminToken: bootstrap\n  policy:\n    url: opa:8181\n",
+		"auth:\n  enabled: true\n  adminToken: bootstrap\n  policy:\n    url: http://opa:8181\n    type: rego\n",
+		"auth:\n  enabled: true\n  adminToken: bootstrap\n  policy:\n    url: http://opa:8181\n    timeout: -1s\n",
+		"auth:\n  enabled: true\n  adminToken: bootstrap\n  policy:\n    replaceRBAC: true\n",
+		"auth:\n  policy:\n    url: http://opa:8181\n",
+	} {
+		if _, err := Load(writeConfig(t, content)); err == nil {
+			t.Errorf("Load(%q) error = nil, want error", content)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrNoConfigFile is returned when updating the settings of a server
+// started without a configuration file
+var ErrNoConfigFile = errors.New("the server has no configuration file to update")
+
+// SettingsChange is an audited update of the configuration file. Before
+// and After hold the changed settings; secrets are never included.
+type SettingsChange struct {
+	At              time.Time                  `json:"at"`
+	By              string                     `json:"by,omitempty"`
+	Fields          []string                   `json:"fields"`
+	RestartRequired []string                   `json:"restartRequired,omitempty"`
+	Before          map[string]json.RawMessage `json:"before"`
+	After           map[string]json.RawMessage `json:"after"`
+}
+
+// Settings reads and updates the configuration file for the admin API.
+// Updates are validated, written to the file, audited and then applied
+// like a reload.
+type Settings struct {
+	path      string
+	auditPath string
+	apply     func() error
+	mu        sync.Mutex
+}
+
+// NewSettings manages the configuration file at path, appending changes to
+// the audit log at auditPath. apply is called after each update to reload
+// the file.
+func NewSettings(path, auditPath string, apply func() error) *Settings {
+	return &Settings{path: path, auditPath: auditPath, apply: apply}
+}
+
+// Get returns the configuration in effect, with environment overrides
+func (s *Settings) Get() (*Config, error) {
+	return Load(s.path)
+}
+
+// Update merges a JSON patch of settings into the configuration file. The
+// patch uses the names of the JSON configuration; nested objects are
+// merged and lists replaced. Secrets can't be read or set through it.
+func (s *Settings) Update(patch []byte, by string) (*SettingsChange, error) {
+	if s.path == "" {
+		return nil, ErrNoConfigFile
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := Load(s.path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	// The file is decoded without environment overrides so they aren't
+	// written to it
+	file := Default()
+	if err := yaml.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(patch))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(file); err != nil {
+		return nil, fmt.Errorf("invalid settings: %w", err)
+	}
+
+	next := *file
+	if err := next.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := next.Validate(); err != nil {
+		return nil, err
+	}
+	change, err := diffSettings(current, &next)
+	if err != nil {
+		return nil, err
+	}
+	if len(change.Fields) == 0 {
+		return change, nil
+	}
+	change.At = time.Now().UTC()
+	change.By = by
+
+	out, err := yaml.Marshal(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(s.path+".tmp", out, info.Mode().Perm()); err != nil {
+		return nil, fmt.Errorf("failed to write config: %w", err)
+	}
+	if err := os.Rename(s.path+".tmp", s.path); err != nil {
+		return nil, fmt.Errorf("failed to write config: %w", err)
+	}
+	if err := s.audit(change); err != nil {
+		return change, err
+	}
+	if s.apply != nil {
+		if err := s.apply(); err != nil {
+			return change, fmt.Errorf("settings saved but not applied: %w", err)
+		}
+	}
+	return change, nil
+}
+
+// Audit returns up to limit of the most recent changes, newest first. A
+// limit of 0 returns all of them.
+func (s *Settings) Audit(limit int) ([]SettingsChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changes := []SettingsChange{}
+	file, err := os.Open(s.auditPath)
+	if os.IsNotExist(err) {
+		return changes, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read settings audit log: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var change SettingsChange
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			return nil, fmt.Errorf("failed to decode settings audit log: %w", err)
+		}
+		changes = append(changes, change)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read settings audit log: %w", err)
+	}
+
+	for i, j := 0, len(changes)-1; i < j; i, j = i+1, j-1 {
+		changes[i], changes[j] = changes[j], changes[i]
+	}
+	if limit > 0 && len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return changes, nil
+}
+
+// audit appends a change to the audit log
+func (s *Settings) audit(change *SettingsChange) error {
+	if s.auditPath == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.auditPath), 0755); err != nil {
+		return fmt.Errorf("failed to create settings audit log: %w", err)
+	}
+	line, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open settings audit log: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write settings audit log: %w", err)
+	}
+	return nil
+}
+
+// diffSettings returns the top-level settings that differ between current
+// and next by their JSON names, and which of them need a restart
+func diffSettings(current, next *Config) (*SettingsChange, error) {
+	before, err := jsonFields(current)
+	if err != nil {
+		return nil, err
+	}
+	after, err := jsonFields(next)
+	if err != nil {
+		return nil, err
+	}
+
+	change := &SettingsChange{
+		Fields: []string{},
+		Before: make(map[string]json.RawMessage),
+		After:  make(map[string]json.RawMessage),
+	}
+	for name, value := range after {
+		if !bytes.Equal(value, before[name]) {
+			change.Fields = append(change.Fields, name)
+			change.After[name] = value
+			if previous, ok := before[name]; ok {
+				change.Before[name] = previous
+			}
+		}
+	}
+	for name, value := range before {
+		if _, ok := after[name]; !ok {
+			change.Fields = append(change.Fields, name)
+			change.Before[name] = value
+		}
+	}
+	sort.Strings(change.Fields)
+
+	configType := reflect.TypeOf(Config{})
+	for _, name := range current.RestartRequired(next) {
+		field, _ := configType.FieldByName(name)
+		if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag != "" && tag != "-" {
+			change.RestartRequired = append(change.RestartRequired, tag)
+		}
+	}
+	return change, nil
+}
+
+// jsonFields returns the top-level JSON values of a configuration
+func jsonFields(cfg *Config) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
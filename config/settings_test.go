@@ -0,0 +1,61 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSettings_Update(t *testing.T) {
+	path := writeConfig(t, "port: 9090\nauth:\n  enabled: true\n  adminToken: s3cret\n")
+	applied := 0
+	settings := NewSettings(path, filepath.Join(t.TempDir(), "settings.jsonl"), func() error {
+		applied++
+		return nil
+	})
+
+	change, err := settings.Update([]byte(`{"logLevel": "debug", "artifactRetention": {"days": 14}, "auth": {"enabled": false}}`), "alice")
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if strings.Join(change.Fields, ",") != "artifactRetention,auth,logLevel" || strings.Join(change.RestartRequired, ",") != "auth" {
+		t.Errorf("change = %+v, want three fields with auth needing a restart", change)
+	}
+	if applied != 1 {
+		t.Errorf("applied %d times, want 1", applied)
+	}
+
+	cfg, err := settings.Get()
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if cfg.LogLevel != "debug" || cfg.Port != 9090 || cfg.ArtifactRetention.Days != 14 || cfg.Auth.Enabled || cfg.Auth.AdminToken != "s3cret" {
+		t.Errorf("config = %+v, want the patch merged and the admin token kept", cfg)
+	}
+
+	for _, patch := range []string{
+		`{"logLevel": "loud"}`,
+		`{"auth": {"adminToken": "stolen"}}`,
+		`{"colour": "blue"}`,
+	} {
+		if _, err := settings.Update([]byte(patch), "mallory"); err == nil {
+			t.Errorf("Update(%s) error = nil, want error", patch)
+		}
+	}
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), "stolen") {
+		t.Error("config file has the rejected admin token")
+	}
+
+	audit, err := settings.Audit(0)
+	if err != nil {
+		t.Fatalf("Audit() error = %v", err)
+	}
+	if len(audit) != 1 || audit[0].By != "alice" || string(audit[0].Before["logLevel"]) != `"info"` || string(audit[0].After["logLevel"]) != `"debug"` {
+		t.Errorf("audit = %+v, want alice's change", audit)
+	}
+
+	if _, err := NewSettings("", "", nil).Update([]byte(`{}`), "alice"); err != ErrNoConfigFile {
+		t.Errorf("Update() without a file error = %v, want ErrNoConfigFile", err)
+	}
+}
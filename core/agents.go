@@ -0,0 +1,681 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultAgentTokenTTL is how long an agent token is valid without a
+	// ttl, and MaxAgentTokenTTL the longest it can be
+	DefaultAgentTokenTTL = 10 * time.Minute
+	MaxAgentTokenTTL     = 24 * time.Hour
+	// AgentHeartbeatTimeout is how long an agent can go without a request
+	// before it is lost and deregistered
+	AgentHeartbeatTimeout = 2 * time.Minute
+	// agentRetention is how long agents that are done are still listed
+	agentRetention = time.Hour
+)
+
+// Agent states
+const (
+	// AgentIdle agents registered and wait for a step of their project
+	AgentIdle = "idle"
+	// AgentRunning agents run the steps of the job they started
+	AgentRunning = "running"
+	// AgentDone agents finished their job or deregistered
+	AgentDone = "done"
+)
+
+// Reasons agents are done
+const (
+	AgentFinished     = "finished"
+	AgentDeregistered = "deregistered"
+	AgentDrained      = "drained"
+	AgentDisconnected = "disconnected"
+	AgentLost         = "lost"
+)
+
+var agentCounter uint64
+
+var (
+	// ErrAgentNotFound is returned for unknown agents and wrong agent
+	// secrets
+	ErrAgentNotFound = errors.New("agent not found")
+	// ErrAgentDone is returned to agents that finished their job or
+	// deregistered
+	ErrAgentDone = errors.New("agent is done")
+)
+
+// AgentToken is a short-lived token an ephemeral agent registers with, once.
+// The agent gets the token's labels and only runs steps of Project, a
+// pipeline's team or, without one, the pipeline.
+type AgentToken struct {
+	ID        string    `json:"id"`
+	Project   string    `json:"project"`
+	Labels    []string  `json:"labels"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// AgentID is the agent that registered with the token
+	AgentID string `json:"agentId,omitempty"`
+	hash    string
+}
+
+// Agent is an ephemeral runner that registered with a token. It runs the
+// steps of one job of its token's project and is deregistered when the job
+// finishes.
+type Agent struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Project string   `json:"project"`
+	Labels  []string `json:"labels"`
+	TokenID string   `json:"tokenId"`
+	Version string   `json:"version,omitempty"`
+	// Protocol is the newest protocol the agent speaks, and Negotiated the
+	// one the server speaks with it
+	Protocol     int        `json:"protocol"`
+	Negotiated   int        `json:"negotiated"`
+	State        string     `json:"state"`
+	JobID        string     `json:"jobId,omitempty"`
+	RegisteredAt time.Time  `json:"registeredAt"`
+	DoneAt       *time.Time `json:"doneAt,omitempty"`
+	// DoneReason is why the agent is done: finished, deregistered, drained,
+	// disconnected or lost
+	DoneReason string `json:"doneReason,omitempty"`
+	// LastHeartbeat is the agent's last request, and HeartbeatAgeMs how
+	// long ago it was
+	LastHeartbeat  time.Time `json:"lastHeartbeat"`
+	HeartbeatAgeMs int64     `json:"heartbeatAgeMs"`
+	RunningStep    string    `json:"runningStep,omitempty"`
+	// Draining agents finish their job and take no other, and agents in
+	// maintenance take no steps until they are resumed
+	Draining          bool   `json:"draining,omitempty"`
+	Maintenance       bool   `json:"maintenance,omitempty"`
+	MaintenanceReason string `json:"maintenanceReason,omitempty"`
+}
+
+// AgentAssignment is a step handed to an agent to run with env
+type AgentAssignment struct {
+	ID    string            `json:"id"`
+	JobID string            `json:"jobId"`
+	Step  Step              `json:"step"`
+	Env   map[string]string `json:"env"`
+}
+
+// agent is a registered agent and the steps handed to it
+type agent struct {
+	Agent
+	hash string
+	slot *runnerSlot
+	// pending are the assignments the agent hasn't picked up yet, and
+	// running the ones it has, by ID
+	pending []*assignment
+	running map[string]*assignment
+	// assigned is closed when a step is handed to the agent, and done when
+	// the agent is done
+	assigned chan struct{}
+	done     chan struct{}
+}
+
+// assignment is a step handed to an agent, whose result is delivered on
+// result
+type assignment struct {
+	AgentAssignment
+	result chan StepResult
+}
+
+// agentExecutor runs steps by handing them to an agent
+type agentExecutor struct {
+	engine *PipelineEngine
+	agent  *agent
+}
+
+// newSecret returns a random secret with a prefix and the hash it is
+// stored as
+func newSecret(prefix string) (string, string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	secret := prefix + hex.EncodeToString(raw)
+	return secret, hashSecret(secret), nil
+}
+
+// hashSecret returns the stored form of an agent token or secret
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// MintAgentToken creates a token an agent registers with to run one job of
+// project on a runner with labels, and returns it with its secret value,
+// which is not stored. A zero ttl is DefaultAgentTokenTTL.
+func (pe *PipelineEngine) MintAgentToken(project string, labels []string, ttl time.Duration) (AgentToken, string, error) {
+	if project == "" {
+		return AgentToken{}, "", fmt.Errorf("agent tokens require a project")
+	}
+	if ttl <= 0 {
+		ttl = DefaultAgentTokenTTL
+	}
+	if ttl > MaxAgentTokenTTL {
+		return AgentToken{}, "", fmt.Errorf("agent token ttl %s is longer than %s", ttl, MaxAgentTokenTTL)
+	}
+	secret, hash, err := newSecret("cva_")
+	if err != nil {
+		return AgentToken{}, "", err
+	}
+
+	now := time.Now()
+	token := &AgentToken{
+		ID:        fmt.Sprintf("agenttoken-%d-%d", now.Unix(), atomic.AddUint64(&agentCounter, 1)),
+		Project:   project,
+		Labels:    append([]string{}, labels...),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		hash:      hash,
+	}
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	for id, t := range pe.agentTokens {
+		if t.AgentID == "" && !now.Before(t.ExpiresAt) {
+			delete(pe.agentTokens, id)
+		}
+	}
+	pe.agentTokens[token.ID] = token
+	return *token, secret, nil
+}
+
+// AgentTokens returns the agent tokens that are valid or were used, newest
+// first
+func (pe *PipelineEngine) AgentTokens() []AgentToken {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	now := time.Now()
+	tokens := []AgentToken{}
+	for _, t := range pe.agentTokens {
+		if t.AgentID != "" || now.Before(t.ExpiresAt) {
+			tokens = append(tokens, *t)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+	return tokens
+}
+
+// RevokeAgentToken deletes an agent token that wasn't used yet
+func (pe *PipelineEngine) RevokeAgentToken(id string) error {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	token, ok := pe.agentTokens[id]
+	if !ok {
+		return fmt.Errorf("agent token %s not found", id)
+	}
+	if token.AgentID != "" {
+		return fmt.Errorf("agent token %s was used by agent %s", id, token.AgentID)
+	}
+	delete(pe.agentTokens, id)
+	return nil
+}
+
+// agentTokenFor reports whether an unused, valid agent token could bring a
+// runner for steps of project with labels. Callers must hold pe.mu.
+func (pe *PipelineEngine) agentTokenFor(project string, labels []string) bool {
+	now := time.Now()
+	for _, t := range pe.agentTokens {
+		runner := runnerSlot{Runner: Runner{Labels: t.Labels}}
+		if t.AgentID == "" && now.Before(t.ExpiresAt) && t.Project == project && runner.matches(labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// AgentInfo describes an agent registering: its build and the protocols it
+// speaks
+type AgentInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// Protocol is the newest protocol the agent speaks and MinProtocol the
+	// oldest it can fall back to. Agents without one speak protocol 1.
+	Protocol    int `json:"protocol"`
+	MinProtocol int `json:"minProtocol"`
+}
+
+// RegisterAgent registers an agent with the secret of an agent token, which
+// can't be used again, and returns the agent with the secret it
+// authenticates with. The agent runs steps as a runner with capacity 1.
+// Agents without a protocol in common with the server are rejected with
+// ErrIncompatibleProtocol before the token is used.
+func (pe *PipelineEngine) RegisterAgent(tokenSecret string, info AgentInfo) (Agent, string, error) {
+	secret, hash, err := newSecret("cvs_")
+	if err != nil {
+		return Agent{}, "", err
+	}
+
+	if info.Protocol <= 0 {
+		info.Protocol = 1
+	}
+	pe.mu.Lock()
+	negotiated, err := negotiate("agent", info.Protocol, info.MinProtocol, ProtocolRange{MinAgentProtocol, AgentProtocol})
+	if err != nil {
+		pe.rejectComponent(Compatibility{Component: "agent", Name: info.Name, Version: info.Version, Protocol: info.Protocol}, err)
+		pe.mu.Unlock()
+		pe.logger.Printf("Agent %s (%s) rejected: %v", info.Name, info.Version, err)
+		pe.emitEvent(Event{Type: "agent.rejected", Timestamp: time.Now(), Data: map[string]interface{}{"name": info.Name, "version": info.Version, "error": err.Error()}})
+		return Agent{}, "", err
+	}
+	var token *AgentToken
+	presented := hashSecret(tokenSecret)
+	for _, t := range pe.agentTokens {
+		if subtle.ConstantTimeCompare([]byte(t.hash), []byte(presented)) == 1 {
+			token = t
+		}
+	}
+	now := time.Now()
+	switch {
+	case token == nil:
+		pe.mu.Unlock()
+		return Agent{}, "", fmt.Errorf("invalid agent token")
+	case token.AgentID != "":
+		pe.mu.Unlock()
+		return Agent{}, "", fmt.Errorf("agent token %s was already used by agent %s", token.ID, token.AgentID)
+	case !now.Before(token.ExpiresAt):
+		pe.mu.Unlock()
+		return Agent{}, "", fmt.Errorf("agent token %s expired at %s", token.ID, token.ExpiresAt.Format(time.RFC3339))
+	}
+
+	a := &agent{
+		Agent: Agent{
+			ID:            fmt.Sprintf("agent-%d-%d", now.Unix(), atomic.AddUint64(&agentCounter, 1)),
+			Name:          info.Name,
+			Project:       token.Project,
+			Labels:        append([]string{}, token.Labels...),
+			TokenID:       token.ID,
+			Version:       info.Version,
+			Protocol:      info.Protocol,
+			Negotiated:    negotiated,
+			State:         AgentIdle,
+			RegisteredAt:  now,
+			LastHeartbeat: now,
+		},
+		hash:     hash,
+		running:  make(map[string]*assignment),
+		assigned: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if a.Name == "" {
+		a.Name = a.ID
+	}
+	a.slot = &runnerSlot{
+		Runner:    Runner{Name: a.ID, Labels: a.Labels, Capacity: 1, Executor: &agentExecutor{engine: pe, agent: a}},
+		idleSince: now,
+		agent:     a,
+		project:   a.Project,
+	}
+	token.AgentID = a.ID
+	for id, other := range pe.agents {
+		if other.DoneAt != nil && now.Sub(*other.DoneAt) > agentRetention {
+			delete(pe.agents, id)
+		}
+	}
+	pe.agents[a.ID] = a
+	pe.runners = append(pe.runners, a.slot)
+	pe.wakeWaiters()
+	registered := a.Agent
+	pe.mu.Unlock()
+
+	pe.logger.Printf("Agent %s (%s) registered for project %s", registered.ID, registered.Name, registered.Project)
+	pe.emitAgentEvent("agent.registered", registered, nil)
+	return registered, secret, nil
+}
+
+// emitAgentEvent emits an agent lifecycle event
+func (pe *PipelineEngine) emitAgentEvent(eventType string, a Agent, data map[string]interface{}) {
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data["agentId"], data["name"], data["project"] = a.ID, a.Name, a.Project
+	pe.emitEvent(Event{Type: eventType, Timestamp: time.Now(), JobID: a.JobID, Data: data})
+}
+
+// Agents returns the registered agents and the agents done in the last
+// hour, newest first
+func (pe *PipelineEngine) Agents() []Agent {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	now := time.Now()
+	agents := make([]Agent, 0, len(pe.agents))
+	for _, a := range pe.agents {
+		agents = append(agents, a.status(now))
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].RegisteredAt.After(agents[j].RegisteredAt) })
+	return agents
+}
+
+// Agent returns an agent by ID
+func (pe *PipelineEngine) Agent(id string) (Agent, error) {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	a, ok := pe.agents[id]
+	if !ok {
+		return Agent{}, ErrAgentNotFound
+	}
+	return a.status(time.Now()), nil
+}
+
+// status returns the agent with its heartbeat age at now
+func (a *agent) status(now time.Time) Agent {
+	status := a.Agent
+	status.Labels = append([]string{}, a.Labels...)
+	if status.State != AgentDone {
+		status.HeartbeatAgeMs = now.Sub(a.LastHeartbeat).Milliseconds()
+	}
+	return status
+}
+
+// authenticateAgent returns the agent with an ID and secret, recording the
+// request as a heartbeat. Callers must hold pe.mu.
+func (pe *PipelineEngine) authenticateAgent(id, secret string) (*agent, error) {
+	a, ok := pe.agents[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(a.hash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrAgentNotFound
+	}
+	a.LastHeartbeat = time.Now()
+	return a, nil
+}
+
+// AgentHeartbeat records that an agent is alive, such as while it runs a
+// long step, and returns ErrAgentDone once it is done
+func (pe *PipelineEngine) AgentHeartbeat(agentID, secret string) error {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	a, err := pe.authenticateAgent(agentID, secret)
+	if err != nil {
+		return err
+	}
+	if a.State == AgentDone {
+		return ErrAgentDone
+	}
+	return nil
+}
+
+// NextAssignment returns the next step handed to an agent, waiting up to
+// wait for one. It returns nil when none was handed to it in time, and
+// ErrAgentDone once the agent finished its job.
+func (pe *PipelineEngine) NextAssignment(ctx context.Context, agentID, secret string, wait time.Duration) (*AgentAssignment, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		pe.mu.Lock()
+		a, err := pe.authenticateAgent(agentID, secret)
+		if err != nil {
+			pe.mu.Unlock()
+			return nil, err
+		}
+		if a.State == AgentDone {
+			pe.mu.Unlock()
+			return nil, ErrAgentDone
+		}
+		if len(a.pending) > 0 {
+			as := a.pending[0]
+			a.pending = a.pending[1:]
+			a.running[as.ID] = as
+			a.RunningStep = as.Step.ID
+			pe.mu.Unlock()
+			handed := as.AgentAssignment
+			return &handed, nil
+		}
+		assigned := a.assigned
+		pe.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-timer.C:
+			return nil, nil
+		case <-assigned:
+		}
+	}
+}
+
+// CompleteAssignment delivers the result of a step an agent ran
+func (pe *PipelineEngine) CompleteAssignment(agentID, secret, assignmentID string, result StepResult) error {
+	pe.mu.Lock()
+	a, err := pe.authenticateAgent(agentID, secret)
+	if err != nil {
+		pe.mu.Unlock()
+		return err
+	}
+	if a.State == AgentDone {
+		pe.mu.Unlock()
+		return ErrAgentDone
+	}
+	as, ok := a.running[assignmentID]
+	if !ok {
+		pe.mu.Unlock()
+		return fmt.Errorf("agent %s has no running assignment %s", agentID, assignmentID)
+	}
+	delete(a.running, assignmentID)
+	a.RunningStep = ""
+	pe.mu.Unlock()
+
+	as.result <- result
+	return nil
+}
+
+// DeregisterAgent removes an agent before it finished its job. Steps it
+// was running fail.
+func (pe *PipelineEngine) DeregisterAgent(agentID, secret string) error {
+	pe.mu.Lock()
+	a, err := pe.authenticateAgent(agentID, secret)
+	if err != nil {
+		pe.mu.Unlock()
+		return err
+	}
+	pe.retire(a, AgentDeregistered)
+	pe.mu.Unlock()
+	return nil
+}
+
+// DrainAgent lets an agent finish the job it is running and take no other.
+// An agent without a job is deregistered right away.
+func (pe *PipelineEngine) DrainAgent(agentID string) (Agent, error) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	a, ok := pe.agents[agentID]
+	if !ok {
+		return Agent{}, ErrAgentNotFound
+	}
+	if a.State == AgentDone {
+		return Agent{}, ErrAgentDone
+	}
+	if a.slot.job == "" && a.slot.busy == 0 {
+		pe.retire(a, AgentDrained)
+		return a.status(time.Now()), nil
+	}
+	if !a.Draining {
+		a.Draining = true
+		pe.logger.Printf("Draining agent %s", agentID)
+		pe.emitAgentEvent("agent.draining", a.Agent, nil)
+	}
+	return a.status(time.Now()), nil
+}
+
+// DisconnectAgent deregisters an agent right away. Steps it was running
+// fail as infrastructure failures and are re-dispatched.
+func (pe *PipelineEngine) DisconnectAgent(agentID string) (Agent, error) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	a, ok := pe.agents[agentID]
+	if !ok {
+		return Agent{}, ErrAgentNotFound
+	}
+	if !pe.retire(a, AgentDisconnected) {
+		return Agent{}, ErrAgentDone
+	}
+	return a.status(time.Now()), nil
+}
+
+// SetAgentMaintenance puts an agent in maintenance, where it takes no
+// steps, or takes it out of maintenance
+func (pe *PipelineEngine) SetAgentMaintenance(agentID string, maintenance bool, reason string) (Agent, error) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	a, ok := pe.agents[agentID]
+	if !ok {
+		return Agent{}, ErrAgentNotFound
+	}
+	if a.State == AgentDone {
+		return Agent{}, ErrAgentDone
+	}
+	if !maintenance {
+		reason = ""
+	}
+	changed := a.Maintenance != maintenance
+	a.Maintenance, a.MaintenanceReason = maintenance, reason
+	if changed {
+		eventType := "agent.maintenance"
+		if !maintenance {
+			eventType = "agent.resumed"
+			pe.wakeWaiters()
+		}
+		pe.logger.Printf("Agent %s %s", agentID, strings.TrimPrefix(eventType, "agent."))
+		pe.emitAgentEvent(eventType, a.Agent, map[string]interface{}{"reason": reason})
+	}
+	return a.status(time.Now()), nil
+}
+
+// WatchAgents deregisters the agents that stopped sending heartbeats every
+// interval until ctx is done
+func (pe *PipelineEngine) WatchAgents(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pe.checkHeartbeats(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkHeartbeats deregisters the agents without a request for
+// AgentHeartbeatTimeout before now
+func (pe *PipelineEngine) checkHeartbeats(now time.Time) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	for _, a := range pe.agents {
+		if a.Negotiated < 2 && a.RunningStep != "" {
+			// Agents before protocol 2 send no heartbeats while steps run
+			continue
+		}
+		if a.State != AgentDone && now.Sub(a.LastHeartbeat) > AgentHeartbeatTimeout {
+			pe.retire(a, AgentLost)
+		}
+	}
+}
+
+// retireAgents deregisters the agents that ran a finished job, as drained
+// when they were draining
+func (pe *PipelineEngine) retireAgents(jobID string) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	for _, a := range pe.agents {
+		if a.JobID != jobID {
+			continue
+		}
+		if a.Draining {
+			pe.retire(a, AgentDrained)
+		} else {
+			pe.retire(a, AgentFinished)
+		}
+	}
+}
+
+// retire marks an agent done for a reason, removes its runner and emits
+// agent.deregistered, and reports whether it wasn't done already. Callers
+// must hold pe.mu.
+func (pe *PipelineEngine) retire(a *agent, reason string) bool {
+	if a.State == AgentDone {
+		return false
+	}
+	now := time.Now()
+	a.State, a.DoneAt, a.DoneReason, a.RunningStep = AgentDone, &now, reason, ""
+	for i, runner := range pe.runners {
+		if runner == a.slot {
+			pe.runners = append(pe.runners[:i:i], pe.runners[i+1:]...)
+			break
+		}
+	}
+	close(a.done)
+	pe.wakeWaiters()
+	pe.logger.Printf("Agent %s deregistered: %s", a.ID, reason)
+	pe.emitAgentEvent("agent.deregistered", a.Agent, map[string]interface{}{"reason": reason})
+	return true
+}
+
+// Execute hands the step to the agent and waits for its result
+func (e *agentExecutor) Execute(ctx context.Context, step Step, env map[string]string) (*StepResult, error) {
+	pe, a := e.engine, e.agent
+	pe.mu.Lock()
+	if a.State == AgentDone {
+		pe.mu.Unlock()
+		return nil, fmt.Errorf("agent %s is done", a.ID)
+	}
+	as := &assignment{
+		AgentAssignment: AgentAssignment{
+			ID:    fmt.Sprintf("%s-step-%d", a.ID, atomic.AddUint64(&agentCounter, 1)),
+			JobID: a.slot.job,
+			Step:  step,
+			Env:   env,
+		},
+		result: make(chan StepResult, 1),
+	}
+	a.pending = append(a.pending, as)
+	close(a.assigned)
+	a.assigned = make(chan struct{})
+	pe.mu.Unlock()
+
+	select {
+	case result := <-as.result:
+		return &result, nil
+	case <-a.done:
+		pe.mu.RLock()
+		reason := a.DoneReason
+		pe.mu.RUnlock()
+		return nil, &InfrastructureError{Err: fmt.Errorf("agent %s was %s while running step %s", a.ID, reason, step.ID)}
+	case <-ctx.Done():
+		pe.mu.Lock()
+		for i, pending := range a.pending {
+			if pending == as {
+				a.pending = append(a.pending[:i], a.pending[i+1:]...)
+				break
+			}
+		}
+		delete(a.running, as.ID)
+		pe.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
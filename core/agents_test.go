@@ -0,0 +1,206 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEphemeralAgent(t *testing.T) {
+	engine := newTestEngine(WithRunners(Runner{Name: "local", Labels: []string{"local"}, Executor: &recordingExecutor{}}))
+	for id, team := range map[string]string{"site": "web", "etl": "data"} {
+		pipeline := scriptPipeline(id, "make")
+		pipeline.Team = team
+		pipeline.Stages[0].RunsOn = []string{"cloud"}
+		engine.CreatePipeline(pipeline)
+	}
+	_, secret, err := engine.MintAgentToken("web", []string{"cloud", "linux"}, time.Minute)
+	if err != nil {
+		t.Fatalf("MintAgentToken() error = %v", err)
+	}
+
+	// The token only brings a runner for the web project
+	other, err := engine.Run(context.Background(), "etl")
+	if err != nil || other.Status != StatusFailed {
+		t.Fatalf("Run(etl) = %v, %v, want a failed job without a runner for its project", other, err)
+	}
+
+	job, err := engine.Start(context.Background(), "site")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	agent, agentSecret, err := engine.RegisterAgent(secret, AgentInfo{Name: "spot-1", Version: "1.0.0", Protocol: AgentProtocol})
+	if err != nil {
+		t.Fatalf("RegisterAgent() error = %v", err)
+	}
+	if _, _, err := engine.RegisterAgent(secret, AgentInfo{Name: "spot-2"}); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("RegisterAgent() with a used token error = %v, want already used", err)
+	}
+
+	assignment, err := engine.NextAssignment(context.Background(), agent.ID, agentSecret, 2*time.Second)
+	if err != nil || assignment == nil {
+		t.Fatalf("NextAssignment() = %v, %v, want the job's step", assignment, err)
+	}
+	if assignment.JobID != job.ID || assignment.Env["CONVEYOR_RUNNER"] != agent.ID {
+		t.Errorf("assignment = %+v, want a step of job %s on runner %s", assignment, job.ID, agent.ID)
+	}
+	if _, err := engine.NextAssignment(context.Background(), agent.ID, "cvs_wrong", 0); err != ErrAgentNotFound {
+		t.Errorf("NextAssignment() with a wrong secret error = %v, want ErrAgentNotFound", err)
+	}
+	if err := engine.CompleteAssignment(agent.ID, agentSecret, assignment.ID, StepResult{Output: "built"}); err != nil {
+		t.Fatalf("CompleteAssignment() error = %v", err)
+	}
+	waitForJob(t, engine, "site", job.ID, StatusSuccess)
+
+	if _, err := engine.NextAssignment(context.Background(), agent.ID, agentSecret, time.Second); err != ErrAgentDone {
+		t.Errorf("NextAssignment() after the job error = %v, want ErrAgentDone", err)
+	}
+	for _, runner := range engine.Runners() {
+		if runner.Agent != "" {
+			t.Errorf("Runners() = %+v, want the agent's runner removed after its job", runner)
+		}
+	}
+	if agents := engine.Agents(); len(agents) != 1 || agents[0].State != AgentDone || agents[0].DoneReason != AgentFinished || agents[0].JobID != job.ID {
+		t.Errorf("Agents() = %+v, want the agent done with job %s", agents, job.ID)
+	}
+}
+
+func TestRegisterAgent_ExpiredToken(t *testing.T) {
+	engine := newTestEngine()
+	_, secret, err := engine.MintAgentToken("web", nil, time.Millisecond)
+	if err != nil {
+		t.Fatalf("MintAgentToken() error = %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, _, err := engine.RegisterAgent(secret, AgentInfo{}); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("RegisterAgent() error = %v, want expired", err)
+	}
+	if _, _, err := engine.RegisterAgent("cva_unknown", AgentInfo{}); err == nil {
+		t.Error("RegisterAgent() with an unknown token error = nil, want error")
+	}
+	if _, _, err := engine.MintAgentToken("", nil, 0); err == nil {
+		t.Error("MintAgentToken() without a project error = nil, want error")
+	}
+}
+
+func TestAgentOperations(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("site", "make")
+	pipeline.Team = "web"
+	pipeline.Stages[0].RunsOn = []string{"cloud"}
+	engine.CreatePipeline(pipeline)
+	events := engine.Subscribe(32)
+	defer events.Close()
+
+	register := func(name string) Agent {
+		_, secret, err := engine.MintAgentToken("web", []string{"cloud"}, time.Minute)
+		if err != nil {
+			t.Fatalf("MintAgentToken() error = %v", err)
+		}
+		agent, _, err := engine.RegisterAgent(secret, AgentInfo{Name: name, Version: "1.2.0", Protocol: AgentProtocol})
+		if err != nil {
+			t.Fatalf("RegisterAgent() error = %v", err)
+		}
+		return agent
+	}
+
+	// Draining an idle agent deregisters it
+	idle := register("idle")
+	if agent, err := engine.DrainAgent(idle.ID); err != nil || agent.State != AgentDone || agent.DoneReason != AgentDrained {
+		t.Errorf("DrainAgent() = %+v, %v, want the idle agent drained", agent, err)
+	}
+	if _, err := engine.DrainAgent(idle.ID); err != ErrAgentDone {
+		t.Errorf("DrainAgent() of a done agent error = %v, want ErrAgentDone", err)
+	}
+
+	// Agents in maintenance take no steps
+	spot := register("spot")
+	if agent, err := engine.SetAgentMaintenance(spot.ID, true, "kernel upgrade"); err != nil || !agent.Maintenance || agent.Version != "1.2.0" {
+		t.Fatalf("SetAgentMaintenance() = %+v, %v, want the agent in maintenance", agent, err)
+	}
+	engine.mu.RLock()
+	serves := engine.agents[spot.ID].slot.serves("web", "")
+	engine.mu.RUnlock()
+	if serves {
+		t.Error("an agent in maintenance serves the project, want not")
+	}
+	if agent, err := engine.SetAgentMaintenance(spot.ID, false, ""); err != nil || agent.Maintenance || agent.MaintenanceReason != "" {
+		t.Errorf("SetAgentMaintenance(false) = %+v, %v, want the agent resumed", agent, err)
+	}
+
+	// Agents without heartbeats are lost
+	engine.checkHeartbeats(time.Now().Add(AgentHeartbeatTimeout / 2))
+	if agent, _ := engine.Agent(spot.ID); agent.State == AgentDone {
+		t.Fatalf("Agent() = %+v, want the agent alive before the heartbeat timeout", agent)
+	}
+	engine.checkHeartbeats(time.Now().Add(AgentHeartbeatTimeout + time.Second))
+	if agent, err := engine.Agent(spot.ID); err != nil || agent.DoneReason != AgentLost {
+		t.Errorf("Agent() = %+v, %v, want the agent lost", agent, err)
+	}
+	if _, err := engine.DisconnectAgent(spot.ID); err != ErrAgentDone {
+		t.Errorf("DisconnectAgent() of a lost agent error = %v, want ErrAgentDone", err)
+	}
+	if _, err := engine.Agent("agent-unknown"); err != ErrAgentNotFound {
+		t.Errorf("Agent() of an unknown agent error = %v, want ErrAgentNotFound", err)
+	}
+
+	var types []string
+	for len(types) < 6 {
+		select {
+		case event := <-events.Events():
+			if reason, ok := event.Data["reason"].(string); ok && reason != "" {
+				types = append(types, event.Type+":"+reason)
+			} else if strings.HasPrefix(event.Type, "agent.") {
+				types = append(types, event.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("agent events = %v, want 6", types)
+		}
+	}
+	want := "agent.registered agent.deregistered:drained agent.registered agent.maintenance:kernel upgrade agent.resumed agent.deregistered:lost"
+	if got := strings.Join(types, " "); got != want {
+		t.Errorf("agent events = %s, want %s", got, want)
+	}
+}
+
+func TestDisconnectAgent_FailsRunningStep(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("site", "make")
+	pipeline.Stages[0].RunsOn = []string{"cloud"}
+	engine.CreatePipeline(pipeline)
+	_, secret, err := engine.MintAgentToken("site", []string{"cloud"}, time.Minute)
+	if err != nil {
+		t.Fatalf("MintAgentToken() error = %v", err)
+	}
+
+	job, err := engine.Start(context.Background(), "site")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	agent, agentSecret, err := engine.RegisterAgent(secret, AgentInfo{Name: "spot", Protocol: AgentProtocol})
+	if err != nil {
+		t.Fatalf("RegisterAgent() error = %v", err)
+	}
+	assignment, err := engine.NextAssignment(context.Background(), agent.ID, agentSecret, 2*time.Second)
+	if err != nil || assignment == nil {
+		t.Fatalf("NextAssignment() = %v, %v, want the job's step", assignment, err)
+	}
+	if err := engine.AgentHeartbeat(agent.ID, agentSecret); err != nil {
+		t.Fatalf("AgentHeartbeat() error = %v", err)
+	}
+	if status, _ := engine.Agent(agent.ID); status.RunningStep != assignment.Step.ID || status.State != AgentRunning {
+		t.Errorf("Agent() = %+v, want it running step %s", status, assignment.Step.ID)
+	}
+
+	if _, err := engine.DisconnectAgent(agent.ID); err != nil {
+		t.Fatalf("DisconnectAgent() error = %v", err)
+	}
+	waitForJob(t, engine, "site", job.ID, StatusFailed)
+	if err := engine.AgentHeartbeat(agent.ID, agentSecret); err != ErrAgentDone {
+		t.Errorf("AgentHeartbeat() after disconnecting error = %v, want ErrAgentDone", err)
+	}
+	if err := engine.CompleteAssignment(agent.ID, agentSecret, assignment.ID, StepResult{}); err != ErrAgentDone {
+		t.Errorf("CompleteAssignment() after disconnecting error = %v, want ErrAgentDone", err)
+	}
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Annotation levels
+const (
+	AnnotationError   = "error"
+	AnnotationWarning = "warning"
+	AnnotationNotice  = "notice"
+)
+
+// Annotation is a problem a step found at a location in the source, such
+// as a linter violation. Plugins report annotations as their
+// "annotations" output.
+type Annotation struct {
+	Path    string `json:"path"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	EndLine int    `json:"endLine,omitempty"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	// Rule is the check that reported the problem, and Source the tool
+	Rule   string `json:"rule,omitempty"`
+	Source string `json:"source,omitempty"`
+}
+
+// StepAnnotation is an annotation of a job's step
+type StepAnnotation struct {
+	StepID string `json:"stepId"`
+	Annotation
+}
+
+// ProblemMatcher turns lines of tool output into annotations. Pattern
+// captures the named groups path, line, column, level, message and rule;
+// only path and message are required.
+type ProblemMatcher struct {
+	Source  string
+	Pattern *regexp.Regexp
+	// Level is used for lines without a level group
+	Level string
+}
+
+// CompilerMatcher matches the "path:line:column: message" lines printed
+// by compilers and most linters
+var CompilerMatcher = ProblemMatcher{
+	Pattern: regexp.MustCompile(`^(?P<path>[^\s:][^:]*):(?P<line>\d+)(:(?P<column>\d+))?:\s*((?P<level>error|warning|note|info)\s*:\s*)?(?P<message>.+)$`),
+	Level:   AnnotationError,
+}
+
+// Match returns the annotations of the output lines the matcher matches
+func (m ProblemMatcher) Match(output string) []Annotation {
+	var annotations []Annotation
+	names := m.Pattern.SubexpNames()
+	for _, line := range strings.Split(output, "\n") {
+		groups := m.Pattern.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if groups == nil {
+			continue
+		}
+		annotation := Annotation{Level: m.Level, Source: m.Source}
+		for i, name := range names {
+			value := strings.TrimSpace(groups[i])
+			if value == "" {
+				continue
+			}
+			switch name {
+			case "path":
+				annotation.Path = value
+			case "line":
+				annotation.Line, _ = strconv.Atoi(value)
+			case "column":
+				annotation.Column, _ = strconv.Atoi(value)
+			case "level":
+				annotation.Level = NormalizeLevel(value)
+			case "message":
+				annotation.Message = value
+			case "rule":
+				annotation.Rule = value
+			}
+		}
+		if annotation.Path != "" && annotation.Message != "" {
+			annotations = append(annotations, annotation)
+		}
+	}
+	return annotations
+}
+
+// NormalizeLevel maps the severities of common tools to annotation levels
+func NormalizeLevel(severity string) string {
+	switch strings.ToLower(severity) {
+	case "error", "fatal", "critical", "high", "2":
+		return AnnotationError
+	case "warning", "warn", "medium", "1":
+		return AnnotationWarning
+	default:
+		return AnnotationNotice
+	}
+}
+
+// JobAnnotations returns the annotations of a job's steps, ordered by step
+// then location
+func (pe *PipelineEngine) JobAnnotations(jobID string) ([]StepAnnotation, error) {
+	job, err := pe.FindJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	annotations := []StepAnnotation{}
+	for _, step := range job.Steps {
+		sorted := append([]Annotation{}, step.Annotations...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			if sorted[i].Path != sorted[j].Path {
+				return sorted[i].Path < sorted[j].Path
+			}
+			return sorted[i].Line < sorted[j].Line
+		})
+		for _, annotation := range sorted {
+			annotations = append(annotations, StepAnnotation{StepID: step.ID, Annotation: annotation})
+		}
+	}
+	return annotations, nil
+}
+
+// pluginAnnotations takes the annotations out of a plugin's outputs
+func pluginAnnotations(outputs map[string]interface{}) []Annotation {
+	annotations, ok := outputs["annotations"].([]Annotation)
+	if !ok {
+		return nil
+	}
+	delete(outputs, "annotations")
+	return annotations
+}
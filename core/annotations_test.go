@@ -0,0 +1,60 @@
+package core
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCompilerMatcher(t *testing.T) {
+	output := "# example.com/app\n" +
+		"main.go:12:5: undefined: foo\n" +
+		"pkg/util.go:3: warning: unused variable\r\n" +
+		"ok  \texample.com/app\t0.01s\n"
+
+	annotations := CompilerMatcher.Match(output)
+	if len(annotations) != 2 {
+		t.Fatalf("Match() = %+v, want 2 annotations", annotations)
+	}
+	if a := annotations[0]; a.Path != "main.go" || a.Line != 12 || a.Column != 5 || a.Level != AnnotationError || a.Message != "undefined: foo" {
+		t.Errorf("annotations[0] = %+v", a)
+	}
+	if a := annotations[1]; a.Path != "pkg/util.go" || a.Line != 3 || a.Level != AnnotationWarning || a.Message != "unused variable" {
+		t.Errorf("annotations[1] = %+v", a)
+	}
+}
+
+func TestRun_PluginAnnotations(t *testing.T) {
+	plugin := &fakePlugin{name: "lint", outputs: map[string]interface{}{
+		"violations": 1,
+		"annotations": []Annotation{
+			{Path: "b.go", Line: 1, Level: AnnotationWarning, Message: "b"},
+			{Path: "a.go", Line: 9, Level: AnnotationError, Message: "token s3cr3t leaked"},
+		},
+	}}
+	engine := newSecretEngine(t)
+	engine.RegisterPlugin(plugin)
+	engine.SetSecret(Secret{Name: "TOKEN", Value: "s3cr3t"})
+	engine.CreatePipeline(&Pipeline{
+		ID:     "lint",
+		Stages: []Stage{{ID: "check", Steps: []Step{{ID: "lint", Plugin: "lint", Secrets: []string{"TOKEN"}}}}},
+	})
+
+	job, err := engine.Run(context.Background(), "lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Steps[0].Output != `{"violations":1}` {
+		t.Errorf("Output = %q, want the outputs without annotations", job.Steps[0].Output)
+	}
+
+	annotations, err := engine.JobAnnotations(job.ID)
+	if err != nil {
+		t.Fatalf("JobAnnotations() error = %v", err)
+	}
+	if len(annotations) != 2 || annotations[0].Path != "a.go" || annotations[0].StepID != "lint" {
+		t.Fatalf("JobAnnotations() = %+v, want both annotations ordered by path", annotations)
+	}
+	if annotations[0].Message != "token *** leaked" {
+		t.Errorf("Message = %q, want the secret masked", annotations[0].Message)
+	}
+}
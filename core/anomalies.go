@@ -0,0 +1,315 @@
+package core
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// anomalyFloor is the smallest deviation from a baseline flagged as an
+// anomaly, so steps with very steady durations don't alert on jitter
+const anomalyFloor = time.Second
+
+// DurationAnomalyPolicy sets when a step's duration is an anomaly: more than
+// StdDevs standard deviations or Percent percent away from the mean of its
+// last Window successful durations, once it has MinSamples of them. A zero
+// StdDevs or Percent turns that check off.
+type DurationAnomalyPolicy struct {
+	StdDevs    float64 `json:"stdDevs,omitempty"`
+	Percent    float64 `json:"percent,omitempty"`
+	MinSamples int     `json:"minSamples,omitempty"`
+	Window     int     `json:"window,omitempty"`
+}
+
+// DefaultDurationAnomalyPolicy flags durations three standard deviations
+// from the mean of the last 20, once there are five
+var DefaultDurationAnomalyPolicy = DurationAnomalyPolicy{StdDevs: 3, MinSamples: 5, Window: 20}
+
+// DurationAnomaly records a step duration that deviated from its baseline
+type DurationAnomaly struct {
+	DurationMs int64 `json:"durationMs"`
+	BaselineMs int64 `json:"baselineMs"`
+	StdDevMs   int64 `json:"stdDevMs"`
+	Samples    int   `json:"samples"`
+	// Deviations is how many standard deviations the duration is from the
+	// baseline, and Percent how far in percent, both negative when faster
+	Deviations float64 `json:"deviations"`
+	Percent    float64 `json:"percent"`
+	// Direction is "slower" or "faster"
+	Direction string `json:"direction"`
+}
+
+// StepDurationStats describes the duration baseline of a pipeline's step
+type StepDurationStats struct {
+	PipelineID string `json:"pipelineId"`
+	StepID     string `json:"stepId"`
+	Samples    int    `json:"samples"`
+	MeanMs     int64  `json:"meanMs"`
+	StdDevMs   int64  `json:"stdDevMs"`
+	P50Ms      int64  `json:"p50Ms"`
+	P95Ms      int64  `json:"p95Ms"`
+	// Anomalies counts the anomalies flagged since the server started
+	Anomalies int `json:"anomalies"`
+}
+
+// durationBaseline is the rolling window of a step's recent successful
+// durations, oldest first
+type durationBaseline struct {
+	samples   []time.Duration
+	anomalies int
+}
+
+// WithDurationAnomalies sets when step durations are flagged as anomalies.
+// Defaults to DefaultDurationAnomalyPolicy.
+func WithDurationAnomalies(policy DurationAnomalyPolicy) Option {
+	return func(pe *PipelineEngine) {
+		pe.anomalyPolicy = normalizeAnomalyPolicy(policy)
+	}
+}
+
+// SetDurationAnomalyPolicy replaces the duration anomaly policy at runtime
+func (pe *PipelineEngine) SetDurationAnomalyPolicy(policy DurationAnomalyPolicy) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.anomalyPolicy = normalizeAnomalyPolicy(policy)
+}
+
+// normalizeAnomalyPolicy fills in the default window and minimum samples
+func normalizeAnomalyPolicy(policy DurationAnomalyPolicy) DurationAnomalyPolicy {
+	if policy.Window <= 0 {
+		policy.Window = DefaultDurationAnomalyPolicy.Window
+	}
+	if policy.MinSamples <= 0 {
+		policy.MinSamples = DefaultDurationAnomalyPolicy.MinSamples
+	}
+	if policy.MinSamples > policy.Window {
+		policy.MinSamples = policy.Window
+	}
+	return policy
+}
+
+// executionTime returns how long a step executed. Time spent waiting for a
+// runner or services doesn't count, and a step still running counts up to
+// now.
+func executionTime(step StepStatus, now time.Time) time.Duration {
+	start, end := step.StartedAt, step.EndedAt
+	for _, phase := range step.Phases {
+		if phase.Name == PhaseExecution {
+			start, end = phase.StartedAt, phase.EndedAt
+		}
+	}
+	if start.IsZero() || step.CachedFrom != "" {
+		return 0
+	}
+	if end.IsZero() {
+		end = now
+	}
+	if end.Before(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// baselineKey identifies the duration baseline of a pipeline's step
+func baselineKey(pipelineID, stepID string) string {
+	return pipelineID + "#" + stepID
+}
+
+// baseline returns the duration baseline of a step, seeding it from the
+// jobs in memory other than skipJobID the first time. Callers must hold
+// pe.mu.
+func (pe *PipelineEngine) baseline(pipelineID, stepID, skipJobID string) *durationBaseline {
+	key := baselineKey(pipelineID, stepID)
+	if baseline, ok := pe.durationBaselines[key]; ok {
+		return baseline
+	}
+
+	type sample struct {
+		at       time.Time
+		duration time.Duration
+	}
+	var samples []sample
+	for _, job := range pe.jobs {
+		if job.PipelineID != pipelineID || job.ID == skipJobID {
+			continue
+		}
+		for _, step := range job.Steps {
+			if step.ID == stepID && countsForBaseline(step) {
+				samples = append(samples, sample{step.StartedAt, executionTime(step, step.EndedAt)})
+			}
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].at.Before(samples[j].at)
+	})
+	if len(samples) > pe.anomalyPolicy.Window {
+		samples = samples[len(samples)-pe.anomalyPolicy.Window:]
+	}
+
+	baseline := &durationBaseline{}
+	for _, s := range samples {
+		baseline.samples = append(baseline.samples, s.duration)
+	}
+	pe.durationBaselines[key] = baseline
+	return baseline
+}
+
+// countsForBaseline reports whether a step's duration belongs in its
+// baseline: it finished successfully and wasn't reused from the cache
+func countsForBaseline(step StepStatus) bool {
+	return (step.Status == StatusSuccess || step.Status == StatusWarning) && step.CachedFrom == "" && !step.EndedAt.IsZero()
+}
+
+// checkDuration compares the duration of a finished step with its baseline,
+// records an anomaly on the step and emits step.anomaly, then adds the
+// duration to the baseline
+func (pe *PipelineEngine) checkDuration(pipeline *Pipeline, job *Job, index int) {
+	pe.mu.Lock()
+	step := job.Steps[index]
+	if !countsForBaseline(step) {
+		pe.mu.Unlock()
+		return
+	}
+	duration := executionTime(step, step.EndedAt)
+	policy := pe.anomalyPolicy
+	baseline := pe.baseline(pipeline.ID, step.ID, job.ID)
+	anomaly := policy.check(duration, baseline.samples)
+	if anomaly != nil {
+		job.Steps[index].DurationAnomaly = anomaly
+		baseline.anomalies++
+	}
+	baseline.samples = append(baseline.samples, duration)
+	if len(baseline.samples) > policy.Window {
+		baseline.samples = baseline.samples[len(baseline.samples)-policy.Window:]
+	}
+	pe.mu.Unlock()
+
+	if anomaly == nil {
+		return
+	}
+	pe.logger.Printf("Step %s of job %s took %s, %s than its %s baseline", step.ID, job.ID, duration.Round(time.Millisecond), anomaly.Direction, (time.Duration(anomaly.BaselineMs) * time.Millisecond).Round(time.Millisecond))
+	pe.emitEvent(Event{
+		Type:       "step.anomaly",
+		Timestamp:  time.Now(),
+		PipelineID: pipeline.ID,
+		JobID:      job.ID,
+		StepID:     step.ID,
+		Data: map[string]interface{}{
+			"durationMs": anomaly.DurationMs,
+			"baselineMs": anomaly.BaselineMs,
+			"stdDevMs":   anomaly.StdDevMs,
+			"deviations": anomaly.Deviations,
+			"percent":    anomaly.Percent,
+			"direction":  anomaly.Direction,
+		},
+	})
+}
+
+// check returns the anomaly of a duration against samples, or nil when the
+// duration is within bounds or there are too few samples
+func (p DurationAnomalyPolicy) check(duration time.Duration, samples []time.Duration) *DurationAnomaly {
+	if len(samples) < p.MinSamples || p.StdDevs <= 0 && p.Percent <= 0 {
+		return nil
+	}
+	mean, stdDev := meanStdDev(samples)
+	delta := float64(duration) - mean
+	if math.Abs(delta) < float64(anomalyFloor) {
+		return nil
+	}
+
+	deviations := 0.0
+	if stdDev > 0 {
+		deviations = delta / stdDev
+	}
+	percent := 0.0
+	if mean > 0 {
+		percent = delta / mean * 100
+	}
+	// Steady durations have no deviation to compare against, so any change
+	// past the floor is an anomaly
+	bySigma := p.StdDevs > 0 && (stdDev == 0 || math.Abs(deviations) > p.StdDevs)
+	byPercent := p.Percent > 0 && math.Abs(percent) > p.Percent
+	if !bySigma && !byPercent {
+		return nil
+	}
+
+	direction := "slower"
+	if delta < 0 {
+		direction = "faster"
+	}
+	return &DurationAnomaly{
+		DurationMs: duration.Milliseconds(),
+		BaselineMs: time.Duration(mean).Milliseconds(),
+		StdDevMs:   time.Duration(stdDev).Milliseconds(),
+		Samples:    len(samples),
+		Deviations: math.Round(deviations*100) / 100,
+		Percent:    math.Round(percent*10) / 10,
+		Direction:  direction,
+	}
+}
+
+// meanStdDev returns the mean and population standard deviation of samples
+func meanStdDev(samples []time.Duration) (float64, float64) {
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s)
+	}
+	mean := sum / float64(len(samples))
+	var squares float64
+	for _, s := range samples {
+		squares += (float64(s) - mean) * (float64(s) - mean)
+	}
+	return mean, math.Sqrt(squares / float64(len(samples)))
+}
+
+// DurationStats returns the duration baselines of a pipeline's steps or,
+// when pipelineID is empty, of every pipeline's, sorted by pipeline and
+// step. Steps get a baseline once they have run since the server started.
+func (pe *PipelineEngine) DurationStats(pipelineID string) []StepDurationStats {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	stats := []StepDurationStats{}
+	for id, pipeline := range pe.pipelines {
+		if pipelineID != "" && id != pipelineID {
+			continue
+		}
+		for _, stage := range expandMatrices(pipeline.Stages) {
+			for _, step := range stage.Steps {
+				baseline, ok := pe.durationBaselines[baselineKey(id, step.ID)]
+				if !ok || len(baseline.samples) == 0 {
+					continue
+				}
+				sorted := append([]time.Duration{}, baseline.samples...)
+				sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+				mean, stdDev := meanStdDev(sorted)
+				stats = append(stats, StepDurationStats{
+					PipelineID: id,
+					StepID:     step.ID,
+					Samples:    len(sorted),
+					MeanMs:     time.Duration(mean).Milliseconds(),
+					StdDevMs:   time.Duration(stdDev).Milliseconds(),
+					P50Ms:      percentile(sorted, 50).Milliseconds(),
+					P95Ms:      percentile(sorted, 95).Milliseconds(),
+					Anomalies:  baseline.anomalies,
+				})
+			}
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].PipelineID != stats[j].PipelineID {
+			return stats[i].PipelineID < stats[j].PipelineID
+		}
+		return stats[i].StepID < stats[j].StepID
+	})
+	return stats
+}
+
+// percentile returns the nearest-rank percentile of sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := int(math.Ceil(float64(p)/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
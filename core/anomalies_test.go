@@ -0,0 +1,83 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDurationAnomalyPolicy_Check(t *testing.T) {
+	samples := []time.Duration{50 * time.Second, 60 * time.Second, 55 * time.Second, 65 * time.Second, 70 * time.Second}
+
+	tests := []struct {
+		name     string
+		policy   DurationAnomalyPolicy
+		duration time.Duration
+		want     string
+	}{
+		{"within deviations", DefaultDurationAnomalyPolicy, 75 * time.Second, ""},
+		{"slower", DefaultDurationAnomalyPolicy, 2 * time.Minute, "slower"},
+		{"faster", DefaultDurationAnomalyPolicy, 10 * time.Second, "faster"},
+		{"percent", DurationAnomalyPolicy{Percent: 20, MinSamples: 5}, 75 * time.Second, "slower"},
+		{"too few samples", DurationAnomalyPolicy{StdDevs: 3, MinSamples: 10}, 2 * time.Minute, ""},
+		{"disabled", DurationAnomalyPolicy{MinSamples: 5}, 2 * time.Minute, ""},
+	}
+	for _, tt := range tests {
+		anomaly := tt.policy.check(tt.duration, samples)
+		switch {
+		case tt.want == "" && anomaly != nil:
+			t.Errorf("%s: check() = %+v, want none", tt.name, anomaly)
+		case tt.want != "" && (anomaly == nil || anomaly.Direction != tt.want):
+			t.Errorf("%s: check() = %+v, want a %s anomaly", tt.name, anomaly, tt.want)
+		}
+	}
+
+	steady := []time.Duration{time.Second, time.Second, time.Second, time.Second, time.Second}
+	if anomaly := DefaultDurationAnomalyPolicy.check(1500*time.Millisecond, steady); anomaly != nil {
+		t.Errorf("check() = %+v, want no anomaly under the floor", anomaly)
+	}
+	if anomaly := DefaultDurationAnomalyPolicy.check(3*time.Second, steady); anomaly == nil || anomaly.Percent != 200 {
+		t.Errorf("check() = %+v, want a 200%% anomaly of a steady step", anomaly)
+	}
+}
+
+func TestCheckDuration_RecordsAnomalies(t *testing.T) {
+	engine := newTestEngine()
+	engine.CreatePipeline(scriptPipeline("web", "make"))
+	sub := engine.Subscribe(10)
+	defer sub.Close()
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	step := func(minutes int, duration time.Duration) StepStatus {
+		started := start.Add(time.Duration(minutes) * time.Minute)
+		return StepStatus{ID: "build-step-a", Status: StatusSuccess, StartedAt: started, EndedAt: started.Add(duration)}
+	}
+	engine.mu.Lock()
+	for i := 0; i < 5; i++ {
+		id := "history-" + string(rune('a'+i))
+		engine.jobs[id] = &Job{ID: id, PipelineID: "web", Status: StatusSuccess, Steps: []StepStatus{step(i*10, time.Minute+time.Duration(i)*time.Second)}}
+	}
+	slow := &Job{ID: "slow", PipelineID: "web", Status: StatusRunning, Steps: []StepStatus{step(60, 5*time.Minute)}}
+	engine.jobs[slow.ID] = slow
+	engine.mu.Unlock()
+
+	pipeline, _ := engine.GetPipeline("web")
+	engine.checkDuration(pipeline, slow, 0)
+
+	anomaly := slow.Steps[0].DurationAnomaly
+	if anomaly == nil || anomaly.Direction != "slower" || anomaly.Samples != 5 || anomaly.BaselineMs != 62000 {
+		t.Fatalf("DurationAnomaly = %+v, want a slower step against 5 samples of 62s", anomaly)
+	}
+	select {
+	case event := <-sub.Events():
+		if event.Type != "step.anomaly" || event.StepID != "build-step-a" {
+			t.Errorf("event = %+v, want step.anomaly", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no step.anomaly event")
+	}
+
+	stats := engine.DurationStats("web")
+	if len(stats) != 1 || stats[0].Samples != 6 || stats[0].Anomalies != 1 || stats[0].P95Ms != 300000 {
+		t.Errorf("DurationStats() = %+v, want the slow run in the baseline", stats)
+	}
+}
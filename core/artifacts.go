@@ -0,0 +1,432 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// ArtifactConfig declares files kept from a job's working directory when
+// the job succeeds
+type ArtifactConfig struct {
+	Name string `json:"name"`
+	// Paths are glob patterns relative to the executor's working directory.
+	// Directories are collected recursively.
+	Paths []string `json:"paths"`
+	// Retention overrides the pipeline's retention period for this
+	// artifact, such as "7d"
+	Retention string `json:"retention,omitempty"`
+}
+
+// RetentionPolicy limits how long a pipeline's artifacts are kept. Zero
+// values mean no limit.
+type RetentionPolicy struct {
+	// Days expires artifacts older than this many days
+	Days int `json:"days,omitempty"`
+	// Count keeps only the artifacts of the most recent jobs
+	Count int `json:"count,omitempty"`
+}
+
+// LegalHold exempts a job's artifacts from expiry
+type LegalHold struct {
+	Reason string    `json:"reason,omitempty"`
+	By     string    `json:"by,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// Artifact is a stored artifact of a job
+type Artifact struct {
+	Name       string    `json:"name"`
+	PipelineID string    `json:"pipelineId"`
+	JobID      string    `json:"jobId"`
+	Files      int       `json:"files"`
+	Size       int64     `json:"size"`
+	CreatedAt  time.Time `json:"createdAt"`
+	// ExpiresAt, Held and Release are computed from the current retention
+	// policy, legal holds and releases when artifacts are listed
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+	Held      bool      `json:"held,omitempty"`
+	// Release names the release the artifact was promoted in
+	Release string `json:"release,omitempty"`
+}
+
+// ArtifactStore stores job artifacts. When the engine's Store also
+// implements ArtifactStore, artifacts are collected from successful jobs.
+type ArtifactStore interface {
+	// SaveArtifact copies the files matching patterns under root and
+	// records the artifact's file count and size
+	SaveArtifact(artifact *Artifact, root string, patterns []string) error
+	ListArtifacts() ([]*Artifact, error)
+	DeleteArtifact(artifact *Artifact) error
+	// ArchiveArtifact writes the artifact's files to w as a gzipped tarball
+	ArchiveArtifact(artifact *Artifact, w io.Writer) error
+}
+
+// ArtifactUsage reports the storage used by artifacts
+type ArtifactUsage struct {
+	Artifacts int                     `json:"artifacts"`
+	Files     int                     `json:"files"`
+	Size      int64                   `json:"size"`
+	HeldSize  int64                   `json:"heldSize"`
+	Pipelines []PipelineArtifactUsage `json:"pipelines"`
+}
+
+// PipelineArtifactUsage reports the storage used by a pipeline's artifacts
+type PipelineArtifactUsage struct {
+	PipelineID string           `json:"pipelineId"`
+	Jobs       int              `json:"jobs"`
+	Artifacts  int              `json:"artifacts"`
+	Size       int64            `json:"size"`
+	HeldSize   int64            `json:"heldSize"`
+	Retention  *RetentionPolicy `json:"retention,omitempty"`
+}
+
+// artifactNamePattern restricts artifact names to safe file names
+var artifactNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ValidArtifactName reports whether name can be used as an artifact name
+func ValidArtifactName(name string) bool {
+	return artifactNamePattern.MatchString(name)
+}
+
+// artifactStore returns the engine's artifact store, or nil
+func (pe *PipelineEngine) artifactStore() ArtifactStore {
+	store, _ := pe.store.(ArtifactStore)
+	return store
+}
+
+// collectArtifacts stores the artifacts a pipeline declares. Failures are
+// logged on the job and do not change its status.
+func (pe *PipelineEngine) collectArtifacts(pipeline *Pipeline, job *Job) {
+	store := pe.artifactStore()
+	if store == nil || len(pipeline.Artifacts) == 0 {
+		return
+	}
+
+	root := pe.jobDir(job)
+	if root == "" {
+		root = "."
+	}
+
+	for _, config := range pipeline.Artifacts {
+		if !ValidArtifactName(config.Name) {
+			pe.logJob(job, "warn", "", fmt.Sprintf("Skipping artifact with invalid name %q", config.Name))
+			continue
+		}
+		artifact := &Artifact{
+			Name:       config.Name,
+			PipelineID: pipeline.ID,
+			JobID:      job.ID,
+			CreatedAt:  time.Now(),
+		}
+		if err := store.SaveArtifact(artifact, root, config.Paths); err != nil {
+			pe.logJob(job, "warn", "", fmt.Sprintf("Failed to collect artifact %s: %v", config.Name, err))
+			continue
+		}
+		pe.logJob(job, "info", "", fmt.Sprintf("Collected artifact %s (%d files, %d bytes)", config.Name, artifact.Files, artifact.Size))
+	}
+}
+
+// JobArtifacts returns the stored artifacts of a job
+func (pe *PipelineEngine) JobArtifacts(jobID string) ([]*Artifact, error) {
+	if _, err := pe.FindJob(jobID); err != nil {
+		return nil, err
+	}
+	artifacts, err := pe.listArtifacts()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*Artifact{}
+	for _, artifact := range artifacts {
+		if artifact.JobID == jobID {
+			result = append(result, artifact)
+		}
+	}
+	return result, nil
+}
+
+// SaveStepArtifact stores the files matching patterns under root as an
+// artifact of the job of the plugin step executing with ctx
+func SaveStepArtifact(ctx context.Context, name, root string, patterns []string) (*Artifact, error) {
+	reporter, ok := ctx.Value(stepReporterKey{}).(*stepReporter)
+	if !ok {
+		return nil, fmt.Errorf("artifact %s can only be stored by a step of a job", name)
+	}
+	store := reporter.engine.artifactStore()
+	if store == nil {
+		return nil, fmt.Errorf("no artifact store")
+	}
+	if !ValidArtifactName(name) {
+		return nil, fmt.Errorf("invalid artifact name %q", name)
+	}
+	artifact := &Artifact{
+		Name:       name,
+		PipelineID: reporter.pipelineID,
+		JobID:      reporter.job.ID,
+		CreatedAt:  time.Now(),
+	}
+	if err := store.SaveArtifact(artifact, root, patterns); err != nil {
+		return nil, err
+	}
+	reporter.engine.logJob(reporter.job, "info", reporter.stepID, fmt.Sprintf("Stored artifact %s (%d files, %d bytes)", name, artifact.Files, artifact.Size))
+	return artifact, nil
+}
+
+// ExtractJobArtifact writes the files of an artifact of any job under dest
+// for the plugin step executing with ctx, such as a rollback reading what
+// an earlier job stored
+func ExtractJobArtifact(ctx context.Context, jobID, name, dest string) error {
+	reporter, ok := ctx.Value(stepReporterKey{}).(*stepReporter)
+	if !ok {
+		return fmt.Errorf("artifact %s can only be read by a step of a job", name)
+	}
+	artifacts, err := reporter.engine.JobArtifacts(jobID)
+	if err != nil {
+		return err
+	}
+	for _, artifact := range artifacts {
+		if artifact.Name == name {
+			return reporter.engine.extractArtifact(artifact, dest)
+		}
+	}
+	return fmt.Errorf("artifact %s of job %s not found", name, jobID)
+}
+
+// ArchiveArtifact writes an artifact of a job to w as a gzipped tarball
+func (pe *PipelineEngine) ArchiveArtifact(jobID, name string, w io.Writer) error {
+	artifacts, err := pe.JobArtifacts(jobID)
+	if err != nil {
+		return err
+	}
+	for _, artifact := range artifacts {
+		if artifact.Name == name {
+			return pe.artifactStore().ArchiveArtifact(artifact, w)
+		}
+	}
+	return fmt.Errorf("artifact %s of job %s not found", name, jobID)
+}
+
+// SetLegalHold places a legal hold on a job, exempting its artifacts from
+// expiry, or releases it when hold is nil
+func (pe *PipelineEngine) SetLegalHold(jobID string, hold *LegalHold) (*Job, error) {
+	pe.mu.Lock()
+	job, exists := pe.jobs[jobID]
+	if !exists {
+		pe.mu.Unlock()
+		return nil, fmt.Errorf("job with ID %s not found", jobID)
+	}
+	if hold != nil && hold.At.IsZero() {
+		hold.At = time.Now()
+	}
+	job.LegalHold = hold
+	pe.mu.Unlock()
+
+	pe.saveJob(job)
+	return pe.snapshotJob(job), nil
+}
+
+// listArtifacts returns every stored artifact, newest first, with its
+// expiry, hold and release computed. Promoted artifacts never expire.
+func (pe *PipelineEngine) listArtifacts() ([]*Artifact, error) {
+	store := pe.artifactStore()
+	if store == nil {
+		return []*Artifact{}, nil
+	}
+	artifacts, err := store.ListArtifacts()
+	if err != nil {
+		return nil, err
+	}
+	released, err := pe.releasedArtifacts()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(artifacts, func(i, j int) bool {
+		return artifacts[i].CreatedAt.After(artifacts[j].CreatedAt)
+	})
+
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	for _, artifact := range artifacts {
+		if release, ok := released[artifact.JobID+"/"+artifact.Name]; ok {
+			artifact.Release = release
+			continue
+		}
+		if job, ok := pe.jobs[artifact.JobID]; ok && job.LegalHold != nil {
+			artifact.Held = true
+			continue
+		}
+		if pipeline, ok := pe.pipelines[artifact.PipelineID]; ok {
+			if retention := pe.artifactRetention(pipeline, artifact.Name); retention > 0 {
+				artifact.ExpiresAt = artifact.CreatedAt.Add(retention)
+			}
+		}
+	}
+	return artifacts, nil
+}
+
+// WithArtifactRetention sets the retention of the artifacts of pipelines
+// without their own artifact retention
+func WithArtifactRetention(policy *RetentionPolicy) Option {
+	return func(pe *PipelineEngine) {
+		pe.defaultRetention = policy
+	}
+}
+
+// SetArtifactRetention changes the default artifact retention of a running
+// engine
+func (pe *PipelineEngine) SetArtifactRetention(policy *RetentionPolicy) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.defaultRetention = policy
+}
+
+// retentionPolicy returns the artifact retention of a pipeline, or the
+// engine's default. Callers must hold pe.mu.
+func (pe *PipelineEngine) retentionPolicy(pipeline *Pipeline) *RetentionPolicy {
+	if pipeline.ArtifactRetention != nil {
+		return pipeline.ArtifactRetention
+	}
+	return pe.defaultRetention
+}
+
+// artifactRetention returns how long an artifact of a pipeline is kept, or
+// 0 when it is kept until the count limit removes it. Callers must hold
+// pe.mu.
+func (pe *PipelineEngine) artifactRetention(pipeline *Pipeline, name string) time.Duration {
+	for _, config := range pipeline.Artifacts {
+		if config.Name == name && config.Retention != "" {
+			if d, err := ParseDuration(config.Retention); err == nil {
+				return d
+			}
+		}
+	}
+	if policy := pe.retentionPolicy(pipeline); policy != nil && policy.Days > 0 {
+		return time.Duration(policy.Days) * 24 * time.Hour
+	}
+	return 0
+}
+
+// ExpireArtifacts deletes artifacts past their retention period and those
+// of jobs beyond their pipeline's retention count, and returns them.
+// Promoted artifacts, those of jobs on legal hold and of deleted pipelines
+// are kept.
+func (pe *PipelineEngine) ExpireArtifacts(now time.Time) ([]*Artifact, error) {
+	artifacts, err := pe.listArtifacts()
+	if err != nil {
+		return nil, err
+	}
+
+	// Jobs of each pipeline whose artifacts the count limit keeps, counted
+	// newest first and not counting held jobs
+	kept := make(map[string]map[string]bool)
+	expired := []*Artifact{}
+	for _, artifact := range artifacts {
+		if artifact.Held || artifact.Release != "" {
+			continue
+		}
+		pe.mu.RLock()
+		pipeline, ok := pe.pipelines[artifact.PipelineID]
+		var retention *RetentionPolicy
+		if ok {
+			retention = pe.retentionPolicy(pipeline)
+		}
+		pe.mu.RUnlock()
+		if !ok {
+			continue
+		}
+
+		expire := !artifact.ExpiresAt.IsZero() && !now.Before(artifact.ExpiresAt)
+		if retention != nil && retention.Count > 0 {
+			jobs := kept[pipeline.ID]
+			if jobs == nil {
+				jobs = make(map[string]bool)
+				kept[pipeline.ID] = jobs
+			}
+			if !jobs[artifact.JobID] && len(jobs) < retention.Count {
+				jobs[artifact.JobID] = true
+			}
+			expire = expire || !jobs[artifact.JobID]
+		}
+
+		if expire {
+			if err := pe.artifactStore().DeleteArtifact(artifact); err != nil {
+				return expired, err
+			}
+			expired = append(expired, artifact)
+		}
+	}
+
+	if len(expired) > 0 {
+		pe.logger.Printf("Expired %d artifacts", len(expired))
+	}
+	return expired, nil
+}
+
+// ArtifactUsage reports the storage used by artifacts, in total and per
+// pipeline
+func (pe *PipelineEngine) ArtifactUsage() (*ArtifactUsage, error) {
+	artifacts, err := pe.listArtifacts()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &ArtifactUsage{Pipelines: []PipelineArtifactUsage{}}
+	byPipeline := make(map[string]*PipelineArtifactUsage)
+	jobs := make(map[string]map[string]bool)
+	for _, artifact := range artifacts {
+		p, ok := byPipeline[artifact.PipelineID]
+		if !ok {
+			p = &PipelineArtifactUsage{PipelineID: artifact.PipelineID}
+			byPipeline[artifact.PipelineID] = p
+			jobs[artifact.PipelineID] = make(map[string]bool)
+		}
+		jobs[artifact.PipelineID][artifact.JobID] = true
+		p.Artifacts++
+		p.Size += artifact.Size
+		usage.Artifacts++
+		usage.Files += artifact.Files
+		usage.Size += artifact.Size
+		if artifact.Held {
+			p.HeldSize += artifact.Size
+			usage.HeldSize += artifact.Size
+		}
+	}
+
+	pe.mu.RLock()
+	for id, p := range byPipeline {
+		p.Jobs = len(jobs[id])
+		if pipeline, ok := pe.pipelines[id]; ok {
+			p.Retention = pe.retentionPolicy(pipeline)
+		}
+		usage.Pipelines = append(usage.Pipelines, *p)
+	}
+	pe.mu.RUnlock()
+
+	sort.Slice(usage.Pipelines, func(i, j int) bool {
+		return usage.Pipelines[i].Size > usage.Pipelines[j].Size
+	})
+	return usage, nil
+}
+
+// WatchArtifacts expires artifacts now and then every interval until ctx
+// is done
+func (pe *PipelineEngine) WatchArtifacts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := pe.ExpireArtifacts(time.Now()); err != nil {
+			pe.logger.Printf("Failed to expire artifacts: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
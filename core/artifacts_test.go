@@ -0,0 +1,202 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// artifactEngine returns an engine storing artifacts in a temporary data
+// directory and running steps in workDir
+func artifactEngine(t *testing.T, workDir string) *PipelineEngine {
+	t.Helper()
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	return newTestEngine(WithStore(store), WithExecutor(&ShellExecutor{Dir: workDir}))
+}
+
+func runArtifactJob(t *testing.T, engine *PipelineEngine, pipelineID string) *Job {
+	t.Helper()
+	job, err := engine.Run(context.Background(), pipelineID)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess {
+		t.Fatalf("Status = %q, want success", job.Status)
+	}
+	return job
+}
+
+func TestArtifacts_CollectAndArchive(t *testing.T) {
+	dir := t.TempDir()
+	engine := artifactEngine(t, dir)
+	pipeline := scriptPipeline("build", "mkdir -p dist/js && echo app > dist/app.bin && echo x > dist/js/main.js")
+	pipeline.Artifacts = []ArtifactConfig{
+		{Name: "dist", Paths: []string{"dist/"}},
+		{Name: "missing", Paths: []string{"nothing/*"}},
+	}
+	engine.CreatePipeline(pipeline)
+
+	job := runArtifactJob(t, engine, "build")
+
+	artifacts, err := engine.JobArtifacts(job.ID)
+	if err != nil {
+		t.Fatalf("JobArtifacts() error = %v", err)
+	}
+	if len(artifacts) != 1 || artifacts[0].Name != "dist" || artifacts[0].Files != 2 {
+		t.Fatalf("artifacts = %+v, want dist with 2 files", artifacts)
+	}
+
+	var buf bytes.Buffer
+	if err := engine.ArchiveArtifact(job.ID, "dist", &buf); err != nil {
+		t.Fatalf("ArchiveArtifact() error = %v", err)
+	}
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("archive is not gzipped: %v", err)
+	}
+	names := map[string]bool{}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid archive: %v", err)
+		}
+		names[header.Name] = true
+	}
+	if !names["dist/app.bin"] || !names["dist/js/main.js"] {
+		t.Errorf("archive entries = %v, want dist/app.bin and dist/js/main.js", names)
+	}
+}
+
+func TestArtifacts_NotCollectedFromFailedJobs(t *testing.T) {
+	dir := t.TempDir()
+	engine := artifactEngine(t, dir)
+	pipeline := scriptPipeline("broken", "echo out > out.txt && exit 1")
+	pipeline.Artifacts = []ArtifactConfig{{Name: "out", Paths: []string{"out.txt"}}}
+	engine.CreatePipeline(pipeline)
+
+	job, _ := engine.Run(context.Background(), "broken")
+	artifacts, err := engine.JobArtifacts(job.ID)
+	if err != nil {
+		t.Fatalf("JobArtifacts() error = %v", err)
+	}
+	if len(artifacts) != 0 {
+		t.Errorf("artifacts = %+v, want none for a failed job", artifacts)
+	}
+}
+
+func TestExpireArtifacts_CountAndLegalHold(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "report.txt"), []byte("report"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	engine := artifactEngine(t, dir)
+	pipeline := scriptPipeline("release", "true")
+	pipeline.Artifacts = []ArtifactConfig{{Name: "report", Paths: []string{"report.txt"}}}
+	pipeline.ArtifactRetention = &RetentionPolicy{Count: 1}
+	engine.CreatePipeline(pipeline)
+
+	held := runArtifactJob(t, engine, "release")
+	old := runArtifactJob(t, engine, "release")
+	latest := runArtifactJob(t, engine, "release")
+	if _, err := engine.SetLegalHold(held.ID, &LegalHold{Reason: "release 1.0", By: "admin"}); err != nil {
+		t.Fatalf("SetLegalHold() error = %v", err)
+	}
+
+	expired, err := engine.ExpireArtifacts(time.Now())
+	if err != nil {
+		t.Fatalf("ExpireArtifacts() error = %v", err)
+	}
+	if len(expired) != 1 || expired[0].JobID != old.ID {
+		t.Fatalf("expired = %+v, want only the artifact of job %s", expired, old.ID)
+	}
+	for _, id := range []string{held.ID, latest.ID} {
+		if artifacts, _ := engine.JobArtifacts(id); len(artifacts) != 1 {
+			t.Errorf("job %s has %d artifacts, want 1", id, len(artifacts))
+		}
+	}
+
+	usage, err := engine.ArtifactUsage()
+	if err != nil {
+		t.Fatalf("ArtifactUsage() error = %v", err)
+	}
+	if usage.Artifacts != 2 || usage.Size != 12 || usage.HeldSize != 6 {
+		t.Errorf("usage = %+v, want 2 artifacts of 12 bytes, 6 held", usage)
+	}
+	if len(usage.Pipelines) != 1 || usage.Pipelines[0].Jobs != 2 {
+		t.Errorf("pipelines = %+v, want release with 2 jobs", usage.Pipelines)
+	}
+}
+
+func TestExpireArtifacts_Days(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "log.txt"), []byte("log"), 0644)
+	os.WriteFile(filepath.Join(dir, "sbom.json"), []byte("{}"), 0644)
+	engine := artifactEngine(t, dir)
+	pipeline := scriptPipeline("nightly", "true")
+	pipeline.Artifacts = []ArtifactConfig{
+		{Name: "logs", Paths: []string{"log.txt"}, Retention: "1d"},
+		{Name: "sbom", Paths: []string{"sbom.json"}},
+	}
+	pipeline.ArtifactRetention = &RetentionPolicy{Days: 30}
+	engine.CreatePipeline(pipeline)
+	job := runArtifactJob(t, engine, "nightly")
+
+	expired, err := engine.ExpireArtifacts(time.Now().Add(48 * time.Hour))
+	if err != nil {
+		t.Fatalf("ExpireArtifacts() error = %v", err)
+	}
+	if len(expired) != 1 || expired[0].Name != "logs" {
+		t.Fatalf("expired = %+v, want logs only", expired)
+	}
+
+	// Releasing a hold makes the job's artifacts subject to retention again
+	engine.SetLegalHold(job.ID, &LegalHold{Reason: "audit"})
+	if expired, _ := engine.ExpireArtifacts(time.Now().Add(31 * 24 * time.Hour)); len(expired) != 0 {
+		t.Errorf("expired = %+v, want none while held", expired)
+	}
+	engine.SetLegalHold(job.ID, nil)
+	if expired, _ := engine.ExpireArtifacts(time.Now().Add(31 * 24 * time.Hour)); len(expired) != 1 {
+		t.Errorf("expired = %+v, want sbom after the hold is released", expired)
+	}
+}
+
+func TestExpireArtifacts_DefaultRetention(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "log.txt"), []byte("log"), 0644)
+	engine := artifactEngine(t, dir)
+	for _, id := range []string{"default", "own"} {
+		pipeline := scriptPipeline(id, "true")
+		pipeline.Artifacts = []ArtifactConfig{{Name: "logs", Paths: []string{"log.txt"}}}
+		if id == "own" {
+			pipeline.ArtifactRetention = &RetentionPolicy{Days: 30}
+		}
+		engine.CreatePipeline(pipeline)
+		runArtifactJob(t, engine, id)
+	}
+
+	later := time.Now().Add(10 * 24 * time.Hour)
+	if expired, _ := engine.ExpireArtifacts(later); len(expired) != 0 {
+		t.Errorf("expired = %+v, want none without a default retention", expired)
+	}
+	engine.SetArtifactRetention(&RetentionPolicy{Days: 7})
+	expired, err := engine.ExpireArtifacts(later)
+	if err != nil {
+		t.Fatalf("ExpireArtifacts() error = %v", err)
+	}
+	if len(expired) != 1 || expired[0].PipelineID != "default" {
+		t.Errorf("expired = %+v, want only the pipeline without its own retention", expired)
+	}
+}
@@ -0,0 +1,190 @@
+package core
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SaveArtifact copies the files matching patterns under root into
+// artifacts/<pipeline>/<job>/<name> and writes the artifact's metadata
+// next to them
+func (s *FileStore) SaveArtifact(artifact *Artifact, root string, patterns []string) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	dest := s.artifactDir(artifact)
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("failed to create artifact directory: %w", err)
+	}
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		for _, match := range matches {
+			rel, err := filepath.Rel(root, match)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return fmt.Errorf("pattern %q matches files outside the working directory", pattern)
+			}
+			if err := copyTree(match, filepath.Join(dest, rel), artifact); err != nil {
+				return err
+			}
+		}
+	}
+	if artifact.Files == 0 {
+		os.RemoveAll(dest)
+		return fmt.Errorf("no files match %s", strings.Join(patterns, ", "))
+	}
+
+	data, err := json.MarshalIndent(artifact, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode artifact: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return writeFileAtomic(dest+".json", data)
+}
+
+// ListArtifacts reads the metadata of every stored artifact
+func (s *FileStore) ListArtifacts() ([]*Artifact, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(s.dir, "artifacts", "*", "*", "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list artifacts: %w", err)
+	}
+
+	artifacts := make([]*Artifact, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		var artifact Artifact
+		if err := json.Unmarshal(data, &artifact); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+		artifacts = append(artifacts, &artifact)
+	}
+	return artifacts, nil
+}
+
+// DeleteArtifact removes an artifact's files and metadata
+func (s *FileStore) DeleteArtifact(artifact *Artifact) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := s.artifactDir(artifact)
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to delete artifact %s: %w", artifact.Name, err)
+	}
+	if err := os.Remove(dir + ".json"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete artifact %s: %w", artifact.Name, err)
+	}
+	// Remove the job directory once its last artifact is gone
+	os.Remove(filepath.Dir(dir))
+	return nil
+}
+
+// ArchiveArtifact writes an artifact's files to w as a gzipped tarball
+func (s *FileStore) ArchiveArtifact(artifact *Artifact, w io.Writer) error {
+	dir := s.artifactDir(artifact)
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive artifact %s: %w", artifact.Name, err)
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// artifactDir returns the directory an artifact's files are stored in
+func (s *FileStore) artifactDir(artifact *Artifact) string {
+	safe := func(name string) string {
+		return strings.ReplaceAll(name, string(filepath.Separator), "_")
+	}
+	return filepath.Join(s.dir, "artifacts", safe(artifact.PipelineID), safe(artifact.JobID), safe(artifact.Name))
+}
+
+// copyTree copies a file or directory, counting the files and bytes copied
+// into artifact. Symlinks are not followed.
+func copyTree(src, dest string, artifact *Artifact) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, 0755)
+		case !info.Mode().IsRegular():
+			return nil
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(out, in)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to copy %s: %w", path, err)
+		}
+		artifact.Files++
+		artifact.Size += n
+		return nil
+	})
+}
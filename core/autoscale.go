@@ -0,0 +1,242 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Scaling directions of a ScalingSignal
+const (
+	ScaleUp   = "up"
+	ScaleDown = "down"
+)
+
+// maxScalingSignals is how many recent scaling signals the engine keeps
+const maxScalingSignals = 50
+
+// AutoscalePolicy sets when the engine signals that runners should be
+// added or removed
+type AutoscalePolicy struct {
+	// QueueDepth is how many steps must be waiting for a runner to scale
+	// up. Defaults to 1.
+	QueueDepth int `json:"queueDepth"`
+	// IdleAfter is how long a runner must have run nothing to scale down.
+	// Defaults to 10 minutes.
+	IdleAfter time.Duration `json:"-"`
+	// Cooldown is how long to wait after a signal before sending another.
+	// Defaults to 5 minutes.
+	Cooldown time.Duration `json:"-"`
+	// MinRunners and MaxRunners bound the recommended runners. A zero
+	// MaxRunners is unbounded.
+	MinRunners int `json:"minRunners"`
+	MaxRunners int `json:"maxRunners,omitempty"`
+	// DryRun only records and reports the recommended capacity
+	DryRun bool `json:"dryRun"`
+}
+
+// ScalingSignal recommends changing the number of runners from Runners to
+// Desired
+type ScalingSignal struct {
+	Direction string `json:"direction"`
+	Runners   int    `json:"runners"`
+	Desired   int    `json:"desired"`
+	// Waiting is the number of steps waiting for a runner and Busy the
+	// number running
+	Waiting int `json:"waiting"`
+	Busy    int `json:"busy"`
+	// IdleRunners are the runners that can be removed when scaling down
+	IdleRunners []string  `json:"idleRunners,omitempty"`
+	Reason      string    `json:"reason"`
+	DryRun      bool      `json:"dryRun,omitempty"`
+	At          time.Time `json:"at"`
+	// Error is why the scaler failed to apply the signal
+	Error string `json:"error,omitempty"`
+}
+
+// ScalingStatus reports the autoscaling policy, what it recommends now and
+// the recent signals, newest first
+type ScalingStatus struct {
+	Enabled bool `json:"enabled"`
+	AutoscalePolicy
+	IdleAfterMs int64 `json:"idleAfterMs"`
+	CooldownMs  int64 `json:"cooldownMs"`
+	// Recommendation is the signal the engine would send now, ignoring the
+	// cooldown, or nil when the runners fit the load
+	Recommendation *ScalingSignal   `json:"recommendation,omitempty"`
+	CooldownUntil  *time.Time       `json:"cooldownUntil,omitempty"`
+	Signals        []*ScalingSignal `json:"signals"`
+}
+
+// Scaler applies scaling signals, such as by calling a webhook or resizing
+// a cloud instance group
+type Scaler interface {
+	Scale(ctx context.Context, signal ScalingSignal) error
+}
+
+// autoscaler tracks the signals sent under an autoscale policy
+type autoscaler struct {
+	policy     AutoscalePolicy
+	scaler     Scaler
+	lastSignal time.Time
+	signals    []*ScalingSignal
+}
+
+// WithAutoscaling turns on scaling signals: scale up when steps queue for
+// runners, and down when runners are idle. Signals are emitted as
+// runners.scale events and applied by scaler, unless the policy is a dry
+// run.
+func WithAutoscaling(policy AutoscalePolicy, scaler Scaler) Option {
+	return func(pe *PipelineEngine) {
+		if policy.QueueDepth <= 0 {
+			policy.QueueDepth = 1
+		}
+		if policy.IdleAfter <= 0 {
+			policy.IdleAfter = 10 * time.Minute
+		}
+		if policy.Cooldown <= 0 {
+			policy.Cooldown = 5 * time.Minute
+		}
+		pe.autoscaling = &autoscaler{policy: policy, scaler: scaler}
+	}
+}
+
+// WatchScaling checks whether runners should be added or removed every
+// interval until ctx is done. It returns right away without autoscaling.
+func (pe *PipelineEngine) WatchScaling(ctx context.Context, interval time.Duration) {
+	if pe.autoscaling == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pe.checkScaling(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recommendScaling returns the scaling signal for the current load, or nil
+// when the runners fit it. Callers must hold pe.mu.
+func (pe *PipelineEngine) recommendScaling(now time.Time) *ScalingSignal {
+	policy := pe.autoscaling.policy
+	signal := &ScalingSignal{Runners: len(pe.runners), Waiting: len(pe.queue), DryRun: policy.DryRun, At: now}
+	capacity, limited := 0, 0
+	var idle []string
+	for _, runner := range pe.runners {
+		signal.Busy += runner.busy
+		if runner.Capacity > 0 {
+			capacity += runner.Capacity
+			limited++
+		}
+		if runner.busy == 0 && now.Sub(runner.idleSince) >= policy.IdleAfter {
+			idle = append(idle, runner.Name)
+		}
+	}
+
+	switch {
+	case signal.Waiting >= policy.QueueDepth:
+		// Add enough runners of the average capacity for the waiting steps
+		perRunner := 1
+		if limited > 0 && capacity/limited > 1 {
+			perRunner = capacity / limited
+		}
+		signal.Direction = ScaleUp
+		signal.Desired = signal.Runners + (signal.Waiting+perRunner-1)/perRunner
+		if policy.MaxRunners > 0 && signal.Desired > policy.MaxRunners {
+			signal.Desired = policy.MaxRunners
+		}
+		signal.Reason = fmt.Sprintf("%d steps waiting for a runner", signal.Waiting)
+	case signal.Waiting == 0 && len(idle) > 0:
+		signal.Direction = ScaleDown
+		signal.Desired = signal.Runners - len(idle)
+		if signal.Desired < policy.MinRunners {
+			signal.Desired = policy.MinRunners
+		}
+		if remove := signal.Runners - signal.Desired; remove > 0 {
+			signal.IdleRunners = idle[:remove]
+		}
+		signal.Reason = fmt.Sprintf("%d runners idle for %s", len(idle), policy.IdleAfter)
+	}
+	if signal.Direction == "" || signal.Desired == signal.Runners {
+		return nil
+	}
+	return signal
+}
+
+// checkScaling emits and applies the recommended scaling signal, unless a
+// signal was sent less than the cooldown ago
+func (pe *PipelineEngine) checkScaling(ctx context.Context, now time.Time) {
+	pe.mu.Lock()
+	a := pe.autoscaling
+	signal := pe.recommendScaling(now)
+	if signal == nil || now.Before(a.lastSignal.Add(a.policy.Cooldown)) {
+		pe.mu.Unlock()
+		return
+	}
+	a.lastSignal = now
+	a.signals = append([]*ScalingSignal{signal}, a.signals...)
+	if len(a.signals) > maxScalingSignals {
+		a.signals = a.signals[:maxScalingSignals]
+	}
+	pe.mu.Unlock()
+
+	mode := ""
+	if signal.DryRun {
+		mode = " (dry run)"
+	}
+	pe.logger.Printf("Scaling %s from %d to %d runners%s: %s", signal.Direction, signal.Runners, signal.Desired, mode, signal.Reason)
+	if !signal.DryRun && a.scaler != nil {
+		if err := a.scaler.Scale(ctx, *signal); err != nil {
+			pe.logger.Printf("Failed to scale %s to %d runners: %v", signal.Direction, signal.Desired, err)
+			pe.mu.Lock()
+			signal.Error = err.Error()
+			pe.mu.Unlock()
+		}
+	}
+	pe.emitEvent(Event{
+		Type:      "runners.scale",
+		Timestamp: now,
+		Data: map[string]interface{}{
+			"direction":   signal.Direction,
+			"runners":     signal.Runners,
+			"desired":     signal.Desired,
+			"waiting":     signal.Waiting,
+			"busy":        signal.Busy,
+			"idleRunners": signal.IdleRunners,
+			"reason":      signal.Reason,
+			"dryRun":      signal.DryRun,
+		},
+	})
+}
+
+// ScalingStatus returns the autoscaling policy, its current recommendation
+// and the recent scaling signals
+func (pe *PipelineEngine) ScalingStatus() ScalingStatus {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	status := ScalingStatus{Signals: []*ScalingSignal{}}
+	a := pe.autoscaling
+	if a == nil {
+		return status
+	}
+	status.Enabled = true
+	status.AutoscalePolicy = a.policy
+	status.IdleAfterMs = a.policy.IdleAfter.Milliseconds()
+	status.CooldownMs = a.policy.Cooldown.Milliseconds()
+	now := time.Now()
+	status.Recommendation = pe.recommendScaling(now)
+	if until := a.lastSignal.Add(a.policy.Cooldown); !a.lastSignal.IsZero() && until.After(now) {
+		status.CooldownUntil = &until
+	}
+	for _, signal := range a.signals {
+		copied := *signal
+		status.Signals = append(status.Signals, &copied)
+	}
+	return status
+}
@@ -0,0 +1,95 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// recordingScaler records the signals it applies
+type recordingScaler struct {
+	signals []ScalingSignal
+	err     error
+}
+
+func (s *recordingScaler) Scale(ctx context.Context, signal ScalingSignal) error {
+	s.signals = append(s.signals, signal)
+	return s.err
+}
+
+func TestCheckScaling(t *testing.T) {
+	scaler := &recordingScaler{}
+	policy := AutoscalePolicy{IdleAfter: time.Minute, Cooldown: 5 * time.Minute, MinRunners: 1, MaxRunners: 4}
+	engine := newTestEngine(WithRunners(Runner{Name: "a", Capacity: 2}, Runner{Name: "b", Capacity: 2}), WithAutoscaling(policy, scaler))
+	ctx := context.Background()
+	now := time.Now()
+
+	engine.mu.Lock()
+	var waiters []*queueWaiter
+	for i := 0; i < 5; i++ {
+		w := &queueWaiter{project: "etl", since: now}
+		engine.enqueue(w)
+		waiters = append(waiters, w)
+	}
+	engine.mu.Unlock()
+
+	engine.checkScaling(ctx, now)
+	if len(scaler.signals) != 1 {
+		t.Fatalf("scaler got %d signals, want 1", len(scaler.signals))
+	}
+	if up := scaler.signals[0]; up.Direction != ScaleUp || up.Runners != 2 || up.Desired != 4 || up.Waiting != 5 {
+		t.Errorf("signal = %+v, want up from 2 to 4 runners capped by maxRunners", up)
+	}
+	engine.checkScaling(ctx, now.Add(time.Minute))
+	if len(scaler.signals) != 1 {
+		t.Errorf("scaler got %d signals during the cooldown, want 1", len(scaler.signals))
+	}
+
+	engine.mu.Lock()
+	for _, w := range waiters {
+		engine.dequeue(w, false)
+	}
+	engine.mu.Unlock()
+	engine.checkScaling(ctx, now.Add(10*time.Minute))
+	if len(scaler.signals) != 2 {
+		t.Fatalf("scaler got %d signals, want 2", len(scaler.signals))
+	}
+	if down := scaler.signals[1]; down.Direction != ScaleDown || down.Desired != 1 || len(down.IdleRunners) != 1 {
+		t.Errorf("signal = %+v, want down to minRunners 1 removing one idle runner", down)
+	}
+
+	scaler.err = errors.New("group not found")
+	engine.checkScaling(ctx, now.Add(20*time.Minute))
+	status := engine.ScalingStatus()
+	if !status.Enabled || len(status.Signals) != 3 || status.Signals[0].Error != "group not found" {
+		t.Errorf("ScalingStatus() = %+v, want three signals, the newest failed", status)
+	}
+}
+
+func TestCheckScaling_DryRun(t *testing.T) {
+	scaler := &recordingScaler{}
+	engine := newTestEngine(WithRunners(Runner{Name: "a", Capacity: 1}), WithAutoscaling(AutoscalePolicy{DryRun: true}, scaler))
+	events := engine.Subscribe(10)
+	defer events.Close()
+
+	engine.mu.Lock()
+	engine.enqueue(&queueWaiter{project: "etl", since: time.Now()})
+	engine.mu.Unlock()
+	engine.checkScaling(context.Background(), time.Now())
+
+	if len(scaler.signals) != 0 {
+		t.Errorf("scaler got %d signals in a dry run, want none", len(scaler.signals))
+	}
+	select {
+	case event := <-events.Events():
+		if event.Type != "runners.scale" || event.Data["dryRun"] != true || event.Data["desired"] != 2 {
+			t.Errorf("event = %+v, want a dry run runners.scale to 2 runners", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no runners.scale event")
+	}
+	if status := engine.ScalingStatus(); status.Recommendation == nil || status.Recommendation.Desired != 2 || status.CooldownUntil == nil {
+		t.Errorf("ScalingStatus() = %+v, want a recommendation of 2 runners in cooldown", status)
+	}
+}
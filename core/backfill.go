@@ -0,0 +1,382 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chip/conveyor/core/cron"
+)
+
+// Backfill statuses
+const (
+	BackfillRunning   = "running"
+	BackfillCompleted = "completed"
+	BackfillCancelled = "cancelled"
+)
+
+// maxBackfillItems bounds the commits or dates of a backfill
+const maxBackfillItems = 1000
+
+// maxBackfillConcurrency bounds the jobs of a backfill running at once
+const maxBackfillConcurrency = 16
+
+// ErrBackfillNotFound is returned for unknown backfills
+var ErrBackfillNotFound = errors.New("backfill not found")
+
+var backfillCounter uint64
+
+// BackfillRequest selects what a backfill runs a pipeline for: the commits
+// after From up to and including To, oldest first, as listed by git in the
+// engine's checkout, or the Commits given; or, for pipelines with a
+// schedule trigger, every time its cron fired from Since until Until.
+type BackfillRequest struct {
+	From    string   `json:"from,omitempty"`
+	To      string   `json:"to,omitempty"`
+	Commits []string `json:"commits,omitempty"`
+	// Repo and Branch are recorded on the revisions of commit backfills
+	Repo   string     `json:"repo,omitempty"`
+	Branch string     `json:"branch,omitempty"`
+	Since  *time.Time `json:"since,omitempty"`
+	Until  *time.Time `json:"until,omitempty"`
+	// Concurrency is how many of the backfill's jobs run at once.
+	// Defaults to 1, and is capped at 16.
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// BackfillItem is a commit or a schedule time of a backfill, with the job
+// that ran for it. Its status is pending until the job starts, and
+// cancelled when the backfill was cancelled first.
+type BackfillItem struct {
+	Commit string     `json:"commit,omitempty"`
+	At     *time.Time `json:"at,omitempty"`
+	JobID  string     `json:"jobId,omitempty"`
+	Status Status     `json:"status"`
+	Error  string     `json:"error,omitempty"`
+
+	revision *Revision
+}
+
+// Backfill runs a pipeline for a range of commits or schedule times
+type Backfill struct {
+	ID          string         `json:"id"`
+	PipelineID  string         `json:"pipelineId"`
+	Status      string         `json:"status"`
+	Concurrency int            `json:"concurrency"`
+	Items       []BackfillItem `json:"items"`
+	// Done counts the items whose job finished or that were cancelled
+	Done      int        `json:"done"`
+	CreatedBy string     `json:"createdBy,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// StartBackfill runs a pipeline for each commit or schedule time the
+// request selects, at most its concurrency at a time, in the background.
+// Jobs record the backfill as the "backfill" trigger value, and the
+// schedule time they stand in for as "scheduledAt".
+func (pe *PipelineEngine) StartBackfill(pipelineID string, req BackfillRequest, createdBy string) (*Backfill, error) {
+	if pe.readOnly {
+		return nil, ErrReadOnly
+	}
+	pipeline, err := pe.GetPipeline(pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	if req.Concurrency < 0 {
+		return nil, fmt.Errorf("concurrency must not be negative")
+	}
+	if req.Concurrency == 0 {
+		req.Concurrency = 1
+	}
+	if req.Concurrency > maxBackfillConcurrency {
+		req.Concurrency = maxBackfillConcurrency
+	}
+
+	var items []BackfillItem
+	switch {
+	case req.Since != nil || req.Until != nil:
+		items, err = pe.scheduleBackfill(pipeline, req)
+	case len(req.Commits) > 0:
+		if len(req.Commits) > maxBackfillItems {
+			return nil, fmt.Errorf("backfill of %d commits is over the limit of %d", len(req.Commits), maxBackfillItems)
+		}
+		for _, commit := range req.Commits {
+			items = append(items, BackfillItem{Commit: commit, revision: &Revision{Repo: req.Repo, Branch: req.Branch, Commit: commit}})
+		}
+	case req.To != "":
+		items, err = pe.commitBackfill(req)
+	default:
+		return nil, fmt.Errorf("backfill needs a commit range, commits, or since and until times")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("backfill range has nothing to run")
+	}
+	for i := range items {
+		items[i].Status = StatusPending
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	backfill := &Backfill{
+		ID:          fmt.Sprintf("backfill-%d-%d", time.Now().Unix(), atomic.AddUint64(&backfillCounter, 1)),
+		PipelineID:  pipelineID,
+		Status:      BackfillRunning,
+		Concurrency: req.Concurrency,
+		Items:       items,
+		CreatedBy:   createdBy,
+		CreatedAt:   time.Now(),
+		cancel:      cancel,
+	}
+	pe.mu.Lock()
+	if pe.backfills == nil {
+		pe.backfills = make(map[string]*Backfill)
+	}
+	pe.backfills[backfill.ID] = backfill
+	snapshot := backfill.snapshot()
+	pe.mu.Unlock()
+
+	pe.logger.Printf("Started backfill %s of pipeline %s with %d runs", backfill.ID, pipelineID, len(items))
+	go pe.runBackfill(ctx, backfill)
+	return snapshot, nil
+}
+
+// commitBackfill lists the commits of a range, oldest first
+func (pe *PipelineEngine) commitBackfill(req BackfillRequest) ([]BackfillItem, error) {
+	wd, ok := pe.executor.(workingDir)
+	if !ok || wd.WorkingDir() == "" || DetectRevision(wd.WorkingDir()).IsZero() {
+		return nil, fmt.Errorf("no git checkout to list the commits of the range from; pass the commits instead")
+	}
+	checkout := DetectRevision(wd.WorkingDir())
+	spec := req.To
+	if req.From != "" {
+		spec = req.From + ".." + req.To
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), revisionTimeout)
+	defer cancel()
+	// The range is listed between the commits the refs resolve to, so refs
+	// never reach git log, where one starting with - would be an option
+	to, err := resolveCommit(ctx, wd.WorkingDir(), req.To)
+	if err != nil {
+		return nil, err
+	}
+	rangeSpec := to
+	if req.From != "" {
+		from, err := resolveCommit(ctx, wd.WorkingDir(), req.From)
+		if err != nil {
+			return nil, err
+		}
+		rangeSpec = from + ".." + to
+	}
+	cmd := exec.CommandContext(ctx, "git", "log", "--reverse", "--format=%H%x09%an <%ae>%x09%s", rangeSpec, "--")
+	cmd.Dir = wd.WorkingDir()
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the commits of %s: %v", spec, err)
+	}
+
+	var items []BackfillItem
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if len(items) == maxBackfillItems {
+			return nil, fmt.Errorf("range %s has more than %d commits", spec, maxBackfillItems)
+		}
+		rev := Revision{Repo: req.Repo, Branch: req.Branch, Commit: fields[0], Author: fields[1], Message: fields[2]}
+		if rev.Repo == "" {
+			rev.Repo = checkout.Repo
+		}
+		items = append(items, BackfillItem{Commit: rev.Commit, revision: &rev})
+	}
+	return items, nil
+}
+
+// resolveCommit returns the commit a ref names in a checkout
+func resolveCommit(ctx context.Context, dir, ref string) (string, error) {
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return "", fmt.Errorf("invalid ref %q", ref)
+	}
+	cmd := exec.CommandContext(ctx, "git", "rev-parse", "--verify", "--quiet", "--end-of-options", ref+"^{commit}")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("unknown commit %q", ref)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// scheduleBackfill lists the times the first schedule trigger of a
+// pipeline fired in a range
+func (pe *PipelineEngine) scheduleBackfill(pipeline *Pipeline, req BackfillRequest) ([]BackfillItem, error) {
+	if req.Since == nil || req.Until == nil || !req.Since.Before(*req.Until) {
+		return nil, fmt.Errorf("schedule backfills need a since time before their until time")
+	}
+	for _, trigger := range pipeline.Triggers {
+		if trigger.Type != TriggerSchedule || trigger.Cron == "" {
+			continue
+		}
+		schedule, err := cron.Parse(trigger.Cron)
+		if err != nil {
+			return nil, err
+		}
+		var items []BackfillItem
+		at := schedule.Next(req.Since.Add(-time.Nanosecond).In(pe.scheduleZone(trigger.Timezone)))
+		for ; !at.After(*req.Until); at = schedule.Next(at) {
+			if len(items) == maxBackfillItems {
+				return nil, fmt.Errorf("schedule %q fires more than %d times in the range", trigger.Cron, maxBackfillItems)
+			}
+			fired := at.UTC()
+			items = append(items, BackfillItem{At: &fired})
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("pipeline %s has no schedule trigger to backfill", pipeline.ID)
+}
+
+// runBackfill starts the jobs of a backfill in order, at most its
+// concurrency at a time, until they ran or ctx is cancelled
+func (pe *PipelineEngine) runBackfill(ctx context.Context, backfill *Backfill) {
+	slots := make(chan struct{}, backfill.Concurrency)
+	var wg sync.WaitGroup
+	for i := range backfill.Items {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			pe.runBackfillItem(backfill, i)
+		}(i)
+	}
+	wg.Wait()
+
+	pe.mu.Lock()
+	now := time.Now()
+	backfill.EndedAt = &now
+	if backfill.Status == BackfillRunning {
+		backfill.Status = BackfillCompleted
+	}
+	for i := range backfill.Items {
+		if backfill.Items[i].Status == StatusPending {
+			backfill.Items[i].Status = StatusCancelled
+			backfill.Done++
+		}
+	}
+	backfill.cancel()
+	pe.mu.Unlock()
+	pe.logger.Printf("Backfill %s of pipeline %s %s", backfill.ID, backfill.PipelineID, backfill.Status)
+}
+
+// runBackfillItem runs the job of a backfill item and waits for it
+func (pe *PipelineEngine) runBackfillItem(backfill *Backfill, i int) {
+	pe.mu.RLock()
+	item := backfill.Items[i]
+	pe.mu.RUnlock()
+
+	values := map[string]string{"backfill": backfill.ID}
+	opts := []RunOption{WithSource(TriggerBackfill)}
+	if item.revision != nil {
+		opts = append(opts, WithRevision(*item.revision))
+		values["commit"] = item.Commit
+		if item.revision.Branch != "" {
+			values["branch"] = item.revision.Branch
+		}
+	}
+	if item.At != nil {
+		values["scheduledAt"] = item.At.Format(time.RFC3339)
+	}
+	opts = append(opts, WithTrigger(values))
+	if backfill.CreatedBy != "" {
+		opts = append(opts, WithTriggeredBy(backfill.CreatedBy))
+	}
+
+	job, err := pe.Start(context.Background(), backfill.PipelineID, opts...)
+	if err != nil {
+		pe.mu.Lock()
+		backfill.Items[i].Status = StatusFailed
+		backfill.Items[i].Error = err.Error()
+		backfill.Done++
+		pe.mu.Unlock()
+		return
+	}
+	pe.mu.Lock()
+	backfill.Items[i].JobID = job.ID
+	backfill.Items[i].Status = StatusRunning
+	pe.mu.Unlock()
+
+	status := StatusInterrupted
+	if done, ok, err := pe.WaitJob(context.Background(), job.ID, func(job *Job) bool { return job.Status.IsTerminal() }); err == nil && ok {
+		status = done.Status
+	}
+	pe.mu.Lock()
+	backfill.Items[i].Status = status
+	backfill.Done++
+	pe.mu.Unlock()
+}
+
+// CancelBackfill stops a backfill from starting more jobs. Its running
+// jobs finish, and its items that didn't start are cancelled.
+func (pe *PipelineEngine) CancelBackfill(pipelineID, id string) (*Backfill, error) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	backfill, ok := pe.backfills[id]
+	if !ok || backfill.PipelineID != pipelineID {
+		return nil, fmt.Errorf("%w: %s", ErrBackfillNotFound, id)
+	}
+	if backfill.Status == BackfillRunning {
+		backfill.Status = BackfillCancelled
+		backfill.cancel()
+	}
+	return backfill.snapshot(), nil
+}
+
+// GetBackfill returns the progress of a backfill of a pipeline
+func (pe *PipelineEngine) GetBackfill(pipelineID, id string) (*Backfill, error) {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	backfill, ok := pe.backfills[id]
+	if !ok || backfill.PipelineID != pipelineID {
+		return nil, fmt.Errorf("%w: %s", ErrBackfillNotFound, id)
+	}
+	return backfill.snapshot(), nil
+}
+
+// Backfills returns the backfills of a pipeline since the server started,
+// newest first
+func (pe *PipelineEngine) Backfills(pipelineID string) []*Backfill {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	backfills := make([]*Backfill, 0)
+	for _, backfill := range pe.backfills {
+		if backfill.PipelineID == pipelineID {
+			backfills = append(backfills, backfill.snapshot())
+		}
+	}
+	sort.Slice(backfills, func(i, j int) bool { return backfills[i].CreatedAt.After(backfills[j].CreatedAt) })
+	return backfills
+}
+
+// snapshot returns a copy of a backfill. Callers must hold pe.mu.
+func (b *Backfill) snapshot() *Backfill {
+	copied := *b
+	copied.Items = append([]BackfillItem(nil), b.Items...)
+	return &copied
+}
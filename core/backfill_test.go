@@ -0,0 +1,187 @@
+package core
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForBackfill waits until a backfill ended
+func waitForBackfill(t *testing.T, engine *PipelineEngine, pipelineID, id string) *Backfill {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		backfill, err := engine.GetBackfill(pipelineID, id)
+		if err != nil {
+			t.Fatalf("GetBackfill() error = %v", err)
+		}
+		if backfill.EndedAt != nil {
+			return backfill
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("backfill %s did not end", id)
+	return nil
+}
+
+func TestBackfill_Commits(t *testing.T) {
+	executor := &recordingExecutor{}
+	engine := newTestEngine(WithExecutor(executor))
+	engine.CreatePipeline(scriptPipeline("build", "make"))
+
+	backfill, err := engine.StartBackfill("build", BackfillRequest{Commits: []string{"a1", "b2", "c3"}, Branch: "main", Concurrency: 2}, "alice")
+	if err != nil {
+		t.Fatalf("StartBackfill() error = %v", err)
+	}
+	backfill = waitForBackfill(t, engine, "build", backfill.ID)
+	if backfill.Status != BackfillCompleted || backfill.Done != 3 {
+		t.Fatalf("backfill = %+v, want three runs completed", backfill)
+	}
+	if executor.peak > 2 {
+		t.Errorf("peak concurrent jobs = %d, want at most 2", executor.peak)
+	}
+	for i, item := range backfill.Items {
+		if item.Status != StatusSuccess || item.JobID == "" {
+			t.Fatalf("item %d = %+v, want a successful job", i, item)
+		}
+		job, _ := engine.JobSnapshot(item.JobID)
+		if job.Revision == nil || job.Revision.Commit != item.Commit || job.Revision.Branch != "main" {
+			t.Errorf("job revision = %+v, want commit %s on main", job.Revision, item.Commit)
+		}
+		if triggerValues(job.Metadata)["backfill"] != backfill.ID || job.Metadata["source"] != TriggerBackfill || job.Metadata["triggeredBy"] != "alice" {
+			t.Errorf("job metadata = %v, want the backfill recorded", job.Metadata)
+		}
+	}
+	if backfills := engine.Backfills("build"); len(backfills) != 1 {
+		t.Errorf("Backfills() = %+v, want one", backfills)
+	}
+
+	capped, err := engine.StartBackfill("build", BackfillRequest{Commits: []string{"d4"}, Concurrency: 1000}, "")
+	if err != nil || capped.Concurrency != maxBackfillConcurrency {
+		t.Errorf("StartBackfill() = %+v, %v, want the concurrency capped at %d", capped, err, maxBackfillConcurrency)
+	}
+	waitForBackfill(t, engine, "build", capped.ID)
+}
+
+func TestBackfill_CommitRange(t *testing.T) {
+	repo := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		cmd.Env = append(cmd.Env, "GIT_AUTHOR_NAME=Dev", "GIT_AUTHOR_EMAIL=dev@example.com", "GIT_COMMITTER_NAME=Dev", "GIT_COMMITTER_EMAIL=dev@example.com", "HOME="+repo)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q")
+	var commits []string
+	for _, message := range []string{"first", "second", "third", "fourth"} {
+		git("commit", "-q", "--allow-empty", "-m", message)
+		commits = append(commits, git("rev-parse", "HEAD"))
+	}
+
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: repo}))
+	engine.CreatePipeline(scriptPipeline("build", "true"))
+	backfill, err := engine.StartBackfill("build", BackfillRequest{From: commits[0], To: commits[3]}, "")
+	if err != nil {
+		t.Fatalf("StartBackfill() error = %v", err)
+	}
+	if len(backfill.Items) != 3 || backfill.Items[0].Commit != commits[1] || backfill.Items[2].Commit != commits[3] {
+		t.Fatalf("items = %+v, want the three commits after the first, oldest first", backfill.Items)
+	}
+	backfill = waitForBackfill(t, engine, "build", backfill.ID)
+	job, _ := engine.JobSnapshot(backfill.Items[0].JobID)
+	if job.Revision == nil || job.Revision.Message != "second" || job.Revision.Author != "Dev <dev@example.com>" {
+		t.Errorf("job revision = %+v, want the commit's author and message", job.Revision)
+	}
+
+	// Refs are resolved to commits, and never passed to git as options
+	for _, req := range []BackfillRequest{
+		{To: "--output=" + repo + "/written"},
+		{From: "-p", To: commits[3]},
+		{To: "missing"},
+	} {
+		if _, err := engine.StartBackfill("build", req, ""); err == nil {
+			t.Errorf("StartBackfill(%+v) error = nil, want error", req)
+		}
+	}
+	if _, err := os.Stat(repo + "/written"); err == nil {
+		t.Error("a ref was passed to git as an option")
+	}
+
+	if _, err := newTestEngine().StartBackfill("build", BackfillRequest{To: "HEAD"}, ""); err == nil {
+		t.Error("StartBackfill() of a range without a checkout error = nil, want error")
+	}
+}
+
+func TestBackfill_ScheduleTimes(t *testing.T) {
+	engine := newTestEngine(WithExecutor(&recordingExecutor{}))
+	pipeline := scriptPipeline("nightly", "make")
+	pipeline.Triggers = []Trigger{{Type: TriggerSchedule, Cron: "0 2 * * *", Timezone: "UTC"}}
+	engine.CreatePipeline(pipeline)
+
+	since := time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)
+	until := time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC)
+	backfill, err := engine.StartBackfill("nightly", BackfillRequest{Since: &since, Until: &until}, "")
+	if err != nil {
+		t.Fatalf("StartBackfill() error = %v", err)
+	}
+	var times []string
+	for _, item := range backfill.Items {
+		times = append(times, item.At.Format("Jan 2 15:04"))
+	}
+	if strings.Join(times, ", ") != "Jan 1 02:00, Jan 2 02:00, Jan 3 02:00" {
+		t.Errorf("times = %v, want the three nights from since", times)
+	}
+	backfill = waitForBackfill(t, engine, "nightly", backfill.ID)
+	job, _ := engine.JobSnapshot(backfill.Items[1].JobID)
+	if triggerValues(job.Metadata)["scheduledAt"] != "2024-01-02T02:00:00Z" {
+		t.Errorf("job trigger = %v, want the schedule time", job.Metadata["trigger"])
+	}
+
+	if _, err := engine.StartBackfill("nightly", BackfillRequest{Since: &until, Until: &since}, ""); err == nil {
+		t.Error("StartBackfill() with since after until error = nil, want error")
+	}
+}
+
+func TestBackfill_Cancel(t *testing.T) {
+	executor := &recordingExecutor{release: make(chan struct{})}
+	engine := newTestEngine(WithExecutor(executor))
+	engine.CreatePipeline(scriptPipeline("build", "make"))
+
+	backfill, err := engine.StartBackfill("build", BackfillRequest{Commits: []string{"a1", "b2", "c3"}}, "")
+	if err != nil {
+		t.Fatalf("StartBackfill() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		current, _ := engine.GetBackfill("build", backfill.ID)
+		if current.Items[0].Status == StatusRunning {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("first run did not start: %+v", current.Items)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := engine.CancelBackfill("build", backfill.ID); err != nil {
+		t.Fatalf("CancelBackfill() error = %v", err)
+	}
+	close(executor.release)
+	backfill = waitForBackfill(t, engine, "build", backfill.ID)
+	if backfill.Status != BackfillCancelled || backfill.Done != 3 {
+		t.Errorf("backfill = %+v, want cancelled with every item done", backfill)
+	}
+	if backfill.Items[0].Status != StatusSuccess || backfill.Items[1].Status != StatusCancelled || backfill.Items[2].JobID != "" {
+		t.Errorf("items = %+v, want the running job finished and the rest cancelled", backfill.Items)
+	}
+
+	if _, err := engine.CancelBackfill("other", backfill.ID); err == nil {
+		t.Error("CancelBackfill() of another pipeline error = nil, want not found")
+	}
+}
@@ -0,0 +1,161 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// FailureBudget is the failure class of jobs and steps stopped for
+// exceeding their pipeline's budget
+const FailureBudget = "budget"
+
+// ErrBudgetExceeded is wrapped by the errors of runs, retries and steps a
+// pipeline's budget doesn't allow
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// budgetWindow is the period MaxRetriesPerDay counts retries over
+const budgetWindow = 24 * time.Hour
+
+// Budget limits what a pipeline's jobs may use. Zero values are unlimited,
+// and admins can run jobs outside the budget with WithBudgetOverride.
+type Budget struct {
+	// MaxDuration is the longest a job may run, such as "2h", including
+	// the time it waits for its concurrency group
+	MaxDuration string `json:"maxDuration,omitempty"`
+	// MaxSteps is the most steps a job may run, counting the steps of
+	// speculative stages that run again but not skipped or cached ones
+	MaxSteps int `json:"maxSteps,omitempty"`
+	// MaxRetriesPerDay is the most retries of the pipeline's jobs in any
+	// 24 hours
+	MaxRetriesPerDay int `json:"maxRetriesPerDay,omitempty"`
+}
+
+// ValidateBudget checks the limits of a pipeline's budget
+func ValidateBudget(budget *Budget) error {
+	if budget == nil {
+		return nil
+	}
+	if budget.MaxDuration != "" {
+		d, err := time.ParseDuration(budget.MaxDuration)
+		if err != nil {
+			return fmt.Errorf("invalid max duration %q", budget.MaxDuration)
+		}
+		if d < time.Second {
+			return fmt.Errorf("max duration %q must be at least 1s", budget.MaxDuration)
+		}
+	}
+	if budget.MaxSteps < 0 {
+		return fmt.Errorf("max steps must not be negative")
+	}
+	if budget.MaxRetriesPerDay < 0 {
+		return fmt.Errorf("max retries per day must not be negative")
+	}
+	return nil
+}
+
+// WithBudgetOverride runs the job outside its pipeline's budget. by is the
+// admin who allowed it, recorded on the job.
+func WithBudgetOverride(by string) RunOption {
+	return func(rc *runConfig) {
+		rc.budgetOverride = by
+	}
+}
+
+// budgetError describes a limit of a budget that was exceeded
+func budgetError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrBudgetExceeded, fmt.Sprintf(format, args...))
+}
+
+// jobBudget returns the budget a job runs within, or nil when it has none
+// or it was overridden. Callers must hold pe.mu.
+func jobBudget(pipeline *Pipeline, job *Job) *Budget {
+	if _, overridden := job.Metadata["budgetOverride"]; overridden {
+		return nil
+	}
+	return pipeline.Budget
+}
+
+// checkRetryBudget returns an error once the pipeline's jobs were retried
+// as often in the last 24 hours as its budget allows. Callers must hold
+// pe.mu.
+func (pe *PipelineEngine) checkRetryBudget(pipeline *Pipeline, metadata map[string]interface{}) error {
+	if _, overridden := metadata["budgetOverride"]; overridden || pipeline.Budget == nil || pipeline.Budget.MaxRetriesPerDay == 0 {
+		return nil
+	}
+	since := time.Now().Add(-budgetWindow)
+	retries := 0
+	for _, job := range pe.jobs {
+		if _, retry := job.Metadata["retryOf"]; retry && job.PipelineID == pipeline.ID && job.QueuedAt.After(since) {
+			retries++
+		}
+	}
+	if retries >= pipeline.Budget.MaxRetriesPerDay {
+		return budgetError("pipeline %s was retried %d times in the last 24 hours, its maximum", pipeline.ID, retries)
+	}
+	return nil
+}
+
+// checkStepBudget returns an error once a job started more steps than its
+// budget allows, and records it as the reason the job failed
+func (pe *PipelineEngine) checkStepBudget(pipeline *Pipeline, job *Job) error {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	budget := jobBudget(pipeline, job)
+	if budget == nil || budget.MaxSteps == 0 {
+		return nil
+	}
+	started := 0
+	for _, step := range job.Steps {
+		if step.Status != StatusSkipped && step.Status != StatusCached {
+			started++
+		}
+	}
+	if started <= budget.MaxSteps {
+		return nil
+	}
+	err := budgetError("the job would run more than its maximum of %d steps", budget.MaxSteps)
+	if job.BudgetExceeded == "" {
+		job.BudgetExceeded = err.Error()
+	}
+	return err
+}
+
+// watchDuration fails a job once it runs longer than its budget allows.
+// The returned func stops watching.
+func (pe *PipelineEngine) watchDuration(pipeline *Pipeline, job *Job) func() {
+	pe.mu.RLock()
+	budget := jobBudget(pipeline, job)
+	started := job.StartedAt
+	pe.mu.RUnlock()
+
+	if budget == nil || budget.MaxDuration == "" {
+		return func() {}
+	}
+	limit, err := time.ParseDuration(budget.MaxDuration)
+	if err != nil {
+		return func() {}
+	}
+	timer := time.AfterFunc(time.Until(started.Add(limit)), func() {
+		pe.exceedBudget(job, budgetError("the job ran longer than its maximum duration of %s", budget.MaxDuration))
+	})
+	return func() { timer.Stop() }
+}
+
+// exceedBudget stops a running job that exceeded its budget, which then
+// fails with the error as its reason
+func (pe *PipelineEngine) exceedBudget(job *Job, err error) {
+	pe.mu.Lock()
+	if job.Status.IsTerminal() || job.BudgetExceeded != "" {
+		pe.mu.Unlock()
+		return
+	}
+	job.BudgetExceeded = err.Error()
+	if cancel, ok := pe.cancels[job.ID]; ok {
+		cancel()
+	}
+	pe.mu.Unlock()
+
+	pe.logJob(job, "error", "", err.Error())
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBudget_MaxDuration(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	pipeline := scriptPipeline("slow", "sleep 5", "touch after")
+	pipeline.Budget = &Budget{MaxDuration: "1s"}
+	engine.CreatePipeline(pipeline)
+
+	start := time.Now()
+	job, err := engine.Run(context.Background(), "slow")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("the job took %s to stop, want it stopped after 1s", elapsed)
+	}
+	if job.Status != StatusFailed || job.FailureClass != FailureBudget {
+		t.Fatalf("job = %s (%s), want failed with class %s", job.Status, job.FailureClass, FailureBudget)
+	}
+	if !strings.Contains(job.BudgetExceeded, "maximum duration of 1s") {
+		t.Errorf("BudgetExceeded = %q, want the maximum duration", job.BudgetExceeded)
+	}
+	if len(job.Steps) != 2 || job.Steps[0].Status != StatusCancelled || job.Steps[1].Status != StatusCancelled {
+		t.Errorf("steps = %+v, want both cancelled", job.Steps)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "after")); err == nil {
+		t.Error("a step ran after the job exceeded its budget")
+	}
+}
+
+func TestBudget_MaxSteps(t *testing.T) {
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: t.TempDir()}))
+	pipeline := scriptPipeline("steps", "true", "true", "true")
+	pipeline.Budget = &Budget{MaxSteps: 2}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "steps")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusFailed || job.FailureClass != FailureBudget {
+		t.Fatalf("job = %s (%s), want failed with class %s", job.Status, job.FailureClass, FailureBudget)
+	}
+	if len(job.Steps) != 3 || job.Steps[1].Status != StatusSuccess {
+		t.Fatalf("steps = %+v, want the first 2 to run", job.Steps)
+	}
+	if step := job.Steps[2]; step.Status != StatusFailed || step.FailureClass != FailureBudget {
+		t.Errorf("step 3 = %s (%s), want failed with class %s", step.Status, step.FailureClass, FailureBudget)
+	}
+	if !strings.Contains(job.BudgetExceeded, "maximum of 2 steps") {
+		t.Errorf("BudgetExceeded = %q, want the maximum steps", job.BudgetExceeded)
+	}
+
+	job, err = engine.Run(context.Background(), "steps", WithBudgetOverride("admin"))
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess || job.Metadata["budgetOverride"] != "admin" {
+		t.Errorf("job = %s with metadata %v, want an overridden success", job.Status, job.Metadata)
+	}
+}
+
+func TestBudget_MaxRetriesPerDay(t *testing.T) {
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: t.TempDir()}))
+	pipeline := scriptPipeline("flaky", "false")
+	pipeline.Budget = &Budget{MaxRetriesPerDay: 1}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "flaky")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	retry, err := engine.Retry(context.Background(), "flaky", job.ID)
+	if err != nil {
+		t.Fatalf("Retry() error = %v", err)
+	}
+	engine.WaitJob(context.Background(), retry.ID, func(job *Job) bool { return job.Status.IsTerminal() })
+	if _, err := engine.Retry(context.Background(), "flaky", job.ID); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("second Retry() error = %v, want the budget exceeded", err)
+	}
+	retry, err = engine.Retry(context.Background(), "flaky", job.ID, WithBudgetOverride("admin"))
+	if err != nil {
+		t.Fatalf("overridden Retry() error = %v", err)
+	}
+	engine.WaitJob(context.Background(), retry.ID, func(job *Job) bool { return job.Status.IsTerminal() })
+}
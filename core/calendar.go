@@ -0,0 +1,289 @@
+package core
+
+import (
+	"sort"
+	"time"
+
+	"github.com/chip/conveyor/core/cron"
+)
+
+// maxCalendarRuns bounds the runs a calendar forecasts for one schedule
+// trigger
+const maxCalendarRuns = 500
+
+// durationSamples is how many recent successful jobs a pipeline's run
+// duration is estimated from
+const durationSamples = 10
+
+// ScheduledRun is a forecast run of a schedule trigger. A run due during a
+// maintenance window starts when the window closes, and a run whose
+// concurrency group is busy waits for the group's running job; a newer run
+// then supersedes it, as it would a pending job.
+type ScheduledRun struct {
+	PipelineID string    `json:"pipelineId"`
+	Cron       string    `json:"cron"`
+	Timezone   string    `json:"timezone,omitempty"`
+	At         time.Time `json:"at"`
+	// StartsAt is when the run is expected to start, after maintenance
+	// windows and its concurrency group
+	StartsAt time.Time `json:"startsAt"`
+	// EstimatedDurationMs is the median duration of the pipeline's recent
+	// successful jobs, omitted without any
+	EstimatedDurationMs int64  `json:"estimatedDurationMs,omitempty"`
+	HeldBy              string `json:"heldBy,omitempty"`
+	ConcurrencyGroup    string `json:"concurrencyGroup,omitempty"`
+	Superseded          bool   `json:"superseded,omitempty"`
+	// Overlaps are the other pipelines with a run expected to be running at
+	// the same time
+	Overlaps []string `json:"overlaps,omitempty"`
+}
+
+// RunDensity counts the jobs that started in one bucket of a calendar
+type RunDensity struct {
+	Start  time.Time `json:"start"`
+	Jobs   int       `json:"jobs"`
+	Failed int       `json:"failed,omitempty"`
+}
+
+// Calendar forecasts the scheduled runs between From and To and counts the
+// jobs that already started in that range, per hour for ranges of up to a
+// week and per day beyond
+type Calendar struct {
+	From    time.Time      `json:"from"`
+	To      time.Time      `json:"to"`
+	Runs    []ScheduledRun `json:"runs"`
+	Bucket  string         `json:"bucket"`
+	Density []RunDensity   `json:"density"`
+	// Truncated is set when a schedule fires more often than a calendar
+	// lists
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ScheduleCalendar returns the calendar of the schedule triggers of a
+// pipeline or, when pipelineID is empty, of every pipeline
+func (pe *PipelineEngine) ScheduleCalendar(pipelineID string, from, to time.Time) *Calendar {
+	from, to = from.UTC(), to.UTC()
+	calendar := &Calendar{From: from, To: to, Runs: []ScheduledRun{}, Bucket: "hour", Density: []RunDensity{}}
+	bucket := time.Hour
+	if to.Sub(from) > 7*24*time.Hour {
+		calendar.Bucket, bucket = "day", 24*time.Hour
+	}
+
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	durations := make(map[string]time.Duration)
+	cancels := make(map[string]bool)
+	for id, pipeline := range pe.pipelines {
+		if pipelineID != "" && id != pipelineID {
+			continue
+		}
+		cancels[id] = pipeline.CancelInProgress
+		for _, trigger := range pipeline.Triggers {
+			if trigger.Type != TriggerSchedule || trigger.Cron == "" {
+				continue
+			}
+			schedule, err := cron.Parse(trigger.Cron)
+			if err != nil {
+				continue
+			}
+			if _, ok := durations[id]; !ok {
+				durations[id] = pe.estimatedDuration(id)
+			}
+			group := resolveGroup(pipeline, map[string]string{"schedule": trigger.Cron}, nil)
+			loc := pe.scheduleZone(trigger.Timezone)
+			count := 0
+			for at := schedule.Next(from.Add(-time.Nanosecond).In(loc)); !at.IsZero() && at.Before(to); at = schedule.Next(at) {
+				if count == maxCalendarRuns {
+					calendar.Truncated = true
+					break
+				}
+				count++
+				run := ScheduledRun{
+					PipelineID:          id,
+					Cron:                trigger.Cron,
+					Timezone:            trigger.Timezone,
+					At:                  at.UTC(),
+					StartsAt:            at.UTC(),
+					EstimatedDurationMs: durations[id].Milliseconds(),
+					ConcurrencyGroup:    group,
+				}
+				if period := pe.heldUntil(id, run.At); period != nil {
+					run.HeldBy, run.StartsAt = period.WindowID, period.End
+				}
+				calendar.Runs = append(calendar.Runs, run)
+			}
+		}
+	}
+	sort.SliceStable(calendar.Runs, func(i, j int) bool {
+		return calendar.Runs[i].StartsAt.Before(calendar.Runs[j].StartsAt)
+	})
+	queueRuns(calendar.Runs, cancels)
+	markOverlaps(calendar.Runs)
+
+	density := make(map[time.Time]*RunDensity)
+	for _, job := range pe.jobs {
+		if pipelineID != "" && job.PipelineID != pipelineID {
+			continue
+		}
+		started := job.StartedAt
+		if started.IsZero() {
+			started = job.QueuedAt
+		}
+		if started.Before(from) || !started.Before(to) {
+			continue
+		}
+		start := started.UTC().Truncate(bucket)
+		d, ok := density[start]
+		if !ok {
+			d = &RunDensity{Start: start}
+			density[start] = d
+		}
+		d.Jobs++
+		if job.Status == StatusFailed {
+			d.Failed++
+		}
+	}
+	for _, d := range density {
+		calendar.Density = append(calendar.Density, *d)
+	}
+	sort.Slice(calendar.Density, func(i, j int) bool {
+		return calendar.Density[i].Start.Before(calendar.Density[j].Start)
+	})
+	return calendar
+}
+
+// estimatedDuration returns the median duration of a pipeline's most recent
+// successful jobs, or zero without any. Callers must hold pe.mu.
+func (pe *PipelineEngine) estimatedDuration(pipelineID string) time.Duration {
+	var jobs []*Job
+	for _, job := range pe.jobs {
+		if job.PipelineID == pipelineID && job.Status == StatusSuccess && !job.StartedAt.IsZero() && job.EndedAt.After(job.StartedAt) {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].StartedAt.After(jobs[j].StartedAt)
+	})
+	if len(jobs) > durationSamples {
+		jobs = jobs[:durationSamples]
+	}
+	if len(jobs) == 0 {
+		return 0
+	}
+	durations := make([]time.Duration, len(jobs))
+	for i, job := range jobs {
+		durations[i] = job.EndedAt.Sub(job.StartedAt)
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[len(durations)/2]
+}
+
+// heldUntil returns the maintenance period a run due at is held by, ending
+// when the run can start, or nil. Back-to-back periods hold it until the
+// last one ends. Callers must hold pe.mu.
+func (pe *PipelineEngine) heldUntil(pipelineID string, at time.Time) *MaintenancePeriod {
+	var held *MaintenancePeriod
+	for i := 0; i < maxMaintenancePeriods; i++ {
+		period := pe.activeMaintenance(pipelineID, at)
+		if period == nil {
+			break
+		}
+		if held == nil {
+			held = period
+		} else {
+			held.End = period.End
+		}
+		at = period.End
+	}
+	return held
+}
+
+// queueRuns delays runs, sorted by StartsAt, that start while their
+// concurrency group is busy until the group frees up, and marks the
+// pending runs a newer run supersedes. With cancelInProgress a newer run
+// supersedes the running one instead. Runs without an estimated duration
+// never keep their group busy.
+func queueRuns(runs []ScheduledRun, cancelInProgress map[string]bool) {
+	type groupState struct {
+		running, pending int
+		busyUntil        time.Time
+	}
+	groups := make(map[string]*groupState)
+	finish := func(g *groupState) {
+		run := &runs[g.pending]
+		run.StartsAt = g.busyUntil
+		g.running, g.pending = g.pending, -1
+		g.busyUntil = run.StartsAt.Add(time.Duration(run.EstimatedDurationMs) * time.Millisecond)
+	}
+
+	for i := range runs {
+		run := &runs[i]
+		if run.ConcurrencyGroup == "" {
+			continue
+		}
+		g, ok := groups[run.ConcurrencyGroup]
+		if !ok {
+			g = &groupState{running: -1, pending: -1}
+			groups[run.ConcurrencyGroup] = g
+		}
+		for g.pending >= 0 && !g.busyUntil.After(run.StartsAt) {
+			finish(g)
+		}
+		if g.busyUntil.After(run.StartsAt) {
+			if !cancelInProgress[run.PipelineID] {
+				if g.pending >= 0 {
+					runs[g.pending].Superseded = true
+				}
+				g.pending = i
+				continue
+			}
+			runs[g.running].Superseded = true
+			if g.pending >= 0 {
+				runs[g.pending].Superseded = true
+				g.pending = -1
+			}
+		}
+		g.running = i
+		g.busyUntil = run.StartsAt.Add(time.Duration(run.EstimatedDurationMs) * time.Millisecond)
+	}
+	for _, g := range groups {
+		if g.pending >= 0 {
+			finish(g)
+		}
+	}
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].StartsAt.Before(runs[j].StartsAt)
+	})
+}
+
+// markOverlaps lists, on every run sorted by StartsAt, the other pipelines
+// expected to be running at the same time
+func markOverlaps(runs []ScheduledRun) {
+	end := func(run ScheduledRun) time.Time {
+		return run.StartsAt.Add(time.Duration(run.EstimatedDurationMs) * time.Millisecond)
+	}
+	overlap := func(run *ScheduledRun, pipelineID string) {
+		for _, id := range run.Overlaps {
+			if id == pipelineID {
+				return
+			}
+		}
+		run.Overlaps = append(run.Overlaps, pipelineID)
+	}
+	for i := range runs {
+		if runs[i].Superseded || runs[i].EstimatedDurationMs == 0 {
+			continue
+		}
+		for j := i + 1; j < len(runs) && runs[j].StartsAt.Before(end(runs[i])); j++ {
+			if runs[j].Superseded || runs[j].PipelineID == runs[i].PipelineID {
+				continue
+			}
+			overlap(&runs[i], runs[j].PipelineID)
+			overlap(&runs[j], runs[i].PipelineID)
+		}
+	}
+	for i := range runs {
+		sort.Strings(runs[i].Overlaps)
+	}
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScheduleCalendar(t *testing.T) {
+	engine := newTestEngine(WithScheduleLocation(time.UTC))
+	backup := scriptPipeline("backup", "echo backup")
+	backup.ConcurrencyGroup = "db"
+	backup.Triggers = []Trigger{{Type: TriggerSchedule, Cron: "0 2 * * *"}}
+	reindex := scriptPipeline("reindex", "echo reindex")
+	reindex.ConcurrencyGroup = "db"
+	reindex.Triggers = []Trigger{{Type: TriggerSchedule, Cron: "30 2 * * *"}, {Type: TriggerSchedule, Cron: "45 2 * * *"}}
+	reports := scriptPipeline("reports", "echo reports")
+	reports.Triggers = []Trigger{{Type: TriggerSchedule, Cron: "0 3 * * *"}}
+	for _, pipeline := range []*Pipeline{backup, reindex, reports} {
+		engine.CreatePipeline(pipeline)
+	}
+
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	past := from.AddDate(0, 0, -7)
+	engine.mu.Lock()
+	for i, history := range []struct {
+		pipelineID string
+		duration   time.Duration
+	}{{"backup", 90 * time.Minute}, {"reindex", 30 * time.Minute}, {"reports", 10 * time.Minute}} {
+		id := history.pipelineID + "-history"
+		engine.jobs[id] = &Job{ID: id, PipelineID: history.pipelineID, Status: StatusSuccess, StartedAt: past.Add(time.Duration(i) * time.Hour), EndedAt: past.Add(time.Duration(i)*time.Hour + history.duration)}
+	}
+	engine.jobs["failed"] = &Job{ID: "failed", PipelineID: "backup", Status: StatusFailed, StartedAt: from.Add(5*time.Hour + 10*time.Minute)}
+	engine.mu.Unlock()
+
+	start, end := from.Add(2*time.Hour+50*time.Minute), from.Add(3*time.Hour+20*time.Minute)
+	window, err := engine.CreateMaintenanceWindow(&MaintenanceWindow{PipelineID: "reports", Start: &start, End: &end})
+	if err != nil {
+		t.Fatalf("CreateMaintenanceWindow() error = %v", err)
+	}
+
+	calendar := engine.ScheduleCalendar("", from, from.Add(24*time.Hour))
+	type run struct {
+		pipelineID string
+		at, starts string
+		heldBy     string
+		superseded bool
+		overlaps   []string
+	}
+	var got []run
+	for _, r := range calendar.Runs {
+		got = append(got, run{r.PipelineID, r.At.Format("15:04"), r.StartsAt.Format("15:04"), r.HeldBy, r.Superseded, r.Overlaps})
+	}
+	want := []run{
+		{"backup", "02:00", "02:00", "", false, []string{"reports"}},
+		{"reindex", "02:30", "02:30", "", true, nil},
+		{"reports", "03:00", "03:20", window.ID, false, []string{"backup"}},
+		{"reindex", "02:45", "03:30", "", false, nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ScheduleCalendar() runs = %+v, want %+v", got, want)
+	}
+
+	if calendar.Bucket != "hour" || len(calendar.Density) != 1 || calendar.Density[0].Start.Hour() != 5 || calendar.Density[0].Failed != 1 {
+		t.Errorf("ScheduleCalendar() density = %s %+v, want the failed job at 05:00", calendar.Bucket, calendar.Density)
+	}
+	if runs := engine.ScheduleCalendar("reports", from, from.Add(72*time.Hour)).Runs; len(runs) != 3 {
+		t.Errorf("ScheduleCalendar(reports) = %d runs, want one a day", len(runs))
+	}
+}
@@ -0,0 +1,223 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UpstreamJob is the job whose success started a job through a
+// pipeline-completed trigger
+type UpstreamJob struct {
+	PipelineID string `json:"pipelineId"`
+	JobID      string `json:"jobId"`
+	// Chain lists the pipelines of the trigger chain that led to the job,
+	// first one first, ending with the upstream pipeline
+	Chain []string `json:"chain"`
+}
+
+// WithUpstream records the job whose success triggered the run, as the
+// "upstream" metadata
+func WithUpstream(upstream UpstreamJob) RunOption {
+	return func(rc *runConfig) {
+		rc.upstream = &upstream
+	}
+}
+
+// JobUpstream returns the upstream job recorded on a job, or nil when it
+// wasn't started by a pipeline-completed trigger
+func JobUpstream(job *Job) *UpstreamJob {
+	switch upstream := job.Metadata["upstream"].(type) {
+	case UpstreamJob:
+		return &upstream
+	case *UpstreamJob:
+		return upstream
+	case map[string]interface{}:
+		// Decoded from the store
+		data, err := json.Marshal(upstream)
+		if err != nil {
+			return nil
+		}
+		var decoded UpstreamJob
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			return nil
+		}
+		return &decoded
+	}
+	return nil
+}
+
+// matchesUpstream reports whether a pipeline-completed trigger starts its
+// pipeline for a successful job of pipelineID on branch with the trigger
+// values of values
+func (t Trigger) matchesUpstream(pipelineID, branch string, values map[string]string) bool {
+	if t.Type != TriggerPipelineCompleted || t.Pipeline != pipelineID {
+		return false
+	}
+	if len(t.Branches) > 0 {
+		matched := false
+		for _, glob := range t.Branches {
+			if ok, _ := path.Match(glob, branch); ok {
+				matched = true
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for name, want := range t.Labels {
+		if values[name] != want {
+			return false
+		}
+	}
+	return true
+}
+
+// triggerDownstream dispatches the pipelines whose pipeline-completed
+// triggers match a successful job. Pipelines already in the job's trigger
+// chain are not started again.
+func (pe *PipelineEngine) triggerDownstream(pipeline *Pipeline, job *Job) {
+	pe.mu.RLock()
+	branch := jobBranch(job)
+	values := triggerValues(job.Metadata)
+	var revision *Revision
+	if job.Revision != nil {
+		rev := *job.Revision
+		revision = &rev
+	}
+	var downstream []string
+	for id, p := range pe.pipelines {
+		for _, trigger := range p.Triggers {
+			if trigger.matchesUpstream(pipeline.ID, branch, values) {
+				downstream = append(downstream, id)
+				break
+			}
+		}
+	}
+	pe.mu.RUnlock()
+	if len(downstream) == 0 {
+		return
+	}
+	sort.Strings(downstream)
+
+	var chain []string
+	if upstream := JobUpstream(job); upstream != nil {
+		chain = append(chain, upstream.Chain...)
+	}
+	chain = append(chain, pipeline.ID)
+	for _, id := range downstream {
+		looped := false
+		for _, seen := range chain {
+			looped = looped || seen == id
+		}
+		if looped {
+			pe.logger.Printf("Not starting pipeline %s after job %s: it is already in the trigger chain %s", id, job.ID, strings.Join(chain, " -> "))
+			continue
+		}
+		opts := []RunOption{
+			WithSource(TriggerPipelineCompleted),
+			WithTrigger(values),
+			WithUpstream(UpstreamJob{PipelineID: pipeline.ID, JobID: job.ID, Chain: chain}),
+		}
+		if revision != nil {
+			opts = append(opts, WithRevision(*revision))
+		}
+		started, held, err := pe.Dispatch(context.Background(), id, opts...)
+		switch {
+		case err != nil:
+			pe.logger.Printf("Failed to start pipeline %s after job %s of pipeline %s: %v", id, job.ID, pipeline.ID, err)
+		case held == nil:
+			pe.logger.Printf("Started pipeline %s as job %s after job %s of pipeline %s", id, started.ID, job.ID, pipeline.ID)
+			pe.emitEvent(Event{
+				Type:       "pipeline.chained",
+				Timestamp:  time.Now(),
+				PipelineID: pipeline.ID,
+				JobID:      job.ID,
+				Data:       map[string]interface{}{"pipelineId": id, "jobId": started.ID},
+			})
+		}
+	}
+}
+
+// validateTriggerChains checks that the pipeline-completed triggers of the
+// engine's pipelines, with upserts replacing and deletes removing some of
+// them, don't form a cycle. Callers must hold pe.mu.
+func (pe *PipelineEngine) validateTriggerChains(upserts []*Pipeline, deletes []string) error {
+	pipelines := make(map[string]*Pipeline, len(pe.pipelines)+len(upserts))
+	for id, pipeline := range pe.pipelines {
+		pipelines[id] = pipeline
+	}
+	for _, id := range deletes {
+		delete(pipelines, id)
+	}
+	for _, pipeline := range upserts {
+		pipelines[pipeline.ID] = pipeline
+	}
+	if cycle := triggerCycle(pipelines); cycle != nil {
+		return fmt.Errorf("pipeline-completed triggers form a cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// triggerCycle returns a cycle of pipelines that start each other through
+// pipeline-completed triggers, starting and ending with the same pipeline,
+// or nil when there is none
+func triggerCycle(pipelines map[string]*Pipeline) []string {
+	// downstream maps upstream pipelines to the pipelines they start
+	downstream := make(map[string][]string)
+	for id, pipeline := range pipelines {
+		for _, trigger := range pipeline.Triggers {
+			if trigger.Type == TriggerPipelineCompleted && trigger.Pipeline != "" {
+				downstream[trigger.Pipeline] = append(downstream[trigger.Pipeline], id)
+			}
+		}
+	}
+	ids := make([]string, 0, len(downstream))
+	for id, next := range downstream {
+		sort.Strings(next)
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var stack []string
+	var visit func(id string) []string
+	visit = func(id string) []string {
+		state[id] = visiting
+		stack = append(stack, id)
+		for _, next := range downstream[id] {
+			switch state[next] {
+			case visiting:
+				for i, seen := range stack {
+					if seen == next {
+						return append(append([]string{}, stack[i:]...), next)
+					}
+				}
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[id] = done
+		return nil
+	}
+	for _, id := range ids {
+		if state[id] == unvisited {
+			if cycle := visit(id); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
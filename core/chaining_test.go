@@ -0,0 +1,133 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func chainedPipeline(id, upstream string, trigger Trigger) *Pipeline {
+	pipeline := scriptPipeline(id, "echo $CONVEYOR_PIPELINE_ID")
+	trigger.Type = TriggerPipelineCompleted
+	trigger.Pipeline = upstream
+	pipeline.Triggers = []Trigger{trigger}
+	return pipeline
+}
+
+// chainedJob returns the job the next pipeline.chained event reports, or
+// nil when none is emitted within a second
+func chainedJob(t *testing.T, sub *Subscription) *Event {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-sub.Events():
+			if event.Type == "pipeline.chained" {
+				return &event
+			}
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+func TestChaining_StartsDownstreamOnSuccess(t *testing.T) {
+	engine := newTestEngine()
+	for _, pipeline := range []*Pipeline{
+		scriptPipeline("build", "exit ${FAIL:-0}"),
+		chainedPipeline("deploy", "build", Trigger{Branches: []string{"release/*"}, Labels: map[string]string{"env": "staging"}}),
+	} {
+		if err := engine.CreatePipeline(pipeline); err != nil {
+			t.Fatalf("CreatePipeline() error = %v", err)
+		}
+	}
+	sub := engine.Subscribe(100)
+
+	// Neither another branch nor other labels start the deploy
+	for _, trigger := range []map[string]string{
+		{"branch": "main", "env": "staging"},
+		{"branch": "release/1.2", "env": "production"},
+	} {
+		if job, err := engine.Run(context.Background(), "build", WithTrigger(trigger)); err != nil || job.Status != StatusSuccess {
+			t.Fatalf("Run() = %v, %v, want success", job, err)
+		}
+	}
+	if event := chainedJob(t, sub); event != nil {
+		t.Fatalf("pipeline.chained = %+v, want none for other branches and labels", event)
+	}
+
+	upstream, err := engine.Run(context.Background(), "build", WithTrigger(map[string]string{"branch": "release/1.2", "env": "staging"}))
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	event := chainedJob(t, sub)
+	if event == nil {
+		t.Fatal("no pipeline.chained event after the build succeeded")
+	}
+	if event.JobID != upstream.ID || event.Data["pipelineId"] != "deploy" {
+		t.Errorf("pipeline.chained = %+v, want deploy started by %s", event, upstream.ID)
+	}
+
+	deploy := waitForJob(t, engine, "deploy", event.Data["jobId"].(string), StatusSuccess)
+	got := JobUpstream(deploy)
+	if got == nil || got.PipelineID != "build" || got.JobID != upstream.ID || strings.Join(got.Chain, ",") != "build" {
+		t.Errorf("upstream = %+v, want job %s of build", got, upstream.ID)
+	}
+	if deploy.Metadata["source"] != TriggerPipelineCompleted || triggerValues(deploy.Metadata)["branch"] != "release/1.2" {
+		t.Errorf("metadata = %v, want the build's trigger values", deploy.Metadata)
+	}
+}
+
+func TestChaining_FailedJobDoesNotTrigger(t *testing.T) {
+	engine := newTestEngine()
+	engine.CreatePipeline(scriptPipeline("build", "exit 1"))
+	engine.CreatePipeline(chainedPipeline("deploy", "build", Trigger{}))
+	sub := engine.Subscribe(100)
+
+	if job, _ := engine.Run(context.Background(), "build"); job.Status != StatusFailed {
+		t.Fatalf("Status = %s, want failed", job.Status)
+	}
+	if event := chainedJob(t, sub); event != nil {
+		t.Errorf("pipeline.chained = %+v, want none after a failure", event)
+	}
+}
+
+func TestChaining_RejectsCycles(t *testing.T) {
+	engine := newTestEngine()
+	if err := engine.CreatePipeline(chainedPipeline("a", "c", Trigger{})); err != nil {
+		t.Fatalf("CreatePipeline(a) error = %v", err)
+	}
+	if err := engine.CreatePipeline(chainedPipeline("b", "a", Trigger{})); err != nil {
+		t.Fatalf("CreatePipeline(b) error = %v", err)
+	}
+
+	err := engine.CreatePipeline(chainedPipeline("c", "b", Trigger{}))
+	if err == nil || !strings.Contains(err.Error(), "cycle: a -> b -> c -> a") {
+		t.Errorf("CreatePipeline(c) error = %v, want the cycle", err)
+	}
+	if err := engine.ApplyPipelines([]*Pipeline{chainedPipeline("self", "self", Trigger{})}, nil); err == nil {
+		t.Error("ApplyPipelines() of a self-triggering pipeline error = nil, want a cycle")
+	}
+	// Deleting a pipeline of the chain breaks it
+	if err := engine.ApplyPipelines([]*Pipeline{chainedPipeline("c", "b", Trigger{})}, []string{"a"}); err != nil {
+		t.Errorf("ApplyPipelines() without a error = %v, want nil", err)
+	}
+}
+
+func TestChaining_SkipsPipelinesInChain(t *testing.T) {
+	engine := newTestEngine()
+	engine.CreatePipeline(scriptPipeline("build"))
+	engine.CreatePipeline(chainedPipeline("deploy", "build", Trigger{}))
+	sub := engine.Subscribe(100)
+
+	// A chain the validation didn't see, such as one restored from an
+	// older version of the pipelines, stops before it loops
+	_, err := engine.Run(context.Background(), "build", WithUpstream(UpstreamJob{PipelineID: "deploy", JobID: "earlier", Chain: []string{"deploy"}}))
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if event := chainedJob(t, sub); event != nil {
+		t.Errorf("pipeline.chained = %+v, want deploy skipped", event)
+	}
+}
@@ -0,0 +1,82 @@
+package core
+
+import (
+	"strings"
+	"time"
+)
+
+// CloudEventsSpecVersion is the CloudEvents version events are exported as
+const CloudEventsSpecVersion = "1.0"
+
+// CloudEventTypePrefix is prepended to event types, so job.completed is
+// exported as dev.conveyor.job.completed
+const CloudEventTypePrefix = "dev.conveyor."
+
+// CloudEventSource is the source of events that don't belong to a pipeline.
+// Events of a pipeline have the source /conveyor/pipelines/<id>.
+const CloudEventSource = "/conveyor"
+
+// CloudEventsContentType is the content type of a CloudEvent in structured
+// mode, and CloudEventsBatchContentType of a batch of them
+const (
+	CloudEventsContentType      = "application/cloudevents+json"
+	CloudEventsBatchContentType = "application/cloudevents-batch+json"
+)
+
+// CloudEvent is an engine event in the JSON format of the CloudEvents 1.0
+// spec. The pipeline, job and step are extension attributes, so brokers can
+// filter on them.
+type CloudEvent struct {
+	SpecVersion     string                 `json:"specversion"`
+	ID              string                 `json:"id"`
+	Source          string                 `json:"source"`
+	Type            string                 `json:"type"`
+	Subject         string                 `json:"subject,omitempty"`
+	Time            time.Time              `json:"time"`
+	DataContentType string                 `json:"datacontenttype,omitempty"`
+	Data            map[string]interface{} `json:"data,omitempty"`
+	Pipeline        string                 `json:"conveyorpipeline,omitempty"`
+	Job             string                 `json:"conveyorjob,omitempty"`
+	Step            string                 `json:"conveyorstep,omitempty"`
+}
+
+// NewCloudEvent converts an engine event to a CloudEvent. The subject is the
+// job, or the step of the job, the event is about.
+func NewCloudEvent(event Event) CloudEvent {
+	source := CloudEventSource
+	if event.PipelineID != "" {
+		source += "/pipelines/" + event.PipelineID
+	}
+	var subject []string
+	if event.JobID != "" {
+		subject = append(subject, "jobs", event.JobID)
+	}
+	if event.StepID != "" {
+		subject = append(subject, "steps", event.StepID)
+	}
+	ce := CloudEvent{
+		SpecVersion: CloudEventsSpecVersion,
+		ID:          event.ID,
+		Source:      source,
+		Type:        CloudEventTypePrefix + event.Type,
+		Subject:     strings.Join(subject, "/"),
+		Time:        event.Timestamp,
+		Data:        event.Data,
+		Pipeline:    event.PipelineID,
+		Job:         event.JobID,
+		Step:        event.StepID,
+	}
+	if ce.Data != nil {
+		ce.DataContentType = "application/json"
+	}
+	return ce
+}
+
+// NewCloudEvents converts engine events to CloudEvents
+func NewCloudEvents(events []Event) []CloudEvent {
+	result := make([]CloudEvent, len(events))
+	for i, event := range events {
+		result[i] = NewCloudEvent(event)
+	}
+	return result
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewCloudEvent(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ce := NewCloudEvent(Event{
+		ID:         "event-1",
+		Type:       "step.completed",
+		Timestamp:  at,
+		PipelineID: "web",
+		JobID:      "job-1",
+		StepID:     "test",
+		Data:       map[string]interface{}{"status": "success"},
+	})
+	data, err := json.Marshal(ce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attrs map[string]interface{}
+	json.Unmarshal(data, &attrs)
+	want := map[string]interface{}{
+		"specversion":      "1.0",
+		"id":               "event-1",
+		"source":           "/conveyor/pipelines/web",
+		"type":             "dev.conveyor.step.completed",
+		"subject":          "jobs/job-1/steps/test",
+		"time":             "2024-05-01T12:00:00Z",
+		"datacontenttype":  "application/json",
+		"conveyorpipeline": "web",
+		"conveyorjob":      "job-1",
+		"conveyorstep":     "test",
+	}
+	for key, value := range want {
+		if attrs[key] != value {
+			t.Errorf("%s = %v, want %v", key, attrs[key], value)
+		}
+	}
+
+	if ce := NewCloudEvent(Event{ID: "event-2", Type: "secret.expired"}); ce.Source != "/conveyor" || ce.Subject != "" || ce.DataContentType != "" {
+		t.Errorf("NewCloudEvent() = %+v, want the engine's source and no subject", ce)
+	}
+}
+
+func TestJobEvents(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, engine := range map[string]*PipelineEngine{
+		"memory": newTestEngine(),
+		"store":  newTestEngine(WithStore(store)),
+	} {
+		engine.CreatePipeline(scriptPipeline("it", `true`))
+		job, err := engine.Run(context.Background(), "it")
+		if err != nil {
+			t.Fatalf("%s: Run() error = %v", name, err)
+		}
+
+		events, err := engine.JobEvents(job.ID)
+		if err != nil {
+			t.Fatalf("%s: JobEvents() error = %v", name, err)
+		}
+		var types []string
+		ids := make(map[string]bool)
+		for _, event := range events {
+			types = append(types, event.Type)
+			ids[event.ID] = true
+			if event.JobID != job.ID || event.Timestamp.IsZero() {
+				t.Errorf("%s: event = %+v, want a timestamped event of the job", name, event)
+			}
+		}
+		if got := strings.Join(types, ","); !strings.HasPrefix(got, "job.started") || !strings.HasSuffix(got, "job.completed") {
+			t.Errorf("%s: event types = %s, want the job from start to completion", name, got)
+		}
+		if len(ids) != len(events) {
+			t.Errorf("%s: event IDs aren't unique: %v", name, ids)
+		}
+
+		if _, err := engine.JobEvents("unknown"); err == nil {
+			t.Errorf("%s: JobEvents(unknown) expected error, got nil", name)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxCommentLength is the longest comment, in bytes
+const maxCommentLength = 10000
+
+var commentCounter uint64
+
+// JobComment is a note a person left on a job or one of its steps, such as
+// "failure caused by upstream outage, ignore"
+type JobComment struct {
+	ID string `json:"id"`
+	// StepID is the step the comment is about, or empty for the whole job
+	StepID string    `json:"stepId,omitempty"`
+	Text   string    `json:"text"`
+	Author string    `json:"author,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// CommentQuery selects comments. Text matches comments containing every
+// word of it, in any case; empty fields match every comment.
+type CommentQuery struct {
+	Text       string
+	Author     string
+	PipelineID string
+	StepID     string
+	// Visible, when set, limits the search to the pipelines it accepts,
+	// such as those a user can read
+	Visible func(pipelineID string) bool
+	// Limit is the most comments returned, newest first
+	Limit int
+}
+
+// CommentMatch is a comment found by a search, with its job
+type CommentMatch struct {
+	JobComment
+	PipelineID string `json:"pipelineId"`
+	JobID      string `json:"jobId"`
+	JobStatus  Status `json:"jobStatus"`
+}
+
+// AddJobComment adds a comment to a job, or to one of its steps when
+// stepID is set
+func (pe *PipelineEngine) AddJobComment(jobID, stepID, text, author string) (JobComment, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return JobComment{}, fmt.Errorf("comment text is required")
+	}
+	if len(text) > maxCommentLength {
+		return JobComment{}, fmt.Errorf("comment is longer than %d bytes", maxCommentLength)
+	}
+
+	pe.mu.Lock()
+	job, exists := pe.jobs[jobID]
+	if !exists {
+		pe.mu.Unlock()
+		return JobComment{}, fmt.Errorf("job with ID %s not found", jobID)
+	}
+	if stepID != "" && !jobHasStep(job, stepID) {
+		pe.mu.Unlock()
+		return JobComment{}, fmt.Errorf("job %s has no step %s", jobID, stepID)
+	}
+	comment := JobComment{
+		ID:     fmt.Sprintf("comment-%d-%d", time.Now().Unix(), atomic.AddUint64(&commentCounter, 1)),
+		StepID: stepID,
+		Text:   text,
+		Author: author,
+		At:     time.Now(),
+	}
+	job.Comments = append(job.Comments, comment)
+	pe.mu.Unlock()
+
+	pe.saveJob(job)
+	return comment, nil
+}
+
+// jobHasStep reports whether a job ran a step. Callers must hold pe.mu.
+func jobHasStep(job *Job, stepID string) bool {
+	for _, step := range job.Steps {
+		if step.ID == stepID {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteJobComment removes a comment from a job, returning it
+func (pe *PipelineEngine) DeleteJobComment(jobID, commentID string) (JobComment, error) {
+	pe.mu.Lock()
+	job, exists := pe.jobs[jobID]
+	if !exists {
+		pe.mu.Unlock()
+		return JobComment{}, fmt.Errorf("job with ID %s not found", jobID)
+	}
+	for i, comment := range job.Comments {
+		if comment.ID == commentID {
+			job.Comments = append(job.Comments[:i:i], job.Comments[i+1:]...)
+			pe.mu.Unlock()
+			pe.saveJob(job)
+			return comment, nil
+		}
+	}
+	pe.mu.Unlock()
+	return JobComment{}, fmt.Errorf("comment %s of job %s not found", commentID, jobID)
+}
+
+// SearchComments returns the comments on every job matching a query,
+// newest first
+func (pe *PipelineEngine) SearchComments(query CommentQuery) []CommentMatch {
+	words := strings.Fields(strings.ToLower(query.Text))
+
+	pe.mu.RLock()
+	matches := make([]CommentMatch, 0)
+	for _, job := range pe.jobs {
+		if query.PipelineID != "" && job.PipelineID != query.PipelineID || query.Visible != nil && !query.Visible(job.PipelineID) {
+			continue
+		}
+		for _, comment := range job.Comments {
+			if query.Author != "" && !strings.EqualFold(comment.Author, query.Author) {
+				continue
+			}
+			if query.StepID != "" && comment.StepID != query.StepID {
+				continue
+			}
+			if !containsWords(strings.ToLower(comment.Text), words) {
+				continue
+			}
+			matches = append(matches, CommentMatch{JobComment: comment, PipelineID: job.PipelineID, JobID: job.ID, JobStatus: job.Status})
+		}
+	}
+	pe.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		if !matches[i].At.Equal(matches[j].At) {
+			return matches[i].At.After(matches[j].At)
+		}
+		return matches[i].ID > matches[j].ID
+	})
+	if query.Limit > 0 && len(matches) > query.Limit {
+		matches = matches[:query.Limit]
+	}
+	return matches
+}
+
+// containsWords reports whether text contains every word
+func containsWords(text string, words []string) bool {
+	for _, word := range words {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"context"
+	"testing"
+)
+
+func TestJobComments(t *testing.T) {
+	engine := newTestEngine()
+	engine.CreatePipeline(scriptPipeline("build", "exit 1"))
+	engine.CreatePipeline(scriptPipeline("deploy", "true"))
+	build, _ := engine.Run(context.Background(), "build")
+	deploy, _ := engine.Run(context.Background(), "deploy")
+
+	stepID := build.Steps[0].ID
+	outage, err := engine.AddJobComment(build.ID, stepID, "  Failure caused by upstream outage, ignore ", "alice")
+	if err != nil {
+		t.Fatalf("AddJobComment() error = %v", err)
+	}
+	if outage.Text != "Failure caused by upstream outage, ignore" || outage.StepID != stepID || outage.Author != "alice" || outage.At.IsZero() {
+		t.Errorf("AddJobComment() = %+v", outage)
+	}
+	engine.AddJobComment(deploy.ID, "", "Deployed during the outage window", "bob")
+
+	if _, err := engine.AddJobComment(build.ID, "", "   ", "alice"); err == nil {
+		t.Error("AddJobComment() of an empty comment error = nil")
+	}
+	if _, err := engine.AddJobComment(build.ID, "missing", "note", "alice"); err == nil {
+		t.Error("AddJobComment() on a missing step error = nil")
+	}
+
+	job, _ := engine.JobSnapshot(build.ID)
+	if len(job.Comments) != 1 || job.Comments[0].ID != outage.ID {
+		t.Errorf("job comments = %+v, want the outage comment", job.Comments)
+	}
+
+	tests := []struct {
+		query CommentQuery
+		want  int
+	}{
+		{CommentQuery{Text: "OUTAGE"}, 2},
+		{CommentQuery{Text: "upstream ignore"}, 1},
+		{CommentQuery{Text: "outage", Author: "Bob"}, 1},
+		{CommentQuery{PipelineID: "build", StepID: stepID}, 1},
+		{CommentQuery{Visible: func(pipelineID string) bool { return pipelineID == "deploy" }}, 1},
+		{CommentQuery{Limit: 1}, 1},
+		{CommentQuery{Text: "flaky"}, 0},
+	}
+	for _, tt := range tests {
+		if got := engine.SearchComments(tt.query); len(got) != tt.want {
+			t.Errorf("SearchComments(%+v) = %d comments, want %d", tt.query, len(got), tt.want)
+		}
+	}
+	if matches := engine.SearchComments(CommentQuery{Text: "upstream"}); len(matches) != 1 || matches[0].JobID != build.ID || matches[0].JobStatus != StatusFailed {
+		t.Errorf("SearchComments() = %+v, want the build job's comment", matches)
+	}
+
+	if _, err := engine.DeleteJobComment(build.ID, outage.ID); err != nil {
+		t.Fatalf("DeleteJobComment() error = %v", err)
+	}
+	if _, err := engine.DeleteJobComment(build.ID, outage.ID); err == nil {
+		t.Error("DeleteJobComment() of a deleted comment error = nil")
+	}
+	if got := engine.SearchComments(CommentQuery{PipelineID: "build"}); len(got) != 0 {
+		t.Errorf("SearchComments() after delete = %+v", got)
+	}
+}
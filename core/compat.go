@@ -0,0 +1,226 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Protocol versions the server speaks with agents and plugins. A component
+// declares the newest protocol it speaks and, for agents, the oldest it can
+// fall back to; unversioned components speak protocol 1.
+const (
+	// AgentProtocol is the newest agent protocol. Protocol 2 added
+	// heartbeats while steps run.
+	AgentProtocol = 2
+	// MinAgentProtocol is the oldest agent protocol the server accepts
+	MinAgentProtocol = 1
+	// PluginProtocol is the version of the Plugin interface
+	PluginProtocol = 1
+	// MinPluginProtocol is the oldest plugin protocol the server accepts
+	MinPluginProtocol = 1
+)
+
+// Compatibility statuses
+const (
+	// CompatCurrent components speak the server's newest protocol
+	CompatCurrent = "current"
+	// CompatLimited components speak an older protocol, work with features
+	// missing and must be upgraded before a server dropping it
+	CompatLimited = "limited"
+	// CompatIncompatible components were rejected
+	CompatIncompatible = "incompatible"
+)
+
+// maxRejected is how many rejected components the compatibility matrix
+// keeps
+const maxRejected = 50
+
+// ErrIncompatibleProtocol is returned for agents and plugins without a
+// protocol in common with the server
+var ErrIncompatibleProtocol = errors.New("incompatible protocol")
+
+// agentLimitations are the features agents speaking an older protocol miss
+var agentLimitations = map[int][]string{
+	1: {"sends no heartbeats while running steps, so it is only found lost once its step finishes or times out"},
+}
+
+// ProtocolRange is the oldest and newest protocol the server speaks
+type ProtocolRange struct {
+	Min     int `json:"min"`
+	Current int `json:"current"`
+}
+
+// Compatibility is how an agent or plugin that connected matches the
+// server's protocols
+type Compatibility struct {
+	// Component is agent or plugin
+	Component string `json:"component"`
+	Name      string `json:"name"`
+	ID        string `json:"id,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Protocol  int    `json:"protocol"`
+	// Negotiated is the protocol the server speaks with the component
+	Negotiated  int      `json:"negotiated,omitempty"`
+	Status      string   `json:"status"`
+	Limitations []string `json:"limitations,omitempty"`
+	// Upgrade is what must be upgraded: the component, or the server
+	Upgrade string    `json:"upgrade,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	SeenAt  time.Time `json:"seenAt"`
+}
+
+// CompatibilityMatrix lists the protocols the server speaks and how the
+// connected and recently rejected agents and plugins match them
+type CompatibilityMatrix struct {
+	ServerVersion   string          `json:"serverVersion"`
+	AgentProtocols  ProtocolRange   `json:"agentProtocols"`
+	PluginProtocols ProtocolRange   `json:"pluginProtocols"`
+	Components      []Compatibility `json:"components"`
+	// UpgradeBeforeServer names the components to upgrade before the
+	// server, which may drop the older protocols they speak
+	UpgradeBeforeServer []string `json:"upgradeBeforeServer"`
+}
+
+// WithVersion sets the server version reported in the compatibility
+// matrix
+func WithVersion(version string) Option {
+	return func(pe *PipelineEngine) {
+		pe.version = version
+	}
+}
+
+// ProtocolError is returned for agents and plugins without a protocol in
+// common with the server. It matches ErrIncompatibleProtocol.
+type ProtocolError struct {
+	Component   string
+	Protocol    int
+	MinProtocol int
+	Supported   ProtocolRange
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Protocol < e.Supported.Min {
+		return fmt.Sprintf("%s speaks protocol %d, older than the oldest the server accepts (%d); upgrade the %s", e.Component, e.Protocol, e.Supported.Min, e.Component)
+	}
+	return fmt.Sprintf("%s needs protocol %d or newer, newer than the server's %d; upgrade the server", e.Component, e.MinProtocol, e.Supported.Current)
+}
+
+func (e *ProtocolError) Is(target error) bool {
+	return target == ErrIncompatibleProtocol
+}
+
+// Upgrade returns what must be upgraded: the component, or the server
+func (e *ProtocolError) Upgrade() string {
+	if e.Protocol < e.Supported.Min {
+		return e.Component
+	}
+	return "server"
+}
+
+// negotiate returns the protocol a component speaking minProtocol to
+// protocol and a server speaking supported agree on
+func negotiate(component string, protocol, minProtocol int, supported ProtocolRange) (int, error) {
+	if protocol <= 0 {
+		protocol = 1
+	}
+	if minProtocol <= 0 || minProtocol > protocol {
+		minProtocol = protocol
+	}
+	negotiated := protocol
+	if negotiated > supported.Current {
+		negotiated = supported.Current
+	}
+	if negotiated < supported.Min || negotiated < minProtocol {
+		return 0, &ProtocolError{Component: component, Protocol: protocol, MinProtocol: minProtocol, Supported: supported}
+	}
+	return negotiated, nil
+}
+
+// NegotiatePluginProtocol returns the protocol the server speaks with a
+// plugin, or ErrIncompatibleProtocol
+func NegotiatePluginProtocol(manifest PluginManifest) (int, error) {
+	return negotiate("plugin "+manifest.Name, manifest.Protocol, manifest.Protocol, ProtocolRange{MinPluginProtocol, PluginProtocol})
+}
+
+// compatibility returns the status of a component that negotiated a
+// protocol with a server speaking supported
+func compatibility(component, name string, protocol, negotiated int, supported ProtocolRange) Compatibility {
+	if protocol <= 0 {
+		protocol = 1
+	}
+	c := Compatibility{Component: component, Name: name, Protocol: protocol, Negotiated: negotiated, Status: CompatCurrent}
+	if negotiated < supported.Current {
+		c.Status, c.Upgrade = CompatLimited, component
+	}
+	return c
+}
+
+// rejectComponent records a component rejected for its protocol. Callers
+// must hold pe.mu.
+func (pe *PipelineEngine) rejectComponent(c Compatibility, err error) {
+	c.Status, c.Error, c.SeenAt, c.Upgrade = CompatIncompatible, err.Error(), time.Now(), c.Component
+	var protocolErr *ProtocolError
+	if errors.As(err, &protocolErr) && protocolErr.Upgrade() == "server" {
+		c.Upgrade = "server"
+	}
+	for i, rejected := range pe.rejected {
+		if rejected.Component == c.Component && rejected.Name == c.Name && rejected.Version == c.Version {
+			pe.rejected = append(pe.rejected[:i:i], pe.rejected[i+1:]...)
+			break
+		}
+	}
+	pe.rejected = append(pe.rejected, c)
+	if len(pe.rejected) > maxRejected {
+		pe.rejected = pe.rejected[len(pe.rejected)-maxRejected:]
+	}
+}
+
+// Compatibility returns the compatibility matrix of the registered agents
+// and plugins and the components rejected recently
+func (pe *PipelineEngine) Compatibility() CompatibilityMatrix {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	agents := ProtocolRange{MinAgentProtocol, AgentProtocol}
+	plugins := ProtocolRange{MinPluginProtocol, PluginProtocol}
+	matrix := CompatibilityMatrix{
+		ServerVersion:       pe.version,
+		AgentProtocols:      agents,
+		PluginProtocols:     plugins,
+		Components:          []Compatibility{},
+		UpgradeBeforeServer: []string{},
+	}
+	for _, a := range pe.agents {
+		if a.State == AgentDone {
+			continue
+		}
+		c := compatibility("agent", a.Name, a.Protocol, a.Negotiated, agents)
+		c.ID, c.Version, c.SeenAt = a.ID, a.Version, a.LastHeartbeat
+		c.Limitations = agentLimitations[a.Negotiated]
+		matrix.Components = append(matrix.Components, c)
+	}
+	for name, plugin := range pe.plugins {
+		manifest := plugin.GetManifest()
+		negotiated, _ := NegotiatePluginProtocol(manifest)
+		c := compatibility("plugin", name, manifest.Protocol, negotiated, plugins)
+		c.Version = manifest.Version
+		matrix.Components = append(matrix.Components, c)
+	}
+	sort.Slice(matrix.Components, func(i, j int) bool {
+		a, b := matrix.Components[i], matrix.Components[j]
+		if a.Component != b.Component {
+			return a.Component < b.Component
+		}
+		return a.Name < b.Name
+	})
+	matrix.Components = append(matrix.Components, pe.rejected...)
+
+	for _, c := range matrix.Components {
+		if c.Upgrade == c.Component {
+			matrix.UpgradeBeforeServer = append(matrix.UpgradeBeforeServer, c.Component+" "+c.Name)
+		}
+	}
+	return matrix
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	supported := ProtocolRange{Min: 2, Current: 3}
+	tests := []struct {
+		name        string
+		protocol    int
+		minProtocol int
+		want        int
+		upgrade     string
+	}{
+		{name: "current", protocol: 3, want: 3},
+		{name: "older supported", protocol: 2, want: 2},
+		{name: "newer falls back", protocol: 5, minProtocol: 2, want: 3},
+		{name: "newer without fallback", protocol: 5, minProtocol: 4, upgrade: "server"},
+		{name: "too old", protocol: 1, upgrade: "agent"},
+		{name: "unversioned", upgrade: "agent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := negotiate("agent", tt.protocol, tt.minProtocol, supported)
+			if tt.upgrade == "" {
+				if err != nil || got != tt.want {
+					t.Errorf("negotiate() = %d, %v, want %d", got, err, tt.want)
+				}
+				return
+			}
+			var protocolErr *ProtocolError
+			if !errors.Is(err, ErrIncompatibleProtocol) || !errors.As(err, &protocolErr) || protocolErr.Upgrade() != tt.upgrade {
+				t.Errorf("negotiate() error = %v, want an incompatible protocol upgrading the %s", err, tt.upgrade)
+			}
+		})
+	}
+}
+
+func TestCompatibility(t *testing.T) {
+	engine := newTestEngine(
+		WithVersion("1.4.0"),
+		WithPlugins(&fakePlugin{name: "lint", version: "0.3.0"}, &fakePlugin{name: "future", version: "9.0.0", protocol: PluginProtocol + 1}),
+	)
+	_, secret, err := engine.MintAgentToken("web", nil, time.Minute)
+	if err != nil {
+		t.Fatalf("MintAgentToken() error = %v", err)
+	}
+
+	// Rejected agents leave the token unused
+	if _, _, err := engine.RegisterAgent(secret, AgentInfo{Name: "next", Version: "2.0.0", Protocol: AgentProtocol + 1, MinProtocol: AgentProtocol + 1}); !errors.Is(err, ErrIncompatibleProtocol) || !strings.Contains(err.Error(), "upgrade the server") {
+		t.Fatalf("RegisterAgent() error = %v, want an incompatible protocol upgrading the server", err)
+	}
+	agent, _, err := engine.RegisterAgent(secret, AgentInfo{Name: "old", Version: "1.0.0"})
+	if err != nil || agent.Protocol != 1 || agent.Negotiated != 1 {
+		t.Fatalf("RegisterAgent() = %+v, %v, want an unversioned agent on protocol 1", agent, err)
+	}
+
+	matrix := engine.Compatibility()
+	if matrix.ServerVersion != "1.4.0" || matrix.AgentProtocols != (ProtocolRange{MinAgentProtocol, AgentProtocol}) {
+		t.Errorf("Compatibility() = %+v, want the server's version and protocols", matrix)
+	}
+	statuses := make(map[string]Compatibility)
+	for _, c := range matrix.Components {
+		statuses[c.Component+" "+c.Name] = c
+	}
+	if c := statuses["agent old"]; c.Status != CompatLimited || c.Upgrade != "agent" || len(c.Limitations) == 0 {
+		t.Errorf("agent old = %+v, want limited with the agent to upgrade", c)
+	}
+	if c := statuses["agent next"]; c.Status != CompatIncompatible || c.Upgrade != "server" || c.Error == "" {
+		t.Errorf("agent next = %+v, want incompatible with the server to upgrade", c)
+	}
+	if c := statuses["plugin lint"]; c.Status != CompatCurrent || c.Upgrade != "" {
+		t.Errorf("plugin lint = %+v, want current", c)
+	}
+	if c := statuses["plugin future"]; c.Status != CompatIncompatible || c.Upgrade != "server" {
+		t.Errorf("plugin future = %+v, want incompatible with the server to upgrade", c)
+	}
+	if got := strings.Join(matrix.UpgradeBeforeServer, ","); got != "agent old" {
+		t.Errorf("UpgradeBeforeServer = %s, want agent old", got)
+	}
+}
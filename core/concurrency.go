@@ -0,0 +1,176 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// concurrencyGroup tracks the running and pending job of a concurrency
+// group
+type concurrencyGroup struct {
+	running string
+	pending string
+}
+
+// ConcurrencyGroupStatus reports the jobs holding a concurrency group
+type ConcurrencyGroupStatus struct {
+	Group   string `json:"group"`
+	Running string `json:"running,omitempty"`
+	Pending string `json:"pending,omitempty"`
+}
+
+// resolveGroup expands the references of a pipeline's concurrency group
+func resolveGroup(pipeline *Pipeline, trigger map[string]string, rev *Revision) string {
+	return expandReferences(pipeline.ConcurrencyGroup, referenceValues(pipeline, "", trigger, rev))
+}
+
+// ValidateConcurrencyGroup checks that a concurrency group only references
+// the pipeline ID, trigger values and the revision
+func ValidateConcurrencyGroup(group string) error {
+	return validateStartReferences(group, "concurrency group")
+}
+
+// jobGroup returns the concurrency group recorded on a job
+func jobGroup(job *Job) string {
+	group, _ := job.Metadata["concurrencyGroup"].(string)
+	return group
+}
+
+// joinGroup adds a new job to its concurrency group. A newer job
+// supersedes the group's pending job, and with cancelInProgress also its
+// running job. Callers must hold pe.mu.
+func (pe *PipelineEngine) joinGroup(pipeline *Pipeline, job *Job) {
+	group := jobGroup(job)
+	if group == "" {
+		return
+	}
+
+	g, ok := pe.groups[group]
+	if !ok {
+		g = &concurrencyGroup{}
+		pe.groups[group] = g
+	}
+	if g.pending != "" {
+		pe.supersede(g.pending, job)
+		g.pending = ""
+	}
+	if g.running != "" && pipeline.CancelInProgress {
+		pe.supersede(g.running, job)
+	}
+
+	if g.running == "" {
+		g.running = job.ID
+		return
+	}
+	g.pending = job.ID
+	job.Logs = append(job.Logs, LogEntry{
+		Timestamp: time.Now(),
+		Level:     "info",
+		Message:   fmt.Sprintf("waiting for job %s in concurrency group %s", g.running, group),
+	})
+}
+
+// releaseGroup lets the next job of a finished job's concurrency group run
+func (pe *PipelineEngine) releaseGroup(job *Job) {
+	group := jobGroup(job)
+	if group == "" {
+		return
+	}
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	g, ok := pe.groups[group]
+	if !ok || g.running != job.ID {
+		return
+	}
+	g.running = ""
+	// The pending job joins the job queue
+	if run, ok := pe.groupRuns[g.pending]; ok {
+		delete(pe.groupRuns, g.pending)
+		g.running, g.pending = g.pending, ""
+		pe.queueJob(run)
+	}
+	pe.dropGroup(group, g)
+}
+
+// dropGroup forgets a group no job holds. Callers must hold pe.mu.
+func (pe *PipelineEngine) dropGroup(name string, g *concurrencyGroup) {
+	if g.running == "" && g.pending == "" && pe.groups[name] == g {
+		delete(pe.groups, name)
+	}
+}
+
+// supersede cancels a job of a concurrency group in favor of a newer job.
+// Callers must hold pe.mu.
+func (pe *PipelineEngine) supersede(jobID string, newer *Job) {
+	job, ok := pe.jobs[jobID]
+	if !ok {
+		return
+	}
+	if job.Metadata == nil {
+		job.Metadata = make(map[string]interface{})
+	}
+	job.Metadata["supersededBy"] = newer.ID
+	job.Logs = append(job.Logs, LogEntry{
+		Timestamp: time.Now(),
+		Level:     "warn",
+		Message:   fmt.Sprintf("superseded by job %s in concurrency group %s", newer.ID, jobGroup(newer)),
+	})
+	if cancel, ok := pe.cancels[jobID]; ok {
+		cancel()
+	}
+
+	pe.emitEvent(Event{
+		Type:       "job.superseded",
+		Timestamp:  time.Now(),
+		PipelineID: job.PipelineID,
+		JobID:      jobID,
+		Data: map[string]interface{}{
+			"supersededBy": newer.ID,
+			"group":        jobGroup(newer),
+		},
+	})
+}
+
+// ConcurrencyGroups returns the concurrency groups that have a running or
+// pending job
+func (pe *PipelineEngine) ConcurrencyGroups() []ConcurrencyGroupStatus {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	groups := make([]ConcurrencyGroupStatus, 0, len(pe.groups))
+	for name, g := range pe.groups {
+		groups = append(groups, ConcurrencyGroupStatus{Group: name, Running: g.running, Pending: g.pending})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Group < groups[j].Group })
+	return groups
+}
+
+// CancelJob cancels a pending or running job of a pipeline. Its running
+// steps are stopped, the steps it didn't get to are marked cancelled, and
+// job.cancelled is emitted once it has stopped.
+func (pe *PipelineEngine) CancelJob(pipelineID, jobID string) error {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	job, exists := pe.jobs[jobID]
+	if !exists {
+		return fmt.Errorf("job with ID %s not found", jobID)
+	}
+	if job.PipelineID != pipelineID {
+		return fmt.Errorf("job with ID %s is not associated with pipeline %s", jobID, pipelineID)
+	}
+	cancel, running := pe.cancels[jobID]
+	if !running || job.Status.IsTerminal() {
+		return fmt.Errorf("job %s is not running", jobID)
+	}
+	job.Logs = append(job.Logs, LogEntry{
+		Timestamp: time.Now(),
+		Level:     "warn",
+		Message:   "cancellation requested",
+	})
+	cancel()
+	return nil
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// groupPipeline appends its name to order.log when it starts and finishes
+func groupPipeline(id, group string, cancelInProgress bool, sleep string) *Pipeline {
+	pipeline := scriptPipeline(id, "echo start-$NAME >> order.log; sleep "+sleep+"; echo end-$NAME >> order.log")
+	pipeline.ConcurrencyGroup = group
+	pipeline.CancelInProgress = cancelInProgress
+	return pipeline
+}
+
+func startGroupJob(t *testing.T, engine *PipelineEngine, pipelineID, name string) *Job {
+	t.Helper()
+	engine.mu.Lock()
+	engine.pipelines[pipelineID].Environment = map[string]string{"NAME": name}
+	engine.mu.Unlock()
+	job, err := engine.Start(context.Background(), pipelineID)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	return job
+}
+
+func TestConcurrencyGroup_SerializesJobs(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	engine.CreatePipeline(groupPipeline("deploy", "deploy-prod", false, "0.3"))
+
+	first := startGroupJob(t, engine, "deploy", "a")
+	waitForJob(t, engine, "deploy", first.ID, StatusRunning)
+	second := startGroupJob(t, engine, "deploy", "b")
+	if second.Status != StatusPending {
+		t.Errorf("second job status = %s, want pending while the group is busy", second.Status)
+	}
+
+	waitForJob(t, engine, "deploy", first.ID, StatusSuccess)
+	waitForJob(t, engine, "deploy", second.ID, StatusSuccess)
+
+	data, _ := os.ReadFile(filepath.Join(dir, "order.log"))
+	if got := strings.Fields(string(data)); strings.Join(got, " ") != "start-a end-a start-b end-b" {
+		t.Errorf("order = %v, want the jobs to run one after the other", got)
+	}
+	if groups := engine.ConcurrencyGroups(); len(groups) != 0 {
+		t.Errorf("groups = %+v, want none once the jobs finished", groups)
+	}
+}
+
+func TestConcurrencyGroup_NewerJobSupersedesPending(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	engine.CreatePipeline(groupPipeline("deploy", "deploy-prod", false, "0.3"))
+
+	running := startGroupJob(t, engine, "deploy", "a")
+	waitForJob(t, engine, "deploy", running.ID, StatusRunning)
+	superseded := startGroupJob(t, engine, "deploy", "b")
+	latest := startGroupJob(t, engine, "deploy", "c")
+
+	job := waitForJob(t, engine, "deploy", superseded.ID, StatusCancelled)
+	if job.Metadata["supersededBy"] != latest.ID {
+		t.Errorf("supersededBy = %v, want %s", job.Metadata["supersededBy"], latest.ID)
+	}
+	waitForJob(t, engine, "deploy", running.ID, StatusSuccess)
+	waitForJob(t, engine, "deploy", latest.ID, StatusSuccess)
+}
+
+func TestConcurrencyGroup_CancelInProgress(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	engine.CreatePipeline(groupPipeline("pr", "pr-${{ trigger.pr }}", true, "5"))
+
+	start := func(pr string) *Job {
+		job, err := engine.Start(context.Background(), "pr", WithTrigger(map[string]string{"pr": pr}))
+		if err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		return job
+	}
+
+	old := start("7")
+	other := start("8")
+	waitForJob(t, engine, "pr", old.ID, StatusRunning)
+	waitForJob(t, engine, "pr", other.ID, StatusRunning)
+
+	newer := start("7")
+	job := waitForJob(t, engine, "pr", old.ID, StatusCancelled)
+	if job.Metadata["supersededBy"] != newer.ID {
+		t.Errorf("supersededBy = %v, want %s", job.Metadata["supersededBy"], newer.ID)
+	}
+	waitForJob(t, engine, "pr", newer.ID, StatusRunning)
+
+	// A different pull request is in its own group and keeps running
+	if snapshot := engine.snapshotJob(engine.jobs[other.ID]); snapshot.Status != StatusRunning {
+		t.Errorf("job of pr 8 status = %s, want running", snapshot.Status)
+	}
+	if err := engine.CancelJob("pr", newer.ID); err != nil {
+		t.Fatalf("CancelJob() error = %v", err)
+	}
+	engine.CancelJob("pr", other.ID)
+	waitForJob(t, engine, "pr", newer.ID, StatusCancelled)
+}
+
+func TestValidateConcurrencyGroup(t *testing.T) {
+	tests := []struct {
+		group   string
+		wantErr bool
+	}{
+		{"deploy-prod", false},
+		{"pr-${{ trigger.pr }}", false},
+		{"deploy-${{ revision.branch }}", false},
+		{"${{pipeline.id}}-${{ trigger.branch }}", false},
+		{"${{ secrets.TOKEN }}", true},
+		{"pr-${{ trigger.pr", true},
+	}
+	for _, tt := range tests {
+		if err := ValidateConcurrencyGroup(tt.group); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateConcurrencyGroup(%q) error = %v, wantErr %v", tt.group, err, tt.wantErr)
+		}
+	}
+
+	pipeline := &Pipeline{ID: "web", ConcurrencyGroup: "${{ pipeline.id }}-${{ trigger.branch }}${{ trigger.missing }}"}
+	if got := resolveGroup(pipeline, map[string]string{"branch": "main"}, nil); got != "web-main" {
+		t.Errorf("resolveGroup() = %q, want web-main", got)
+	}
+}
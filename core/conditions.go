@@ -0,0 +1,112 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConditionMatch is whether a finished job matches a condition
+type ConditionMatch struct {
+	PipelineID string    `json:"pipelineId"`
+	JobID      string    `json:"jobId"`
+	Status     Status    `json:"status"`
+	EndedAt    time.Time `json:"endedAt"`
+	Matched    bool      `json:"matched"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// conditionSource returns the expression of a condition, which may be
+// written bare or as ${{ ... }}
+func conditionSource(condition string) string {
+	source := strings.TrimSpace(condition)
+	if strings.HasPrefix(source, "${{") && strings.HasSuffix(source, "}}") {
+		source = strings.TrimSpace(source[3 : len(source)-2])
+	}
+	return source
+}
+
+// ValidateCondition checks a condition over a job, such as
+// job.status == 'failed' && trigger.branch == 'main'. hashFiles can't be
+// used, since a finished job has no files to hash.
+func ValidateCondition(condition string) error {
+	node, err := parseExpression(conditionSource(condition))
+	if err != nil {
+		return fmt.Errorf("invalid condition %q: %w", condition, err)
+	}
+	for _, name := range expressionFunctionsUsed(node) {
+		if expressionFunctions[name].needsDir {
+			return fmt.Errorf("%s can't be used in conditions", name)
+		}
+	}
+	return nil
+}
+
+// EvaluateCondition evaluates a condition with the values of references,
+// such as those of JobValues
+func EvaluateCondition(condition string, values map[string]string) (bool, error) {
+	if err := ValidateCondition(condition); err != nil {
+		return false, err
+	}
+	value, err := evaluateExpression(conditionSource(condition), expressionScope{values: values})
+	if err != nil {
+		return false, err
+	}
+	return truthy(value), nil
+}
+
+// JobValues returns the values conditions over a job can reference: those
+// of steps, and job.status, job.failureClass, job.durationSeconds,
+// job.durationMinutes and job.retryOf
+func JobValues(job *Job) map[string]string {
+	values := referenceValues(&Pipeline{ID: job.PipelineID}, job.ID, triggerValues(job.Metadata), job.Revision)
+	values["job.status"] = string(job.Status)
+	values["job.failureClass"] = job.FailureClass
+	if !job.StartedAt.IsZero() {
+		end := job.EndedAt
+		if end.IsZero() {
+			end = time.Now()
+		}
+		duration := end.Sub(job.StartedAt)
+		values["job.durationSeconds"] = strconv.FormatFloat(math.Round(duration.Seconds()), 'f', -1, 64)
+		values["job.durationMinutes"] = strconv.FormatFloat(math.Round(duration.Minutes()*100)/100, 'f', -1, 64)
+	}
+	if retryOf, ok := job.Metadata["retryOf"]; ok {
+		values["job.retryOf"] = fmt.Sprint(retryOf)
+	}
+	return values
+}
+
+// ConditionMatches evaluates a condition against the jobs that finished
+// since a time, of one pipeline when pipelineID is set, returning the most
+// recent limit of them, newest first
+func (pe *PipelineEngine) ConditionMatches(condition, pipelineID string, since time.Time, limit int) ([]ConditionMatch, error) {
+	if err := ValidateCondition(condition); err != nil {
+		return nil, err
+	}
+	jobs := pe.FinishedJobs(since, time.Now().Add(time.Second))
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].EndedAt.After(jobs[j].EndedAt)
+	})
+
+	matches := make([]ConditionMatch, 0)
+	for _, job := range jobs {
+		if pipelineID != "" && job.PipelineID != pipelineID {
+			continue
+		}
+		if limit > 0 && len(matches) == limit {
+			break
+		}
+		match := ConditionMatch{PipelineID: job.PipelineID, JobID: job.ID, Status: job.Status, EndedAt: job.EndedAt}
+		matched, err := EvaluateCondition(condition, JobValues(job))
+		if err != nil {
+			match.Error = err.Error()
+		}
+		match.Matched = matched
+		matches = append(matches, match)
+	}
+	return matches, nil
+}
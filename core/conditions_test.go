@@ -0,0 +1,85 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluateCondition(t *testing.T) {
+	start := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	job := &Job{
+		ID:           "job-1",
+		PipelineID:   "build",
+		Status:       StatusFailed,
+		FailureClass: FailureTest,
+		StartedAt:    start,
+		EndedAt:      start.Add(90 * time.Second),
+		Metadata:     map[string]interface{}{"trigger": map[string]string{"branch": "main"}},
+		Revision:     &Revision{Branch: "main"},
+	}
+	values := JobValues(job)
+	if values["job.durationMinutes"] != "1.5" || values["job.durationSeconds"] != "90" {
+		t.Errorf("JobValues() durations = %s min, %s s", values["job.durationMinutes"], values["job.durationSeconds"])
+	}
+
+	tests := map[string]bool{
+		"job.status == 'failed' && trigger.branch == 'main'":   true,
+		"${{ job.durationMinutes > 1 }}":                       true,
+		"job.durationMinutes >= 2 || job.failureClass == 'x'":  false,
+		"job.durationSeconds < 100 && revision.branch <= 'n'":  true,
+		"!(job.failureClass == 'test') || pipeline.id != 'ok'": true,
+		"trigger.missing": false,
+	}
+	for condition, want := range tests {
+		got, err := EvaluateCondition(condition, values)
+		if err != nil {
+			t.Errorf("EvaluateCondition(%q) error = %v", condition, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("EvaluateCondition(%q) = %v, want %v", condition, got, want)
+		}
+	}
+
+	if err := ValidateCondition("hashFiles('go.sum') != ''"); err == nil || !strings.Contains(err.Error(), "hashFiles can't be used in conditions") {
+		t.Errorf("ValidateCondition() error = %v, want hashFiles rejected", err)
+	}
+	if err := ValidateCondition("job.status = 'failed'"); err == nil {
+		t.Error("ValidateCondition() = nil, want a syntax error")
+	}
+}
+
+func TestConditionMatches(t *testing.T) {
+	engine := newTestEngine()
+	engine.CreatePipeline(scriptPipeline("ok", "true"))
+	engine.CreatePipeline(scriptPipeline("broken", "exit 1"))
+	for _, id := range []string{"ok", "broken", "broken"} {
+		engine.Run(context.Background(), id)
+	}
+
+	matches, err := engine.ConditionMatches("job.status == 'failed'", "", time.Now().Add(-time.Hour), 0)
+	if err != nil {
+		t.Fatalf("ConditionMatches() error = %v", err)
+	}
+	matched := 0
+	for _, match := range matches {
+		if match.Matched != (match.PipelineID == "broken") {
+			t.Errorf("match = %+v", match)
+		}
+		if match.Matched {
+			matched++
+		}
+	}
+	if len(matches) != 3 || matched != 2 {
+		t.Errorf("ConditionMatches() = %d jobs, %d matched, want 3 and 2", len(matches), matched)
+	}
+
+	if matches, _ := engine.ConditionMatches("true", "broken", time.Now().Add(-time.Hour), 1); len(matches) != 1 || matches[0].PipelineID != "broken" {
+		t.Errorf("ConditionMatches() of one pipeline with a limit = %+v", matches)
+	}
+	if _, err := engine.ConditionMatches("job.status ==", "", time.Time{}, 0); err == nil {
+		t.Error("ConditionMatches() error = nil, want the invalid condition")
+	}
+}
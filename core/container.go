@@ -0,0 +1,249 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// containerWorkspace is where a step's directory is mounted in its container
+const containerWorkspace = "/workspace"
+
+// dockerStartFailed is the exit code of docker run when the container
+// couldn't be created or started
+const dockerStartFailed = 125
+
+var containerCounter uint64
+
+// ContainerExecutor runs the commands of steps in a container of the step's
+// image with the docker CLI. The step's directory is mounted as the
+// container's working directory, and its environment is passed by name so
+// secrets never appear on a command line. Steps with services run on a
+// network of their own the services join, and reach them by name. Steps
+// with a network policy run on an internal network instead, whose only way
+// out is the egress proxy.
+type ContainerExecutor struct {
+	// Binary is the docker binary. Defaults to "docker".
+	Binary string
+	// Dir is the directory mounted for steps the engine gives no directory.
+	// Defaults to the current directory.
+	Dir string
+	// Network is the network containers of steps without services join.
+	// Defaults to docker's "bridge" network.
+	Network string
+	// User runs commands as another user than the image's, such as
+	// "1000:1000", so files they write stay the server's
+	User string
+	// Pull is when images are pulled: missing, always or never. Defaults
+	// to docker's default, missing.
+	Pull string
+}
+
+// WithContainerExecutor runs the command steps that name an image with
+// executor instead of their runner's executor. Steps on agents run on the
+// agent as before.
+func WithContainerExecutor(executor StepExecutor) Option {
+	return func(pe *PipelineEngine) {
+		pe.containers = executor
+	}
+}
+
+// WorkingDir returns the directory mounted for steps without one
+func (e *ContainerExecutor) WorkingDir() string {
+	return e.Dir
+}
+
+// Execute runs the step command in a container with the executor's
+// directory mounted
+func (e *ContainerExecutor) Execute(ctx context.Context, step Step, env map[string]string) (*StepResult, error) {
+	return e.ExecuteIn(ctx, e.Dir, step, env)
+}
+
+// ExecuteIn runs the step command in a container of the step's image with
+// dir mounted as its working directory, and captures its combined output
+func (e *ContainerExecutor) ExecuteIn(ctx context.Context, dir string, step Step, env map[string]string) (*StepResult, error) {
+	if strings.TrimSpace(step.Command) == "" {
+		return nil, fmt.Errorf("step %s has no command", step.ID)
+	}
+	if step.Image == "" {
+		return nil, fmt.Errorf("step %s has no image", step.ID)
+	}
+	mount, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve the directory of step %s: %w", step.ID, err)
+	}
+
+	name := fmt.Sprintf("conveyor-%d-%d", time.Now().Unix(), atomic.AddUint64(&containerCounter, 1))
+	network := e.Network
+	if network == "" {
+		network = "bridge"
+	}
+	services := runningServices(ctx)
+	if isolation := egressIsolation(ctx); isolation != nil {
+		network = isolation.Network
+	} else if len(services) > 0 {
+		network = name
+		docker := &DockerRuntime{Binary: e.Binary}
+		if err := docker.CreateNetwork(ctx, network); err != nil {
+			return nil, &InfrastructureError{Err: fmt.Errorf("failed to create the step's network: %w", err)}
+		}
+		defer func() {
+			cleanupCtx, cancel := context.WithTimeout(context.Background(), serviceStopTimeout)
+			defer cancel()
+			docker.RemoveNetwork(cleanupCtx, network)
+		}()
+	}
+	if len(services) > 0 {
+		leave, err := e.joinServices(ctx, network, services)
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+		env = networkServiceEnv(env, services)
+	}
+
+	cmd := exec.Command(e.binary(), e.runArgs(name, network, mount, step, env)...)
+	cmd.Env = os.Environ()
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+
+	result, err := runCommand(ctx, cmd)
+	if ctx.Err() != nil {
+		// Killing the CLI leaves the container running
+		e.remove(name)
+	}
+	var infra *InfrastructureError
+	if err != nil && result != nil && result.ExitCode == dockerStartFailed && !errors.As(err, &infra) {
+		return result, &InfrastructureError{Err: fmt.Errorf("failed to start a container of %s: %s", step.Image, lastLine(result.Output))}
+	}
+	return result, err
+}
+
+// IsolateEgress creates an internal network for a step with a network
+// policy. Containers on it have no route off the network, so the egress
+// proxy, listening on the network's gateway address on the host, is their
+// only way out.
+func (e *ContainerExecutor) IsolateEgress(ctx context.Context, step Step) (*EgressIsolation, error) {
+	docker := &DockerRuntime{Binary: e.Binary}
+	network := fmt.Sprintf("conveyor-egress-%d-%d", time.Now().Unix(), atomic.AddUint64(&containerCounter, 1))
+	if _, err := docker.run(ctx, "network", "create", "--internal", network); err != nil {
+		return nil, &InfrastructureError{Err: fmt.Errorf("failed to create the internal network of step %s: %w", step.ID, err)}
+	}
+	remove := func() {
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), serviceStopTimeout)
+		defer cancel()
+		docker.RemoveNetwork(cleanupCtx, network)
+	}
+
+	gateways, err := docker.run(ctx, "network", "inspect", "--format", "{{range .IPAM.Config}}{{.Gateway}} {{end}}", network)
+	if err != nil {
+		remove()
+		return nil, &InfrastructureError{Err: fmt.Errorf("failed to inspect the internal network of step %s: %w", step.ID, err)}
+	}
+	for _, gateway := range strings.Fields(gateways) {
+		if ip := net.ParseIP(gateway); ip != nil && ip.To4() != nil {
+			return &EgressIsolation{Network: network, ProxyHost: ip.String(), Remove: remove}, nil
+		}
+	}
+	remove()
+	return nil, &InfrastructureError{Err: fmt.Errorf("the internal network of step %s has no IPv4 gateway", step.ID)}
+}
+
+// joinServices connects a step's services to its network by name. The
+// returned function disconnects them, once the step's container is gone.
+func (e *ContainerExecutor) joinServices(ctx context.Context, network string, services []*RunningService) (func(), error) {
+	docker := &DockerRuntime{Binary: e.Binary}
+	var connected []*RunningService
+	leave := func() {
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), serviceStopTimeout)
+		defer cancel()
+		for _, service := range connected {
+			docker.run(cleanupCtx, "network", "disconnect", "--force", network, service.ContainerID)
+		}
+	}
+	for _, service := range services {
+		if _, err := docker.run(ctx, "network", "connect", "--alias", service.Name, network, service.ContainerID); err != nil {
+			leave()
+			return nil, &InfrastructureError{Err: fmt.Errorf("failed to connect service %s to the step's network: %w", service.Name, err)}
+		}
+		connected = append(connected, service)
+	}
+	return leave, nil
+}
+
+// networkServiceEnv returns a copy of env in which the service variables
+// point at the services' names and ports on the step's network. Behind an
+// egress proxy, the names bypass it.
+func networkServiceEnv(env map[string]string, services []*RunningService) map[string]string {
+	copied := make(map[string]string, len(env))
+	for key, value := range env {
+		copied[key] = value
+	}
+	for _, service := range services {
+		for key, value := range networkServiceVariables(service) {
+			copied[key] = value
+		}
+		if copied["NO_PROXY"] != "" {
+			copied["NO_PROXY"] += "," + service.Name
+			copied["no_proxy"] = copied["NO_PROXY"]
+		}
+	}
+	return copied
+}
+
+// runArgs returns the docker run arguments of a step
+func (e *ContainerExecutor) runArgs(name, network, mount string, step Step, env map[string]string) []string {
+	args := []string{"run", "--rm", "--name", name, "--network", network,
+		"--volume", mount + ":" + containerWorkspace, "--workdir", containerWorkspace}
+	if e.User != "" {
+		args = append(args, "--user", e.User)
+	}
+	if e.Pull != "" {
+		args = append(args, "--pull", e.Pull)
+	}
+
+	names := make([]string, 0, len(env))
+	for key := range env {
+		if key != "CONVEYOR_WORKSPACE" {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	for _, key := range names {
+		args = append(args, "--env", key)
+	}
+	if _, ok := env["CONVEYOR_WORKSPACE"]; ok {
+		args = append(args, "--env", "CONVEYOR_WORKSPACE="+containerWorkspace)
+	}
+	return append(args, "--entrypoint", "sh", step.Image, "-c", step.Command)
+}
+
+// remove force-removes a container that outlived its step
+func (e *ContainerExecutor) remove(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), serviceStopTimeout)
+	defer cancel()
+	exec.CommandContext(ctx, e.binary(), "rm", "--force", name).Run()
+}
+
+func (e *ContainerExecutor) binary() string {
+	if e.Binary == "" {
+		return "docker"
+	}
+	return e.Binary
+}
+
+// lastLine returns the last non-empty line of output, where docker reports
+// why it failed
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
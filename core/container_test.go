@@ -0,0 +1,247 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDocker writes a docker binary that prints its arguments and the value
+// of TOKEN, and exits with code
+func fakeDocker(t *testing.T, code string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake docker binary is a shell script")
+	}
+	binary := filepath.Join(t.TempDir(), "docker")
+	script := "#!/bin/sh\necho \"$@\"\necho \"token=$TOKEN\"\nexit " + code + "\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return binary
+}
+
+func TestContainerExecutor_RunsStepInImage(t *testing.T) {
+	dir := t.TempDir()
+	executor := &ContainerExecutor{Binary: fakeDocker(t, "0"), User: "1000:1000"}
+	step := Step{ID: "test", Image: "golang:1.16", Command: "go test ./..."}
+	env := map[string]string{"TOKEN": "s3cret", "CONVEYOR_WORKSPACE": dir}
+
+	result, err := executor.ExecuteIn(context.Background(), dir, step, env)
+	if err != nil {
+		t.Fatalf("ExecuteIn() error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(result.Output), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Output = %q, want the arguments and the token", result.Output)
+	}
+	args := lines[0]
+	for _, want := range []string{
+		"run --rm --name conveyor-",
+		"--network bridge --volume " + dir + ":/workspace --workdir /workspace --user 1000:1000",
+		"--env TOKEN --env CONVEYOR_WORKSPACE=/workspace --entrypoint sh golang:1.16 -c go test ./...",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("arguments %q, want %q", args, want)
+		}
+	}
+	if strings.Contains(args, "s3cret") {
+		t.Errorf("arguments %q contain the secret", args)
+	}
+	if lines[1] != "token=s3cret" {
+		t.Errorf("environment %q, want the token passed to docker", lines[1])
+	}
+}
+
+func TestContainerExecutor_Services(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake docker binary is a shell script")
+	}
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	binary := filepath.Join(dir, "docker")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\necho \"db=$DB_HOST:$DB_PORT\"\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	db := &RunningService{Service: Service{Name: "db", Ports: []int{5432}}, ContainerID: "c0ffee", Addresses: map[int]string{5432: "127.0.0.1:49153"}}
+	ctx := withServices(context.Background(), []*RunningService{db})
+	env := map[string]string{}
+	for key, value := range serviceEnv(ctx) {
+		env[key] = value
+	}
+	result, err := (&ContainerExecutor{Binary: binary}).ExecuteIn(ctx, dir, Step{ID: "test", Image: "golang:1.16", Command: "go test"}, env)
+	if err != nil {
+		t.Fatalf("ExecuteIn() error = %v", err)
+	}
+	if result.Output != "db=db:5432\n" {
+		t.Errorf("Output = %q, want the service's name and container port", result.Output)
+	}
+
+	data, _ := os.ReadFile(calls)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("docker calls = %q, want the network created, joined, used and removed", lines)
+	}
+	network := strings.TrimPrefix(lines[0], "network create ")
+	for i, want := range []string{
+		"network connect --alias db " + network + " c0ffee",
+		"run --rm --name " + network + " --network " + network + " ",
+		"network disconnect --force " + network + " c0ffee",
+		"network rm " + network,
+	} {
+		if !strings.HasPrefix(lines[i+1], want) {
+			t.Errorf("docker call %d = %q, want %q", i+1, lines[i+1], want)
+		}
+	}
+}
+
+func TestContainerExecutor_IsolateEgress(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake docker binary is a shell script")
+	}
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	binary := filepath.Join(dir, "docker")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n" +
+		"if [ \"$2\" = inspect ]; then echo 'fd00::1 172.30.0.1 '; exit 0; fi\n" +
+		"echo \"no_proxy=$NO_PROXY\"\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	executor := &ContainerExecutor{Binary: binary}
+	step := Step{ID: "test", Image: "golang:1.16", Command: "go test"}
+
+	isolation, err := executor.IsolateEgress(context.Background(), step)
+	if err != nil {
+		t.Fatalf("IsolateEgress() error = %v", err)
+	}
+	if isolation.ProxyHost != "172.30.0.1" {
+		t.Errorf("ProxyHost = %q, want the network's IPv4 gateway", isolation.ProxyHost)
+	}
+
+	db := &RunningService{Service: Service{Name: "db", Ports: []int{5432}}, ContainerID: "c0ffee"}
+	ctx := withServices(context.WithValue(context.Background(), egressIsolationKey{}, isolation), []*RunningService{db})
+	result, err := executor.ExecuteIn(ctx, dir, step, map[string]string{"NO_PROXY": "localhost"})
+	if err != nil {
+		t.Fatalf("ExecuteIn() error = %v", err)
+	}
+	if result.Output != "no_proxy=localhost,db\n" {
+		t.Errorf("Output = %q, want the service to bypass the proxy", result.Output)
+	}
+	isolation.Remove()
+
+	data, _ := os.ReadFile(calls)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	network := isolation.Network
+	want := []string{
+		"network create --internal " + network,
+		"network inspect --format {{range .IPAM.Config}}{{.Gateway}} {{end}} " + network,
+		"network connect --alias db " + network + " c0ffee",
+		"run --rm --name ",
+		"network disconnect --force " + network + " c0ffee",
+		"network rm " + network,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("docker calls = %q, want the internal network created, used and removed", lines)
+	}
+	for i := range want {
+		if !strings.HasPrefix(lines[i], want[i]) {
+			t.Errorf("docker call %d = %q, want %q", i, lines[i], want[i])
+		}
+	}
+	if !strings.Contains(lines[3], " --network "+network+" ") {
+		t.Errorf("docker run = %q, want the step on the internal network", lines[3])
+	}
+}
+
+func TestRun_ContainerOutputStreams(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake docker binary is a shell script")
+	}
+	dir := t.TempDir()
+	release := filepath.Join(dir, "release")
+	binary := filepath.Join(dir, "docker")
+	script := "#!/bin/sh\necho first\nwhile [ ! -f " + release + " ]; do sleep 0.05; done\necho second\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	engine := newTestEngine(WithContainerExecutor(&ContainerExecutor{Binary: binary, Dir: dir}))
+	pipeline := scriptPipeline("stream", "make")
+	pipeline.Stages[0].Steps[0].Image = "golang:1.16"
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Start(context.Background(), "stream")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		snapshot, err := engine.JobSnapshot(job.ID)
+		if err != nil {
+			t.Fatalf("JobSnapshot() error = %v", err)
+		}
+		if len(snapshot.Steps) == 1 && snapshot.Steps[0].Output == "first\n" {
+			if snapshot.Steps[0].Status != StatusRunning {
+				t.Fatalf("step status = %q, want the output while the step runs", snapshot.Steps[0].Status)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("step output = %+v, want the first line before the step ends", snapshot.Steps)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := os.WriteFile(release, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	done := waitForJob(t, engine, "stream", job.ID, StatusSuccess)
+	if done.Steps[0].Output != "first\nsecond\n" {
+		t.Errorf("Output = %q, want the full output once the step ends", done.Steps[0].Output)
+	}
+}
+
+func TestContainerExecutor_ExitCodes(t *testing.T) {
+	step := Step{ID: "test", Image: "golang:1.16", Command: "false"}
+
+	result, err := (&ContainerExecutor{Binary: fakeDocker(t, "3")}).Execute(context.Background(), step, nil)
+	var infra *InfrastructureError
+	if err == nil || errors.As(err, &infra) || result.ExitCode != 3 {
+		t.Errorf("Execute() = %+v, %v, want a step failure with exit code 3", result, err)
+	}
+
+	_, err = (&ContainerExecutor{Binary: fakeDocker(t, "125")}).Execute(context.Background(), step, nil)
+	if !errors.As(err, &infra) {
+		t.Errorf("Execute() error = %v, want an infrastructure error when the container doesn't start", err)
+	}
+
+	if _, err := (&ContainerExecutor{}).Execute(context.Background(), Step{ID: "test", Command: "true"}, nil); err == nil {
+		t.Error("Execute() without an image error = nil, want error")
+	}
+}
+
+func TestRun_ImageStepsRunInContainers(t *testing.T) {
+	shell, containers := &recordingExecutor{}, &recordingExecutor{}
+	engine := newTestEngine(WithExecutor(shell), WithContainerExecutor(containers))
+	pipeline := scriptPipeline("images", "echo build", "echo test")
+	pipeline.Stages[0].Steps[1].Image = "golang:1.16"
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "images")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess {
+		t.Fatalf("Status = %q, want success; logs: %+v", job.Status, job.Logs)
+	}
+	if strings.Join(shell.steps, ",") != "build-step-a" || strings.Join(containers.steps, ",") != "build-step-b" {
+		t.Errorf("shell ran %v and containers ran %v, want the image step in a container", shell.steps, containers.steps)
+	}
+}
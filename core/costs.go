@@ -0,0 +1,314 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// CostRates price the resources steps use. Steps are charged for the CPU
+// and memory they request for as long as they execute, plus the per-minute
+// rate of the runner they ran on.
+type CostRates struct {
+	Currency string `json:"currency,omitempty"`
+	// CPUMinute is the price of one core for a minute
+	CPUMinute float64 `json:"cpuMinute,omitempty"`
+	// GBMinute is the price of one GiB of memory for a minute
+	GBMinute float64 `json:"gbMinute,omitempty"`
+	// Runners maps runner names or labels to a price per minute. A runner
+	// named in the map uses its own rate, otherwise the highest rate of its
+	// labels.
+	Runners map[string]float64 `json:"runners,omitempty"`
+	// Carbon enables estimates of the energy and emissions of jobs
+	Carbon *CarbonFactors `json:"carbon,omitempty"`
+}
+
+// CarbonFactors estimate the energy steps use from the CPU and memory they
+// request, and its emissions from the carbon intensity of the grid the
+// runner draws from. Steps that request no CPU are counted as one core.
+type CarbonFactors struct {
+	// GridIntensity is the default grid intensity in gCO2e per kWh
+	GridIntensity float64 `json:"gridIntensity"`
+	// Runners maps runner names or labels, such as a region, to their grid
+	// intensity. A runner named in the map uses its own intensity,
+	// otherwise the highest intensity of its labels.
+	Runners map[string]float64 `json:"runners,omitempty"`
+	// CPUWatts is the power draw of one core, 10 W by default
+	CPUWatts float64 `json:"cpuWatts,omitempty"`
+	// GBWatts is the power draw of one GiB of memory, 0.4 W by default
+	GBWatts float64 `json:"gbWatts,omitempty"`
+	// PUE is the power usage effectiveness of the data center, 1 by default
+	PUE float64 `json:"pue,omitempty"`
+}
+
+// Defaults of carbon factors
+const (
+	defaultCPUWatts = 10
+	defaultGBWatts  = 0.4
+)
+
+// energy returns the kWh used by cpuMinutes and gbMinutes
+func (f *CarbonFactors) energy(cpuMinutes, gbMinutes float64) float64 {
+	cpuWatts, gbWatts, pue := f.CPUWatts, f.GBWatts, f.PUE
+	if cpuWatts == 0 {
+		cpuWatts = defaultCPUWatts
+	}
+	if gbWatts == 0 {
+		gbWatts = defaultGBWatts
+	}
+	if pue == 0 {
+		pue = 1
+	}
+	return (cpuMinutes*cpuWatts + gbMinutes*gbWatts) / 60 / 1000 * pue
+}
+
+// StepCost is the estimated cost of a step
+type StepCost struct {
+	StepID     string  `json:"stepId"`
+	Runner     string  `json:"runner,omitempty"`
+	Minutes    float64 `json:"minutes"`
+	CPUMinutes float64 `json:"cpuMinutes,omitempty"`
+	GBMinutes  float64 `json:"gbMinutes,omitempty"`
+	Cost       float64 `json:"cost"`
+	// EnergyKWh and CarbonGrams are set when carbon estimates are enabled
+	EnergyKWh   float64 `json:"energyKWh,omitempty"`
+	CarbonGrams float64 `json:"carbonGrams,omitempty"`
+}
+
+// JobCost is the estimated cost of a job
+type JobCost struct {
+	JobID       string     `json:"jobId"`
+	PipelineID  string     `json:"pipelineId"`
+	Team        string     `json:"team,omitempty"`
+	Month       string     `json:"month"`
+	Currency    string     `json:"currency,omitempty"`
+	Minutes     float64    `json:"minutes"`
+	CPUMinutes  float64    `json:"cpuMinutes"`
+	GBMinutes   float64    `json:"gbMinutes"`
+	Total       float64    `json:"total"`
+	EnergyKWh   float64    `json:"energyKWh,omitempty"`
+	CarbonGrams float64    `json:"carbonGrams,omitempty"`
+	Steps       []StepCost `json:"steps"`
+}
+
+// CostSummary aggregates the cost of jobs sharing a pipeline, team or month
+type CostSummary struct {
+	Key         string  `json:"key"`
+	Jobs        int     `json:"jobs"`
+	Minutes     float64 `json:"minutes"`
+	CPUMinutes  float64 `json:"cpuMinutes"`
+	GBMinutes   float64 `json:"gbMinutes"`
+	Total       float64 `json:"total"`
+	EnergyKWh   float64 `json:"energyKWh,omitempty"`
+	CarbonGrams float64 `json:"carbonGrams,omitempty"`
+}
+
+// CostTrend is the cost of a pipeline's jobs per month
+type CostTrend struct {
+	PipelineID string        `json:"pipelineId"`
+	Months     []CostSummary `json:"months"`
+}
+
+// CostFilter selects the jobs of a cost report. Empty fields match all.
+type CostFilter struct {
+	PipelineID string
+	Team       string
+	// Month is a month in the form 2006-01
+	Month string
+}
+
+// CostReport aggregates estimated job costs per pipeline, team and month,
+// and per pipeline and month for trends. Pipelines and teams are sorted by
+// descending cost, months by date.
+type CostReport struct {
+	Rates       CostRates     `json:"rates"`
+	Jobs        int           `json:"jobs"`
+	Total       float64       `json:"total"`
+	EnergyKWh   float64       `json:"energyKWh,omitempty"`
+	CarbonGrams float64       `json:"carbonGrams,omitempty"`
+	Pipelines   []CostSummary `json:"pipelines"`
+	Teams       []CostSummary `json:"teams"`
+	Months      []CostSummary `json:"months"`
+	Trends      []CostTrend   `json:"trends"`
+}
+
+// costMonthFormat is the layout of report months
+const costMonthFormat = "2006-01"
+
+// WithCostRates sets the rates job costs are estimated with
+func WithCostRates(rates CostRates) Option {
+	return func(pe *PipelineEngine) {
+		pe.costRates = rates
+	}
+}
+
+// stepMinutes returns the execution time of a step in minutes. Time spent
+// waiting for a runner or services is not charged.
+func stepMinutes(step StepStatus, now time.Time) float64 {
+	return executionTime(step, now).Minutes()
+}
+
+// runnerValue looks a runner up in values by name, then by label, taking
+// the highest value of its labels. Callers must hold pe.mu.
+func (pe *PipelineEngine) runnerValue(values map[string]float64, name string) (float64, bool) {
+	if value, ok := values[name]; ok {
+		return value, true
+	}
+	found, highest := false, 0.0
+	for _, runner := range pe.runners {
+		if runner.Name != name {
+			continue
+		}
+		for _, label := range runner.Labels {
+			for key, value := range values {
+				if strings.EqualFold(key, label) && (!found || value > highest) {
+					found, highest = true, value
+				}
+			}
+		}
+	}
+	return highest, found
+}
+
+// jobCost estimates the cost of a job. Steps that are still running are
+// charged up to now. Callers must hold pe.mu.
+func (pe *PipelineEngine) jobCost(job *Job, now time.Time) *JobCost {
+	started := job.StartedAt
+	if started.IsZero() {
+		started = job.QueuedAt
+	}
+	cost := &JobCost{
+		JobID:      job.ID,
+		PipelineID: job.PipelineID,
+		Month:      started.Format(costMonthFormat),
+		Currency:   pe.costRates.Currency,
+		Steps:      make([]StepCost, 0, len(job.Steps)),
+	}
+	if pipeline, ok := pe.pipelines[job.PipelineID]; ok {
+		cost.Team = pipeline.Team
+	}
+
+	for _, step := range job.Steps {
+		minutes := stepMinutes(step, now)
+		stepCost := StepCost{StepID: step.ID, Runner: step.Runner, Minutes: minutes}
+		if step.Resources != nil {
+			stepCost.CPUMinutes = step.Resources.CPU * minutes
+			stepCost.GBMinutes = float64(step.Resources.Memory) / (1 << 30) * minutes
+		}
+		stepCost.Cost = stepCost.CPUMinutes*pe.costRates.CPUMinute + stepCost.GBMinutes*pe.costRates.GBMinute
+		if rate, ok := pe.runnerValue(pe.costRates.Runners, step.Runner); ok {
+			stepCost.Cost += minutes * rate
+		}
+		if factors := pe.costRates.Carbon; factors != nil {
+			cpuMinutes := stepCost.CPUMinutes
+			if step.Resources == nil || step.Resources.CPU == 0 {
+				cpuMinutes = minutes
+			}
+			intensity, ok := pe.runnerValue(factors.Runners, step.Runner)
+			if !ok {
+				intensity = factors.GridIntensity
+			}
+			stepCost.EnergyKWh = factors.energy(cpuMinutes, stepCost.GBMinutes)
+			stepCost.CarbonGrams = stepCost.EnergyKWh * intensity
+		}
+
+		cost.Minutes += stepCost.Minutes
+		cost.CPUMinutes += stepCost.CPUMinutes
+		cost.GBMinutes += stepCost.GBMinutes
+		cost.Total += stepCost.Cost
+		cost.EnergyKWh += stepCost.EnergyKWh
+		cost.CarbonGrams += stepCost.CarbonGrams
+		cost.Steps = append(cost.Steps, stepCost)
+	}
+	return cost
+}
+
+// JobCost returns the estimated cost of a job
+func (pe *PipelineEngine) JobCost(jobID string) (*JobCost, error) {
+	job, err := pe.FindJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	return pe.jobCost(job, time.Now()), nil
+}
+
+// CostReport estimates the cost of the jobs matching filter and aggregates
+// it per pipeline, team and month
+func (pe *PipelineEngine) CostReport(filter CostFilter) *CostReport {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	now := time.Now()
+	report := &CostReport{Rates: pe.costRates}
+	pipelines := make(map[string]*CostSummary)
+	teams := make(map[string]*CostSummary)
+	months := make(map[string]*CostSummary)
+	trends := make(map[string]map[string]*CostSummary)
+	for _, job := range pe.jobs {
+		if filter.PipelineID != "" && job.PipelineID != filter.PipelineID {
+			continue
+		}
+		cost := pe.jobCost(job, now)
+		if filter.Team != "" && cost.Team != filter.Team || filter.Month != "" && cost.Month != filter.Month {
+			continue
+		}
+
+		report.Jobs++
+		report.Total += cost.Total
+		report.EnergyKWh += cost.EnergyKWh
+		report.CarbonGrams += cost.CarbonGrams
+		addCost(pipelines, cost.PipelineID, cost)
+		addCost(teams, cost.Team, cost)
+		addCost(months, cost.Month, cost)
+		if trends[cost.PipelineID] == nil {
+			trends[cost.PipelineID] = make(map[string]*CostSummary)
+		}
+		addCost(trends[cost.PipelineID], cost.Month, cost)
+	}
+
+	report.Pipelines = sortedCosts(pipelines, false)
+	report.Teams = sortedCosts(teams, false)
+	report.Months = sortedCosts(months, true)
+	report.Trends = make([]CostTrend, 0, len(report.Pipelines))
+	for _, pipeline := range report.Pipelines {
+		report.Trends = append(report.Trends, CostTrend{
+			PipelineID: pipeline.Key,
+			Months:     sortedCosts(trends[pipeline.Key], true),
+		})
+	}
+	return report
+}
+
+// addCost adds a job's cost to the summary for key
+func addCost(summaries map[string]*CostSummary, key string, cost *JobCost) {
+	summary, ok := summaries[key]
+	if !ok {
+		summary = &CostSummary{Key: key}
+		summaries[key] = summary
+	}
+	summary.Jobs++
+	summary.Minutes += cost.Minutes
+	summary.CPUMinutes += cost.CPUMinutes
+	summary.GBMinutes += cost.GBMinutes
+	summary.Total += cost.Total
+	summary.EnergyKWh += cost.EnergyKWh
+	summary.CarbonGrams += cost.CarbonGrams
+}
+
+// sortedCosts returns summaries by descending cost, or by key when byKey is
+// set
+func sortedCosts(summaries map[string]*CostSummary, byKey bool) []CostSummary {
+	sorted := make([]CostSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		sorted = append(sorted, *summary)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if byKey || sorted[i].Total == sorted[j].Total {
+			return sorted[i].Key < sorted[j].Key
+		}
+		return sorted[i].Total > sorted[j].Total
+	})
+	return sorted
+}
@@ -0,0 +1,174 @@
+package core
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+// costJob returns a finished job whose steps each executed for the given
+// minutes on the given runner
+func costJob(id, pipelineID string, started time.Time, runner string, resources *Resources, minutes ...float64) *Job {
+	job := &Job{ID: id, PipelineID: pipelineID, Status: StatusSuccess, StartedAt: started}
+	at := started
+	for i, m := range minutes {
+		end := at.Add(time.Duration(m * float64(time.Minute)))
+		job.Steps = append(job.Steps, StepStatus{
+			ID:        "step-" + string(rune('a'+i)),
+			Status:    StatusSuccess,
+			StartedAt: at.Add(-time.Minute),
+			EndedAt:   end,
+			Runner:    runner,
+			Resources: resources,
+			Phases: []Phase{
+				{Name: PhaseSetup, StartedAt: at.Add(-time.Minute), EndedAt: at},
+				{Name: PhaseExecution, StartedAt: at, EndedAt: end},
+			},
+		})
+		at = end
+	}
+	job.EndedAt = at
+	return job
+}
+
+func approx(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestJobCost(t *testing.T) {
+	engine := newTestEngine(
+		WithRunners(
+			Runner{Name: "small", Labels: []string{"linux"}},
+			Runner{Name: "gpu-1", Labels: []string{"linux", "gpu"}},
+		),
+		WithCostRates(CostRates{CPUMinute: 0.01, GBMinute: 0.002, Runners: map[string]float64{"linux": 0.1, "GPU": 1}}),
+	)
+	engine.CreatePipeline(&Pipeline{ID: "train", Name: "train", Team: "ml"})
+	started := time.Date(2026, 3, 14, 9, 0, 0, 0, time.UTC)
+	engine.jobs["j1"] = costJob("j1", "train", started, "gpu-1", &Resources{CPU: 2, Memory: 4 << 30}, 10)
+
+	cost, err := engine.JobCost("j1")
+	if err != nil {
+		t.Fatalf("JobCost() error = %v", err)
+	}
+	// 10 minutes, excluding a minute of setup: 20 cpu-minutes at 0.01,
+	// 40 GB-minutes at 0.002 and 10 minutes of the gpu label at 1
+	if !approx(cost.Minutes, 10) || !approx(cost.CPUMinutes, 20) || !approx(cost.GBMinutes, 40) {
+		t.Errorf("usage = %v min, %v cpu-min, %v GB-min, want 10, 20, 40", cost.Minutes, cost.CPUMinutes, cost.GBMinutes)
+	}
+	if !approx(cost.Total, 0.2+0.08+10) {
+		t.Errorf("Total = %v, want 10.28", cost.Total)
+	}
+	if cost.Team != "ml" || cost.Month != "2026-03" {
+		t.Errorf("Team, Month = %q, %q, want ml, 2026-03", cost.Team, cost.Month)
+	}
+}
+
+func TestCostReport(t *testing.T) {
+	engine := newTestEngine(WithCostRates(CostRates{Currency: "USD", Runners: map[string]float64{"local": 1}}))
+	engine.CreatePipeline(&Pipeline{ID: "api", Name: "api", Team: "backend"})
+	engine.CreatePipeline(&Pipeline{ID: "web", Name: "web", Team: "frontend"})
+	engine.CreatePipeline(&Pipeline{ID: "worker", Name: "worker", Team: "backend"})
+	march := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	april := time.Date(2026, 4, 2, 0, 0, 0, 0, time.UTC)
+	engine.jobs["a1"] = costJob("a1", "api", march, "local", nil, 2, 3)
+	engine.jobs["a2"] = costJob("a2", "api", april, "local", nil, 4)
+	engine.jobs["w1"] = costJob("w1", "web", march, "local", nil, 1)
+	engine.jobs["k1"] = costJob("k1", "worker", april, "local", nil, 7)
+
+	report := engine.CostReport(CostFilter{})
+	if report.Jobs != 4 || !approx(report.Total, 17) {
+		t.Fatalf("report = %d jobs, total %v, want 4 jobs, 17", report.Jobs, report.Total)
+	}
+	if len(report.Pipelines) != 3 || report.Pipelines[0].Key != "api" || !approx(report.Pipelines[0].Total, 9) {
+		t.Errorf("Pipelines = %+v, want api first at 9", report.Pipelines)
+	}
+	if len(report.Teams) != 2 || report.Teams[0].Key != "backend" || report.Teams[0].Jobs != 3 || !approx(report.Teams[0].Total, 16) {
+		t.Errorf("Teams = %+v, want backend first with 3 jobs at 16", report.Teams)
+	}
+	if len(report.Months) != 2 || report.Months[0].Key != "2026-03" || !approx(report.Months[1].Total, 11) {
+		t.Errorf("Months = %+v, want 2026-03 then 2026-04 at 11", report.Months)
+	}
+
+	filtered := engine.CostReport(CostFilter{Team: "backend", Month: "2026-04"})
+	if filtered.Jobs != 2 || !approx(filtered.Total, 11) {
+		t.Errorf("filtered report = %d jobs, total %v, want 2 jobs, 11", filtered.Jobs, filtered.Total)
+	}
+}
+
+func TestRun_RecordsStepResources(t *testing.T) {
+	engine := newTestEngine(WithExecutor(&recordingExecutor{}))
+	pipeline := scriptPipeline("sized", "echo a", "echo b")
+	pipeline.Stages[0].Steps[0].Resources = &ResourceRequirements{Requests: Resources{CPU: 0.5}}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "sized")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if r := job.Steps[0].Resources; r == nil || r.CPU != 0.5 {
+		t.Errorf("step a Resources = %+v, want 0.5 cpu", r)
+	}
+	if job.Steps[1].Resources != nil {
+		t.Errorf("step b Resources = %+v, want none", job.Steps[1].Resources)
+	}
+}
+
+func TestJobCost_Carbon(t *testing.T) {
+	engine := newTestEngine(
+		WithRunners(
+			Runner{Name: "eu", Labels: []string{"linux", "eu-north"}},
+			Runner{Name: "us", Labels: []string{"linux", "us-east"}},
+		),
+		WithCostRates(CostRates{Carbon: &CarbonFactors{
+			GridIntensity: 400,
+			Runners:       map[string]float64{"eu-north": 40},
+			CPUWatts:      12,
+			GBWatts:       0.5,
+			PUE:           1.5,
+		}}),
+	)
+	engine.CreatePipeline(&Pipeline{ID: "build", Name: "build"})
+	started := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	engine.jobs["eu"] = costJob("eu", "build", started, "eu", &Resources{CPU: 2, Memory: 4 << 30}, 60)
+	engine.jobs["us"] = costJob("us", "build", started, "us", nil, 60)
+
+	// 2 cores at 12 W and 4 GiB at 0.5 W for an hour, times a PUE of 1.5
+	eu, _ := engine.JobCost("eu")
+	if !approx(eu.EnergyKWh, 0.039) || !approx(eu.CarbonGrams, 0.039*40) {
+		t.Errorf("eu = %v kWh, %v g, want 0.039 kWh at 40 g/kWh", eu.EnergyKWh, eu.CarbonGrams)
+	}
+	// Without requests a step counts as one core, at the default intensity
+	us, _ := engine.JobCost("us")
+	if !approx(us.EnergyKWh, 0.018) || !approx(us.CarbonGrams, 0.018*400) {
+		t.Errorf("us = %v kWh, %v g, want 0.018 kWh at 400 g/kWh", us.EnergyKWh, us.CarbonGrams)
+	}
+
+	report := engine.CostReport(CostFilter{})
+	if !approx(report.CarbonGrams, eu.CarbonGrams+us.CarbonGrams) {
+		t.Errorf("report CarbonGrams = %v, want %v", report.CarbonGrams, eu.CarbonGrams+us.CarbonGrams)
+	}
+}
+
+func TestCostReport_Trends(t *testing.T) {
+	engine := newTestEngine(WithCostRates(CostRates{Runners: map[string]float64{"local": 1}}))
+	engine.CreatePipeline(&Pipeline{ID: "api", Name: "api"})
+	for i, month := range []time.Month{time.January, time.March, time.January} {
+		id := "job-" + string(rune('a'+i))
+		engine.jobs[id] = costJob(id, "api", time.Date(2026, month, 10, 0, 0, 0, 0, time.UTC), "local", nil, float64(i+1))
+	}
+
+	report := engine.CostReport(CostFilter{})
+	if len(report.Trends) != 1 || report.Trends[0].PipelineID != "api" {
+		t.Fatalf("Trends = %+v, want one for api", report.Trends)
+	}
+	months := report.Trends[0].Months
+	if len(months) != 2 || months[0].Key != "2026-01" || months[0].Jobs != 2 || !approx(months[0].Total, 4) ||
+		months[1].Key != "2026-03" || !approx(months[1].Total, 2) {
+		t.Errorf("Months = %+v, want 2026-01 at 4 then 2026-03 at 2", months)
+	}
+	if report.CarbonGrams != 0 {
+		t.Errorf("CarbonGrams = %v without carbon factors, want 0", report.CarbonGrams)
+	}
+}
@@ -0,0 +1,267 @@
+// Package cron parses standard five-field cron expressions and computes
+// when they next fire.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression
+type Schedule struct {
+	expr   string
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// anyDay is set when either day field is "*", in which case both day
+	// fields must match. Otherwise either one matching is enough.
+	anyDay bool
+}
+
+type field struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowField = field{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// descriptors maps the supported @-shorthands to their expressions
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a cron expression with the fields minute, hour, day of month,
+// month and day of week. Fields accept *, lists, ranges, steps and the
+// three-letter English names of months and weekdays. The shorthands
+// @yearly, @monthly, @weekly, @daily and @hourly are also accepted.
+func Parse(expr string) (*Schedule, error) {
+	spec := strings.TrimSpace(expr)
+	if expanded, ok := descriptors[strings.ToLower(spec)]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, got %d", expr, len(fields))
+	}
+
+	schedule := &Schedule{expr: expr}
+	targets := []*uint64{&schedule.minute, &schedule.hour, &schedule.dom, &schedule.month, &schedule.dow}
+	for i, f := range []field{minuteField, hourField, domField, monthField, dowField} {
+		bits, err := f.parse(fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %w", expr, err)
+		}
+		*targets[i] = bits
+	}
+
+	// Sunday may be written as 0 or 7
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+	schedule.anyDay = fields[2] == "*" || fields[4] == "*"
+
+	return schedule, nil
+}
+
+// String returns the expression the schedule was parsed from
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+// Next returns the first time after t that matches the schedule, in t's
+// location. It returns the zero time if nothing matches within five years.
+//
+// A schedule with a restricted hour fires by the wall clock: a time skipped
+// when daylight saving time starts fires when the clock jumps past it, and a
+// time repeated when it ends fires only once, at its first occurrence.
+func (s *Schedule) Next(t time.Time) time.Time {
+	if s.hour&allHours != allHours {
+		return s.nextWallClock(t)
+	}
+
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if !has(s.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !has(s.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+// allHours is the hour field of "*"
+const allHours = 1<<24 - 1
+
+// nextWallClock is Next for schedules that fire at particular hours, walking
+// the calendar days rather than elapsed time
+func (s *Schedule) nextWallClock(t time.Time) time.Time {
+	loc := t.Location()
+	year, month, day := t.Date()
+	for i := 0; i < 5*366; i++ {
+		// Noon is never moved by a daylight saving change
+		date := time.Date(year, month, day+i, 12, 0, 0, 0, loc)
+		if !has(s.month, int(date.Month())) || !s.dayMatches(date) {
+			continue
+		}
+		for hour := 0; hour < 24; hour++ {
+			if !has(s.hour, hour) {
+				continue
+			}
+			for minute := 0; minute < 60; minute++ {
+				if !has(s.minute, minute) {
+					continue
+				}
+				if at := wallClock(date, hour, minute); at.After(t) {
+					return at
+				}
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// wallClock returns the first instant the clock in date's location reads
+// hour:minute on date, or the instant it jumps past that time when daylight
+// saving time skips it
+func wallClock(date time.Time, hour, minute int) time.Time {
+	year, month, day := date.Date()
+	want := time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	at := time.Date(year, month, day, hour, minute, 0, 0, date.Location())
+
+	// time.Date picks either side of a skipped time, so move to the first
+	// instant the clock reads it or later
+	for reading(at).Before(want) {
+		at = at.Add(time.Minute)
+	}
+	for !reading(at.Add(-time.Minute)).Before(want) {
+		at = at.Add(-time.Minute)
+	}
+
+	// A repeated time reads the same an hour, or in a few zones half an
+	// hour, earlier
+	for _, shift := range []time.Duration{time.Hour, 30 * time.Minute} {
+		if earlier := at.Add(-shift); reading(earlier).Equal(want) {
+			return earlier
+		}
+	}
+	return at
+}
+
+// reading returns what the clock of t's location reads at t, as a UTC time
+// so readings compare by value
+func reading(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+// dayMatches applies the cron rule that a restricted day of month and day of
+// week match if either does
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := has(s.dom, t.Day())
+	dow := has(s.dow, int(t.Weekday()))
+	if s.anyDay {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func has(bits uint64, value int) bool {
+	return bits&(1<<uint(value)) != 0
+}
+
+// parse converts a field to a bit set of the values it matches
+func (f field) parse(expr string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		rangeExpr, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			rangeExpr = part[:i]
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %s field %q", f.name, part)
+			}
+			step = n
+		}
+
+		low, high := f.min, f.max
+		switch {
+		case rangeExpr == "*":
+		case strings.Contains(rangeExpr, "-"):
+			i := strings.Index(rangeExpr, "-")
+			var err error
+			if low, err = f.value(rangeExpr[:i]); err != nil {
+				return 0, err
+			}
+			if high, err = f.value(rangeExpr[i+1:]); err != nil {
+				return 0, err
+			}
+			if low > high {
+				return 0, fmt.Errorf("invalid range in %s field %q", f.name, part)
+			}
+		default:
+			value, err := f.value(rangeExpr)
+			if err != nil {
+				return 0, err
+			}
+			low = value
+			if step == 1 {
+				high = value
+			}
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// value parses a single number or name within the field's bounds
+func (f field) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", f.name, s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("%s %d out of range %d-%d", f.name, v, f.min, f.max)
+	}
+	return v, nil
+}
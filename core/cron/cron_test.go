@@ -0,0 +1,148 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// Friday 15 March 2024, 10:30
+	from := time.Date(2024, 3, 15, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 3, 15, 10, 31, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2024, 3, 16, 2, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 3, 15, 11, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2024, 3, 15, 10, 40, 0, 0, time.UTC)},
+		{"15,45 9-17 * * mon-fri", time.Date(2024, 3, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 9 * * MON", time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Restricted day of month and day of week match if either does
+		{"0 0 20 * sun", time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		schedule, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", tt.expr, err)
+			continue
+		}
+		if got := schedule.Next(from); !got.Equal(tt.want) {
+			t.Errorf("Parse(%q).Next() = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestNext_NeverMatches(t *testing.T) {
+	schedule, err := Parse("0 0 31 2 *")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if got := schedule.Next(time.Now()); !got.IsZero() {
+		t.Errorf("Next() = %v, want zero time", got)
+	}
+}
+
+func TestNext_DaylightSaving(t *testing.T) {
+	chicago, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want []time.Time
+	}{
+		{
+			// Clocks jump from 02:00 to 03:00 CDT on 10 March 2024
+			name: "skipped time fires when the clock jumps",
+			expr: "30 2 * * *",
+			from: time.Date(2024, 3, 9, 12, 0, 0, 0, chicago),
+			want: []time.Time{
+				time.Date(2024, 3, 10, 8, 0, 0, 0, time.UTC),
+				time.Date(2024, 3, 11, 7, 30, 0, 0, time.UTC),
+			},
+		},
+		{
+			// Clocks fall back from 02:00 CDT to 01:00 CST on 3 November 2024
+			name: "repeated time fires once",
+			expr: "30 1 * * *",
+			from: time.Date(2024, 11, 2, 12, 0, 0, 0, chicago),
+			want: []time.Time{
+				time.Date(2024, 11, 3, 6, 30, 0, 0, time.UTC),
+				time.Date(2024, 11, 4, 7, 30, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "hourly schedules follow elapsed time",
+			expr: "0 * * * *",
+			from: time.Date(2024, 11, 3, 0, 30, 0, 0, chicago),
+			want: []time.Time{
+				time.Date(2024, 11, 3, 6, 0, 0, 0, time.UTC),
+				time.Date(2024, 11, 3, 7, 0, 0, 0, time.UTC),
+				time.Date(2024, 11, 3, 8, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "daily time keeps its wall clock across the change",
+			expr: "0 2 * * *",
+			from: time.Date(2024, 11, 2, 12, 0, 0, 0, chicago),
+			want: []time.Time{
+				time.Date(2024, 11, 3, 8, 0, 0, 0, time.UTC),
+				time.Date(2024, 11, 4, 8, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "half hour offsets",
+			expr: "0 9 * * *",
+			from: time.Date(2024, 3, 15, 10, 0, 0, 0, kolkata),
+			want: []time.Time{time.Date(2024, 3, 16, 3, 30, 0, 0, time.UTC)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			at := tt.from
+			for _, want := range tt.want {
+				at = schedule.Next(at)
+				if !at.Equal(want) {
+					t.Fatalf("Next() = %v, want %v", at.UTC(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * * funday",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) expected error", expr)
+		}
+	}
+}
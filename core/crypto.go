@@ -0,0 +1,159 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+)
+
+// DefaultChecksumAlgorithm is the hash release artifacts are checksummed
+// with unless the engine is configured otherwise
+const DefaultChecksumAlgorithm = "sha256"
+
+// hashAlgorithm is a hash artifacts can be checksummed with, and whether
+// FIPS 140 approves it
+type hashAlgorithm struct {
+	new  func() hash.Hash
+	fips bool
+}
+
+// hashAlgorithms are the checksum algorithms by name. SHA-1 is only kept
+// to verify releases promoted by other tools; FIPS mode refuses it.
+var hashAlgorithms = map[string]hashAlgorithm{
+	"sha256": {sha256.New, true},
+	"sha384": {sha512.New384, true},
+	"sha512": {sha512.New, true},
+	"sha1":   {sha1.New, false},
+}
+
+// boringCrypto is set when the binary is built with the BoringCrypto module
+var boringCrypto bool
+
+// CryptoMode reports the algorithms the engine's cryptography uses
+type CryptoMode struct {
+	FIPS bool `json:"fips"`
+	// BoringCrypto reports whether the binary uses the FIPS-validated
+	// BoringCrypto module
+	BoringCrypto      bool   `json:"boringCrypto"`
+	ChecksumAlgorithm string `json:"checksumAlgorithm"`
+	SecretEncryption  string `json:"secretEncryption"`
+	ReleaseSignature  string `json:"releaseSignature"`
+}
+
+// HashAlgorithms returns the names of the checksum algorithms, only the
+// FIPS-approved ones when fips is set
+func HashAlgorithms(fips bool) []string {
+	var names []string
+	for name, algorithm := range hashAlgorithms {
+		if algorithm.fips || !fips {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateHashAlgorithm checks that name is a checksum algorithm, and a
+// FIPS-approved one when fips is set
+func ValidateHashAlgorithm(name string, fips bool) error {
+	algorithm, ok := hashAlgorithms[name]
+	if !ok {
+		return fmt.Errorf("unknown hash algorithm %q, must be one of %s", name, strings.Join(HashAlgorithms(false), ", "))
+	}
+	if fips && !algorithm.fips {
+		return fmt.Errorf("hash algorithm %s is not FIPS-approved, must be one of %s", name, strings.Join(HashAlgorithms(true), ", "))
+	}
+	return nil
+}
+
+// WithCrypto restricts the engine to FIPS-approved algorithms and sets the
+// algorithm release artifacts are checksummed with; an empty algorithm
+// keeps DefaultChecksumAlgorithm
+func WithCrypto(fips bool, checksumAlgorithm string) Option {
+	return func(pe *PipelineEngine) {
+		pe.fips = fips
+		if checksumAlgorithm != "" {
+			pe.checksumAlgorithm = checksumAlgorithm
+		}
+	}
+}
+
+// CryptoMode returns the engine's cryptographic configuration
+func (pe *PipelineEngine) CryptoMode() CryptoMode {
+	return CryptoMode{
+		FIPS:              pe.fips,
+		BoringCrypto:      boringCrypto,
+		ChecksumAlgorithm: pe.checksumAlgorithm,
+		SecretEncryption:  "AES-256-GCM",
+		ReleaseSignature:  "HMAC-SHA256",
+	}
+}
+
+// checksumHash returns a new hash of the named algorithm, refusing ones
+// FIPS mode doesn't approve
+func (pe *PipelineEngine) checksumHash(name string) (hash.Hash, error) {
+	if err := ValidateHashAlgorithm(name, pe.fips); err != nil {
+		return nil, err
+	}
+	return hashAlgorithms[name].new(), nil
+}
+
+// VerifyFIPS checks that FIPS mode can be enabled: the binary must be built
+// with the BoringCrypto module, and the approved algorithms must pass their
+// known-answer self-tests
+func VerifyFIPS() error {
+	if !boringCrypto {
+		return fmt.Errorf("FIPS mode requires a binary built with BoringCrypto (make build-fips)")
+	}
+	return cryptoSelfTest()
+}
+
+// cryptoSelfTest runs known-answer tests of the hashes and HMAC, and an
+// AES-256-GCM round trip
+func cryptoSelfTest() error {
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"sha256", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"sha384", "cb00753f45a35e8bb5a03d699ac65007272c32ab0eded1631a8b605a43ff5bed8086072ba1e7cc2358baeca134c825a7"},
+		{"sha512", "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+	} {
+		h := hashAlgorithms[test.name].new()
+		h.Write([]byte("abc"))
+		if hex.EncodeToString(h.Sum(nil)) != test.want {
+			return fmt.Errorf("%s self-test failed", test.name)
+		}
+	}
+
+	// RFC 4231 test case 2
+	mac := hmac.New(sha256.New, []byte("Jefe"))
+	mac.Write([]byte("what do ya want for nothing?"))
+	if hex.EncodeToString(mac.Sum(nil)) != "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843" {
+		return fmt.Errorf("HMAC-SHA256 self-test failed")
+	}
+
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		return fmt.Errorf("AES-256 self-test failed: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("AES-256-GCM self-test failed: %w", err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	plaintext := []byte("conveyor self-test")
+	opened, err := gcm.Open(nil, nonce, gcm.Seal(nil, nonce, plaintext, nil), nil)
+	if err != nil || string(opened) != string(plaintext) {
+		return fmt.Errorf("AES-256-GCM self-test failed")
+	}
+	return nil
+}
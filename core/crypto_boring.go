@@ -0,0 +1,14 @@
+//go:build boringcrypto
+// +build boringcrypto
+
+package core
+
+import (
+	"crypto/boring"
+	// Restricts TLS to FIPS-approved versions, cipher suites and curves
+	_ "crypto/tls/fipsonly"
+)
+
+func init() {
+	boringCrypto = boring.Enabled()
+}
@@ -0,0 +1,64 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateHashAlgorithm(t *testing.T) {
+	if err := ValidateHashAlgorithm("sha384", true); err != nil {
+		t.Errorf("ValidateHashAlgorithm(sha384, fips) error = %v", err)
+	}
+	if err := ValidateHashAlgorithm("sha1", false); err != nil {
+		t.Errorf("ValidateHashAlgorithm(sha1) error = %v", err)
+	}
+	if err := ValidateHashAlgorithm("sha1", true); err == nil || !strings.Contains(err.Error(), "not FIPS-approved") {
+		t.Errorf("ValidateHashAlgorithm(sha1, fips) error = %v, want not FIPS-approved", err)
+	}
+	if err := ValidateHashAlgorithm("md5", false); err == nil {
+		t.Error("ValidateHashAlgorithm(md5) error = nil, want unknown")
+	}
+}
+
+func TestVerifyFIPS(t *testing.T) {
+	if err := cryptoSelfTest(); err != nil {
+		t.Errorf("cryptoSelfTest() error = %v", err)
+	}
+	if boringCrypto {
+		t.Skip("built with BoringCrypto")
+	}
+	if err := VerifyFIPS(); err == nil || !strings.Contains(err.Error(), "BoringCrypto") {
+		t.Errorf("VerifyFIPS() error = %v, want a BoringCrypto build required", err)
+	}
+}
+
+func TestPromote_ChecksumAlgorithm(t *testing.T) {
+	engine := releaseEngine(t, t.TempDir(), t.TempDir())
+	WithCrypto(false, "sha1")(engine)
+	pipeline := scriptPipeline("build", "mkdir -p dist && echo app > dist/app.bin")
+	pipeline.Artifacts = []ArtifactConfig{{Name: "dist", Paths: []string{"dist/"}}}
+	engine.CreatePipeline(pipeline)
+	job := runArtifactJob(t, engine, "build")
+
+	release, err := engine.Promote(job.ID, PromoteRequest{Name: "v1"})
+	if err != nil {
+		t.Fatalf("Promote() error = %v", err)
+	}
+	if !strings.HasPrefix(release.Artifacts[0].Checksum, "sha1:") {
+		t.Errorf("checksum = %s, want sha1", release.Artifacts[0].Checksum)
+	}
+
+	// Releases are verified with the algorithm they were promoted with,
+	// which FIPS mode must approve
+	WithCrypto(false, "sha512")(engine)
+	if err := engine.VerifyRelease(release); err != nil {
+		t.Errorf("VerifyRelease() error = %v", err)
+	}
+	WithCrypto(true, "sha512")(engine)
+	if err := engine.VerifyRelease(release); err == nil || !strings.Contains(err.Error(), "not FIPS-approved") {
+		t.Errorf("VerifyRelease() in FIPS mode error = %v, want sha1 refused", err)
+	}
+	if mode := engine.CryptoMode(); !mode.FIPS || mode.ChecksumAlgorithm != "sha512" {
+		t.Errorf("CryptoMode() = %+v, want FIPS with sha512", mode)
+	}
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// stageNeeds returns the IDs of the stages a stage waits for, from its
+// Needs and DependsOn
+func stageNeeds(stage Stage) []string {
+	if len(stage.DependsOn) == 0 {
+		return stage.Needs
+	}
+	needs := append([]string{}, stage.Needs...)
+	for _, id := range stage.DependsOn {
+		listed := false
+		for _, need := range needs {
+			listed = listed || need == id
+		}
+		if !listed {
+			needs = append(needs, id)
+		}
+	}
+	return needs
+}
+
+// usesStageGraph reports whether any stage declares dependencies. Stages of
+// pipelines without any run one after the other.
+func usesStageGraph(stages []Stage) bool {
+	for _, stage := range stages {
+		if len(stage.Needs) > 0 || len(stage.DependsOn) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateStageGraph checks that the dependencies of stages name other
+// stages of the pipeline and don't form a cycle
+func ValidateStageGraph(stages []Stage) error {
+	index := make(map[string]int, len(stages))
+	for i, stage := range stages {
+		index[stage.ID] = i
+	}
+	for _, stage := range stages {
+		for _, need := range stageNeeds(stage) {
+			if need == stage.ID {
+				return fmt.Errorf("stage %s needs itself", stage.ID)
+			}
+			if _, ok := index[need]; !ok {
+				return fmt.Errorf("stage %s needs unknown stage %s", stage.ID, need)
+			}
+		}
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make([]int, len(stages))
+	var visit func(i int, path []string) error
+	visit = func(i int, path []string) error {
+		path = append(path, stages[i].ID)
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("stage dependencies form a cycle: %s", strings.Join(path, " -> "))
+		}
+		state[i] = visiting
+		for _, need := range stageNeeds(stages[i]) {
+			if err := visit(index[need], path); err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+		return nil
+	}
+	for i := range stages {
+		if err := visit(i, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stageResult is the outcome of a stage run by runStageGraph
+type stageResult struct {
+	index  int
+	status Status
+}
+
+// runStageGraph runs the stages of a pipeline as a dependency graph: each
+// stage starts as soon as every stage it needs succeeded, concurrently with
+// the other stages that are ready. Stages needing a stage that failed or
+// was skipped are skipped, while independent stages carry on, unless they
+// have steps that run on failure: those wait for every stage they need and
+// run after a failure upstream. It returns StatusSuccess, StatusFailed when
+// a stage that doesn't allow failure failed, or the stopped status when ctx
+// is done.
+func (pe *PipelineEngine) runStageGraph(ctx context.Context, pipeline *Pipeline, job *Job, completed map[string]bool) Status {
+	stages := pipeline.Stages
+	index := make(map[string]int, len(stages))
+	for i, stage := range stages {
+		index[stage.ID] = i
+	}
+	statuses := make([]Status, len(stages))
+	// upstreamFailed is whether a stage, or a stage it depends on, failed
+	upstreamFailed := make([]bool, len(stages))
+	results := make(chan stageResult)
+	running := 0
+
+	for {
+		for changed := true; changed && ctx.Err() == nil; {
+			changed = false
+			for i, stage := range stages {
+				if statuses[i] != "" {
+					continue
+				}
+				ready, blockedBy, failed := true, "", false
+				for _, need := range stageNeeds(stage) {
+					failed = failed || upstreamFailed[index[need]]
+					switch statuses[index[need]] {
+					case StatusSuccess:
+					case "", StatusRunning:
+						ready = false
+					default:
+						blockedBy = need
+					}
+				}
+				switch {
+				case blockedBy != "" && !stageRunsAfterFailure(stage):
+					statuses[i], upstreamFailed[i], changed = StatusSkipped, failed, true
+					pe.logJob(job, "info", "", fmt.Sprintf("Stage %s skipped because stage %s didn't succeed", stage.ID, blockedBy))
+				case !ready:
+				case blockedBy != "" && !failed:
+					statuses[i], changed = StatusSkipped, true
+					pe.logJob(job, "info", "", fmt.Sprintf("Stage %s skipped because stage %s was skipped", stage.ID, blockedBy))
+				default:
+					statuses[i], upstreamFailed[i], changed = StatusRunning, failed, true
+					running++
+					go func(i int, stage Stage, failed bool) {
+						results <- stageResult{index: i, status: pe.runStage(ctx, pipeline, job, stage, completed, failed)}
+					}(i, stage, failed)
+				}
+			}
+		}
+		if running == 0 {
+			break
+		}
+		result := <-results
+		running--
+		statuses[result.index] = stageOutcome(stages[result.index], result.status)
+		if statuses[result.index] == StatusFailed {
+			upstreamFailed[result.index] = true
+		}
+	}
+
+	if ctx.Err() != nil {
+		return pe.stoppedStatus()
+	}
+	for _, status := range statuses {
+		if status == StatusFailed {
+			return StatusFailed
+		}
+	}
+	return StatusSuccess
+}
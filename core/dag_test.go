@@ -0,0 +1,100 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// graphStage is a stage running command that needs the given stages
+func graphStage(id, command string, needs ...string) Stage {
+	return Stage{ID: id, Name: id, Needs: needs, Steps: []Step{{ID: id + "-step", Name: id, Type: "script", Command: command}}}
+}
+
+func TestValidateStageGraph(t *testing.T) {
+	tests := []struct {
+		name   string
+		stages []Stage
+		want   string
+	}{
+		{"diamond", []Stage{graphStage("a", ""), graphStage("b", "", "a"), graphStage("c", "", "a"), graphStage("d", "", "b", "c")}, ""},
+		{"unknown", []Stage{graphStage("a", "", "missing")}, "needs unknown stage missing"},
+		{"self", []Stage{graphStage("a", "", "a")}, "needs itself"},
+		{"cycle", []Stage{graphStage("a", "", "c"), graphStage("b", "", "a"), graphStage("c", "", "b")}, "cycle: a -> c -> b -> a"},
+		{"dependsOn cycle", []Stage{{ID: "a", DependsOn: []string{"b"}}, {ID: "b", Needs: []string{"a"}}}, "cycle"},
+	}
+	for _, tt := range tests {
+		err := ValidateStageGraph(tt.stages)
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%s: ValidateStageGraph() error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+
+	engine := newTestEngine()
+	cyclic := &Pipeline{ID: "cyclic", Stages: []Stage{graphStage("a", "true", "b"), graphStage("b", "true", "a")}}
+	if err := engine.CreatePipeline(cyclic); err == nil {
+		t.Error("CreatePipeline() with a cycle succeeded")
+	}
+}
+
+func TestRun_StageGraph(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	engine.CreatePipeline(&Pipeline{ID: "graph", Stages: []Stage{
+		graphStage("package", "echo package >> order.log", "unit", "lint"),
+		graphStage("unit", "sleep 0.3; echo unit >> order.log"),
+		graphStage("lint", "sleep 0.3; echo lint >> order.log"),
+	}})
+
+	start := time.Now()
+	job, err := engine.Run(context.Background(), "graph")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess {
+		t.Fatalf("status = %s, want success", job.Status)
+	}
+	if elapsed := time.Since(start); elapsed > 550*time.Millisecond {
+		t.Errorf("job took %s, want unit and lint to run concurrently", elapsed)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "order.log"))
+	if order := strings.Fields(string(data)); len(order) != 3 || order[2] != "package" {
+		t.Errorf("order = %v, want package after unit and lint", order)
+	}
+}
+
+func TestRun_StageGraphSkipsDependentsOfFailures(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	engine.CreatePipeline(&Pipeline{ID: "graph", Stages: []Stage{
+		graphStage("build", "exit 1"),
+		graphStage("test", "touch test", "build"),
+		graphStage("deploy", "touch deploy", "test"),
+		graphStage("docs", "touch docs"),
+	}})
+
+	job, err := engine.Run(context.Background(), "graph")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusFailed {
+		t.Errorf("status = %s, want failed", job.Status)
+	}
+	for name, want := range map[string]bool{"test": false, "deploy": false, "docs": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != want {
+			t.Errorf("stage %s ran = %v, want %v", name, err == nil, want)
+		}
+	}
+	skipped := 0
+	for _, entry := range job.Logs {
+		if strings.Contains(entry.Message, "skipped because stage") {
+			skipped++
+		}
+	}
+	if skipped != 2 {
+		t.Errorf("logged %d skipped stages, want test and deploy", skipped)
+	}
+}
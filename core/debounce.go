@@ -0,0 +1,176 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+var debounceCounter uint64
+
+// debounceBatch collects the webhook triggers for a branch of a pipeline
+// that arrive within its trigger's debounce window
+type debounceBatch struct {
+	held  *HeldTrigger
+	due   time.Time
+	timer *time.Timer
+}
+
+// ValidateDebounce checks the debounce window and maximum delay of a
+// trigger, such as "30s" and "5m"
+func ValidateDebounce(debounce, maxDelay string) error {
+	window, err := parseDebounce(debounce)
+	if err != nil {
+		return fmt.Errorf("invalid debounce %q", debounce)
+	}
+	limit, err := parseDebounce(maxDelay)
+	if err != nil {
+		return fmt.Errorf("invalid max delay %q", maxDelay)
+	}
+	if limit > 0 && limit < window {
+		return fmt.Errorf("max delay %s is shorter than the debounce window %s", maxDelay, debounce)
+	}
+	return nil
+}
+
+func parseDebounce(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+// debounceWindow returns the debounce window and maximum delay of the
+// first trigger of a pipeline that debounces webhook runs for branch
+func debounceWindow(pipeline *Pipeline, branch string) (window, maxDelay time.Duration, ok bool) {
+	for _, trigger := range pipeline.Triggers {
+		if trigger.Debounce == "" || trigger.Type == TriggerSchedule || trigger.Type == TriggerPipelineCompleted {
+			continue
+		}
+		matched := len(trigger.Branches) == 0
+		for _, glob := range trigger.Branches {
+			if ok, _ := path.Match(glob, branch); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		window, err := parseDebounce(trigger.Debounce)
+		if err != nil || window == 0 {
+			continue
+		}
+		maxDelay, _ := parseDebounce(trigger.MaxDelay)
+		return window, maxDelay, true
+	}
+	return 0, 0, false
+}
+
+// heldCommit returns the commit a held trigger is for
+func heldCommit(held *HeldTrigger) string {
+	if held.Revision != nil && held.Revision.Commit != "" {
+		return held.Revision.Commit
+	}
+	return held.Trigger["commit"]
+}
+
+// debounce adds a webhook run to the pending batch for its branch when a
+// trigger of the pipeline debounces it, and returns the batch. The batch
+// runs for the latest commit once no run arrived for the debounce window,
+// or the maximum delay after its first run, recording the commits it
+// skipped. It returns nil for runs that start right away.
+func (pe *PipelineEngine) debounce(pipelineID string, rc runConfig) *HeldTrigger {
+	if rc.source != TriggerWebhook {
+		return nil
+	}
+	branch := rc.trigger["branch"]
+	if rc.revision != nil && rc.revision.Branch != "" {
+		branch = rc.revision.Branch
+	}
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pipeline, exists := pe.pipelines[pipelineID]
+	if !exists {
+		return nil
+	}
+	window, maxDelay, ok := debounceWindow(pipeline, branch)
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	key := pipelineID + "\x00" + branch
+	batch, pending := pe.debounced[key]
+	if !pending {
+		batch = &debounceBatch{held: &HeldTrigger{
+			ID:         fmt.Sprintf("debounce-%d-%d", now.Unix(), atomic.AddUint64(&debounceCounter, 1)),
+			PipelineID: pipelineID,
+			Source:     rc.source,
+			HeldAt:     now,
+		}}
+		if pe.debounced == nil {
+			pe.debounced = make(map[string]*debounceBatch)
+		}
+		pe.debounced[key] = batch
+	} else if commit := heldCommit(batch.held); commit != "" {
+		batch.held.Skipped = append(batch.held.Skipped, commit)
+	}
+
+	held := batch.held
+	held.Trigger = rc.trigger
+	held.Revision = rc.revision
+	held.NoCache = rc.noCache
+	held.TriggeredBy = rc.triggeredBy
+	batch.due = now.Add(window)
+	if deadline := held.HeldAt.Add(maxDelay); maxDelay > 0 && batch.due.After(deadline) {
+		batch.due = deadline
+	}
+	due := batch.due
+	held.Until = &due
+	if batch.timer == nil {
+		batch.timer = time.AfterFunc(due.Sub(now), func() { pe.runDebounced(key, batch) })
+	} else {
+		batch.timer.Reset(due.Sub(now))
+	}
+	copied := *held
+	return &copied
+}
+
+// runDebounced starts the latest run of a batch once it is due
+func (pe *PipelineEngine) runDebounced(key string, batch *debounceBatch) {
+	pe.mu.Lock()
+	if pe.debounced[key] != batch || time.Now().Before(batch.due) {
+		// Already started, or a later run reset the timer
+		pe.mu.Unlock()
+		return
+	}
+	delete(pe.debounced, key)
+	held := *batch.held
+	pe.mu.Unlock()
+
+	job, maintenance, err := pe.dispatch(context.Background(), held.PipelineID, held.runOptions()...)
+	switch {
+	case err != nil:
+		pe.logger.Printf("Failed to start debounced trigger %s of pipeline %s: %v", held.ID, held.PipelineID, err)
+	case maintenance != nil:
+		pe.logger.Printf("Debounced trigger %s of pipeline %s is held as %s", held.ID, held.PipelineID, maintenance.ID)
+	default:
+		pe.logger.Printf("Started debounced trigger %s of pipeline %s as job %s, skipping %d commits", held.ID, held.PipelineID, job.ID, len(held.Skipped))
+	}
+}
+
+// withSkippedCommits records the commits a debounced run skipped, as the
+// "skippedCommits" metadata
+func withSkippedCommits(commits []string) RunOption {
+	return func(rc *runConfig) {
+		rc.skipped = commits
+	}
+}
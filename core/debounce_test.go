@@ -0,0 +1,109 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// waitForJobs waits until a pipeline has n jobs, all of them finished
+func waitForJobs(t *testing.T, engine *PipelineEngine, pipelineID string, n int) []*Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		jobs, err := engine.ListJobs(pipelineID)
+		if err != nil {
+			t.Fatalf("ListJobs() error = %v", err)
+		}
+		done := len(jobs) == n
+		for i, job := range jobs {
+			jobs[i] = engine.snapshotJob(job)
+			done = done && jobs[i].Status.IsTerminal()
+		}
+		if done {
+			return jobs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("pipeline %s did not finish %d jobs", pipelineID, n)
+	return nil
+}
+
+func TestDispatch_DebouncesWebhookTriggers(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("build", "echo build")
+	pipeline.Triggers = []Trigger{{Type: "push", Branches: []string{"main"}, Debounce: "100ms"}}
+	engine.CreatePipeline(pipeline)
+
+	var first *HeldTrigger
+	for i := 1; i <= 3; i++ {
+		job, held, err := engine.Dispatch(context.Background(), "build", WithSource(TriggerWebhook),
+			WithRevision(Revision{Branch: "main", Commit: fmt.Sprintf("c%d", i)}))
+		if err != nil || job != nil || held == nil || held.Until == nil {
+			t.Fatalf("Dispatch() = %v, %+v, %v, want the trigger debounced", job, held, err)
+		}
+		if first == nil {
+			first = held
+		} else if held.ID != first.ID {
+			t.Errorf("trigger ID = %s, want pushes collapsed into %s", held.ID, first.ID)
+		}
+	}
+
+	// Other branches and manual runs aren't debounced
+	if job, held, _ := engine.Dispatch(context.Background(), "build", WithSource(TriggerWebhook), WithRevision(Revision{Branch: "feature"})); job == nil || held != nil {
+		t.Errorf("Dispatch(feature) = %v, %+v, want a job", job, held)
+	}
+	if job, held, _ := engine.Dispatch(context.Background(), "build"); job == nil || held != nil {
+		t.Errorf("Dispatch(manual) = %v, %+v, want a job", job, held)
+	}
+
+	jobs := waitForJobs(t, engine, "build", 3)
+	var debounced *Job
+	for _, job := range jobs {
+		if job.Revision != nil && job.Revision.Commit == "c3" {
+			debounced = job
+		}
+	}
+	if debounced == nil {
+		t.Fatalf("jobs %+v, want one for the latest commit", jobs)
+	}
+	if skipped := fmt.Sprint(debounced.Metadata["skippedCommits"]); skipped != "[c1 c2]" {
+		t.Errorf("skippedCommits = %s, want [c1 c2]", skipped)
+	}
+}
+
+func TestDispatch_DebounceMaxDelay(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("build", "echo build")
+	pipeline.Triggers = []Trigger{{Type: "push", Debounce: "1h", MaxDelay: "100ms"}}
+	engine.CreatePipeline(pipeline)
+
+	start := time.Now()
+	_, held, _ := engine.Dispatch(context.Background(), "build", WithSource(TriggerWebhook), WithTrigger(map[string]string{"commit": "c1"}))
+	if held == nil || held.Until.Sub(start) > time.Second {
+		t.Fatalf("Dispatch() held = %+v, want the trigger started after the max delay", held)
+	}
+	jobs := waitForJobs(t, engine, "build", 1)
+	if triggerValues(jobs[0].Metadata)["commit"] != "c1" || jobs[0].Metadata["skippedCommits"] != nil {
+		t.Errorf("job metadata = %v, want commit c1 without skipped commits", jobs[0].Metadata)
+	}
+}
+
+func TestValidateDebounce(t *testing.T) {
+	for _, tc := range []struct {
+		debounce, maxDelay string
+		valid              bool
+	}{
+		{"", "", true},
+		{"30s", "", true},
+		{"30s", "5m", true},
+		{"soon", "", false},
+		{"-1s", "", false},
+		{"5m", "30s", false},
+	} {
+		if err := ValidateDebounce(tc.debounce, tc.maxDelay); (err == nil) != tc.valid {
+			t.Errorf("ValidateDebounce(%q, %q) error = %v, want valid %v", tc.debounce, tc.maxDelay, err, tc.valid)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"time"
+)
+
+// MaxDebugTTL is the longest a failed step's environment is kept for
+// debugging
+const MaxDebugTTL = 4 * time.Hour
+
+// Debug session statuses
+const (
+	DebugActive  = "active"
+	DebugClosed  = "closed"
+	DebugExpired = "expired"
+)
+
+// Debug audit events
+const (
+	DebugEventOpened   = "opened"
+	DebugEventAttached = "attached"
+	DebugEventInput    = "input"
+	DebugEventDetached = "detached"
+	DebugEventClosed   = "closed"
+	DebugEventExpired  = "expired"
+)
+
+// ErrDebugSessionNotFound is returned for unknown debug sessions
+var ErrDebugSessionNotFound = errors.New("debug session not found")
+
+// DebugSession keeps the workspace and services of a failed step alive so
+// developers can inspect the failure in a terminal
+type DebugSession struct {
+	ID         string `json:"id"`
+	JobID      string `json:"jobId"`
+	PipelineID string `json:"pipelineId"`
+	StepID     string `json:"stepId"`
+	// Dir is the directory terminals start in
+	Dir       string    `json:"dir"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	EndedAt   time.Time `json:"endedAt,omitempty"`
+	ClosedBy  string    `json:"closedBy,omitempty"`
+	// Attached is the number of terminals currently attached
+	Attached int `json:"attached"`
+}
+
+// DebugAuditEntry records an action on a debug session, including every
+// line typed into its terminals
+type DebugAuditEntry struct {
+	Time       time.Time `json:"time"`
+	SessionID  string    `json:"sessionId"`
+	JobID      string    `json:"jobId"`
+	PipelineID string    `json:"pipelineId"`
+	User       string    `json:"user,omitempty"`
+	Event      string    `json:"event"`
+	Data       string    `json:"data,omitempty"`
+}
+
+// DebugAuditStore is implemented by stores that persist the debug audit
+// trail
+type DebugAuditStore interface {
+	AppendDebugAudit(entry DebugAuditEntry) error
+}
+
+// debugSession is a debug session with the state needed to attach to it
+type debugSession struct {
+	DebugSession
+	shell string
+	env   map[string]string
+	audit []DebugAuditEntry
+	// cleanup holds the teardown deferred until the session ends
+	cleanup []func()
+	timer   *time.Timer
+	done    chan struct{}
+}
+
+// ParseDebugTTL parses how long a failed step's environment is kept
+func ParseDebugTTL(value string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid debug_on_failure %q: %w", value, err)
+	}
+	if ttl <= 0 || ttl > MaxDebugTTL {
+		return 0, fmt.Errorf("debug_on_failure must be between 0 and %s, got %s", MaxDebugTTL, ttl)
+	}
+	return ttl, nil
+}
+
+// WithDebugOnFailure keeps the environment of the run's first failed step
+// alive for ttl so it can be inspected in a debug session
+func WithDebugOnFailure(ttl time.Duration) RunOption {
+	return func(rc *runConfig) {
+		rc.debugTTL = ttl
+	}
+}
+
+// debugTTL returns how long the job keeps a failed step's environment, or
+// zero when debugging on failure is off
+func debugTTL(pipeline *Pipeline, job *Job) time.Duration {
+	value, _ := job.Metadata["debugOnFailure"].(string)
+	if value == "" {
+		value = pipeline.DebugOnFailure
+	}
+	if value == "" {
+		return 0
+	}
+	ttl, err := ParseDebugTTL(value)
+	if err != nil {
+		return 0
+	}
+	return ttl
+}
+
+// openDebugSession opens a debug session for a failed step unless the job
+// already has one. The session takes over stopping the step's services.
+func (pe *PipelineEngine) openDebugSession(pipeline *Pipeline, job *Job, step Step, env map[string]string, runner *runnerSlot, ttl time.Duration, stopServices func()) bool {
+	shell := "sh"
+	executor := pe.executor
+	if runner != nil {
+		executor = runner.Executor
+	}
+	if se, ok := executor.(*ShellExecutor); ok && se.Shell != "" {
+		shell = se.Shell
+	}
+	dir := pe.jobDir(job)
+
+	pe.mu.Lock()
+	for _, s := range pe.debugSessions {
+		if s.JobID == job.ID {
+			pe.mu.Unlock()
+			return false
+		}
+	}
+	now := time.Now()
+	session := &debugSession{
+		DebugSession: DebugSession{
+			ID:         fmt.Sprintf("debug-%s-%s", job.ID, step.ID),
+			JobID:      job.ID,
+			PipelineID: pipeline.ID,
+			StepID:     step.ID,
+			Dir:        dir,
+			Status:     DebugActive,
+			CreatedAt:  now,
+			ExpiresAt:  now.Add(ttl),
+		},
+		shell:   shell,
+		env:     env,
+		cleanup: []func(){stopServices},
+		done:    make(chan struct{}),
+	}
+	pe.debugSessions[session.ID] = session
+	session.timer = time.AfterFunc(ttl, func() {
+		pe.endDebugSession(session.ID, DebugExpired, "")
+	})
+	pe.mu.Unlock()
+
+	pe.auditDebug(session, "", DebugEventOpened, step.ID)
+	pe.logJob(job, "info", step.ID, fmt.Sprintf("Debug session %s is open until %s", session.ID, session.ExpiresAt.Format(time.RFC3339)))
+	pe.emitDebugEvent("debug.opened", session)
+	return true
+}
+
+// holdForDebug defers cleanup until the job's active debug session ends.
+// It reports false when the job has no active session.
+func (pe *PipelineEngine) holdForDebug(jobID string, cleanup func()) bool {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	for _, s := range pe.debugSessions {
+		if s.JobID == jobID && s.Status == DebugActive {
+			s.cleanup = append(s.cleanup, cleanup)
+			return true
+		}
+	}
+	return false
+}
+
+// endDebugSession ends an active session, kills its terminals and releases
+// the environment it kept
+func (pe *PipelineEngine) endDebugSession(id, status, user string) error {
+	pe.mu.Lock()
+	session, ok := pe.debugSessions[id]
+	if !ok {
+		pe.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrDebugSessionNotFound, id)
+	}
+	if session.Status != DebugActive {
+		pe.mu.Unlock()
+		return fmt.Errorf("debug session %s is %s", id, session.Status)
+	}
+	session.Status = status
+	session.EndedAt = time.Now()
+	session.ClosedBy = user
+	session.timer.Stop()
+	close(session.done)
+	cleanup := session.cleanup
+	session.cleanup = nil
+	job := pe.jobs[session.JobID]
+	pe.mu.Unlock()
+
+	for _, fn := range cleanup {
+		fn()
+	}
+
+	event := DebugEventClosed
+	if status == DebugExpired {
+		event = DebugEventExpired
+	}
+	pe.auditDebug(session, user, event, "")
+	if job != nil {
+		pe.logJob(job, "info", session.StepID, fmt.Sprintf("Debug session %s %s", id, status))
+		pe.saveJob(job)
+	}
+	pe.emitDebugEvent("debug."+status, session)
+	return nil
+}
+
+// CloseDebugSession ends an active debug session and releases the
+// environment it kept
+func (pe *PipelineEngine) CloseDebugSession(id, user string) error {
+	return pe.endDebugSession(id, DebugClosed, user)
+}
+
+// closeDebugSessions ends every active debug session
+func (pe *PipelineEngine) closeDebugSessions() {
+	pe.mu.RLock()
+	var ids []string
+	for id, s := range pe.debugSessions {
+		if s.Status == DebugActive {
+			ids = append(ids, id)
+		}
+	}
+	pe.mu.RUnlock()
+
+	for _, id := range ids {
+		pe.endDebugSession(id, DebugClosed, "")
+	}
+}
+
+// GetDebugSession returns a debug session
+func (pe *PipelineEngine) GetDebugSession(id string) (*DebugSession, error) {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	session, ok := pe.debugSessions[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrDebugSessionNotFound, id)
+	}
+	snapshot := session.DebugSession
+	return &snapshot, nil
+}
+
+// DebugSessions returns the debug sessions of a job, oldest first
+func (pe *PipelineEngine) DebugSessions(jobID string) []DebugSession {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	sessions := []DebugSession{}
+	for _, s := range pe.debugSessions {
+		if s.JobID == jobID {
+			sessions = append(sessions, s.DebugSession)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions
+}
+
+// DebugAudit returns the audit trail of a debug session
+func (pe *PipelineEngine) DebugAudit(id string) ([]DebugAuditEntry, error) {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	session, ok := pe.debugSessions[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrDebugSessionNotFound, id)
+	}
+	return append([]DebugAuditEntry{}, session.audit...), nil
+}
+
+// AttachDebugSession runs an interactive shell in the session's directory
+// with the failed step's environment, reading input from in and writing
+// output to out until the shell exits, ctx is done or the session ends.
+// Secrets are not passed to the shell. Every input line is audited.
+func (pe *PipelineEngine) AttachDebugSession(ctx context.Context, id, user string, in io.Reader, out io.Writer) error {
+	pe.mu.Lock()
+	session, ok := pe.debugSessions[id]
+	if !ok {
+		pe.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrDebugSessionNotFound, id)
+	}
+	if session.Status != DebugActive {
+		pe.mu.Unlock()
+		return fmt.Errorf("debug session %s is %s", id, session.Status)
+	}
+	session.Attached++
+	pe.mu.Unlock()
+
+	defer func() {
+		pe.mu.Lock()
+		session.Attached--
+		pe.mu.Unlock()
+	}()
+
+	cmd := exec.Command(session.shell, "-i")
+	cmd.Dir = session.Dir
+	cmd.Env = os.Environ()
+	for key, value := range session.env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.Env = append(cmd.Env, "CONVEYOR_DEBUG_SESSION="+session.ID)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	setProcessGroup(cmd)
+
+	// A pipe rather than cmd.Stdin, so waiting for the shell doesn't wait
+	// for the next read from in
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start debug shell: %w", err)
+	}
+	pe.auditDebug(session, user, DebugEventAttached, session.shell)
+
+	go func() {
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			line := scanner.Text()
+			pe.auditDebug(session, user, DebugEventInput, line)
+			if _, err := io.WriteString(stdin, line+"\n"); err != nil {
+				break
+			}
+		}
+		stdin.Close()
+	}()
+
+	shellCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-session.done:
+			cancel()
+		case <-shellCtx.Done():
+		}
+	}()
+
+	err = waitOrKill(shellCtx, cmd)
+	exitCode := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode = exitErr.ExitCode()
+	}
+	pe.auditDebug(session, user, DebugEventDetached, fmt.Sprintf("exit code %d", exitCode))
+	if shellCtx.Err() != nil {
+		return nil
+	}
+	if err != nil && exitCode == 0 {
+		return fmt.Errorf("debug shell failed: %w", err)
+	}
+	return nil
+}
+
+// auditDebug records an audit entry for a session and persists it when
+// the store supports it
+func (pe *PipelineEngine) auditDebug(session *debugSession, user, event, data string) {
+	entry := DebugAuditEntry{
+		Time:       time.Now(),
+		SessionID:  session.ID,
+		JobID:      session.JobID,
+		PipelineID: session.PipelineID,
+		User:       user,
+		Event:      event,
+		Data:       data,
+	}
+
+	pe.mu.Lock()
+	session.audit = append(session.audit, entry)
+	pe.mu.Unlock()
+
+	if store, ok := pe.store.(DebugAuditStore); ok {
+		if err := store.AppendDebugAudit(entry); err != nil {
+			pe.logger.Printf("Debug session %s: failed to save audit entry: %v", session.ID, err)
+		}
+	}
+}
+
+// emitDebugEvent emits an event about a debug session
+func (pe *PipelineEngine) emitDebugEvent(eventType string, session *debugSession) {
+	pe.mu.RLock()
+	data := map[string]interface{}{
+		"sessionId": session.ID,
+		"status":    session.Status,
+		"expiresAt": session.ExpiresAt,
+	}
+	pe.mu.RUnlock()
+
+	pe.emitEvent(Event{
+		Type:       eventType,
+		Timestamp:  time.Now(),
+		PipelineID: session.PipelineID,
+		JobID:      session.JobID,
+		StepID:     session.StepID,
+		Data:       data,
+	})
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugSession_KeepsFailedStep(t *testing.T) {
+	runtime := &fakeRuntime{}
+	defer runtime.close()
+	dir := t.TempDir()
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := newTestEngine(WithServiceRuntime(runtime), WithExecutor(&ShellExecutor{Dir: dir}), WithStore(store))
+	pipeline := scriptPipeline("it", `echo broken > state; exit 3`)
+	pipeline.Stages[0].Steps[0].Services = []Service{{Name: "postgres", Image: "postgres:15"}}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "it", WithDebugOnFailure(time.Minute))
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusFailed {
+		t.Fatalf("Status = %q, want failed", job.Status)
+	}
+
+	sessions := engine.DebugSessions(job.ID)
+	if len(sessions) != 1 || sessions[0].Status != DebugActive || sessions[0].StepID != "build-step-a" {
+		t.Fatalf("DebugSessions() = %+v, want one active session", sessions)
+	}
+	session := sessions[0]
+	for _, call := range runtime.calls {
+		if call == "stop postgres" {
+			t.Fatal("services stopped while the debug session is open")
+		}
+	}
+
+	var out bytes.Buffer
+	in := strings.NewReader("cat state\necho step=$CONVEYOR_STEP_ID host=$POSTGRES_HOST\nexit\n")
+	if err := engine.AttachDebugSession(context.Background(), session.ID, "alice", in, &out); err != nil {
+		t.Fatalf("AttachDebugSession() error = %v", err)
+	}
+	if !strings.Contains(out.String(), "broken") || !strings.Contains(out.String(), "step=build-step-a host=127.0.0.1") {
+		t.Errorf("output = %q, want the step's workspace and environment", out.String())
+	}
+
+	if err := engine.CloseDebugSession(session.ID, "alice"); err != nil {
+		t.Fatalf("CloseDebugSession() error = %v", err)
+	}
+	if err := engine.CloseDebugSession(session.ID, "alice"); err == nil {
+		t.Error("CloseDebugSession() on a closed session expected error, got nil")
+	}
+	if got := strings.Join(runtime.calls, ","); !strings.Contains(got, "stop postgres") {
+		t.Errorf("calls = %v, want services stopped when the session closes", runtime.calls)
+	}
+
+	audit, _ := engine.DebugAudit(session.ID)
+	var events []string
+	for _, entry := range audit {
+		events = append(events, entry.Event)
+	}
+	want := "opened,attached,input,input,input,detached,closed"
+	if strings.Join(events, ",") != want {
+		t.Errorf("audit events = %v, want %s", events, want)
+	}
+	if audit[2].User != "alice" || audit[2].Data != "cat state" {
+		t.Errorf("input entry = %+v, want alice's command", audit[2])
+	}
+	data, err := os.ReadFile(filepath.Join(store.dir, "debug", "audit.jsonl"))
+	if err != nil || strings.Count(string(data), "\n") != len(audit) {
+		t.Errorf("stored audit log = %q, %v, want every entry", data, err)
+	}
+}
+
+func TestDebugSession_Expires(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("it", `exit 1`)
+	pipeline.DebugOnFailure = "50ms"
+	engine.CreatePipeline(pipeline)
+
+	job, _ := engine.Run(context.Background(), "it")
+	sessions := engine.DebugSessions(job.ID)
+	if len(sessions) != 1 {
+		t.Fatalf("DebugSessions() = %+v, want one session", sessions)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		session, err := engine.GetDebugSession(sessions[0].ID)
+		if err != nil {
+			t.Fatalf("GetDebugSession() error = %v", err)
+		}
+		if session.Status == DebugExpired {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Status = %q, want expired", session.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := engine.AttachDebugSession(context.Background(), sessions[0].ID, "alice", strings.NewReader(""), &bytes.Buffer{}); err == nil {
+		t.Error("AttachDebugSession() on an expired session expected error, got nil")
+	}
+}
+
+func TestDebugSession_OffByDefault(t *testing.T) {
+	engine := newTestEngine()
+	engine.CreatePipeline(scriptPipeline("it", `exit 1`))
+
+	job, _ := engine.Run(context.Background(), "it")
+	if sessions := engine.DebugSessions(job.ID); len(sessions) != 0 {
+		t.Errorf("DebugSessions() = %+v, want none", sessions)
+	}
+}
+
+func TestParseDebugTTL(t *testing.T) {
+	for _, value := range []string{"", "soon", "0s", "-5m", "5h"} {
+		if _, err := ParseDebugTTL(value); err == nil {
+			t.Errorf("ParseDebugTTL(%q) expected error, got nil", value)
+		}
+	}
+	if ttl, err := ParseDebugTTL("30m"); err != nil || ttl != 30*time.Minute {
+		t.Errorf("ParseDebugTTL(30m) = %v, %v, want 30m", ttl, err)
+	}
+}
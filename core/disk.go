@@ -0,0 +1,253 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// FailureDiskQuota is the failure class of steps stopped for using more
+// disk than their job's quota, or for leaving less free space than the
+// server reserves
+const FailureDiskQuota = "disk_quota"
+
+// Reasons a step was stopped for its disk usage
+const (
+	DiskQuotaJob     = "job_quota"
+	DiskQuotaReserve = "reserve"
+)
+
+// defaultDiskInterval is how often disk usage is measured by default
+const defaultDiskInterval = 5 * time.Second
+
+// DiskQuotaPolicy bounds the disk jobs use. Usage is measured every
+// Interval while a step runs, and the step is stopped once it is over.
+type DiskQuotaPolicy struct {
+	// JobBytes is the most a job's directory may hold. Zero means
+	// unlimited; pipelines can set their own with DiskQuota.
+	JobBytes int64
+	// ReserveBytes is the free space kept for the server on the
+	// filesystem of ReserveDir. Steps don't start, and running ones are
+	// stopped, while less is free. Zero turns it off.
+	ReserveBytes int64
+	ReserveDir   string
+	// Interval is how often usage is measured, 5s by default
+	Interval time.Duration
+}
+
+// DiskUsage is the disk a step's job used while the step ran
+type DiskUsage struct {
+	// PeakBytes is the most the job's directory held
+	PeakBytes  int64 `json:"peakBytes"`
+	QuotaBytes int64 `json:"quotaBytes,omitempty"`
+	// Exceeded is why the step was stopped, job_quota or reserve
+	Exceeded string `json:"exceeded,omitempty"`
+}
+
+// DiskStats counts a pipeline's steps stopped for their disk usage since
+// the engine started
+type DiskStats struct {
+	PipelineID string `json:"pipelineId"`
+	// QuotaExceeded counts steps stopped over their job's quota, and
+	// ReserveExceeded steps stopped to keep the server's reserve free
+	QuotaExceeded   int `json:"quotaExceeded"`
+	ReserveExceeded int `json:"reserveExceeded"`
+	// PeakBytes is the most a job's directory held
+	PeakBytes int64 `json:"peakBytes"`
+}
+
+// DiskQuotaError is the error of a step stopped for its disk usage
+type DiskQuotaError struct {
+	Reason string
+	// Used and Limit are the job's usage and quota, or the free space and
+	// the reserve
+	Used  int64
+	Limit int64
+}
+
+func (e *DiskQuotaError) Error() string {
+	if e.Reason == DiskQuotaReserve {
+		return fmt.Sprintf("only %s of disk is free, less than the %s reserved for the server", FormatMemory(e.Used), FormatMemory(e.Limit))
+	}
+	return fmt.Sprintf("job uses %s of disk, over its quota of %s", FormatMemory(e.Used), FormatMemory(e.Limit))
+}
+
+// WithDiskQuotas bounds the disk jobs use
+func WithDiskQuotas(policy DiskQuotaPolicy) Option {
+	return func(pe *PipelineEngine) {
+		if policy.Interval <= 0 {
+			policy.Interval = defaultDiskInterval
+		}
+		pe.diskPolicy = policy
+	}
+}
+
+// ValidateDiskQuota checks a pipeline's disk quota, such as "20Gi"
+func ValidateDiskQuota(quota string) error {
+	size, err := ParseMemory(quota)
+	if err != nil {
+		return fmt.Errorf("invalid disk quota %q", quota)
+	}
+	if size < 1<<20 {
+		return fmt.Errorf("disk quota %q must be at least 1Mi", quota)
+	}
+	return nil
+}
+
+// jobDiskQuota returns the disk quota of a pipeline's jobs
+func (pe *PipelineEngine) jobDiskQuota(pipeline *Pipeline) int64 {
+	if pipeline.DiskQuota != "" {
+		if quota, err := ParseMemory(pipeline.DiskQuota); err == nil && quota > 0 {
+			return quota
+		}
+	}
+	return pe.diskPolicy.JobBytes
+}
+
+// diskWatch measures the disk a step's job uses while the step runs
+type diskWatch struct {
+	dir     string
+	quota   int64
+	reserve int64
+	// reserveDir is the directory whose filesystem keeps the reserve
+	reserveDir string
+	usage      DiskUsage
+	err        *DiskQuotaError
+	done       chan struct{}
+	stopped    chan struct{}
+}
+
+// check measures the usage once, returning an error when it is over
+func (w *diskWatch) check() *DiskQuotaError {
+	if w.quota > 0 && w.dir != "" {
+		used := dirSize(w.dir)
+		if used > w.usage.PeakBytes {
+			w.usage.PeakBytes = used
+		}
+		if used > w.quota {
+			return &DiskQuotaError{Reason: DiskQuotaJob, Used: used, Limit: w.quota}
+		}
+	}
+	if w.reserve > 0 {
+		if free, err := freeSpace(w.reserveDir); err == nil && free < w.reserve {
+			return &DiskQuotaError{Reason: DiskQuotaReserve, Used: free, Limit: w.reserve}
+		}
+	}
+	return nil
+}
+
+// watchDisk returns a watch of the disk a step of a job uses, and a
+// context cancelled when the usage is over, or nil when no quota or
+// reserve applies. A step that would start below the reserve gets its
+// error right away.
+func (pe *PipelineEngine) watchDisk(ctx context.Context, pipeline *Pipeline, job *Job) (*diskWatch, context.Context, error) {
+	quota := pe.jobDiskQuota(pipeline)
+	if quota <= 0 && pe.diskPolicy.ReserveBytes <= 0 {
+		return nil, ctx, nil
+	}
+	w := &diskWatch{
+		dir:        pe.jobDir(job),
+		quota:      quota,
+		reserve:    pe.diskPolicy.ReserveBytes,
+		reserveDir: pe.diskPolicy.ReserveDir,
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	w.usage.QuotaBytes = quota
+	if w.reserveDir == "" {
+		w.reserveDir = "."
+	}
+	if err := w.check(); err != nil && err.Reason == DiskQuotaReserve {
+		w.err = err
+		w.usage.Exceeded = err.Reason
+		close(w.stopped)
+		return w, ctx, err
+	}
+
+	interval := pe.diskPolicy.Interval
+	if interval <= 0 {
+		interval = defaultDiskInterval
+	}
+	watchCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer close(w.stopped)
+		defer cancel()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-watchCtx.Done():
+				return
+			case <-ticker.C:
+				if err := w.check(); err != nil {
+					w.err = err
+					return
+				}
+			}
+		}
+	}()
+	return w, watchCtx, nil
+}
+
+// stop ends the watch and measures the usage the step left behind,
+// returning an error when the job went over
+func (w *diskWatch) stop() *DiskQuotaError {
+	select {
+	case <-w.done:
+	default:
+		close(w.done)
+	}
+	<-w.stopped
+	if w.err == nil {
+		if err := w.check(); err != nil && err.Reason == DiskQuotaJob {
+			w.err = err
+		}
+	}
+	if w.err != nil {
+		w.usage.Exceeded = w.err.Reason
+	}
+	return w.err
+}
+
+// recordDiskUsage records the disk a step's job used on the step and the
+// pipeline's stats
+func (pe *PipelineEngine) recordDiskUsage(pipelineID string, job *Job, index int, usage DiskUsage) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	job.Steps[index].Disk = &usage
+	stats := pe.diskStats[pipelineID]
+	if stats == nil {
+		stats = &DiskStats{PipelineID: pipelineID}
+		pe.diskStats[pipelineID] = stats
+	}
+	switch usage.Exceeded {
+	case DiskQuotaJob:
+		stats.QuotaExceeded++
+	case DiskQuotaReserve:
+		stats.ReserveExceeded++
+	}
+	if usage.PeakBytes > stats.PeakBytes {
+		stats.PeakBytes = usage.PeakBytes
+	}
+}
+
+// DiskStats reports the steps stopped for their disk usage per pipeline,
+// for one pipeline when pipelineID is set, sorted by pipeline ID
+func (pe *PipelineEngine) DiskStats(pipelineID string) []DiskStats {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	stats := make([]DiskStats, 0, len(pe.diskStats))
+	for _, s := range pe.diskStats {
+		if pipelineID == "" || s.PipelineID == pipelineID {
+			stats = append(stats, *s)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].PipelineID < stats[j].PipelineID
+	})
+	return stats
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestValidateDiskQuota(t *testing.T) {
+	if err := ValidateDiskQuota("20Gi"); err != nil {
+		t.Errorf("ValidateDiskQuota(20Gi) error = %v", err)
+	}
+	for _, quota := range []string{"", "lots", "512Ki"} {
+		if err := ValidateDiskQuota(quota); err == nil {
+			t.Errorf("ValidateDiskQuota(%q) error = nil, want an error", quota)
+		}
+	}
+}
+
+func TestRun_DiskQuota(t *testing.T) {
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: t.TempDir()}), WithDiskQuotas(DiskQuotaPolicy{Interval: 10 * time.Millisecond}))
+	pipeline := scriptPipeline("disk", "head -c 2097152 /dev/zero > big && sleep 10")
+	pipeline.DiskQuota = "1Mi"
+	engine.CreatePipeline(pipeline)
+
+	start := time.Now()
+	job, err := engine.Run(context.Background(), "disk")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Run() took %s, want the step stopped once over its quota", elapsed)
+	}
+	step := job.Steps[0]
+	if job.Status != StatusFailed || step.FailureClass != FailureDiskQuota || job.FailureClass != FailureDiskQuota {
+		t.Fatalf("Status = %s, step FailureClass = %q, job FailureClass = %q, want failed with disk_quota", job.Status, step.FailureClass, job.FailureClass)
+	}
+	if step.Disk == nil || step.Disk.Exceeded != DiskQuotaJob || step.Disk.QuotaBytes != 1<<20 || step.Disk.PeakBytes < 2<<20 {
+		t.Errorf("Disk = %+v, want the job quota exceeded at 2Mi", step.Disk)
+	}
+	if stats := engine.DiskStats(""); len(stats) != 1 || stats[0].QuotaExceeded != 1 || stats[0].PeakBytes < 2<<20 {
+		t.Errorf("DiskStats() = %+v, want one step over its quota", stats)
+	}
+	series, err := engine.QueryMetric(MetricQuery{Metric: MetricDiskQuotaExceeded, From: start.Add(-time.Minute), To: time.Now().Add(time.Minute), Interval: time.Hour})
+	if err != nil {
+		t.Fatalf("QueryMetric() error = %v", err)
+	}
+	// The window may span two hourly buckets
+	var exceeded float64
+	for _, point := range series.Points {
+		exceeded += point.Value
+	}
+	if exceeded != 1 {
+		t.Errorf("QueryMetric() = %+v, want one step", series)
+	}
+}
+
+func TestRun_DiskReserve(t *testing.T) {
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: t.TempDir()}), WithDiskQuotas(DiskQuotaPolicy{ReserveBytes: 1 << 62, ReserveDir: t.TempDir()}))
+	engine.CreatePipeline(scriptPipeline("reserve", "echo ran"))
+
+	job, err := engine.Run(context.Background(), "reserve")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	step := job.Steps[0]
+	if step.FailureClass != FailureDiskQuota || step.Output != "" {
+		t.Errorf("step = %s %q with output %q, want disk_quota without running", step.Status, step.FailureClass, step.Output)
+	}
+	if step.Disk == nil || step.Disk.Exceeded != DiskQuotaReserve {
+		t.Errorf("Disk = %+v, want the reserve exceeded", step.Disk)
+	}
+}
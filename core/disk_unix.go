@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package core
+
+import "syscall"
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem of dir
+func freeSpace(dir string) (int64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, err
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize), nil
+}
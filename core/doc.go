@@ -0,0 +1,20 @@
+// Package core implements the Conveyor pipeline engine.
+//
+// The engine has no dependency on the HTTP API and can be embedded directly
+// in other Go programs:
+//
+//	engine := core.NewPipelineEngine(
+//		core.WithPlugins(security.NewSecurityPlugin()),
+//		core.WithExecutor(&core.ShellExecutor{Dir: "/src"}),
+//	)
+//
+//	sub := engine.Subscribe(100)
+//	defer sub.Close()
+//
+//	if err := engine.CreatePipeline(pipeline); err != nil {
+//		return err
+//	}
+//	job, err := engine.Run(ctx, pipeline.ID)
+//
+// The api package wraps an engine with the REST and WebSocket endpoints.
+package core
@@ -0,0 +1,196 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxBusEvents is how many events the in-memory event bus keeps for
+// listeners catching up
+const maxBusEvents = 10000
+
+// maxOutboxEvents is how many events wait to be published to a remote
+// event bus before newer ones are dropped
+const maxOutboxEvents = 10000
+
+// ErrInvalidEventPosition is returned when reading an event bus after a
+// position that isn't one of its positions
+var ErrInvalidEventPosition = errors.New("invalid event position")
+
+// EventBus carries the events of every replica of a server in one order.
+// Each event has a position listeners resume reading from, so a listener
+// that falls behind catches up rather than losing events, as long as the
+// bus still keeps them.
+type EventBus interface {
+	// Publish appends an event and returns its position
+	Publish(ctx context.Context, event Event) (string, error)
+	// Read returns up to limit events after a position, or from the oldest
+	// kept when after is "", waiting up to wait for one to arrive
+	Read(ctx context.Context, after string, limit int, wait time.Duration) ([]Event, error)
+	// Last returns the position of the newest event, or "" without events
+	Last(ctx context.Context) (string, error)
+}
+
+// WithEventBus publishes events to a bus shared by the replicas of a server,
+// such as Redis, instead of keeping them in memory. Events are published in
+// the background by RunEventBus; replica names the events' origin.
+func WithEventBus(bus EventBus, replica string) Option {
+	return func(pe *PipelineEngine) {
+		pe.bus = bus
+		pe.replica = replica
+		pe.outbox = make(chan Event, maxOutboxEvents)
+	}
+}
+
+// ReadEvents returns up to limit events of every replica after a position,
+// or from the oldest kept when after is "", waiting up to wait for one.
+// Each event's Position is where the next read resumes.
+func (pe *PipelineEngine) ReadEvents(ctx context.Context, after string, limit int, wait time.Duration) ([]Event, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	return pe.bus.Read(ctx, after, limit, wait)
+}
+
+// LastEventPosition returns the position of the newest event, where a
+// listener only interested in new events starts reading
+func (pe *PipelineEngine) LastEventPosition(ctx context.Context) (string, error) {
+	return pe.bus.Last(ctx)
+}
+
+// publishEvent appends an event to the bus. Events for a remote bus are
+// queued so the engine never waits on the network, and are dropped when
+// the queue is full.
+func (pe *PipelineEngine) publishEvent(event Event) {
+	event.Origin = pe.replica
+	if pe.outbox == nil {
+		pe.bus.Publish(context.Background(), event)
+		return
+	}
+	select {
+	case pe.outbox <- event:
+	default:
+		pe.logger.Printf("Event bus queue is full, dropped event %s", event.Type)
+	}
+}
+
+// RunEventBus publishes queued events to a remote event bus until ctx is
+// done, retrying each event until it is published
+func (pe *PipelineEngine) RunEventBus(ctx context.Context) {
+	if pe.outbox == nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-pe.outbox:
+			for attempt := 0; ; attempt++ {
+				if _, err := pe.bus.Publish(ctx, event); err == nil {
+					break
+				} else if attempt == 0 {
+					pe.logger.Printf("Failed to publish event %s, retrying: %v", event.Type, err)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+			}
+		}
+	}
+}
+
+// memoryBus is the event bus of a single server: the newest events in
+// memory at positions counting up from 1
+type memoryBus struct {
+	mu     sync.Mutex
+	events []Event
+	// next is the position of the next event published
+	next uint64
+	// published is closed and replaced whenever an event is published
+	published chan struct{}
+}
+
+func newMemoryBus() *memoryBus {
+	return &memoryBus{next: 1, published: make(chan struct{})}
+}
+
+func (b *memoryBus) Publish(ctx context.Context, event Event) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	event.Position = strconv.FormatUint(b.next, 10)
+	b.next++
+	b.events = append(b.events, event)
+	if len(b.events) > maxBusEvents {
+		b.events = append([]Event(nil), b.events[len(b.events)-maxBusEvents/2:]...)
+	}
+	close(b.published)
+	b.published = make(chan struct{})
+	return event.Position, nil
+}
+
+func (b *memoryBus) Read(ctx context.Context, after string, limit int, wait time.Duration) ([]Event, error) {
+	var position uint64
+	if after != "" {
+		var err error
+		if position, err = strconv.ParseUint(after, 10, 64); err != nil {
+			return nil, fmt.Errorf("%w %q", ErrInvalidEventPosition, after)
+		}
+	}
+
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		b.mu.Lock()
+		if n := len(b.events); n > 0 {
+			// Positions are consecutive, so the first event after position
+			// is found by offset
+			first, _ := strconv.ParseUint(b.events[0].Position, 10, 64)
+			start := 0
+			if position >= first {
+				start = int(position - first + 1)
+			}
+			if start < n {
+				end := start + limit
+				if end > n {
+					end = n
+				}
+				events := append([]Event(nil), b.events[start:end]...)
+				b.mu.Unlock()
+				return events, nil
+			}
+		}
+		published := b.published
+		b.mu.Unlock()
+
+		if timeout == nil {
+			return []Event{}, nil
+		}
+		select {
+		case <-published:
+		case <-timeout:
+			return []Event{}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (b *memoryBus) Last(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.events) == 0 {
+		return "", nil
+	}
+	return b.events[len(b.events)-1].Position, nil
+}
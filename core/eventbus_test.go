@@ -0,0 +1,88 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadEvents(t *testing.T) {
+	engine := newTestEngine()
+	ctx := context.Background()
+	if last, err := engine.LastEventPosition(ctx); err != nil || last != "" {
+		t.Errorf("LastEventPosition() = %q, %v, want no position", last, err)
+	}
+	for _, jobID := range []string{"a", "b", "c"} {
+		engine.emitEvent(Event{Type: "job_started", JobID: jobID})
+	}
+
+	// A listener reads a page at a time from where it left off
+	events, err := engine.ReadEvents(ctx, "", 2, 0)
+	if err != nil || len(events) != 2 || events[0].JobID != "a" || events[1].Position != "2" {
+		t.Fatalf("ReadEvents() = %+v, %v, want the first two events", events, err)
+	}
+	events, err = engine.ReadEvents(ctx, events[1].Position, 2, 0)
+	if err != nil || len(events) != 1 || events[0].JobID != "c" {
+		t.Fatalf("ReadEvents() = %+v, %v, want the third event", events, err)
+	}
+
+	// A read waiting for new events returns when one is emitted
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		engine.emitEvent(Event{Type: "job_completed", JobID: "c"})
+	}()
+	events, err = engine.ReadEvents(ctx, "3", 10, 5*time.Second)
+	if err != nil || len(events) != 1 || events[0].Type != "job_completed" {
+		t.Errorf("ReadEvents() waiting = %+v, %v, want the new event", events, err)
+	}
+	if _, err := engine.ReadEvents(ctx, "first", 10, 0); !errors.Is(err, ErrInvalidEventPosition) {
+		t.Errorf("ReadEvents() of an invalid position error = %v, want ErrInvalidEventPosition", err)
+	}
+}
+
+// flakyBus fails its first publish
+type flakyBus struct {
+	*memoryBus
+	mu        sync.Mutex
+	failed    bool
+	published chan Event
+}
+
+func (b *flakyBus) Publish(ctx context.Context, event Event) (string, error) {
+	b.mu.Lock()
+	failed := b.failed
+	b.failed = true
+	b.mu.Unlock()
+	if !failed {
+		return "", errors.New("connection refused")
+	}
+	b.published <- event
+	return b.memoryBus.Publish(ctx, event)
+}
+
+func TestRunEventBus(t *testing.T) {
+	bus := &flakyBus{memoryBus: newMemoryBus(), published: make(chan Event, 1)}
+	engine := newTestEngine(WithEventBus(bus, "replica-a"))
+	sub := engine.Subscribe(1)
+	defer sub.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go engine.RunEventBus(ctx)
+	engine.emitEvent(Event{Type: "job_started", JobID: "a"})
+
+	// Local listeners get the event at once, the bus after a retry
+	if event := <-sub.Events(); event.JobID != "a" {
+		t.Errorf("listener event = %+v, want the emitted event", event)
+	}
+	select {
+	case event := <-bus.published:
+		if event.Origin != "replica-a" {
+			t.Errorf("Origin = %q, want replica-a", event.Origin)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not published to the bus")
+	}
+}
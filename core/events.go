@@ -0,0 +1,102 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var subscriptionCounter uint64
+
+// Subscription delivers engine events to a subscriber until it is closed
+type Subscription struct {
+	id     string
+	events chan Event
+	engine *PipelineEngine
+	once   sync.Once
+}
+
+// Subscribe registers a new event subscription. Events are delivered on a
+// channel with the given buffer size; when the buffer is full, events are
+// dropped rather than blocking the engine.
+func (pe *PipelineEngine) Subscribe(buffer int) *Subscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+
+	sub := &Subscription{
+		id:     fmt.Sprintf("subscription-%d", atomic.AddUint64(&subscriptionCounter, 1)),
+		events: make(chan Event, buffer),
+		engine: pe,
+	}
+	pe.RegisterEventListener(sub.id, sub.events)
+
+	return sub
+}
+
+// Events returns the channel events are delivered on. It is closed when the
+// subscription is closed.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Close unregisters the subscription and closes its event channel
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.engine.UnregisterEventListener(s.id)
+		close(s.events)
+	})
+}
+
+// maxJobEvents is how many events of a job are kept in memory when the
+// store doesn't keep them
+const maxJobEvents = 1000
+
+var eventCounter uint64
+
+// EventStore is implemented by stores that keep the event history of jobs
+type EventStore interface {
+	AppendEvent(event Event) error
+	JobEvents(jobID string) ([]Event, error)
+}
+
+// newEventID returns a unique event ID
+func newEventID() string {
+	return fmt.Sprintf("event-%d-%d", time.Now().UnixNano(), atomic.AddUint64(&eventCounter, 1))
+}
+
+// recordEvent adds an event of a job to the job's event history
+func (pe *PipelineEngine) recordEvent(event Event) {
+	if event.JobID == "" {
+		return
+	}
+	if store, ok := pe.store.(EventStore); ok {
+		if err := store.AppendEvent(event); err != nil {
+			pe.logger.Printf("Failed to store event %s of job %s: %v", event.Type, event.JobID, err)
+		}
+		return
+	}
+
+	pe.eventsMu.Lock()
+	defer pe.eventsMu.Unlock()
+	events := append(pe.jobEvents[event.JobID], event)
+	if len(events) > maxJobEvents {
+		events = events[len(events)-maxJobEvents:]
+	}
+	pe.jobEvents[event.JobID] = events
+}
+
+// JobEvents returns the events of a job in the order they were emitted
+func (pe *PipelineEngine) JobEvents(jobID string) ([]Event, error) {
+	if _, err := pe.FindJob(jobID); err != nil {
+		return nil, err
+	}
+	if store, ok := pe.store.(EventStore); ok {
+		return store.JobEvents(jobID)
+	}
+
+	pe.eventsMu.RLock()
+	defer pe.eventsMu.RUnlock()
+	return append([]Event{}, pe.jobEvents[jobID]...), nil
+}
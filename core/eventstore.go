@@ -0,0 +1,74 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AppendEvent appends an event to the history of its job in
+// events/<job>.jsonl
+func (s *FileStore) AppendEvent(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := filepath.Join(s.dir, "events")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create events directory: %w", err)
+	}
+	file, err := os.OpenFile(s.eventsPath(event.JobID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open event history: %w", err)
+	}
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write event history: %w", err)
+	}
+	return nil
+}
+
+// JobEvents reads the event history of a job. Lines that can't be decoded,
+// such as one cut short by a crash, are skipped.
+func (s *FileStore) JobEvents(jobID string) ([]Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open(s.eventsPath(jobID))
+	if os.IsNotExist(err) {
+		return []Event{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event history: %w", err)
+	}
+	defer file.Close()
+
+	events := []Event{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err == nil {
+			events = append(events, event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read event history: %w", err)
+	}
+	return events, nil
+}
+
+// eventsPath returns the path of a job's event history
+func (s *FileStore) eventsPath(jobID string) string {
+	return filepath.Join(s.dir, "events", strings.ReplaceAll(jobID, string(filepath.Separator), "_")+".jsonl")
+}
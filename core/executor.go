@@ -0,0 +1,136 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// StepExecutor runs the command of a single step
+type StepExecutor interface {
+	Execute(ctx context.Context, step Step, env map[string]string) (*StepResult, error)
+}
+
+// StepResult describes the outcome of a step execution
+type StepResult struct {
+	ExitCode int                    `json:"exitCode"`
+	Output   string                 `json:"output,omitempty"`
+	Outputs  map[string]interface{} `json:"outputs,omitempty"`
+	// Annotations are the problems the step found in the source
+	Annotations []Annotation `json:"annotations,omitempty"`
+	// TestReport is the results of the tests the step ran
+	TestReport *TestReport `json:"testReport,omitempty"`
+	// Migrations are the database migrations the step applied or rolled
+	// back
+	Migrations []Migration `json:"migrations,omitempty"`
+	// LoadTests are the results of the load tests the step ran
+	LoadTests []LoadTest `json:"loadTests,omitempty"`
+	// outputSize is the size of the output before truncation, and
+	// fullOutput a temporary file with the untruncated output
+	outputSize int64
+	fullOutput string
+}
+
+// ShellExecutor runs step commands with a shell on the local host
+type ShellExecutor struct {
+	// Shell is the shell binary used to run commands. Defaults to "sh".
+	Shell string
+	// Dir is the working directory for commands. Defaults to the current directory.
+	Dir string
+	// Resume allows jobs interrupted by a server restart to continue from
+	// their last completed step. Only enable it when steps are idempotent.
+	Resume bool
+}
+
+// CanResume reports whether interrupted jobs may be resumed
+func (e *ShellExecutor) CanResume(job *Job) bool {
+	return e.Resume
+}
+
+// WorkingDir returns the directory commands run in
+func (e *ShellExecutor) WorkingDir() string {
+	return e.Dir
+}
+
+// Execute runs the step command in the executor's directory and captures
+// its combined output
+func (e *ShellExecutor) Execute(ctx context.Context, step Step, env map[string]string) (*StepResult, error) {
+	return e.ExecuteIn(ctx, e.Dir, step, env)
+}
+
+// ExecuteIn runs the step command in dir and captures its combined output
+func (e *ShellExecutor) ExecuteIn(ctx context.Context, dir string, step Step, env map[string]string) (*StepResult, error) {
+	if strings.TrimSpace(step.Command) == "" {
+		return nil, fmt.Errorf("step %s has no command", step.ID)
+	}
+
+	shell := e.Shell
+	if shell == "" {
+		shell = "sh"
+	}
+
+	cmd := exec.Command(shell, "-c", step.Command)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	return runCommand(ctx, cmd)
+}
+
+// runCommand runs a step's command, capturing its combined output up to the
+// output limit in ctx, and stops it when ctx is cancelled
+func runCommand(ctx context.Context, cmd *exec.Cmd) (*StepResult, error) {
+	output := newOutputCapture(outputLimit(ctx))
+	var w io.Writer = output
+	if sink := outputSink(ctx); sink != nil {
+		w = io.MultiWriter(output, sink)
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return nil, &InfrastructureError{Err: fmt.Errorf("failed to run command: %w", err)}
+	}
+
+	err := waitOrKill(ctx, cmd)
+	result := &StepResult{outputSize: output.size}
+	result.Output, result.fullOutput, _ = output.result()
+	if ctx.Err() != nil {
+		result.ExitCode = -1
+		return result, fmt.Errorf("command stopped: %w", ctx.Err())
+	}
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			result.ExitCode = exitErr.ExitCode()
+			if result.ExitCode < 0 {
+				return result, &InfrastructureError{Err: fmt.Errorf("command killed: %v", exitErr)}
+			}
+			return result, fmt.Errorf("command exited with code %d", result.ExitCode)
+		}
+		return result, &InfrastructureError{Err: fmt.Errorf("failed to run command: %w", err)}
+	}
+
+	return result, nil
+}
+
+// waitOrKill waits for a started command, killing its process group if ctx
+// is cancelled first
+func waitOrKill(ctx context.Context, cmd *exec.Cmd) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		return <-done
+	}
+}
@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package core
+
+import "os/exec"
+
+// setProcessGroup is a no-op on Windows
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup terminates the command process
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,827 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expressionPattern matches expressions such as ${{ hashFiles('go.sum') }}
+var expressionPattern = regexp.MustCompile(`\$\{\{(.*?)\}\}`)
+
+// expressionScope is what expressions are evaluated with
+type expressionScope struct {
+	values map[string]string
+	// dir is the directory hashFiles patterns are relative to
+	dir string
+	now time.Time
+}
+
+// expressionFunction is a built-in function of expressions. Functions that
+// need the job's directory can't be used where it isn't known yet.
+type expressionFunction struct {
+	minArgs, maxArgs int
+	needsDir         bool
+	call             func(scope expressionScope, args []interface{}) (interface{}, error)
+}
+
+// expressionFunctions are the functions expressions can call, by name
+var expressionFunctions map[string]expressionFunction
+
+func init() {
+	expressionFunctions = map[string]expressionFunction{
+		"hashFiles":     {1, -1, true, hashFilesFunction},
+		"fromJSON":      {1, 1, false, fromJSONFunction},
+		"toJSON":        {1, 1, false, toJSONFunction},
+		"toUpper":       {1, 1, false, toUpperFunction},
+		"toLower":       {1, 1, false, toLowerFunction},
+		"date":          {1, 2, false, dateFunction},
+		"semverCompare": {2, 2, false, semverCompareFunction},
+	}
+}
+
+// ValidateExpressions checks the syntax, functions and references of the
+// expressions in s
+func ValidateExpressions(s string) error {
+	_, err := parseExpressions(s)
+	return err
+}
+
+// parseExpressions parses the expressions in s, leaving out bare
+// references, which are substituted as they are
+func parseExpressions(s string) ([]expressionNode, error) {
+	var nodes []expressionNode
+	for _, match := range expressionPattern.FindAllStringSubmatch(s, -1) {
+		source := strings.TrimSpace(match[1])
+		if referenceExpression.MatchString(match[0]) {
+			continue
+		}
+		node, err := parseExpression(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression %q: %w", source, err)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// expandExpressions replaces the references and expressions in s with
+// their values. Expressions that fail are left in place, and the first
+// error is returned.
+func expandExpressions(s string, scope expressionScope) (string, error) {
+	if !strings.Contains(s, "${{") {
+		return s, nil
+	}
+	var first error
+	expanded := expressionPattern.ReplaceAllStringFunc(s, func(match string) string {
+		if referenceExpression.MatchString(match) {
+			ref := referenceExpression.FindStringSubmatch(match)[1]
+			if !knownReference(ref) {
+				return match
+			}
+			return scope.values[ref]
+		}
+		source := strings.TrimSpace(expressionPattern.FindStringSubmatch(match)[1])
+		value, err := evaluateExpression(source, scope)
+		if err != nil {
+			if first == nil {
+				first = fmt.Errorf("expression %q: %w", source, err)
+			}
+			return match
+		}
+		return formatValue(value)
+	})
+	return expanded, first
+}
+
+// evaluateExpression parses and evaluates an expression
+func evaluateExpression(source string, scope expressionScope) (interface{}, error) {
+	node, err := parseExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	if scope.now.IsZero() {
+		scope.now = time.Now()
+	}
+	return node.eval(scope)
+}
+
+// formatValue returns the text a value expands to. Objects and arrays are
+// JSON, whole numbers have no decimals and null is empty.
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// truthy reports whether a value counts as true in a condition: anything
+// but false, null, zero, "", "false" and "0"
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != "" && v != "false" && v != "0"
+	}
+	return true
+}
+
+// expressionNode is a parsed expression
+type expressionNode interface {
+	eval(scope expressionScope) (interface{}, error)
+}
+
+type (
+	literalNode   struct{ value interface{} }
+	referenceNode struct{ name string }
+	callNode      struct {
+		name string
+		args []expressionNode
+	}
+	indexNode struct {
+		target, index expressionNode
+	}
+	notNode    struct{ operand expressionNode }
+	binaryNode struct {
+		op          string
+		left, right expressionNode
+	}
+)
+
+func (n literalNode) eval(expressionScope) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n referenceNode) eval(scope expressionScope) (interface{}, error) {
+	return scope.values[n.name], nil
+}
+
+func (n callNode) eval(scope expressionScope) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(scope)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	value, err := expressionFunctions[n.name].call(scope, args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", n.name, err)
+	}
+	return value, nil
+}
+
+func (n indexNode) eval(scope expressionScope) (interface{}, error) {
+	target, err := n.target.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+	switch t := target.(type) {
+	case map[string]interface{}:
+		return t[formatValue(index)], nil
+	case []interface{}:
+		i, ok := index.(float64)
+		if !ok || i < 0 || int(i) >= len(t) || i != float64(int(i)) {
+			return nil, nil
+		}
+		return t[int(i)], nil
+	}
+	return nil, nil
+}
+
+func (n notNode) eval(scope expressionScope) (interface{}, error) {
+	value, err := n.operand.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(value), nil
+}
+
+func (n binaryNode) eval(scope expressionScope) (interface{}, error) {
+	left, err := n.left.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "&&":
+		if !truthy(left) {
+			return left, nil
+		}
+		return n.right.eval(scope)
+	case "||":
+		if truthy(left) {
+			return left, nil
+		}
+		return n.right.eval(scope)
+	}
+	right, err := n.right.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return formatValue(left) == formatValue(right), nil
+	case "!=":
+		return formatValue(left) != formatValue(right), nil
+	}
+	c := compareValues(left, right)
+	switch n.op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	}
+	return c >= 0, nil
+}
+
+// compareValues orders two values as numbers when both are numbers or
+// numeric text, such as job.durationMinutes, and as text otherwise
+func compareValues(left, right interface{}) int {
+	a, errA := strconv.ParseFloat(formatValue(left), 64)
+	b, errB := strconv.ParseFloat(formatValue(right), 64)
+	if errA == nil && errB == nil {
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(formatValue(left), formatValue(right))
+}
+
+// expressionParser is a recursive descent parser of expressions:
+//
+//	or      = and { "||" and }
+//	and     = compare { "&&" compare }
+//	compare = unary [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) unary ]
+//	unary   = "!" unary | postfix
+//	postfix = primary { "." name | "[" or "]" }
+//	primary = string | number | true | false | null | name "(" [ or { "," or } ] ")" | reference | "(" or ")"
+type expressionParser struct {
+	source string
+	pos    int
+}
+
+// parseExpression parses an expression, checking its functions and
+// references
+func parseExpression(source string) (expressionNode, error) {
+	p := &expressionParser{source: source}
+	node, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	p.space()
+	if p.pos < len(p.source) {
+		return nil, fmt.Errorf("unexpected %q", p.source[p.pos:])
+	}
+	return node, nil
+}
+
+func (p *expressionParser) space() {
+	for p.pos < len(p.source) && (p.source[p.pos] == ' ' || p.source[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// accept consumes token when it comes next
+func (p *expressionParser) accept(token string) bool {
+	p.space()
+	if strings.HasPrefix(p.source[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func (p *expressionParser) or() (expressionNode, error) {
+	left, err := p.and()
+	for err == nil && p.accept("||") {
+		var right expressionNode
+		if right, err = p.and(); err == nil {
+			left = binaryNode{"||", left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *expressionParser) and() (expressionNode, error) {
+	left, err := p.compare()
+	for err == nil && p.accept("&&") {
+		var right expressionNode
+		if right, err = p.compare(); err == nil {
+			left = binaryNode{"&&", left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *expressionParser) compare() (expressionNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.accept(op) {
+			right, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			return binaryNode{op, left, right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) unary() (expressionNode, error) {
+	p.space()
+	if strings.HasPrefix(p.source[p.pos:], "!") && !strings.HasPrefix(p.source[p.pos:], "!=") {
+		p.pos++
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	}
+	node, err := p.primary()
+	for err == nil {
+		switch {
+		case p.accept("."):
+			name := p.name(false)
+			if name == "" {
+				return nil, fmt.Errorf("expected a property name at %d", p.pos)
+			}
+			node = indexNode{node, literalNode{name}}
+		case p.accept("["):
+			var index expressionNode
+			if index, err = p.or(); err == nil {
+				if !p.accept("]") {
+					return nil, fmt.Errorf("expected ] at %d", p.pos)
+				}
+				node = indexNode{node, index}
+			}
+		default:
+			return node, nil
+		}
+	}
+	return nil, err
+}
+
+// name consumes a function, property or, with dots, reference name
+func (p *expressionParser) name(dots bool) string {
+	start := p.pos
+	for p.pos < len(p.source) {
+		c := p.source[p.pos]
+		if c == '_' || c == '-' && p.pos > start || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' && p.pos > start || dots && c == '.' && p.pos > start {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.source[start:p.pos]
+}
+
+func (p *expressionParser) primary() (expressionNode, error) {
+	p.space()
+	if p.pos >= len(p.source) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+	switch c := p.source[p.pos]; {
+	case c == '\'' || c == '"':
+		return p.stringLiteral(c)
+	case c == '-' || c >= '0' && c <= '9':
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.source) && (p.source[p.pos] == '.' || p.source[p.pos] >= '0' && p.source[p.pos] <= '9') {
+			p.pos++
+		}
+		value, err := strconv.ParseFloat(p.source[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.source[start:p.pos])
+		}
+		return literalNode{value}, nil
+	case c == '(':
+		p.pos++
+		node, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("expected ) at %d", p.pos)
+		}
+		return node, nil
+	}
+
+	start := p.pos
+	name := p.name(true)
+	switch name {
+	case "":
+		return nil, fmt.Errorf("unexpected %q", p.source[p.pos:])
+	case "true", "false":
+		return literalNode{name == "true"}, nil
+	case "null":
+		return literalNode{nil}, nil
+	}
+	if !p.accept("(") {
+		if !knownReference(name) {
+			return nil, fmt.Errorf("unknown reference %q", name)
+		}
+		return referenceNode{name}, nil
+	}
+	function, ok := expressionFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at %d", name, start)
+	}
+	call := callNode{name: name}
+	if !p.accept(")") {
+		for {
+			arg, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if p.accept(")") {
+				break
+			}
+			if !p.accept(",") {
+				return nil, fmt.Errorf("expected , or ) at %d", p.pos)
+			}
+		}
+	}
+	if len(call.args) < function.minArgs || function.maxArgs >= 0 && len(call.args) > function.maxArgs {
+		return nil, fmt.Errorf("%s takes %s, got %d", name, arity(function), len(call.args))
+	}
+	return call, nil
+}
+
+// arity describes the arguments a function takes
+func arity(function expressionFunction) string {
+	switch {
+	case function.maxArgs < 0:
+		return fmt.Sprintf("at least %d arguments", function.minArgs)
+	case function.minArgs == function.maxArgs && function.minArgs == 1:
+		return "1 argument"
+	case function.minArgs == function.maxArgs:
+		return fmt.Sprintf("%d arguments", function.minArgs)
+	}
+	return fmt.Sprintf("%d to %d arguments", function.minArgs, function.maxArgs)
+}
+
+// stringLiteral consumes a string quoted with quote. A doubled quote stands
+// for the quote itself.
+func (p *expressionParser) stringLiteral(quote byte) (expressionNode, error) {
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.source) {
+		c := p.source[p.pos]
+		p.pos++
+		if c != quote {
+			b.WriteByte(c)
+			continue
+		}
+		if p.pos < len(p.source) && p.source[p.pos] == quote {
+			b.WriteByte(quote)
+			p.pos++
+			continue
+		}
+		return literalNode{b.String()}, nil
+	}
+	return nil, fmt.Errorf("unterminated string")
+}
+
+// expressionFunctionsUsed returns the names of the functions an
+// expression calls
+func expressionFunctionsUsed(node expressionNode) []string {
+	var names []string
+	var walk func(expressionNode)
+	walk = func(node expressionNode) {
+		switch n := node.(type) {
+		case callNode:
+			names = append(names, n.name)
+			for _, arg := range n.args {
+				walk(arg)
+			}
+		case indexNode:
+			walk(n.target)
+			walk(n.index)
+		case notNode:
+			walk(n.operand)
+		case binaryNode:
+			walk(n.left)
+			walk(n.right)
+		}
+	}
+	walk(node)
+	return names
+}
+
+// expressionReferences returns the references an expression uses
+func expressionReferences(node expressionNode) []string {
+	var refs []string
+	var walk func(expressionNode)
+	walk = func(node expressionNode) {
+		switch n := node.(type) {
+		case referenceNode:
+			refs = append(refs, n.name)
+		case callNode:
+			for _, arg := range n.args {
+				walk(arg)
+			}
+		case indexNode:
+			walk(n.target)
+			walk(n.index)
+		case notNode:
+			walk(n.operand)
+		case binaryNode:
+			walk(n.left)
+			walk(n.right)
+		}
+	}
+	walk(node)
+	return refs
+}
+
+// hashFilesFunction returns the SHA-256 of the files matching the glob
+// patterns, where ** matches any number of directories, or "" when none
+// match. Files are hashed in path order, so the hash only changes with
+// their contents.
+func hashFilesFunction(scope expressionScope, args []interface{}) (interface{}, error) {
+	dir := scope.dir
+	if dir == "" {
+		dir = "."
+	}
+	var patterns []string
+	for _, arg := range args {
+		pattern := filepath.ToSlash(formatValue(arg))
+		if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+		patterns = append(patterns, strings.TrimPrefix(pattern, "./"))
+	}
+
+	var files []string
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		for _, pattern := range patterns {
+			if matchGlob(pattern, rel) {
+				files = append(files, rel)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return "", nil
+	}
+	sort.Strings(files)
+	hash := sha256.New()
+	for _, rel := range files {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, err
+		}
+		fileHash := sha256.New()
+		_, err = io.Copy(fileHash, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		hash.Write(fileHash.Sum(nil))
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// matchGlob reports whether a slash-separated path matches a glob pattern
+// in which a ** segment matches any number of directories
+func matchGlob(pattern, name string) bool {
+	patterns, names := strings.Split(pattern, "/"), strings.Split(name, "/")
+	var match func(p, n int) bool
+	match = func(p, n int) bool {
+		for ; p < len(patterns); p++ {
+			if patterns[p] == "**" {
+				for skip := n; skip <= len(names); skip++ {
+					if match(p+1, skip) {
+						return true
+					}
+				}
+				return false
+			}
+			if n >= len(names) {
+				return false
+			}
+			if ok, _ := path.Match(patterns[p], names[n]); !ok {
+				return false
+			}
+			n++
+		}
+		return n == len(names)
+	}
+	return match(0, 0)
+}
+
+// fromJSONFunction parses JSON text, such as a trigger value
+func fromJSONFunction(_ expressionScope, args []interface{}) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(formatValue(args[0])), &value); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	return value, nil
+}
+
+// toJSONFunction returns a value as JSON
+func toJSONFunction(_ expressionScope, args []interface{}) (interface{}, error) {
+	data, err := json.Marshal(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// toUpperFunction returns text in upper case
+func toUpperFunction(_ expressionScope, args []interface{}) (interface{}, error) {
+	return strings.ToUpper(formatValue(args[0])), nil
+}
+
+// toLowerFunction returns text in lower case
+func toLowerFunction(_ expressionScope, args []interface{}) (interface{}, error) {
+	return strings.ToLower(formatValue(args[0])), nil
+}
+
+// dateFunction formats the current time, or an RFC 3339 time or Unix
+// seconds, in UTC with a Go layout such as "2006-01-02"
+func dateFunction(scope expressionScope, args []interface{}) (interface{}, error) {
+	at := scope.now
+	if len(args) == 2 {
+		switch v := args[1].(type) {
+		case float64:
+			at = time.Unix(int64(v), 0)
+		default:
+			parsed, err := time.Parse(time.RFC3339, formatValue(v))
+			if err != nil {
+				return nil, fmt.Errorf("invalid time %q, want RFC 3339 or Unix seconds", formatValue(v))
+			}
+			at = parsed
+		}
+	}
+	return at.UTC().Format(formatValue(args[0])), nil
+}
+
+// semverCompareFunction reports whether a version satisfies a constraint:
+// comma-separated comparisons such as ">=1.2.0, <2.0.0", where ^1.2.0
+// allows changes that keep the major version, ~1.2.0 those that keep the
+// minor version, and a bare version means equal
+func semverCompareFunction(_ expressionScope, args []interface{}) (interface{}, error) {
+	version, err := parseSemver(formatValue(args[1]))
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range strings.Split(formatValue(args[0]), ",") {
+		part = strings.TrimSpace(part)
+		op := strings.TrimRight(part[:len(part)-len(strings.TrimLeft(part, "<>=!^~"))], " ")
+		bound, err := parseSemver(strings.TrimSpace(part[len(op):]))
+		if err != nil {
+			return nil, err
+		}
+		c := version.compare(bound)
+		var ok bool
+		switch op {
+		case "", "=", "==":
+			ok = c == 0
+		case "!=":
+			ok = c != 0
+		case ">":
+			ok = c > 0
+		case ">=":
+			ok = c >= 0
+		case "<":
+			ok = c < 0
+		case "<=":
+			ok = c <= 0
+		case "^":
+			ok = c >= 0 && version.major == bound.major
+		case "~":
+			ok = c >= 0 && version.major == bound.major && version.minor == bound.minor
+		default:
+			return nil, fmt.Errorf("invalid constraint %q", part)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// semver is a semantic version
+type semver struct {
+	major, minor, patch int
+	prerelease          string
+}
+
+// parseSemver parses a version such as v1.2.3-rc.1, ignoring build
+// metadata. Missing minor and patch versions are zero.
+func parseSemver(s string) (semver, error) {
+	var v semver
+	text := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.Index(text, "+"); i >= 0 {
+		text = text[:i]
+	}
+	if i := strings.Index(text, "-"); i >= 0 {
+		text, v.prerelease = text[:i], text[i+1:]
+	}
+	parts := strings.Split(text, ".")
+	if len(parts) > 3 || text == "" {
+		return v, fmt.Errorf("invalid version %q", s)
+	}
+	numbers := []*int{&v.major, &v.minor, &v.patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		*numbers[i] = n
+	}
+	return v, nil
+}
+
+// compare returns -1, 0 or 1 as v is lower than, equal to or higher than
+// other. Prereleases are lower than their release and compared by their
+// dot-separated identifiers.
+func (v semver) compare(other semver) int {
+	for _, pair := range [][2]int{{v.major, other.major}, {v.minor, other.minor}, {v.patch, other.patch}} {
+		if pair[0] != pair[1] {
+			if pair[0] < pair[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case v.prerelease == other.prerelease:
+		return 0
+	case v.prerelease == "":
+		return 1
+	case other.prerelease == "":
+		return -1
+	}
+	a, b := strings.Split(v.prerelease, "."), strings.Split(other.prerelease, ".")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		x, errX := strconv.Atoi(a[i])
+		y, errY := strconv.Atoi(b[i])
+		switch {
+		case errX == nil && errY == nil && x < y, errX == nil && errY != nil, errX != nil && errY != nil && a[i] < b[i]:
+			return -1
+		}
+		return 1
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
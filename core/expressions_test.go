@@ -0,0 +1,184 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandExpressions(t *testing.T) {
+	scope := expressionScope{
+		values: map[string]string{
+			"pipeline.id":     "build",
+			"trigger.branch":  "Main",
+			"trigger.payload": `{"labels":["ci","fast"],"pr":{"number":42}}`,
+			"revision.tag":    "v1.4.2",
+		},
+		now: time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	tests := map[string]string{
+		"${{ pipeline.id }}-${{ custom.value }}":                   "build-${{ custom.value }}",
+		"${{ toUpper(trigger.branch) }}":                           "MAIN",
+		"${{ toLower('A') }}${{ toLower(\"B\") }}":                 "ab",
+		"${{ fromJSON(trigger.payload).pr.number }}":               "42",
+		"${{ fromJSON(trigger.payload).labels[1] }}":               "fast",
+		"${{ toJSON(fromJSON(trigger.payload).labels) }}":          `["ci","fast"]`,
+		"${{ date('2006-01-02') }}":                                "2026-03-04",
+		"${{ date('2006', '2020-01-01T00:00:00Z') }}":              "2020",
+		"${{ date('2006-01-02', 0) }}":                             "1970-01-01",
+		"${{ semverCompare('>=1.2.0, <2', revision.tag) }}":        "true",
+		"${{ semverCompare('^2.0.0', revision.tag) }}":             "false",
+		"${{ trigger.branch == 'Main' && !(revision.tag == '') }}": "true",
+		"${{ trigger.missing || 'default' }}":                      "default",
+		"${{ 'it''s' != \"it's\" }}":                               "false",
+	}
+	for s, want := range tests {
+		got, err := expandExpressions(s, scope)
+		if err != nil {
+			t.Errorf("expandExpressions(%q) error = %v", s, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("expandExpressions(%q) = %q, want %q", s, got, want)
+		}
+	}
+
+	for _, s := range []string{"${{ fromJSON('{') }}", "${{ date('2006', 'yesterday') }}", "${{ semverCompare('>=1', 'latest') }}"} {
+		if got, err := expandExpressions(s, scope); err == nil || got != s {
+			t.Errorf("expandExpressions(%q) = %q, %v, want an error leaving it in place", s, got, err)
+		}
+	}
+}
+
+func TestValidateExpressions(t *testing.T) {
+	tests := map[string]string{
+		"make ${{ custom.value }}":         "",
+		"${{ hashFiles('a', 'b') }}":       "",
+		"${{ toUpper() }}":                 "toUpper takes 1 argument, got 0",
+		"${{ date('a', 'b', 'c') }}":       "date takes 1 to 2 arguments, got 3",
+		"${{ shell('rm -rf /') }}":         `unknown function "shell"`,
+		"${{ toUpper(secrets.token) }}":    `unknown reference "secrets.token"`,
+		"${{ toUpper('a' }}":               "expected , or )",
+		"${{ 'open }}":                     "unterminated string",
+		"${{ trigger.a == trigger.b c }}":  `unexpected "c"`,
+		"${{ fromJSON(trigger.x)[0 }}":     "expected ]",
+		"${{ trigger.branch == 'main' }}x": "",
+	}
+	for s, want := range tests {
+		err := ValidateExpressions(s)
+		if want == "" && err != nil || want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("ValidateExpressions(%q) = %v, want %q", s, err, want)
+		}
+	}
+
+	if err := validateStartReferences("deploy-${{ toLower(trigger.env) }}", "lock"); err != nil {
+		t.Errorf("validateStartReferences() error = %v", err)
+	}
+	if err := validateStartReferences("${{ hashFiles('go.sum') }}", "lock"); err == nil || !strings.Contains(err.Error(), "hashFiles can't be used in lock") {
+		t.Errorf("validateStartReferences() error = %v, want hashFiles rejected", err)
+	}
+	if err := validateStartReferences("${{ toLower(job.id) }}", "lock"); err == nil || !strings.Contains(err.Error(), `unknown reference "job.id"`) {
+		t.Errorf("validateStartReferences() error = %v, want job.id rejected", err)
+	}
+}
+
+func TestHashFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"go.sum":            "a",
+		"lib/go.sum":        "b",
+		"lib/deep/go.sum":   "c",
+		"web/package.json":  "{}",
+		"lib/deep/notes.md": "",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+	scope := expressionScope{dir: dir}
+	hash := func(patterns ...interface{}) string {
+		t.Helper()
+		value, err := hashFilesFunction(scope, patterns)
+		if err != nil {
+			t.Fatalf("hashFiles(%v) error = %v", patterns, err)
+		}
+		return value.(string)
+	}
+
+	all := hash("**/go.sum")
+	if len(all) != 64 || all == hash("go.sum") || all != hash("lib/**/go.sum", "./go.sum") {
+		t.Errorf("hashFiles('**/go.sum') = %q, want the hash of all three go.sum files", all)
+	}
+	if got := hash("**/*.lock"); got != "" {
+		t.Errorf("hashFiles() with no matches = %q, want empty", got)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "lib/deep/go.sum"), []byte("changed"), 0644)
+	if hash("**/go.sum") == all {
+		t.Error("hashFiles() unchanged after a file changed")
+	}
+}
+
+func TestSemverCompare(t *testing.T) {
+	tests := []struct {
+		constraint, version string
+		want                bool
+	}{
+		{"1.2.3", "v1.2.3", true},
+		{"!=1.2.3", "1.2.4", true},
+		{">1.2.3", "1.2.3-rc.1", false},
+		{"<1.2.3", "1.2.3-rc.1", true},
+		{">=1.2.3-rc.2", "1.2.3-rc.10", true},
+		{"^1.2.0", "1.9.0", true},
+		{"^1.2.0", "2.0.0", false},
+		{"~1.2.0", "1.2.9", true},
+		{"~1.2.0", "1.3.0", false},
+		{">= 1.0, < 1.5", "1.4.99+build.7", true},
+	}
+	for _, tt := range tests {
+		got, err := semverCompareFunction(expressionScope{}, []interface{}{tt.constraint, tt.version})
+		if err != nil {
+			t.Errorf("semverCompare(%q, %q) error = %v", tt.constraint, tt.version, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("semverCompare(%q, %q) = %v, want %v", tt.constraint, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestRun_Expressions(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("expr", "echo ${{ toUpper(trigger.env) }}")
+	pipeline.Stages[0].Steps = append(pipeline.Stages[0].Steps, Step{
+		ID:      "deploy",
+		Name:    "deploy",
+		Type:    "script",
+		Command: "echo deploying",
+		When:    &ConditionalExecution{Custom: "${{ trigger.env == 'production' }}"},
+	})
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "expr", WithTrigger(map[string]string{"env": "staging"}))
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess || len(job.Steps) != 2 {
+		t.Fatalf("job = %s with %d steps, want success with 2", job.Status, len(job.Steps))
+	}
+	if got := job.Steps[0].Output; got != "STAGING\n" {
+		t.Errorf("Output = %q, want STAGING", got)
+	}
+	if job.Steps[1].Status != StatusSkipped || job.Steps[1].Output != "" {
+		t.Errorf("deploy = %s %q, want skipped", job.Steps[1].Status, job.Steps[1].Output)
+	}
+
+	pipeline.Stages[0].Steps[0].Command = "echo ${{ fromJSON(trigger.env) }}"
+	engine.UpdatePipeline(pipeline)
+	job, _ = engine.Run(context.Background(), "expr", WithTrigger(map[string]string{"env": "staging"}))
+	if job.Status != StatusFailed || len(job.Logs) == 0 || !strings.Contains(job.Logs[len(job.Logs)-1].Message, "invalid JSON") {
+		t.Errorf("job = %s with logs %+v, want failed on invalid JSON", job.Status, job.Logs)
+	}
+}
@@ -0,0 +1,239 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Failure classes. The engine classifies failures as infrastructure when a
+// step couldn't be executed or its runner failed it, as timeout when it ran out of time,
+// as disk_quota when it used too much disk and as unknown otherwise. Steps classify their own failures, such as test or
+// compile failures, with failure rules.
+const (
+	FailureInfrastructure = "infrastructure"
+	FailureTimeout        = "timeout"
+	FailureTest           = "test"
+	FailureCompile        = "compile"
+	FailureUnknown        = "unknown"
+)
+
+// FailureRule classifies a step's failure as Class when its exit code is
+// one of ExitCodes or its output or error matches the regular expression
+// Pattern
+type FailureRule struct {
+	Class     string `json:"class"`
+	ExitCodes []int  `json:"exitCodes,omitempty"`
+	Pattern   string `json:"pattern,omitempty"`
+}
+
+// FailureStats counts the outcomes of a pipeline's steps by status and
+// failure class
+type FailureStats struct {
+	PipelineID string `json:"pipelineId"`
+	Jobs       int    `json:"jobs"`
+	Failed     int    `json:"failed"`
+	// Classes counts failed steps per failure class
+	Classes  map[string]int `json:"classes"`
+	Warnings int            `json:"warnings"`
+	Skipped  int            `json:"skipped"`
+	// Retries counts the attempts beyond the first of retried steps
+	Retries int `json:"retries"`
+}
+
+// ValidateExitCodes checks that a step maps exit codes to success, warning,
+// skipped or failed
+func ValidateExitCodes(codes map[int]Status) error {
+	for code, status := range codes {
+		switch status {
+		case StatusSuccess, StatusWarning, StatusSkipped, StatusFailed:
+		default:
+			return fmt.Errorf("exit code %d: status must be success, warning, skipped or failed, got %q", code, status)
+		}
+	}
+	return nil
+}
+
+// ValidateFailureRule checks a failure rule
+func ValidateFailureRule(rule FailureRule) error {
+	if rule.Class == "" {
+		return fmt.Errorf("failure rule requires a class")
+	}
+	if len(rule.ExitCodes) == 0 && rule.Pattern == "" {
+		return fmt.Errorf("failure rule %s requires exit codes or a pattern", rule.Class)
+	}
+	if rule.Pattern != "" {
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return fmt.Errorf("failure rule %s: invalid pattern: %v", rule.Class, err)
+		}
+	}
+	return nil
+}
+
+// exitStatus returns the status of an executed step from its exit code and
+// the step's exit code mapping. Codes mapped to success, warning or skipped
+// clear the execution error; unmapped codes keep the default of success for
+// zero and failed otherwise. Errors that aren't about the exit code, such as
+// a timeout, always fail the step.
+func exitStatus(step Step, result *StepResult, err error) (Status, error) {
+	if result == nil || result.ExitCode < 0 || err != nil && result.ExitCode == 0 {
+		if err != nil {
+			return StatusFailed, err
+		}
+		return StatusSuccess, nil
+	}
+	status, mapped := step.ExitCodes[result.ExitCode]
+	switch {
+	case !mapped && err != nil:
+		return StatusFailed, err
+	case !mapped:
+		return StatusSuccess, nil
+	case status == StatusFailed:
+		if err == nil {
+			err = fmt.Errorf("exit code %d is mapped to failed", result.ExitCode)
+		}
+		return StatusFailed, err
+	}
+	return status, nil
+}
+
+// classifyFailure returns the failure class of a failed step attempt.
+// The step's rules come first, then the engine's classes.
+func classifyFailure(step Step, attempt *stepAttempt) string {
+	for _, rule := range step.Failures {
+		if attempt.executed && attempt.result != nil {
+			for _, code := range rule.ExitCodes {
+				if attempt.result.ExitCode == code {
+					return rule.Class
+				}
+			}
+		}
+		if rule.Pattern == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			continue
+		}
+		if attempt.result != nil && pattern.MatchString(attempt.result.Output) || attempt.err != nil && pattern.MatchString(attempt.err.Error()) {
+			return rule.Class
+		}
+	}
+
+	switch {
+	case attempt.diskExceeded:
+		return FailureDiskQuota
+	case errors.Is(attempt.err, ErrBudgetExceeded):
+		return FailureBudget
+	case !attempt.executed:
+		return FailureInfrastructure
+	case attempt.timedOut:
+		return FailureTimeout
+	case infrastructureFailure(attempt):
+		return FailureInfrastructure
+	}
+	return FailureUnknown
+}
+
+// retries reports whether a step's retry policy retries a failure of class
+// after the given attempt, and how long to wait first
+func retries(step Step, attempt int, class string) (time.Duration, bool) {
+	retry := step.Retry
+	if retry == nil || attempt >= retry.MaxAttempts {
+		return 0, false
+	}
+	if len(retry.On) > 0 {
+		matched := false
+		for _, on := range retry.On {
+			matched = matched || on == class
+		}
+		if !matched {
+			return 0, false
+		}
+	}
+	interval, err := time.ParseDuration(retry.Interval)
+	if err != nil || interval < 0 {
+		interval = 0
+	}
+	if retry.ExponentialBackoff {
+		for i := 1; i < attempt; i++ {
+			interval *= 2
+		}
+	}
+	return interval, true
+}
+
+// jobFailureClass returns the failure class of a failed job: the class of
+// its last failed step, or infrastructure when it failed before or between
+// steps. Callers must hold pe.mu.
+func jobFailureClass(job *Job) string {
+	for i := len(job.Steps) - 1; i >= 0; i-- {
+		step := job.Steps[i]
+		if step.Status == StatusFailed && !step.RolledBack && step.FailureClass != "" {
+			return step.FailureClass
+		}
+	}
+	return FailureInfrastructure
+}
+
+// FailureStats counts step outcomes and failure classes per pipeline over
+// the engine's jobs, for one pipeline when pipelineID is set
+func (pe *PipelineEngine) FailureStats(pipelineID string) []FailureStats {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	pipelines := make(map[string]*FailureStats)
+	for _, job := range pe.jobs {
+		if pipelineID != "" && job.PipelineID != pipelineID {
+			continue
+		}
+		stats := pipelines[job.PipelineID]
+		if stats == nil {
+			stats = &FailureStats{PipelineID: job.PipelineID, Classes: make(map[string]int)}
+			pipelines[job.PipelineID] = stats
+		}
+		stats.Jobs++
+		for _, step := range job.Steps {
+			switch step.Status {
+			case StatusFailed:
+				stats.Failed++
+				class := step.FailureClass
+				if class == "" {
+					class = FailureUnknown
+				}
+				stats.Classes[class]++
+			case StatusWarning:
+				stats.Warnings++
+			case StatusSkipped:
+				stats.Skipped++
+			}
+			if step.Attempts > 1 {
+				stats.Retries += step.Attempts - 1
+			}
+		}
+	}
+
+	result := make([]FailureStats, 0, len(pipelines))
+	for _, stats := range pipelines {
+		result = append(result, *stats)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].PipelineID < result[j].PipelineID
+	})
+	return result
+}
+
+// describeAttempt describes a failed attempt of a step for the job log
+func describeAttempt(step Step, attempt int, class string, err error) string {
+	message := fmt.Sprintf("Attempt %d of step %s failed", attempt, step.ID)
+	if class != "" {
+		message += " (" + class + ")"
+	}
+	if err != nil {
+		message += ": " + strings.TrimSpace(err.Error())
+	}
+	return message
+}
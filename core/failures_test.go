@@ -0,0 +1,90 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRun_ExitCodeMapping(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("codes", `exit 2`, `exit 77`, `exit 3`)
+	for i := range pipeline.Stages[0].Steps {
+		pipeline.Stages[0].Steps[i].ExitCodes = map[int]Status{2: StatusWarning, 77: StatusSkipped, 0: StatusSuccess}
+	}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "codes")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	var statuses []string
+	for _, step := range job.Steps {
+		statuses = append(statuses, string(step.Status))
+	}
+	if got := strings.Join(statuses, ","); got != "warning,skipped,failed" {
+		t.Errorf("step statuses = %s, want warning,skipped,failed", got)
+	}
+	if job.Status != StatusFailed || job.FailureClass != FailureUnknown {
+		t.Errorf("job = %s (%s), want an unknown failure", job.Status, job.FailureClass)
+	}
+}
+
+func TestRun_RetriesOnlyClassifiedFailures(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	pipeline := scriptPipeline("flaky",
+		`echo x >> attempts; [ $(wc -l < attempts) -ge 3 ] || { echo "connection reset by peer"; exit 1; }`,
+		`echo "--- FAIL: TestSum"; exit 1`,
+	)
+	failures := []FailureRule{
+		{Class: FailureInfrastructure, Pattern: "connection reset"},
+		{Class: FailureTest, Pattern: "(?m)^--- FAIL"},
+	}
+	for i := range pipeline.Stages[0].Steps {
+		step := &pipeline.Stages[0].Steps[i]
+		step.Failures = failures
+		step.Retry = &RetryConfig{MaxAttempts: 3, Interval: "1ms", On: []string{FailureInfrastructure}}
+	}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "flaky")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	infra, test := job.Steps[0], job.Steps[1]
+	if infra.Status != StatusSuccess || infra.Attempts != 3 || infra.FailureClass != "" {
+		t.Errorf("flaky step = %s after %d attempts (%s), want success on the third", infra.Status, infra.Attempts, infra.FailureClass)
+	}
+	if test.Status != StatusFailed || test.Attempts != 0 || test.FailureClass != FailureTest {
+		t.Errorf("failing test step = %s after %d attempts (%s), want a test failure without retries", test.Status, test.Attempts, test.FailureClass)
+	}
+	if job.FailureClass != FailureTest {
+		t.Errorf("job FailureClass = %q, want test", job.FailureClass)
+	}
+
+	stats := engine.FailureStats("flaky")
+	if len(stats) != 1 || stats[0].Classes[FailureTest] != 1 || stats[0].Retries != 2 || stats[0].Failed != 1 {
+		t.Errorf("FailureStats() = %+v, want one test failure and two retries", stats)
+	}
+}
+
+func TestClassifyFailure_EngineClasses(t *testing.T) {
+	step := Step{ID: "s"}
+	if class := classifyFailure(step, &stepAttempt{}); class != FailureInfrastructure {
+		t.Errorf("class of a step that didn't run = %q, want infrastructure", class)
+	}
+	if class := classifyFailure(step, &stepAttempt{executed: true, timedOut: true}); class != FailureTimeout {
+		t.Errorf("class of a timed out step = %q, want timeout", class)
+	}
+	if class := classifyFailure(step, &stepAttempt{executed: true, result: &StepResult{ExitCode: 137}}); class != FailureInfrastructure {
+		t.Errorf("class of an out of memory kill = %q, want infrastructure", class)
+	}
+	if class := classifyFailure(step, &stepAttempt{executed: true, result: &StepResult{ExitCode: 1}}); class != FailureUnknown {
+		t.Errorf("class of a failed command = %q, want unknown", class)
+	}
+	step.Failures = []FailureRule{{Class: "oom", ExitCodes: []int{137}}}
+	if class := classifyFailure(step, &stepAttempt{executed: true, result: &StepResult{ExitCode: 137}}); class != "oom" {
+		t.Errorf("class = %q, want the step's rule", class)
+	}
+}
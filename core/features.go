@@ -0,0 +1,206 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// Feature flags gating engine and plugin behaviors
+const (
+	// FeatureSpeculativeStages starts speculative stages alongside the
+	// allow_failure stage before them. Disabled, they run after it.
+	FeatureSpeculativeStages = "speculative-stages"
+	// FeatureSemgrepScans runs Semgrep rulesets in code scans. Disabled,
+	// code scans only use the built-in rules.
+	FeatureSemgrepScans = "semgrep-scans"
+)
+
+// Feature describes a feature flag and its state when not configured
+type Feature struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Default     bool   `json:"default"`
+}
+
+// features are the known feature flags by name
+var features = map[string]Feature{
+	FeatureSpeculativeStages: {
+		Name:        FeatureSpeculativeStages,
+		Description: "Start speculative stages while the allow_failure stage before them runs",
+		Default:     true,
+	},
+	FeatureSemgrepScans: {
+		Name:        FeatureSemgrepScans,
+		Description: "Run Semgrep rulesets in code scans",
+		Default:     true,
+	},
+}
+
+// FeatureFlag is the state of a feature flag. Pipelines and
+// ExceptPipelines are pipeline ID patterns, such as "payments-*", the
+// feature is turned on and off for whatever Enabled is; exceptions win.
+type FeatureFlag struct {
+	Name            string   `json:"name"`
+	Enabled         bool     `json:"enabled"`
+	Pipelines       []string `json:"pipelines,omitempty"`
+	ExceptPipelines []string `json:"exceptPipelines,omitempty"`
+}
+
+// FeatureFlagState is a feature flag, its description and whether it is
+// configured or in its default state
+type FeatureFlagState struct {
+	FeatureFlag
+	Description string `json:"description"`
+	Default     bool   `json:"default"`
+	Configured  bool   `json:"configured"`
+}
+
+// ValidateFeatureFlag checks that a flag names a known feature and that its
+// pipeline patterns are valid
+func ValidateFeatureFlag(flag FeatureFlag) error {
+	if _, ok := features[flag.Name]; !ok {
+		return fmt.Errorf("unknown feature flag %q", flag.Name)
+	}
+	for _, pattern := range append(append([]string{}, flag.Pipelines...), flag.ExceptPipelines...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("feature flag %s: invalid pipeline pattern %q", flag.Name, pattern)
+		}
+	}
+	return nil
+}
+
+// enabledFor reports whether the flag is on for a pipeline
+func (f FeatureFlag) enabledFor(pipelineID string) bool {
+	if matchesAny(f.ExceptPipelines, pipelineID) {
+		return false
+	}
+	if matchesAny(f.Pipelines, pipelineID) {
+		return true
+	}
+	return f.Enabled
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WithFeatureFlags configures feature flags. Flags of unknown features are
+// ignored; validate them with ValidateFeatureFlag.
+func WithFeatureFlags(flags ...FeatureFlag) Option {
+	return func(pe *PipelineEngine) {
+		pe.featureFlags = featureFlagMap(flags)
+	}
+}
+
+func featureFlagMap(flags []FeatureFlag) map[string]FeatureFlag {
+	byName := make(map[string]FeatureFlag, len(flags))
+	for _, flag := range flags {
+		if _, ok := features[flag.Name]; ok {
+			byName[flag.Name] = flag
+		}
+	}
+	return byName
+}
+
+// ReplaceFeatureFlags replaces every configured flag, such as on a
+// configuration reload
+func (pe *PipelineEngine) ReplaceFeatureFlags(flags []FeatureFlag) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.featureFlags = featureFlagMap(flags)
+}
+
+// SetFeatureFlag configures a flag at runtime
+func (pe *PipelineEngine) SetFeatureFlag(flag FeatureFlag) (*FeatureFlagState, error) {
+	if err := ValidateFeatureFlag(flag); err != nil {
+		return nil, err
+	}
+	pe.mu.Lock()
+	if pe.featureFlags == nil {
+		pe.featureFlags = make(map[string]FeatureFlag)
+	}
+	pe.featureFlags[flag.Name] = flag
+	pe.mu.Unlock()
+
+	pe.logger.Printf("Feature flag %s set (enabled %v, pipelines %v, except %v)", flag.Name, flag.Enabled, flag.Pipelines, flag.ExceptPipelines)
+	return pe.FeatureFlag(flag.Name)
+}
+
+// ResetFeatureFlag returns a flag to its default state
+func (pe *PipelineEngine) ResetFeatureFlag(name string) (*FeatureFlagState, error) {
+	if _, ok := features[name]; !ok {
+		return nil, fmt.Errorf("unknown feature flag %q", name)
+	}
+	pe.mu.Lock()
+	delete(pe.featureFlags, name)
+	pe.mu.Unlock()
+
+	pe.logger.Printf("Feature flag %s reset", name)
+	return pe.FeatureFlag(name)
+}
+
+// FeatureFlag returns the state of a flag
+func (pe *PipelineEngine) FeatureFlag(name string) (*FeatureFlagState, error) {
+	feature, ok := features[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown feature flag %q", name)
+	}
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	return pe.featureFlagState(feature), nil
+}
+
+// FeatureFlags returns the state of every flag, sorted by name
+func (pe *PipelineEngine) FeatureFlags() []FeatureFlagState {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	states := make([]FeatureFlagState, 0, len(features))
+	for _, feature := range features {
+		states = append(states, *pe.featureFlagState(feature))
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	return states
+}
+
+// featureFlagState returns the state of a feature. Callers must hold pe.mu.
+func (pe *PipelineEngine) featureFlagState(feature Feature) *FeatureFlagState {
+	state := &FeatureFlagState{
+		FeatureFlag: FeatureFlag{Name: feature.Name, Enabled: feature.Default},
+		Description: feature.Description,
+		Default:     feature.Default,
+	}
+	if flag, ok := pe.featureFlags[feature.Name]; ok {
+		state.FeatureFlag = flag
+		state.Configured = true
+	}
+	return state
+}
+
+// FeatureEnabled reports whether a feature is on for a pipeline
+func (pe *PipelineEngine) FeatureEnabled(name, pipelineID string) bool {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	if flag, ok := pe.featureFlags[name]; ok {
+		return flag.enabledFor(pipelineID)
+	}
+	return features[name].Default
+}
+
+// FeatureEnabled reports whether a feature is on for the pipeline of the
+// plugin step executing with ctx, or its default outside a step
+func FeatureEnabled(ctx context.Context, name string) bool {
+	if reporter, ok := ctx.Value(stepReporterKey{}).(*stepReporter); ok {
+		return reporter.engine.FeatureEnabled(name, reporter.pipelineID)
+	}
+	return features[name].Default
+}
@@ -0,0 +1,59 @@
+package core
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestFeatureEnabled_Targeting(t *testing.T) {
+	engine := newTestEngine(WithFeatureFlags(FeatureFlag{
+		Name:            FeatureSpeculativeStages,
+		Pipelines:       []string{"payments-*"},
+		ExceptPipelines: []string{"payments-legacy"},
+	}))
+
+	for pipeline, want := range map[string]bool{
+		"payments-api":    true,
+		"payments-legacy": false,
+		"web":             false,
+	} {
+		if got := engine.FeatureEnabled(FeatureSpeculativeStages, pipeline); got != want {
+			t.Errorf("FeatureEnabled(%s) = %v, want %v", pipeline, got, want)
+		}
+	}
+	if !engine.FeatureEnabled(FeatureSemgrepScans, "web") {
+		t.Error("FeatureEnabled(semgrep-scans) = false, want its default")
+	}
+
+	if _, err := engine.SetFeatureFlag(FeatureFlag{Name: "new-scheduler", Enabled: true}); err == nil {
+		t.Error("SetFeatureFlag() of an unknown feature error = nil, want error")
+	}
+	if _, err := engine.SetFeatureFlag(FeatureFlag{Name: FeatureSpeculativeStages, Pipelines: []string{"["}}); err == nil {
+		t.Error("SetFeatureFlag() with an invalid pattern error = nil, want error")
+	}
+	state, err := engine.ResetFeatureFlag(FeatureSpeculativeStages)
+	if err != nil || state.Configured || !state.Enabled || !engine.FeatureEnabled(FeatureSpeculativeStages, "web") {
+		t.Errorf("ResetFeatureFlag() = %+v, %v, want the default state", state, err)
+	}
+}
+
+func TestRun_SpeculativeStagesFlagOff(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	engine.CreatePipeline(speculativePipeline("exit 1"))
+	if _, err := engine.SetFeatureFlag(FeatureFlag{Name: FeatureSpeculativeStages, Enabled: false}); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := engine.Run(context.Background(), "speculative")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess || len(job.Steps) != 2 {
+		t.Fatalf("job = %s with %d steps, want verify then deploy", job.Status, len(job.Steps))
+	}
+	if got := lines(t, filepath.Join(dir, "rollback.log")); got != 0 {
+		t.Errorf("rollback ran %d times, want none without speculation", got)
+	}
+}
@@ -0,0 +1,242 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// PipelineVersion is a pipeline's definition from the time it was created
+// or changed until its next version, or its deletion
+type PipelineVersion struct {
+	PipelineID string    `json:"pipelineId"`
+	Version    string    `json:"version,omitempty"`
+	At         time.Time `json:"at"`
+	Deleted    bool      `json:"deleted,omitempty"`
+	Pipeline   *Pipeline `json:"pipeline,omitempty"`
+}
+
+// PipelineHistoryStore is implemented by stores that keep the versions of
+// pipelines across restarts
+type PipelineHistoryStore interface {
+	AppendPipelineVersion(version PipelineVersion) error
+	LoadPipelineHistory() ([]PipelineVersion, error)
+}
+
+// pipelineDigest returns the version of a pipeline's definition: the start
+// of the SHA-256 digest of the pipeline without its timestamps
+func pipelineDigest(pipeline *Pipeline) string {
+	definition := *pipeline
+	definition.Version, definition.CreatedAt, definition.UpdatedAt = "", time.Time{}, time.Time{}
+	data, err := json.Marshal(definition)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// recordPipelineVersion versions a created or changed pipeline, or a
+// deleted one when pipeline is nil. Versions equal to the pipeline's
+// previous version aren't recorded again. Callers must hold pe.mu.
+func (pe *PipelineEngine) recordPipelineVersion(id string, pipeline *Pipeline, at time.Time) {
+	version := PipelineVersion{PipelineID: id, At: at, Deleted: pipeline == nil}
+	if pipeline != nil {
+		pipeline.Version = pipelineDigest(pipeline)
+		version.Version = pipeline.Version
+		definition := *pipeline
+		version.Pipeline = &definition
+	}
+	if previous, ok := pe.pipelineVersions[id]; ok && previous == version.Version {
+		return
+	}
+	pe.pipelineVersions[id] = version.Version
+
+	if store, ok := pe.store.(PipelineHistoryStore); ok {
+		// Read-only engines leave the history to the server writing the
+		// store
+		if pe.readOnly {
+			return
+		}
+		if err := store.AppendPipelineVersion(version); err != nil {
+			pe.logger.Printf("Failed to store version %s of pipeline %s: %v", version.Version, id, err)
+		}
+		return
+	}
+	pe.pipelineHistory = append(pe.pipelineHistory, version)
+}
+
+// loadPipelineHistory returns the recorded versions of every pipeline,
+// oldest first
+func (pe *PipelineEngine) loadPipelineHistory() ([]PipelineVersion, error) {
+	if store, ok := pe.store.(PipelineHistoryStore); ok {
+		history, err := store.LoadPipelineHistory()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load pipeline history: %w", err)
+		}
+		return history, nil
+	}
+
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	return append([]PipelineVersion(nil), pe.pipelineHistory...), nil
+}
+
+// PipelineVersions returns the versions of a pipeline, oldest first
+func (pe *PipelineEngine) PipelineVersions(id string) ([]PipelineVersion, error) {
+	history, err := pe.loadPipelineHistory()
+	if err != nil {
+		return nil, err
+	}
+	versions := []PipelineVersion{}
+	for _, version := range history {
+		if version.PipelineID != id {
+			continue
+		}
+		// A restart records the current version again
+		if n := len(versions); n > 0 && versions[n-1].Version == version.Version {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("pipeline with ID %s has no history", id)
+	}
+	return versions, nil
+}
+
+// PipelinesAsOf returns the pipelines as they were defined at a time, each
+// with the version in effect then
+func (pe *PipelineEngine) PipelinesAsOf(at time.Time) ([]*Pipeline, error) {
+	history, err := pe.loadPipelineHistory()
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]*Pipeline)
+	for _, version := range history {
+		if version.At.After(at) {
+			continue
+		}
+		if version.Deleted {
+			delete(current, version.PipelineID)
+		} else {
+			current[version.PipelineID] = version.Pipeline
+		}
+	}
+	pipelines := make([]*Pipeline, 0, len(current))
+	for _, pipeline := range current {
+		pipelines = append(pipelines, pipeline)
+	}
+	sort.Slice(pipelines, func(i, j int) bool { return pipelines[i].ID < pipelines[j].ID })
+	return pipelines, nil
+}
+
+// PipelineAsOf returns a pipeline as it was defined at a time
+func (pe *PipelineEngine) PipelineAsOf(id string, at time.Time) (*Pipeline, error) {
+	pipelines, err := pe.PipelinesAsOf(at)
+	if err != nil {
+		return nil, err
+	}
+	for _, pipeline := range pipelines {
+		if pipeline.ID == id {
+			return pipeline, nil
+		}
+	}
+	return nil, fmt.Errorf("pipeline with ID %s did not exist at %s", id, at.Format(time.RFC3339))
+}
+
+// JobsAsOf returns the jobs of a pipeline that existed at a time, as they
+// were then: their status, steps, phases, logs and comments up to that time
+func (pe *PipelineEngine) JobsAsOf(pipelineID string, at time.Time) ([]*Job, error) {
+	if _, err := pe.PipelineAsOf(pipelineID, at); err != nil {
+		return nil, err
+	}
+
+	pe.mu.RLock()
+	var matched []*Job
+	for _, job := range pe.jobs {
+		if job.PipelineID == pipelineID && !jobQueuedAt(job).After(at) {
+			matched = append(matched, job)
+		}
+	}
+	pe.mu.RUnlock()
+
+	jobs := make([]*Job, 0, len(matched))
+	for _, job := range matched {
+		jobs = append(jobs, jobAsOf(pe.snapshotJob(job), at))
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobQueuedAt(jobs[i]).Before(jobQueuedAt(jobs[j])) })
+	return jobs, nil
+}
+
+// jobQueuedAt returns when a job was created
+func jobQueuedAt(job *Job) time.Time {
+	if job.QueuedAt.IsZero() {
+		return job.StartedAt
+	}
+	return job.QueuedAt
+}
+
+// jobAsOf rewinds a snapshot of a job to a time. A job that hadn't finished
+// then was running, or pending while its queued phase lasted and it waited
+// for its concurrency group.
+func jobAsOf(job *Job, at time.Time) *Job {
+	if job.EndedAt.IsZero() || job.EndedAt.After(at) {
+		job.EndedAt = time.Time{}
+		job.Status = StatusRunning
+		if jobGroup(job) != "" && len(job.Phases) > 0 && job.Phases[0].Name == PhaseQueued && (job.Phases[0].EndedAt.IsZero() || job.Phases[0].EndedAt.After(at)) {
+			job.Status = StatusPending
+		}
+	}
+	job.Phases = phasesAsOf(job.Phases, at)
+
+	steps := job.Steps[:0]
+	for _, step := range job.Steps {
+		if step.StartedAt.After(at) {
+			continue
+		}
+		if step.EndedAt.IsZero() || step.EndedAt.After(at) {
+			step.Status, step.EndedAt, step.ExitCode, step.Output = StatusRunning, time.Time{}, 0, ""
+			step.Annotations = nil
+		}
+		step.Phases = phasesAsOf(step.Phases, at)
+		steps = append(steps, step)
+	}
+	job.Steps = steps
+
+	logs := job.Logs[:0]
+	for _, entry := range job.Logs {
+		if !entry.Timestamp.After(at) {
+			logs = append(logs, entry)
+		}
+	}
+	job.Logs = logs
+
+	comments := job.Comments[:0]
+	for _, comment := range job.Comments {
+		if !comment.At.After(at) {
+			comments = append(comments, comment)
+		}
+	}
+	job.Comments = comments
+	return job
+}
+
+// phasesAsOf returns the phases started by a time, open if they hadn't
+// ended then
+func phasesAsOf(phases []Phase, at time.Time) []Phase {
+	rewound := phases[:0]
+	for _, phase := range phases {
+		if phase.StartedAt.After(at) {
+			continue
+		}
+		if phase.EndedAt.After(at) {
+			phase.EndedAt = time.Time{}
+		}
+		rewound = append(rewound, phase)
+	}
+	return rewound
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPipelinesAsOf(t *testing.T) {
+	engine := newTestEngine()
+	before := time.Now()
+	time.Sleep(time.Millisecond)
+	engine.CreatePipeline(scriptPipeline("site", "make"))
+	created := time.Now()
+	time.Sleep(time.Millisecond)
+
+	// Updating to the same definition adds no version
+	engine.UpdatePipeline(scriptPipeline("site", "make"))
+	engine.UpdatePipeline(scriptPipeline("site", "make test"))
+	updated := time.Now()
+	time.Sleep(time.Millisecond)
+	engine.DeletePipeline("site")
+
+	versions, err := engine.PipelineVersions("site")
+	if err != nil || len(versions) != 3 || !versions[2].Deleted || versions[0].Version == versions[1].Version {
+		t.Fatalf("PipelineVersions() = %+v, %v, want created, updated and deleted versions", versions, err)
+	}
+
+	if pipelines, _ := engine.PipelinesAsOf(before); len(pipelines) != 0 {
+		t.Errorf("PipelinesAsOf(before) = %d pipelines, want none", len(pipelines))
+	}
+	if pipeline, err := engine.PipelineAsOf("site", created); err != nil || pipeline.Stages[0].Steps[0].Command != "make" || pipeline.Version != versions[0].Version {
+		t.Errorf("PipelineAsOf(created) = %+v, %v, want the first version", pipeline, err)
+	}
+	if pipeline, err := engine.PipelineAsOf("site", updated); err != nil || pipeline.Stages[0].Steps[0].Command != "make test" {
+		t.Errorf("PipelineAsOf(updated) = %+v, %v, want the updated version", pipeline, err)
+	}
+	if _, err := engine.PipelineAsOf("site", time.Now()); err == nil {
+		t.Error("PipelineAsOf(now) of a deleted pipeline error = nil, want error")
+	}
+}
+
+func TestJobAsOf(t *testing.T) {
+	start := time.Now()
+	job := &Job{
+		Status:    StatusSuccess,
+		QueuedAt:  start,
+		StartedAt: start,
+		EndedAt:   start.Add(time.Minute),
+		Steps: []StepStatus{
+			{ID: "build", Status: StatusSuccess, StartedAt: start, EndedAt: start.Add(30 * time.Second), Output: "built"},
+			{ID: "test", Status: StatusSuccess, StartedAt: start.Add(30 * time.Second), EndedAt: start.Add(time.Minute)},
+		},
+		Logs: []LogEntry{{Timestamp: start, Message: "build"}, {Timestamp: start.Add(40 * time.Second), Message: "test"}},
+	}
+
+	rewound := jobAsOf(job, start.Add(20*time.Second))
+	if rewound.Status != StatusRunning || !rewound.EndedAt.IsZero() {
+		t.Errorf("jobAsOf() status = %s, want running before the job ended", rewound.Status)
+	}
+	if len(rewound.Steps) != 1 || rewound.Steps[0].Status != StatusRunning || rewound.Steps[0].Output != "" {
+		t.Errorf("jobAsOf() steps = %+v, want the first step running", rewound.Steps)
+	}
+	if len(rewound.Logs) != 1 {
+		t.Errorf("jobAsOf() logs = %+v, want the logs up to then", rewound.Logs)
+	}
+}
+
+func TestFileStore_PipelineHistory(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	engine := newTestEngine(WithStore(store))
+	engine.CreatePipeline(scriptPipeline("site", "make"))
+	engine.UpdatePipeline(scriptPipeline("site", "make test"))
+
+	history, err := store.LoadPipelineHistory()
+	if err != nil || len(history) != 2 {
+		t.Fatalf("LoadPipelineHistory() = %+v, %v, want 2 versions", history, err)
+	}
+	if history[1].Pipeline == nil || history[1].Pipeline.Stages[0].Steps[0].Command != "make test" {
+		t.Errorf("LoadPipelineHistory()[1] = %+v, want the updated pipeline", history[1])
+	}
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// AppendPipelineVersion appends a pipeline version to
+// pipelines/history.jsonl
+func (s *FileStore) AppendPipelineVersion(version PipelineVersion) error {
+	data, err := json.Marshal(version)
+	if err != nil {
+		return fmt.Errorf("failed to encode pipeline version: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := filepath.Join(s.dir, "pipelines")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create pipelines directory: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "history.jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open pipeline history: %w", err)
+	}
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write pipeline history: %w", err)
+	}
+	return nil
+}
+
+// LoadPipelineHistory reads the versions of every pipeline, oldest first.
+// Lines that can't be decoded, such as one cut short by a crash, are
+// skipped.
+func (s *FileStore) LoadPipelineHistory() ([]PipelineVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open(filepath.Join(s.dir, "pipelines", "history.jsonl"))
+	if os.IsNotExist(err) {
+		return []PipelineVersion{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pipeline history: %w", err)
+	}
+	defer file.Close()
+
+	history := []PipelineVersion{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for scanner.Scan() {
+		var version PipelineVersion
+		if err := json.Unmarshal(scanner.Bytes(), &version); err == nil {
+			history = append(history, version)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read pipeline history: %w", err)
+	}
+	return history, nil
+}
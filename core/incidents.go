@@ -0,0 +1,317 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var incidentCounter uint64
+
+// Incident is an ongoing or past production incident. While it is active,
+// deploy stages to the environments it freezes wait until it is resolved.
+type Incident struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	// Reference is the incident's identifier in the incident tracker, such
+	// as "INC-1234"
+	Reference string `json:"reference,omitempty"`
+	// Environments are the environments whose deploys are frozen, or all
+	// of them when empty
+	Environments []string  `json:"environments,omitempty"`
+	DeclaredBy   string    `json:"declaredBy,omitempty"`
+	DeclaredAt   time.Time `json:"declaredAt"`
+	ResolvedBy   string    `json:"resolvedBy,omitempty"`
+	// ResolvedAt is when the incident was resolved, lifting its freeze
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+	// Jobs are the jobs linked to the incident: those whose deploys it held
+	// and those linked by hand
+	Jobs []string `json:"jobs,omitempty"`
+}
+
+// IncidentStore stores incidents. When the engine's Store also implements
+// IncidentStore, they survive restarts.
+type IncidentStore interface {
+	SaveIncidents(incidents []*Incident) error
+	LoadIncidents() ([]*Incident, error)
+}
+
+// Active reports whether the incident hasn't been resolved
+func (i *Incident) Active() bool {
+	return i.ResolvedAt == nil
+}
+
+// freezes reports whether an active incident freezes deploys to an
+// environment
+func (i *Incident) freezes(environment string) bool {
+	if !i.Active() {
+		return false
+	}
+	if len(i.Environments) == 0 {
+		return true
+	}
+	for _, frozen := range i.Environments {
+		if frozen == environment {
+			return true
+		}
+	}
+	return false
+}
+
+// copyIncident returns a copy of an incident that doesn't share its slices
+func copyIncident(incident *Incident) Incident {
+	copied := *incident
+	copied.Environments = append([]string(nil), incident.Environments...)
+	copied.Jobs = append([]string(nil), incident.Jobs...)
+	return copied
+}
+
+// DeclareIncident starts an incident, freezing deploys to its environments
+func (pe *PipelineEngine) DeclareIncident(incident *Incident) (Incident, error) {
+	if strings.TrimSpace(incident.Title) == "" {
+		return Incident{}, fmt.Errorf("incident title is required")
+	}
+	for _, environment := range incident.Environments {
+		if strings.TrimSpace(environment) == "" {
+			return Incident{}, fmt.Errorf("incident environments can't be empty")
+		}
+	}
+	declared := &Incident{
+		ID:           fmt.Sprintf("incident-%d-%d", time.Now().Unix(), atomic.AddUint64(&incidentCounter, 1)),
+		Title:        incident.Title,
+		Reference:    incident.Reference,
+		Environments: append([]string(nil), incident.Environments...),
+		DeclaredBy:   incident.DeclaredBy,
+		DeclaredAt:   time.Now(),
+	}
+
+	pe.mu.Lock()
+	pe.incidents = append(pe.incidents, declared)
+	pe.saveIncidents()
+	copied := copyIncident(declared)
+	pe.mu.Unlock()
+
+	environments := "all environments"
+	if len(declared.Environments) > 0 {
+		environments = strings.Join(declared.Environments, ", ")
+	}
+	pe.logger.Printf("Declared incident %s (%s), freezing deploys to %s", declared.ID, declared.Title, environments)
+	return copied, nil
+}
+
+// ResolveIncident resolves an active incident, letting the deploys it held
+// continue
+func (pe *PipelineEngine) ResolveIncident(id, by string) (Incident, error) {
+	pe.mu.Lock()
+	incident := pe.findIncident(id)
+	if incident == nil {
+		pe.mu.Unlock()
+		return Incident{}, fmt.Errorf("incident %s not found", id)
+	}
+	if !incident.Active() {
+		pe.mu.Unlock()
+		return Incident{}, fmt.Errorf("incident %s is already resolved", id)
+	}
+	now := time.Now()
+	incident.ResolvedAt, incident.ResolvedBy = &now, by
+	pe.saveIncidents()
+	if pe.incidentResolved != nil {
+		close(pe.incidentResolved)
+		pe.incidentResolved = nil
+	}
+	copied := copyIncident(incident)
+	pe.mu.Unlock()
+
+	pe.logger.Printf("Resolved incident %s, lifting its deploy freeze", id)
+	return copied, nil
+}
+
+// Incidents returns the incidents, or only the active ones, newest first
+func (pe *PipelineEngine) Incidents(activeOnly bool) []Incident {
+	pe.mu.RLock()
+	incidents := make([]Incident, 0, len(pe.incidents))
+	for _, incident := range pe.incidents {
+		if !activeOnly || incident.Active() {
+			incidents = append(incidents, copyIncident(incident))
+		}
+	}
+	pe.mu.RUnlock()
+	sort.SliceStable(incidents, func(i, j int) bool {
+		return incidents[i].DeclaredAt.After(incidents[j].DeclaredAt)
+	})
+	return incidents
+}
+
+// GetIncident returns an incident
+func (pe *PipelineEngine) GetIncident(id string) (Incident, error) {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	incident := pe.findIncident(id)
+	if incident == nil {
+		return Incident{}, fmt.Errorf("incident %s not found", id)
+	}
+	return copyIncident(incident), nil
+}
+
+// LinkIncidentJob links a job to an incident, such as the deploy that
+// caused it
+func (pe *PipelineEngine) LinkIncidentJob(incidentID, jobID string) error {
+	pe.mu.Lock()
+	incident := pe.findIncident(incidentID)
+	if incident == nil {
+		pe.mu.Unlock()
+		return fmt.Errorf("incident %s not found", incidentID)
+	}
+	job, exists := pe.jobs[jobID]
+	if !exists {
+		pe.mu.Unlock()
+		return fmt.Errorf("job with ID %s not found", jobID)
+	}
+	pe.linkIncident(incident, job)
+	pe.mu.Unlock()
+
+	pe.saveJob(job)
+	return nil
+}
+
+// IncidentJobs returns the jobs linked to an incident, oldest first
+func (pe *PipelineEngine) IncidentJobs(id string) ([]*Job, error) {
+	incident, err := pe.GetIncident(id)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*Job, 0, len(incident.Jobs))
+	for _, jobID := range incident.Jobs {
+		if job, err := pe.JobSnapshot(jobID); err == nil {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobQueuedAt(jobs[i]).Before(jobQueuedAt(jobs[j])) })
+	return jobs, nil
+}
+
+// findIncident returns an incident by ID, or nil. Callers must hold pe.mu.
+func (pe *PipelineEngine) findIncident(id string) *Incident {
+	for _, incident := range pe.incidents {
+		if incident.ID == id {
+			return incident
+		}
+	}
+	return nil
+}
+
+// freezingIncident returns the first active incident freezing deploys to
+// an environment, or nil. Callers must hold pe.mu.
+func (pe *PipelineEngine) freezingIncident(environment string) *Incident {
+	for _, incident := range pe.incidents {
+		if incident.freezes(environment) {
+			return incident
+		}
+	}
+	return nil
+}
+
+// linkIncident records a link between an incident and a job on both. It
+// reports whether the link is new. Callers must hold pe.mu.
+func (pe *PipelineEngine) linkIncident(incident *Incident, job *Job) bool {
+	for _, id := range job.Incidents {
+		if id == incident.ID {
+			return false
+		}
+	}
+	job.Incidents = append(job.Incidents, incident.ID)
+	incident.Jobs = append(incident.Jobs, job.ID)
+	pe.saveIncidents()
+	return true
+}
+
+// holdDeploy waits while active incidents freeze deploys to the
+// environment of a deploy stage, linking the job to each of them. It
+// reports false when ctx is done first.
+func (pe *PipelineEngine) holdDeploy(ctx context.Context, job *Job, stage Stage) bool {
+	if stage.Deploy == "" {
+		return true
+	}
+	held := false
+	for {
+		pe.mu.Lock()
+		incident := pe.freezingIncident(stage.Deploy)
+		if incident == nil {
+			pe.mu.Unlock()
+			if held {
+				pe.logJob(job, "info", "", fmt.Sprintf("Deploy freeze on %s lifted, running stage %s", stage.Deploy, stage.ID))
+				pe.emitDeployEvent("deploy.released", job, stage, "")
+			}
+			return true
+		}
+		linked := pe.linkIncident(incident, job)
+		if pe.incidentResolved == nil {
+			pe.incidentResolved = make(chan struct{})
+		}
+		resolved := pe.incidentResolved
+		incidentID, title := incident.ID, incident.Title
+		pe.mu.Unlock()
+
+		if linked {
+			pe.saveJob(job)
+			pe.logJob(job, "warning", "", fmt.Sprintf("Stage %s deploys to %s, which is frozen by incident %s (%s); waiting until it is resolved", stage.ID, stage.Deploy, incidentID, title))
+			pe.emitDeployEvent("deploy.held", job, stage, incidentID)
+		}
+		held = true
+
+		select {
+		case <-resolved:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// emitDeployEvent emits an event about a deploy stage held by an incident
+func (pe *PipelineEngine) emitDeployEvent(eventType string, job *Job, stage Stage, incidentID string) {
+	data := map[string]interface{}{
+		"stage":       stage.ID,
+		"environment": stage.Deploy,
+	}
+	if incidentID != "" {
+		data["incident"] = incidentID
+	}
+	pe.emitEvent(Event{
+		Type:       eventType,
+		Timestamp:  time.Now(),
+		PipelineID: job.PipelineID,
+		JobID:      job.ID,
+		Data:       data,
+	})
+}
+
+// RestoreIncidents loads the incidents kept by the engine's store
+func (pe *PipelineEngine) RestoreIncidents() error {
+	store, ok := pe.store.(IncidentStore)
+	if !ok {
+		return nil
+	}
+	incidents, err := store.LoadIncidents()
+	if err != nil {
+		return err
+	}
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.incidents = incidents
+	return nil
+}
+
+// saveIncidents stores the incidents, when the store keeps them. Callers
+// must hold pe.mu.
+func (pe *PipelineEngine) saveIncidents() {
+	store, ok := pe.store.(IncidentStore)
+	if !ok {
+		return
+	}
+	if err := store.SaveIncidents(pe.incidents); err != nil {
+		pe.logger.Printf("Failed to save incidents: %v", err)
+	}
+}
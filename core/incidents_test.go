@@ -0,0 +1,127 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// deployPipeline builds, then deploys to environment, touching deployed
+func deployPipeline(id, environment string) *Pipeline {
+	pipeline := scriptPipeline(id, "true")
+	pipeline.Stages = append(pipeline.Stages, Stage{
+		ID:     "deploy",
+		Name:   "deploy",
+		Deploy: environment,
+		Steps:  []Step{{ID: "deploy-step", Name: "deploy", Type: "script", Command: "touch deployed-" + id}},
+	})
+	return pipeline
+}
+
+func TestIncidents_FreezeDeploys(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	engine.CreatePipeline(deployPipeline("api-prod", "production"))
+	engine.CreatePipeline(deployPipeline("api-staging", "staging"))
+
+	incident, err := engine.DeclareIncident(&Incident{Title: "Checkout errors", Reference: "INC-42", Environments: []string{"production"}, DeclaredBy: "alice"})
+	if err != nil {
+		t.Fatalf("DeclareIncident() error = %v", err)
+	}
+
+	staging, _ := engine.Start(context.Background(), "api-staging")
+	waitForJob(t, engine, "api-staging", staging.ID, StatusSuccess)
+
+	prod, _ := engine.Start(context.Background(), "api-prod")
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if current, _ := engine.GetIncident(incident.ID); len(current.Jobs) > 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(dir, "deployed-api-prod")); err == nil {
+		t.Fatal("production deploy ran during the incident")
+	}
+	snapshot, _ := engine.JobSnapshot(prod.ID)
+	if snapshot.Status != StatusRunning || len(snapshot.Incidents) != 1 || snapshot.Incidents[0] != incident.ID {
+		t.Errorf("held job = %s with incidents %v, want running and linked to %s", snapshot.Status, snapshot.Incidents, incident.ID)
+	}
+
+	if _, err := engine.ResolveIncident(incident.ID, "bob"); err != nil {
+		t.Fatalf("ResolveIncident() error = %v", err)
+	}
+	waitForJob(t, engine, "api-prod", prod.ID, StatusSuccess)
+	if _, err := os.Stat(filepath.Join(dir, "deployed-api-prod")); err != nil {
+		t.Error("production deploy didn't run once the incident was resolved")
+	}
+
+	jobs, err := engine.IncidentJobs(incident.ID)
+	if err != nil || len(jobs) != 1 || jobs[0].ID != prod.ID {
+		t.Errorf("IncidentJobs() = %v, %v, want only the held production job", jobs, err)
+	}
+	resolved, _ := engine.GetIncident(incident.ID)
+	if resolved.Active() || resolved.ResolvedBy != "bob" {
+		t.Errorf("GetIncident() = %+v, want resolved by bob", resolved)
+	}
+	if _, err := engine.ResolveIncident(incident.ID, "bob"); err == nil {
+		t.Error("ResolveIncident() of a resolved incident succeeded")
+	}
+}
+
+func TestIncidents_CancelHeldDeploy(t *testing.T) {
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: t.TempDir()}))
+	engine.CreatePipeline(deployPipeline("api-prod", "production"))
+	if _, err := engine.DeclareIncident(&Incident{Title: "Outage"}); err != nil {
+		t.Fatalf("DeclareIncident() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job, _ := engine.Start(ctx, "api-prod")
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if snapshot, _ := engine.JobSnapshot(job.ID); len(snapshot.Incidents) > 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	waitForJob(t, engine, "api-prod", job.ID, StatusCancelled)
+}
+
+func TestIncidents_LinkAndList(t *testing.T) {
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: t.TempDir()}))
+	engine.CreatePipeline(scriptPipeline("build", "true"))
+	job, _ := engine.Run(context.Background(), "build")
+
+	if _, err := engine.DeclareIncident(&Incident{}); err == nil {
+		t.Error("DeclareIncident() without a title succeeded")
+	}
+	first, _ := engine.DeclareIncident(&Incident{Title: "Disk full"})
+	second, _ := engine.DeclareIncident(&Incident{Title: "Bad config"})
+	engine.ResolveIncident(first.ID, "")
+
+	if err := engine.LinkIncidentJob(second.ID, job.ID); err != nil {
+		t.Fatalf("LinkIncidentJob() error = %v", err)
+	}
+	if err := engine.LinkIncidentJob(second.ID, job.ID); err != nil {
+		t.Fatalf("LinkIncidentJob() again error = %v", err)
+	}
+	if err := engine.LinkIncidentJob("incident-missing", job.ID); err == nil {
+		t.Error("LinkIncidentJob() of an unknown incident succeeded")
+	}
+	linked, _ := engine.GetIncident(second.ID)
+	if len(linked.Jobs) != 1 || linked.Jobs[0] != job.ID {
+		t.Errorf("Jobs = %v, want [%s] once", linked.Jobs, job.ID)
+	}
+
+	if active := engine.Incidents(true); len(active) != 1 || active[0].ID != second.ID {
+		t.Errorf("Incidents(true) = %+v, want only %s", active, second.ID)
+	}
+	if all := engine.Incidents(false); len(all) != 2 {
+		t.Errorf("Incidents(false) = %d incidents, want 2", len(all))
+	}
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SaveIncidents writes the incidents to incidents.json
+func (s *FileStore) SaveIncidents(incidents []*Incident) error {
+	data, err := json.MarshalIndent(incidents, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode incidents: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return writeFileAtomic(filepath.Join(s.dir, "incidents.json"), data)
+}
+
+// LoadIncidents reads incidents.json, which is empty when it doesn't exist
+// yet
+func (s *FileStore) LoadIncidents() ([]*Incident, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(s.dir, "incidents.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read incidents: %w", err)
+	}
+	var incidents []*Incident
+	if err := json.Unmarshal(data, &incidents); err != nil {
+		return nil, fmt.Errorf("failed to decode incidents: %w", err)
+	}
+	return incidents, nil
+}
@@ -0,0 +1,143 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// oomExitCode is the exit code of a command killed with SIGKILL, which is
+// how the kernel's and Docker's out of memory killers stop processes
+const oomExitCode = 137
+
+// InfrastructureError marks an error as caused by the infrastructure a step
+// ran on rather than by the step, such as a runner that couldn't start the
+// step's command or a process killed by a signal
+type InfrastructureError struct {
+	Err error
+}
+
+func (e *InfrastructureError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InfrastructureError) Unwrap() error {
+	return e.Err
+}
+
+// InfraStats counts infrastructure failures of a pipeline's steps and how
+// the engine re-dispatched them since it started
+type InfraStats struct {
+	PipelineID string `json:"pipelineId"`
+	// Failures counts step attempts that failed with an infrastructure
+	// failure
+	Failures int `json:"failures"`
+	// Retries counts re-dispatches, which don't use the steps' retry budget
+	Retries int `json:"retries"`
+	// Recovered counts steps that succeeded after being re-dispatched, and
+	// Exhausted steps still failing with an infrastructure failure when
+	// the re-dispatches ran out
+	Recovered int `json:"recovered"`
+	Exhausted int `json:"exhausted"`
+	// Runners counts infrastructure failures per runner
+	Runners map[string]int `json:"runners,omitempty"`
+}
+
+// WithInfraRetries re-dispatches steps failing with an infrastructure
+// failure up to max times, after delay, preferring another runner. These
+// retries don't count against a step's retry policy. It is off by default.
+func WithInfraRetries(max int, delay time.Duration) Option {
+	return func(pe *PipelineEngine) {
+		if max > 0 {
+			pe.infraRetries = max
+		}
+		if delay > 0 {
+			pe.infraRetryDelay = delay
+		}
+	}
+}
+
+// infrastructureFailure reports whether an executed attempt failed because
+// of its infrastructure: an InfrastructureError, or a command killed by a
+// signal or the out of memory killer
+func infrastructureFailure(attempt *stepAttempt) bool {
+	var infra *InfrastructureError
+	if errors.As(attempt.err, &infra) {
+		return true
+	}
+	return attempt.result != nil && attempt.result.ExitCode == oomExitCode
+}
+
+// recordInfraFailure counts an infrastructure failure of a step attempt on
+// runner, and whether it is re-dispatched
+func (pe *PipelineEngine) recordInfraFailure(pipelineID string, runner *runnerSlot, retried bool) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	stats := pe.infraStatsFor(pipelineID)
+	stats.Failures++
+	if retried {
+		stats.Retries++
+	}
+	if runner != nil {
+		if stats.Runners == nil {
+			stats.Runners = make(map[string]int)
+		}
+		stats.Runners[runner.Name]++
+	}
+}
+
+// recordInfraOutcome counts how a re-dispatched step ended
+func (pe *PipelineEngine) recordInfraOutcome(pipelineID string, err error, class string) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	stats := pe.infraStatsFor(pipelineID)
+	switch {
+	case err == nil:
+		stats.Recovered++
+	case class == FailureInfrastructure:
+		stats.Exhausted++
+	}
+}
+
+// infraStatsFor returns the infrastructure stats of a pipeline. Callers
+// must hold pe.mu.
+func (pe *PipelineEngine) infraStatsFor(pipelineID string) *InfraStats {
+	stats := pe.infraStats[pipelineID]
+	if stats == nil {
+		stats = &InfraStats{PipelineID: pipelineID}
+		pe.infraStats[pipelineID] = stats
+	}
+	return stats
+}
+
+// InfraStats reports infrastructure failures and re-dispatches per
+// pipeline, for one pipeline when pipelineID is set, sorted by pipeline ID
+func (pe *PipelineEngine) InfraStats(pipelineID string) []InfraStats {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	stats := make([]InfraStats, 0, len(pe.infraStats))
+	for _, s := range pe.infraStats {
+		if pipelineID != "" && s.PipelineID != pipelineID {
+			continue
+		}
+		copied := *s
+		if s.Runners != nil {
+			copied.Runners = make(map[string]int, len(s.Runners))
+			for name, count := range s.Runners {
+				copied.Runners[name] = count
+			}
+		}
+		stats = append(stats, copied)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].PipelineID < stats[j].PipelineID
+	})
+	return stats
+}
+
+// describeRedispatch describes the re-dispatch of a step for the job log
+func describeRedispatch(retry, max int, delay time.Duration) string {
+	return fmt.Sprintf("; re-dispatching in %s (infrastructure retry %d of %d)", delay, retry, max)
+}
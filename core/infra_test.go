@@ -0,0 +1,83 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// brokenExecutor fails every step as its infrastructure would
+type brokenExecutor struct{}
+
+func (e *brokenExecutor) Execute(ctx context.Context, step Step, env map[string]string) (*StepResult, error) {
+	return nil, &InfrastructureError{Err: errors.New("runner lost")}
+}
+
+func TestRun_RedispatchesInfrastructureFailures(t *testing.T) {
+	engine := newTestEngine(
+		WithInfraRetries(2, time.Millisecond),
+		WithRunners(
+			Runner{Name: "broken", Labels: []string{"linux"}, Executor: &brokenExecutor{}},
+			Runner{Name: "healthy", Labels: []string{"linux"}, Executor: &recordingExecutor{}},
+		),
+	)
+	pipeline := scriptPipeline("infra", "echo build")
+	pipeline.Stages[0].RunsOn = []string{"linux"}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "infra")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	step := job.Steps[0]
+	if job.Status != StatusSuccess || step.Runner != "healthy" {
+		t.Fatalf("job = %s on runner %q, want success on the healthy runner; logs: %+v", job.Status, step.Runner, job.Logs)
+	}
+	if step.InfraRetries != 1 || step.Attempts != 0 {
+		t.Errorf("step InfraRetries = %d, Attempts = %d, want one re-dispatch outside the retry budget", step.InfraRetries, step.Attempts)
+	}
+
+	stats := engine.InfraStats("infra")
+	if len(stats) != 1 || stats[0].Failures != 1 || stats[0].Retries != 1 || stats[0].Recovered != 1 || stats[0].Runners["broken"] != 1 {
+		t.Errorf("InfraStats() = %+v, want one recovered failure on the broken runner", stats)
+	}
+}
+
+func TestRun_InfrastructureRetriesKeepRetryBudget(t *testing.T) {
+	engine := newTestEngine(WithInfraRetries(1, time.Millisecond))
+	pipeline := scriptPipeline("oom", `exit 137`)
+	pipeline.Stages[0].Steps[0].Retry = &RetryConfig{MaxAttempts: 2, Interval: "1ms"}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "oom")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	step := job.Steps[0]
+	if step.Status != StatusFailed || step.FailureClass != FailureInfrastructure {
+		t.Fatalf("step = %s (%s), want an infrastructure failure", step.Status, step.FailureClass)
+	}
+	// Re-dispatched once, then retried once per its policy
+	if step.InfraRetries != 1 || step.Attempts != 2 {
+		t.Errorf("step InfraRetries = %d, Attempts = %d, want 1 and 2", step.InfraRetries, step.Attempts)
+	}
+
+	stats := engine.InfraStats("")
+	if len(stats) != 1 || stats[0].Failures != 3 || stats[0].Retries != 1 || stats[0].Exhausted != 1 || stats[0].Recovered != 0 {
+		t.Errorf("InfraStats() = %+v, want three failures, one re-dispatch and one exhausted step", stats)
+	}
+}
+
+func TestRun_InfrastructureRetriesOffByDefault(t *testing.T) {
+	engine := newTestEngine()
+	engine.CreatePipeline(scriptPipeline("oom", `exit 137`))
+
+	job, _ := engine.Run(context.Background(), "oom")
+	if step := job.Steps[0]; step.InfraRetries != 0 || step.FailureClass != FailureInfrastructure {
+		t.Errorf("step InfraRetries = %d (%s), want no re-dispatch", step.InfraRetries, step.FailureClass)
+	}
+	if stats := engine.InfraStats(""); len(stats) != 1 || stats[0].Failures != 1 || stats[0].Retries != 0 {
+		t.Errorf("InfraStats() = %+v, want the failure counted without re-dispatch", stats)
+	}
+}
@@ -0,0 +1,220 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// QueuedJob is a job waiting for one of the engine's job slots
+type QueuedJob struct {
+	JobID      string    `json:"jobId"`
+	PipelineID string    `json:"pipelineId"`
+	Position   int       `json:"position"`
+	QueuedAt   time.Time `json:"queuedAt"`
+}
+
+// JobQueueStatus reports the limit on jobs running at once, the running
+// jobs and the jobs waiting for them, first in line first
+type JobQueueStatus struct {
+	MaxConcurrent int         `json:"maxConcurrent"`
+	Running       int         `json:"running"`
+	Queued        []QueuedJob `json:"queued"`
+}
+
+// jobRun is a job waiting for a worker to run it
+type jobRun struct {
+	ctx      context.Context
+	pipeline *Pipeline
+	job      *Job
+	// stopWatch stops watching the job's duration, which its budget
+	// counts from when it was queued
+	stopWatch func()
+	// done is closed once the job finished
+	done chan struct{}
+}
+
+// WithMaxConcurrentJobs limits the jobs running at once. Jobs are run by a
+// pool of at most n workers, and other jobs wait as pending, in the order
+// they were started, until a worker is free. Zero, the default, runs every
+// job right away.
+func WithMaxConcurrentJobs(n int) Option {
+	return func(pe *PipelineEngine) {
+		pe.maxJobs = n
+	}
+}
+
+// SetMaxConcurrentJobs changes the limit on jobs running at once. Lowering
+// it lets running jobs finish; raising it starts queued jobs right away.
+func (pe *PipelineEngine) SetMaxConcurrentJobs(n int) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.maxJobs = n
+	pe.dispatchJobs()
+}
+
+// JobQueue returns the limit on jobs running at once and the queued jobs
+func (pe *PipelineEngine) JobQueue() JobQueueStatus {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	status := JobQueueStatus{MaxConcurrent: pe.maxJobs, Running: len(pe.jobSlots), Queued: make([]QueuedJob, 0, len(pe.jobQueue))}
+	for i, run := range pe.jobQueue {
+		status.Queued = append(status.Queued, QueuedJob{
+			JobID:      run.job.ID,
+			PipelineID: run.job.PipelineID,
+			Position:   i + 1,
+			QueuedAt:   run.job.QueuedAt,
+		})
+	}
+	return status
+}
+
+// admitJob reserves a job slot for a new job when one is free and no job
+// is queued for one, and reports whether it did. Callers must hold pe.mu.
+func (pe *PipelineEngine) admitJob(jobID string) bool {
+	if !pe.slotFree() || len(pe.jobQueue) > 0 {
+		return false
+	}
+	if pe.jobSlots == nil {
+		pe.jobSlots = make(map[string]bool)
+	}
+	pe.jobSlots[jobID] = true
+	return true
+}
+
+// slotFree reports whether a worker may start. Callers must hold pe.mu.
+func (pe *PipelineEngine) slotFree() bool {
+	return pe.maxJobs <= 0 || len(pe.jobSlots) < pe.maxJobs
+}
+
+// enqueueJob hands a new job to the workers, and returns a channel closed
+// once it finished. A job admitted with a slot starts right away. Other
+// jobs join the job queue, once they hold their concurrency group if they
+// have one.
+func (pe *PipelineEngine) enqueueJob(ctx context.Context, pipeline *Pipeline, job *Job) <-chan struct{} {
+	run := &jobRun{ctx: ctx, pipeline: pipeline, job: job, stopWatch: pe.watchDuration(pipeline, job), done: make(chan struct{})}
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	if pe.jobSlots[job.ID] {
+		go pe.jobWorker(run)
+		return run.done
+	}
+	if ctx.Err() != nil {
+		// Cancelled before it was queued
+		go pe.finishJob(run)
+		return run.done
+	}
+	if group := jobGroup(job); group != "" {
+		g := pe.groups[group]
+		if g != nil && g.running == "" && g.pending == job.ID {
+			g.running, g.pending = job.ID, ""
+		}
+		if g != nil && g.running != job.ID {
+			// releaseGroup queues the job once the group is free
+			if pe.groupRuns == nil {
+				pe.groupRuns = make(map[string]*jobRun)
+			}
+			pe.groupRuns[job.ID] = run
+			return run.done
+		}
+	}
+	pe.queueJob(run)
+	return run.done
+}
+
+// queueJob puts a job at the end of the job queue and starts the jobs
+// workers are free for. Callers must hold pe.mu.
+func (pe *PipelineEngine) queueJob(run *jobRun) {
+	pe.jobQueue = append(pe.jobQueue, run)
+	pe.dispatchJobs()
+	if position := len(pe.jobQueue); position > 0 && pe.jobQueue[position-1] == run {
+		run.job.Logs = append(run.job.Logs, LogEntry{
+			Timestamp: time.Now(),
+			Level:     "info",
+			Message:   fmt.Sprintf("Queued at position %d: %d of %d job slots in use", position, len(pe.jobSlots), pe.maxJobs),
+		})
+	}
+}
+
+// dispatchJobs starts a worker for each queued job, first in line first,
+// while fewer than the limit are running. Callers must hold pe.mu.
+func (pe *PipelineEngine) dispatchJobs() {
+	for pe.slotFree() {
+		run := pe.nextJob()
+		if run == nil {
+			return
+		}
+		go pe.jobWorker(run)
+	}
+}
+
+// nextJob takes the first job out of the queue and gives it a slot, or
+// returns nil when the queue is empty. Callers must hold pe.mu.
+func (pe *PipelineEngine) nextJob() *jobRun {
+	if len(pe.jobQueue) == 0 {
+		return nil
+	}
+	run := pe.jobQueue[0]
+	pe.jobQueue[0] = nil
+	pe.jobQueue = pe.jobQueue[1:]
+	if pe.jobSlots == nil {
+		pe.jobSlots = make(map[string]bool)
+	}
+	pe.jobSlots[run.job.ID] = true
+	return run
+}
+
+// jobWorker runs a job, then the queued jobs after it while the limit
+// allows, and exits once the queue is empty
+func (pe *PipelineEngine) jobWorker(run *jobRun) {
+	for run != nil {
+		pe.finishJob(run)
+
+		pe.mu.Lock()
+		delete(pe.jobSlots, run.job.ID)
+		run = nil
+		if pe.slotFree() {
+			run = pe.nextJob()
+		}
+		pe.mu.Unlock()
+	}
+}
+
+// unqueueJob takes a cancelled job out of the job queue, or out of the
+// jobs waiting for their concurrency group, and completes it. Callers must
+// hold pe.mu.
+func (pe *PipelineEngine) unqueueJob(jobID string) {
+	var run *jobRun
+	for i, queued := range pe.jobQueue {
+		if queued.job.ID == jobID {
+			run = queued
+			pe.jobQueue = append(pe.jobQueue[:i], pe.jobQueue[i+1:]...)
+			break
+		}
+	}
+	if waiting, ok := pe.groupRuns[jobID]; ok {
+		run = waiting
+		delete(pe.groupRuns, jobID)
+	}
+	if run == nil {
+		return
+	}
+	if group := jobGroup(run.job); group != "" {
+		if g, ok := pe.groups[group]; ok && g.pending == jobID {
+			g.pending = ""
+			pe.dropGroup(group, g)
+		}
+	}
+
+	// The job stops right away, without a slot, since its context is done
+	go pe.finishJob(run)
+}
+
+// finishJob runs a job and signals its end
+func (pe *PipelineEngine) finishJob(run *jobRun) {
+	pe.runJob(run.ctx, run.pipeline, run.job)
+	run.stopWatch()
+	close(run.done)
+}
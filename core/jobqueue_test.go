@@ -0,0 +1,91 @@
+package core
+
+import (
+	"context"
+	"testing"
+)
+
+func TestJobQueue_LimitsConcurrentJobs(t *testing.T) {
+	executor := &recordingExecutor{release: make(chan struct{})}
+	engine := newTestEngine(WithExecutor(executor), WithMaxConcurrentJobs(1))
+	engine.CreatePipeline(scriptPipeline("build", "make"))
+
+	var jobs []*Job
+	for i := 0; i < 3; i++ {
+		job, err := engine.Start(context.Background(), "build")
+		if err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		jobs = append(jobs, job)
+	}
+	if jobs[0].Status != StatusRunning || jobs[1].Status != StatusPending || jobs[2].Status != StatusPending {
+		t.Fatalf("statuses = %s, %s, %s, want the first running and the others pending", jobs[0].Status, jobs[1].Status, jobs[2].Status)
+	}
+
+	waitForJob(t, engine, "build", jobs[0].ID, StatusRunning)
+	queue := engine.JobQueue()
+	if queue.MaxConcurrent != 1 || queue.Running != 1 || len(queue.Queued) != 2 {
+		t.Fatalf("JobQueue() = %+v, want one running and two queued", queue)
+	}
+	if queue.Queued[0].JobID != jobs[1].ID || queue.Queued[1].Position != 2 || queue.Queued[1].PipelineID != "build" {
+		t.Errorf("queued = %+v, want the jobs in the order they were started", queue.Queued)
+	}
+
+	// Cancelling a queued job takes it out of line
+	if err := engine.CancelJob("build", jobs[1].ID); err != nil {
+		t.Fatalf("CancelJob() error = %v", err)
+	}
+	waitForJob(t, engine, "build", jobs[1].ID, StatusCancelled)
+
+	close(executor.release)
+	waitForJob(t, engine, "build", jobs[0].ID, StatusSuccess)
+	waitForJob(t, engine, "build", jobs[2].ID, StatusSuccess)
+	if executor.peak != 1 {
+		t.Errorf("peak concurrent steps = %d, want 1", executor.peak)
+	}
+	if queue := engine.JobQueue(); queue.Running != 0 || len(queue.Queued) != 0 {
+		t.Errorf("JobQueue() = %+v, want it empty once the jobs finished", queue)
+	}
+}
+
+func TestJobQueue_RaisingTheLimitStartsQueuedJobs(t *testing.T) {
+	executor := &recordingExecutor{release: make(chan struct{})}
+	defer close(executor.release)
+	engine := newTestEngine(WithExecutor(executor), WithMaxConcurrentJobs(1))
+	engine.CreatePipeline(scriptPipeline("build", "make"))
+
+	first, _ := engine.Start(context.Background(), "build")
+	second, _ := engine.Start(context.Background(), "build")
+	waitForJob(t, engine, "build", first.ID, StatusRunning)
+	if queue := engine.JobQueue(); len(queue.Queued) != 1 {
+		t.Fatalf("JobQueue() = %+v, want the second job queued", queue)
+	}
+
+	engine.SetMaxConcurrentJobs(2)
+	waitForJob(t, engine, "build", second.ID, StatusRunning)
+	if queue := engine.JobQueue(); queue.Running != 2 || len(queue.Queued) != 0 {
+		t.Errorf("JobQueue() = %+v, want both jobs running", queue)
+	}
+}
+
+func TestJobQueue_ResumedJobsWaitForASlot(t *testing.T) {
+	store := newRecoveryStore(t, crashedJob())
+	engine := newTestEngine(WithStore(store), WithExecutor(&ShellExecutor{Resume: true}), WithMaxConcurrentJobs(1))
+	engine.CreatePipeline(scriptPipeline("resume", "echo first", "echo second"))
+	engine.CreatePipeline(scriptPipeline("busy", "sleep 0.3"))
+
+	busy, _ := engine.Start(context.Background(), "busy")
+	waitForJob(t, engine, "busy", busy.ID, StatusRunning)
+	if err := engine.RestoreJobs(); err != nil {
+		t.Fatalf("RestoreJobs() error = %v", err)
+	}
+
+	resumed, _ := engine.GetJob("resume", "crashed")
+	if resumed.Status != StatusPending {
+		t.Errorf("resumed job status = %s, want pending while the slot is taken", resumed.Status)
+	}
+	if queue := engine.JobQueue(); len(queue.Queued) != 1 || queue.Queued[0].JobID != "crashed" {
+		t.Errorf("JobQueue() = %+v, want the resumed job queued", queue)
+	}
+	waitForJob(t, engine, "resume", "crashed", StatusSuccess)
+}
@@ -0,0 +1,152 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// jobWorkspaces gives every job that doesn't run in a warm workspace a
+// directory of its own under root/<job>, kept for retention after the job
+// finishes
+type jobWorkspaces struct {
+	root      string
+	retention time.Duration
+}
+
+// WithJobWorkspaces runs the steps of each job in a directory of its own
+// under root instead of the executor's working directory. The directories
+// of finished jobs are deleted once they ended retention ago, right away
+// when retention is zero.
+func WithJobWorkspaces(root string, retention time.Duration) Option {
+	return func(pe *PipelineEngine) {
+		pe.jobWorkspaces = &jobWorkspaces{root: root, retention: retention}
+	}
+}
+
+// ValidateWorkingDir checks that a step's working directory is a relative
+// path that stays within the job's directory
+func ValidateWorkingDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if filepath.IsAbs(dir) || strings.HasPrefix(dir, "/") || strings.HasPrefix(dir, `\`) {
+		return fmt.Errorf("working directory %q must be relative to the job's workspace", dir)
+	}
+	clean := path.Clean(filepath.ToSlash(dir))
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("working directory %q is outside the job's workspace", dir)
+	}
+	return nil
+}
+
+// stepDir returns the directory a step runs in: its working directory
+// within dir, which must exist, or dir
+func stepDir(dir string, step Step) (string, error) {
+	if step.WorkingDir == "" {
+		return dir, nil
+	}
+	if err := ValidateWorkingDir(step.WorkingDir); err != nil {
+		return "", err
+	}
+	workDir := filepath.Join(dir, filepath.FromSlash(step.WorkingDir))
+	if info, err := os.Stat(workDir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("working directory %s of step %s does not exist", step.WorkingDir, step.ID)
+	}
+	return workDir, nil
+}
+
+// acquireJobWorkspace creates the directory of a job, or finds it again
+// for a resumed job
+func (pe *PipelineEngine) acquireJobWorkspace(pipeline *Pipeline, job *Job) error {
+	dir := filepath.Join(pe.jobWorkspaces.root, workspaceDirName(job.ID))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create job workspace: %w", err)
+	}
+	pe.mu.Lock()
+	pe.leases[job.ID] = &workspaceLease{pipelineID: pipeline.ID, dir: dir, temporary: true, job: true}
+	pe.mu.Unlock()
+	return nil
+}
+
+// releaseJobWorkspace deletes the directory of a finished job when it
+// isn't retained. Interrupted jobs keep theirs to resume in.
+func (pe *PipelineEngine) releaseJobWorkspace(lease *workspaceLease, status Status) {
+	if status == StatusInterrupted || pe.jobWorkspaces.retention > 0 {
+		return
+	}
+	if err := os.RemoveAll(lease.dir); err != nil {
+		pe.logger.Printf("Failed to delete job workspace %s: %v", lease.dir, err)
+	}
+}
+
+// CleanJobWorkspaces deletes the directories of jobs that finished more
+// than the retention before now, of jobs that no longer exist, and returns
+// how many it deleted
+func (pe *PipelineEngine) CleanJobWorkspaces(now time.Time) (int, error) {
+	if pe.jobWorkspaces == nil {
+		return 0, nil
+	}
+	entries, err := ioutil.ReadDir(pe.jobWorkspaces.root)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	pe.mu.RLock()
+	jobs := make(map[string]*Job, len(pe.jobs))
+	for id, job := range pe.jobs {
+		jobs[workspaceDirName(id)] = job
+	}
+	held := make(map[string]bool, len(pe.leases))
+	for _, lease := range pe.leases {
+		held[lease.dir] = true
+	}
+	expired := make([]string, 0)
+	for _, entry := range entries {
+		dir := filepath.Join(pe.jobWorkspaces.root, entry.Name())
+		if !entry.IsDir() || held[dir] {
+			continue
+		}
+		job, ok := jobs[entry.Name()]
+		switch {
+		case !ok:
+			expired = append(expired, dir)
+		case job.Status.IsTerminal() && !job.EndedAt.After(now.Add(-pe.jobWorkspaces.retention)):
+			expired = append(expired, dir)
+		}
+	}
+	pe.mu.RUnlock()
+
+	for _, dir := range expired {
+		if err := os.RemoveAll(dir); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
+
+// WatchJobWorkspaces cleans job workspaces now and then every interval
+// until ctx is done
+func (pe *PipelineEngine) WatchJobWorkspaces(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := pe.CleanJobWorkspaces(time.Now()); err != nil {
+			pe.logger.Printf("Failed to clean job workspaces: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobWorkspace_StepsRunInJobDirectory(t *testing.T) {
+	root := t.TempDir()
+	engine := newTestEngine(WithJobWorkspaces(root, time.Hour))
+	pipeline := scriptPipeline("web", "mkdir -p src/app && pwd > src/app/where", "pwd")
+	pipeline.Stages[0].Steps[1].WorkingDir = "src/app"
+	if err := engine.CreatePipeline(pipeline); err != nil {
+		t.Fatalf("CreatePipeline() error = %v", err)
+	}
+
+	job, err := engine.Run(context.Background(), "web")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess {
+		t.Fatalf("Status = %q, want success; logs: %+v", job.Status, job.Logs)
+	}
+	dir := filepath.Join(root, job.ID)
+	where, err := os.ReadFile(filepath.Join(dir, "src", "app", "where"))
+	if err != nil {
+		t.Fatalf("job directory is missing: %v", err)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(job.Steps[1].Output), filepath.Join(job.ID, "src", "app")) {
+		t.Errorf("second step ran in %q, want src/app of the job's directory %q", job.Steps[1].Output, where)
+	}
+
+	// Retained until the retention passes
+	if n, err := engine.CleanJobWorkspaces(time.Now()); err != nil || n != 0 {
+		t.Errorf("CleanJobWorkspaces() = %d, %v, want the directory retained", n, err)
+	}
+	if n, err := engine.CleanJobWorkspaces(time.Now().Add(2 * time.Hour)); err != nil || n != 1 {
+		t.Errorf("CleanJobWorkspaces() after the retention = %d, %v, want 1", n, err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("job directory still exists after the retention: %v", err)
+	}
+}
+
+func TestJobWorkspace_DeletedWithoutRetention(t *testing.T) {
+	root := t.TempDir()
+	engine := newTestEngine(WithJobWorkspaces(root, 0))
+	if err := engine.CreatePipeline(scriptPipeline("web", "touch built")); err != nil {
+		t.Fatalf("CreatePipeline() error = %v", err)
+	}
+
+	job, err := engine.Run(context.Background(), "web")
+	if err != nil || job.Status != StatusSuccess {
+		t.Fatalf("Run() = %v, %v, want success", job, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, job.ID)); !os.IsNotExist(err) {
+		t.Errorf("job directory exists after the job: %v", err)
+	}
+}
+
+func TestJobWorkspace_MissingWorkingDirFailsStep(t *testing.T) {
+	engine := newTestEngine(WithJobWorkspaces(t.TempDir(), 0))
+	pipeline := scriptPipeline("web", "true")
+	pipeline.Stages[0].Steps[0].WorkingDir = "missing"
+	if err := engine.CreatePipeline(pipeline); err != nil {
+		t.Fatalf("CreatePipeline() error = %v", err)
+	}
+
+	job, err := engine.Run(context.Background(), "web")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusFailed || job.Steps[0].Status != StatusFailed {
+		t.Fatalf("job = %s, step = %s, want both failed", job.Status, job.Steps[0].Status)
+	}
+	logged := false
+	for _, entry := range job.Logs {
+		logged = logged || strings.Contains(entry.Message, "working directory missing of step build-step-a does not exist")
+	}
+	if !logged {
+		t.Errorf("logs = %+v, want the missing working directory", job.Logs)
+	}
+}
+
+func TestValidateWorkingDir(t *testing.T) {
+	for dir, valid := range map[string]bool{
+		"":           true,
+		"src/app":    true,
+		"./build":    true,
+		"a/../b":     true,
+		"/etc":       false,
+		"../outside": false,
+		"a/../..":    false,
+	} {
+		if err := ValidateWorkingDir(dir); (err == nil) != valid {
+			t.Errorf("ValidateWorkingDir(%q) error = %v, want valid %v", dir, err, valid)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package core
+
+import (
+	"context"
+	"time"
+)
+
+// interruptGracePeriod bounds how long Shutdown waits for cancelled jobs to
+// record their final state
+const interruptGracePeriod = 5 * time.Second
+
+// Shutdown stops the engine from accepting new jobs and waits for running
+// jobs to finish. If ctx expires first, running jobs are cancelled and
+// recorded as interrupted, and ctx's error is returned.
+func (pe *PipelineEngine) Shutdown(ctx context.Context) error {
+	pe.mu.Lock()
+	pe.closing = true
+	pe.mu.Unlock()
+
+	pe.closeDebugSessions()
+
+	done := make(chan struct{})
+	go func() {
+		pe.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	pe.mu.Lock()
+	pe.interrupting = true
+	for jobID, cancel := range pe.cancels {
+		pe.logger.Printf("Interrupting job %s", jobID)
+		cancel()
+	}
+	pe.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(interruptGracePeriod):
+		pe.logger.Printf("Timed out waiting for interrupted jobs to stop")
+	}
+
+	return ctx.Err()
+}
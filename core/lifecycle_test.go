@@ -0,0 +1,95 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func waitForJob(t *testing.T, engine *PipelineEngine, pipelineID, jobID string, status Status) *Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := engine.GetJob(pipelineID, jobID)
+		if err != nil {
+			t.Fatalf("GetJob() error = %v", err)
+		}
+		if snapshot := engine.snapshotJob(job); snapshot.Status == status {
+			return snapshot
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not reach status %s", jobID, status)
+	return nil
+}
+
+func TestShutdown_WaitsForRunningJobs(t *testing.T) {
+	engine := newTestEngine()
+	engine.CreatePipeline(scriptPipeline("drain", "sleep 0.2"))
+
+	job, err := engine.Start(context.Background(), "drain")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := engine.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	got, _ := engine.GetJob("drain", job.ID)
+	if got.Status != StatusSuccess {
+		t.Errorf("Status = %q, want %q", got.Status, StatusSuccess)
+	}
+
+	if _, err := engine.Start(context.Background(), "drain"); err == nil {
+		t.Error("Start() after Shutdown() expected error, got nil")
+	}
+}
+
+func TestShutdown_InterruptsJobsAfterDeadline(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	engine := newTestEngine(WithStore(store))
+	engine.CreatePipeline(scriptPipeline("slow", "sleep 30"))
+
+	job, _ := engine.Start(context.Background(), "slow")
+	waitForJob(t, engine, "slow", job.ID, StatusRunning)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := engine.Shutdown(ctx); err == nil {
+		t.Fatal("Shutdown() expected deadline error, got nil")
+	}
+
+	got := waitForJob(t, engine, "slow", job.ID, StatusInterrupted)
+	if len(got.Steps) != 1 || got.Steps[0].Status != StatusInterrupted {
+		t.Errorf("Steps = %+v, want one interrupted step", got.Steps)
+	}
+
+	jobs, err := store.LoadJobs()
+	if err != nil {
+		t.Fatalf("LoadJobs() error = %v", err)
+	}
+	if len(jobs) != 1 || jobs[0].Status != StatusInterrupted {
+		t.Errorf("persisted jobs = %+v, want one interrupted job", jobs)
+	}
+}
+
+func TestRun_StepTimeout(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("timeout", "sleep 5")
+	pipeline.Stages[0].Steps[0].Timeout = "50ms"
+	engine.CreatePipeline(pipeline)
+
+	job, _ := engine.Run(context.Background(), "timeout")
+	if job.Status != StatusFailed {
+		t.Errorf("Status = %q, want %q", job.Status, StatusFailed)
+	}
+	if len(job.Logs) == 0 || job.Logs[0].Message != "step timed out after 50ms" {
+		t.Errorf("Logs = %+v, want timeout message", job.Logs)
+	}
+}
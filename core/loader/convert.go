@@ -1,6 +1,7 @@
 package loader
 
 import (
+	"strings"
 	"time"
 
 	"github.com/chip/conveyor/core"
@@ -15,11 +16,22 @@ func Convert(p *YAMLPipeline, id string) (*core.Pipeline, error) {
 
 	now := time.Now()
 	pipeline := &core.Pipeline{
-		ID:          id,
-		Name:        p.Name,
-		Description: p.Description,
-		CreatedAt:   now,
-		UpdatedAt:   now,
+		ID:               id,
+		Name:             p.Name,
+		Description:      p.Description,
+		ConcurrencyGroup: p.ConcurrencyGroup,
+		CancelInProgress: p.CancelInProgress,
+		Team:             p.Team,
+		Release:          p.Release,
+		DebugOnFailure:   p.DebugOnFailure,
+		Redact:           p.Redact,
+		DiskQuota:        p.DiskQuota,
+		Budget:           convertBudget(p.Budget),
+		Network:          convertNetwork(p.Network),
+		Readme:           p.Readme,
+		Info:             convertInfo(p.Info),
+		CreatedAt:        now,
+		UpdatedAt:        now,
 	}
 
 	for _, t := range p.Triggers {
@@ -28,6 +40,12 @@ func Convert(p *YAMLPipeline, id string) (*core.Pipeline, error) {
 			Branches: t.Branches,
 			Events:   t.Events,
 			Paths:    t.Paths,
+			Cron:     t.Cron,
+			Timezone: t.Timezone,
+			Pipeline: t.Pipeline,
+			Labels:   t.Labels,
+			Debounce: t.Debounce,
+			MaxDelay: t.MaxDelay,
 		})
 	}
 
@@ -39,16 +57,42 @@ func Convert(p *YAMLPipeline, id string) (*core.Pipeline, error) {
 		}
 	}
 
+	if p.Workspace != nil && p.Workspace.Enabled {
+		pipeline.Workspace = &core.WorkspaceConfig{Dependencies: p.Workspace.Dependencies}
+	}
+
 	if p.Environment != nil {
 		pipeline.Environment = p.Environment.Variables
 	}
 
+	for _, a := range p.Artifacts {
+		pipeline.Artifacts = append(pipeline.Artifacts, core.ArtifactConfig{
+			Name:      a.Name,
+			Paths:     a.Path,
+			Retention: a.Retention,
+		})
+	}
+	if p.ArtifactRetention != nil {
+		pipeline.ArtifactRetention = &core.RetentionPolicy{
+			Days:  p.ArtifactRetention.Days,
+			Count: p.ArtifactRetention.Count,
+		}
+	}
+
 	for _, ys := range p.Stages {
 		stageID := Slugify(ys.Name)
 
 		stage := core.Stage{
-			ID:   stageID,
-			Name: ys.Name,
+			ID:           stageID,
+			Name:         ys.Name,
+			AllowFailure: ys.AllowFailure,
+			Speculative:  ys.Speculative,
+			RunsOn:       ys.RunsOn,
+			Services:     convertServices(ys.Services),
+			Deploy:       ys.Deploy,
+			Parallel:     ys.Parallel,
+			MaxParallel:  ys.MaxParallel,
+			Matrix:       convertMatrix(ys.Matrix),
 		}
 
 		for _, need := range ys.Needs {
@@ -67,66 +111,183 @@ func Convert(p *YAMLPipeline, id string) (*core.Pipeline, error) {
 		}
 
 		for _, yst := range ys.Steps {
-			stepID := Slugify(stageID + "-" + yst.Name)
-
-			step := core.Step{
-				ID:          stepID,
-				Name:        yst.Name,
-				Command:     yst.Run,
-				Plugin:      yst.Plugin,
-				Image:       yst.Image,
-				Environment: yst.Environment,
-				Config:      yst.Config,
-				Timeout:     yst.Timeout,
-				DependsOn:   yst.DependsOn,
-				Outputs:     yst.Outputs,
-			}
+			stage.Steps = append(stage.Steps, convertStep(stageID, yst))
+		}
+		for _, yst := range ys.Rollback {
+			stage.Rollback = append(stage.Rollback, convertStep(stageID+"-rollback", yst))
+		}
 
-			if yst.Type != "" {
-				step.Type = yst.Type
-			} else if yst.Plugin != "" {
-				step.Type = "plugin"
-			} else {
-				step.Type = "script"
-			}
+		pipeline.Stages = append(pipeline.Stages, stage)
+	}
 
-			if yst.Description != "" {
-				if step.Metadata == nil {
-					step.Metadata = make(map[string]interface{})
-				}
-				step.Metadata["description"] = yst.Description
-			}
+	return pipeline, nil
+}
 
-			if yst.When != nil {
-				step.When = &core.ConditionalExecution{
-					Branch:  yst.When.Branch,
-					Status:  yst.When.Status,
-					Custom:  yst.When.Custom,
-					Pattern: yst.When.Pattern,
-				}
-			}
+// convertStep transforms a YAMLStep into a core.Step whose ID is derived from
+// prefix and the step name.
+func convertStep(prefix string, yst YAMLStep) core.Step {
+	step := core.Step{
+		ID:          Slugify(prefix + "-" + yst.Name),
+		Name:        yst.Name,
+		Command:     yst.Run,
+		Plugin:      yst.Plugin,
+		Image:       yst.Image,
+		Environment: yst.Environment,
+		Config:      yst.Config,
+		Timeout:     yst.Timeout,
+		DependsOn:   yst.DependsOn,
+		Outputs:     yst.Outputs,
+		Secrets:     yst.Secrets,
+		RunsOn:      yst.RunsOn,
+		Services:    convertServices(yst.Services),
+		Resources:   convertResources(yst.Resources),
+		OutputLimit: yst.OutputLimit,
+		WorkingDir:  yst.WorkingDir,
+		Redact:      yst.Redact,
+		Locks:       yst.Locks,
+		LockTimeout: yst.LockTimeout,
+		Network:     convertNetwork(yst.Network),
+		Matrix:      convertMatrix(yst.Matrix),
+	}
 
-			if yst.Retry != nil {
-				step.Retry = &core.RetryConfig{
-					MaxAttempts:        yst.Retry.MaxAttempts,
-					Interval:           yst.Retry.Interval,
-					ExponentialBackoff: yst.Retry.ExponentialBackoff,
-				}
-			}
+	if yst.Type != "" {
+		step.Type = yst.Type
+	} else if yst.Plugin != "" {
+		step.Type = "plugin"
+	} else {
+		step.Type = "script"
+	}
 
-			if yst.Cache != nil {
-				step.Cache = &core.CacheConfig{
-					Key:    yst.Cache.Key,
-					Paths:  yst.Cache.Paths,
-					Policy: yst.Cache.Policy,
-				}
-			}
+	if yst.Description != "" {
+		if step.Metadata == nil {
+			step.Metadata = make(map[string]interface{})
+		}
+		step.Metadata["description"] = yst.Description
+	}
 
-			stage.Steps = append(stage.Steps, step)
+	if yst.When != nil {
+		step.When = &core.ConditionalExecution{
+			Branch:  yst.When.Branch,
+			Status:  yst.When.Status,
+			Custom:  yst.When.Custom,
+			Pattern: yst.When.Pattern,
 		}
+	}
 
-		pipeline.Stages = append(pipeline.Stages, stage)
+	if yst.Retry != nil {
+		step.Retry = &core.RetryConfig{
+			MaxAttempts:        yst.Retry.MaxAttempts,
+			Interval:           yst.Retry.Interval,
+			ExponentialBackoff: yst.Retry.ExponentialBackoff,
+			On:                 yst.Retry.On,
+		}
 	}
 
-	return pipeline, nil
+	if len(yst.ExitCodes) > 0 {
+		step.ExitCodes = make(map[int]core.Status, len(yst.ExitCodes))
+		for code, status := range yst.ExitCodes {
+			step.ExitCodes[code] = core.Status(strings.ToLower(status))
+		}
+	}
+	for _, failure := range yst.Failures {
+		step.Failures = append(step.Failures, core.FailureRule{
+			Class:     failure.Class,
+			ExitCodes: failure.ExitCodes,
+			Pattern:   failure.Pattern,
+		})
+	}
+
+	if yst.Memoize != nil && yst.Memoize.Enabled {
+		step.Memoize = &core.MemoizeConfig{
+			Inputs: yst.Memoize.Inputs,
+			Key:    yst.Memoize.Key,
+		}
+	}
+
+	if yst.Cache != nil {
+		step.Cache = &core.CacheConfig{
+			Key:    yst.Cache.Key,
+			Paths:  yst.Cache.Paths,
+			Policy: yst.Cache.Policy,
+		}
+	}
+
+	return step
+}
+
+// convertMatrix transforms a YAMLMatrix into a core.Matrix.
+func convertMatrix(m *YAMLMatrix) *core.Matrix {
+	if m == nil {
+		return nil
+	}
+	matrix := &core.Matrix{Exclude: m.Exclude, MaxParallel: m.MaxParallel}
+	for _, axis := range m.Axes {
+		matrix.Axes = append(matrix.Axes, core.MatrixAxis{Name: axis.Name, Values: axis.Values})
+	}
+	return matrix
+}
+
+// convertServices transforms YAMLServices into core.Services.
+func convertServices(services []YAMLService) []core.Service {
+	var converted []core.Service
+	for _, ys := range services {
+		service := core.Service{
+			Name:        ys.Name,
+			Image:       ys.Image,
+			Command:     ys.Command,
+			Environment: ys.Environment,
+			Ports:       ys.Ports,
+		}
+		if ys.Health != nil {
+			service.Health = &core.ServiceHealth{
+				Command:  ys.Health.Command,
+				Interval: ys.Health.Interval,
+				Timeout:  ys.Health.Timeout,
+			}
+		}
+		converted = append(converted, service)
+	}
+	return converted
+}
+
+// convertResources transforms YAMLResources into core.ResourceRequirements.
+// Quantities are checked by the validator, so invalid ones are dropped.
+func convertResources(yr *YAMLResources) *core.ResourceRequirements {
+	if yr == nil {
+		return nil
+	}
+	resources := &core.ResourceRequirements{}
+	resources.Requests, _ = core.ParseResources(yr.CPU, yr.Memory)
+	if yr.Limits != nil {
+		resources.Limits, _ = core.ParseResources(yr.Limits.CPU, yr.Limits.Memory)
+	}
+	return resources
+}
+
+// convertNetwork transforms a YAMLNetwork into a core.NetworkPolicy.
+func convertNetwork(yn *YAMLNetwork) *core.NetworkPolicy {
+	if yn == nil {
+		return nil
+	}
+	return &core.NetworkPolicy{Egress: yn.Egress, DefaultDeny: yn.DefaultDeny}
+}
+
+// convertBudget transforms a YAMLBudget into a core.Budget.
+func convertBudget(yb *YAMLBudget) *core.Budget {
+	if yb == nil {
+		return nil
+	}
+	return &core.Budget{MaxDuration: yb.MaxDuration, MaxSteps: yb.MaxSteps, MaxRetriesPerDay: yb.MaxRetriesPerDay}
+}
+
+// convertInfo transforms a YAMLInfo into a core.PipelineInfo.
+func convertInfo(info *YAMLInfo) *core.PipelineInfo {
+	if info == nil {
+		return nil
+	}
+	converted := &core.PipelineInfo{Owner: info.Owner, Runbook: info.Runbook, Links: info.Links}
+	if info.SLO != nil {
+		converted.SLO = &core.PipelineSLO{SuccessRate: info.SLO.SuccessRate, Duration: info.SLO.Duration}
+	}
+	return converted
 }
@@ -2,7 +2,11 @@ package loader
 
 import (
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/chip/conveyor/core"
 )
 
 func TestConvert_MinimalPipeline(t *testing.T) {
@@ -212,4 +216,438 @@ func TestConvert_SecureBuildFixture(t *testing.T) {
 	if pipeline.Cache == nil {
 		t.Error("Cache is nil, want non-nil")
 	}
+	if len(pipeline.Artifacts) != 2 {
+		t.Fatalf("len(Artifacts) = %d, want 2", len(pipeline.Artifacts))
+	}
+	if got := pipeline.Artifacts[1]; got.Name != "build-artifacts" || len(got.Paths) != 2 || got.Retention != "7d" {
+		t.Errorf("Artifacts[1] = %+v, want build-artifacts with 2 paths kept 7d", got)
+	}
+}
+
+func TestConvert_Memoize(t *testing.T) {
+	yp, err := Parse([]byte(`
+name: memo
+stages:
+  - name: build
+    steps:
+      - name: deps
+        run: go mod download
+        memoize: true
+      - name: compile
+        run: go build ./...
+        memoize:
+          inputs: [go.sum, "*.go"]
+          key: v2
+      - name: test
+        run: go test ./...
+        memoize: false
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	pipeline, err := Convert(yp, "memo")
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+
+	steps := pipeline.Stages[0].Steps
+	if steps[0].Memoize == nil || len(steps[0].Memoize.Inputs) != 0 {
+		t.Errorf("deps Memoize = %+v, want enabled without inputs", steps[0].Memoize)
+	}
+	if steps[1].Memoize == nil || len(steps[1].Memoize.Inputs) != 2 || steps[1].Memoize.Key != "v2" {
+		t.Errorf("compile Memoize = %+v, want inputs and key", steps[1].Memoize)
+	}
+	if steps[2].Memoize != nil {
+		t.Errorf("test Memoize = %+v, want nil", steps[2].Memoize)
+	}
+}
+
+func TestConvert_SpeculativeStage(t *testing.T) {
+	yp := &YAMLPipeline{
+		Name: "speculative",
+		Stages: []YAMLStage{
+			{Name: "verify", AllowFailure: true, Steps: []YAMLStep{{Name: "e2e", Run: "make e2e"}}},
+			{
+				Name:        "deploy",
+				Speculative: true,
+				Steps:       []YAMLStep{{Name: "push", Run: "make push"}},
+				Rollback:    []YAMLStep{{Name: "undo", Run: "make undo"}},
+			},
+		},
+	}
+
+	pipeline, err := Convert(yp, "speculative")
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+
+	if !pipeline.Stages[0].AllowFailure {
+		t.Error("verify AllowFailure = false, want true")
+	}
+	deploy := pipeline.Stages[1]
+	if !deploy.Speculative {
+		t.Error("deploy Speculative = false, want true")
+	}
+	if len(deploy.Rollback) != 1 || deploy.Rollback[0].ID != "deploy-rollback-undo" {
+		t.Errorf("deploy Rollback = %+v, want one step with ID deploy-rollback-undo", deploy.Rollback)
+	}
+}
+
+func TestConvert_RunsOn(t *testing.T) {
+	yp, err := Parse([]byte(`
+name: runners
+stages:
+  - name: build
+    runs_on: linux
+    steps:
+      - name: compile
+        run: make
+      - name: package
+        run: make image
+        runs_on: [linux, docker, large]
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if _, err := Validate(yp); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	pipeline, err := Convert(yp, "runners")
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+	stage := pipeline.Stages[0]
+	if !reflect.DeepEqual(stage.RunsOn, []string{"linux"}) {
+		t.Errorf("stage RunsOn = %v, want [linux]", stage.RunsOn)
+	}
+	if stage.Steps[0].RunsOn != nil {
+		t.Errorf("compile RunsOn = %v, want nil", stage.Steps[0].RunsOn)
+	}
+	if !reflect.DeepEqual(stage.Steps[1].RunsOn, []string{"linux", "docker", "large"}) {
+		t.Errorf("package RunsOn = %v, want [linux docker large]", stage.Steps[1].RunsOn)
+	}
+}
+
+func TestConvert_Budget(t *testing.T) {
+	yp, err := Parse([]byte(`
+name: build
+budget:
+  max_duration: 90m
+  max_steps: 40
+  max_retries_per_day: 3
+stages:
+  - name: build
+    steps:
+      - name: compile
+        run: make
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	pipeline, err := Convert(yp, "build")
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+	if want := (&core.Budget{MaxDuration: "90m", MaxSteps: 40, MaxRetriesPerDay: 3}); !reflect.DeepEqual(pipeline.Budget, want) {
+		t.Errorf("Budget = %+v, want %+v", pipeline.Budget, want)
+	}
+}
+
+func TestConvert_Network(t *testing.T) {
+	yp, err := Parse([]byte(`
+name: deps
+network:
+  default_deny: true
+  egress: [10.0.0.0/8]
+stages:
+  - name: build
+    steps:
+      - name: install
+        run: npm ci
+        network:
+          egress: [registry.npmjs.org:443]
+      - name: compile
+        run: make
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if _, err := Validate(yp); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	pipeline, err := Convert(yp, "deps")
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+	if want := (&core.NetworkPolicy{Egress: []string{"10.0.0.0/8"}, DefaultDeny: true}); !reflect.DeepEqual(pipeline.Network, want) {
+		t.Errorf("pipeline Network = %+v, want %+v", pipeline.Network, want)
+	}
+	steps := pipeline.Stages[0].Steps
+	if want := (&core.NetworkPolicy{Egress: []string{"registry.npmjs.org:443"}}); !reflect.DeepEqual(steps[0].Network, want) {
+		t.Errorf("install Network = %+v, want %+v", steps[0].Network, want)
+	}
+	if steps[1].Network != nil {
+		t.Errorf("compile Network = %+v, want nil", steps[1].Network)
+	}
+}
+
+func TestConvert_Workspace(t *testing.T) {
+	yp, err := Parse([]byte(`
+name: web
+workspace:
+  dependencies: [node_modules]
+stages:
+  - name: build
+    steps:
+      - name: install
+        run: npm ci
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	pipeline, err := Convert(yp, "web")
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+	if pipeline.Workspace == nil || !reflect.DeepEqual(pipeline.Workspace.Dependencies, []string{"node_modules"}) {
+		t.Errorf("Workspace = %+v, want node_modules as a dependency", pipeline.Workspace)
+	}
+
+	yp.Workspace = &YAMLWorkspace{Enabled: true, Dependencies: []string{"../outside"}}
+	if _, err := Validate(yp); err == nil {
+		t.Error("Validate() error = nil, want dependency outside the workspace rejected")
+	}
+}
+
+func TestConvert_Services(t *testing.T) {
+	yp, err := Parse([]byte(`
+name: integration
+stages:
+  - name: test
+    services:
+      - name: redis
+        image: redis:7
+        ports: [6379]
+    steps:
+      - name: integration
+        run: go test ./...
+        services:
+          - name: postgres
+            image: postgres:15
+            environment:
+              POSTGRES_PASSWORD: test
+            ports: [5432]
+            health:
+              command: pg_isready -U postgres
+              interval: 2s
+              timeout: 1m
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if _, err := Validate(yp); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	pipeline, err := Convert(yp, "integration")
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+	stage := pipeline.Stages[0]
+	if len(stage.Services) != 1 || stage.Services[0].Name != "redis" || stage.Services[0].Ports[0] != 6379 {
+		t.Errorf("stage Services = %+v, want redis on 6379", stage.Services)
+	}
+	services := stage.Steps[0].Services
+	if len(services) != 1 || services[0].Health == nil || services[0].Health.Command != "pg_isready -U postgres" ||
+		services[0].Environment["POSTGRES_PASSWORD"] != "test" {
+		t.Errorf("step Services = %+v, want postgres with a health command", services)
+	}
+
+	yp.Stages[0].Services = append(yp.Stages[0].Services, YAMLService{Name: "Redis_2"}, YAMLService{Name: "redis", Image: "redis:7"})
+	_, err = Validate(yp)
+	if err == nil {
+		t.Fatal("Validate() error = nil, want service errors")
+	}
+	for _, want := range []string{"must be a lowercase hostname", "image is required", "duplicate name"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %v, want it to mention %q", err, want)
+		}
+	}
+}
+
+func TestConvert_Resources(t *testing.T) {
+	yp, err := Parse([]byte(`
+name: heavy
+stages:
+  - name: build
+    steps:
+      - name: compile
+        run: make
+        resources:
+          cpu: 500m
+          memory: 512Mi
+          limits:
+            cpu: 2
+            memory: 1Gi
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if _, err := Validate(yp); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	pipeline, err := Convert(yp, "heavy")
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+	want := &core.ResourceRequirements{
+		Requests: core.Resources{CPU: 0.5, Memory: 512 << 20},
+		Limits:   core.Resources{CPU: 2, Memory: 1 << 30},
+	}
+	if got := pipeline.Stages[0].Steps[0].Resources; !reflect.DeepEqual(got, want) {
+		t.Errorf("Resources = %+v, want %+v", got, want)
+	}
+
+	yp.Stages[0].Steps[0].Resources = &YAMLResources{CPU: "4", Memory: "lots", Limits: &YAMLResourceLimit{CPU: "2"}}
+	_, err = Validate(yp)
+	if err == nil {
+		t.Fatal("Validate() error = nil, want resource errors")
+	}
+	for _, want := range []string{`invalid memory quantity "lots"`, "cpu request 4 exceeds limit 2"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %v, want it to mention %q", err, want)
+		}
+	}
+}
+
+func TestConvert_Team(t *testing.T) {
+	yp, err := Parse([]byte(`
+name: train
+team: ml
+stages:
+  - name: fit
+    steps:
+      - name: fit
+        run: python fit.py
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	pipeline, err := Convert(yp, "train")
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+	if pipeline.Team != "ml" {
+		t.Errorf("Team = %q, want ml", pipeline.Team)
+	}
+}
+
+func TestConvert_FailureHandling(t *testing.T) {
+	yp, err := Parse([]byte(`
+name: tests
+stages:
+  - name: test
+    steps:
+      - name: unit
+        run: make test
+        exit_codes:
+          2: warning
+          77: Skipped
+        failures:
+          - class: infrastructure
+            exit_codes: [137]
+            pattern: "connection reset"
+          - class: test
+            pattern: "^--- FAIL"
+        retry:
+          max_attempts: 3
+          on: [infrastructure]
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if _, err := Validate(yp); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	pipeline, err := Convert(yp, "tests")
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+	step := pipeline.Stages[0].Steps[0]
+	if want := map[int]core.Status{2: core.StatusWarning, 77: core.StatusSkipped}; !reflect.DeepEqual(step.ExitCodes, want) {
+		t.Errorf("ExitCodes = %v, want %v", step.ExitCodes, want)
+	}
+	want := []core.FailureRule{
+		{Class: "infrastructure", ExitCodes: []int{137}, Pattern: "connection reset"},
+		{Class: "test", Pattern: "^--- FAIL"},
+	}
+	if !reflect.DeepEqual(step.Failures, want) {
+		t.Errorf("Failures = %+v, want %+v", step.Failures, want)
+	}
+	if !reflect.DeepEqual(step.Retry.On, []string{"infrastructure"}) {
+		t.Errorf("Retry.On = %v, want infrastructure", step.Retry.On)
+	}
+
+	yp.Stages[0].Steps[0].ExitCodes = map[int]string{3: "flaky"}
+	yp.Stages[0].Steps[0].Failures = []YAMLFailure{{Class: "test", Pattern: "("}, {Class: "compile"}}
+	_, err = Validate(yp)
+	if err == nil {
+		t.Fatal("Validate() error = nil, want failure handling errors")
+	}
+	for _, want := range []string{`exit code 3: status must be`, "invalid pattern", "failure rule compile requires exit codes or a pattern"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %v, want it to mention %q", err, want)
+		}
+	}
+}
+
+func TestConvert_Matrix(t *testing.T) {
+	yp, err := Parse([]byte(`
+name: matrix
+stages:
+  - name: test
+    matrix:
+      os: [linux, windows]
+    steps:
+      - name: unit
+        run: go test ./...
+        matrix:
+          go: [1.20, "1.21"]
+          exclude:
+            - {os: windows, go: 1.20}
+          max_parallel: 2
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if _, err := Validate(yp); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	pipeline, err := Convert(yp, "matrix")
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+	if want := (&core.Matrix{Axes: []core.MatrixAxis{{Name: "os", Values: []string{"linux", "windows"}}}}); !reflect.DeepEqual(pipeline.Stages[0].Matrix, want) {
+		t.Errorf("stage Matrix = %+v, want %+v", pipeline.Stages[0].Matrix, want)
+	}
+	want := &core.Matrix{
+		Axes:        []core.MatrixAxis{{Name: "go", Values: []string{"1.20", "1.21"}}},
+		Exclude:     []map[string]string{{"os": "windows", "go": "1.20"}},
+		MaxParallel: 2,
+	}
+	if !reflect.DeepEqual(pipeline.Stages[0].Steps[0].Matrix, want) {
+		t.Errorf("step Matrix = %+v, want %+v", pipeline.Stages[0].Steps[0].Matrix, want)
+	}
+
+	yp.Stages[0].Steps[0].Matrix.Axes[0].Values = nil
+	if _, err := Validate(yp); err == nil || !strings.Contains(err.Error(), `step "unit": matrix axis go has no values`) {
+		t.Errorf("Validate() error = %v, want an axis without values", err)
+	}
 }
@@ -0,0 +1,569 @@
+package loader
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Project kinds, detected by their marker files.
+const (
+	KindGo     = "go"
+	KindNode   = "node"
+	KindMaven  = "maven"
+	KindDocker = "docker"
+)
+
+// projectMarkers lists the files that identify a project, in the order the
+// kind of a directory with several of them is picked.
+var projectMarkers = []struct {
+	kind string
+	file string
+}{
+	{KindGo, "go.mod"},
+	{KindNode, "package.json"},
+	{KindMaven, "pom.xml"},
+	{KindDocker, "Dockerfile"},
+}
+
+// skippedDirs are never scanned for projects.
+var skippedDirs = map[string]bool{
+	"node_modules": true,
+	"vendor":       true,
+	"target":       true,
+	"dist":         true,
+	"build":        true,
+	"testdata":     true,
+}
+
+// States of generated pipeline files in a discovery report.
+const (
+	// GeneratedCreated means the file was written for a new project.
+	GeneratedCreated = "created"
+	// GeneratedUpdated means the file was regenerated from a changed template.
+	GeneratedUpdated = "updated"
+	// GeneratedUnchanged means the file matches its template.
+	GeneratedUnchanged = "unchanged"
+	// GeneratedEdited means the file was edited by hand and is left alone.
+	GeneratedEdited = "edited"
+	// GeneratedRemoved means the project is gone and its file was deleted.
+	GeneratedRemoved = "removed"
+	// GeneratedOrphaned means the project is gone but its file was edited
+	// by hand, so it is kept.
+	GeneratedOrphaned = "orphaned"
+	// GeneratedConflict means another file has the name of the project's
+	// pipeline file.
+	GeneratedConflict = "conflict"
+	// GeneratedInvalid means the template rendered an invalid pipeline.
+	GeneratedInvalid = "invalid"
+)
+
+// generatedMarker starts the header line that marks a generated file.
+const generatedMarker = "# conveyor-generated:"
+
+// Project is a buildable project found in a repository.
+type Project struct {
+	// Path is the project directory relative to the repository root, with
+	// forward slashes. The root itself is ".".
+	Path string `json:"path"`
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// Markers are the marker files found in the directory.
+	Markers    []string `json:"markers"`
+	Dockerfile bool     `json:"dockerfile"`
+	// PipelineID is the ID of the project's generated pipeline.
+	PipelineID string `json:"pipelineId"`
+}
+
+// GeneratedPipeline is the state of a project's generated pipeline file.
+type GeneratedPipeline struct {
+	PipelineID string `json:"pipelineId"`
+	File       string `json:"file"`
+	Project    string `json:"project"`
+	Kind       string `json:"kind,omitempty"`
+	State      string `json:"state"`
+	Error      string `json:"error,omitempty"`
+}
+
+// DiscoveryReport describes the last discovery: the projects found, the
+// state of every generated pipeline file and the pipeline files written by
+// hand.
+type DiscoveryReport struct {
+	Root      string              `json:"root"`
+	LastRun   time.Time           `json:"lastRun"`
+	Projects  []Project           `json:"projects"`
+	Generated []GeneratedPipeline `json:"generated"`
+	Manual    []string            `json:"manual"`
+	Error     string              `json:"error,omitempty"`
+}
+
+// DiscoveryOptions configures a Discoverer.
+type DiscoveryOptions struct {
+	// Root is the repository scanned for projects.
+	Root string
+	// Dir is the pipelines directory generated files are written to.
+	Dir string
+	// Templates maps project kinds to template files that replace the
+	// built-in templates.
+	Templates map[string]string
+	// Exclude lists globs of project paths, relative to Root, that are not
+	// scanned.
+	Exclude []string
+}
+
+// Discoverer generates a pipeline for every project found in a monorepo
+// and keeps the generated files in sync as projects are added and removed.
+// Generated files carry a header with the hash of their content; files
+// edited by hand no longer match it and are left alone.
+type Discoverer struct {
+	opts      DiscoveryOptions
+	templates map[string]*template.Template
+
+	runMu  sync.Mutex
+	mu     sync.RWMutex
+	report DiscoveryReport
+}
+
+// NewDiscoverer creates a Discoverer, reading the configured templates.
+func NewDiscoverer(opts DiscoveryOptions) (*Discoverer, error) {
+	d := &Discoverer{
+		opts:      opts,
+		templates: make(map[string]*template.Template),
+		report:    DiscoveryReport{Root: opts.Root},
+	}
+	for kind, text := range builtinTemplates {
+		d.templates[kind] = template.Must(newTemplate(kind).Parse(text))
+	}
+	for kind, file := range opts.Templates {
+		if _, ok := builtinTemplates[kind]; !ok {
+			return nil, fmt.Errorf("template for unknown project kind %q", kind)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s template: %w", kind, err)
+		}
+		tmpl, err := newTemplate(kind).Parse(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s template: %w", kind, err)
+		}
+		d.templates[kind] = tmpl
+	}
+	for _, pattern := range opts.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+	}
+	return d, nil
+}
+
+// newTemplate creates a template with the functions templates can use.
+func newTemplate(kind string) *template.Template {
+	return template.New(kind).Option("missingkey=error").Funcs(template.FuncMap{
+		"quote": strconv.Quote,
+	})
+}
+
+// Report returns the result of the last discovery.
+func (d *Discoverer) Report() DiscoveryReport {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	report := d.report
+	report.Projects = append([]Project(nil), d.report.Projects...)
+	report.Generated = append([]GeneratedPipeline(nil), d.report.Generated...)
+	report.Manual = append([]string(nil), d.report.Manual...)
+	return report
+}
+
+// Discover scans the repository for projects and creates, updates and
+// removes their generated pipeline files.
+func (d *Discoverer) Discover() (*DiscoveryReport, error) {
+	d.runMu.Lock()
+	defer d.runMu.Unlock()
+
+	report, err := d.discover()
+	if err != nil {
+		report = &DiscoveryReport{Error: err.Error()}
+	}
+	report.Root = d.opts.Root
+	report.LastRun = time.Now()
+
+	d.mu.Lock()
+	d.report = *report
+	d.mu.Unlock()
+	return report, err
+}
+
+func (d *Discoverer) discover() (*DiscoveryReport, error) {
+	projects, err := d.findProjects()
+	if err != nil {
+		return nil, err
+	}
+	existing, err := readPipelineFiles(d.opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(d.opts.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create pipelines directory: %w", err)
+	}
+
+	report := &DiscoveryReport{Projects: projects}
+	claimed := make(map[string]bool)
+	for _, project := range projects {
+		generated := d.generate(project, existing, claimed)
+		report.Generated = append(report.Generated, generated)
+		if generated.State != GeneratedConflict {
+			claimed[generated.File] = true
+		}
+	}
+
+	// Generated files of projects that are gone
+	for name, file := range existing {
+		if claimed[name] {
+			continue
+		}
+		if file.project == "" {
+			report.Manual = append(report.Manual, name)
+			continue
+		}
+		generated := GeneratedPipeline{
+			PipelineID: strings.TrimSuffix(name, filepath.Ext(name)),
+			File:       name,
+			Project:    file.project,
+			Kind:       file.kind,
+			State:      GeneratedOrphaned,
+		}
+		if !file.edited {
+			if err := os.Remove(filepath.Join(d.opts.Dir, name)); err != nil {
+				generated.Error = err.Error()
+			} else {
+				generated.State = GeneratedRemoved
+				log.Printf("Removed generated pipeline %s: project %s no longer exists", name, file.project)
+			}
+		}
+		report.Generated = append(report.Generated, generated)
+	}
+
+	sort.Strings(report.Manual)
+	sort.Slice(report.Generated, func(i, j int) bool {
+		return report.Generated[i].File < report.Generated[j].File
+	})
+	return report, nil
+}
+
+// generate renders a project's pipeline and writes it unless its file was
+// edited by hand or belongs to something else.
+func (d *Discoverer) generate(project Project, existing map[string]*pipelineFile, claimed map[string]bool) GeneratedPipeline {
+	name := project.PipelineID + ".yaml"
+	generated := GeneratedPipeline{PipelineID: project.PipelineID, File: name, Project: project.Path, Kind: project.Kind}
+
+	current, exists := existing[name]
+	switch {
+	case claimed[name]:
+		generated.State = GeneratedConflict
+		generated.Error = "another project generates a pipeline with the same ID"
+		return generated
+	case exists && current.project != project.Path:
+		generated.State = GeneratedConflict
+		generated.Error = fmt.Sprintf("%s is not generated for this project", name)
+		return generated
+	case exists && current.edited:
+		generated.State = GeneratedEdited
+		return generated
+	}
+
+	body, err := d.render(project)
+	if err == nil {
+		_, _, err = BuildPipeline(body, project.PipelineID)
+	}
+	if err != nil {
+		generated.State = GeneratedInvalid
+		generated.Error = err.Error()
+		return generated
+	}
+
+	content := generatedContent(project, body)
+	if exists && bytes.Equal(current.data, content) {
+		generated.State = GeneratedUnchanged
+		return generated
+	}
+	if err := os.WriteFile(filepath.Join(d.opts.Dir, name), content, 0644); err != nil {
+		generated.State = GeneratedInvalid
+		generated.Error = err.Error()
+		return generated
+	}
+	generated.State = GeneratedCreated
+	if exists {
+		generated.State = GeneratedUpdated
+	}
+	log.Printf("Generated pipeline %s for %s project %s", name, project.Kind, project.Path)
+	return generated
+}
+
+// templateData is what pipeline templates are rendered with.
+type templateData struct {
+	Project
+	// Paths is the trigger path glob of the project's files.
+	Paths string
+}
+
+// render renders the template of a project's kind.
+func (d *Discoverer) render(project Project) ([]byte, error) {
+	data := templateData{Project: project, Paths: project.Path + "/**"}
+	if project.Path == "." {
+		data.Paths = "**"
+	}
+	var buf bytes.Buffer
+	if err := d.templates[project.Kind].Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render %s template: %w", project.Kind, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// generatedContent adds the generated header to a rendered pipeline.
+func generatedContent(project Project, body []byte) []byte {
+	header := fmt.Sprintf("# Generated by project discovery for %s. Edits stop discovery from\n"+
+		"# updating this file; delete it to have it generated again.\n"+
+		"%s project=%s kind=%s sha256=%s\n",
+		project.Path, generatedMarker, project.Path, project.Kind, hashBytes(body))
+	return append([]byte(header), body...)
+}
+
+// pipelineFile is a file in the pipelines directory.
+type pipelineFile struct {
+	data []byte
+	// project and kind are set for generated files
+	project string
+	kind    string
+	// edited is set for generated files whose content no longer matches
+	// their header
+	edited bool
+}
+
+// readPipelineFiles reads the pipeline files in dir and their generated
+// headers.
+func readPipelineFiles(dir string) (map[string]*pipelineFile, error) {
+	files := make(map[string]*pipelineFile)
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("failed to glob %s: %w", pattern, err)
+		}
+		for _, match := range matches {
+			data, err := os.ReadFile(match)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", match, err)
+			}
+			files[filepath.Base(match)] = parseGenerated(data)
+		}
+	}
+	return files, nil
+}
+
+// parseGenerated reads the generated header of a pipeline file, if it has
+// one.
+func parseGenerated(data []byte) *pipelineFile {
+	file := &pipelineFile{data: data}
+	offset := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		offset += len(line) + 1
+		if !strings.HasPrefix(line, "#") {
+			return file
+		}
+		if !strings.HasPrefix(line, generatedMarker) {
+			continue
+		}
+		hash := ""
+		for _, field := range strings.Fields(strings.TrimPrefix(line, generatedMarker)) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "project":
+				file.project = kv[1]
+			case "kind":
+				file.kind = kv[1]
+			case "sha256":
+				hash = kv[1]
+			}
+		}
+		if offset > len(data) {
+			offset = len(data)
+		}
+		file.edited = hashBytes(data[offset:]) != hash
+		return file
+	}
+	return file
+}
+
+// findProjects walks the repository for directories with marker files.
+// Directories inside a Maven project are its modules rather than projects
+// of their own.
+func (d *Discoverer) findProjects() ([]Project, error) {
+	root, err := filepath.Abs(d.opts.Root)
+	if err != nil {
+		return nil, err
+	}
+	pipelinesDir, _ := filepath.Abs(d.opts.Dir)
+
+	var projects []Project
+	var mavenRoots []string
+	err = filepath.Walk(root, func(dir string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if dir != root && (strings.HasPrefix(info.Name(), ".") || skippedDirs[info.Name()] || dir == pipelinesDir || d.excluded(rel)) {
+			return filepath.SkipDir
+		}
+
+		project := Project{Path: rel}
+		for _, marker := range projectMarkers {
+			if _, err := os.Stat(filepath.Join(dir, marker.file)); err != nil {
+				continue
+			}
+			project.Markers = append(project.Markers, marker.file)
+			if project.Kind == "" {
+				project.Kind = marker.kind
+			}
+			if marker.kind == KindDocker {
+				project.Dockerfile = true
+			}
+		}
+		if project.Kind == "" || insideAny(rel, mavenRoots) && project.Kind == KindMaven {
+			return nil
+		}
+		if project.Kind == KindMaven {
+			mavenRoots = append(mavenRoots, rel)
+		}
+
+		project.Name = rel
+		if rel == "." {
+			project.Name = filepath.Base(root)
+		}
+		project.PipelineID = Slugify(strings.Replace(project.Name, "/", "-", -1))
+		projects = append(projects, project)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", d.opts.Root, err)
+	}
+	return projects, nil
+}
+
+// excluded reports whether a project path matches an exclude pattern.
+func (d *Discoverer) excluded(rel string) bool {
+	for _, pattern := range d.opts.Exclude {
+		if matched, _ := path.Match(pattern, rel); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// insideAny reports whether rel is below one of the directories.
+func insideAny(rel string, dirs []string) bool {
+	for _, dir := range dirs {
+		if dir == "." || strings.HasPrefix(rel, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// builtinTemplates are the pipeline templates of each project kind. They
+// are rendered with a Project, and Paths, the project's trigger glob.
+var builtinTemplates = map[string]string{
+	KindGo: `name: {{quote .Name}}
+description: Go module in {{.Path}}
+triggers:
+  - type: push
+    paths: [{{quote .Paths}}]
+stages:
+  - name: test
+    steps:
+      - name: vet
+        run: cd {{quote .Path}} && go vet ./...
+      - name: test
+        run: cd {{quote .Path}} && go test ./...
+  - name: build
+    needs: [test]
+    steps:
+      - name: build
+        run: cd {{quote .Path}} && go build ./...
+{{- if .Dockerfile}}
+      - name: image
+        run: cd {{quote .Path}} && docker build -t {{.PipelineID}} .
+{{- end}}
+`,
+	KindNode: `name: {{quote .Name}}
+description: Node.js package in {{.Path}}
+triggers:
+  - type: push
+    paths: [{{quote .Paths}}]
+stages:
+  - name: test
+    steps:
+      - name: install
+        run: cd {{quote .Path}} && npm ci
+      - name: test
+        run: cd {{quote .Path}} && npm test
+  - name: build
+    needs: [test]
+    steps:
+      - name: build
+        run: cd {{quote .Path}} && npm run build --if-present
+{{- if .Dockerfile}}
+      - name: image
+        run: cd {{quote .Path}} && docker build -t {{.PipelineID}} .
+{{- end}}
+`,
+	KindMaven: `name: {{quote .Name}}
+description: Maven project in {{.Path}}
+triggers:
+  - type: push
+    paths: [{{quote .Paths}}]
+stages:
+  - name: test
+    steps:
+      - name: verify
+        run: cd {{quote .Path}} && mvn --batch-mode verify
+{{- if .Dockerfile}}
+  - name: build
+    needs: [test]
+    steps:
+      - name: image
+        run: cd {{quote .Path}} && docker build -t {{.PipelineID}} .
+{{- end}}
+`,
+	KindDocker: `name: {{quote .Name}}
+description: Docker image built from {{.Path}}
+triggers:
+  - type: push
+    paths: [{{quote .Paths}}]
+stages:
+  - name: build
+    steps:
+      - name: image
+        run: cd {{quote .Path}} && docker build -t {{.PipelineID}} .
+`,
+}
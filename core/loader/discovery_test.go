@@ -0,0 +1,176 @@
+package loader
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func discover(t *testing.T, d *Discoverer) map[string]GeneratedPipeline {
+	t.Helper()
+	report, err := d.Discover()
+	if err != nil {
+		t.Fatalf("Discover() error = %v", err)
+	}
+	generated := make(map[string]GeneratedPipeline)
+	for _, g := range report.Generated {
+		generated[g.PipelineID] = g
+	}
+	return generated
+}
+
+func TestDiscoverer_GeneratesPipelines(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "pipelines")
+	writeFile(t, filepath.Join(root, "services", "api", "go.mod"), "module example.com/api\n")
+	writeFile(t, filepath.Join(root, "services", "api", "Dockerfile"), "FROM scratch\n")
+	writeFile(t, filepath.Join(root, "web", "package.json"), "{}\n")
+	writeFile(t, filepath.Join(root, "web", "node_modules", "left-pad", "package.json"), "{}\n")
+	writeFile(t, filepath.Join(root, "java", "pom.xml"), "<project/>\n")
+	writeFile(t, filepath.Join(root, "java", "core", "pom.xml"), "<project/>\n")
+	writeFile(t, filepath.Join(root, "tools", "legacy", "go.mod"), "module legacy\n")
+	writeFile(t, filepath.Join(dir, "nightly.yaml"), "name: nightly\n")
+
+	d, err := NewDiscoverer(DiscoveryOptions{Root: root, Dir: dir, Exclude: []string{"tools/*"}})
+	if err != nil {
+		t.Fatalf("NewDiscoverer() error = %v", err)
+	}
+	generated := discover(t, d)
+
+	if len(generated) != 3 {
+		t.Fatalf("generated = %+v, want services-api, web and java", generated)
+	}
+	for _, id := range []string{"services-api", "web", "java"} {
+		if generated[id].State != GeneratedCreated {
+			t.Errorf("%s state = %q, want %q", id, generated[id].State, GeneratedCreated)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "services-api.yaml"))
+	if err != nil {
+		t.Fatalf("generated file not written: %v", err)
+	}
+	pipeline, _, err := BuildPipeline(data, "services-api")
+	if err != nil {
+		t.Fatalf("generated pipeline is invalid: %v", err)
+	}
+	if pipeline.Name != "services/api" || len(pipeline.Stages) != 2 || len(pipeline.Stages[1].Steps) != 2 {
+		t.Errorf("pipeline = %+v, want test and build stages with a docker image step", pipeline)
+	}
+	if got := pipeline.Stages[0].Steps[1].Command; got != `cd "services/api" && go test ./...` {
+		t.Errorf("test command = %q, want it to run in the project", got)
+	}
+
+	report := d.Report()
+	if len(report.Manual) != 1 || report.Manual[0] != "nightly.yaml" {
+		t.Errorf("Manual = %v, want nightly.yaml", report.Manual)
+	}
+
+	// A second run leaves the files alone
+	if generated := discover(t, d); generated["web"].State != GeneratedUnchanged {
+		t.Errorf("web state = %q, want %q", generated["web"].State, GeneratedUnchanged)
+	}
+}
+
+func TestDiscoverer_KeepsEditedFiles(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "pipelines")
+	writeFile(t, filepath.Join(root, "api", "go.mod"), "module api\n")
+	writeFile(t, filepath.Join(root, "worker", "go.mod"), "module worker\n")
+	writeFile(t, filepath.Join(root, "web", "package.json"), "{}\n")
+
+	d, err := NewDiscoverer(DiscoveryOptions{Root: root, Dir: dir})
+	if err != nil {
+		t.Fatalf("NewDiscoverer() error = %v", err)
+	}
+	discover(t, d)
+
+	// Edit the api pipeline by hand, then remove the api and worker projects
+	apiFile := filepath.Join(dir, "api.yaml")
+	data, _ := os.ReadFile(apiFile)
+	edited := strings.Replace(string(data), "go test ./...", "go test -race ./...", 1)
+	writeFile(t, apiFile, edited)
+	if generated := discover(t, d); generated["api"].State != GeneratedEdited {
+		t.Errorf("api state = %q, want %q", generated["api"].State, GeneratedEdited)
+	}
+
+	os.RemoveAll(filepath.Join(root, "api"))
+	os.RemoveAll(filepath.Join(root, "worker"))
+	generated := discover(t, d)
+	if generated["api"].State != GeneratedOrphaned || generated["worker"].State != GeneratedRemoved {
+		t.Errorf("generated = %+v, want api orphaned and worker removed", generated)
+	}
+	if data, _ := os.ReadFile(apiFile); string(data) != edited {
+		t.Error("edited api.yaml was changed, want it kept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "worker.yaml")); !os.IsNotExist(err) {
+		t.Errorf("worker.yaml still exists, want it removed")
+	}
+}
+
+func TestDiscoverer_TemplatesAndConflicts(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "pipelines")
+	writeFile(t, filepath.Join(root, "app", "package.json"), "{}\n")
+	writeFile(t, filepath.Join(root, "site", "package.json"), "{}\n")
+	writeFile(t, filepath.Join(dir, "site.yaml"), "name: site\n")
+	template := filepath.Join(root, "node.tmpl")
+	writeFile(t, template, `name: {{quote .Name}}
+stages:
+  - name: test
+    steps:
+      - name: test
+        run: cd {{quote .Path}} && yarn test
+`)
+
+	if _, err := NewDiscoverer(DiscoveryOptions{Root: root, Dir: dir, Templates: map[string]string{"rust": template}}); err == nil {
+		t.Error("NewDiscoverer() expected error for an unknown kind, got nil")
+	}
+	d, err := NewDiscoverer(DiscoveryOptions{Root: root, Dir: dir, Templates: map[string]string{KindNode: template}})
+	if err != nil {
+		t.Fatalf("NewDiscoverer() error = %v", err)
+	}
+	generated := discover(t, d)
+
+	if generated["site"].State != GeneratedConflict {
+		t.Errorf("site state = %q, want %q for a manual file with its name", generated["site"].State, GeneratedConflict)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "app.yaml"))
+	if !strings.Contains(string(data), "yarn test") {
+		t.Errorf("app.yaml = %q, want the custom template", data)
+	}
+}
+
+func TestWatcher_DiscoversProjects(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "pipelines")
+	writeFile(t, filepath.Join(root, "api", "go.mod"), "module api\n")
+
+	d, err := NewDiscoverer(DiscoveryOptions{Root: root, Dir: dir})
+	if err != nil {
+		t.Fatalf("NewDiscoverer() error = %v", err)
+	}
+	engine := newTestEngine()
+	w := NewWatcher(engine, dir, WatchOptions{Discoverer: d})
+	syncWatcher(t, w)
+	if _, err := engine.GetPipeline("api"); err != nil {
+		t.Fatalf("generated pipeline not applied: %v", err)
+	}
+
+	os.RemoveAll(filepath.Join(root, "api"))
+	syncWatcher(t, w)
+	if _, err := engine.GetPipeline("api"); err == nil {
+		t.Error("pipeline of the removed project still exists")
+	}
+}
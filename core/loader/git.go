@@ -0,0 +1,58 @@
+package loader
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitSource keeps a local clone of a pipeline repository up to date.
+type gitSource struct {
+	repo   string
+	branch string
+	dir    string
+}
+
+// pull clones the repository if needed, resets the clone to the latest
+// remote commit and returns its revision.
+func (g *gitSource) pull() (string, error) {
+	if _, err := os.Stat(filepath.Join(g.dir, ".git")); os.IsNotExist(err) {
+		args := []string{"clone", "--depth", "1"}
+		if g.branch != "" {
+			args = append(args, "--branch", g.branch)
+		}
+		if _, err := runGit("", append(args, g.repo, g.dir)...); err != nil {
+			return "", err
+		}
+	} else {
+		ref := "HEAD"
+		if g.branch != "" {
+			ref = g.branch
+		}
+		if _, err := runGit(g.dir, "fetch", "--depth", "1", "origin", ref); err != nil {
+			return "", err
+		}
+		if _, err := runGit(g.dir, "reset", "--hard", "FETCH_HEAD"); err != nil {
+			return "", err
+		}
+	}
+
+	return runGit(g.dir, "rev-parse", "HEAD")
+}
+
+// runGit runs a git command and returns its trimmed output.
+func runGit(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s failed: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -91,6 +91,21 @@ func (l *PipelineLoader) LoadFromBytes(data []byte, id string) (*core.Pipeline,
 }
 
 func (l *PipelineLoader) loadPipeline(data []byte, id string) (*core.Pipeline, []string, error) {
+	pipeline, warnings, err := BuildPipeline(data, id)
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	if err := l.engine.CreatePipeline(pipeline); err != nil {
+		return nil, warnings, fmt.Errorf("failed to register pipeline: %w", err)
+	}
+
+	return pipeline, warnings, nil
+}
+
+// BuildPipeline parses, validates and converts YAML into a pipeline without
+// registering it with an engine.
+func BuildPipeline(data []byte, id string) (*core.Pipeline, []string, error) {
 	yp, err := Parse(data)
 	if err != nil {
 		return nil, nil, fmt.Errorf("YAML parse error: %w", err)
@@ -106,9 +121,5 @@ func (l *PipelineLoader) loadPipeline(data []byte, id string) (*core.Pipeline, [
 		return nil, warnings, fmt.Errorf("conversion error: %w", err)
 	}
 
-	if err := l.engine.CreatePipeline(pipeline); err != nil {
-		return nil, warnings, fmt.Errorf("failed to register pipeline: %w", err)
-	}
-
 	return pipeline, warnings, nil
 }
@@ -46,8 +46,8 @@ func TestLoadFile_SecureBuild(t *testing.T) {
 	if err != nil {
 		t.Fatalf("LoadFile() error = %v", err)
 	}
-	if len(warnings) != 3 {
-		t.Errorf("len(warnings) = %d, want 3, got %v", len(warnings), warnings)
+	if len(warnings) != 2 {
+		t.Errorf("len(warnings) = %d, want 2, got %v", len(warnings), warnings)
 	}
 	if len(pipeline.Stages) != 6 {
 		t.Errorf("len(Stages) = %d, want 6", len(pipeline.Stages))
@@ -1,5 +1,11 @@
 package loader
 
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
 // YAMLPipeline is the top-level YAML pipeline representation.
 type YAMLPipeline struct {
 	Name          string            `yaml:"name"`
@@ -10,7 +16,66 @@ type YAMLPipeline struct {
 	Cache         *YAMLCache        `yaml:"cache"`
 	Stages        []YAMLStage       `yaml:"stages"`
 	Notifications interface{}       `yaml:"notifications"`
-	Artifacts     interface{}       `yaml:"artifacts"`
+	Artifacts     []YAMLArtifact    `yaml:"artifacts"`
+	// ArtifactRetention is the default retention of the pipeline's artifacts.
+	ArtifactRetention *YAMLRetention `yaml:"artifact_retention"`
+	// ConcurrencyGroup allows one running job at a time per group, and
+	// CancelInProgress supersedes the running job when a newer one starts.
+	ConcurrencyGroup string `yaml:"concurrency_group"`
+	CancelInProgress bool   `yaml:"cancel_in_progress"`
+	// Workspace keeps the workspace warm between jobs.
+	Workspace *YAMLWorkspace `yaml:"workspace"`
+	// Team owns the pipeline in cost reports.
+	Team string `yaml:"team"`
+	// Release names the promoted release the pipeline deploys.
+	Release string `yaml:"release"`
+	// DebugOnFailure keeps a failed step's environment alive for debugging,
+	// as a duration such as "30m".
+	DebugOnFailure string `yaml:"debug_on_failure"`
+	// Redact lists regular expressions whose matches are masked in the
+	// logs, outputs and events of the pipeline's jobs.
+	Redact []string `yaml:"redact"`
+	// DiskQuota is the most disk each job may use, such as "20Gi".
+	DiskQuota string `yaml:"disk_quota"`
+	// Budget limits the duration, steps and retries of each job.
+	Budget *YAMLBudget `yaml:"budget"`
+	// Network is the egress allowed to steps with a network policy, and
+	// with default_deny, to every step.
+	Network *YAMLNetwork `yaml:"network"`
+	// Readme documents the pipeline in Markdown, and Info tells on-call
+	// engineers who owns it and where its runbook is.
+	Readme string    `yaml:"readme"`
+	Info   *YAMLInfo `yaml:"info"`
+}
+
+// YAMLBudget limits how long a job runs, such as "2h", how many steps it
+// runs and how often the pipeline's jobs are retried in 24 hours.
+type YAMLBudget struct {
+	MaxDuration      string `yaml:"max_duration"`
+	MaxSteps         int    `yaml:"max_steps"`
+	MaxRetriesPerDay int    `yaml:"max_retries_per_day"`
+}
+
+// YAMLInfo is a pipeline's owner, runbook, SLO and other links.
+type YAMLInfo struct {
+	Owner   string            `yaml:"owner"`
+	Runbook string            `yaml:"runbook"`
+	SLO     *YAMLSLO          `yaml:"slo"`
+	Links   map[string]string `yaml:"links"`
+}
+
+// YAMLSLO is the percentage of jobs that should succeed and how long they
+// should take at most.
+type YAMLSLO struct {
+	SuccessRate float64 `yaml:"success_rate"`
+	Duration    string  `yaml:"duration"`
+}
+
+// YAMLNetwork restricts outbound connections to the host names,
+// "*.example.com" wildcards, IP addresses and CIDRs listed in egress.
+type YAMLNetwork struct {
+	Egress      []string `yaml:"egress"`
+	DefaultDeny bool     `yaml:"default_deny"`
 }
 
 // YAMLEnvironment holds environment variable configuration.
@@ -24,6 +89,21 @@ type YAMLTrigger struct {
 	Branches []string `yaml:"branches"`
 	Events   []string `yaml:"events"`
 	Paths    []string `yaml:"paths"`
+	// Cron is when a schedule trigger runs the pipeline.
+	Cron string `yaml:"cron"`
+	// Timezone is the IANA time zone Cron is read in, such as
+	// "America/Chicago".
+	Timezone string `yaml:"timezone"`
+	// Pipeline is the pipeline whose successful jobs start this one with a
+	// pipeline-completed trigger. Labels are trigger values those jobs
+	// must have, as in `env: staging`.
+	Pipeline string            `yaml:"pipeline"`
+	Labels   map[string]string `yaml:"labels"`
+	// Debounce collapses the webhook runs for a branch within this window,
+	// such as "30s", into one for the latest commit. MaxDelay bounds how
+	// long the first of them waits.
+	Debounce string `yaml:"debounce"`
+	MaxDelay string `yaml:"max_delay"`
 }
 
 // YAMLCache represents cache configuration.
@@ -39,6 +119,26 @@ type YAMLStage struct {
 	Needs []string   `yaml:"needs"`
 	When  *YAMLWhen  `yaml:"when"`
 	Steps []YAMLStep `yaml:"steps"`
+	// AllowFailure lets the pipeline continue when the stage fails.
+	AllowFailure bool `yaml:"allow_failure"`
+	// Speculative starts the stage while the preceding allow_failure stage
+	// is still running. Rollback steps undo its work if that stage fails.
+	Speculative bool       `yaml:"speculative"`
+	Rollback    []YAMLStep `yaml:"rollback"`
+	// RunsOn selects the runners of the stage's steps by label.
+	RunsOn YAMLLabels `yaml:"runs_on"`
+	// Services run for the duration of the stage.
+	Services []YAMLService `yaml:"services"`
+	// Deploy names the environment the stage deploys to. Incidents freeze
+	// deploys to their environments.
+	Deploy string `yaml:"deploy"`
+	// Parallel runs the stage's steps concurrently, at most MaxParallel
+	// at a time when it is set.
+	Parallel    bool `yaml:"parallel"`
+	MaxParallel int  `yaml:"max_parallel"`
+	// Matrix expands each step of the stage into a step per combination
+	// of its values.
+	Matrix *YAMLMatrix `yaml:"matrix"`
 }
 
 // YAMLStep represents a step within a stage.
@@ -57,6 +157,181 @@ type YAMLStep struct {
 	Cache       *YAMLCache             `yaml:"cache"`
 	DependsOn   []string               `yaml:"depends_on"`
 	Outputs     map[string]string      `yaml:"outputs"`
+	Memoize     *YAMLMemoize           `yaml:"memoize"`
+	Secrets     []string               `yaml:"secrets"`
+	RunsOn      YAMLLabels             `yaml:"runs_on"`
+	Services    []YAMLService          `yaml:"services"`
+	Resources   *YAMLResources         `yaml:"resources"`
+	// WorkingDir is the directory the step runs in, relative to the job's
+	// workspace.
+	WorkingDir string `yaml:"working_dir"`
+	// Redact lists regular expressions masked in the step's logs, outputs
+	// and events, besides the pipeline's.
+	Redact []string `yaml:"redact"`
+	// OutputLimit overrides the size the step's output is truncated to.
+	OutputLimit string `yaml:"output_limit"`
+	// ExitCodes maps exit codes to statuses, as in `2: warning`.
+	ExitCodes map[int]string `yaml:"exit_codes"`
+	// Failures classify the step's failures by exit code or output.
+	Failures []YAMLFailure `yaml:"failures"`
+	// Locks are named locks on external resources, such as `staging-db`,
+	// the step holds while it runs. LockTimeout limits the wait for them.
+	Locks       []string `yaml:"locks"`
+	LockTimeout string   `yaml:"lock_timeout"`
+	// Network restricts the step's outbound connections to its egress and
+	// the pipeline's.
+	Network *YAMLNetwork `yaml:"network"`
+	// Matrix expands the step into a step per combination of its values,
+	// such as go versions and operating systems.
+	Matrix *YAMLMatrix `yaml:"matrix"`
+}
+
+// YAMLMatrix maps the axes of a matrix to their values, in order. The
+// exclude and max_parallel keys are not axes.
+type YAMLMatrix struct {
+	Axes        []YAMLMatrixAxis
+	Exclude     []map[string]string
+	MaxParallel int
+}
+
+// YAMLMatrixAxis is an axis of a matrix and its values.
+type YAMLMatrixAxis struct {
+	Name   string
+	Values []string
+}
+
+// UnmarshalYAML keeps the axes in the order they are written, which is the
+// order of the values in the IDs of the steps.
+func (m *YAMLMatrix) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: matrix must map axes to their values", value.Line)
+	}
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		key, node := value.Content[i], value.Content[i+1]
+		switch key.Value {
+		case "exclude":
+			if err := node.Decode(&m.Exclude); err != nil {
+				return err
+			}
+		case "max_parallel":
+			if err := node.Decode(&m.MaxParallel); err != nil {
+				return err
+			}
+		default:
+			var values YAMLLabels
+			if err := node.Decode(&values); err != nil {
+				return err
+			}
+			m.Axes = append(m.Axes, YAMLMatrixAxis{Name: key.Value, Values: values})
+		}
+	}
+	return nil
+}
+
+// YAMLFailure classifies a step's failures as class when its exit code is
+// one of exit_codes or its output matches pattern.
+type YAMLFailure struct {
+	Class     string `yaml:"class"`
+	ExitCodes []int  `yaml:"exit_codes"`
+	Pattern   string `yaml:"pattern"`
+}
+
+// YAMLResources represents the CPU and memory a step requests, such as
+// `cpu: 500m` and `memory: 512Mi`, and optional limits.
+type YAMLResources struct {
+	CPU    string             `yaml:"cpu"`
+	Memory string             `yaml:"memory"`
+	Limits *YAMLResourceLimit `yaml:"limits"`
+}
+
+// YAMLResourceLimit represents the CPU and memory limits of a step.
+type YAMLResourceLimit struct {
+	CPU    string `yaml:"cpu"`
+	Memory string `yaml:"memory"`
+}
+
+// YAMLService represents a sidecar container, such as a database.
+type YAMLService struct {
+	Name        string            `yaml:"name"`
+	Image       string            `yaml:"image"`
+	Command     []string          `yaml:"command"`
+	Environment map[string]string `yaml:"environment"`
+	Ports       []int             `yaml:"ports"`
+	Health      *YAMLHealth       `yaml:"health"`
+}
+
+// YAMLHealth represents the wait condition of a service.
+type YAMLHealth struct {
+	Command  string `yaml:"command"`
+	Interval string `yaml:"interval"`
+	Timeout  string `yaml:"timeout"`
+}
+
+// YAMLArtifact declares files kept from a successful job.
+type YAMLArtifact struct {
+	Name      string    `yaml:"name"`
+	Path      YAMLPaths `yaml:"path"`
+	Retention string    `yaml:"retention"`
+}
+
+// YAMLPaths is a single path or a list of paths.
+type YAMLPaths []string
+
+// UnmarshalYAML accepts `path: dist/` as well as a list.
+func (p *YAMLPaths) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var path string
+		if err := value.Decode(&path); err != nil {
+			return err
+		}
+		if path != "" {
+			*p = YAMLPaths{path}
+		}
+		return nil
+	}
+
+	var paths []string
+	if err := value.Decode(&paths); err != nil {
+		return err
+	}
+	*p = paths
+	return nil
+}
+
+// YAMLLabels is a single runner label or a list of labels.
+type YAMLLabels []string
+
+// UnmarshalYAML accepts `runs_on: docker` as well as a list.
+func (l *YAMLLabels) UnmarshalYAML(value *yaml.Node) error {
+	return (*YAMLPaths)(l).UnmarshalYAML(value)
+}
+
+// YAMLRetention limits how long artifacts are kept, by age in days or by
+// the number of most recent jobs.
+type YAMLRetention struct {
+	Days  int `yaml:"days"`
+	Count int `yaml:"count"`
+}
+
+// YAMLWorkspace represents warm workspace configuration. It may be given as
+// a boolean or as a mapping with dependency directories.
+type YAMLWorkspace struct {
+	Enabled      bool     `yaml:"-"`
+	Dependencies []string `yaml:"dependencies"`
+}
+
+// UnmarshalYAML accepts `workspace: true` as well as a mapping.
+func (w *YAMLWorkspace) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&w.Enabled)
+	}
+
+	type plain YAMLWorkspace
+	if err := value.Decode((*plain)(w)); err != nil {
+		return err
+	}
+	w.Enabled = true
+	return nil
 }
 
 // YAMLWhen represents conditional execution configuration.
@@ -72,4 +347,28 @@ type YAMLRetry struct {
 	MaxAttempts        int    `yaml:"max_attempts"`
 	Interval           string `yaml:"interval"`
 	ExponentialBackoff bool   `yaml:"exponential_backoff"`
+	// On limits retries to failures of the listed classes.
+	On []string `yaml:"on"`
+}
+
+// YAMLMemoize represents step result caching configuration. It may be
+// given as a boolean or as a mapping with inputs and a key.
+type YAMLMemoize struct {
+	Enabled bool     `yaml:"-"`
+	Inputs  []string `yaml:"inputs"`
+	Key     string   `yaml:"key"`
+}
+
+// UnmarshalYAML accepts `memoize: true` as well as a mapping.
+func (m *YAMLMemoize) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&m.Enabled)
+	}
+
+	type plain YAMLMemoize
+	if err := value.Decode((*plain)(m)); err != nil {
+		return err
+	}
+	m.Enabled = true
+	return nil
 }
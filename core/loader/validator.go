@@ -2,7 +2,13 @@ package loader
 
 import (
 	"fmt"
+	"path"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/core/cron"
 )
 
 // Validate checks a YAMLPipeline for errors and returns warnings for unsupported fields.
@@ -38,21 +44,44 @@ func Validate(p *YAMLPipeline) ([]string, error) {
 			errs = append(errs, fmt.Sprintf("stage %q: must have at least one step", stage.Name))
 		}
 
-		for j, step := range stage.Steps {
-			if strings.TrimSpace(step.Name) == "" {
-				errs = append(errs, fmt.Sprintf("stage %q, step %d: name is required", stage.Name, j+1))
-				continue
-			}
-
-			hasRun := strings.TrimSpace(step.Run) != ""
-			hasPlugin := strings.TrimSpace(step.Plugin) != ""
-			if !hasRun && !hasPlugin {
-				errs = append(errs, fmt.Sprintf("stage %q, step %q: must have either 'run' or 'plugin'", stage.Name, step.Name))
+		if err := validateLabels(stage.RunsOn); err != "" {
+			errs = append(errs, fmt.Sprintf("stage %q: %s", stage.Name, err))
+		}
+		for _, err := range validateServices(stage.Services) {
+			errs = append(errs, fmt.Sprintf("stage %q: %s", stage.Name, err))
+		}
+		if err := validateWhen(stage.When); err != nil {
+			errs = append(errs, fmt.Sprintf("stage %q: %v", stage.Name, err))
+		}
+		if stage.When != nil {
+			if err := core.ValidateExpressions(stage.When.Custom); err != nil {
+				errs = append(errs, fmt.Sprintf("stage %q: when.custom: %v", stage.Name, err))
 			}
-			if hasRun && hasPlugin {
-				errs = append(errs, fmt.Sprintf("stage %q, step %q: cannot have both 'run' and 'plugin'", stage.Name, step.Name))
+		}
+		matrix := convertMatrix(stage.Matrix)
+		if err := core.ValidateMatrix(matrix, nil); err != nil {
+			errs = append(errs, fmt.Sprintf("stage %q: %v", stage.Name, err))
+		}
+		errs = append(errs, validateSteps(stage.Name, "step", stage.Steps, matrix)...)
+		errs = append(errs, validateSteps(stage.Name, "rollback step", stage.Rollback, nil)...)
+		for _, step := range stage.Rollback {
+			if step.Matrix != nil {
+				errs = append(errs, fmt.Sprintf("stage %q, rollback step %q: rollback steps can't have a matrix", stage.Name, step.Name))
 			}
 		}
+
+		if stage.Speculative && (i == 0 || !p.Stages[i-1].AllowFailure) {
+			errs = append(errs, fmt.Sprintf("stage %q: speculative requires the previous stage to set allow_failure", stage.Name))
+		}
+		if stage.MaxParallel < 0 {
+			errs = append(errs, fmt.Sprintf("stage %q: max_parallel must not be negative", stage.Name))
+		}
+		if stage.MaxParallel > 0 && !stage.Parallel {
+			warnings = append(warnings, fmt.Sprintf("stage %q: max_parallel only applies to parallel stages and will be ignored", stage.Name))
+		}
+		if len(stage.Rollback) > 0 && !stage.Speculative {
+			warnings = append(warnings, fmt.Sprintf("stage %q: rollback steps only run for speculative stages and will be ignored", stage.Name))
+		}
 	}
 
 	for _, stage := range p.Stages {
@@ -73,8 +102,88 @@ func Validate(p *YAMLPipeline) ([]string, error) {
 	if p.Notifications != nil {
 		warnings = append(warnings, "field 'notifications' is not yet supported and will be ignored")
 	}
-	if p.Artifacts != nil {
-		warnings = append(warnings, "field 'artifacts' is not yet supported and will be ignored")
+	errs = append(errs, validateArtifacts(p)...)
+
+	if p.Workspace != nil {
+		for _, dep := range p.Workspace.Dependencies {
+			clean := path.Clean(dep)
+			if dep == "" || path.IsAbs(dep) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+				errs = append(errs, fmt.Sprintf("workspace: dependency %q must be a directory inside the workspace", dep))
+			}
+		}
+	}
+
+	for i, trigger := range p.Triggers {
+		switch {
+		case trigger.Type == core.TriggerSchedule && trigger.Cron == "":
+			errs = append(errs, fmt.Sprintf("trigger %d: schedule triggers require a cron expression", i+1))
+		case trigger.Type == core.TriggerSchedule:
+			if _, err := cron.Parse(trigger.Cron); err != nil {
+				errs = append(errs, fmt.Sprintf("trigger %d: %v", i+1, err))
+			}
+			if err := core.ValidateTimezone(trigger.Timezone); err != nil {
+				errs = append(errs, fmt.Sprintf("trigger %d: %v", i+1, err))
+			}
+		case trigger.Cron != "" || trigger.Timezone != "":
+			warnings = append(warnings, fmt.Sprintf("trigger %d: cron and timezone only apply to schedule triggers and will be ignored", i+1))
+		}
+		switch {
+		case trigger.Type == core.TriggerPipelineCompleted && trigger.Pipeline == "":
+			errs = append(errs, fmt.Sprintf("trigger %d: pipeline-completed triggers require a pipeline", i+1))
+		case trigger.Type == core.TriggerPipelineCompleted:
+			for _, glob := range trigger.Branches {
+				if _, err := path.Match(glob, ""); err != nil {
+					errs = append(errs, fmt.Sprintf("trigger %d: invalid branch pattern %q", i+1, glob))
+				}
+			}
+		case trigger.Pipeline != "" || len(trigger.Labels) > 0:
+			warnings = append(warnings, fmt.Sprintf("trigger %d: pipeline and labels only apply to pipeline-completed triggers and will be ignored", i+1))
+		}
+		if err := core.ValidateDebounce(trigger.Debounce, trigger.MaxDelay); err != nil {
+			errs = append(errs, fmt.Sprintf("trigger %d: %v", i+1, err))
+		}
+		switch {
+		case (trigger.Debounce != "" || trigger.MaxDelay != "") && (trigger.Type == core.TriggerSchedule || trigger.Type == core.TriggerPipelineCompleted):
+			warnings = append(warnings, fmt.Sprintf("trigger %d: debounce and max_delay only apply to webhook triggers and will be ignored", i+1))
+		case trigger.MaxDelay != "" && trigger.Debounce == "":
+			warnings = append(warnings, fmt.Sprintf("trigger %d: max_delay has no effect without debounce", i+1))
+		}
+	}
+
+	if err := core.ValidateConcurrencyGroup(p.ConcurrencyGroup); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if p.CancelInProgress && strings.TrimSpace(p.ConcurrencyGroup) == "" {
+		warnings = append(warnings, "cancel_in_progress has no effect without concurrency_group")
+	}
+	if p.Release != "" {
+		if err := core.ValidateRelease(p.Release); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if p.DebugOnFailure != "" {
+		if _, err := core.ParseDebugTTL(p.DebugOnFailure); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if err := core.ValidateRedactPatterns(p.Redact); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if p.DiskQuota != "" {
+		if err := core.ValidateDiskQuota(p.DiskQuota); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if err := core.ValidateBudget(convertBudget(p.Budget)); err != nil {
+		errs = append(errs, fmt.Sprintf("budget: %v", err))
+	}
+	if err := core.ValidatePipelineInfo(convertInfo(p.Info)); err != nil {
+		errs = append(errs, fmt.Sprintf("info: %v", err))
+	}
+	if p.Network != nil {
+		if err := core.ValidateEgress(p.Network.Egress); err != nil {
+			errs = append(errs, fmt.Sprintf("network: %v", err))
+		}
 	}
 
 	if len(errs) > 0 {
@@ -84,6 +193,229 @@ func Validate(p *YAMLPipeline) ([]string, error) {
 	return warnings, nil
 }
 
+// validateSteps checks the steps of a stage. kind names the steps in errors,
+// and matrix is the stage's.
+func validateSteps(stageName, kind string, steps []YAMLStep, matrix *core.Matrix) []string {
+	var errs []string
+	for j, step := range steps {
+		if strings.TrimSpace(step.Name) == "" {
+			errs = append(errs, fmt.Sprintf("stage %q, %s %d: name is required", stageName, kind, j+1))
+			continue
+		}
+
+		hasRun := strings.TrimSpace(step.Run) != ""
+		hasPlugin := strings.TrimSpace(step.Plugin) != ""
+		if !hasRun && !hasPlugin {
+			errs = append(errs, fmt.Sprintf("stage %q, %s %q: must have either 'run' or 'plugin'", stageName, kind, step.Name))
+		}
+		if hasRun && hasPlugin {
+			errs = append(errs, fmt.Sprintf("stage %q, %s %q: cannot have both 'run' and 'plugin'", stageName, kind, step.Name))
+		}
+		if err := validateLabels(step.RunsOn); err != "" {
+			errs = append(errs, fmt.Sprintf("stage %q, %s %q: %s", stageName, kind, step.Name, err))
+		}
+		for _, err := range validateServices(step.Services) {
+			errs = append(errs, fmt.Sprintf("stage %q, %s %q: %s", stageName, kind, step.Name, err))
+		}
+		for _, err := range validateResources(step.Resources) {
+			errs = append(errs, fmt.Sprintf("stage %q, %s %q: %s", stageName, kind, step.Name, err))
+		}
+		if step.OutputLimit != "" {
+			if err := core.ValidateOutputLimit(step.OutputLimit); err != nil {
+				errs = append(errs, fmt.Sprintf("stage %q, %s %q: %v", stageName, kind, step.Name, err))
+			}
+		}
+		if err := core.ValidateLocks(step.Locks, step.LockTimeout); err != nil {
+			errs = append(errs, fmt.Sprintf("stage %q, %s %q: %v", stageName, kind, step.Name, err))
+		}
+		if err := core.ValidateWorkingDir(step.WorkingDir); err != nil {
+			errs = append(errs, fmt.Sprintf("stage %q, %s %q: %v", stageName, kind, step.Name, err))
+		}
+		if err := core.ValidateRedactPatterns(step.Redact); err != nil {
+			errs = append(errs, fmt.Sprintf("stage %q, %s %q: %v", stageName, kind, step.Name, err))
+		}
+		if step.Matrix != nil {
+			if err := core.ValidateMatrix(matrix, convertMatrix(step.Matrix)); err != nil {
+				errs = append(errs, fmt.Sprintf("stage %q, %s %q: %v", stageName, kind, step.Name, err))
+			}
+		}
+		if err := validateWhen(step.When); err != nil {
+			errs = append(errs, fmt.Sprintf("stage %q, %s %q: %v", stageName, kind, step.Name, err))
+		}
+		for _, err := range validateFailureHandling(step) {
+			errs = append(errs, fmt.Sprintf("stage %q, %s %q: %s", stageName, kind, step.Name, err))
+		}
+		for _, err := range validateNetwork(step) {
+			errs = append(errs, fmt.Sprintf("stage %q, %s %q: %s", stageName, kind, step.Name, err))
+		}
+		for _, err := range validateExpressions(step) {
+			errs = append(errs, fmt.Sprintf("stage %q, %s %q: %s", stageName, kind, step.Name, err))
+		}
+	}
+	return errs
+}
+
+// validateExpressions checks the expressions in the fields of a step that
+// are expanded when it runs.
+func validateExpressions(step YAMLStep) []string {
+	fields := map[string]string{"run": step.Run}
+	for key, value := range step.Environment {
+		fields["environment."+key] = value
+	}
+	for key, value := range step.Config {
+		if s, ok := value.(string); ok {
+			fields["config."+key] = s
+		}
+	}
+	if step.When != nil {
+		fields["when.custom"] = step.When.Custom
+	}
+	if step.Cache != nil {
+		fields["cache.key"] = step.Cache.Key
+	}
+	if step.Memoize != nil {
+		fields["memoize.key"] = step.Memoize.Key
+	}
+
+	var errs []string
+	for field, value := range fields {
+		if err := core.ValidateExpressions(value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", field, err))
+		}
+	}
+	sort.Strings(errs)
+	return errs
+}
+
+// validateWhen checks the condition of a stage or step. The custom
+// expressions of steps are checked with their other expressions.
+func validateWhen(when *YAMLWhen) error {
+	if when == nil {
+		return nil
+	}
+	return core.ValidateWhen(&core.ConditionalExecution{
+		Branch:  when.Branch,
+		Status:  when.Status,
+		Custom:  when.Custom,
+		Pattern: when.Pattern,
+	})
+}
+
+// validateNetwork checks the network policy of a step, which only applies
+// to commands; plugins run in the server.
+func validateNetwork(step YAMLStep) []string {
+	if step.Network == nil {
+		return nil
+	}
+	var errs []string
+	if strings.TrimSpace(step.Plugin) != "" {
+		errs = append(errs, "network only applies to steps with 'run'")
+	}
+	if step.Network.DefaultDeny {
+		errs = append(errs, "network: default_deny only applies to the pipeline")
+	}
+	if err := core.ValidateEgress(step.Network.Egress); err != nil {
+		errs = append(errs, fmt.Sprintf("network: %v", err))
+	}
+	return errs
+}
+
+// validateFailureHandling checks a step's exit code mapping, failure rules
+// and the failure classes it retries.
+func validateFailureHandling(step YAMLStep) []string {
+	var errs []string
+	codes := make(map[int]core.Status, len(step.ExitCodes))
+	for code, status := range step.ExitCodes {
+		codes[code] = core.Status(strings.ToLower(status))
+	}
+	if err := core.ValidateExitCodes(codes); err != nil {
+		errs = append(errs, err.Error())
+	}
+	for _, failure := range step.Failures {
+		rule := core.FailureRule{Class: failure.Class, ExitCodes: failure.ExitCodes, Pattern: failure.Pattern}
+		if err := core.ValidateFailureRule(rule); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if step.Retry != nil {
+		for _, class := range step.Retry.On {
+			if strings.TrimSpace(class) == "" {
+				errs = append(errs, "retry: on lists an empty failure class")
+			}
+		}
+	}
+	return errs
+}
+
+// validateResources checks the resource quantities of a step and that its
+// requests don't exceed its limits.
+func validateResources(resources *YAMLResources) []string {
+	if resources == nil {
+		return nil
+	}
+	var errs []string
+	requests, err := core.ParseResources(resources.CPU, resources.Memory)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("resources: %v", err))
+	}
+	if resources.Limits == nil {
+		return errs
+	}
+	limits, err := core.ParseResources(resources.Limits.CPU, resources.Limits.Memory)
+	if err != nil {
+		return append(errs, fmt.Sprintf("resource limits: %v", err))
+	}
+	if limits.CPU > 0 && requests.CPU > limits.CPU {
+		errs = append(errs, fmt.Sprintf("cpu request %s exceeds limit %s", resources.CPU, resources.Limits.CPU))
+	}
+	if limits.Memory > 0 && requests.Memory > limits.Memory {
+		errs = append(errs, fmt.Sprintf("memory request %s exceeds limit %s", resources.Memory, resources.Limits.Memory))
+	}
+	return errs
+}
+
+// validateServices checks the services of a stage or step.
+func validateServices(services []YAMLService) []string {
+	var errs []string
+	names := make(map[string]bool)
+	for i, service := range services {
+		switch {
+		case !core.ValidServiceName(service.Name):
+			errs = append(errs, fmt.Sprintf("service %d: name %q must be a lowercase hostname", i+1, service.Name))
+		case names[service.Name]:
+			errs = append(errs, fmt.Sprintf("service %q: duplicate name", service.Name))
+		}
+		names[service.Name] = true
+
+		if strings.TrimSpace(service.Image) == "" {
+			errs = append(errs, fmt.Sprintf("service %q: image is required", service.Name))
+		}
+		for _, port := range service.Ports {
+			if port < 1 || port > 65535 {
+				errs = append(errs, fmt.Sprintf("service %q: invalid port %d", service.Name, port))
+			}
+		}
+		if health := service.Health; health != nil {
+			for _, d := range []string{health.Interval, health.Timeout} {
+				if _, err := time.ParseDuration(d); d != "" && err != nil {
+					errs = append(errs, fmt.Sprintf("service %q: invalid health duration %q", service.Name, d))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// validateLabels checks a runs_on selector and returns the problem, if any.
+func validateLabels(labels []string) string {
+	for _, label := range labels {
+		if strings.TrimSpace(label) == "" || strings.ContainsAny(label, " \t,") {
+			return fmt.Sprintf("invalid runs_on label %q", label)
+		}
+	}
+	return ""
+}
+
 func detectCycles(stages []YAMLStage) error {
 	adj := make(map[string][]string)
 	for _, s := range stages {
@@ -130,3 +462,35 @@ func detectCycles(stages []YAMLStage) error {
 
 	return nil
 }
+
+// validateArtifacts checks artifact declarations and the retention policy.
+func validateArtifacts(p *YAMLPipeline) []string {
+	var errs []string
+
+	names := make(map[string]bool)
+	for i, a := range p.Artifacts {
+		switch {
+		case a.Name == "":
+			errs = append(errs, fmt.Sprintf("artifact %d: name is required", i+1))
+		case !core.ValidArtifactName(a.Name):
+			errs = append(errs, fmt.Sprintf("artifact %q: name may only contain letters, digits, '.', '-' and '_'", a.Name))
+		case names[a.Name]:
+			errs = append(errs, fmt.Sprintf("artifact %q: duplicate name", a.Name))
+		}
+		names[a.Name] = true
+
+		if len(a.Path) == 0 {
+			errs = append(errs, fmt.Sprintf("artifact %q: path is required", a.Name))
+		}
+		if a.Retention != "" {
+			if _, err := core.ParseDuration(a.Retention); err != nil {
+				errs = append(errs, fmt.Sprintf("artifact %q: invalid retention %q", a.Name, a.Retention))
+			}
+		}
+	}
+
+	if r := p.ArtifactRetention; r != nil && (r.Days < 0 || r.Count < 0) {
+		errs = append(errs, "artifact_retention: days and count must not be negative")
+	}
+	return errs
+}
@@ -135,7 +135,6 @@ func TestValidate_UnsupportedFieldsWarnings(t *testing.T) {
 		Name:          "with-extras",
 		Version:       "1.0.0",
 		Notifications: map[string]interface{}{"type": "slack"},
-		Artifacts:     []interface{}{"report.html"},
 		Stages: []YAMLStage{
 			{Name: "build", Steps: []YAMLStep{{Name: "step", Run: "echo"}}},
 		},
@@ -144,8 +143,8 @@ func TestValidate_UnsupportedFieldsWarnings(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Validate() error = %v, want nil", err)
 	}
-	if len(warnings) != 3 {
-		t.Errorf("len(warnings) = %d, want 3", len(warnings))
+	if len(warnings) != 2 {
+		t.Errorf("len(warnings) = %d, want 2", len(warnings))
 	}
 }
 
@@ -222,3 +221,378 @@ func TestValidate_ThreeNodeCycle(t *testing.T) {
 		t.Errorf("error = %q, want it to mention 'circular'", err.Error())
 	}
 }
+
+func TestValidate_Speculative(t *testing.T) {
+	p, err := Parse([]byte(`
+name: speculative
+stages:
+  - name: verify
+    allow_failure: true
+    steps:
+      - name: e2e
+        run: make e2e
+  - name: deploy
+    speculative: true
+    steps:
+      - name: push
+        run: make push
+    rollback:
+      - name: undo
+        run: make undo
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if _, err := Validate(p); err != nil {
+		t.Errorf("Validate() error = %v, want nil", err)
+	}
+
+	p.Stages[0].AllowFailure = false
+	_, err = Validate(p)
+	if err == nil || !strings.Contains(err.Error(), "allow_failure") {
+		t.Errorf("Validate() error = %v, want it to require allow_failure", err)
+	}
+}
+
+func TestValidate_RollbackWithoutSpeculative(t *testing.T) {
+	p := &YAMLPipeline{
+		Name: "rollback",
+		Stages: []YAMLStage{
+			{
+				Name:     "deploy",
+				Steps:    []YAMLStep{{Name: "push", Run: "make push"}},
+				Rollback: []YAMLStep{{Name: "undo"}},
+			},
+		},
+	}
+	warnings, err := Validate(p)
+	if err == nil || !strings.Contains(err.Error(), "rollback step") {
+		t.Errorf("Validate() error = %v, want invalid rollback step", err)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("Validate() warnings = %v, want one about ignored rollback", warnings)
+	}
+}
+
+func TestValidate_Parallel(t *testing.T) {
+	p, err := Parse([]byte(`
+name: parallel
+stages:
+  - name: test
+    parallel: true
+    max_parallel: 2
+    steps:
+      - name: unit
+        run: make unit
+      - name: lint
+        run: make lint
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if warnings, err := Validate(p); err != nil || len(warnings) != 0 {
+		t.Errorf("Validate() = %v, %v, want no problems", warnings, err)
+	}
+	pipeline, err := Convert(p, "parallel")
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+	if stage := pipeline.Stages[0]; !stage.Parallel || stage.MaxParallel != 2 {
+		t.Errorf("Convert() stage = %+v, want parallel with at most 2 steps", stage)
+	}
+
+	p.Stages[0].MaxParallel = -1
+	if _, err := Validate(p); err == nil || !strings.Contains(err.Error(), "max_parallel") {
+		t.Errorf("Validate() error = %v, want negative max_parallel rejected", err)
+	}
+	p.Stages[0].MaxParallel, p.Stages[0].Parallel = 2, false
+	if warnings, _ := Validate(p); len(warnings) != 1 {
+		t.Errorf("Validate() warnings = %v, want max_parallel without parallel reported", warnings)
+	}
+}
+
+func TestValidate_Artifacts(t *testing.T) {
+	stages := []YAMLStage{{Name: "build", Steps: []YAMLStep{{Name: "step", Run: "echo"}}}}
+
+	valid := &YAMLPipeline{
+		Name:              "artifacts",
+		Stages:            stages,
+		Artifacts:         []YAMLArtifact{{Name: "dist", Path: YAMLPaths{"dist/"}, Retention: "7d"}},
+		ArtifactRetention: &YAMLRetention{Days: 30, Count: 10},
+	}
+	if _, err := Validate(valid); err != nil {
+		t.Fatalf("Validate() error = %v, want nil", err)
+	}
+
+	invalid := &YAMLPipeline{
+		Name:   "artifacts",
+		Stages: stages,
+		Artifacts: []YAMLArtifact{
+			{Name: "dist", Path: YAMLPaths{"dist/"}},
+			{Name: "dist", Path: YAMLPaths{"bin/"}, Retention: "soon"},
+			{Name: "../escape"},
+		},
+		ArtifactRetention: &YAMLRetention{Count: -1},
+	}
+	_, err := Validate(invalid)
+	if err == nil {
+		t.Fatal("Validate() error = nil, want artifact errors")
+	}
+	for _, want := range []string{"duplicate name", "invalid retention", "may only contain", "path is required", "must not be negative"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %v, want it to mention %q", err, want)
+		}
+	}
+}
+
+func TestValidate_ConcurrencyGroup(t *testing.T) {
+	stages := []YAMLStage{{Name: "build", Steps: []YAMLStep{{Name: "step", Run: "echo"}}}}
+
+	valid := &YAMLPipeline{Name: "pr", Stages: stages, ConcurrencyGroup: "pr-${{ trigger.pr }}", CancelInProgress: true}
+	warnings, err := Validate(valid)
+	if err != nil {
+		t.Fatalf("Validate() error = %v, want nil", err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("warnings = %v, want none", warnings)
+	}
+
+	invalid := &YAMLPipeline{Name: "pr", Stages: stages, ConcurrencyGroup: "pr-${{ branch }}"}
+	if _, err := Validate(invalid); err == nil || !strings.Contains(err.Error(), "unknown reference") {
+		t.Errorf("Validate() error = %v, want unknown reference", err)
+	}
+
+	ungrouped := &YAMLPipeline{Name: "pr", Stages: stages, CancelInProgress: true}
+	warnings, err = Validate(ungrouped)
+	if err != nil {
+		t.Fatalf("Validate() error = %v, want nil", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "cancel_in_progress") {
+		t.Errorf("warnings = %v, want cancel_in_progress warning", warnings)
+	}
+}
+
+func TestValidate_ScheduleTriggers(t *testing.T) {
+	stages := []YAMLStage{{Name: "build", Steps: []YAMLStep{{Name: "step", Run: "echo"}}}}
+
+	nightly := &YAMLPipeline{Name: "nightly", Stages: stages, Triggers: []YAMLTrigger{{Type: "schedule", Cron: "0 2 * * *"}}}
+	if _, err := Validate(nightly); err != nil {
+		t.Fatalf("Validate() error = %v, want nil", err)
+	}
+
+	for _, cron := range []string{"", "every night"} {
+		invalid := &YAMLPipeline{Name: "nightly", Stages: stages, Triggers: []YAMLTrigger{{Type: "schedule", Cron: cron}}}
+		if _, err := Validate(invalid); err == nil || !strings.Contains(err.Error(), "trigger 1") {
+			t.Errorf("Validate(cron %q) error = %v, want a trigger error", cron, err)
+		}
+	}
+
+	chicago := &YAMLPipeline{Name: "nightly", Stages: stages, Triggers: []YAMLTrigger{{Type: "schedule", Cron: "0 2 * * *", Timezone: "America/Chicago"}}}
+	if _, err := Validate(chicago); err != nil {
+		t.Errorf("Validate(timezone) error = %v, want nil", err)
+	}
+	chicago.Triggers[0].Timezone = "Central"
+	if _, err := Validate(chicago); err == nil || !strings.Contains(err.Error(), "unknown time zone") {
+		t.Errorf("Validate(timezone Central) error = %v, want an unknown time zone", err)
+	}
+
+	push := &YAMLPipeline{Name: "push", Stages: stages, Triggers: []YAMLTrigger{{Type: "push", Cron: "@daily"}}}
+	if warnings, err := Validate(push); err != nil || len(warnings) != 1 {
+		t.Errorf("Validate() = %v, %v, want a warning about cron", warnings, err)
+	}
+}
+
+func TestValidate_Locks(t *testing.T) {
+	step := YAMLStep{Name: "migrate", Run: "make migrate", Locks: []string{"staging-db"}, LockTimeout: "30m"}
+	valid := &YAMLPipeline{Name: "deploy", Stages: []YAMLStage{{Name: "db", Steps: []YAMLStep{step}}}}
+	if _, err := Validate(valid); err != nil {
+		t.Fatalf("Validate() error = %v, want nil", err)
+	}
+
+	step.LockTimeout = "forever"
+	invalid := &YAMLPipeline{Name: "deploy", Stages: []YAMLStage{{Name: "db", Steps: []YAMLStep{step}}}}
+	if _, err := Validate(invalid); err == nil || !strings.Contains(err.Error(), `step "migrate": invalid lock timeout`) {
+		t.Errorf("Validate() error = %v, want an invalid lock timeout", err)
+	}
+}
+
+func TestValidate_PipelineCompletedTriggers(t *testing.T) {
+	stages := []YAMLStage{{Name: "deploy", Steps: []YAMLStep{{Name: "deploy", Run: "make deploy"}}}}
+	valid := &YAMLPipeline{Name: "deploy", Stages: stages, Triggers: []YAMLTrigger{
+		{Type: "pipeline-completed", Pipeline: "build", Branches: []string{"release/*"}, Labels: map[string]string{"env": "staging"}},
+	}}
+	if _, err := Validate(valid); err != nil {
+		t.Fatalf("Validate() error = %v, want nil", err)
+	}
+
+	invalid := &YAMLPipeline{Name: "deploy", Stages: stages, Triggers: []YAMLTrigger{
+		{Type: "pipeline-completed"},
+		{Type: "pipeline-completed", Pipeline: "build", Branches: []string{"release/["}},
+	}}
+	_, err := Validate(invalid)
+	for _, want := range []string{"trigger 1: pipeline-completed triggers require a pipeline", `trigger 2: invalid branch pattern "release/["`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() error = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestValidate_DebouncedTriggers(t *testing.T) {
+	stages := []YAMLStage{{Name: "build", Steps: []YAMLStep{{Name: "build", Run: "make"}}}}
+	valid := &YAMLPipeline{Name: "build", Stages: stages, Triggers: []YAMLTrigger{
+		{Type: "push", Branches: []string{"main"}, Debounce: "30s", MaxDelay: "5m"},
+	}}
+	if _, err := Validate(valid); err != nil {
+		t.Fatalf("Validate() error = %v, want nil", err)
+	}
+
+	invalid := &YAMLPipeline{Name: "build", Stages: stages, Triggers: []YAMLTrigger{
+		{Type: "push", Debounce: "soon"},
+		{Type: "push", Debounce: "5m", MaxDelay: "30s"},
+	}}
+	_, err := Validate(invalid)
+	for _, want := range []string{`trigger 1: invalid debounce "soon"`, "trigger 2: max delay 30s is shorter than the debounce window 5m"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() error = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestValidate_WorkingDir(t *testing.T) {
+	step := YAMLStep{Name: "test", Run: "go test ./...", WorkingDir: "services/api"}
+	valid := &YAMLPipeline{Name: "build", Stages: []YAMLStage{{Name: "test", Steps: []YAMLStep{step}}}}
+	if _, err := Validate(valid); err != nil {
+		t.Fatalf("Validate() error = %v, want nil", err)
+	}
+
+	step.WorkingDir = "../other"
+	invalid := &YAMLPipeline{Name: "build", Stages: []YAMLStage{{Name: "test", Steps: []YAMLStep{step}}}}
+	if _, err := Validate(invalid); err == nil || !strings.Contains(err.Error(), `step "test": working directory "../other" is outside the job's workspace`) {
+		t.Errorf("Validate() error = %v, want the working directory rejected", err)
+	}
+}
+
+func TestValidate_Redact(t *testing.T) {
+	step := YAMLStep{Name: "deploy", Run: "make deploy", Redact: []string{`cust-[0-9]+`}}
+	valid := &YAMLPipeline{Name: "deploy", Redact: []string{`[a-z0-9-]+\.corp\.local`}, Stages: []YAMLStage{{Name: "deploy", Steps: []YAMLStep{step}}}}
+	if _, err := Validate(valid); err != nil {
+		t.Fatalf("Validate() error = %v, want nil", err)
+	}
+
+	step.Redact = []string{"(cust"}
+	invalid := &YAMLPipeline{Name: "deploy", Redact: []string{".*"}, Stages: []YAMLStage{{Name: "deploy", Steps: []YAMLStep{step}}}}
+	_, err := Validate(invalid)
+	for _, want := range []string{`redaction pattern ".*" matches empty text`, `stage "deploy", step "deploy": invalid redaction pattern "(cust"`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() error = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestValidate_Network(t *testing.T) {
+	step := YAMLStep{Name: "install", Run: "npm ci", Network: &YAMLNetwork{Egress: []string{"registry.npmjs.org:443"}}}
+	valid := &YAMLPipeline{Name: "build", Network: &YAMLNetwork{Egress: []string{"10.0.0.0/8"}, DefaultDeny: true}, Stages: []YAMLStage{{Name: "deps", Steps: []YAMLStep{step}}}}
+	if _, err := Validate(valid); err != nil {
+		t.Fatalf("Validate() error = %v, want nil", err)
+	}
+
+	invalid := &YAMLPipeline{Name: "build", Network: &YAMLNetwork{Egress: []string{"https://github.com"}}, Stages: valid.Stages}
+	if _, err := Validate(invalid); err == nil || !strings.Contains(err.Error(), `network: invalid egress "https://github.com"`) {
+		t.Errorf("Validate() error = %v, want an invalid egress", err)
+	}
+
+	plugin := YAMLStep{Name: "scan", Plugin: "security", Network: &YAMLNetwork{DefaultDeny: true}}
+	invalid = &YAMLPipeline{Name: "build", Stages: []YAMLStage{{Name: "deps", Steps: []YAMLStep{plugin}}}}
+	_, err := Validate(invalid)
+	if err == nil || !strings.Contains(err.Error(), "only applies to steps with 'run'") || !strings.Contains(err.Error(), "default_deny only applies to the pipeline") {
+		t.Errorf("Validate() error = %v, want errors about the plugin step's network", err)
+	}
+}
+
+func TestValidate_DiskQuota(t *testing.T) {
+	stages := []YAMLStage{{Name: "build", Steps: []YAMLStep{{Name: "build", Run: "make"}}}}
+	if _, err := Validate(&YAMLPipeline{Name: "build", DiskQuota: "20Gi", Stages: stages}); err != nil {
+		t.Fatalf("Validate() error = %v, want nil", err)
+	}
+	if _, err := Validate(&YAMLPipeline{Name: "build", DiskQuota: "20GB", Stages: stages}); err == nil || !strings.Contains(err.Error(), `invalid disk quota "20GB"`) {
+		t.Errorf("Validate() error = %v, want an invalid disk quota", err)
+	}
+}
+
+func TestValidate_Budget(t *testing.T) {
+	stages := []YAMLStage{{Name: "build", Steps: []YAMLStep{{Name: "build", Run: "make"}}}}
+	if _, err := Validate(&YAMLPipeline{Name: "build", Budget: &YAMLBudget{MaxDuration: "2h", MaxSteps: 20, MaxRetriesPerDay: 5}, Stages: stages}); err != nil {
+		t.Fatalf("Validate() error = %v, want nil", err)
+	}
+	tests := map[string]*YAMLBudget{
+		`budget: invalid max duration "2 hours"`:           {MaxDuration: "2 hours"},
+		`budget: max duration "10ms" must be at least 1s`:  {MaxDuration: "10ms"},
+		"budget: max steps must not be negative":           {MaxSteps: -1},
+		"budget: max retries per day must not be negative": {MaxRetriesPerDay: -1},
+	}
+	for want, budget := range tests {
+		if _, err := Validate(&YAMLPipeline{Name: "build", Budget: budget, Stages: stages}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate(%+v) error = %v, want %q", budget, err, want)
+		}
+	}
+}
+
+func TestValidate_Expressions(t *testing.T) {
+	valid := YAMLStep{
+		Name:  "build",
+		Run:   "echo ${{ toUpper(trigger.branch) }}",
+		When:  &YAMLWhen{Custom: "${{ trigger.branch == 'main' && semverCompare('>=1.2', revision.tag) }}"},
+		Cache: &YAMLCache{Key: "go-${{ hashFiles('**/go.sum') }}", Paths: []string{"vendor"}},
+	}
+	stages := []YAMLStage{{Name: "build", Steps: []YAMLStep{valid}}}
+	if _, err := Validate(&YAMLPipeline{Name: "build", Stages: stages}); err != nil {
+		t.Fatalf("Validate() error = %v, want nil", err)
+	}
+
+	invalid := YAMLStep{Name: "build", Run: "make", Environment: map[string]string{"TAG": "${{ hashFile('go.sum') }}"}}
+	stages = []YAMLStage{{Name: "build", Steps: []YAMLStep{invalid}}}
+	if _, err := Validate(&YAMLPipeline{Name: "build", Stages: stages}); err == nil || !strings.Contains(err.Error(), `environment.TAG: invalid expression "hashFile('go.sum')": unknown function "hashFile"`) {
+		t.Errorf("Validate() error = %v, want an unknown function", err)
+	}
+}
+
+func TestValidate_When(t *testing.T) {
+	step := YAMLStep{Name: "notify", Run: "notify", When: &YAMLWhen{Status: "failure", Branch: "main,release/*"}}
+	stage := YAMLStage{Name: "deploy", When: &YAMLWhen{Pattern: "^v[0-9]+$"}, Steps: []YAMLStep{step}}
+	if _, err := Validate(&YAMLPipeline{Name: "build", Stages: []YAMLStage{stage}}); err != nil {
+		t.Fatalf("Validate() error = %v, want nil", err)
+	}
+
+	tests := []struct {
+		name  string
+		stage YAMLWhen
+		step  YAMLWhen
+		want  string
+	}{
+		{"status", YAMLWhen{}, YAMLWhen{Status: "failed"}, `step "notify": invalid when.status "failed"`},
+		{"branch", YAMLWhen{Branch: "release/["}, YAMLWhen{}, `stage "deploy": invalid when.branch "release/["`},
+		{"pattern", YAMLWhen{}, YAMLWhen{Pattern: "(main"}, `step "notify": invalid when.pattern`},
+		{"custom", YAMLWhen{Custom: "${{ branch() }}"}, YAMLWhen{}, `stage "deploy": when.custom: invalid expression`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step := YAMLStep{Name: "notify", Run: "notify", When: &tt.step}
+			stage := YAMLStage{Name: "deploy", When: &tt.stage, Steps: []YAMLStep{step}}
+			if _, err := Validate(&YAMLPipeline{Name: "build", Stages: []YAMLStage{stage}}); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate_Info(t *testing.T) {
+	stages := []YAMLStage{{Name: "build", Steps: []YAMLStep{{Name: "build", Run: "make"}}}}
+	info := &YAMLInfo{Owner: "payments-oncall", Runbook: "https://wiki.example.com/build", SLO: &YAMLSLO{SuccessRate: 99, Duration: "30m"}}
+	if _, err := Validate(&YAMLPipeline{Name: "build", Info: info, Stages: stages}); err != nil {
+		t.Fatalf("Validate() error = %v, want nil", err)
+	}
+	info.Runbook = "wiki/build"
+	if _, err := Validate(&YAMLPipeline{Name: "build", Info: info, Stages: stages}); err == nil || !strings.Contains(err.Error(), `info: runbook: "wiki/build" is not an http(s) URL`) {
+		t.Errorf("Validate() error = %v, want an invalid runbook", err)
+	}
+}
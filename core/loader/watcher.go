@@ -0,0 +1,562 @@
+package loader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chip/conveyor/core"
+)
+
+// Drift kinds reported when the engine state differs from the watched files.
+const (
+	// DriftModified means a pipeline was changed through the API.
+	DriftModified = "modified"
+	// DriftDeleted means a pipeline defined in a file was deleted through the API.
+	DriftDeleted = "deleted"
+	// DriftUntracked means a pipeline exists in the engine but not in any file.
+	DriftUntracked = "untracked"
+)
+
+// Drift describes a pipeline whose engine state differs from its file.
+type Drift struct {
+	PipelineID string    `json:"pipelineId"`
+	File       string    `json:"file,omitempty"`
+	Kind       string    `json:"kind"`
+	DetectedAt time.Time `json:"detectedAt"`
+}
+
+// WatchOptions configures a Watcher.
+type WatchOptions struct {
+	// Interval between directory scans. Zero disables polling, leaving
+	// syncs to explicit Sync calls such as those made by a webhook.
+	Interval time.Duration
+	// SelfHeal re-applies the file definition when a pipeline drifts.
+	// Otherwise drift is only reported.
+	SelfHeal bool
+	// ReadOnly marks pipelines as managed exclusively by the watched files.
+	// The watcher only reports it; the API enforces it.
+	ReadOnly bool
+	// Repo is an optional git repository cloned into the watched directory
+	// and pulled before every scan. Each revision is applied atomically.
+	Repo string
+	// Branch of Repo to follow. Defaults to the remote's default branch.
+	Branch string
+	// Discoverer regenerates the pipelines of discovered projects before
+	// every scan, so projects that are added or removed are picked up.
+	Discoverer *Discoverer
+}
+
+// SyncStatus reports the state of the last reconciliation.
+type SyncStatus struct {
+	Dir            string              `json:"dir"`
+	Repo           string              `json:"repo,omitempty"`
+	Branch         string              `json:"branch,omitempty"`
+	Revision       string              `json:"revision,omitempty"`
+	FailedRevision string              `json:"failedRevision,omitempty"`
+	SelfHeal       bool                `json:"selfHeal"`
+	ReadOnly       bool                `json:"readOnly"`
+	LastSync       time.Time           `json:"lastSync"`
+	LastApplied    time.Time           `json:"lastApplied"`
+	LastError      string              `json:"lastError,omitempty"`
+	Files          map[string]string   `json:"files"`
+	Errors         map[string]string   `json:"errors,omitempty"`
+	Warnings       map[string][]string `json:"warnings,omitempty"`
+	Drift          []Drift             `json:"drift"`
+}
+
+// managedFile is a pipeline file the watcher has applied to the engine.
+type managedFile struct {
+	pipelineID  string
+	hash        string
+	fingerprint string
+	data        []byte
+}
+
+// fileChange is a pipeline file that differs from what was last applied.
+type fileChange struct {
+	name     string
+	hash     string
+	data     []byte
+	pipeline *core.Pipeline
+	warnings []string
+	err      error
+}
+
+// Watcher keeps the engine's pipelines in sync with a directory of YAML
+// files, GitOps style. Files that are added, changed or removed are
+// created, updated or deleted in the engine, and pipelines changed through
+// the API are reported as drift.
+type Watcher struct {
+	engine *core.PipelineEngine
+	dir    string
+	opts   WatchOptions
+	git    *gitSource
+
+	syncMu         sync.Mutex
+	mu             sync.RWMutex
+	files          map[string]*managedFile
+	rejected       map[string]string
+	errors         map[string]string
+	warnings       map[string][]string
+	drift          map[string]Drift
+	revision       string
+	failedRevision string
+	lastSync       time.Time
+	lastApplied    time.Time
+	lastError      string
+}
+
+// NewWatcher creates a Watcher for dir. Call Sync to load the directory and
+// Run to keep watching it.
+func NewWatcher(engine *core.PipelineEngine, dir string, opts WatchOptions) *Watcher {
+	w := &Watcher{
+		engine:   engine,
+		dir:      dir,
+		opts:     opts,
+		files:    make(map[string]*managedFile),
+		rejected: make(map[string]string),
+		errors:   make(map[string]string),
+		warnings: make(map[string][]string),
+		drift:    make(map[string]Drift),
+	}
+	if opts.Repo != "" {
+		w.git = &gitSource{repo: opts.Repo, branch: opts.Branch, dir: dir}
+	}
+	return w
+}
+
+// ReadOnly reports whether pipelines may only be changed through the files.
+func (w *Watcher) ReadOnly() bool {
+	return w.opts.ReadOnly
+}
+
+// Run syncs the directory every interval until ctx is done. It returns
+// immediately when polling is disabled.
+func (w *Watcher) Run(ctx context.Context) {
+	if w.opts.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(w.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.Sync(); err != nil {
+				log.Printf("Pipeline sync failed: %v", err)
+			}
+		}
+	}
+}
+
+// Sync reconciles the engine with the watched directory once. With a git
+// repository, all changes in a revision are applied together, or none are
+// if any file in it is invalid.
+func (w *Watcher) Sync() error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	err := w.sync()
+
+	w.mu.Lock()
+	w.lastSync = time.Now()
+	w.lastError = ""
+	if err != nil {
+		w.lastError = err.Error()
+	}
+	w.mu.Unlock()
+
+	return err
+}
+
+func (w *Watcher) sync() error {
+	revision := ""
+	if w.git != nil {
+		var err error
+		if revision, err = w.git.pull(); err != nil {
+			return err
+		}
+	}
+
+	if w.opts.Discoverer != nil {
+		if _, err := w.opts.Discoverer.Discover(); err != nil {
+			log.Printf("Project discovery failed: %v", err)
+		}
+	}
+
+	current, err := w.scan()
+	if err != nil {
+		return err
+	}
+
+	if w.git != nil {
+		w.mu.RLock()
+		failed := revision == w.failedRevision
+		w.mu.RUnlock()
+		if !failed {
+			w.applyRevision(revision, current)
+		}
+	} else {
+		changes, removed := w.plan(current)
+		for _, change := range changes {
+			w.applyFile(change)
+		}
+		w.remove(removed)
+	}
+
+	w.mu.Lock()
+	for name := range w.errors {
+		if _, ok := current[name]; !ok {
+			delete(w.errors, name)
+			delete(w.warnings, name)
+			delete(w.rejected, name)
+		}
+	}
+	w.mu.Unlock()
+
+	w.detectDrift()
+	return nil
+}
+
+// plan builds the pipelines of new and changed files and lists the files
+// that were removed.
+func (w *Watcher) plan(current map[string][]byte) ([]*fileChange, []string) {
+	var changes []*fileChange
+	for name, data := range current {
+		hash := hashBytes(data)
+		if managed, ok := w.files[name]; ok && managed.hash == hash {
+			continue
+		}
+		if w.git == nil && w.rejected[name] == hash {
+			continue
+		}
+		changes = append(changes, buildChange(name, data, hash))
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].name < changes[j].name
+	})
+
+	var removed []string
+	for name := range w.files {
+		if _, ok := current[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+
+	return changes, removed
+}
+
+// applyRevision applies every change in a repository revision at once. If
+// any changed file is invalid the revision is rejected and the engine keeps
+// the previous revision's pipelines.
+func (w *Watcher) applyRevision(revision string, current map[string][]byte) {
+	changes, removed := w.plan(current)
+
+	w.mu.Lock()
+	invalid := 0
+	for _, change := range changes {
+		w.recordResult(change)
+		if change.err != nil {
+			invalid++
+		}
+	}
+	if invalid > 0 {
+		w.failedRevision = revision
+		w.mu.Unlock()
+		log.Printf("Rejected revision %s: %d invalid pipeline files", shortRevision(revision), invalid)
+		return
+	}
+	w.mu.Unlock()
+
+	upserts := make([]*core.Pipeline, 0, len(changes))
+	for _, change := range changes {
+		upserts = append(upserts, change.pipeline)
+	}
+	deletes := make([]string, 0, len(removed))
+	for _, name := range removed {
+		deletes = append(deletes, w.files[name].pipelineID)
+	}
+
+	if len(upserts) > 0 || len(deletes) > 0 {
+		if err := w.engine.ApplyPipelines(upserts, deletes); err != nil {
+			w.mu.Lock()
+			w.failedRevision = revision
+			w.mu.Unlock()
+			log.Printf("Failed to apply revision %s: %v", shortRevision(revision), err)
+			return
+		}
+	}
+
+	w.mu.Lock()
+	for _, change := range changes {
+		w.track(change)
+	}
+	for _, name := range removed {
+		delete(w.files, name)
+	}
+	if revision != w.revision || len(changes) > 0 || len(removed) > 0 {
+		w.lastApplied = time.Now()
+	}
+	w.revision = revision
+	w.failedRevision = ""
+	w.mu.Unlock()
+
+	if len(changes) > 0 || len(removed) > 0 {
+		log.Printf("Applied revision %s: %d pipelines changed, %d removed", shortRevision(revision), len(changes), len(removed))
+	}
+}
+
+// applyFile creates or updates the pipeline defined by a single file.
+// Invalid files are recorded as errors and leave the engine's pipeline
+// unchanged.
+func (w *Watcher) applyFile(change *fileChange) {
+	w.mu.Lock()
+	w.recordResult(change)
+	w.mu.Unlock()
+	if change.err != nil {
+		log.Printf("Skipping invalid pipeline file %s: %v", change.name, change.err)
+		return
+	}
+
+	if err := w.engine.ApplyPipelines([]*core.Pipeline{change.pipeline}, nil); err != nil {
+		w.mu.Lock()
+		w.errors[change.name] = err.Error()
+		w.rejected[change.name] = change.hash
+		w.mu.Unlock()
+		log.Printf("Failed to apply pipeline file %s: %v", change.name, err)
+		return
+	}
+
+	w.mu.Lock()
+	w.track(change)
+	w.lastApplied = time.Now()
+	w.mu.Unlock()
+
+	log.Printf("Applied pipeline %s from %s", change.pipeline.ID, change.name)
+}
+
+// remove deletes the pipelines of removed files.
+func (w *Watcher) remove(names []string) {
+	for _, name := range names {
+		managed := w.files[name]
+		if err := w.engine.DeletePipeline(managed.pipelineID); err == nil {
+			log.Printf("Deleted pipeline %s (%s removed)", managed.pipelineID, name)
+		}
+		w.mu.Lock()
+		delete(w.files, name)
+		w.lastApplied = time.Now()
+		w.mu.Unlock()
+	}
+}
+
+// recordResult stores the warnings and error of a change. Callers must hold
+// w.mu.
+func (w *Watcher) recordResult(change *fileChange) {
+	if len(change.warnings) > 0 {
+		w.warnings[change.name] = change.warnings
+	} else {
+		delete(w.warnings, change.name)
+	}
+	if change.err != nil {
+		w.errors[change.name] = change.err.Error()
+		w.rejected[change.name] = change.hash
+		return
+	}
+	delete(w.errors, change.name)
+	delete(w.rejected, change.name)
+}
+
+// track records an applied change. Callers must hold w.mu.
+func (w *Watcher) track(change *fileChange) {
+	w.files[change.name] = &managedFile{
+		pipelineID:  change.pipeline.ID,
+		hash:        change.hash,
+		fingerprint: fingerprint(change.pipeline),
+		data:        change.data,
+	}
+	delete(w.drift, change.pipeline.ID)
+}
+
+// Status returns the result of the last reconciliation.
+func (w *Watcher) Status() SyncStatus {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	status := SyncStatus{
+		Dir:            w.dir,
+		Repo:           w.opts.Repo,
+		Branch:         w.opts.Branch,
+		Revision:       w.revision,
+		FailedRevision: w.failedRevision,
+		SelfHeal:       w.opts.SelfHeal,
+		ReadOnly:       w.opts.ReadOnly,
+		LastSync:       w.lastSync,
+		LastApplied:    w.lastApplied,
+		LastError:      w.lastError,
+		Files:          make(map[string]string, len(w.files)),
+		Errors:         make(map[string]string, len(w.errors)),
+		Warnings:       make(map[string][]string, len(w.warnings)),
+		Drift:          make([]Drift, 0, len(w.drift)),
+	}
+	for name, managed := range w.files {
+		status.Files[name] = managed.pipelineID
+	}
+	for name, err := range w.errors {
+		status.Errors[name] = err
+	}
+	for name, warnings := range w.warnings {
+		status.Warnings[name] = warnings
+	}
+	for _, d := range w.drift {
+		status.Drift = append(status.Drift, d)
+	}
+	sort.Slice(status.Drift, func(i, j int) bool {
+		return status.Drift[i].PipelineID < status.Drift[j].PipelineID
+	})
+
+	return status
+}
+
+// scan reads every pipeline file in the directory.
+func (w *Watcher) scan() (map[string][]byte, error) {
+	files := make(map[string][]byte)
+
+	if _, err := os.Stat(w.dir); os.IsNotExist(err) {
+		return files, nil
+	}
+
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(w.dir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("failed to glob %s: %w", pattern, err)
+		}
+		for _, path := range matches {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", path, err)
+			}
+			files[filepath.Base(path)] = data
+		}
+	}
+
+	return files, nil
+}
+
+// detectDrift compares the engine's pipelines with the applied files and
+// records the differences, re-applying the files when self-heal is enabled.
+func (w *Watcher) detectDrift() {
+	w.mu.RLock()
+	managed := make(map[string]*managedFile, len(w.files))
+	for name, file := range w.files {
+		managed[name] = file
+	}
+	w.mu.RUnlock()
+
+	now := time.Now()
+	found := make(map[string]Drift)
+	tracked := make(map[string]bool)
+
+	for name, file := range managed {
+		tracked[file.pipelineID] = true
+
+		kind := ""
+		pipeline, err := w.engine.GetPipeline(file.pipelineID)
+		if err != nil {
+			kind = DriftDeleted
+		} else if fingerprint(pipeline) != file.fingerprint {
+			kind = DriftModified
+		}
+		if kind == "" {
+			continue
+		}
+
+		if w.opts.SelfHeal {
+			log.Printf("Pipeline %s was %s outside %s, re-applying", file.pipelineID, kind, name)
+			w.applyFile(buildChange(name, file.data, file.hash))
+			continue
+		}
+		found[file.pipelineID] = Drift{PipelineID: file.pipelineID, File: name, Kind: kind, DetectedAt: now}
+	}
+
+	for _, pipeline := range w.engine.ListPipelines() {
+		if !tracked[pipeline.ID] {
+			found[pipeline.ID] = Drift{PipelineID: pipeline.ID, Kind: DriftUntracked, DetectedAt: now}
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for id, d := range found {
+		if previous, ok := w.drift[id]; ok && previous.Kind == d.Kind {
+			// Keep the time the drift was first seen
+			found[id] = previous
+			continue
+		}
+		if d.Kind != DriftUntracked {
+			log.Printf("Drift detected: pipeline %s was %s outside %s", id, d.Kind, d.File)
+		}
+	}
+	w.drift = found
+}
+
+// buildChange builds the pipeline defined by a file.
+func buildChange(name string, data []byte, hash string) *fileChange {
+	id := strings.TrimSuffix(name, filepath.Ext(name))
+	pipeline, warnings, err := buildManagedPipeline(data, id, name)
+	return &fileChange{name: name, hash: hash, data: data, pipeline: pipeline, warnings: warnings, err: err}
+}
+
+// shortRevision abbreviates a git commit hash for logs.
+func shortRevision(revision string) string {
+	if len(revision) > 12 {
+		return revision[:12]
+	}
+	return revision
+}
+
+// buildManagedPipeline builds a pipeline from a file and marks it as
+// managed by the watcher.
+func buildManagedPipeline(data []byte, id, file string) (*core.Pipeline, []string, error) {
+	pipeline, warnings, err := BuildPipeline(data, id)
+	if err != nil {
+		return nil, warnings, err
+	}
+	pipeline.Metadata = map[string]interface{}{
+		"source": "file",
+		"file":   file,
+	}
+	return pipeline, warnings, nil
+}
+
+// fingerprint hashes a pipeline's definition, ignoring timestamps.
+func fingerprint(pipeline *core.Pipeline) string {
+	definition := *pipeline
+	definition.CreatedAt = time.Time{}
+	definition.UpdatedAt = time.Time{}
+
+	data, err := json.Marshal(definition)
+	if err != nil {
+		return ""
+	}
+	return hashBytes(data)
+}
+
+// hashBytes returns the hex SHA-256 of data.
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
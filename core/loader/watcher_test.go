@@ -0,0 +1,201 @@
+package loader
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+const watchedPipeline = `name: %s
+stages:
+  - name: build
+    steps:
+      - name: compile
+        run: %s
+`
+
+func writePipelineFile(t *testing.T, dir, file, name, command string) {
+	t.Helper()
+	content := []byte(fmt.Sprintf(watchedPipeline, name, command))
+	if err := os.WriteFile(filepath.Join(dir, file), content, 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", file, err)
+	}
+}
+
+func syncWatcher(t *testing.T, w *Watcher) SyncStatus {
+	t.Helper()
+	if err := w.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	return w.Status()
+}
+
+func TestWatcher_CreatesUpdatesAndDeletes(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine()
+	w := NewWatcher(engine, dir, WatchOptions{})
+
+	writePipelineFile(t, dir, "app.yaml", "app", "make")
+	syncWatcher(t, w)
+
+	pipeline, err := engine.GetPipeline("app")
+	if err != nil {
+		t.Fatalf("pipeline not created: %v", err)
+	}
+	if pipeline.Metadata["file"] != "app.yaml" {
+		t.Errorf("Metadata[file] = %v, want app.yaml", pipeline.Metadata["file"])
+	}
+
+	writePipelineFile(t, dir, "app.yaml", "app", "make all")
+	syncWatcher(t, w)
+	pipeline, _ = engine.GetPipeline("app")
+	if got := pipeline.Stages[0].Steps[0].Command; got != "make all" {
+		t.Errorf("Command = %q, want updated command", got)
+	}
+
+	os.Remove(filepath.Join(dir, "app.yaml"))
+	status := syncWatcher(t, w)
+	if _, err := engine.GetPipeline("app"); err == nil {
+		t.Error("pipeline still exists after its file was removed")
+	}
+	if len(status.Files) != 0 {
+		t.Errorf("Files = %v, want none", status.Files)
+	}
+}
+
+func TestWatcher_InvalidFileKeepsPipeline(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine()
+	w := NewWatcher(engine, dir, WatchOptions{})
+
+	writePipelineFile(t, dir, "app.yaml", "app", "make")
+	syncWatcher(t, w)
+
+	os.WriteFile(filepath.Join(dir, "app.yaml"), []byte("name: [broken"), 0644)
+	status := syncWatcher(t, w)
+
+	if status.Errors["app.yaml"] == "" {
+		t.Error("expected an error for the invalid file")
+	}
+	pipeline, err := engine.GetPipeline("app")
+	if err != nil || pipeline.Stages[0].Steps[0].Command != "make" {
+		t.Errorf("previous pipeline definition should be kept, got %v, %v", pipeline, err)
+	}
+}
+
+func TestWatcher_DetectsDrift(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine()
+	w := NewWatcher(engine, dir, WatchOptions{})
+
+	writePipelineFile(t, dir, "app.yaml", "app", "make")
+	writePipelineFile(t, dir, "lib.yaml", "lib", "make lib")
+	syncWatcher(t, w)
+
+	modified, _, _ := BuildPipeline([]byte(fmt.Sprintf(watchedPipeline, "app", "rm -rf /")), "app")
+	engine.UpdatePipeline(modified)
+	engine.DeletePipeline("lib")
+	extra, _, _ := BuildPipeline([]byte(fmt.Sprintf(watchedPipeline, "extra", "true")), "extra")
+	engine.CreatePipeline(extra)
+
+	status := syncWatcher(t, w)
+	kinds := make(map[string]string)
+	for _, d := range status.Drift {
+		kinds[d.PipelineID] = d.Kind
+	}
+	want := map[string]string{"app": DriftModified, "lib": DriftDeleted, "extra": DriftUntracked}
+	for id, kind := range want {
+		if kinds[id] != kind {
+			t.Errorf("drift for %s = %q, want %q", id, kinds[id], kind)
+		}
+	}
+
+	// Drift is only reported, the engine keeps the API changes
+	pipeline, _ := engine.GetPipeline("app")
+	if pipeline.Stages[0].Steps[0].Command != "rm -rf /" {
+		t.Error("drift should not be reverted without self-heal")
+	}
+}
+
+func TestWatcher_SelfHeal(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine()
+	w := NewWatcher(engine, dir, WatchOptions{SelfHeal: true})
+
+	writePipelineFile(t, dir, "app.yaml", "app", "make")
+	syncWatcher(t, w)
+
+	modified, _, _ := BuildPipeline([]byte(fmt.Sprintf(watchedPipeline, "app", "make deploy")), "app")
+	engine.UpdatePipeline(modified)
+
+	status := syncWatcher(t, w)
+	if len(status.Drift) != 0 {
+		t.Errorf("Drift = %v, want none after self-heal", status.Drift)
+	}
+	pipeline, _ := engine.GetPipeline("app")
+	if got := pipeline.Stages[0].Steps[0].Command; got != "make" {
+		t.Errorf("Command = %q, want the file definition restored", got)
+	}
+}
+
+func gitCommit(t *testing.T, dir, message string) {
+	t.Helper()
+	for _, args := range [][]string{
+		{"add", "-A"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", message},
+	} {
+		if _, err := runGit(dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWatcher_GitRevisionsApplyAtomically(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	remote := t.TempDir()
+	if _, err := runGit(remote, "init", "-q"); err != nil {
+		t.Fatal(err)
+	}
+	writePipelineFile(t, remote, "app.yaml", "app", "make")
+	writePipelineFile(t, remote, "lib.yaml", "lib", "make lib")
+	gitCommit(t, remote, "initial")
+
+	engine := newTestEngine()
+	w := NewWatcher(engine, filepath.Join(t.TempDir(), "clone"), WatchOptions{Repo: remote})
+	status := syncWatcher(t, w)
+	if len(status.Files) != 2 || status.Revision == "" {
+		t.Fatalf("status = %+v, want two files at a revision", status)
+	}
+	applied := status.Revision
+
+	// One valid and one invalid change in the same commit
+	writePipelineFile(t, remote, "app.yaml", "app", "make all")
+	os.WriteFile(filepath.Join(remote, "lib.yaml"), []byte("name: [broken"), 0644)
+	gitCommit(t, remote, "partly broken")
+
+	status = syncWatcher(t, w)
+	if status.Revision != applied || status.FailedRevision == "" {
+		t.Errorf("Revision = %q, FailedRevision = %q, want the revision rejected", status.Revision, status.FailedRevision)
+	}
+	pipeline, _ := engine.GetPipeline("app")
+	if got := pipeline.Stages[0].Steps[0].Command; got != "make" {
+		t.Errorf("Command = %q, valid changes in a rejected revision must not be applied", got)
+	}
+
+	writePipelineFile(t, remote, "lib.yaml", "lib", "make lib")
+	os.Remove(filepath.Join(remote, "app.yaml"))
+	gitCommit(t, remote, "fixed")
+
+	status = syncWatcher(t, w)
+	if status.FailedRevision != "" || status.Revision == applied {
+		t.Errorf("status = %+v, want the fixed revision applied", status)
+	}
+	if _, err := engine.GetPipeline("app"); err == nil {
+		t.Error("app should be deleted by the fixed revision")
+	}
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"sort"
+	"time"
+)
+
+// LoadTest is the result of a load test a step ran. Plugins report load
+// tests as their "loadTests" output and they are recorded on the job, so
+// their metrics can be charted across jobs.
+type LoadTest struct {
+	StepID string `json:"stepId"`
+	// Tool is the load testing tool, such as k6
+	Tool string `json:"tool"`
+	// Target is what was tested: a script or a URL
+	Target   string  `json:"target"`
+	Requests int64   `json:"requests"`
+	RPS      float64 `json:"rps"`
+	P50Ms    float64 `json:"p50Ms"`
+	P95Ms    float64 `json:"p95Ms"`
+	P99Ms    float64 `json:"p99Ms,omitempty"`
+	// ErrorRate is the share of failed requests, from 0 to 1
+	ErrorRate float64 `json:"errorRate"`
+	// Violations are the thresholds the test exceeded
+	Violations []string  `json:"violations,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+// LoadTestPoint is a load test of a job in a pipeline's trend
+type LoadTestPoint struct {
+	PipelineID string `json:"pipelineId"`
+	JobID      string `json:"jobId"`
+	LoadTest
+}
+
+// pluginLoadTests takes the load tests out of a plugin's outputs
+func pluginLoadTests(outputs map[string]interface{}) []LoadTest {
+	loadTests, ok := outputs["loadTests"].([]LoadTest)
+	if !ok {
+		return nil
+	}
+	delete(outputs, "loadTests")
+	return loadTests
+}
+
+// LoadTestTrend returns the load tests recorded on the jobs of a pipeline,
+// or of every pipeline when pipelineID is empty, oldest first. stepID
+// narrows them to one step.
+func (pe *PipelineEngine) LoadTestTrend(pipelineID, stepID string) []LoadTestPoint {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	points := []LoadTestPoint{}
+	for _, job := range pe.jobs {
+		if pipelineID != "" && job.PipelineID != pipelineID {
+			continue
+		}
+		for _, loadTest := range job.LoadTests {
+			if stepID != "" && loadTest.StepID != stepID {
+				continue
+			}
+			points = append(points, LoadTestPoint{PipelineID: job.PipelineID, JobID: job.ID, LoadTest: loadTest})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if !points[i].At.Equal(points[j].At) {
+			return points[i].At.Before(points[j].At)
+		}
+		return points[i].JobID < points[j].JobID
+	})
+	return points
+}
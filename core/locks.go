@@ -0,0 +1,257 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// resourceLock is a named lock on an external resource, such as a
+// database, held by one step at a time. Waiting steps get it in the order
+// they asked for it. released is closed and replaced whenever the holder
+// releases it.
+type resourceLock struct {
+	holder   *LockHolder
+	waiting  []*LockHolder
+	released chan struct{}
+}
+
+// LockHolder is a step holding or waiting for a lock
+type LockHolder struct {
+	JobID      string    `json:"jobId"`
+	PipelineID string    `json:"pipelineId"`
+	StepID     string    `json:"stepId"`
+	Since      time.Time `json:"since"`
+}
+
+// LockStatus reports the step holding a lock and the steps waiting for it
+type LockStatus struct {
+	Name    string       `json:"name"`
+	Holder  *LockHolder  `json:"holder,omitempty"`
+	Waiting []LockHolder `json:"waiting"`
+}
+
+// ValidateLocks checks a step's lock names, which may reference the
+// pipeline ID, trigger values and the revision, and its lock timeout
+func ValidateLocks(names []string, timeout string) error {
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("locks: empty lock name")
+		}
+		if seen[name] {
+			return fmt.Errorf("locks: %s is listed twice", name)
+		}
+		seen[name] = true
+		if err := validateStartReferences(name, "lock"); err != nil {
+			return err
+		}
+	}
+	if timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid lock timeout %q", timeout)
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("lock timeout without locks")
+		}
+	}
+	return nil
+}
+
+// acquireLocks waits until a step holds all its locks and returns the
+// function releasing them. Locks are taken in name order so steps taking
+// the same locks can't deadlock. It fails when the step's lock timeout
+// passes first or ctx is done.
+func (pe *PipelineEngine) acquireLocks(ctx context.Context, pipeline *Pipeline, job *Job, step Step) (func(), error) {
+	if len(step.Locks) == 0 {
+		return func() {}, nil
+	}
+	names := append([]string{}, step.Locks...)
+	sort.Strings(names)
+
+	if step.LockTimeout != "" {
+		timeout, err := time.ParseDuration(step.LockTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lock timeout %q", step.LockTimeout)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	holder := &LockHolder{JobID: job.ID, PipelineID: pipeline.ID, StepID: step.ID, Since: time.Now()}
+	held := make([]string, 0, len(names))
+	release := func() {
+		for _, name := range held {
+			pe.releaseLock(name, holder)
+		}
+	}
+	for _, name := range names {
+		if err := pe.acquireLock(ctx, name, holder, job); err != nil {
+			release()
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, fmt.Errorf("timed out after %s waiting for lock %s", step.LockTimeout, name)
+			}
+			return nil, err
+		}
+		held = append(held, name)
+	}
+	return release, nil
+}
+
+// acquireLock waits until a step holds a lock
+func (pe *PipelineEngine) acquireLock(ctx context.Context, name string, holder *LockHolder, job *Job) error {
+	pe.mu.Lock()
+	l, ok := pe.locks[name]
+	if !ok {
+		l = &resourceLock{released: make(chan struct{})}
+		pe.locks[name] = l
+	}
+	l.waiting = append(l.waiting, holder)
+	logged := false
+	for {
+		if l.holder == nil && l.waiting[0] == holder {
+			l.holder, l.waiting = holder, l.waiting[1:]
+			pe.mu.Unlock()
+			pe.emitLockEvent("lock.acquired", name, holder)
+			return nil
+		}
+		if !logged {
+			msg := fmt.Sprintf("Waiting in line for lock %s", name)
+			if l.holder != nil {
+				msg = fmt.Sprintf("Waiting for lock %s held by step %s of job %s", name, l.holder.StepID, l.holder.JobID)
+			}
+			pe.mu.Unlock()
+			pe.logJob(job, "info", holder.StepID, msg)
+			pe.mu.Lock()
+			logged = true
+			continue
+		}
+		released := l.released
+		pe.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			pe.mu.Lock()
+			for i, waiting := range l.waiting {
+				if waiting == holder {
+					l.waiting = append(l.waiting[:i:i], l.waiting[i+1:]...)
+					break
+				}
+			}
+			// The next step in line may take the lock now
+			close(l.released)
+			l.released = make(chan struct{})
+			pe.dropLock(name, l)
+			pe.mu.Unlock()
+			return ctx.Err()
+		case <-released:
+		}
+		pe.mu.Lock()
+	}
+}
+
+// releaseLock releases a lock if holder holds it
+func (pe *PipelineEngine) releaseLock(name string, holder *LockHolder) {
+	pe.mu.Lock()
+	l, ok := pe.locks[name]
+	if !ok || l.holder != holder {
+		pe.mu.Unlock()
+		return
+	}
+	l.holder = nil
+	close(l.released)
+	l.released = make(chan struct{})
+	pe.dropLock(name, l)
+	pe.mu.Unlock()
+
+	pe.emitLockEvent("lock.released", name, holder)
+}
+
+// dropLock forgets a lock no step holds or waits for. Callers must hold
+// pe.mu.
+func (pe *PipelineEngine) dropLock(name string, l *resourceLock) {
+	if l.holder == nil && len(l.waiting) == 0 && pe.locks[name] == l {
+		delete(pe.locks, name)
+	}
+}
+
+// emitLockEvent emits a lock event of a step
+func (pe *PipelineEngine) emitLockEvent(eventType, name string, holder *LockHolder) {
+	pe.emitEvent(Event{
+		Type:       eventType,
+		Timestamp:  time.Now(),
+		PipelineID: holder.PipelineID,
+		JobID:      holder.JobID,
+		Data: map[string]interface{}{
+			"lock":   name,
+			"stepId": holder.StepID,
+		},
+	})
+}
+
+// LockStep waits until the plugin step executing with ctx holds the named
+// lock, shared with the locks steps declare, and returns the function
+// releasing it. It fails when timeout, if positive, passes first. Outside a
+// step there is nothing to lock against and it returns at once.
+func LockStep(ctx context.Context, name string, timeout time.Duration) (func(), error) {
+	reporter, ok := ctx.Value(stepReporterKey{}).(*stepReporter)
+	if !ok {
+		return func() {}, nil
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	pe := reporter.engine
+	holder := &LockHolder{JobID: reporter.job.ID, PipelineID: reporter.pipelineID, StepID: reporter.stepID, Since: time.Now()}
+	if err := pe.acquireLock(ctx, name, holder, reporter.job); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("timed out after %s waiting for lock %s", timeout, name)
+		}
+		return nil, err
+	}
+	return func() { pe.releaseLock(name, holder) }, nil
+}
+
+// Locks returns the locks that are held or waited for
+func (pe *PipelineEngine) Locks() []LockStatus {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	locks := make([]LockStatus, 0, len(pe.locks))
+	for name, l := range pe.locks {
+		locks = append(locks, l.status(name))
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Name < locks[j].Name })
+	return locks
+}
+
+// Lock returns a lock's holder and queue. Locks no step holds or waits for
+// are free.
+func (pe *PipelineEngine) Lock(name string) LockStatus {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	if l, ok := pe.locks[name]; ok {
+		return l.status(name)
+	}
+	return LockStatus{Name: name, Waiting: []LockHolder{}}
+}
+
+// status returns a copy of the lock's holder and queue
+func (l *resourceLock) status(name string) LockStatus {
+	status := LockStatus{Name: name, Waiting: make([]LockHolder, 0, len(l.waiting))}
+	if l.holder != nil {
+		holder := *l.holder
+		status.Holder = &holder
+	}
+	for _, waiting := range l.waiting {
+		status.Waiting = append(status.Waiting, *waiting)
+	}
+	return status
+}
@@ -0,0 +1,102 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lockPipeline's step holds lock, appending its name to order.log when it
+// starts and finishes
+func lockPipeline(id, lock, timeout, sleep string) *Pipeline {
+	pipeline := scriptPipeline(id, "echo start-"+id+" >> order.log; sleep "+sleep+"; echo end-"+id+" >> order.log")
+	pipeline.Stages[0].Steps[0].Locks = []string{lock}
+	pipeline.Stages[0].Steps[0].LockTimeout = timeout
+	return pipeline
+}
+
+func TestLocks_SerializeStepsAcrossPipelines(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	engine.CreatePipeline(lockPipeline("migrate-api", "staging-db", "", "0.3"))
+	engine.CreatePipeline(lockPipeline("migrate-billing", "staging-db", "", "0"))
+
+	first, err := engine.Start(context.Background(), "migrate-api")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for engine.Lock("staging-db").Holder == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	second, err := engine.Start(context.Background(), "migrate-billing")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	for len(engine.Lock("staging-db").Waiting) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	lock := engine.Lock("staging-db")
+	if lock.Holder == nil || lock.Holder.JobID != first.ID || len(lock.Waiting) != 1 || lock.Waiting[0].PipelineID != "migrate-billing" {
+		t.Errorf("Lock() = %+v, want held by job %s with migrate-billing waiting", lock, first.ID)
+	}
+
+	waitForJob(t, engine, "migrate-api", first.ID, StatusSuccess)
+	waitForJob(t, engine, "migrate-billing", second.ID, StatusSuccess)
+	data, _ := os.ReadFile(filepath.Join(dir, "order.log"))
+	if got := strings.Join(strings.Fields(string(data)), " "); got != "start-migrate-api end-migrate-api start-migrate-billing end-migrate-billing" {
+		t.Errorf("order = %s, want the steps to run one after the other", got)
+	}
+	if locks := engine.Locks(); len(locks) != 0 {
+		t.Errorf("Locks() = %+v, want none once the steps finished", locks)
+	}
+}
+
+func TestLocks_Timeout(t *testing.T) {
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: t.TempDir()}))
+	engine.CreatePipeline(lockPipeline("deploy", "staging-db", "", "0.5"))
+	engine.CreatePipeline(lockPipeline("migrate", "staging-db", "50ms", "0"))
+
+	holder, err := engine.Start(context.Background(), "deploy")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for engine.Lock("staging-db").Holder == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	job, err := engine.Run(context.Background(), "migrate")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusFailed || !strings.Contains(job.Logs[len(job.Logs)-1].Message, "timed out after 50ms waiting for lock staging-db") {
+		t.Errorf("Run() = %s %+v, want failed waiting for the lock", job.Status, job.Logs)
+	}
+	if lock := engine.Lock("staging-db"); len(lock.Waiting) != 0 {
+		t.Errorf("Lock() = %+v, want the timed out step out of the queue", lock)
+	}
+	waitForJob(t, engine, "deploy", holder.ID, StatusSuccess)
+}
+
+func TestValidateLocks(t *testing.T) {
+	if err := ValidateLocks([]string{"db-${{ trigger.env }}", "queue"}, "10m"); err != nil {
+		t.Errorf("ValidateLocks() error = %v", err)
+	}
+	for _, tt := range []struct {
+		names   []string
+		timeout string
+	}{
+		{names: []string{" "}},
+		{names: []string{"db", "db"}},
+		{names: []string{"db-${{ steps.x }}"}},
+		{names: []string{"db"}, timeout: "soon"},
+		{timeout: "1m"},
+	} {
+		if err := ValidateLocks(tt.names, tt.timeout); err == nil {
+			t.Errorf("ValidateLocks(%q, %q) error = nil, want error", tt.names, tt.timeout)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/chip/conveyor/core/cron"
+)
+
+// maxMaintenancePeriods bounds the periods listed for a recurring window
+const maxMaintenancePeriods = 100
+
+var maintenanceCounter uint64
+
+// ErrMaintenanceNotFound is returned for unknown maintenance windows and
+// held triggers
+var ErrMaintenanceNotFound = errors.New("not found")
+
+// MaintenanceWindow is a period during which scheduled and webhook triggers
+// are held instead of starting jobs, for one pipeline or, without a
+// PipelineID, for all of them. An ad-hoc window runs from Start to End, a
+// recurring window for Duration each time its Cron expression fires.
+type MaintenanceWindow struct {
+	ID         string     `json:"id"`
+	PipelineID string     `json:"pipelineId,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	Start      *time.Time `json:"start,omitempty"`
+	End        *time.Time `json:"end,omitempty"`
+	Cron       string     `json:"cron,omitempty"`
+	// Timezone is the IANA time zone Cron is read in. Defaults to the
+	// engine's schedule time zone.
+	Timezone  string    `json:"timezone,omitempty"`
+	Duration  string    `json:"duration,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// MaintenancePeriod is one occurrence of a maintenance window
+type MaintenancePeriod struct {
+	WindowID   string    `json:"windowId"`
+	PipelineID string    `json:"pipelineId,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+}
+
+// HeldTrigger is a trigger held during a maintenance window, started when
+// the window closes or when held triggers are flushed
+type HeldTrigger struct {
+	ID         string            `json:"id"`
+	PipelineID string            `json:"pipelineId"`
+	Source     string            `json:"source"`
+	Trigger    map[string]string `json:"trigger,omitempty"`
+	Revision   *Revision         `json:"revision,omitempty"`
+	NoCache    bool              `json:"noCache,omitempty"`
+	// TriggeredBy is who started the held run
+	TriggeredBy string `json:"triggeredBy,omitempty"`
+	// Upstream is the job a held pipeline-completed trigger is for
+	Upstream *UpstreamJob `json:"upstream,omitempty"`
+	// Skipped are the commits a debounced trigger skipped
+	Skipped  []string  `json:"skipped,omitempty"`
+	WindowID string    `json:"windowId"`
+	HeldAt   time.Time `json:"heldAt"`
+	// Until is when a debounced trigger starts. Triggers held by a
+	// maintenance window have a WindowID instead.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// MaintenanceState is what a MaintenanceStore keeps
+type MaintenanceState struct {
+	Windows []*MaintenanceWindow `json:"windows"`
+	Held    []*HeldTrigger       `json:"held"`
+}
+
+// MaintenanceStore stores maintenance windows and held triggers. When the
+// engine's Store also implements MaintenanceStore, they survive restarts.
+type MaintenanceStore interface {
+	SaveMaintenance(state *MaintenanceState) error
+	LoadMaintenance() (*MaintenanceState, error)
+}
+
+// ValidateMaintenanceWindow checks that a window is either ad-hoc, with an
+// end after its start, or recurring, with a cron expression and a positive
+// duration
+func ValidateMaintenanceWindow(window *MaintenanceWindow) error {
+	adHoc := window.Start != nil || window.End != nil
+	recurring := window.Cron != "" || window.Duration != ""
+	switch {
+	case adHoc && recurring:
+		return fmt.Errorf("maintenance window needs either start and end or cron and duration, not both")
+	case adHoc && window.Timezone != "":
+		return fmt.Errorf("maintenance window timezone only applies to cron windows")
+	case adHoc:
+		if window.Start == nil || window.End == nil || !window.End.After(*window.Start) {
+			return fmt.Errorf("maintenance window needs a start and an end after it")
+		}
+	case recurring:
+		if _, err := cron.Parse(window.Cron); err != nil {
+			return err
+		}
+		if err := ValidateTimezone(window.Timezone); err != nil {
+			return err
+		}
+		if duration, err := time.ParseDuration(window.Duration); err != nil || duration <= 0 {
+			return fmt.Errorf("invalid maintenance window duration %q", window.Duration)
+		}
+	default:
+		return fmt.Errorf("maintenance window needs start and end, or cron and duration")
+	}
+	return nil
+}
+
+// periods returns the occurrences of a window that end after from and start
+// before to. A recurring window without a time zone fires in loc.
+func (w *MaintenanceWindow) periods(from, to time.Time, loc *time.Location) []MaintenancePeriod {
+	period := func(start, end time.Time) MaintenancePeriod {
+		return MaintenancePeriod{WindowID: w.ID, PipelineID: w.PipelineID, Reason: w.Reason, Start: start, End: end}
+	}
+	if w.Start != nil && w.End != nil {
+		if w.End.After(from) && w.Start.Before(to) {
+			return []MaintenancePeriod{period(*w.Start, *w.End)}
+		}
+		return nil
+	}
+	schedule, err := cron.Parse(w.Cron)
+	if err != nil {
+		return nil
+	}
+	duration, err := time.ParseDuration(w.Duration)
+	if err != nil || duration <= 0 {
+		return nil
+	}
+	if w.Timezone != "" {
+		if zone, err := time.LoadLocation(w.Timezone); err == nil {
+			loc = zone
+		}
+	}
+	var periods []MaintenancePeriod
+	for start := schedule.Next(from.Add(-duration).In(loc)); start.Before(to) && len(periods) < maxMaintenancePeriods; start = schedule.Next(start) {
+		periods = append(periods, period(start.UTC(), start.Add(duration).UTC()))
+	}
+	return periods
+}
+
+// appliesTo reports whether a window covers a pipeline
+func (w *MaintenanceWindow) appliesTo(pipelineID string) bool {
+	return w.PipelineID == "" || w.PipelineID == pipelineID
+}
+
+// CreateMaintenanceWindow validates and adds a maintenance window
+func (pe *PipelineEngine) CreateMaintenanceWindow(window *MaintenanceWindow) (*MaintenanceWindow, error) {
+	if err := ValidateMaintenanceWindow(window); err != nil {
+		return nil, err
+	}
+	created := *window
+	created.ID = fmt.Sprintf("maintenance-%d-%d", time.Now().Unix(), atomic.AddUint64(&maintenanceCounter, 1))
+	created.CreatedAt = time.Now()
+	if created.Start != nil && created.End != nil {
+		start, end := created.Start.UTC(), created.End.UTC()
+		created.Start, created.End = &start, &end
+	}
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	if created.PipelineID != "" {
+		if _, ok := pe.pipelines[created.PipelineID]; !ok {
+			return nil, fmt.Errorf("pipeline %s not found", created.PipelineID)
+		}
+	}
+	pe.maintenance = append(pe.maintenance, &created)
+	pe.saveMaintenance()
+	return &created, nil
+}
+
+// DeleteMaintenanceWindow removes a maintenance window. Triggers it held
+// stay held until they are flushed.
+func (pe *PipelineEngine) DeleteMaintenanceWindow(id string) error {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	for i, window := range pe.maintenance {
+		if window.ID == id {
+			pe.maintenance = append(pe.maintenance[:i], pe.maintenance[i+1:]...)
+			pe.saveMaintenance()
+			return nil
+		}
+	}
+	return fmt.Errorf("maintenance window %s %w", id, ErrMaintenanceNotFound)
+}
+
+// MaintenanceWindows returns the maintenance windows covering a pipeline,
+// or all of them when pipelineID is empty
+func (pe *PipelineEngine) MaintenanceWindows(pipelineID string) []MaintenanceWindow {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	windows := make([]MaintenanceWindow, 0, len(pe.maintenance))
+	for _, window := range pe.maintenance {
+		if pipelineID == "" || window.appliesTo(pipelineID) {
+			windows = append(windows, *window)
+		}
+	}
+	return windows
+}
+
+// UpcomingMaintenance returns the maintenance periods between from and to,
+// including those already open at from, covering a pipeline or, when
+// pipelineID is empty, any pipeline, sorted by start
+func (pe *PipelineEngine) UpcomingMaintenance(pipelineID string, from, to time.Time) []MaintenancePeriod {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	periods := []MaintenancePeriod{}
+	for _, window := range pe.maintenance {
+		if pipelineID == "" || window.appliesTo(pipelineID) {
+			periods = append(periods, window.periods(from, to, pe.scheduleLocation)...)
+		}
+	}
+	sort.Slice(periods, func(i, j int) bool {
+		return periods[i].Start.Before(periods[j].Start)
+	})
+	return periods
+}
+
+// activeMaintenance returns the open maintenance period covering a pipeline
+// at now that ends last, or nil. Callers must hold pe.mu.
+func (pe *PipelineEngine) activeMaintenance(pipelineID string, now time.Time) *MaintenancePeriod {
+	var active *MaintenancePeriod
+	for _, window := range pe.maintenance {
+		if !window.appliesTo(pipelineID) {
+			continue
+		}
+		for _, period := range window.periods(now, now.Add(time.Nanosecond), pe.scheduleLocation) {
+			if active == nil || period.End.After(active.End) {
+				p := period
+				active = &p
+			}
+		}
+	}
+	return active
+}
+
+// holds reports whether triggers from source are held by maintenance
+// windows; manual runs never are
+func holds(source string) bool {
+	return source == TriggerSchedule || source == TriggerWebhook || source == TriggerPipelineCompleted
+}
+
+// Dispatch starts a pipeline like Start, unless the run comes from a
+// scheduled or webhook trigger while a maintenance window covers the
+// pipeline, or from a webhook a trigger of the pipeline debounces. Then the
+// trigger is held, and returned instead of a job.
+func (pe *PipelineEngine) Dispatch(ctx context.Context, pipelineID string, opts ...RunOption) (*Job, *HeldTrigger, error) {
+	if held := pe.debounce(pipelineID, newRunConfig(opts)); held != nil {
+		pe.logger.Printf("Debounced %s trigger %s of pipeline %s until %s", held.Source, held.ID, pipelineID, held.Until.Format(time.RFC3339))
+		return nil, held, nil
+	}
+	return pe.dispatch(ctx, pipelineID, opts...)
+}
+
+// dispatch starts a pipeline like Start, or holds the trigger while a
+// maintenance window covers the pipeline
+func (pe *PipelineEngine) dispatch(ctx context.Context, pipelineID string, opts ...RunOption) (*Job, *HeldTrigger, error) {
+	rc := newRunConfig(opts)
+	if holds(rc.source) {
+		pe.mu.Lock()
+		_, exists := pe.pipelines[pipelineID]
+		period := pe.activeMaintenance(pipelineID, time.Now())
+		if exists && period != nil {
+			held := &HeldTrigger{
+				ID:          fmt.Sprintf("held-%d-%d", time.Now().Unix(), atomic.AddUint64(&maintenanceCounter, 1)),
+				PipelineID:  pipelineID,
+				Source:      rc.source,
+				Trigger:     rc.trigger,
+				Revision:    rc.revision,
+				NoCache:     rc.noCache,
+				TriggeredBy: rc.triggeredBy,
+				Upstream:    rc.upstream,
+				Skipped:     rc.skipped,
+				WindowID:    period.WindowID,
+				HeldAt:      time.Now(),
+			}
+			pe.heldTriggers = append(pe.heldTriggers, held)
+			pe.saveMaintenance()
+			pe.mu.Unlock()
+			pe.logger.Printf("Held %s trigger of pipeline %s until maintenance window %s closes at %s", rc.source, pipelineID, period.WindowID, period.End.Format(time.RFC3339))
+			copied := *held
+			return nil, &copied, nil
+		}
+		pe.mu.Unlock()
+	}
+	job, err := pe.Start(ctx, pipelineID, opts...)
+	return job, nil, err
+}
+
+// HeldTriggers returns the held triggers of a pipeline, or all of them when
+// pipelineID is empty, oldest first
+func (pe *PipelineEngine) HeldTriggers(pipelineID string) []HeldTrigger {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	held := make([]HeldTrigger, 0, len(pe.heldTriggers))
+	for _, trigger := range pe.heldTriggers {
+		if pipelineID == "" || trigger.PipelineID == pipelineID {
+			held = append(held, *trigger)
+		}
+	}
+	return held
+}
+
+// DiscardHeldTrigger drops a held trigger without starting it
+func (pe *PipelineEngine) DiscardHeldTrigger(id string) error {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	for i, trigger := range pe.heldTriggers {
+		if trigger.ID == id {
+			pe.heldTriggers = append(pe.heldTriggers[:i], pe.heldTriggers[i+1:]...)
+			pe.saveMaintenance()
+			return nil
+		}
+	}
+	return fmt.Errorf("held trigger %s %w", id, ErrMaintenanceNotFound)
+}
+
+// FlushHeldTriggers starts the held triggers of a pipeline, or of all
+// pipelines when pipelineID is empty, in the order they were held. Triggers
+// of pipelines still in a maintenance window stay held unless force is set.
+// It returns the started jobs.
+func (pe *PipelineEngine) FlushHeldTriggers(ctx context.Context, pipelineID string, force bool) ([]*Job, error) {
+	now := time.Now()
+	pe.mu.Lock()
+	var flushed, kept []*HeldTrigger
+	for _, trigger := range pe.heldTriggers {
+		if pipelineID != "" && trigger.PipelineID != pipelineID || !force && pe.activeMaintenance(trigger.PipelineID, now) != nil {
+			kept = append(kept, trigger)
+			continue
+		}
+		flushed = append(flushed, trigger)
+	}
+	if len(flushed) == 0 {
+		pe.mu.Unlock()
+		return nil, nil
+	}
+	pe.heldTriggers = kept
+	pe.saveMaintenance()
+	pe.mu.Unlock()
+
+	jobs := make([]*Job, 0, len(flushed))
+	var errs []string
+	for _, trigger := range flushed {
+		job, err := pe.Start(ctx, trigger.PipelineID, trigger.runOptions()...)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", trigger.ID, err))
+			continue
+		}
+		pe.logger.Printf("Started held %s trigger %s of pipeline %s as job %s", trigger.Source, trigger.ID, trigger.PipelineID, job.ID)
+		jobs = append(jobs, job)
+	}
+	if len(errs) > 0 {
+		return jobs, fmt.Errorf("failed to start held triggers: %v", errs)
+	}
+	return jobs, nil
+}
+
+// runOptions returns the options of the run a held trigger starts
+func (h *HeldTrigger) runOptions() []RunOption {
+	opts := []RunOption{WithSource(h.Source), WithTrigger(h.Trigger)}
+	if h.Revision != nil {
+		opts = append(opts, WithRevision(*h.Revision))
+	}
+	if h.NoCache {
+		opts = append(opts, WithoutCache())
+	}
+	if h.TriggeredBy != "" {
+		opts = append(opts, WithTriggeredBy(h.TriggeredBy))
+	}
+	if h.Upstream != nil {
+		opts = append(opts, WithUpstream(*h.Upstream))
+	}
+	if len(h.Skipped) > 0 {
+		opts = append(opts, withSkippedCommits(h.Skipped))
+	}
+	return opts
+}
+
+// RestoreMaintenance loads the maintenance windows and held triggers kept
+// by the engine's store
+func (pe *PipelineEngine) RestoreMaintenance() error {
+	store, ok := pe.store.(MaintenanceStore)
+	if !ok {
+		return nil
+	}
+	state, err := store.LoadMaintenance()
+	if err != nil {
+		return err
+	}
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.maintenance = state.Windows
+	pe.heldTriggers = state.Held
+	return nil
+}
+
+// saveMaintenance stores the maintenance windows and held triggers, when
+// the store keeps them. Callers must hold pe.mu.
+func (pe *PipelineEngine) saveMaintenance() {
+	store, ok := pe.store.(MaintenanceStore)
+	if !ok {
+		return
+	}
+	state := &MaintenanceState{Windows: pe.maintenance, Held: pe.heldTriggers}
+	if err := store.SaveMaintenance(state); err != nil {
+		pe.logger.Printf("Failed to save maintenance windows: %v", err)
+	}
+}
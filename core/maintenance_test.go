@@ -0,0 +1,166 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDispatch_HoldsTriggersDuringMaintenance(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := newTestEngine(WithStore(store))
+	engine.CreatePipeline(scriptPipeline("deploy", "echo deploy"))
+	start, end := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	window, err := engine.CreateMaintenanceWindow(&MaintenanceWindow{Start: &start, End: &end, Reason: "database upgrade"})
+	if err != nil {
+		t.Fatalf("CreateMaintenanceWindow() error = %v", err)
+	}
+
+	job, held, err := engine.Dispatch(context.Background(), "deploy", WithSource(TriggerWebhook), WithTrigger(map[string]string{"pr": "42"}))
+	if err != nil || job != nil || held == nil || held.WindowID != window.ID {
+		t.Fatalf("Dispatch(webhook) = %v, %+v, %v, want the trigger held", job, held, err)
+	}
+	manual, held, _ := engine.Dispatch(context.Background(), "deploy")
+	if manual == nil || held != nil {
+		t.Fatalf("Dispatch(manual) = %v, %+v, want a job", manual, held)
+	}
+	engine.WaitJob(context.Background(), manual.ID, func(job *Job) bool { return job.Status.IsTerminal() })
+
+	if jobs, err := engine.FlushHeldTriggers(context.Background(), "", false); err != nil || len(jobs) != 0 {
+		t.Errorf("FlushHeldTriggers() = %v, %v, want nothing started during the window", jobs, err)
+	}
+
+	restored := newTestEngine(WithStore(store))
+	restored.CreatePipeline(scriptPipeline("deploy", "echo deploy"))
+	if err := restored.RestoreMaintenance(); err != nil {
+		t.Fatalf("RestoreMaintenance() error = %v", err)
+	}
+	if len(restored.MaintenanceWindows("deploy")) != 1 || len(restored.HeldTriggers("deploy")) != 1 {
+		t.Fatalf("restored windows %+v and held triggers %+v, want one each", restored.MaintenanceWindows(""), restored.HeldTriggers(""))
+	}
+
+	if err := restored.DeleteMaintenanceWindow(window.ID); err != nil {
+		t.Fatalf("DeleteMaintenanceWindow() error = %v", err)
+	}
+	jobs, err := restored.FlushHeldTriggers(context.Background(), "", false)
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("FlushHeldTriggers() = %v, %v, want the held trigger started", jobs, err)
+	}
+	if jobs[0].Metadata["source"] != TriggerWebhook || triggerValues(jobs[0].Metadata)["pr"] != "42" {
+		t.Errorf("job metadata = %v, want the held trigger's source and values", jobs[0].Metadata)
+	}
+	if held := restored.HeldTriggers(""); len(held) != 0 {
+		t.Errorf("HeldTriggers() = %+v, want none after the flush", held)
+	}
+	restored.WaitJob(context.Background(), jobs[0].ID, func(job *Job) bool { return job.Status.IsTerminal() })
+}
+
+func TestUpcomingMaintenance_RecurringWindow(t *testing.T) {
+	engine := newTestEngine(WithScheduleLocation(time.UTC))
+	engine.CreatePipeline(scriptPipeline("deploy", "echo deploy"))
+	engine.CreatePipeline(scriptPipeline("docs", "echo docs"))
+	if _, err := engine.CreateMaintenanceWindow(&MaintenanceWindow{PipelineID: "deploy", Cron: "0 2 * * *", Duration: "2h"}); err != nil {
+		t.Fatalf("CreateMaintenanceWindow() error = %v", err)
+	}
+
+	from := time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)
+	periods := engine.UpcomingMaintenance("deploy", from, from.Add(48*time.Hour))
+	var starts []string
+	for _, period := range periods {
+		starts = append(starts, period.Start.Format("Jan 2 15:04"))
+	}
+	if got := strings.Join(starts, ", "); got != "Jan 1 02:00, Jan 2 02:00, Jan 3 02:00" {
+		t.Errorf("periods start at %s, want the open one and the next two", got)
+	}
+	if periods := engine.UpcomingMaintenance("docs", from, from.Add(48*time.Hour)); len(periods) != 0 {
+		t.Errorf("UpcomingMaintenance(docs) = %+v, want none", periods)
+	}
+}
+
+func TestUpcomingMaintenance_Timezone(t *testing.T) {
+	if _, err := time.LoadLocation("America/Chicago"); err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+	engine := newTestEngine(WithScheduleLocation(time.UTC))
+	if _, err := engine.CreateMaintenanceWindow(&MaintenanceWindow{Cron: "0 2 * * *", Timezone: "America/Chicago", Duration: "1h"}); err != nil {
+		t.Fatalf("CreateMaintenanceWindow() error = %v", err)
+	}
+
+	// Daylight saving time starts on 10 March 2024, skipping 02:00
+	from := time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC)
+	var starts []string
+	for _, period := range engine.UpcomingMaintenance("", from, from.Add(72*time.Hour)) {
+		starts = append(starts, period.Start.Format("Jan 2 15:04 MST"))
+	}
+	if got := strings.Join(starts, ", "); got != "Mar 9 08:00 UTC, Mar 10 08:00 UTC, Mar 11 07:00 UTC" {
+		t.Errorf("periods start at %s, want 02:00 Chicago time in UTC", got)
+	}
+}
+
+func TestRunSchedules_Timezone(t *testing.T) {
+	if _, err := time.LoadLocation("America/Chicago"); err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+	engine := newTestEngine(WithScheduleLocation(time.UTC))
+	pipeline := scriptPipeline("nightly", "echo build")
+	pipeline.Triggers = []Trigger{{Type: TriggerSchedule, Cron: "0 2 * * *", Timezone: "America/Chicago"}, {Type: TriggerSchedule, Cron: "0 2 * * *"}}
+	engine.CreatePipeline(pipeline)
+
+	engine.runSchedules(context.Background(), time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC))
+	want := map[string]time.Time{
+		"nightly#0#0 2 * * *#America/Chicago": time.Date(2024, 3, 10, 8, 0, 0, 0, time.UTC),
+		"nightly#1#0 2 * * *#":                time.Date(2024, 3, 10, 2, 0, 0, 0, time.UTC),
+	}
+	for key, at := range want {
+		if got := engine.scheduleNext[key]; !got.Equal(at) || got.Location() != time.UTC {
+			t.Errorf("next run of %s = %v, want %v", key, got, at)
+		}
+	}
+}
+
+func TestRunSchedules_HeldDuringMaintenance(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("nightly", "echo build")
+	pipeline.Triggers = []Trigger{{Type: TriggerSchedule, Cron: "* * * * *"}}
+	engine.CreatePipeline(pipeline)
+	if _, err := engine.CreateMaintenanceWindow(&MaintenanceWindow{PipelineID: "nightly", Cron: "* * * * *", Duration: "1h"}); err != nil {
+		t.Fatalf("CreateMaintenanceWindow() error = %v", err)
+	}
+
+	now := time.Now()
+	engine.runSchedules(context.Background(), now)
+	if held := engine.HeldTriggers(""); len(held) != 0 {
+		t.Fatalf("HeldTriggers() = %+v, want no run before the schedule is due", held)
+	}
+	engine.runSchedules(context.Background(), now.Add(2*time.Minute))
+	held := engine.HeldTriggers("nightly")
+	if len(held) != 1 || held[0].Source != TriggerSchedule {
+		t.Fatalf("HeldTriggers() = %+v, want the scheduled run held", held)
+	}
+	if jobs, _ := engine.ListJobs("nightly"); len(jobs) != 0 {
+		t.Errorf("ListJobs() = %d jobs, want none during maintenance", len(jobs))
+	}
+}
+
+func TestValidateMaintenanceWindow(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Hour)
+	for _, window := range []*MaintenanceWindow{
+		{},
+		{Start: &now},
+		{Start: &later, End: &now},
+		{Cron: "0 2 * * *"},
+		{Cron: "nightly", Duration: "1h"},
+		{Start: &now, End: &later, Cron: "0 2 * * *", Duration: "1h"},
+		{Start: &now, End: &later, Timezone: "UTC"},
+		{Cron: "0 2 * * *", Timezone: "Mars/Olympus_Mons", Duration: "1h"},
+	} {
+		if err := ValidateMaintenanceWindow(window); err == nil {
+			t.Errorf("ValidateMaintenanceWindow(%+v) expected error, got nil", window)
+		}
+	}
+}
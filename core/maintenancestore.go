@@ -0,0 +1,42 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SaveMaintenance writes the maintenance windows and held triggers to
+// maintenance.json
+func (s *FileStore) SaveMaintenance(state *MaintenanceState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode maintenance windows: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return writeFileAtomic(filepath.Join(s.dir, "maintenance.json"), data)
+}
+
+// LoadMaintenance reads maintenance.json, which is empty when it doesn't
+// exist yet
+func (s *FileStore) LoadMaintenance() (*MaintenanceState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := &MaintenanceState{}
+	data, err := os.ReadFile(filepath.Join(s.dir, "maintenance.json"))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read maintenance windows: %w", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to decode maintenance windows: %w", err)
+	}
+	return state, nil
+}
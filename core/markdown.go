@@ -0,0 +1,141 @@
+package core
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// markdownInline matches the inline Markdown RenderMarkdown supports: code
+// spans, links, strong and emphasized text
+var markdownInline = regexp.MustCompile("`([^`]+)`|\\[([^\\]]+)\\]\\(([^)\\s]+)\\)|\\*\\*([^*]+)\\*\\*|__([^_]+)__|\\*([^*]+)\\*|\\b_([^_]+)_\\b")
+
+var (
+	markdownHeading  = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	markdownBullet   = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	markdownNumbered = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	markdownRule     = regexp.MustCompile(`^(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+)
+
+// RenderMarkdown renders the common subset of Markdown pipeline readmes
+// use as HTML: headings, paragraphs, lists, block quotes, rules, fenced
+// code, code spans, links, and strong and emphasized text. Raw HTML is
+// escaped, and links other than http(s), mailto and relative ones are
+// dropped.
+func RenderMarkdown(source string) string {
+	var b strings.Builder
+	lines := strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n")
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			fmt.Fprintf(&b, "<p>%s</p>\n", renderInline(strings.Join(paragraph, "\n")))
+			paragraph = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			flush()
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			flush()
+			fence := trimmed[:3]
+			language := strings.TrimSpace(trimmed[3:])
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				code = append(code, lines[i])
+			}
+			class := ""
+			if language != "" {
+				class = fmt.Sprintf(` class="language-%s"`, html.EscapeString(strings.Fields(language)[0]))
+			}
+			fmt.Fprintf(&b, "<pre><code%s>%s</code></pre>\n", class, html.EscapeString(strings.Join(code, "\n")))
+		case markdownHeading.MatchString(trimmed):
+			flush()
+			match := markdownHeading.FindStringSubmatch(trimmed)
+			level := len(match[1])
+			fmt.Fprintf(&b, "<h%d>%s</h%d>\n", level, renderInline(match[2]), level)
+		case markdownRule.MatchString(trimmed):
+			flush()
+			b.WriteString("<hr>\n")
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote = append(quote, strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">"), " "))
+			}
+			i--
+			fmt.Fprintf(&b, "<blockquote>\n%s</blockquote>\n", RenderMarkdown(strings.Join(quote, "\n")))
+		case markdownBullet.MatchString(line) || markdownNumbered.MatchString(line):
+			flush()
+			item, tag := markdownBullet, "ul"
+			if !markdownBullet.MatchString(line) {
+				item, tag = markdownNumbered, "ol"
+			}
+			fmt.Fprintf(&b, "<%s>\n", tag)
+			for ; i < len(lines) && item.MatchString(lines[i]); i++ {
+				fmt.Fprintf(&b, "<li>%s</li>\n", renderInline(item.FindStringSubmatch(lines[i])[1]))
+			}
+			i--
+			fmt.Fprintf(&b, "</%s>\n", tag)
+		default:
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+	flush()
+	return b.String()
+}
+
+// renderInline renders the inline Markdown of a block as HTML
+func renderInline(text string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range markdownInline.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(html.EscapeString(text[last:m[0]]))
+		last = m[1]
+		group := func(n int) string { return text[m[2*n]:m[2*n+1]] }
+		switch {
+		case m[2] >= 0:
+			fmt.Fprintf(&b, "<code>%s</code>", html.EscapeString(group(1)))
+		case m[4] >= 0:
+			label, link := renderInline(group(2)), group(3)
+			if safeLink(link) {
+				fmt.Fprintf(&b, `<a href="%s">%s</a>`, html.EscapeString(link), label)
+			} else {
+				b.WriteString(label)
+			}
+		case m[8] >= 0 || m[10] >= 0:
+			n := 4
+			if m[8] < 0 {
+				n = 5
+			}
+			fmt.Fprintf(&b, "<strong>%s</strong>", renderInline(group(n)))
+		default:
+			n := 6
+			if m[12] < 0 {
+				n = 7
+			}
+			fmt.Fprintf(&b, "<em>%s</em>", renderInline(group(n)))
+		}
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String()
+}
+
+// safeLink reports whether a link can be rendered: http(s) and mailto
+// links, and relative ones
+func safeLink(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "", "http", "https", "mailto":
+		return true
+	}
+	return false
+}
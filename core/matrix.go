@@ -0,0 +1,337 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// maxMatrixSteps bounds the combinations of a matrix
+const maxMatrixSteps = 256
+
+// matrixAxisName matches the names of matrix axes, which references use as
+// ${{ matrix.<name> }}
+var matrixAxisName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// matrixIDUnsafe matches the characters of matrix values left out of the
+// IDs of expanded steps
+var matrixIDUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Matrix expands a step into one step per combination of the values of its
+// axes, such as go versions × operating systems. Combinations matching an
+// entry of Exclude on all of the entry's axes are left out. The expanded
+// steps run concurrently, at most MaxParallel at a time when it is
+// positive.
+type Matrix struct {
+	Axes        []MatrixAxis        `json:"axes"`
+	Exclude     []map[string]string `json:"exclude,omitempty"`
+	MaxParallel int                 `json:"maxParallel,omitempty"`
+}
+
+// MatrixAxis is a named dimension of a matrix and its values
+type MatrixAxis struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+// matrixCell is the combination of matrix values an expanded step runs
+// with
+type matrixCell struct {
+	// of is the ID of the step the matrix expanded
+	of          string
+	values      map[string]string
+	maxParallel int
+}
+
+// origin returns the ID of the step a matrix step was expanded from, or ""
+// for other steps
+func (c *matrixCell) origin() string {
+	if c == nil {
+		return ""
+	}
+	return c.of
+}
+
+// combination returns the matrix values of an expanded step
+func (c *matrixCell) combination() map[string]string {
+	if c == nil {
+		return nil
+	}
+	return c.values
+}
+
+// stepMatrix returns the matrix of a step, combining the axes of its
+// stage's matrix with its own, or nil when neither has one
+func stepMatrix(stage Stage, step Step) *Matrix {
+	switch {
+	case stage.Matrix == nil:
+		return step.Matrix
+	case step.Matrix == nil:
+		return stage.Matrix
+	}
+	combined := Matrix{
+		Axes:        append(append([]MatrixAxis(nil), stage.Matrix.Axes...), step.Matrix.Axes...),
+		Exclude:     append(append([]map[string]string(nil), stage.Matrix.Exclude...), step.Matrix.Exclude...),
+		MaxParallel: step.Matrix.MaxParallel,
+	}
+	if combined.MaxParallel == 0 {
+		combined.MaxParallel = stage.Matrix.MaxParallel
+	}
+	return &combined
+}
+
+// ValidateMatrix checks the axes and exclusions of the matrix of a step
+// combined with its stage's, either of which may be nil
+func ValidateMatrix(stage, step *Matrix) error {
+	m := stepMatrix(Stage{Matrix: stage}, Step{Matrix: step})
+	if m == nil {
+		return nil
+	}
+	return m.validate()
+}
+
+// validate checks the axes and exclusions of a matrix, and that it has at
+// most maxMatrixSteps combinations and excludes fewer than all of them
+func (m *Matrix) validate() error {
+	if len(m.Axes) == 0 {
+		return fmt.Errorf("matrix has no axes")
+	}
+	names := make(map[string]bool, len(m.Axes))
+	for _, axis := range m.Axes {
+		if !matrixAxisName.MatchString(axis.Name) {
+			return fmt.Errorf("invalid matrix axis name %q", axis.Name)
+		}
+		if names[axis.Name] {
+			return fmt.Errorf("matrix axis %s is defined twice", axis.Name)
+		}
+		names[axis.Name] = true
+		if len(axis.Values) == 0 {
+			return fmt.Errorf("matrix axis %s has no values", axis.Name)
+		}
+		seen := make(map[string]bool, len(axis.Values))
+		for _, value := range axis.Values {
+			if strings.TrimSpace(value) == "" {
+				return fmt.Errorf("matrix axis %s has an empty value", axis.Name)
+			}
+			if seen[value] {
+				return fmt.Errorf("matrix axis %s lists %q twice", axis.Name, value)
+			}
+			seen[value] = true
+		}
+	}
+	for _, exclude := range m.Exclude {
+		for name := range exclude {
+			if !names[name] {
+				return fmt.Errorf("matrix exclude names unknown axis %s", name)
+			}
+		}
+	}
+	if m.MaxParallel < 0 {
+		return fmt.Errorf("matrix maxParallel must not be negative")
+	}
+
+	size := 1
+	for _, axis := range m.Axes {
+		size *= len(axis.Values)
+		if size > maxMatrixSteps {
+			return fmt.Errorf("matrix has more than %d combinations", maxMatrixSteps)
+		}
+	}
+	if len(m.combinations()) == 0 {
+		return fmt.Errorf("matrix excludes every combination")
+	}
+	return nil
+}
+
+// combinations returns the combinations of the matrix's values that aren't
+// excluded, varying the last axis fastest
+func (m *Matrix) combinations() [][]string {
+	combos := [][]string{nil}
+	for _, axis := range m.Axes {
+		next := make([][]string, 0, len(combos)*len(axis.Values))
+		for _, combo := range combos {
+			for _, value := range axis.Values {
+				next = append(next, append(append([]string(nil), combo...), value))
+			}
+		}
+		combos = next
+	}
+
+	kept := combos[:0]
+	for _, combo := range combos {
+		if !m.excluded(combo) {
+			kept = append(kept, combo)
+		}
+	}
+	return kept
+}
+
+// excluded reports whether an entry of Exclude matches a combination
+func (m *Matrix) excluded(combo []string) bool {
+	for _, exclude := range m.Exclude {
+		matches := len(exclude) > 0
+		for i, axis := range m.Axes {
+			if value, ok := exclude[axis.Name]; ok && value != combo[i] {
+				matches = false
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// validateMatrices checks the matrices of a pipeline's stages and steps,
+// and that the steps they expand into don't take the ID of another step
+func validateMatrices(pipeline *Pipeline) error {
+	for _, stage := range pipeline.Stages {
+		if stage.Matrix != nil {
+			if err := stage.Matrix.validate(); err != nil {
+				return fmt.Errorf("stage %s: %w", stage.ID, err)
+			}
+		}
+		for _, step := range stage.Steps {
+			if m := stepMatrix(stage, step); m != nil {
+				if err := m.validate(); err != nil {
+					return fmt.Errorf("step %s: %w", step.ID, err)
+				}
+			}
+		}
+		for _, step := range stage.Rollback {
+			if step.Matrix != nil {
+				return fmt.Errorf("rollback step %s can't have a matrix", step.ID)
+			}
+		}
+	}
+
+	// IDs of the steps, and whether a matrix expanded them
+	expanded := make(map[string]bool)
+	for _, stage := range expandMatrices(pipeline.Stages) {
+		for _, step := range stage.Steps {
+			if matrix, ok := expanded[step.ID]; ok && (matrix || step.matrix != nil) {
+				return fmt.Errorf("matrix step ID %s is taken by another step", step.ID)
+			}
+			expanded[step.ID] = step.matrix != nil
+		}
+	}
+	return nil
+}
+
+// hasMatrices reports whether a stage, or a step of one, has a matrix
+func hasMatrices(stages []Stage) bool {
+	for _, stage := range stages {
+		if stage.Matrix != nil {
+			return true
+		}
+		for _, step := range stage.Steps {
+			if step.Matrix != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expandMatrices returns stages whose steps with a matrix, of their own or
+// their stage's, are replaced by a step per combination of its values.
+// When there are none, stages are returned as they are.
+func expandMatrices(stages []Stage) []Stage {
+	if !hasMatrices(stages) {
+		return stages
+	}
+	expanded := make([]Stage, len(stages))
+	for i, stage := range stages {
+		steps := make([]Step, 0, len(stage.Steps))
+		for _, step := range stage.Steps {
+			m := stepMatrix(stage, step)
+			if m == nil {
+				steps = append(steps, step)
+				continue
+			}
+			for _, combo := range m.combinations() {
+				steps = append(steps, matrixStep(stage, step, m, combo))
+			}
+		}
+		stage.Steps = steps
+		stage.Matrix = nil
+		expanded[i] = stage
+	}
+	return expanded
+}
+
+// matrixStep returns the step of a combination of matrix values. Its ID
+// and name carry the values, its environment has them as MATRIX_<AXIS>
+// variables, and references to them in its image, working directory and
+// runner labels are expanded; the rest of the step expands them when it
+// runs.
+func matrixStep(stage Stage, step Step, m *Matrix, combo []string) Step {
+	values := make(map[string]string, len(combo))
+	refs := make(map[string]string, len(combo))
+	ids := make([]string, len(combo))
+	for i, axis := range m.Axes {
+		values[axis.Name] = combo[i]
+		refs["matrix."+axis.Name] = combo[i]
+		ids[i] = strings.Trim(matrixIDUnsafe.ReplaceAllString(combo[i], "-"), "-")
+	}
+	expand := func(s string) string {
+		return referenceExpression.ReplaceAllStringFunc(s, func(match string) string {
+			if value, ok := refs[referenceExpression.FindStringSubmatch(match)[1]]; ok {
+				return value
+			}
+			return match
+		})
+	}
+
+	origin := step.ID
+	step.ID = origin + "-" + strings.Join(ids, "-")
+	if step.Name == "" {
+		step.Name = origin
+	}
+	step.Name = fmt.Sprintf("%s (%s)", step.Name, strings.Join(combo, ", "))
+	step.Matrix = nil
+	step.matrix = &matrixCell{of: origin, values: values, maxParallel: m.MaxParallel}
+
+	env := make(map[string]string, len(step.Environment)+len(values))
+	for key, value := range step.Environment {
+		env[key] = value
+	}
+	for name, value := range values {
+		env["MATRIX_"+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))] = value
+	}
+	step.Environment = env
+
+	step.Image = expand(step.Image)
+	step.WorkingDir = expand(step.WorkingDir)
+	labels := step.RunsOn
+	if len(labels) == 0 {
+		labels = stage.RunsOn
+	}
+	if len(labels) > 0 {
+		step.RunsOn = make([]string, len(labels))
+		for i, label := range labels {
+			step.RunsOn[i] = expand(label)
+		}
+	}
+	return step
+}
+
+// addMatrixValues adds the matrix values of a step to the values its
+// references expand to
+func addMatrixValues(values map[string]string, step Step) map[string]string {
+	for name, value := range step.matrix.combination() {
+		values["matrix."+name] = value
+	}
+	return values
+}
+
+// withMatrices returns a pipeline whose matrix steps are expanded for a
+// job to run, or the pipeline itself when it has none
+func withMatrices(pipeline *Pipeline) *Pipeline {
+	if !hasMatrices(pipeline.Stages) {
+		return pipeline
+	}
+	expanded := *pipeline
+	expanded.Stages = expandMatrices(pipeline.Stages)
+	return &expanded
+}
@@ -0,0 +1,159 @@
+package core
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandMatrices(t *testing.T) {
+	stages := []Stage{{
+		ID:     "test",
+		RunsOn: []string{"${{ matrix.os }}"},
+		Steps: []Step{
+			{ID: "test-lint", Name: "lint", Command: "make lint"},
+			{ID: "test-unit", Name: "unit", Command: "go test", Matrix: &Matrix{
+				Axes: []MatrixAxis{
+					{Name: "go", Values: []string{"1.21", "1.22"}},
+					{Name: "os", Values: []string{"linux", "mac os"}},
+				},
+				Exclude: []map[string]string{{"go": "1.21", "os": "mac os"}},
+			}},
+		},
+	}}
+
+	expanded := expandMatrices(stages)
+	var ids, names []string
+	for _, step := range expanded[0].Steps {
+		ids = append(ids, step.ID)
+		names = append(names, step.Name)
+	}
+	if want := []string{"test-lint", "test-unit-1.21-linux", "test-unit-1.22-linux", "test-unit-1.22-mac-os"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("IDs = %v, want %v", ids, want)
+	}
+	if names[3] != "unit (1.22, mac os)" {
+		t.Errorf("Name = %q, want the values in parentheses", names[3])
+	}
+
+	step := expanded[0].Steps[3]
+	if step.Environment["MATRIX_GO"] != "1.22" || step.Environment["MATRIX_OS"] != "mac os" {
+		t.Errorf("Environment = %v, want the matrix values", step.Environment)
+	}
+	if !reflect.DeepEqual(step.RunsOn, []string{"mac os"}) {
+		t.Errorf("RunsOn = %v, want the stage's labels with the os", step.RunsOn)
+	}
+	if step.matrix.origin() != "test-unit" || expanded[0].Steps[0].matrix != nil {
+		t.Errorf("origin = %q, want test-unit only for the matrix steps", step.matrix.origin())
+	}
+	if len(stages[0].Steps) != 2 || stages[0].Steps[1].Matrix == nil {
+		t.Error("expandMatrices() changed the pipeline's stages")
+	}
+}
+
+func TestValidateMatrices(t *testing.T) {
+	axes := []MatrixAxis{{Name: "go", Values: []string{"1.21", "1.22"}}}
+	tests := []struct {
+		name   string
+		matrix *Matrix
+		steps  []Step
+		want   string
+	}{
+		{"no values", &Matrix{Axes: []MatrixAxis{{Name: "go"}}}, nil, "axis go has no values"},
+		{"unknown exclude", &Matrix{Axes: axes, Exclude: []map[string]string{{"os": "linux"}}}, nil, "unknown axis os"},
+		{"all excluded", &Matrix{Axes: axes, Exclude: []map[string]string{{}, {"go": "1.21"}, {"go": "1.22"}}}, nil, "excludes every combination"},
+		{"too large", &Matrix{Axes: []MatrixAxis{
+			{Name: "a", Values: strings.Split("0 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16", " ")},
+			{Name: "b", Values: strings.Split("0 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16", " ")},
+		}}, nil, "more than 256 combinations"},
+		{"taken ID", &Matrix{Axes: axes}, []Step{{ID: "build-test-1.22", Command: "true"}}, "ID build-test-1.22 is taken"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps := append([]Step{{ID: "build-test", Command: "true", Matrix: tt.matrix}}, tt.steps...)
+			pipeline := &Pipeline{ID: "matrix", Stages: []Stage{{ID: "build", Steps: steps}}}
+			err := newTestEngine().CreatePipeline(pipeline)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("CreatePipeline() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRun_Matrix(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("matrix", `echo "go ${{ matrix.go }} on $MATRIX_OS"`, "echo done")
+	pipeline.Stages[0].Steps[0].Matrix = &Matrix{Axes: []MatrixAxis{
+		{Name: "go", Values: []string{"1.21", "1.22"}},
+		{Name: "os", Values: []string{"linux"}},
+	}}
+	if err := engine.CreatePipeline(pipeline); err != nil {
+		t.Fatalf("CreatePipeline() error = %v", err)
+	}
+
+	job, err := engine.Run(context.Background(), "matrix")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess || len(job.Steps) != 3 {
+		t.Fatalf("Status = %q with %d steps, want success with 3; logs: %+v", job.Status, len(job.Steps), job.Logs)
+	}
+	outputs := make(map[string]string)
+	for _, step := range job.Steps[:2] {
+		if step.MatrixOf != "build-step-a" {
+			t.Errorf("step %s MatrixOf = %q, want build-step-a", step.ID, step.MatrixOf)
+		}
+		outputs[step.ID] = strings.TrimSpace(step.Output)
+	}
+	want := map[string]string{
+		"build-step-a-1.21-linux": "go 1.21 on linux",
+		"build-step-a-1.22-linux": "go 1.22 on linux",
+	}
+	if !reflect.DeepEqual(outputs, want) {
+		t.Errorf("outputs = %v, want %v", outputs, want)
+	}
+	if job.Steps[0].Matrix["go"] == "" || job.Steps[2].ID != "build-step-b" || job.Steps[2].Matrix != nil {
+		t.Errorf("Steps = %+v, want matrix values on the matrix steps only", job.Steps)
+	}
+}
+
+func TestRun_MatrixRunsConcurrently(t *testing.T) {
+	executor := &recordingExecutor{release: make(chan struct{})}
+	engine := newTestEngine(WithExecutor(executor))
+	pipeline := scriptPipeline("matrix", "make test")
+	pipeline.Stages[0].Matrix = &Matrix{Axes: []MatrixAxis{{Name: "shard", Values: []string{"1", "2", "3"}}}}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Start(context.Background(), "matrix")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		executor.mu.Lock()
+		running := executor.running
+		executor.mu.Unlock()
+		if running == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d matrix steps running, want 3", running)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(executor.release)
+	waitForJob(t, engine, "matrix", job.ID, StatusSuccess)
+
+	// MaxParallel bounds the steps of the matrix running at once
+	limited := &recordingExecutor{}
+	engine = newTestEngine(WithExecutor(limited))
+	pipeline.Stages[0].Matrix.MaxParallel = 1
+	engine.CreatePipeline(pipeline)
+	if job, _ := engine.Run(context.Background(), "matrix"); job.Status != StatusSuccess || len(limited.steps) != 3 {
+		t.Fatalf("Status = %q with steps %v, want success with 3", job.Status, limited.steps)
+	}
+	if limited.peak != 1 {
+		t.Errorf("peak concurrent steps = %d, want 1", limited.peak)
+	}
+}
@@ -0,0 +1,259 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// MemoizeConfig enables step result caching. A memoized step is skipped
+// when its command, configuration, environment and input files match a
+// previous successful run, and the recorded result is reused.
+type MemoizeConfig struct {
+	// Inputs are glob patterns of files whose contents are part of the
+	// cache key, relative to the executor's working directory. Directories
+	// are hashed recursively.
+	Inputs []string `json:"inputs,omitempty"`
+	// Key is mixed into the cache key; change it to invalidate results
+	Key string `json:"key,omitempty"`
+}
+
+// CachedResult is the recorded result of a successful memoized step
+type CachedResult struct {
+	Key        string                 `json:"key"`
+	PipelineID string                 `json:"pipelineId"`
+	StepID     string                 `json:"stepId"`
+	JobID      string                 `json:"jobId"`
+	ExitCode   int                    `json:"exitCode"`
+	Output     string                 `json:"output,omitempty"`
+	Outputs    map[string]interface{} `json:"outputs,omitempty"`
+	CreatedAt  time.Time              `json:"createdAt"`
+}
+
+// ResultStore persists memoized step results. When the engine's Store also
+// implements ResultStore, cached results survive a restart.
+type ResultStore interface {
+	SaveResult(result *CachedResult) error
+	LoadResult(key string) (*CachedResult, error)
+	DeleteResults(pipelineID string) (int, error)
+}
+
+// workingDir is implemented by executors that run steps in a directory.
+// Memoized step inputs are resolved relative to it.
+type workingDir interface {
+	WorkingDir() string
+}
+
+// memoKeyExcludedEnv lists variables that differ between runs and must not
+// affect the cache key. Memoized steps declare the files they read as
+// inputs, so a new commit alone doesn't invalidate their results.
+var memoKeyExcludedEnv = map[string]bool{
+	"CONVEYOR_JOB_ID":         true,
+	"CONVEYOR_WORKSPACE":      true,
+	"CONVEYOR_RELEASE_DIR":    true,
+	"CONVEYOR_REPO":           true,
+	"CONVEYOR_BRANCH":         true,
+	"CONVEYOR_COMMIT":         true,
+	"CONVEYOR_COMMIT_AUTHOR":  true,
+	"CONVEYOR_COMMIT_MESSAGE": true,
+	"CONVEYOR_PULL_REQUEST":   true,
+}
+
+// memoKey computes the cache key of a memoized step from everything that
+// can affect its result
+func (pe *PipelineEngine) memoKey(pipeline *Pipeline, job *Job, step Step, env map[string]string) (string, error) {
+	hash := sha256.New()
+	write := func(parts ...string) {
+		for _, part := range parts {
+			fmt.Fprintf(hash, "%d:%s;", len(part), part)
+		}
+	}
+
+	config, err := json.Marshal(step.Config)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode step config: %w", err)
+	}
+	write(pipeline.ID, step.ID, step.Type, step.Plugin, step.Command, step.Image, string(config), step.Memoize.Key)
+
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		if !memoKeyExcludedEnv[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		write("env", key, env[key])
+	}
+
+	inputs, err := hashInputs(pe.jobDir(job), step.Memoize.Inputs)
+	if err != nil {
+		return "", err
+	}
+	for _, input := range inputs {
+		write("input", input)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashInputs returns "path=sha256" entries for every file matched by the
+// patterns, in a stable order. Patterns matching nothing are recorded so
+// that a file appearing later changes the key.
+func hashInputs(dir string, patterns []string) ([]string, error) {
+	var entries []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid input pattern %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			entries = append(entries, pattern+"=missing")
+			continue
+		}
+
+		for _, match := range matches {
+			err := filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				sum, err := hashFile(path)
+				if err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(dir, path)
+				if err != nil || dir == "" {
+					rel = path
+				}
+				entries = append(entries, filepath.ToSlash(rel)+"="+sum)
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to hash input %s: %w", match, err)
+			}
+		}
+	}
+
+	sort.Strings(entries)
+	return entries, nil
+}
+
+// hashFile returns the hex SHA-256 of a file's contents
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// cachedResult returns the memoized result for key, loading it from the
+// store if it is not in memory
+func (pe *PipelineEngine) cachedResult(key string) *CachedResult {
+	if result, ok := pe.cacheManager.getResult(key); ok {
+		return result
+	}
+
+	resultStore, ok := pe.store.(ResultStore)
+	if !ok {
+		return nil
+	}
+	result, err := resultStore.LoadResult(key)
+	if err != nil {
+		pe.logger.Printf("Failed to load cached step result %s: %v", key, err)
+		return nil
+	}
+	if result != nil {
+		pe.cacheManager.putResult(result)
+	}
+	return result
+}
+
+// recordResult memoizes the result of a successful step
+func (pe *PipelineEngine) recordResult(result *CachedResult) {
+	pe.cacheManager.putResult(result)
+
+	if resultStore, ok := pe.store.(ResultStore); ok {
+		if err := resultStore.SaveResult(result); err != nil {
+			pe.logger.Printf("Failed to persist cached step result for %s: %v", result.StepID, err)
+		}
+	}
+}
+
+// ClearCache deletes the memoized step results of a pipeline so its next
+// run executes every step. It returns the number of results removed.
+func (pe *PipelineEngine) ClearCache(pipelineID string) (int, error) {
+	if _, err := pe.GetPipeline(pipelineID); err != nil {
+		return 0, err
+	}
+
+	removed := pe.cacheManager.clearPipeline(pipelineID)
+
+	if resultStore, ok := pe.store.(ResultStore); ok {
+		stored, err := resultStore.DeleteResults(pipelineID)
+		if err != nil {
+			return removed, fmt.Errorf("failed to delete cached results: %w", err)
+		}
+		if stored > removed {
+			removed = stored
+		}
+	}
+
+	return removed, nil
+}
+
+// getResult returns an in-memory cached result
+func (cm *CacheManager) getResult(key string) (*CachedResult, bool) {
+	cm.mu.RLock()
+	data, ok := cm.caches[key]
+	cm.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	var result CachedResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, false
+	}
+	return &result, true
+}
+
+// putResult stores a cached result in memory
+func (cm *CacheManager) putResult(result *CachedResult) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+
+	cm.mu.Lock()
+	cm.caches[result.Key] = data
+	cm.mu.Unlock()
+}
+
+// clearPipeline removes the in-memory results of a pipeline
+func (cm *CacheManager) clearPipeline(pipelineID string) int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	removed := 0
+	for key, data := range cm.caches {
+		var result CachedResult
+		if err := json.Unmarshal(data, &result); err == nil && result.PipelineID == pipelineID {
+			delete(cm.caches, key)
+			removed++
+		}
+	}
+	return removed
+}
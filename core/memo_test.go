@@ -0,0 +1,117 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// memoPipeline counts its executions in runs.log and declares input.txt as
+// its only input
+func memoPipeline(t *testing.T, dir string) *Pipeline {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "input.txt"), []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pipeline := scriptPipeline("memo", "echo run >> runs.log; cat input.txt")
+	pipeline.Stages[0].Steps[0].Memoize = &MemoizeConfig{Inputs: []string{"input.txt"}}
+	return pipeline
+}
+
+func executions(t *testing.T, dir string) int {
+	t.Helper()
+	data, _ := os.ReadFile(filepath.Join(dir, "runs.log"))
+	return strings.Count(string(data), "run")
+}
+
+func runMemo(t *testing.T, engine *PipelineEngine, opts ...RunOption) *Job {
+	t.Helper()
+	job, err := engine.Run(context.Background(), "memo", opts...)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess {
+		t.Fatalf("Status = %q, want success", job.Status)
+	}
+	return job
+}
+
+func TestMemoize_ReusesUnchangedStep(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	engine.CreatePipeline(memoPipeline(t, dir))
+
+	first := runMemo(t, engine)
+	second := runMemo(t, engine)
+
+	if executions(t, dir) != 1 {
+		t.Errorf("executions = %d, want 1", executions(t, dir))
+	}
+	step := second.Steps[0]
+	if step.Status != StatusCached || step.CachedFrom != first.ID {
+		t.Errorf("step = %+v, want cached from %s", step, first.ID)
+	}
+	if step.Output != first.Steps[0].Output {
+		t.Errorf("Output = %q, want recorded output %q", step.Output, first.Steps[0].Output)
+	}
+}
+
+func TestMemoize_InputChangeInvalidates(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	engine.CreatePipeline(memoPipeline(t, dir))
+
+	runMemo(t, engine)
+	os.WriteFile(filepath.Join(dir, "input.txt"), []byte("v2"), 0644)
+	job := runMemo(t, engine)
+
+	if executions(t, dir) != 2 {
+		t.Errorf("executions = %d, want 2", executions(t, dir))
+	}
+	if job.Steps[0].Status != StatusSuccess || !strings.Contains(job.Steps[0].Output, "v2") {
+		t.Errorf("step = %+v, want a fresh run with the new input", job.Steps[0])
+	}
+}
+
+func TestMemoize_CacheBust(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	engine.CreatePipeline(memoPipeline(t, dir))
+
+	runMemo(t, engine)
+	runMemo(t, engine, WithoutCache())
+	if executions(t, dir) != 2 {
+		t.Errorf("executions = %d after WithoutCache, want 2", executions(t, dir))
+	}
+
+	removed, err := engine.ClearCache("memo")
+	if err != nil || removed != 1 {
+		t.Errorf("ClearCache() = %d, %v, want 1 result removed", removed, err)
+	}
+	runMemo(t, engine)
+	if executions(t, dir) != 3 {
+		t.Errorf("executions = %d after ClearCache, want 3", executions(t, dir))
+	}
+}
+
+func TestMemoize_PersistsAcrossEngines(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}), WithStore(store))
+	first.CreatePipeline(memoPipeline(t, dir))
+	runMemo(t, first)
+
+	second := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}), WithStore(store))
+	second.CreatePipeline(memoPipeline(t, dir))
+	job := runMemo(t, second)
+
+	if job.Steps[0].Status != StatusCached {
+		t.Errorf("Status = %q, want cached from the persisted result", job.Steps[0].Status)
+	}
+}
@@ -0,0 +1,218 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Metrics served as time series, such as to Grafana
+const (
+	// MetricJobs counts the jobs that finished in each interval
+	MetricJobs = "jobs.count"
+	// MetricJobsSucceeded and MetricJobsFailed count the finished jobs
+	// that succeeded, with or without warnings, and that failed
+	MetricJobsSucceeded = "jobs.succeeded"
+	MetricJobsFailed    = "jobs.failed"
+	// MetricSuccessRate is the percentage of finished jobs that succeeded
+	MetricSuccessRate = "jobs.success_rate"
+	// MetricDurationAvg and MetricDurationP95 are the average and 95th
+	// percentile durations of finished jobs in milliseconds
+	MetricDurationAvg = "jobs.duration.avg"
+	MetricDurationP95 = "jobs.duration.p95"
+	// MetricQueueDepth is the most steps waiting for a runner at once
+	MetricQueueDepth = "queue.depth"
+	// MetricDiskQuotaExceeded counts the steps of finished jobs stopped for
+	// their disk usage
+	MetricDiskQuotaExceeded = "steps.disk_quota_exceeded"
+)
+
+// maxMetricPoints bounds the points of a time series
+const maxMetricPoints = 11000
+
+// maxQueueSamples bounds the queue depth changes kept for time series.
+// Older changes are dropped.
+const maxQueueSamples = 20000
+
+// Metrics returns the names of the metrics served as time series
+func Metrics() []string {
+	return []string{MetricJobs, MetricJobsSucceeded, MetricJobsFailed, MetricSuccessRate, MetricDurationAvg, MetricDurationP95, MetricQueueDepth, MetricDiskQuotaExceeded}
+}
+
+// MetricQuery asks for a metric in intervals from From to To, optionally
+// for one pipeline's jobs
+type MetricQuery struct {
+	Metric     string
+	PipelineID string
+	From       time.Time
+	To         time.Time
+	Interval   time.Duration
+}
+
+// DataPoint is a metric's value for the interval starting at At
+type DataPoint struct {
+	At    time.Time `json:"at"`
+	Value float64   `json:"value"`
+}
+
+// TimeSeries is the values of a metric over time. Intervals without jobs
+// have no success rate or durations, so they have no point.
+type TimeSeries struct {
+	Metric     string      `json:"metric"`
+	PipelineID string      `json:"pipelineId,omitempty"`
+	Points     []DataPoint `json:"points"`
+}
+
+// queueSample is the queue depth from a time until the next sample
+type queueSample struct {
+	at    time.Time
+	depth int
+}
+
+// recordQueueDepth samples the queue depth after it changed. Callers must
+// hold pe.mu.
+func (pe *PipelineEngine) recordQueueDepth(at time.Time) {
+	pe.queueSamples = append(pe.queueSamples, queueSample{at: at, depth: len(pe.queue)})
+	if len(pe.queueSamples) > maxQueueSamples {
+		pe.queueSamples = append([]queueSample(nil), pe.queueSamples[len(pe.queueSamples)-maxQueueSamples/2:]...)
+	}
+}
+
+// QueryMetric returns a metric's time series
+func (pe *PipelineEngine) QueryMetric(q MetricQuery) (TimeSeries, error) {
+	if q.Interval <= 0 {
+		return TimeSeries{}, fmt.Errorf("interval must be positive")
+	}
+	if !q.To.After(q.From) {
+		return TimeSeries{}, fmt.Errorf("from must be before to")
+	}
+	from := q.From.Truncate(q.Interval)
+	buckets := int((q.To.Sub(from)-1)/q.Interval) + 1
+	if buckets > maxMetricPoints {
+		return TimeSeries{}, fmt.Errorf("%d intervals of %s, want at most %d", buckets, q.Interval, maxMetricPoints)
+	}
+
+	series := TimeSeries{Metric: q.Metric, PipelineID: q.PipelineID, Points: []DataPoint{}}
+	switch q.Metric {
+	case MetricQueueDepth:
+		if q.PipelineID != "" {
+			return TimeSeries{}, fmt.Errorf("%s is not kept per pipeline", q.Metric)
+		}
+		series.Points = pe.queueDepths(from, q.Interval, buckets)
+	case MetricJobs, MetricJobsSucceeded, MetricJobsFailed, MetricSuccessRate, MetricDurationAvg, MetricDurationP95, MetricDiskQuotaExceeded:
+		series.Points = pe.jobMetric(q.Metric, q.PipelineID, from, q.Interval, buckets)
+	default:
+		return TimeSeries{}, fmt.Errorf("unknown metric %q", q.Metric)
+	}
+	return series, nil
+}
+
+// jobMetric returns the points of a job metric, bucketing jobs by the
+// time they ended
+func (pe *PipelineEngine) jobMetric(metric, pipelineID string, from time.Time, interval time.Duration, buckets int) []DataPoint {
+	durations := make([][]time.Duration, buckets)
+	succeeded := make([]int, buckets)
+	failed := make([]int, buckets)
+	overDisk := make([]int, buckets)
+
+	pe.mu.RLock()
+	for _, job := range pe.jobs {
+		if job.EndedAt.IsZero() || job.EndedAt.Before(from) || (pipelineID != "" && job.PipelineID != pipelineID) {
+			continue
+		}
+		i := int(job.EndedAt.Sub(from) / interval)
+		if i >= buckets {
+			continue
+		}
+		start := job.StartedAt
+		if start.IsZero() {
+			start = job.QueuedAt
+		}
+		durations[i] = append(durations[i], job.EndedAt.Sub(start))
+		switch job.Status {
+		case StatusSuccess, StatusWarning:
+			succeeded[i]++
+		case StatusFailed:
+			failed[i]++
+		}
+		for _, step := range job.Steps {
+			if step.FailureClass == FailureDiskQuota {
+				overDisk[i]++
+			}
+		}
+	}
+	pe.mu.RUnlock()
+
+	points := make([]DataPoint, 0, buckets)
+	for i := 0; i < buckets; i++ {
+		at := from.Add(time.Duration(i) * interval)
+		finished := len(durations[i])
+		switch metric {
+		case MetricJobs:
+			points = append(points, DataPoint{at, float64(finished)})
+		case MetricJobsSucceeded:
+			points = append(points, DataPoint{at, float64(succeeded[i])})
+		case MetricJobsFailed:
+			points = append(points, DataPoint{at, float64(failed[i])})
+		case MetricDiskQuotaExceeded:
+			points = append(points, DataPoint{at, float64(overDisk[i])})
+		}
+		if finished == 0 {
+			continue
+		}
+		switch metric {
+		case MetricSuccessRate:
+			points = append(points, DataPoint{at, 100 * float64(succeeded[i]) / float64(finished)})
+		case MetricDurationAvg:
+			var total time.Duration
+			for _, d := range durations[i] {
+				total += d
+			}
+			points = append(points, DataPoint{at, float64((total / time.Duration(finished)).Milliseconds())})
+		case MetricDurationP95:
+			sort.Slice(durations[i], func(a, b int) bool { return durations[i][a] < durations[i][b] })
+			points = append(points, DataPoint{at, float64(percentile(durations[i], 95).Milliseconds())})
+		}
+	}
+	return points
+}
+
+// queueDepths returns the most steps waiting at once in each interval
+func (pe *PipelineEngine) queueDepths(from time.Time, interval time.Duration, buckets int) []DataPoint {
+	pe.mu.RLock()
+	samples := append([]queueSample(nil), pe.queueSamples...)
+	current := len(pe.queue)
+	pe.mu.RUnlock()
+
+	// The depth when the first interval starts is the depth of the last
+	// change before it, or the oldest depth kept
+	depth := 0
+	if len(samples) == 0 {
+		depth = current
+	}
+	next := 0
+	for next < len(samples) && samples[next].at.Before(from) {
+		depth = samples[next].depth
+		next++
+	}
+
+	points := make([]DataPoint, 0, buckets)
+	now := time.Now()
+	for i := 0; i < buckets; i++ {
+		at := from.Add(time.Duration(i) * interval)
+		if at.After(now) {
+			break
+		}
+		end := at.Add(interval)
+		most := depth
+		for next < len(samples) && samples[next].at.Before(end) {
+			depth = samples[next].depth
+			if depth > most {
+				most = depth
+			}
+			next++
+		}
+		points = append(points, DataPoint{at, float64(most)})
+	}
+	return points
+}
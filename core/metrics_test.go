@@ -0,0 +1,90 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueryMetric_Jobs(t *testing.T) {
+	engine := newTestEngine()
+	from := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	for _, job := range []*Job{
+		{ID: "a", PipelineID: "web", Status: StatusSuccess, StartedAt: from, EndedAt: from.Add(10 * time.Second)},
+		{ID: "b", PipelineID: "web", Status: StatusFailed, StartedAt: from, EndedAt: from.Add(30 * time.Second)},
+		{ID: "c", PipelineID: "api", Status: StatusWarning, StartedAt: from.Add(time.Minute), EndedAt: from.Add(time.Minute + 20*time.Second)},
+		{ID: "d", PipelineID: "web", Status: StatusRunning, StartedAt: from},
+	} {
+		engine.AddJob(job)
+	}
+	query := MetricQuery{From: from, To: from.Add(3 * time.Minute), Interval: time.Minute}
+
+	query.Metric = MetricJobs
+	if series, err := engine.QueryMetric(query); err != nil || len(series.Points) != 3 || series.Points[0].Value != 2 || series.Points[1].Value != 1 || series.Points[2].Value != 0 {
+		t.Errorf("QueryMetric(jobs.count) = %+v, %v, want 2, 1 and 0 jobs", series, err)
+	}
+	query.Metric = MetricSuccessRate
+	if series, err := engine.QueryMetric(query); err != nil || len(series.Points) != 2 || series.Points[0].Value != 50 || series.Points[1].Value != 100 {
+		t.Errorf("QueryMetric(jobs.success_rate) = %+v, %v, want 50%% and 100%% with no point without jobs", series, err)
+	}
+	query.Metric, query.PipelineID = MetricDurationAvg, "web"
+	if series, err := engine.QueryMetric(query); err != nil || len(series.Points) != 1 || series.Points[0].Value != 20000 {
+		t.Errorf("QueryMetric(jobs.duration.avg, web) = %+v, %v, want 20s", series, err)
+	}
+	query.Metric = MetricQueueDepth
+	if _, err := engine.QueryMetric(query); err == nil {
+		t.Error("QueryMetric(queue.depth) of a pipeline error = nil, want error")
+	}
+	query.Metric, query.PipelineID = "jobs.unknown", ""
+	if _, err := engine.QueryMetric(query); err == nil {
+		t.Error("QueryMetric() of an unknown metric error = nil, want error")
+	}
+	query.Metric, query.Interval = MetricJobs, time.Millisecond
+	if _, err := engine.QueryMetric(query); err == nil {
+		t.Error("QueryMetric() with too many intervals error = nil, want error")
+	}
+}
+
+func TestQueryMetric_QueueDepth(t *testing.T) {
+	executor := &recordingExecutor{release: make(chan struct{})}
+	engine := newTestEngine(WithRunners(Runner{Name: "one", Labels: []string{"linux"}, Capacity: 1, Executor: executor}))
+	from := time.Now().Add(-time.Minute)
+
+	var jobs []*Job
+	for _, id := range []string{"a", "b", "c"} {
+		engine.CreatePipeline(scriptPipeline(id, "make"))
+		job, err := engine.Start(context.Background(), id)
+		if err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		jobs = append(jobs, job)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		engine.mu.RLock()
+		waiting := len(engine.queue)
+		engine.mu.RUnlock()
+		if waiting == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(executor.release)
+	for _, job := range jobs {
+		waitForJob(t, engine, job.PipelineID, job.ID, StatusSuccess)
+	}
+
+	series, err := engine.QueryMetric(MetricQuery{Metric: MetricQueueDepth, From: from, To: time.Now().Add(time.Minute), Interval: time.Hour})
+	if err != nil || len(series.Points) == 0 {
+		t.Fatalf("QueryMetric(queue.depth) = %+v, %v, want points", series, err)
+	}
+	most := 0.0
+	for _, point := range series.Points {
+		if point.Value > most {
+			most = point.Value
+		}
+	}
+	if most != 2 {
+		t.Errorf("QueryMetric(queue.depth) = %+v, want 2 steps waiting at most", series)
+	}
+}
@@ -0,0 +1,34 @@
+package core
+
+import "time"
+
+// Migration directions
+const (
+	MigrationUp   = "up"
+	MigrationDown = "down"
+)
+
+// Migration is a database migration a step applied or rolled back. Plugins
+// report migrations as their "migrations" output and they are recorded on
+// the job.
+type Migration struct {
+	StepID string `json:"stepId"`
+	// Tool is the migration tool, such as flyway
+	Tool string `json:"tool"`
+	// Database identifies the database without its credentials
+	Database    string    `json:"database"`
+	Version     string    `json:"version"`
+	Description string    `json:"description,omitempty"`
+	Direction   string    `json:"direction"`
+	At          time.Time `json:"at"`
+}
+
+// pluginMigrations takes the migrations out of a plugin's outputs
+func pluginMigrations(outputs map[string]interface{}) []Migration {
+	migrations, ok := outputs["migrations"].([]Migration)
+	if !ok {
+		return nil
+	}
+	delete(outputs, "migrations")
+	return migrations
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun_PluginMigrationsLocksAndArtifacts(t *testing.T) {
+	engine := artifactEngine(t, t.TempDir())
+	scripts := t.TempDir()
+	os.WriteFile(filepath.Join(scripts, "2_users.down.sql"), []byte("DROP TABLE users;"), 0644)
+
+	var lockErr, saveErr error
+	var holder *LockHolder
+	plugin := &fakePlugin{name: "migrate", types: []string{"db-migrate"}, outputs: map[string]interface{}{
+		"migrations": []Migration{{Tool: "flyway", Database: "postgres://db/app", Version: "2", Direction: MigrationUp}},
+	}}
+	plugin.run = func(ctx context.Context) {
+		release, err := LockStep(ctx, "db-migrate:app", 0)
+		if err != nil {
+			lockErr = err
+			return
+		}
+		holder = engine.Lock("db-migrate:app").Holder
+		if _, err := LockStep(ctx, "db-migrate:app", 20*time.Millisecond); err == nil || !strings.Contains(err.Error(), "timed out after 20ms") {
+			lockErr = err
+		}
+		release()
+		_, saveErr = SaveStepArtifact(ctx, "rollback-migrate", scripts, []string{"*"})
+	}
+	engine.RegisterPlugin(plugin)
+	engine.CreatePipeline(&Pipeline{ID: "deploy", Stages: []Stage{{ID: "db", Steps: []Step{{ID: "migrate", Type: "db-migrate"}}}}})
+
+	job := runArtifactJob(t, engine, "deploy")
+	if lockErr != nil || holder == nil || holder.StepID != "migrate" {
+		t.Errorf("LockStep() error = %v with holder %+v, want the step to hold the lock", lockErr, holder)
+	}
+	if saveErr != nil {
+		t.Fatalf("SaveStepArtifact() error = %v", saveErr)
+	}
+	if len(job.Migrations) != 1 || job.Migrations[0].StepID != "migrate" || job.Migrations[0].Version != "2" {
+		t.Errorf("Migrations = %+v, want version 2 recorded for the step", job.Migrations)
+	}
+	if strings.Contains(job.Steps[0].Output, "migrations") {
+		t.Errorf("Output = %s, want the migrations taken out", job.Steps[0].Output)
+	}
+
+	dest := t.TempDir()
+	plugin.run = func(ctx context.Context) {
+		saveErr = ExtractJobArtifact(ctx, job.ID, "rollback-migrate", dest)
+	}
+	runArtifactJob(t, engine, "deploy")
+	if saveErr != nil {
+		t.Fatalf("ExtractJobArtifact() error = %v", saveErr)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "2_users.down.sql")); string(data) != "DROP TABLE users;" {
+		t.Errorf("extracted script = %q", data)
+	}
+
+	if release, err := LockStep(context.Background(), "db", 0); err != nil {
+		t.Errorf("LockStep() outside a step error = %v", err)
+	} else {
+		release()
+	}
+}
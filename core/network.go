@@ -0,0 +1,497 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NetworkPolicy restricts the outbound connections of steps. Steps reach
+// the network through a proxy of the engine, which only connects to the
+// destinations the policy allows.
+type NetworkPolicy struct {
+	// Egress lists the destinations steps may connect to: host names,
+	// "*.example.com" wildcards, IP addresses or CIDRs, each optionally
+	// with a port, as in "registry.npmjs.org:443" or "[2001:db8::1]:443"
+	Egress []string `json:"egress,omitempty"`
+	// DefaultDeny enforces the pipeline's policy on all of its steps, not
+	// just those with a policy of their own
+	DefaultDeny bool `json:"defaultDeny,omitempty"`
+}
+
+// EgressReport is what a step's network policy allowed and the
+// connections it blocked
+type EgressReport struct {
+	Allow   []string            `json:"allow"`
+	Blocked []BlockedConnection `json:"blocked,omitempty"`
+}
+
+// BlockedConnection is a destination a step was refused a connection to
+type BlockedConnection struct {
+	Destination string    `json:"destination"`
+	Attempts    int       `json:"attempts"`
+	FirstAt     time.Time `json:"firstAt"`
+}
+
+// EgressIsolator is implemented by executors that can run a step where the
+// egress proxy is its only way out. Steps with a network policy only run on
+// such executors, since proxy variables alone are easy to bypass.
+type EgressIsolator interface {
+	IsolateEgress(ctx context.Context, step Step) (*EgressIsolation, error)
+}
+
+// EgressIsolation is where an isolated step runs
+type EgressIsolation struct {
+	// Network is the network the step joins, which only reaches the proxy
+	Network string
+	// ProxyHost is the address the proxy listens on, reachable from the
+	// network
+	ProxyHost string
+	// Remove tears the isolation down once the step ends
+	Remove func()
+}
+
+// egressIsolationKey is the context key of the isolation of a step
+type egressIsolationKey struct{}
+
+// egressIsolation returns the isolation in ctx the step runs in, or nil
+func egressIsolation(ctx context.Context) *EgressIsolation {
+	isolation, _ := ctx.Value(egressIsolationKey{}).(*EgressIsolation)
+	return isolation
+}
+
+// restrictEgress isolates a step with the isolator of its executor, nil for
+// executors that can't, and starts a proxy enforcing allow there, pointing
+// env at it. The returned function stops the proxy, removes the isolation
+// and returns the connections it blocked.
+func restrictEgress(ctx context.Context, isolator EgressIsolator, step Step, allow []string, env map[string]string) (context.Context, func() []BlockedConnection, error) {
+	if isolator == nil {
+		return nil, nil, fmt.Errorf("step %s has a network policy, which its executor can't enforce; run it in a container", step.ID)
+	}
+	isolation, err := isolator.IsolateEgress(ctx, step)
+	if err != nil {
+		return nil, nil, err
+	}
+	proxy, err := startEgressProxy(allow, isolation.ProxyHost)
+	if err != nil {
+		if isolation.Remove != nil {
+			isolation.Remove()
+		}
+		return nil, nil, err
+	}
+	proxy.environment(env)
+	env["CONVEYOR_EGRESS_ALLOW"] = strings.Join(allow, ",")
+	stop := func() []BlockedConnection {
+		blocked := proxy.Close()
+		if isolation.Remove != nil {
+			isolation.Remove()
+		}
+		return blocked
+	}
+	return context.WithValue(ctx, egressIsolationKey{}, isolation), stop, nil
+}
+
+// errEgressBlocked is returned for connections a network policy refuses
+var errEgressBlocked = errors.New("blocked by network policy")
+
+// egressRule is a parsed entry of a network policy's egress list
+type egressRule struct {
+	// host is a lowercase host name, or a suffix such as ".example.com"
+	// for wildcards; network is set for IP addresses and CIDRs instead
+	host    string
+	network *net.IPNet
+	// port is "" for any port
+	port string
+}
+
+// ValidateEgress checks the entries of an egress list
+func ValidateEgress(entries []string) error {
+	_, err := parseEgress(entries)
+	return err
+}
+
+// parseEgress parses the entries of an egress list
+func parseEgress(entries []string) ([]egressRule, error) {
+	rules := make([]egressRule, 0, len(entries))
+	for _, entry := range entries {
+		rule, err := parseEgressRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseEgressRule parses a host name, wildcard, IP address or CIDR with an
+// optional port
+func parseEgressRule(entry string) (egressRule, error) {
+	host, port := strings.TrimSpace(entry), ""
+	if strings.HasPrefix(host, "[") || strings.Count(host, ":") == 1 {
+		var err error
+		host, port, err = net.SplitHostPort(host)
+		if err != nil {
+			return egressRule{}, fmt.Errorf("invalid egress %q: %v", entry, err)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return egressRule{}, fmt.Errorf("invalid egress %q: port must be 1 to 65535", entry)
+		}
+	}
+	if host == "" {
+		return egressRule{}, fmt.Errorf("invalid egress %q: no host", entry)
+	}
+	if strings.Contains(host, "/") {
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return egressRule{}, fmt.Errorf("invalid egress %q: %v", entry, err)
+		}
+		return egressRule{network: network, port: port}, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * len(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return egressRule{network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, port: port}, nil
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	name := host
+	if strings.HasPrefix(host, "*.") {
+		host = host[1:]
+		name = host[1:]
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !validLabel(label) {
+			return egressRule{}, fmt.Errorf("invalid egress %q: not a host name, IP address or CIDR", entry)
+		}
+	}
+	return egressRule{host: host, port: port}, nil
+}
+
+// validLabel reports whether s is a label of a host name
+func validLabel(s string) bool {
+	if s == "" || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// allowsName reports whether the rule allows connections to a host name
+func (r egressRule) allowsName(host, port string) bool {
+	if r.host == "" || (r.port != "" && r.port != port) {
+		return false
+	}
+	if strings.HasPrefix(r.host, ".") {
+		return strings.HasSuffix(host, r.host)
+	}
+	return host == r.host
+}
+
+// allowsIP reports whether the rule allows connections to an address
+func (r egressRule) allowsIP(ip net.IP, port string) bool {
+	return r.network != nil && (r.port == "" || r.port == port) && r.network.Contains(ip)
+}
+
+// stepEgress returns the egress list enforced on a step: the pipeline's
+// list followed by the step's. ok is false for steps without a policy in
+// pipelines that don't deny by default.
+func stepEgress(pipeline *Pipeline, step Step) (allow []string, ok bool) {
+	if pipeline.Network != nil {
+		allow = append(allow, pipeline.Network.Egress...)
+		ok = pipeline.Network.DefaultDeny
+	}
+	if step.Network != nil {
+		allow = append(allow, step.Network.Egress...)
+		ok = true
+	}
+	if allow == nil {
+		allow = []string{}
+	}
+	return allow, ok
+}
+
+// egressProxy is an HTTP proxy on the host, reachable from the isolation of
+// a step, that connects it to the destinations its network policy allows. HTTPS is
+// tunnelled with CONNECT, so the proxy sees host names but not requests.
+type egressProxy struct {
+	rules    []egressRule
+	listener net.Listener
+	server   *http.Server
+	forward  *http.Transport
+	resolver *net.Resolver
+	dialer   *net.Dialer
+
+	mu      sync.Mutex
+	blocked map[string]*BlockedConnection
+	tunnels map[net.Conn]struct{}
+}
+
+// startEgressProxy starts a proxy enforcing an egress list, listening on
+// host
+func startEgressProxy(allow []string, host string) (*egressProxy, error) {
+	rules, err := parseEgress(allow)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, &InfrastructureError{Err: fmt.Errorf("failed to start egress proxy: %w", err)}
+	}
+	p := &egressProxy{
+		rules:    rules,
+		listener: listener,
+		resolver: net.DefaultResolver,
+		dialer:   &net.Dialer{Timeout: 30 * time.Second},
+		blocked:  make(map[string]*BlockedConnection),
+		tunnels:  make(map[net.Conn]struct{}),
+	}
+	p.forward = &http.Transport{DialContext: p.dial}
+	forward := &httputil.ReverseProxy{
+		Director:  func(*http.Request) {},
+		Transport: p.forward,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.refuse(w, r.Host, err)
+		},
+	}
+	p.server = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodConnect {
+				p.tunnel(w, r)
+				return
+			}
+			if r.URL.Scheme != "http" || r.URL.Host == "" {
+				http.Error(w, "conveyor egress proxy only forwards absolute http URLs", http.StatusBadRequest)
+				return
+			}
+			r.Header.Del("Proxy-Connection")
+			r.Header.Del("Proxy-Authorization")
+			forward.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	go p.server.Serve(listener)
+	return p, nil
+}
+
+// environment points the proxy variables of common tools at the proxy.
+// Loopback addresses, such as those of services published on the host,
+// bypass it.
+func (p *egressProxy) environment(env map[string]string) {
+	url := "http://" + p.listener.Addr().String()
+	for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "ALL_PROXY", "http_proxy", "https_proxy", "all_proxy"} {
+		env[name] = url
+	}
+	env["NO_PROXY"] = "localhost,127.0.0.1,::1"
+	env["no_proxy"] = env["NO_PROXY"]
+}
+
+// tunnel connects a CONNECT request to its destination
+func (p *egressProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, err := p.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		p.refuse(w, r.Host, err)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "tunnelling not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	if !p.track(client, upstream) {
+		return
+	}
+	defer p.untrack(client, upstream)
+
+	client.SetDeadline(time.Time{})
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, buffered)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// refuse responds to a request the proxy didn't connect
+func (p *egressProxy) refuse(w http.ResponseWriter, destination string, err error) {
+	if errors.Is(err, errEgressBlocked) {
+		http.Error(w, fmt.Sprintf("conveyor: connection to %s %v", destination, err), http.StatusForbidden)
+		return
+	}
+	http.Error(w, fmt.Sprintf("conveyor: connection to %s failed: %v", destination, err), http.StatusBadGateway)
+}
+
+// dial connects to an address the policy allows, by name, or else by an
+// allowed address the name resolves to, and records it as blocked
+// otherwise
+func (p *egressProxy) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, "80"
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rule := range p.rules {
+		if rule.allowsName(host, port) {
+			return p.dialer.DialContext(ctx, network, net.JoinHostPort(host, port))
+		}
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if p.hasNetworks() {
+		addrs, err := p.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		for _, rule := range p.rules {
+			if rule.allowsIP(ip, port) {
+				return p.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			}
+		}
+	}
+
+	p.block(net.JoinHostPort(host, port))
+	return nil, errEgressBlocked
+}
+
+// hasNetworks reports whether any rule allows IP addresses
+func (p *egressProxy) hasNetworks() bool {
+	for _, rule := range p.rules {
+		if rule.network != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// block records a refused connection
+func (p *egressProxy) block(destination string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if blocked, ok := p.blocked[destination]; ok {
+		blocked.Attempts++
+		return
+	}
+	p.blocked[destination] = &BlockedConnection{Destination: destination, Attempts: 1, FirstAt: time.Now()}
+}
+
+// track registers the connections of a tunnel so Close ends it. It
+// closes them and returns false when the proxy is already closed.
+func (p *egressProxy) track(conns ...net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.tunnels == nil {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return false
+	}
+	for _, conn := range conns {
+		p.tunnels[conn] = struct{}{}
+	}
+	return true
+}
+
+// untrack closes the connections of a finished tunnel
+func (p *egressProxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+		delete(p.tunnels, conn)
+	}
+}
+
+// Close stops the proxy and ends its tunnels. It returns the connections
+// the proxy blocked, ordered by their first attempt.
+func (p *egressProxy) Close() []BlockedConnection {
+	p.server.Close()
+	p.forward.CloseIdleConnections()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for conn := range p.tunnels {
+		conn.Close()
+	}
+	p.tunnels = nil
+	blocked := make([]BlockedConnection, 0, len(p.blocked))
+	for _, b := range p.blocked {
+		blocked = append(blocked, *b)
+	}
+	sort.Slice(blocked, func(i, j int) bool {
+		if !blocked[i].FirstAt.Equal(blocked[j].FirstAt) {
+			return blocked[i].FirstAt.Before(blocked[j].FirstAt)
+		}
+		return blocked[i].Destination < blocked[j].Destination
+	})
+	return blocked
+}
+
+// recordEgress records a step's egress report and logs its blocked
+// connections as warnings of the job
+func (pe *PipelineEngine) recordEgress(job *Job, index int, step Step, allow []string, blocked []BlockedConnection) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	job.Steps[index].Egress = &EgressReport{Allow: allow, Blocked: blocked}
+	for _, b := range blocked {
+		job.Logs = append(job.Logs, LogEntry{
+			Timestamp: b.FirstAt,
+			Level:     "warn",
+			Message:   pe.redact(job.PipelineID, step.ID, fmt.Sprintf("network policy blocked %d connection attempts to %s", b.Attempts, b.Destination)),
+			StepID:    step.ID,
+		})
+	}
+}
+
+// egressSummary returns whether any step of a job had a network policy
+// and how many connections they blocked. Callers must hold pe.mu.
+func egressSummary(job *Job) (enforced bool, blocked int) {
+	for _, step := range job.Steps {
+		if step.Egress == nil {
+			continue
+		}
+		enforced = true
+		for _, b := range step.Egress.Blocked {
+			blocked += b.Attempts
+		}
+	}
+	return enforced, blocked
+}
@@ -0,0 +1,266 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidateEgress(t *testing.T) {
+	valid := []string{"registry.npmjs.org", "*.github.com", "proxy.golang.org:443", "10.0.0.0/8", "192.0.2.1:8080", "2001:db8::/32", "[2001:db8::1]:443"}
+	if err := ValidateEgress(valid); err != nil {
+		t.Errorf("ValidateEgress(%v) error = %v", valid, err)
+	}
+	for _, entry := range []string{"", "https://github.com", "github.com:0", "github.com:https", "10.0.0.0/33", "-bad.com", "*", "a b"} {
+		if err := ValidateEgress([]string{entry}); err == nil {
+			t.Errorf("ValidateEgress(%q) error = nil, want an error", entry)
+		}
+	}
+}
+
+func TestEgressRule(t *testing.T) {
+	tests := []struct {
+		entry, host, port string
+		want              bool
+	}{
+		{"github.com", "github.com", "443", true},
+		{"github.com", "api.github.com", "443", false},
+		{"*.github.com", "api.github.com", "443", true},
+		{"*.github.com", "github.com", "443", false},
+		{"*.github.com", "evilgithub.com", "443", false},
+		{"github.com:443", "github.com", "80", false},
+		{"10.0.0.0/8", "10.1.2.3", "22", true},
+		{"10.0.0.0/8:443", "10.1.2.3", "22", false},
+		{"192.0.2.1", "192.0.2.1", "80", true},
+		{"192.0.2.1", "192.0.2.2", "80", false},
+	}
+	for _, tt := range tests {
+		rule, err := parseEgressRule(tt.entry)
+		if err != nil {
+			t.Fatalf("parseEgressRule(%q) error = %v", tt.entry, err)
+		}
+		got := rule.allowsName(tt.host, tt.port)
+		if ip := net.ParseIP(tt.host); ip != nil {
+			got = rule.allowsIP(ip, tt.port)
+		}
+		if got != tt.want {
+			t.Errorf("%q allows %s:%s = %v, want %v", tt.entry, tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+// proxyClient returns a client connecting through the proxy of env
+func proxyClient(t *testing.T, env map[string]string) *http.Client {
+	t.Helper()
+	proxy, err := url.Parse(env["HTTP_PROXY"])
+	if err != nil {
+		t.Fatalf("HTTP_PROXY = %q: %v", env["HTTP_PROXY"], err)
+	}
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}}
+}
+
+func TestEgressProxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	proxy, err := startEgressProxy([]string{address}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("startEgressProxy() error = %v", err)
+	}
+	env := map[string]string{}
+	proxy.environment(env)
+	client := proxyClient(t, env)
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get(allowed) error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("Get(allowed) = %d %q, want 200 ok", resp.StatusCode, body)
+	}
+
+	// Another port of the same host is blocked, by plain requests and
+	// tunnels alike
+	blocked := "http://127.0.0.1:1/"
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(blocked)
+		if err != nil {
+			t.Fatalf("Get(blocked) error = %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Get(blocked) status = %d, want 403", resp.StatusCode)
+		}
+	}
+	if _, err := client.Get("https://127.0.0.1:2/"); err == nil {
+		t.Error("Get(blocked https) error = nil, want a refused tunnel")
+	}
+
+	report := proxy.Close()
+	if len(report) != 2 || report[0].Destination != "127.0.0.1:1" || report[0].Attempts != 2 || report[1].Destination != "127.0.0.1:2" {
+		t.Errorf("blocked = %+v, want 2 attempts to 127.0.0.1:1 then 127.0.0.1:2", report)
+	}
+}
+
+func TestEgressProxy_Tunnel(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure")
+	}))
+	defer server.Close()
+
+	proxy, err := startEgressProxy([]string{"127.0.0.0/8"}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("startEgressProxy() error = %v", err)
+	}
+	defer proxy.Close()
+	env := map[string]string{}
+	proxy.environment(env)
+	client := server.Client()
+	proxyURL, _ := url.Parse(env["HTTPS_PROXY"])
+	client.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyURL)
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "secure" {
+		t.Errorf("body = %q, want secure", body)
+	}
+}
+
+// fetchExecutor fetches the URL of a step's command through the proxy in
+// the step's environment. It isolates steps on the loopback interface.
+type fetchExecutor struct {
+	env      map[string]string
+	isolated int
+	removed  int
+}
+
+func (e *fetchExecutor) IsolateEgress(ctx context.Context, step Step) (*EgressIsolation, error) {
+	e.isolated++
+	return &EgressIsolation{Network: "loopback", ProxyHost: "127.0.0.1", Remove: func() { e.removed++ }}, nil
+}
+
+func (e *fetchExecutor) Execute(ctx context.Context, step Step, env map[string]string) (*StepResult, error) {
+	e.env = env
+	if env["HTTP_PROXY"] == "" {
+		return &StepResult{Output: "direct"}, nil
+	}
+	proxy, _ := url.Parse(env["HTTP_PROXY"])
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}}
+	resp, err := client.Get(step.Command)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return &StepResult{Output: resp.Status}, nil
+}
+
+func TestRun_NetworkPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	executor := &fetchExecutor{}
+	engine := newTestEngine(WithExecutor(executor))
+	pipeline := scriptPipeline("egress", server.URL, "http://192.0.2.1/")
+	pipeline.Network = &NetworkPolicy{Egress: []string{address}, DefaultDeny: true}
+	if err := engine.CreatePipeline(pipeline); err != nil {
+		t.Fatalf("CreatePipeline() error = %v", err)
+	}
+	sub := engine.Subscribe(100)
+	defer sub.Close()
+
+	job, err := engine.Run(context.Background(), "egress")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Steps[0].Output != "200 OK" || job.Steps[1].Output != "403 Forbidden" {
+		t.Errorf("outputs = %q, %q, want 200 OK then 403 Forbidden", job.Steps[0].Output, job.Steps[1].Output)
+	}
+	if executor.isolated != 2 || executor.removed != 2 {
+		t.Errorf("isolated %d and removed %d steps, want 2", executor.isolated, executor.removed)
+	}
+	if executor.env["CONVEYOR_EGRESS_ALLOW"] != address {
+		t.Errorf("CONVEYOR_EGRESS_ALLOW = %q, want %q", executor.env["CONVEYOR_EGRESS_ALLOW"], address)
+	}
+	if job.Steps[1].Recording.Environment["HTTP_PROXY"] != "" {
+		t.Error("recording has the proxy of the run, want it left out")
+	}
+	egress := job.Steps[1].Egress
+	if egress == nil || len(egress.Blocked) != 1 || egress.Blocked[0].Destination != "192.0.2.1:80" {
+		t.Fatalf("Egress = %+v, want 192.0.2.1:80 blocked", egress)
+	}
+	if len(job.Steps[0].Egress.Blocked) != 0 {
+		t.Errorf("Steps[0].Egress.Blocked = %+v, want none", job.Steps[0].Egress.Blocked)
+	}
+	warned := false
+	for _, entry := range job.Logs {
+		warned = warned || entry.Level == "warn" && strings.Contains(entry.Message, "192.0.2.1:80")
+	}
+	if !warned {
+		t.Errorf("Logs = %+v, want a warning about 192.0.2.1:80", job.Logs)
+	}
+
+	for event := range sub.Events() {
+		if event.Type == "job.egress" {
+			if event.Data["blocked"] != 1 {
+				t.Errorf("job.egress blocked = %v, want 1", event.Data["blocked"])
+			}
+			break
+		}
+		if event.Type == "job.completed" {
+			t.Fatal("job.completed before job.egress")
+		}
+	}
+
+	// Without default deny, only steps with a policy of their own use the
+	// proxy
+	pipeline.Network.DefaultDeny = false
+	if err := engine.UpdatePipeline(pipeline); err != nil {
+		t.Fatalf("UpdatePipeline() error = %v", err)
+	}
+	job, err = engine.Run(context.Background(), "egress")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Steps[0].Output != "direct" || job.Steps[0].Egress != nil {
+		t.Errorf("Steps[0] = %q, %+v, want direct without egress", job.Steps[0].Output, job.Steps[0].Egress)
+	}
+}
+
+func TestRun_NetworkPolicyNeedsIsolation(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("egress", "curl --noproxy '*' https://example.com")
+	pipeline.Network = &NetworkPolicy{DefaultDeny: true}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "egress")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusFailed {
+		t.Fatalf("Status = %q, want the step refused on the shell executor", job.Status)
+	}
+	if job.Steps[0].Output != "" {
+		t.Errorf("Output = %q, want the command not run", job.Steps[0].Output)
+	}
+	found := false
+	for _, entry := range job.Logs {
+		found = found || strings.Contains(entry.Message, "can't enforce")
+	}
+	if !found {
+		t.Errorf("Logs = %+v, want the policy refused", job.Logs)
+	}
+}
@@ -0,0 +1,206 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Option configures a PipelineEngine created by NewPipelineEngine
+type Option func(*PipelineEngine)
+
+// WithExecutor sets the executor used to run script steps. The default is a
+// ShellExecutor running commands in the current directory.
+func WithExecutor(executor StepExecutor) Option {
+	return func(pe *PipelineEngine) {
+		if executor != nil {
+			pe.executor = executor
+		}
+	}
+}
+
+// WithPlugins registers plugins when the engine is created, logging the
+// plugins that are rejected
+func WithPlugins(plugins ...Plugin) Option {
+	return func(pe *PipelineEngine) {
+		for _, plugin := range plugins {
+			if err := pe.RegisterPlugin(plugin); err != nil {
+				pe.logger.Printf("Plugin not registered: %v", err)
+			}
+		}
+	}
+}
+
+// WithLogger sets the logger used for engine diagnostics
+func WithLogger(logger *log.Logger) Option {
+	return func(pe *PipelineEngine) {
+		if logger != nil {
+			pe.logger = logger
+		}
+	}
+}
+
+// WithStore persists jobs to store as they change. Call RestoreJobs after
+// creating the engine to load jobs from a previous run.
+func WithStore(store Store) Option {
+	return func(pe *PipelineEngine) {
+		pe.store = store
+	}
+}
+
+// WithSecrets sets the store secrets referenced by steps are read from
+func WithSecrets(store SecretStore) Option {
+	return func(pe *PipelineEngine) {
+		pe.secrets = store
+	}
+}
+
+// WithDefaultEnvironment sets variables of every step that neither its
+// pipeline nor the step sets, such as the GOPROXY of the dependency cache
+func WithDefaultEnvironment(env map[string]string) Option {
+	return func(pe *PipelineEngine) {
+		pe.defaultEnv = env
+	}
+}
+
+// RunOption customizes a single pipeline run
+type RunOption func(*runConfig)
+
+// runConfig holds the settings of a single run
+type runConfig struct {
+	noCache  bool
+	trigger  map[string]string
+	revision *Revision
+	debugTTL time.Duration
+	source   string
+	// triggeredBy is who started the run
+	triggeredBy string
+	// budgetOverride is the admin who allowed the run outside its
+	// pipeline's budget
+	budgetOverride string
+	// upstream is the job whose success triggered the run
+	upstream *UpstreamJob
+	// skipped are the commits a debounced run skipped
+	skipped []string
+}
+
+// WithoutCache executes every step of the run even when a memoized result
+// exists, and records fresh results
+func WithoutCache() RunOption {
+	return func(rc *runConfig) {
+		rc.noCache = true
+	}
+}
+
+// WithSource records where the run came from: manual, schedule or
+// webhook. Scheduled and webhook runs are held during maintenance windows
+// when started with Dispatch.
+func WithSource(source string) RunOption {
+	return func(rc *runConfig) {
+		rc.source = source
+	}
+}
+
+// WithTriggeredBy records who started the run, such as the API caller.
+// Secret usage reports show it.
+func WithTriggeredBy(name string) RunOption {
+	return func(rc *runConfig) {
+		rc.triggeredBy = name
+	}
+}
+
+// WithTrigger records what triggered the run, such as the branch, commit
+// or pull request. Concurrency groups can reference the values as
+// ${{ trigger.<name> }}.
+func WithTrigger(values map[string]string) RunOption {
+	return func(rc *runConfig) {
+		rc.trigger = values
+	}
+}
+
+// WithRevision records the code the run is for. Unset fields are taken
+// from the trigger values and the checkout in the executor's working
+// directory.
+func WithRevision(rev Revision) RunOption {
+	return func(rc *runConfig) {
+		rc.revision = &rev
+	}
+}
+
+// metadata records the run settings on the job so they survive a resume
+func (rc runConfig) metadata(metadata map[string]interface{}) map[string]interface{} {
+	if rc.noCache {
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+		}
+		metadata["noCache"] = true
+	}
+	if len(rc.trigger) > 0 {
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+		}
+		metadata["trigger"] = rc.trigger
+	}
+	if rc.debugTTL > 0 {
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+		}
+		metadata["debugOnFailure"] = rc.debugTTL.String()
+	}
+	if rc.source != "" {
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+		}
+		metadata["source"] = rc.source
+	}
+	if rc.triggeredBy != "" {
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+		}
+		metadata["triggeredBy"] = rc.triggeredBy
+	}
+	if rc.budgetOverride != "" {
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+		}
+		metadata["budgetOverride"] = rc.budgetOverride
+	}
+	if rc.upstream != nil {
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+		}
+		metadata["upstream"] = *rc.upstream
+	}
+	if len(rc.skipped) > 0 {
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+		}
+		metadata["skippedCommits"] = rc.skipped
+	}
+	return metadata
+}
+
+// triggerValues returns the trigger values recorded in job metadata, which
+// are a map[string]interface{} once the job has been persisted
+func triggerValues(metadata map[string]interface{}) map[string]string {
+	switch trigger := metadata["trigger"].(type) {
+	case map[string]string:
+		return trigger
+	case map[string]interface{}:
+		values := make(map[string]string, len(trigger))
+		for key, value := range trigger {
+			values[key] = fmt.Sprint(value)
+		}
+		return values
+	}
+	return nil
+}
+
+// newRunConfig applies run options
+func newRunConfig(opts []RunOption) runConfig {
+	var rc runConfig
+	for _, opt := range opts {
+		opt(&rc)
+	}
+	return rc
+}
@@ -0,0 +1,643 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultOutputLimit is the size step output is truncated to unless the
+// engine or step sets another limit
+const DefaultOutputLimit = 4 << 20
+
+// outputTruncatedFormat is the marker between the head and tail of
+// truncated output
+const outputTruncatedFormat = "\n[... %d bytes truncated ...]\n"
+
+// binarySample is how much of the output is inspected to tell binary from
+// text output
+const binarySample = 8000
+
+// ErrStepOutputNotFound is returned for the output of a step that didn't
+// run, or binary output that wasn't kept
+var ErrStepOutputNotFound = errors.New("step output not found")
+
+// StepOutput describes the raw output of a step
+type StepOutput struct {
+	JobID  string `json:"jobId"`
+	StepID string `json:"stepId"`
+	Size   int64  `json:"size"`
+	// Binary marks output that isn't text
+	Binary bool `json:"binary,omitempty"`
+	// Sanitized marks text output with invalid UTF-8 replaced in the job
+	// record
+	Sanitized bool `json:"sanitized,omitempty"`
+	// Artifact names the artifact with the raw output, if it was kept
+	Artifact string `json:"artifact,omitempty"`
+}
+
+// OutputStats counts how often the output of a pipeline's steps was
+// truncated since the engine started
+type OutputStats struct {
+	PipelineID string `json:"pipelineId"`
+	Steps      int    `json:"steps"`
+	Truncated  int    `json:"truncated"`
+	// TruncatedBytes is the output left out of job records, kept only in
+	// output artifacts
+	TruncatedBytes int64 `json:"truncatedBytes"`
+}
+
+// WithOutputLimit sets the size step output is truncated to, keeping its
+// head and tail. Steps can set their own limit with OutputLimit.
+func WithOutputLimit(limit int64) Option {
+	return func(pe *PipelineEngine) {
+		if limit > 0 {
+			pe.outputLimit = limit
+		}
+	}
+}
+
+// ValidateOutputLimit checks a step's output limit, such as "512Ki"
+func ValidateOutputLimit(limit string) error {
+	size, err := ParseMemory(limit)
+	if err != nil {
+		return fmt.Errorf("invalid output limit %q", limit)
+	}
+	if size < 1024 {
+		return fmt.Errorf("output limit %q must be at least 1Ki", limit)
+	}
+	return nil
+}
+
+// stepOutputLimit returns the output limit of a step
+func (pe *PipelineEngine) stepOutputLimit(step Step) int64 {
+	if step.OutputLimit != "" {
+		if limit, err := ParseMemory(step.OutputLimit); err == nil && limit > 0 {
+			return limit
+		}
+	}
+	if pe.outputLimit > 0 {
+		return pe.outputLimit
+	}
+	return DefaultOutputLimit
+}
+
+// outputLimitKey is the context key of the output limit of a step
+type outputLimitKey struct{}
+
+// withOutputLimit returns a context carrying the output limit executors
+// capture step output with
+func withOutputLimit(ctx context.Context, limit int64) context.Context {
+	return context.WithValue(ctx, outputLimitKey{}, limit)
+}
+
+// outputLimit returns the output limit in ctx, or zero when unlimited
+func outputLimit(ctx context.Context) int64 {
+	limit, _ := ctx.Value(outputLimitKey{}).(int64)
+	return limit
+}
+
+// outputSinkKey is the context key of the writer step output is streamed to
+type outputSinkKey struct{}
+
+// withOutputSink returns a context whose executors also write step output to
+// w as the command writes it
+func withOutputSink(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, outputSinkKey{}, w)
+}
+
+// outputSink returns the writer in ctx step output is streamed to, or nil
+func outputSink(ctx context.Context) io.Writer {
+	w, _ := ctx.Value(outputSinkKey{}).(io.Writer)
+	return w
+}
+
+// liveOutputInterval is how often the output of a running step is
+// published to its status
+const liveOutputInterval = 200 * time.Millisecond
+
+// maxLiveLine is how much of a line without a newline is held back before
+// it is streamed anyway
+const maxLiveLine = 64 << 10
+
+// liveOutput streams the output of a running step into its status. Output
+// is masked a line at a time, so secrets and redaction patterns match whole
+// lines, and is kept within the step's limit; once the step ends, its status
+// gets the head and tail of the full output instead.
+type liveOutput struct {
+	engine     *PipelineEngine
+	pipelineID string
+	job        *Job
+	index      int
+	stepID     string
+	secrets    map[string]string
+	limit      int64
+
+	mu      sync.Mutex
+	partial []byte
+	text    []byte
+	timer   *time.Timer
+	// full is set once the output reaches the limit
+	full   bool
+	closed bool
+}
+
+// newLiveOutput clears the output of the step at index, left over from an
+// earlier attempt, and returns a writer streaming its output into it
+func (pe *PipelineEngine) newLiveOutput(pipeline *Pipeline, job *Job, step Step, index int, secrets map[string]string) *liveOutput {
+	pe.mu.Lock()
+	job.Steps[index].Output = ""
+	pe.mu.Unlock()
+	return &liveOutput{
+		engine:     pe,
+		pipelineID: pipeline.ID,
+		job:        job,
+		index:      index,
+		stepID:     step.ID,
+		secrets:    secrets,
+		limit:      pe.stepOutputLimit(step),
+	}
+}
+
+func (o *liveOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.partial = append(o.partial, p...)
+	end := bytes.LastIndexByte(o.partial, '\n') + 1
+	if end == 0 && len(o.partial) >= maxLiveLine {
+		end = len(o.partial)
+	}
+	if end == 0 || o.full || o.closed {
+		return len(p), nil
+	}
+	line := strings.ToValidUTF8(string(o.partial[:end]), "\uFFFD")
+	o.partial = append(o.partial[:0], o.partial[end:]...)
+	text := o.engine.redact(o.pipelineID, o.stepID, maskSecrets(line, o.secrets))
+	if int64(len(o.text)+len(text)) > o.limit {
+		o.full = true
+		return len(p), nil
+	}
+	o.text = append(o.text, text...)
+	if o.timer == nil {
+		o.timer = time.AfterFunc(liveOutputInterval, o.publish)
+	}
+	return len(p), nil
+}
+
+// publish copies the output streamed so far into the step's status while
+// the step runs
+func (o *liveOutput) publish() {
+	o.mu.Lock()
+	o.timer = nil
+	if o.closed {
+		o.mu.Unlock()
+		return
+	}
+	text := string(o.text)
+	o.mu.Unlock()
+
+	o.engine.mu.Lock()
+	defer o.engine.mu.Unlock()
+	if status := &o.job.Steps[o.index]; status.Status == StatusRunning {
+		status.Output = text
+	}
+}
+
+// close stops streaming, once the step's command has exited
+func (o *liveOutput) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	if o.timer != nil {
+		o.timer.Stop()
+		o.timer = nil
+	}
+}
+
+// outputCapture captures command output within a limit. Once the output
+// exceeds it, only the first and last half of the limit are kept in memory
+// and the full output is written to a temporary file.
+type outputCapture struct {
+	limit int64
+	size  int64
+	// buf holds all output until the limit is exceeded, then the head
+	buf []byte
+	// tail is a ring buffer of the last output once the limit is exceeded
+	tail    []byte
+	tailPos int
+	file    *os.File
+	err     error
+}
+
+// newOutputCapture creates a capture, which is unlimited for limit <= 0
+func newOutputCapture(limit int64) *outputCapture {
+	return &outputCapture{limit: limit}
+}
+
+func (c *outputCapture) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	if c.file != nil {
+		if _, err := c.file.Write(p); err != nil && c.err == nil {
+			c.err = err
+		}
+		c.writeTail(p)
+		return len(p), nil
+	}
+	if c.limit <= 0 || c.size <= c.limit {
+		c.buf = append(c.buf, p...)
+		return len(p), nil
+	}
+
+	// The limit is exceeded: spill everything to a file and keep the head
+	// and tail
+	file, err := os.CreateTemp("", "conveyor-output-")
+	if err != nil {
+		c.err = err
+		c.limit = 0
+		c.buf = append(c.buf, p...)
+		return len(p), nil
+	}
+	c.file = file
+	if _, err := file.Write(c.buf); err != nil {
+		c.err = err
+	}
+	if _, err := file.Write(p); err != nil && c.err == nil {
+		c.err = err
+	}
+	all := append(c.buf, p...)
+	c.tail = make([]byte, c.limit-c.limit/2)
+	c.buf = append([]byte(nil), all[:c.limit/2]...)
+	c.writeTail(all[c.limit/2:])
+	return len(p), nil
+}
+
+// writeTail adds p to the tail ring buffer
+func (c *outputCapture) writeTail(p []byte) {
+	if len(p) >= len(c.tail) {
+		copy(c.tail, p[len(p)-len(c.tail):])
+		c.tailPos = 0
+		return
+	}
+	n := copy(c.tail[c.tailPos:], p)
+	if n < len(p) {
+		copy(c.tail, p[n:])
+	}
+	c.tailPos = (c.tailPos + len(p)) % len(c.tail)
+}
+
+// result returns the captured output, truncated with a marker when it
+// exceeded the limit, and the file with the full output, if any
+func (c *outputCapture) result() (string, string, error) {
+	if c.file == nil {
+		return string(c.buf), "", c.err
+	}
+	path := c.file.Name()
+	if err := c.file.Close(); err != nil && c.err == nil {
+		c.err = err
+	}
+	if c.err != nil {
+		os.Remove(path)
+		path = ""
+	}
+
+	tail := append(append([]byte(nil), c.tail[c.tailPos:]...), c.tail[:c.tailPos]...)
+	return joinTruncated(string(c.buf), string(tail), c.size), path, c.err
+}
+
+// truncateOutput keeps the head and tail of output within limit
+func truncateOutput(output string, limit int64) string {
+	if limit <= 0 || int64(len(output)) <= limit {
+		return output
+	}
+	head := output[:limit/2]
+	tail := output[int64(len(output))-(limit-limit/2):]
+	return joinTruncated(head, tail, int64(len(output)))
+}
+
+// joinTruncated joins the head and tail of output of size bytes with the
+// truncation marker. Characters split at the cut are left out, so truncation
+// doesn't turn text into invalid UTF-8.
+func joinTruncated(head, tail string, size int64) string {
+	for i := len(head) - 1; i >= 0 && i >= len(head)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(head[i]) {
+			if !utf8.FullRuneInString(head[i:]) {
+				head = head[:i]
+			}
+			break
+		}
+	}
+	for i := 0; i < len(tail) && i < utf8.UTFMax; i++ {
+		if utf8.RuneStart(tail[i]) {
+			tail = tail[i:]
+			break
+		}
+	}
+	return head + fmt.Sprintf(outputTruncatedFormat, size-int64(len(head))-int64(len(tail))) + tail
+}
+
+// binaryOutput reports whether output looks binary rather than text: its
+// start has a NUL byte, or more than 30% of it is invalid UTF-8 or
+// control characters other than whitespace, bells, backspaces and escapes
+func binaryOutput(output string) bool {
+	sample := output
+	if len(sample) > binarySample {
+		sample = sample[:binarySample]
+	}
+	if strings.IndexByte(sample, 0) >= 0 {
+		return true
+	}
+	bad := 0
+	for i := 0; i < len(sample); {
+		r, size := utf8.DecodeRuneInString(sample[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			// A character cut off by the sample's end isn't invalid
+			if len(sample) < len(output) && !utf8.FullRuneInString(sample[i:]) {
+				i = len(sample)
+				continue
+			}
+			bad++
+		case r < 0x20 && !strings.ContainsRune("\t\n\v\f\r\a\b\x1b", r), r == 0x7f:
+			bad++
+		}
+		i += size
+	}
+	return bad*10 > len(sample)*3
+}
+
+// limitOutput truncates the output of a step result to the step's limit and
+// keeps it out of the job record when it is binary, or replaces invalid
+// UTF-8 in it. The full, raw output is stored as the artifact output-<step>
+// of the job when the store keeps artifacts.
+func (pe *PipelineEngine) limitOutput(pipeline *Pipeline, job *Job, step Step, index int, result *StepResult, secrets map[string]string) {
+	if result == nil {
+		return
+	}
+	limit := pe.stepOutputLimit(step)
+	full := result.fullOutput
+	result.fullOutput = ""
+	binary := binaryOutput(result.Output)
+	sanitized := !binary && !utf8.ValidString(result.Output)
+	if full == "" && (int64(len(result.Output)) > limit || binary || sanitized) {
+		result.outputSize = int64(len(result.Output))
+		if file, err := os.CreateTemp("", "conveyor-output-"); err == nil {
+			_, err = file.WriteString(result.Output)
+			file.Close()
+			if err == nil {
+				full = file.Name()
+			} else {
+				os.Remove(file.Name())
+			}
+		}
+		result.Output = truncateOutput(result.Output, limit)
+	}
+	if full != "" {
+		defer os.Remove(full)
+	}
+
+	size := result.outputSize
+	if size == 0 {
+		size = int64(len(result.Output))
+	}
+	truncated := size > limit
+
+	artifact := ""
+	if truncated || binary || sanitized {
+		artifact = pe.saveFullOutput(pipeline, job, step, full, secrets)
+	}
+	if truncated && !binary {
+		message := fmt.Sprintf("Output of step %s truncated to %d of %d bytes", step.ID, limit, size)
+		if artifact != "" {
+			message += "; the full output is in artifact " + artifact
+		}
+		pe.logJob(job, "warn", step.ID, message)
+	}
+	switch {
+	case binary:
+		result.Output = ""
+		message := fmt.Sprintf("Output of step %s is binary (%d bytes) and left out of the job", step.ID, size)
+		if artifact != "" {
+			message += "; it is in artifact " + artifact
+		}
+		pe.logJob(job, "warn", step.ID, message)
+	case sanitized:
+		result.Output = strings.ToValidUTF8(result.Output, "\uFFFD")
+	}
+
+	pe.mu.Lock()
+	stepStatus := &job.Steps[index]
+	stepStatus.OutputSize = size
+	stepStatus.OutputTruncated = truncated && !binary
+	stepStatus.OutputBinary = binary
+	stepStatus.OutputSanitized = sanitized
+	stepStatus.OutputArtifact = artifact
+	stats := pe.outputStats[pipeline.ID]
+	if stats == nil {
+		stats = &OutputStats{PipelineID: pipeline.ID}
+		pe.outputStats[pipeline.ID] = stats
+	}
+	stats.Steps++
+	if truncated && !binary {
+		stats.Truncated++
+		stats.TruncatedBytes += size - limit
+	}
+	pe.mu.Unlock()
+}
+
+// saveFullOutput stores the full output of a step, with secrets masked, as
+// an artifact and returns its name, or "" when it wasn't stored
+func (pe *PipelineEngine) saveFullOutput(pipeline *Pipeline, job *Job, step Step, path string, secrets map[string]string) string {
+	store := pe.artifactStore()
+	if store == nil || path == "" {
+		return ""
+	}
+	dir, err := os.MkdirTemp("", "conveyor-output-")
+	if err != nil {
+		return ""
+	}
+	defer os.RemoveAll(dir)
+
+	name := "output-" + step.ID
+	if err := maskFile(filepath.Join(dir, step.ID+".log"), path, secrets, pe.redactPatterns(pipeline.ID, step.ID)); err != nil {
+		pe.logJob(job, "warn", step.ID, fmt.Sprintf("Failed to keep the full output of step %s: %v", step.ID, err))
+		return ""
+	}
+	artifact := &Artifact{
+		Name:       name,
+		PipelineID: pipeline.ID,
+		JobID:      job.ID,
+		CreatedAt:  time.Now(),
+	}
+	if err := store.SaveArtifact(artifact, dir, []string{step.ID + ".log"}); err != nil {
+		pe.logJob(job, "warn", step.ID, fmt.Sprintf("Failed to keep the full output of step %s: %v", step.ID, err))
+		return ""
+	}
+	return name
+}
+
+// maskFile copies src to dst with secret values and the text redaction
+// patterns match replaced by ***, reading src in chunks. Enough of each
+// chunk is carried over to the next to mask values split between them, and
+// with patterns, its last partial line.
+func maskFile(dst, src string, secrets map[string]string, patterns []*regexp.Regexp) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	overlap := 0
+	for _, value := range secrets {
+		if len(value) > overlap {
+			overlap = len(value)
+		}
+	}
+	var carry []byte
+	chunk := make([]byte, 64<<10)
+	for err == nil {
+		var n int
+		n, err = in.Read(chunk)
+		data := append(carry, chunk[:n]...)
+		for _, value := range secrets {
+			if value != "" {
+				data = bytes.ReplaceAll(data, []byte(value), []byte("***"))
+			}
+		}
+		keep := 0
+		if err == nil && overlap > 1 {
+			keep = overlap - 1
+			if keep > len(data) {
+				keep = len(data)
+			}
+		}
+		if line := len(data) - bytes.LastIndexByte(data, '\n') - 1; err == nil && len(patterns) > 0 && line > keep && line <= len(chunk) {
+			keep = line
+		}
+		write := data[:len(data)-keep]
+		if len(patterns) > 0 {
+			write = []byte(redactText(string(write), patterns))
+		}
+		if _, writeErr := out.Write(write); writeErr != nil {
+			out.Close()
+			return writeErr
+		}
+		carry = append([]byte(nil), data[len(data)-keep:]...)
+	}
+	if closeErr := out.Close(); closeErr != nil {
+		return closeErr
+	}
+	if err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// OutputStats reports how often step output was truncated per pipeline,
+// sorted by pipeline ID
+func (pe *PipelineEngine) OutputStats() []OutputStats {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	stats := make([]OutputStats, 0, len(pe.outputStats))
+	for _, s := range pe.outputStats {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].PipelineID < stats[j].PipelineID
+	})
+	return stats
+}
+
+// StepOutput describes the output of a step of a job. Of a step that ran more
+// than once, such as a step rolled back and run again, the last run counts.
+func (pe *PipelineEngine) StepOutput(jobID, stepID string) (*StepOutput, error) {
+	status, err := pe.stepStatus(jobID, stepID)
+	if err != nil {
+		return nil, err
+	}
+	size := status.OutputSize
+	if size == 0 {
+		size = int64(len(status.Output))
+	}
+	return &StepOutput{
+		JobID:     jobID,
+		StepID:    stepID,
+		Size:      size,
+		Binary:    status.OutputBinary,
+		Sanitized: status.OutputSanitized,
+		Artifact:  status.OutputArtifact,
+	}, nil
+}
+
+// WriteStepOutput writes the raw output of a step to w: the full output
+// when it was kept as an artifact, or else the output in the job record
+func (pe *PipelineEngine) WriteStepOutput(jobID, stepID string, w io.Writer) error {
+	status, err := pe.stepStatus(jobID, stepID)
+	if err != nil {
+		return err
+	}
+	if status.OutputArtifact == "" {
+		if status.OutputBinary {
+			return fmt.Errorf("%w: binary output of step %s wasn't kept", ErrStepOutputNotFound, stepID)
+		}
+		_, err := io.WriteString(w, status.Output)
+		return err
+	}
+
+	artifacts, err := pe.JobArtifacts(jobID)
+	if err != nil {
+		return err
+	}
+	for _, artifact := range artifacts {
+		if artifact.Name != status.OutputArtifact {
+			continue
+		}
+		found := false
+		err := pe.readArtifact(artifact, func(header *tar.Header, r io.Reader) error {
+			if header.Name != stepID+".log" {
+				return nil
+			}
+			found = true
+			_, err := io.Copy(w, r)
+			return err
+		})
+		if err == nil && !found {
+			err = fmt.Errorf("%w: artifact %s has no output", ErrStepOutputNotFound, artifact.Name)
+		}
+		return err
+	}
+	return fmt.Errorf("%w: artifact %s expired", ErrStepOutputNotFound, status.OutputArtifact)
+}
+
+// stepStatus returns a copy of the status of the last run of a step
+func (pe *PipelineEngine) stepStatus(jobID, stepID string) (*StepStatus, error) {
+	job, err := pe.FindJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	for i := len(job.Steps) - 1; i >= 0; i-- {
+		if job.Steps[i].ID == stepID {
+			status := job.Steps[i]
+			return &status, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrStepOutputNotFound, stepID)
+}
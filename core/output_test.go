@@ -0,0 +1,179 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestOutputCapture_KeepsHeadAndTail(t *testing.T) {
+	c := newOutputCapture(10)
+	for _, chunk := range []string{"012", "345", "678", "9ab", "cde", "fgh", "ij"} {
+		c.Write([]byte(chunk))
+	}
+	output, path, err := c.result()
+	if err != nil {
+		t.Fatalf("result() error = %v", err)
+	}
+	defer os.Remove(path)
+
+	if want := "01234" + fmt.Sprintf(outputTruncatedFormat, 10) + "fghij"; output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "0123456789abcdefghij" {
+		t.Errorf("full output = %q, want everything written", data)
+	}
+
+	small := newOutputCapture(10)
+	small.Write([]byte("short"))
+	if output, path, _ := small.result(); output != "short" || path != "" {
+		t.Errorf("result() = %q, %q, want the output untouched", output, path)
+	}
+}
+
+func TestTruncateOutput(t *testing.T) {
+	if got := truncateOutput("0123456789abc", 4); got != "01"+fmt.Sprintf(outputTruncatedFormat, 9)+"bc" {
+		t.Errorf("truncateOutput() = %q", got)
+	}
+	if got := truncateOutput("0123", 4); got != "0123" {
+		t.Errorf("truncateOutput() = %q, want output within the limit untouched", got)
+	}
+}
+
+func TestTruncateOutput_KeepsCharactersWhole(t *testing.T) {
+	got := truncateOutput("aé"+strings.Repeat("x", 10)+"éb", 6)
+	if !utf8.ValidString(got) || !strings.HasPrefix(got, "aé") || !strings.HasSuffix(got, "éb") {
+		t.Errorf("truncateOutput() = %q, want whole characters", got)
+	}
+	if got := truncateOutput("ab€"+strings.Repeat("x", 10)+"€", 6); !strings.HasPrefix(got, "ab\n") || !strings.HasSuffix(got, "\n€") {
+		t.Errorf("truncateOutput() = %q, want split characters left out", got)
+	}
+}
+
+func TestBinaryOutput(t *testing.T) {
+	for _, text := range []string{"", "plain\ttext\r\n", "\x1b[31mred\x1b[0m ✓\n", "caf\xe9 latin-1\n"} {
+		if binaryOutput(text) {
+			t.Errorf("binaryOutput(%q) = true, want false", text)
+		}
+	}
+	for _, binary := range []string{"PK\x03\x04\x00\x00", "\x89PNG\r\n\x1a\n\xff\xfe\x01\x02\x03"} {
+		if !binaryOutput(binary) {
+			t.Errorf("binaryOutput(%q) = false, want true", binary)
+		}
+	}
+}
+
+func TestRun_BinaryAndInvalidOutput(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := newTestEngine(WithStore(store))
+	engine.CreatePipeline(scriptPipeline("bin", `printf 'PK\003\004\000\000\001'`, `printf 'caf\351\n'`))
+
+	job, err := engine.Run(context.Background(), "bin")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	binary, latin := job.Steps[0], job.Steps[1]
+	if !binary.OutputBinary || binary.Output != "" || binary.OutputArtifact != "output-build-step-a" {
+		t.Errorf("binary step = %+v, want its output only in an artifact", binary)
+	}
+	if !latin.OutputSanitized || latin.Output != "caf\uFFFD\n" {
+		t.Errorf("invalid UTF-8 step = %+v, want the invalid byte replaced", latin)
+	}
+	if _, err := json.Marshal(job); err != nil {
+		t.Errorf("json.Marshal(job) error = %v", err)
+	}
+
+	var raw bytes.Buffer
+	if err := engine.WriteStepOutput(job.ID, "build-step-a", &raw); err != nil || raw.String() != "PK\003\004\000\000\001" {
+		t.Errorf("WriteStepOutput() = %q, %v, want the raw binary output", raw.String(), err)
+	}
+	raw.Reset()
+	if err := engine.WriteStepOutput(job.ID, "build-step-b", &raw); err != nil || raw.String() != "caf\351\n" {
+		t.Errorf("WriteStepOutput() = %q, %v, want the raw invalid UTF-8", raw.String(), err)
+	}
+	if output, err := engine.StepOutput(job.ID, "build-step-a"); err != nil || !output.Binary || output.Size != 7 {
+		t.Errorf("StepOutput() = %+v, %v, want 7 binary bytes", output, err)
+	}
+	if _, err := engine.StepOutput(job.ID, "unknown"); !errors.Is(err, ErrStepOutputNotFound) {
+		t.Errorf("StepOutput(unknown) error = %v, want ErrStepOutputNotFound", err)
+	}
+}
+
+func TestMaskFile_ValuesAcrossChunks(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	content := strings.Repeat("a", 64<<10-3) + "hunter2" + strings.Repeat("b", 10)
+	os.WriteFile(src, []byte(content), 0644)
+
+	dst := filepath.Join(dir, "dst")
+	if err := maskFile(dst, src, map[string]string{"TOKEN": "hunter2"}, nil); err != nil {
+		t.Fatalf("maskFile() error = %v", err)
+	}
+	data, _ := os.ReadFile(dst)
+	if want := strings.Replace(content, "hunter2", "***", 1); string(data) != want {
+		t.Errorf("masked file has %d bytes, contains secret: %v", len(data), strings.Contains(string(data), "hunter2"))
+	}
+}
+
+func TestMaskFile_PatternsAcrossChunks(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	content := strings.Repeat("a\n", 32<<10-4) + "db-17.internal.example\nok\n"
+	os.WriteFile(src, []byte(content), 0644)
+
+	dst := filepath.Join(dir, "dst")
+	if err := maskFile(dst, src, nil, []*regexp.Regexp{regexp.MustCompile(`[a-z0-9-]+\.internal\.example`)}); err != nil {
+		t.Fatalf("maskFile() error = %v", err)
+	}
+	data, _ := os.ReadFile(dst)
+	if want := strings.Replace(content, "db-17.internal.example", "***", 1); string(data) != want {
+		t.Errorf("masked file has %d bytes, contains hostname: %v", len(data), strings.Contains(string(data), "internal.example"))
+	}
+}
+
+func TestRun_TruncatesStepOutput(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := newTestEngine(WithStore(store), WithOutputLimit(1<<20))
+	pipeline := scriptPipeline("logs", `i=0; while [ $i -lt 500 ]; do echo "line $i of noisy output"; i=$((i+1)); done`, `echo quiet`)
+	pipeline.Stages[0].Steps[0].OutputLimit = "1Ki"
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "logs")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	noisy, quiet := job.Steps[0], job.Steps[1]
+	if !noisy.OutputTruncated || noisy.OutputArtifact != "output-build-step-a" || noisy.OutputSize < 10000 {
+		t.Fatalf("step = %+v, want truncated output kept in an artifact", noisy)
+	}
+	if len(noisy.Output) > 1100 || !strings.HasPrefix(noisy.Output, "line 0 ") || !strings.HasSuffix(noisy.Output, "line 499 of noisy output\n") ||
+		!strings.Contains(noisy.Output, "bytes truncated") {
+		t.Errorf("Output = %q, want its head and tail with a marker", noisy.Output)
+	}
+	if quiet.OutputTruncated || quiet.Output != "quiet\n" {
+		t.Errorf("second step = %+v, want its output untouched", quiet)
+	}
+
+	artifacts, _ := engine.JobArtifacts(job.ID)
+	if len(artifacts) != 1 || artifacts[0].Size != noisy.OutputSize {
+		t.Errorf("artifacts = %+v, want the full output", artifacts)
+	}
+	stats := engine.OutputStats()
+	if len(stats) != 1 || stats[0].Steps != 2 || stats[0].Truncated != 1 {
+		t.Errorf("OutputStats() = %+v, want one of two steps truncated", stats)
+	}
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// outputMarker starts the lines of a step's output that set its outputs,
+// as in "::output version=1.4.2"
+const outputMarker = "::output "
+
+// outputName matches the names of step outputs
+var outputName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// stepOutputReference matches references to step outputs, such as
+// steps.build-compile.outputs.version
+var stepOutputReference = regexp.MustCompile(`^steps\.([A-Za-z0-9_-]+)\.outputs\.([A-Za-z0-9_-]+)$`)
+
+// stepOutputs returns the values of the outputs a step declares, and the
+// names of those it didn't set. Outputs are set by marker lines of the
+// step's output, the last one winning, or read from a plugin's results
+// at the field the step maps them to, which is the output's name by
+// default.
+func stepOutputs(step Step, result *StepResult) (map[string]string, []string) {
+	if len(step.Outputs) == 0 || result == nil {
+		return nil, nil
+	}
+	set := make(map[string]string)
+	for _, line := range strings.Split(result.Output, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if !strings.HasPrefix(line, outputMarker) {
+			continue
+		}
+		name, value := line[len(outputMarker):], ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = name[:i], name[i+1:]
+		}
+		if _, declared := step.Outputs[name]; declared {
+			set[name] = value
+		}
+	}
+
+	outputs := make(map[string]string, len(step.Outputs))
+	var missing []string
+	for name, field := range step.Outputs {
+		if value, ok := set[name]; ok {
+			outputs[name] = value
+			continue
+		}
+		if field == "" {
+			field = name
+		}
+		if value, ok := resultField(result.Outputs, field); ok {
+			outputs[name] = formatValue(value)
+			continue
+		}
+		missing = append(missing, name)
+	}
+	sort.Strings(missing)
+	return outputs, missing
+}
+
+// resultField returns the value of a plugin result at a dotted path, such
+// as "image.digest"
+func resultField(results map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = results
+	for _, key := range strings.Split(path, ".") {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = fields[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// addStepOutputs adds the outputs of the steps a job ran to reference
+// values. Callers must hold pe.mu.
+func addStepOutputs(values map[string]string, job *Job) map[string]string {
+	for _, step := range job.Steps {
+		for name, value := range step.Outputs {
+			values["steps."+step.ID+".outputs."+name] = value
+		}
+	}
+	return values
+}
+
+// ValidateStepOutputs checks the names of the outputs steps declare, and
+// that references to step outputs name an output another step of the
+// pipeline declares
+func ValidateStepOutputs(stages []Stage) error {
+	declared := make(map[string]map[string]string)
+	for _, stage := range stages {
+		for _, step := range stage.Steps {
+			for name := range step.Outputs {
+				if !outputName.MatchString(name) {
+					return fmt.Errorf("step %s: invalid output name %q", step.ID, name)
+				}
+			}
+			declared[step.ID] = step.Outputs
+		}
+	}
+
+	// Syntax errors are reported by the checks of expressions
+	check := func(s, stepID, what string) error {
+		refs, err := textReferences(s)
+		if err != nil {
+			return nil
+		}
+		for _, ref := range refs {
+			if !strings.HasPrefix(ref, "steps.") {
+				continue
+			}
+			match := stepOutputReference.FindStringSubmatch(ref)
+			switch {
+			case match == nil:
+				return fmt.Errorf("%s: invalid step output reference %q, want steps.<step>.outputs.<name>", what, ref)
+			case match[1] == stepID:
+				return fmt.Errorf("%s references its own output %s", what, match[2])
+			case declared[match[1]] == nil:
+				return fmt.Errorf("%s: %q references unknown step %s", what, ref, match[1])
+			}
+			if _, ok := declared[match[1]][match[2]]; !ok {
+				return fmt.Errorf("%s: step %s has no output %s", what, match[1], match[2])
+			}
+		}
+		return nil
+	}
+	for _, stage := range stages {
+		if stage.When != nil {
+			if err := check(stage.When.Custom, "", "stage "+stage.ID); err != nil {
+				return err
+			}
+		}
+		for _, step := range stage.Steps {
+			texts := []string{step.Command}
+			for _, value := range step.Environment {
+				texts = append(texts, value)
+			}
+			for _, value := range step.Config {
+				if s, ok := value.(string); ok {
+					texts = append(texts, s)
+				}
+			}
+			if step.When != nil {
+				texts = append(texts, step.When.Custom)
+			}
+			for _, text := range texts {
+				if err := check(text, step.ID, "step "+step.ID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
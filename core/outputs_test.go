@@ -0,0 +1,84 @@
+package core
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStepOutputs(t *testing.T) {
+	step := Step{Outputs: map[string]string{"version": "", "digest": "image.digest", "missing": ""}}
+	result := &StepResult{
+		Output: "building\n::output version=1.0\n::output version=1.2.3\r\n::output other=x\n",
+		Outputs: map[string]interface{}{
+			"image": map[string]interface{}{"digest": "sha256:abc"},
+		},
+	}
+	outputs, missing := stepOutputs(step, result)
+	if want := map[string]string{"version": "1.2.3", "digest": "sha256:abc"}; !reflect.DeepEqual(outputs, want) {
+		t.Errorf("outputs = %v, want %v", outputs, want)
+	}
+	if !reflect.DeepEqual(missing, []string{"missing"}) {
+		t.Errorf("missing = %v, want [missing]", missing)
+	}
+}
+
+func TestRun_StepOutputs(t *testing.T) {
+	plugin := &fakePlugin{name: "image", outputs: map[string]interface{}{
+		"image": map[string]interface{}{"digest": "sha256:abc", "size": 42},
+	}}
+	engine := newTestEngine(WithPlugins(plugin), WithExecutor(&ShellExecutor{Dir: t.TempDir()}))
+	pipeline := scriptPipeline("outputs", `echo "::output version=1.2.3"`)
+	pipeline.Stages[0].Steps[0].Outputs = map[string]string{"version": ""}
+	pipeline.Stages = append(pipeline.Stages, Stage{ID: "publish", Steps: []Step{
+		{ID: "image", Type: "plugin", Plugin: "image", Outputs: map[string]string{"digest": "image.digest", "size": "image.size"},
+			Config: map[string]interface{}{"tag": "app:${{ steps.build-step-a.outputs.version }}"}},
+		{ID: "check", Type: "script", Command: `test "${{ steps.build-step-a.outputs.version }}/${{ steps.image.outputs.digest }}/${{ steps.image.outputs.size }}" = "1.2.3/sha256:abc/42"`},
+	}})
+	if err := engine.CreatePipeline(pipeline); err != nil {
+		t.Fatalf("CreatePipeline() error = %v", err)
+	}
+
+	job, err := engine.Run(context.Background(), "outputs")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess {
+		t.Fatalf("Status = %q, want success with the outputs passed on; steps %+v", job.Status, job.Steps)
+	}
+	if got := job.Steps[0].Outputs["version"]; got != "1.2.3" {
+		t.Errorf("version = %q, want 1.2.3", got)
+	}
+	if got := plugin.steps[0].Config["tag"]; got != "app:1.2.3" {
+		t.Errorf("Config[tag] = %v, want app:1.2.3", got)
+	}
+}
+
+func TestValidateStepOutputs(t *testing.T) {
+	stages := func(command string) []Stage {
+		return []Stage{{ID: "build", Steps: []Step{
+			{ID: "compile", Outputs: map[string]string{"version": ""}},
+			{ID: "publish", Command: command},
+		}}}
+	}
+	if err := ValidateStepOutputs(stages("publish ${{ steps.compile.outputs.version }}")); err != nil {
+		t.Errorf("ValidateStepOutputs() error = %v", err)
+	}
+	for command, want := range map[string]string{
+		"publish ${{ steps.compile }}":                      "invalid step output reference",
+		"publish ${{ steps.test.outputs.version }}":         "unknown step test",
+		"publish ${{ steps.compile.outputs.digest }}":       "has no output digest",
+		"publish ${{ toUpper(steps.compile.outputs.tag) }}": "has no output tag",
+		"publish ${{ steps.publish.outputs.version }}":      "references its own output",
+	} {
+		if err := ValidateStepOutputs(stages(command)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("ValidateStepOutputs(%q) error = %v, want %q", command, err, want)
+		}
+	}
+
+	invalid := []Stage{{ID: "build", Steps: []Step{{ID: "compile", Outputs: map[string]string{"a.b": ""}}}}}
+	if err := ValidateStepOutputs(invalid); err == nil {
+		t.Error("ValidateStepOutputs() of an invalid output name succeeded")
+	}
+}
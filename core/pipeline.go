@@ -3,44 +3,113 @@ package core
 import (
 	"context"
 	"fmt"
+	"log"
+	"sort"
 	"sync"
 	"time"
 )
 
 // Event represents a pipeline event
 type Event struct {
-	Type      string                 `json:"type"`
-	Timestamp time.Time              `json:"timestamp"`
-	PipelineID string                `json:"pipelineId,omitempty"`
-	JobID     string                 `json:"jobId,omitempty"`
-	StepID    string                 `json:"stepId,omitempty"`
-	Data      map[string]interface{} `json:"data,omitempty"`
+	// ID is unique among the engine's events
+	ID         string                 `json:"id"`
+	Type       string                 `json:"type"`
+	Timestamp  time.Time              `json:"timestamp"`
+	PipelineID string                 `json:"pipelineId,omitempty"`
+	JobID      string                 `json:"jobId,omitempty"`
+	StepID     string                 `json:"stepId,omitempty"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+	// Origin is the replica that emitted the event, with a shared event bus
+	Origin string `json:"origin,omitempty"`
+	// Position is where the event is on the event bus
+	Position string `json:"position,omitempty"`
 }
 
 // Pipeline represents a CI/CD pipeline
 type Pipeline struct {
-	ID          string                 `json:"id"`
-	Name        string                 `json:"name"`
-	Description string                 `json:"description,omitempty"`
-	Stages      []Stage                `json:"stages"`
-	Triggers    []Trigger              `json:"triggers,omitempty"`
-	Cache       *CacheConfig           `json:"cache,omitempty"`
-	Environment map[string]string      `json:"environment,omitempty"`
-	Metadata    map[string]interface{} `json:"metadata,omitempty"`
-	CreatedAt   time.Time              `json:"createdAt"`
-	UpdatedAt   time.Time              `json:"updatedAt"`
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Readme documents the pipeline in Markdown, and Info tells on-call
+	// engineers who owns it and where its runbook is
+	Readme string        `json:"readme,omitempty"`
+	Info   *PipelineInfo `json:"info,omitempty"`
+	// Version identifies the pipeline's definition. It is set by the engine
+	// and changes whenever the definition does.
+	Version     string            `json:"version,omitempty"`
+	Stages      []Stage           `json:"stages"`
+	Triggers    []Trigger         `json:"triggers,omitempty"`
+	Cache       *CacheConfig      `json:"cache,omitempty"`
+	Environment map[string]string `json:"environment,omitempty"`
+	Artifacts   []ArtifactConfig  `json:"artifacts,omitempty"`
+	// ArtifactRetention limits how long the pipeline's artifacts are kept
+	ArtifactRetention *RetentionPolicy `json:"artifactRetention,omitempty"`
+	// ConcurrencyGroup allows one running job at a time among the jobs of
+	// the group, across pipelines. It may reference trigger values, as in
+	// "pr-${{ trigger.pr }}". A newer job replaces the group's pending job.
+	ConcurrencyGroup string `json:"concurrencyGroup,omitempty"`
+	// CancelInProgress also cancels the group's running job when a newer
+	// job of this pipeline starts
+	CancelInProgress bool `json:"cancelInProgress,omitempty"`
+	// Workspace keeps the pipeline's workspace warm between jobs
+	Workspace *WorkspaceConfig `json:"workspace,omitempty"`
+	// Team owns the pipeline and is charged for its jobs in cost reports
+	Team string `json:"team,omitempty"`
+	// Release names the promoted release a deploy pipeline's jobs use
+	// instead of building. It may reference trigger values, as in
+	// "${{ trigger.release }}".
+	Release string `json:"release,omitempty"`
+	// Network is the egress allowed to all steps with a network policy,
+	// and with DefaultDeny, to every command step
+	Network *NetworkPolicy `json:"network,omitempty"`
+	// DiskQuota is the most disk, such as "20Gi", the directory of each
+	// of the pipeline's jobs may use, overriding the engine's quota
+	DiskQuota string `json:"diskQuota,omitempty"`
+	// Budget limits the duration, steps and retries of the pipeline's
+	// jobs
+	Budget *Budget `json:"budget,omitempty"`
+	// DebugOnFailure keeps the environment of a failed step alive for the
+	// duration, such as "30m", so it can be inspected in a debug session
+	DebugOnFailure string `json:"debugOnFailure,omitempty"`
+	// Redact masks the text these regular expressions match, such as
+	// internal hostnames or customer identifiers, in the logs, outputs and
+	// events of the pipeline's jobs
+	Redact    []string               `json:"redact,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	CreatedAt time.Time              `json:"createdAt"`
+	UpdatedAt time.Time              `json:"updatedAt"`
 }
 
 // Stage represents a stage in a pipeline
 type Stage struct {
-	ID        string                 `json:"id"`
-	Name      string                 `json:"name"`
-	Steps     []Step                 `json:"steps"`
-	Needs     []string               `json:"needs,omitempty"`
-	When      *ConditionalExecution  `json:"when,omitempty"`
-	Metadata  map[string]interface{} `json:"metadata,omitempty"`
-	Parallel  bool                   `json:"parallel"`
-	DependsOn []string               `json:"dependsOn,omitempty"`
+	ID       string                 `json:"id"`
+	Name     string                 `json:"name"`
+	Steps    []Step                 `json:"steps"`
+	Needs    []string               `json:"needs,omitempty"`
+	When     *ConditionalExecution  `json:"when,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// Parallel runs the stage's steps concurrently, at most MaxParallel at
+	// a time when it is positive
+	Parallel    bool     `json:"parallel"`
+	MaxParallel int      `json:"maxParallel,omitempty"`
+	DependsOn   []string `json:"dependsOn,omitempty"`
+	// AllowFailure lets the job continue when a step of the stage fails
+	AllowFailure bool `json:"allowFailure,omitempty"`
+	// Speculative starts the stage while the preceding allowFailure stage
+	// is still running. If that stage fails, the speculative work is
+	// cancelled, undone by the Rollback steps and run again.
+	Speculative bool   `json:"speculative,omitempty"`
+	Rollback    []Step `json:"rollback,omitempty"`
+	// RunsOn selects the runners the stage's steps run on by label
+	RunsOn []string `json:"runsOn,omitempty"`
+	// Services run for the duration of the stage
+	Services []Service `json:"services,omitempty"`
+	// Deploy names the environment the stage deploys to, such as
+	// production. Active incidents freeze deploys to their environments.
+	Deploy string `json:"deploy,omitempty"`
+	// Matrix expands each of the stage's steps into a step per
+	// combination of its values, along with the axes of the step's own
+	Matrix *Matrix `json:"matrix,omitempty"`
 }
 
 // Step represents a step in a pipeline stage
@@ -58,8 +127,47 @@ type Step struct {
 	Timeout     string                 `json:"timeout,omitempty"`
 	Cache       *CacheConfig           `json:"cache,omitempty"`
 	DependsOn   []string               `json:"dependsOn,omitempty"`
-	Outputs     map[string]string      `json:"outputs,omitempty"`
-	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	// WorkingDir is the directory the step runs in, relative to the job's
+	// workspace
+	WorkingDir string `json:"workingDir,omitempty"`
+	// Redact masks what these regular expressions match in the step's
+	// logs, outputs and events, besides the pipeline's patterns
+	Redact []string `json:"redact,omitempty"`
+	// Outputs are the named values the step sets for later steps, with
+	// "::output name=value" lines of its output, or that a plugin step
+	// returns in the result field each maps to, its name when empty
+	Outputs map[string]string `json:"outputs,omitempty"`
+	Memoize *MemoizeConfig    `json:"memoize,omitempty"`
+	// Secrets lists secrets injected as environment variables of the same name
+	Secrets  []string               `json:"secrets,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// RunsOn overrides the runner labels of the step's stage
+	RunsOn []string `json:"runsOn,omitempty"`
+	// Services run for the duration of the step
+	Services []Service `json:"services,omitempty"`
+	// Resources are reserved on the step's runner while it runs
+	Resources *ResourceRequirements `json:"resources,omitempty"`
+	// OutputLimit overrides the size the step's output is truncated to,
+	// such as "16Mi"
+	OutputLimit string `json:"outputLimit,omitempty"`
+	// ExitCodes maps exit codes to the step's status: success, warning,
+	// skipped or failed
+	ExitCodes map[int]Status `json:"exitCodes,omitempty"`
+	// Failures classify the step's failures, first match wins
+	Failures []FailureRule `json:"failures,omitempty"`
+	// Locks are named locks on external resources the step holds while it
+	// runs, waiting up to LockTimeout for them
+	Locks       []string `json:"locks,omitempty"`
+	LockTimeout string   `json:"lockTimeout,omitempty"`
+	// Network restricts the step's outbound connections to its egress
+	// list and the pipeline's
+	Network *NetworkPolicy `json:"network,omitempty"`
+	// Matrix expands the step into a step per combination of its values,
+	// which run concurrently
+	Matrix *Matrix `json:"matrix,omitempty"`
+
+	// matrix is the combination of values of a step a matrix expanded
+	matrix *matrixCell
 }
 
 // Trigger represents a pipeline trigger
@@ -68,6 +176,21 @@ type Trigger struct {
 	Branches []string `json:"branches,omitempty"`
 	Events   []string `json:"events,omitempty"`
 	Paths    []string `json:"paths,omitempty"`
+	// Cron is when a schedule trigger runs the pipeline
+	Cron string `json:"cron,omitempty"`
+	// Timezone is the IANA time zone Cron is read in. Defaults to the
+	// engine's schedule time zone.
+	Timezone string `json:"timezone,omitempty"`
+	// Pipeline is the pipeline whose successful jobs start this one with a
+	// pipeline-completed trigger, when they ran for one of Branches and
+	// have the trigger values of Labels
+	Pipeline string            `json:"pipeline,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	// Debounce collapses the webhook runs for a branch that arrive within
+	// this window, such as "30s", into one run for the latest commit.
+	// MaxDelay bounds how long the first of them waits.
+	Debounce string `json:"debounce,omitempty"`
+	MaxDelay string `json:"maxDelay,omitempty"`
 }
 
 // ConditionalExecution represents a condition for executing a step or stage
@@ -80,9 +203,12 @@ type ConditionalExecution struct {
 
 // RetryConfig represents retry configuration for a step
 type RetryConfig struct {
-	MaxAttempts int    `json:"maxAttempts"`
-	Interval    string `json:"interval,omitempty"`
-	ExponentialBackoff bool `json:"exponentialBackoff,omitempty"`
+	MaxAttempts        int    `json:"maxAttempts"`
+	Interval           string `json:"interval,omitempty"`
+	ExponentialBackoff bool   `json:"exponentialBackoff,omitempty"`
+	// On limits retries to failures of these classes, such as
+	// infrastructure
+	On []string `json:"on,omitempty"`
 }
 
 // CacheConfig represents caching configuration
@@ -96,23 +222,100 @@ type CacheConfig struct {
 type Job struct {
 	ID         string                 `json:"id"`
 	PipelineID string                 `json:"pipelineId"`
-	Status     string                 `json:"status"`
+	Status     Status                 `json:"status"`
 	Steps      []StepStatus           `json:"steps,omitempty"`
+	QueuedAt   time.Time              `json:"queuedAt,omitempty"`
 	StartedAt  time.Time              `json:"startedAt"`
 	EndedAt    time.Time              `json:"endedAt,omitempty"`
+	Phases     []Phase                `json:"phases,omitempty"`
 	Metadata   map[string]interface{} `json:"metadata,omitempty"`
 	Logs       []LogEntry             `json:"logs,omitempty"`
+	// LegalHold exempts the job's artifacts from expiry
+	LegalHold *LegalHold `json:"legalHold,omitempty"`
+	// PipelineVersion is the version of the pipeline the job ran
+	PipelineVersion string `json:"pipelineVersion,omitempty"`
+	// Revision is the code the job ran against
+	Revision *Revision `json:"revision,omitempty"`
+	// Workspace is the warm workspace the job ran in
+	Workspace *JobWorkspace `json:"workspace,omitempty"`
+	// Release is the promoted release a deploy job used
+	Release *JobRelease `json:"release,omitempty"`
+	// FailureClass classifies why a failed job failed
+	FailureClass string `json:"failureClass,omitempty"`
+	// BudgetExceeded is why a job failed for exceeding its pipeline's
+	// budget
+	BudgetExceeded string `json:"budgetExceeded,omitempty"`
+	// Comments are notes people left on the job and its steps
+	Comments []JobComment `json:"comments,omitempty"`
+	// Incidents are the incidents the job is linked to
+	Incidents []string `json:"incidents,omitempty"`
+	// Migrations are the database migrations the job's steps applied or
+	// rolled back
+	Migrations []Migration `json:"migrations,omitempty"`
+	// LoadTests are the results of the load tests the job's steps ran
+	LoadTests []LoadTest `json:"loadTests,omitempty"`
 }
 
 // StepStatus represents the status of a step execution
 type StepStatus struct {
 	ID        string    `json:"id"`
 	Name      string    `json:"name"`
-	Status    string    `json:"status"`
+	Status    Status    `json:"status"`
 	StartedAt time.Time `json:"startedAt"`
 	EndedAt   time.Time `json:"endedAt,omitempty"`
 	ExitCode  int       `json:"exitCode,omitempty"`
 	Output    string    `json:"output,omitempty"`
+	// Outputs are the values of the outputs the step declares, which later
+	// steps reference as ${{ steps.<id>.outputs.<name> }}
+	Outputs map[string]string `json:"outputs,omitempty"`
+	// CachedFrom is the job whose result a cached step reused
+	CachedFrom string `json:"cachedFrom,omitempty"`
+	// MatrixOf is the step whose matrix the step was expanded from, and
+	// Matrix its values
+	MatrixOf string            `json:"matrixOf,omitempty"`
+	Matrix   map[string]string `json:"matrix,omitempty"`
+	// Phases break the step's duration down into setup, execution and
+	// teardown
+	Phases []Phase `json:"phases,omitempty"`
+	// RolledBack marks speculative work that was discarded because the
+	// stage it ran ahead of failed
+	RolledBack bool `json:"rolledBack,omitempty"`
+	// Runner is the runner the step ran on
+	Runner string `json:"runner,omitempty"`
+	// Resources are the resources the step reserved on its runner
+	Resources *Resources `json:"resources,omitempty"`
+	// Recording is what the step was executed with, for replays
+	Recording *StepRecording `json:"recording,omitempty"`
+	// OutputSize is the size of the step's output before truncation
+	OutputSize int64 `json:"outputSize,omitempty"`
+	// OutputTruncated marks output cut down to the step's limit, and
+	// OutputArtifact names the artifact with the full output
+	OutputTruncated bool   `json:"outputTruncated,omitempty"`
+	OutputArtifact  string `json:"outputArtifact,omitempty"`
+	// OutputBinary marks binary output, which is only kept in the output
+	// artifact
+	OutputBinary bool `json:"outputBinary,omitempty"`
+	// OutputSanitized marks output with invalid UTF-8 replaced
+	OutputSanitized bool `json:"outputSanitized,omitempty"`
+	// FailureClass classifies why a failed step failed
+	FailureClass string `json:"failureClass,omitempty"`
+	// Attempts counts the executions of a retried step
+	Attempts int `json:"attempts,omitempty"`
+	// InfraRetries counts the re-dispatches of a step after infrastructure
+	// failures, which are not part of Attempts
+	InfraRetries int `json:"infraRetries,omitempty"`
+	// DurationAnomaly records a duration far from the step's baseline
+	DurationAnomaly *DurationAnomaly `json:"durationAnomaly,omitempty"`
+	// Annotations are the problems the step found in the source, such as
+	// linter violations
+	Annotations []Annotation `json:"annotations,omitempty"`
+	// TestReport is the results of the tests the step ran
+	TestReport *TestReport `json:"testReport,omitempty"`
+	// Egress is what the step's network policy allowed and blocked
+	Egress *EgressReport `json:"egress,omitempty"`
+	// Disk is the disk the step's job used while the step ran, when a
+	// quota or reserve applies
+	Disk *DiskUsage `json:"disk,omitempty"`
 }
 
 // LogEntry represents a log entry
@@ -131,17 +334,87 @@ type PluginManifest struct {
 	Author      string   `json:"author"`
 	Type        string   `json:"type"`
 	StepTypes   []string `json:"stepTypes"`
+	// Protocol is the version of the Plugin interface the plugin was built
+	// for
+	Protocol int `json:"protocol,omitempty"`
 }
 
 // PipelineEngine handles pipeline execution
 type PipelineEngine struct {
-	pipelines       map[string]*Pipeline
-	jobs            map[string]*Job
-	plugins         map[string]Plugin
-	eventListeners  map[string]chan Event
-	cacheManager    *CacheManager
-	mu              sync.RWMutex
-	eventsMu        sync.RWMutex
+	pipelines         map[string]*Pipeline
+	pipelineHistory   []PipelineVersion
+	pipelineVersions  map[string]string
+	jobs              map[string]*Job
+	plugins           map[string]Plugin
+	eventListeners    map[string]chan Event
+	bus               EventBus
+	replica           string
+	outbox            chan Event
+	jobEvents         map[string][]Event
+	cacheManager      *CacheManager
+	executor          StepExecutor
+	logger            *log.Logger
+	store             Store
+	secrets           SecretStore
+	cancels           map[string]context.CancelFunc
+	groups            map[string]*concurrencyGroup
+	locks             map[string]*resourceLock
+	runners           []*runnerSlot
+	runnerFreed       chan struct{}
+	queue             []*queueWaiter
+	queueSamples      []queueSample
+	queuePolicy       string
+	queueWeights      map[string]int
+	projectQueues     map[string]*projectQueue
+	autoscaling       *autoscaler
+	agentTokens       map[string]*AgentToken
+	agents            map[string]*agent
+	rejected          []Compatibility
+	version           string
+	workspaces        *workspaceManager
+	jobWorkspaces     *jobWorkspaces
+	containers        StepExecutor
+	serviceRuntime    ServiceRuntime
+	leases            map[string]*workspaceLease
+	debugSessions     map[string]*debugSession
+	outputLimit       int64
+	outputStats       map[string]*OutputStats
+	infraRetries      int
+	infraRetryDelay   time.Duration
+	infraStats        map[string]*InfraStats
+	maintenance       []*MaintenanceWindow
+	heldTriggers      []*HeldTrigger
+	debounced         map[string]*debounceBatch
+	maxJobs           int
+	jobSlots          map[string]bool
+	jobQueue          []*jobRun
+	groupRuns         map[string]*jobRun
+	backfills         map[string]*Backfill
+	incidents         []*Incident
+	incidentResolved  chan struct{}
+	scheduleNext      map[string]time.Time
+	scheduleLocation  *time.Location
+	anomalyPolicy     DurationAnomalyPolicy
+	durationBaselines map[string]*durationBaseline
+	secretUsage       map[string]*SecretUsage
+	costRates         CostRates
+	signingKey        []byte
+	oldSigningKeys    [][]byte
+	defaultRetention  *RetentionPolicy
+	featureFlags      map[string]FeatureFlag
+	fips              bool
+	checksumAlgorithm string
+	defaultEnv        map[string]string
+	diskPolicy        DiskQuotaPolicy
+	diskStats         map[string]*DiskStats
+	running           sync.WaitGroup
+	closing           bool
+	interrupting      bool
+	readOnly          bool
+	mu                sync.RWMutex
+	eventsMu          sync.RWMutex
+	redactMu          sync.RWMutex
+	redactions        map[string]*pipelineRedactions
 }
 
 // Plugin interface for pipeline plugins
@@ -156,23 +429,61 @@ type CacheManager struct {
 	mu     sync.RWMutex
 }
 
-// NewPipelineEngine creates a new pipeline engine
-func NewPipelineEngine() *PipelineEngine {
-	return &PipelineEngine{
-		pipelines:      make(map[string]*Pipeline),
-		jobs:           make(map[string]*Job),
-		plugins:        make(map[string]Plugin),
-		eventListeners: make(map[string]chan Event),
-		cacheManager:   &CacheManager{caches: make(map[string][]byte)},
+// NewPipelineEngine creates a new pipeline engine configured by opts
+func NewPipelineEngine(opts ...Option) *PipelineEngine {
+	pe := &PipelineEngine{
+		pipelines:         make(map[string]*Pipeline),
+		pipelineVersions:  make(map[string]string),
+		jobs:              make(map[string]*Job),
+		plugins:           make(map[string]Plugin),
+		eventListeners:    make(map[string]chan Event),
+		bus:               newMemoryBus(),
+		jobEvents:         make(map[string][]Event),
+		cacheManager:      &CacheManager{caches: make(map[string][]byte)},
+		executor:          &ShellExecutor{},
+		logger:            log.Default(),
+		cancels:           make(map[string]context.CancelFunc),
+		groups:            make(map[string]*concurrencyGroup),
+		locks:             make(map[string]*resourceLock),
+		leases:            make(map[string]*workspaceLease),
+		debugSessions:     make(map[string]*debugSession),
+		outputStats:       make(map[string]*OutputStats),
+		infraStats:        make(map[string]*InfraStats),
+		diskStats:         make(map[string]*DiskStats),
+		scheduleNext:      make(map[string]time.Time),
+		scheduleLocation:  time.Local,
+		anomalyPolicy:     DefaultDurationAnomalyPolicy,
+		queuePolicy:       QueueFIFO,
+		agentTokens:       make(map[string]*AgentToken),
+		agents:            make(map[string]*agent),
+		projectQueues:     make(map[string]*projectQueue),
+		durationBaselines: make(map[string]*durationBaseline),
+		secretUsage:       make(map[string]*SecretUsage),
+		serviceRuntime:    &DockerRuntime{},
+		checksumAlgorithm: DefaultChecksumAlgorithm,
 	}
+
+	for _, opt := range opts {
+		opt(pe)
+	}
+	pe.setupRunners()
+
+	return pe
 }
 
-// RegisterPlugin registers a plugin with the engine
-func (pe *PipelineEngine) RegisterPlugin(plugin Plugin) {
+// RegisterPlugin registers a plugin with the engine. Plugins built for a
+// protocol the engine doesn't speak are rejected.
+func (pe *PipelineEngine) RegisterPlugin(plugin Plugin) error {
 	manifest := plugin.GetManifest()
 	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	if _, err := NegotiatePluginProtocol(manifest); err != nil {
+		c := Compatibility{Component: "plugin", Name: manifest.Name, Version: manifest.Version, Protocol: manifest.Protocol}
+		pe.rejectComponent(c, err)
+		return err
+	}
 	pe.plugins[manifest.Name] = plugin
-	pe.mu.Unlock()
+	return nil
 }
 
 // RegisterEventListener registers an event listener
@@ -189,8 +500,19 @@ func (pe *PipelineEngine) UnregisterEventListener(id string) {
 	pe.eventsMu.Unlock()
 }
 
-// emitEvent emits an event to all listeners
+// emitEvent emits an event to all listeners and records it in the event
+// history of its job
 func (pe *PipelineEngine) emitEvent(event Event) {
+	if event.ID == "" {
+		event.ID = newEventID()
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	event = pe.redactEvent(event)
+	pe.recordEvent(event)
+	pe.publishEvent(event)
+
 	pe.eventsMu.RLock()
 	defer pe.eventsMu.RUnlock()
 
@@ -209,6 +531,18 @@ func (pe *PipelineEngine) CreatePipeline(pipeline *Pipeline) error {
 	if pipeline.ID == "" {
 		return fmt.Errorf("pipeline ID is required")
 	}
+	if err := ValidateStageGraph(pipeline.Stages); err != nil {
+		return err
+	}
+	if err := validateMatrices(pipeline); err != nil {
+		return err
+	}
+	if err := ValidateStepOutputs(expandMatrices(pipeline.Stages)); err != nil {
+		return err
+	}
+	if err := validateRedactions(pipeline); err != nil {
+		return err
+	}
 
 	pe.mu.Lock()
 	defer pe.mu.Unlock()
@@ -216,16 +550,21 @@ func (pe *PipelineEngine) CreatePipeline(pipeline *Pipeline) error {
 	if _, exists := pe.pipelines[pipeline.ID]; exists {
 		return fmt.Errorf("pipeline with ID %s already exists", pipeline.ID)
 	}
+	if err := pe.validateTriggerChains([]*Pipeline{pipeline}, nil); err != nil {
+		return err
+	}
 
 	now := time.Now()
 	pipeline.CreatedAt = now
 	pipeline.UpdatedAt = now
 
 	pe.pipelines[pipeline.ID] = pipeline
+	pe.setRedactions(pipeline)
+	pe.recordPipelineVersion(pipeline.ID, pipeline, now)
 
 	pe.emitEvent(Event{
-		Type:      "pipeline.created",
-		Timestamp: time.Now(),
+		Type:       "pipeline.created",
+		Timestamp:  time.Now(),
 		PipelineID: pipeline.ID,
 		Data: map[string]interface{}{
 			"name": pipeline.Name,
@@ -235,6 +574,120 @@ func (pe *PipelineEngine) CreatePipeline(pipeline *Pipeline) error {
 	return nil
 }
 
+// UpdatePipeline replaces an existing pipeline, keeping its creation time
+func (pe *PipelineEngine) UpdatePipeline(pipeline *Pipeline) error {
+	if err := ValidateStageGraph(pipeline.Stages); err != nil {
+		return err
+	}
+	if err := validateMatrices(pipeline); err != nil {
+		return err
+	}
+	if err := ValidateStepOutputs(expandMatrices(pipeline.Stages)); err != nil {
+		return err
+	}
+	if err := validateRedactions(pipeline); err != nil {
+		return err
+	}
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	existing, exists := pe.pipelines[pipeline.ID]
+	if !exists {
+		return fmt.Errorf("pipeline with ID %s not found", pipeline.ID)
+	}
+	if err := pe.validateTriggerChains([]*Pipeline{pipeline}, nil); err != nil {
+		return err
+	}
+
+	pipeline.CreatedAt = existing.CreatedAt
+	pipeline.UpdatedAt = time.Now()
+
+	pe.pipelines[pipeline.ID] = pipeline
+	pe.setRedactions(pipeline)
+	pe.recordPipelineVersion(pipeline.ID, pipeline, pipeline.UpdatedAt)
+
+	pe.emitEvent(Event{
+		Type:       "pipeline.updated",
+		Timestamp:  time.Now(),
+		PipelineID: pipeline.ID,
+		Data: map[string]interface{}{
+			"name": pipeline.Name,
+		},
+	})
+
+	return nil
+}
+
+// ApplyPipelines creates or replaces the pipelines in upserts and deletes the
+// pipelines in deletes as a single change, so readers never observe a
+// partially applied set
+func (pe *PipelineEngine) ApplyPipelines(upserts []*Pipeline, deletes []string) error {
+	for _, pipeline := range upserts {
+		if pipeline.ID == "" {
+			return fmt.Errorf("pipeline ID is required")
+		}
+		if err := ValidateStageGraph(pipeline.Stages); err != nil {
+			return fmt.Errorf("pipeline %s: %w", pipeline.ID, err)
+		}
+		if err := validateMatrices(pipeline); err != nil {
+			return err
+		}
+		if err := ValidateStepOutputs(expandMatrices(pipeline.Stages)); err != nil {
+			return fmt.Errorf("pipeline %s: %w", pipeline.ID, err)
+		}
+		if err := validateRedactions(pipeline); err != nil {
+			return fmt.Errorf("pipeline %s: %w", pipeline.ID, err)
+		}
+	}
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	if err := pe.validateTriggerChains(upserts, deletes); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, pipeline := range upserts {
+		eventType := "pipeline.created"
+		pipeline.CreatedAt = now
+		if existing, exists := pe.pipelines[pipeline.ID]; exists {
+			eventType = "pipeline.updated"
+			pipeline.CreatedAt = existing.CreatedAt
+		}
+		pipeline.UpdatedAt = now
+		pe.pipelines[pipeline.ID] = pipeline
+		pe.setRedactions(pipeline)
+		pe.recordPipelineVersion(pipeline.ID, pipeline, now)
+
+		pe.emitEvent(Event{
+			Type:       eventType,
+			Timestamp:  now,
+			PipelineID: pipeline.ID,
+			Data: map[string]interface{}{
+				"name": pipeline.Name,
+			},
+		})
+	}
+
+	for _, id := range deletes {
+		if _, exists := pe.pipelines[id]; !exists {
+			continue
+		}
+		delete(pe.pipelines, id)
+		pe.recordPipelineVersion(id, nil, now)
+
+		pe.emitEvent(Event{
+			Type:       "pipeline.deleted",
+			Timestamp:  now,
+			PipelineID: id,
+		})
+	}
+
+	return nil
+}
+
 // GetPipeline retrieves a pipeline by ID
 func (pe *PipelineEngine) GetPipeline(id string) (*Pipeline, error) {
 	pe.mu.RLock()
@@ -271,69 +724,35 @@ func (pe *PipelineEngine) DeletePipeline(id string) error {
 	}
 
 	delete(pe.pipelines, id)
+	pe.clearRedactions(id)
+	pe.recordPipelineVersion(id, nil, time.Now())
 
 	pe.emitEvent(Event{
-		Type:      "pipeline.deleted",
-		Timestamp: time.Now(),
+		Type:       "pipeline.deleted",
+		Timestamp:  time.Now(),
 		PipelineID: id,
 	})
 
 	return nil
 }
 
-// ExecutePipeline executes a pipeline
+// ExecutePipeline executes a pipeline in the background
 func (pe *PipelineEngine) ExecutePipeline(pipelineID string) error {
+	_, err := pe.Start(context.Background(), pipelineID)
+	return err
+}
+
+// FindJob retrieves a job by ID regardless of its pipeline
+func (pe *PipelineEngine) FindJob(jobID string) (*Job, error) {
 	pe.mu.RLock()
-	_, exists := pe.pipelines[pipelineID]
-	pe.mu.RUnlock()
+	defer pe.mu.RUnlock()
 
+	job, exists := pe.jobs[jobID]
 	if !exists {
-		return fmt.Errorf("pipeline with ID %s not found", pipelineID)
-	}
-
-	// Create a new job
-	job := &Job{
-		ID:         fmt.Sprintf("job-%d", time.Now().Unix()),
-		PipelineID: pipelineID,
-		Status:     "running",
-		StartedAt:  time.Now(),
-		Steps:      []StepStatus{},
+		return nil, fmt.Errorf("job with ID %s not found", jobID)
 	}
 
-	pe.mu.Lock()
-	pe.jobs[job.ID] = job
-	pe.mu.Unlock()
-
-	pe.emitEvent(Event{
-		Type:      "job.started",
-		Timestamp: time.Now(),
-		PipelineID: pipelineID,
-		JobID:     job.ID,
-	})
-
-	// Execute the pipeline in a goroutine
-	go func() {
-		// Simulate pipeline execution
-		// In a real implementation, this would execute stages and steps
-		time.Sleep(2 * time.Second)
-
-		pe.mu.Lock()
-		job.Status = "success"
-		job.EndedAt = time.Now()
-		pe.mu.Unlock()
-
-		pe.emitEvent(Event{
-			Type:      "job.completed",
-			Timestamp: time.Now(),
-			PipelineID: pipelineID,
-			JobID:     job.ID,
-			Data: map[string]interface{}{
-				"status": "success",
-			},
-		})
-	}()
-
-	return nil
+	return job, nil
 }
 
 // GetJob retrieves a job by ID
@@ -372,69 +791,53 @@ func (pe *PipelineEngine) ListJobs(pipelineID string) ([]*Job, error) {
 	return jobs, nil
 }
 
-// RetryJob retries a job
-func (pe *PipelineEngine) RetryJob(pipelineID, jobID string) error {
+// FinishedJobs returns snapshots of the jobs of every pipeline that ended
+// at or after since and before until, in the order they ended
+func (pe *PipelineEngine) FinishedJobs(since, until time.Time) []*Job {
 	pe.mu.RLock()
-	job, exists := pe.jobs[jobID]
-	pe.mu.RUnlock()
-
-	if !exists {
-		return fmt.Errorf("job with ID %s not found", jobID)
-	}
-
-	if job.PipelineID != pipelineID {
-		return fmt.Errorf("job with ID %s is not associated with pipeline %s", jobID, pipelineID)
+	var matched []*Job
+	for _, job := range pe.jobs {
+		if !job.EndedAt.IsZero() && !job.EndedAt.Before(since) && job.EndedAt.Before(until) {
+			matched = append(matched, job)
+		}
 	}
+	pe.mu.RUnlock()
 
-	// Create a new job based on the old one
-	newJob := &Job{
-		ID:         fmt.Sprintf("job-%d", time.Now().Unix()),
-		PipelineID: pipelineID,
-		Status:     "running",
-		StartedAt:  time.Now(),
-		Steps:      []StepStatus{},
-		Metadata: map[string]interface{}{
-			"retryOf": jobID,
-		},
+	jobs := make([]*Job, 0, len(matched))
+	for _, job := range matched {
+		jobs = append(jobs, pe.snapshotJob(job))
 	}
-
-	pe.mu.Lock()
-	pe.jobs[newJob.ID] = newJob
-	pe.mu.Unlock()
-
-	pe.emitEvent(Event{
-		Type:      "job.started",
-		Timestamp: time.Now(),
-		PipelineID: pipelineID,
-		JobID:     newJob.ID,
-		Data: map[string]interface{}{
-			"retryOf": jobID,
-		},
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].EndedAt.Equal(jobs[j].EndedAt) {
+			return jobs[i].EndedAt.Before(jobs[j].EndedAt)
+		}
+		return jobs[i].ID < jobs[j].ID
 	})
+	return jobs
+}
 
-	// Execute the job in a goroutine
-	go func() {
-		// Simulate job execution
-		// In a real implementation, this would execute stages and steps
-		time.Sleep(2 * time.Second)
+// RetryJob retries a job in the background
+func (pe *PipelineEngine) RetryJob(pipelineID, jobID string) error {
+	_, err := pe.Retry(context.Background(), pipelineID, jobID)
+	return err
+}
 
-		pe.mu.Lock()
-		newJob.Status = "success"
-		newJob.EndedAt = time.Now()
+// SetJobMetadata records a value in the metadata of a job, such as what
+// an integration responded about it
+func (pe *PipelineEngine) SetJobMetadata(jobID, key string, value interface{}) error {
+	pe.mu.Lock()
+	job, exists := pe.jobs[jobID]
+	if !exists {
 		pe.mu.Unlock()
+		return fmt.Errorf("job with ID %s not found", jobID)
+	}
+	if job.Metadata == nil {
+		job.Metadata = make(map[string]interface{})
+	}
+	job.Metadata[key] = value
+	pe.mu.Unlock()
 
-		pe.emitEvent(Event{
-			Type:      "job.completed",
-			Timestamp: time.Now(),
-			PipelineID: pipelineID,
-			JobID:     newJob.ID,
-			Data: map[string]interface{}{
-				"status": "success",
-				"retryOf": jobID,
-			},
-		})
-	}()
-
+	pe.saveJob(job)
 	return nil
 }
 
@@ -442,35 +845,39 @@ func (pe *PipelineEngine) RetryJob(pipelineID, jobID string) error {
 func (pe *PipelineEngine) AddJob(job *Job) {
 	pe.mu.Lock()
 	defer pe.mu.Unlock()
-	
+
+	if job.Status == "" {
+		job.Status = StatusPending
+	}
+
 	pe.jobs[job.ID] = job
-	
+
 	// Emit an event for this job addition
 	pe.emitEvent(Event{
-		Type:      "job.added",
-		Timestamp: time.Now(),
+		Type:       "job.added",
+		Timestamp:  time.Now(),
 		PipelineID: job.PipelineID,
-		JobID:     job.ID,
+		JobID:      job.ID,
 		Data: map[string]interface{}{
 			"status": job.Status,
 		},
 	})
-	
+
 	// If the job is running, emit a job.started event
-	if job.Status == "running" {
+	if job.Status == StatusRunning {
 		pe.emitEvent(Event{
-			Type:      "job.started",
-			Timestamp: time.Now(),
+			Type:       "job.started",
+			Timestamp:  time.Now(),
 			PipelineID: job.PipelineID,
-			JobID:     job.ID,
+			JobID:      job.ID,
 		})
-	} else if job.Status == "success" || job.Status == "failed" {
+	} else if job.Status.IsTerminal() {
 		eventType := "job.completed"
 		pe.emitEvent(Event{
-			Type:      eventType,
-			Timestamp: time.Now(),
+			Type:       eventType,
+			Timestamp:  time.Now(),
 			PipelineID: job.PipelineID,
-			JobID:     job.ID,
+			JobID:      job.ID,
 			Data: map[string]interface{}{
 				"status": job.Status,
 			},
@@ -482,16 +889,23 @@ func (pe *PipelineEngine) AddJob(job *Job) {
 func (pe *PipelineEngine) UpdateJob(job *Job) error {
 	pe.mu.Lock()
 	defer pe.mu.Unlock()
-	
+
 	// Check if the job exists
-	_, exists := pe.jobs[job.ID]
+	existing, exists := pe.jobs[job.ID]
 	if !exists {
 		return fmt.Errorf("job with ID %s not found", job.ID)
 	}
-	
+
+	// Reject status changes the state machine does not allow
+	if existing != job && existing.Status != job.Status {
+		if err := existing.Status.ValidateTransition(job.Status); err != nil {
+			return fmt.Errorf("job %s: %w", job.ID, err)
+		}
+	}
+
 	// Update the job
 	pe.jobs[job.ID] = job
-	
+
 	return nil
 }
 
@@ -507,7 +921,7 @@ func (pe *PipelineEngine) EmitStepStartedEvent(pipelineID, jobID, stepID string)
 }
 
 // EmitStepCompletedEvent emits a step completed event
-func (pe *PipelineEngine) EmitStepCompletedEvent(pipelineID, jobID, stepID, status string) {
+func (pe *PipelineEngine) EmitStepCompletedEvent(pipelineID, jobID, stepID string, status Status) {
 	pe.emitEvent(Event{
 		Type:       "step.completed",
 		Timestamp:  time.Now(),
@@ -521,7 +935,7 @@ func (pe *PipelineEngine) EmitStepCompletedEvent(pipelineID, jobID, stepID, stat
 }
 
 // EmitJobCompletedEvent emits a job completed event
-func (pe *PipelineEngine) EmitJobCompletedEvent(pipelineID, jobID, status string) {
+func (pe *PipelineEngine) EmitJobCompletedEvent(pipelineID, jobID string, status Status) {
 	pe.emitEvent(Event{
 		Type:       "job.completed",
 		Timestamp:  time.Now(),
@@ -531,4 +945,4 @@ func (pe *PipelineEngine) EmitJobCompletedEvent(pipelineID, jobID, status string
 			"status": status,
 		},
 	})
-} 
\ No newline at end of file
+}
@@ -0,0 +1,236 @@
+package core
+
+import (
+	"sort"
+	"time"
+)
+
+// Queue policies decide which step waiting for a runner gets one first
+const (
+	// QueueFIFO starts waiting steps in the order they started waiting
+	QueueFIFO = "fifo"
+	// QueueFair interleaves waiting steps across projects by weighted
+	// round-robin, so a project flooding the queue can't starve the others
+	QueueFair = "fair"
+)
+
+// queueWaiter is a step waiting for a runner
+type queueWaiter struct {
+	jobID   string
+	stepID  string
+	project string
+	labels  []string
+	request Resources
+	avoid   string
+	since   time.Time
+}
+
+// projectQueue tracks the waiting steps and runner grants of a project
+type projectQueue struct {
+	waiting int
+	started int
+	waited  time.Duration
+	maxWait time.Duration
+	// pass is the project's virtual time under fair queuing: every runner
+	// it gets adds 1/weight, and the project with the lowest pass goes next
+	pass float64
+}
+
+// QueueStats reports the steps of a project waiting for runners and how
+// long the steps it started waited
+type QueueStats struct {
+	Project string `json:"project"`
+	Weight  int    `json:"weight"`
+	Waiting int    `json:"waiting"`
+	// OldestWaitingSince is when the project's longest waiting step
+	// started waiting
+	OldestWaitingSince *time.Time `json:"oldestWaitingSince,omitempty"`
+	// Started counts the steps that got a runner since the server started,
+	// and AverageWaitMs and MaxWaitMs how long they waited
+	Started       int   `json:"started"`
+	AverageWaitMs int64 `json:"averageWaitMs"`
+	MaxWaitMs     int64 `json:"maxWaitMs"`
+}
+
+// QueueStatus reports the queue policy and the queue of every project
+type QueueStatus struct {
+	Policy   string       `json:"policy"`
+	Projects []QueueStats `json:"projects"`
+}
+
+// WithQueuePolicy sets the order steps waiting for a runner get one,
+// QueueFIFO by default. Under QueueFair, weights give projects a larger
+// share of the runners; projects without a weight have 1.
+func WithQueuePolicy(policy string, weights map[string]int) Option {
+	return func(pe *PipelineEngine) {
+		pe.queuePolicy, pe.queueWeights = queuePolicy(policy), weights
+	}
+}
+
+// SetQueuePolicy changes the queue policy and weights at runtime
+func (pe *PipelineEngine) SetQueuePolicy(policy string, weights map[string]int) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.queuePolicy, pe.queueWeights = queuePolicy(policy), weights
+	pe.wakeWaiters()
+}
+
+// queuePolicy returns a known queue policy, defaulting to QueueFIFO
+func queuePolicy(policy string) string {
+	if policy == QueueFair {
+		return QueueFair
+	}
+	return QueueFIFO
+}
+
+// jobProject returns the project a job's steps queue under: its pipeline's
+// team, or the pipeline itself without one. Callers must hold pe.mu.
+func (pe *PipelineEngine) jobProject(job *Job) string {
+	if pipeline, ok := pe.pipelines[job.PipelineID]; ok {
+		return pipelineProject(pipeline)
+	}
+	return job.PipelineID
+}
+
+// pipelineProject returns the project of a pipeline: its team, or the
+// pipeline itself without one
+func pipelineProject(pipeline *Pipeline) string {
+	if pipeline.Team != "" {
+		return pipeline.Team
+	}
+	return pipeline.ID
+}
+
+// queueWeight returns the weight of a project, at least 1. Callers must
+// hold pe.mu.
+func (pe *PipelineEngine) queueWeight(project string) int {
+	if weight := pe.queueWeights[project]; weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// projectQueue returns the queue of a project. Callers must hold pe.mu.
+func (pe *PipelineEngine) projectQueue(project string) *projectQueue {
+	q, ok := pe.projectQueues[project]
+	if !ok {
+		q = &projectQueue{}
+		pe.projectQueues[project] = q
+	}
+	return q
+}
+
+// enqueue adds a waiter to the queue. A project that starts waiting again
+// catches its pass up with the projects already waiting, so it doesn't get
+// the runners to itself for the time it was idle. Callers must hold pe.mu.
+func (pe *PipelineEngine) enqueue(w *queueWaiter) {
+	q := pe.projectQueue(w.project)
+	if q.waiting == 0 {
+		lowest, found := 0.0, false
+		for _, other := range pe.projectQueues {
+			if other.waiting > 0 && (!found || other.pass < lowest) {
+				lowest, found = other.pass, true
+			}
+		}
+		if found && q.pass < lowest {
+			q.pass = lowest
+		}
+	}
+	q.waiting++
+	pe.queue = append(pe.queue, w)
+	pe.recordQueueDepth(time.Now())
+}
+
+// dequeue removes a waiter from the queue, recording its wait when it got
+// a runner. Callers must hold pe.mu.
+func (pe *PipelineEngine) dequeue(w *queueWaiter, started bool) {
+	for i, queued := range pe.queue {
+		if queued == w {
+			pe.queue = append(pe.queue[:i], pe.queue[i+1:]...)
+			break
+		}
+	}
+	pe.recordQueueDepth(time.Now())
+	q := pe.projectQueue(w.project)
+	q.waiting--
+	if !started {
+		return
+	}
+	wait := time.Since(w.since)
+	q.started++
+	q.waited += wait
+	if wait > q.maxWait {
+		q.maxWait = wait
+	}
+	q.pass += 1 / float64(pe.queueWeight(w.project))
+}
+
+// ahead reports whether waiter a gets a runner before b: under fair
+// queuing when its project has a lower pass, otherwise when it has waited
+// longer. Callers must hold pe.mu.
+func (pe *PipelineEngine) ahead(a, b *queueWaiter) bool {
+	if pe.queuePolicy == QueueFair && a.project != b.project {
+		if pass, other := pe.projectQueues[a.project].pass, pe.projectQueues[b.project].pass; pass != other {
+			return pass < other
+		}
+	}
+	return a.since.Before(b.since)
+}
+
+// turn returns the runner a waiter takes now, or nil while no runner has
+// room for it or a waiter ahead of it would take the same runner. Callers
+// must hold pe.mu.
+func (pe *PipelineEngine) turn(w *queueWaiter) *runnerSlot {
+	runner := pe.pickRunner(w)
+	if runner == nil {
+		return nil
+	}
+	for _, other := range pe.queue {
+		if other != w && pe.ahead(other, w) && pe.pickRunner(other) == runner {
+			return nil
+		}
+	}
+	return runner
+}
+
+// wakeWaiters wakes the steps waiting for a runner to check whether they
+// go next. Callers must hold pe.mu.
+func (pe *PipelineEngine) wakeWaiters() {
+	close(pe.runnerFreed)
+	pe.runnerFreed = make(chan struct{})
+}
+
+// Queue returns the queue policy and the queue of every project whose steps
+// used a runner since the server started, sorted by project
+func (pe *PipelineEngine) Queue() QueueStatus {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	oldest := make(map[string]time.Time)
+	for _, w := range pe.queue {
+		if since, ok := oldest[w.project]; !ok || w.since.Before(since) {
+			oldest[w.project] = w.since
+		}
+	}
+	status := QueueStatus{Policy: pe.queuePolicy, Projects: make([]QueueStats, 0, len(pe.projectQueues))}
+	for project, q := range pe.projectQueues {
+		stats := QueueStats{
+			Project:   project,
+			Weight:    pe.queueWeight(project),
+			Waiting:   q.waiting,
+			Started:   q.started,
+			MaxWaitMs: q.maxWait.Milliseconds(),
+		}
+		if since, ok := oldest[project]; ok {
+			stats.OldestWaitingSince = &since
+		}
+		if q.started > 0 {
+			stats.AverageWaitMs = (q.waited / time.Duration(q.started)).Milliseconds()
+		}
+		status.Projects = append(status.Projects, stats)
+	}
+	sort.Slice(status.Projects, func(i, j int) bool {
+		return status.Projects[i].Project < status.Projects[j].Project
+	})
+	return status
+}
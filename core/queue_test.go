@@ -0,0 +1,77 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireRunner_QueuePolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		weights map[string]int
+		want    string
+	}{
+		{QueueFIFO, nil, "data,data,data,data,web,web"},
+		{QueueFair, nil, "data,web,data,web,data,data"},
+		{QueueFair, map[string]int{"data": 2}, "data,web,data,data,web,data"},
+	}
+	for _, tt := range tests {
+		engine := newTestEngine(WithRunners(Runner{Name: "only", Capacity: 1}), WithQueuePolicy(tt.policy, tt.weights))
+		for id, team := range map[string]string{"etl": "data", "site": "web"} {
+			pipeline := scriptPipeline(id, "true")
+			pipeline.Team = team
+			engine.CreatePipeline(pipeline)
+		}
+		step := Step{ID: "s"}
+		runner, err := engine.acquireRunner(context.Background(), &Job{ID: "hold", PipelineID: "etl"}, step, "")
+		if err != nil {
+			t.Fatalf("acquireRunner() error = %v", err)
+		}
+
+		started := make(chan string)
+		waiting := 0
+		for _, pipelineID := range []string{"etl", "etl", "etl", "etl", "site", "site"} {
+			job := &Job{ID: pipelineID, PipelineID: pipelineID}
+			go func() {
+				if _, err := engine.acquireRunner(context.Background(), job, step, ""); err == nil {
+					engine.mu.RLock()
+					started <- engine.jobProject(job)
+					engine.mu.RUnlock()
+				}
+			}()
+			// Queue the steps one at a time so they wait in order
+			waiting++
+			for deadline := time.Now().Add(time.Second); len(engineQueue(engine)) < waiting && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		var order []string
+		for range []int{1, 2, 3, 4, 5, 6} {
+			engine.releaseRunner(runner, Resources{})
+			select {
+			case project := <-started:
+				order = append(order, project)
+			case <-time.After(time.Second):
+				t.Fatalf("%s: no step started after %v", tt.policy, order)
+			}
+		}
+		if got := strings.Join(order, ","); got != tt.want {
+			t.Errorf("%s %v: runners went to %s, want %s", tt.policy, tt.weights, got, tt.want)
+		}
+
+		status := engine.Queue()
+		if status.Policy != tt.policy || len(status.Projects) != 2 || status.Projects[0].Started != 5 || status.Projects[1].Waiting != 0 {
+			t.Errorf("Queue() = %+v, want 5 data steps started and none waiting", status)
+		}
+	}
+}
+
+// engineQueue returns the waiters of an engine's queue
+func engineQueue(engine *PipelineEngine) []*queueWaiter {
+	engine.mu.RLock()
+	defer engine.mu.RUnlock()
+	return append([]*queueWaiter{}, engine.queue...)
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PipelineInfo is what on-call engineers need to know about a pipeline
+type PipelineInfo struct {
+	// Owner is who to contact about the pipeline, such as a team or rota
+	Owner string `json:"owner,omitempty"`
+	// Runbook links to the steps to take when the pipeline fails
+	Runbook string       `json:"runbook,omitempty"`
+	SLO     *PipelineSLO `json:"slo,omitempty"`
+	// Links are other links by name, such as a dashboard
+	Links map[string]string `json:"links,omitempty"`
+}
+
+// PipelineSLO is the service level objective of a pipeline's jobs
+type PipelineSLO struct {
+	// SuccessRate is the percentage of jobs that should succeed, such as 99.5
+	SuccessRate float64 `json:"successRate,omitempty"`
+	// Duration is how long jobs should take at most, such as "30m"
+	Duration string `json:"duration,omitempty"`
+}
+
+// PipelineReadme is a pipeline's documentation and on-call information
+type PipelineReadme struct {
+	PipelineID string `json:"pipelineId"`
+	// Version is the version of the pipeline the readme is part of
+	Version   string        `json:"version,omitempty"`
+	Readme    string        `json:"readme"`
+	Info      *PipelineInfo `json:"info,omitempty"`
+	UpdatedAt time.Time     `json:"updatedAt"`
+}
+
+// ReadmeOf returns the readme of a pipeline
+func ReadmeOf(pipeline *Pipeline) PipelineReadme {
+	return PipelineReadme{
+		PipelineID: pipeline.ID,
+		Version:    pipeline.Version,
+		Readme:     pipeline.Readme,
+		Info:       pipeline.Info,
+		UpdatedAt:  pipeline.UpdatedAt,
+	}
+}
+
+// HTML renders the readme as a page, with the on-call information above
+// the documentation
+func (r PipelineReadme) HTML(title string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n<body>\n", html.EscapeString(title))
+	if info := r.Info; info != nil {
+		b.WriteString("<dl class=\"pipeline-info\">\n")
+		item := func(term, value string) {
+			fmt.Fprintf(&b, "<dt>%s</dt><dd>%s</dd>\n", term, value)
+		}
+		link := func(href string) string {
+			return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(href), html.EscapeString(href))
+		}
+		if info.Owner != "" {
+			item("Owner", html.EscapeString(info.Owner))
+		}
+		if info.Runbook != "" {
+			item("Runbook", link(info.Runbook))
+		}
+		if slo := info.SLO; slo != nil {
+			var objectives []string
+			if slo.SuccessRate > 0 {
+				objectives = append(objectives, fmt.Sprintf("%v%% of jobs succeed", slo.SuccessRate))
+			}
+			if slo.Duration != "" {
+				objectives = append(objectives, "jobs take at most "+html.EscapeString(slo.Duration))
+			}
+			item("SLO", strings.Join(objectives, ", "))
+		}
+		names := make([]string, 0, len(info.Links))
+		for name := range info.Links {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			item(html.EscapeString(name), link(info.Links[name]))
+		}
+		b.WriteString("</dl>\n")
+	}
+	b.WriteString(RenderMarkdown(r.Readme))
+	b.WriteString("</body>\n</html>\n")
+	return b.String()
+}
+
+// ValidatePipelineInfo checks that the runbook and links are http(s) URLs
+// and that the SLO is within range
+func ValidatePipelineInfo(info *PipelineInfo) error {
+	if info == nil {
+		return nil
+	}
+	if info.Runbook != "" {
+		if err := validateLink(info.Runbook); err != nil {
+			return fmt.Errorf("runbook: %w", err)
+		}
+	}
+	names := make([]string, 0, len(info.Links))
+	for name := range info.Links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := validateLink(info.Links[name]); err != nil {
+			return fmt.Errorf("link %q: %w", name, err)
+		}
+	}
+	if slo := info.SLO; slo != nil {
+		if slo.SuccessRate < 0 || slo.SuccessRate > 100 {
+			return fmt.Errorf("slo success rate %v must be between 0 and 100", slo.SuccessRate)
+		}
+		if slo.Duration != "" {
+			if d, err := time.ParseDuration(slo.Duration); err != nil || d <= 0 {
+				return fmt.Errorf("invalid slo duration %q", slo.Duration)
+			}
+		}
+	}
+	return nil
+}
+
+// validateLink checks that link is an absolute http(s) URL
+func validateLink(link string) error {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http(s) URL", link)
+	}
+	return nil
+}
+
+// SetPipelineReadme replaces a pipeline's readme and on-call information,
+// recording a new version of the pipeline
+func (pe *PipelineEngine) SetPipelineReadme(id, readme string, info *PipelineInfo) (*Pipeline, error) {
+	if err := ValidatePipelineInfo(info); err != nil {
+		return nil, err
+	}
+	existing, err := pe.GetPipeline(id)
+	if err != nil {
+		return nil, err
+	}
+	pe.mu.RLock()
+	updated := *existing
+	pe.mu.RUnlock()
+	updated.Readme, updated.Info = readme, info
+	if err := pe.UpdatePipeline(&updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
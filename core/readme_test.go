@@ -0,0 +1,80 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	source := "# Deploy <web>\n\nShips **main** to *production*.\nSee [the runbook](https://wiki.example.com/deploy) and [this](javascript:void).\n\n- run `make deploy`\n- check __metrics__\n\n1. first\n2. second\n\n> Page on-call\n> if it fails\n\n---\n\n```sh\necho \"<hi>\"\n```\n<script>alert(1)</script>\n"
+	want := `<h1>Deploy &lt;web&gt;</h1>
+<p>Ships <strong>main</strong> to <em>production</em>.
+See <a href="https://wiki.example.com/deploy">the runbook</a> and this.</p>
+<ul>
+<li>run <code>make deploy</code></li>
+<li>check <strong>metrics</strong></li>
+</ul>
+<ol>
+<li>first</li>
+<li>second</li>
+</ol>
+<blockquote>
+<p>Page on-call
+if it fails</p>
+</blockquote>
+<hr>
+<pre><code class="language-sh">echo &#34;&lt;hi&gt;&#34;</code></pre>
+<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>
+`
+	if got := RenderMarkdown(source); got != want {
+		t.Errorf("RenderMarkdown() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSetPipelineReadme(t *testing.T) {
+	engine := newTestEngine()
+	engine.CreatePipeline(scriptPipeline("deploy", "true"))
+	before, _ := engine.GetPipeline("deploy")
+	version := before.Version
+
+	info := &PipelineInfo{
+		Owner:   "payments-oncall",
+		Runbook: "https://wiki.example.com/deploy",
+		SLO:     &PipelineSLO{SuccessRate: 99.5, Duration: "30m"},
+		Links:   map[string]string{"dashboard": "https://grafana.example.com/d/deploy"},
+	}
+	pipeline, err := engine.SetPipelineReadme("deploy", "# Deploy", info)
+	if err != nil {
+		t.Fatalf("SetPipelineReadme() error = %v", err)
+	}
+	if pipeline.Version == version || pipeline.Readme != "# Deploy" {
+		t.Errorf("pipeline = version %s, readme %q, want a new version with the readme", pipeline.Version, pipeline.Readme)
+	}
+
+	// The readme is kept with the version it was part of
+	versions, _ := engine.PipelineVersions("deploy")
+	if len(versions) != 2 || versions[0].Pipeline.Readme != "" || versions[1].Pipeline.Info.Owner != "payments-oncall" {
+		t.Errorf("PipelineVersions() = %+v", versions)
+	}
+
+	page := ReadmeOf(pipeline).HTML("deploy")
+	for _, want := range []string{"<title>deploy</title>", "<dd>payments-oncall</dd>", `<a href="https://wiki.example.com/deploy">`, "99.5% of jobs succeed, jobs take at most 30m", "<dt>dashboard</dt>", "<h1>Deploy</h1>"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("HTML() is missing %q:\n%s", want, page)
+		}
+	}
+
+	for _, invalid := range []*PipelineInfo{
+		{Runbook: "wiki/deploy"},
+		{Links: map[string]string{"dashboard": "javascript:alert(1)"}},
+		{SLO: &PipelineSLO{SuccessRate: 101}},
+		{SLO: &PipelineSLO{Duration: "soon"}},
+	} {
+		if _, err := engine.SetPipelineReadme("deploy", "", invalid); err == nil {
+			t.Errorf("SetPipelineReadme(%+v) error = nil", invalid)
+		}
+	}
+	if _, err := engine.SetPipelineReadme("missing", "", nil); err == nil {
+		t.Error("SetPipelineReadme() of a missing pipeline error = nil")
+	}
+}
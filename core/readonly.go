@@ -0,0 +1,90 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrReadOnly is returned for jobs started on a read-only engine
+var ErrReadOnly = errors.New("the server is read-only")
+
+// WithReadOnly makes the engine an observer of a store another server
+// writes. It doesn't start or recover jobs, and doesn't write the store;
+// RefreshStore picks up the jobs the other server runs and what else it
+// changes.
+func WithReadOnly() Option {
+	return func(pe *PipelineEngine) {
+		pe.readOnly = true
+	}
+}
+
+// ReadOnly reports whether the engine only observes its store
+func (pe *PipelineEngine) ReadOnly() bool {
+	return pe.readOnly
+}
+
+// RefreshJobs reloads the jobs of a read-only engine from its store
+func (pe *PipelineEngine) RefreshJobs() error {
+	if !pe.readOnly || pe.store == nil {
+		return nil
+	}
+	jobs, err := pe.store.LoadJobs()
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string]*Job, len(jobs))
+	for _, job := range jobs {
+		loaded[job.ID] = job
+	}
+	pe.mu.Lock()
+	pe.jobs = loaded
+	pe.mu.Unlock()
+	return nil
+}
+
+// RefreshStore reloads the jobs, incidents, maintenance windows, secrets
+// and secret usage of a read-only engine from its store. Releases and
+// artifacts are read from the store on each request.
+func (pe *PipelineEngine) RefreshStore() error {
+	if !pe.readOnly || pe.store == nil {
+		return nil
+	}
+	if err := pe.RefreshJobs(); err != nil {
+		return fmt.Errorf("jobs: %w", err)
+	}
+	if err := pe.RestoreIncidents(); err != nil {
+		return fmt.Errorf("incidents: %w", err)
+	}
+	if err := pe.RestoreMaintenance(); err != nil {
+		return fmt.Errorf("maintenance windows: %w", err)
+	}
+	if err := pe.RestoreSecretUsage(); err != nil {
+		return fmt.Errorf("secret usage: %w", err)
+	}
+	if secrets, ok := pe.secrets.(interface{ Reload() error }); ok {
+		if err := secrets.Reload(); err != nil {
+			return fmt.Errorf("secrets: %w", err)
+		}
+	}
+	return nil
+}
+
+// WatchStore refreshes a read-only engine every interval until ctx is done
+func (pe *PipelineEngine) WatchStore(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := pe.RefreshStore(); err != nil {
+			pe.logger.Printf("Failed to refresh the store: %v", err)
+		}
+	}
+}
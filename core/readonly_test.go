@@ -0,0 +1,75 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReadOnly_ObservesStore(t *testing.T) {
+	store := newRecoveryStore(t, crashedJob())
+	engine := newTestEngine(WithStore(store), WithReadOnly())
+	engine.CreatePipeline(scriptPipeline("resume", "echo first", "echo second"))
+
+	if err := engine.RestoreJobs(); err != nil {
+		t.Fatalf("RestoreJobs() error = %v", err)
+	}
+	crashed, err := engine.GetJob("resume", "crashed")
+	if err != nil {
+		t.Fatalf("GetJob() error = %v", err)
+	}
+	if crashed.Status != StatusRunning {
+		t.Errorf("crashed.Status = %q, want it left to the server running it", crashed.Status)
+	}
+	if _, err := engine.Start(context.Background(), "resume"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Start() error = %v, want ErrReadOnly", err)
+	}
+	if history, _ := store.LoadPipelineHistory(); len(history) != 0 {
+		t.Errorf("pipeline history = %+v, want nothing written", history)
+	}
+
+	// Jobs the other server saves show up on refresh
+	if err := store.SaveJob(&Job{ID: "next", PipelineID: "resume", Status: StatusSuccess}); err != nil {
+		t.Fatalf("SaveJob() error = %v", err)
+	}
+	if err := engine.RefreshJobs(); err != nil {
+		t.Fatalf("RefreshJobs() error = %v", err)
+	}
+	if _, err := engine.GetJob("resume", "next"); err != nil {
+		t.Errorf("GetJob() after refresh error = %v", err)
+	}
+}
+
+func TestReadOnly_RefreshStore(t *testing.T) {
+	store := newRecoveryStore(t)
+	key := bytes.Repeat([]byte{1}, 32)
+	secrets, err := NewFileSecretStore(store.dir, key)
+	if err != nil {
+		t.Fatalf("NewFileSecretStore() error = %v", err)
+	}
+	observed, _ := NewFileSecretStore(store.dir, key)
+	engine := newTestEngine(WithStore(store), WithSecrets(observed), WithReadOnly())
+
+	// The other server declares an incident, schedules maintenance and
+	// saves a secret a step read
+	store.SaveIncidents([]*Incident{{ID: "inc-1", Title: "outage", DeclaredAt: time.Now()}})
+	store.SaveMaintenance(&MaintenanceState{Windows: []*MaintenanceWindow{{ID: "mw-1", Reason: "upgrade"}}})
+	store.SaveSecretUsage([]*SecretUsage{{Secret: "TOKEN", PipelineID: "deploy", StepID: "push", Uses: 2}})
+	secrets.SaveSecret(&Secret{Name: "TOKEN", Value: "hunter2"})
+
+	if err := engine.RefreshStore(); err != nil {
+		t.Fatalf("RefreshStore() error = %v", err)
+	}
+	if incidents := engine.Incidents(false); len(incidents) != 1 || incidents[0].ID != "inc-1" {
+		t.Errorf("incidents = %+v, want the declared one", incidents)
+	}
+	if windows := engine.MaintenanceWindows(""); len(windows) != 1 || windows[0].ID != "mw-1" {
+		t.Errorf("maintenance windows = %+v, want the scheduled one", windows)
+	}
+	usage, err := engine.SecretUsage("TOKEN")
+	if err != nil || !usage.Defined || usage.Uses != 2 {
+		t.Errorf("SecretUsage() = %+v, %v, want the saved secret read twice", usage, err)
+	}
+}
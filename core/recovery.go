@@ -0,0 +1,157 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// restartReason is recorded on jobs that could not be resumed after a restart
+const restartReason = "server restarted while the job was running"
+
+// Resumer is implemented by executors that can safely continue a job from
+// its last completed step after the server restarts
+type Resumer interface {
+	CanResume(job *Job) bool
+}
+
+// RestoreJobs loads jobs persisted by a previous run into the engine and
+// recovers jobs that were still pending or running when that run stopped.
+// If the executor implements Resumer and agrees, such jobs continue from
+// their last completed step; otherwise they are marked failed. Pipelines
+// must be registered before calling RestoreJobs so that resumed jobs can
+// find their definitions.
+func (pe *PipelineEngine) RestoreJobs() error {
+	if pe.store == nil {
+		return nil
+	}
+
+	jobs, err := pe.store.LoadJobs()
+	if err != nil {
+		return fmt.Errorf("failed to load jobs: %w", err)
+	}
+
+	var unfinished []*Job
+	pe.mu.Lock()
+	for _, job := range jobs {
+		pe.jobs[job.ID] = job
+		if !job.Status.IsTerminal() {
+			unfinished = append(unfinished, job)
+		}
+	}
+	pe.mu.Unlock()
+
+	// The server writing the store runs its unfinished jobs
+	if pe.readOnly {
+		pe.logger.Printf("Restored %d jobs", len(jobs))
+		return nil
+	}
+	for _, job := range unfinished {
+		pe.recoverJob(job)
+	}
+
+	pe.logger.Printf("Restored %d jobs, recovered %d unfinished jobs", len(jobs), len(unfinished))
+	return nil
+}
+
+// recoverJob resumes an unfinished job if possible and fails it otherwise
+func (pe *PipelineEngine) recoverJob(job *Job) {
+	pipeline, err := pe.GetPipeline(job.PipelineID)
+	if err != nil {
+		pe.failRecoveredJob(job, fmt.Sprintf("%s; %v", restartReason, err))
+		return
+	}
+
+	if resumer, ok := pe.executor.(Resumer); ok && resumer.CanResume(job) {
+		pe.resumeJob(pipeline, job)
+		return
+	}
+
+	pe.failRecoveredJob(job, restartReason)
+}
+
+// resumeJob restarts a recovered job after its last completed step
+func (pe *PipelineEngine) resumeJob(pipeline *Pipeline, job *Job) {
+	pe.mu.Lock()
+	completed := job.Steps[:0]
+	resumedAfter := ""
+	for _, step := range job.Steps {
+		if step.Status.Succeeded() {
+			completed = append(completed, step)
+			resumedAfter = step.ID
+		}
+	}
+	job.Steps = completed
+	// Like new jobs, resumed jobs are pending until they get a job slot
+	job.Status = StatusPending
+	if jobGroup(job) == "" && pe.admitJob(job.ID) {
+		job.Status = StatusRunning
+	}
+	advancePhase(&job.Phases, PhaseQueued, time.Now())
+
+	if job.Metadata == nil {
+		job.Metadata = make(map[string]interface{})
+	}
+	job.Metadata["resumedAt"] = time.Now()
+	job.Logs = append(job.Logs, LogEntry{
+		Timestamp: time.Now(),
+		Level:     "info",
+		Message:   fmt.Sprintf("resumed after server restart with %d completed steps", len(completed)),
+	})
+
+	pe.joinGroup(pipeline, job)
+	jobCtx := pe.trackJob(context.Background(), job)
+	pe.mu.Unlock()
+
+	pe.saveJob(job)
+	pe.emitEvent(Event{
+		Type:       "job.resumed",
+		Timestamp:  time.Now(),
+		PipelineID: job.PipelineID,
+		JobID:      job.ID,
+		Data: map[string]interface{}{
+			"completedSteps": len(completed),
+			"resumedAfter":   resumedAfter,
+		},
+	})
+
+	pe.enqueueJob(jobCtx, pipeline, job)
+}
+
+// failRecoveredJob marks a recovered job and its unfinished steps failed
+func (pe *PipelineEngine) failRecoveredJob(job *Job, reason string) {
+	pe.mu.Lock()
+	now := time.Now()
+	for i := range job.Steps {
+		if !job.Steps[i].Status.IsTerminal() {
+			job.Steps[i].Status = StatusFailed
+			job.Steps[i].EndedAt = now
+		}
+	}
+
+	if err := pe.transitionJob(job, StatusFailed); err != nil {
+		pe.logger.Printf("Job %s: %v", job.ID, err)
+	}
+	if job.Metadata == nil {
+		job.Metadata = make(map[string]interface{})
+	}
+	job.Metadata["failureReason"] = reason
+	job.Logs = append(job.Logs, LogEntry{
+		Timestamp: now,
+		Level:     "error",
+		Message:   reason,
+	})
+	pe.mu.Unlock()
+
+	pe.saveJob(job)
+	pe.emitEvent(Event{
+		Type:       "job.completed",
+		Timestamp:  time.Now(),
+		PipelineID: job.PipelineID,
+		JobID:      job.ID,
+		Data: map[string]interface{}{
+			"status": StatusFailed,
+			"reason": reason,
+		},
+	})
+}
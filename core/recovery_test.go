@@ -0,0 +1,107 @@
+package core
+
+import (
+	"context"
+	"testing"
+)
+
+func newRecoveryStore(t *testing.T, jobs ...*Job) *FileStore {
+	t.Helper()
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	for _, job := range jobs {
+		if err := store.SaveJob(job); err != nil {
+			t.Fatalf("SaveJob() error = %v", err)
+		}
+	}
+	return store
+}
+
+func crashedJob() *Job {
+	return &Job{
+		ID:         "crashed",
+		PipelineID: "resume",
+		Status:     StatusRunning,
+		Steps: []StepStatus{
+			{ID: "build-step-a", Status: StatusSuccess, Output: "first\n"},
+			{ID: "build-step-b", Status: StatusRunning},
+		},
+	}
+}
+
+func TestRestoreJobs_FailsUnfinishedJobs(t *testing.T) {
+	store := newRecoveryStore(t,
+		&Job{ID: "done", PipelineID: "resume", Status: StatusSuccess},
+		crashedJob(),
+	)
+
+	engine := newTestEngine(WithStore(store))
+	engine.CreatePipeline(scriptPipeline("resume", "echo first", "echo second"))
+	sub := engine.Subscribe(4)
+	defer sub.Close()
+
+	if err := engine.RestoreJobs(); err != nil {
+		t.Fatalf("RestoreJobs() error = %v", err)
+	}
+
+	done, _ := engine.GetJob("resume", "done")
+	if done.Status != StatusSuccess {
+		t.Errorf("done.Status = %q, want %q", done.Status, StatusSuccess)
+	}
+
+	crashed, _ := engine.GetJob("resume", "crashed")
+	if crashed.Status != StatusFailed {
+		t.Errorf("crashed.Status = %q, want %q", crashed.Status, StatusFailed)
+	}
+	if crashed.Metadata["failureReason"] != restartReason {
+		t.Errorf("failureReason = %v, want %q", crashed.Metadata["failureReason"], restartReason)
+	}
+	if crashed.Steps[0].Status != StatusSuccess || crashed.Steps[1].Status != StatusFailed {
+		t.Errorf("Steps = %+v, want success then failed", crashed.Steps)
+	}
+
+	event := <-sub.Events()
+	if event.Type != "job.completed" || event.Data["reason"] != restartReason {
+		t.Errorf("event = %+v, want job.completed with restart reason", event)
+	}
+}
+
+func TestRestoreJobs_ResumesFromLastCompletedStep(t *testing.T) {
+	store := newRecoveryStore(t, crashedJob())
+
+	engine := newTestEngine(WithStore(store), WithExecutor(&ShellExecutor{Resume: true}))
+	engine.CreatePipeline(scriptPipeline("resume", "echo first", "echo second"))
+
+	if err := engine.RestoreJobs(); err != nil {
+		t.Fatalf("RestoreJobs() error = %v", err)
+	}
+
+	job := waitForJob(t, engine, "resume", "crashed", StatusSuccess)
+	if len(job.Steps) != 2 {
+		t.Fatalf("len(Steps) = %d, want 2", len(job.Steps))
+	}
+	if job.Steps[0].Output != "first\n" || job.Steps[1].Output != "second\n" {
+		t.Errorf("Steps = %+v, want first step kept and second re-run", job.Steps)
+	}
+	if _, ok := job.Metadata["resumedAt"]; !ok {
+		t.Error("Metadata missing resumedAt")
+	}
+
+	engine.Shutdown(context.Background())
+}
+
+func TestRestoreJobs_FailsWhenPipelineMissing(t *testing.T) {
+	store := newRecoveryStore(t, crashedJob())
+
+	engine := newTestEngine(WithStore(store), WithExecutor(&ShellExecutor{Resume: true}))
+	if err := engine.RestoreJobs(); err != nil {
+		t.Fatalf("RestoreJobs() error = %v", err)
+	}
+
+	crashed, _ := engine.GetJob("resume", "crashed")
+	if crashed.Status != StatusFailed {
+		t.Errorf("Status = %q, want %q", crashed.Status, StatusFailed)
+	}
+}
@@ -0,0 +1,228 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// redactionMask replaces the text redaction patterns match
+const redactionMask = "***"
+
+// pipelineRedactions are the compiled redaction patterns of a pipeline and
+// of its steps
+type pipelineRedactions struct {
+	pipeline []*regexp.Regexp
+	steps    map[string][]*regexp.Regexp
+}
+
+// RedactionMatch is text a redaction pattern matched
+type RedactionMatch struct {
+	Pattern string `json:"pattern"`
+	Text    string `json:"text"`
+}
+
+// RedactionTest is the result of applying redaction patterns to text
+type RedactionTest struct {
+	Redacted string           `json:"redacted"`
+	Matches  []RedactionMatch `json:"matches"`
+}
+
+// compileRedactions compiles redaction patterns, rejecting those that
+// match empty text
+func compileRedactions(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %v", pattern, err)
+		}
+		if re.MatchString("") {
+			return nil, fmt.Errorf("redaction pattern %q matches empty text", pattern)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// ValidateRedactPatterns checks redaction patterns
+func ValidateRedactPatterns(patterns []string) error {
+	_, err := compileRedactions(patterns)
+	return err
+}
+
+// validateRedactions checks the redaction patterns of a pipeline and its
+// steps
+func validateRedactions(pipeline *Pipeline) error {
+	_, err := newPipelineRedactions(pipeline)
+	return err
+}
+
+func newPipelineRedactions(pipeline *Pipeline) (*pipelineRedactions, error) {
+	compiled, err := compileRedactions(pipeline.Redact)
+	if err != nil {
+		return nil, err
+	}
+	r := &pipelineRedactions{pipeline: compiled, steps: make(map[string][]*regexp.Regexp)}
+	for _, stage := range expandMatrices(pipeline.Stages) {
+		for _, steps := range [][]Step{stage.Steps, stage.Rollback} {
+			for _, step := range steps {
+				if len(step.Redact) == 0 {
+					continue
+				}
+				compiled, err := compileRedactions(step.Redact)
+				if err != nil {
+					return nil, fmt.Errorf("step %s: %w", step.ID, err)
+				}
+				r.steps[step.ID] = compiled
+			}
+		}
+	}
+	return r, nil
+}
+
+// setRedactions keeps the compiled redaction patterns of a pipeline for
+// the logs, outputs and events of its jobs. Invalid patterns were rejected
+// by validateRedactions.
+func (pe *PipelineEngine) setRedactions(pipeline *Pipeline) {
+	r, err := newPipelineRedactions(pipeline)
+	if err != nil {
+		return
+	}
+	pe.redactMu.Lock()
+	defer pe.redactMu.Unlock()
+	if pe.redactions == nil {
+		pe.redactions = make(map[string]*pipelineRedactions)
+	}
+	pe.redactions[pipeline.ID] = r
+}
+
+// clearRedactions forgets the redaction patterns of a deleted pipeline
+func (pe *PipelineEngine) clearRedactions(pipelineID string) {
+	pe.redactMu.Lock()
+	defer pe.redactMu.Unlock()
+	delete(pe.redactions, pipelineID)
+}
+
+// redactPatterns returns the patterns that apply to a step of a pipeline,
+// or to the pipeline's job when stepID is empty. Unlike the other engine
+// state they have their own lock, so they can be read with pe.mu held.
+func (pe *PipelineEngine) redactPatterns(pipelineID, stepID string) []*regexp.Regexp {
+	pe.redactMu.RLock()
+	defer pe.redactMu.RUnlock()
+	r, ok := pe.redactions[pipelineID]
+	if !ok {
+		return nil
+	}
+	if steps := r.steps[stepID]; len(steps) > 0 {
+		return append(append([]*regexp.Regexp(nil), r.pipeline...), steps...)
+	}
+	return r.pipeline
+}
+
+// redact masks the text the redaction patterns of a pipeline, and of the
+// step when stepID is set, match
+func (pe *PipelineEngine) redact(pipelineID, stepID, text string) string {
+	return redactText(text, pe.redactPatterns(pipelineID, stepID))
+}
+
+func redactText(text string, patterns []*regexp.Regexp) string {
+	for _, re := range patterns {
+		text = re.ReplaceAllString(text, redactionMask)
+	}
+	return text
+}
+
+// redactEvent masks the text of an event's data for the pipeline it is
+// about. The data is copied, as it may be shared with the job.
+func (pe *PipelineEngine) redactEvent(event Event) Event {
+	if event.PipelineID == "" || len(event.Data) == 0 {
+		return event
+	}
+	patterns := pe.redactPatterns(event.PipelineID, event.StepID)
+	if len(patterns) == 0 {
+		return event
+	}
+	event.Data = redactValue(event.Data, patterns).(map[string]interface{})
+	return event
+}
+
+// redactValue returns a copy of a value with the strings in it redacted.
+// Values of other types are kept as they are.
+func redactValue(value interface{}, patterns []*regexp.Regexp) interface{} {
+	switch v := value.(type) {
+	case string:
+		return redactText(v, patterns)
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = redactValue(item, patterns)
+		}
+		return copied
+	case map[string]string:
+		copied := make(map[string]string, len(v))
+		for key, item := range v {
+			copied[key] = redactText(item, patterns)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = redactValue(item, patterns)
+		}
+		return copied
+	case []string:
+		copied := make([]string, len(v))
+		for i, item := range v {
+			copied[i] = redactText(item, patterns)
+		}
+		return copied
+	}
+	return value
+}
+
+// TestRedactions applies redaction patterns to text and reports what they
+// matched. Without patterns, it applies those of the pipeline, and of its
+// step stepID when set.
+func (pe *PipelineEngine) TestRedactions(pipelineID, stepID string, patterns []string, text string) (*RedactionTest, error) {
+	pipeline, err := pe.GetPipeline(pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	if patterns == nil {
+		patterns = append(patterns, pipeline.Redact...)
+		if stepID != "" {
+			step, ok := findStep(pipeline, stepID)
+			if !ok {
+				return nil, fmt.Errorf("step %s not found in pipeline %s", stepID, pipelineID)
+			}
+			patterns = append(patterns, step.Redact...)
+		}
+	}
+	compiled, err := compileRedactions(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	test := &RedactionTest{Redacted: text, Matches: []RedactionMatch{}}
+	for _, re := range compiled {
+		for _, match := range re.FindAllString(test.Redacted, -1) {
+			test.Matches = append(test.Matches, RedactionMatch{Pattern: re.String(), Text: match})
+		}
+		test.Redacted = re.ReplaceAllString(test.Redacted, redactionMask)
+	}
+	return test, nil
+}
+
+// findStep returns the step of a pipeline with an ID
+func findStep(pipeline *Pipeline, stepID string) (Step, bool) {
+	for _, stage := range pipeline.Stages {
+		for _, steps := range [][]Step{stage.Steps, stage.Rollback} {
+			for _, step := range steps {
+				if step.ID == stepID {
+					return step, true
+				}
+			}
+		}
+	}
+	return Step{}, false
+}
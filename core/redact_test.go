@@ -0,0 +1,85 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRun_RedactsPatterns(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("deploy", "echo connecting to db-1.corp.local for cust-1234", "echo cust-5678 >&2; exit 1")
+	pipeline.Redact = []string{`[a-z0-9-]+\.corp\.local`}
+	pipeline.Stages[0].Steps[1].Redact = []string{`cust-[0-9]+`}
+	if err := engine.CreatePipeline(pipeline); err != nil {
+		t.Fatalf("CreatePipeline() error = %v", err)
+	}
+
+	job, err := engine.Run(context.Background(), "deploy", WithTrigger(map[string]string{"host": "api.corp.local"}))
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if out := job.Steps[0].Output; !strings.Contains(out, "connecting to *** for cust-1234") {
+		t.Errorf("first step output = %q, want the hostname masked and the step pattern not applied", out)
+	}
+	if out := job.Steps[1].Output; strings.Contains(out, "cust-5678") {
+		t.Errorf("second step output = %q, want the customer masked", out)
+	}
+
+	events, err := engine.JobEvents(job.ID)
+	if err != nil {
+		t.Fatalf("JobEvents() error = %v", err)
+	}
+	for _, event := range events {
+		if data := fmt.Sprint(event.Data); strings.Contains(data, "corp.local") {
+			t.Errorf("%s event data = %s, want the hostname masked", event.Type, data)
+		}
+	}
+	if triggerValues(job.Metadata)["host"] != "api.corp.local" {
+		t.Errorf("job trigger = %v, want the job's own metadata untouched", job.Metadata["trigger"])
+	}
+
+	bad := scriptPipeline("bad", "true")
+	bad.Stages[0].Steps[0].Redact = []string{"[a-z"}
+	if err := engine.CreatePipeline(bad); err == nil || !strings.Contains(err.Error(), `invalid redaction pattern "[a-z"`) {
+		t.Errorf("CreatePipeline() error = %v, want the invalid pattern rejected", err)
+	}
+
+	// A pipeline created again after it was deleted doesn't inherit the
+	// patterns of the deleted one
+	if err := engine.DeletePipeline("deploy"); err != nil {
+		t.Fatalf("DeletePipeline() error = %v", err)
+	}
+	if patterns := engine.redactPatterns("deploy", ""); len(patterns) != 0 {
+		t.Errorf("redactPatterns() = %v after DeletePipeline(), want none", patterns)
+	}
+	engine.CreatePipeline(scriptPipeline("deploy", "echo db-1.corp.local"))
+	if job, _ := engine.Run(context.Background(), "deploy"); !strings.Contains(job.Steps[0].Output, "db-1.corp.local") {
+		t.Errorf("output = %q, want nothing masked", job.Steps[0].Output)
+	}
+}
+
+func TestTestRedactions(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("deploy", "true")
+	pipeline.Redact = []string{`[a-z0-9-]+\.corp\.local`}
+	pipeline.Stages[0].Steps[0].Redact = []string{`cust-[0-9]+`}
+	engine.CreatePipeline(pipeline)
+
+	test, err := engine.TestRedactions("deploy", "build-step-a", nil, "cust-42 on db-1.corp.local")
+	if err != nil {
+		t.Fatalf("TestRedactions() error = %v", err)
+	}
+	if test.Redacted != "*** on ***" || len(test.Matches) != 2 || test.Matches[0].Text != "db-1.corp.local" {
+		t.Errorf("TestRedactions() = %+v, want both patterns applied", test)
+	}
+
+	test, err = engine.TestRedactions("deploy", "", []string{`secret-\w+`}, "secret-abc and cust-42")
+	if err != nil || test.Redacted != "*** and cust-42" {
+		t.Errorf("TestRedactions(patterns) = %+v, %v, want only the given pattern applied", test, err)
+	}
+	if _, err := engine.TestRedactions("deploy", "", []string{"x*"}, "text"); err == nil {
+		t.Error("TestRedactions() with a pattern matching empty text error = nil, want error")
+	}
+}
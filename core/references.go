@@ -0,0 +1,149 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// referenceExpression matches references such as ${{ trigger.pr }}
+var referenceExpression = regexp.MustCompile(`\$\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// referenceNamespaces lists the prefixes references can use
+var referenceNamespaces = []string{"pipeline.", "job.", "trigger.", "revision.", "steps.", "matrix."}
+
+// knownReference reports whether a reference is in a known namespace
+func knownReference(ref string) bool {
+	for _, namespace := range referenceNamespaces {
+		if strings.HasPrefix(ref, namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateStartReferences checks that s only references values known when
+// a job starts: the pipeline ID, trigger values and the revision. Functions
+// other than hashFiles, which needs the job's files, can be used. what
+// names s in errors.
+func validateStartReferences(s, what string) error {
+	refs, err := textReferences(s)
+	if err != nil {
+		return fmt.Errorf("%v in %s", err, what)
+	}
+	nodes, _ := parseExpressions(s)
+	for _, node := range nodes {
+		for _, name := range expressionFunctionsUsed(node) {
+			if expressionFunctions[name].needsDir {
+				return fmt.Errorf("%s can't be used in %s", name, what)
+			}
+		}
+	}
+	for _, ref := range refs {
+		if ref != "pipeline.id" && !strings.HasPrefix(ref, "trigger.") && !strings.HasPrefix(ref, "revision.") {
+			return fmt.Errorf("unknown reference %q in %s", ref, what)
+		}
+	}
+	if strings.Contains(strings.Join(expressionPattern.Split(s, -1), ""), "${{") {
+		return fmt.Errorf("unterminated reference in %s %q", what, s)
+	}
+	return nil
+}
+
+// textReferences returns the references in s, bare or in expressions
+func textReferences(s string) ([]string, error) {
+	refs := []string{}
+	for _, match := range referenceExpression.FindAllStringSubmatch(s, -1) {
+		refs = append(refs, match[1])
+	}
+	nodes, err := parseExpressions(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		refs = append(refs, expressionReferences(node)...)
+	}
+	return refs, nil
+}
+
+// referenceValues returns the values references expand to
+func referenceValues(pipeline *Pipeline, jobID string, trigger map[string]string, rev *Revision) map[string]string {
+	values := map[string]string{"pipeline.id": pipeline.ID}
+	if jobID != "" {
+		values["job.id"] = jobID
+	}
+	for key, value := range trigger {
+		values["trigger."+key] = value
+	}
+	if rev != nil {
+		for key, value := range rev.values() {
+			values["revision."+key] = value
+		}
+	}
+	return values
+}
+
+// expandReferences replaces references and expressions in s with their
+// values. References to unset values in a known namespace expand to an
+// empty string, and other references are left in place.
+func expandReferences(s string, values map[string]string) string {
+	expanded, _ := expandExpressions(s, expressionScope{values: values})
+	return expanded
+}
+
+// expandStep expands the references and expressions in a step's command,
+// environment, string config values, locks and cache keys. hashFiles is
+// relative to dir, the job's directory.
+func expandStep(step Step, values map[string]string, dir string) (Step, error) {
+	scope := expressionScope{values: values, dir: dir, now: time.Now()}
+	var first error
+	expand := func(s string) string {
+		expanded, err := expandExpressions(s, scope)
+		if err != nil && first == nil {
+			first = err
+		}
+		return expanded
+	}
+	step.Command = expand(step.Command)
+	if len(step.Environment) > 0 {
+		env := make(map[string]string, len(step.Environment))
+		for key, value := range step.Environment {
+			env[key] = expand(value)
+		}
+		step.Environment = env
+	}
+	if len(step.Config) > 0 {
+		config := make(map[string]interface{}, len(step.Config))
+		for key, value := range step.Config {
+			if s, ok := value.(string); ok {
+				value = expand(s)
+			}
+			config[key] = value
+		}
+		step.Config = config
+	}
+	if len(step.Locks) > 0 {
+		locks := make([]string, len(step.Locks))
+		for i, name := range step.Locks {
+			locks[i] = expand(name)
+		}
+		step.Locks = locks
+	}
+	if step.Cache != nil {
+		cache := *step.Cache
+		cache.Key = expand(cache.Key)
+		step.Cache = &cache
+	}
+	if step.Memoize != nil {
+		memoize := *step.Memoize
+		memoize.Key = expand(memoize.Key)
+		step.Memoize = &memoize
+	}
+	if step.When != nil {
+		when := *step.When
+		when.Custom = expand(when.Custom)
+		step.When = &when
+	}
+	return step, first
+}
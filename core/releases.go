@@ -0,0 +1,472 @@
+package core
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Release is a set of a job's artifacts promoted under a name, such as a
+// release candidate. Releases are immutable: their artifacts are exempt from
+// expiry, their contents are checksummed, and deploy pipelines that
+// reference them get exactly the files that were promoted.
+type Release struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	PipelineID  string            `json:"pipelineId"`
+	JobID       string            `json:"jobId"`
+	Revision    *Revision         `json:"revision,omitempty"`
+	Artifacts   []ReleaseArtifact `json:"artifacts"`
+	PromotedBy  string            `json:"promotedBy,omitempty"`
+	PromotedAt  time.Time         `json:"promotedAt"`
+}
+
+// ReleaseArtifact is a promoted artifact and the checksum of its contents
+type ReleaseArtifact struct {
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+	Size  int64  `json:"size"`
+	// Checksum is the hash of the artifact's file names and contents,
+	// prefixed with its algorithm
+	Checksum string `json:"checksum"`
+	// Signature is an HMAC-SHA256 of the release name, artifact name and
+	// checksum, set when the engine has a signing key
+	Signature string `json:"signature,omitempty"`
+}
+
+// PromoteRequest selects the artifacts of a job to promote. All of the
+// job's artifacts are promoted when Artifacts is empty.
+type PromoteRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Artifacts   []string `json:"artifacts,omitempty"`
+	By          string   `json:"-"`
+}
+
+// JobRelease is the release a deploy job uses
+type JobRelease struct {
+	Name  string `json:"name"`
+	JobID string `json:"jobId"`
+	// Dir holds the release's artifacts, one directory per artifact
+	Dir string `json:"dir,omitempty"`
+}
+
+// ReleaseStore stores releases. When the engine's Store also implements
+// ReleaseStore, job artifacts can be promoted.
+type ReleaseStore interface {
+	// SaveRelease stores a new release and fails with ErrReleaseExists when
+	// a release of the same name exists
+	SaveRelease(release *Release) error
+	ListReleases() ([]*Release, error)
+}
+
+// ErrReleaseExists is returned when promoting under a name already taken
+var ErrReleaseExists = errors.New("release already exists")
+
+// WithReleaseSigningKey sets the key releases are signed with. A subkey is
+// derived from it, so the secret store key can be passed. Signatures made
+// with previous keys are still accepted.
+func WithReleaseSigningKey(key []byte, previous ...[]byte) Option {
+	return func(pe *PipelineEngine) {
+		pe.signingKey = releaseSigningKey(key)
+		pe.oldSigningKeys = nil
+		for _, key := range previous {
+			pe.oldSigningKeys = append(pe.oldSigningKeys, releaseSigningKey(key))
+		}
+	}
+}
+
+// releaseSigningKey derives the release signing subkey of a key
+func releaseSigningKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("conveyor release signing"))
+	return mac.Sum(nil)
+}
+
+// ValidReleaseName reports whether name can be used as a release name
+func ValidReleaseName(name string) bool {
+	return artifactNamePattern.MatchString(name)
+}
+
+// ValidateRelease checks the release a deploy pipeline references: a
+// release name, or a template that may reference the pipeline ID, trigger
+// values and the revision
+func ValidateRelease(release string) error {
+	if !strings.Contains(release, "${{") && !ValidReleaseName(release) {
+		return fmt.Errorf("invalid release name %q", release)
+	}
+	return validateStartReferences(release, "release")
+}
+
+// releaseStore returns the engine's release store, or nil
+func (pe *PipelineEngine) releaseStore() ReleaseStore {
+	store, _ := pe.store.(ReleaseStore)
+	return store
+}
+
+// Promote checksums and signs the artifacts of a successful job and stores
+// them as an immutable release
+func (pe *PipelineEngine) Promote(jobID string, req PromoteRequest) (*Release, error) {
+	store := pe.releaseStore()
+	if store == nil {
+		return nil, fmt.Errorf("releases require a store that keeps them")
+	}
+	if !ValidReleaseName(req.Name) {
+		return nil, fmt.Errorf("invalid release name %q", req.Name)
+	}
+	job, err := pe.FindJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+	job = pe.snapshotJob(job)
+	if job.Status != StatusSuccess {
+		return nil, fmt.Errorf("job %s is %s; only successful jobs can be promoted", jobID, job.Status)
+	}
+
+	artifacts, err := pe.JobArtifacts(jobID)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := selectArtifacts(artifacts, req.Artifacts)
+	if err != nil {
+		return nil, fmt.Errorf("job %s: %w", jobID, err)
+	}
+
+	release := &Release{
+		Name:        req.Name,
+		Description: req.Description,
+		PipelineID:  job.PipelineID,
+		JobID:       job.ID,
+		Revision:    job.Revision,
+		PromotedBy:  req.By,
+		PromotedAt:  time.Now(),
+	}
+	for _, artifact := range selected {
+		checksum, err := pe.artifactChecksum(artifact, pe.checksumAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		release.Artifacts = append(release.Artifacts, ReleaseArtifact{
+			Name:      artifact.Name,
+			Files:     artifact.Files,
+			Size:      artifact.Size,
+			Checksum:  checksum,
+			Signature: pe.signArtifact(release.Name, artifact.Name, checksum),
+		})
+	}
+	if err := store.SaveRelease(release); err != nil {
+		return nil, err
+	}
+
+	pe.logger.Printf("Promoted %d artifacts of job %s as release %s", len(release.Artifacts), jobID, release.Name)
+	return release, nil
+}
+
+// selectArtifacts returns the named artifacts, or all when names is empty
+func selectArtifacts(artifacts []*Artifact, names []string) ([]*Artifact, error) {
+	if len(artifacts) == 0 {
+		return nil, fmt.Errorf("no artifacts to promote")
+	}
+	if len(names) == 0 {
+		return artifacts, nil
+	}
+	byName := make(map[string]*Artifact, len(artifacts))
+	for _, artifact := range artifacts {
+		byName[artifact.Name] = artifact
+	}
+	selected := make([]*Artifact, 0, len(names))
+	for _, name := range names {
+		artifact, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("artifact %s not found", name)
+		}
+		selected = append(selected, artifact)
+	}
+	return selected, nil
+}
+
+// Releases returns every release, newest first
+func (pe *PipelineEngine) Releases() ([]*Release, error) {
+	store := pe.releaseStore()
+	if store == nil {
+		return []*Release{}, nil
+	}
+	releases, err := store.ListReleases()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		return releases[i].PromotedAt.After(releases[j].PromotedAt)
+	})
+	return releases, nil
+}
+
+// GetRelease returns a release by name
+func (pe *PipelineEngine) GetRelease(name string) (*Release, error) {
+	releases, err := pe.Releases()
+	if err != nil {
+		return nil, err
+	}
+	for _, release := range releases {
+		if release.Name == name {
+			return release, nil
+		}
+	}
+	return nil, fmt.Errorf("release %s not found", name)
+}
+
+// VerifyRelease checks that every artifact of a release is still stored
+// with the contents it was promoted with
+func (pe *PipelineEngine) VerifyRelease(release *Release) error {
+	for _, promoted := range release.Artifacts {
+		if _, err := pe.verifiedArtifact(release, promoted.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifiedArtifact returns the stored artifact of a release after checking
+// its signature and checksum
+func (pe *PipelineEngine) verifiedArtifact(release *Release, name string) (*Artifact, error) {
+	var promoted *ReleaseArtifact
+	for i := range release.Artifacts {
+		if release.Artifacts[i].Name == name {
+			promoted = &release.Artifacts[i]
+		}
+	}
+	if promoted == nil {
+		return nil, fmt.Errorf("release %s has no artifact %s", release.Name, name)
+	}
+	if promoted.Signature != "" && pe.signingKey != nil && !pe.validSignature(release.Name, name, promoted) {
+		return nil, fmt.Errorf("release %s: artifact %s has an invalid signature", release.Name, name)
+	}
+	algorithm := DefaultChecksumAlgorithm
+	if i := strings.Index(promoted.Checksum, ":"); i > 0 {
+		algorithm = promoted.Checksum[:i]
+	}
+
+	artifacts, err := pe.listArtifacts()
+	if err != nil {
+		return nil, err
+	}
+	for _, artifact := range artifacts {
+		if artifact.JobID != release.JobID || artifact.Name != name {
+			continue
+		}
+		checksum, err := pe.artifactChecksum(artifact, algorithm)
+		if err != nil {
+			return nil, err
+		}
+		if checksum != promoted.Checksum {
+			return nil, fmt.Errorf("release %s: artifact %s changed since it was promoted", release.Name, name)
+		}
+		return artifact, nil
+	}
+	return nil, fmt.Errorf("release %s: artifact %s is missing from storage", release.Name, name)
+}
+
+// ArchiveReleaseArtifact verifies an artifact of a release and writes it to
+// w as a gzipped tarball
+func (pe *PipelineEngine) ArchiveReleaseArtifact(name, artifactName string, w io.Writer) error {
+	release, err := pe.GetRelease(name)
+	if err != nil {
+		return err
+	}
+	artifact, err := pe.verifiedArtifact(release, artifactName)
+	if err != nil {
+		return err
+	}
+	return pe.artifactStore().ArchiveArtifact(artifact, w)
+}
+
+// signArtifact returns the signature of a promoted artifact, or "" without
+// a signing key
+func (pe *PipelineEngine) signArtifact(release, artifact, checksum string) string {
+	if pe.signingKey == nil {
+		return ""
+	}
+	return artifactSignature(pe.signingKey, release, artifact, checksum)
+}
+
+// validSignature reports whether a promoted artifact was signed with the
+// signing key or one of the previous ones
+func (pe *PipelineEngine) validSignature(release, artifact string, promoted *ReleaseArtifact) bool {
+	for _, key := range append([][]byte{pe.signingKey}, pe.oldSigningKeys...) {
+		if hmac.Equal([]byte(promoted.Signature), []byte(artifactSignature(key, release, artifact, promoted.Checksum))) {
+			return true
+		}
+	}
+	return false
+}
+
+// artifactSignature signs a promoted artifact with a key
+func artifactSignature(key []byte, release, artifact, checksum string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s", release, artifact, checksum)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// artifactChecksum hashes the names and contents of an artifact's files
+// with the named algorithm, so it doesn't change when only modification
+// times do
+func (pe *PipelineEngine) artifactChecksum(artifact *Artifact, algorithm string) (string, error) {
+	hash, err := pe.checksumHash(algorithm)
+	if err != nil {
+		return "", fmt.Errorf("failed to checksum artifact %s: %w", artifact.Name, err)
+	}
+	err = pe.readArtifact(artifact, func(header *tar.Header, r io.Reader) error {
+		fmt.Fprintf(hash, "%s\x00%d\x00", header.Name, header.Size)
+		_, err := io.Copy(hash, r)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to checksum artifact %s: %w", artifact.Name, err)
+	}
+	return algorithm + ":" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// readArtifact calls fn for each file of an artifact's archive
+func (pe *PipelineEngine) readArtifact(artifact *Artifact, fn func(header *tar.Header, r io.Reader) error) error {
+	store := pe.artifactStore()
+	if store == nil {
+		return fmt.Errorf("no artifact store")
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(store.ArchiveArtifact(artifact, pw))
+	}()
+	defer pr.Close()
+
+	gz, err := gzip.NewReader(pr)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// prepareRelease verifies the release a deploy pipeline references and
+// extracts its artifacts for the job's steps
+func (pe *PipelineEngine) prepareRelease(pipeline *Pipeline, job *Job) error {
+	if pipeline.Release == "" {
+		return nil
+	}
+	pe.mu.RLock()
+	name := expandReferences(pipeline.Release, referenceValues(pipeline, job.ID, triggerValues(job.Metadata), job.Revision))
+	pe.mu.RUnlock()
+	if name == "" {
+		return fmt.Errorf("release %q resolves to an empty name", pipeline.Release)
+	}
+
+	release, err := pe.GetRelease(name)
+	if err != nil {
+		return err
+	}
+	if err := pe.VerifyRelease(release); err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "conveyor-release-")
+	if err != nil {
+		return fmt.Errorf("failed to create release directory: %w", err)
+	}
+	for _, promoted := range release.Artifacts {
+		artifact, err := pe.verifiedArtifact(release, promoted.Name)
+		if err == nil {
+			err = pe.extractArtifact(artifact, filepath.Join(dir, promoted.Name))
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+
+	pe.mu.Lock()
+	job.Release = &JobRelease{Name: release.Name, JobID: release.JobID, Dir: dir}
+	if job.Revision == nil && release.Revision != nil {
+		rev := *release.Revision
+		job.Revision = &rev
+	}
+	pe.mu.Unlock()
+	pe.logJob(job, "info", "", fmt.Sprintf("Using release %s from job %s", release.Name, release.JobID))
+	return nil
+}
+
+// extractArtifact writes the files of an artifact under dest
+func (pe *PipelineEngine) extractArtifact(artifact *Artifact, dest string) error {
+	err := pe.readArtifact(artifact, func(header *tar.Header, r io.Reader) error {
+		target := filepath.Join(dest, filepath.FromSlash(header.Name))
+		if rel, err := filepath.Rel(dest, target); err != nil || strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("file %s is outside the artifact", header.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, r)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to extract artifact %s: %w", artifact.Name, err)
+	}
+	return nil
+}
+
+// cleanupRelease removes the extracted release of a finished job, or once
+// the job's debug session ends
+func (pe *PipelineEngine) cleanupRelease(job *Job) {
+	pe.mu.RLock()
+	release := job.Release
+	pe.mu.RUnlock()
+	if release == nil || release.Dir == "" {
+		return
+	}
+	remove := func() { os.RemoveAll(release.Dir) }
+	if !pe.holdForDebug(job.ID, remove) {
+		remove()
+	}
+}
+
+// releasedArtifacts returns the releases of stored artifacts, keyed by job
+// ID and artifact name
+func (pe *PipelineEngine) releasedArtifacts() (map[string]string, error) {
+	releases, err := pe.Releases()
+	if err != nil {
+		return nil, err
+	}
+	released := make(map[string]string)
+	for _, release := range releases {
+		for _, artifact := range release.Artifacts {
+			released[release.JobID+"/"+artifact.Name] = release.Name
+		}
+	}
+	return released, nil
+}
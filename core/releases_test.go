@@ -0,0 +1,148 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// releaseEngine returns an engine with a signing key storing artifacts and
+// releases in dataDir and running steps in workDir
+func releaseEngine(t *testing.T, dataDir, workDir string) *PipelineEngine {
+	t.Helper()
+	store, err := NewFileStore(dataDir)
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	return newTestEngine(WithStore(store), WithExecutor(&ShellExecutor{Dir: workDir}), WithReleaseSigningKey([]byte("key")))
+}
+
+func TestPromote(t *testing.T) {
+	engine := releaseEngine(t, t.TempDir(), t.TempDir())
+	pipeline := scriptPipeline("build", "mkdir -p dist && echo app > dist/app.bin && echo docs > notes.txt")
+	pipeline.Artifacts = []ArtifactConfig{
+		{Name: "dist", Paths: []string{"dist/"}},
+		{Name: "notes", Paths: []string{"notes.txt"}},
+	}
+	pipeline.ArtifactRetention = &RetentionPolicy{Count: 1}
+	engine.CreatePipeline(pipeline)
+	job := runArtifactJob(t, engine, "build")
+
+	release, err := engine.Promote(job.ID, PromoteRequest{Name: "v1.0.0-rc1", Artifacts: []string{"dist"}, By: "alice"})
+	if err != nil {
+		t.Fatalf("Promote() error = %v", err)
+	}
+	if len(release.Artifacts) != 1 || release.Artifacts[0].Name != "dist" || release.PromotedBy != "alice" {
+		t.Fatalf("release = %+v, want dist promoted by alice", release)
+	}
+	promoted := release.Artifacts[0]
+	if !strings.HasPrefix(promoted.Checksum, "sha256:") || promoted.Signature == "" {
+		t.Errorf("artifact = %+v, want a checksum and signature", promoted)
+	}
+
+	if _, err := engine.Promote(job.ID, PromoteRequest{Name: "v1.0.0-rc1"}); !errors.Is(err, ErrReleaseExists) {
+		t.Errorf("Promote() again error = %v, want ErrReleaseExists", err)
+	}
+	if _, err := engine.Promote(job.ID, PromoteRequest{Name: "v2", Artifacts: []string{"docs"}}); err == nil {
+		t.Error("Promote() of an unknown artifact error = nil, want error")
+	}
+
+	// Newer jobs push the promoted job out of the retention count, but
+	// only its unpromoted artifact expires
+	runArtifactJob(t, engine, "build")
+	expired, err := engine.ExpireArtifacts(time.Now())
+	if err != nil {
+		t.Fatalf("ExpireArtifacts() error = %v", err)
+	}
+	if len(expired) != 1 || expired[0].JobID != job.ID || expired[0].Name != "notes" {
+		t.Errorf("expired = %+v, want only the notes of the promoted job", expired)
+	}
+	artifacts, _ := engine.JobArtifacts(job.ID)
+	if len(artifacts) != 1 || artifacts[0].Release != "v1.0.0-rc1" {
+		t.Errorf("artifacts = %+v, want dist kept for the release", artifacts)
+	}
+	if err := engine.VerifyRelease(release); err != nil {
+		t.Errorf("VerifyRelease() error = %v", err)
+	}
+
+	// Releases signed before a key change verify with the previous key
+	WithReleaseSigningKey([]byte("rotated"), []byte("key"))(engine)
+	if err := engine.VerifyRelease(release); err != nil {
+		t.Errorf("VerifyRelease() with the previous key error = %v", err)
+	}
+	WithReleaseSigningKey([]byte("rotated"))(engine)
+	if err := engine.VerifyRelease(release); err == nil {
+		t.Error("VerifyRelease() with another key error = nil, want an invalid signature")
+	}
+}
+
+func TestPromote_FailedJob(t *testing.T) {
+	engine := releaseEngine(t, t.TempDir(), t.TempDir())
+	pipeline := scriptPipeline("broken", "exit 1")
+	engine.CreatePipeline(pipeline)
+	job, _ := engine.Run(context.Background(), "broken")
+
+	if _, err := engine.Promote(job.ID, PromoteRequest{Name: "v1"}); err == nil || !strings.Contains(err.Error(), "only successful jobs") {
+		t.Errorf("Promote() error = %v, want only successful jobs", err)
+	}
+}
+
+func TestRun_DeploysRelease(t *testing.T) {
+	dataDir := t.TempDir()
+	engine := releaseEngine(t, dataDir, t.TempDir())
+	build := scriptPipeline("build", "mkdir -p dist && echo app > dist/app.bin")
+	build.Artifacts = []ArtifactConfig{{Name: "dist", Paths: []string{"dist/"}}}
+	engine.CreatePipeline(build)
+	buildJob := runArtifactJob(t, engine, "build")
+	if _, err := engine.Promote(buildJob.ID, PromoteRequest{Name: "rc1"}); err != nil {
+		t.Fatalf("Promote() error = %v", err)
+	}
+
+	deploy := scriptPipeline("deploy", `cat "$CONVEYOR_RELEASE_DIR/dist/dist/app.bin" && echo "$CONVEYOR_RELEASE"`)
+	deploy.Release = "${{ trigger.release }}"
+	engine.CreatePipeline(deploy)
+
+	job, err := engine.Run(context.Background(), "deploy", WithTrigger(map[string]string{"release": "rc1"}))
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess {
+		t.Fatalf("Status = %q, want success; logs: %+v", job.Status, job.Logs)
+	}
+	if output := job.Steps[0].Output; !strings.Contains(output, "app") || !strings.Contains(output, "rc1") {
+		t.Errorf("Output = %q, want the promoted file and release name", output)
+	}
+	if job.Release == nil || job.Release.JobID != buildJob.ID {
+		t.Errorf("Release = %+v, want rc1 from job %s", job.Release, buildJob.ID)
+	}
+	if _, err := os.Stat(job.Release.Dir); !os.IsNotExist(err) {
+		t.Errorf("release directory %s still exists after the job, want it removed", job.Release.Dir)
+	}
+
+	// A modified artifact fails verification and the deploy
+	path := filepath.Join(dataDir, "artifacts", "build", buildJob.ID, "dist", "dist", "app.bin")
+	if err := os.WriteFile(path, []byte("tampered\n"), 0644); err != nil {
+		t.Fatalf("failed to modify artifact: %v", err)
+	}
+	job, _ = engine.Run(context.Background(), "deploy", WithTrigger(map[string]string{"release": "rc1"}))
+	if job.Status != StatusFailed || len(job.Logs) == 0 || !strings.Contains(job.Logs[0].Message, "changed since it was promoted") {
+		t.Errorf("Status = %q, logs %+v, want failed on a changed artifact", job.Status, job.Logs)
+	}
+}
+
+func TestValidateRelease(t *testing.T) {
+	for _, release := range []string{"v1.2.3", "${{ trigger.release }}", "app-${{ revision.commit }}"} {
+		if err := ValidateRelease(release); err != nil {
+			t.Errorf("ValidateRelease(%q) error = %v", release, err)
+		}
+	}
+	for _, release := range []string{"../v1", "${{ job.id }}", "${{ trigger.release"} {
+		if err := ValidateRelease(release); err == nil {
+			t.Errorf("ValidateRelease(%q) error = nil, want error", release)
+		}
+	}
+}
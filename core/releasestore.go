@@ -0,0 +1,67 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SaveRelease writes a release to releases/<name>.json. Existing releases
+// are never overwritten.
+func (s *FileStore) SaveRelease(release *Release) error {
+	data, err := json.MarshalIndent(release, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode release: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := filepath.Join(s.dir, "releases")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create release directory: %w", err)
+	}
+	path := filepath.Join(dir, release.Name+".json")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0444)
+	if os.IsExist(err) {
+		return fmt.Errorf("%w: %s", ErrReleaseExists, release.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save release %s: %w", release.Name, err)
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to save release %s: %w", release.Name, err)
+	}
+	return nil
+}
+
+// ListReleases reads every stored release
+func (s *FileStore) ListReleases() ([]*Release, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(s.dir, "releases", "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list releases: %w", err)
+	}
+
+	releases := make([]*Release, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		var release Release
+		if err := json.Unmarshal(data, &release); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+		releases = append(releases, &release)
+	}
+	return releases, nil
+}
@@ -0,0 +1,338 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// snapshotTimeout bounds the git commands of a workspace snapshot
+const snapshotTimeout = 30 * time.Second
+
+// ErrStepNotRecorded is returned when replaying a step that has no
+// recording, such as a step that never started
+var ErrStepNotRecorded = errors.New("step has no recording")
+
+// StepRecording is what a step was executed with, recorded so the step can
+// be replayed
+type StepRecording struct {
+	// Step is the step definition with its references resolved
+	Step Step `json:"step"`
+	// Environment is the step's environment with secret values masked
+	Environment map[string]string `json:"environment"`
+	// Dir is the directory the step ran in
+	Dir string `json:"dir,omitempty"`
+	// Snapshot references the workspace content the step started from
+	Snapshot *WorkspaceSnapshot `json:"snapshot,omitempty"`
+	// Images maps the step's image and the images of its services to the
+	// digests that were used
+	Images map[string]string `json:"images,omitempty"`
+}
+
+// WorkspaceSnapshot references the state of a git working tree. Untracked
+// files are not part of it.
+type WorkspaceSnapshot struct {
+	// Commit is the checked out commit
+	Commit string `json:"commit"`
+	// Tree is a commit of the working tree including uncommitted changes to
+	// tracked files, which is Commit when the tree was clean
+	Tree string `json:"tree"`
+	// Ref keeps the snapshot in the repository of the workspace
+	Ref string `json:"ref"`
+	// Dir is the working tree the snapshot was taken in
+	Dir string `json:"dir"`
+}
+
+// StepReplay is the result of replaying a recorded step
+type StepReplay struct {
+	JobID    string `json:"jobId"`
+	StepID   string `json:"stepId"`
+	Status   Status `json:"status"`
+	ExitCode int    `json:"exitCode"`
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// OriginalStatus and OriginalExitCode are the recorded run's result
+	OriginalStatus   Status    `json:"originalStatus"`
+	OriginalExitCode int       `json:"originalExitCode"`
+	Snapshot         string    `json:"snapshot,omitempty"`
+	Warnings         []string  `json:"warnings,omitempty"`
+	StartedAt        time.Time `json:"startedAt"`
+	EndedAt          time.Time `json:"endedAt"`
+}
+
+// ImageResolver is implemented by service runtimes that can resolve the
+// digest of a local image
+type ImageResolver interface {
+	ImageDigest(ctx context.Context, image string) (string, error)
+}
+
+// ImageDigest returns the repository digest of a local image, or its ID
+// when it has none
+func (d *DockerRuntime) ImageDigest(ctx context.Context, image string) (string, error) {
+	return d.run(ctx, "image", "inspect", "--format", "{{if .RepoDigests}}{{index .RepoDigests 0}}{{else}}{{.Id}}{{end}}", image)
+}
+
+// recordStep records the resolved step, its masked environment, a snapshot
+// of its workspace and its image digests on the step's status
+func (pe *PipelineEngine) recordStep(ctx context.Context, job *Job, index int, step Step, env, secrets map[string]string, dir string) {
+	recording := &StepRecording{
+		Step:        step,
+		Environment: make(map[string]string, len(env)),
+		Dir:         dir,
+		Snapshot:    snapshotWorkspace(dir, job.ID, step.ID),
+	}
+	for key, value := range env {
+		recording.Environment[key] = maskSecrets(value, secrets)
+	}
+
+	if resolver, ok := pe.serviceRuntime.(ImageResolver); ok {
+		images := []string{step.Image}
+		for _, service := range step.Services {
+			images = append(images, service.Image)
+		}
+		for _, image := range images {
+			if image == "" {
+				continue
+			}
+			digest, err := resolver.ImageDigest(ctx, image)
+			if err != nil {
+				pe.logger.Printf("Step %s: failed to resolve image %s: %v", step.ID, image, err)
+				continue
+			}
+			if recording.Images == nil {
+				recording.Images = make(map[string]string)
+			}
+			recording.Images[image] = digest
+		}
+	}
+
+	pe.mu.Lock()
+	job.Steps[index].Recording = recording
+	pe.mu.Unlock()
+}
+
+// snapshotWorkspace snapshots the git working tree in dir and keeps it
+// under refs/conveyor/snapshots/<job>/<step>. It returns nil when dir is
+// not the root of a git checkout.
+func snapshotWorkspace(dir, jobID, stepID string) *WorkspaceSnapshot {
+	if dir == "" {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+
+	commit, err := snapshotGit(ctx, dir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil
+	}
+	// stash create commits the working tree without touching it or the
+	// stash, and prints nothing when the tree is clean
+	tree, err := snapshotGit(ctx, dir, "stash", "create")
+	if err != nil {
+		return nil
+	}
+	if tree == "" {
+		tree = commit
+	}
+	ref := "refs/conveyor/snapshots/" + jobID + "/" + stepID
+	if _, err := snapshotGit(ctx, dir, "update-ref", ref, tree); err != nil {
+		return nil
+	}
+	return &WorkspaceSnapshot{Commit: commit, Tree: tree, Ref: ref, Dir: dir}
+}
+
+// snapshotGit runs git in dir with an identity for snapshot commits
+func snapshotGit(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Conveyor", "GIT_AUTHOR_EMAIL=conveyor@localhost",
+		"GIT_COMMITTER_NAME=Conveyor", "GIT_COMMITTER_EMAIL=conveyor@localhost",
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ReplayStep executes a recorded step again, in isolation: in a temporary
+// checkout of its workspace snapshot, with its recorded environment, it and
+// its services on the recorded image digests and the current values of its
+// secrets. Without a snapshot the step runs in an empty directory.
+func (pe *PipelineEngine) ReplayStep(ctx context.Context, jobID, stepID string) (*StepReplay, error) {
+	job, err := pe.FindJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	pe.mu.RLock()
+	var recorded *StepStatus
+	for i := range job.Steps {
+		if job.Steps[i].ID == stepID && job.Steps[i].Recording != nil {
+			status := job.Steps[i]
+			recorded = &status
+		}
+	}
+	pe.mu.RUnlock()
+	if recorded == nil {
+		return nil, fmt.Errorf("%w: %s", ErrStepNotRecorded, stepID)
+	}
+	recording := recorded.Recording
+	step := recording.Step
+
+	replay := &StepReplay{
+		JobID:            jobID,
+		StepID:           stepID,
+		OriginalStatus:   recorded.Status,
+		OriginalExitCode: recorded.ExitCode,
+		StartedAt:        time.Now(),
+	}
+	pe.logJob(job, "info", stepID, fmt.Sprintf("Replaying step %s", stepID))
+
+	root, err := os.MkdirTemp("", "conveyor-replay-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create replay directory: %w", err)
+	}
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "workspace")
+	if snapshot := recording.Snapshot; snapshot != nil {
+		if err := checkoutSnapshot(ctx, snapshot, dir); err != nil {
+			os.RemoveAll(dir)
+			replay.Warnings = append(replay.Warnings, fmt.Sprintf("workspace snapshot unavailable, running in an empty directory: %v", err))
+		} else {
+			replay.Snapshot = snapshot.Tree
+		}
+	} else {
+		replay.Warnings = append(replay.Warnings, "step has no workspace snapshot, running in an empty directory")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create replay directory: %w", err)
+	}
+
+	env := make(map[string]string, len(recording.Environment))
+	for key, value := range recording.Environment {
+		env[key] = value
+	}
+	if _, ok := env["CONVEYOR_WORKSPACE"]; ok {
+		env["CONVEYOR_WORKSPACE"] = dir
+	}
+	secrets, err := pe.resolveSecrets(job, step)
+	if err == nil {
+		for name, value := range secrets {
+			env[name] = value
+		}
+
+		if digest, ok := recording.Images[step.Image]; ok {
+			step.Image = digest
+		}
+		services := make([]Service, len(step.Services))
+		for i, service := range step.Services {
+			if digest, ok := recording.Images[service.Image]; ok {
+				service.Image = digest
+			}
+			services[i] = service
+		}
+		var running []*RunningService
+		var stopServices func()
+		running, stopServices, err = pe.startServices(ctx, job, stepID, "replay-"+stepID, services)
+		if err == nil {
+			defer stopServices()
+			ctx = withServices(ctx, running)
+			for key, value := range serviceEnv(ctx) {
+				env[key] = value
+			}
+			replay.ExitCode, replay.Output, err = pe.replayStep(ctx, job, step, dir, env, recorded.Egress)
+			replay.Output = pe.redact(job.PipelineID, stepID, maskSecrets(replay.Output, secrets))
+			if binaryOutput(replay.Output) {
+				replay.Warnings = append(replay.Warnings, fmt.Sprintf("output is binary (%d bytes) and left out", len(replay.Output)))
+				replay.Output = ""
+			} else {
+				replay.Output = strings.ToValidUTF8(replay.Output, "\uFFFD")
+			}
+		}
+	}
+
+	replay.EndedAt = time.Now()
+	replay.Status = StatusSuccess
+	if err != nil {
+		replay.Status = StatusFailed
+		replay.Error = pe.redact(job.PipelineID, stepID, maskSecrets(err.Error(), secrets))
+	}
+	pe.logJob(job, "info", stepID, fmt.Sprintf("Replay of step %s finished with status %s", stepID, replay.Status))
+	pe.saveJob(job)
+	return replay, nil
+}
+
+// replayStep executes a step in dir and returns its exit code and output
+func (pe *PipelineEngine) replayStep(ctx context.Context, job *Job, step Step, dir string, env map[string]string, egress *EgressReport) (int, string, error) {
+	stepCtx, cancel, err := withStepTimeout(ctx, step)
+	if err != nil {
+		return 0, "", err
+	}
+	defer cancel()
+	limit := pe.stepOutputLimit(step)
+	stepCtx = withOutputLimit(stepCtx, limit)
+
+	if dir, err = stepDir(dir, step); err != nil {
+		return 0, "", err
+	}
+	var result *StepResult
+	if plugin := pe.pluginFor(step); plugin != nil {
+		result, err = executePlugin(stepCtx, plugin, &Pipeline{ID: job.PipelineID}, job, step, dir, env)
+	} else if step.Plugin != "" {
+		return 0, "", fmt.Errorf("plugin %s is not registered", step.Plugin)
+	} else {
+		executor, ok := pe.containers.(DirExecutor)
+		if !ok || step.Image == "" {
+			if executor, ok = pe.executor.(DirExecutor); !ok {
+				return 0, "", fmt.Errorf("the engine's executor can't run steps in a replay directory")
+			}
+		}
+		// A step that ran with a network policy is replayed with it
+		if egress != nil {
+			isolator, _ := executor.(EgressIsolator)
+			var stop func() []BlockedConnection
+			if stepCtx, stop, err = restrictEgress(stepCtx, isolator, step, egress.Allow, env); err != nil {
+				return 0, "", err
+			}
+			defer stop()
+		}
+		result, err = executor.ExecuteIn(stepCtx, dir, step, env)
+	}
+	if err != nil && ctx.Err() == nil && stepCtx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("step timed out after %s", step.Timeout)
+	}
+	if result == nil {
+		return 0, "", err
+	}
+	output := result.Output
+	if result.fullOutput != "" {
+		os.Remove(result.fullOutput)
+	} else {
+		output = truncateOutput(output, limit)
+	}
+	return result.ExitCode, output, err
+}
+
+// checkoutSnapshot checks a workspace snapshot out into dir, sharing the
+// objects of the workspace's repository
+func checkoutSnapshot(ctx context.Context, snapshot *WorkspaceSnapshot, dir string) error {
+	if _, err := snapshotGit(ctx, snapshot.Dir, "rev-parse", "--verify", "--quiet", snapshot.Tree+"^{commit}"); err != nil {
+		return fmt.Errorf("snapshot %s not found in %s", snapshot.Tree, snapshot.Dir)
+	}
+	if _, err := snapshotGit(ctx, "", "clone", "--quiet", "--shared", "--no-checkout", snapshot.Dir, dir); err != nil {
+		return err
+	}
+	_, err := snapshotGit(ctx, dir, "checkout", "--quiet", "--detach", snapshot.Tree)
+	return err
+}
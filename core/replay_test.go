@@ -0,0 +1,100 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gitCheckout creates a repository with a committed file and an
+// uncommitted change to it
+func gitCheckout(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"config", "user.email", "dev@example.com"},
+		{"config", "user.name", "Dev"},
+	} {
+		if _, err := snapshotGit(context.Background(), dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "version"), []byte("1\n"), 0644)
+	for _, args := range [][]string{{"add", "version"}, {"commit", "--quiet", "--message", "initial"}} {
+		if _, err := snapshotGit(context.Background(), dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "version"), []byte("2\n"), 0644)
+	return dir
+}
+
+func TestReplayStep_ReproducesRecordedStep(t *testing.T) {
+	repo := gitCheckout(t)
+	secrets, err := NewFileSecretStore(t.TempDir(), bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets.SaveSecret(&Secret{Name: "TOKEN", Value: "hunter2"})
+	engine := newTestEngine(WithSecrets(secrets), WithExecutor(&ShellExecutor{Dir: repo}))
+	pipeline := scriptPipeline("it", `cat version; echo "token=$TOKEN mode=$MODE"; echo changed > version; exit 4`)
+	pipeline.Stages[0].Steps[0].Environment = map[string]string{"MODE": "ci"}
+	pipeline.Stages[0].Steps[0].Secrets = []string{"TOKEN"}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "it")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	recording := job.Steps[0].Recording
+	if recording == nil {
+		t.Fatal("step has no recording")
+	}
+	if recording.Environment["TOKEN"] != "***" || recording.Environment["MODE"] != "ci" || recording.Step.Command != pipeline.Stages[0].Steps[0].Command {
+		t.Errorf("recording = %+v, want the command and masked environment", recording)
+	}
+	if recording.Snapshot == nil || recording.Snapshot.Tree == recording.Snapshot.Commit {
+		t.Fatalf("Snapshot = %+v, want a snapshot of the uncommitted change", recording.Snapshot)
+	}
+
+	replay, err := engine.ReplayStep(context.Background(), job.ID, "build-step-a")
+	if err != nil {
+		t.Fatalf("ReplayStep() error = %v", err)
+	}
+	if replay.Output != "2\ntoken=*** mode=ci\n" {
+		t.Errorf("Output = %q, want the snapshot's content and the step's environment", replay.Output)
+	}
+	if replay.Status != StatusFailed || replay.ExitCode != 4 || replay.OriginalExitCode != 4 || len(replay.Warnings) != 0 {
+		t.Errorf("replay = %+v, want the recorded failure reproduced", replay)
+	}
+	if data, _ := os.ReadFile(filepath.Join(repo, "version")); string(data) != "changed\n" {
+		t.Errorf("workspace version = %q, want it untouched by the replay", data)
+	}
+
+	if _, err := engine.ReplayStep(context.Background(), job.ID, "unknown"); !errors.Is(err, ErrStepNotRecorded) {
+		t.Errorf("ReplayStep(unknown) error = %v, want ErrStepNotRecorded", err)
+	}
+}
+
+func TestReplayStep_WithoutSnapshot(t *testing.T) {
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: t.TempDir()}))
+	engine.CreatePipeline(scriptPipeline("it", `ls | wc -l; touch file`))
+
+	job, _ := engine.Run(context.Background(), "it")
+	replay, err := engine.ReplayStep(context.Background(), job.ID, "build-step-a")
+	if err != nil {
+		t.Fatalf("ReplayStep() error = %v", err)
+	}
+	if strings.TrimSpace(replay.Output) != "0" || replay.Status != StatusSuccess || len(replay.Warnings) != 1 {
+		t.Errorf("replay = %+v, want a run in an empty directory with a warning", replay)
+	}
+}
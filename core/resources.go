@@ -0,0 +1,168 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Resources is an amount of CPU, in cores, and memory, in bytes
+type Resources struct {
+	CPU    float64 `json:"cpu,omitempty"`
+	Memory int64   `json:"memory,omitempty"`
+}
+
+// IsZero reports whether no resources are set
+func (r Resources) IsZero() bool {
+	return r.CPU == 0 && r.Memory == 0
+}
+
+// Add returns the sum of two amounts
+func (r Resources) Add(other Resources) Resources {
+	return Resources{CPU: r.CPU + other.CPU, Memory: r.Memory + other.Memory}
+}
+
+// Sub returns r minus other
+func (r Resources) Sub(other Resources) Resources {
+	return Resources{CPU: r.CPU - other.CPU, Memory: r.Memory - other.Memory}
+}
+
+// Fits reports whether request fits in r. Zero fields of r are unlimited.
+func (r Resources) Fits(request Resources) bool {
+	const epsilon = 1e-9
+	if r.CPU > 0 && request.CPU > r.CPU+epsilon {
+		return false
+	}
+	if r.Memory > 0 && request.Memory > r.Memory {
+		return false
+	}
+	return true
+}
+
+// String formats resources as "cpu 2, memory 4Gi"
+func (r Resources) String() string {
+	var parts []string
+	if r.CPU != 0 {
+		parts = append(parts, "cpu "+FormatCPU(r.CPU))
+	}
+	if r.Memory != 0 {
+		parts = append(parts, "memory "+FormatMemory(r.Memory))
+	}
+	if len(parts) == 0 {
+		return "no resources"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ResourceRequirements are the resources a step needs. Requests are
+// reserved on the runner the step is scheduled on; limits are passed to the
+// step as CONVEYOR_CPU_LIMIT and CONVEYOR_MEMORY_LIMIT. A limit without a
+// request also serves as the request.
+type ResourceRequirements struct {
+	Requests Resources `json:"requests,omitempty"`
+	Limits   Resources `json:"limits,omitempty"`
+}
+
+// request returns the resources reserved for a step
+func (r *ResourceRequirements) request() Resources {
+	if r == nil {
+		return Resources{}
+	}
+	request := r.Requests
+	if request.CPU == 0 {
+		request.CPU = r.Limits.CPU
+	}
+	if request.Memory == 0 {
+		request.Memory = r.Limits.Memory
+	}
+	return request
+}
+
+// cpuPattern matches CPU quantities such as "2", "0.5" and "500m"
+var cpuPattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)(m?)$`)
+
+// ParseCPU parses a CPU quantity in cores, or millicores with an "m" suffix
+func ParseCPU(s string) (float64, error) {
+	match := cpuPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return 0, fmt.Errorf("invalid cpu quantity %q", s)
+	}
+	cpu, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cpu quantity %q", s)
+	}
+	if match[2] == "m" {
+		cpu /= 1000
+	}
+	return cpu, nil
+}
+
+// FormatCPU formats a CPU quantity in cores, or millicores below one core
+func FormatCPU(cpu float64) string {
+	if cpu < 1 && cpu > 0 {
+		return fmt.Sprintf("%dm", int(math.Round(cpu*1000)))
+	}
+	return strconv.FormatFloat(cpu, 'f', -1, 64)
+}
+
+// memoryPattern matches memory quantities such as "512Mi", "2G" and "1024"
+var memoryPattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([KMGT]i?)?$`)
+
+// memoryUnits maps memory suffixes to bytes
+var memoryUnits = map[string]float64{
+	"":   1,
+	"K":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+}
+
+// ParseMemory parses a memory quantity in bytes, with an optional decimal
+// (K, M, G, T) or binary (Ki, Mi, Gi, Ti) suffix
+func ParseMemory(s string) (int64, error) {
+	match := memoryPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return 0, fmt.Errorf("invalid memory quantity %q", s)
+	}
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory quantity %q", s)
+	}
+	return int64(value * memoryUnits[match[2]]), nil
+}
+
+// FormatMemory formats bytes with the largest binary suffix that keeps the
+// value whole
+func FormatMemory(bytes int64) string {
+	for _, unit := range []string{"Ti", "Gi", "Mi", "Ki"} {
+		size := int64(memoryUnits[unit])
+		if bytes >= size && bytes%size == 0 {
+			return strconv.FormatInt(bytes/size, 10) + unit
+		}
+	}
+	return strconv.FormatInt(bytes, 10)
+}
+
+// ParseResources parses CPU and memory quantities, either of which may be
+// empty
+func ParseResources(cpu, memory string) (Resources, error) {
+	var r Resources
+	var err error
+	if cpu != "" {
+		if r.CPU, err = ParseCPU(cpu); err != nil {
+			return r, err
+		}
+	}
+	if memory != "" {
+		if r.Memory, err = ParseMemory(memory); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
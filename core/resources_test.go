@@ -0,0 +1,41 @@
+package core
+
+import "testing"
+
+func TestParseResources(t *testing.T) {
+	tests := []struct {
+		cpu, memory string
+		want        Resources
+	}{
+		{"2", "", Resources{CPU: 2}},
+		{"500m", "512Mi", Resources{CPU: 0.5, Memory: 512 << 20}},
+		{"1.5", "2G", Resources{CPU: 1.5, Memory: 2e9}},
+		{"", "1024", Resources{Memory: 1024}},
+	}
+	for _, tt := range tests {
+		got, err := ParseResources(tt.cpu, tt.memory)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseResources(%q, %q) = %+v, %v, want %+v", tt.cpu, tt.memory, got, err, tt.want)
+		}
+	}
+
+	for _, cpu := range []string{"-1", "2 cores", "m"} {
+		if _, err := ParseCPU(cpu); err == nil {
+			t.Errorf("ParseCPU(%q) error = nil, want error", cpu)
+		}
+	}
+	for _, memory := range []string{"1GB", "Mi", "-5"} {
+		if _, err := ParseMemory(memory); err == nil {
+			t.Errorf("ParseMemory(%q) error = nil, want error", memory)
+		}
+	}
+}
+
+func TestResources_String(t *testing.T) {
+	if got := (Resources{CPU: 0.25, Memory: 3 << 30}).String(); got != "cpu 250m, memory 3Gi" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := (Resources{CPU: 2, Memory: 1500}).String(); got != "cpu 2, memory 1500" {
+		t.Errorf("String() = %q", got)
+	}
+}
@@ -0,0 +1,192 @@
+package core
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Revision describes the code a job ran against
+type Revision struct {
+	Repo        string `json:"repo,omitempty"`
+	Branch      string `json:"branch,omitempty"`
+	Commit      string `json:"commit,omitempty"`
+	Author      string `json:"author,omitempty"`
+	Message     string `json:"message,omitempty"`
+	PullRequest int    `json:"pullRequest,omitempty"`
+}
+
+// IsZero reports whether no revision field is set
+func (r Revision) IsZero() bool {
+	return r == Revision{}
+}
+
+// values returns the revision fields by the names used in references such
+// as ${{ revision.branch }}
+func (r Revision) values() map[string]string {
+	values := map[string]string{
+		"repo":    r.Repo,
+		"branch":  r.Branch,
+		"commit":  r.Commit,
+		"author":  r.Author,
+		"message": r.Message,
+		"pr":      "",
+	}
+	if r.PullRequest > 0 {
+		values["pr"] = strconv.Itoa(r.PullRequest)
+	}
+	return values
+}
+
+// environment returns the variables steps see for the revision
+func (r Revision) environment() map[string]string {
+	env := make(map[string]string)
+	set := func(key, value string) {
+		if value != "" {
+			env[key] = value
+		}
+	}
+	set("CONVEYOR_REPO", r.Repo)
+	set("CONVEYOR_BRANCH", r.Branch)
+	set("CONVEYOR_COMMIT", r.Commit)
+	set("CONVEYOR_COMMIT_AUTHOR", r.Author)
+	set("CONVEYOR_COMMIT_MESSAGE", r.Message)
+	if r.PullRequest > 0 {
+		env["CONVEYOR_PULL_REQUEST"] = strconv.Itoa(r.PullRequest)
+	}
+	return env
+}
+
+// RevisionFromTrigger reads a revision from the repo, branch, commit,
+// author, message and pr trigger values
+func RevisionFromTrigger(trigger map[string]string) Revision {
+	rev := Revision{
+		Repo:    trigger["repo"],
+		Branch:  trigger["branch"],
+		Commit:  trigger["commit"],
+		Author:  trigger["author"],
+		Message: trigger["message"],
+	}
+	if pr, err := strconv.Atoi(strings.TrimPrefix(trigger["pr"], "#")); err == nil && pr > 0 {
+		rev.PullRequest = pr
+	}
+	return rev
+}
+
+// Merge fills the fields of r that are unset from other
+func (r Revision) Merge(other Revision) Revision {
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	fill(&r.Repo, other.Repo)
+	fill(&r.Branch, other.Branch)
+	fill(&r.Commit, other.Commit)
+	fill(&r.Author, other.Author)
+	fill(&r.Message, other.Message)
+	if r.PullRequest == 0 {
+		r.PullRequest = other.PullRequest
+	}
+	return r
+}
+
+// revisionTimeout bounds the git commands of DetectRevision
+const revisionTimeout = 5 * time.Second
+
+// DetectRevision reads the revision checked out in a git working tree. It
+// returns a zero Revision when dir is not a git checkout or git is missing.
+func DetectRevision(dir string) Revision {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		return Revision{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), revisionTimeout)
+	defer cancel()
+
+	git := func(args ...string) string {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	rev := Revision{
+		Repo:   git("config", "--get", "remote.origin.url"),
+		Commit: git("rev-parse", "HEAD"),
+	}
+	if rev.Commit == "" {
+		return Revision{}
+	}
+	if branch := git("rev-parse", "--abbrev-ref", "HEAD"); branch != "HEAD" {
+		rev.Branch = branch
+	}
+	if log := git("log", "-1", "--format=%an <%ae>%n%s"); log != "" {
+		lines := strings.SplitN(log, "\n", 2)
+		rev.Author = lines[0]
+		if len(lines) == 2 {
+			rev.Message = lines[1]
+		}
+	}
+	return rev
+}
+
+// jobRevision returns the revision of a new run: the given revision, then
+// the trigger values, then the checkout in the executor's working directory
+func (pe *PipelineEngine) jobRevision(rc runConfig) *Revision {
+	rev := Revision{}
+	if rc.revision != nil {
+		rev = *rc.revision
+	}
+	rev = rev.Merge(RevisionFromTrigger(rc.trigger))
+	if rev.Commit == "" {
+		if wd, ok := pe.executor.(workingDir); ok && wd.WorkingDir() != "" {
+			rev = rev.Merge(DetectRevision(wd.WorkingDir()))
+		}
+	}
+	if rev.IsZero() {
+		return nil
+	}
+	return &rev
+}
+
+// JobFilter selects jobs by the revision they ran against. Empty fields
+// match every job, and Commit matches a prefix of the commit SHA.
+type JobFilter struct {
+	Repo        string
+	Branch      string
+	Commit      string
+	Author      string
+	PullRequest int
+}
+
+// Match reports whether a job satisfies the filter
+func (f JobFilter) Match(job *Job) bool {
+	if f == (JobFilter{}) {
+		return true
+	}
+	rev := Revision{}
+	if job.Revision != nil {
+		rev = *job.Revision
+	}
+	switch {
+	case f.Repo != "" && rev.Repo != f.Repo:
+		return false
+	case f.Branch != "" && rev.Branch != f.Branch:
+		return false
+	case f.Commit != "" && !strings.HasPrefix(rev.Commit, f.Commit):
+		return false
+	case f.Author != "" && !strings.Contains(strings.ToLower(rev.Author), strings.ToLower(f.Author)):
+		return false
+	case f.PullRequest != 0 && rev.PullRequest != f.PullRequest:
+		return false
+	}
+	return true
+}
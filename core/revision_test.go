@@ -0,0 +1,104 @@
+package core
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+)
+
+func TestRevisionFromTrigger(t *testing.T) {
+	rev := RevisionFromTrigger(map[string]string{"branch": "main", "commit": "abc123", "pr": "#42"})
+	want := Revision{Branch: "main", Commit: "abc123", PullRequest: 42}
+	if rev != want {
+		t.Errorf("RevisionFromTrigger() = %+v, want %+v", rev, want)
+	}
+
+	merged := Revision{Commit: "def456"}.Merge(rev)
+	if merged.Commit != "def456" || merged.Branch != "main" || merged.PullRequest != 42 {
+		t.Errorf("Merge() = %+v, want commit def456 on main for #42", merged)
+	}
+}
+
+func TestRun_RevisionInEnvironmentAndReferences(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("vcs", `echo "$CONVEYOR_BRANCH $CONVEYOR_COMMIT $CONVEYOR_PULL_REQUEST"`, "echo ${{ revision.commit }}-${{ trigger.env }}")
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "vcs",
+		WithRevision(Revision{Commit: "abc123", Author: "Dev <dev@example.com>"}),
+		WithTrigger(map[string]string{"branch": "feature", "pr": "7", "env": "staging"}))
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess {
+		t.Fatalf("Status = %q, want success", job.Status)
+	}
+
+	want := Revision{Branch: "feature", Commit: "abc123", Author: "Dev <dev@example.com>", PullRequest: 7}
+	if job.Revision == nil || *job.Revision != want {
+		t.Errorf("Revision = %+v, want %+v", job.Revision, want)
+	}
+	if got := job.Steps[0].Output; got != "feature abc123 7\n" {
+		t.Errorf("Steps[0].Output = %q, want revision variables", got)
+	}
+	if got := job.Steps[1].Output; got != "abc123-staging\n" {
+		t.Errorf("Steps[1].Output = %q, want expanded references", got)
+	}
+
+	retried, err := engine.Retry(context.Background(), "vcs", job.ID)
+	if err != nil {
+		t.Fatalf("Retry() error = %v", err)
+	}
+	if retried.Revision == nil || *retried.Revision != want {
+		t.Errorf("retry Revision = %+v, want %+v", retried.Revision, want)
+	}
+	waitForJob(t, engine, "vcs", retried.ID, StatusSuccess)
+}
+
+func TestDetectRevision(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"-c", "user.name=Dev", "-c", "user.email=dev@example.com", "commit", "-q", "--allow-empty", "-m", "Initial commit"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Skipf("git %v: %v: %s", args, err, out)
+		}
+	}
+
+	rev := DetectRevision(dir)
+	if len(rev.Commit) != 40 || rev.Branch != "main" || rev.Author != "Dev <dev@example.com>" || rev.Message != "Initial commit" {
+		t.Errorf("DetectRevision() = %+v, want the initial commit on main", rev)
+	}
+	if rev := DetectRevision(t.TempDir()); !rev.IsZero() {
+		t.Errorf("DetectRevision() outside a checkout = %+v, want zero", rev)
+	}
+}
+
+func TestJobFilter_Match(t *testing.T) {
+	job := &Job{Revision: &Revision{Branch: "main", Commit: "abc123", Author: "Dev <dev@example.com>", PullRequest: 42}}
+	tests := []struct {
+		filter JobFilter
+		want   bool
+	}{
+		{JobFilter{}, true},
+		{JobFilter{Branch: "main", Commit: "abc"}, true},
+		{JobFilter{Author: "dev@example"}, true},
+		{JobFilter{PullRequest: 42}, true},
+		{JobFilter{Branch: "develop"}, false},
+		{JobFilter{Commit: "def"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Match(job); got != tt.want {
+			t.Errorf("%+v.Match() = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+	if (JobFilter{Branch: "main"}).Match(&Job{}) {
+		t.Error("Match() of a job without revision = true, want false")
+	}
+}
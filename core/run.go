@@ -0,0 +1,1229 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var jobCounter uint64
+
+// newJobID returns a job ID that is unique within the process
+func newJobID() string {
+	return fmt.Sprintf("job-%d-%d", time.Now().Unix(), atomic.AddUint64(&jobCounter, 1))
+}
+
+// Run executes a pipeline and blocks until the resulting job finishes or ctx
+// is cancelled. A failed pipeline is reported through the returned job's
+// Status; the error is only set when the job could not be started.
+func (pe *PipelineEngine) Run(ctx context.Context, pipelineID string, opts ...RunOption) (*Job, error) {
+	rc := newRunConfig(opts)
+	pipeline, job, jobCtx, err := pe.newJob(ctx, pipelineID, rc.metadata(nil), pe.jobRevision(rc))
+	if err != nil {
+		return nil, err
+	}
+
+	done := pe.enqueueJob(jobCtx, pipeline, job)
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// Take the job out of the queue if it is still waiting
+		pe.mu.Lock()
+		if cancel, ok := pe.cancels[job.ID]; ok {
+			cancel()
+		}
+		pe.mu.Unlock()
+		<-done
+	}
+
+	return pe.snapshotJob(job), nil
+}
+
+// Start executes a pipeline in the background and returns a snapshot of the
+// created job. Use GetJob or Subscribe to follow its progress.
+func (pe *PipelineEngine) Start(ctx context.Context, pipelineID string, opts ...RunOption) (*Job, error) {
+	rc := newRunConfig(opts)
+	pipeline, job, jobCtx, err := pe.newJob(ctx, pipelineID, rc.metadata(nil), pe.jobRevision(rc))
+	if err != nil {
+		return nil, err
+	}
+
+	pe.enqueueJob(jobCtx, pipeline, job)
+
+	return pe.snapshotJob(job), nil
+}
+
+// Retry starts a new job in the background for the pipeline of an existing job
+func (pe *PipelineEngine) Retry(ctx context.Context, pipelineID, jobID string, opts ...RunOption) (*Job, error) {
+	original, err := pe.GetJob(pipelineID, jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retries keep the trigger and revision of the original job unless
+	// given new ones
+	rc := newRunConfig(opts)
+	pe.mu.RLock()
+	if rc.trigger == nil {
+		rc.trigger = triggerValues(original.Metadata)
+	}
+	if rc.revision == nil {
+		rc.revision = original.Revision
+	}
+	pe.mu.RUnlock()
+
+	pipeline, job, jobCtx, err := pe.newJob(ctx, pipelineID, rc.metadata(map[string]interface{}{
+		"retryOf": jobID,
+	}), pe.jobRevision(rc))
+	if err != nil {
+		return nil, err
+	}
+
+	pe.enqueueJob(jobCtx, pipeline, job)
+
+	return pe.snapshotJob(job), nil
+}
+
+// newJob registers a running job for a pipeline and emits job.started. The
+// returned context is cancelled when the job is cancelled or interrupted.
+func (pe *PipelineEngine) newJob(ctx context.Context, pipelineID string, metadata map[string]interface{}, rev *Revision) (*Pipeline, *Job, context.Context, error) {
+	if pe.readOnly {
+		return nil, nil, nil, ErrReadOnly
+	}
+	pe.mu.Lock()
+	if pe.closing {
+		pe.mu.Unlock()
+		return nil, nil, nil, fmt.Errorf("engine is shutting down")
+	}
+
+	pipeline, exists := pe.pipelines[pipelineID]
+	if !exists {
+		pe.mu.Unlock()
+		return nil, nil, nil, fmt.Errorf("pipeline with ID %s not found", pipelineID)
+	}
+	if _, retry := metadata["retryOf"]; retry {
+		if err := pe.checkRetryBudget(pipeline, metadata); err != nil {
+			pe.mu.Unlock()
+			return nil, nil, nil, err
+		}
+	}
+
+	// Jobs of a concurrency group are pending until the group is free, and
+	// other jobs until they get a job slot
+	status := StatusRunning
+	jobID := newJobID()
+	if group := resolveGroup(pipeline, triggerValues(metadata), rev); group != "" {
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+		}
+		metadata["concurrencyGroup"] = group
+		status = StatusPending
+	} else if !pe.admitJob(jobID) {
+		status = StatusPending
+	}
+
+	now := time.Now()
+	job := &Job{
+		ID:              jobID,
+		PipelineID:      pipelineID,
+		Status:          status,
+		QueuedAt:        now,
+		StartedAt:       now,
+		Steps:           []StepStatus{},
+		Phases:          []Phase{{Name: PhaseQueued, StartedAt: now}},
+		Metadata:        metadata,
+		Revision:        rev,
+		PipelineVersion: pipeline.Version,
+	}
+	pe.jobs[job.ID] = job
+	pe.joinGroup(pipeline, job)
+	jobCtx := pe.trackJob(ctx, job)
+	pe.mu.Unlock()
+
+	if by, ok := metadata["budgetOverride"]; ok && pipeline.Budget != nil {
+		pe.logJob(job, "warn", "", fmt.Sprintf("Budget of pipeline %s overridden by %v", pipelineID, by))
+	}
+	pe.saveJob(job)
+
+	pe.emitEvent(Event{
+		Type:       "job.started",
+		Timestamp:  time.Now(),
+		PipelineID: pipelineID,
+		JobID:      job.ID,
+		Data:       metadata,
+	})
+
+	return pipeline, job, jobCtx, nil
+}
+
+// trackJob registers a job as running and returns its cancellable context.
+// Callers must hold pe.mu.
+func (pe *PipelineEngine) trackJob(ctx context.Context, job *Job) context.Context {
+	jobCtx, cancel := context.WithCancel(ctx)
+	// Callers of cancel hold pe.mu
+	pe.cancels[job.ID] = func() {
+		cancel()
+		pe.unqueueJob(job.ID)
+	}
+	pe.running.Add(1)
+	return jobCtx
+}
+
+// releaseJob drops the cancel function of a finished job
+func (pe *PipelineEngine) releaseJob(jobID string) {
+	pe.mu.Lock()
+	if cancel, ok := pe.cancels[jobID]; ok {
+		cancel()
+		delete(pe.cancels, jobID)
+	}
+	pe.mu.Unlock()
+
+	pe.running.Done()
+}
+
+// saveJob persists a snapshot of the job if the engine has a store
+func (pe *PipelineEngine) saveJob(job *Job) {
+	if pe.store == nil || pe.readOnly {
+		return
+	}
+
+	if err := pe.store.SaveJob(pe.snapshotJob(job)); err != nil {
+		pe.logger.Printf("Failed to persist job %s: %v", job.ID, err)
+	}
+}
+
+// JobSnapshot returns a copy of a job that is safe to read while the job
+// runs
+func (pe *PipelineEngine) JobSnapshot(jobID string) (*Job, error) {
+	job, err := pe.FindJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+	return pe.snapshotJob(job), nil
+}
+
+// snapshotJob returns a copy of a job that is safe to read while it runs
+func (pe *PipelineEngine) snapshotJob(job *Job) *Job {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	snapshot := *job
+	snapshot.Steps = append([]StepStatus(nil), job.Steps...)
+	for i := range snapshot.Steps {
+		snapshot.Steps[i].Phases = append([]Phase(nil), job.Steps[i].Phases...)
+	}
+	snapshot.Phases = append([]Phase(nil), job.Phases...)
+	snapshot.Logs = append([]LogEntry(nil), job.Logs...)
+	snapshot.Comments = append([]JobComment(nil), job.Comments...)
+	snapshot.Incidents = append([]string(nil), job.Incidents...)
+	snapshot.Migrations = append([]Migration(nil), job.Migrations...)
+	snapshot.LoadTests = append([]LoadTest(nil), job.LoadTests...)
+	if job.LegalHold != nil {
+		hold := *job.LegalHold
+		snapshot.LegalHold = &hold
+	}
+	if job.Revision != nil {
+		rev := *job.Revision
+		snapshot.Revision = &rev
+	}
+	if job.Workspace != nil {
+		workspace := *job.Workspace
+		snapshot.Workspace = &workspace
+	}
+	if job.Release != nil {
+		release := *job.Release
+		snapshot.Release = &release
+	}
+	if job.Metadata != nil {
+		snapshot.Metadata = make(map[string]interface{}, len(job.Metadata))
+		for key, value := range job.Metadata {
+			snapshot.Metadata[key] = value
+		}
+	}
+	return &snapshot
+}
+
+// runJob executes the stages of a pipeline in order, stopping at the first
+// failure of a stage that does not allow failure or when ctx is cancelled,
+// or as a dependency graph when stages declare what they need. Steps the
+// job already completed are skipped. Workers of the job queue run jobs
+// once they hold their concurrency group and a job slot.
+func (pe *PipelineEngine) runJob(ctx context.Context, pipeline *Pipeline, job *Job) {
+	pipeline = withMatrices(pipeline)
+	defer pe.releaseJob(job.ID)
+	defer pe.releaseGroup(job)
+
+	if ctx.Err() != nil {
+		pe.completeJob(pipeline, job, pe.stoppedStatus())
+		return
+	}
+
+	// Queued jobs are pending until a worker runs them
+	pe.mu.Lock()
+	if job.Status == StatusPending {
+		if err := pe.transitionJob(job, StatusRunning); err != nil {
+			pe.logger.Printf("Job %s: %v", job.ID, err)
+		}
+	}
+	advancePhase(&job.Phases, PhaseScheduling, time.Now())
+	pe.mu.Unlock()
+
+	if err := pe.checkRunners(pipeline); err != nil {
+		pe.logJob(job, "error", "", err.Error())
+		pe.completeJob(pipeline, job, StatusFailed)
+		return
+	}
+	if err := pe.acquireWorkspace(pipeline, job); err != nil {
+		pe.logJob(job, "error", "", err.Error())
+		pe.completeJob(pipeline, job, StatusFailed)
+		return
+	}
+	if err := pe.prepareRelease(pipeline, job); err != nil {
+		pe.logJob(job, "error", "", err.Error())
+		pe.completeJob(pipeline, job, StatusFailed)
+		return
+	}
+
+	completed := pe.completedSteps(job)
+	status := StatusSuccess
+
+	pe.mu.Lock()
+	advancePhase(&job.Phases, "", time.Now())
+	pe.mu.Unlock()
+
+	if usesStageGraph(pipeline.Stages) {
+		status = pe.runStageGraph(ctx, pipeline, job, completed)
+	} else {
+		stages := pipeline.Stages
+		for i := 0; i < len(stages); i++ {
+			if status != StatusSuccess {
+				// Once a stage failed, only steps that run on failure run
+				if status == StatusFailed && stageRunsAfterFailure(stages[i]) {
+					pe.runStage(ctx, pipeline, job, stages[i], completed, true)
+				}
+				continue
+			}
+			var outcome Status
+			if i+1 < len(stages) && canSpeculate(stages[i], stages[i+1], completed) && pe.FeatureEnabled(FeatureSpeculativeStages, pipeline.ID) {
+				outcome = pe.runSpeculative(ctx, pipeline, job, stages[i], stages[i+1], completed)
+				i++
+			} else {
+				outcome = stageOutcome(stages[i], pe.runStage(ctx, pipeline, job, stages[i], completed, false))
+			}
+			if outcome != StatusSkipped {
+				status = outcome
+			}
+		}
+	}
+
+	pe.completeJob(pipeline, job, status)
+}
+
+// runStage executes the steps of a stage in order and returns StatusSuccess,
+// StatusFailed once a step failed, StatusSkipped when the stage's condition
+// is false or the stopped status. failed is whether the job failed before
+// the stage; after a failure, only steps that run on failure run. Deploy
+// stages first wait for incidents freezing their environment to be
+// resolved.
+func (pe *PipelineEngine) runStage(ctx context.Context, pipeline *Pipeline, job *Job, stage Stage, completed map[string]bool, failed bool) Status {
+	run, reason, err := pe.stageCondition(pipeline, job, stage)
+	if err != nil {
+		pe.logJob(job, "error", "", err.Error())
+		return StatusFailed
+	}
+	if !run {
+		pe.skipStage(pipeline, job, stage, completed, reason)
+		return StatusSkipped
+	}
+	if !pe.holdDeploy(ctx, job, stage) {
+		return pe.stoppedStatus()
+	}
+	if len(stage.Services) > 0 {
+		running, stop, err := pe.startServices(ctx, job, "", stage.ID, stage.Services)
+		if err != nil {
+			pe.logJob(job, "error", "", fmt.Sprintf("Stage %s: %v", stage.ID, err))
+			if ctx.Err() != nil {
+				return pe.stoppedStatus()
+			}
+			return StatusFailed
+		}
+		defer stop()
+		ctx = withServices(ctx, running)
+	}
+
+	if stage.Parallel {
+		return pe.runParallelSteps(ctx, pipeline, job, stage, stage.Steps, stage.MaxParallel, completed, failed)
+	}
+	status := StatusSuccess
+	for i := 0; i < len(stage.Steps); i++ {
+		step := stage.Steps[i]
+		// The steps a matrix expanded into run together
+		if origin := step.matrix.origin(); origin != "" {
+			end := i + 1
+			for end < len(stage.Steps) && stage.Steps[end].matrix.origin() == origin {
+				end++
+			}
+			outcome := pe.runParallelSteps(ctx, pipeline, job, stage, stage.Steps[i:end], 0, completed, failed || status == StatusFailed)
+			if ctx.Err() != nil {
+				return pe.stoppedStatus()
+			}
+			if outcome == StatusFailed {
+				status = StatusFailed
+			}
+			i = end - 1
+			continue
+		}
+		if completed[step.ID] {
+			continue
+		}
+		step.RunsOn = stepLabels(stage, step)
+		step.When = stepCondition(stage, step)
+		if ctx.Err() != nil {
+			return pe.stoppedStatus()
+		}
+		failedSoFar := failed || status == StatusFailed
+		if failedSoFar && !runsAfterFailure(step.When) {
+			continue
+		}
+		if !pe.runStep(ctx, pipeline, job, step, failedSoFar) {
+			if ctx.Err() != nil {
+				return pe.stoppedStatus()
+			}
+			status = StatusFailed
+		}
+	}
+	return status
+}
+
+// runParallelSteps runs steps of a stage concurrently, at most limit at a
+// time when it is positive, and the steps of a matrix at most its
+// MaxParallel. Once a step fails, only steps that run on failure are
+// started, while running steps finish. It returns StatusSuccess,
+// StatusFailed or the stopped status.
+func (pe *PipelineEngine) runParallelSteps(ctx context.Context, pipeline *Pipeline, job *Job, stage Stage, steps []Step, limit int, completed map[string]bool, failed bool) Status {
+	if limit <= 0 || limit > len(steps) {
+		limit = len(steps)
+	}
+	slots := make(chan struct{}, limit)
+	matrices := make(map[string]chan struct{})
+	var wg sync.WaitGroup
+	var failures int32
+	for _, step := range steps {
+		if completed[step.ID] {
+			continue
+		}
+		step.RunsOn = stepLabels(stage, step)
+		step.When = stepCondition(stage, step)
+		var matrixSlots chan struct{}
+		if step.matrix != nil && step.matrix.maxParallel > 0 {
+			matrixSlots = matrices[step.matrix.of]
+			if matrixSlots == nil {
+				matrixSlots = make(chan struct{}, step.matrix.maxParallel)
+				matrices[step.matrix.of] = matrixSlots
+			}
+			select {
+			case matrixSlots <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() == nil {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		release := func() {
+			<-slots
+			if matrixSlots != nil {
+				<-matrixSlots
+			}
+		}
+		if (failed || atomic.LoadInt32(&failures) != 0) && !runsAfterFailure(step.When) {
+			release()
+			continue
+		}
+		wg.Add(1)
+		go func(step Step, failedSoFar bool) {
+			defer wg.Done()
+			if !pe.runStep(ctx, pipeline, job, step, failedSoFar) {
+				atomic.StoreInt32(&failures, 1)
+			}
+			release()
+		}(step, failed || atomic.LoadInt32(&failures) != 0)
+	}
+	wg.Wait()
+
+	switch {
+	case ctx.Err() != nil:
+		return pe.stoppedStatus()
+	case atomic.LoadInt32(&failures) != 0:
+		return StatusFailed
+	}
+	return StatusSuccess
+}
+
+// stageOutcome returns the status a stage contributes to its job, which is
+// success for failed stages that allow failure
+func stageOutcome(stage Stage, status Status) Status {
+	if status == StatusFailed && stage.AllowFailure {
+		return StatusSuccess
+	}
+	return status
+}
+
+// completedSteps returns the IDs of steps the job already finished
+// successfully, which is only non-empty for resumed jobs
+func (pe *PipelineEngine) completedSteps(job *Job) map[string]bool {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	completed := make(map[string]bool)
+	for _, step := range job.Steps {
+		if step.Status.Succeeded() && !step.RolledBack {
+			completed[step.ID] = true
+		}
+	}
+	return completed
+}
+
+// completeJob records the final status of a job and emits job.completed,
+// preceded by job.egress when steps of the job had a network policy
+func (pe *PipelineEngine) completeJob(pipeline *Pipeline, job *Job, status Status) {
+	pe.mu.Lock()
+	advancePhase(&job.Phases, PhaseFinalizing, time.Now())
+	// Jobs stopped for exceeding their budget fail, unless they finished
+	// before they stopped
+	budgetExceeded := job.BudgetExceeded
+	switch {
+	case budgetExceeded == "":
+	case status == StatusCancelled:
+		status = StatusFailed
+	case status == StatusSuccess:
+		job.BudgetExceeded, budgetExceeded = "", ""
+	}
+	pe.mu.Unlock()
+
+	if status == StatusSuccess {
+		pe.collectArtifacts(pipeline, job)
+	}
+	pe.releaseWorkspace(pipeline, job, status)
+	pe.cleanupRelease(job)
+	pe.retireAgents(job.ID)
+
+	pe.mu.Lock()
+	if err := pe.transitionJob(job, status); err != nil {
+		pe.logger.Printf("Job %s: %v", job.ID, err)
+	}
+	if status == StatusFailed {
+		job.FailureClass = jobFailureClass(job)
+		if budgetExceeded != "" {
+			job.FailureClass = FailureBudget
+		}
+	}
+	cancelledSteps := 0
+	if status == StatusCancelled || budgetExceeded != "" {
+		cancelledSteps = cancelRemainingSteps(pipeline, job, job.EndedAt)
+	}
+	failureClass := job.FailureClass
+	restricted, blocked := egressSummary(job)
+	advancePhase(&job.Phases, "", job.EndedAt)
+	pe.mu.Unlock()
+
+	pe.saveJob(job)
+
+	pe.logger.Printf("Job %s for pipeline %s finished with status %s", job.ID, pipeline.ID, status)
+
+	data := map[string]interface{}{
+		"status": status,
+	}
+	if retryOf, ok := job.Metadata["retryOf"]; ok {
+		data["retryOf"] = retryOf
+	}
+	if failureClass != "" {
+		data["failureClass"] = failureClass
+	}
+	if budgetExceeded != "" {
+		data["budgetExceeded"] = budgetExceeded
+	}
+
+	if restricted {
+		pe.emitEvent(Event{
+			Type:       "job.egress",
+			Timestamp:  time.Now(),
+			PipelineID: pipeline.ID,
+			JobID:      job.ID,
+			Data:       map[string]interface{}{"blocked": blocked},
+		})
+	}
+	if status == StatusCancelled {
+		cancelled := map[string]interface{}{"cancelledSteps": cancelledSteps}
+		if supersededBy, ok := job.Metadata["supersededBy"]; ok {
+			cancelled["supersededBy"] = supersededBy
+		}
+		pe.emitEvent(Event{
+			Type:       "job.cancelled",
+			Timestamp:  time.Now(),
+			PipelineID: pipeline.ID,
+			JobID:      job.ID,
+			Data:       cancelled,
+		})
+	}
+	pe.emitEvent(Event{
+		Type:       "job.completed",
+		Timestamp:  time.Now(),
+		PipelineID: pipeline.ID,
+		JobID:      job.ID,
+		Data:       data,
+	})
+	if status == StatusSuccess {
+		pe.triggerDownstream(pipeline, job)
+	}
+}
+
+// cancelRemainingSteps marks the steps of a cancelled job that were still
+// running or never started as cancelled at now, and returns how many there
+// were. Callers must hold pe.mu.
+func cancelRemainingSteps(pipeline *Pipeline, job *Job, now time.Time) int {
+	count := 0
+	recorded := make(map[string]bool, len(job.Steps))
+	for i := range job.Steps {
+		step := &job.Steps[i]
+		recorded[step.ID] = true
+		if !step.Status.IsTerminal() {
+			step.Status = StatusCancelled
+			step.EndedAt = now
+			count++
+		}
+	}
+	for _, stage := range pipeline.Stages {
+		for _, step := range stage.Steps {
+			if recorded[step.ID] {
+				continue
+			}
+			job.Steps = append(job.Steps, StepStatus{
+				ID:        step.ID,
+				Name:      step.Name,
+				Status:    StatusCancelled,
+				StartedAt: now,
+				MatrixOf:  step.matrix.origin(),
+				Matrix:    step.matrix.combination(),
+				EndedAt:   now,
+			})
+			count++
+		}
+	}
+	return count
+}
+
+// stoppedStatus returns the status for work stopped by a cancelled context
+func (pe *PipelineEngine) stoppedStatus() Status {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	if pe.interrupting {
+		return StatusInterrupted
+	}
+	return StatusCancelled
+}
+
+// transitionJob moves a job to the next status, recording the end time when
+// the status is terminal. Callers must hold pe.mu.
+func (pe *PipelineEngine) transitionJob(job *Job, next Status) error {
+	if err := job.Status.ValidateTransition(next); err != nil {
+		return err
+	}
+
+	job.Status = next
+	if next.IsTerminal() {
+		job.EndedAt = time.Now()
+	}
+	return nil
+}
+
+// runStep executes a single step, recording its status on the job
+func (pe *PipelineEngine) runStep(ctx context.Context, pipeline *Pipeline, job *Job, step Step, failed bool) bool {
+	dir := pe.jobDir(job)
+	pe.mu.Lock()
+	values := addStepOutputs(referenceValues(pipeline, job.ID, triggerValues(job.Metadata), job.Revision), job)
+	step, expandErr := expandStep(step, addMatrixValues(values, step), dir)
+	branch := jobBranch(job)
+	now := time.Now()
+	job.Steps = append(job.Steps, StepStatus{
+		ID:        step.ID,
+		Name:      step.Name,
+		Status:    StatusRunning,
+		StartedAt: now,
+		MatrixOf:  step.matrix.origin(),
+		Matrix:    step.matrix.combination(),
+		Phases:    []Phase{{Name: PhaseSetup, StartedAt: now}},
+	})
+	index := len(job.Steps) - 1
+	pe.mu.Unlock()
+
+	pe.saveJob(job)
+	pe.EmitStepStartedEvent(pipeline.ID, job.ID, step.ID)
+
+	if expandErr == nil {
+		if run, reason := evaluateWhen(step.When, branch, failed); !run {
+			pe.skipStep(pipeline, job, step, index, reason)
+			return true
+		}
+	}
+
+	memoKey := ""
+	if expandErr == nil && step.Memoize != nil {
+		key, err := pe.memoKey(pipeline, job, step, stepEnvironment(pipeline, job, step))
+		if err != nil {
+			pe.logger.Printf("Step %s: not memoized: %v", step.ID, err)
+		} else {
+			if !skipCache(job) {
+				if cached := pe.cachedResult(key); cached != nil {
+					pe.reuseResult(pipeline, job, step, index, cached)
+					return true
+				}
+			}
+			memoKey = key
+		}
+	}
+
+	err := expandErr
+	if err == nil {
+		err = pe.checkStepBudget(pipeline, job)
+	}
+	var secrets map[string]string
+	if err == nil {
+		secrets, err = pe.resolveSecrets(job, step)
+	}
+	releaseLocks := func() {}
+	if err == nil {
+		releaseLocks, err = pe.acquireLocks(ctx, pipeline, job, step)
+	}
+	attempt := &stepAttempt{serviceCtx: ctx, stopServices: func() {}, err: err}
+	status := StatusFailed
+	infraRetries, avoid := 0, ""
+	for n := 1; err == nil; {
+		attempt = pe.attemptStep(ctx, pipeline, job, step, index, secrets, avoid)
+		status, attempt.err = exitStatus(step, attempt.result, attempt.err)
+		if attempt.err == nil || ctx.Err() != nil {
+			break
+		}
+		class := classifyFailure(step, attempt)
+		// Infrastructure failures are re-dispatched, preferably to another
+		// runner, before the step's own retry policy is consulted
+		redispatch := class == FailureInfrastructure && infraRetries < pe.infraRetries
+		if class == FailureInfrastructure {
+			pe.recordInfraFailure(pipeline.ID, attempt.runner, redispatch)
+		}
+		var delay time.Duration
+		var message string
+		if redispatch {
+			infraRetries++
+			delay = pe.infraRetryDelay
+			message = describeRedispatch(infraRetries, pe.infraRetries, delay)
+			if attempt.runner != nil {
+				avoid = attempt.runner.Name
+			}
+		} else {
+			var retry bool
+			if delay, retry = retries(step, n, class); !retry {
+				break
+			}
+			message = fmt.Sprintf("; retrying in %s", delay)
+		}
+		attempt.stopServices()
+		attempt.stopServices = func() {}
+		if attempt.result != nil && attempt.result.fullOutput != "" {
+			os.Remove(attempt.result.fullOutput)
+			attempt.result.fullOutput = ""
+		}
+		pe.logJob(job, "warn", step.ID, maskSecrets(describeAttempt(step, n, class, attempt.err), secrets)+message)
+		pe.mu.Lock()
+		if redispatch {
+			job.Steps[index].InfraRetries = infraRetries
+		} else {
+			n++
+			job.Steps[index].Attempts = n
+		}
+		pe.mu.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if releaseLocks != nil {
+		releaseLocks()
+	}
+	class := ""
+	if attempt.err != nil {
+		class = classifyFailure(step, attempt)
+	}
+	if infraRetries > 0 {
+		pe.recordInfraOutcome(pipeline.ID, attempt.err, class)
+	}
+	err = attempt.err
+	result, runner, serviceCtx, stopServices := attempt.result, attempt.runner, attempt.serviceCtx, attempt.stopServices
+	mask := func(text string) string {
+		return pe.redact(pipeline.ID, step.ID, maskSecrets(text, secrets))
+	}
+	outputs, missing := stepOutputs(step, result)
+	for name, value := range outputs {
+		outputs[name] = mask(value)
+	}
+	if err == nil && len(missing) > 0 {
+		pe.logJob(job, "warn", step.ID, fmt.Sprintf("Step didn't set its outputs %s", strings.Join(missing, ", ")))
+	}
+	if result != nil {
+		pe.limitOutput(pipeline, job, step, index, result, secrets)
+		result.Output = mask(result.Output)
+		for i := range result.Annotations {
+			result.Annotations[i].Message = mask(result.Annotations[i].Message)
+		}
+		if result.TestReport != nil {
+			for i := range result.TestReport.Cases {
+				result.TestReport.Cases[i].Error = mask(result.TestReport.Cases[i].Error)
+			}
+		}
+	}
+
+	if err != nil {
+		status = StatusFailed
+		if ctx.Err() != nil {
+			status = pe.stoppedStatus()
+			class = ""
+		}
+	}
+
+	pe.mu.Lock()
+	stepStatus := &job.Steps[index]
+	stepStatus.Status = status
+	stepStatus.FailureClass = class
+	advancePhase(&stepStatus.Phases, PhaseTeardown, time.Now())
+	if result != nil {
+		stepStatus.ExitCode = result.ExitCode
+		stepStatus.Output = result.Output
+		stepStatus.Outputs = outputs
+		stepStatus.Annotations = result.Annotations
+		stepStatus.TestReport = result.TestReport
+		for _, migration := range result.Migrations {
+			migration.StepID = step.ID
+			job.Migrations = append(job.Migrations, migration)
+		}
+		for _, loadTest := range result.LoadTests {
+			loadTest.StepID = step.ID
+			job.LoadTests = append(job.LoadTests, loadTest)
+		}
+	}
+	if err != nil {
+		job.Logs = append(job.Logs, LogEntry{
+			Timestamp: time.Now(),
+			Level:     "error",
+			Message:   mask(err.Error()),
+			StepID:    step.ID,
+		})
+	}
+	pe.mu.Unlock()
+
+	if status == StatusFailed {
+		if ttl := debugTTL(pipeline, job); ttl > 0 {
+			env := stepEnvironment(pipeline, job, step)
+			for name, value := range serviceEnv(serviceCtx) {
+				env[name] = value
+			}
+			if pe.openDebugSession(pipeline, job, step, env, runner, ttl, stopServices) {
+				stopServices = func() {}
+			}
+		}
+	}
+	stopServices()
+
+	if err == nil && memoKey != "" {
+		pe.recordResult(&CachedResult{
+			Key:        memoKey,
+			PipelineID: pipeline.ID,
+			StepID:     step.ID,
+			JobID:      job.ID,
+			ExitCode:   result.ExitCode,
+			Output:     result.Output,
+			Outputs:    result.Outputs,
+			CreatedAt:  time.Now(),
+		})
+	}
+
+	pe.mu.Lock()
+	stepStatus = &job.Steps[index]
+	stepStatus.EndedAt = time.Now()
+	advancePhase(&stepStatus.Phases, "", stepStatus.EndedAt)
+	pe.mu.Unlock()
+
+	pe.checkDuration(pipeline, job, index)
+	pe.saveJob(job)
+	pe.EmitStepCompletedEvent(pipeline.ID, job.ID, step.ID, status)
+
+	return err == nil
+}
+
+// stepAttempt is one execution of a step with the runner and services it
+// ran with
+type stepAttempt struct {
+	result       *StepResult
+	runner       *runnerSlot
+	serviceCtx   context.Context
+	stopServices func()
+	// executed is set once the step's command or plugin ran, and timedOut
+	// when it ran out of time
+	executed bool
+	timedOut bool
+	// diskExceeded is set when the step was stopped for its disk usage
+	diskExceeded bool
+	err          error
+}
+
+// attemptStep acquires a runner, other than the runner named avoid if
+// possible, and starts services for a step, then executes it. The runner is
+// released when the step is done; stopping the services is left to the
+// caller.
+func (pe *PipelineEngine) attemptStep(ctx context.Context, pipeline *Pipeline, job *Job, step Step, index int, secrets map[string]string, avoid string) *stepAttempt {
+	attempt := &stepAttempt{serviceCtx: ctx, stopServices: func() {}}
+	if pe.usesRunner(step) {
+		attempt.runner, attempt.err = pe.acquireRunner(ctx, job, step, avoid)
+		if attempt.runner != nil {
+			pe.mu.Lock()
+			job.Steps[index].Runner = attempt.runner.Name
+			if request := step.Resources.request(); !request.IsZero() {
+				job.Steps[index].Resources = &request
+			}
+			pe.mu.Unlock()
+		}
+	}
+	if attempt.err == nil && len(step.Services) > 0 {
+		var running []*RunningService
+		var stop func()
+		running, stop, attempt.err = pe.startServices(ctx, job, step.ID, step.ID, step.Services)
+		attempt.serviceCtx = withServices(ctx, running)
+		if stop != nil {
+			attempt.stopServices = stop
+		}
+	}
+	if attempt.err == nil {
+		stepCtx, cancel, err := withStepTimeout(attempt.serviceCtx, step)
+		attempt.err = err
+		if err == nil {
+			pe.advanceStepPhase(job, index, PhaseExecution)
+			stepCtx = withOutputLimit(stepCtx, pe.stepOutputLimit(step))
+			// A step that would start below the disk reserve isn't run,
+			// and the watch reports why
+			watch, diskCtx, diskErr := pe.watchDisk(stepCtx, pipeline, job)
+			if diskErr == nil {
+				attempt.executed = true
+				attempt.result, attempt.err = pe.executeStep(diskCtx, pipeline, job, step, index, secrets, attempt.runner)
+			}
+			if watch != nil {
+				if err := watch.stop(); err != nil && ctx.Err() == nil {
+					attempt.err = err
+					attempt.diskExceeded = true
+				}
+				pe.recordDiskUsage(pipeline.ID, job, index, watch.usage)
+			}
+			if attempt.err != nil && !attempt.diskExceeded && ctx.Err() == nil && stepCtx.Err() == context.DeadlineExceeded {
+				attempt.err = fmt.Errorf("step timed out after %s", step.Timeout)
+				attempt.timedOut = true
+			}
+			cancel()
+		}
+	}
+	if attempt.runner != nil {
+		pe.releaseRunner(attempt.runner, step.Resources.request())
+	}
+	return attempt
+}
+
+// skipCache reports whether the job was started with WithoutCache
+func skipCache(job *Job) bool {
+	noCache, _ := job.Metadata["noCache"].(bool)
+	return noCache
+}
+
+// reuseResult completes a step with a memoized result instead of running it
+func (pe *PipelineEngine) reuseResult(pipeline *Pipeline, job *Job, step Step, index int, cached *CachedResult) {
+	pe.mu.Lock()
+	stepStatus := &job.Steps[index]
+	stepStatus.Status = StatusCached
+	advancePhase(&stepStatus.Phases, PhaseRestore, time.Now())
+	stepStatus.ExitCode = cached.ExitCode
+	// Patterns added since the result was cached apply too
+	stepStatus.Output = pe.redact(pipeline.ID, step.ID, cached.Output)
+	stepStatus.Outputs, _ = stepOutputs(step, &StepResult{Output: cached.Output, Outputs: cached.Outputs})
+	for name, value := range stepStatus.Outputs {
+		stepStatus.Outputs[name] = pe.redact(pipeline.ID, step.ID, value)
+	}
+	stepStatus.CachedFrom = cached.JobID
+	job.Logs = append(job.Logs, LogEntry{
+		Timestamp: time.Now(),
+		Level:     "info",
+		Message:   fmt.Sprintf("inputs unchanged, reused result from job %s", cached.JobID),
+		StepID:    step.ID,
+	})
+	stepStatus.EndedAt = time.Now()
+	advancePhase(&stepStatus.Phases, "", stepStatus.EndedAt)
+	pe.mu.Unlock()
+
+	pe.saveJob(job)
+	pe.EmitStepCompletedEvent(pipeline.ID, job.ID, step.ID, StatusCached)
+}
+
+// skipStep records a step whose when condition is false as skipped, and
+// why
+func (pe *PipelineEngine) skipStep(pipeline *Pipeline, job *Job, step Step, index int, reason string) {
+	pe.mu.Lock()
+	stepStatus := &job.Steps[index]
+	stepStatus.Status = StatusSkipped
+	job.Logs = append(job.Logs, LogEntry{
+		Timestamp: time.Now(),
+		Level:     "info",
+		Message:   pe.redact(pipeline.ID, step.ID, "step skipped: "+reason),
+		StepID:    step.ID,
+	})
+	stepStatus.EndedAt = time.Now()
+	advancePhase(&stepStatus.Phases, "", stepStatus.EndedAt)
+	pe.mu.Unlock()
+
+	pe.saveJob(job)
+	pe.EmitStepCompletedEvent(pipeline.ID, job.ID, step.ID, StatusSkipped)
+}
+
+// skipStage records the steps of a stage whose when condition is false as
+// skipped
+func (pe *PipelineEngine) skipStage(pipeline *Pipeline, job *Job, stage Stage, completed map[string]bool, reason string) {
+	pe.logJob(job, "info", "", fmt.Sprintf("Stage %s skipped: %s", stage.ID, reason))
+	for _, step := range stage.Steps {
+		if completed[step.ID] {
+			continue
+		}
+		pe.mu.Lock()
+		now := time.Now()
+		job.Steps = append(job.Steps, StepStatus{
+			ID:        step.ID,
+			Name:      step.Name,
+			Status:    StatusRunning,
+			StartedAt: now,
+			MatrixOf:  step.matrix.origin(),
+			Matrix:    step.matrix.combination(),
+			Phases:    []Phase{{Name: PhaseSetup, StartedAt: now}},
+		})
+		index := len(job.Steps) - 1
+		pe.mu.Unlock()
+		pe.EmitStepStartedEvent(pipeline.ID, job.ID, step.ID)
+		pe.skipStep(pipeline, job, step, index, "stage "+stage.ID+": "+reason)
+	}
+}
+
+// withStepTimeout derives a context bounded by the step's timeout, if any
+func withStepTimeout(ctx context.Context, step Step) (context.Context, context.CancelFunc, error) {
+	if step.Timeout == "" {
+		return ctx, func() {}, nil
+	}
+
+	timeout, err := time.ParseDuration(step.Timeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid timeout %q: %w", step.Timeout, err)
+	}
+
+	stepCtx, cancel := context.WithTimeout(ctx, timeout)
+	return stepCtx, cancel, nil
+}
+
+// executeStep dispatches a step to its plugin or to the executor of its
+// runner, adding secrets to the step's environment, and records what the
+// step is executed with
+func (pe *PipelineEngine) executeStep(ctx context.Context, pipeline *Pipeline, job *Job, step Step, index int, secrets map[string]string, runner *runnerSlot) (*StepResult, error) {
+	plugin := pe.pluginFor(step)
+	if plugin == nil && step.Plugin != "" {
+		return nil, fmt.Errorf("plugin %s is not registered", step.Plugin)
+	}
+
+	env := stepEnvironment(pipeline, job, step)
+	for name, value := range pe.defaultEnv {
+		if _, set := env[name]; !set {
+			env[name] = value
+		}
+	}
+	for name, value := range serviceEnv(ctx) {
+		env[name] = value
+	}
+	for name, value := range secrets {
+		env[name] = value
+	}
+	if plugin != nil {
+		// Steps are recorded with the job's directory, which replays
+		// resolve the working directory in
+		pe.recordStep(ctx, job, index, step, env, secrets, pe.jobDir(job))
+		dir, err := stepDir(pe.jobDir(job), step)
+		if err != nil {
+			return nil, err
+		}
+		return executePlugin(pe.withStepReporter(ctx, pipeline, job, step, secrets), plugin, pipeline, job, step, dir, env)
+	}
+
+	executor := pe.executor
+	if runner != nil {
+		env["CONVEYOR_RUNNER"] = runner.Name
+		executor = runner.Executor
+	}
+	if _, remote := executor.(*agentExecutor); step.Image != "" && pe.containers != nil && !remote {
+		executor = pe.containers
+	}
+	if limits := step.Resources; limits != nil {
+		if limits.Limits.CPU > 0 {
+			env["CONVEYOR_CPU_LIMIT"] = FormatCPU(limits.Limits.CPU)
+		}
+		if limits.Limits.Memory > 0 {
+			env["CONVEYOR_MEMORY_LIMIT"] = strconv.FormatInt(limits.Limits.Memory, 10)
+		}
+	}
+
+	allow, restricted := stepEgress(pipeline, step)
+
+	pe.mu.RLock()
+	lease, ok := pe.leases[job.ID]
+	pe.mu.RUnlock()
+	dirExecutor, supported := executor.(DirExecutor)
+	dir := ""
+	if ok && supported {
+		dir = lease.dir
+		env["CONVEYOR_WORKSPACE"] = dir
+	} else if wd, isWorkingDir := executor.(workingDir); isWorkingDir {
+		dir = wd.WorkingDir()
+	}
+	pe.recordStep(ctx, job, index, step, env, secrets, dir)
+	if step.WorkingDir != "" {
+		if !supported {
+			return nil, fmt.Errorf("step %s sets a working directory, which its executor can't run in", step.ID)
+		}
+		var err error
+		if dir, err = stepDir(dir, step); err != nil {
+			return nil, err
+		}
+	}
+
+	// The proxy's address changes with every run, so it isn't recorded
+	if restricted {
+		isolator, _ := executor.(EgressIsolator)
+		var stop func() []BlockedConnection
+		var err error
+		if ctx, stop, err = restrictEgress(ctx, isolator, step, allow, env); err != nil {
+			return nil, err
+		}
+		defer func() {
+			pe.recordEgress(job, index, step, allow, stop())
+		}()
+	}
+	live := pe.newLiveOutput(pipeline, job, step, index, secrets)
+	defer live.close()
+	ctx = withOutputSink(ctx, live)
+	if (ok || step.WorkingDir != "") && supported {
+		return dirExecutor.ExecuteIn(ctx, dir, step, env)
+	}
+	return executor.Execute(ctx, step, env)
+}
+
+// pluginFor finds the plugin for a step by name, falling back to step type.
+// A name pinned to a version, as in "security@1.0.0", only matches a plugin
+// of that version.
+func (pe *PipelineEngine) pluginFor(step Step) Plugin {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	if step.Plugin != "" {
+		name, version := step.Plugin, ""
+		if i := strings.LastIndex(name, "@"); i >= 0 {
+			name, version = name[:i], name[i+1:]
+		}
+		plugin := pe.plugins[name]
+		if plugin != nil && version != "" && version != "latest" && plugin.GetManifest().Version != version {
+			return nil
+		}
+		return plugin
+	}
+
+	for _, plugin := range pe.plugins {
+		for _, stepType := range plugin.GetManifest().StepTypes {
+			if stepType == step.Type {
+				return plugin
+			}
+		}
+	}
+
+	return nil
+}
+
+// executePlugin runs a plugin step with the job context added to its config:
+// the pipeline and job IDs, the working directory as workDir and the step's
+// environment, including its secrets, as env
+func executePlugin(ctx context.Context, plugin Plugin, pipeline *Pipeline, job *Job, step Step, dir string, env map[string]string) (*StepResult, error) {
+	config := make(map[string]interface{}, len(step.Config)+4)
+	for key, value := range step.Config {
+		config[key] = value
+	}
+	config["pipelineId"] = pipeline.ID
+	config["jobId"] = job.ID
+	config["workDir"] = dir
+	config["env"] = env
+	step.Config = config
+
+	outputs, err := plugin.Execute(ctx, step)
+	result := &StepResult{
+		Outputs:     outputs,
+		Annotations: pluginAnnotations(outputs),
+		TestReport:  pluginTestReport(outputs),
+		Migrations:  pluginMigrations(outputs),
+		LoadTests:   pluginLoadTests(outputs),
+	}
+	if outputs != nil {
+		if encoded, encodeErr := json.Marshal(outputs); encodeErr == nil {
+			result.Output = string(encoded)
+		}
+	}
+	if err != nil {
+		result.ExitCode = 1
+		return result, fmt.Errorf("plugin %s failed: %w", plugin.GetManifest().Name, err)
+	}
+
+	return result, nil
+}
+
+// stepEnvironment merges pipeline and step environment with job variables
+// and the job's revision
+func stepEnvironment(pipeline *Pipeline, job *Job, step Step) map[string]string {
+	env := make(map[string]string, len(pipeline.Environment)+len(step.Environment)+3)
+	for key, value := range pipeline.Environment {
+		env[key] = value
+	}
+	if job.Revision != nil {
+		for key, value := range job.Revision.environment() {
+			env[key] = value
+		}
+	}
+	if job.Release != nil {
+		env["CONVEYOR_RELEASE"] = job.Release.Name
+		env["CONVEYOR_RELEASE_DIR"] = job.Release.Dir
+	}
+	for key, value := range step.Environment {
+		env[key] = value
+	}
+	env["CONVEYOR_PIPELINE_ID"] = pipeline.ID
+	env["CONVEYOR_JOB_ID"] = job.ID
+	env["CONVEYOR_STEP_ID"] = step.ID
+	return env
+}
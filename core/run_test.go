@@ -0,0 +1,378 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakePlugin struct {
+	name     string
+	version  string
+	protocol int
+	types    []string
+	outputs  map[string]interface{}
+	err      error
+	steps    []Step
+	// run is called with the context of each step
+	run func(ctx context.Context)
+}
+
+func (p *fakePlugin) Execute(ctx context.Context, step Step) (map[string]interface{}, error) {
+	p.steps = append(p.steps, step)
+	if p.run != nil {
+		p.run(ctx)
+	}
+	return p.outputs, p.err
+}
+
+func (p *fakePlugin) GetManifest() PluginManifest {
+	return PluginManifest{Name: p.name, Version: p.version, StepTypes: p.types, Protocol: p.protocol}
+}
+
+func newTestEngine(opts ...Option) *PipelineEngine {
+	opts = append([]Option{WithLogger(log.New(io.Discard, "", 0))}, opts...)
+	return NewPipelineEngine(opts...)
+}
+
+func scriptPipeline(id string, commands ...string) *Pipeline {
+	stage := Stage{ID: "build", Name: "build"}
+	for i, command := range commands {
+		stage.Steps = append(stage.Steps, Step{
+			ID:      "build-step-" + string(rune('a'+i)),
+			Name:    "step",
+			Type:    "script",
+			Command: command,
+		})
+	}
+	return &Pipeline{ID: id, Name: id, Stages: []Stage{stage}}
+}
+
+func TestRun_Success(t *testing.T) {
+	engine := newTestEngine()
+	if err := engine.CreatePipeline(scriptPipeline("ok", "echo hello", "echo $CONVEYOR_PIPELINE_ID")); err != nil {
+		t.Fatalf("CreatePipeline() error = %v", err)
+	}
+
+	job, err := engine.Run(context.Background(), "ok")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != "success" {
+		t.Errorf("Status = %q, want %q", job.Status, "success")
+	}
+	if len(job.Steps) != 2 {
+		t.Fatalf("len(Steps) = %d, want 2", len(job.Steps))
+	}
+	if job.Steps[0].Output != "hello\n" {
+		t.Errorf("Steps[0].Output = %q, want %q", job.Steps[0].Output, "hello\n")
+	}
+	if job.Steps[1].Output != "ok\n" {
+		t.Errorf("Steps[1].Output = %q, want %q", job.Steps[1].Output, "ok\n")
+	}
+	if job.EndedAt.IsZero() {
+		t.Error("EndedAt is zero, want completion time")
+	}
+}
+
+func TestRun_FailureStopsPipeline(t *testing.T) {
+	engine := newTestEngine()
+	engine.CreatePipeline(scriptPipeline("fail", "exit 3", "echo unreachable"))
+
+	job, err := engine.Run(context.Background(), "fail")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != "failed" {
+		t.Errorf("Status = %q, want %q", job.Status, "failed")
+	}
+	if len(job.Steps) != 1 {
+		t.Fatalf("len(Steps) = %d, want 1", len(job.Steps))
+	}
+	if job.Steps[0].ExitCode != 3 {
+		t.Errorf("ExitCode = %d, want 3", job.Steps[0].ExitCode)
+	}
+	if len(job.Logs) == 0 {
+		t.Error("Logs is empty, want failure entry")
+	}
+}
+
+func TestRun_UnknownPipeline(t *testing.T) {
+	engine := newTestEngine()
+	if _, err := engine.Run(context.Background(), "missing"); err == nil {
+		t.Fatal("Run() expected error for unknown pipeline, got nil")
+	}
+}
+
+func TestRun_CancelledContext(t *testing.T) {
+	engine := newTestEngine()
+	engine.CreatePipeline(scriptPipeline("cancel", "echo one"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	job, err := engine.Run(ctx, "cancel")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != "cancelled" {
+		t.Errorf("Status = %q, want %q", job.Status, "cancelled")
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	pipeline := scriptPipeline("cancel", "sleep 5; touch first", "touch second")
+	pipeline.Stages = append(pipeline.Stages, Stage{ID: "deploy", Steps: []Step{{ID: "deploy", Type: "script", Command: "touch deploy"}}})
+	engine.CreatePipeline(pipeline)
+	sub := engine.Subscribe(32)
+	defer sub.Close()
+
+	start := time.Now()
+	job, err := engine.Start(context.Background(), "cancel")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	for event := range sub.Events() {
+		if event.Type == "step.started" {
+			break
+		}
+	}
+	if err := engine.CancelJob("other", job.ID); err == nil {
+		t.Error("CancelJob() of another pipeline's job succeeded")
+	}
+	if err := engine.CancelJob("cancel", job.ID); err != nil {
+		t.Fatalf("CancelJob() error = %v", err)
+	}
+
+	var cancelled *Event
+	for event := range sub.Events() {
+		if event.Type == "job.cancelled" {
+			e := event
+			cancelled = &e
+		}
+		if event.Type == "job.completed" {
+			break
+		}
+	}
+	if cancelled == nil || cancelled.Data["cancelledSteps"] != 2 {
+		t.Errorf("job.cancelled = %+v, want it with the 2 steps that didn't run", cancelled)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("the job took %s to stop, want the running step killed", elapsed)
+	}
+	job, _ = engine.GetJob("cancel", job.ID)
+	job = engine.snapshotJob(job)
+	if job.Status != StatusCancelled || len(job.Steps) != 3 {
+		t.Fatalf("job = %s with %d steps, want cancelled with 3", job.Status, len(job.Steps))
+	}
+	for _, step := range job.Steps {
+		if step.Status != StatusCancelled {
+			t.Errorf("step %s = %s, want cancelled", step.ID, step.Status)
+		}
+	}
+	for _, name := range []string{"first", "second", "deploy"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s ran after the job was cancelled", name)
+		}
+	}
+	if err := engine.CancelJob("cancel", job.ID); err == nil {
+		t.Error("CancelJob() of a finished job succeeded")
+	}
+}
+
+func TestRun_PluginStep(t *testing.T) {
+	plugin := &fakePlugin{name: "scanner", types: []string{"secret-scan"}, outputs: map[string]interface{}{"findings": 0}}
+	dir := t.TempDir()
+	engine := newTestEngine(WithPlugins(plugin), WithExecutor(&ShellExecutor{Dir: dir}))
+	engine.CreatePipeline(&Pipeline{
+		ID: "scan",
+		Stages: []Stage{{
+			ID: "scan",
+			Steps: []Step{
+				{ID: "by-name", Type: "plugin", Plugin: "scanner", Environment: map[string]string{"TARGET": "src"}},
+				{ID: "by-type", Type: "secret-scan"},
+			},
+		}},
+	})
+
+	job, err := engine.Run(context.Background(), "scan")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != "success" {
+		t.Fatalf("Status = %q, want %q", job.Status, "success")
+	}
+	if len(plugin.steps) != 2 {
+		t.Fatalf("plugin executed %d steps, want 2", len(plugin.steps))
+	}
+	if plugin.steps[0].Config["jobId"] != job.ID {
+		t.Errorf("Config[jobId] = %v, want %q", plugin.steps[0].Config["jobId"], job.ID)
+	}
+	if plugin.steps[0].Config["workDir"] != dir {
+		t.Errorf("Config[workDir] = %v, want the executor's directory %q", plugin.steps[0].Config["workDir"], dir)
+	}
+	if env, _ := plugin.steps[0].Config["env"].(map[string]string); env["TARGET"] != "src" {
+		t.Errorf("Config[env] = %v, want the step's environment", plugin.steps[0].Config["env"])
+	}
+	if job.Steps[0].Output != `{"findings":0}` {
+		t.Errorf("Output = %q, want plugin outputs as JSON", job.Steps[0].Output)
+	}
+}
+
+func TestRun_PluginError(t *testing.T) {
+	plugin := &fakePlugin{name: "scanner", err: errors.New("boom")}
+	engine := newTestEngine(WithPlugins(plugin))
+	engine.CreatePipeline(&Pipeline{
+		ID:     "scan",
+		Stages: []Stage{{ID: "scan", Steps: []Step{{ID: "s", Plugin: "scanner"}}}},
+	})
+
+	job, _ := engine.Run(context.Background(), "scan")
+	if job.Status != "failed" {
+		t.Errorf("Status = %q, want %q", job.Status, "failed")
+	}
+}
+
+func TestRun_UnregisteredPlugin(t *testing.T) {
+	engine := newTestEngine()
+	engine.CreatePipeline(&Pipeline{
+		ID:     "scan",
+		Stages: []Stage{{ID: "scan", Steps: []Step{{ID: "s", Plugin: "missing"}}}},
+	})
+
+	job, _ := engine.Run(context.Background(), "scan")
+	if job.Status != "failed" {
+		t.Errorf("Status = %q, want %q", job.Status, "failed")
+	}
+}
+
+func TestRun_DefaultEnvironment(t *testing.T) {
+	engine := newTestEngine(WithDefaultEnvironment(map[string]string{"GOPROXY": "http://cache/go", "GOFLAGS": "-mod=mod"}))
+	pipeline := scriptPipeline("env", "echo $GOPROXY $GOFLAGS")
+	pipeline.Environment = map[string]string{"GOFLAGS": "-mod=vendor"}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "env")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got := job.Steps[0].Output; got != "http://cache/go -mod=vendor\n" {
+		t.Errorf("Output = %q, want the default GOPROXY and the pipeline's GOFLAGS", got)
+	}
+}
+
+func TestPluginFor_PinnedVersion(t *testing.T) {
+	engine := newTestEngine(WithPlugins(&fakePlugin{name: "scanner", version: "1.2.0"}))
+
+	tests := map[string]bool{
+		"scanner":        true,
+		"scanner@1.2.0":  true,
+		"scanner@latest": true,
+		"scanner@2.0.0":  false,
+		"missing@1.2.0":  false,
+	}
+	for name, found := range tests {
+		if got := engine.pluginFor(Step{Plugin: name}) != nil; got != found {
+			t.Errorf("pluginFor(%q) found = %v, want %v", name, got, found)
+		}
+	}
+}
+
+func TestSubscribe_ReceivesJobEvents(t *testing.T) {
+	engine := newTestEngine()
+	engine.CreatePipeline(scriptPipeline("events", "true"))
+
+	sub := engine.Subscribe(16)
+	defer sub.Close()
+
+	job, err := engine.Start(context.Background(), "events")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	want := []string{"job.started", "step.started", "step.completed", "job.completed"}
+	for _, eventType := range want {
+		select {
+		case event := <-sub.Events():
+			if event.Type != eventType {
+				t.Fatalf("event.Type = %q, want %q", event.Type, eventType)
+			}
+			if event.JobID != job.ID {
+				t.Errorf("event.JobID = %q, want %q", event.JobID, job.ID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", eventType)
+		}
+	}
+}
+
+func TestSubscription_CloseClosesChannel(t *testing.T) {
+	engine := newTestEngine()
+	sub := engine.Subscribe(1)
+	sub.Close()
+	sub.Close()
+
+	if _, ok := <-sub.Events(); ok {
+		t.Error("Events() channel still open after Close()")
+	}
+}
+
+// parallelPipeline runs commands as the steps of a parallel stage
+func parallelPipeline(maxParallel int, commands ...string) *Pipeline {
+	pipeline := scriptPipeline("parallel", commands...)
+	pipeline.Stages[0].Parallel = true
+	pipeline.Stages[0].MaxParallel = maxParallel
+	return pipeline
+}
+
+func TestRun_ParallelStage(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxParallel int
+		min, max    time.Duration
+	}{
+		{"unlimited", 0, 300 * time.Millisecond, 550 * time.Millisecond},
+		{"limited", 2, 600 * time.Millisecond, 850 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: t.TempDir()}))
+		engine.CreatePipeline(parallelPipeline(tt.maxParallel, "sleep 0.3", "sleep 0.3", "sleep 0.3"))
+
+		start := time.Now()
+		job, err := engine.Run(context.Background(), "parallel")
+		if err != nil {
+			t.Fatalf("%s: Run() error = %v", tt.name, err)
+		}
+		elapsed := time.Since(start)
+		if job.Status != StatusSuccess || len(job.Steps) != 3 {
+			t.Errorf("%s: job = %s with %d steps, want all 3 steps to succeed", tt.name, job.Status, len(job.Steps))
+		}
+		if elapsed < tt.min || elapsed > tt.max {
+			t.Errorf("%s: job took %s, want between %s and %s", tt.name, elapsed, tt.min, tt.max)
+		}
+	}
+}
+
+func TestRun_ParallelStageStopsStartingAfterFailure(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	engine.CreatePipeline(parallelPipeline(1, "exit 1", "touch second"))
+
+	job, err := engine.Run(context.Background(), "parallel")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusFailed || len(job.Steps) != 1 {
+		t.Errorf("job = %s with %d steps, want failed after the first step", job.Status, len(job.Steps))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "second")); err == nil {
+		t.Error("the second step ran after the first failed")
+	}
+}
@@ -0,0 +1,404 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Runner is an executor that steps are scheduled on by label. Steps with a
+// runsOn selector run on a runner that has all of its labels.
+type Runner struct {
+	Name   string   `json:"name"`
+	Labels []string `json:"labels"`
+	// Capacity is the number of steps the runner runs at once. Zero means
+	// unlimited.
+	Capacity int `json:"capacity"`
+	// Resources is the CPU and memory steps can reserve on the runner. Zero
+	// fields are not accounted.
+	Resources Resources `json:"resources,omitempty"`
+	// Executor runs the steps. Defaults to the engine's executor.
+	Executor StepExecutor `json:"-"`
+}
+
+// RunnerStatus reports a runner and the steps it is running
+type RunnerStatus struct {
+	Runner
+	Busy int `json:"busy"`
+	// Allocated is the CPU and memory reserved by running steps
+	Allocated Resources `json:"allocated,omitempty"`
+	// Agent is the ID of the ephemeral agent of the runner, which only runs
+	// steps of Project and, once it started one, of JobID
+	Agent   string `json:"agent,omitempty"`
+	Project string `json:"project,omitempty"`
+	JobID   string `json:"jobId,omitempty"`
+}
+
+// LabelCapacity reports how many steps runners with a label can take
+type LabelCapacity struct {
+	Label     string `json:"label"`
+	Runners   int    `json:"runners"`
+	Capacity  int    `json:"capacity"`
+	Busy      int    `json:"busy"`
+	Available int    `json:"available"`
+	// Unlimited is set when a runner with the label has no capacity limit
+	Unlimited bool `json:"unlimited,omitempty"`
+	// Resources and ResourcesAvailable total the accounted CPU and memory
+	// of the runners
+	Resources          Resources `json:"resources,omitempty"`
+	ResourcesAvailable Resources `json:"resourcesAvailable,omitempty"`
+}
+
+// runnerSlot tracks the steps running on a runner
+type runnerSlot struct {
+	Runner
+	busy      int
+	allocated Resources
+	// idleSince is when the runner last finished its last running step
+	idleSince time.Time
+	// agent is set on the runners of ephemeral agents, which only run the
+	// steps of project and, once they started one, of job
+	agent   *agent
+	project string
+	job     string
+}
+
+// DefaultRunnerLabels returns the labels of the local runner used when no
+// runners are configured
+func DefaultRunnerLabels() []string {
+	return []string{"local", runtime.GOOS, runtime.GOARCH}
+}
+
+// WithRunners sets the runners steps are scheduled on. Without runners,
+// every step runs on the engine's executor as the "local" runner.
+func WithRunners(runners ...Runner) Option {
+	return func(pe *PipelineEngine) {
+		for _, runner := range runners {
+			if runner.Name == "" {
+				runner.Name = fmt.Sprintf("runner-%d", len(pe.runners)+1)
+			}
+			runner.Labels = append([]string(nil), runner.Labels...)
+			pe.runners = append(pe.runners, &runnerSlot{Runner: runner})
+		}
+	}
+}
+
+// setupRunners adds the local runner when none are configured and defaults
+// runner executors to the engine's executor
+func (pe *PipelineEngine) setupRunners() {
+	if len(pe.runners) == 0 {
+		pe.runners = []*runnerSlot{{Runner: Runner{Name: "local", Labels: DefaultRunnerLabels()}}}
+	}
+	for _, runner := range pe.runners {
+		if runner.Executor == nil {
+			runner.Executor = pe.executor
+		}
+		runner.idleSince = time.Now()
+	}
+	pe.runnerFreed = make(chan struct{})
+}
+
+// serves reports whether the runner can run steps of a project's job.
+// Agents in maintenance run none.
+func (r *runnerSlot) serves(project, jobID string) bool {
+	if r.agent != nil && r.agent.Maintenance {
+		return false
+	}
+	return (r.project == "" || r.project == project) && (r.job == "" || r.job == jobID)
+}
+
+// matches reports whether the runner has every label
+func (r *runnerSlot) matches(labels []string) bool {
+	for _, label := range labels {
+		found := false
+		for _, own := range r.Labels {
+			if strings.EqualFold(own, label) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// hasCapacity reports whether the runner can take another step with the
+// requested resources
+func (r *runnerSlot) hasCapacity(request Resources) bool {
+	if r.Capacity > 0 && r.busy >= r.Capacity {
+		return false
+	}
+	return r.Resources.Fits(r.allocated.Add(request))
+}
+
+// fitScore is the share of the runner's resources left free after placing
+// request. Steps go to the runner with the lowest score, so busy runners
+// fill up before idle ones are used.
+func (r *runnerSlot) fitScore(request Resources) float64 {
+	score := 0.0
+	if r.Resources.CPU > 0 {
+		score += (r.Resources.CPU - r.allocated.CPU - request.CPU) / r.Resources.CPU
+	} else {
+		score++
+	}
+	if r.Resources.Memory > 0 {
+		score += float64(r.Resources.Memory-r.allocated.Memory-request.Memory) / float64(r.Resources.Memory)
+	} else {
+		score++
+	}
+	return score
+}
+
+// noRunnerError describes a runsOn selector no runner matches. Callers must
+// hold pe.mu.
+func (pe *PipelineEngine) noRunnerError(stepID string, labels []string) error {
+	runners := make([]string, 0, len(pe.runners))
+	for _, runner := range pe.runners {
+		runners = append(runners, fmt.Sprintf("%s [%s]", runner.Name, strings.Join(runner.Labels, ", ")))
+	}
+	return fmt.Errorf("no runner matches runs_on [%s] of step %s; runners: %s",
+		strings.Join(labels, ", "), stepID, strings.Join(runners, "; "))
+}
+
+// resourceError describes a step whose resource requests exceed the
+// capacity of every runner matching its labels. Callers must hold pe.mu.
+func (pe *PipelineEngine) resourceError(stepID string, labels []string, request Resources) error {
+	var runners []string
+	for _, runner := range pe.runners {
+		if runner.matches(labels) {
+			runners = append(runners, fmt.Sprintf("%s (%s)", runner.Name, runner.Resources))
+		}
+	}
+	selector := "any runner"
+	if len(labels) > 0 {
+		selector = fmt.Sprintf("any runner matching runs_on [%s]", strings.Join(labels, ", "))
+	}
+	return fmt.Errorf("step %s requests %s, more than %s has: %s; lower the step's resources or add a runner with more capacity",
+		stepID, request, selector, strings.Join(runners, "; "))
+}
+
+// placeable reports an error when no runner could ever run a step of a
+// project: none matches its labels, or none has the resources it requests.
+// An agent token for the project with the labels counts as a runner to
+// come. Callers must hold pe.mu.
+func (pe *PipelineEngine) placeable(stepID, project string, labels []string, request Resources) error {
+	matched := false
+	for _, runner := range pe.runners {
+		if !runner.matches(labels) || runner.project != "" && runner.project != project {
+			continue
+		}
+		matched = true
+		if runner.Resources.Fits(request) {
+			return nil
+		}
+	}
+	if pe.agentTokenFor(project, labels) {
+		return nil
+	}
+	if !matched {
+		return pe.noRunnerError(stepID, labels)
+	}
+	return pe.resourceError(stepID, labels, request)
+}
+
+// checkRunners reports the first step of a pipeline that no runner can run
+func (pe *PipelineEngine) checkRunners(pipeline *Pipeline) error {
+	type placement struct {
+		id      string
+		labels  []string
+		request Resources
+	}
+	var placements []placement
+	project := pipelineProject(pipeline)
+	for _, stage := range pipeline.Stages {
+		steps := append(append([]Step(nil), stage.Steps...), stage.Rollback...)
+		for _, step := range steps {
+			labels := stepLabels(stage, step)
+			request := step.Resources.request()
+			if len(labels) == 0 && request.IsZero() || !pe.usesRunner(step) {
+				continue
+			}
+			placements = append(placements, placement{step.ID, labels, request})
+		}
+	}
+
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	for _, p := range placements {
+		if err := pe.placeable(p.id, project, p.labels, p.request); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stepLabels returns the runsOn selector of a step, which defaults to its
+// stage's
+func stepLabels(stage Stage, step Step) []string {
+	if len(step.RunsOn) > 0 {
+		return step.RunsOn
+	}
+	return stage.RunsOn
+}
+
+// usesRunner reports whether a step runs on a runner rather than a plugin
+func (pe *PipelineEngine) usesRunner(step Step) bool {
+	return step.Plugin == "" && pe.pluginFor(step) == nil
+}
+
+// acquireRunner waits until a runner matching the step's labels has
+// capacity for the resources it requests and it is the step's turn under
+// the queue policy, and reserves them on the runner pickRunner picks. It
+// fails right away when no runner could ever run the step.
+func (pe *PipelineEngine) acquireRunner(ctx context.Context, job *Job, step Step, avoid string) (*runnerSlot, error) {
+	request := step.Resources.request()
+	logged := false
+	pe.mu.Lock()
+	w := &queueWaiter{jobID: job.ID, stepID: step.ID, project: pe.jobProject(job), labels: step.RunsOn, request: request, avoid: avoid, since: time.Now()}
+	pe.enqueue(w)
+	for {
+		if err := pe.placeable(step.ID, w.project, step.RunsOn, request); err != nil {
+			pe.dequeue(w, false)
+			pe.mu.Unlock()
+			return nil, err
+		}
+		if runner := pe.turn(w); runner != nil {
+			if runner.agent != nil {
+				runner.job = job.ID
+				runner.agent.State, runner.agent.JobID = AgentRunning, job.ID
+			}
+			runner.busy++
+			runner.allocated = runner.allocated.Add(request)
+			pe.dequeue(w, true)
+			if len(pe.queue) > 0 {
+				pe.wakeWaiters()
+			}
+			pe.mu.Unlock()
+			return runner, nil
+		}
+
+		freed := pe.runnerFreed
+		pe.mu.Unlock()
+
+		if !logged {
+			msg := "Waiting for a runner with free capacity"
+			if !request.IsZero() {
+				msg = fmt.Sprintf("Waiting for a runner with %s free", request)
+			}
+			pe.logJob(job, "info", step.ID, msg)
+			logged = true
+		}
+
+		select {
+		case <-ctx.Done():
+			pe.mu.Lock()
+			pe.dequeue(w, false)
+			pe.wakeWaiters()
+			pe.mu.Unlock()
+			return nil, fmt.Errorf("waiting for a runner: %w", ctx.Err())
+		case <-freed:
+		}
+		pe.mu.Lock()
+	}
+}
+
+// pickRunner returns the runner serving a waiter's job and matching its
+// labels with room for its request that is left with the least free
+// resources, passing over the runner it avoids when another runner matches,
+// or nil when none has room. Callers must hold pe.mu.
+func (pe *PipelineEngine) pickRunner(w *queueWaiter) *runnerSlot {
+	avoiding := false
+	for _, runner := range pe.runners {
+		avoiding = avoiding || w.avoid != "" && runner.Name != w.avoid && runner.matches(w.labels) && runner.serves(w.project, w.jobID)
+	}
+	var best *runnerSlot
+	for _, runner := range pe.runners {
+		if !runner.matches(w.labels) || !runner.serves(w.project, w.jobID) || !runner.hasCapacity(w.request) || avoiding && runner.Name == w.avoid {
+			continue
+		}
+		if best == nil || runner.fitScore(w.request) < best.fitScore(w.request) {
+			best = runner
+		}
+	}
+	return best
+}
+
+// releaseRunner frees the capacity and resources a step reserved and wakes
+// waiting steps
+func (pe *PipelineEngine) releaseRunner(runner *runnerSlot, request Resources) {
+	pe.mu.Lock()
+	runner.busy--
+	runner.allocated = runner.allocated.Sub(request)
+	if runner.busy == 0 {
+		runner.idleSince = time.Now()
+	}
+	pe.wakeWaiters()
+	pe.mu.Unlock()
+}
+
+// Runners returns the runners and the steps running on them
+func (pe *PipelineEngine) Runners() []RunnerStatus {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	statuses := make([]RunnerStatus, 0, len(pe.runners))
+	for _, runner := range pe.runners {
+		status := RunnerStatus{Runner: runner.Runner, Busy: runner.busy, Allocated: runner.allocated, Project: runner.project, JobID: runner.job}
+		if runner.agent != nil {
+			status.Agent = runner.agent.ID
+		}
+		status.Labels = append([]string(nil), runner.Labels...)
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// LabelCapacities reports the capacity of runners per label, sorted by label
+func (pe *PipelineEngine) LabelCapacities() []LabelCapacity {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	byLabel := make(map[string]*LabelCapacity)
+	for _, runner := range pe.runners {
+		for _, label := range runner.Labels {
+			label = strings.ToLower(label)
+			capacity, ok := byLabel[label]
+			if !ok {
+				capacity = &LabelCapacity{Label: label}
+				byLabel[label] = capacity
+			}
+			capacity.Runners++
+			capacity.Busy += runner.busy
+			capacity.Resources = capacity.Resources.Add(runner.Resources)
+			free := runner.Resources.Sub(runner.allocated)
+			if free.CPU > 0 {
+				capacity.ResourcesAvailable.CPU += free.CPU
+			}
+			if free.Memory > 0 {
+				capacity.ResourcesAvailable.Memory += free.Memory
+			}
+			if runner.Capacity <= 0 {
+				capacity.Unlimited = true
+				continue
+			}
+			capacity.Capacity += runner.Capacity
+			if free := runner.Capacity - runner.busy; free > 0 {
+				capacity.Available += free
+			}
+		}
+	}
+
+	capacities := make([]LabelCapacity, 0, len(byLabel))
+	for _, capacity := range byLabel {
+		capacities = append(capacities, *capacity)
+	}
+	sort.Slice(capacities, func(i, j int) bool {
+		return capacities[i].Label < capacities[j].Label
+	})
+	return capacities
+}
@@ -0,0 +1,220 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingExecutor records the steps it ran and can block them until
+// release is closed
+type recordingExecutor struct {
+	mu      sync.Mutex
+	steps   []string
+	running int
+	peak    int
+	release chan struct{}
+}
+
+func (e *recordingExecutor) Execute(ctx context.Context, step Step, env map[string]string) (*StepResult, error) {
+	e.mu.Lock()
+	e.steps = append(e.steps, step.ID)
+	e.running++
+	if e.running > e.peak {
+		e.peak = e.running
+	}
+	e.mu.Unlock()
+
+	if e.release != nil {
+		select {
+		case <-e.release:
+		case <-ctx.Done():
+		}
+	}
+
+	e.mu.Lock()
+	e.running--
+	e.mu.Unlock()
+	return &StepResult{Output: env["CONVEYOR_RUNNER"]}, nil
+}
+
+func TestRun_StepsRunOnMatchingRunner(t *testing.T) {
+	linux, large := &recordingExecutor{}, &recordingExecutor{}
+	engine := newTestEngine(WithRunners(
+		Runner{Name: "small", Labels: []string{"linux", "docker"}, Executor: linux},
+		Runner{Name: "big", Labels: []string{"linux", "docker", "large"}, Executor: large},
+	))
+	pipeline := scriptPipeline("labels", "echo build", "echo test")
+	pipeline.Stages[0].RunsOn = []string{"linux"}
+	pipeline.Stages[0].Steps[1].RunsOn = []string{"Docker", "large"}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "labels")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess {
+		t.Fatalf("Status = %q, want success; logs: %+v", job.Status, job.Logs)
+	}
+	if job.Steps[0].Runner != "small" || job.Steps[1].Runner != "big" {
+		t.Errorf("runners = %q, %q, want small, big", job.Steps[0].Runner, job.Steps[1].Runner)
+	}
+	if job.Steps[1].Output != "big" {
+		t.Errorf("CONVEYOR_RUNNER = %q, want big", job.Steps[1].Output)
+	}
+}
+
+func TestRun_NoMatchingRunner(t *testing.T) {
+	executor := &recordingExecutor{}
+	engine := newTestEngine(WithRunners(Runner{Name: "small", Labels: []string{"linux"}, Executor: executor}))
+	pipeline := scriptPipeline("gpu", "echo build", "echo train")
+	pipeline.Stages[0].Steps[1].RunsOn = []string{"linux", "gpu"}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "gpu")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusFailed {
+		t.Fatalf("Status = %q, want failed", job.Status)
+	}
+	if len(executor.steps) != 0 {
+		t.Errorf("executed steps %v, want none before scheduling fails", executor.steps)
+	}
+	if len(job.Logs) == 0 || !strings.Contains(job.Logs[0].Message, "no runner matches runs_on [linux, gpu] of step build-step-b") ||
+		!strings.Contains(job.Logs[0].Message, "small [linux]") {
+		t.Errorf("Logs = %+v, want a scheduling error naming the step and runners", job.Logs)
+	}
+}
+
+func TestRun_RunnerCapacity(t *testing.T) {
+	executor := &recordingExecutor{release: make(chan struct{})}
+	engine := newTestEngine(WithRunners(Runner{Name: "one", Labels: []string{"linux"}, Capacity: 1, Executor: executor}))
+	engine.CreatePipeline(scriptPipeline("a", "echo a"))
+	engine.CreatePipeline(scriptPipeline("b", "echo b"))
+
+	first, _ := engine.Start(context.Background(), "a")
+	second, _ := engine.Start(context.Background(), "b")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		capacities := engine.LabelCapacities()
+		if len(capacities) == 1 && capacities[0].Busy == 1 && capacities[0].Available == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("LabelCapacities() = %+v, want linux fully busy", capacities)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(executor.release)
+	waitForJob(t, engine, "a", first.ID, StatusSuccess)
+	waitForJob(t, engine, "b", second.ID, StatusSuccess)
+	if executor.peak != 1 {
+		t.Errorf("peak concurrent steps = %d, want 1", executor.peak)
+	}
+	if runners := engine.Runners(); runners[0].Busy != 0 {
+		t.Errorf("Busy = %d after jobs finished, want 0", runners[0].Busy)
+	}
+}
+
+func TestDefaultRunner(t *testing.T) {
+	engine := newTestEngine()
+	runners := engine.Runners()
+	if len(runners) != 1 || runners[0].Name != "local" || runners[0].Capacity != 0 {
+		t.Fatalf("Runners() = %+v, want the unlimited local runner", runners)
+	}
+	for _, capacity := range engine.LabelCapacities() {
+		if !capacity.Unlimited {
+			t.Errorf("label %s is limited, want unlimited", capacity.Label)
+		}
+	}
+}
+
+func TestRun_ResourceRequestsQueue(t *testing.T) {
+	executor := &recordingExecutor{release: make(chan struct{})}
+	engine := newTestEngine(WithRunners(Runner{Name: "two", Labels: []string{"linux"}, Resources: Resources{CPU: 2}, Executor: executor}))
+	for _, id := range []string{"a", "b"} {
+		pipeline := scriptPipeline(id, "echo "+id)
+		pipeline.Stages[0].Steps[0].Resources = &ResourceRequirements{Requests: Resources{CPU: 1.5}}
+		engine.CreatePipeline(pipeline)
+	}
+
+	first, _ := engine.Start(context.Background(), "a")
+	second, _ := engine.Start(context.Background(), "b")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		runners := engine.Runners()
+		a, _ := engine.GetJob("a", first.ID)
+		b, _ := engine.GetJob("b", second.ID)
+		if runners[0].Allocated.CPU == 1.5 && len(a.Logs)+len(b.Logs) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Runners() = %+v, want 1.5 cpu allocated and a job waiting", runners)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if capacities := engine.LabelCapacities(); capacities[0].ResourcesAvailable.CPU != 0.5 {
+		t.Errorf("ResourcesAvailable = %+v, want 0.5 cpu", capacities[0].ResourcesAvailable)
+	}
+
+	close(executor.release)
+	waitForJob(t, engine, "a", first.ID, StatusSuccess)
+	waitForJob(t, engine, "b", second.ID, StatusSuccess)
+	if executor.peak != 1 {
+		t.Errorf("peak concurrent steps = %d, want 1", executor.peak)
+	}
+	if runners := engine.Runners(); !runners[0].Allocated.IsZero() {
+		t.Errorf("Allocated = %+v after jobs finished, want none", runners[0].Allocated)
+	}
+}
+
+func TestRun_ResourceRequestsExceedRunners(t *testing.T) {
+	executor := &recordingExecutor{}
+	engine := newTestEngine(WithRunners(
+		Runner{Name: "small", Labels: []string{"linux"}, Resources: Resources{CPU: 2, Memory: 4 << 30}, Executor: executor},
+		Runner{Name: "gpu", Labels: []string{"gpu"}, Resources: Resources{CPU: 64, Memory: 256 << 30}, Executor: executor},
+	))
+	pipeline := scriptPipeline("big", "echo build")
+	pipeline.Stages[0].Steps[0].RunsOn = []string{"linux"}
+	pipeline.Stages[0].Steps[0].Resources = &ResourceRequirements{Limits: Resources{CPU: 4, Memory: 8 << 30}}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "big")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusFailed || len(executor.steps) != 0 {
+		t.Fatalf("Status = %q with steps %v, want failed before running", job.Status, executor.steps)
+	}
+	want := "step build-step-a requests cpu 4, memory 8Gi, more than any runner matching runs_on [linux] has: small (cpu 2, memory 4Gi)"
+	if len(job.Logs) == 0 || !strings.Contains(job.Logs[0].Message, want) {
+		t.Errorf("Logs = %+v, want %q", job.Logs, want)
+	}
+}
+
+func TestAcquireRunner_PacksBusiestRunner(t *testing.T) {
+	engine := newTestEngine(WithRunners(
+		Runner{Name: "a", Resources: Resources{CPU: 4, Memory: 8 << 30}},
+		Runner{Name: "b", Resources: Resources{CPU: 4, Memory: 8 << 30}},
+	))
+	step := Step{ID: "s", Resources: &ResourceRequirements{Requests: Resources{CPU: 1, Memory: 1 << 30}}}
+	job := &Job{ID: "job"}
+
+	var names []string
+	for i := 0; i < 5; i++ {
+		runner, err := engine.acquireRunner(context.Background(), job, step, "")
+		if err != nil {
+			t.Fatalf("acquireRunner() error = %v", err)
+		}
+		names = append(names, runner.Name)
+	}
+	if got := strings.Join(names, ","); got != "a,a,a,a,b" {
+		t.Errorf("runners = %s, want a filled before b", got)
+	}
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/chip/conveyor/core/cron"
+)
+
+// Trigger sources, recorded on jobs as the "source" metadata. Scheduled,
+// webhook and pipeline-completed triggers are held during maintenance
+// windows.
+const (
+	TriggerManual            = "manual"
+	TriggerSchedule          = "schedule"
+	TriggerWebhook           = "webhook"
+	TriggerPipelineCompleted = "pipeline-completed"
+	TriggerBackfill          = "backfill"
+)
+
+// WatchSchedules starts the pipelines whose schedule triggers are due and
+// the held triggers whose maintenance windows closed, every interval until
+// ctx is done
+func (pe *PipelineEngine) WatchSchedules(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pe.runSchedules(ctx, time.Now())
+		if _, err := pe.FlushHeldTriggers(ctx, "", false); err != nil {
+			pe.logger.Printf("Failed to flush held triggers: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runSchedules dispatches the pipelines with a schedule trigger due at or
+// before now. A schedule's first run is its first time after it was seen.
+func (pe *PipelineEngine) runSchedules(ctx context.Context, now time.Time) {
+	type due struct {
+		pipelineID string
+		cron       string
+	}
+	var dispatch []due
+
+	pe.mu.Lock()
+	next := make(map[string]time.Time)
+	for id, pipeline := range pe.pipelines {
+		for i, trigger := range pipeline.Triggers {
+			if trigger.Type != TriggerSchedule || trigger.Cron == "" {
+				continue
+			}
+			schedule, err := cron.Parse(trigger.Cron)
+			if err != nil {
+				continue
+			}
+			key := id + "#" + strconv.Itoa(i) + "#" + trigger.Cron + "#" + trigger.Timezone
+			local := now.In(pe.scheduleZone(trigger.Timezone))
+			at, seen := pe.scheduleNext[key]
+			switch {
+			case !seen:
+				at = schedule.Next(local).UTC()
+			case !at.After(now):
+				dispatch = append(dispatch, due{pipelineID: id, cron: trigger.Cron})
+				at = schedule.Next(local).UTC()
+			}
+			next[key] = at
+		}
+	}
+	pe.scheduleNext = next
+	pe.mu.Unlock()
+
+	for _, d := range dispatch {
+		job, held, err := pe.Dispatch(ctx, d.pipelineID, WithSource(TriggerSchedule), WithTrigger(map[string]string{"schedule": d.cron}))
+		switch {
+		case err != nil:
+			pe.logger.Printf("Failed to start scheduled run of pipeline %s: %v", d.pipelineID, err)
+		case held == nil:
+			pe.logger.Printf("Started scheduled run of pipeline %s as job %s", d.pipelineID, job.ID)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SecretState describes how close a secret is to its expiry
+type SecretState string
+
+// Secret states. A secret without an expiry is always active.
+const (
+	SecretActive   SecretState = "active"
+	SecretExpiring SecretState = "expiring"
+	SecretExpired  SecretState = "expired"
+)
+
+// Actions taken when a step references an expired secret
+const (
+	ExpiryFail = "fail"
+	ExpiryWarn = "warn"
+)
+
+// defaultRemindBefore is how long before expiry a secret counts as expiring
+// when it does not set RemindBefore
+const defaultRemindBefore = 7 * 24 * time.Hour
+
+// secretNamePattern restricts secret names to valid environment variable names
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Secret is a named value injected into the environment of steps that list
+// it. The value is never encoded to JSON.
+type Secret struct {
+	Name        string    `json:"name"`
+	Value       string    `json:"-"`
+	Description string    `json:"description,omitempty"`
+	ExpiresAt   time.Time `json:"expiresAt,omitempty"`
+	// RotateEvery sets ExpiresAt each time the value changes, e.g. "90d"
+	RotateEvery string `json:"rotateEvery,omitempty"`
+	// RemindBefore is how long before ExpiresAt reminders start. Defaults
+	// to 7 days.
+	RemindBefore string `json:"remindBefore,omitempty"`
+	// OnExpiry is ExpiryFail (the default) to fail steps that reference the
+	// expired secret, or ExpiryWarn to run them with a warning
+	OnExpiry  string    `json:"onExpiry,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	RotatedAt time.Time `json:"rotatedAt"`
+	// Notified is the state a reminder was last sent for
+	Notified SecretState `json:"notified,omitempty"`
+}
+
+// SecretInfo is a secret's metadata together with its current state
+type SecretInfo struct {
+	Secret
+	State SecretState `json:"state"`
+}
+
+// SecretStore persists secrets. GetSecret returns nil without an error for
+// unknown names.
+type SecretStore interface {
+	GetSecret(name string) (*Secret, error)
+	ListSecrets() ([]*Secret, error)
+	SaveSecret(secret *Secret) error
+	DeleteSecret(name string) error
+}
+
+// State returns the expiry state of the secret at now
+func (s *Secret) State(now time.Time) SecretState {
+	if s.ExpiresAt.IsZero() {
+		return SecretActive
+	}
+	if !now.Before(s.ExpiresAt) {
+		return SecretExpired
+	}
+
+	remind := defaultRemindBefore
+	if s.RemindBefore != "" {
+		if d, err := ParseDuration(s.RemindBefore); err == nil {
+			remind = d
+		}
+	}
+	if !now.Before(s.ExpiresAt.Add(-remind)) {
+		return SecretExpiring
+	}
+	return SecretActive
+}
+
+// ParseDuration parses a duration that may also be given in days,
+// such as "90d"
+func ParseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// SetSecret creates a secret or updates an existing one. A non-empty Value
+// rotates the secret, restarting its RotateEvery period; an empty Value
+// only updates the settings of an existing secret.
+func (pe *PipelineEngine) SetSecret(update Secret) (*SecretInfo, error) {
+	if pe.secrets == nil {
+		return nil, fmt.Errorf("no secret store is configured")
+	}
+	if !secretNamePattern.MatchString(update.Name) {
+		return nil, fmt.Errorf("secret name %q must be a valid environment variable name", update.Name)
+	}
+	for _, d := range []string{update.RotateEvery, update.RemindBefore} {
+		if d == "" {
+			continue
+		}
+		if _, err := ParseDuration(d); err != nil {
+			return nil, err
+		}
+	}
+	switch update.OnExpiry {
+	case "", ExpiryFail, ExpiryWarn:
+	default:
+		return nil, fmt.Errorf("onExpiry must be %q or %q", ExpiryFail, ExpiryWarn)
+	}
+
+	secret, err := pe.secrets.GetSecret(update.Name)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if secret == nil {
+		if update.Value == "" {
+			return nil, fmt.Errorf("secret %s requires a value", update.Name)
+		}
+		secret = &Secret{Name: update.Name, CreatedAt: now}
+	}
+
+	secret.Description = update.Description
+	secret.RotateEvery = update.RotateEvery
+	secret.RemindBefore = update.RemindBefore
+	secret.OnExpiry = update.OnExpiry
+	if !update.ExpiresAt.IsZero() {
+		secret.ExpiresAt = update.ExpiresAt
+	}
+	if update.Value != "" {
+		secret.Value = update.Value
+		secret.RotatedAt = now
+		if update.ExpiresAt.IsZero() {
+			secret.ExpiresAt = time.Time{}
+			if secret.RotateEvery != "" {
+				every, _ := ParseDuration(secret.RotateEvery)
+				secret.ExpiresAt = now.Add(every)
+			}
+		}
+	}
+	// A changed expiry may need a fresh reminder
+	if secret.State(now) != secret.Notified {
+		secret.Notified = ""
+	}
+
+	if err := pe.secrets.SaveSecret(secret); err != nil {
+		return nil, err
+	}
+	return &SecretInfo{Secret: *secret, State: secret.State(now)}, nil
+}
+
+// Secret returns the metadata of a secret
+func (pe *PipelineEngine) Secret(name string) (*SecretInfo, error) {
+	if pe.secrets == nil {
+		return nil, fmt.Errorf("no secret store is configured")
+	}
+	secret, err := pe.secrets.GetSecret(name)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("secret %s not found", name)
+	}
+	return &SecretInfo{Secret: *secret, State: secret.State(time.Now())}, nil
+}
+
+// Secrets returns the metadata of every secret. With expiringOnly, only
+// expiring and expired secrets are returned.
+func (pe *PipelineEngine) Secrets(expiringOnly bool) ([]SecretInfo, error) {
+	if pe.secrets == nil {
+		return []SecretInfo{}, nil
+	}
+	secrets, err := pe.secrets.ListSecrets()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	infos := make([]SecretInfo, 0, len(secrets))
+	for _, secret := range secrets {
+		state := secret.State(now)
+		if expiringOnly && state == SecretActive {
+			continue
+		}
+		infos = append(infos, SecretInfo{Secret: *secret, State: state})
+	}
+	return infos, nil
+}
+
+// DeleteSecret removes a secret
+func (pe *PipelineEngine) DeleteSecret(name string) error {
+	if pe.secrets == nil {
+		return fmt.Errorf("no secret store is configured")
+	}
+	secret, err := pe.secrets.GetSecret(name)
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return fmt.Errorf("secret %s not found", name)
+	}
+	return pe.secrets.DeleteSecret(name)
+}
+
+// CheckSecrets emits secret.expiring and secret.expired events for secrets
+// that reached those states since their last reminder
+func (pe *PipelineEngine) CheckSecrets(now time.Time) error {
+	if pe.secrets == nil {
+		return nil
+	}
+	secrets, err := pe.secrets.ListSecrets()
+	if err != nil {
+		return err
+	}
+
+	for _, secret := range secrets {
+		state := secret.State(now)
+		if state == SecretActive || state == secret.Notified {
+			continue
+		}
+
+		secret.Notified = state
+		if err := pe.secrets.SaveSecret(secret); err != nil {
+			return err
+		}
+		pe.emitEvent(Event{
+			Type:      "secret." + string(state),
+			Timestamp: now,
+			Data: map[string]interface{}{
+				"name":      secret.Name,
+				"expiresAt": secret.ExpiresAt,
+			},
+		})
+	}
+	return nil
+}
+
+// WatchSecrets checks for expiring secrets now and then every interval
+// until ctx is done
+func (pe *PipelineEngine) WatchSecrets(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := pe.CheckSecrets(time.Now()); err != nil {
+			pe.logger.Printf("Failed to check secret expiry: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// resolveSecrets returns the values of the secrets a step lists and counts
+// their usage. Expired secrets fail the step unless they are set to warn;
+// warnings are logged on the job.
+func (pe *PipelineEngine) resolveSecrets(job *Job, step Step) (map[string]string, error) {
+	if len(step.Secrets) == 0 {
+		return nil, nil
+	}
+	if pe.secrets == nil {
+		return nil, fmt.Errorf("step uses secrets but no secret store is configured")
+	}
+
+	now := time.Now()
+	values := make(map[string]string, len(step.Secrets))
+	for _, name := range step.Secrets {
+		secret, err := pe.secrets.GetSecret(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret %s: %w", name, err)
+		}
+		if secret == nil {
+			return nil, fmt.Errorf("secret %s is not defined", name)
+		}
+
+		switch secret.State(now) {
+		case SecretExpired:
+			message := fmt.Sprintf("secret %s expired on %s and must be rotated", name, secret.ExpiresAt.Format(time.RFC3339))
+			if secret.OnExpiry != ExpiryWarn {
+				return nil, fmt.Errorf("%s", message)
+			}
+			pe.logJob(job, "warn", step.ID, message)
+		case SecretExpiring:
+			pe.logJob(job, "warn", step.ID, fmt.Sprintf("secret %s expires on %s", name, secret.ExpiresAt.Format(time.RFC3339)))
+		}
+		values[name] = secret.Value
+	}
+	pe.recordSecretUsage(job, step, step.Secrets)
+	return values, nil
+}
+
+// maskSecrets replaces secret values in text
+func maskSecrets(text string, secrets map[string]string) string {
+	for _, value := range secrets {
+		if value != "" {
+			text = strings.ReplaceAll(text, value, "***")
+		}
+	}
+	return text
+}
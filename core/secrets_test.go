@@ -0,0 +1,240 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSecretEngine(t *testing.T) *PipelineEngine {
+	t.Helper()
+	store, err := NewFileSecretStore(t.TempDir(), bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("NewFileSecretStore() error = %v", err)
+	}
+	return newTestEngine(WithSecrets(store))
+}
+
+func TestFileSecretStore_EncryptsValues(t *testing.T) {
+	dir := t.TempDir()
+	key, err := SecretKey("", filepath.Join(dir, "secrets.key"), filepath.Join(dir, "secrets.salt"))
+	if err != nil {
+		t.Fatalf("SecretKey() error = %v", err)
+	}
+	store, err := NewFileSecretStore(dir, key)
+	if err != nil {
+		t.Fatalf("NewFileSecretStore() error = %v", err)
+	}
+	if err := store.SaveSecret(&Secret{Name: "TOKEN", Value: "hunter2"}); err != nil {
+		t.Fatalf("SaveSecret() error = %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "secrets.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hunter2") {
+		t.Error("secret value stored in plain text")
+	}
+
+	again, err := SecretKey("", filepath.Join(dir, "secrets.key"), filepath.Join(dir, "secrets.salt"))
+	if err != nil || !bytes.Equal(again, key) {
+		t.Fatalf("SecretKey() = %v, %v, want the generated key", again, err)
+	}
+	reopened, err := NewFileSecretStore(dir, again)
+	if err != nil {
+		t.Fatalf("NewFileSecretStore() error = %v", err)
+	}
+	secret, _ := reopened.GetSecret("TOKEN")
+	if secret == nil || secret.Value != "hunter2" {
+		t.Errorf("GetSecret() = %+v, want the decrypted value", secret)
+	}
+
+	wrongKey, _ := SecretKey("another passphrase", "", filepath.Join(dir, "secrets.salt"))
+	if _, err := NewFileSecretStore(dir, wrongKey); err == nil {
+		t.Error("NewFileSecretStore() with the wrong key expected error")
+	}
+}
+
+func TestSecretKey_Passphrase(t *testing.T) {
+	dir := t.TempDir()
+	saltFile := filepath.Join(dir, "secrets.salt")
+	key, err := SecretKey("hunter2", "", saltFile)
+	if err != nil {
+		t.Fatalf("SecretKey() error = %v", err)
+	}
+	if _, err := os.Stat(saltFile); err != nil {
+		t.Fatalf("salt file not created: %v", err)
+	}
+	again, _ := SecretKey("hunter2", "", saltFile)
+	other, _ := SecretKey("hunter2", "", filepath.Join(t.TempDir(), "secrets.salt"))
+	if !bytes.Equal(key, again) || bytes.Equal(key, other) {
+		t.Error("SecretKey() want the same key with the same salt and another with a new salt")
+	}
+	if legacy := LegacySecretKeys("hunter2"); bytes.Equal(key, legacy[0]) {
+		t.Error("SecretKey() = the unsalted hash of the passphrase")
+	}
+
+	// A store encrypted with the unsalted hash is re-encrypted with the
+	// derived key
+	legacy, err := NewFileSecretStore(dir, LegacySecretKeys("hunter2")[0])
+	if err != nil {
+		t.Fatalf("NewFileSecretStore() error = %v", err)
+	}
+	legacy.SaveSecret(&Secret{Name: "TOKEN", Value: "s3cret"})
+	if _, err := NewFileSecretStore(dir, key, LegacySecretKeys("another")...); err == nil {
+		t.Fatal("NewFileSecretStore() with the wrong previous key error = nil")
+	}
+	store, err := NewFileSecretStore(dir, key, LegacySecretKeys("hunter2")...)
+	if err != nil {
+		t.Fatalf("NewFileSecretStore() with the previous key error = %v", err)
+	}
+	if secret, _ := store.GetSecret("TOKEN"); secret == nil || secret.Value != "s3cret" {
+		t.Errorf("GetSecret() = %+v, want the migrated value", secret)
+	}
+	if _, err := NewFileSecretStore(dir, key); err != nil {
+		t.Errorf("NewFileSecretStore() after migrating error = %v", err)
+	}
+}
+
+func TestSecret_State(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		secret Secret
+		want   SecretState
+	}{
+		{Secret{}, SecretActive},
+		{Secret{ExpiresAt: now.Add(30 * 24 * time.Hour)}, SecretActive},
+		{Secret{ExpiresAt: now.Add(3 * 24 * time.Hour)}, SecretExpiring},
+		{Secret{ExpiresAt: now.Add(3 * 24 * time.Hour), RemindBefore: "1d"}, SecretActive},
+		{Secret{ExpiresAt: now.Add(20 * 24 * time.Hour), RemindBefore: "30d"}, SecretExpiring},
+		{Secret{ExpiresAt: now.Add(-time.Minute)}, SecretExpired},
+	}
+	for _, tt := range tests {
+		if got := tt.secret.State(now); got != tt.want {
+			t.Errorf("State() of %+v = %s, want %s", tt.secret, got, tt.want)
+		}
+	}
+}
+
+func TestSetSecret_Rotation(t *testing.T) {
+	engine := newSecretEngine(t)
+
+	if _, err := engine.SetSecret(Secret{Name: "TOKEN"}); err == nil {
+		t.Error("SetSecret() without a value expected error")
+	}
+	if _, err := engine.SetSecret(Secret{Name: "bad-name", Value: "x"}); err == nil {
+		t.Error("SetSecret() with an invalid name expected error")
+	}
+
+	created, err := engine.SetSecret(Secret{Name: "TOKEN", Value: "v1", RotateEvery: "90d"})
+	if err != nil {
+		t.Fatalf("SetSecret() error = %v", err)
+	}
+	wantExpiry := created.RotatedAt.Add(90 * 24 * time.Hour)
+	if !created.ExpiresAt.Equal(wantExpiry) || created.State != SecretActive {
+		t.Errorf("SetSecret() = %+v, want expiry 90 days after rotation", created)
+	}
+
+	updated, err := engine.SetSecret(Secret{Name: "TOKEN", Description: "deploy token", RotateEvery: "90d"})
+	if err != nil {
+		t.Fatalf("SetSecret() error = %v", err)
+	}
+	if !updated.ExpiresAt.Equal(created.ExpiresAt) || updated.Description != "deploy token" {
+		t.Errorf("settings update = %+v, want the expiry unchanged", updated)
+	}
+}
+
+func secretPipeline(command string) *Pipeline {
+	pipeline := scriptPipeline("deploy", command)
+	pipeline.Stages[0].Steps[0].Secrets = []string{"TOKEN"}
+	return pipeline
+}
+
+func TestRun_InjectsAndMasksSecrets(t *testing.T) {
+	engine := newSecretEngine(t)
+	if _, err := engine.SetSecret(Secret{Name: "TOKEN", Value: "s3cr3t-value"}); err != nil {
+		t.Fatal(err)
+	}
+	engine.CreatePipeline(secretPipeline(`test "$TOKEN" = s3cr3t-value && echo "token is $TOKEN"`))
+
+	job, err := engine.Run(context.Background(), "deploy")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess {
+		t.Fatalf("Status = %q, want success", job.Status)
+	}
+	if output := job.Steps[0].Output; strings.Contains(output, "s3cr3t-value") || !strings.Contains(output, "token is ***") {
+		t.Errorf("Output = %q, want the secret masked", output)
+	}
+
+	engine.RegisterPlugin(&fakePlugin{name: "deploy", types: []string{"deploy"}, err: errors.New("login with s3cr3t-value failed")})
+	pipeline := secretPipeline("")
+	pipeline.Stages[0].Steps[0].Type = "deploy"
+	engine.UpdatePipeline(pipeline)
+	job, _ = engine.Run(context.Background(), "deploy")
+	if last := job.Logs[len(job.Logs)-1].Message; job.Status != StatusFailed || !strings.HasSuffix(last, "login with *** failed") {
+		t.Errorf("job = %s with error %q, want the secret masked in the error", job.Status, last)
+	}
+}
+
+func TestRun_ExpiredSecret(t *testing.T) {
+	engine := newSecretEngine(t)
+	if _, err := engine.SetSecret(Secret{Name: "TOKEN", Value: "v1", ExpiresAt: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	engine.CreatePipeline(secretPipeline("true"))
+
+	job, _ := engine.Run(context.Background(), "deploy")
+	if job.Status != StatusFailed {
+		t.Fatalf("Status = %q, want failed for an expired secret", job.Status)
+	}
+	if len(job.Logs) == 0 || !strings.Contains(job.Logs[0].Message, "secret TOKEN expired") {
+		t.Errorf("Logs = %+v, want an expired secret error", job.Logs)
+	}
+
+	if _, err := engine.SetSecret(Secret{Name: "TOKEN", OnExpiry: ExpiryWarn}); err != nil {
+		t.Fatal(err)
+	}
+	job, _ = engine.Run(context.Background(), "deploy")
+	if job.Status != StatusSuccess {
+		t.Fatalf("Status = %q, want success when expired secrets only warn", job.Status)
+	}
+	if len(job.Logs) == 0 || job.Logs[0].Level != "warn" {
+		t.Errorf("Logs = %+v, want an expiry warning", job.Logs)
+	}
+}
+
+func TestCheckSecrets_RemindsOncePerState(t *testing.T) {
+	engine := newSecretEngine(t)
+	sub := engine.Subscribe(10)
+	defer sub.Close()
+
+	if _, err := engine.SetSecret(Secret{Name: "TOKEN", Value: "v1", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	engine.CheckSecrets(now)
+	engine.CheckSecrets(now)
+	engine.CheckSecrets(now.Add(2 * time.Hour))
+
+	var types []string
+	for len(sub.Events()) > 0 {
+		types = append(types, (<-sub.Events()).Type)
+	}
+	if strings.Join(types, ",") != "secret.expiring,secret.expired" {
+		t.Errorf("events = %v, want one expiring and one expired reminder", types)
+	}
+
+	expiring, err := engine.Secrets(true)
+	if err != nil || len(expiring) != 1 {
+		t.Errorf("Secrets(true) = %v, %v, want the expiring secret", expiring, err)
+	}
+}
@@ -0,0 +1,305 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// secretKeyIterations is the PBKDF2 iteration count of passphrase keys
+const secretKeyIterations = 600000
+
+// FileSecretStore keeps secrets in a JSON file with their values encrypted
+// using AES-256-GCM
+type FileSecretStore struct {
+	path    string
+	aead    cipher.AEAD
+	mu      sync.Mutex
+	secrets map[string]*Secret
+}
+
+// storedSecret is the on-disk form of a secret
+type storedSecret struct {
+	Secret
+	Ciphertext string `json:"ciphertext"`
+}
+
+// NewFileSecretStore opens the secret store in dir, creating it if needed.
+// key must be 32 bytes; see SecretKey. A store encrypted with one of the
+// previous keys, such as LegacySecretKeys, is re-encrypted with key.
+func NewFileSecretStore(dir string, key []byte, previous ...[]byte) (*FileSecretStore, error) {
+	aead, err := secretCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create secret store directory: %w", err)
+	}
+
+	s := &FileSecretStore{
+		path:    filepath.Join(dir, "secrets.json"),
+		aead:    aead,
+		secrets: make(map[string]*Secret),
+	}
+
+	stored, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	if err = s.load(stored); err == nil {
+		return s, nil
+	}
+	for _, key := range previous {
+		old, cipherErr := secretCipher(key)
+		if cipherErr != nil {
+			continue
+		}
+		if s.aead = old; s.load(stored) != nil {
+			continue
+		}
+		// Re-encrypt with the current key
+		s.aead = aead
+		if err := s.write(); err != nil {
+			return nil, fmt.Errorf("failed to re-encrypt secrets: %w", err)
+		}
+		return s, nil
+	}
+	return nil, err
+}
+
+// Reload replaces the secrets with what the file holds, such as secrets
+// another server changed in a shared data directory
+func (s *FileSecretStore) Reload() error {
+	stored, err := s.read()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(stored)
+}
+
+// read returns the stored secrets, none when the file doesn't exist yet
+func (s *FileSecretStore) read() ([]storedSecret, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets: %w", err)
+	}
+	var stored []storedSecret
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to decode secrets: %w", err)
+	}
+	return stored, nil
+}
+
+// secretCipher returns the AES-256-GCM cipher of a key
+func secretCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("secret key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// load decrypts stored secrets into the store
+func (s *FileSecretStore) load(stored []storedSecret) error {
+	secrets := make(map[string]*Secret, len(stored))
+	for _, entry := range stored {
+		value, err := s.decrypt(entry.Ciphertext)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt secret %s, is the secret key correct? %w", entry.Name, err)
+		}
+		secret := entry.Secret
+		secret.Value = value
+		secrets[secret.Name] = &secret
+	}
+	s.secrets = secrets
+	return nil
+}
+
+// SecretKey returns the key for a FileSecretStore. A passphrase is derived
+// into a key with PBKDF2-HMAC-SHA256 and the random salt in saltFile, which
+// is created on first use. Without one, the key is read from keyFile, which
+// is created with a random key on first use.
+func SecretKey(passphrase, keyFile, saltFile string) ([]byte, error) {
+	if passphrase != "" {
+		salt, err := readOrCreateKey(saltFile, 16)
+		if err != nil {
+			return nil, fmt.Errorf("secret key salt: %w", err)
+		}
+		return pbkdf2.Key([]byte(passphrase), salt, secretKeyIterations, 32, sha256.New), nil
+	}
+	key, err := readOrCreateKey(keyFile, 32)
+	if err != nil {
+		return nil, fmt.Errorf("secret key: %w", err)
+	}
+	return key, nil
+}
+
+// LegacySecretKeys returns the key a passphrase was hashed into before keys
+// were derived with PBKDF2, so stores and releases made with it still open
+func LegacySecretKeys(passphrase string) [][]byte {
+	if passphrase == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(passphrase))
+	return [][]byte{sum[:]}
+}
+
+// readOrCreateKey returns the base64 bytes in path, after writing size
+// random ones to it if it doesn't exist
+func readOrCreateKey(path string, size int) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil || len(key) != size {
+			return nil, fmt.Errorf("invalid key in %s", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read: %w", err)
+	}
+
+	key := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write: %w", err)
+	}
+	return key, nil
+}
+
+// GetSecret returns a copy of a secret, or nil if it does not exist
+func (s *FileSecretStore) GetSecret(name string) (*Secret, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secret, ok := s.secrets[name]
+	if !ok {
+		return nil, nil
+	}
+	copied := *secret
+	return &copied, nil
+}
+
+// ListSecrets returns copies of all secrets ordered by name
+func (s *FileSecretStore) ListSecrets() ([]*Secret, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secrets := make([]*Secret, 0, len(s.secrets))
+	for _, secret := range s.secrets {
+		copied := *secret
+		secrets = append(secrets, &copied)
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		return secrets[i].Name < secrets[j].Name
+	})
+	return secrets, nil
+}
+
+// SaveSecret creates or replaces a secret
+func (s *FileSecretStore) SaveSecret(secret *Secret) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copied := *secret
+	previous, existed := s.secrets[secret.Name]
+	s.secrets[secret.Name] = &copied
+	if err := s.write(); err != nil {
+		if existed {
+			s.secrets[secret.Name] = previous
+		} else {
+			delete(s.secrets, secret.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// DeleteSecret removes a secret
+func (s *FileSecretStore) DeleteSecret(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, ok := s.secrets[name]
+	if !ok {
+		return nil
+	}
+	delete(s.secrets, name)
+	if err := s.write(); err != nil {
+		s.secrets[name] = previous
+		return err
+	}
+	return nil
+}
+
+// write saves all secrets to disk. Callers must hold s.mu.
+func (s *FileSecretStore) write() error {
+	stored := make([]storedSecret, 0, len(s.secrets))
+	for _, secret := range s.secrets {
+		ciphertext, err := s.encrypt(secret.Value)
+		if err != nil {
+			return err
+		}
+		stored = append(stored, storedSecret{Secret: *secret, Ciphertext: ciphertext})
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].Name < stored[j].Name
+	})
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode secrets: %w", err)
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// encrypt seals a value with a random nonce prepended to the ciphertext
+func (s *FileSecretStore) encrypt(value string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(value), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt opens a value sealed by encrypt
+func (s *FileSecretStore) decrypt(ciphertext string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < s.aead.NonceSize() {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+	nonce, sealed := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	value, err := s.aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
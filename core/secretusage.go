@@ -0,0 +1,276 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SecretUsage counts how often a pipeline step read a secret
+type SecretUsage struct {
+	Secret     string    `json:"secret"`
+	PipelineID string    `json:"pipelineId"`
+	StepID     string    `json:"stepId"`
+	StepName   string    `json:"stepName,omitempty"`
+	Uses       int       `json:"uses"`
+	FirstUsed  time.Time `json:"firstUsed"`
+	LastUsed   time.Time `json:"lastUsed"`
+	LastJobID  string    `json:"lastJobId"`
+	// LastTriggeredBy is who or what started the job that last read the
+	// secret: the API caller, or the trigger source such as schedule
+	LastTriggeredBy string `json:"lastTriggeredBy,omitempty"`
+}
+
+// SecretReference is a step of a registered pipeline that lists a secret
+type SecretReference struct {
+	PipelineID string `json:"pipelineId"`
+	StageID    string `json:"stageId"`
+	StepID     string `json:"stepId"`
+	StepName   string `json:"stepName,omitempty"`
+}
+
+// SecretUsageReport describes where a secret is referenced and read
+type SecretUsageReport struct {
+	Name string `json:"name"`
+	// Defined is false for a deleted secret that was read before
+	Defined   bool       `json:"defined"`
+	Uses      int        `json:"uses"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+	Pipelines []string   `json:"pipelines"`
+	// Steps are the steps that read the secret, most recent first
+	Steps      []SecretUsage     `json:"steps"`
+	References []SecretReference `json:"references"`
+}
+
+// Reasons a secret is reported as unused
+const (
+	// UnusedUnreferenced secrets aren't listed by any registered pipeline
+	UnusedUnreferenced = "unreferenced"
+	// UnusedStale secrets are listed but weren't read since the cutoff
+	UnusedStale = "stale"
+)
+
+// UnusedSecret is a secret that is safe to review for removal
+type UnusedSecret struct {
+	SecretInfo
+	Reason   string     `json:"reason"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+}
+
+// SecretUsageStore persists secret usage. It is optional: the engine only
+// keeps usage in memory when its Store doesn't implement it.
+type SecretUsageStore interface {
+	SaveSecretUsage(usage []*SecretUsage) error
+	LoadSecretUsage() ([]*SecretUsage, error)
+}
+
+// recordSecretUsage counts a step's read of its secrets
+func (pe *PipelineEngine) recordSecretUsage(job *Job, step Step, names []string) {
+	now := time.Now()
+	triggeredBy := jobTriggeredBy(job)
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	for _, name := range names {
+		key := secretUsageKey(name, job.PipelineID, step.ID)
+		usage := pe.secretUsage[key]
+		if usage == nil {
+			usage = &SecretUsage{Secret: name, PipelineID: job.PipelineID, StepID: step.ID, FirstUsed: now}
+			pe.secretUsage[key] = usage
+		}
+		usage.StepName = step.Name
+		usage.Uses++
+		usage.LastUsed = now
+		usage.LastJobID = job.ID
+		usage.LastTriggeredBy = triggeredBy
+	}
+	pe.saveSecretUsage()
+}
+
+// secretUsageKey identifies the usage of a secret by a pipeline step
+func secretUsageKey(name, pipelineID, stepID string) string {
+	return name + "\x00" + pipelineID + "\x00" + stepID
+}
+
+// jobTriggeredBy returns who started a job, falling back to its trigger
+// source
+func jobTriggeredBy(job *Job) string {
+	if by, ok := job.Metadata["triggeredBy"].(string); ok && by != "" {
+		return by
+	}
+	source, _ := job.Metadata["source"].(string)
+	return source
+}
+
+// SecretUsage reports the pipeline steps that list a secret and the ones
+// that read it
+func (pe *PipelineEngine) SecretUsage(name string) (*SecretUsageReport, error) {
+	defined := false
+	if pe.secrets != nil {
+		secret, err := pe.secrets.GetSecret(name)
+		if err != nil {
+			return nil, err
+		}
+		defined = secret != nil
+	}
+
+	report := &SecretUsageReport{
+		Name:       name,
+		Defined:    defined,
+		Pipelines:  []string{},
+		Steps:      []SecretUsage{},
+		References: pe.secretReferences()[name],
+	}
+	if report.References == nil {
+		report.References = []SecretReference{}
+	}
+
+	pe.mu.RLock()
+	pipelines := make(map[string]bool)
+	for _, usage := range pe.secretUsage {
+		if usage.Secret != name {
+			continue
+		}
+		report.Steps = append(report.Steps, *usage)
+		report.Uses += usage.Uses
+		if report.LastUsed == nil || usage.LastUsed.After(*report.LastUsed) {
+			last := usage.LastUsed
+			report.LastUsed = &last
+		}
+		if !pipelines[usage.PipelineID] {
+			pipelines[usage.PipelineID] = true
+			report.Pipelines = append(report.Pipelines, usage.PipelineID)
+		}
+	}
+	pe.mu.RUnlock()
+
+	if !defined && len(report.Steps) == 0 {
+		return nil, fmt.Errorf("secret %s not found", name)
+	}
+	sort.Strings(report.Pipelines)
+	sort.Slice(report.Steps, func(i, j int) bool {
+		return report.Steps[i].LastUsed.After(report.Steps[j].LastUsed)
+	})
+	return report, nil
+}
+
+// UnusedSecrets returns the secrets no registered pipeline lists, and the
+// listed ones no step read since the cutoff, ordered by name
+func (pe *PipelineEngine) UnusedSecrets(since time.Time) ([]UnusedSecret, error) {
+	secrets, err := pe.Secrets(false)
+	if err != nil {
+		return nil, err
+	}
+	references := pe.secretReferences()
+
+	pe.mu.RLock()
+	lastUsed := make(map[string]time.Time)
+	for _, usage := range pe.secretUsage {
+		if usage.LastUsed.After(lastUsed[usage.Secret]) {
+			lastUsed[usage.Secret] = usage.LastUsed
+		}
+	}
+	pe.mu.RUnlock()
+
+	unused := []UnusedSecret{}
+	for _, secret := range secrets {
+		entry := UnusedSecret{SecretInfo: secret}
+		if last, ok := lastUsed[secret.Name]; ok {
+			entry.LastUsed = &last
+		}
+		switch {
+		case len(references[secret.Name]) == 0:
+			entry.Reason = UnusedUnreferenced
+		case entry.LastUsed == nil || entry.LastUsed.Before(since):
+			// Secrets created after the cutoff haven't had the chance
+			if secret.CreatedAt.After(since) {
+				continue
+			}
+			entry.Reason = UnusedStale
+		default:
+			continue
+		}
+		unused = append(unused, entry)
+	}
+	return unused, nil
+}
+
+// secretReferences maps secret names to the steps of registered pipelines
+// that list them
+func (pe *PipelineEngine) secretReferences() map[string][]SecretReference {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	references := make(map[string][]SecretReference)
+	for _, pipeline := range pe.pipelines {
+		for _, stage := range pipeline.Stages {
+			for _, steps := range [][]Step{stage.Steps, stage.Rollback} {
+				for _, step := range steps {
+					for _, name := range step.Secrets {
+						references[name] = append(references[name], SecretReference{
+							PipelineID: pipeline.ID,
+							StageID:    stage.ID,
+							StepID:     step.ID,
+							StepName:   step.Name,
+						})
+					}
+				}
+			}
+		}
+	}
+	for _, refs := range references {
+		sort.Slice(refs, func(i, j int) bool {
+			if refs[i].PipelineID != refs[j].PipelineID {
+				return refs[i].PipelineID < refs[j].PipelineID
+			}
+			return refs[i].StepID < refs[j].StepID
+		})
+	}
+	return references
+}
+
+// RestoreSecretUsage loads the secret usage kept by the store
+func (pe *PipelineEngine) RestoreSecretUsage() error {
+	store, ok := pe.store.(SecretUsageStore)
+	if !ok {
+		return nil
+	}
+	usage, err := store.LoadSecretUsage()
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]*SecretUsage, len(usage))
+	for _, u := range usage {
+		loaded[secretUsageKey(u.Secret, u.PipelineID, u.StepID)] = u
+	}
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.secretUsage = loaded
+	return nil
+}
+
+// saveSecretUsage stores the secret usage, when the store keeps it.
+// Callers must hold pe.mu.
+func (pe *PipelineEngine) saveSecretUsage() {
+	store, ok := pe.store.(SecretUsageStore)
+	if !ok {
+		return
+	}
+	usage := make([]*SecretUsage, 0, len(pe.secretUsage))
+	for _, u := range pe.secretUsage {
+		usage = append(usage, u)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		a, b := usage[i], usage[j]
+		if a.Secret != b.Secret {
+			return a.Secret < b.Secret
+		}
+		if a.PipelineID != b.PipelineID {
+			return a.PipelineID < b.PipelineID
+		}
+		return a.StepID < b.StepID
+	})
+	if err := store.SaveSecretUsage(usage); err != nil {
+		pe.logger.Printf("Failed to save secret usage: %v", err)
+	}
+}
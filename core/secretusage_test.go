@@ -0,0 +1,91 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSecretUsage_RecordsAndPersists(t *testing.T) {
+	secrets, err := NewFileSecretStore(t.TempDir(), bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := newTestEngine(WithSecrets(secrets), WithStore(store))
+	engine.SetSecret(Secret{Name: "TOKEN", Value: "value"})
+	engine.CreatePipeline(secretPipeline(`echo "$TOKEN" > /dev/null`))
+
+	for i := 0; i < 2; i++ {
+		if _, err := engine.Run(context.Background(), "deploy", WithTriggeredBy("alice")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	job, err := engine.Run(context.Background(), "deploy", WithSource(TriggerSchedule))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestEngine(WithSecrets(secrets), WithStore(store))
+	restored.CreatePipeline(secretPipeline("true"))
+	if err := restored.RestoreSecretUsage(); err != nil {
+		t.Fatalf("RestoreSecretUsage() error = %v", err)
+	}
+	report, err := restored.SecretUsage("TOKEN")
+	if err != nil {
+		t.Fatalf("SecretUsage() error = %v", err)
+	}
+	if report.Uses != 3 || len(report.Steps) != 1 || len(report.Pipelines) != 1 || report.Pipelines[0] != "deploy" {
+		t.Fatalf("SecretUsage() = %+v, want 3 uses by one step of deploy", report)
+	}
+	step := report.Steps[0]
+	if step.LastJobID != job.ID || step.LastTriggeredBy != TriggerSchedule {
+		t.Errorf("last use = %s by %q, want %s by schedule", step.LastJobID, step.LastTriggeredBy, job.ID)
+	}
+	if len(report.References) != 1 || report.References[0].StepID != step.StepID {
+		t.Errorf("References = %+v, want the deploy step", report.References)
+	}
+
+	if _, err := restored.SecretUsage("MISSING"); err == nil {
+		t.Error("SecretUsage() of an unknown secret expected error")
+	}
+}
+
+func TestUnusedSecrets(t *testing.T) {
+	engine := newSecretEngine(t)
+	for _, name := range []string{"TOKEN", "LISTED", "ORPHAN"} {
+		engine.SetSecret(Secret{Name: name, Value: "value"})
+	}
+	pipeline := secretPipeline("true")
+	// Rollback steps only run when the stage fails
+	pipeline.Stages[0].Rollback = []Step{{ID: "undo", Type: "script", Command: "true", Secrets: []string{"LISTED"}}}
+	engine.CreatePipeline(pipeline)
+	if _, err := engine.Run(context.Background(), "deploy"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing listed is stale yet: the secrets were created after the cutoff
+	unused, err := engine.UnusedSecrets(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("UnusedSecrets() error = %v", err)
+	}
+	if len(unused) != 1 || unused[0].Name != "ORPHAN" || unused[0].Reason != UnusedUnreferenced {
+		t.Errorf("UnusedSecrets() = %+v, want only ORPHAN unreferenced", unused)
+	}
+
+	unused, _ = engine.UnusedSecrets(time.Now().Add(time.Hour))
+	reasons := make(map[string]string)
+	for _, secret := range unused {
+		reasons[secret.Name] = secret.Reason
+	}
+	want := map[string]string{"TOKEN": UnusedStale, "LISTED": UnusedStale, "ORPHAN": UnusedUnreferenced}
+	for name, reason := range want {
+		if reasons[name] != reason {
+			t.Errorf("%s reason = %q, want %q", name, reasons[name], reason)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SaveSecretUsage writes the secret usage to secret-usage.json
+func (s *FileStore) SaveSecretUsage(usage []*SecretUsage) error {
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode secret usage: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return writeFileAtomic(filepath.Join(s.dir, "secret-usage.json"), data)
+}
+
+// LoadSecretUsage reads secret-usage.json, which is empty when it doesn't
+// exist yet
+func (s *FileStore) LoadSecretUsage() ([]*SecretUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var usage []*SecretUsage
+	data, err := os.ReadFile(filepath.Join(s.dir, "secret-usage.json"))
+	if os.IsNotExist(err) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret usage: %w", err)
+	}
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, fmt.Errorf("failed to decode secret usage: %w", err)
+	}
+	return usage, nil
+}
@@ -0,0 +1,357 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Service is a sidecar container started for a stage or step, such as a
+// database for integration tests
+type Service struct {
+	// Name is the service's hostname on the network it shares with the
+	// other services, and names its environment variables
+	Name        string            `json:"name"`
+	Image       string            `json:"image"`
+	Command     []string          `json:"command,omitempty"`
+	Environment map[string]string `json:"environment,omitempty"`
+	// Ports are published on the host for steps to connect to
+	Ports  []int          `json:"ports,omitempty"`
+	Health *ServiceHealth `json:"health,omitempty"`
+}
+
+// ServiceHealth is the wait condition of a service. Without a command, a
+// service is healthy once its first port accepts connections.
+type ServiceHealth struct {
+	// Command runs inside the container and succeeds once it is ready
+	Command  string `json:"command,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	// Timeout bounds the wait, 60s by default
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// RunningService is a started service container
+type RunningService struct {
+	Service
+	ContainerID string `json:"containerId"`
+	// Addresses maps container ports to their host address
+	Addresses map[int]string `json:"addresses,omitempty"`
+}
+
+// ServiceRuntime starts service containers
+type ServiceRuntime interface {
+	CreateNetwork(ctx context.Context, name string) error
+	RemoveNetwork(ctx context.Context, name string) error
+	StartService(ctx context.Context, network, container string, service Service) (*RunningService, error)
+	// CheckHealth runs the service's health command once
+	CheckHealth(ctx context.Context, service *RunningService) error
+	StopService(ctx context.Context, service *RunningService) error
+}
+
+// WithServiceRuntime sets the runtime service containers are started with.
+// The default runs the docker CLI.
+func WithServiceRuntime(runtime ServiceRuntime) Option {
+	return func(pe *PipelineEngine) {
+		pe.serviceRuntime = runtime
+	}
+}
+
+// Defaults of service health checks
+const (
+	defaultHealthInterval = time.Second
+	defaultHealthTimeout  = time.Minute
+	serviceStopTimeout    = 30 * time.Second
+)
+
+// serviceNamePattern matches service names usable as hostnames
+var serviceNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// ValidServiceName reports whether a service name is a valid hostname
+func ValidServiceName(name string) bool {
+	return len(name) <= 63 && serviceNamePattern.MatchString(name)
+}
+
+// servicesKey is the context key of the services of a step
+type servicesKey struct{}
+
+// stepServices are the services of a step and the variables it reaches
+// them with on the host
+type stepServices struct {
+	env     map[string]string
+	running []*RunningService
+}
+
+// withServices adds services to those already in ctx
+func withServices(ctx context.Context, running []*RunningService) context.Context {
+	if len(running) == 0 {
+		return ctx
+	}
+	merged := &stepServices{env: make(map[string]string)}
+	if current, ok := ctx.Value(servicesKey{}).(*stepServices); ok {
+		for key, value := range current.env {
+			merged.env[key] = value
+		}
+		merged.running = append(merged.running, current.running...)
+	}
+	for _, service := range running {
+		for key, value := range serviceVariables(service) {
+			merged.env[key] = value
+		}
+		merged.running = append(merged.running, service)
+	}
+	return context.WithValue(ctx, servicesKey{}, merged)
+}
+
+// serviceEnv returns the service variables in ctx
+func serviceEnv(ctx context.Context) map[string]string {
+	if services, ok := ctx.Value(servicesKey{}).(*stepServices); ok {
+		return services.env
+	}
+	return nil
+}
+
+// runningServices returns the services in ctx
+func runningServices(ctx context.Context) []*RunningService {
+	if services, ok := ctx.Value(servicesKey{}).(*stepServices); ok {
+		return services.running
+	}
+	return nil
+}
+
+// servicePrefix returns the prefix of a service's variables
+func servicePrefix(name string) string {
+	return strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// networkServiceVariables returns the variables a container on a network
+// the service joined reaches it with: its name and container ports
+func networkServiceVariables(service *RunningService) map[string]string {
+	prefix := servicePrefix(service.Name)
+	env := map[string]string{prefix + "_HOST": service.Name}
+	for i, port := range service.Ports {
+		if i == 0 {
+			env[prefix+"_PORT"] = strconv.Itoa(port)
+		}
+		env[prefix+"_PORT_"+strconv.Itoa(port)] = strconv.Itoa(port)
+	}
+	return env
+}
+
+// serviceVariables returns the variables steps reach a service with:
+// NAME_HOST, NAME_PORT for the first port, and NAME_PORT_<port> for each
+func serviceVariables(service *RunningService) map[string]string {
+	prefix := servicePrefix(service.Name)
+	env := map[string]string{prefix + "_HOST": "127.0.0.1"}
+	for i, port := range service.Ports {
+		address, ok := service.Addresses[port]
+		if !ok {
+			continue
+		}
+		host, hostPort, err := net.SplitHostPort(address)
+		if err != nil {
+			continue
+		}
+		if i == 0 {
+			env[prefix+"_HOST"] = host
+			env[prefix+"_PORT"] = hostPort
+		}
+		env[prefix+"_PORT_"+strconv.Itoa(port)] = hostPort
+	}
+	return env
+}
+
+// networkNameInvalid matches characters not allowed in network names
+var networkNameInvalid = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// serviceNetwork returns the network name of a job's services for scope
+func serviceNetwork(jobID, scope string) string {
+	return networkNameInvalid.ReplaceAllString(strings.ToLower("conveyor-"+jobID+"-"+scope), "-")
+}
+
+// startServices starts services on their own network and waits until they
+// are healthy. The returned function stops them.
+func (pe *PipelineEngine) startServices(ctx context.Context, job *Job, stepID, scope string, services []Service) ([]*RunningService, func(), error) {
+	if len(services) == 0 {
+		return nil, func() {}, nil
+	}
+	runtime := pe.serviceRuntime
+	if runtime == nil {
+		return nil, nil, fmt.Errorf("services require a service runtime")
+	}
+
+	network := serviceNetwork(job.ID, scope)
+	if err := runtime.CreateNetwork(ctx, network); err != nil {
+		return nil, nil, fmt.Errorf("failed to create service network: %w", err)
+	}
+
+	var started []*RunningService
+	stop := func() {
+		stopCtx, cancel := context.WithTimeout(context.Background(), serviceStopTimeout)
+		defer cancel()
+		for i := len(started) - 1; i >= 0; i-- {
+			if err := runtime.StopService(stopCtx, started[i]); err != nil {
+				pe.logJob(job, "warn", stepID, fmt.Sprintf("Failed to stop service %s: %v", started[i].Name, err))
+			}
+		}
+		if err := runtime.RemoveNetwork(stopCtx, network); err != nil {
+			pe.logJob(job, "warn", stepID, fmt.Sprintf("Failed to remove service network: %v", err))
+		}
+	}
+
+	for _, service := range services {
+		running, err := runtime.StartService(ctx, network, network+"-"+service.Name, service)
+		if err != nil {
+			stop()
+			return nil, nil, fmt.Errorf("failed to start service %s: %w", service.Name, err)
+		}
+		started = append(started, running)
+		pe.logJob(job, "info", stepID, fmt.Sprintf("Started service %s (%s)", service.Name, service.Image))
+	}
+	for _, running := range started {
+		if err := pe.waitHealthy(ctx, runtime, running); err != nil {
+			stop()
+			return nil, nil, err
+		}
+	}
+	return started, stop, nil
+}
+
+// waitHealthy waits for a service's health command to succeed, or for its
+// first port to accept connections
+func (pe *PipelineEngine) waitHealthy(ctx context.Context, runtime ServiceRuntime, service *RunningService) error {
+	interval, timeout := defaultHealthInterval, defaultHealthTimeout
+	command := ""
+	if health := service.Health; health != nil {
+		command = health.Command
+		if health.Interval != "" {
+			d, err := time.ParseDuration(health.Interval)
+			if err != nil {
+				return fmt.Errorf("service %s: invalid health interval %q", service.Name, health.Interval)
+			}
+			interval = d
+		}
+		if health.Timeout != "" {
+			d, err := time.ParseDuration(health.Timeout)
+			if err != nil {
+				return fmt.Errorf("service %s: invalid health timeout %q", service.Name, health.Timeout)
+			}
+			timeout = d
+		}
+	}
+
+	check := func() error { return nil }
+	switch {
+	case command != "":
+		check = func() error { return runtime.CheckHealth(ctx, service) }
+	case len(service.Ports) > 0:
+		address := service.Addresses[service.Ports[0]]
+		check = func() error {
+			conn, err := net.DialTimeout("tcp", address, interval)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service %s did not become healthy within %s: %v", service.Name, timeout, err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for service %s: %w", service.Name, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+// DockerRuntime runs services with the docker CLI
+type DockerRuntime struct {
+	// Binary is the docker binary. Defaults to "docker".
+	Binary string
+}
+
+// run runs a docker command and returns its trimmed output
+func (d *DockerRuntime) run(ctx context.Context, args ...string) (string, error) {
+	binary := d.Binary
+	if binary == "" {
+		binary = "docker"
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s %s: %s", binary, args[0], msg)
+		}
+		return "", fmt.Errorf("%s %s: %w", binary, args[0], err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// CreateNetwork creates a bridge network
+func (d *DockerRuntime) CreateNetwork(ctx context.Context, name string) error {
+	_, err := d.run(ctx, "network", "create", name)
+	return err
+}
+
+// RemoveNetwork removes a network
+func (d *DockerRuntime) RemoveNetwork(ctx context.Context, name string) error {
+	_, err := d.run(ctx, "network", "rm", name)
+	return err
+}
+
+// StartService runs a detached container reachable by the service name on
+// the network, with its ports published on localhost
+func (d *DockerRuntime) StartService(ctx context.Context, network, container string, service Service) (*RunningService, error) {
+	args := []string{"run", "--detach", "--name", container, "--network", network, "--network-alias", service.Name}
+	for key, value := range service.Environment {
+		args = append(args, "--env", key+"="+value)
+	}
+	for _, port := range service.Ports {
+		args = append(args, "--publish", fmt.Sprintf("127.0.0.1::%d", port))
+	}
+	args = append(args, service.Image)
+	args = append(args, service.Command...)
+
+	id, err := d.run(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	running := &RunningService{Service: service, ContainerID: id, Addresses: make(map[int]string)}
+	for _, port := range service.Ports {
+		out, err := d.run(ctx, "port", id, fmt.Sprintf("%d/tcp", port))
+		if err != nil {
+			d.StopService(ctx, running)
+			return nil, err
+		}
+		running.Addresses[port] = strings.SplitN(out, "\n", 2)[0]
+	}
+	return running, nil
+}
+
+// CheckHealth runs the health command in the container
+func (d *DockerRuntime) CheckHealth(ctx context.Context, service *RunningService) error {
+	_, err := d.run(ctx, "exec", service.ContainerID, "sh", "-c", service.Health.Command)
+	return err
+}
+
+// StopService removes the container
+func (d *DockerRuntime) StopService(ctx context.Context, service *RunningService) error {
+	_, err := d.run(ctx, "rm", "--force", "--volumes", service.ContainerID)
+	return err
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRuntime starts services that listen on a local port
+type fakeRuntime struct {
+	mu        sync.Mutex
+	calls     []string
+	unhealthy int
+	listeners []net.Listener
+}
+
+func (r *fakeRuntime) record(call string) {
+	r.mu.Lock()
+	r.calls = append(r.calls, call)
+	r.mu.Unlock()
+}
+
+func (r *fakeRuntime) CreateNetwork(ctx context.Context, name string) error {
+	r.record("network " + name)
+	return nil
+}
+
+func (r *fakeRuntime) RemoveNetwork(ctx context.Context, name string) error {
+	r.record("rm network " + name)
+	return nil
+}
+
+func (r *fakeRuntime) StartService(ctx context.Context, network, container string, service Service) (*RunningService, error) {
+	r.record("start " + service.Name)
+	running := &RunningService{Service: service, ContainerID: container, Addresses: make(map[int]string)}
+	for _, port := range service.Ports {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		r.listeners = append(r.listeners, listener)
+		running.Addresses[port] = listener.Addr().String()
+	}
+	return running, nil
+}
+
+func (r *fakeRuntime) CheckHealth(ctx context.Context, service *RunningService) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.unhealthy > 0 {
+		r.unhealthy--
+		return errors.New("not ready")
+	}
+	return nil
+}
+
+func (r *fakeRuntime) StopService(ctx context.Context, service *RunningService) error {
+	r.record("stop " + service.Name)
+	return nil
+}
+
+func (r *fakeRuntime) close() {
+	for _, listener := range r.listeners {
+		listener.Close()
+	}
+}
+
+func TestRun_StepServices(t *testing.T) {
+	runtime := &fakeRuntime{unhealthy: 2}
+	defer runtime.close()
+	engine := newTestEngine(WithServiceRuntime(runtime))
+	pipeline := scriptPipeline("it", `echo "$POSTGRES_HOST:$POSTGRES_PORT $POSTGRES_PORT_5432 $REDIS_CACHE_HOST"`, `echo "${POSTGRES_PORT:-none}"`)
+	pipeline.Stages[0].Steps[0].Services = []Service{
+		{Name: "postgres", Image: "postgres:15", Ports: []int{5432}, Health: &ServiceHealth{Command: "pg_isready", Interval: "10ms"}},
+		{Name: "redis-cache", Image: "redis:7"},
+	}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "it")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess {
+		t.Fatalf("Status = %q, want success; logs: %+v", job.Status, job.Logs)
+	}
+
+	address := strings.Fields(job.Steps[0].Output)
+	if len(address) != 3 || !strings.HasPrefix(address[0], "127.0.0.1:") || !strings.HasSuffix(address[0], ":"+address[1]) || address[2] != "127.0.0.1" {
+		t.Errorf("Output = %q, want service addresses", job.Steps[0].Output)
+	}
+	if job.Steps[1].Output != "none\n" {
+		t.Errorf("second step Output = %q, want no services", job.Steps[1].Output)
+	}
+
+	network := serviceNetwork(job.ID, "build-step-a")
+	want := []string{"network " + network, "start postgres", "start redis-cache", "stop redis-cache", "stop postgres", "rm network " + network}
+	if strings.Join(runtime.calls, ",") != strings.Join(want, ",") {
+		t.Errorf("calls = %v, want %v", runtime.calls, want)
+	}
+}
+
+func TestRun_StageServicesWaitForPort(t *testing.T) {
+	runtime := &fakeRuntime{}
+	defer runtime.close()
+	engine := newTestEngine(WithServiceRuntime(runtime))
+	pipeline := scriptPipeline("it", `test -n "$DB_PORT"`, `test -n "$DB_PORT"`)
+	pipeline.Stages[0].Services = []Service{{Name: "db", Image: "postgres:15", Ports: []int{5432}}}
+	engine.CreatePipeline(pipeline)
+
+	job, _ := engine.Run(context.Background(), "it")
+	if job.Status != StatusSuccess {
+		t.Fatalf("Status = %q, want success; logs: %+v", job.Status, job.Logs)
+	}
+	if strings.Count(strings.Join(runtime.calls, ","), "start db") != 1 {
+		t.Errorf("calls = %v, want the stage service started once", runtime.calls)
+	}
+}
+
+func TestRun_UnhealthyServiceFailsStep(t *testing.T) {
+	runtime := &fakeRuntime{unhealthy: 1000}
+	engine := newTestEngine(WithServiceRuntime(runtime))
+	pipeline := scriptPipeline("it", "echo unreachable")
+	pipeline.Stages[0].Steps[0].Services = []Service{
+		{Name: "db", Image: "postgres:15", Health: &ServiceHealth{Command: "pg_isready", Interval: "5ms", Timeout: "30ms"}},
+	}
+	engine.CreatePipeline(pipeline)
+
+	job, _ := engine.Run(context.Background(), "it")
+	if job.Status != StatusFailed {
+		t.Fatalf("Status = %q, want failed", job.Status)
+	}
+	if job.Steps[0].Output != "" {
+		t.Errorf("Output = %q, want the step not run", job.Steps[0].Output)
+	}
+	found := false
+	for _, entry := range job.Logs {
+		found = found || strings.Contains(entry.Message, "service db did not become healthy within 30ms")
+	}
+	if !found {
+		t.Errorf("Logs = %+v, want the health check failure", job.Logs)
+	}
+	if calls := strings.Join(runtime.calls, ","); !strings.Contains(calls, "stop db") || !strings.HasSuffix(calls, "rm network "+serviceNetwork(job.ID, "build-step-a")) {
+		t.Errorf("calls = %v, want the service torn down", runtime.calls)
+	}
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// canSpeculate reports whether next may start while verify is still running.
+// Speculation only pays off when verify still has work left to do.
+func canSpeculate(verify, next Stage, completed map[string]bool) bool {
+	if !verify.AllowFailure || !next.Speculative {
+		return false
+	}
+	for _, step := range verify.Steps {
+		if !completed[step.ID] {
+			return true
+		}
+	}
+	return false
+}
+
+// runSpeculative runs the speculative stage alongside the verification stage
+// it follows. When verification fails, the speculative work is cancelled,
+// rolled back and run again now that verification has finished.
+func (pe *PipelineEngine) runSpeculative(ctx context.Context, pipeline *Pipeline, job *Job, verify, speculative Stage, completed map[string]bool) Status {
+	pe.logJob(job, "info", "", fmt.Sprintf("starting stage %s speculatively while %s runs", speculative.ID, verify.ID))
+	pe.emitSpeculationEvent("speculation.started", pipeline, job, verify, speculative)
+
+	specCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan Status, 1)
+	go func() {
+		done <- pe.runStage(specCtx, pipeline, job, withoutMemoize(speculative), completed, false)
+	}()
+
+	verified := pe.runStage(ctx, pipeline, job, verify, completed, false)
+	if verified == StatusSuccess || verified == StatusSkipped {
+		status := <-done
+		pe.emitSpeculationEvent("speculation.confirmed", pipeline, job, verify, speculative)
+		return stageOutcome(speculative, status)
+	}
+
+	cancel()
+	<-done
+	if verified != StatusFailed {
+		return verified
+	}
+
+	pe.logJob(job, "warn", "", fmt.Sprintf("stage %s failed, rolling back speculative stage %s", verify.ID, speculative.ID))
+	if status := pe.rollbackStage(ctx, pipeline, job, speculative); status != StatusSuccess {
+		return status
+	}
+	pe.emitSpeculationEvent("speculation.rolledback", pipeline, job, verify, speculative)
+
+	return stageOutcome(speculative, pe.runStage(ctx, pipeline, job, speculative, completed, false))
+}
+
+// rollbackStage marks the speculative steps of a stage as rolled back and
+// runs the stage's rollback steps if any of them started
+func (pe *PipelineEngine) rollbackStage(ctx context.Context, pipeline *Pipeline, job *Job, stage Stage) Status {
+	ids := make(map[string]bool, len(stage.Steps))
+	for _, step := range stage.Steps {
+		ids[step.ID] = true
+	}
+
+	started := false
+	pe.mu.Lock()
+	for i := range job.Steps {
+		if ids[job.Steps[i].ID] {
+			job.Steps[i].RolledBack = true
+			started = true
+		}
+	}
+	pe.mu.Unlock()
+
+	if !started {
+		return StatusSuccess
+	}
+
+	rollback := withoutMemoize(Stage{ID: stage.ID, Steps: stage.Rollback, RunsOn: stage.RunsOn})
+	return pe.runStage(ctx, pipeline, job, rollback, nil, false)
+}
+
+// withoutMemoize returns a copy of a stage whose steps never read or record
+// memoized results, since speculative work may be rolled back
+func withoutMemoize(stage Stage) Stage {
+	steps := make([]Step, len(stage.Steps))
+	for i, step := range stage.Steps {
+		step.Memoize = nil
+		steps[i] = step
+	}
+	stage.Steps = steps
+	return stage
+}
+
+// logJob appends a log entry to a job
+func (pe *PipelineEngine) logJob(job *Job, level, stepID, message string) {
+	message = pe.redact(job.PipelineID, stepID, message)
+	pe.mu.Lock()
+	job.Logs = append(job.Logs, LogEntry{
+		Timestamp: time.Now(),
+		Level:     level,
+		Message:   message,
+		StepID:    stepID,
+	})
+	pe.mu.Unlock()
+}
+
+// emitSpeculationEvent emits an event about a speculative stage
+func (pe *PipelineEngine) emitSpeculationEvent(eventType string, pipeline *Pipeline, job *Job, verify, speculative Stage) {
+	pe.emitEvent(Event{
+		Type:       eventType,
+		Timestamp:  time.Now(),
+		PipelineID: pipeline.ID,
+		JobID:      job.ID,
+		Data: map[string]interface{}{
+			"stage":     speculative.ID,
+			"verifying": verify.ID,
+		},
+	})
+}
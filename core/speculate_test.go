@@ -0,0 +1,174 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// speculativePipeline runs a verify stage that allows failure, followed by a
+// speculative deploy stage that appends to deploy.log and a rollback step
+// that records the undo in rollback.log
+func speculativePipeline(verifyCommand string) *Pipeline {
+	return &Pipeline{
+		ID:   "speculative",
+		Name: "speculative",
+		Stages: []Stage{
+			{
+				ID:           "verify",
+				Name:         "verify",
+				AllowFailure: true,
+				Steps:        []Step{{ID: "verify-check", Name: "check", Type: "script", Command: verifyCommand}},
+			},
+			{
+				ID:          "deploy",
+				Name:        "deploy",
+				Speculative: true,
+				Steps:       []Step{{ID: "deploy-push", Name: "push", Type: "script", Command: "echo push >> deploy.log"}},
+				Rollback:    []Step{{ID: "deploy-rollback-undo", Name: "undo", Type: "script", Command: "echo undo >> rollback.log"}},
+			},
+		},
+	}
+}
+
+func runSpeculativeJob(t *testing.T, verifyCommand string) (*Job, string) {
+	t.Helper()
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	if err := engine.CreatePipeline(speculativePipeline(verifyCommand)); err != nil {
+		t.Fatalf("CreatePipeline() error = %v", err)
+	}
+
+	job, err := engine.Run(context.Background(), "speculative")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	return job, dir
+}
+
+func lines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, b := range data {
+		if b == '\n' {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRun_SpeculativeStageConfirmed(t *testing.T) {
+	job, dir := runSpeculativeJob(t, "sleep 0.2")
+
+	if job.Status != StatusSuccess {
+		t.Fatalf("Status = %q, want success", job.Status)
+	}
+	if len(job.Steps) != 2 {
+		t.Fatalf("len(Steps) = %d, want 2", len(job.Steps))
+	}
+
+	var verify, deploy StepStatus
+	for _, step := range job.Steps {
+		switch step.ID {
+		case "verify-check":
+			verify = step
+		case "deploy-push":
+			deploy = step
+		}
+	}
+	if !deploy.StartedAt.Before(verify.EndedAt) {
+		t.Error("deploy did not start before verify finished")
+	}
+	if deploy.RolledBack {
+		t.Error("confirmed speculative step marked as rolled back")
+	}
+	if got := lines(t, filepath.Join(dir, "deploy.log")); got != 1 {
+		t.Errorf("deploy ran %d times, want 1", got)
+	}
+	if got := lines(t, filepath.Join(dir, "rollback.log")); got != 0 {
+		t.Errorf("rollback ran %d times, want 0", got)
+	}
+}
+
+func TestRun_SpeculativeStageRolledBack(t *testing.T) {
+	job, dir := runSpeculativeJob(t, "sleep 0.2; exit 1")
+
+	if job.Status != StatusSuccess {
+		t.Fatalf("Status = %q, want success since verify allows failure", job.Status)
+	}
+
+	var ids []string
+	for _, step := range job.Steps {
+		ids = append(ids, step.ID)
+	}
+	if len(job.Steps) != 4 {
+		t.Fatalf("steps = %v, want verify, speculative deploy, rollback and deploy", ids)
+	}
+	var deploys []StepStatus
+	for _, step := range job.Steps {
+		if step.ID == "deploy-push" {
+			deploys = append(deploys, step)
+		}
+	}
+	if len(deploys) != 2 || !deploys[0].RolledBack {
+		t.Fatalf("deploy steps = %+v, want a rolled back speculative run first", deploys)
+	}
+	last := job.Steps[3]
+	if last.ID != "deploy-push" || last.RolledBack || last.Status != StatusSuccess {
+		t.Errorf("last step = %+v, want deploy run again", last)
+	}
+	if got := lines(t, filepath.Join(dir, "rollback.log")); got != 1 {
+		t.Errorf("rollback ran %d times, want 1", got)
+	}
+	if got := lines(t, filepath.Join(dir, "deploy.log")); got != 2 {
+		t.Errorf("deploy ran %d times, want 2", got)
+	}
+}
+
+func TestRun_FailedRollbackFailsJob(t *testing.T) {
+	dir := t.TempDir()
+	engine := newTestEngine(WithExecutor(&ShellExecutor{Dir: dir}))
+	pipeline := speculativePipeline("sleep 0.2; exit 1")
+	pipeline.Stages[1].Rollback[0].Command = "exit 3"
+	if err := engine.CreatePipeline(pipeline); err != nil {
+		t.Fatalf("CreatePipeline() error = %v", err)
+	}
+
+	job, err := engine.Run(context.Background(), "speculative")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusFailed {
+		t.Errorf("Status = %q, want failed", job.Status)
+	}
+}
+
+func TestRun_AllowFailureStage(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("lenient", "exit 1")
+	pipeline.Stages[0].AllowFailure = true
+	pipeline.Stages = append(pipeline.Stages, Stage{
+		ID:    "after",
+		Name:  "after",
+		Steps: []Step{{ID: "after-a", Name: "a", Type: "script", Command: "true"}},
+	})
+	if err := engine.CreatePipeline(pipeline); err != nil {
+		t.Fatalf("CreatePipeline() error = %v", err)
+	}
+
+	job, err := engine.Run(context.Background(), "lenient")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess || len(job.Steps) != 2 {
+		t.Errorf("Status = %q with %d steps, want success after both stages", job.Status, len(job.Steps))
+	}
+}
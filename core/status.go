@@ -0,0 +1,135 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Status is the lifecycle state of a job or step
+type Status string
+
+// Job and step statuses. StatusInterrupted marks work that stopped because
+// the server shut down before it finished. StatusCached marks a step that
+// was skipped because a memoized result of an identical run was reused.
+// StatusWarning and StatusSkipped are outcomes a step's exit code can be
+// mapped to; both let the job continue.
+const (
+	StatusPending     Status = "pending"
+	StatusRunning     Status = "running"
+	StatusSuccess     Status = "success"
+	StatusFailed      Status = "failed"
+	StatusCancelled   Status = "cancelled"
+	StatusInterrupted Status = "interrupted"
+	StatusCached      Status = "cached"
+	StatusWarning     Status = "warning"
+	StatusSkipped     Status = "skipped"
+)
+
+// statusTransitions lists the statuses each status may move to. Statuses
+// without an entry are terminal.
+var statusTransitions = map[Status][]Status{
+	StatusPending: {StatusRunning, StatusFailed, StatusCancelled, StatusInterrupted},
+	StatusRunning: {StatusSuccess, StatusCached, StatusWarning, StatusSkipped, StatusFailed, StatusCancelled, StatusInterrupted},
+}
+
+// allStatuses lists every known status in lifecycle order
+var allStatuses = []Status{
+	StatusPending,
+	StatusRunning,
+	StatusSuccess,
+	StatusFailed,
+	StatusCancelled,
+	StatusInterrupted,
+	StatusCached,
+	StatusWarning,
+	StatusSkipped,
+}
+
+// Statuses returns every known status in lifecycle order
+func Statuses() []Status {
+	return append([]Status(nil), allStatuses...)
+}
+
+// ParseStatus converts a string to a Status, ignoring case and surrounding space
+func ParseStatus(s string) (Status, error) {
+	status := Status(strings.ToLower(strings.TrimSpace(s)))
+	if !status.Valid() {
+		return "", fmt.Errorf("unknown status %q", s)
+	}
+	return status, nil
+}
+
+// Valid reports whether the status is a known status
+func (s Status) Valid() bool {
+	for _, status := range allStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTerminal reports whether no further transitions are allowed from the status
+func (s Status) IsTerminal() bool {
+	return s.Valid() && len(statusTransitions[s]) == 0
+}
+
+// Succeeded reports whether the status is a successful outcome, either by
+// running or by reusing a cached result, including steps that warned or
+// skipped their work
+func (s Status) Succeeded() bool {
+	return s == StatusSuccess || s == StatusCached || s == StatusWarning || s == StatusSkipped
+}
+
+// AllowedTransitions returns the statuses that may follow s
+func (s Status) AllowedTransitions() []Status {
+	transitions := make([]Status, len(statusTransitions[s]))
+	copy(transitions, statusTransitions[s])
+	return transitions
+}
+
+// CanTransitionTo reports whether moving from s to next is allowed
+func (s Status) CanTransitionTo(next Status) bool {
+	for _, allowed := range statusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateTransition returns an error if moving from s to next is not allowed
+func (s Status) ValidateTransition(next Status) error {
+	if !next.Valid() {
+		return fmt.Errorf("unknown status %q", next)
+	}
+	if !s.CanTransitionTo(next) {
+		return fmt.Errorf("invalid status transition from %s to %s", s, next)
+	}
+	return nil
+}
+
+// String returns the status as a string
+func (s Status) String() string {
+	return string(s)
+}
+
+// UnmarshalJSON decodes a status, normalizing case and rejecting unknown values
+func (s *Status) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("status must be a string: %w", err)
+	}
+	if raw == "" {
+		*s = ""
+		return nil
+	}
+
+	status, err := ParseStatus(raw)
+	if err != nil {
+		return err
+	}
+	*s = status
+	return nil
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStatus_Transitions(t *testing.T) {
+	tests := []struct {
+		from, to Status
+		want     bool
+	}{
+		{StatusPending, StatusRunning, true},
+		{StatusPending, StatusCancelled, true},
+		{StatusPending, StatusSuccess, false},
+		{StatusRunning, StatusSuccess, true},
+		{StatusRunning, StatusFailed, true},
+		{StatusRunning, StatusCancelled, true},
+		{StatusSuccess, StatusRunning, false},
+		{StatusFailed, StatusSuccess, false},
+		{StatusCancelled, StatusRunning, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.from.CanTransitionTo(tt.to); got != tt.want {
+			t.Errorf("%s.CanTransitionTo(%s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+		err := tt.from.ValidateTransition(tt.to)
+		if (err == nil) != tt.want {
+			t.Errorf("%s.ValidateTransition(%s) error = %v, want error = %v", tt.from, tt.to, err, !tt.want)
+		}
+	}
+}
+
+func TestStatus_IsTerminal(t *testing.T) {
+	for _, status := range []Status{StatusSuccess, StatusFailed, StatusCancelled} {
+		if !status.IsTerminal() {
+			t.Errorf("%s.IsTerminal() = false, want true", status)
+		}
+		if len(status.AllowedTransitions()) != 0 {
+			t.Errorf("%s.AllowedTransitions() = %v, want none", status, status.AllowedTransitions())
+		}
+	}
+	for _, status := range []Status{StatusPending, StatusRunning, Status("bogus")} {
+		if status.IsTerminal() {
+			t.Errorf("%s.IsTerminal() = true, want false", status)
+		}
+	}
+}
+
+func TestStatus_JSON(t *testing.T) {
+	data, err := json.Marshal(StatusSuccess)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if string(data) != `"success"` {
+		t.Errorf("Marshal() = %s, want %q", data, "success")
+	}
+
+	var status Status
+	if err := json.Unmarshal([]byte(`"FAILED"`), &status); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if status != StatusFailed {
+		t.Errorf("Unmarshal() = %q, want %q", status, StatusFailed)
+	}
+
+	if err := json.Unmarshal([]byte(`"done"`), &status); err == nil {
+		t.Error("Unmarshal() expected error for unknown status, got nil")
+	}
+}
+
+func TestUpdateJob_RejectsInvalidTransition(t *testing.T) {
+	engine := newTestEngine()
+	engine.AddJob(&Job{ID: "job-1", PipelineID: "p", Status: StatusSuccess})
+
+	err := engine.UpdateJob(&Job{ID: "job-1", PipelineID: "p", Status: StatusRunning})
+	if err == nil {
+		t.Fatal("UpdateJob() expected error for success -> running, got nil")
+	}
+
+	engine.AddJob(&Job{ID: "job-2", PipelineID: "p"})
+	if err := engine.UpdateJob(&Job{ID: "job-2", PipelineID: "p", Status: StatusRunning}); err != nil {
+		t.Errorf("UpdateJob() error = %v for pending -> running", err)
+	}
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// StepProgress is the progress of a long-running plugin step
+type StepProgress struct {
+	Done  int    `json:"done"`
+	Total int    `json:"total"`
+	Unit  string `json:"unit,omitempty"`
+	// Rate is how many units are done per second
+	Rate float64 `json:"rate,omitempty"`
+}
+
+// Percent returns how much of the work is done, from 0 to 100
+func (p StepProgress) Percent() float64 {
+	if p.Total <= 0 {
+		return 0
+	}
+	return float64(p.Done) * 100 / float64(p.Total)
+}
+
+// stepReporter writes to the job log on behalf of the plugin step it is
+// passed to
+type stepReporter struct {
+	engine     *PipelineEngine
+	pipelineID string
+	job        *Job
+	stepID     string
+	secrets    map[string]string
+}
+
+// stepReporterKey is the context key of the reporter of a plugin step
+type stepReporterKey struct{}
+
+// withStepReporter returns a context plugins log to the job of step with
+func (pe *PipelineEngine) withStepReporter(ctx context.Context, pipeline *Pipeline, job *Job, step Step, secrets map[string]string) context.Context {
+	return context.WithValue(ctx, stepReporterKey{}, &stepReporter{
+		engine:     pe,
+		pipelineID: pipeline.ID,
+		job:        job,
+		stepID:     step.ID,
+		secrets:    secrets,
+	})
+}
+
+// LogStep adds a message to the job log of the plugin step executing with
+// ctx, masking secrets. It does nothing outside a step.
+func LogStep(ctx context.Context, level, message string) {
+	reporter, ok := ctx.Value(stepReporterKey{}).(*stepReporter)
+	if !ok {
+		return
+	}
+	reporter.engine.logJob(reporter.job, level, reporter.stepID, maskSecrets(message, reporter.secrets))
+}
+
+// ReportStepProgress logs the progress of the plugin step executing with ctx
+// and emits it as a step.progress event. It does nothing outside a step.
+func ReportStepProgress(ctx context.Context, progress StepProgress) {
+	reporter, ok := ctx.Value(stepReporterKey{}).(*stepReporter)
+	if !ok {
+		return
+	}
+	message := fmt.Sprintf("%d/%d %s (%.0f%%)", progress.Done, progress.Total, progress.Unit, progress.Percent())
+	if progress.Rate > 0 {
+		message += fmt.Sprintf(", %.1f %s/s", progress.Rate, progress.Unit)
+	}
+	reporter.engine.logJob(reporter.job, "info", reporter.stepID, message)
+	reporter.engine.emitEvent(Event{
+		Type:       "step.progress",
+		Timestamp:  time.Now(),
+		PipelineID: reporter.pipelineID,
+		JobID:      reporter.job.ID,
+		StepID:     reporter.stepID,
+		Data: map[string]interface{}{
+			"done":    progress.Done,
+			"total":   progress.Total,
+			"unit":    progress.Unit,
+			"percent": progress.Percent(),
+			"rate":    progress.Rate,
+		},
+	})
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRun_PluginLogsAndProgress(t *testing.T) {
+	plugin := &fakePlugin{name: "scan", run: func(ctx context.Context) {
+		LogStep(ctx, "warn", "skipped a file with token s3cr3t")
+		ReportStepProgress(ctx, StepProgress{Done: 1, Total: 4, Unit: "files"})
+	}}
+	engine := newSecretEngine(t)
+	engine.RegisterPlugin(plugin)
+	engine.SetSecret(Secret{Name: "TOKEN", Value: "s3cr3t"})
+	engine.CreatePipeline(&Pipeline{
+		ID:     "scan",
+		Stages: []Stage{{ID: "check", Steps: []Step{{ID: "scan", Plugin: "scan", Secrets: []string{"TOKEN"}}}}},
+	})
+
+	job, err := engine.Run(context.Background(), "scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := make(map[string]string)
+	for _, entry := range job.Logs {
+		if entry.StepID == "scan" {
+			logged[entry.Message] = entry.Level
+		}
+	}
+	if logged["skipped a file with token ***"] != "warn" || logged["1/4 files (25%)"] != "info" {
+		t.Errorf("step logs = %v, want the masked warning and the progress", logged)
+	}
+
+	events, err := engine.JobEvents(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var progress *Event
+	for i := range events {
+		if events[i].Type == "step.progress" {
+			progress = &events[i]
+		}
+	}
+	if progress == nil || progress.StepID != "scan" || progress.Data["done"] != 1 || progress.Data["total"] != 4 {
+		t.Errorf("step.progress event = %+v", progress)
+	}
+
+	// Outside a step there is no job to log to
+	LogStep(context.Background(), "info", "ignored")
+	ReportStepProgress(context.Background(), StepProgress{Done: 1, Total: 1})
+}
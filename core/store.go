@@ -0,0 +1,171 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Store persists engine state so it survives a server restart
+type Store interface {
+	SaveJob(job *Job) error
+	LoadJobs() ([]*Job, error)
+}
+
+// FileStore persists jobs as JSON files in a directory
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileStore creates a FileStore rooted at dir, creating it if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	for _, sub := range []string{"jobs", "results"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create store directory: %w", err)
+		}
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// SaveJob writes a job to disk, replacing any previous version atomically
+func (s *FileStore) SaveJob(job *Job) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode job %s: %w", job.ID, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return writeFileAtomic(s.jobPath(job.ID), data)
+}
+
+// LoadJobs reads all persisted jobs ordered by start time
+func (s *FileStore) LoadJobs() ([]*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(s.dir, "jobs", "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+
+	jobs := make([]*Job, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+		jobs = append(jobs, &job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].StartedAt.Before(jobs[j].StartedAt)
+	})
+
+	return jobs, nil
+}
+
+// SaveResult writes a memoized step result to disk
+func (s *FileStore) SaveResult(result *CachedResult) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode cached result: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return writeFileAtomic(s.resultPath(result.Key), data)
+}
+
+// LoadResult reads a memoized step result, returning nil if there is none
+func (s *FileStore) LoadResult(key string) (*CachedResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.resultPath(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached result: %w", err)
+	}
+
+	var result CachedResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode cached result: %w", err)
+	}
+	return &result, nil
+}
+
+// DeleteResults removes the memoized results of a pipeline
+func (s *FileStore) DeleteResults(pipelineID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(s.dir, "results", "*.json"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to list cached results: %w", err)
+	}
+
+	removed := 0
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var result CachedResult
+		if err := json.Unmarshal(data, &result); err != nil || result.PipelineID != pipelineID {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return removed, fmt.Errorf("failed to delete %s: %w", path, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// resultPath returns the file a memoized result is stored in. Keys are hex
+// digests and safe to use as file names.
+func (s *FileStore) resultPath(key string) string {
+	return filepath.Join(s.dir, "results", key+".json")
+}
+
+// jobPath returns the file a job is stored in
+func (s *FileStore) jobPath(id string) string {
+	return filepath.Join(s.dir, "jobs", strings.ReplaceAll(id, string(filepath.Separator), "_")+".json")
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
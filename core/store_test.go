@@ -0,0 +1,38 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFileStore_RoundTrip(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+
+	now := time.Now()
+	first := &Job{ID: "job-1", PipelineID: "p", Status: StatusSuccess, StartedAt: now.Add(-time.Minute)}
+	second := &Job{ID: "job-2", PipelineID: "p", Status: StatusRunning, StartedAt: now}
+	store.SaveJob(second)
+	store.SaveJob(first)
+
+	first.Status = StatusFailed
+	if err := store.SaveJob(first); err != nil {
+		t.Fatalf("SaveJob() error = %v", err)
+	}
+
+	jobs, err := store.LoadJobs()
+	if err != nil {
+		t.Fatalf("LoadJobs() error = %v", err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("len(jobs) = %d, want 2", len(jobs))
+	}
+	if jobs[0].ID != "job-1" || jobs[0].Status != StatusFailed {
+		t.Errorf("jobs[0] = %s/%s, want job-1/failed", jobs[0].ID, jobs[0].Status)
+	}
+	if jobs[1].ID != "job-2" {
+		t.Errorf("jobs[1].ID = %s, want job-2", jobs[1].ID)
+	}
+}
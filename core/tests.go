@@ -0,0 +1,100 @@
+package core
+
+// Test case statuses
+const (
+	TestPassed  = "passed"
+	TestFailed  = "failed"
+	TestSkipped = "skipped"
+	// TestFlaky is a test that failed before passing on a retry
+	TestFlaky = "flaky"
+)
+
+// TestReport is the results of the tests a step ran. Plugins report them
+// as their "testReport" output and they are recorded on the step.
+type TestReport struct {
+	// Tool is the test runner, such as playwright
+	Tool       string     `json:"tool"`
+	Total      int        `json:"total"`
+	Passed     int        `json:"passed"`
+	Failed     int        `json:"failed"`
+	Skipped    int        `json:"skipped"`
+	Flaky      int        `json:"flaky"`
+	DurationMs int64      `json:"durationMs"`
+	Cases      []TestCase `json:"cases"`
+}
+
+// TestCase is a test of a report
+type TestCase struct {
+	// Suite is the file and the groups the test is in
+	Suite      string `json:"suite,omitempty"`
+	Name       string `json:"name"`
+	File       string `json:"file,omitempty"`
+	Line       int    `json:"line,omitempty"`
+	Status     string `json:"status"`
+	DurationMs int64  `json:"durationMs"`
+	// Retries is how often the test was retried
+	Retries int    `json:"retries,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Attachments are the screenshots, videos and traces of the test
+	Attachments []TestAttachment `json:"attachments,omitempty"`
+}
+
+// TestAttachment is a file of a test stored in a job artifact
+type TestAttachment struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType,omitempty"`
+	Artifact    string `json:"artifact"`
+	// Path is the file's path within the artifact
+	Path string `json:"path"`
+}
+
+// StepTestReport is the test report of a job's step
+type StepTestReport struct {
+	StepID string `json:"stepId"`
+	TestReport
+}
+
+// Count sets the report's totals from its cases
+func (r *TestReport) Count() {
+	r.Total, r.Passed, r.Failed, r.Skipped, r.Flaky = len(r.Cases), 0, 0, 0, 0
+	for _, c := range r.Cases {
+		switch c.Status {
+		case TestPassed:
+			r.Passed++
+		case TestFailed:
+			r.Failed++
+		case TestSkipped:
+			r.Skipped++
+		case TestFlaky:
+			r.Flaky++
+		}
+	}
+}
+
+// JobTestReports returns the test reports of a job's steps in step order
+func (pe *PipelineEngine) JobTestReports(jobID string) ([]StepTestReport, error) {
+	job, err := pe.FindJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	reports := []StepTestReport{}
+	for _, step := range job.Steps {
+		if step.TestReport != nil {
+			reports = append(reports, StepTestReport{StepID: step.ID, TestReport: *step.TestReport})
+		}
+	}
+	return reports, nil
+}
+
+// pluginTestReport takes the test report out of a plugin's outputs
+func pluginTestReport(outputs map[string]interface{}) *TestReport {
+	report, ok := outputs["testReport"].(*TestReport)
+	if !ok {
+		return nil
+	}
+	delete(outputs, "testReport")
+	return report
+}
@@ -0,0 +1,150 @@
+package core
+
+import "time"
+
+// Job and step phase names recorded for timelines. Phases are open-ended:
+// later parts of the engine can record additional named phases.
+const (
+	PhaseQueued     = "queued"
+	PhaseScheduling = "scheduling"
+	PhaseFinalizing = "finalizing"
+	PhaseSetup      = "setup"
+	PhaseExecution  = "execution"
+	PhaseRestore    = "restore"
+	PhaseTeardown   = "teardown"
+)
+
+// Phase is a timed part of a job or step
+type Phase struct {
+	Name      string    `json:"name"`
+	StartedAt time.Time `json:"startedAt"`
+	EndedAt   time.Time `json:"endedAt,omitempty"`
+}
+
+// Timeline breaks a job's duration down into the phases of the job and its
+// steps
+type Timeline struct {
+	JobID      string           `json:"jobId"`
+	PipelineID string           `json:"pipelineId"`
+	Status     Status           `json:"status"`
+	QueuedAt   time.Time        `json:"queuedAt"`
+	StartedAt  time.Time        `json:"startedAt"`
+	EndedAt    time.Time        `json:"endedAt,omitempty"`
+	DurationMs int64            `json:"durationMs"`
+	Phases     []TimelineSpan   `json:"phases"`
+	Steps      []StepTimeline   `json:"steps"`
+	Totals     map[string]int64 `json:"totals"`
+}
+
+// StepTimeline is the timeline of a single step
+type StepTimeline struct {
+	TimelineSpan
+	ID         string         `json:"id"`
+	Status     Status         `json:"status"`
+	CachedFrom string         `json:"cachedFrom,omitempty"`
+	Phases     []TimelineSpan `json:"phases"`
+}
+
+// TimelineSpan is a phase positioned relative to the time the job was queued
+type TimelineSpan struct {
+	Name       string    `json:"name"`
+	StartedAt  time.Time `json:"startedAt"`
+	EndedAt    time.Time `json:"endedAt,omitempty"`
+	OffsetMs   int64     `json:"offsetMs"`
+	DurationMs int64     `json:"durationMs"`
+	Running    bool      `json:"running,omitempty"`
+}
+
+// JobTimeline returns the timeline of a job
+func (pe *PipelineEngine) JobTimeline(jobID string) (*Timeline, error) {
+	job, err := pe.FindJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+	return BuildTimeline(pe.snapshotJob(job), time.Now()), nil
+}
+
+// BuildTimeline computes the timeline of a job. Phases that have not ended
+// are measured up to now, or up to the job's end if it has finished.
+func BuildTimeline(job *Job, now time.Time) *Timeline {
+	if job.Status.IsTerminal() && !job.EndedAt.IsZero() {
+		now = job.EndedAt
+	}
+
+	origin := job.QueuedAt
+	if origin.IsZero() {
+		origin = job.StartedAt
+	}
+
+	timeline := &Timeline{
+		JobID:      job.ID,
+		PipelineID: job.PipelineID,
+		Status:     job.Status,
+		QueuedAt:   origin,
+		StartedAt:  job.StartedAt,
+		EndedAt:    job.EndedAt,
+		Phases:     make([]TimelineSpan, 0, len(job.Phases)),
+		Steps:      make([]StepTimeline, 0, len(job.Steps)),
+		Totals:     make(map[string]int64),
+	}
+	timeline.DurationMs = span("job", origin, job.EndedAt, origin, now).DurationMs
+
+	for _, phase := range job.Phases {
+		s := span(phase.Name, phase.StartedAt, phase.EndedAt, origin, now)
+		timeline.Phases = append(timeline.Phases, s)
+		timeline.Totals[phase.Name] += s.DurationMs
+	}
+
+	for _, step := range job.Steps {
+		st := StepTimeline{
+			TimelineSpan: span(step.Name, step.StartedAt, step.EndedAt, origin, now),
+			ID:           step.ID,
+			Status:       step.Status,
+			CachedFrom:   step.CachedFrom,
+			Phases:       make([]TimelineSpan, 0, len(step.Phases)),
+		}
+		for _, phase := range step.Phases {
+			s := span(phase.Name, phase.StartedAt, phase.EndedAt, origin, now)
+			st.Phases = append(st.Phases, s)
+			timeline.Totals[phase.Name] += s.DurationMs
+		}
+		timeline.Steps = append(timeline.Steps, st)
+	}
+
+	return timeline
+}
+
+// span positions a phase relative to origin, treating a zero end as still
+// running
+func span(name string, start, end, origin, now time.Time) TimelineSpan {
+	s := TimelineSpan{
+		Name:      name,
+		StartedAt: start,
+		EndedAt:   end,
+		OffsetMs:  start.Sub(origin).Milliseconds(),
+	}
+	if end.IsZero() {
+		end = now
+		s.Running = true
+	}
+	s.DurationMs = end.Sub(start).Milliseconds()
+	return s
+}
+
+// advancePhase ends the last phase if it is still open and starts the
+// named phase, if any. Callers must hold pe.mu for phases of a live job.
+func advancePhase(phases *[]Phase, name string, at time.Time) {
+	if n := len(*phases); n > 0 && (*phases)[n-1].EndedAt.IsZero() {
+		(*phases)[n-1].EndedAt = at
+	}
+	if name != "" {
+		*phases = append(*phases, Phase{Name: name, StartedAt: at})
+	}
+}
+
+// advanceStepPhase moves a running step to its next phase
+func (pe *PipelineEngine) advanceStepPhase(job *Job, index int, name string) {
+	pe.mu.Lock()
+	advancePhase(&job.Steps[index].Phases, name, time.Now())
+	pe.mu.Unlock()
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestJobTimeline(t *testing.T) {
+	engine := newTestEngine()
+	engine.CreatePipeline(scriptPipeline("timed", "sleep 0.05", "true"))
+
+	job, err := engine.Run(context.Background(), "timed")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	timeline, err := engine.JobTimeline(job.ID)
+	if err != nil {
+		t.Fatalf("JobTimeline() error = %v", err)
+	}
+
+	var phases []string
+	for _, phase := range timeline.Phases {
+		phases = append(phases, phase.Name)
+		if phase.Running {
+			t.Errorf("phase %s still running after the job finished", phase.Name)
+		}
+	}
+	want := []string{PhaseQueued, PhaseScheduling, PhaseFinalizing}
+	if len(phases) != len(want) {
+		t.Fatalf("job phases = %v, want %v", phases, want)
+	}
+	for i := range want {
+		if phases[i] != want[i] {
+			t.Errorf("job phases = %v, want %v", phases, want)
+		}
+	}
+
+	if len(timeline.Steps) != 2 {
+		t.Fatalf("len(Steps) = %d, want 2", len(timeline.Steps))
+	}
+	var stepPhases []string
+	for _, phase := range timeline.Steps[0].Phases {
+		stepPhases = append(stepPhases, phase.Name)
+	}
+	if len(stepPhases) != 3 || stepPhases[1] != PhaseExecution {
+		t.Errorf("step phases = %v, want setup, execution, teardown", stepPhases)
+	}
+	if timeline.Totals[PhaseExecution] < 50 {
+		t.Errorf("execution total = %dms, want at least the 50ms sleep", timeline.Totals[PhaseExecution])
+	}
+	if timeline.Steps[1].OffsetMs < timeline.Steps[0].OffsetMs {
+		t.Errorf("second step offset %d is before the first %d", timeline.Steps[1].OffsetMs, timeline.Steps[0].OffsetMs)
+	}
+	if timeline.DurationMs < timeline.Totals[PhaseExecution] {
+		t.Errorf("DurationMs = %d, shorter than execution total %d", timeline.DurationMs, timeline.Totals[PhaseExecution])
+	}
+}
+
+func TestBuildTimeline_RunningPhase(t *testing.T) {
+	queued := time.Now().Add(-time.Second)
+	job := &Job{
+		ID:        "job-1",
+		Status:    StatusRunning,
+		QueuedAt:  queued,
+		StartedAt: queued,
+		Phases:    []Phase{{Name: PhaseQueued, StartedAt: queued}},
+	}
+
+	timeline := BuildTimeline(job, queued.Add(2*time.Second))
+	if len(timeline.Phases) != 1 || !timeline.Phases[0].Running {
+		t.Fatalf("Phases = %+v, want one running phase", timeline.Phases)
+	}
+	if timeline.Phases[0].DurationMs != 2000 {
+		t.Errorf("DurationMs = %d, want 2000", timeline.Phases[0].DurationMs)
+	}
+}
+
+func TestJobTimeline_UnknownJob(t *testing.T) {
+	engine := newTestEngine()
+	if _, err := engine.JobTimeline("missing"); err == nil {
+		t.Error("JobTimeline() expected error for unknown job")
+	}
+}
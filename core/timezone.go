@@ -0,0 +1,44 @@
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+// ValidateTimezone checks that a schedule time zone is empty, for the
+// engine's schedule time zone, or an IANA name such as "America/Chicago"
+func ValidateTimezone(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, err := time.LoadLocation(name); err != nil {
+		return fmt.Errorf("unknown time zone %q", name)
+	}
+	return nil
+}
+
+// WithScheduleLocation sets the time zone of cron triggers and maintenance
+// windows that do not name one. Defaults to the local time zone.
+func WithScheduleLocation(loc *time.Location) Option {
+	return func(pe *PipelineEngine) {
+		if loc != nil {
+			pe.scheduleLocation = loc
+		}
+	}
+}
+
+// ScheduleLocation returns the time zone of schedules that do not name one
+func (pe *PipelineEngine) ScheduleLocation() *time.Location {
+	return pe.scheduleLocation
+}
+
+// scheduleZone returns the location of a schedule's time zone, falling back
+// to the engine's for an empty or unknown name
+func (pe *PipelineEngine) scheduleZone(name string) *time.Location {
+	if name != "" {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+	return pe.scheduleLocation
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// waitPollInterval is how often a waiting client's job is checked in case
+// its events were dropped
+const waitPollInterval = time.Second
+
+// JobCondition reports whether a job reached the state a client waits for
+type JobCondition func(job *Job) bool
+
+// ParseJobCondition parses the state of a job to wait for: "completed" for
+// any terminal status, "started" for any status but pending, or a status.
+// Waiting for a status also ends when the job completes without reaching it.
+func ParseJobCondition(until string) (JobCondition, error) {
+	switch until {
+	case "", "completed":
+		return func(job *Job) bool { return job.Status.IsTerminal() }, nil
+	case "started":
+		return func(job *Job) bool { return job.Status != StatusPending }, nil
+	}
+	status, err := ParseStatus(until)
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition %q: want completed, started or a status", until)
+	}
+	return func(job *Job) bool { return job.Status == status || job.Status.IsTerminal() }, nil
+}
+
+// WaitJob waits until a job meets cond or ctx is done, and returns a
+// snapshot of the job and whether it met cond
+func (pe *PipelineEngine) WaitJob(ctx context.Context, jobID string, cond JobCondition) (*Job, bool, error) {
+	job, err := pe.FindJob(jobID)
+	if err != nil {
+		return nil, false, err
+	}
+	sub := pe.Subscribe(16)
+	defer sub.Close()
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	for {
+		snapshot := pe.snapshotJob(job)
+		if cond(snapshot) {
+			return snapshot, true, nil
+		}
+		select {
+		case <-ctx.Done():
+			return pe.snapshotJob(job), false, nil
+		case <-sub.Events():
+		case <-ticker.C:
+		}
+	}
+}
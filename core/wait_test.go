@@ -0,0 +1,61 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWaitJob_UntilCompleted(t *testing.T) {
+	engine := newTestEngine()
+	engine.CreatePipeline(scriptPipeline("it", `sleep 0.2`))
+	started, err := engine.Start(context.Background(), "it")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	cond, _ := ParseJobCondition("completed")
+	job, met, err := engine.WaitJob(context.Background(), started.ID, cond)
+	if err != nil {
+		t.Fatalf("WaitJob() error = %v", err)
+	}
+	if !met || job.Status != StatusSuccess || job.EndedAt.IsZero() {
+		t.Errorf("WaitJob() = %q, %v, want the completed job", job.Status, met)
+	}
+}
+
+func TestWaitJob_Timeout(t *testing.T) {
+	engine := newTestEngine()
+	engine.CreatePipeline(scriptPipeline("it", `sleep 2`))
+	started, _ := engine.Start(context.Background(), "it")
+	defer engine.CancelJob("it", started.ID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	cond, _ := ParseJobCondition("success")
+	job, met, err := engine.WaitJob(ctx, started.ID, cond)
+	if err != nil {
+		t.Fatalf("WaitJob() error = %v", err)
+	}
+	if met || job.Status.IsTerminal() {
+		t.Errorf("WaitJob() = %q, %v, want the running job after the timeout", job.Status, met)
+	}
+
+	if _, _, err := engine.WaitJob(ctx, "unknown", cond); err == nil {
+		t.Error("WaitJob(unknown) expected error, got nil")
+	}
+}
+
+func TestParseJobCondition(t *testing.T) {
+	if _, err := ParseJobCondition("finished"); err == nil {
+		t.Error("ParseJobCondition(finished) expected error, got nil")
+	}
+	started, _ := ParseJobCondition("started")
+	if started(&Job{Status: StatusPending}) || !started(&Job{Status: StatusRunning}) {
+		t.Error("started condition doesn't match running jobs only")
+	}
+	success, _ := ParseJobCondition("success")
+	if success(&Job{Status: StatusRunning}) || !success(&Job{Status: StatusFailed}) {
+		t.Error("status condition doesn't end on completion")
+	}
+}
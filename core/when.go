@@ -0,0 +1,169 @@
+package core
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// When statuses: which outcome of the job so far a stage or step runs on
+const (
+	// WhenSuccess runs it only while nothing has failed, the default
+	WhenSuccess = "success"
+	// WhenFailure runs it only once something has failed
+	WhenFailure = "failure"
+	// WhenAlways runs it either way
+	WhenAlways = "always"
+)
+
+// ValidateWhen checks the status, branch globs and pattern of a condition
+func ValidateWhen(when *ConditionalExecution) error {
+	if when == nil {
+		return nil
+	}
+	switch when.Status {
+	case "", WhenSuccess, WhenFailure, WhenAlways:
+	default:
+		return fmt.Errorf("invalid when.status %q, want %s, %s or %s", when.Status, WhenSuccess, WhenFailure, WhenAlways)
+	}
+	for _, glob := range branchGlobs(when.Branch) {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid when.branch %q: %w", glob, err)
+		}
+	}
+	if when.Pattern != "" {
+		if _, err := regexp.Compile(when.Pattern); err != nil {
+			return fmt.Errorf("invalid when.pattern: %w", err)
+		}
+	}
+	return nil
+}
+
+// whenStatus returns the status a condition runs on
+func whenStatus(when *ConditionalExecution) string {
+	if when == nil || when.Status == "" {
+		return WhenSuccess
+	}
+	return when.Status
+}
+
+// runsAfterFailure reports whether a condition lets its stage or step run
+// once something in the job has failed
+func runsAfterFailure(when *ConditionalExecution) bool {
+	status := whenStatus(when)
+	return status == WhenFailure || status == WhenAlways
+}
+
+// stageRunsAfterFailure reports whether a stage, or any of its steps, runs
+// once something in the job has failed
+func stageRunsAfterFailure(stage Stage) bool {
+	if runsAfterFailure(stage.When) {
+		return true
+	}
+	for _, step := range stage.Steps {
+		if runsAfterFailure(step.When) {
+			return true
+		}
+	}
+	return false
+}
+
+// stepCondition returns a step's condition with the stage's status when
+// the step doesn't set its own, so the steps of a stage that runs on
+// failure run on failure too
+func stepCondition(stage Stage, step Step) *ConditionalExecution {
+	if stage.When == nil || stage.When.Status == "" || step.When != nil && step.When.Status != "" {
+		return step.When
+	}
+	when := ConditionalExecution{Status: stage.When.Status}
+	if step.When != nil {
+		when = *step.When
+		when.Status = stage.When.Status
+	}
+	return &when
+}
+
+// evaluateWhen reports whether a condition, with its custom expression
+// already expanded, holds for a job on branch that has failed so far or
+// not, and why it doesn't
+func evaluateWhen(when *ConditionalExecution, branch string, failed bool) (bool, string) {
+	if when == nil {
+		when = &ConditionalExecution{}
+	}
+	switch whenStatus(when) {
+	case WhenSuccess:
+		if failed {
+			return false, "the job has failed"
+		}
+	case WhenFailure:
+		if !failed {
+			return false, "nothing has failed"
+		}
+	}
+	if globs := branchGlobs(when.Branch); len(globs) > 0 {
+		matched := false
+		for _, glob := range globs {
+			if ok, _ := path.Match(glob, branch); ok {
+				matched = true
+			}
+		}
+		if !matched {
+			return false, fmt.Sprintf("branch %q doesn't match %s", branch, when.Branch)
+		}
+	}
+	if when.Pattern != "" {
+		if re, err := regexp.Compile(when.Pattern); err != nil || !re.MatchString(branch) {
+			return false, fmt.Sprintf("branch %q doesn't match pattern %s", branch, when.Pattern)
+		}
+	}
+	if custom := strings.TrimSpace(when.Custom); custom != "" && !truthy(custom) {
+		return false, "condition is false"
+	}
+	return true, ""
+}
+
+// branchGlobs returns the comma-separated globs of a when.branch
+func branchGlobs(branch string) []string {
+	var globs []string
+	for _, glob := range strings.Split(branch, ",") {
+		if glob = strings.TrimSpace(glob); glob != "" {
+			globs = append(globs, glob)
+		}
+	}
+	return globs
+}
+
+// jobBranch returns the branch a job runs for: its revision's, or the
+// branch it was triggered with
+func jobBranch(job *Job) string {
+	if job.Revision != nil && job.Revision.Branch != "" {
+		return job.Revision.Branch
+	}
+	return triggerValues(job.Metadata)["branch"]
+}
+
+// stageCondition evaluates the branch, pattern and custom expression of a
+// stage's condition for a job, expanding the expression with the job's
+// values. The stage's status applies to its steps.
+func (pe *PipelineEngine) stageCondition(pipeline *Pipeline, job *Job, stage Stage) (bool, string, error) {
+	if stage.When == nil {
+		return true, "", nil
+	}
+	when := *stage.When
+	when.Status = WhenAlways
+	pe.mu.RLock()
+	values := addStepOutputs(referenceValues(pipeline, job.ID, triggerValues(job.Metadata), job.Revision), job)
+	branch := jobBranch(job)
+	pe.mu.RUnlock()
+	if when.Custom != "" {
+		custom, err := expandExpressions(when.Custom, expressionScope{values: values, dir: pe.jobDir(job), now: time.Now()})
+		if err != nil {
+			return false, "", fmt.Errorf("stage %s: when.custom: %w", stage.ID, err)
+		}
+		when.Custom = custom
+	}
+	ok, reason := evaluateWhen(&when, branch, false)
+	return ok, reason, nil
+}
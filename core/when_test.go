@@ -0,0 +1,172 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestEvaluateWhen(t *testing.T) {
+	tests := []struct {
+		name   string
+		when   *ConditionalExecution
+		branch string
+		failed bool
+		want   bool
+	}{
+		{"none", nil, "main", false, true},
+		{"none after failure", nil, "main", true, false},
+		{"failure", &ConditionalExecution{Status: WhenFailure}, "main", false, false},
+		{"failure after failure", &ConditionalExecution{Status: WhenFailure}, "main", true, true},
+		{"always", &ConditionalExecution{Status: WhenAlways}, "main", true, true},
+		{"branch", &ConditionalExecution{Branch: "main, release/*"}, "release/1.2", false, true},
+		{"other branch", &ConditionalExecution{Branch: "main, release/*"}, "feature/login", false, false},
+		{"pattern", &ConditionalExecution{Pattern: "^hotfix-[0-9]+$"}, "hotfix-42", false, true},
+		{"other pattern", &ConditionalExecution{Pattern: "^hotfix-[0-9]+$"}, "main", false, false},
+		{"custom", &ConditionalExecution{Custom: "true"}, "main", false, true},
+		{"false custom", &ConditionalExecution{Custom: "false"}, "main", false, false},
+	}
+	for _, tt := range tests {
+		if got, reason := evaluateWhen(tt.when, tt.branch, tt.failed); got != tt.want || !got && reason == "" {
+			t.Errorf("%s: evaluateWhen() = %v, %q, want %v with a reason", tt.name, got, reason, tt.want)
+		}
+	}
+}
+
+func TestValidateWhen(t *testing.T) {
+	if err := ValidateWhen(&ConditionalExecution{Status: WhenAlways, Branch: "main,release/*", Pattern: "^v"}); err != nil {
+		t.Errorf("ValidateWhen() error = %v, want nil", err)
+	}
+	for _, when := range []ConditionalExecution{{Status: "failed"}, {Branch: "release/["}, {Pattern: "(main"}} {
+		if err := ValidateWhen(&when); err == nil {
+			t.Errorf("ValidateWhen(%+v) succeeded, want an error", when)
+		}
+	}
+}
+
+func TestRun_WhenBranch(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("branch", "echo build")
+	pipeline.Stages[0].Steps = append(pipeline.Stages[0].Steps, Step{
+		ID:      "publish",
+		Name:    "publish",
+		Type:    "script",
+		Command: "echo publishing",
+		When:    &ConditionalExecution{Branch: "main,release/*"},
+	})
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "branch", WithTrigger(map[string]string{"branch": "feature/login"}))
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != StatusSuccess || len(job.Steps) != 2 || job.Steps[1].Status != StatusSkipped {
+		t.Fatalf("job = %s with steps %+v, want success with publish skipped", job.Status, job.Steps)
+	}
+	if !hasLog(job, "publish", `step skipped: branch "feature/login" doesn't match main,release/*`) {
+		t.Errorf("logs = %+v, want the reason publish was skipped", job.Logs)
+	}
+
+	job, _ = engine.Run(context.Background(), "branch", WithRevision(Revision{Branch: "release/1.2"}))
+	if job.Steps[1].Status != StatusSuccess || job.Steps[1].Output != "publishing\n" {
+		t.Errorf("publish = %s %q, want it to run on release/1.2", job.Steps[1].Status, job.Steps[1].Output)
+	}
+}
+
+func TestRun_WhenStatus(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := &Pipeline{ID: "status", Stages: []Stage{
+		{ID: "build", Steps: []Step{
+			{ID: "compile", Type: "script", Command: "exit 1"},
+			{ID: "test", Type: "script", Command: "echo test"},
+			{ID: "logs", Type: "script", Command: "echo logs", When: &ConditionalExecution{Status: WhenFailure}},
+		}},
+		{ID: "deploy", Steps: []Step{{ID: "deploy", Type: "script", Command: "echo deploy"}}},
+		{ID: "notify", When: &ConditionalExecution{Status: WhenFailure}, Steps: []Step{{ID: "page", Type: "script", Command: "echo page"}}},
+		{ID: "cleanup", Steps: []Step{{ID: "cleanup", Type: "script", Command: "echo cleanup", When: &ConditionalExecution{Status: WhenAlways}}}},
+	}}
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "status")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got := stepStatuses(job); job.Status != StatusFailed || got != "compile:failed logs:success page:success cleanup:success" {
+		t.Errorf("job = %s with steps %s, want failed with the failure and always steps run", job.Status, got)
+	}
+
+	pipeline.Stages[0].Steps[0].Command = "echo compile"
+	engine.UpdatePipeline(pipeline)
+	job, _ = engine.Run(context.Background(), "status")
+	if got := stepStatuses(job); job.Status != StatusSuccess || got != "compile:success test:success logs:skipped deploy:success page:skipped cleanup:success" {
+		t.Errorf("job = %s with steps %s, want success with the failure steps skipped", job.Status, got)
+	}
+}
+
+func TestRun_WhenStage(t *testing.T) {
+	engine := newTestEngine()
+	pipeline := scriptPipeline("stage", "echo build")
+	pipeline.Stages = append(pipeline.Stages, Stage{
+		ID:   "release",
+		When: &ConditionalExecution{Custom: "${{ trigger.tag != '' }}"},
+		Steps: []Step{
+			{ID: "tag", Type: "script", Command: "echo tag"},
+			{ID: "upload", Type: "script", Command: "echo upload"},
+		},
+	})
+	engine.CreatePipeline(pipeline)
+
+	job, err := engine.Run(context.Background(), "stage")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got := stepStatuses(job); job.Status != StatusSuccess || got != "build-step-a:success tag:skipped upload:skipped" {
+		t.Errorf("job = %s with steps %s, want success with the release stage skipped", job.Status, got)
+	}
+	if !hasLog(job, "upload", "step skipped: stage release: condition is false") {
+		t.Errorf("logs = %+v, want the reason the stage was skipped", job.Logs)
+	}
+
+	job, _ = engine.Run(context.Background(), "stage", WithTrigger(map[string]string{"tag": "v1.2.0"}))
+	if got := stepStatuses(job); got != "build-step-a:success tag:success upload:success" {
+		t.Errorf("steps = %s, want the release stage run for a tag", got)
+	}
+}
+
+func TestRun_WhenStageGraph(t *testing.T) {
+	engine := newTestEngine()
+	report := graphStage("report", "echo report", "test")
+	report.When = &ConditionalExecution{Status: WhenFailure}
+	engine.CreatePipeline(&Pipeline{ID: "graph", Stages: []Stage{
+		graphStage("test", "exit 1"),
+		graphStage("deploy", "echo deploy", "test"),
+		report,
+	}})
+
+	job, err := engine.Run(context.Background(), "graph")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got := stepStatuses(job); job.Status != StatusFailed || got != "test-step:failed report-step:success" {
+		t.Errorf("job = %s with steps %s, want failed with the report stage run", job.Status, got)
+	}
+}
+
+// stepStatuses lists the steps of a job with their status
+func stepStatuses(job *Job) string {
+	var steps []string
+	for _, step := range job.Steps {
+		steps = append(steps, step.ID+":"+string(step.Status))
+	}
+	return strings.Join(steps, " ")
+}
+
+// hasLog reports whether a job logged message for a step
+func hasLog(job *Job, stepID, message string) bool {
+	for _, entry := range job.Logs {
+		if entry.StepID == stepID && entry.Message == message {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,614 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WorkspaceConfig keeps a pipeline's workspace warm between jobs. Jobs reuse
+// the files of an earlier job, such as its git clone, instead of starting
+// from an empty directory.
+type WorkspaceConfig struct {
+	// Dependencies are directories, such as node_modules, that are only
+	// reused when unchanged since the last successful job
+	Dependencies []string `json:"dependencies,omitempty"`
+}
+
+// WorkspacePolicy limits the warm workspaces kept on disk
+type WorkspacePolicy struct {
+	// MaxAge evicts workspaces unused for longer. Zero keeps them.
+	MaxAge time.Duration
+	// MaxBytes evicts the least recently used workspaces while the total
+	// size is larger. Zero means unlimited.
+	MaxBytes int64
+	// MaxPerPipeline limits the workspaces of a pipeline, which is the
+	// number of its jobs that can run in a warm workspace at once. Further
+	// jobs get a temporary workspace. Zero means unlimited.
+	MaxPerPipeline int
+}
+
+// JobWorkspace describes the workspace a job ran in
+type JobWorkspace struct {
+	Slot   int  `json:"slot"`
+	Reused bool `json:"reused"`
+	// Reason explains why the workspace was not reused
+	Reason    string `json:"reason,omitempty"`
+	Temporary bool   `json:"temporary,omitempty"`
+	// Dependencies reports per dependency directory whether it was reused
+	Dependencies map[string]bool `json:"dependencies,omitempty"`
+}
+
+// WorkspaceStats reports the workspace reuse of a pipeline
+type WorkspaceStats struct {
+	PipelineID       string `json:"pipelineId"`
+	Hits             int    `json:"hits"`
+	Misses           int    `json:"misses"`
+	DependencyHits   int    `json:"dependencyHits"`
+	DependencyMisses int    `json:"dependencyMisses"`
+	Evictions        int    `json:"evictions"`
+	Workspaces       int    `json:"workspaces"`
+	Bytes            int64  `json:"bytes"`
+}
+
+// Workspace manifest states. A workspace left in use was not released,
+// because the server stopped while its job ran.
+const (
+	workspaceClean = "clean"
+	workspaceInUse = "in-use"
+)
+
+// workspaceManifest is stored next to a workspace directory
+type workspaceManifest struct {
+	PipelineID string    `json:"pipelineId"`
+	Slot       int       `json:"slot"`
+	State      string    `json:"state"`
+	LastJob    string    `json:"lastJob,omitempty"`
+	LastUsed   time.Time `json:"lastUsed"`
+	Size       int64     `json:"size"`
+	// Dependencies maps dependency directories to their fingerprint after
+	// the last successful job
+	Dependencies map[string]string `json:"dependencies,omitempty"`
+}
+
+// workspaceSlot is a workspace directory and whether a job holds it
+type workspaceSlot struct {
+	manifest workspaceManifest
+	busy     bool
+}
+
+// workspaceLease is a workspace held by a job
+type workspaceLease struct {
+	pipelineID string
+	slot       int
+	dir        string
+	temporary  bool
+	// job is set for the directory of a single job, see WithJobWorkspaces
+	job bool
+}
+
+// workspaceManager keeps warm workspaces under root/<pipeline>/<slot> with
+// a <slot>.json manifest beside each
+type workspaceManager struct {
+	root   string
+	policy WorkspacePolicy
+	slots  map[string]map[int]*workspaceSlot
+	stats  map[string]*WorkspaceStats
+	mu     sync.Mutex
+}
+
+// WithWorkspaces keeps warm workspaces under root for pipelines that
+// configure a workspace
+func WithWorkspaces(root string, policy WorkspacePolicy) Option {
+	return func(pe *PipelineEngine) {
+		manager := &workspaceManager{
+			root:   root,
+			policy: policy,
+			slots:  make(map[string]map[int]*workspaceSlot),
+			stats:  make(map[string]*WorkspaceStats),
+		}
+		if err := manager.load(); err != nil {
+			pe.logger.Printf("Failed to load workspaces: %v", err)
+		}
+		pe.workspaces = manager
+	}
+}
+
+// DirExecutor is implemented by executors that can run a step in a given
+// directory, which lets steps run in warm workspaces
+type DirExecutor interface {
+	ExecuteIn(ctx context.Context, dir string, step Step, env map[string]string) (*StepResult, error)
+}
+
+// workspaceDirName returns the directory name of a pipeline's workspaces
+func workspaceDirName(pipelineID string) string {
+	if ValidArtifactName(pipelineID) {
+		return pipelineID
+	}
+	sum := sha256.Sum256([]byte(pipelineID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// dir returns the directory of a workspace slot
+func (m *workspaceManager) dir(pipelineID string, slot int) string {
+	return filepath.Join(m.root, workspaceDirName(pipelineID), strconv.Itoa(slot))
+}
+
+// load reads the manifests and statistics of an earlier run
+func (m *workspaceManager) load() error {
+	if err := os.MkdirAll(m.root, 0o755); err != nil {
+		return err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(m.root, "*", "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var manifest workspaceManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("invalid workspace manifest %s: %w", path, err)
+		}
+		m.slotsOf(manifest.PipelineID)[manifest.Slot] = &workspaceSlot{manifest: manifest}
+	}
+
+	data, err := os.ReadFile(filepath.Join(m.root, "stats.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var stats []*WorkspaceStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return fmt.Errorf("invalid workspace stats: %w", err)
+	}
+	for _, s := range stats {
+		m.stats[s.PipelineID] = s
+	}
+	return nil
+}
+
+// slotsOf returns the slots of a pipeline. Callers must hold m.mu.
+func (m *workspaceManager) slotsOf(pipelineID string) map[int]*workspaceSlot {
+	slots, ok := m.slots[pipelineID]
+	if !ok {
+		slots = make(map[int]*workspaceSlot)
+		m.slots[pipelineID] = slots
+	}
+	return slots
+}
+
+// statsOf returns the statistics of a pipeline. Callers must hold m.mu.
+func (m *workspaceManager) statsOf(pipelineID string) *WorkspaceStats {
+	stats, ok := m.stats[pipelineID]
+	if !ok {
+		stats = &WorkspaceStats{PipelineID: pipelineID}
+		m.stats[pipelineID] = stats
+	}
+	return stats
+}
+
+// reserve picks the workspace slot of a job: the slot the job was
+// interrupted in, then the most recently used free slot, then a new one
+func (m *workspaceManager) reserve(pipelineID, jobID string) (*workspaceSlot, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	slots := m.slotsOf(pipelineID)
+	var best *workspaceSlot
+	for _, slot := range slots {
+		if slot.busy {
+			continue
+		}
+		if slot.manifest.State == workspaceInUse && slot.manifest.LastJob == jobID {
+			best = slot
+			break
+		}
+		if best == nil || slot.manifest.LastUsed.After(best.manifest.LastUsed) {
+			best = slot
+		}
+	}
+	if best != nil {
+		best.busy = true
+		return best, false
+	}
+
+	if m.policy.MaxPerPipeline > 0 && len(slots) >= m.policy.MaxPerPipeline {
+		return nil, false
+	}
+	index := 0
+	for slots[index] != nil {
+		index++
+	}
+	slot := &workspaceSlot{manifest: workspaceManifest{PipelineID: pipelineID, Slot: index}, busy: true}
+	slots[index] = slot
+	return slot, true
+}
+
+// acquire prepares a workspace for a job, checking the integrity of what an
+// earlier job left behind
+func (m *workspaceManager) acquire(pipeline *Pipeline, jobID string) (*workspaceLease, *JobWorkspace, error) {
+	slot, created := m.reserve(pipeline.ID, jobID)
+	if slot == nil {
+		dir := filepath.Join(m.root, "tmp", jobID)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, nil, err
+		}
+		m.mu.Lock()
+		m.statsOf(pipeline.ID).Misses++
+		m.mu.Unlock()
+		lease := &workspaceLease{pipelineID: pipeline.ID, dir: dir, temporary: true}
+		return lease, &JobWorkspace{Temporary: true, Reason: "all workspaces are in use"}, nil
+	}
+
+	manifest := slot.manifest
+	lease := &workspaceLease{pipelineID: pipeline.ID, slot: manifest.Slot, dir: m.dir(pipeline.ID, manifest.Slot)}
+	info := &JobWorkspace{Slot: manifest.Slot}
+
+	resumed := manifest.State == workspaceInUse && manifest.LastJob == jobID
+	switch {
+	case created:
+		info.Reason = "new workspace"
+	case resumed:
+	case manifest.State != workspaceClean:
+		info.Reason = "previous job did not finish"
+	case !checkoutIntact(lease.dir):
+		info.Reason = "git checkout is corrupt"
+	}
+	info.Reused = info.Reason == ""
+	if !info.Reused {
+		if err := os.RemoveAll(lease.dir); err != nil {
+			m.abandon(slot)
+			return nil, nil, err
+		}
+		manifest.Dependencies = nil
+	}
+	if err := os.MkdirAll(lease.dir, 0o755); err != nil {
+		m.abandon(slot)
+		return nil, nil, err
+	}
+
+	// Dependency directories are only trusted while they match the
+	// fingerprint taken after the last successful job
+	depHits, depMisses := 0, 0
+	if info.Reused && !resumed {
+		info.Dependencies = make(map[string]bool)
+		for _, dep := range pipeline.Workspace.Dependencies {
+			path := filepath.Join(lease.dir, filepath.FromSlash(dep))
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			recorded, ok := manifest.Dependencies[dep]
+			if ok && fingerprint(path) == recorded {
+				info.Dependencies[dep] = true
+				depHits++
+				continue
+			}
+			info.Dependencies[dep] = false
+			depMisses++
+			if err := os.RemoveAll(path); err != nil {
+				m.abandon(slot)
+				return nil, nil, err
+			}
+		}
+	}
+
+	manifest.State = workspaceInUse
+	manifest.LastJob = jobID
+	manifest.LastUsed = time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	slot.manifest = manifest
+	stats := m.statsOf(pipeline.ID)
+	if info.Reused {
+		stats.Hits++
+	} else {
+		stats.Misses++
+	}
+	stats.DependencyHits += depHits
+	stats.DependencyMisses += depMisses
+	if err := m.saveManifest(slot); err != nil {
+		slot.busy = false
+		return nil, nil, err
+	}
+	return lease, info, nil
+}
+
+// abandon drops a slot whose directory could not be prepared
+func (m *workspaceManager) abandon(slot *workspaceSlot) {
+	m.mu.Lock()
+	delete(m.slotsOf(slot.manifest.PipelineID), slot.manifest.Slot)
+	m.mu.Unlock()
+}
+
+// checkoutIntact reports whether a git checkout in dir, if any, can be read
+func checkoutIntact(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		return true
+	}
+	return !DetectRevision(dir).IsZero()
+}
+
+// release returns a job's workspace. Dependencies are fingerprinted after a
+// successful job; after a failed job they are discarded on the next use.
+// Workspaces of cancelled jobs are deleted, and those of interrupted jobs
+// are kept for the job to resume in.
+func (m *workspaceManager) release(lease *workspaceLease, pipeline *Pipeline, status Status) {
+	if lease.temporary {
+		os.RemoveAll(lease.dir)
+		return
+	}
+
+	m.mu.Lock()
+	slot := m.slotsOf(lease.pipelineID)[lease.slot]
+	m.mu.Unlock()
+	if slot == nil {
+		return
+	}
+
+	if status == StatusInterrupted {
+		m.mu.Lock()
+		slot.busy = false
+		m.mu.Unlock()
+		return
+	}
+
+	manifest := slot.manifest
+	manifest.Dependencies = nil
+	switch status {
+	case StatusSuccess:
+		manifest.Dependencies = make(map[string]string)
+		for _, dep := range pipeline.Workspace.Dependencies {
+			path := filepath.Join(lease.dir, filepath.FromSlash(dep))
+			if _, err := os.Stat(path); err == nil {
+				manifest.Dependencies[dep] = fingerprint(path)
+			}
+		}
+	case StatusFailed:
+	default:
+		m.mu.Lock()
+		m.remove(slot)
+		m.mu.Unlock()
+		return
+	}
+	manifest.State = workspaceClean
+	manifest.LastUsed = time.Now()
+	manifest.Size = dirSize(lease.dir)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	slot.manifest = manifest
+	slot.busy = false
+	m.saveManifest(slot)
+	m.evict(time.Now())
+	m.saveStats()
+}
+
+// remove deletes a workspace and its manifest. Callers must hold m.mu.
+func (m *workspaceManager) remove(slot *workspaceSlot) {
+	dir := m.dir(slot.manifest.PipelineID, slot.manifest.Slot)
+	os.RemoveAll(dir)
+	os.Remove(dir + ".json")
+	delete(m.slotsOf(slot.manifest.PipelineID), slot.manifest.Slot)
+}
+
+// evict removes idle workspaces that exceed the policy. Callers must hold
+// m.mu.
+func (m *workspaceManager) evict(now time.Time) int {
+	var idle []*workspaceSlot
+	var total int64
+	for _, slots := range m.slots {
+		for _, slot := range slots {
+			total += slot.manifest.Size
+			if !slot.busy {
+				idle = append(idle, slot)
+			}
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool {
+		return idle[i].manifest.LastUsed.Before(idle[j].manifest.LastUsed)
+	})
+
+	evicted := 0
+	for _, slot := range idle {
+		expired := m.policy.MaxAge > 0 && now.Sub(slot.manifest.LastUsed) > m.policy.MaxAge
+		oversize := m.policy.MaxBytes > 0 && total > m.policy.MaxBytes
+		if !expired && !oversize {
+			continue
+		}
+		total -= slot.manifest.Size
+		m.statsOf(slot.manifest.PipelineID).Evictions++
+		m.remove(slot)
+		evicted++
+	}
+	return evicted
+}
+
+// saveManifest writes a slot's manifest. Callers must hold m.mu.
+func (m *workspaceManager) saveManifest(slot *workspaceSlot) error {
+	data, err := json.MarshalIndent(slot.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(m.dir(slot.manifest.PipelineID, slot.manifest.Slot)+".json", data, 0o644)
+}
+
+// saveStats writes the statistics. Callers must hold m.mu.
+func (m *workspaceManager) saveStats() {
+	stats := make([]*WorkspaceStats, 0, len(m.stats))
+	for _, s := range m.stats {
+		stats = append(stats, s)
+	}
+	if data, err := json.MarshalIndent(stats, "", "  "); err == nil {
+		os.WriteFile(filepath.Join(m.root, "stats.json"), data, 0o644)
+	}
+}
+
+// fingerprint hashes the names, sizes, modes and modification times of the
+// files under path, which changes when the directory is modified
+func fingerprint(path string) string {
+	hash := sha256.New()
+	filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			fmt.Fprintf(hash, "error:%s;", file)
+			return nil
+		}
+		rel, _ := filepath.Rel(path, file)
+		fmt.Fprintf(hash, "%s:%d:%o:%d;", filepath.ToSlash(rel), info.Size(), info.Mode(), info.ModTime().UnixNano())
+		return nil
+	})
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// dirSize returns the total size of the files under dir
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// acquireWorkspace gives a job of a pipeline with a workspace config its
+// warm workspace, and other jobs a directory of their own when job
+// workspaces are enabled
+func (pe *PipelineEngine) acquireWorkspace(pipeline *Pipeline, job *Job) error {
+	if pe.workspaces == nil || pipeline.Workspace == nil {
+		if pe.jobWorkspaces != nil {
+			return pe.acquireJobWorkspace(pipeline, job)
+		}
+		return nil
+	}
+
+	lease, info, err := pe.workspaces.acquire(pipeline, job.ID)
+	if err != nil {
+		return fmt.Errorf("failed to prepare workspace: %w", err)
+	}
+
+	pe.mu.Lock()
+	pe.leases[job.ID] = lease
+	job.Workspace = info
+	pe.mu.Unlock()
+
+	if info.Reused {
+		pe.logJob(job, "info", "", fmt.Sprintf("Reusing workspace %d", info.Slot))
+	} else {
+		pe.logJob(job, "info", "", fmt.Sprintf("Starting from an empty workspace: %s", info.Reason))
+	}
+	for dep, reused := range info.Dependencies {
+		if !reused {
+			pe.logJob(job, "info", "", fmt.Sprintf("Discarded %s: changed since the last successful job", dep))
+		}
+	}
+	return nil
+}
+
+// releaseWorkspace returns the workspace of a finished job, or once the
+// job's debug session ends
+func (pe *PipelineEngine) releaseWorkspace(pipeline *Pipeline, job *Job, status Status) {
+	pe.mu.Lock()
+	lease, ok := pe.leases[job.ID]
+	delete(pe.leases, job.ID)
+	pe.mu.Unlock()
+	if !ok {
+		return
+	}
+	release := func() { pe.workspaces.release(lease, pipeline, status) }
+	if lease.job {
+		release = func() { pe.releaseJobWorkspace(lease, status) }
+	}
+	if !pe.holdForDebug(job.ID, release) {
+		release()
+	}
+}
+
+// jobDir returns the directory a job's steps run in: its workspace, or the
+// working directory of the engine's executor
+func (pe *PipelineEngine) jobDir(job *Job) string {
+	pe.mu.RLock()
+	lease, ok := pe.leases[job.ID]
+	pe.mu.RUnlock()
+	if ok {
+		return lease.dir
+	}
+	if wd, ok := pe.executor.(workingDir); ok {
+		return wd.WorkingDir()
+	}
+	return ""
+}
+
+// WorkspaceStats reports the workspace reuse per pipeline, sorted by
+// pipeline ID. It is empty when workspaces are disabled.
+func (pe *PipelineEngine) WorkspaceStats() []WorkspaceStats {
+	if pe.workspaces == nil {
+		return []WorkspaceStats{}
+	}
+
+	m := pe.workspaces
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	byPipeline := make(map[string]WorkspaceStats)
+	for id, s := range m.stats {
+		byPipeline[id] = *s
+	}
+	for id, slots := range m.slots {
+		stats, ok := byPipeline[id]
+		if !ok {
+			stats = WorkspaceStats{PipelineID: id}
+		}
+		stats.Workspaces = len(slots)
+		stats.Bytes = 0
+		for _, slot := range slots {
+			stats.Bytes += slot.manifest.Size
+		}
+		byPipeline[id] = stats
+	}
+
+	result := make([]WorkspaceStats, 0, len(byPipeline))
+	for _, stats := range byPipeline {
+		result = append(result, stats)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].PipelineID < result[j].PipelineID
+	})
+	return result
+}
+
+// ClearWorkspaces deletes the idle workspaces of a pipeline and returns how
+// many were removed
+func (pe *PipelineEngine) ClearWorkspaces(pipelineID string) int {
+	if pe.workspaces == nil {
+		return 0
+	}
+
+	m := pe.workspaces
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	removed := 0
+	for _, slot := range m.slotsOf(pipelineID) {
+		if !slot.busy {
+			m.remove(slot)
+			removed++
+		}
+	}
+	return removed
+}
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func workspaceEngine(t *testing.T, root string, policy WorkspacePolicy) *PipelineEngine {
+	t.Helper()
+	engine := newTestEngine(WithWorkspaces(root, policy))
+	pipeline := scriptPipeline("web", `test -f clone && echo warm || touch clone; mkdir -p deps; test -f deps/lib || echo installed > deps/lib`, `exit ${FAIL:-0}`)
+	pipeline.Workspace = &WorkspaceConfig{Dependencies: []string{"deps"}}
+	if err := engine.CreatePipeline(pipeline); err != nil {
+		t.Fatalf("CreatePipeline() error = %v", err)
+	}
+	return engine
+}
+
+func runWorkspaceJob(t *testing.T, engine *PipelineEngine, status Status) *Job {
+	t.Helper()
+	job, err := engine.Run(context.Background(), "web")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if job.Status != status {
+		t.Fatalf("Status = %q, want %q; logs: %+v", job.Status, status, job.Logs)
+	}
+	return job
+}
+
+func TestWorkspace_ReusedBetweenJobs(t *testing.T) {
+	root := t.TempDir()
+	engine := workspaceEngine(t, root, WorkspacePolicy{})
+
+	first := runWorkspaceJob(t, engine, StatusSuccess)
+	if first.Workspace == nil || first.Workspace.Reused || first.Workspace.Reason != "new workspace" {
+		t.Fatalf("first Workspace = %+v, want a new workspace", first.Workspace)
+	}
+
+	second := runWorkspaceJob(t, engine, StatusSuccess)
+	if !second.Workspace.Reused || !second.Workspace.Dependencies["deps"] {
+		t.Errorf("second Workspace = %+v, want reused with deps", second.Workspace)
+	}
+	if second.Steps[0].Output != "warm\n" {
+		t.Errorf("Output = %q, want the clone from the first job", second.Steps[0].Output)
+	}
+
+	// Dependencies changed outside a job fail the integrity check
+	lib := filepath.Join(root, "web", "0", "deps", "lib")
+	if err := os.WriteFile(lib, []byte("tampered"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	third := runWorkspaceJob(t, engine, StatusSuccess)
+	if !third.Workspace.Reused || third.Workspace.Dependencies["deps"] {
+		t.Errorf("third Workspace = %+v, want reused without deps", third.Workspace)
+	}
+	if data, _ := os.ReadFile(lib); string(data) != "installed\n" {
+		t.Errorf("deps/lib = %q, want it reinstalled", data)
+	}
+
+	stats := engine.WorkspaceStats()
+	if len(stats) != 1 {
+		t.Fatalf("WorkspaceStats() = %+v, want one pipeline", stats)
+	}
+	want := WorkspaceStats{PipelineID: "web", Hits: 2, Misses: 1, DependencyHits: 1, DependencyMisses: 1, Workspaces: 1, Bytes: stats[0].Bytes}
+	if stats[0] != want || stats[0].Bytes == 0 {
+		t.Errorf("WorkspaceStats() = %+v, want %+v", stats[0], want)
+	}
+
+	// Statistics and manifests survive a restart
+	restarted := workspaceEngine(t, root, WorkspacePolicy{})
+	if stats := restarted.WorkspaceStats(); len(stats) != 1 || stats[0].Hits != 2 || stats[0].Workspaces != 1 {
+		t.Errorf("WorkspaceStats() after restart = %+v, want the earlier hits", stats)
+	}
+}
+
+func TestWorkspace_UncleanWorkspaceIsWiped(t *testing.T) {
+	root := t.TempDir()
+	engine := workspaceEngine(t, root, WorkspacePolicy{})
+	runWorkspaceJob(t, engine, StatusSuccess)
+
+	// A workspace left in use by a job that never finished is not trusted
+	restarted := newTestEngine(WithWorkspaces(root, WorkspacePolicy{}))
+	restarted.workspaces.slots["web"][0].manifest.State = workspaceInUse
+	pipeline := scriptPipeline("web", "test -f clone && echo warm || echo cold")
+	pipeline.Workspace = &WorkspaceConfig{}
+	restarted.CreatePipeline(pipeline)
+
+	job, _ := restarted.Run(context.Background(), "web")
+	if job.Workspace.Reused || job.Workspace.Reason != "previous job did not finish" {
+		t.Errorf("Workspace = %+v, want wiped after an unfinished job", job.Workspace)
+	}
+	if job.Steps[0].Output != "cold\n" {
+		t.Errorf("Output = %q, want an empty workspace", job.Steps[0].Output)
+	}
+}
+
+func TestWorkspace_FailedJobDiscardsDependencies(t *testing.T) {
+	engine := workspaceEngine(t, t.TempDir(), WorkspacePolicy{})
+	os.Setenv("FAIL", "1")
+	runWorkspaceJob(t, engine, StatusFailed)
+	os.Unsetenv("FAIL")
+
+	job := runWorkspaceJob(t, engine, StatusSuccess)
+	if !job.Workspace.Reused || job.Workspace.Dependencies["deps"] {
+		t.Errorf("Workspace = %+v, want reused without deps of the failed job", job.Workspace)
+	}
+}
+
+func TestWorkspace_Eviction(t *testing.T) {
+	root := t.TempDir()
+	engine := workspaceEngine(t, root, WorkspacePolicy{MaxAge: time.Hour})
+	runWorkspaceJob(t, engine, StatusSuccess)
+
+	m := engine.workspaces
+	m.mu.Lock()
+	kept := m.evict(time.Now())
+	evicted := m.evict(time.Now().Add(2 * time.Hour))
+	m.mu.Unlock()
+	if kept != 0 || evicted != 1 {
+		t.Errorf("evicted %d then %d workspaces, want 0 then 1", kept, evicted)
+	}
+	if _, err := os.Stat(filepath.Join(root, "web", "0")); !os.IsNotExist(err) {
+		t.Errorf("workspace still exists after eviction: %v", err)
+	}
+	if stats := engine.WorkspaceStats(); stats[0].Evictions != 1 || stats[0].Workspaces != 0 {
+		t.Errorf("WorkspaceStats() = %+v, want one eviction and no workspaces", stats)
+	}
+
+	// Over the size limit, the released workspace is evicted right away
+	small := workspaceEngine(t, t.TempDir(), WorkspacePolicy{MaxBytes: 1})
+	runWorkspaceJob(t, small, StatusSuccess)
+	if stats := small.WorkspaceStats(); stats[0].Evictions != 1 {
+		t.Errorf("WorkspaceStats() = %+v, want the oversized workspace evicted", stats)
+	}
+}
@@ -0,0 +1,556 @@
+// Package depcache is a pull-through cache of the Go module proxy and the
+// npm registry that steps download their dependencies through, cutting
+// external bandwidth and keeping builds going while an upstream is down.
+package depcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chip/conveyor/config"
+	"github.com/chip/conveyor/logging"
+)
+
+// Prefix is the path the cache is served under
+const Prefix = "/depcache"
+
+// Ecosystems of the cache
+const (
+	EcosystemGo  = "go"
+	EcosystemNpm = "npm"
+)
+
+// Default upstreams
+const (
+	DefaultGoProxy     = "https://proxy.golang.org"
+	DefaultNpmRegistry = "https://registry.npmjs.org"
+)
+
+// Header reports how a response was served: hit, miss or stale
+const Header = "X-Conveyor-Cache"
+
+// Stats counts the requests of an ecosystem since the server started, and
+// what is cached
+type Stats struct {
+	Ecosystem string `json:"ecosystem"`
+	Upstream  string `json:"upstream"`
+	Requests  int64  `json:"requests"`
+	Hits      int64  `json:"hits"`
+	Misses    int64  `json:"misses"`
+	// Stale counts cached copies served because the upstream failed
+	Stale        int64 `json:"stale"`
+	Denied       int64 `json:"denied"`
+	Errors       int64 `json:"errors"`
+	BytesServed  int64 `json:"bytesServed"`
+	BytesFetched int64 `json:"bytesFetched"`
+	Entries      int   `json:"entries"`
+	SizeBytes    int64 `json:"sizeBytes"`
+}
+
+// entry is the metadata of a cached response, stored next to its body
+type entry struct {
+	Path        string    `json:"path"`
+	ContentType string    `json:"contentType,omitempty"`
+	FetchedAt   time.Time `json:"fetchedAt"`
+	Size        int64     `json:"size"`
+}
+
+// fetch is a request to an upstream that concurrent requests for the same
+// file wait for
+type fetch struct {
+	done chan struct{}
+	// status and body are the upstream's response when it isn't cached
+	status int
+	body   []byte
+	err    error
+}
+
+// Cache caches the responses of the upstreams on disk
+type Cache struct {
+	// TTL is how long mutable metadata, such as version lists, is served
+	// before being refreshed
+	TTL time.Duration
+	// Offline serves cached copies only and never contacts the upstreams
+	Offline bool
+
+	dir       string
+	url       string
+	client    *http.Client
+	upstreams map[string]string
+	allow     []string
+	deny      []string
+
+	mu      sync.Mutex
+	stats   map[string]*Stats
+	fetches map[string]*fetch
+}
+
+// New creates a cache of the settings that keeps the cached files in dir.
+// client reaches the upstreams.
+func New(settings config.DependencyCache, dir string, client *http.Client) (*Cache, error) {
+	upstreams := map[string]string{EcosystemGo: DefaultGoProxy, EcosystemNpm: DefaultNpmRegistry}
+	if settings.GoProxy != "" {
+		upstreams[EcosystemGo] = settings.GoProxy
+	}
+	if settings.NpmRegistry != "" {
+		upstreams[EcosystemNpm] = settings.NpmRegistry
+	}
+	c := &Cache{
+		TTL:       5 * time.Minute,
+		dir:       dir,
+		url:       strings.TrimSuffix(settings.URL, "/"),
+		client:    client,
+		upstreams: map[string]string{},
+		allow:     settings.Allow,
+		deny:      settings.Deny,
+		stats:     map[string]*Stats{},
+		fetches:   map[string]*fetch{},
+	}
+	for ecosystem, upstream := range upstreams {
+		if err := os.MkdirAll(filepath.Join(dir, ecosystem), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create dependency cache directory: %w", err)
+		}
+		c.upstreams[ecosystem] = strings.TrimSuffix(upstream, "/")
+		c.stats[ecosystem] = &Stats{Ecosystem: ecosystem, Upstream: c.upstreams[ecosystem]}
+	}
+	return c, nil
+}
+
+// Environment returns the variables pointing Go and npm at the cache at
+// base, the URL of Prefix
+func Environment(base string) map[string]string {
+	base = strings.TrimSuffix(base, "/")
+	return map[string]string{
+		"GOPROXY":             base + "/" + EcosystemGo,
+		"npm_config_registry": base + "/" + EcosystemNpm + "/",
+	}
+}
+
+// Stats returns the statistics of each ecosystem
+func (c *Cache) Stats() []Stats {
+	c.mu.Lock()
+	stats := make([]Stats, 0, len(c.stats))
+	for _, s := range c.stats {
+		stats = append(stats, *s)
+	}
+	c.mu.Unlock()
+
+	for i := range stats {
+		root := filepath.Join(c.dir, stats[i].Ecosystem)
+		filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && !strings.HasSuffix(name, ".json") && !strings.HasSuffix(name, ".tmp") {
+				stats[i].Entries++
+				stats[i].SizeBytes += info.Size()
+			}
+			return nil
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Ecosystem < stats[j].Ecosystem })
+	return stats
+}
+
+// count adds to the statistics of an ecosystem
+func (c *Cache) count(ecosystem string, add func(*Stats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	add(c.stats[ecosystem])
+}
+
+// ServeHTTP serves Go module proxy requests under Prefix/go and npm
+// registry requests under Prefix/npm
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, Prefix), "/")
+	ecosystem, file := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		ecosystem, file = rest[:i], rest[i+1:]
+	}
+	if _, ok := c.upstreams[ecosystem]; !ok || file == "" {
+		http.NotFound(w, r)
+		return
+	}
+	c.count(ecosystem, func(s *Stats) { s.Requests++ })
+
+	if ecosystem == EcosystemNpm && strings.HasPrefix(file, "-/") {
+		// Searches, audits and logins aren't cached
+		c.forward(w, r, ecosystem, file)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, mutable, ok := goRequest(file)
+	key := file
+	if ecosystem == EcosystemNpm {
+		name, mutable, ok = npmRequest(file)
+		if strings.Contains(r.Header.Get("Accept"), "application/vnd.npm.install-v1+json") {
+			// Abbreviated package documents are cached apart from full ones
+			key += "#install-v1"
+		}
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if name != "" && !c.allowed(name) {
+		c.count(ecosystem, func(s *Stats) { s.Denied++ })
+		http.Error(w, fmt.Sprintf("%s is not allowed by the dependency cache", name), http.StatusForbidden)
+		return
+	}
+	c.serve(w, r, ecosystem, key, c.upstreams[ecosystem]+"/"+upstreamPath(r, ecosystem, file), mutable)
+}
+
+// upstreamPath returns the escaped path of file, keeping escapes such as
+// the %2f of scoped npm packages
+func upstreamPath(r *http.Request, ecosystem, file string) string {
+	prefix := Prefix + "/" + ecosystem + "/"
+	if escaped := r.URL.EscapedPath(); strings.HasPrefix(escaped, prefix) {
+		return escaped[len(prefix):]
+	}
+	return file
+}
+
+// goRequest returns the module path of a Go module proxy request, and
+// whether its response changes over time
+func goRequest(file string) (module string, mutable, ok bool) {
+	if strings.HasPrefix(file, "sumdb/") {
+		// Checksum database tiles and lookups never change; its latest
+		// signed tree head and whether it is proxied do
+		return "", !strings.Contains(file, "/tile/") && !strings.Contains(file, "/lookup/"), true
+	}
+	if strings.HasSuffix(file, "/@latest") {
+		return unescapeModule(strings.TrimSuffix(file, "/@latest")), true, true
+	}
+	i := strings.Index(file, "/@v/")
+	if i < 0 {
+		return "", false, false
+	}
+	module = unescapeModule(file[:i])
+	return module, file[i+len("/@v/"):] == "list", true
+}
+
+// unescapeModule reverses the case encoding of module paths, where "!a"
+// stands for "A"
+func unescapeModule(escaped string) string {
+	var b strings.Builder
+	bang := false
+	for _, r := range escaped {
+		switch {
+		case r == '!':
+			bang = true
+			continue
+		case bang && r >= 'a' && r <= 'z':
+			r -= 'a' - 'A'
+		}
+		bang = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// npmRequest returns the package of an npm registry request, and whether
+// its response changes over time. Package documents change as versions
+// are published; tarballs don't.
+func npmRequest(file string) (name string, mutable, ok bool) {
+	if i := strings.Index(file, "/-/"); i >= 0 {
+		return file[:i], false, strings.HasSuffix(file, ".tgz")
+	}
+	parts := strings.Split(file, "/")
+	name = parts[0]
+	if strings.HasPrefix(name, "@") {
+		if len(parts) < 2 {
+			return "", false, false
+		}
+		name += "/" + parts[1]
+	}
+	return name, true, true
+}
+
+// allowed reports whether a module or package may be fetched: it matches
+// no deny pattern, and an allow pattern when there are any
+func (c *Cache) allowed(name string) bool {
+	for _, pattern := range c.deny {
+		if matchName(pattern, name) {
+			return false
+		}
+	}
+	if len(c.allow) == 0 {
+		return true
+	}
+	for _, pattern := range c.allow {
+		if matchName(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchName reports whether a glob pattern matches name or one of its
+// parent paths, so "github.com/acme/*" matches github.com/acme/lib/v2
+func matchName(pattern, name string) bool {
+	for {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		i := strings.LastIndex(name, "/")
+		if i < 0 {
+			return false
+		}
+		name = name[:i]
+	}
+}
+
+// files returns the paths of the body and metadata of a cached response
+func (c *Cache) files(ecosystem, key string) (body, meta string) {
+	sum := sha256.Sum256([]byte(key))
+	id := hex.EncodeToString(sum[:])
+	body = filepath.Join(c.dir, ecosystem, id[:2], id)
+	return body, body + ".json"
+}
+
+// lookup returns the cached entry of a key
+func (c *Cache) lookup(ecosystem, key string) (*entry, bool) {
+	_, meta := c.files(ecosystem, key)
+	data, err := os.ReadFile(meta)
+	if err != nil {
+		return nil, false
+	}
+	var e entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, false
+	}
+	return &e, true
+}
+
+// serve responds with the cached copy of a key, fetching it when it isn't
+// cached or, for mutable files, is older than the TTL. A cached copy is
+// served when the upstream fails.
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, ecosystem, key, target string, mutable bool) {
+	cached, found := c.lookup(ecosystem, key)
+	if found && (c.Offline || !mutable || time.Since(cached.FetchedAt) < c.TTL) {
+		c.count(ecosystem, func(s *Stats) { s.Hits++ })
+		c.write(w, r, ecosystem, key, cached, "hit")
+		return
+	}
+	if c.Offline {
+		c.count(ecosystem, func(s *Stats) { s.Misses++ })
+		http.Error(w, "not in the dependency cache, and offline mode doesn't fetch it", http.StatusNotFound)
+		return
+	}
+
+	f := c.fetch(ecosystem, key, target, r.Header.Get("Accept"))
+	switch {
+	case f.err == nil && f.status == http.StatusOK:
+		fetched, ok := c.lookup(ecosystem, key)
+		if ok {
+			c.count(ecosystem, func(s *Stats) { s.Misses++ })
+			c.write(w, r, ecosystem, key, fetched, "miss")
+			return
+		}
+		f.err = fmt.Errorf("cached copy of %s disappeared", key)
+	case f.err == nil && f.status < http.StatusInternalServerError:
+		// Not found and the like are passed on, uncached
+		c.count(ecosystem, func(s *Stats) { s.Misses++ })
+		w.Header().Set(Header, "miss")
+		w.WriteHeader(f.status)
+		w.Write(f.body)
+		return
+	case f.err == nil:
+		f.err = fmt.Errorf("%s responded %d", target, f.status)
+	}
+
+	if found {
+		logging.Warnf("Dependency cache: serving a stale copy of %s: %v", key, f.err)
+		c.count(ecosystem, func(s *Stats) { s.Stale++ })
+		c.write(w, r, ecosystem, key, cached, "stale")
+		return
+	}
+	c.count(ecosystem, func(s *Stats) { s.Errors++ })
+	http.Error(w, fmt.Sprintf("failed to fetch %s: %v", key, f.err), http.StatusBadGateway)
+}
+
+// fetch downloads a key from the upstream into the cache, once for
+// concurrent requests
+func (c *Cache) fetch(ecosystem, key, target, accept string) *fetch {
+	id := ecosystem + "/" + key
+	c.mu.Lock()
+	if f, ok := c.fetches[id]; ok {
+		c.mu.Unlock()
+		<-f.done
+		return f
+	}
+	f := &fetch{done: make(chan struct{})}
+	c.fetches[id] = f
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.fetches, id)
+		c.mu.Unlock()
+		close(f.done)
+	}()
+
+	// The download outlives the request that started it, which other
+	// requests may be waiting on
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, target, nil)
+	if err != nil {
+		f.err = err
+		return f
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		f.err = err
+		return f
+	}
+	defer resp.Body.Close()
+	f.status = resp.StatusCode
+	if resp.StatusCode != http.StatusOK {
+		f.body, _ = io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return f
+	}
+
+	body, meta := c.files(ecosystem, key)
+	if err := os.MkdirAll(filepath.Dir(body), 0755); err != nil {
+		f.err = err
+		return f
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(body), "fetch-*.tmp")
+	if err != nil {
+		f.err = err
+		return f
+	}
+	defer os.Remove(tmp.Name())
+	size, err := io.Copy(tmp, resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		f.err = fmt.Errorf("failed to download %s: %w", target, err)
+		return f
+	}
+	c.count(ecosystem, func(s *Stats) { s.BytesFetched += size })
+	data, _ := json.Marshal(entry{Path: key, ContentType: resp.Header.Get("Content-Type"), FetchedAt: time.Now(), Size: size})
+	if err := os.Rename(tmp.Name(), body); err != nil {
+		f.err = err
+		return f
+	}
+	if err := os.WriteFile(meta, data, 0644); err != nil {
+		f.err = err
+	}
+	return f
+}
+
+// write responds with a cached entry. npm package documents have their
+// tarball URLs pointed at the cache.
+func (c *Cache) write(w http.ResponseWriter, r *http.Request, ecosystem, key string, e *entry, how string) {
+	body, _ := c.files(ecosystem, key)
+	data, err := os.ReadFile(body)
+	if err != nil {
+		c.count(ecosystem, func(s *Stats) { s.Errors++ })
+		http.Error(w, fmt.Sprintf("failed to read the cached copy of %s", key), http.StatusInternalServerError)
+		return
+	}
+	if ecosystem == EcosystemNpm && !strings.Contains(key, "/-/") {
+		if rewritten, err := rewriteTarballs(data, c.upstreams[EcosystemNpm], c.base(r)+"/"+EcosystemNpm); err == nil {
+			data = rewritten
+		}
+	}
+	if e.ContentType != "" {
+		w.Header().Set("Content-Type", e.ContentType)
+	}
+	w.Header().Set(Header, how)
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	w.Write(data)
+	c.count(ecosystem, func(s *Stats) { s.BytesServed += int64(len(data)) })
+}
+
+// base returns the URL of Prefix as the client reached it
+func (c *Cache) base(r *http.Request) string {
+	if c.url != "" {
+		return c.url
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + Prefix
+}
+
+// rewriteTarballs points the tarball URLs of an npm package document that
+// are on the upstream registry at base
+func rewriteTarballs(data []byte, upstream, base string) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	versions := []interface{}{doc}
+	if all, ok := doc["versions"].(map[string]interface{}); ok {
+		for _, version := range all {
+			versions = append(versions, version)
+		}
+	}
+	for _, version := range versions {
+		manifest, _ := version.(map[string]interface{})
+		dist, _ := manifest["dist"].(map[string]interface{})
+		if tarball, ok := dist["tarball"].(string); ok && strings.HasPrefix(tarball, upstream+"/") {
+			dist["tarball"] = base + strings.TrimPrefix(tarball, upstream)
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// forward passes a request the cache doesn't handle on to the upstream
+func (c *Cache) forward(w http.ResponseWriter, r *http.Request, ecosystem, file string) {
+	if c.Offline {
+		http.Error(w, "offline mode doesn't reach the registry", http.StatusServiceUnavailable)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, c.upstreams[ecosystem]+"/"+upstreamPath(r, ecosystem, file)+queryOf(r), r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, name := range []string{"Accept", "Authorization", "Content-Type", "Npm-Command", "Npm-Session"} {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.count(ecosystem, func(s *Stats) { s.Errors++ })
+		http.Error(w, fmt.Sprintf("failed to reach the registry: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	n, _ := io.Copy(w, resp.Body)
+	c.count(ecosystem, func(s *Stats) { s.BytesServed += n; s.BytesFetched += n })
+}
+
+// queryOf returns the query of a request with its question mark
+func queryOf(r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return ""
+	}
+	return "?" + r.URL.RawQuery
+}
@@ -0,0 +1,188 @@
+package depcache
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chip/conveyor/config"
+)
+
+// upstream is a fake module proxy and registry counting its requests
+type upstream struct {
+	*httptest.Server
+	requests int64
+	down     int32
+}
+
+func newUpstream(t *testing.T) *upstream {
+	u := &upstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&u.requests, 1)
+		if atomic.LoadInt32(&u.down) == 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.EscapedPath() {
+		case "/github.com/!acme/lib/@v/list":
+			io.WriteString(w, "v1.0.0\n")
+		case "/github.com/!acme/lib/@v/v1.0.0.zip":
+			time.Sleep(20 * time.Millisecond)
+			w.Header().Set("Content-Type", "application/zip")
+			io.WriteString(w, "zip")
+		case "/@acme%2fwidget":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"name": "@acme/widget",
+				"versions": map[string]interface{}{
+					"1.0.0": map[string]interface{}{"dist": map[string]interface{}{"tarball": u.URL + "/@acme/widget/-/widget-1.0.0.tgz"}},
+				},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func newTestCache(t *testing.T, u *upstream, settings config.DependencyCache) *Cache {
+	t.Helper()
+	settings.GoProxy, settings.NpmRegistry = u.URL, u.URL
+	cache, err := New(settings, t.TempDir(), u.Client())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return cache
+}
+
+// get requests a path of the cache, returning the status, how it was
+// served and the body
+func get(cache *Cache, path string) (int, string, string) {
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://ci.example.com"+Prefix+path, nil))
+	return w.Code, w.Header().Get(Header), w.Body.String()
+}
+
+func TestCache_Go(t *testing.T) {
+	u := newUpstream(t)
+	cache := newTestCache(t, u, config.DependencyCache{})
+
+	// Concurrent requests for a file download it once
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code, _, body := get(cache, "/go/github.com/!acme/lib/@v/v1.0.0.zip"); code != http.StatusOK || body != "zip" {
+				t.Errorf("GET zip = %d %q, want 200 zip", code, body)
+			}
+		}()
+	}
+	wg.Wait()
+	if code, how, _ := get(cache, "/go/github.com/!acme/lib/@v/v1.0.0.zip"); code != http.StatusOK || how != "hit" {
+		t.Errorf("GET zip again = %d %s, want a 200 hit", code, how)
+	}
+	if n := atomic.LoadInt64(&u.requests); n != 1 {
+		t.Errorf("upstream requests = %d, want 1", n)
+	}
+
+	if code, how, _ := get(cache, "/go/github.com/!acme/missing/@v/list"); code != http.StatusNotFound || how != "miss" {
+		t.Errorf("GET missing = %d %s, want a 404 miss", code, how)
+	}
+
+	// Version lists are refreshed after the TTL, and served stale while
+	// the upstream is down
+	cache.TTL = 0
+	get(cache, "/go/github.com/!acme/lib/@v/list")
+	atomic.StoreInt32(&u.down, 1)
+	if code, how, body := get(cache, "/go/github.com/!acme/lib/@v/list"); code != http.StatusOK || how != "stale" || body != "v1.0.0\n" {
+		t.Errorf("GET list while down = %d %s %q, want a stale copy", code, how, body)
+	}
+	if code, _, _ := get(cache, "/go/github.com/!acme/lib/@v/v2.0.0.mod"); code != http.StatusBadGateway {
+		t.Errorf("GET uncached while down = %d, want 502", code)
+	}
+
+	stats := cache.Stats()
+	if len(stats) != 2 || stats[0].Ecosystem != EcosystemGo {
+		t.Fatalf("Stats() = %+v, want go then npm", stats)
+	}
+	s := stats[0]
+	if s.Requests != 8 || s.Hits+s.Misses != 6 || s.Stale != 1 || s.Errors != 1 || s.Entries != 2 || s.BytesFetched != 10 {
+		t.Errorf("go stats = %+v", s)
+	}
+}
+
+func TestCache_Npm(t *testing.T) {
+	u := newUpstream(t)
+	cache := newTestCache(t, u, config.DependencyCache{})
+
+	code, _, body := get(cache, "/npm/@acme%2fwidget")
+	if code != http.StatusOK {
+		t.Fatalf("GET packument = %d %q", code, body)
+	}
+	var doc struct {
+		Versions map[string]struct {
+			Dist struct {
+				Tarball string `json:"tarball"`
+			} `json:"dist"`
+		} `json:"versions"`
+	}
+	json.Unmarshal([]byte(body), &doc)
+	want := "http://ci.example.com/depcache/npm/@acme/widget/-/widget-1.0.0.tgz"
+	if got := doc.Versions["1.0.0"].Dist.Tarball; got != want {
+		t.Errorf("tarball = %q, want %q", got, want)
+	}
+}
+
+func TestCache_AllowDeny(t *testing.T) {
+	u := newUpstream(t)
+	cache := newTestCache(t, u, config.DependencyCache{
+		Allow: []string{"github.com/Acme/*", "@acme/*"},
+		Deny:  []string{"github.com/Acme/secret"},
+	})
+	for path, want := range map[string]int{
+		"/go/github.com/!acme/lib/@v/list":       http.StatusOK,
+		"/go/github.com/!acme/secret/@v/list":    http.StatusForbidden,
+		"/go/github.com/!acme/secret/v2/@v/list": http.StatusForbidden,
+		"/go/github.com/evil/lib/@v/list":        http.StatusForbidden,
+		"/npm/@acme%2fwidget":                    http.StatusOK,
+		"/npm/left-pad":                          http.StatusForbidden,
+	} {
+		if code, _, _ := get(cache, path); code != want {
+			t.Errorf("GET %s = %d, want %d", path, code, want)
+		}
+	}
+	if denied := cache.Stats()[0].Denied; denied != 3 {
+		t.Errorf("go Denied = %d, want 3", denied)
+	}
+}
+
+func TestCache_Offline(t *testing.T) {
+	u := newUpstream(t)
+	cache := newTestCache(t, u, config.DependencyCache{})
+	get(cache, "/go/github.com/!acme/lib/@v/list")
+
+	cache.Offline, cache.TTL = true, 0
+	if code, how, _ := get(cache, "/go/github.com/!acme/lib/@v/list"); code != http.StatusOK || how != "hit" {
+		t.Errorf("GET cached = %d %s, want a 200 hit", code, how)
+	}
+	if code, _, _ := get(cache, "/go/github.com/!acme/lib/@v/v1.0.0.zip"); code != http.StatusNotFound {
+		t.Errorf("GET uncached = %d, want 404", code)
+	}
+	if n := atomic.LoadInt64(&u.requests); n != 1 {
+		t.Errorf("upstream requests = %d, want 1", n)
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	env := Environment("http://localhost:8080/depcache/")
+	if env["GOPROXY"] != "http://localhost:8080/depcache/go" || env["npm_config_registry"] != "http://localhost:8080/depcache/npm/" {
+		t.Errorf("Environment() = %v", env)
+	}
+}
@@ -0,0 +1,294 @@
+// Package eventbus shares engine events between the replicas of a server
+// over a Redis stream.
+package eventbus
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chip/conveyor/config"
+	"github.com/chip/conveyor/core"
+)
+
+// Defaults of the stream settings
+const (
+	DefaultStream = "conveyor:events"
+	DefaultMaxLen = 100000
+)
+
+// maxIdleConns is how many idle connections are kept for reuse
+const maxIdleConns = 8
+
+// dialTimeout bounds connecting to Redis and commands that don't block
+const dialTimeout = 5 * time.Second
+
+// Redis is an event bus on a Redis stream. Events are appended with XADD,
+// which trims the stream to about MaxLen events, and positions are stream
+// entry IDs, so every replica reads the events in the same order.
+type Redis struct {
+	addr     string
+	tls      *tls.Config
+	username string
+	password string
+	db       int
+	stream   string
+	maxLen   int
+	idle     chan *conn
+}
+
+// NewRedis creates an event bus on the stream of the settings. It doesn't
+// connect until the bus is used.
+func NewRedis(settings config.EventBus) (*Redis, error) {
+	u, err := url.Parse(settings.URL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		return nil, fmt.Errorf("invalid redis url %q", settings.URL)
+	}
+	r := &Redis{
+		addr:   u.Host,
+		stream: settings.Stream,
+		maxLen: settings.MaxLen,
+		idle:   make(chan *conn, maxIdleConns),
+	}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.Scheme == "rediss" {
+		r.tls = &tls.Config{ServerName: u.Hostname()}
+	}
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	if r.stream == "" {
+		r.stream = DefaultStream
+	}
+	if r.maxLen <= 0 {
+		r.maxLen = DefaultMaxLen
+	}
+	return r, nil
+}
+
+// Publish appends an event to the stream
+func (r *Redis) Publish(ctx context.Context, event core.Event) (string, error) {
+	event.Position = ""
+	data, err := json.Marshal(event)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode event: %w", err)
+	}
+	reply, err := r.do(ctx, 0, "XADD", r.stream, "MAXLEN", "~", strconv.Itoa(r.maxLen), "*", "event", string(data))
+	if err != nil {
+		return "", err
+	}
+	id, ok := reply.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected XADD reply %v", reply)
+	}
+	return id, nil
+}
+
+// Read returns the events after a position with XREAD, blocking up to wait
+// for one when there are none
+func (r *Redis) Read(ctx context.Context, after string, limit int, wait time.Duration) ([]core.Event, error) {
+	if after == "" {
+		after = "0-0"
+	} else if !validID(after) {
+		return nil, fmt.Errorf("%w %q", core.ErrInvalidEventPosition, after)
+	}
+	args := []string{"XREAD", "COUNT", strconv.Itoa(limit)}
+	if wait > 0 {
+		// A block of 0 would wait forever
+		args = append(args, "BLOCK", strconv.FormatInt(int64((wait+time.Millisecond-1)/time.Millisecond), 10))
+	}
+	args = append(args, "STREAMS", r.stream, after)
+	reply, err := r.do(ctx, wait, args...)
+	if err != nil {
+		return nil, err
+	}
+	events := []core.Event{}
+	// A reply of streams and their entries, or nil when none arrived
+	streams, _ := reply.([]interface{})
+	for _, stream := range streams {
+		pair, ok := stream.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("unexpected XREAD reply %v", reply)
+		}
+		entries, err := decodeEntries(pair[1])
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, entries...)
+	}
+	return events, nil
+}
+
+// Last returns the ID of the stream's newest entry
+func (r *Redis) Last(ctx context.Context) (string, error) {
+	reply, err := r.do(ctx, 0, "XREVRANGE", r.stream, "+", "-", "COUNT", "1")
+	if err != nil {
+		return "", err
+	}
+	entries, err := decodeEntries(reply)
+	if err != nil || len(entries) == 0 {
+		return "", err
+	}
+	return entries[0].Position, nil
+}
+
+// decodeEntries decodes stream entries of an event field into events at
+// the entries' IDs
+func decodeEntries(reply interface{}) ([]core.Event, error) {
+	entries, ok := reply.([]interface{})
+	if !ok && reply != nil {
+		return nil, fmt.Errorf("unexpected stream entries %v", reply)
+	}
+	events := make([]core.Event, 0, len(entries))
+	for _, entry := range entries {
+		pair, ok := entry.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("unexpected stream entry %v", entry)
+		}
+		id, _ := pair[0].(string)
+		fields, _ := pair[1].([]interface{})
+		for i := 0; i+1 < len(fields); i += 2 {
+			if name, _ := fields[i].(string); name != "event" {
+				continue
+			}
+			data, _ := fields[i+1].(string)
+			var event core.Event
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				return nil, fmt.Errorf("failed to decode event %s: %w", id, err)
+			}
+			event.Position = id
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// validID reports whether id is a stream entry ID, ms-seq or ms
+func validID(id string) bool {
+	ms, seq := id, "0"
+	if i := strings.Index(id, "-"); i >= 0 {
+		ms, seq = id[:i], id[i+1:]
+	}
+	_, err := strconv.ParseUint(ms, 10, 64)
+	if err != nil {
+		return false
+	}
+	_, err = strconv.ParseUint(seq, 10, 64)
+	return err == nil
+}
+
+// do runs a command on an idle connection or a new one. block is how long
+// the command may block in Redis on top of the usual timeout.
+func (r *Redis) do(ctx context.Context, block time.Duration, args ...string) (interface{}, error) {
+	c, err := r.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(dialTimeout + block)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+
+	// Canceling ctx interrupts a blocked read
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	reply, err := c.do(args...)
+	close(done)
+
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			// The connection is in an unknown state
+			c.conn.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("redis %s: %w", args[0], err)
+		}
+		r.put(c)
+		return nil, fmt.Errorf("redis %s: %w", args[0], err)
+	}
+	r.put(c)
+	return reply, nil
+}
+
+// get returns an idle connection, or connects and authenticates a new one
+func (r *Redis) get(ctx context.Context) (*conn, error) {
+	select {
+	case c := <-r.idle:
+		return c, nil
+	default:
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var nc net.Conn
+	var err error
+	if r.tls != nil {
+		nc, err = (&tls.Dialer{NetDialer: dialer, Config: r.tls}).DialContext(ctx, "tcp", r.addr)
+	} else {
+		nc, err = dialer.DialContext(ctx, "tcp", r.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	c := &conn{conn: nc, r: bufio.NewReader(nc)}
+	nc.SetDeadline(time.Now().Add(dialTimeout))
+	if r.password != "" {
+		args := []string{"AUTH", r.password}
+		if r.username != "" {
+			args = []string{"AUTH", r.username, r.password}
+		}
+		if _, err := c.do(args...); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("failed to authenticate to redis: %w", err)
+		}
+	}
+	if r.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(r.db)); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("failed to select redis database %d: %w", r.db, err)
+		}
+	}
+	return c, nil
+}
+
+// put keeps a connection for reuse, or closes it when enough are idle
+func (r *Redis) put(c *conn) {
+	select {
+	case r.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// Close closes the idle connections
+func (r *Redis) Close() error {
+	for {
+		select {
+		case c := <-r.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
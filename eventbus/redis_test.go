@@ -0,0 +1,144 @@
+package eventbus
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chip/conveyor/config"
+	"github.com/chip/conveyor/core"
+)
+
+// fakeRedis serves a stream's XADD, XREAD and XREVRANGE over RESP
+type fakeRedis struct {
+	mu       sync.Mutex
+	entries  [][2]string
+	commands []string
+}
+
+func (f *fakeRedis) serve(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (f *fakeRedis) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, arg.(string))
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, strings.Join(args, " "))
+		var out string
+		switch args[0] {
+		case "AUTH", "SELECT":
+			out = "+OK\r\n"
+		case "XADD":
+			id := fmt.Sprintf("%d-0", len(f.entries)+1)
+			f.entries = append(f.entries, [2]string{id, args[len(args)-1]})
+			out = fmt.Sprintf("$%d\r\n%s\r\n", len(id), id)
+		case "XREAD":
+			after, _ := strconv.Atoi(strings.SplitN(args[len(args)-1], "-", 2)[0])
+			var found [][2]string
+			if after < len(f.entries) {
+				found = f.entries[after:]
+			}
+			if len(found) == 0 {
+				out = "*-1\r\n"
+			} else {
+				out = fmt.Sprintf("*1\r\n*2\r\n$%d\r\n%s\r\n%s", len(args[len(args)-2]), args[len(args)-2], encodeEntries(found))
+			}
+		case "XREVRANGE":
+			if len(f.entries) == 0 {
+				out = "*0\r\n"
+			} else {
+				out = encodeEntries(f.entries[len(f.entries)-1:])
+			}
+		default:
+			out = "-ERR unknown command\r\n"
+		}
+		f.mu.Unlock()
+		c.Write([]byte(out))
+	}
+}
+
+func encodeEntries(entries [][2]string) string {
+	out := fmt.Sprintf("*%d\r\n", len(entries))
+	for _, e := range entries {
+		out += fmt.Sprintf("*2\r\n$%d\r\n%s\r\n*2\r\n$5\r\nevent\r\n$%d\r\n%s\r\n", len(e[0]), e[0], len(e[1]), e[1])
+	}
+	return out
+}
+
+func TestRedis(t *testing.T) {
+	fake := &fakeRedis{}
+	addr := fake.serve(t)
+	bus, err := NewRedis(config.EventBus{URL: "redis://:secret@" + addr + "/2", MaxLen: 50})
+	if err != nil {
+		t.Fatalf("NewRedis() error = %v", err)
+	}
+	defer bus.Close()
+	ctx := context.Background()
+
+	if last, err := bus.Last(ctx); err != nil || last != "" {
+		t.Errorf("Last() = %q, %v, want no position", last, err)
+	}
+	for _, jobID := range []string{"job-1", "job-2"} {
+		if _, err := bus.Publish(ctx, core.Event{Type: "job_started", JobID: jobID, Origin: "replica-a"}); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+	if last, err := bus.Last(ctx); err != nil || last != "2-0" {
+		t.Errorf("Last() = %q, %v, want 2-0", last, err)
+	}
+
+	events, err := bus.Read(ctx, "", 10, 0)
+	if err != nil || len(events) != 2 || events[0].JobID != "job-1" || events[0].Position != "1-0" || events[1].Origin != "replica-a" {
+		t.Fatalf("Read() = %+v, %v, want both events at their positions", events, err)
+	}
+	if events, err := bus.Read(ctx, "2-0", 10, 10*time.Millisecond); err != nil || len(events) != 0 {
+		t.Errorf("Read() after the last event = %+v, %v, want none", events, err)
+	}
+	if _, err := bus.Read(ctx, "latest", 10, 0); !errors.Is(err, core.ErrInvalidEventPosition) {
+		t.Errorf("Read() of an invalid position error = %v, want ErrInvalidEventPosition", err)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.commands[0] != "AUTH secret" || fake.commands[1] != "SELECT 2" {
+		t.Errorf("commands = %q, want the connection authenticated and the database selected", fake.commands)
+	}
+	if !strings.HasPrefix(fake.commands[3], "XADD conveyor:events MAXLEN ~ 50 * event ") {
+		t.Errorf("command = %q, want XADD trimming the default stream", fake.commands[3])
+	}
+	if !strings.Contains(strings.Join(fake.commands, "\n"), "XREAD COUNT 10 BLOCK 10 STREAMS conveyor:events 2-0") {
+		t.Errorf("commands = %q, want a blocking XREAD", fake.commands)
+	}
+}
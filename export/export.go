@@ -0,0 +1,264 @@
+// Package export writes jobs, steps and tracked security findings as CSV or
+// Parquet files partitioned by date, for analytics warehouses to load.
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/chip/conveyor/config"
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/logging"
+	"github.com/chip/conveyor/plugins/security"
+)
+
+// Formats of exported files
+const (
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+)
+
+// FindingSource lists tracked security findings
+type FindingSource interface {
+	Findings(filter security.FindingFilter) []security.TrackedFinding
+}
+
+// Request selects the records of an export: the jobs and their steps that
+// ended at or after Since and before Until, and the tracked findings as of
+// the export
+type Request struct {
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+	Format string    `json:"format,omitempty"`
+}
+
+// Validate checks a request's period and format
+func (r Request) Validate() error {
+	if !r.Until.IsZero() && r.Until.Before(r.Since) {
+		return fmt.Errorf("since %s is after until %s", r.Since.Format(time.RFC3339), r.Until.Format(time.RFC3339))
+	}
+	switch r.Format {
+	case "", FormatCSV, FormatParquet:
+		return nil
+	}
+	return fmt.Errorf("unsupported format %q, want csv or parquet", r.Format)
+}
+
+// File is a file an export wrote
+type File struct {
+	Key   string `json:"key"`
+	Table string `json:"table"`
+	Rows  int    `json:"rows"`
+	Bytes int    `json:"bytes"`
+}
+
+// Result is the outcome of an export
+type Result struct {
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+	Format string    `json:"format"`
+	Files  []File    `json:"files"`
+	At     time.Time `json:"at"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// Status reports where records are exported and how far the periodic
+// export got
+type Status struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	// ExportedUntil is the end of the last period exported. The next
+	// periodic export starts there.
+	ExportedUntil time.Time `json:"exportedUntil,omitempty"`
+	LastRun       *Result   `json:"lastRun,omitempty"`
+}
+
+// Exporter exports records to a sink, one export at a time
+type Exporter struct {
+	engine   *core.PipelineEngine
+	findings FindingSource
+	sink     Sink
+	format   string
+	state    string
+
+	mu     sync.Mutex
+	status Status
+}
+
+// New creates an exporter for the settings that keeps its progress in
+// dir. findings may be nil.
+func New(settings config.Export, dir string, engine *core.PipelineEngine, findings FindingSource) (*Exporter, error) {
+	sink, err := NewSink(settings)
+	if err != nil {
+		return nil, err
+	}
+	format := settings.Format
+	if format == "" {
+		format = FormatCSV
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create export directory: %w", err)
+	}
+	e := &Exporter{
+		engine:   engine,
+		findings: findings,
+		sink:     sink,
+		format:   format,
+		state:    filepath.Join(dir, "state.json"),
+	}
+	e.status = Status{Path: settings.Path, Format: format}
+	data, err := os.ReadFile(e.state)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read export state: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &e.status); err != nil {
+			return nil, fmt.Errorf("failed to parse export state: %w", err)
+		}
+		e.status.Path, e.status.Format = settings.Path, format
+	}
+	return e, nil
+}
+
+// Status returns the exporter's status
+func (e *Exporter) Status() Status {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.status
+}
+
+// Run exports the records of each interval until ctx is done
+func (e *Exporter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if result, err := e.ExportPending(ctx, now); err != nil {
+				logging.Warnf("Failed to export records: %v", err)
+			} else {
+				logging.Infof("Exported %d files of records up to %s", len(result.Files), now.Format(time.RFC3339))
+			}
+		}
+	}
+}
+
+// ExportPending exports the records since the last periodic export up to
+// now and moves it forward on success. The first export takes every
+// record.
+func (e *Exporter) ExportPending(ctx context.Context, now time.Time) (Result, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	result, err := e.export(ctx, Request{Since: e.status.ExportedUntil, Until: now})
+	e.status.LastRun = &result
+	if err == nil {
+		e.status.ExportedUntil = now
+	}
+	if saveErr := e.save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return result, err
+}
+
+// Export exports the records a request selects. Until defaults to now and
+// Format to the configured format. It doesn't move the periodic export
+// forward.
+func (e *Exporter) Export(ctx context.Context, req Request) (Result, error) {
+	if req.Until.IsZero() {
+		req.Until = time.Now()
+	}
+	if err := req.Validate(); err != nil {
+		return Result{}, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	result, err := e.export(ctx, req)
+	e.status.LastRun = &result
+	return result, err
+}
+
+// export writes the tables of a request, one file per table and date.
+// Callers must hold e.mu.
+func (e *Exporter) export(ctx context.Context, req Request) (Result, error) {
+	format := req.Format
+	if format == "" {
+		format = e.format
+	}
+	result := Result{Since: req.Since, Until: req.Until, Format: format, Files: []File{}, At: time.Now()}
+
+	// Jobs and steps are partitioned by the day they ended
+	jobs := make(map[string]*Table)
+	steps := make(map[string]*Table)
+	var dates []string
+	for _, job := range e.engine.FinishedJobs(req.Since, req.Until) {
+		date := job.EndedAt.UTC().Format("2006-01-02")
+		if jobs[date] == nil {
+			jobs[date] = &Table{Name: "jobs", Columns: jobColumns}
+			steps[date] = &Table{Name: "steps", Columns: stepColumns}
+			dates = append(dates, date)
+		}
+		jobs[date].Rows = append(jobs[date].Rows, jobRow(job))
+		for _, step := range job.Steps {
+			steps[date].Rows = append(steps[date].Rows, stepRow(job, step))
+		}
+	}
+	var tables []dated
+	for _, date := range dates {
+		tables = append(tables, dated{date, jobs[date]}, dated{date, steps[date]})
+	}
+
+	// Findings are a snapshot as of the export
+	if e.findings != nil {
+		findings := &Table{Name: "findings", Columns: findingColumns}
+		for _, tracked := range e.findings.Findings(security.FindingFilter{}) {
+			findings.Rows = append(findings.Rows, findingRow(tracked))
+		}
+		tables = append(tables, dated{req.Until.UTC().Format("2006-01-02"), findings})
+	}
+
+	stamp := req.Until.UTC().Format("20060102T150405Z")
+	for _, t := range tables {
+		key := fmt.Sprintf("%s/date=%s/%s-%s.%s", t.table.Name, t.date, t.table.Name, stamp, format)
+		var data []byte
+		if format == FormatParquet {
+			data = encodeParquet(t.table)
+		} else {
+			data = encodeCSV(t.table)
+		}
+		if err := e.sink.Put(ctx, key, data); err != nil {
+			result.Error = err.Error()
+			return result, err
+		}
+		result.Files = append(result.Files, File{Key: key, Table: t.table.Name, Rows: len(t.table.Rows), Bytes: len(data)})
+	}
+	return result, nil
+}
+
+// dated is a table of a date partition
+type dated struct {
+	date  string
+	table *Table
+}
+
+// save writes the exporter's progress. Callers must hold e.mu.
+func (e *Exporter) save() error {
+	data, err := json.MarshalIndent(e.status, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode export state: %w", err)
+	}
+	if err := os.WriteFile(e.state+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write export state: %w", err)
+	}
+	return os.Rename(e.state+".tmp", e.state)
+}
@@ -0,0 +1,135 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chip/conveyor/config"
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/plugins/security"
+)
+
+type fakeFindings []security.TrackedFinding
+
+func (f fakeFindings) Findings(filter security.FindingFilter) []security.TrackedFinding {
+	return f
+}
+
+func runJob(t *testing.T) *core.PipelineEngine {
+	t.Helper()
+	engine := core.NewPipelineEngine(core.WithLogger(log.New(io.Discard, "", 0)))
+	engine.CreatePipeline(&core.Pipeline{ID: "site", Stages: []core.Stage{{ID: "build", Steps: []core.Step{{ID: "make", Name: "make", Type: "script", Command: "echo built"}}}}})
+	job, err := engine.Run(context.Background(), "site")
+	if err != nil || job.Status != core.StatusSuccess {
+		t.Fatalf("Run() = %+v, %v, want a successful job", job, err)
+	}
+	return engine
+}
+
+func TestExporter_CSV(t *testing.T) {
+	engine := runJob(t)
+	dir := t.TempDir()
+	findings := fakeFindings{{ID: "f1", Scope: "pipeline:site", Status: security.FindingOpen, Finding: security.Finding{Title: "Weak hash, \"md5\"", Severity: "high"}}}
+	exporter, err := New(config.Export{Path: filepath.Join(dir, "warehouse")}, filepath.Join(dir, "state"), engine, findings)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	now := time.Now().Add(time.Second)
+	result, err := exporter.ExportPending(context.Background(), now)
+	if err != nil || len(result.Files) != 3 {
+		t.Fatalf("ExportPending() = %+v, %v, want jobs, steps and findings files", result, err)
+	}
+	date := now.UTC().Format("2006-01-02")
+	data, err := os.ReadFile(filepath.Join(dir, "warehouse", "jobs", "date="+date, "jobs-"+now.UTC().Format("20060102T150405Z")+".csv"))
+	if err != nil {
+		t.Fatalf("jobs file: %v", err)
+	}
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil || len(records) != 2 || records[0][0] != "job_id" || records[1][1] != "site" || records[1][3] != "success" {
+		t.Errorf("jobs file = %q, %v, want a header and the job", records, err)
+	}
+	if records[1][4] != "" {
+		t.Errorf("failure_class = %q, want an empty field for null", records[1][4])
+	}
+
+	// The next periodic export starts where this one ended
+	if status := exporter.Status(); !status.ExportedUntil.Equal(now) || status.Format != FormatCSV {
+		t.Errorf("Status() = %+v, want exported until %s", status, now)
+	}
+	reloaded, err := New(config.Export{Path: filepath.Join(dir, "warehouse")}, filepath.Join(dir, "state"), engine, nil)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if result, err := reloaded.ExportPending(context.Background(), now.Add(time.Minute)); err != nil || len(result.Files) != 0 {
+		t.Errorf("ExportPending() = %+v, %v, want no new jobs", result, err)
+	}
+
+	if _, err := exporter.Export(context.Background(), Request{Since: now, Until: now.Add(-time.Hour)}); err == nil {
+		t.Error("Export() with until before since error = nil, want error")
+	}
+}
+
+func TestEncodeParquet(t *testing.T) {
+	table := &Table{Name: "jobs", Columns: []Column{{"id", String}, {"ended_at", Time}, {"kev", Bool}}}
+	table.Rows = [][]interface{}{
+		{"job-1", time.Unix(1, 0), true},
+		{nil, time.Time{}, false},
+	}
+	data := encodeParquet(table)
+	if !bytes.HasPrefix(data, []byte("PAR1")) || !bytes.HasSuffix(data, []byte("PAR1")) {
+		t.Fatalf("encodeParquet() = %q, want PAR1 magic at both ends", data)
+	}
+	footer := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	if footer <= 0 || footer > len(data)-12 {
+		t.Fatalf("footer length = %d, want within the file of %d bytes", footer, len(data))
+	}
+	meta := data[len(data)-8-footer : len(data)-8]
+	for _, name := range []string{"schema", "id", "ended_at", "kev", "conveyor"} {
+		if !bytes.Contains(meta, []byte(name)) {
+			t.Errorf("footer lacks %q", name)
+		}
+	}
+	// The id column's definition levels mark the second row null: one
+	// bit-packed group of 0b01
+	if !bytes.Contains(data, []byte{2, 0, 0, 0, 3, 1, 5, 0, 0, 0, 'j', 'o', 'b', '-', '1'}) {
+		t.Error("encodeParquet() lacks the id column's levels and values")
+	}
+}
+
+func TestS3Sink(t *testing.T) {
+	var path, auth, sum string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, auth, sum = r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("X-Amz-Content-Sha256")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	sink, err := NewSink(config.Export{Path: "s3://warehouse/ci/", Region: "eu-west-1", Endpoint: server.URL})
+	if err != nil {
+		t.Fatalf("NewSink() error = %v", err)
+	}
+	s3 := sink.(*S3Sink)
+	s3.AccessKeyID, s3.SecretAccessKey = "AKID", "secret"
+	if err := sink.Put(context.Background(), "jobs/date=2026-10-16/jobs.csv", []byte("job_id\n")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if path != "/warehouse/ci/jobs/date=2026-10-16/jobs.csv" || string(body) != "job_id\n" {
+		t.Errorf("upload = %s %q, want the object under the prefix", path, body)
+	}
+	if !strings.Contains(auth, "/eu-west-1/s3/aws4_request") || len(sum) != 64 {
+		t.Errorf("Authorization = %s, X-Amz-Content-Sha256 = %s, want a signed S3 request", auth, sum)
+	}
+}
@@ -0,0 +1,271 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// Parquet physical types, repetitions, converted types and encodings of
+// the format's Thrift definitions
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetOptional = 1
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetPlain = 0
+	parquetRLE   = 3
+)
+
+// Thrift compact protocol field types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// encodeParquet writes a table as an uncompressed Parquet file with one
+// row group. Every column is optional, so unset values are nulls.
+func encodeParquet(table *Table) []byte {
+	var file bytes.Buffer
+	file.WriteString("PAR1")
+
+	type chunk struct {
+		offset, size int64
+	}
+	chunks := make([]chunk, len(table.Columns))
+	for i, column := range table.Columns {
+		page := parquetPage(table, i, column)
+		chunks[i] = chunk{offset: int64(file.Len()), size: int64(len(page))}
+		file.Write(page)
+	}
+
+	// FileMetaData
+	var meta thriftWriter
+	meta.i32(1, 1)
+	meta.listHeader(2, thriftStruct, len(table.Columns)+1)
+	meta.beginStruct()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(table.Columns)))
+	meta.endStruct()
+	for _, column := range table.Columns {
+		physical, converted := parquetType(column.Type)
+		meta.beginStruct()
+		meta.i32(1, physical)
+		meta.i32(3, parquetOptional)
+		meta.binary(4, column.Name)
+		if converted >= 0 {
+			meta.i32(6, converted)
+		}
+		meta.endStruct()
+	}
+	meta.i64(3, int64(len(table.Rows)))
+	meta.listHeader(4, thriftStruct, 1)
+	meta.beginStruct()
+	meta.listHeader(1, thriftStruct, len(table.Columns))
+	var total int64
+	for i, column := range table.Columns {
+		physical, _ := parquetType(column.Type)
+		total += chunks[i].size
+		meta.beginStruct()
+		meta.i64(2, chunks[i].offset)
+		meta.field(3, thriftStruct)
+		meta.beginStruct()
+		meta.i32(1, physical)
+		meta.listHeader(2, thriftI32, 2)
+		meta.varint(zigzag(parquetPlain))
+		meta.varint(zigzag(parquetRLE))
+		meta.listHeader(3, thriftBinary, 1)
+		meta.varint(uint64(len(column.Name)))
+		meta.buf.WriteString(column.Name)
+		meta.i32(4, 0)
+		meta.i64(5, int64(len(table.Rows)))
+		meta.i64(6, chunks[i].size)
+		meta.i64(7, chunks[i].size)
+		meta.i64(9, chunks[i].offset)
+		meta.endStruct()
+		meta.endStruct()
+	}
+	meta.i64(2, total)
+	meta.i64(3, int64(len(table.Rows)))
+	meta.endStruct()
+	meta.binary(6, "conveyor")
+	meta.buf.WriteByte(0)
+
+	file.Write(meta.buf.Bytes())
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(meta.buf.Len()))
+	file.Write(length[:])
+	file.WriteString("PAR1")
+	return file.Bytes()
+}
+
+// parquetType returns the physical and converted type of a column type,
+// or -1 without a converted type
+func parquetType(t ColumnType) (int32, int32) {
+	switch t {
+	case Int:
+		return parquetInt64, -1
+	case Float:
+		return parquetDouble, -1
+	case Bool:
+		return parquetBoolean, -1
+	case Time:
+		return parquetInt64, parquetTimestampMillis
+	}
+	return parquetByteArray, parquetUTF8
+}
+
+// parquetPage writes a column as one data page: its header, the definition
+// levels marking the non-null values, then those values PLAIN encoded
+func parquetPage(table *Table, i int, column Column) []byte {
+	defined := make([]bool, len(table.Rows))
+	var values bytes.Buffer
+	var bools []bool
+	for r, row := range table.Rows {
+		value := row[i]
+		if isNull(value) {
+			continue
+		}
+		defined[r] = true
+		switch v := value.(type) {
+		case string:
+			var n [4]byte
+			binary.LittleEndian.PutUint32(n[:], uint32(len(v)))
+			values.Write(n[:])
+			values.WriteString(v)
+		case int64:
+			binary.Write(&values, binary.LittleEndian, v)
+		case int:
+			binary.Write(&values, binary.LittleEndian, int64(v))
+		case float64:
+			binary.Write(&values, binary.LittleEndian, math.Float64bits(v))
+		case bool:
+			bools = append(bools, v)
+		case time.Time:
+			binary.Write(&values, binary.LittleEndian, v.UnixNano()/int64(time.Millisecond))
+		}
+	}
+	if column.Type == Bool {
+		values.Write(bitPack(bools))
+	}
+
+	levels := rleBitPacked(defined)
+	var data bytes.Buffer
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(levels)))
+	data.Write(n[:])
+	data.Write(levels)
+	data.Write(values.Bytes())
+
+	// PageHeader with a DataPageHeader
+	var header thriftWriter
+	header.i32(1, 0)
+	header.i32(2, int32(data.Len()))
+	header.i32(3, int32(data.Len()))
+	header.field(5, thriftStruct)
+	header.beginStruct()
+	header.i32(1, int32(len(table.Rows)))
+	header.i32(2, parquetPlain)
+	header.i32(3, parquetRLE)
+	header.i32(4, parquetRLE)
+	header.endStruct()
+	header.buf.WriteByte(0)
+
+	return append(header.buf.Bytes(), data.Bytes()...)
+}
+
+// rleBitPacked encodes definition levels of bit width 1 as a single
+// bit-packed run of the RLE/bit-packing hybrid encoding
+func rleBitPacked(levels []bool) []byte {
+	groups := (len(levels) + 7) / 8
+	var run thriftWriter
+	run.varint(uint64(groups<<1 | 1))
+	packed := bitPack(levels)
+	run.buf.Write(packed)
+	return run.buf.Bytes()
+}
+
+// bitPack packs booleans eight to a byte, least significant bit first
+func bitPack(bits []bool) []byte {
+	packed := make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit {
+			packed[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return packed
+}
+
+// thriftWriter writes structs in the Thrift compact protocol. Fields must
+// be written in increasing order of their IDs.
+type thriftWriter struct {
+	buf   bytes.Buffer
+	last  int16
+	stack []int16
+}
+
+func (w *thriftWriter) beginStruct() {
+	w.stack = append(w.stack, w.last)
+	w.last = 0
+}
+
+func (w *thriftWriter) endStruct() {
+	w.buf.WriteByte(0)
+	w.last = w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+}
+
+func (w *thriftWriter) field(id int16, typ byte) {
+	if delta := id - w.last; delta > 0 && delta <= 15 {
+		w.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		w.buf.WriteByte(typ)
+		w.varint(zigzag(int64(id)))
+	}
+	w.last = id
+}
+
+func (w *thriftWriter) i32(id int16, value int32) {
+	w.field(id, thriftI32)
+	w.varint(zigzag(int64(value)))
+}
+
+func (w *thriftWriter) i64(id int16, value int64) {
+	w.field(id, thriftI64)
+	w.varint(zigzag(value))
+}
+
+func (w *thriftWriter) binary(id int16, value string) {
+	w.field(id, thriftBinary)
+	w.varint(uint64(len(value)))
+	w.buf.WriteString(value)
+}
+
+func (w *thriftWriter) listHeader(id int16, elem byte, size int) {
+	w.field(id, thriftList)
+	if size < 15 {
+		w.buf.WriteByte(byte(size)<<4 | elem)
+		return
+	}
+	w.buf.WriteByte(0xf0 | elem)
+	w.varint(uint64(size))
+}
+
+func (w *thriftWriter) varint(value uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf.Write(b[:binary.PutUvarint(b[:], value)])
+}
+
+func zigzag(n int64) uint64 {
+	return uint64(n<<1) ^ uint64(n>>63)
+}
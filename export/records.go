@@ -0,0 +1,179 @@
+package export
+
+import (
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/plugins/security"
+)
+
+var jobColumns = []Column{
+	{"job_id", String},
+	{"pipeline_id", String},
+	{"pipeline_version", String},
+	{"status", String},
+	{"failure_class", String},
+	{"queued_at", Time},
+	{"started_at", Time},
+	{"ended_at", Time},
+	{"duration_ms", Int},
+	{"repo", String},
+	{"branch", String},
+	{"commit", String},
+	{"author", String},
+	{"pull_request", Int},
+	{"steps", Int},
+	{"failed_steps", Int},
+}
+
+var stepColumns = []Column{
+	{"job_id", String},
+	{"pipeline_id", String},
+	{"step_id", String},
+	{"name", String},
+	{"status", String},
+	{"failure_class", String},
+	{"runner", String},
+	{"started_at", Time},
+	{"ended_at", Time},
+	{"duration_ms", Int},
+	{"exit_code", Int},
+	{"attempts", Int},
+	{"infra_retries", Int},
+	{"cached_from", String},
+}
+
+var findingColumns = []Column{
+	{"finding_id", String},
+	{"fingerprint", String},
+	{"scope", String},
+	{"scan_type", String},
+	{"status", String},
+	{"rule_id", String},
+	{"type", String},
+	{"title", String},
+	{"severity", String},
+	{"package", String},
+	{"version", String},
+	{"fix_version", String},
+	{"path", String},
+	{"first_seen", Time},
+	{"last_seen", Time},
+	{"fixed_at", Time},
+	{"occurrences", Int},
+	{"triage", String},
+	{"epss", Float},
+	{"kev", Bool},
+}
+
+// jobRow returns a job's record
+func jobRow(job *core.Job) []interface{} {
+	var revision core.Revision
+	if job.Revision != nil {
+		revision = *job.Revision
+	}
+	var pullRequest interface{}
+	if revision.PullRequest > 0 {
+		pullRequest = int64(revision.PullRequest)
+	}
+	failed := 0
+	for _, step := range job.Steps {
+		if step.Status == core.StatusFailed {
+			failed++
+		}
+	}
+	return []interface{}{
+		job.ID,
+		job.PipelineID,
+		nullable(job.PipelineVersion),
+		string(job.Status),
+		nullable(job.FailureClass),
+		job.QueuedAt,
+		job.StartedAt,
+		job.EndedAt,
+		durationMillis(job.StartedAt, job.EndedAt),
+		nullable(revision.Repo),
+		nullable(revision.Branch),
+		nullable(revision.Commit),
+		nullable(revision.Author),
+		pullRequest,
+		int64(len(job.Steps)),
+		int64(failed),
+	}
+}
+
+// stepRow returns the record of a job's step
+func stepRow(job *core.Job, step core.StepStatus) []interface{} {
+	return []interface{}{
+		job.ID,
+		job.PipelineID,
+		step.ID,
+		step.Name,
+		string(step.Status),
+		nullable(step.FailureClass),
+		nullable(step.Runner),
+		step.StartedAt,
+		step.EndedAt,
+		durationMillis(step.StartedAt, step.EndedAt),
+		int64(step.ExitCode),
+		int64(step.Attempts),
+		int64(step.InfraRetries),
+		nullable(step.CachedFrom),
+	}
+}
+
+// findingRow returns a tracked finding's record
+func findingRow(tracked security.TrackedFinding) []interface{} {
+	var fixedAt time.Time
+	if tracked.FixedAt != nil {
+		fixedAt = *tracked.FixedAt
+	}
+	var triage interface{}
+	if tracked.Triage != nil {
+		triage = tracked.Triage.State
+	}
+	f := tracked.Finding
+	var epss interface{}
+	if f.EPSS > 0 {
+		epss = f.EPSS
+	}
+	return []interface{}{
+		tracked.ID,
+		tracked.Fingerprint,
+		tracked.Scope,
+		tracked.ScanType,
+		tracked.Status,
+		nullable(f.ID),
+		f.Type,
+		f.Title,
+		f.Severity,
+		nullable(f.Package),
+		nullable(f.Version),
+		nullable(f.FixVersion),
+		nullable(f.Path),
+		tracked.FirstSeen,
+		tracked.LastSeen,
+		fixedAt,
+		int64(tracked.Occurrences),
+		triage,
+		epss,
+		f.KEV,
+	}
+}
+
+// nullable returns nil for an empty string
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// durationMillis returns the milliseconds between two times, or nil if
+// either is unset
+func durationMillis(start, end time.Time) interface{} {
+	if start.IsZero() || end.IsZero() {
+		return nil
+	}
+	return int64(end.Sub(start) / time.Millisecond)
+}
@@ -0,0 +1,119 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chip/conveyor/config"
+	"github.com/chip/conveyor/internal/sigv4"
+)
+
+// Sink stores exported files by key, a slash-separated path such as
+// jobs/date=2026-10-16/jobs-20261016T120000Z.csv
+type Sink interface {
+	Put(ctx context.Context, key string, data []byte) error
+}
+
+// NewSink returns the sink of an export path: an S3 bucket for
+// s3://bucket/prefix URLs, and a directory otherwise
+func NewSink(settings config.Export) (Sink, error) {
+	if !strings.HasPrefix(settings.Path, "s3://") {
+		return &DirSink{Dir: settings.Path}, nil
+	}
+	u, err := url.Parse(settings.Path)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 path %q", settings.Path)
+	}
+	return &S3Sink{
+		Bucket:          u.Host,
+		Prefix:          strings.Trim(u.Path, "/"),
+		Region:          settings.Region,
+		Endpoint:        settings.Endpoint,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Client:          &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// DirSink writes files under a directory, such as a mounted bucket
+type DirSink struct {
+	Dir string
+}
+
+// Put writes a file, replacing it atomically
+func (s *DirSink) Put(ctx context.Context, key string, data []byte) error {
+	dest := filepath.Join(s.Dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create export directory: %w", err)
+	}
+	if err := os.WriteFile(dest+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	return os.Rename(dest+".tmp", dest)
+}
+
+// S3Sink uploads files to an S3 bucket with Signature Version 4 signed
+// requests
+type S3Sink struct {
+	Bucket string
+	Prefix string
+	Region string
+	// Endpoint overrides https://s3.<region>.amazonaws.com. Buckets are
+	// addressed by path on endpoints and by host on AWS.
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Client          *http.Client
+}
+
+// Put uploads a file to the bucket
+func (s *S3Sink) Put(ctx context.Context, key string, data []byte) error {
+	if s.AccessKeyID == "" || s.SecretAccessKey == "" {
+		return fmt.Errorf("AWS credentials are not set")
+	}
+	object := path.Join(s.Prefix, key)
+	target := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.Bucket, s.Region, object)
+	if s.Endpoint != "" {
+		target = fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(s.Endpoint, "/"), s.Bucket, object)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create upload request: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	req.Header.Set("Content-Type", contentType(key))
+	sigv4.Sign(req, data, "s3", s.Region, s.AccessKeyID, s.SecretAccessKey, s.SessionToken, time.Now())
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("failed to upload %s: %s: %s", key, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// contentType returns the media type of an exported file
+func contentType(key string) string {
+	if strings.HasSuffix(key, ".parquet") {
+		return "application/vnd.apache.parquet"
+	}
+	return "text/csv"
+}
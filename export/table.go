@@ -0,0 +1,89 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"time"
+)
+
+// ColumnType is the type of a column's values
+type ColumnType int
+
+// Column types. Time values are written in milliseconds since the epoch to
+// Parquet and in RFC 3339 to CSV.
+const (
+	String ColumnType = iota
+	Int
+	Float
+	Bool
+	Time
+)
+
+// Column is a named, typed column of a table
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+// Table is the records of one kind, such as jobs. Row values are strings,
+// int64s, float64s, bools and times matching the columns; nils and zero
+// times are nulls.
+type Table struct {
+	Name    string
+	Columns []Column
+	Rows    [][]interface{}
+}
+
+// isNull reports whether a value is written as a null
+func isNull(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	t, ok := value.(time.Time)
+	return ok && t.IsZero()
+}
+
+// encodeCSV writes a table as CSV with a header row. Nulls are empty
+// fields.
+func encodeCSV(table *Table) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	header := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		header[i] = column.Name
+	}
+	w.Write(header)
+
+	record := make([]string, len(table.Columns))
+	for _, row := range table.Rows {
+		for i, value := range row {
+			record[i] = csvValue(value)
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// csvValue formats a value as a CSV field
+func csvValue(value interface{}) string {
+	if isNull(value) {
+		return ""
+	}
+	switch v := value.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	}
+	return ""
+}
@@ -0,0 +1,382 @@
+// Package functions invokes serverless functions with the payloads of jobs
+// and steps at lifecycle events, a lighter-weight alternative to writing a
+// plugin. AWS Lambda functions are invoked through the Invoke API, Google
+// Cloud Functions and other functions with an HTTP POST.
+package functions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/chip/conveyor/config"
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/logging"
+)
+
+const (
+	defaultRetries = 2
+	defaultTimeout = 30 * time.Second
+	// maxCapturedResponse bounds responses that aren't JSON recorded in
+	// a job's metadata
+	maxCapturedResponse = 4096
+)
+
+// MetadataPrefix prefixes the job metadata key responses of a function are
+// captured under, followed by the function's name
+const MetadataPrefix = "function."
+
+// Payload is what functions are invoked with
+type Payload struct {
+	Event      string                 `json:"event"`
+	PipelineID string                 `json:"pipelineId"`
+	JobID      string                 `json:"jobId"`
+	StepID     string                 `json:"stepId,omitempty"`
+	Timestamp  time.Time              `json:"timestamp"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+	// Job is the job the event is about, without its logs
+	Job *core.Job `json:"job,omitempty"`
+}
+
+// Response is a function's response to an event, captured in the job's
+// metadata
+type Response struct {
+	Event      string    `json:"event"`
+	StepID     string    `json:"stepId,omitempty"`
+	InvokedAt  time.Time `json:"invokedAt"`
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	// Body is the JSON the function responded with, or its response as a
+	// string when that isn't JSON
+	Body  interface{} `json:"body,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// Jobs is what the dispatcher needs of the engine
+type Jobs interface {
+	JobSnapshot(jobID string) (*core.Job, error)
+	SetJobMetadata(jobID, key string, value interface{}) error
+}
+
+// result is what a single invocation returned
+type result struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+	// functionError is set when the function raised an error but the
+	// invocation succeeded
+	functionError string
+}
+
+// err reports a failed invocation, and whether it is worth retrying
+func (r result) err() (error, bool) {
+	switch {
+	case r.functionError != "":
+		return fmt.Errorf("function raised an error (%s): %s", r.functionError, truncate(r.body)), true
+	case r.statusCode == http.StatusTooManyRequests || r.statusCode >= 500:
+		return fmt.Errorf("function endpoint returned %d", r.statusCode), true
+	case r.statusCode >= 300:
+		return fmt.Errorf("function endpoint returned %d", r.statusCode), false
+	}
+	return nil, false
+}
+
+// invoker invokes a single function
+type invoker interface {
+	Invoke(ctx context.Context, payload []byte) (result, error)
+}
+
+// httpInvoker posts payloads to a Cloud Function or another HTTP endpoint
+type httpInvoker struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// Invoke posts the payload to the function
+func (h *httpInvoker) Invoke(ctx context.Context, payload []byte) (result, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(payload))
+	if err != nil {
+		return result{}, fmt.Errorf("failed to create invocation request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	return do(h.client, req)
+}
+
+// do sends req and reads the response
+func do(client *http.Client, req *http.Request) (result, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return result{}, fmt.Errorf("failed to invoke function: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return result{statusCode: resp.StatusCode}, fmt.Errorf("failed to read function response: %w", err)
+	}
+	return result{statusCode: resp.StatusCode, header: resp.Header, body: body}, nil
+}
+
+// function is a configured function and when it is invoked
+type function struct {
+	name      string
+	invoker   invoker
+	events    map[string]bool
+	pipelines []string
+	retries   int
+	timeout   time.Duration
+	capture   bool
+}
+
+// matches reports whether the function is invoked for event
+func (f function) matches(event core.Event) bool {
+	if !f.events[event.Type] || event.JobID == "" {
+		return false
+	}
+	if len(f.pipelines) == 0 {
+		return true
+	}
+	for _, pattern := range f.pipelines {
+		if matched, _ := path.Match(pattern, event.PipelineID); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Dispatcher invokes the configured functions with the engine's events.
+// Its configuration can be replaced while it is running.
+type Dispatcher struct {
+	jobs      Jobs
+	client    *http.Client
+	mu        sync.RWMutex
+	functions []function
+	// backoff is the delay before the first retry, doubled for each
+	// following one
+	backoff time.Duration
+}
+
+// NewDispatcher creates a dispatcher with no functions that looks up and
+// annotates jobs in jobs
+func NewDispatcher(jobs Jobs) *Dispatcher {
+	return &Dispatcher{jobs: jobs, client: &http.Client{}, backoff: time.Second}
+}
+
+// Configure replaces the dispatcher's functions
+func (d *Dispatcher) Configure(settings []config.Function) error {
+	functions := make([]function, 0, len(settings))
+	for _, s := range settings {
+		inv, err := d.invoker(s)
+		if err != nil {
+			return fmt.Errorf("function %s: %w", s.Name, err)
+		}
+		f := function{
+			name:      s.Name,
+			invoker:   inv,
+			events:    map[string]bool{"job.completed": true},
+			pipelines: s.Pipelines,
+			retries:   defaultRetries,
+			timeout:   defaultTimeout,
+			capture:   s.Capture,
+		}
+		if len(s.Events) > 0 {
+			f.events = make(map[string]bool, len(s.Events))
+			for _, event := range s.Events {
+				f.events[event] = true
+			}
+		}
+		if s.Retries != nil {
+			f.retries = *s.Retries
+		}
+		if s.Timeout != "" {
+			if f.timeout, err = time.ParseDuration(s.Timeout); err != nil {
+				return fmt.Errorf("function %s: invalid timeout: %w", s.Name, err)
+			}
+		}
+		functions = append(functions, f)
+	}
+
+	d.mu.Lock()
+	d.functions = functions
+	d.mu.Unlock()
+	return nil
+}
+
+// invoker creates the invoker of a configured function
+func (d *Dispatcher) invoker(s config.Function) (invoker, error) {
+	switch s.Type {
+	case config.FunctionLambda:
+		region := s.Region
+		if region == "" {
+			region = os.Getenv("AWS_REGION")
+		}
+		if region == "" {
+			return nil, fmt.Errorf("lambda requires a region or AWS_REGION")
+		}
+		endpoint := s.URL
+		if endpoint == "" {
+			endpoint = fmt.Sprintf("https://lambda.%s.amazonaws.com", region)
+		}
+		return &lambdaInvoker{
+			endpoint:    endpoint,
+			function:    s.Function,
+			region:      region,
+			client:      d.client,
+			credentials: environmentCredentials,
+		}, nil
+	case config.FunctionGCF, config.FunctionHTTP:
+		inv := &httpInvoker{url: s.URL, client: d.client}
+		if s.TokenEnv != "" {
+			inv.token = os.Getenv(s.TokenEnv)
+		}
+		return inv, nil
+	default:
+		return nil, fmt.Errorf("unsupported function type %q", s.Type)
+	}
+}
+
+// Run invokes functions with events until events is closed or ctx is done.
+// Each event's functions are invoked in the background so a slow function
+// doesn't hold up the next events.
+func (d *Dispatcher) Run(ctx context.Context, events <-chan core.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			go d.Invoke(ctx, event)
+		}
+	}
+}
+
+// Invoke invokes every function interested in event and waits for them
+// to respond
+func (d *Dispatcher) Invoke(ctx context.Context, event core.Event) {
+	d.mu.RLock()
+	functions := d.functions
+	d.mu.RUnlock()
+
+	var matched []function
+	for _, f := range functions {
+		if f.matches(event) {
+			matched = append(matched, f)
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(d.payload(event))
+	if err != nil {
+		logging.Warnf("Failed to encode %s payload for functions: %v", event.Type, err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, f := range matched {
+		wg.Add(1)
+		go func(f function) {
+			defer wg.Done()
+			d.invoke(ctx, f, event, payload)
+		}(f)
+	}
+	wg.Wait()
+}
+
+// payload builds what functions are invoked with for event
+func (d *Dispatcher) payload(event core.Event) Payload {
+	payload := Payload{
+		Event:      event.Type,
+		PipelineID: event.PipelineID,
+		JobID:      event.JobID,
+		StepID:     event.StepID,
+		Timestamp:  event.Timestamp,
+		Data:       event.Data,
+	}
+	if job, err := d.jobs.JobSnapshot(event.JobID); err == nil {
+		job.Logs = nil
+		payload.Job = job
+	}
+	return payload
+}
+
+// invoke calls f, retrying failures that may be transient with an
+// exponential backoff, and captures its response
+func (d *Dispatcher) invoke(ctx context.Context, f function, event core.Event, payload []byte) {
+	response := Response{Event: event.Type, StepID: event.StepID, InvokedAt: time.Now()}
+	var err error
+	for attempt := 0; attempt <= f.retries; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(d.backoff << uint(attempt-1))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+			case <-timer.C:
+			}
+			if ctx.Err() != nil {
+				err = ctx.Err()
+				break
+			}
+		}
+		response.Attempts = attempt + 1
+
+		var res result
+		var retry bool
+		attemptCtx, cancel := context.WithTimeout(ctx, f.timeout)
+		res, err = f.invoker.Invoke(attemptCtx, payload)
+		cancel()
+		if err == nil {
+			err, retry = res.err()
+		} else {
+			retry = true
+		}
+		response.StatusCode = res.statusCode
+		response.Body = responseBody(res.body)
+		if !retry {
+			break
+		}
+	}
+
+	if err != nil {
+		response.Error = err.Error()
+		logging.Warnf("Function %s failed for %s of job %s after %d attempts: %v", f.name, event.Type, event.JobID, response.Attempts, err)
+	}
+	if !f.capture {
+		return
+	}
+	if err := d.jobs.SetJobMetadata(event.JobID, MetadataPrefix+f.name, response); err != nil {
+		logging.Warnf("Failed to capture the response of function %s: %v", f.name, err)
+	}
+}
+
+// responseBody returns a response as JSON when it is, or else as a string
+func responseBody(body []byte) interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return json.RawMessage(body)
+	}
+	return truncate(body)
+}
+
+func truncate(body []byte) string {
+	if len(body) > maxCapturedResponse {
+		return string(body[:maxCapturedResponse]) + "..."
+	}
+	return string(body)
+}
@@ -0,0 +1,194 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chip/conveyor/config"
+	"github.com/chip/conveyor/core"
+)
+
+// fakeJobs records the metadata functions capture
+type fakeJobs struct {
+	mu       sync.Mutex
+	metadata map[string]interface{}
+}
+
+func (f *fakeJobs) JobSnapshot(jobID string) (*core.Job, error) {
+	return &core.Job{ID: jobID, PipelineID: "build", Status: core.StatusSuccess, Logs: []core.LogEntry{{Message: "secret"}}}, nil
+}
+
+func (f *fakeJobs) SetJobMetadata(jobID, key string, value interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.metadata == nil {
+		f.metadata = make(map[string]interface{})
+	}
+	f.metadata[jobID+"/"+key] = value
+	return nil
+}
+
+func newDispatcher(t *testing.T, jobs Jobs, settings ...config.Function) *Dispatcher {
+	t.Helper()
+	d := NewDispatcher(jobs)
+	d.backoff = time.Millisecond
+	if err := d.Configure(settings); err != nil {
+		t.Fatalf("Configure() error = %v", err)
+	}
+	return d
+}
+
+func TestSignV4(t *testing.T) {
+	// The get-vanilla case of the AWS Signature Version 4 test suite
+	req := httptest.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signV4(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization = %q, want %q", got, want)
+	}
+}
+
+func TestDispatcher_RetriesAndCapturesResponse(t *testing.T) {
+	var calls int
+	var payload Payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Authorization = %q, want the token", r.Header.Get("Authorization"))
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		fmt.Fprint(w, `{"approved":true}`)
+	}))
+	defer server.Close()
+
+	os.Setenv("CONVEYOR_TEST_FUNCTION_TOKEN", "token")
+	defer os.Unsetenv("CONVEYOR_TEST_FUNCTION_TOKEN")
+	jobs := &fakeJobs{}
+	d := newDispatcher(t, jobs, config.Function{
+		Name: "approve", Type: config.FunctionGCF, URL: server.URL,
+		TokenEnv: "CONVEYOR_TEST_FUNCTION_TOKEN", Capture: true,
+	})
+
+	d.Invoke(context.Background(), core.Event{Type: "job.completed", PipelineID: "build", JobID: "job-1"})
+
+	if calls != 2 {
+		t.Fatalf("function called %d times, want 2", calls)
+	}
+	if payload.JobID != "job-1" || payload.Job == nil || payload.Job.Logs != nil {
+		t.Errorf("payload = %+v, want job-1 without logs", payload)
+	}
+	response, ok := jobs.metadata["job-1/function.approve"].(Response)
+	if !ok {
+		t.Fatalf("metadata = %v, want the captured response", jobs.metadata)
+	}
+	body, _ := json.Marshal(response.Body)
+	if response.Attempts != 2 || response.StatusCode != http.StatusOK || string(body) != `{"approved":true}` || response.Error != "" {
+		t.Errorf("response = %+v, want the second attempt's JSON", response)
+	}
+}
+
+func TestDispatcher_DoesNotRetryClientErrors(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "bad payload", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	jobs := &fakeJobs{}
+	d := newDispatcher(t, jobs, config.Function{Name: "hook", Type: config.FunctionHTTP, URL: server.URL, Capture: true})
+	d.Invoke(context.Background(), core.Event{Type: "job.completed", PipelineID: "build", JobID: "job-1"})
+
+	if calls != 1 {
+		t.Errorf("function called %d times, want 1", calls)
+	}
+	response := jobs.metadata["job-1/function.hook"].(Response)
+	if response.Error == "" || response.Body != "bad payload\n" {
+		t.Errorf("response = %+v, want the error and body", response)
+	}
+}
+
+func TestDispatcher_FiltersEventsAndPipelines(t *testing.T) {
+	var mu sync.Mutex
+	var invoked []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload Payload
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		invoked = append(invoked, payload.Event+" "+payload.PipelineID)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	d := newDispatcher(t, &fakeJobs{}, config.Function{
+		Name: "hook", Type: config.FunctionHTTP, URL: server.URL,
+		Events: []string{"step.completed"}, Pipelines: []string{"deploy-*"},
+	})
+	for _, event := range []core.Event{
+		{Type: "job.completed", PipelineID: "deploy-web", JobID: "job-1"},
+		{Type: "step.completed", PipelineID: "build", JobID: "job-2", StepID: "test"},
+		{Type: "step.completed", PipelineID: "deploy-web", JobID: "job-3", StepID: "push"},
+	} {
+		d.Invoke(context.Background(), event)
+	}
+
+	if strings.Join(invoked, ",") != "step.completed deploy-web" {
+		t.Errorf("invoked for %v, want only the deploy step", invoked)
+	}
+}
+
+func TestDispatcher_InvokesLambda(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.EscapedPath() != "/2015-03-31/functions/arn%3Aaws%3Alambda%3Aus-east-1%3A123%3Afunction%3Ahook/invocations" {
+			t.Errorf("path = %s, want the invocation path of the function", r.URL.EscapedPath())
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			t.Errorf("Authorization = %q, want a SigV4 signature", r.Header.Get("Authorization"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if !json.Valid(body) {
+			t.Errorf("payload %q is not JSON", body)
+		}
+		w.Header().Set("X-Amz-Function-Error", "Unhandled")
+		fmt.Fprint(w, `{"errorMessage":"boom"}`)
+	}))
+	defer server.Close()
+
+	for key, value := range map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "secret"} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+	retries := 1
+	jobs := &fakeJobs{}
+	d := newDispatcher(t, jobs, config.Function{
+		Name: "hook", Type: config.FunctionLambda, Function: "arn:aws:lambda:us-east-1:123:function:hook",
+		Region: "us-east-1", URL: server.URL, Retries: &retries, Capture: true,
+	})
+	d.Invoke(context.Background(), core.Event{Type: "job.completed", PipelineID: "build", JobID: "job-1"})
+
+	if calls != 2 {
+		t.Errorf("function called %d times, want 2", calls)
+	}
+	response := jobs.metadata["job-1/function.hook"].(Response)
+	if !strings.Contains(response.Error, "Unhandled") || response.Attempts != 2 {
+		t.Errorf("response = %+v, want the function's error after 2 attempts", response)
+	}
+}
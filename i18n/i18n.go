@@ -0,0 +1,100 @@
+// Package i18n localizes human-readable strings. English is written inline
+// where a string is used and the other languages come from the message
+// catalogs in locales; machine-readable codes are never translated.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Default is the language of inline strings and the fallback of every
+// negotiation
+const Default = "en"
+
+//go:embed locales/*.json
+var locales embed.FS
+
+// catalogs are the translations of each language by message key
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]map[string]string {
+	entries, err := locales.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	catalogs := make(map[string]map[string]string)
+	for _, entry := range entries {
+		data, err := locales.ReadFile(path.Join("locales", entry.Name()))
+		if err != nil {
+			panic(err)
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			panic(fmt.Sprintf("invalid message catalog %s: %v", entry.Name(), err))
+		}
+		catalogs[strings.TrimSuffix(entry.Name(), ".json")] = catalog
+	}
+	return catalogs
+}
+
+// Supported returns the supported languages, starting with Default
+func Supported() []string {
+	languages := []string{Default}
+	for lang := range catalogs {
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages[1:])
+	return languages
+}
+
+// Sprintf formats the translation of key in lang, or the English format
+// when lang has none
+func Sprintf(lang, key, format string, args ...interface{}) string {
+	if translated, ok := catalogs[lang][key]; ok {
+		format = translated
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// Translated reports whether lang has a translation of key
+func Translated(lang, key string) bool {
+	_, ok := catalogs[lang][key]
+	return ok
+}
+
+// Negotiate picks the supported language an Accept-Language header prefers
+// most, matching on the primary subtag so "es-MX" selects Spanish. It
+// returns Default when none is supported.
+func Negotiate(acceptLanguage string) string {
+	best, bestQ := Default, 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		lang := strings.SplitN(tag, "-", 2)[0]
+		if q > bestQ && (lang == Default || catalogs[lang] != nil) {
+			best, bestQ = lang, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,57 @@
+package i18n
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                             "en",
+		"ja-JP,ja;q=0.9,en;q=0.8":      "ja",
+		"fr-FR, es-MX;q=0.7, en;q=0.5": "es",
+		"de, en-GB;q=0.8, ja;q=0.3":    "en",
+		"ES":                           "es",
+		"*":                            "en",
+		"es;q=0.2, ja;q=0.6":           "ja",
+	} {
+		if got := Negotiate(header); got != want {
+			t.Errorf("Negotiate(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestSprintf(t *testing.T) {
+	if got := Sprintf("es", "report.title", "Security report: %s", "scan-1"); got != "Informe de seguridad: scan-1" {
+		t.Errorf("Sprintf(es) = %q", got)
+	}
+	if got := Sprintf("en", "report.title", "Security report: %s", "scan-1"); got != "Security report: scan-1" {
+		t.Errorf("Sprintf(en) = %q", got)
+	}
+	if got := Sprintf("ja", "missing.key", "Fallback"); got != "Fallback" {
+		t.Errorf("Sprintf() of a missing key = %q, want the English text", got)
+	}
+}
+
+// Every catalog translates the same messages
+func TestCatalogsComplete(t *testing.T) {
+	var reference []string
+	for _, lang := range Supported()[1:] {
+		var keys []string
+		for key := range catalogs[lang] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if reference == nil {
+			reference = keys
+			continue
+		}
+		if !reflect.DeepEqual(keys, reference) {
+			t.Errorf("catalog %s has keys %v, want %v", lang, keys, reference)
+		}
+	}
+	if got := Supported(); !reflect.DeepEqual(got, []string{"en", "es", "ja"}) {
+		t.Errorf("Supported() = %v", got)
+	}
+}
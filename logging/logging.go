@@ -0,0 +1,92 @@
+// Package logging provides leveled logging on top of the standard logger.
+// The level can be changed at runtime, e.g. when the server configuration
+// is reloaded.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is the minimum severity that is logged
+type Level int32
+
+// Log levels in increasing severity
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+var currentLevel = int32(LevelInfo)
+
+// ParseLevel converts a level name to a Level
+func ParseLevel(s string) (Level, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	for level, levelName := range levelNames {
+		if levelName == name {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// String returns the level name
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int32(l))
+}
+
+// SetLevel sets the minimum level that is logged
+func SetLevel(level Level) {
+	atomic.StoreInt32(&currentLevel, int32(level))
+}
+
+// CurrentLevel returns the minimum level that is logged
+func CurrentLevel() Level {
+	return Level(atomic.LoadInt32(&currentLevel))
+}
+
+// Enabled reports whether messages at level are logged
+func Enabled(level Level) bool {
+	return level >= CurrentLevel()
+}
+
+// Debugf logs a debug message
+func Debugf(format string, args ...interface{}) {
+	logf(LevelDebug, format, args...)
+}
+
+// Infof logs an informational message
+func Infof(format string, args ...interface{}) {
+	logf(LevelInfo, format, args...)
+}
+
+// Warnf logs a warning
+func Warnf(format string, args ...interface{}) {
+	logf(LevelWarn, format, args...)
+}
+
+// Errorf logs an error
+func Errorf(format string, args ...interface{}) {
+	logf(LevelError, format, args...)
+}
+
+func logf(level Level, format string, args ...interface{}) {
+	if !Enabled(level) {
+		return
+	}
+	log.Output(3, strings.ToUpper(level.String())+" "+fmt.Sprintf(format, args...))
+}
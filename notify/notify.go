@@ -0,0 +1,379 @@
+// Package notify delivers job notifications to webhooks and chat services,
+// and engine events to CloudEvents brokers.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chip/conveyor/config"
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/logging"
+)
+
+// Message is a notification about a finished job
+type Message struct {
+	PipelineID string `json:"pipelineId"`
+	JobID      string `json:"jobId"`
+	Status     string `json:"status"`
+	// FailureClass classifies why a failed job failed
+	FailureClass string    `json:"failureClass,omitempty"`
+	Text         string    `json:"text"`
+	Timestamp    time.Time `json:"timestamp"`
+	// Values are what notification conditions can reference, see
+	// core.JobValues
+	Values map[string]string `json:"-"`
+}
+
+// Notifier delivers a message to a single destination
+type Notifier interface {
+	Notify(ctx context.Context, msg Message) error
+}
+
+// New creates a notifier for a configured notification channel
+func New(settings config.Notification, client *http.Client) (Notifier, error) {
+	switch settings.Type {
+	case "webhook":
+		return &WebhookNotifier{URL: settings.URL, Client: client}, nil
+	case "slack":
+		return &SlackNotifier{URL: settings.URL, Channel: settings.Channel, Client: client}, nil
+	default:
+		return nil, fmt.Errorf("unsupported notification type %q", settings.Type)
+	}
+}
+
+// WebhookNotifier posts messages as JSON to a URL
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// Notify posts the message to the webhook
+func (n *WebhookNotifier) Notify(ctx context.Context, msg Message) error {
+	return postJSON(ctx, n.Client, n.URL, msg)
+}
+
+// SlackNotifier posts messages to a Slack incoming webhook
+type SlackNotifier struct {
+	URL     string
+	Channel string
+	Client  *http.Client
+}
+
+// Notify posts the message text to Slack
+func (n *SlackNotifier) Notify(ctx context.Context, msg Message) error {
+	payload := map[string]string{"text": msg.Text}
+	if n.Channel != "" {
+		payload["channel"] = n.Channel
+	}
+	return postJSON(ctx, n.Client, n.URL, payload)
+}
+
+// CloudEventsPublisher posts engine events as CloudEvents in structured
+// mode, as accepted by Knative brokers and EventBridge API destinations
+type CloudEventsPublisher struct {
+	URL    string
+	Client *http.Client
+}
+
+// Publish posts the event to the broker
+func (p *CloudEventsPublisher) Publish(ctx context.Context, event core.Event) error {
+	return post(ctx, p.Client, p.URL, core.CloudEventsContentType, core.NewCloudEvent(event))
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, payload interface{}) error {
+	return post(ctx, client, url, "application/json", payload)
+}
+
+func post(ctx context.Context, client *http.Client, url, contentType string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create notification request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notification endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// route sends messages for a set of job statuses, and of failures for a
+// set of failure classes, that meet a condition to a notifier
+type route struct {
+	notifier Notifier
+	statuses map[string]bool
+	classes  map[string]bool
+	when     string
+}
+
+// matches reports whether the route wants msg. A route without statuses
+// receives every finished job, one without failure classes every failure,
+// and one without a condition every message of those.
+func (r route) matches(msg Message) bool {
+	if len(r.statuses) > 0 && !r.statuses[msg.Status] {
+		return false
+	}
+	if len(r.classes) > 0 && msg.FailureClass != "" && !r.classes[msg.FailureClass] {
+		return false
+	}
+	if r.when == "" {
+		return true
+	}
+	matched, err := core.EvaluateCondition(r.when, messageValues(msg))
+	if err != nil {
+		logging.Warnf("Failed to evaluate notification condition %q: %v", r.when, err)
+	}
+	return matched
+}
+
+// messageValues returns the values conditions are evaluated with: the
+// message's own, which a message that isn't about a job has too
+func messageValues(msg Message) map[string]string {
+	values := map[string]string{
+		"pipeline.id":      msg.PipelineID,
+		"job.id":           msg.JobID,
+		"job.status":       msg.Status,
+		"job.failureClass": msg.FailureClass,
+	}
+	for key, value := range msg.Values {
+		values[key] = value
+	}
+	return values
+}
+
+// sink publishes engine events of a set of types as CloudEvents
+type sink struct {
+	publisher *CloudEventsPublisher
+	types     map[string]bool
+}
+
+// matches reports whether the sink wants events of type eventType. A sink
+// without types receives every event.
+func (s sink) matches(eventType string) bool {
+	return len(s.types) == 0 || s.types[eventType]
+}
+
+// Dispatcher forwards job completion events to the configured notifiers,
+// and engine events to the configured CloudEvents brokers. Its
+// configuration can be replaced while it is running.
+type Dispatcher struct {
+	client *http.Client
+	mu     sync.RWMutex
+	routes []route
+	sinks  []sink
+	// jobs looks up finished jobs for the values of conditions
+	jobs func(jobID string) (*core.Job, error)
+}
+
+// NewDispatcher creates a dispatcher with no notifiers
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Configure replaces the dispatcher's notifiers
+func (d *Dispatcher) Configure(settings []config.Notification) error {
+	routes := make([]route, 0, len(settings))
+	var sinks []sink
+	for _, s := range settings {
+		if s.Type == "cloudevents" {
+			types := make(map[string]bool, len(s.Events))
+			for _, event := range s.Events {
+				types[event] = true
+			}
+			sinks = append(sinks, sink{publisher: &CloudEventsPublisher{URL: s.URL, Client: d.client}, types: types})
+			continue
+		}
+		notifier, err := New(s, d.client)
+		if err != nil {
+			return err
+		}
+
+		statuses := make(map[string]bool, len(s.Events))
+		for _, event := range s.Events {
+			statuses[event] = true
+		}
+		classes := make(map[string]bool, len(s.FailureClasses))
+		for _, class := range s.FailureClasses {
+			classes[class] = true
+		}
+		routes = append(routes, route{notifier: notifier, statuses: statuses, classes: classes, when: s.When})
+	}
+
+	d.mu.Lock()
+	d.routes = routes
+	d.sinks = sinks
+	d.mu.Unlock()
+	return nil
+}
+
+// SetJobs sets how finished jobs are looked up, so conditions can
+// reference their trigger values, revision and duration
+func (d *Dispatcher) SetJobs(lookup func(jobID string) (*core.Job, error)) {
+	d.mu.Lock()
+	d.jobs = lookup
+	d.mu.Unlock()
+}
+
+// Run forwards job.completed, step duration anomaly and secret expiry
+// events, and every event to brokers, until events is closed or ctx is done
+func (d *Dispatcher) Run(ctx context.Context, events <-chan core.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			d.Publish(ctx, event)
+			switch event.Type {
+			case "job.completed":
+				msg := messageFor(event)
+				msg.Values = d.jobValues(event)
+				d.Dispatch(ctx, msg)
+			case "step.anomaly":
+				d.Dispatch(ctx, anomalyMessageFor(event))
+			case "secret.expiring", "secret.expired":
+				d.Dispatch(ctx, secretMessageFor(event))
+			}
+		}
+	}
+}
+
+// Dispatch sends msg to every notifier interested in its status
+func (d *Dispatcher) Dispatch(ctx context.Context, msg Message) {
+	d.mu.RLock()
+	routes := d.routes
+	d.mu.RUnlock()
+
+	for _, r := range routes {
+		if !r.matches(msg) {
+			continue
+		}
+		if err := r.notifier.Notify(ctx, msg); err != nil {
+			logging.Warnf("Failed to deliver %s notification: %v", msg.Status, err)
+		}
+	}
+}
+
+// jobValues returns the values of the job an event is about, or nil when
+// it can't be looked up
+func (d *Dispatcher) jobValues(event core.Event) map[string]string {
+	d.mu.RLock()
+	lookup := d.jobs
+	d.mu.RUnlock()
+	if lookup == nil {
+		return nil
+	}
+	job, err := lookup(event.JobID)
+	if err != nil {
+		return nil
+	}
+	return core.JobValues(job)
+}
+
+// Publish sends event to every broker interested in its type
+func (d *Dispatcher) Publish(ctx context.Context, event core.Event) {
+	d.mu.RLock()
+	sinks := d.sinks
+	d.mu.RUnlock()
+
+	for _, s := range sinks {
+		if !s.matches(event.Type) {
+			continue
+		}
+		if err := s.publisher.Publish(ctx, event); err != nil {
+			logging.Warnf("Failed to publish %s event: %v", event.Type, err)
+		}
+	}
+}
+
+// messageFor builds a message from a job.completed event
+func messageFor(event core.Event) Message {
+	status := fmt.Sprint(event.Data["status"])
+	class, _ := event.Data["failureClass"].(string)
+	text := fmt.Sprintf("Job %s of pipeline %s finished with status %s", event.JobID, event.PipelineID, status)
+	if class != "" {
+		text += fmt.Sprintf(" (%s failure)", class)
+	}
+	return Message{
+		PipelineID:   event.PipelineID,
+		JobID:        event.JobID,
+		Status:       status,
+		FailureClass: class,
+		Text:         text,
+		Timestamp:    event.Timestamp,
+	}
+}
+
+// anomalyMessageFor builds a message from a step.anomaly event. The message
+// status is "duration_anomaly".
+func anomalyMessageFor(event core.Event) Message {
+	duration := time.Duration(toInt64(event.Data["durationMs"])) * time.Millisecond
+	baseline := time.Duration(toInt64(event.Data["baselineMs"])) * time.Millisecond
+	return Message{
+		PipelineID: event.PipelineID,
+		JobID:      event.JobID,
+		Status:     "duration_anomaly",
+		Text: fmt.Sprintf("Step %s of job %s in pipeline %s took %s, %v%% %s than its %s baseline",
+			event.StepID, event.JobID, event.PipelineID, duration, math.Abs(toFloat64(event.Data["percent"])), event.Data["direction"], baseline),
+		Timestamp: event.Timestamp,
+	}
+}
+
+// toInt64 and toFloat64 read numbers from event data, which are decoded as
+// float64 when events come back from JSON
+func toInt64(value interface{}) int64 {
+	return int64(toFloat64(value))
+}
+
+func toFloat64(value interface{}) float64 {
+	switch v := value.(type) {
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// secretMessageFor builds a message from a secret.expiring or secret.expired
+// event. The message status is "expiring" or "expired".
+func secretMessageFor(event core.Event) Message {
+	status := strings.TrimPrefix(event.Type, "secret.")
+	expiresAt, _ := event.Data["expiresAt"].(time.Time)
+
+	verb := "expires"
+	if status == "expired" {
+		verb = "expired"
+	}
+	return Message{
+		Status:    status,
+		Text:      fmt.Sprintf("Secret %v %s on %s and should be rotated", event.Data["name"], verb, expiresAt.Format(time.RFC1123)),
+		Timestamp: event.Timestamp,
+	}
+}
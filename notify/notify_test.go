@@ -0,0 +1,203 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chip/conveyor/config"
+	"github.com/chip/conveyor/core"
+)
+
+func TestDispatcher_FiltersByStatus(t *testing.T) {
+	received := make(chan Message, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		json.NewDecoder(r.Body).Decode(&msg)
+		received <- msg
+	}))
+	defer server.Close()
+
+	d := NewDispatcher()
+	err := d.Configure([]config.Notification{
+		{Type: "webhook", URL: server.URL, Events: []string{"failed"}},
+	})
+	if err != nil {
+		t.Fatalf("Configure() error = %v", err)
+	}
+
+	d.Dispatch(context.Background(), Message{JobID: "job-1", Status: "success"})
+	d.Dispatch(context.Background(), Message{JobID: "job-2", Status: "failed"})
+
+	select {
+	case msg := <-received:
+		if msg.JobID != "job-2" {
+			t.Errorf("received notification for %s, want job-2", msg.JobID)
+		}
+	default:
+		t.Fatal("expected a notification for the failed job")
+	}
+	if len(received) != 0 {
+		t.Errorf("received %d extra notifications", len(received))
+	}
+}
+
+func TestDispatcher_FiltersByFailureClass(t *testing.T) {
+	received := make(chan Message, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		json.NewDecoder(r.Body).Decode(&msg)
+		received <- msg
+	}))
+	defer server.Close()
+
+	d := NewDispatcher()
+	err := d.Configure([]config.Notification{
+		{Type: "webhook", URL: server.URL, Events: []string{"failed"}, FailureClasses: []string{"infrastructure"}},
+	})
+	if err != nil {
+		t.Fatalf("Configure() error = %v", err)
+	}
+
+	d.Dispatch(context.Background(), messageFor(core.Event{Type: "job.completed", JobID: "job-1", Data: map[string]interface{}{"status": "failed", "failureClass": "test"}}))
+	d.Dispatch(context.Background(), messageFor(core.Event{Type: "job.completed", JobID: "job-2", Data: map[string]interface{}{"status": "failed", "failureClass": "infrastructure"}}))
+
+	if len(received) != 1 {
+		t.Fatalf("received %d notifications, want 1", len(received))
+	}
+	msg := <-received
+	if msg.JobID != "job-2" || msg.FailureClass != "infrastructure" || !strings.Contains(msg.Text, "infrastructure failure") {
+		t.Errorf("received %+v, want the infrastructure failure", msg)
+	}
+}
+
+func TestDispatcher_PublishesCloudEvents(t *testing.T) {
+	received := make(chan map[string]interface{}, 2)
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		var event map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer server.Close()
+
+	d := NewDispatcher()
+	err := d.Configure([]config.Notification{
+		{Type: "cloudevents", URL: server.URL, Events: []string{"job.completed"}},
+	})
+	if err != nil {
+		t.Fatalf("Configure() error = %v", err)
+	}
+
+	d.Publish(context.Background(), core.Event{ID: "event-1", Type: "job.started", JobID: "job-1"})
+	d.Publish(context.Background(), core.Event{ID: "event-2", Type: "job.completed", PipelineID: "web", JobID: "job-1"})
+
+	select {
+	case event := <-received:
+		if event["type"] != "dev.conveyor.job.completed" || event["specversion"] != "1.0" || event["id"] != "event-2" {
+			t.Errorf("received %v, want the job.completed CloudEvent", event)
+		}
+	default:
+		t.Fatal("expected the job.completed event")
+	}
+	if contentType != core.CloudEventsContentType {
+		t.Errorf("Content-Type = %q, want %q", contentType, core.CloudEventsContentType)
+	}
+	if len(received) != 0 {
+		t.Errorf("received %d extra events", len(received))
+	}
+}
+
+func TestDispatcher_Reconfigure(t *testing.T) {
+	d := NewDispatcher()
+	if err := d.Configure([]config.Notification{{Type: "email"}}); err == nil {
+		t.Error("Configure() expected error for unsupported type")
+	}
+	if err := d.Configure(nil); err != nil {
+		t.Errorf("Configure(nil) error = %v", err)
+	}
+}
+
+func TestSecretMessageFor(t *testing.T) {
+	expiresAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	msg := secretMessageFor(core.Event{
+		Type: "secret.expired",
+		Data: map[string]interface{}{"name": "DEPLOY_TOKEN", "expiresAt": expiresAt},
+	})
+
+	if msg.Status != "expired" {
+		t.Errorf("Status = %q, want expired", msg.Status)
+	}
+	if !strings.Contains(msg.Text, "DEPLOY_TOKEN expired on Fri, 01 Mar 2024") {
+		t.Errorf("Text = %q, want the secret name and expiry", msg.Text)
+	}
+}
+
+func TestAnomalyMessageFor(t *testing.T) {
+	msg := anomalyMessageFor(core.Event{
+		Type:       "step.anomaly",
+		PipelineID: "web",
+		JobID:      "job-1",
+		StepID:     "build",
+		Data:       map[string]interface{}{"durationMs": int64(90000), "baselineMs": int64(30000), "percent": 200.0, "direction": "slower"},
+	})
+
+	if msg.Status != "duration_anomaly" || msg.PipelineID != "web" {
+		t.Errorf("anomalyMessageFor() = %+v, want a duration_anomaly message for web", msg)
+	}
+	if !strings.Contains(msg.Text, "took 1m30s, 200% slower than its 30s baseline") {
+		t.Errorf("Text = %q, want the duration and baseline", msg.Text)
+	}
+}
+
+func TestDispatcher_FiltersByCondition(t *testing.T) {
+	received := make(chan Message, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		json.NewDecoder(r.Body).Decode(&msg)
+		received <- msg
+	}))
+	defer server.Close()
+
+	d := NewDispatcher()
+	err := d.Configure([]config.Notification{
+		{Type: "webhook", URL: server.URL, When: "job.status == 'failed' && trigger.branch == 'main' && job.durationMinutes > 30"},
+	})
+	if err != nil {
+		t.Fatalf("Configure() error = %v", err)
+	}
+	start := time.Now().Add(-time.Hour)
+	jobs := map[string]*core.Job{
+		"job-1": {ID: "job-1", Status: core.StatusFailed, StartedAt: start, EndedAt: start.Add(45 * time.Minute), Metadata: map[string]interface{}{"trigger": map[string]string{"branch": "main"}}},
+		"job-2": {ID: "job-2", Status: core.StatusFailed, StartedAt: start, EndedAt: start.Add(5 * time.Minute), Metadata: map[string]interface{}{"trigger": map[string]string{"branch": "main"}}},
+		"job-3": {ID: "job-3", Status: core.StatusFailed, StartedAt: start, EndedAt: start.Add(45 * time.Minute), Metadata: map[string]interface{}{"trigger": map[string]string{"branch": "dev"}}},
+	}
+	d.SetJobs(func(jobID string) (*core.Job, error) {
+		return jobs[jobID], nil
+	})
+
+	events := make(chan core.Event, 3)
+	for _, id := range []string{"job-1", "job-2", "job-3"} {
+		events <- core.Event{Type: "job.completed", JobID: id, Data: map[string]interface{}{"status": "failed"}}
+	}
+	close(events)
+	d.Run(context.Background(), events)
+
+	if len(received) != 1 {
+		t.Fatalf("received %d notifications, want 1", len(received))
+	}
+	if msg := <-received; msg.JobID != "job-1" {
+		t.Errorf("received notification for %s, want job-1", msg.JobID)
+	}
+
+	// Messages that aren't about a job have their status to go by
+	d.Dispatch(context.Background(), Message{Status: "expired"})
+	if len(received) != 0 {
+		t.Errorf("received %d notifications for an expired secret, want 0", len(received))
+	}
+}
@@ -0,0 +1,189 @@
+package bluegreen
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chip/conveyor/core"
+)
+
+func shellStep(t *testing.T, extra map[string]interface{}) (map[string]interface{}, string) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	dir := t.TempDir()
+	config := map[string]interface{}{
+		"workDir":   dir,
+		"current":   "cat live 2>/dev/null || true",
+		"provision": "echo provision-$DEPLOY_COLOR >> log",
+		"verify":    []interface{}{"echo verify-$DEPLOY_COLOR >> log"},
+		"switch":    "echo $DEPLOY_COLOR > live; echo switch-$DEPLOY_COLOR >> log",
+		"teardown":  "echo teardown-$DEPLOY_COLOR >> log",
+	}
+	for key, value := range extra {
+		config[key] = value
+	}
+	return config, dir
+}
+
+func execute(t *testing.T, p *BlueGreenPlugin, config map[string]interface{}) (map[string]interface{}, error) {
+	t.Helper()
+	return p.Execute(context.Background(), core.Step{ID: "deploy", Type: "blue-green", Config: config})
+}
+
+func read(t *testing.T, dir, name string) string {
+	t.Helper()
+	data, _ := os.ReadFile(filepath.Join(dir, name))
+	return strings.Join(strings.Fields(string(data)), " ")
+}
+
+func statuses(outputs map[string]interface{}) string {
+	var list []string
+	for _, phase := range outputs["phases"].([]Phase) {
+		list = append(list, phase.Name+"="+phase.Status)
+	}
+	return strings.Join(list, " ")
+}
+
+func TestBlueGreen_AlternatesColors(t *testing.T) {
+	config, dir := shellStep(t, nil)
+	p := NewBlueGreenPlugin()
+
+	outputs, err := execute(t, p, config)
+	if err != nil {
+		t.Fatalf("first Execute() error = %v", err)
+	}
+	if outputs["live"] != "blue" || outputs["previous"] != "" {
+		t.Errorf("first deploy outputs = %v, want blue live with nothing before", outputs)
+	}
+	if got := statuses(outputs); got != "provision=succeeded verify=succeeded switch=succeeded teardown=skipped" {
+		t.Errorf("first deploy phases = %s, want no teardown without a previous color", got)
+	}
+
+	outputs, err = execute(t, p, config)
+	if err != nil {
+		t.Fatalf("second Execute() error = %v", err)
+	}
+	if outputs["live"] != "green" || outputs["previous"] != "blue" || outputs["switched"] != true {
+		t.Errorf("second deploy outputs = %v, want green live after blue", outputs)
+	}
+	want := "provision-blue verify-blue switch-blue provision-green verify-green switch-green teardown-blue"
+	if got := read(t, dir, "log"); got != want {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestBlueGreen_FailedVerificationKeepsTraffic(t *testing.T) {
+	config, dir := shellStep(t, map[string]interface{}{
+		"active":  "blue",
+		"current": "",
+		"verify":  []interface{}{"echo smoke test failed; exit 1"},
+	})
+	outputs, err := execute(t, NewBlueGreenPlugin(), config)
+	if err == nil || !strings.Contains(err.Error(), "verify phase failed") {
+		t.Fatalf("Execute() error = %v, want the verify phase to fail", err)
+	}
+	if outputs["live"] != "blue" || outputs["switched"] != false {
+		t.Errorf("outputs = %v, want traffic left on blue", outputs)
+	}
+	if got := statuses(outputs); got != "provision=succeeded verify=failed switch=skipped teardown=skipped" {
+		t.Errorf("phases = %s", got)
+	}
+	if phases := outputs["phases"].([]Phase); phases[1].Output != "smoke test failed" {
+		t.Errorf("verify output = %q, want the command's output", phases[1].Output)
+	}
+	if got := read(t, dir, "log"); got != "provision-green" {
+		t.Errorf("commands = %q, want only the provision", got)
+	}
+}
+
+func TestBlueGreen_FailedSwitchSwitchesBack(t *testing.T) {
+	config, dir := shellStep(t, map[string]interface{}{
+		"active":  "blue",
+		"current": "",
+		"switch":  `echo switch-$DEPLOY_COLOR >> log; test "$DEPLOY_COLOR" = blue`,
+	})
+	outputs, err := execute(t, NewBlueGreenPlugin(), config)
+	if err == nil {
+		t.Fatal("Execute() with a failing switch succeeded")
+	}
+	if outputs["live"] != "blue" {
+		t.Errorf("live = %v, want blue", outputs["live"])
+	}
+	if got := read(t, dir, "log"); got != "provision-green verify-green switch-green switch-blue" {
+		t.Errorf("commands = %q, want a switch back to blue", got)
+	}
+}
+
+func TestBlueGreen_KubernetesAndHealth(t *testing.T) {
+	healthy := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/green/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		healthy++
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	var calls []string
+	p := NewBlueGreenPlugin()
+	p.run = func(ctx context.Context, dir string, env map[string]string, name string, args ...string) (string, error) {
+		calls = append(calls, name+" "+strings.Join(args, " "))
+		if name == "kubectl" && args[0] == "get" {
+			return "blue", nil
+		}
+		return "", nil
+	}
+	outputs, err := execute(t, p, map[string]interface{}{
+		"provision": "deploy",
+		"healthUrl": server.URL + "/$DEPLOY_COLOR/health",
+		"kubernetes": map[string]interface{}{
+			"service":   "web",
+			"namespace": "prod",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if outputs["live"] != "green" || healthy != 1 {
+		t.Errorf("outputs = %v after %d health checks, want green live", outputs, healthy)
+	}
+	want := []string{
+		`kubectl get service web --output jsonpath={.spec.selector.color} --namespace prod`,
+		`sh -c deploy`,
+		`kubectl patch service web --type merge --patch {"spec":{"selector":{"color":"green"}}} --namespace prod`,
+	}
+	if strings.Join(calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands =\n%s\nwant\n%s", strings.Join(calls, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		config map[string]interface{}
+		want   string
+	}{
+		{map[string]interface{}{"switch": "x"}, "provision command"},
+		{map[string]interface{}{"provision": "x"}, "switch command or a kubernetes service"},
+		{map[string]interface{}{"provision": "x", "switch": "x", "kubernetes": map[string]interface{}{"service": "web"}}, "not both"},
+		{map[string]interface{}{"provision": "x", "kubernetes": map[string]interface{}{}}, "needs a service"},
+		{map[string]interface{}{"provision": "x", "switch": "x", "colors": []interface{}{"a", "a"}}, "two different colors"},
+		{map[string]interface{}{"provision": "x", "switch": "x", "active": "red"}, "neither blue nor green"},
+		{map[string]interface{}{"provision": "x", "switch": "x", "gracePeriod": "later"}, "invalid gracePeriod"},
+	}
+	for _, tt := range tests {
+		if _, err := parseConfig(tt.config); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseConfig(%v) error = %v, want %q", tt.config, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+// Package bluegreen provides the blue-green step, which deploys a new
+// version to the idle one of two colors, verifies it, switches traffic to
+// it and tears the old color down after a grace period.
+package bluegreen
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/plugins/pluginutil"
+)
+
+// Defaults of blue-green steps
+const (
+	defaultSelector      = "color"
+	defaultHealthTimeout = 2 * time.Minute
+	healthInterval       = 2 * time.Second
+	// switchBackTimeout bounds switching traffic back after a failed or
+	// cancelled switch
+	switchBackTimeout = 2 * time.Minute
+)
+
+// Phases of a blue-green deployment, in order
+const (
+	PhaseProvision = "provision"
+	PhaseVerify    = "verify"
+	PhaseSwitch    = "switch"
+	PhaseTeardown  = "teardown"
+)
+
+// Statuses of a phase
+const (
+	PhaseSucceeded = "succeeded"
+	PhaseFailed    = "failed"
+	PhaseSkipped   = "skipped"
+)
+
+// BlueGreenPlugin implements the Plugin interface for blue/green
+// deployments
+type BlueGreenPlugin struct {
+	client *http.Client
+	run    pluginutil.CombinedFunc
+}
+
+// NewBlueGreenPlugin creates a blue/green deployment plugin
+func NewBlueGreenPlugin() *BlueGreenPlugin {
+	return &BlueGreenPlugin{client: &http.Client{Timeout: 10 * time.Second}, run: pluginutil.RunCombined}
+}
+
+// GetManifest returns the plugin manifest
+func (p *BlueGreenPlugin) GetManifest() core.PluginManifest {
+	return core.PluginManifest{
+		Name:        "bluegreen",
+		Version:     "1.0.0",
+		Description: "Blue/green deployments with verification, traffic switching through a command or a Kubernetes service, and delayed teardown",
+		Author:      "Conveyor Team",
+		Type:        "deploy",
+		StepTypes:   []string{"blue-green"},
+	}
+}
+
+// Phase reports one phase of a deployment
+type Phase struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	StartedAt time.Time `json:"startedAt,omitempty"`
+	EndedAt   time.Time `json:"endedAt,omitempty"`
+	Output    string    `json:"output,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// kubernetesService is a Kubernetes service whose selector picks the
+// color receiving traffic
+type kubernetesService struct {
+	name      string
+	namespace string
+	selector  string
+	context   string
+}
+
+// config is the configuration of a blue-green step
+type config struct {
+	colors [2]string
+	// liveColor is the active config value
+	liveColor   string
+	current     string
+	provision   string
+	verify      []string
+	healthURL   string
+	healthWait  time.Duration
+	switchCmd   string
+	service     *kubernetesService
+	teardown    string
+	gracePeriod time.Duration
+	dir         string
+	env         map[string]string
+}
+
+// deployment is a blue-green step in progress
+type deployment struct {
+	*config
+	plugin *BlueGreenPlugin
+	phases []Phase
+	active string
+	idle   string
+}
+
+// Execute deploys to the idle color, verifies it and switches traffic to
+// it, then tears the old color down once the grace period passed. A failed
+// provision or verification leaves traffic on the active color, and a
+// failed switch is switched back. Every phase is reported in the outputs.
+func (p *BlueGreenPlugin) Execute(ctx context.Context, step core.Step) (map[string]interface{}, error) {
+	if step.Type != "blue-green" {
+		return nil, fmt.Errorf("unsupported step type: %s", step.Type)
+	}
+	cfg, err := parseConfig(step.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &deployment{config: cfg, plugin: p}
+	if d.active, err = d.activeColor(ctx); err != nil {
+		return nil, err
+	}
+	d.idle = cfg.colors[0]
+	if d.active == cfg.colors[0] {
+		d.idle = cfg.colors[1]
+	}
+	if d.active == "" {
+		core.LogStep(ctx, "info", fmt.Sprintf("No color is live yet, deploying to %s", d.idle))
+	} else {
+		core.LogStep(ctx, "info", fmt.Sprintf("%s is live, deploying to %s", d.active, d.idle))
+	}
+
+	phases := []struct {
+		name string
+		run  func(context.Context) (string, error)
+	}{
+		{PhaseProvision, d.provisionIdle},
+		{PhaseVerify, d.verifyIdle},
+		{PhaseSwitch, d.switchTraffic},
+		{PhaseTeardown, d.teardownActive},
+	}
+	for i, phase := range phases {
+		err := d.runPhase(ctx, phase.name, phase.run)
+		if err == nil {
+			continue
+		}
+		for _, skipped := range phases[i+1:] {
+			d.phases = append(d.phases, Phase{Name: skipped.name, Status: PhaseSkipped})
+		}
+		live := d.active
+		switch phase.name {
+		case PhaseSwitch:
+			d.switchBack(ctx)
+		case PhaseTeardown:
+			// Traffic is on the new color, so only the cleanup failed
+			live = d.idle
+		}
+		return d.outputs(live), fmt.Errorf("%s phase failed: %w", phase.name, err)
+	}
+	return d.outputs(d.idle), nil
+}
+
+// runPhase runs and reports a phase
+func (d *deployment) runPhase(ctx context.Context, name string, run func(context.Context) (string, error)) error {
+	phase := Phase{Name: name, StartedAt: time.Now()}
+	core.LogStep(ctx, "info", fmt.Sprintf("Starting the %s phase", name))
+	output, err := run(ctx)
+	phase.EndedAt, phase.Output = time.Now(), strings.TrimSpace(output)
+	switch {
+	case err == errSkipped:
+		phase.Status, err = PhaseSkipped, nil
+	case err != nil:
+		phase.Status, phase.Error = PhaseFailed, err.Error()
+		core.LogStep(ctx, "error", fmt.Sprintf("The %s phase failed: %v", name, err))
+	default:
+		phase.Status = PhaseSucceeded
+		core.LogStep(ctx, "info", fmt.Sprintf("The %s phase succeeded in %s", name, phase.EndedAt.Sub(phase.StartedAt).Round(time.Millisecond)))
+	}
+	d.phases = append(d.phases, phase)
+	return err
+}
+
+// errSkipped is returned by a phase with nothing to do
+var errSkipped = errors.New("skipped")
+
+// outputs returns the step's outputs with the color that is live
+func (d *deployment) outputs(live string) map[string]interface{} {
+	return map[string]interface{}{
+		"live":     live,
+		"previous": d.active,
+		"deployed": d.idle,
+		"switched": live == d.idle,
+		"phases":   d.phases,
+	}
+}
+
+// activeColor finds the color receiving traffic: the output of the
+// current command, the active config value, or the selector of the
+// Kubernetes service. It is empty when no color is live yet.
+func (d *deployment) activeColor(ctx context.Context) (string, error) {
+	var active string
+	switch {
+	case d.current != "":
+		output, err := d.shell(ctx, d.current, nil)
+		if err != nil {
+			return "", fmt.Errorf("finding the active color failed: %w", err)
+		}
+		active = strings.TrimSpace(output)
+	case d.liveColor != "":
+		active = d.liveColor
+	case d.service != nil:
+		output, err := d.plugin.run(ctx, d.dir, d.env, "kubectl", d.kubectlArgs("get", "service", d.service.name, "--output", "jsonpath={.spec.selector."+strings.ReplaceAll(d.service.selector, ".", `\.`)+"}")...)
+		if err != nil {
+			return "", fmt.Errorf("finding the active color failed: %w", err)
+		}
+		active = strings.TrimSpace(output)
+	}
+	if active != "" && active != d.colors[0] && active != d.colors[1] {
+		return "", fmt.Errorf("active color %q is neither %s nor %s", active, d.colors[0], d.colors[1])
+	}
+	return active, nil
+}
+
+// provisionIdle deploys the new version to the idle color
+func (d *deployment) provisionIdle(ctx context.Context) (string, error) {
+	return d.shell(ctx, d.provision, nil)
+}
+
+// verifyIdle waits for the idle color's health URL to answer with a 2xx
+// status and runs the verification commands against it
+func (d *deployment) verifyIdle(ctx context.Context) (string, error) {
+	if d.healthURL == "" && len(d.verify) == 0 {
+		return "", errSkipped
+	}
+	var output strings.Builder
+	if d.healthURL != "" {
+		url := os.Expand(d.healthURL, d.lookup)
+		if err := d.plugin.waitHealthy(ctx, url, d.healthWait); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&output, "%s is healthy\n", url)
+	}
+	for _, command := range d.verify {
+		out, err := d.shell(ctx, command, nil)
+		output.WriteString(out)
+		if err != nil {
+			return output.String(), fmt.Errorf("%s: %w", command, err)
+		}
+	}
+	return output.String(), nil
+}
+
+// switchTraffic points traffic at the idle color
+func (d *deployment) switchTraffic(ctx context.Context) (string, error) {
+	return d.pointAt(ctx, d.idle)
+}
+
+// switchBack points traffic back at the active color after a failed
+// switch, even when the step was cancelled
+func (d *deployment) switchBack(ctx context.Context) {
+	if d.active == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), switchBackTimeout)
+	defer cancel()
+	if _, err := d.pointAt(ctx, d.active); err != nil {
+		core.LogStep(ctx, "error", fmt.Sprintf("Switching traffic back to %s failed: %v", d.active, err))
+		return
+	}
+	core.LogStep(ctx, "warning", fmt.Sprintf("Switched traffic back to %s", d.active))
+}
+
+// pointAt sends traffic to a color with the switch command or by setting
+// the Kubernetes service's selector
+func (d *deployment) pointAt(ctx context.Context, color string) (string, error) {
+	if d.switchCmd != "" {
+		return d.shell(ctx, d.switchCmd, map[string]string{"DEPLOY_COLOR": color})
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{"selector": map[string]string{d.service.selector: color}},
+	})
+	if err != nil {
+		return "", err
+	}
+	return d.plugin.run(ctx, d.dir, d.env, "kubectl", d.kubectlArgs("patch", "service", d.service.name, "--type", "merge", "--patch", string(patch))...)
+}
+
+// teardownActive waits for the grace period, so requests in flight on the
+// old color finish, and then tears it down
+func (d *deployment) teardownActive(ctx context.Context) (string, error) {
+	if d.teardown == "" || d.active == "" {
+		return "", errSkipped
+	}
+	if d.gracePeriod > 0 {
+		core.LogStep(ctx, "info", fmt.Sprintf("Waiting %s before tearing down %s", d.gracePeriod, d.active))
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(d.gracePeriod):
+		}
+	}
+	return d.shell(ctx, d.teardown, map[string]string{"DEPLOY_COLOR": d.active})
+}
+
+// kubectlArgs adds the service's namespace and context to kubectl
+// arguments
+func (d *deployment) kubectlArgs(args ...string) []string {
+	if d.service.namespace != "" {
+		args = append(args, "--namespace", d.service.namespace)
+	}
+	if d.service.context != "" {
+		args = append(args, "--context", d.service.context)
+	}
+	return args
+}
+
+// shell runs a command with the colors in $DEPLOY_COLOR, the idle color
+// unless overridden, and $ACTIVE_COLOR
+func (d *deployment) shell(ctx context.Context, command string, overrides map[string]string) (string, error) {
+	env := make(map[string]string, len(d.env)+2)
+	for key, value := range d.env {
+		env[key] = value
+	}
+	env["DEPLOY_COLOR"], env["ACTIVE_COLOR"] = d.idle, d.active
+	for key, value := range overrides {
+		env[key] = value
+	}
+	return d.plugin.run(ctx, d.dir, env, "sh", "-c", command)
+}
+
+// lookup resolves $DEPLOY_COLOR, $ACTIVE_COLOR and the step's environment
+func (d *deployment) lookup(name string) string {
+	switch name {
+	case "DEPLOY_COLOR":
+		return d.idle
+	case "ACTIVE_COLOR":
+		return d.active
+	}
+	return d.env[name]
+}
+
+// waitHealthy polls a URL until it answers with a 2xx status or timeout
+// passes
+func (p *BlueGreenPlugin) waitHealthy(ctx context.Context, url string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var last string
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := p.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return nil
+			}
+			last = resp.Status
+		} else {
+			last = err.Error()
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s wasn't healthy within %s: %s", url, timeout, last)
+		case <-time.After(healthInterval):
+		}
+	}
+}
+
+// parseConfig reads and checks the configuration of a blue-green step
+func parseConfig(values map[string]interface{}) (*config, error) {
+	cfg := &config{
+		colors:     [2]string{"blue", "green"},
+		liveColor:  pluginutil.String(values, "active"),
+		current:    pluginutil.String(values, "current"),
+		provision:  pluginutil.String(values, "provision"),
+		verify:     pluginutil.StringList(values, "verify"),
+		healthURL:  pluginutil.String(values, "healthUrl"),
+		healthWait: defaultHealthTimeout,
+		switchCmd:  pluginutil.String(values, "switch"),
+		teardown:   pluginutil.String(values, "teardown"),
+		dir:        pluginutil.String(values, "workDir"),
+	}
+	cfg.env, _ = values["env"].(map[string]string)
+	if cfg.provision == "" {
+		return nil, fmt.Errorf("blue-green needs a provision command")
+	}
+	if colors := pluginutil.StringList(values, "colors"); colors != nil {
+		if len(colors) != 2 || colors[0] == "" || colors[1] == "" || colors[0] == colors[1] {
+			return nil, fmt.Errorf("blue-green needs two different colors")
+		}
+		cfg.colors = [2]string{colors[0], colors[1]}
+	}
+	if cfg.liveColor != "" && cfg.liveColor != cfg.colors[0] && cfg.liveColor != cfg.colors[1] {
+		return nil, fmt.Errorf("active color %q is neither %s nor %s", cfg.liveColor, cfg.colors[0], cfg.colors[1])
+	}
+
+	if service, ok := values["kubernetes"].(map[string]interface{}); ok {
+		cfg.service = &kubernetesService{
+			name:      pluginutil.String(service, "service"),
+			namespace: pluginutil.String(service, "namespace"),
+			selector:  pluginutil.String(service, "selector"),
+			context:   pluginutil.String(service, "context"),
+		}
+		if cfg.service.name == "" {
+			return nil, fmt.Errorf("kubernetes needs a service")
+		}
+		if cfg.service.selector == "" {
+			cfg.service.selector = defaultSelector
+		}
+	}
+	switch {
+	case cfg.switchCmd == "" && cfg.service == nil:
+		return nil, fmt.Errorf("blue-green needs a switch command or a kubernetes service")
+	case cfg.switchCmd != "" && cfg.service != nil:
+		return nil, fmt.Errorf("blue-green needs either a switch command or a kubernetes service, not both")
+	}
+
+	for _, d := range []struct {
+		key    string
+		target *time.Duration
+	}{{"healthTimeout", &cfg.healthWait}, {"gracePeriod", &cfg.gracePeriod}} {
+		if value := pluginutil.String(values, d.key); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed < 0 {
+				return nil, fmt.Errorf("invalid %s %q", d.key, value)
+			}
+			*d.target = parsed
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,169 @@
+package canary
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/chip/conveyor/core"
+)
+
+// prometheus serves the error rate values in turn, then the last one
+func prometheus(t *testing.T, values ...string) *httptest.Server {
+	t.Helper()
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query" || r.URL.Query().Get("query") != "error_rate" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status": "error", "error": "unexpected query"}`)
+			return
+		}
+		i := int(atomic.AddInt32(&calls, 1)) - 1
+		if i >= len(values) {
+			i = len(values) - 1
+		}
+		fmt.Fprintf(w, `{"status": "success", "data": {"resultType": "vector", "result": [{"metric": {}, "value": [1700000000, %q]}]}}`, values[i])
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func canaryStep(t *testing.T, server string, extra map[string]interface{}) (core.Step, string) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	dir := t.TempDir()
+	config := map[string]interface{}{
+		"workDir":    dir,
+		"prometheus": server,
+		"shift":      "echo $CANARY_WEIGHT >> weights.log",
+		"weights":    []interface{}{10, 50},
+		"bake":       "30ms",
+		"interval":   "10ms",
+		"metrics": []interface{}{
+			map[string]interface{}{"name": "errors", "query": "error_rate", "max": 0.05},
+		},
+	}
+	for key, value := range extra {
+		config[key] = value
+	}
+	return core.Step{ID: "canary", Type: "canary-deploy", Config: config}, dir
+}
+
+func weights(t *testing.T, dir string) string {
+	t.Helper()
+	data, _ := os.ReadFile(filepath.Join(dir, "weights.log"))
+	return strings.Join(strings.Fields(string(data)), " ")
+}
+
+func TestCanary_Promotes(t *testing.T) {
+	step, dir := canaryStep(t, prometheus(t, "0.01").URL, nil)
+	outputs, err := NewCanaryPlugin().Execute(context.Background(), step)
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if outputs["decision"] != DecisionPromoted {
+		t.Errorf("decision = %v, want %s", outputs["decision"], DecisionPromoted)
+	}
+	checks := outputs["analysis"].([]Check)
+	if len(checks) < 2 || checks[0].Weight != 10 || checks[len(checks)-1].Weight != 50 || !checks[0].Passed || *checks[0].Value != 0.01 {
+		t.Errorf("analysis = %+v, want passing checks at 10%% and 50%%", checks)
+	}
+	if got := weights(t, dir); got != "10 50 100" {
+		t.Errorf("weights = %q, want the shift command to set 10, 50, then 100", got)
+	}
+}
+
+func TestCanary_RollsBack(t *testing.T) {
+	step, dir := canaryStep(t, prometheus(t, "0.01", "0.2").URL, map[string]interface{}{
+		"rollback": "echo rollback >> weights.log",
+	})
+	outputs, err := NewCanaryPlugin().Execute(context.Background(), step)
+	if err == nil || !strings.Contains(err.Error(), "errors failed 1 checks at 10% traffic") {
+		t.Fatalf("Execute() error = %v, want a rollback at 10%%", err)
+	}
+	if outputs["decision"] != DecisionRolledBack {
+		t.Errorf("decision = %v, want %s", outputs["decision"], DecisionRolledBack)
+	}
+	checks := outputs["analysis"].([]Check)
+	if last := checks[len(checks)-1]; last.Passed || *last.Value != 0.2 {
+		t.Errorf("last check = %+v, want the failing value", last)
+	}
+	if got := weights(t, dir); got != "10 rollback" {
+		t.Errorf("commands = %q, want the rollback after the first shift", got)
+	}
+}
+
+func TestCanary_FailureLimitAndQueryErrors(t *testing.T) {
+	step, dir := canaryStep(t, prometheus(t, "0.2", "0.01").URL, map[string]interface{}{
+		"weights":      []interface{}{20},
+		"failureLimit": 2,
+	})
+	if _, err := NewCanaryPlugin().Execute(context.Background(), step); err != nil {
+		t.Errorf("Execute() error = %v, want one failed check tolerated", err)
+	}
+
+	step, dir = canaryStep(t, "http://127.0.0.1:1", nil)
+	outputs, err := NewCanaryPlugin().Execute(context.Background(), step)
+	if err == nil {
+		t.Fatal("Execute() with Prometheus down succeeded")
+	}
+	if checks := outputs["analysis"].([]Check); len(checks) != 1 || checks[0].Error == "" {
+		t.Errorf("analysis = %+v, want the failed query", checks)
+	}
+	if got := weights(t, dir); got != "10 0" {
+		t.Errorf("weights = %q, want the shift command to roll back to 0", got)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"prometheus": "http://prometheus:9090",
+			"shift":      "true",
+			"metrics":    []interface{}{map[string]interface{}{"query": "up", "min": 1}},
+		}
+	}
+	cfg, err := parseConfig(valid())
+	if err != nil {
+		t.Fatalf("parseConfig() error = %v", err)
+	}
+	if len(cfg.weights) != 1 || cfg.weights[0] != defaultWeight || cfg.bake != defaultBake || cfg.metrics[0].Name != "metric-1" || *cfg.metrics[0].Min != 1 {
+		t.Errorf("parseConfig() = %+v, want the defaults", cfg)
+	}
+
+	tests := []struct {
+		key   string
+		value interface{}
+		want  string
+	}{
+		{"prometheus", nil, "prometheus URL"},
+		{"shift", nil, "shift command"},
+		{"weight", 100, "between 1 and 99"},
+		{"weights", []interface{}{50, 20}, "must increase"},
+		{"bake", "soon", "invalid bake"},
+		{"failureLimit", 0, "failureLimit"},
+		{"metrics", []interface{}{map[string]interface{}{"query": "up"}}, "min or a max"},
+		{"metrics", nil, "needs metrics"},
+		{"tokenEnv", "PROM_TOKEN", "token in $PROM_TOKEN"},
+	}
+	for _, tt := range tests {
+		config := valid()
+		if tt.value == nil {
+			delete(config, tt.key)
+		} else {
+			config[tt.key] = tt.value
+		}
+		if _, err := parseConfig(config); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseConfig(%s: %v) error = %v, want %q", tt.key, tt.value, err, tt.want)
+		}
+	}
+}
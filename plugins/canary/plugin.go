@@ -0,0 +1,386 @@
+// Package canary provides the canary-deploy step, which shifts part of the
+// traffic to a new version, watches its metrics in Prometheus while it
+// bakes and promotes or rolls it back depending on thresholds.
+package canary
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/plugins/pluginutil"
+)
+
+// Defaults of canary steps
+const (
+	defaultWeight       = 10
+	defaultBake         = 5 * time.Minute
+	defaultInterval     = time.Minute
+	defaultFailureLimit = 1
+	// commandTimeout bounds the rollback run after the step was cancelled
+	commandTimeout = 5 * time.Minute
+)
+
+// Decisions of a canary analysis
+const (
+	DecisionPromoted   = "promoted"
+	DecisionRolledBack = "rolled back"
+)
+
+// CanaryPlugin implements the Plugin interface for canary deployments
+type CanaryPlugin struct {
+	client *http.Client
+}
+
+// NewCanaryPlugin creates a canary deployment plugin
+func NewCanaryPlugin() *CanaryPlugin {
+	return &CanaryPlugin{client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// GetManifest returns the plugin manifest
+func (p *CanaryPlugin) GetManifest() core.PluginManifest {
+	return core.PluginManifest{
+		Name:        "canary",
+		Version:     "1.0.0",
+		Description: "Canary deployments promoted or rolled back by Prometheus metrics",
+		Author:      "Conveyor Team",
+		Type:        "deploy",
+		StepTypes:   []string{"canary-deploy"},
+	}
+}
+
+// Metric is a Prometheus query whose value must stay within bounds while
+// the canary bakes
+type Metric struct {
+	Name  string   `json:"name"`
+	Query string   `json:"query"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+}
+
+// Check is one evaluation of a metric
+type Check struct {
+	Metric string    `json:"metric"`
+	Weight int       `json:"weight"`
+	At     time.Time `json:"at"`
+	// Value is missing when the query failed or returned no data
+	Value  *float64 `json:"value,omitempty"`
+	Passed bool     `json:"passed"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// config is the configuration of a canary step
+type config struct {
+	weights      []int
+	bake         time.Duration
+	interval     time.Duration
+	prometheus   string
+	token        string
+	metrics      []Metric
+	failureLimit int
+	shift        string
+	promote      string
+	rollback     string
+	dir          string
+	env          map[string]string
+}
+
+// Execute shifts each of the step's traffic weights to the canary in turn
+// and checks its metrics every interval while it bakes. A metric out of
+// bounds failureLimit times rolls the canary back and fails the step;
+// otherwise it is promoted. The analysis is part of the outputs either way.
+func (p *CanaryPlugin) Execute(ctx context.Context, step core.Step) (map[string]interface{}, error) {
+	if step.Type != "canary-deploy" {
+		return nil, fmt.Errorf("unsupported step type: %s", step.Type)
+	}
+	cfg, err := parseConfig(step.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	checks := []Check{}
+	outputs := func(decision, reason string) map[string]interface{} {
+		return map[string]interface{}{
+			"decision": decision,
+			"reason":   reason,
+			"weights":  cfg.weights,
+			"analysis": checks,
+		}
+	}
+	rollback := func(reason string) (map[string]interface{}, error) {
+		core.LogStep(ctx, "warning", "Rolling back the canary: "+reason)
+		runCtx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		defer cancel()
+		if err := cfg.run(runCtx, cfg.rollback, 0); err != nil {
+			return outputs(DecisionRolledBack, reason), fmt.Errorf("%s, and the rollback failed: %w", reason, err)
+		}
+		return outputs(DecisionRolledBack, reason), fmt.Errorf("canary rolled back: %s", reason)
+	}
+
+	for _, weight := range cfg.weights {
+		if err := cfg.run(ctx, cfg.shift, weight); err != nil {
+			return rollback(fmt.Sprintf("shifting %d%% of traffic failed: %v", weight, err))
+		}
+		core.LogStep(ctx, "info", fmt.Sprintf("Shifted %d%% of traffic to the canary, baking for %s", weight, cfg.bake))
+
+		failures := make(map[string]int)
+		deadline := time.Now().Add(cfg.bake)
+		for time.Now().Before(deadline) {
+			wait := cfg.interval
+			if remaining := time.Until(deadline); remaining < wait {
+				wait = remaining
+			}
+			select {
+			case <-ctx.Done():
+				return rollback("the step was cancelled")
+			case <-time.After(wait):
+			}
+			for _, metric := range cfg.metrics {
+				check := p.check(ctx, cfg, metric, weight)
+				checks = append(checks, check)
+				if check.Passed {
+					continue
+				}
+				failures[metric.Name]++
+				core.LogStep(ctx, "warning", fmt.Sprintf("Canary check of %s failed at %d%%: %s", metric.Name, weight, describe(check, metric)))
+				if failures[metric.Name] >= cfg.failureLimit {
+					return rollback(fmt.Sprintf("%s failed %d checks at %d%% traffic", metric.Name, failures[metric.Name], weight))
+				}
+			}
+		}
+	}
+
+	if err := cfg.run(ctx, cfg.promote, 100); err != nil {
+		return rollback(fmt.Sprintf("promoting failed: %v", err))
+	}
+	core.LogStep(ctx, "info", fmt.Sprintf("Promoted the canary after %d checks", len(checks)))
+	return outputs(DecisionPromoted, "every metric stayed within its thresholds"), nil
+}
+
+// check evaluates a metric. Failed queries and queries without data fail
+// the check.
+func (p *CanaryPlugin) check(ctx context.Context, cfg *config, metric Metric, weight int) Check {
+	check := Check{Metric: metric.Name, Weight: weight, At: time.Now()}
+	value, err := p.query(ctx, cfg.prometheus, cfg.token, metric.Query)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	check.Value = &value
+	check.Passed = (metric.Min == nil || value >= *metric.Min) && (metric.Max == nil || value <= *metric.Max)
+	return check
+}
+
+// describe explains why a check failed
+func describe(check Check, metric Metric) string {
+	if check.Value == nil {
+		return check.Error
+	}
+	var bounds []string
+	if metric.Min != nil {
+		bounds = append(bounds, fmt.Sprintf("min %v", *metric.Min))
+	}
+	if metric.Max != nil {
+		bounds = append(bounds, fmt.Sprintf("max %v", *metric.Max))
+	}
+	return fmt.Sprintf("%v is outside %s", *check.Value, strings.Join(bounds, ", "))
+}
+
+// run runs a traffic command with the canary's weight in $CANARY_WEIGHT.
+// Without a promote or rollback command, the shift command sets the weight
+// to 100 or 0.
+func (c *config) run(ctx context.Context, command string, weight int) error {
+	if command == "" {
+		command = c.shift
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = c.dir
+	cmd.Env = os.Environ()
+	for key, value := range c.env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.Env = append(cmd.Env, "CANARY_WEIGHT="+strconv.Itoa(weight))
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// parseConfig reads and checks the configuration of a canary step
+func parseConfig(values map[string]interface{}) (*config, error) {
+	cfg := &config{
+		bake:         defaultBake,
+		interval:     defaultInterval,
+		failureLimit: defaultFailureLimit,
+		prometheus:   strings.TrimSuffix(pluginutil.String(values, "prometheus"), "/"),
+		shift:        pluginutil.String(values, "shift"),
+		promote:      pluginutil.String(values, "promote"),
+		rollback:     pluginutil.String(values, "rollback"),
+		dir:          pluginutil.String(values, "workDir"),
+	}
+	cfg.env, _ = values["env"].(map[string]string)
+	if cfg.prometheus == "" {
+		return nil, fmt.Errorf("canary-deploy needs a prometheus URL")
+	}
+	if cfg.shift == "" {
+		return nil, fmt.Errorf("canary-deploy needs a shift command")
+	}
+	if tokenEnv := pluginutil.String(values, "tokenEnv"); tokenEnv != "" {
+		if cfg.token = cfg.env[tokenEnv]; cfg.token == "" {
+			return nil, fmt.Errorf("canary-deploy needs a token in $%s", tokenEnv)
+		}
+	}
+
+	weights, err := intList(values, "weights")
+	if err != nil {
+		return nil, err
+	}
+	if len(weights) == 0 {
+		weight, ok, err := number(values["weight"])
+		if err != nil {
+			return nil, fmt.Errorf("weight: %w", err)
+		}
+		if !ok {
+			weight = defaultWeight
+		}
+		if weight != float64(int(weight)) {
+			return nil, fmt.Errorf("weight must be a whole number")
+		}
+		weights = []int{int(weight)}
+	}
+	for i, weight := range weights {
+		if weight <= 0 || weight >= 100 {
+			return nil, fmt.Errorf("canary weight %d must be between 1 and 99", weight)
+		}
+		if i > 0 && weight <= weights[i-1] {
+			return nil, fmt.Errorf("canary weights must increase")
+		}
+	}
+	cfg.weights = weights
+
+	for _, d := range []struct {
+		key    string
+		target *time.Duration
+	}{{"bake", &cfg.bake}, {"interval", &cfg.interval}} {
+		if value := pluginutil.String(values, d.key); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("invalid %s %q", d.key, value)
+			}
+			*d.target = parsed
+		}
+	}
+	if limit, ok, err := number(values["failureLimit"]); err != nil || ok && limit < 1 {
+		return nil, fmt.Errorf("failureLimit must be a positive number")
+	} else if ok {
+		cfg.failureLimit = int(limit)
+	}
+
+	if cfg.metrics, err = parseMetrics(values["metrics"]); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// parseMetrics reads the metrics of a canary step, each with a name, a
+// query and a min or max
+func parseMetrics(value interface{}) ([]Metric, error) {
+	list, _ := value.([]interface{})
+	if len(list) == 0 {
+		return nil, fmt.Errorf("canary-deploy needs metrics to analyze")
+	}
+	metrics := make([]Metric, 0, len(list))
+	seen := make(map[string]bool)
+	for i, item := range list {
+		values, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("metric %d must be a map", i+1)
+		}
+		metric := Metric{Name: pluginutil.String(values, "name"), Query: pluginutil.String(values, "query")}
+		if metric.Name == "" {
+			metric.Name = fmt.Sprintf("metric-%d", i+1)
+		}
+		if metric.Query == "" {
+			return nil, fmt.Errorf("metric %s needs a query", metric.Name)
+		}
+		if seen[metric.Name] {
+			return nil, fmt.Errorf("metric %s is listed twice", metric.Name)
+		}
+		seen[metric.Name] = true
+		for _, bound := range []struct {
+			key    string
+			target **float64
+		}{{"min", &metric.Min}, {"max", &metric.Max}} {
+			limit, ok, err := number(values[bound.key])
+			if err != nil {
+				return nil, fmt.Errorf("metric %s %s: %w", metric.Name, bound.key, err)
+			}
+			if ok {
+				*bound.target = &limit
+			}
+		}
+		if metric.Min == nil && metric.Max == nil {
+			return nil, fmt.Errorf("metric %s needs a min or a max", metric.Name)
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, nil
+}
+
+// number reads a numeric config value, which YAML and JSON decode as
+// different types. It reports false when the value is unset.
+func number(value interface{}) (float64, bool, error) {
+	switch n := value.(type) {
+	case nil:
+		return 0, false, nil
+	case int:
+		return float64(n), true, nil
+	case int64:
+		return float64(n), true, nil
+	case float64:
+		return n, true, nil
+	case string:
+		parsed, err := strconv.ParseFloat(n, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("%q is not a number", n)
+		}
+		return parsed, true, nil
+	}
+	return 0, false, fmt.Errorf("%v is not a number", value)
+}
+
+// intList reads a list of whole numbers
+func intList(config map[string]interface{}, key string) ([]int, error) {
+	var items []interface{}
+	switch value := config[key].(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		items = value
+	case []int:
+		return value, nil
+	default:
+		return nil, fmt.Errorf("%s must be a list of numbers", key)
+	}
+	list := make([]int, 0, len(items))
+	for _, item := range items {
+		n, ok, err := number(item)
+		if err != nil || !ok || n != float64(int(n)) {
+			return nil, fmt.Errorf("%s must be a list of whole numbers", key)
+		}
+		list = append(list, int(n))
+	}
+	return list, nil
+}
@@ -0,0 +1,76 @@
+package canary
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// queryResponse is the response of the Prometheus instant query API
+type queryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+// query runs an instant query against Prometheus and returns its value: a
+// scalar, or the first sample of a vector
+func (p *CanaryPlugin) query(ctx context.Context, server, token, query string) (float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server+"/api/v1/query?query="+url.QueryEscape(query), nil)
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("prometheus query failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result queryResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 10<<20)).Decode(&result); err != nil {
+		return 0, fmt.Errorf("prometheus returned %s: %w", resp.Status, err)
+	}
+	if result.Status != "success" {
+		return 0, fmt.Errorf("prometheus query failed: %s", result.Error)
+	}
+
+	var sample []interface{}
+	switch result.Data.ResultType {
+	case "scalar":
+		if err := json.Unmarshal(result.Data.Result, &sample); err != nil {
+			return 0, fmt.Errorf("invalid prometheus scalar: %w", err)
+		}
+	case "vector":
+		var vector []struct {
+			Value []interface{} `json:"value"`
+		}
+		if err := json.Unmarshal(result.Data.Result, &vector); err != nil {
+			return 0, fmt.Errorf("invalid prometheus vector: %w", err)
+		}
+		if len(vector) == 0 {
+			return 0, fmt.Errorf("query returned no data")
+		}
+		sample = vector[0].Value
+	default:
+		return 0, fmt.Errorf("query returned a %s, not a scalar or vector", result.Data.ResultType)
+	}
+	if len(sample) != 2 {
+		return 0, fmt.Errorf("invalid prometheus sample")
+	}
+	text, _ := sample[1].(string)
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid prometheus value %q", text)
+	}
+	return value, nil
+}
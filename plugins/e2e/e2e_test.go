@@ -0,0 +1,193 @@
+package e2e
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chip/conveyor/core"
+)
+
+const playwrightJSON = `{
+  "suites": [{
+    "title": "login.spec.ts", "file": "login.spec.ts",
+    "suites": [{
+      "title": "login", "file": "login.spec.ts",
+      "specs": [
+        {"title": "shows the dashboard", "file": "login.spec.ts", "line": 4, "tests": [
+          {"projectName": "chromium", "status": "expected", "results": [{"status": "passed", "duration": 1200, "attachments": []}]}
+        ]},
+        {"title": "rejects a bad password", "file": "login.spec.ts", "line": 12, "tests": [
+          {"projectName": "chromium", "status": "unexpected", "results": [
+            {"status": "failed", "duration": 3000, "error": {"message": "\u001b[31mexpect(locator).toBeVisible() failed\u001b[39m"}, "attachments": []},
+            {"status": "failed", "duration": 2500, "error": {"message": "\u001b[31mexpect(locator).toBeVisible() failed\u001b[39m"}, "attachments": [
+              {"name": "screenshot", "contentType": "image/png", "path": "/work/.conveyor-e2e/e2e/artifacts/login-rejects/test-failed-1.png"},
+              {"name": "trace", "contentType": "application/zip", "path": "/work/.conveyor-e2e/e2e/artifacts/login-rejects/trace.zip"},
+              {"name": "stdout", "contentType": "text/plain", "path": "/tmp/elsewhere.txt"}
+            ]}
+          ]}
+        ]},
+        {"title": "remembers the user", "file": "login.spec.ts", "line": 20, "tests": [
+          {"projectName": "chromium", "status": "flaky", "results": [{"status": "failed", "duration": 900}, {"status": "passed", "duration": 800}]}
+        ]}
+      ]
+    }]
+  }],
+  "errors": []
+}`
+
+func TestPlaywright_ReportsResultsAndStoresAttachments(t *testing.T) {
+	workDir := t.TempDir()
+	store, err := core.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var command []string
+	var env map[string]string
+	plugin := NewE2EPlugin()
+	plugin.run = func(ctx context.Context, dir string, e map[string]string, name string, args ...string) (string, string, error) {
+		command, env = append([]string{name}, args...), e
+		// The container sees the working directory at /work
+		host := func(path string) string { return filepath.Join(dir, strings.TrimPrefix(path, "/work/")) }
+		artifacts := host("/work/.conveyor-e2e/e2e/artifacts/login-rejects")
+		os.MkdirAll(artifacts, 0755)
+		os.WriteFile(filepath.Join(artifacts, "test-failed-1.png"), []byte("png"), 0644)
+		os.WriteFile(filepath.Join(artifacts, "trace.zip"), []byte("zip"), 0644)
+		os.WriteFile(host(e["PLAYWRIGHT_JSON_OUTPUT_NAME"]), []byte(playwrightJSON), 0644)
+		return "", "", errors.New("exit status 1")
+	}
+	engine := core.NewPipelineEngine(core.WithLogger(log.New(io.Discard, "", 0)), core.WithStore(store),
+		core.WithExecutor(&core.ShellExecutor{Dir: workDir}), core.WithPlugins(plugin))
+
+	step := core.Step{ID: "e2e", Type: "e2e-test", Environment: map[string]string{"BASE_URL": "http://localhost:3000"},
+		Config: map[string]interface{}{"tool": "playwright", "browser": "chromium", "args": []interface{}{"--retries=1"}}}
+	engine.CreatePipeline(&core.Pipeline{ID: "web", Stages: []core.Stage{{ID: "test", Steps: []core.Step{step}}}})
+	job, _ := engine.Run(context.Background(), "web")
+	if job.Status != core.StatusFailed || !strings.Contains(job.Logs[len(job.Logs)-1].Message, "1 of 3 tests failed") {
+		t.Fatalf("job = %s %+v, want one failed test", job.Status, job.Logs)
+	}
+
+	joined := strings.Join(command, " ")
+	for _, want := range []string{"docker run --rm --network host", "--volume " + workDir + ":/work", "--env BASE_URL", "--env PLAYWRIGHT_JSON_OUTPUT_NAME", defaultImages[ToolPlaywright] + " npx playwright test --reporter=json", "--project=chromium --retries=1"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("command = %s, want %q", joined, want)
+		}
+	}
+	if strings.Contains(joined, "localhost:3000") || env["BASE_URL"] != "http://localhost:3000" {
+		t.Errorf("command = %s with env %v, want the variables passed by name", joined, env)
+	}
+
+	reports, err := engine.JobTestReports(job.ID)
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("JobTestReports() = %+v, %v", reports, err)
+	}
+	report := reports[0]
+	if report.StepID != "e2e" || report.Total != 3 || report.Passed != 1 || report.Failed != 1 || report.Flaky != 1 || report.DurationMs != 8400 {
+		t.Errorf("report = %+v", report.TestReport)
+	}
+	failed := report.Cases[1]
+	if failed.Name != "rejects a bad password [chromium]" || failed.Suite != "login.spec.ts › login" || failed.Retries != 1 || failed.Error != "expect(locator).toBeVisible() failed" {
+		t.Errorf("failed case = %+v", failed)
+	}
+	if len(failed.Attachments) != 2 || failed.Attachments[0].Path != "login-rejects/test-failed-1.png" || failed.Attachments[1].Artifact != "e2e-e2e" {
+		t.Errorf("attachments = %+v, want the screenshot and trace in the artifact", failed.Attachments)
+	}
+
+	artifacts, _ := engine.JobArtifacts(job.ID)
+	if len(artifacts) != 1 || artifacts[0].Name != "e2e-e2e" || artifacts[0].Files != 2 {
+		t.Errorf("artifacts = %+v, want the attachments stored", artifacts)
+	}
+	if _, err := os.Stat(filepath.Join(workDir, outputDir)); !os.IsNotExist(err) {
+		t.Errorf("output directory left behind: %v", err)
+	}
+}
+
+func TestCypress_ReadsJUnitResults(t *testing.T) {
+	workDir := t.TempDir()
+	var command []string
+	plugin := NewE2EPlugin()
+	plugin.run = func(ctx context.Context, dir string, env map[string]string, name string, args ...string) (string, string, error) {
+		command = append([]string{name}, args...)
+		output := filepath.Join(dir, outputDir, "smoke")
+		os.MkdirAll(filepath.Join(output, "junit"), 0755)
+		os.MkdirAll(filepath.Join(output, "artifacts", "screenshots", "cart.cy.js"), 0755)
+		os.MkdirAll(filepath.Join(output, "artifacts", "videos"), 0755)
+		os.WriteFile(filepath.Join(output, "artifacts", "screenshots", "cart.cy.js", "cart -- adds an item (failed) (attempt 2).png"), nil, 0644)
+		os.WriteFile(filepath.Join(output, "artifacts", "videos", "cart.cy.js.mp4"), nil, 0644)
+		os.WriteFile(filepath.Join(output, "junit", "results-1a2b.xml"), []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<testsuites name="Mocha Tests" tests="3" failures="1">
+  <testsuite name="Root Suite" file="cypress/e2e/cart.cy.js" tests="0" failures="0"></testsuite>
+  <testsuite name="cart" tests="3" failures="1">
+    <testcase name="cart adds an item" time="2.5" classname="adds an item"><failure message="expected 1 items, got 0" type="AssertionError"><![CDATA[AssertionError: expected 1 items, got 0]]></failure></testcase>
+    <testcase name="cart removes an item" time="0.75" classname="removes an item"></testcase>
+    <testcase name="cart checks out" time="0" classname="checks out"><skipped/></testcase>
+  </testsuite>
+</testsuites>`), 0644)
+		return "", "", errors.New("exit status 1")
+	}
+
+	outputs, err := plugin.Execute(context.Background(), core.Step{ID: "smoke", Type: "e2e-test", Config: map[string]interface{}{
+		"tool": "cypress", "container": false, "workDir": workDir, "browser": "firefox",
+	}})
+	if err == nil || err.Error() != "1 of 3 tests failed" {
+		t.Errorf("Execute() error = %v, want one failed test", err)
+	}
+	if command[0] != "cypress" || !strings.Contains(strings.Join(command, " "), "mochaFile="+filepath.Join(workDir, outputDir, "smoke", "junit", "results-[hash].xml")) {
+		t.Errorf("command = %v, want cypress run on the server", command)
+	}
+	report := outputs["testReport"].(*core.TestReport)
+	if report.Total != 3 || report.Failed != 1 || report.Skipped != 1 || report.DurationMs != 3250 {
+		t.Errorf("report = %+v", report)
+	}
+	failed := report.Cases[0]
+	if failed.File != "cypress/e2e/cart.cy.js" || failed.Error != "expected 1 items, got 0" {
+		t.Errorf("failed case = %+v", failed)
+	}
+	// Outside a job the attachments can't be stored
+	if len(failed.Attachments) != 0 || outputs["artifact"] != nil {
+		t.Errorf("attachments = %+v, want none without an artifact", failed.Attachments)
+	}
+
+}
+
+func TestCypressAttachments(t *testing.T) {
+	artifacts := t.TempDir()
+	os.MkdirAll(filepath.Join(artifacts, "screenshots", "cart.cy.js"), 0755)
+	os.MkdirAll(filepath.Join(artifacts, "videos"), 0755)
+	os.WriteFile(filepath.Join(artifacts, "screenshots", "cart.cy.js", "cart -- adds an item (failed) (attempt 2).png"), nil, 0644)
+	os.WriteFile(filepath.Join(artifacts, "screenshots", "cart.cy.js", "cart -- removes an item (failed).png"), nil, 0644)
+	os.WriteFile(filepath.Join(artifacts, "videos", "cart.cy.js.mp4"), nil, 0644)
+
+	attachments := (&config{artifact: "e2e-smoke"}).cypressAttachments(artifacts, "cypress/e2e/cart.cy.js", "cart adds an item")
+	if len(attachments) != 2 || attachments[0].Path != "screenshots/cart.cy.js/cart -- adds an item (failed) (attempt 2).png" || attachments[1].Path != "videos/cart.cy.js.mp4" {
+		t.Errorf("cypressAttachments() = %+v, want the test's screenshot and the spec's video", attachments)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		config map[string]interface{}
+		want   string
+	}{
+		{map[string]interface{}{"workDir": "/src"}, "needs a tool"},
+		{map[string]interface{}{"tool": "selenium", "workDir": "/src"}, "unknown test runner"},
+		{map[string]interface{}{"tool": "cypress"}, "needs a working directory"},
+		{map[string]interface{}{"tool": "cypress", "workDir": "/src", "artifact": "../x"}, "invalid artifact name"},
+		{map[string]interface{}{"tool": "cypress", "workDir": "/src", "args": 3}, "args must be a list"},
+	}
+	for _, tt := range tests {
+		if _, err := parseConfig(core.Step{ID: "e2e", Config: tt.config}); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseConfig(%v) error = %v, want %q", tt.config, err, tt.want)
+		}
+	}
+
+	cfg, err := parseConfig(core.Step{ID: "e2e", Image: "registry.example.com/playwright:custom", Config: map[string]interface{}{"tool": "playwright", "workDir": "/src"}})
+	if err != nil || cfg.image != "registry.example.com/playwright:custom" || cfg.trace != defaultTrace {
+		t.Errorf("parseConfig() = %+v, %v, want the step's image", cfg, err)
+	}
+}
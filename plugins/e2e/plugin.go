@@ -0,0 +1,287 @@
+// Package e2e provides the e2e-test step, which runs Playwright or Cypress
+// suites in a container with the browsers preinstalled, stores their
+// screenshots, videos and traces as an artifact and reports the results as
+// the step's test report.
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/plugins/pluginutil"
+)
+
+// Test runners
+const (
+	ToolPlaywright = "playwright"
+	ToolCypress    = "cypress"
+)
+
+// Defaults of e2e-test steps
+const (
+	defaultNetwork = "host"
+	defaultTrace   = "retain-on-failure"
+	// containerDir is where the working directory is mounted
+	containerDir = "/work"
+	// outputDir holds a step's results and attachments in the working
+	// directory while it runs
+	outputDir = ".conveyor-e2e"
+)
+
+// defaultImages are the images with each runner and its browsers
+var defaultImages = map[string]string{
+	ToolPlaywright: "mcr.microsoft.com/playwright:v1.48.2-jammy",
+	ToolCypress:    "cypress/included:13.15.2",
+}
+
+// E2EPlugin implements the Plugin interface for browser tests
+type E2EPlugin struct {
+	run pluginutil.RunFunc
+}
+
+// NewE2EPlugin creates a browser testing plugin
+func NewE2EPlugin() *E2EPlugin {
+	return &E2EPlugin{run: pluginutil.RunCommand}
+}
+
+// GetManifest returns the plugin manifest
+func (p *E2EPlugin) GetManifest() core.PluginManifest {
+	return core.PluginManifest{
+		Name:        "e2e",
+		Version:     "1.0.0",
+		Description: "Playwright and Cypress suites in browser containers, with screenshots, videos and traces kept as artifacts",
+		Author:      "Conveyor Team",
+		Type:        "test",
+		StepTypes:   []string{"e2e-test"},
+	}
+}
+
+// config is the configuration of an e2e-test step
+type config struct {
+	tool  string
+	image string
+	// container is false to run the runner installed on the server
+	container bool
+	network   string
+	browser   string
+	trace     string
+	args      []string
+	artifact  string
+	dir       string
+	env       map[string]string
+	// output is the step's directory under outputDir
+	output string
+}
+
+// Execute runs a step's suite, stores its attachments and fails when tests
+// failed
+func (p *E2EPlugin) Execute(ctx context.Context, step core.Step) (map[string]interface{}, error) {
+	if step.Type != "e2e-test" {
+		return nil, fmt.Errorf("unsupported step type: %s", step.Type)
+	}
+	cfg, err := parseConfig(step)
+	if err != nil {
+		return nil, err
+	}
+
+	output := filepath.Join(cfg.dir, filepath.FromSlash(cfg.output))
+	os.RemoveAll(output)
+	if err := os.MkdirAll(filepath.Join(output, "artifacts"), 0755); err != nil {
+		return nil, err
+	}
+	defer func() {
+		os.RemoveAll(output)
+		// Remove outputDir once no step uses it
+		os.Remove(filepath.Dir(output))
+	}()
+
+	name, args, env := cfg.command()
+	core.LogStep(ctx, "info", fmt.Sprintf("Running the %s suite%s", cfg.tool, cfg.describeContainer()))
+	stdout, stderr, runErr := p.run(ctx, cfg.dir, env, name, args...)
+	pluginutil.LogOutput(ctx, stdout, stderr)
+
+	var report *core.TestReport
+	if cfg.tool == ToolPlaywright {
+		report, err = cfg.playwrightReport(filepath.Join(output, "results.json"))
+	} else {
+		report, err = cfg.cypressReport(filepath.Join(output, "junit"), filepath.Join(output, "artifacts"))
+	}
+	if err != nil {
+		if runErr != nil {
+			return nil, toolError(cfg.tool, stderr, runErr)
+		}
+		return nil, err
+	}
+
+	outputs := map[string]interface{}{"tool": cfg.tool, "testReport": report}
+	if stored := p.storeAttachments(ctx, cfg, filepath.Join(output, "artifacts"), report); stored {
+		outputs["artifact"] = cfg.artifact
+	}
+	core.LogStep(ctx, "info", fmt.Sprintf("%d tests: %d passed, %d failed, %d flaky, %d skipped",
+		report.Total, report.Passed, report.Failed, report.Flaky, report.Skipped))
+	switch {
+	case report.Failed > 0:
+		return outputs, fmt.Errorf("%d of %d tests failed", report.Failed, report.Total)
+	case runErr != nil:
+		return outputs, toolError(cfg.tool, stderr, runErr)
+	}
+	return outputs, nil
+}
+
+// storeAttachments stores the files the runner wrote as the step's
+// artifact and drops the attachments of the report that weren't stored
+func (p *E2EPlugin) storeAttachments(ctx context.Context, cfg *config, dir string, report *core.TestReport) bool {
+	stored := false
+	if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+		if _, err := core.SaveStepArtifact(ctx, cfg.artifact, dir, []string{"*"}); err != nil {
+			core.LogStep(ctx, "warn", fmt.Sprintf("Failed to store the test attachments: %v", err))
+		} else {
+			stored = true
+		}
+	}
+	if !stored {
+		for i := range report.Cases {
+			report.Cases[i].Attachments = nil
+		}
+	}
+	return stored
+}
+
+// command returns the command running the suite, and its environment
+func (cfg *config) command() (string, []string, map[string]string) {
+	env := make(map[string]string, len(cfg.env)+1)
+	for key, value := range cfg.env {
+		env[key] = value
+	}
+	var command []string
+	if cfg.tool == ToolPlaywright {
+		env["PLAYWRIGHT_JSON_OUTPUT_NAME"] = cfg.path("results.json")
+		command = []string{"npx", "playwright", "test", "--reporter=json", "--output=" + cfg.path("artifacts")}
+		if cfg.trace != "off" {
+			command = append(command, "--trace="+cfg.trace)
+		}
+		if cfg.browser != "" {
+			command = append(command, "--project="+cfg.browser)
+		}
+	} else {
+		command = []string{"cypress", "run",
+			"--reporter", "junit",
+			"--reporter-options", "mochaFile=" + cfg.path("junit/results-[hash].xml"),
+			"--config", "video=true,screenshotsFolder=" + cfg.path("artifacts/screenshots") + ",videosFolder=" + cfg.path("artifacts/videos"),
+		}
+		if cfg.browser != "" {
+			command = append(command, "--browser", cfg.browser)
+		}
+	}
+	command = append(command, cfg.args...)
+	if !cfg.container {
+		return command[0], command[1:], env
+	}
+
+	// The variables are passed by name, so their values, which may be
+	// secrets, stay out of the command line
+	args := []string{"run", "--rm", "--network", cfg.network, "--ipc", "host",
+		"--volume", cfg.dir + ":" + containerDir, "--workdir", containerDir}
+	for _, key := range sortedKeys(env) {
+		args = append(args, "--env", key)
+	}
+	if cfg.tool == ToolCypress {
+		args = append(args, "--entrypoint", command[0])
+		command = command[1:]
+	}
+	args = append(args, cfg.image)
+	return "docker", append(args, command...), env
+}
+
+// path returns the path of a file of the step's output directory as the
+// runner sees it
+func (cfg *config) path(name string) string {
+	if cfg.container {
+		return path.Join(containerDir, cfg.output, name)
+	}
+	return filepath.Join(cfg.dir, filepath.FromSlash(cfg.output), filepath.FromSlash(name))
+}
+
+// describeContainer names the container image in log messages
+func (cfg *config) describeContainer() string {
+	if !cfg.container {
+		return ""
+	}
+	return " in " + cfg.image
+}
+
+// parseConfig reads and checks the configuration of an e2e-test step
+func parseConfig(step core.Step) (*config, error) {
+	values := step.Config
+	cfg := &config{
+		tool:      pluginutil.String(values, "tool"),
+		image:     step.Image,
+		container: true,
+		network:   pluginutil.String(values, "network"),
+		browser:   pluginutil.String(values, "browser"),
+		trace:     pluginutil.String(values, "trace"),
+		artifact:  pluginutil.String(values, "artifact"),
+		dir:       pluginutil.String(values, "workDir"),
+		output:    path.Join(outputDir, step.ID),
+	}
+	cfg.env, _ = values["env"].(map[string]string)
+
+	switch cfg.tool {
+	case ToolPlaywright, ToolCypress:
+	case "":
+		return nil, fmt.Errorf("e2e-test needs a tool: %s or %s", ToolPlaywright, ToolCypress)
+	default:
+		return nil, fmt.Errorf("unknown test runner %q, want %s or %s", cfg.tool, ToolPlaywright, ToolCypress)
+	}
+	if container, ok := values["container"].(bool); ok {
+		cfg.container = container
+	}
+	if cfg.image == "" {
+		cfg.image = defaultImages[cfg.tool]
+	}
+	if cfg.network == "" {
+		cfg.network = defaultNetwork
+	}
+	if cfg.trace == "" {
+		cfg.trace = defaultTrace
+	}
+	if cfg.artifact == "" {
+		cfg.artifact = "e2e-" + step.ID
+	}
+	if !core.ValidArtifactName(cfg.artifact) {
+		return nil, fmt.Errorf("invalid artifact name %q", cfg.artifact)
+	}
+	if cfg.dir == "" {
+		return nil, fmt.Errorf("e2e-test needs a working directory")
+	}
+
+	switch args := values["args"].(type) {
+	case nil:
+	case string:
+		cfg.args = strings.Fields(args)
+	case []interface{}:
+		for _, arg := range args {
+			cfg.args = append(cfg.args, fmt.Sprint(arg))
+		}
+	case []string:
+		cfg.args = args
+	default:
+		return nil, fmt.Errorf("args must be a list")
+	}
+	return cfg, nil
+}
+
+// toolError describes a failed run by the last line of its error output,
+// or err
+func toolError(tool, stderr string, err error) error {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	if msg := strings.TrimSpace(lines[len(lines)-1]); msg != "" {
+		return fmt.Errorf("%s failed: %s", tool, msg)
+	}
+	return fmt.Errorf("%s failed: %w", tool, err)
+}
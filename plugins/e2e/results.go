@@ -0,0 +1,272 @@
+package e2e
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/chip/conveyor/core"
+)
+
+// ansiEscape matches the color codes in Playwright's error messages
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// cypressAttempt is the attempt suffix of screenshots of retried tests
+var cypressAttempt = regexp.MustCompile(` \(attempt \d+\)$`)
+
+// playwrightResults is the output of Playwright's JSON reporter
+type playwrightResults struct {
+	Suites []playwrightSuite   `json:"suites"`
+	Errors []playwrightMessage `json:"errors"`
+}
+
+type playwrightSuite struct {
+	Title  string            `json:"title"`
+	File   string            `json:"file"`
+	Specs  []playwrightSpec  `json:"specs"`
+	Suites []playwrightSuite `json:"suites"`
+}
+
+type playwrightSpec struct {
+	Title string           `json:"title"`
+	File  string           `json:"file"`
+	Line  int              `json:"line"`
+	Tests []playwrightTest `json:"tests"`
+}
+
+// playwrightTest is a spec in one project, with a result per attempt
+type playwrightTest struct {
+	ProjectName string `json:"projectName"`
+	// Status is expected, unexpected, flaky or skipped
+	Status  string `json:"status"`
+	Results []struct {
+		Duration    int64              `json:"duration"`
+		Error       *playwrightMessage `json:"error"`
+		Attachments []struct {
+			Name        string `json:"name"`
+			ContentType string `json:"contentType"`
+			Path        string `json:"path"`
+		} `json:"attachments"`
+	} `json:"results"`
+}
+
+type playwrightMessage struct {
+	Message string `json:"message"`
+}
+
+// junitSuites is the JUnit report of a Cypress spec. The suite of the
+// spec's file comes first and the suites of its describe blocks follow.
+type junitSuites struct {
+	Suites []struct {
+		Name  string `xml:"name,attr"`
+		File  string `xml:"file,attr"`
+		Cases []struct {
+			Name    string  `xml:"name,attr"`
+			Time    float64 `xml:"time,attr"`
+			Failure *struct {
+				Message string `xml:"message,attr"`
+				Text    string `xml:",chardata"`
+			} `xml:"failure"`
+			Skipped *struct{} `xml:"skipped"`
+		} `xml:"testcase"`
+	} `xml:"testsuite"`
+}
+
+// playwrightReport reads the results of Playwright's JSON reporter
+func (cfg *config) playwrightReport(file string) (*core.TestReport, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("playwright wrote no results: %w", err)
+	}
+	var results playwrightResults
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("invalid playwright results: %w", err)
+	}
+
+	report := &core.TestReport{Tool: ToolPlaywright}
+	var walk func(suite playwrightSuite, titles []string)
+	walk = func(suite playwrightSuite, titles []string) {
+		if suite.Title != "" {
+			titles = append(titles, suite.Title)
+		}
+		for _, spec := range suite.Specs {
+			for _, test := range spec.Tests {
+				report.Cases = append(report.Cases, cfg.playwrightCase(strings.Join(titles, " › "), spec, test))
+			}
+		}
+		for _, child := range suite.Suites {
+			walk(child, titles)
+		}
+	}
+	for _, suite := range results.Suites {
+		walk(suite, nil)
+	}
+	if len(report.Cases) == 0 && len(results.Errors) > 0 {
+		return nil, fmt.Errorf("playwright failed: %s", cleanMessage(results.Errors[0].Message))
+	}
+	report.Count()
+	for _, c := range report.Cases {
+		report.DurationMs += c.DurationMs
+	}
+	return report, nil
+}
+
+// playwrightCase returns the test case of a spec's test in a project
+func (cfg *config) playwrightCase(suite string, spec playwrightSpec, test playwrightTest) core.TestCase {
+	c := core.TestCase{Suite: suite, Name: spec.Title, File: spec.File, Line: spec.Line}
+	if test.ProjectName != "" {
+		c.Name += " [" + test.ProjectName + "]"
+	}
+	switch test.Status {
+	case "expected":
+		c.Status = core.TestPassed
+	case "flaky":
+		c.Status = core.TestFlaky
+	case "skipped":
+		c.Status = core.TestSkipped
+	default:
+		c.Status = core.TestFailed
+	}
+	if len(test.Results) > 1 {
+		c.Retries = len(test.Results) - 1
+	}
+	for _, result := range test.Results {
+		c.DurationMs += result.Duration
+		if result.Error != nil && c.Status == core.TestFailed {
+			c.Error = cleanMessage(result.Error.Message)
+		}
+		for _, attachment := range result.Attachments {
+			if rel, ok := cfg.artifactPath(attachment.Path); ok {
+				c.Attachments = append(c.Attachments, core.TestAttachment{
+					Name:        attachment.Name,
+					ContentType: attachment.ContentType,
+					Artifact:    cfg.artifact,
+					Path:        rel,
+				})
+			}
+		}
+	}
+	return c
+}
+
+// cypressReport reads the JUnit reports Cypress wrote per spec and
+// attaches the screenshots and videos of the spec's tests
+func (cfg *config) cypressReport(dir, artifacts string) (*core.TestReport, error) {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.xml"))
+	if len(files) == 0 {
+		return nil, fmt.Errorf("cypress wrote no results")
+	}
+	sort.Strings(files)
+
+	report := &core.TestReport{Tool: ToolCypress}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var suites junitSuites
+		if err := xml.Unmarshal(data, &suites); err != nil {
+			return nil, fmt.Errorf("invalid cypress results %s: %w", filepath.Base(file), err)
+		}
+		spec := ""
+		for _, suite := range suites.Suites {
+			if suite.File != "" {
+				spec = suite.File
+			}
+			for _, testcase := range suite.Cases {
+				c := core.TestCase{
+					Suite:      suite.Name,
+					Name:       testcase.Name,
+					File:       spec,
+					Status:     core.TestPassed,
+					DurationMs: int64(math.Round(testcase.Time * 1000)),
+				}
+				switch {
+				case testcase.Failure != nil:
+					c.Status = core.TestFailed
+					c.Error = testcase.Failure.Message
+					if c.Error == "" {
+						c.Error = strings.TrimSpace(testcase.Failure.Text)
+					}
+					c.Attachments = cfg.cypressAttachments(artifacts, spec, testcase.Name)
+				case testcase.Skipped != nil:
+					c.Status = core.TestSkipped
+				}
+				report.Cases = append(report.Cases, c)
+				report.DurationMs += c.DurationMs
+			}
+		}
+	}
+	report.Count()
+	return report, nil
+}
+
+// cypressAttachments returns the screenshots of a failed test, which
+// Cypress names after the test's titles, and the video of its spec
+func (cfg *config) cypressAttachments(artifacts, spec, name string) []core.TestAttachment {
+	var attachments []core.TestAttachment
+	if spec == "" {
+		return nil
+	}
+	screenshots, _ := filepath.Glob(filepath.Join(artifacts, "screenshots", "*", filepath.Base(spec), "*.png"))
+	direct, _ := filepath.Glob(filepath.Join(artifacts, "screenshots", filepath.Base(spec), "*.png"))
+	for _, file := range append(direct, screenshots...) {
+		title := strings.TrimSuffix(filepath.Base(file), ".png")
+		title = strings.TrimSuffix(cypressAttempt.ReplaceAllString(title, ""), " (failed)")
+		if strings.ReplaceAll(title, " -- ", " ") != name {
+			continue
+		}
+		rel, _ := filepath.Rel(artifacts, file)
+		attachments = append(attachments, core.TestAttachment{Name: "screenshot", ContentType: "image/png", Artifact: cfg.artifact, Path: filepath.ToSlash(rel)})
+	}
+	video := filepath.Join(artifacts, "videos", filepath.Base(spec)+".mp4")
+	if _, err := os.Stat(video); err == nil {
+		attachments = append(attachments, core.TestAttachment{Name: "video", ContentType: "video/mp4", Artifact: cfg.artifact, Path: "videos/" + filepath.Base(video)})
+	}
+	return attachments
+}
+
+// artifactPath returns the path within the step's artifact of a file the
+// runner wrote, or false when it isn't part of it
+func (cfg *config) artifactPath(file string) (string, bool) {
+	root := cfg.path("artifacts")
+	var rel string
+	if cfg.container {
+		if !strings.HasPrefix(file, root+"/") {
+			return "", false
+		}
+		rel = path.Clean(strings.TrimPrefix(file, root+"/"))
+	} else {
+		var err error
+		if rel, err = filepath.Rel(root, file); err != nil {
+			return "", false
+		}
+		rel = filepath.ToSlash(rel)
+	}
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
+// cleanMessage removes the color codes of a message
+func cleanMessage(message string) string {
+	return strings.TrimSpace(ansiEscape.ReplaceAllString(message, ""))
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
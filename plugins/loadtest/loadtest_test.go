@@ -0,0 +1,129 @@
+package loadtest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chip/conveyor/core"
+)
+
+const summaryJSON = `{"metrics": {
+	"http_reqs": {"count": 1200, "rate": 40.5},
+	"http_req_duration": {"min": 3.1, "med": 42.5, "avg": 60, "max": 900, "p(95)": 812.25, "p(99)": 880, "thresholds": {"p(95)<1000": false}},
+	"http_req_failed": {"passes": 30, "fails": 1170, "value": 0.025}
+}}`
+
+func TestK6_RecordsMetricsAndChecksThresholds(t *testing.T) {
+	workDir := t.TempDir()
+	var args []string
+	plugin := NewLoadTestPlugin()
+	plugin.run = func(ctx context.Context, dir string, env map[string]string, name string, a ...string) (string, string, error) {
+		args = a
+		for _, arg := range a {
+			if strings.HasPrefix(arg, "--summary-export=") {
+				os.WriteFile(strings.TrimPrefix(arg, "--summary-export="), []byte(summaryJSON), 0644)
+			}
+		}
+		return "", "", nil
+	}
+	engine := core.NewPipelineEngine(core.WithLogger(log.New(io.Discard, "", 0)),
+		core.WithExecutor(&core.ShellExecutor{Dir: workDir}), core.WithPlugins(plugin))
+
+	step := core.Step{ID: "load", Type: "load-test", Config: map[string]interface{}{
+		"tool": "k6", "script": "load/api.js", "vus": 20,
+		"thresholds": map[string]interface{}{"p95": "500ms", "errorRate": "1%", "minRps": 10},
+	}}
+	engine.CreatePipeline(&core.Pipeline{ID: "perf", Stages: []core.Stage{{ID: "test", Steps: []core.Step{step}}}})
+	job, _ := engine.Run(context.Background(), "perf")
+	if job.Status != core.StatusFailed {
+		t.Fatalf("Status = %s, want failed", job.Status)
+	}
+	if joined := strings.Join(args, " "); !strings.Contains(joined, "--vus 20") || args[len(args)-1] != filepath.Join(workDir, "load", "api.js") {
+		t.Errorf("k6 args = %v", args)
+	}
+	if len(job.LoadTests) != 1 {
+		t.Fatalf("LoadTests = %+v, want one", job.LoadTests)
+	}
+	result := job.LoadTests[0]
+	if result.StepID != "load" || result.Target != "load/api.js" || result.Requests != 1200 || result.P95Ms != 812.25 || result.ErrorRate != 0.025 {
+		t.Errorf("LoadTest = %+v", result)
+	}
+	if len(result.Violations) != 2 || result.Violations[0] != "p95 latency 812.25ms exceeds 500ms" || result.Violations[1] != "error rate 2.50% exceeds 1.00%" {
+		t.Errorf("Violations = %q", result.Violations)
+	}
+
+	trend := engine.LoadTestTrend("perf", "load")
+	if len(trend) != 1 || trend[0].JobID != job.ID || trend[0].RPS != 40.5 {
+		t.Errorf("LoadTestTrend() = %+v", trend)
+	}
+	if trend := engine.LoadTestTrend("perf", "other"); len(trend) != 0 {
+		t.Errorf("LoadTestTrend() for another step = %+v", trend)
+	}
+}
+
+func TestK6_FailsWithoutSummary(t *testing.T) {
+	plugin := NewLoadTestPlugin()
+	plugin.run = func(ctx context.Context, dir string, env map[string]string, name string, args ...string) (string, string, error) {
+		return "", "ReferenceError: http is not defined\n", errors.New("exit status 107")
+	}
+	step := core.Step{Type: "load-test", Config: map[string]interface{}{"tool": "k6", "script": "api.js"}}
+	if _, err := plugin.Execute(context.Background(), step); err == nil || !strings.Contains(err.Error(), "http is not defined") {
+		t.Errorf("Execute() error = %v, want k6's error", err)
+	}
+}
+
+func TestVegeta_ReportsMetrics(t *testing.T) {
+	var calls []string
+	var targets string
+	plugin := NewLoadTestPlugin()
+	plugin.run = func(ctx context.Context, dir string, env map[string]string, name string, args ...string) (string, string, error) {
+		calls = append(calls, name+" "+strings.Join(args, " "))
+		if args[0] == "attack" {
+			data, _ := os.ReadFile(strings.TrimPrefix(args[1], "-targets="))
+			targets = string(data)
+			return "", "", nil
+		}
+		return `{"latencies": {"50th": 2000000, "95th": 12500000, "99th": 30000000}, "requests": 3000, "rate": 100.02, "success": 1, "errors": []}`, "", nil
+	}
+	outputs, err := plugin.Execute(context.Background(), core.Step{Type: "load-test", Config: map[string]interface{}{
+		"tool": "vegeta", "target": "https://staging.example.com/health", "rate": "100/1s", "duration": "30s",
+		"thresholds": map[string]interface{}{"p99": 50, "errorRate": 0.001, "minRps": 100},
+	}})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if targets != "GET https://staging.example.com/health\n" || !strings.Contains(calls[0], "-rate=100/1s -duration=30s") || !strings.HasPrefix(calls[1], "vegeta report -type=json") {
+		t.Errorf("calls = %q with targets %q", calls, targets)
+	}
+	result := outputs["loadTests"].([]core.LoadTest)[0]
+	if result.Requests != 3000 || result.P95Ms != 12.5 || result.P99Ms != 30 || result.ErrorRate != 0 || len(result.Violations) != 0 {
+		t.Errorf("LoadTest = %+v", result)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		config map[string]interface{}
+		want   string
+	}{
+		{map[string]interface{}{}, "needs a tool"},
+		{map[string]interface{}{"tool": "jmeter"}, "unknown load testing tool"},
+		{map[string]interface{}{"tool": "k6"}, "need a script"},
+		{map[string]interface{}{"tool": "vegeta"}, "either a target or a targets file"},
+		{map[string]interface{}{"tool": "vegeta", "target": "http://x", "duration": "forever"}, "invalid duration"},
+		{map[string]interface{}{"tool": "k6", "script": "a.js", "thresholds": map[string]interface{}{"p90": "1s"}}, "unknown threshold"},
+		{map[string]interface{}{"tool": "k6", "script": "a.js", "thresholds": map[string]interface{}{"errorRate": 5}}, "at most 1"},
+		{map[string]interface{}{"tool": "k6", "script": "a.js", "thresholds": map[string]interface{}{"p95": "fast"}}, "invalid p95 threshold"},
+	}
+	for _, tt := range tests {
+		if _, err := parseConfig(core.Step{Config: tt.config}); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseConfig(%v) error = %v, want %q", tt.config, err, tt.want)
+		}
+	}
+}
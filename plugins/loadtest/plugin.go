@@ -0,0 +1,313 @@
+// Package loadtest provides the load-test step, which runs k6 or vegeta,
+// records the latency, error rate and throughput of the run on the job and
+// fails the step when they exceed the configured thresholds.
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/plugins/pluginutil"
+)
+
+// Load testing tools
+const (
+	ToolK6     = "k6"
+	ToolVegeta = "vegeta"
+)
+
+// Defaults of vegeta runs
+const (
+	defaultMethod   = "GET"
+	defaultRate     = "50/1s"
+	defaultDuration = "30s"
+)
+
+// LoadTestPlugin implements the Plugin interface for load tests
+type LoadTestPlugin struct {
+	run pluginutil.RunFunc
+}
+
+// NewLoadTestPlugin creates a load testing plugin
+func NewLoadTestPlugin() *LoadTestPlugin {
+	return &LoadTestPlugin{run: pluginutil.RunCommand}
+}
+
+// GetManifest returns the plugin manifest
+func (p *LoadTestPlugin) GetManifest() core.PluginManifest {
+	return core.PluginManifest{
+		Name:        "loadtest",
+		Version:     "1.0.0",
+		Description: "Load tests with k6 or vegeta, with their metrics recorded per job and checked against thresholds",
+		Author:      "Conveyor Team",
+		Type:        "test",
+		StepTypes:   []string{"load-test"},
+	}
+}
+
+// thresholds are the limits a load test must stay within. Zero values are
+// not checked.
+type thresholds struct {
+	p95       time.Duration
+	p99       time.Duration
+	errorRate float64
+	minRPS    float64
+}
+
+// config is the configuration of a load-test step
+type config struct {
+	tool string
+	// name is what the test targets as configured: the script, the target
+	// or the targets file
+	name string
+	// script is the k6 script
+	script string
+	vus    string
+	// target and method are the request vegeta sends, or targets a file
+	// of them
+	target   string
+	method   string
+	targets  string
+	rate     string
+	duration string
+	limits   thresholds
+	dir      string
+	env      map[string]string
+}
+
+// Execute runs a load test, records its metrics for the job and fails when
+// they exceed the step's thresholds
+func (p *LoadTestPlugin) Execute(ctx context.Context, step core.Step) (map[string]interface{}, error) {
+	if step.Type != "load-test" {
+		return nil, fmt.Errorf("unsupported step type: %s", step.Type)
+	}
+	cfg, err := parseConfig(step)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.MkdirTemp("", "conveyor-loadtest-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	var result *core.LoadTest
+	var toolErr error
+	if cfg.tool == ToolK6 {
+		result, toolErr = p.runK6(ctx, cfg, tmp)
+	} else {
+		result, toolErr = p.runVegeta(ctx, cfg, tmp)
+	}
+	if result == nil {
+		return nil, toolErr
+	}
+	result.Violations = cfg.limits.check(*result)
+	result.At = time.Now()
+	core.LogStep(ctx, "info", fmt.Sprintf("%d requests at %.1f req/s: p95 %s, error rate %s",
+		result.Requests, result.RPS, formatMs(result.P95Ms), formatRate(result.ErrorRate)))
+
+	outputs := map[string]interface{}{
+		"tool":      result.Tool,
+		"target":    result.Target,
+		"loadTests": []core.LoadTest{*result},
+	}
+	if len(result.Violations) > 0 {
+		outputs["violations"] = result.Violations
+		return outputs, fmt.Errorf("load test exceeded its thresholds: %s", strings.Join(result.Violations, "; "))
+	}
+	if toolErr != nil {
+		return outputs, toolErr
+	}
+	return outputs, nil
+}
+
+// check returns the thresholds a load test exceeded
+func (t thresholds) check(result core.LoadTest) []string {
+	var violations []string
+	if t.p95 > 0 && result.P95Ms > durationMs(t.p95) {
+		violations = append(violations, fmt.Sprintf("p95 latency %s exceeds %s", formatMs(result.P95Ms), t.p95))
+	}
+	if t.p99 > 0 && result.P99Ms > durationMs(t.p99) {
+		violations = append(violations, fmt.Sprintf("p99 latency %s exceeds %s", formatMs(result.P99Ms), t.p99))
+	}
+	if t.errorRate > 0 && result.ErrorRate > t.errorRate {
+		violations = append(violations, fmt.Sprintf("error rate %s exceeds %s", formatRate(result.ErrorRate), formatRate(t.errorRate)))
+	}
+	if t.minRPS > 0 && result.RPS < t.minRPS {
+		violations = append(violations, fmt.Sprintf("throughput %.1f req/s is below %g req/s", result.RPS, t.minRPS))
+	}
+	return violations
+}
+
+// parseConfig reads and checks the configuration of a load-test step
+func parseConfig(step core.Step) (*config, error) {
+	values := step.Config
+	cfg := &config{
+		tool:     pluginutil.String(values, "tool"),
+		script:   pluginutil.String(values, "script"),
+		vus:      pluginutil.String(values, "vus"),
+		target:   pluginutil.String(values, "target"),
+		method:   pluginutil.String(values, "method"),
+		targets:  pluginutil.String(values, "targets"),
+		rate:     pluginutil.String(values, "rate"),
+		duration: pluginutil.String(values, "duration"),
+		dir:      pluginutil.String(values, "workDir"),
+	}
+	cfg.env, _ = values["env"].(map[string]string)
+
+	switch cfg.tool {
+	case ToolK6:
+		if cfg.script == "" {
+			return nil, fmt.Errorf("k6 load tests need a script")
+		}
+		cfg.name, cfg.script = cfg.script, resolvePath(cfg.dir, cfg.script)
+	case ToolVegeta:
+		if (cfg.target == "") == (cfg.targets == "") {
+			return nil, fmt.Errorf("vegeta load tests need either a target or a targets file")
+		}
+		cfg.name = cfg.target
+		if cfg.targets != "" {
+			cfg.name, cfg.targets = cfg.targets, resolvePath(cfg.dir, cfg.targets)
+		}
+		if cfg.method == "" {
+			cfg.method = defaultMethod
+		}
+		if cfg.rate == "" {
+			cfg.rate = defaultRate
+		}
+		if cfg.duration == "" {
+			cfg.duration = defaultDuration
+		}
+	case "":
+		return nil, fmt.Errorf("load-test needs a tool: %s or %s", ToolK6, ToolVegeta)
+	default:
+		return nil, fmt.Errorf("unknown load testing tool %q, want %s or %s", cfg.tool, ToolK6, ToolVegeta)
+	}
+	if cfg.duration != "" {
+		if d, err := time.ParseDuration(cfg.duration); err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid duration %q", cfg.duration)
+		}
+	}
+
+	limits, err := parseThresholds(values["thresholds"])
+	if err != nil {
+		return nil, err
+	}
+	cfg.limits = limits
+	return cfg, nil
+}
+
+// parseThresholds reads the thresholds of a step: p95 and p99 latencies as
+// durations or milliseconds, errorRate as a fraction or a percentage, and
+// minRps
+func parseThresholds(value interface{}) (thresholds, error) {
+	var limits thresholds
+	if value == nil {
+		return limits, nil
+	}
+	values, ok := value.(map[string]interface{})
+	if !ok {
+		return limits, fmt.Errorf("thresholds must be a map")
+	}
+	for key, value := range values {
+		var err error
+		switch key {
+		case "p95":
+			limits.p95, err = parseLatency(value)
+		case "p99":
+			limits.p99, err = parseLatency(value)
+		case "errorRate":
+			limits.errorRate, err = parseRate(value)
+		case "minRps":
+			limits.minRPS, err = parseNumber(value)
+		default:
+			return limits, fmt.Errorf("unknown threshold %q, want p95, p99, errorRate or minRps", key)
+		}
+		if err != nil {
+			return limits, fmt.Errorf("invalid %s threshold %v: %w", key, value, err)
+		}
+	}
+	return limits, nil
+}
+
+// parseLatency reads a duration such as 500ms, or a number of milliseconds
+func parseLatency(value interface{}) (time.Duration, error) {
+	if s, ok := value.(string); ok {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			return d, nil
+		}
+	}
+	ms, err := parseNumber(value)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms * float64(time.Millisecond)), nil
+}
+
+// parseRate reads a fraction such as 0.01, or a percentage such as 1%
+func parseRate(value interface{}) (float64, error) {
+	if s, ok := value.(string); ok && strings.HasSuffix(s, "%") {
+		percent, err := parseNumber(strings.TrimSuffix(s, "%"))
+		return percent / 100, err
+	}
+	rate, err := parseNumber(value)
+	if err == nil && rate > 1 {
+		return 0, fmt.Errorf("a rate is at most 1, or a percentage such as 1%%")
+	}
+	return rate, err
+}
+
+// parseNumber reads a positive number
+func parseNumber(value interface{}) (float64, error) {
+	var number float64
+	switch v := value.(type) {
+	case int:
+		number = float64(v)
+	case int64:
+		number = float64(v)
+	case float64:
+		number = v
+	case string:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("not a number")
+		}
+		number = parsed
+	default:
+		return 0, fmt.Errorf("not a number")
+	}
+	if number <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return number, nil
+}
+
+// resolvePath resolves a path relative to the working directory
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// durationMs returns a duration in milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// formatMs formats milliseconds as a duration
+func formatMs(ms float64) string {
+	return time.Duration(ms * float64(time.Millisecond)).Round(time.Microsecond).String()
+}
+
+// formatRate formats a rate as a percentage
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(rate*100, 'f', 2, 64) + "%"
+}
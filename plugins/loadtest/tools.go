@@ -0,0 +1,131 @@
+package loadtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/plugins/pluginutil"
+)
+
+// k6Summary is the summary k6 exports with --summary-export. Trend metrics
+// such as http_req_duration have their statistics in milliseconds, and rate
+// metrics such as http_req_failed their rate as value.
+type k6Summary struct {
+	Metrics map[string]map[string]interface{} `json:"metrics"`
+}
+
+// vegetaReport is the JSON report of vegeta, with latencies in nanoseconds
+type vegetaReport struct {
+	Latencies map[string]float64 `json:"latencies"`
+	Requests  int64              `json:"requests"`
+	Rate      float64            `json:"rate"`
+	Success   float64            `json:"success"`
+	Errors    []string           `json:"errors"`
+}
+
+// runK6 runs a k6 script and reads the summary it exports. A failed run
+// that still exported a summary, such as one crossing the script's own
+// thresholds, returns its result and the error.
+func (p *LoadTestPlugin) runK6(ctx context.Context, cfg *config, tmp string) (*core.LoadTest, error) {
+	summaryFile := filepath.Join(tmp, "summary.json")
+	args := []string{"run", "--no-color", "--summary-export=" + summaryFile, "--summary-trend-stats=min,med,avg,max,p(95),p(99)"}
+	if cfg.vus != "" {
+		args = append(args, "--vus", cfg.vus)
+	}
+	if cfg.duration != "" {
+		args = append(args, "--duration", cfg.duration)
+	}
+	args = append(args, cfg.script)
+	core.LogStep(ctx, "info", fmt.Sprintf("Running k6 script %s", cfg.name))
+	stdout, stderr, err := p.run(ctx, cfg.dir, cfg.env, "k6", args...)
+	pluginutil.LogOutput(ctx, stdout, stderr)
+
+	data, readErr := os.ReadFile(summaryFile)
+	var summary k6Summary
+	if readErr != nil || json.Unmarshal(data, &summary) != nil || summary.Metrics["http_reqs"] == nil {
+		if err != nil {
+			return nil, toolError("k6 run", stderr, err)
+		}
+		return nil, fmt.Errorf("k6 run made no HTTP requests")
+	}
+	duration := summary.Metrics["http_req_duration"]
+	result := &core.LoadTest{
+		Tool:      ToolK6,
+		Target:    cfg.name,
+		Requests:  int64(metric(summary.Metrics["http_reqs"], "count")),
+		RPS:       metric(summary.Metrics["http_reqs"], "rate"),
+		P50Ms:     metric(duration, "med"),
+		P95Ms:     metric(duration, "p(95)"),
+		P99Ms:     metric(duration, "p(99)"),
+		ErrorRate: metric(summary.Metrics["http_req_failed"], "value"),
+	}
+	if err != nil {
+		return result, toolError("k6 run", stderr, err)
+	}
+	return result, nil
+}
+
+// runVegeta attacks the targets at the configured rate and reads vegeta's
+// report of the results
+func (p *LoadTestPlugin) runVegeta(ctx context.Context, cfg *config, tmp string) (*core.LoadTest, error) {
+	targets := cfg.targets
+	if targets == "" {
+		targets = filepath.Join(tmp, "targets.txt")
+		if err := os.WriteFile(targets, []byte(cfg.method+" "+cfg.target+"\n"), 0600); err != nil {
+			return nil, err
+		}
+	}
+	results := filepath.Join(tmp, "results.bin")
+	core.LogStep(ctx, "info", fmt.Sprintf("Attacking %s at %s for %s with vegeta", cfg.name, cfg.rate, cfg.duration))
+	stdout, stderr, err := p.run(ctx, cfg.dir, cfg.env, "vegeta", "attack",
+		"-targets="+targets, "-rate="+cfg.rate, "-duration="+cfg.duration, "-output="+results)
+	if err != nil {
+		pluginutil.LogOutput(ctx, stdout, stderr)
+		return nil, toolError("vegeta attack", stderr, err)
+	}
+
+	stdout, stderr, err = p.run(ctx, cfg.dir, cfg.env, "vegeta", "report", "-type=json", results)
+	var report vegetaReport
+	if err != nil || json.Unmarshal([]byte(stdout), &report) != nil {
+		return nil, toolError("vegeta report", stderr, err)
+	}
+	if report.Requests == 0 {
+		return nil, fmt.Errorf("vegeta attack made no requests")
+	}
+	for _, message := range report.Errors {
+		core.LogStep(ctx, "warn", message)
+	}
+	return &core.LoadTest{
+		Tool:      ToolVegeta,
+		Target:    cfg.name,
+		Requests:  report.Requests,
+		RPS:       report.Rate,
+		P50Ms:     report.Latencies["50th"] / 1e6,
+		P95Ms:     report.Latencies["95th"] / 1e6,
+		P99Ms:     report.Latencies["99th"] / 1e6,
+		ErrorRate: 1 - report.Success,
+	}, nil
+}
+
+// metric returns a statistic of a k6 metric, or 0 when it is missing
+func metric(values map[string]interface{}, name string) float64 {
+	value, _ := values[name].(float64)
+	return value
+}
+
+// toolError describes a failed tool run by its error output, or err
+func toolError(command, stderr string, err error) error {
+	if err == nil {
+		return fmt.Errorf("%s printed unexpected output", command)
+	}
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	if msg := strings.TrimSpace(lines[len(lines)-1]); msg != "" {
+		return fmt.Errorf("%s failed: %s", command, msg)
+	}
+	return fmt.Errorf("%s failed: %w", command, err)
+}
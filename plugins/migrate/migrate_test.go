@@ -0,0 +1,197 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/chip/conveyor/core"
+)
+
+// fakeMigrate simulates the migrate CLI against a database at version
+type fakeMigrate struct {
+	version int
+	calls   []string
+	// downFiles are the files of the source a rollback ran with
+	downFiles []string
+}
+
+func (f *fakeMigrate) run(ctx context.Context, dir string, env map[string]string, name string, args ...string) (string, string, error) {
+	path, command := args[1], args[4:]
+	f.calls = append(f.calls, strings.Join(command, " "))
+	switch command[0] {
+	case "version":
+		if f.version == 0 {
+			return "", "error: no migration\n", errors.New("exit status 1")
+		}
+		return "", fmt.Sprintf("%d\n", f.version), nil
+	case "up":
+		f.version = 3
+	case "goto":
+		fmt.Sscan(command[1], &f.version)
+		if f.version < 3 {
+			entries, _ := os.ReadDir(path)
+			for _, entry := range entries {
+				f.downFiles = append(f.downFiles, entry.Name())
+			}
+			sort.Strings(f.downFiles)
+		}
+	case "down":
+		f.version = 0
+	}
+	return "", "", nil
+}
+
+func writeMigrations(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	os.MkdirAll(filepath.Join(dir, "migrations"), 0755)
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, "migrations", name), []byte("-- "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrate_AppliesAndRollsBack(t *testing.T) {
+	workDir := t.TempDir()
+	writeMigrations(t, workDir, "1_init.up.sql", "1_init.down.sql", "2_users.up.sql", "2_users.down.sql", "3_orders.up.sql", "3_orders.down.sql")
+	store, err := core.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeMigrate{version: 1}
+	plugin := NewMigratePlugin()
+	plugin.run = fake.run
+	engine := core.NewPipelineEngine(core.WithLogger(log.New(io.Discard, "", 0)), core.WithStore(store),
+		core.WithExecutor(&core.ShellExecutor{Dir: workDir}), core.WithPlugins(plugin))
+
+	database := "postgres://admin:hunter2@db:5432/app?sslmode=disable"
+	migrateStep := core.Step{ID: "migrate", Type: "db-migrate", Config: map[string]interface{}{"tool": "golang-migrate", "database": database}}
+	engine.CreatePipeline(&core.Pipeline{ID: "deploy", Stages: []core.Stage{{ID: "db", Steps: []core.Step{migrateStep}}}})
+	job, err := engine.Run(context.Background(), "deploy")
+	if err != nil || job.Status != core.StatusSuccess {
+		t.Fatalf("Run() = %v, %v, want success", job, err)
+	}
+	if len(job.Migrations) != 2 || job.Migrations[0].Version != "2" || job.Migrations[1].Description != "orders" || job.Migrations[0].Database != "postgres://db:5432/app" {
+		t.Errorf("Migrations = %+v, want versions 2 and 3 without credentials", job.Migrations)
+	}
+	if strings.Contains(job.Steps[0].Output, "hunter2") || !strings.Contains(job.Steps[0].Output, `"rollbackArtifact":"rollback-migrate"`) {
+		t.Errorf("Output = %s, want the rollback artifact and no password", job.Steps[0].Output)
+	}
+
+	rollbackStep := core.Step{ID: "rollback", Type: "db-migrate", Config: map[string]interface{}{
+		"tool": "golang-migrate", "database": database, "direction": "down", "rollbackJob": job.ID, "artifact": "rollback-migrate",
+	}}
+	engine.CreatePipeline(&core.Pipeline{ID: "rollback", Stages: []core.Stage{{ID: "db", Steps: []core.Step{rollbackStep}}}})
+	rollback, err := engine.Run(context.Background(), "rollback")
+	if err != nil || rollback.Status != core.StatusSuccess {
+		t.Fatalf("rollback Run() = %+v, %v, want success", rollback, err)
+	}
+	if fake.version != 1 || strings.Join(fake.downFiles, " ") != "1_rollback_base.down.sql 2_users.down.sql 3_orders.down.sql" {
+		t.Errorf("rolled back to %d with %v, want version 1 with the stored down scripts", fake.version, fake.downFiles)
+	}
+	if len(rollback.Migrations) != 2 || rollback.Migrations[0].Version != "3" || rollback.Migrations[0].Direction != core.MigrationDown {
+		t.Errorf("Migrations = %+v, want 3 then 2 rolled back", rollback.Migrations)
+	}
+
+	again, _ := engine.Run(context.Background(), "rollback")
+	if again.Status != core.StatusFailed || !strings.Contains(again.Logs[len(again.Logs)-1].Message, "is at version 1, not version 3") {
+		t.Errorf("second rollback = %s %+v, want it refused", again.Status, again.Logs)
+	}
+}
+
+func TestMigrate_DirtyDatabase(t *testing.T) {
+	p := NewMigratePlugin()
+	p.run = func(ctx context.Context, dir string, env map[string]string, name string, args ...string) (string, string, error) {
+		return "", "4 (dirty)\n", nil
+	}
+	_, err := p.Execute(context.Background(), core.Step{ID: "migrate", Type: "db-migrate", Config: map[string]interface{}{
+		"tool": "golang-migrate", "databaseEnv": "DATABASE_URL", "env": map[string]string{"DATABASE_URL": "mysql://root@tcp(db)/app"},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "dirty at version 4") {
+		t.Errorf("Execute() error = %v, want the dirty database reported", err)
+	}
+}
+
+func TestFlyway_RecordsAppliedBeforeFailure(t *testing.T) {
+	workDir := t.TempDir()
+	writeMigrations(t, workDir, "V1__init.sql", "V1_1__add_users.sql", "U1_1__add_users.sql", "V2__orders.sql")
+	version := "1"
+	var migrateArgs []string
+	p := NewMigratePlugin()
+	p.run = func(ctx context.Context, dir string, env map[string]string, name string, args ...string) (string, string, error) {
+		switch args[len(args)-1] {
+		case "info":
+			return fmt.Sprintf(`{"schemaVersion": %q}`, version), "", nil
+		case "migrate":
+			migrateArgs = args
+			version = "1.1"
+			return `{"error": {"message": "Migration V2__orders.sql failed"}}`, "", errors.New("exit status 1")
+		}
+		return "", "", fmt.Errorf("unexpected command %v", args)
+	}
+
+	outputs, err := p.Execute(context.Background(), core.Step{ID: "migrate", Type: "db-migrate", Config: map[string]interface{}{
+		"tool": "flyway", "database": "jdbc:postgresql://db:5432/app?user=admin&password=secret", "workDir": workDir,
+	}})
+	if err == nil || !strings.Contains(err.Error(), "Migration V2__orders.sql failed") {
+		t.Fatalf("Execute() error = %v, want Flyway's error", err)
+	}
+	if want := "filesystem:" + filepath.Join(workDir, "migrations"); migrateArgs[1] != "-locations="+want {
+		t.Errorf("migrate args = %v, want locations %s", migrateArgs, want)
+	}
+	migrations := outputs["migrations"].([]core.Migration)
+	if len(migrations) != 1 || migrations[0].Version != "1.1" || migrations[0].Description != "add users" || migrations[0].Database != "jdbc:postgresql://db:5432/app" {
+		t.Errorf("migrations = %+v, want 1.1 recorded", migrations)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "1", -1}, {"2", "10", -1}, {"1.10", "1.9", 1}, {"1.0", "1", 0}, {"3", "", 1},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		config map[string]interface{}
+		want   string
+	}{
+		{map[string]interface{}{"database": "postgres://db/app"}, "needs a tool"},
+		{map[string]interface{}{"tool": "liquibase", "database": "postgres://db/app"}, "unknown migration tool"},
+		{map[string]interface{}{"tool": "flyway"}, "needs a database"},
+		{map[string]interface{}{"tool": "flyway", "databaseEnv": "DB"}, "DB is not set"},
+		{map[string]interface{}{"tool": "flyway", "database": "x", "direction": "sideways"}, "invalid direction"},
+		{map[string]interface{}{"tool": "flyway", "database": "x", "direction": "down"}, "needs the rollbackJob"},
+		{map[string]interface{}{"tool": "flyway", "database": "x", "lockTimeout": "never"}, "invalid lockTimeout"},
+		{map[string]interface{}{"tool": "flyway", "database": "x", "artifact": "../x"}, "invalid artifact name"},
+	}
+	for _, tt := range tests {
+		if _, err := parseConfig(core.Step{ID: "migrate", Config: tt.config}); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseConfig(%v) error = %v, want %q", tt.config, err, tt.want)
+		}
+	}
+
+	cfg, err := parseConfig(core.Step{ID: "migrate", Config: map[string]interface{}{"tool": "flyway", "database": "not a url"}})
+	if err != nil {
+		t.Fatalf("parseConfig() error = %v", err)
+	}
+	if !strings.HasPrefix(cfg.lock, "db-migrate:database-") || cfg.artifact != "rollback-migrate" {
+		t.Errorf("lock = %s, artifact = %s, want the defaults", cfg.lock, cfg.artifact)
+	}
+}
@@ -0,0 +1,375 @@
+// Package migrate provides the db-migrate step, which applies database
+// migrations with golang-migrate or Flyway, records the versions it applied
+// on the job and keeps their down scripts as an artifact for rollbacks.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/plugins/pluginutil"
+)
+
+// Migration tools
+const (
+	ToolGolangMigrate = "golang-migrate"
+	ToolFlyway        = "flyway"
+)
+
+// Defaults of db-migrate steps
+const (
+	defaultPath = "migrations"
+	// manifestFile describes a rollback artifact
+	manifestFile = "rollback.json"
+)
+
+// MigratePlugin implements the Plugin interface for database migrations
+type MigratePlugin struct {
+	run pluginutil.RunFunc
+}
+
+// NewMigratePlugin creates a database migration plugin
+func NewMigratePlugin() *MigratePlugin {
+	return &MigratePlugin{run: pluginutil.RunCommand}
+}
+
+// GetManifest returns the plugin manifest
+func (p *MigratePlugin) GetManifest() core.PluginManifest {
+	return core.PluginManifest{
+		Name:        "migrate",
+		Version:     "1.0.0",
+		Description: "Database migrations with golang-migrate or Flyway, locked per database, with down scripts kept for rollbacks",
+		Author:      "Conveyor Team",
+		Type:        "deploy",
+		StepTypes:   []string{"db-migrate"},
+	}
+}
+
+// config is the configuration of a db-migrate step
+type config struct {
+	tool string
+	// database is the database URL, and name the same without credentials
+	database    string
+	name        string
+	path        string
+	direction   string
+	target      string
+	lock        string
+	lockTimeout time.Duration
+	artifact    string
+	rollbackJob string
+	dir         string
+	env         map[string]string
+}
+
+// rollbackManifest describes the down scripts of a rollback artifact
+type rollbackManifest struct {
+	Tool     string `json:"tool"`
+	Database string `json:"database"`
+	// From is the version before the job migrated, empty for a database
+	// without migrations, and To the version it migrated to
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to"`
+	Versions  []string  `json:"versions"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// migrator is a db-migrate step in progress
+type migrator struct {
+	*config
+	plugin *MigratePlugin
+}
+
+// Execute migrates the database up, or rolls back what an earlier job
+// migrated with direction down, holding the database's lock so jobs never
+// migrate the same database at once
+func (p *MigratePlugin) Execute(ctx context.Context, step core.Step) (map[string]interface{}, error) {
+	if step.Type != "db-migrate" {
+		return nil, fmt.Errorf("unsupported step type: %s", step.Type)
+	}
+	cfg, err := parseConfig(step)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := core.LockStep(ctx, cfg.lock, cfg.lockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	m := &migrator{config: cfg, plugin: p}
+	if cfg.direction == core.MigrationDown {
+		return m.rollback(ctx)
+	}
+	return m.migrate(ctx)
+}
+
+// migrate applies the pending migrations and stores the down scripts of
+// those it applied. Migrations applied before a failure are recorded too.
+func (m *migrator) migrate(ctx context.Context) (map[string]interface{}, error) {
+	before, err := m.version(ctx)
+	if err != nil {
+		return nil, err
+	}
+	core.LogStep(ctx, "info", fmt.Sprintf("Migrating %s up from %s with %s", m.name, describeVersion(before), m.tool))
+	migrateErr := m.up(ctx)
+	after, err := m.version(ctx)
+	if err != nil {
+		if migrateErr != nil {
+			return nil, migrateErr
+		}
+		return nil, err
+	}
+
+	files, err := sourceFiles(m.tool, m.path)
+	if err != nil {
+		return nil, err
+	}
+	applied := between(files, before, after)
+	outputs := m.outputs(core.MigrationUp, before, after, applied)
+	if len(applied) > 0 {
+		artifact, err := m.saveRollback(ctx, files, before, after, applied)
+		if err != nil {
+			core.LogStep(ctx, "warn", fmt.Sprintf("Failed to store the down scripts: %v", err))
+		} else {
+			outputs["rollbackArtifact"] = artifact
+		}
+	}
+	if migrateErr != nil {
+		return outputs, migrateErr
+	}
+	core.LogStep(ctx, "info", fmt.Sprintf("Applied %d migrations, %s is at %s", len(applied), m.name, describeVersion(after)))
+	return outputs, nil
+}
+
+// rollback runs the down scripts an earlier job stored, returning the
+// database to the version it had before that job
+func (m *migrator) rollback(ctx context.Context) (map[string]interface{}, error) {
+	dir, err := os.MkdirTemp("", "conveyor-rollback-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := core.ExtractJobArtifact(ctx, m.rollbackJob, m.artifact, dir); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("artifact %s has no rollback manifest: %w", m.artifact, err)
+	}
+	var manifest rollbackManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid rollback manifest: %w", err)
+	}
+	os.Remove(filepath.Join(dir, manifestFile))
+	if manifest.Tool != m.tool || manifest.Database != m.name {
+		return nil, fmt.Errorf("artifact %s rolls back %s with %s, not %s with %s", m.artifact, manifest.Database, manifest.Tool, m.name, m.tool)
+	}
+
+	before, err := m.version(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if before != manifest.To {
+		return nil, fmt.Errorf("%s is at %s, not %s where job %s left it; roll back later migrations first", m.name, describeVersion(before), describeVersion(manifest.To), m.rollbackJob)
+	}
+	core.LogStep(ctx, "info", fmt.Sprintf("Rolling %s back from %s to %s with the down scripts of job %s", m.name, describeVersion(before), describeVersion(manifest.From), m.rollbackJob))
+	rollbackErr := m.down(ctx, dir, manifest)
+	after, err := m.version(ctx)
+	if err != nil {
+		if rollbackErr != nil {
+			return nil, rollbackErr
+		}
+		return nil, err
+	}
+
+	var reverted []sourceFile
+	for i := len(manifest.Versions) - 1; i >= 0; i-- {
+		if version := manifest.Versions[i]; compareVersions(version, after) > 0 {
+			reverted = append(reverted, sourceFile{version: version})
+		}
+	}
+	outputs := m.outputs(core.MigrationDown, before, after, reverted)
+	if rollbackErr != nil {
+		return outputs, rollbackErr
+	}
+	core.LogStep(ctx, "info", fmt.Sprintf("Rolled back %d migrations, %s is at %s", len(reverted), m.name, describeVersion(after)))
+	return outputs, nil
+}
+
+// saveRollback stores the down scripts of the applied migrations and a
+// manifest of what they roll back as the step's rollback artifact
+func (m *migrator) saveRollback(ctx context.Context, files map[string]sourceFile, before, after string, applied []sourceFile) (string, error) {
+	dir, err := os.MkdirTemp("", "conveyor-rollback-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	manifest := rollbackManifest{Tool: m.tool, Database: m.name, From: before, To: after, CreatedAt: time.Now()}
+	for _, migration := range applied {
+		if migration.down == "" {
+			return "", fmt.Errorf("migration %s has no down script", migration.version)
+		}
+		data, err := os.ReadFile(migration.down)
+		if err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(filepath.Join(dir, filepath.Base(migration.down)), data, 0644); err != nil {
+			return "", err
+		}
+		manifest.Versions = append(manifest.Versions, migration.version)
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestFile), data, 0644); err != nil {
+		return "", err
+	}
+	if _, err := core.SaveStepArtifact(ctx, m.artifact, dir, []string{"*"}); err != nil {
+		return "", err
+	}
+	return m.artifact, nil
+}
+
+// outputs returns the step's outputs, with the migrations it applied or
+// rolled back to be recorded on the job
+func (m *migrator) outputs(direction, from, to string, migrations []sourceFile) map[string]interface{} {
+	now := time.Now()
+	records := make([]core.Migration, 0, len(migrations))
+	versions := make([]string, 0, len(migrations))
+	for _, migration := range migrations {
+		records = append(records, core.Migration{
+			Tool:        m.tool,
+			Database:    m.name,
+			Version:     migration.version,
+			Description: migration.description,
+			Direction:   direction,
+			At:          now,
+		})
+		versions = append(versions, migration.version)
+	}
+	return map[string]interface{}{
+		"tool":       m.tool,
+		"database":   m.name,
+		"direction":  direction,
+		"from":       from,
+		"to":         to,
+		"versions":   versions,
+		"migrations": records,
+	}
+}
+
+// describeVersion names a version in log messages
+func describeVersion(version string) string {
+	if version == "" {
+		return "no version"
+	}
+	return "version " + version
+}
+
+// parseConfig reads and checks the configuration of a db-migrate step
+func parseConfig(step core.Step) (*config, error) {
+	values := step.Config
+	cfg := &config{
+		tool:        pluginutil.String(values, "tool"),
+		database:    pluginutil.String(values, "database"),
+		path:        pluginutil.String(values, "path"),
+		direction:   pluginutil.String(values, "direction"),
+		target:      pluginutil.String(values, "target"),
+		lock:        pluginutil.String(values, "lock"),
+		artifact:    pluginutil.String(values, "artifact"),
+		rollbackJob: pluginutil.String(values, "rollbackJob"),
+		dir:         pluginutil.String(values, "workDir"),
+	}
+	cfg.env, _ = values["env"].(map[string]string)
+
+	switch cfg.tool {
+	case ToolGolangMigrate, ToolFlyway:
+	case "":
+		return nil, fmt.Errorf("db-migrate needs a tool: %s or %s", ToolGolangMigrate, ToolFlyway)
+	default:
+		return nil, fmt.Errorf("unknown migration tool %q, want %s or %s", cfg.tool, ToolGolangMigrate, ToolFlyway)
+	}
+	if name := pluginutil.String(values, "databaseEnv"); name != "" {
+		if cfg.database != "" {
+			return nil, fmt.Errorf("db-migrate needs either a database or a databaseEnv, not both")
+		}
+		cfg.database = cfg.env[name]
+		if cfg.database == "" {
+			return nil, fmt.Errorf("databaseEnv %s is not set", name)
+		}
+	}
+	if cfg.database == "" {
+		return nil, fmt.Errorf("db-migrate needs a database or a databaseEnv")
+	}
+	cfg.name = redact(cfg.database)
+
+	switch cfg.direction {
+	case "":
+		cfg.direction = core.MigrationUp
+	case core.MigrationUp:
+	case core.MigrationDown:
+		if cfg.rollbackJob == "" {
+			return nil, fmt.Errorf("direction down needs the rollbackJob whose migrations to roll back")
+		}
+		if cfg.target != "" {
+			return nil, fmt.Errorf("direction down rolls back to the version before rollbackJob and takes no target")
+		}
+	default:
+		return nil, fmt.Errorf("invalid direction %q, want up or down", cfg.direction)
+	}
+
+	if cfg.path == "" {
+		cfg.path = defaultPath
+	}
+	if !filepath.IsAbs(cfg.path) {
+		cfg.path = filepath.Join(cfg.dir, cfg.path)
+	}
+	if cfg.lock == "" {
+		cfg.lock = "db-migrate:" + cfg.name
+	}
+	if cfg.artifact == "" {
+		cfg.artifact = "rollback-" + step.ID
+	}
+	if !core.ValidArtifactName(cfg.artifact) {
+		return nil, fmt.Errorf("invalid artifact name %q", cfg.artifact)
+	}
+	if value := pluginutil.String(values, "lockTimeout"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid lockTimeout %q", value)
+		}
+		cfg.lockTimeout = timeout
+	}
+	return cfg, nil
+}
+
+// redact returns a database URL without its credentials and parameters.
+// Values that aren't URLs are replaced by a hash.
+func redact(database string) string {
+	prefix := ""
+	if strings.HasPrefix(database, "jdbc:") {
+		prefix, database = "jdbc:", strings.TrimPrefix(database, "jdbc:")
+	}
+	u, err := url.Parse(database)
+	if err != nil || u.Scheme == "" || u.Host == "" && u.Path == "" {
+		sum := sha256.Sum256([]byte(prefix + database))
+		return "database-" + hex.EncodeToString(sum[:6])
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return prefix + u.String()
+}
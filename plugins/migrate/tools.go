@@ -0,0 +1,262 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chip/conveyor/plugins/pluginutil"
+)
+
+// Migration file names: golang-migrate's 3_add_users.up.sql and
+// 3_add_users.down.sql, and Flyway's V1.2__add_users.sql and its undo
+// script U1.2__add_users.sql
+var (
+	golangMigrateFile = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.[^.]+$`)
+	flywayFile        = regexp.MustCompile(`^([VU])(\d+(?:[._]\d+)*)__(.+)\.sql$`)
+	// golangMigrateVersion is the output of migrate version
+	golangMigrateVersion = regexp.MustCompile(`(?m)^(\d+)( \(dirty\))?\s*$`)
+)
+
+// sourceFile is a migration and its down script
+type sourceFile struct {
+	version     string
+	description string
+	down        string
+}
+
+// version returns the database's current migration version, or "" when
+// no migration was applied. A golang-migrate database left dirty by a
+// failed migration must be fixed first.
+func (m *migrator) version(ctx context.Context) (string, error) {
+	if m.tool == ToolFlyway {
+		stdout, stderr, err := m.plugin.run(ctx, m.dir, m.env, "flyway", m.flywayArgs(m.path, "info")...)
+		var info struct {
+			SchemaVersion string `json:"schemaVersion"`
+		}
+		if decodeErr := json.Unmarshal([]byte(stdout), &info); decodeErr != nil || err != nil {
+			return "", toolError("flyway info", stdout, stderr, err)
+		}
+		if _, err := strconv.ParseUint(strings.SplitN(info.SchemaVersion, ".", 2)[0], 10, 64); err != nil {
+			// An empty schema has no version
+			return "", nil
+		}
+		return info.SchemaVersion, nil
+	}
+
+	stdout, stderr, err := m.plugin.run(ctx, m.dir, m.env, "migrate", m.migrateArgs(m.path, "version")...)
+	output := stdout + stderr
+	if err != nil && strings.Contains(output, "no migration") {
+		return "", nil
+	}
+	match := golangMigrateVersion.FindStringSubmatch(output)
+	if err != nil || match == nil {
+		return "", toolError("migrate version", stdout, stderr, err)
+	}
+	if match[2] != "" {
+		return "", fmt.Errorf("%s is dirty at version %s after a failed migration; fix it and run migrate force before migrating again", m.name, match[1])
+	}
+	return match[1], nil
+}
+
+// up applies the pending migrations, up to the target version when set
+func (m *migrator) up(ctx context.Context) error {
+	var name string
+	var args []string
+	if m.tool == ToolFlyway {
+		name, args = "flyway", []string{"migrate"}
+		if m.target != "" {
+			args = append(args, "-target="+m.target)
+		}
+		args = m.flywayArgs(m.path, args...)
+	} else {
+		name, args = "migrate", []string{"up"}
+		if m.target != "" {
+			args = []string{"goto", m.target}
+		}
+		args = m.migrateArgs(m.path, args...)
+	}
+	stdout, stderr, err := m.plugin.run(ctx, m.dir, m.env, name, args...)
+	pluginutil.LogOutput(ctx, stdout, stderr)
+	if err != nil {
+		return toolError(name+" "+args[len(args)-1], stdout, stderr, err)
+	}
+	return nil
+}
+
+// down runs the down scripts in dir to return the database to the
+// manifest's From version. golang-migrate goes to it in one run, with a
+// placeholder for the From version so it is a known version; Flyway undoes
+// one migration per run.
+func (m *migrator) down(ctx context.Context, dir string, manifest rollbackManifest) error {
+	if m.tool == ToolFlyway {
+		for range manifest.Versions {
+			args := m.flywayArgs(dir, "undo", "-ignoreMigrationPatterns=*:missing")
+			stdout, stderr, err := m.plugin.run(ctx, m.dir, m.env, "flyway", args...)
+			pluginutil.LogOutput(ctx, stdout, stderr)
+			if err != nil {
+				return toolError("flyway undo", stdout, stderr, err)
+			}
+		}
+		return nil
+	}
+
+	args := []string{"down", "-all"}
+	if manifest.From != "" {
+		placeholder := filepath.Join(dir, manifest.From+"_rollback_base.down.sql")
+		if err := os.WriteFile(placeholder, nil, 0644); err != nil {
+			return err
+		}
+		args = []string{"goto", manifest.From}
+	}
+	stdout, stderr, err := m.plugin.run(ctx, m.dir, m.env, "migrate", m.migrateArgs(dir, args...)...)
+	pluginutil.LogOutput(ctx, stdout, stderr)
+	if err != nil {
+		return toolError("migrate "+args[0], stdout, stderr, err)
+	}
+	return nil
+}
+
+// migrateArgs returns the arguments of a golang-migrate command
+func (m *migrator) migrateArgs(path string, args ...string) []string {
+	return append([]string{"-path", path, "-database", m.database}, args...)
+}
+
+// flywayArgs returns the arguments of a Flyway command with JSON output
+func (m *migrator) flywayArgs(path string, args ...string) []string {
+	return append([]string{"-url=" + m.database, "-locations=filesystem:" + path, "-outputType=json"}, args...)
+}
+
+// sourceFiles returns the migrations in path by version. golang-migrate
+// only reads path itself, while Flyway also reads its subdirectories.
+func sourceFiles(tool, path string) (map[string]sourceFile, error) {
+	files := make(map[string]sourceFile)
+	add := func(file string) {
+		name := filepath.Base(file)
+		if tool == ToolGolangMigrate {
+			match := golangMigrateFile.FindStringSubmatch(name)
+			if match == nil {
+				return
+			}
+			version := strings.TrimLeft(match[1], "0")
+			if version == "" {
+				version = "0"
+			}
+			migration := files[version]
+			migration.version, migration.description = version, match[2]
+			if match[3] == "down" {
+				migration.down = file
+			}
+			files[version] = migration
+			return
+		}
+		match := flywayFile.FindStringSubmatch(name)
+		if match == nil {
+			return
+		}
+		version := strings.ReplaceAll(match[2], "_", ".")
+		migration := files[version]
+		migration.version, migration.description = version, strings.ReplaceAll(match[3], "_", " ")
+		if match[1] == "U" {
+			migration.down = file
+		}
+		files[version] = migration
+	}
+
+	if tool == ToolGolangMigrate {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migrations: %w", err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				add(filepath.Join(path, entry.Name()))
+			}
+		}
+		return files, nil
+	}
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			add(file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+	return files, nil
+}
+
+// between returns the migrations after from up to and including to, in
+// version order
+func between(files map[string]sourceFile, from, to string) []sourceFile {
+	var migrations []sourceFile
+	for version, migration := range files {
+		if compareVersions(version, from) > 0 && compareVersions(version, to) <= 0 {
+			migrations = append(migrations, migration)
+		}
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return compareVersions(migrations[i].version, migrations[j].version) < 0
+	})
+	return migrations
+}
+
+// compareVersions compares dotted numeric versions, where "" comes before
+// any version
+func compareVersions(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return -1
+	case b == "":
+		return 1
+	}
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y uint64
+		if i < len(as) {
+			x, _ = strconv.ParseUint(as[i], 10, 64)
+		}
+		if i < len(bs) {
+			y, _ = strconv.ParseUint(bs[i], 10, 64)
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// toolError describes a failed tool run by Flyway's JSON error, the tool's
+// error output, or err
+func toolError(command, stdout, stderr string, err error) error {
+	var flyway struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(stdout), &flyway) == nil && flyway.Error.Message != "" {
+		return fmt.Errorf("%s failed: %s", command, flyway.Error.Message)
+	}
+	if msg := strings.TrimSpace(stderr); msg != "" {
+		return fmt.Errorf("%s failed: %s", command, msg)
+	}
+	if err == nil {
+		return fmt.Errorf("%s printed unexpected output: %s", command, strings.TrimSpace(stdout))
+	}
+	return fmt.Errorf("%s failed: %w", command, err)
+}
@@ -0,0 +1,121 @@
+// Package pluginutil holds what the built-in step plugins share: reading
+// step config values and running the tools they wrap.
+package pluginutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/chip/conveyor/core"
+)
+
+// RunFunc runs a command like RunCommand. Plugins hold one so tests can
+// fake the tools they run.
+type RunFunc func(ctx context.Context, dir string, env map[string]string, name string, args ...string) (string, string, error)
+
+// CombinedFunc runs a command like RunCombined
+type CombinedFunc func(ctx context.Context, dir string, env map[string]string, name string, args ...string) (string, error)
+
+// RunCommand runs a command in dir with env added to the server's
+// environment, and returns its stdout and stderr
+func RunCommand(ctx context.Context, dir string, env map[string]string, name string, args ...string) (string, string, error) {
+	cmd := command(ctx, dir, env, name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+// RunCombined runs a command like RunCommand, and returns its stdout and
+// stderr combined. When it fails, the error includes the output.
+func RunCombined(ctx context.Context, dir string, env map[string]string, name string, args ...string) (string, error) {
+	cmd := command(ctx, dir, env, name, args...)
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			return output.String(), fmt.Errorf("%w: %s", err, msg)
+		}
+		return output.String(), err
+	}
+	return output.String(), nil
+}
+
+func command(ctx context.Context, dir string, env map[string]string, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	return cmd
+}
+
+// LogOutput adds a tool's output to the step's log, which masks the step's
+// secrets
+func LogOutput(ctx context.Context, stdout, stderr string) {
+	for _, output := range []string{stdout, stderr} {
+		if output = strings.TrimSpace(output); output != "" {
+			core.LogStep(ctx, "info", output)
+		}
+	}
+}
+
+// String returns a string config value, or "" when it is unset. Numbers
+// are formatted as strings.
+func String(config map[string]interface{}, key string) string {
+	switch value := config[key].(type) {
+	case string:
+		return value
+	case int, int64, float64:
+		return fmt.Sprint(value)
+	}
+	return ""
+}
+
+// StringOr returns a string config value, or def when it is unset or empty
+func StringOr(config map[string]interface{}, key, def string) string {
+	if value := String(config, key); value != "" {
+		return value
+	}
+	return def
+}
+
+// Bool returns a boolean config value, or def when it is unset
+func Bool(config map[string]interface{}, key string, def bool) bool {
+	if value, ok := config[key].(bool); ok {
+		return value
+	}
+	return def
+}
+
+// StringList returns a config value that is a string or a list of
+// strings, or nil when it is unset or neither
+func StringList(config map[string]interface{}, key string) []string {
+	list, _ := ParseStringList(config, key)
+	return list
+}
+
+// ParseStringList returns a config value that is a string or a list of
+// strings, and an error when it is set to anything else
+func ParseStringList(config map[string]interface{}, key string) ([]string, error) {
+	switch value := config[key].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []string:
+		return value, nil
+	case []interface{}:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			list = append(list, fmt.Sprint(item))
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("%s must be a list", key)
+}
@@ -0,0 +1,56 @@
+package pluginutil
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigValues(t *testing.T) {
+	config := map[string]interface{}{
+		"tool":    "k6",
+		"vus":     10,
+		"empty":   "",
+		"dryRun":  true,
+		"one":     "a",
+		"list":    []interface{}{"a", 2},
+		"invalid": 3,
+	}
+	if got := String(config, "tool"); got != "k6" {
+		t.Errorf("String(tool) = %q", got)
+	}
+	if got := String(config, "vus"); got != "10" {
+		t.Errorf("String(vus) = %q, want the number formatted", got)
+	}
+	if got := StringOr(config, "empty", "default"); got != "default" {
+		t.Errorf("StringOr(empty) = %q, want the default", got)
+	}
+	if !Bool(config, "dryRun", false) || !Bool(config, "missing", true) {
+		t.Error("Bool() ignored the value or the default")
+	}
+	if got := StringList(config, "one"); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("StringList(one) = %v", got)
+	}
+	if got := StringList(config, "list"); !reflect.DeepEqual(got, []string{"a", "2"}) {
+		t.Errorf("StringList(list) = %v", got)
+	}
+	if list, err := ParseStringList(config, "missing"); list != nil || err != nil {
+		t.Errorf("ParseStringList(missing) = %v, %v, want nil", list, err)
+	}
+	if _, err := ParseStringList(config, "invalid"); err == nil || err.Error() != "invalid must be a list" {
+		t.Errorf("ParseStringList(invalid) error = %v", err)
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	stdout, stderr, err := RunCommand(context.Background(), t.TempDir(), map[string]string{"GREETING": "hi"}, "sh", "-c", "echo $GREETING; echo oops >&2")
+	if err != nil || stdout != "hi\n" || stderr != "oops\n" {
+		t.Errorf("RunCommand() = %q, %q, %v", stdout, stderr, err)
+	}
+
+	output, err := RunCombined(context.Background(), t.TempDir(), nil, "sh", "-c", "echo failed >&2; exit 3")
+	if err == nil || !strings.Contains(err.Error(), "failed") || output != "failed\n" {
+		t.Errorf("RunCombined() = %q, %v, want the output in the error", output, err)
+	}
+}
@@ -0,0 +1,121 @@
+package quality
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/chip/conveyor/core"
+)
+
+// hunkHeader matches the new file range of a unified diff hunk
+var hunkHeader = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+
+// changes are the lines added or modified since the base, by file
+type changes map[string]map[int]bool
+
+// contains reports whether an annotation is on a changed line. Annotations
+// of a whole file are new when the file changed.
+func (c changes) contains(annotation core.Annotation) bool {
+	lines, ok := c[annotation.Path]
+	if !ok {
+		return false
+	}
+	if annotation.Line == 0 {
+		return true
+	}
+	end := annotation.EndLine
+	if end < annotation.Line {
+		end = annotation.Line
+	}
+	for line := annotation.Line; line <= end; line++ {
+		if lines[line] {
+			return true
+		}
+	}
+	return false
+}
+
+// changedLines returns the lines of the checkout in dir that differ from
+// where it branched off base, preferring the remote branch origin/<base>.
+// Uncommitted changes count as changed, and paths are relative to dir.
+func changedLines(ctx context.Context, dir string, env map[string]string, base string) (changes, error) {
+	var mergeBase string
+	var err error
+	for _, ref := range []string{"origin/" + base, base} {
+		mergeBase, err = runGit(ctx, dir, env, "merge-base", "HEAD", ref)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find where the checkout branched off %s: %w", base, err)
+	}
+
+	diff, err := runGit(ctx, dir, env, "diff", "--unified=0", "--no-color", "--no-ext-diff", "--relative", mergeBase)
+	if err != nil {
+		return nil, err
+	}
+	return parseDiff(diff), nil
+}
+
+// parseDiff reads the added lines of a unified diff with no context
+func parseDiff(diff string) changes {
+	changed := make(changes)
+	var file string
+	scanner := bufio.NewScanner(strings.NewReader(diff))
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			file = strings.TrimPrefix(strings.TrimPrefix(line, "+++ "), "b/")
+			if file == "/dev/null" {
+				file = ""
+			} else if changed[file] == nil {
+				changed[file] = make(map[int]bool)
+			}
+		case strings.HasPrefix(line, "@@") && file != "":
+			m := hunkHeader.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			start, _ := strconv.Atoi(m[1])
+			count := 1
+			if m[2] != "" {
+				count, _ = strconv.Atoi(m[2])
+			}
+			for n := start; n < start+count; n++ {
+				changed[file][n] = true
+			}
+		}
+	}
+	return changed
+}
+
+// runGit runs git in dir with env added to the server's environment and
+// returns its trimmed output
+func runGit(ctx context.Context, dir string, env map[string]string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
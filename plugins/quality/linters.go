@@ -0,0 +1,234 @@
+package quality
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chip/conveyor/core"
+)
+
+// linter runs a static analysis tool and normalizes its report into
+// annotations
+type linter struct {
+	name string
+	// configs are the tool's configuration files, in the order the tool
+	// prefers them
+	configs []string
+	// applies reports whether the tool applies to a workspace without one
+	// of its configuration files
+	applies func(dir string) bool
+	args    func(config string) []string
+	parse   func(report []byte) ([]core.Annotation, error)
+	// combined parses standard error after standard output, for tools
+	// that print problems to either
+	combined bool
+}
+
+// linters are the supported tools by step type
+var linters = map[string]*linter{
+	"golangci-lint": {
+		name:    "golangci-lint",
+		configs: []string{".golangci.yml", ".golangci.yaml", ".golangci.toml", ".golangci.json"},
+		applies: func(dir string) bool { return exists(filepath.Join(dir, "go.mod")) },
+		args: func(config string) []string {
+			args := []string{"run", "--out-format", "json"}
+			if config != "" {
+				args = append(args, "--config", config)
+			}
+			return append(args, "./...")
+		},
+		parse: parseGolangciLint,
+	},
+	"eslint": {
+		name: "eslint",
+		configs: []string{"eslint.config.js", "eslint.config.mjs", "eslint.config.cjs",
+			".eslintrc.js", ".eslintrc.cjs", ".eslintrc.yaml", ".eslintrc.yml", ".eslintrc.json", ".eslintrc"},
+		applies: hasPackageESLintConfig,
+		args: func(config string) []string {
+			args := []string{"--format", "json"}
+			if config != "" {
+				args = append(args, "--config", config)
+			}
+			return append(args, ".")
+		},
+		parse: parseESLint,
+	},
+	"semgrep": {
+		name:    "semgrep",
+		configs: []string{".semgrep.yml", ".semgrep.yaml", ".semgrep"},
+		// The registry's rules are only used when asked for by step type
+		applies: func(dir string) bool { return false },
+		args: func(config string) []string {
+			if config == "" {
+				config = "auto"
+			}
+			return []string{"scan", "--json", "--quiet", "--config", config}
+		},
+		parse: parseSemgrep,
+	},
+}
+
+// commandLinter runs any tool printing "path:line:column: message" lines,
+// such as staticcheck or go vet
+func commandLinter(command []string) *linter {
+	matcher := core.CompilerMatcher
+	matcher.Source = filepath.Base(command[0])
+	return &linter{
+		name: command[0],
+		args: func(string) []string { return command[1:] },
+		parse: func(report []byte) ([]core.Annotation, error) {
+			return matcher.Match(string(report)), nil
+		},
+		combined: true,
+	}
+}
+
+// linterOrder is the order auto-detected linters run in
+var linterOrder = []string{"golangci-lint", "eslint", "semgrep"}
+
+// detectConfig returns the linter's configuration file in dir, if any
+func (l *linter) detectConfig(dir string) string {
+	for _, name := range l.configs {
+		if exists(filepath.Join(dir, name)) {
+			return name
+		}
+	}
+	return ""
+}
+
+// detect reports whether the linter applies to the workspace in dir, and
+// its configuration file
+func (l *linter) detect(dir string) (string, bool) {
+	if config := l.detectConfig(dir); config != "" {
+		return config, true
+	}
+	return "", l.applies(dir)
+}
+
+func parseGolangciLint(report []byte) ([]core.Annotation, error) {
+	var result struct {
+		Issues []struct {
+			FromLinter string
+			Text       string
+			Severity   string
+			Pos        struct {
+				Filename string
+				Line     int
+				Column   int
+			}
+		}
+	}
+	if err := json.Unmarshal(report, &result); err != nil {
+		return nil, err
+	}
+	annotations := make([]core.Annotation, 0, len(result.Issues))
+	for _, issue := range result.Issues {
+		level := core.AnnotationError
+		if issue.Severity != "" {
+			level = core.NormalizeLevel(issue.Severity)
+		}
+		annotations = append(annotations, core.Annotation{
+			Path:    filepath.ToSlash(issue.Pos.Filename),
+			Line:    issue.Pos.Line,
+			Column:  issue.Pos.Column,
+			Level:   level,
+			Message: issue.Text,
+			Rule:    issue.FromLinter,
+			Source:  "golangci-lint",
+		})
+	}
+	return annotations, nil
+}
+
+func parseESLint(report []byte) ([]core.Annotation, error) {
+	var files []struct {
+		FilePath string `json:"filePath"`
+		Messages []struct {
+			RuleID   string `json:"ruleId"`
+			Severity int    `json:"severity"`
+			Message  string `json:"message"`
+			Line     int    `json:"line"`
+			Column   int    `json:"column"`
+			EndLine  int    `json:"endLine"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(report, &files); err != nil {
+		return nil, err
+	}
+	annotations := []core.Annotation{}
+	for _, file := range files {
+		for _, message := range file.Messages {
+			level := core.AnnotationWarning
+			if message.Severity == 2 {
+				level = core.AnnotationError
+			}
+			annotations = append(annotations, core.Annotation{
+				Path:    filepath.ToSlash(file.FilePath),
+				Line:    message.Line,
+				Column:  message.Column,
+				EndLine: message.EndLine,
+				Level:   level,
+				Message: message.Message,
+				Rule:    message.RuleID,
+				Source:  "eslint",
+			})
+		}
+	}
+	return annotations, nil
+}
+
+func parseSemgrep(report []byte) ([]core.Annotation, error) {
+	var result struct {
+		Results []struct {
+			CheckID string `json:"check_id"`
+			Path    string `json:"path"`
+			Start   struct {
+				Line int `json:"line"`
+				Col  int `json:"col"`
+			} `json:"start"`
+			End struct {
+				Line int `json:"line"`
+			} `json:"end"`
+			Extra struct {
+				Message  string `json:"message"`
+				Severity string `json:"severity"`
+			} `json:"extra"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(report, &result); err != nil {
+		return nil, err
+	}
+	annotations := make([]core.Annotation, 0, len(result.Results))
+	for _, r := range result.Results {
+		annotations = append(annotations, core.Annotation{
+			Path:    filepath.ToSlash(r.Path),
+			Line:    r.Start.Line,
+			Column:  r.Start.Col,
+			EndLine: r.End.Line,
+			Level:   core.NormalizeLevel(r.Extra.Severity),
+			Message: strings.TrimSpace(r.Extra.Message),
+			Rule:    r.CheckID,
+			Source:  "semgrep",
+		})
+	}
+	return annotations, nil
+}
+
+// hasPackageESLintConfig reports whether package.json configures eslint
+func hasPackageESLintConfig(dir string) bool {
+	data, err := os.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return false
+	}
+	var pkg struct {
+		ESLintConfig json.RawMessage `json:"eslintConfig"`
+	}
+	return json.Unmarshal(data, &pkg) == nil && len(pkg.ESLintConfig) > 0
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,270 @@
+// Package quality provides static analysis steps that run golangci-lint,
+// eslint and semgrep and report their findings as annotations.
+package quality
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/plugins/pluginutil"
+)
+
+// Defaults of lint steps
+const (
+	defaultFailOn     = core.AnnotationError
+	defaultBaseBranch = "main"
+)
+
+// levelRanks orders annotation levels for failOn
+var levelRanks = map[string]int{core.AnnotationNotice: 0, core.AnnotationWarning: 1, core.AnnotationError: 2}
+
+// runFunc runs a tool in dir and returns its standard output and error
+type runFunc func(ctx context.Context, dir string, env map[string]string, name string, args ...string) ([]byte, []byte, error)
+
+// QualityPlugin implements the Plugin interface for static analysis steps
+type QualityPlugin struct {
+	run runFunc
+}
+
+// NewQualityPlugin creates a static analysis plugin
+func NewQualityPlugin() *QualityPlugin {
+	return &QualityPlugin{run: runTool}
+}
+
+// GetManifest returns the plugin manifest
+func (p *QualityPlugin) GetManifest() core.PluginManifest {
+	return core.PluginManifest{
+		Name:        "quality",
+		Version:     "1.0.0",
+		Description: "Static analysis with golangci-lint, eslint and semgrep, reported as annotations",
+		Author:      "Conveyor Team",
+		Type:        "quality",
+		StepTypes:   []string{"lint", "golangci-lint", "eslint", "semgrep"},
+	}
+}
+
+// Execute runs the linters of a step. The lint step type runs every linter
+// that applies to the workspace. The step fails when it reports
+// annotations at or above failOn, error by default; with newOnly, only
+// annotations on lines changed since the checkout branched off baseBranch
+// are reported.
+func (p *QualityPlugin) Execute(ctx context.Context, step core.Step) (map[string]interface{}, error) {
+	workDir := pluginutil.String(step.Config, "workDir")
+	env, _ := step.Config["env"].(map[string]string)
+	dir := resolvePath(workDir, pluginutil.StringOr(step.Config, "path", "."))
+
+	failOn := pluginutil.StringOr(step.Config, "failOn", defaultFailOn)
+	if _, ok := levelRanks[failOn]; !ok && failOn != "never" {
+		return nil, fmt.Errorf("failOn must be error, warning, notice or never, got %q", failOn)
+	}
+
+	selected, err := p.selectLinters(step, dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(selected) == 0 {
+		return map[string]interface{}{
+			"status": "skipped",
+			"reason": "no linter applies to the workspace",
+		}, nil
+	}
+
+	var annotations []core.Annotation
+	names := make([]string, 0, len(selected))
+	configs := make(map[string]string, len(selected))
+	for _, s := range selected {
+		found, err := p.lint(ctx, s.linter, dir, env, s.config, pluginutil.StringList(step.Config, "args"))
+		if err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, relativeTo(found, workDir, dir)...)
+		names = append(names, s.linter.name)
+		if s.config != "" {
+			configs[s.linter.name] = s.config
+		}
+	}
+
+	outputs := map[string]interface{}{
+		"linters":    names,
+		"configs":    configs,
+		"violations": len(annotations),
+	}
+	if pluginutil.Bool(step.Config, "newOnly", false) {
+		base := pluginutil.StringOr(step.Config, "baseBranch", defaultBaseBranch)
+		changed, err := changedLines(ctx, workDir, env, base)
+		if err != nil {
+			return nil, err
+		}
+		var fresh []core.Annotation
+		for _, annotation := range annotations {
+			if changed.contains(annotation) {
+				fresh = append(fresh, annotation)
+			}
+		}
+		annotations = fresh
+		outputs["baseBranch"] = base
+		outputs["new"] = len(annotations)
+	}
+	if annotations == nil {
+		annotations = []core.Annotation{}
+	}
+	counts := make(map[string]int)
+	for _, annotation := range annotations {
+		counts[annotation.Level]++
+	}
+	outputs["errors"] = counts[core.AnnotationError]
+	outputs["warnings"] = counts[core.AnnotationWarning]
+	outputs["annotations"] = annotations
+
+	if failing := atLeast(annotations, failOn); failing > 0 {
+		return outputs, fmt.Errorf("found %d violations at %s level or above", failing, failOn)
+	}
+	return outputs, nil
+}
+
+// selected is a linter picked for a step with its configuration file
+type selected struct {
+	linter *linter
+	config string
+}
+
+// selectLinters picks the linters of a step: its type's, or for the lint
+// type its command, the ones listed in linters or the ones detected in
+// dir. An explicit config overrides the detected configuration file.
+func (p *QualityPlugin) selectLinters(step core.Step, dir string) ([]selected, error) {
+	config := pluginutil.String(step.Config, "config")
+	if l, ok := linters[step.Type]; ok {
+		if config == "" {
+			config = l.detectConfig(dir)
+		}
+		return []selected{{linter: l, config: config}}, nil
+	}
+	if step.Type != "lint" && step.Type != "plugin" {
+		return nil, fmt.Errorf("unsupported step type: %s", step.Type)
+	}
+
+	if command := pluginutil.StringList(step.Config, "command"); len(command) > 0 {
+		return []selected{{linter: commandLinter(command)}}, nil
+	}
+
+	names := pluginutil.StringList(step.Config, "linters")
+	if len(names) > 0 {
+		var picked []selected
+		for _, name := range names {
+			l, ok := linters[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown linter %q", name)
+			}
+			picked = append(picked, selected{linter: l, config: l.detectConfig(dir)})
+		}
+		return picked, nil
+	}
+
+	var picked []selected
+	for _, name := range linterOrder {
+		if config, ok := linters[name].detect(dir); ok {
+			picked = append(picked, selected{linter: linters[name], config: config})
+		}
+	}
+	return picked, nil
+}
+
+// lint runs a linter and parses its report. Linters exit with an error
+// when they find violations, so only a report that can't be parsed fails.
+func (p *QualityPlugin) lint(ctx context.Context, l *linter, dir string, env map[string]string, config string, extra []string) ([]core.Annotation, error) {
+	args := append(l.args(config), extra...)
+	stdout, stderr, err := p.run(ctx, dir, env, l.name, args...)
+	var notFound *exec.Error
+	if errors.As(err, &notFound) {
+		return nil, fmt.Errorf("%s is not installed on the runner: %w", l.name, err)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	report := stdout
+	if l.combined {
+		report = append(append(report, '\n'), stderr...)
+	}
+	annotations, parseErr := l.parse(bytes.TrimSpace(report))
+	if parseErr != nil {
+		if msg := strings.TrimSpace(string(stderr)); msg != "" {
+			return nil, fmt.Errorf("%s failed: %s", l.name, msg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s failed: %w", l.name, err)
+		}
+		return nil, fmt.Errorf("failed to parse %s report: %w", l.name, parseErr)
+	}
+	if err != nil && len(annotations) == 0 {
+		// A plain text report without problems doesn't explain the failure
+		if msg := strings.TrimSpace(string(stderr)); msg != "" {
+			return nil, fmt.Errorf("%s failed: %s", l.name, msg)
+		}
+		return nil, fmt.Errorf("%s failed: %w", l.name, err)
+	}
+	return annotations, nil
+}
+
+// relativeTo makes annotation paths, which linters report as absolute or
+// relative to dir, relative to the job's working directory
+func relativeTo(annotations []core.Annotation, workDir, dir string) []core.Annotation {
+	for i := range annotations {
+		path := filepath.FromSlash(annotations[i].Path)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		if workDir != "" {
+			if rel, err := filepath.Rel(workDir, path); err == nil {
+				path = rel
+			}
+		}
+		annotations[i].Path = filepath.ToSlash(path)
+	}
+	return annotations
+}
+
+// atLeast counts the annotations at or above level
+func atLeast(annotations []core.Annotation, level string) int {
+	rank, ok := levelRanks[level]
+	if !ok {
+		return 0
+	}
+	count := 0
+	for _, annotation := range annotations {
+		if levelRanks[annotation.Level] >= rank {
+			count++
+		}
+	}
+	return count
+}
+
+// runTool runs a tool in dir with env added to the server's environment
+func runTool(ctx context.Context, dir string, env map[string]string, name string, args ...string) ([]byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// resolvePath returns path relative to dir unless it is absolute
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) || dir == "" {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
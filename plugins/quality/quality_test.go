@@ -0,0 +1,191 @@
+package quality
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chip/conveyor/core"
+)
+
+// fakeTool records tool invocations and returns canned reports by tool.
+// Tools exit with an error unless they are clean.
+type fakeTool struct {
+	reports map[string]string
+	clean   map[string]bool
+	calls   []string
+}
+
+func (f *fakeTool) run(ctx context.Context, dir string, env map[string]string, name string, args ...string) ([]byte, []byte, error) {
+	f.calls = append(f.calls, name+" "+strings.Join(args, " "))
+	report, ok := f.reports[name]
+	if !ok {
+		return nil, nil, &exec.Error{Name: name, Err: exec.ErrNotFound}
+	}
+	if f.clean[name] {
+		return []byte(report), nil, nil
+	}
+	return []byte(report), nil, errors.New("exit status 1")
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+const golangciReport = `{"Issues":[
+	{"FromLinter":"errcheck","Text":"Error return value is not checked","Pos":{"Filename":"main.go","Line":12,"Column":2}},
+	{"FromLinter":"gocritic","Text":"ifElseChain","Severity":"warning","Pos":{"Filename":"util/strings.go","Line":3,"Column":1}}
+]}`
+
+func TestLint_DetectsLintersAndConfigs(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"go.mod":               "module example.com/app\n",
+		"web/package.json":     `{"name": "web"}`,
+		"web/eslint.config.js": "export default []\n",
+		".semgrep.yml":         "rules: []\n",
+	})
+	eslintReport := `[{"filePath":"` + filepath.ToSlash(filepath.Join(dir, "web", "app.js")) + `","messages":[{"ruleId":"no-unused-vars","severity":1,"message":"'x' is unused","line":4,"column":7}]}]`
+	tool := &fakeTool{reports: map[string]string{"golangci-lint": golangciReport, "eslint": eslintReport, "semgrep": `{"results":[]}`}, clean: map[string]bool{"semgrep": true}}
+	plugin := &QualityPlugin{run: tool.run}
+
+	outputs, err := plugin.Execute(context.Background(), core.Step{Type: "lint", Config: map[string]interface{}{"workDir": dir}})
+	if err == nil || !strings.Contains(err.Error(), "found 1 violations at error level") {
+		t.Fatalf("Execute() error = %v, want the errcheck error to fail the step", err)
+	}
+	if linters := outputs["linters"].([]string); strings.Join(linters, ",") != "golangci-lint,semgrep" {
+		t.Errorf("linters = %v, want golangci-lint and semgrep detected at the root", linters)
+	}
+	if configs := outputs["configs"].(map[string]string); configs["semgrep"] != ".semgrep.yml" {
+		t.Errorf("configs = %v, want the semgrep config detected", configs)
+	}
+	if !strings.Contains(tool.calls[1], "--config .semgrep.yml") {
+		t.Errorf("semgrep ran as %q, want the detected config", tool.calls[1])
+	}
+
+	// eslint applies to the web directory
+	outputs, err = plugin.Execute(context.Background(), core.Step{Type: "lint", Config: map[string]interface{}{"workDir": dir, "path": "web"}})
+	if err != nil {
+		t.Fatalf("Execute() error = %v, want warnings not to fail the step", err)
+	}
+	annotations := outputs["annotations"].([]core.Annotation)
+	if len(annotations) != 1 || annotations[0].Path != "web/app.js" || annotations[0].Level != core.AnnotationWarning || annotations[0].Rule != "no-unused-vars" {
+		t.Errorf("annotations = %+v, want the eslint warning relative to the workspace", annotations)
+	}
+}
+
+func TestLint_Errors(t *testing.T) {
+	plugin := &QualityPlugin{run: (&fakeTool{}).run}
+	dir := t.TempDir()
+
+	outputs, err := plugin.Execute(context.Background(), core.Step{Type: "lint", Config: map[string]interface{}{"workDir": dir}})
+	if err != nil || outputs["status"] != "skipped" {
+		t.Errorf("Execute() = %v, %v, want skipped without applicable linters", outputs, err)
+	}
+	if _, err := plugin.Execute(context.Background(), core.Step{Type: "eslint", Config: map[string]interface{}{"workDir": dir}}); err == nil || !strings.Contains(err.Error(), "not installed") {
+		t.Errorf("Execute() error = %v, want eslint reported as not installed", err)
+	}
+	if _, err := plugin.Execute(context.Background(), core.Step{Type: "lint", Config: map[string]interface{}{"failOn": "fatal"}}); err == nil {
+		t.Error("Execute() with an invalid failOn expected error")
+	}
+}
+
+func TestLint_Command(t *testing.T) {
+	tool := &fakeTool{reports: map[string]string{"staticcheck": "main.go:7:2: should use strings.Builder (SA1000)\nexit status 1\n"}}
+	plugin := &QualityPlugin{run: tool.run}
+
+	outputs, err := plugin.Execute(context.Background(), core.Step{Type: "lint", Config: map[string]interface{}{
+		"command": []interface{}{"staticcheck", "./..."},
+		"failOn":  "never",
+	}})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	annotations := outputs["annotations"].([]core.Annotation)
+	if len(annotations) != 1 || annotations[0].Path != "main.go" || annotations[0].Line != 7 || annotations[0].Source != "staticcheck" {
+		t.Errorf("annotations = %+v, want the staticcheck problem", annotations)
+	}
+}
+
+func TestLint_NewOnly(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		if _, err := runGit(context.Background(), dir, nil, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("init", "--quiet", "--initial-branch", "main")
+	git("config", "user.email", "dev@example.com")
+	git("config", "user.name", "Dev")
+	writeFiles(t, dir, map[string]string{"go.mod": "module example.com/app\n", "main.go": strings.Repeat("// line\n", 20)})
+	git("add", ".")
+	git("commit", "--quiet", "-m", "initial")
+	git("checkout", "--quiet", "-b", "feature")
+	lines := strings.Split(strings.Repeat("// line\n", 20), "\n")
+	lines[11] = "// changed"
+	writeFiles(t, dir, map[string]string{"main.go": strings.Join(lines, "\n")})
+
+	tool := &fakeTool{reports: map[string]string{"golangci-lint": golangciReport}}
+	plugin := &QualityPlugin{run: tool.run}
+	outputs, err := plugin.Execute(context.Background(), core.Step{Type: "golangci-lint", Config: map[string]interface{}{
+		"workDir": dir,
+		"newOnly": true,
+	}})
+	if err == nil {
+		t.Fatal("Execute() error = nil, want the new errcheck violation to fail the step")
+	}
+	if outputs["violations"] != 2 || outputs["new"] != 1 {
+		t.Errorf("violations = %v, new = %v, want 2 and 1", outputs["violations"], outputs["new"])
+	}
+	annotations := outputs["annotations"].([]core.Annotation)
+	if len(annotations) != 1 || annotations[0].Line != 12 {
+		t.Errorf("annotations = %+v, want only the violation on the changed line", annotations)
+	}
+}
+
+func TestParseDiff(t *testing.T) {
+	diff := `diff --git a/main.go b/main.go
+--- a/main.go
++++ b/main.go
+@@ -3,0 +4,2 @@ func main() {
++	a()
++	b()
+@@ -10 +12 @@
+-	old()
++	new()
+@@ -20,2 +21,0 @@
+-	gone()
+-	gone()
+diff --git a/old.go b/old.go
+--- a/old.go
++++ /dev/null
+@@ -1 +0,0 @@
+-package old
+`
+	changed := parseDiff(diff)
+	for _, line := range []int{4, 5, 12} {
+		if !changed["main.go"][line] {
+			t.Errorf("line %d not changed", line)
+		}
+	}
+	if len(changed["main.go"]) != 3 || len(changed) != 1 {
+		t.Errorf("parseDiff() = %v, want lines 4, 5 and 12 of main.go", changed)
+	}
+}
@@ -0,0 +1,103 @@
+package release
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// changelogSections lists the commit types that appear in changelogs, in
+// order, with their headings
+var changelogSections = []struct {
+	commitType string
+	heading    string
+}{
+	{"feat", "Features"},
+	{"fix", "Bug Fixes"},
+	{"perf", "Performance Improvements"},
+	{"revert", "Reverts"},
+}
+
+// Changelog renders the markdown section of a release: breaking changes,
+// then features, fixes, performance improvements and reverts. Other commit
+// types are left out.
+func Changelog(version string, date time.Time, commits []Commit) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "## %s (%s)\n", version, date.Format("2006-01-02"))
+
+	var breaking []string
+	for _, commit := range commits {
+		if commit.Breaking {
+			breaking = append(breaking, changelogEntry(commit, commit.Note))
+		}
+	}
+	writeSection(&b, "Breaking Changes", breaking)
+
+	for _, section := range changelogSections {
+		var entries []string
+		for _, commit := range commits {
+			if commit.Type == section.commitType {
+				entries = append(entries, changelogEntry(commit, commit.Subject))
+			}
+		}
+		writeSection(&b, section.heading, entries)
+	}
+	return b.String()
+}
+
+// changelogEntry formats a commit as a list item
+func changelogEntry(commit Commit, text string) string {
+	hash := commit.Hash
+	if len(hash) > 7 {
+		hash = hash[:7]
+	}
+	if commit.Scope != "" {
+		return fmt.Sprintf("- **%s:** %s (%s)", commit.Scope, text, hash)
+	}
+	return fmt.Sprintf("- %s (%s)", text, hash)
+}
+
+// writeSection writes a heading and its entries, if there are any
+func writeSection(b *strings.Builder, heading string, entries []string) {
+	if len(entries) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "\n### %s\n\n%s\n", heading, strings.Join(entries, "\n"))
+}
+
+// prependChangelog adds a release section to the top of a changelog file,
+// below its title when it starts with one. The file is created if needed.
+func prependChangelog(path, section string) error {
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read changelog: %w", err)
+	}
+
+	content := string(existing)
+	title := "# Changelog\n"
+	if strings.HasPrefix(content, "# ") {
+		end := strings.Index(content, "\n")
+		if end < 0 {
+			end = len(content) - 1
+		}
+		title, content = content[:end+1], content[end+1:]
+		if !strings.HasSuffix(title, "\n") {
+			title += "\n"
+		}
+	}
+	content = strings.TrimLeft(content, "\n")
+
+	updated := title + "\n" + section
+	if content != "" {
+		updated += "\n" + content
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create changelog directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(updated), 0644); err != nil {
+		return fmt.Errorf("failed to write changelog: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package release
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// runGit runs git in dir with env added to the server's environment and
+// returns its trimmed output
+func runGit(ctx context.Context, dir string, env map[string]string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// Tag is a version tag
+type Tag struct {
+	Name    string
+	Version Version
+}
+
+// History is the release state of a checkout: the version tag at HEAD, the
+// latest version tag before it and the commits in between
+type History struct {
+	Current  *Tag
+	Previous *Tag
+	Commits  []Commit
+}
+
+// readHistory reads the version tags with prefix and the commits since the
+// latest one before HEAD
+func readHistory(ctx context.Context, dir string, env map[string]string, prefix string) (*History, error) {
+	history := &History{}
+
+	atHead, err := runGit(ctx, dir, env, "tag", "--points-at", "HEAD", "--list", prefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	headTags := make(map[string]bool)
+	for _, name := range strings.Fields(atHead) {
+		headTags[name] = true
+		history.Current = newerTag(history.Current, name, prefix)
+	}
+
+	merged, err := runGit(ctx, dir, env, "tag", "--merged", "HEAD", "--list", prefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Fields(merged) {
+		if !headTags[name] {
+			history.Previous = newerTag(history.Previous, name, prefix)
+		}
+	}
+
+	revisions := "HEAD"
+	if history.Previous != nil {
+		revisions = history.Previous.Name + "..HEAD"
+	}
+	log, err := runGit(ctx, dir, env, "log", "--format=%H%x1f%B%x1e", revisions)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range strings.Split(log, "\x1e") {
+		fields := strings.SplitN(strings.TrimSpace(record), "\x1f", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		history.Commits = append(history.Commits, ParseCommit(fields[0], fields[1]))
+	}
+	return history, nil
+}
+
+// newerTag returns the tag with the higher version of current and name.
+// Names that aren't a version after the prefix are ignored.
+func newerTag(current *Tag, name, prefix string) *Tag {
+	version, err := ParseVersion(strings.TrimPrefix(name, prefix))
+	if err != nil {
+		return current
+	}
+	if current == nil || current.Version.Less(version) {
+		return &Tag{Name: name, Version: version}
+	}
+	return current
+}
+
+// remotePattern matches the host and project path of ssh and https remotes
+var remotePattern = regexp.MustCompile(`^(?:[a-z+]+://)?(?:[^@/]+@)?([^:/]+)(?::\d+)?[:/](.+?)(?:\.git)?/?$`)
+
+// remoteRepository returns the project path, such as owner/repo, of a
+// remote's URL
+func remoteRepository(ctx context.Context, dir string, env map[string]string, remote string) (string, error) {
+	url, err := runGit(ctx, dir, env, "remote", "get-url", remote)
+	if err != nil {
+		return "", err
+	}
+	match := remotePattern.FindStringSubmatch(url)
+	if match == nil {
+		return "", fmt.Errorf("cannot read the repository from remote %s %q", remote, url)
+	}
+	return match[2], nil
+}
@@ -0,0 +1,288 @@
+// Package release provides built-in steps for release pipelines: semantic
+// versioning from conventional commits, changelogs, git tags, GitHub or
+// GitLab releases and reproducible build checks.
+package release
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/plugins/pluginutil"
+)
+
+// ReleasePlugin implements the Plugin interface for release steps
+type ReleasePlugin struct {
+	client *http.Client
+	now    func() time.Time
+}
+
+// NewReleasePlugin creates a release plugin
+func NewReleasePlugin() *ReleasePlugin {
+	return &ReleasePlugin{
+		client: &http.Client{Timeout: 5 * time.Minute},
+		now:    time.Now,
+	}
+}
+
+// GetManifest returns the plugin manifest
+func (p *ReleasePlugin) GetManifest() core.PluginManifest {
+	return core.PluginManifest{
+		Name:        "release",
+		Version:     "1.0.0",
+		Description: "Semantic versioning, changelogs, git tags and GitHub/GitLab releases from conventional commits, and reproducible build checks",
+		Author:      "Conveyor Team",
+		Type:        "release",
+		StepTypes:   []string{"semver", "changelog", "git-tag", "github-release", "gitlab-release", "reproducible"},
+	}
+}
+
+// Defaults of release steps
+const (
+	defaultTagPrefix      = "v"
+	defaultInitialVersion = "0.1.0"
+	defaultRemote         = "origin"
+	defaultGitHubAPI      = "https://api.github.com"
+	defaultGitLabAPI      = "https://gitlab.com/api/v4"
+)
+
+// plan is the release a step works on
+type plan struct {
+	history  *History
+	version  Version
+	previous string
+	tag      string
+	bump     string
+	commit   string
+	// release is false when there are no releasable changes
+	release bool
+}
+
+// Execute runs a release step
+func (p *ReleasePlugin) Execute(ctx context.Context, step core.Step) (map[string]interface{}, error) {
+	dir := pluginutil.String(step.Config, "workDir")
+	env, _ := step.Config["env"].(map[string]string)
+	if step.Type == "reproducible" {
+		return p.verifyReproducible(ctx, step, dir, env)
+	}
+
+	plan, err := p.plan(ctx, step.Config, dir, env)
+	if err != nil {
+		return nil, err
+	}
+	outputs := map[string]interface{}{
+		"version":         plan.version.String(),
+		"previousVersion": plan.previous,
+		"tag":             plan.tag,
+		"bump":            plan.bump,
+		"release":         plan.release,
+		"commits":         len(plan.history.Commits),
+	}
+	if step.Type == "semver" {
+		return outputs, nil
+	}
+	if !plan.release {
+		outputs["status"] = "skipped"
+		outputs["reason"] = "no releasable changes since " + plan.previous
+		return outputs, nil
+	}
+
+	notes := Changelog(plan.version.String(), p.now(), plan.history.Commits)
+	switch step.Type {
+	case "changelog":
+		outputs["changelog"] = notes
+		if file := pluginutil.String(step.Config, "file"); file != "" {
+			if err := prependChangelog(resolvePath(dir, file), notes); err != nil {
+				return nil, err
+			}
+			outputs["file"] = file
+		}
+	case "git-tag":
+		pushed, err := p.tag(ctx, step.Config, dir, env, plan, notes)
+		if err != nil {
+			return nil, err
+		}
+		outputs["commit"] = plan.commit
+		outputs["pushed"] = pushed
+	case "github-release", "gitlab-release":
+		release, err := p.publish(ctx, step, dir, env, plan, notes)
+		if err != nil {
+			return nil, err
+		}
+		outputs["url"] = release.URL
+		outputs["assets"] = release.Assets
+	default:
+		return nil, fmt.Errorf("unsupported step type: %s", step.Type)
+	}
+	return outputs, nil
+}
+
+// plan reads the checkout's history and works out the version to release.
+// A version tag at HEAD is the release, so steps after git-tag release the
+// tagged version rather than bumping again.
+func (p *ReleasePlugin) plan(ctx context.Context, config map[string]interface{}, dir string, env map[string]string) (*plan, error) {
+	prefix := pluginutil.StringOr(config, "tagPrefix", defaultTagPrefix)
+	history, err := readHistory(ctx, dir, env, prefix)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := runGit(ctx, dir, env, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	result := &plan{history: history, bump: NextBump(history.Commits), commit: commit, release: true}
+	if history.Previous != nil {
+		result.previous = history.Previous.Version.String()
+	}
+
+	switch override := strings.TrimPrefix(pluginutil.String(config, "version"), prefix); {
+	case override != "":
+		if result.version, err = ParseVersion(override); err != nil {
+			return nil, err
+		}
+	case history.Current != nil:
+		result.version = history.Current.Version
+	case history.Previous != nil:
+		result.version = history.Previous.Version.Bump(result.bump)
+		result.release = result.bump != BumpNone
+	default:
+		initial := pluginutil.StringOr(config, "initialVersion", defaultInitialVersion)
+		if result.version, err = ParseVersion(strings.TrimPrefix(initial, prefix)); err != nil {
+			return nil, err
+		}
+	}
+	result.tag = prefix + result.version.String()
+	return result, nil
+}
+
+// tag creates an annotated tag of the release at HEAD with the changelog as
+// its message and pushes it unless push is false. An existing tag at HEAD
+// is pushed again, so retries succeed.
+func (p *ReleasePlugin) tag(ctx context.Context, config map[string]interface{}, dir string, env map[string]string, plan *plan, notes string) (bool, error) {
+	if existing, err := runGit(ctx, dir, env, "rev-parse", "--verify", "--quiet", plan.tag+"^{commit}"); err == nil {
+		if existing != plan.commit {
+			return false, fmt.Errorf("tag %s already exists on commit %s", plan.tag, existing)
+		}
+	} else {
+		message := pluginutil.StringOr(config, "message", notes)
+		if _, err := runGit(ctx, dir, taggerEnv(ctx, dir, env), "tag", "--annotate", "--cleanup=verbatim", plan.tag, "--message", message); err != nil {
+			return false, err
+		}
+	}
+
+	if !pluginutil.Bool(config, "push", true) {
+		return false, nil
+	}
+	remote := pluginutil.StringOr(config, "remote", defaultRemote)
+	if _, err := runGit(ctx, dir, env, "push", remote, "refs/tags/"+plan.tag); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// taggerEnv adds a tagger identity to env when git has none configured
+func taggerEnv(ctx context.Context, dir string, env map[string]string) map[string]string {
+	if email, err := runGit(ctx, dir, env, "config", "user.email"); err == nil && email != "" {
+		return env
+	}
+	tagger := make(map[string]string, len(env)+2)
+	for key, value := range env {
+		tagger[key] = value
+	}
+	if tagger["GIT_COMMITTER_NAME"] == "" {
+		tagger["GIT_COMMITTER_NAME"] = "Conveyor"
+	}
+	if tagger["GIT_COMMITTER_EMAIL"] == "" {
+		tagger["GIT_COMMITTER_EMAIL"] = "conveyor@localhost"
+	}
+	return tagger
+}
+
+// publish creates the GitHub or GitLab release of the plan with the
+// changelog as its notes and the assets attached
+func (p *ReleasePlugin) publish(ctx context.Context, step core.Step, dir string, env map[string]string, plan *plan, notes string) (*published, error) {
+	github := step.Type == "github-release"
+	tokenEnv, api := "GITLAB_TOKEN", defaultGitLabAPI
+	if github {
+		tokenEnv, api = "GITHUB_TOKEN", defaultGitHubAPI
+	}
+	tokenEnv = pluginutil.StringOr(step.Config, "tokenEnv", tokenEnv)
+	token := env[tokenEnv]
+	if token == "" {
+		return nil, fmt.Errorf("%s requires a token in $%s", step.Type, tokenEnv)
+	}
+
+	repository := pluginutil.String(step.Config, "repository")
+	if repository == "" {
+		var err error
+		repository, err = remoteRepository(ctx, dir, env, pluginutil.StringOr(step.Config, "remote", defaultRemote))
+		if err != nil {
+			return nil, err
+		}
+	}
+	assets, err := resolveAssets(dir, env, pluginutil.StringList(step.Config, "assets"))
+	if err != nil {
+		return nil, err
+	}
+
+	release := publication{
+		Repository: repository,
+		Tag:        plan.tag,
+		Commit:     plan.commit,
+		Name:       pluginutil.StringOr(step.Config, "name", plan.tag),
+		Notes:      notes,
+		Draft:      pluginutil.Bool(step.Config, "draft", false),
+		Prerelease: pluginutil.Bool(step.Config, "prerelease", plan.version.Prerelease != ""),
+		Assets:     assets,
+	}
+	api = pluginutil.StringOr(step.Config, "apiUrl", api)
+	if github {
+		return publishGitHub(ctx, p.client, api, token, release)
+	}
+	return publishGitLab(ctx, p.client, api, token, release)
+}
+
+// resolveAssets expands the asset patterns, which can reference the step's
+// environment such as $CONVEYOR_RELEASE_DIR, into the files they match.
+// Patterns that match no file are an error.
+func resolveAssets(dir string, env map[string]string, patterns []string) ([]string, error) {
+	var assets []string
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		expanded := os.Expand(pattern, func(name string) string { return env[name] })
+		matches, err := filepath.Glob(resolvePath(dir, expanded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid asset pattern %q: %w", pattern, err)
+		}
+		found := false
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || info.IsDir() || seen[match] {
+				continue
+			}
+			seen[match] = true
+			found = true
+			assets = append(assets, match)
+		}
+		if !found {
+			return nil, fmt.Errorf("asset pattern %q matches no files", pattern)
+		}
+	}
+	sort.Strings(assets)
+	return assets, nil
+}
+
+// resolvePath resolves a path relative to the working directory
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) || dir == "" {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
@@ -0,0 +1,239 @@
+package release
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// publication is a release to create on GitHub or GitLab
+type publication struct {
+	Repository string
+	Tag        string
+	Commit     string
+	Name       string
+	Notes      string
+	Draft      bool
+	Prerelease bool
+	// Assets are the files attached to the release
+	Assets []string
+}
+
+// published is a created release
+type published struct {
+	URL    string
+	Assets []string
+}
+
+// errStatus is returned for API responses with an unexpected status
+type errStatus struct {
+	code int
+	body string
+}
+
+func (e *errStatus) Error() string {
+	return fmt.Sprintf("status %d: %s", e.code, e.body)
+}
+
+// hasStatus reports whether err is an API response with the status code
+func hasStatus(err error, code int) bool {
+	var status *errStatus
+	return errors.As(err, &status) && status.code == code
+}
+
+// apiClient calls a hosting service's REST API
+type apiClient struct {
+	client  *http.Client
+	headers map[string]string
+}
+
+// do sends a request and decodes a JSON response into out, if set
+func (c *apiClient) do(ctx context.Context, method, endpoint, contentType string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	for key, value := range c.headers {
+		req.Header.Set(key, value)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &errStatus{code: resp.StatusCode, body: strings.TrimSpace(string(msg))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// doJSON sends a JSON request body
+func (c *apiClient) doJSON(ctx context.Context, method, endpoint string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	return c.do(ctx, method, endpoint, "application/json", body, out)
+}
+
+// githubRelease is the part of a GitHub release used here
+type githubRelease struct {
+	HTMLURL   string `json:"html_url"`
+	UploadURL string `json:"upload_url"`
+}
+
+// publishGitHub creates a GitHub release, or reuses the release of the tag
+// when it exists, and uploads the assets to it
+func publishGitHub(ctx context.Context, client *http.Client, api, token string, p publication) (*published, error) {
+	c := &apiClient{client: client, headers: map[string]string{
+		"Accept":        "application/vnd.github+json",
+		"Authorization": "Bearer " + token,
+	}}
+	base := strings.TrimRight(api, "/") + "/repos/" + p.Repository + "/releases"
+
+	var release githubRelease
+	err := c.doJSON(ctx, http.MethodPost, base, map[string]interface{}{
+		"tag_name":         p.Tag,
+		"target_commitish": p.Commit,
+		"name":             p.Name,
+		"body":             p.Notes,
+		"draft":            p.Draft,
+		"prerelease":       p.Prerelease,
+	}, &release)
+	if hasStatus(err, http.StatusUnprocessableEntity) {
+		// The release was created by an earlier attempt
+		err = c.doJSON(ctx, http.MethodGet, base+"/tags/"+url.PathEscape(p.Tag), nil, &release)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GitHub release: %w", err)
+	}
+
+	result := &published{URL: release.HTMLURL}
+	uploadURL := release.UploadURL
+	if i := strings.Index(uploadURL, "{"); i >= 0 {
+		uploadURL = uploadURL[:i]
+	}
+	for _, path := range p.Assets {
+		name := filepath.Base(path)
+		// Uploads need a Content-Length, which readers of files don't give
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read asset: %w", err)
+		}
+		var asset struct {
+			URL string `json:"browser_download_url"`
+		}
+		err = c.do(ctx, http.MethodPost, uploadURL+"?name="+url.QueryEscape(name), "application/octet-stream", bytes.NewReader(data), &asset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload asset %s: %w", name, err)
+		}
+		result.Assets = append(result.Assets, asset.URL)
+	}
+	return result, nil
+}
+
+// publishGitLab uploads the assets to a GitLab project and creates a
+// release linking to them
+func publishGitLab(ctx context.Context, client *http.Client, api, token string, p publication) (*published, error) {
+	c := &apiClient{client: client, headers: map[string]string{"PRIVATE-TOKEN": token}}
+	api = strings.TrimRight(api, "/")
+	project := api + "/projects/" + url.PathEscape(p.Repository)
+	web := strings.TrimSuffix(api, "/api/v4")
+
+	type link struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	}
+	var links []link
+	for _, path := range p.Assets {
+		upload, err := gitlabUpload(ctx, c, project, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload asset %s: %w", filepath.Base(path), err)
+		}
+		linkURL := web + "/" + p.Repository + upload.URL
+		if upload.FullPath != "" {
+			linkURL = web + upload.FullPath
+		}
+		links = append(links, link{Name: filepath.Base(path), URL: linkURL})
+	}
+
+	var release struct {
+		Links struct {
+			Self string `json:"self"`
+		} `json:"_links"`
+	}
+	body := map[string]interface{}{
+		"tag_name":    p.Tag,
+		"ref":         p.Commit,
+		"name":        p.Name,
+		"description": p.Notes,
+	}
+	if len(links) > 0 {
+		body["assets"] = map[string]interface{}{"links": links}
+	}
+	if err := c.doJSON(ctx, http.MethodPost, project+"/releases", body, &release); err != nil {
+		return nil, fmt.Errorf("failed to create GitLab release: %w", err)
+	}
+
+	result := &published{URL: release.Links.Self}
+	for _, l := range links {
+		result.Assets = append(result.Assets, l.URL)
+	}
+	return result, nil
+}
+
+// gitlabUploaded is the response to a project upload
+type gitlabUploaded struct {
+	URL      string `json:"url"`
+	FullPath string `json:"full_path"`
+}
+
+// gitlabUpload uploads a file to a project
+func gitlabUpload(ctx context.Context, c *apiClient, project, path string) (*gitlabUploaded, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return nil, err
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	var uploaded gitlabUploaded
+	if err := c.do(ctx, http.MethodPost, project+"/uploads", form.FormDataContentType(), &body, &uploaded); err != nil {
+		return nil, err
+	}
+	return &uploaded, nil
+}
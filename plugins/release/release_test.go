@@ -0,0 +1,378 @@
+package release
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chip/conveyor/core"
+)
+
+// gitRepo creates a repository with an initial commit
+func gitRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	git(t, dir, "init", "--quiet")
+	git(t, dir, "config", "user.email", "dev@example.com")
+	git(t, dir, "config", "user.name", "Dev")
+	commit(t, dir, "chore: initial commit")
+	return dir
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, err := runGit(context.Background(), dir, nil, args...)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return out
+}
+
+func commit(t *testing.T, dir, message string) {
+	t.Helper()
+	git(t, dir, "commit", "--quiet", "--allow-empty", "--message", message)
+}
+
+func run(t *testing.T, p *ReleasePlugin, stepType, dir string, config map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	if config == nil {
+		config = make(map[string]interface{})
+	}
+	config["workDir"] = dir
+	outputs, err := p.Execute(context.Background(), core.Step{ID: stepType, Type: stepType, Config: config})
+	if err != nil {
+		t.Fatalf("Execute(%s) error = %v", stepType, err)
+	}
+	return outputs
+}
+
+func TestVersion_Bump(t *testing.T) {
+	tests := []struct {
+		version, bump, want string
+	}{
+		{"1.2.3", BumpPatch, "1.2.4"},
+		{"1.2.3", BumpMinor, "1.3.0"},
+		{"1.2.3", BumpMajor, "2.0.0"},
+		{"1.2.3", BumpNone, "1.2.3"},
+		{"0.4.1", BumpMajor, "0.5.0"},
+		{"0.4.1", BumpMinor, "0.4.2"},
+		{"2.0.0-rc.1", BumpPatch, "2.0.0"},
+	}
+	for _, tt := range tests {
+		v, err := ParseVersion(tt.version)
+		if err != nil {
+			t.Fatalf("ParseVersion(%q) error = %v", tt.version, err)
+		}
+		if got := v.Bump(tt.bump).String(); got != tt.want {
+			t.Errorf("%s.Bump(%s) = %s, want %s", tt.version, tt.bump, got, tt.want)
+		}
+	}
+	if _, err := ParseVersion("1.2"); err == nil {
+		t.Error("ParseVersion(1.2) expected error, got nil")
+	}
+}
+
+func TestParseCommit(t *testing.T) {
+	tests := []struct {
+		message string
+		want    Commit
+		bump    string
+	}{
+		{"feat(api): add releases", Commit{Type: "feat", Scope: "api", Subject: "add releases"}, BumpMinor},
+		{"fix: handle empty tags", Commit{Type: "fix", Subject: "handle empty tags"}, BumpPatch},
+		{"refactor!: drop v1 routes", Commit{Type: "refactor", Subject: "drop v1 routes", Breaking: true, Note: "drop v1 routes"}, BumpMajor},
+		{"feat: new config\n\nBREAKING CHANGE: costs moved under reports", Commit{Type: "feat", Subject: "new config", Breaking: true, Note: "costs moved under reports"}, BumpMajor},
+		{"Merge branch 'main'", Commit{Subject: "Merge branch 'main'"}, BumpNone},
+	}
+	for _, tt := range tests {
+		got := ParseCommit("", tt.message)
+		if got != tt.want {
+			t.Errorf("ParseCommit(%q) = %+v, want %+v", tt.message, got, tt.want)
+		}
+		if bump := NextBump([]Commit{got}); bump != tt.bump {
+			t.Errorf("NextBump(%q) = %s, want %s", tt.message, bump, tt.bump)
+		}
+	}
+}
+
+func TestSemver(t *testing.T) {
+	dir := gitRepo(t)
+	p := NewReleasePlugin()
+
+	outputs := run(t, p, "semver", dir, nil)
+	if outputs["version"] != "0.1.0" || outputs["release"] != true {
+		t.Errorf("first release = %v, want initial version 0.1.0", outputs)
+	}
+
+	git(t, dir, "tag", "v1.4.2")
+	commit(t, dir, "docs: fix typo")
+	outputs = run(t, p, "semver", dir, nil)
+	if outputs["version"] != "1.4.2" || outputs["release"] != false || outputs["bump"] != BumpNone {
+		t.Errorf("docs only = %v, want no release", outputs)
+	}
+	if outputs := run(t, p, "changelog", dir, nil); outputs["status"] != "skipped" {
+		t.Errorf("changelog without releasable changes = %v, want skipped", outputs)
+	}
+
+	commit(t, dir, "fix: retry uploads")
+	commit(t, dir, "feat(ui): dark mode")
+	outputs = run(t, p, "semver", dir, nil)
+	if outputs["version"] != "1.5.0" || outputs["previousVersion"] != "1.4.2" || outputs["tag"] != "v1.5.0" || outputs["commits"] != 3 {
+		t.Errorf("semver = %v, want 1.5.0 after 1.4.2 from 3 commits", outputs)
+	}
+
+	// A tagged HEAD is the release, not bumped again
+	git(t, dir, "tag", "v1.5.0")
+	if outputs := run(t, p, "semver", dir, nil); outputs["version"] != "1.5.0" || outputs["previousVersion"] != "1.4.2" {
+		t.Errorf("semver at tag = %v, want 1.5.0 after 1.4.2", outputs)
+	}
+}
+
+func TestChangelog(t *testing.T) {
+	dir := gitRepo(t)
+	git(t, dir, "tag", "v1.0.0")
+	commit(t, dir, "fix(api): reject empty names")
+	commit(t, dir, "feat!: remove the legacy scheduler")
+	commit(t, dir, "chore: bump deps")
+
+	changelog := filepath.Join(dir, "CHANGELOG.md")
+	if err := os.WriteFile(changelog, []byte("# Changelog\n\n## 1.0.0 (2026-01-01)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewReleasePlugin()
+	p.now = func() time.Time { return time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC) }
+	outputs := run(t, p, "changelog", dir, map[string]interface{}{"file": "CHANGELOG.md"})
+
+	notes, _ := outputs["changelog"].(string)
+	for _, want := range []string{"## 2.0.0 (2026-10-16)", "### Breaking Changes\n\n- remove the legacy scheduler", "### Bug Fixes\n\n- **api:** reject empty names"} {
+		if !strings.Contains(notes, want) {
+			t.Errorf("changelog = %q, want it to contain %q", notes, want)
+		}
+	}
+	if strings.Contains(notes, "bump deps") {
+		t.Errorf("changelog = %q, want chores left out", notes)
+	}
+
+	data, err := os.ReadFile(changelog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "# Changelog\n\n## 2.0.0") || !strings.Contains(string(data), "## 1.0.0") {
+		t.Errorf("CHANGELOG.md = %q, want the new release below the title and above 1.0.0", data)
+	}
+}
+
+func TestGitTag(t *testing.T) {
+	remote := t.TempDir()
+	if _, err := runGit(context.Background(), remote, nil, "init", "--quiet", "--bare"); err != nil {
+		t.Fatal(err)
+	}
+	dir := gitRepo(t)
+	git(t, dir, "remote", "add", "origin", remote)
+	git(t, dir, "tag", "v0.3.0")
+	commit(t, dir, "feat: promote releases")
+
+	p := NewReleasePlugin()
+	outputs := run(t, p, "git-tag", dir, nil)
+	if outputs["tag"] != "v0.3.1" || outputs["pushed"] != true {
+		t.Errorf("git-tag = %v, want v0.3.1 pushed", outputs)
+	}
+	if got := git(t, remote, "tag", "--list"); got != "v0.3.1" {
+		t.Errorf("remote tags = %q, want v0.3.1", got)
+	}
+	if got := git(t, dir, "tag", "--list", "--format=%(contents:subject)", "v0.3.1"); !strings.HasPrefix(got, "## 0.3.1") {
+		t.Errorf("tag message = %q, want the changelog", got)
+	}
+
+	// Retrying tags the same release again
+	if outputs := run(t, p, "git-tag", dir, nil); outputs["tag"] != "v0.3.1" {
+		t.Errorf("retried git-tag = %v, want v0.3.1", outputs)
+	}
+}
+
+func TestGitHubRelease(t *testing.T) {
+	dir := gitRepo(t)
+	commit(t, dir, "feat: first feature")
+	if err := os.MkdirAll(filepath.Join(dir, "dist"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dist", "app.tar.gz"), []byte("binary"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var created map[string]interface{}
+	var uploaded string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/repos/acme/app/releases":
+			json.NewDecoder(r.Body).Decode(&created)
+			json.NewEncoder(w).Encode(map[string]string{
+				"html_url":   "https://github.com/acme/app/releases/v0.1.0",
+				"upload_url": "http://" + r.Host + "/uploads/1/assets{?name,label}",
+			})
+		case r.Method == http.MethodPost && r.URL.Path == "/uploads/1/assets":
+			body, _ := io.ReadAll(r.Body)
+			uploaded = r.URL.Query().Get("name") + ":" + string(body)
+			json.NewEncoder(w).Encode(map[string]string{"browser_download_url": "https://github.com/acme/app/releases/download/v0.1.0/app.tar.gz"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	outputs := run(t, NewReleasePlugin(), "github-release", dir, map[string]interface{}{
+		"apiUrl":     server.URL,
+		"repository": "acme/app",
+		"assets":     []interface{}{"$DIST/*.tar.gz"},
+		"env":        map[string]string{"GITHUB_TOKEN": "secret-token", "DIST": "dist"},
+	})
+	if outputs["url"] != "https://github.com/acme/app/releases/v0.1.0" {
+		t.Errorf("github-release = %v, want the release URL", outputs)
+	}
+	if created["tag_name"] != "v0.1.0" || !strings.Contains(created["body"].(string), "first feature") {
+		t.Errorf("created release = %v, want v0.1.0 with the changelog", created)
+	}
+	if uploaded != "app.tar.gz:binary" {
+		t.Errorf("uploaded = %q, want app.tar.gz", uploaded)
+	}
+
+	_, err := NewReleasePlugin().Execute(context.Background(), core.Step{Type: "github-release", Config: map[string]interface{}{"workDir": dir, "repository": "acme/app"}})
+	if err == nil || !strings.Contains(err.Error(), "$GITHUB_TOKEN") {
+		t.Errorf("Execute() without token error = %v, want missing token", err)
+	}
+}
+
+func TestGitLabRelease(t *testing.T) {
+	dir := gitRepo(t)
+	git(t, dir, "remote", "add", "origin", "git@gitlab.example.com:group/app.git")
+	commit(t, dir, "fix: crash on start")
+	if err := os.WriteFile(filepath.Join(dir, "app.zip"), []byte("zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var created struct {
+		TagName string `json:"tag_name"`
+		Assets  struct {
+			Links []struct {
+				Name string `json:"name"`
+				URL  string `json:"url"`
+			} `json:"links"`
+		} `json:"assets"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "gl-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.EscapedPath() {
+		case "/api/v4/projects/group%2Fapp/uploads":
+			json.NewEncoder(w).Encode(map[string]string{"url": "/uploads/abc/app.zip"})
+		case "/api/v4/projects/group%2Fapp/releases":
+			json.NewDecoder(r.Body).Decode(&created)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"_links":{"self":"https://gitlab.example.com/group/app/-/releases/v0.1.0"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	outputs := run(t, NewReleasePlugin(), "gitlab-release", dir, map[string]interface{}{
+		"apiUrl": server.URL + "/api/v4",
+		"assets": "app.zip",
+		"env":    map[string]string{"GITLAB_TOKEN": "gl-token"},
+	})
+	if outputs["url"] != "https://gitlab.example.com/group/app/-/releases/v0.1.0" {
+		t.Errorf("gitlab-release = %v, want the release URL", outputs)
+	}
+	if created.TagName != "v0.1.0" || len(created.Assets.Links) != 1 || created.Assets.Links[0].URL != server.URL+"/group/app/uploads/abc/app.zip" {
+		t.Errorf("created release = %+v, want v0.1.0 linking the upload", created)
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "main.txt"), []byte("hello\n"), 0644)
+	// A stale output in the working directory must not be compared
+	os.MkdirAll(filepath.Join(dir, "dist"), 0755)
+	os.WriteFile(filepath.Join(dir, "dist", "stale.txt"), []byte("old"), 0644)
+
+	outputs := run(t, NewReleasePlugin(), "reproducible", dir, map[string]interface{}{
+		"command": "mkdir -p dist && cp main.txt dist/app.txt && cp main.txt dist/copy.txt",
+		"paths":   []interface{}{"dist"},
+	})
+	if outputs["reproducible"] != true || outputs["files"] != 2 {
+		t.Errorf("outputs = %v, want 2 reproducible files", outputs)
+	}
+
+	outputs, err := NewReleasePlugin().Execute(context.Background(), core.Step{Type: "reproducible", Config: map[string]interface{}{
+		"workDir": dir,
+		"command": "mkdir -p dist && date +%N > dist/stamp.txt && cp main.txt dist/app.txt && printf '\\000\\001%s' $(date +%N) > dist/random.bin && tar -cf dist/app.tar main.txt dist/stamp.txt",
+		"paths":   "dist",
+	}})
+	if err == nil || !strings.Contains(err.Error(), "files differ") {
+		t.Fatalf("Execute() error = %v, want files differ", err)
+	}
+	differences := outputs["differences"].([]Difference)
+	byPath := make(map[string]Difference)
+	for _, d := range differences {
+		byPath[d.Path] = d
+	}
+	if _, ok := byPath["dist/app.txt"]; ok || len(differences) != 3 {
+		t.Fatalf("differences = %+v, want stamp.txt, random.bin and app.tar", differences)
+	}
+	if d := byPath["dist/stamp.txt"]; d.Kind != DiffContent || len(d.Detail) != 1 || !strings.HasPrefix(d.Detail[0], "line 1: ") {
+		t.Errorf("stamp.txt = %+v, want its first line", d)
+	}
+	if d := byPath["dist/app.tar"]; len(d.Detail) == 0 || !strings.Contains(strings.Join(d.Detail, "\n"), "entry dist/stamp.txt: content differs") {
+		t.Errorf("app.tar = %+v, want the differing entry", d)
+	}
+	if d := byPath["dist/random.bin"]; len(d.Detail) != 1 || !strings.HasPrefix(d.Detail[0], "binary files differ from byte ") {
+		t.Errorf("random.bin = %+v, want the offset of the change", d)
+	}
+	if annotations := outputs["annotations"].([]core.Annotation); len(annotations) != 3 || annotations[0].Level != core.AnnotationError {
+		t.Errorf("annotations = %+v, want an error per difference", annotations)
+	}
+}
+
+func TestReproducible_AgainstRelease(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "main.txt"), []byte("hello\n"), 0644)
+	release := t.TempDir()
+	os.MkdirAll(filepath.Join(release, "dist", "dist"), 0755)
+	os.WriteFile(filepath.Join(release, "dist", "dist", "app.txt"), []byte("hello\n"), 0755)
+
+	config := map[string]interface{}{
+		"against": "release",
+		"command": "mkdir -p dist && cp main.txt dist/app.txt",
+		"paths":   "dist",
+		"env":     map[string]string{"CONVEYOR_RELEASE": "rc1", "CONVEYOR_RELEASE_DIR": release},
+	}
+	config["failOnDiff"] = false
+	outputs := run(t, NewReleasePlugin(), "reproducible", dir, config)
+	differences := outputs["differences"].([]Difference)
+	if outputs["reproducible"] != false || len(differences) != 1 || differences[0].Kind != DiffMode {
+		t.Errorf("differences = %+v, want the release's mode", differences)
+	}
+
+	config["artifact"] = "binaries"
+	if _, err := NewReleasePlugin().Execute(context.Background(), core.Step{Type: "reproducible", Config: config}); err == nil || !strings.Contains(err.Error(), "no artifact binaries") {
+		t.Errorf("Execute() error = %v, want a missing artifact", err)
+	}
+}
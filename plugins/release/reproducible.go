@@ -0,0 +1,594 @@
+package release
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/plugins/pluginutil"
+)
+
+// Reproducibility check modes
+const (
+	// ModeRebuild builds twice and compares the builds
+	ModeRebuild = "rebuild"
+	// ModeRelease builds once and compares the build with the promoted
+	// release the job uses
+	ModeRelease = "release"
+)
+
+// Kinds of differences between builds
+const (
+	DiffMissing = "missing"
+	DiffExtra   = "extra"
+	DiffContent = "content"
+	DiffMode    = "mode"
+)
+
+// maxDetail bounds the lines describing one difference
+const maxDetail = 20
+
+// Difference is a file that differs between the expected build, the first
+// build or the release, and the actual build
+type Difference struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+	// Expected and Actual are the SHA-256 digests of the file's contents
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	// Detail describes what differs: the first differing lines of text,
+	// the entries of archives or the offset of binary changes
+	Detail []string `json:"detail,omitempty"`
+}
+
+// verifyReproducible runs a reproducible step: it builds with the step's
+// command in fresh copies of the working directory and compares the files
+// its paths select, bit for bit
+func (p *ReleasePlugin) verifyReproducible(ctx context.Context, step core.Step, dir string, env map[string]string) (map[string]interface{}, error) {
+	command := pluginutil.String(step.Config, "command")
+	if strings.TrimSpace(command) == "" {
+		return nil, fmt.Errorf("reproducible requires a command")
+	}
+	paths := pluginutil.StringList(step.Config, "paths")
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("reproducible requires the paths of the build's outputs")
+	}
+	mode := pluginutil.StringOr(step.Config, "against", ModeRebuild)
+	if mode != ModeRebuild && mode != ModeRelease {
+		return nil, fmt.Errorf("invalid against %q, want %s or %s", mode, ModeRebuild, ModeRelease)
+	}
+	if dir == "" {
+		dir = "."
+	}
+
+	expected := ""
+	if mode == ModeRelease {
+		var err error
+		if expected, err = releaseArtifactDir(env, pluginutil.String(step.Config, "artifact")); err != nil {
+			return nil, err
+		}
+	}
+
+	scratch, err := os.MkdirTemp("", "conveyor-reproducible-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create build directory: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	shell := pluginutil.StringOr(step.Config, "shell", "sh")
+	builds := []string{"release"}
+	if mode == ModeRebuild {
+		builds = []string{"first", "second"}
+	}
+	var actual string
+	for _, name := range builds {
+		build := filepath.Join(scratch, name)
+		core.LogStep(ctx, "info", fmt.Sprintf("Building in a copy of the working directory (%s build)", name))
+		if err := prepareBuild(dir, build, paths); err != nil {
+			return nil, err
+		}
+		if err := runBuild(ctx, build, shell, command, env); err != nil {
+			return nil, fmt.Errorf("%s build failed: %w", name, err)
+		}
+		if expected == "" {
+			expected = build
+		} else {
+			actual = build
+		}
+	}
+
+	want, err := buildFiles(expected, paths)
+	if err != nil {
+		return nil, err
+	}
+	got, err := buildFiles(actual, paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(want) == 0 && len(got) == 0 {
+		return nil, fmt.Errorf("no files match the paths %s", strings.Join(paths, ", "))
+	}
+	differences, digest, err := compareBuilds(expected, actual, want, got)
+	if err != nil {
+		return nil, err
+	}
+
+	annotations := make([]core.Annotation, 0, len(differences))
+	for _, d := range differences {
+		message := fmt.Sprintf("not reproducible: %s", d.Kind)
+		if len(d.Detail) > 0 {
+			message += ": " + d.Detail[0]
+		}
+		core.LogStep(ctx, "warn", d.Path+" "+message)
+		annotations = append(annotations, core.Annotation{Path: d.Path, Level: core.AnnotationError, Message: message, Rule: "reproducible", Source: "reproducible"})
+	}
+	outputs := map[string]interface{}{
+		"against":      mode,
+		"reproducible": len(differences) == 0,
+		"files":        len(got),
+		"digest":       digest,
+		"differences":  differences,
+		"annotations":  annotations,
+	}
+	if len(differences) > 0 && pluginutil.Bool(step.Config, "failOnDiff", true) {
+		return outputs, fmt.Errorf("%d files differ between builds", len(differences))
+	}
+	return outputs, nil
+}
+
+// releaseArtifactDir returns the directory of an artifact of the release
+// the job uses, by default its only artifact
+func releaseArtifactDir(env map[string]string, artifact string) (string, error) {
+	root := env["CONVEYOR_RELEASE_DIR"]
+	if root == "" {
+		return "", fmt.Errorf("against release requires a pipeline with a release")
+	}
+	if artifact != "" {
+		dir := filepath.Join(root, artifact)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return "", fmt.Errorf("release %s has no artifact %s", env["CONVEYOR_RELEASE"], artifact)
+		}
+		return dir, nil
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return "", fmt.Errorf("failed to read release: %w", err)
+	}
+	if len(entries) != 1 {
+		return "", fmt.Errorf("release %s has %d artifacts, set the artifact to compare with", env["CONVEYOR_RELEASE"], len(entries))
+	}
+	return filepath.Join(root, entries[0].Name()), nil
+}
+
+// prepareBuild copies the working directory to dest without the files
+// matching paths, so a build can't pass by reusing earlier outputs
+func prepareBuild(src, dest string, paths []string) error {
+	outputs, err := buildFiles(src, paths)
+	if err != nil {
+		return err
+	}
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if _, ok := outputs[filepath.ToSlash(rel)]; ok {
+			return nil
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy working directory: %w", err)
+	}
+	return nil
+}
+
+// copyFile copies a regular file
+func copyFile(src, dest string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// runBuild runs the build command in dir with env added to the server's
+// environment. A failed build's error ends with the tail of its output.
+func runBuild(ctx context.Context, dir, shell, command string, env map[string]string) error {
+	cmd := exec.CommandContext(ctx, shell, "-c", command)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		if len(lines) > 10 {
+			lines = lines[len(lines)-10:]
+		}
+		return fmt.Errorf("%v\n%s", err, strings.Join(lines, "\n"))
+	}
+	return nil
+}
+
+// buildFiles returns the regular files matching the glob patterns under
+// root, recursing into directories, by slash-separated relative path
+func buildFiles(root string, patterns []string) (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(root, filepath.FromSlash(pattern)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %q: %w", pattern, err)
+		}
+		for _, match := range matches {
+			err := filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil || !info.Mode().IsRegular() {
+					return err
+				}
+				rel, err := filepath.Rel(root, path)
+				if err != nil {
+					return err
+				}
+				files[filepath.ToSlash(rel)] = info
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to list %s: %w", match, err)
+			}
+		}
+	}
+	return files, nil
+}
+
+// compareBuilds compares the files of two builds by path. It returns their
+// differences and a digest of the actual build's paths and contents.
+func compareBuilds(expectedRoot, actualRoot string, expected, actual map[string]os.FileInfo) ([]Difference, string, error) {
+	paths := make([]string, 0, len(expected)+len(actual))
+	for path := range expected {
+		paths = append(paths, path)
+	}
+	for path := range actual {
+		if _, ok := expected[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	tree := sha256.New()
+	differences := []Difference{}
+	for _, path := range paths {
+		want, inExpected := expected[path]
+		got, inActual := actual[path]
+		var wantSum, gotSum string
+		var err error
+		if inExpected {
+			if wantSum, err = fileDigest(filepath.Join(expectedRoot, path)); err != nil {
+				return nil, "", err
+			}
+		}
+		if inActual {
+			if gotSum, err = fileDigest(filepath.Join(actualRoot, path)); err != nil {
+				return nil, "", err
+			}
+			fmt.Fprintf(tree, "%s %s\n", gotSum, path)
+		}
+
+		d := Difference{Path: path, Expected: wantSum, Actual: gotSum}
+		switch {
+		case !inActual:
+			d.Kind = DiffMissing
+		case !inExpected:
+			d.Kind = DiffExtra
+		case wantSum != gotSum:
+			d.Kind = DiffContent
+			d.Detail = describeDifference(path, filepath.Join(expectedRoot, path), filepath.Join(actualRoot, path))
+		case want.Mode().Perm() != got.Mode().Perm():
+			d.Kind = DiffMode
+			d.Detail = []string{fmt.Sprintf("mode %s, was %s", got.Mode().Perm(), want.Mode().Perm())}
+		default:
+			continue
+		}
+		differences = append(differences, d)
+	}
+	return differences, "sha256:" + hex.EncodeToString(tree.Sum(nil)), nil
+}
+
+// fileDigest returns the hex SHA-256 of a file
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// describeDifference explains how two versions of a file differ. Archives
+// are compared entry by entry, since timestamps and ordering inside them
+// are the most common sources of non-determinism.
+func describeDifference(name, expected, actual string) []string {
+	var detail []string
+	var err error
+	switch lower := strings.ToLower(name); {
+	case hasSuffix(lower, ".zip", ".jar", ".war", ".whl", ".apk", ".nupkg"):
+		detail, err = diffZip(expected, actual)
+	case hasSuffix(lower, ".tar"):
+		detail, err = diffTar(expected, actual, false)
+	case hasSuffix(lower, ".tar.gz", ".tgz"):
+		detail, err = diffTar(expected, actual, true)
+	default:
+		detail, err = diffBytes(expected, actual)
+	}
+	if err != nil {
+		detail, _ = diffBytes(expected, actual)
+	}
+	if len(detail) > maxDetail {
+		detail = append(detail[:maxDetail], fmt.Sprintf("... and %d more", len(detail)-maxDetail))
+	}
+	return detail
+}
+
+func hasSuffix(s string, suffixes ...string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveEntry is what is compared of an archive's entry
+type archiveEntry struct {
+	index    int
+	digest   string
+	modified string
+	mode     os.FileMode
+	owner    string
+}
+
+// diffEntries describes the differences between the entries of two
+// archives
+func diffEntries(expected, actual map[string]archiveEntry, order []string) []string {
+	var detail []string
+	reordered := false
+	for _, name := range order {
+		want, inExpected := expected[name]
+		got, inActual := actual[name]
+		switch {
+		case !inActual:
+			detail = append(detail, fmt.Sprintf("entry %s is missing", name))
+		case !inExpected:
+			detail = append(detail, fmt.Sprintf("entry %s is new", name))
+		default:
+			if want.digest != got.digest {
+				detail = append(detail, fmt.Sprintf("entry %s: content differs", name))
+			}
+			if want.modified != got.modified {
+				detail = append(detail, fmt.Sprintf("entry %s: modified %s, was %s", name, got.modified, want.modified))
+			}
+			if want.mode != got.mode {
+				detail = append(detail, fmt.Sprintf("entry %s: mode %s, was %s", name, got.mode, want.mode))
+			}
+			if want.owner != got.owner {
+				detail = append(detail, fmt.Sprintf("entry %s: owner %s, was %s", name, got.owner, want.owner))
+			}
+			reordered = reordered || want.index != got.index
+		}
+	}
+	if reordered {
+		detail = append(detail, "entries are in a different order")
+	}
+	return detail
+}
+
+// entryOrder returns the names of the entries of both archives, sorted
+func entryOrder(expected, actual map[string]archiveEntry) []string {
+	names := make([]string, 0, len(expected)+len(actual))
+	for name := range expected {
+		names = append(names, name)
+	}
+	for name := range actual {
+		if _, ok := expected[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// diffZip compares the entries of two zip archives
+func diffZip(expected, actual string) ([]string, error) {
+	want, err := zipEntries(expected)
+	if err != nil {
+		return nil, err
+	}
+	got, err := zipEntries(actual)
+	if err != nil {
+		return nil, err
+	}
+	return diffEntries(want, got, entryOrder(want, got)), nil
+}
+
+func zipEntries(path string) (map[string]archiveEntry, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	entries := make(map[string]archiveEntry, len(r.File))
+	for i, f := range r.File {
+		entries[f.Name] = archiveEntry{
+			index:    i,
+			digest:   fmt.Sprintf("%08x", f.CRC32),
+			modified: f.Modified.UTC().Format("2006-01-02T15:04:05Z"),
+			mode:     f.Mode(),
+		}
+	}
+	return entries, nil
+}
+
+// diffTar compares the entries of two tar archives, and the headers of
+// gzipped ones
+func diffTar(expected, actual string, gzipped bool) ([]string, error) {
+	want, wantHeader, err := tarEntries(expected, gzipped)
+	if err != nil {
+		return nil, err
+	}
+	got, gotHeader, err := tarEntries(actual, gzipped)
+	if err != nil {
+		return nil, err
+	}
+	var detail []string
+	if wantHeader != gotHeader {
+		detail = append(detail, fmt.Sprintf("gzip header: %s, was %s", gotHeader, wantHeader))
+	}
+	return append(detail, diffEntries(want, got, entryOrder(want, got))...), nil
+}
+
+func tarEntries(path string, gzipped bool) (map[string]archiveEntry, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	var r io.Reader = bufio.NewReader(f)
+	header := ""
+	if gzipped {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, "", err
+		}
+		defer gz.Close()
+		header = fmt.Sprintf("name %q, modified %s", gz.Name, gz.ModTime.UTC().Format("2006-01-02T15:04:05Z"))
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	entries := make(map[string]archiveEntry)
+	for i := 0; ; i++ {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return entries, header, nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		sum := sha256.New()
+		if _, err := io.Copy(sum, tr); err != nil {
+			return nil, "", err
+		}
+		entries[h.Name] = archiveEntry{
+			index:    i,
+			digest:   hex.EncodeToString(sum.Sum(nil)),
+			modified: h.ModTime.UTC().Format("2006-01-02T15:04:05Z"),
+			mode:     os.FileMode(h.Mode),
+			owner:    fmt.Sprintf("%d:%d", h.Uid, h.Gid),
+		}
+	}
+}
+
+// diffBytes describes the first differing lines of text files, or the
+// first differing byte of binary files
+func diffBytes(expected, actual string) ([]string, error) {
+	want, err := os.ReadFile(expected)
+	if err != nil {
+		return nil, err
+	}
+	got, err := os.ReadFile(actual)
+	if err != nil {
+		return nil, err
+	}
+	if isText(want) && isText(got) {
+		return diffLines(string(want), string(got)), nil
+	}
+	offset := 0
+	for offset < len(want) && offset < len(got) && want[offset] == got[offset] {
+		offset++
+	}
+	return []string{fmt.Sprintf("binary files differ from byte %d (sizes %d and %d)", offset, len(want), len(got))}, nil
+}
+
+// isText reports whether data looks like text
+func isText(data []byte) bool {
+	head := data
+	if len(head) > 8192 {
+		head = head[:8192]
+	}
+	return utf8.Valid(data) && bytes.IndexByte(head, 0) < 0
+}
+
+// diffLines describes up to five differing lines of two texts
+func diffLines(expected, actual string) []string {
+	want := strings.Split(expected, "\n")
+	got := strings.Split(actual, "\n")
+	var detail []string
+	for i := 0; i < len(want) || i < len(got); i++ {
+		var w, g string
+		if i < len(want) {
+			w = want[i]
+		}
+		if i < len(got) {
+			g = got[i]
+		}
+		if w == g {
+			continue
+		}
+		if len(detail) == 5 {
+			detail = append(detail, "...")
+			break
+		}
+		detail = append(detail, fmt.Sprintf("line %d: %q, was %q", i+1, truncateLine(g), truncateLine(w)))
+	}
+	return detail
+}
+
+// truncateLine shortens a line for a difference's detail
+func truncateLine(line string) string {
+	if len(line) <= 120 {
+		return line
+	}
+	return line[:120] + "..."
+}
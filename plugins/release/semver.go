@@ -0,0 +1,163 @@
+package release
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version
+type Version struct {
+	Major      int
+	Minor      int
+	Patch      int
+	Prerelease string
+}
+
+// versionPattern matches MAJOR.MINOR.PATCH with an optional pre-release and
+// build metadata
+var versionPattern = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// ParseVersion parses a semantic version such as 1.4.2 or 2.0.0-rc.1
+func ParseVersion(s string) (Version, error) {
+	match := versionPattern.FindStringSubmatch(s)
+	if match == nil {
+		return Version{}, fmt.Errorf("invalid semantic version %q", s)
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	patch, _ := strconv.Atoi(match[3])
+	return Version{Major: major, Minor: minor, Patch: patch, Prerelease: match[4]}, nil
+}
+
+// String formats the version without a tag prefix
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Prerelease != "" {
+		s += "-" + v.Prerelease
+	}
+	return s
+}
+
+// Less reports whether v has lower precedence than other. Pre-releases
+// compare as strings, which orders rc.1 before rc.2 but not rc.9 before rc.10.
+func (v Version) Less(other Version) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	}
+	if v.Patch != other.Patch {
+		return v.Patch < other.Patch
+	}
+	if v.Prerelease == "" || other.Prerelease == "" {
+		return v.Prerelease != "" && other.Prerelease == ""
+	}
+	return v.Prerelease < other.Prerelease
+}
+
+// Bump levels, in increasing order
+const (
+	BumpNone  = "none"
+	BumpPatch = "patch"
+	BumpMinor = "minor"
+	BumpMajor = "major"
+)
+
+// bumpRank orders bump levels
+var bumpRank = map[string]int{BumpNone: 0, BumpPatch: 1, BumpMinor: 2, BumpMajor: 3}
+
+// Bump returns the version after a bump. Before 1.0.0, breaking changes bump
+// the minor version and features the patch version.
+func (v Version) Bump(bump string) Version {
+	if v.Major == 0 {
+		switch bump {
+		case BumpMajor:
+			bump = BumpMinor
+		case BumpMinor:
+			bump = BumpPatch
+		}
+	}
+	next := Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch}
+	switch bump {
+	case BumpMajor:
+		next = Version{Major: v.Major + 1}
+	case BumpMinor:
+		next = Version{Major: v.Major, Minor: v.Minor + 1}
+	case BumpPatch:
+		// A pre-release is released as its version
+		if v.Prerelease == "" {
+			next.Patch++
+		}
+	default:
+		return v
+	}
+	return next
+}
+
+// Commit is a commit parsed as a conventional commit
+type Commit struct {
+	Hash    string `json:"hash"`
+	Type    string `json:"type,omitempty"`
+	Scope   string `json:"scope,omitempty"`
+	Subject string `json:"subject"`
+	// Breaking is set by a "!" after the type or a BREAKING CHANGE footer
+	Breaking bool   `json:"breaking,omitempty"`
+	Note     string `json:"note,omitempty"`
+}
+
+// headerPattern matches a conventional commit header: type(scope)!: subject
+var headerPattern = regexp.MustCompile(`^([A-Za-z]+)(?:\(([^)]*)\))?(!)?: (.+)$`)
+
+// breakingPattern matches a breaking change footer
+var breakingPattern = regexp.MustCompile(`(?m)^BREAKING[ -]CHANGE: (.+)$`)
+
+// ParseCommit parses a commit message. Messages that don't follow the
+// conventional commits format keep their first line as subject and no type.
+func ParseCommit(hash, message string) Commit {
+	lines := strings.SplitN(strings.TrimSpace(message), "\n", 2)
+	commit := Commit{Hash: hash, Subject: strings.TrimSpace(lines[0])}
+	if match := headerPattern.FindStringSubmatch(commit.Subject); match != nil {
+		commit.Type = strings.ToLower(match[1])
+		commit.Scope = match[2]
+		commit.Breaking = match[3] == "!"
+		commit.Subject = match[4]
+	}
+	if len(lines) > 1 && commit.Type != "" {
+		if match := breakingPattern.FindStringSubmatch(lines[1]); match != nil {
+			commit.Breaking = true
+			commit.Note = strings.TrimSpace(match[1])
+		}
+	}
+	if commit.Breaking && commit.Note == "" {
+		commit.Note = commit.Subject
+	}
+	return commit
+}
+
+// commitBump returns the bump a commit calls for: major for breaking
+// changes, minor for features and patch for fixes and performance changes
+func commitBump(commit Commit) string {
+	switch {
+	case commit.Breaking:
+		return BumpMajor
+	case commit.Type == "feat":
+		return BumpMinor
+	case commit.Type == "fix" || commit.Type == "perf":
+		return BumpPatch
+	}
+	return BumpNone
+}
+
+// NextBump returns the highest bump the commits call for
+func NextBump(commits []Commit) string {
+	bump := BumpNone
+	for _, commit := range commits {
+		if b := commitBump(commit); bumpRank[b] > bumpRank[bump] {
+			bump = b
+		}
+	}
+	return bump
+}
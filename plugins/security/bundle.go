@@ -0,0 +1,156 @@
+package security
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bundleManifestFile describes the databases of a bundle
+const bundleManifestFile = "bundle.json"
+
+// BundleManifest describes a database bundle for offline mode
+type BundleManifest struct {
+	CreatedAt time.Time        `json:"createdAt"`
+	Databases []BundleDatabase `json:"databases"`
+}
+
+// BundleDatabase is a database file of a bundle
+type BundleDatabase struct {
+	Name    string `json:"name"`
+	File    string `json:"file"`
+	Source  string `json:"source"`
+	Entries int    `json:"entries"`
+	SHA256  string `json:"sha256"`
+}
+
+// Bundle fetches every EPSS score and the KEV catalog into the enricher's
+// directory, so an offline enricher opened on it has complete databases,
+// and writes the bundle's manifest
+func (e *Enricher) Bundle(ctx context.Context) (BundleManifest, error) {
+	if e.dir == "" {
+		return BundleManifest{}, fmt.Errorf("a database bundle needs a directory")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now().UTC()
+	if err := e.fetchKEV(ctx, now); err != nil {
+		return BundleManifest{}, fmt.Errorf("failed to fetch the KEV catalog: %w", err)
+	}
+	if err := e.fetchEPSSFeed(ctx, now); err != nil {
+		return BundleManifest{}, fmt.Errorf("failed to fetch EPSS scores: %w", err)
+	}
+
+	manifest := BundleManifest{CreatedAt: now}
+	for _, db := range []BundleDatabase{
+		{Name: "kev", File: "kev.json", Source: e.KEVURL, Entries: len(e.kev.CVEs)},
+		{Name: "epss", File: "epss.json", Source: e.EPSSFeedURL, Entries: len(e.epss)},
+	} {
+		sum, err := fileSHA256(filepath.Join(e.dir, db.File))
+		if err != nil {
+			return BundleManifest{}, err
+		}
+		db.SHA256 = sum
+		manifest.Databases = append(manifest.Databases, db)
+	}
+	return manifest, e.save(bundleManifestFile, manifest)
+}
+
+// fetchEPSSFeed replaces the cached EPSS scores with the scores of every
+// CVE from the gzipped CSV feed. Callers must hold e.mu.
+func (e *Enricher) fetchEPSSFeed(ctx context.Context, now time.Time) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.EPSSFeedURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", e.EPSSFeedURL, resp.Status)
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s: %w", e.EPSSFeedURL, err)
+	}
+	defer gz.Close()
+
+	// The feed starts with a #model_version comment and a header row
+	reader := csv.NewReader(gz)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	scores := make(map[string]epssScore)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", e.EPSSFeedURL, err)
+		}
+		if len(record) < 3 || !isCVE(record[0]) {
+			continue
+		}
+		score, err := strconv.ParseFloat(record[1], 64)
+		if err != nil {
+			return fmt.Errorf("invalid EPSS score %q for %s", record[1], record[0])
+		}
+		percentile, _ := strconv.ParseFloat(record[2], 64)
+		scores[strings.ToUpper(record[0])] = epssScore{Score: score, Percentile: percentile, FetchedAt: now}
+	}
+	if len(scores) == 0 {
+		return fmt.Errorf("%s has no scores", e.EPSSFeedURL)
+	}
+	e.epss = scores
+	return e.save("epss.json", e.epss)
+}
+
+// ReadBundle reads the manifest of the bundle in dir and verifies the
+// checksums of its databases
+func ReadBundle(dir string) (BundleManifest, error) {
+	var manifest BundleManifest
+	data, err := os.ReadFile(filepath.Join(dir, bundleManifestFile))
+	if err != nil {
+		return manifest, fmt.Errorf("failed to read database bundle: %w", err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("failed to decode database bundle manifest: %w", err)
+	}
+	for _, db := range manifest.Databases {
+		sum, err := fileSHA256(filepath.Join(dir, db.File))
+		if err != nil {
+			return manifest, err
+		}
+		if sum != db.SHA256 {
+			return manifest, fmt.Errorf("database bundle file %s doesn't match its checksum", db.File)
+		}
+	}
+	return manifest, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read bundle file: %w", err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to read bundle file: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
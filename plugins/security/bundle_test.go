@@ -0,0 +1,87 @@
+package security
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/chip/conveyor/core"
+)
+
+func TestEnricher_BundleForOffline(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/kev":
+			fmt.Fprint(w, `{"vulnerabilities": [{"cveID": "CVE-2021-44228"}]}`)
+		case "/epss.csv.gz":
+			gz := gzip.NewWriter(w)
+			fmt.Fprint(gz, "#model_version:v2023.03.01,score_date:2024-01-01T00:00:00+0000\ncve,epss,percentile\nCVE-2021-44228,0.97565,0.99996\nCVE-2021-1234,0.00043,0.0824\n")
+			gz.Close()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	enricher, err := NewEnricher(dir, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	enricher.EPSSFeedURL, enricher.KEVURL = server.URL+"/epss.csv.gz", server.URL+"/kev"
+	manifest, err := enricher.Bundle(context.Background())
+	if err != nil {
+		t.Fatalf("Bundle() error = %v", err)
+	}
+	if len(manifest.Databases) != 2 || manifest.Databases[0].Entries != 1 || manifest.Databases[1].Entries != 2 {
+		t.Errorf("Bundle() = %+v, want the KEV catalog and both EPSS scores", manifest)
+	}
+	if _, err := ReadBundle(dir); err != nil {
+		t.Fatalf("ReadBundle() error = %v", err)
+	}
+
+	// An offline enricher only uses the bundle
+	requests = 0
+	offline, err := NewEnricher(dir, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	offline.Offline = true
+	findings := []Finding{{ID: "CVE-2021-44228"}, {ID: "CVE-2099-0001"}}
+	offline.Enrich(context.Background(), findings)
+	if requests != 0 || !findings[0].KEV || findings[0].EPSS != 0.97565 || findings[1].EPSS != 0 {
+		t.Errorf("requests = %d, findings = %+v, want the bundled scores", requests, findings)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "kev.json"), []byte(`{"cves": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadBundle(dir); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("ReadBundle() error = %v, want a checksum mismatch", err)
+	}
+}
+
+func TestCodeScan_OfflineRejectsRemoteRulesets(t *testing.T) {
+	plugin := NewSecurityPlugin()
+	config := plugin.GetConfig()
+	config.Offline = true
+	plugin.UpdateConfig(config)
+	plugin.runTool = func(ctx context.Context, dir string, env map[string]string, name string, args ...string) ([]byte, []byte, error) {
+		t.Errorf("ran %s offline with a remote ruleset", name)
+		return nil, nil, nil
+	}
+
+	step := core.Step{Type: "code-scan", Config: map[string]interface{}{"targetDir": t.TempDir(), "semgrep": "p/owasp-top-ten"}}
+	if _, err := plugin.Execute(context.Background(), step); err == nil || !strings.Contains(err.Error(), "offline") {
+		t.Errorf("Execute() error = %v, want the registry ruleset refused", err)
+	}
+}
@@ -0,0 +1,381 @@
+package security
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/plugins/pluginutil"
+)
+
+// CodeScanConfig configures the code scan. Rules are matched against each
+// line of the scanned files. SemgrepConfigs are Semgrep rule files,
+// directories or registry rulesets such as "p/owasp-top-ten", run with the
+// semgrep CLI for multi-line, syntax-aware matching; without any, the
+// target's .semgrep.yml or .semgrep directory is used when it has one.
+type CodeScanConfig struct {
+	Enabled        bool       `json:"enabled"`
+	Rules          []CodeRule `json:"rules,omitempty"`
+	SemgrepConfigs []string   `json:"semgrepConfigs,omitempty"`
+	// Ignore lists path prefixes that aren't scanned by line rules
+	Ignore []string `json:"ignore,omitempty"`
+	FailOn string   `json:"failOn,omitempty"`
+}
+
+// CodeRule is a pattern matched against each line of source
+type CodeRule struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Severity    string `json:"severity"`
+	Pattern     string `json:"pattern"`
+}
+
+// semgrepRuleFiles are the Semgrep configurations found in a target
+var semgrepRuleFiles = []string{".semgrep.yml", ".semgrep.yaml", ".semgrep"}
+
+// ValidateCodeRules checks that rules have an ID, a severity and a pattern
+// that compiles
+func ValidateCodeRules(rules []CodeRule) error {
+	for _, rule := range rules {
+		if rule.ID == "" {
+			return fmt.Errorf("code rule %q needs an id", rule.Name)
+		}
+		if err := ValidateSeverity(rule.Severity); err != nil {
+			return fmt.Errorf("code rule %s: %w", rule.ID, err)
+		}
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return fmt.Errorf("code rule %s: invalid pattern: %w", rule.ID, err)
+		}
+	}
+	return nil
+}
+
+// executeCodeScan matches the code rules and runs the Semgrep rulesets of
+// the plugin and the step against the target directory. The step fails
+// when findings reach its failOn severity or the plugin's; with newOnly,
+// only findings the scope hasn't had before count.
+func (p *SecurityPlugin) executeCodeScan(ctx context.Context, scanID string, step core.Step) (map[string]interface{}, error) {
+	config := p.config.CodeScan
+	if !config.Enabled {
+		return map[string]interface{}{
+			"status": "skipped",
+			"reason": "code scan is disabled",
+		}, nil
+	}
+
+	failOn := config.FailOn
+	if value, ok := step.Config["failOn"].(string); ok {
+		if err := ValidateSeverity(value); err != nil {
+			return nil, err
+		}
+		failOn = value
+	}
+	rules := append([]CodeRule{}, config.Rules...)
+	if custom, ok := step.Config["customRules"]; ok {
+		stepRules, err := decodeCodeRules(custom)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, stepRules...)
+	}
+	if err := ValidateCodeRules(rules); err != nil {
+		return nil, err
+	}
+
+	dir, _ := step.Config["targetDir"].(string)
+	if dir == "" {
+		dir, _ = step.Config["workDir"].(string)
+	}
+	semgrepConfigs := append(append([]string{}, config.SemgrepConfigs...), pluginutil.StringList(step.Config, "semgrep")...)
+	if len(semgrepConfigs) == 0 {
+		for _, name := range semgrepRuleFiles {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				semgrepConfigs = []string{name}
+				break
+			}
+		}
+	}
+	if len(semgrepConfigs) > 0 && !core.FeatureEnabled(ctx, core.FeatureSemgrepScans) {
+		core.LogStep(ctx, "warn", fmt.Sprintf("Skipping Semgrep rulesets %s: the %s feature flag is off", strings.Join(semgrepConfigs, ", "), core.FeatureSemgrepScans))
+		semgrepConfigs = nil
+	}
+	if len(rules) == 0 && len(semgrepConfigs) == 0 {
+		return map[string]interface{}{
+			"status": "skipped",
+			"reason": "no code rules or Semgrep rulesets are configured",
+		}, nil
+	}
+	if p.config.Offline {
+		for _, ruleset := range semgrepConfigs {
+			if remoteRuleset(ruleset) {
+				return nil, fmt.Errorf("semgrep ruleset %s is fetched from the network, which offline mode doesn't allow; use a local rule file", ruleset)
+			}
+		}
+	}
+
+	budget, err := p.scanBudget()
+	if err != nil {
+		return nil, err
+	}
+	// A canceled scan is recorded with the findings made so far
+	findings, err := matchCodeRules(ctx, budget, dir, rules, config.Ignore)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		return nil, err
+	}
+	canceled := err != nil
+	if len(semgrepConfigs) > 0 && !canceled {
+		activeScanFrom(ctx).setPhase(PhaseSemgrep)
+		env := registryEnv(p.config.Dependencies, stepLookup(step))
+		if p.config.Offline {
+			env["SEMGREP_ENABLE_VERSION_CHECK"] = "0"
+		}
+		semgrepFindings, err := p.runSemgrep(ctx, dir, semgrepConfigs, env)
+		if errors.Is(err, context.Canceled) {
+			canceled = true
+		} else if err != nil {
+			return nil, err
+		}
+		findings = append(findings, semgrepFindings...)
+	}
+
+	pipelineID, _ := step.Config["pipelineId"].(string)
+	jobID, _ := step.Config["jobId"].(string)
+	scan := Scan{
+		ID:            scanID,
+		Type:          "code",
+		PipelineID:    pipelineID,
+		JobID:         jobID,
+		Status:        "completed",
+		Timestamp:     time.Now(),
+		FindingsCount: len(findings),
+		Findings:      findings,
+		Metadata:      map[string]interface{}{"rules": len(rules), "semgrep": semgrepConfigs},
+	}
+	countSeverities(&scan)
+	outputs := map[string]interface{}{"scan": scan}
+	if active := activeScanFrom(ctx); active != nil {
+		outputs["progress"] = active.snapshot()
+	}
+	if canceled {
+		scan.Status = "canceled"
+		scan.Metadata["partial"] = true
+		outputs["scan"] = scan
+		return outputs, fmt.Errorf("code scan canceled with %d findings so far", len(findings))
+	}
+	newOnly, _ := step.Config["newOnly"].(bool)
+	if failing := p.gate(&scan, stepScope(step), failOn, newOnly); failing > 0 {
+		outputs["scan"] = scan
+		return outputs, fmt.Errorf("code scan found %d issues at or above %s severity", failing, failOn)
+	}
+	return outputs, nil
+}
+
+// matchCodeRules matches rules against each line of the files under dir,
+// streaming them within the memory budget. The findings made before an
+// error are returned with it.
+func matchCodeRules(ctx context.Context, budget *memoryBudget, dir string, rules []CodeRule, ignore []string) ([]Finding, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	patterns := make([]*regexp.Regexp, len(rules))
+	for i, rule := range rules {
+		patterns[i] = regexp.MustCompile(rule.Pattern)
+	}
+
+	var mu sync.Mutex
+	var findings []Finding
+	err := scanFiles(ctx, budget, dir, ignore, func() lineMatcher {
+		return func(rel string, n int, line []byte) {
+			for i, pattern := range patterns {
+				if !pattern.Match(line) {
+					continue
+				}
+				rule := rules[i]
+				mu.Lock()
+				findings = append(findings, Finding{
+					ID:          rule.ID,
+					Type:        "code",
+					Title:       rule.Name,
+					Description: rule.Description,
+					Severity:    strings.ToLower(rule.Severity),
+					Path:        rel,
+					LineNumber:  n,
+					Context:     strings.TrimSpace(string(line)),
+					Metadata:    map[string]interface{}{"engine": "regex"},
+				})
+				mu.Unlock()
+			}
+		}
+	})
+	// Files are scanned concurrently, each by a single worker
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Path < findings[j].Path })
+	return findings, err
+}
+
+// runSemgrep runs the semgrep CLI with rulesets against dir and converts
+// its results to findings. env reaches the network through the proxy.
+func (p *SecurityPlugin) runSemgrep(ctx context.Context, dir string, configs []string, env map[string]string) ([]Finding, error) {
+	args := []string{"scan", "--json", "--quiet", "--metrics", "off"}
+	for _, config := range configs {
+		args = append(args, "--config", config)
+	}
+	stdout, stderr, err := p.runTool(ctx, dir, env, "semgrep", args...)
+	var notFound *exec.Error
+	if errors.As(err, &notFound) {
+		return nil, fmt.Errorf("semgrep rulesets are configured but semgrep is not installed: %w", err)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	var report semgrepReport
+	if decodeErr := json.Unmarshal(bytes.TrimSpace(stdout), &report); decodeErr != nil {
+		if msg := strings.TrimSpace(string(stderr)); msg != "" {
+			return nil, fmt.Errorf("semgrep failed: %s", msg)
+		}
+		return nil, fmt.Errorf("failed to parse semgrep report: %w", decodeErr)
+	}
+	if len(report.Results) == 0 && len(report.Errors) > 0 {
+		return nil, fmt.Errorf("semgrep failed: %s", report.Errors[0].Message)
+	}
+	return report.findings(), nil
+}
+
+// semgrepReport is the part of semgrep's JSON output findings are made of
+type semgrepReport struct {
+	Results []struct {
+		CheckID string `json:"check_id"`
+		Path    string `json:"path"`
+		Start   struct {
+			Line int `json:"line"`
+		} `json:"start"`
+		End struct {
+			Line int `json:"line"`
+		} `json:"end"`
+		Extra struct {
+			Message  string                 `json:"message"`
+			Severity string                 `json:"severity"`
+			Lines    string                 `json:"lines"`
+			Metadata map[string]interface{} `json:"metadata"`
+		} `json:"extra"`
+	} `json:"results"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func (r semgrepReport) findings() []Finding {
+	findings := make([]Finding, 0, len(r.Results))
+	for _, result := range r.Results {
+		metadata := map[string]interface{}{"engine": "semgrep"}
+		for _, key := range []string{"cwe", "owasp", "confidence", "references"} {
+			if value, ok := result.Extra.Metadata[key]; ok {
+				metadata[key] = value
+			}
+		}
+		if result.End.Line > result.Start.Line {
+			metadata["endLine"] = result.End.Line
+		}
+		title := result.CheckID[strings.LastIndex(result.CheckID, ".")+1:]
+		findings = append(findings, Finding{
+			ID:          result.CheckID,
+			Type:        "code",
+			Title:       title,
+			Description: strings.TrimSpace(result.Extra.Message),
+			Severity:    semgrepSeverity(result.Extra.Severity),
+			Path:        filepath.ToSlash(result.Path),
+			LineNumber:  result.Start.Line,
+			Context:     strings.TrimSpace(result.Extra.Lines),
+			Metadata:    metadata,
+		})
+	}
+	return findings
+}
+
+// semgrepSeverity maps Semgrep's ERROR, WARNING and INFO to severities
+func semgrepSeverity(severity string) string {
+	switch strings.ToUpper(severity) {
+	case "ERROR":
+		return "high"
+	case "WARNING":
+		return "medium"
+	default:
+		return "low"
+	}
+}
+
+// countSeverities counts a scan's findings by severity
+func countSeverities(scan *Scan) {
+	for _, finding := range scan.Findings {
+		switch finding.Severity {
+		case "critical", "high":
+			scan.HighCount++
+		case "medium":
+			scan.MediumCount++
+		case "low":
+			scan.LowCount++
+		}
+	}
+}
+
+// decodeCodeRules reads the customRules of a step
+func decodeCodeRules(value interface{}) ([]CodeRule, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var rules []CodeRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid customRules: %w", err)
+	}
+	return rules, nil
+}
+
+// ignored reports whether a path starts with one of the ignored prefixes
+func ignored(path string, ignore []string) bool {
+	for _, prefix := range ignore {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteRuleset reports whether semgrep fetches a ruleset from its registry
+// or a URL rather than reading it from disk
+func remoteRuleset(ruleset string) bool {
+	for _, prefix := range []string{"p/", "r/", "s/", "http://", "https://"} {
+		if strings.HasPrefix(ruleset, prefix) {
+			return true
+		}
+	}
+	return ruleset == "auto"
+}
+
+// runTool runs a tool in dir with env added to the server's environment
+// and returns its standard output and error
+func runTool(ctx context.Context, dir string, env map[string]string, name string, args ...string) ([]byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
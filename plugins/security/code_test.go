@@ -0,0 +1,126 @@
+package security
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chip/conveyor/core"
+)
+
+const semgrepOutput = `{"results":[{
+	"check_id":"python.lang.security.audit.dangerous-subprocess-use",
+	"path":"app/run.py",
+	"start":{"line":10,"col":5},
+	"end":{"line":13,"col":6},
+	"extra":{"message":"Detected subprocess call with shell=True","severity":"ERROR","lines":"subprocess.run(\n  cmd, shell=True)","metadata":{"cwe":["CWE-78"],"likelihood":"LOW"}}
+}],"errors":[]}`
+
+func TestCodeScan_Rules(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"src/db.go":           "package db\n\nquery := \"SELECT * FROM users WHERE id = \" + id\n",
+		"node_modules/x/a.js": "eval(input)\n",
+		"build/gen.js":        "eval(input)\n",
+		"src/app.js":          "const x = 1\neval(input)\n",
+		"logo.png":            "eval(\x00)",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plugin := NewSecurityPlugin()
+	plugin.config.CodeScan.Ignore = []string{"build/"}
+	plugin.config.CodeScan.Rules = []CodeRule{{ID: "JS-EVAL", Name: "eval", Severity: "high", Pattern: `\beval\(`}}
+	step := core.Step{Type: "code-scan", Config: map[string]interface{}{
+		"targetDir": dir,
+		"customRules": []interface{}{map[string]interface{}{
+			"id": "SQL-CONCAT", "name": "SQL built by concatenation", "severity": "MEDIUM", "pattern": `(?i)"select .*"\s*\+`,
+		}},
+	}}
+
+	outputs, err := plugin.Execute(context.Background(), step)
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	scan := outputs["scan"].(Scan)
+	found := make(map[string]bool)
+	for _, finding := range scan.Findings {
+		found[finding.ID+" "+finding.Path] = true
+	}
+	if len(scan.Findings) != 2 || !found["JS-EVAL src/app.js"] || !found["SQL-CONCAT src/db.go"] {
+		t.Errorf("Findings = %+v, want eval in src/app.js and SQL in src/db.go", scan.Findings)
+	}
+	if scan.HighCount != 1 || scan.MediumCount != 1 {
+		t.Errorf("counts = %d high, %d medium, want 1 and 1", scan.HighCount, scan.MediumCount)
+	}
+
+	step.Config["failOn"] = "high"
+	if _, err := plugin.Execute(context.Background(), step); err == nil {
+		t.Error("Execute() error = nil, want the eval finding to fail the step")
+	}
+
+	step.Config["customRules"] = []interface{}{map[string]interface{}{"id": "BAD", "severity": "high", "pattern": "("}}
+	if _, err := plugin.Execute(context.Background(), step); err == nil {
+		t.Error("Execute() error = nil, want an invalid pattern rejected")
+	}
+}
+
+func TestCodeScan_Semgrep(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".semgrep.yml"), []byte("rules: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var args []string
+	plugin := NewSecurityPlugin()
+	plugin.runTool = func(ctx context.Context, runDir string, env map[string]string, name string, a ...string) ([]byte, []byte, error) {
+		if runDir != dir || name != "semgrep" {
+			t.Errorf("ran %s in %s, want semgrep in the target", name, runDir)
+		}
+		args = a
+		return []byte(semgrepOutput), nil, nil
+	}
+
+	outputs, err := plugin.Execute(context.Background(), core.Step{Type: "code-scan", Config: map[string]interface{}{"targetDir": dir}})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if !strings.Contains(strings.Join(args, " "), "--config .semgrep.yml") {
+		t.Errorf("semgrep args = %v, want the target's rules detected", args)
+	}
+	scan := outputs["scan"].(Scan)
+	if len(scan.Findings) != 1 {
+		t.Fatalf("Findings = %+v, want the semgrep result", scan.Findings)
+	}
+	finding := scan.Findings[0]
+	if finding.Severity != "high" || finding.Path != "app/run.py" || finding.LineNumber != 10 || finding.Title != "dangerous-subprocess-use" {
+		t.Errorf("finding = %+v", finding)
+	}
+	if finding.Metadata["endLine"] != 13 || finding.Metadata["cwe"] == nil {
+		t.Errorf("Metadata = %v, want the end line and CWE", finding.Metadata)
+	}
+
+	plugin.runTool = func(ctx context.Context, dir string, env map[string]string, name string, a ...string) ([]byte, []byte, error) {
+		return nil, nil, &exec.Error{Name: name, Err: exec.ErrNotFound}
+	}
+	step := core.Step{Type: "code-scan", Config: map[string]interface{}{"targetDir": dir, "semgrep": "p/owasp-top-ten"}}
+	if _, err := plugin.Execute(context.Background(), step); err == nil || !strings.Contains(err.Error(), "not installed") {
+		t.Errorf("Execute() error = %v, want semgrep reported missing", err)
+	}
+}
+
+func TestCodeScan_SkippedWithoutRules(t *testing.T) {
+	plugin := NewSecurityPlugin()
+	outputs, err := plugin.Execute(context.Background(), core.Step{Type: "code-scan", Config: map[string]interface{}{"targetDir": t.TempDir()}})
+	if err != nil || outputs["status"] != "skipped" {
+		t.Errorf("Execute() = %v, %v, want skipped", outputs, err)
+	}
+}
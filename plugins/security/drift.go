@@ -0,0 +1,384 @@
+package security
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chip/conveyor/core"
+)
+
+// DriftScanConfig configures the drift scan, which runs a read-only
+// terraform plan in each workspace and reports the resources whose real
+// state differs from their configuration
+type DriftScanConfig struct {
+	Enabled bool   `json:"enabled"`
+	FailOn  string `json:"failOn,omitempty"`
+}
+
+// DriftWorkspace is a Terraform configuration a drift scan plans
+type DriftWorkspace struct {
+	// Name identifies the workspace in findings. Defaults to Dir, followed
+	// by the Terraform workspace when one is set.
+	Name string `json:"name,omitempty"`
+	// Dir is the configuration's directory relative to the target.
+	// Defaults to the target itself.
+	Dir string `json:"dir,omitempty"`
+	// Workspace is the Terraform workspace to plan, selected through
+	// TF_WORKSPACE. Defaults to the configuration's current workspace.
+	Workspace string   `json:"workspace,omitempty"`
+	VarFiles  []string `json:"varFiles,omitempty"`
+}
+
+// ValidateDriftWorkspaces checks that workspaces stay inside the target
+// and have distinct names
+func ValidateDriftWorkspaces(workspaces []DriftWorkspace) error {
+	names := make(map[string]bool, len(workspaces))
+	for _, workspace := range workspaces {
+		for _, p := range append([]string{workspace.Dir}, workspace.VarFiles...) {
+			if !insideTarget(p) {
+				return fmt.Errorf("drift workspace %s: %q is not a path inside the target", workspace.name(), p)
+			}
+		}
+		if names[workspace.name()] {
+			return fmt.Errorf("drift workspace %s is listed twice", workspace.name())
+		}
+		names[workspace.name()] = true
+	}
+	return nil
+}
+
+// insideTarget reports whether p is a relative path that doesn't leave
+// the directory it is relative to
+func insideTarget(p string) bool {
+	p = filepath.ToSlash(p)
+	if path.IsAbs(p) || filepath.IsAbs(p) {
+		return false
+	}
+	clean := path.Clean(p)
+	return clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// name returns the name findings of the workspace are reported under
+func (w DriftWorkspace) name() string {
+	if w.Name != "" {
+		return w.Name
+	}
+	name := normalizePath(w.Dir)
+	if name == "" {
+		name = "."
+	}
+	if w.Workspace != "" {
+		name += ":" + w.Workspace
+	}
+	return name
+}
+
+// executeDriftScan plans every workspace of the step without locking or
+// changing state. Each resource the plan would change is a finding, high
+// when it would be deleted or replaced. The step fails when findings reach
+// its failOn severity or the plugin's.
+func (p *SecurityPlugin) executeDriftScan(ctx context.Context, scanID string, step core.Step) (map[string]interface{}, error) {
+	config := p.config.DriftScan
+	if !config.Enabled {
+		return map[string]interface{}{
+			"status": "skipped",
+			"reason": "drift scan is disabled",
+		}, nil
+	}
+	if p.config.Offline {
+		return map[string]interface{}{
+			"status": "skipped",
+			"reason": "drift scan queries infrastructure providers, which offline mode doesn't allow",
+		}, nil
+	}
+
+	failOn := config.FailOn
+	if value, ok := step.Config["failOn"].(string); ok {
+		if err := ValidateSeverity(value); err != nil {
+			return nil, err
+		}
+		failOn = value
+	}
+	workspaces, err := decodeDriftWorkspaces(step.Config["workspaces"])
+	if err != nil {
+		return nil, err
+	}
+	if len(workspaces) == 0 {
+		return map[string]interface{}{
+			"status": "skipped",
+			"reason": "no Terraform workspaces are configured",
+		}, nil
+	}
+	if err := ValidateDriftWorkspaces(workspaces); err != nil {
+		return nil, err
+	}
+
+	dir, _ := step.Config["targetDir"].(string)
+	if dir == "" {
+		dir, _ = step.Config["workDir"].(string)
+	}
+	var findings []Finding
+	summaries := make(map[string]interface{}, len(workspaces))
+	for _, workspace := range workspaces {
+		planned, summary, err := p.planWorkspace(ctx, dir, workspace)
+		if err != nil {
+			return nil, fmt.Errorf("drift scan of %s failed: %w", workspace.name(), err)
+		}
+		core.LogStep(ctx, "info", fmt.Sprintf("Workspace %s: %d resources drifted", workspace.name(), len(planned)))
+		findings = append(findings, planned...)
+		summaries[workspace.name()] = summary
+	}
+
+	pipelineID, _ := step.Config["pipelineId"].(string)
+	jobID, _ := step.Config["jobId"].(string)
+	scan := Scan{
+		ID:            scanID,
+		Type:          "drift",
+		PipelineID:    pipelineID,
+		JobID:         jobID,
+		Status:        "completed",
+		Timestamp:     time.Now(),
+		FindingsCount: len(findings),
+		Findings:      findings,
+		Metadata:      map[string]interface{}{"workspaces": summaries},
+	}
+	countSeverities(&scan)
+	outputs := map[string]interface{}{"scan": scan, "drifted": len(findings) > 0}
+	newOnly, _ := step.Config["newOnly"].(bool)
+	if failing := p.gate(&scan, stepScope(step), failOn, newOnly); failing > 0 {
+		outputs["scan"] = scan
+		return outputs, fmt.Errorf("drift scan found %d drifted resources at or above %s severity", failing, failOn)
+	}
+	return outputs, nil
+}
+
+// planWorkspace initializes and plans a workspace, returning a finding for
+// every resource the plan would change and the plan's change summary
+func (p *SecurityPlugin) planWorkspace(ctx context.Context, target string, workspace DriftWorkspace) ([]Finding, map[string]int, error) {
+	dir := filepath.Join(target, filepath.FromSlash(workspace.Dir))
+	env := map[string]string{"TF_IN_AUTOMATION": "1", "TF_INPUT": "0"}
+	if workspace.Workspace != "" {
+		env["TF_WORKSPACE"] = workspace.Workspace
+	}
+
+	_, stderr, err := p.runTool(ctx, dir, env, "terraform", "init", "-input=false", "-lock=false", "-no-color")
+	var notFound *exec.Error
+	if errors.As(err, &notFound) {
+		return nil, nil, fmt.Errorf("drift scans need terraform, which is not installed: %w", err)
+	}
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("terraform init failed: %s", toolError(err, stderr))
+	}
+
+	args := []string{"plan", "-input=false", "-lock=false", "-detailed-exitcode", "-json"}
+	for _, file := range workspace.VarFiles {
+		args = append(args, "-var-file="+file)
+	}
+	stdout, stderr, err := p.runTool(ctx, dir, env, "terraform", args...)
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+	// -detailed-exitcode exits with 2 when the plan has changes
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 2) {
+		plan := parsePlan(stdout)
+		if len(plan.errors) > 0 {
+			return nil, nil, fmt.Errorf("terraform plan failed: %s", strings.Join(plan.errors, "; "))
+		}
+		return nil, nil, fmt.Errorf("terraform plan failed: %s", toolError(err, stderr))
+	}
+	plan := parsePlan(stdout)
+	return plan.findings(workspace), plan.summary, nil
+}
+
+// toolError describes a failed tool run by its stderr, or err without any
+func toolError(err error, stderr []byte) string {
+	if msg := strings.TrimSpace(string(stderr)); msg != "" {
+		return msg
+	}
+	return err.Error()
+}
+
+// planMessage is the part of a line of terraform plan -json output drift
+// findings are made of
+type planMessage struct {
+	Type   string `json:"type"`
+	Change struct {
+		Resource struct {
+			Addr         string `json:"addr"`
+			ResourceType string `json:"resource_type"`
+			Provider     string `json:"implied_provider"`
+		} `json:"resource"`
+		Action string `json:"action"`
+		Reason string `json:"reason"`
+	} `json:"change"`
+	Changes    map[string]interface{} `json:"changes"`
+	Diagnostic struct {
+		Severity string `json:"severity"`
+		Summary  string `json:"summary"`
+		Detail   string `json:"detail"`
+	} `json:"diagnostic"`
+}
+
+// driftedResource is a resource a plan would change, with the change made
+// to it outside of Terraform when the plan detected one
+type driftedResource struct {
+	addr         string
+	resourceType string
+	provider     string
+	action       string
+	reason       string
+	drift        string
+}
+
+// planOutput is a parsed terraform plan -json output
+type planOutput struct {
+	resources map[string]*driftedResource
+	summary   map[string]int
+	errors    []string
+}
+
+// parsePlan reads the resource changes, change summary and error
+// diagnostics of terraform plan -json output, skipping other lines
+func parsePlan(output []byte) planOutput {
+	parsed := planOutput{resources: make(map[string]*driftedResource), summary: make(map[string]int)}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var msg planMessage
+		if json.Unmarshal(scanner.Bytes(), &msg) != nil {
+			continue
+		}
+		switch msg.Type {
+		case "resource_drift", "planned_change":
+			action := msg.Change.Action
+			if msg.Change.Resource.Addr == "" || action == "noop" || action == "read" {
+				continue
+			}
+			resource, ok := parsed.resources[msg.Change.Resource.Addr]
+			if !ok {
+				resource = &driftedResource{
+					addr:         msg.Change.Resource.Addr,
+					resourceType: msg.Change.Resource.ResourceType,
+					provider:     msg.Change.Resource.Provider,
+				}
+				parsed.resources[resource.addr] = resource
+			}
+			if msg.Type == "resource_drift" {
+				resource.drift = action
+			} else {
+				resource.action = action
+				resource.reason = msg.Change.Reason
+			}
+		case "change_summary":
+			for _, key := range []string{"add", "change", "remove", "import"} {
+				if n, ok := msg.Changes[key].(float64); ok {
+					parsed.summary[key] = int(n)
+				}
+			}
+		case "diagnostic":
+			if msg.Diagnostic.Severity == "error" {
+				text := msg.Diagnostic.Summary
+				if msg.Diagnostic.Detail != "" {
+					text += ": " + msg.Diagnostic.Detail
+				}
+				parsed.errors = append(parsed.errors, text)
+			}
+		}
+	}
+	return parsed
+}
+
+// findings returns a finding for every changed resource of the plan,
+// ordered by address
+func (pl planOutput) findings(workspace DriftWorkspace) []Finding {
+	addrs := make([]string, 0, len(pl.resources))
+	for addr := range pl.resources {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	findings := make([]Finding, 0, len(addrs))
+	for _, addr := range addrs {
+		resource := pl.resources[addr]
+		severity := "medium"
+		if destructive(resource.action) || destructive(resource.drift) {
+			severity = "high"
+		}
+		title := fmt.Sprintf("%s differs from its configuration", addr)
+		description := fmt.Sprintf("terraform plan would %s %s", resource.action, addr)
+		if resource.action == "" {
+			description = fmt.Sprintf("%s was changed outside of Terraform", addr)
+		}
+		if resource.drift != "" {
+			title = fmt.Sprintf("%s changed outside of Terraform (%s)", addr, resource.drift)
+		}
+		metadata := map[string]interface{}{"workspace": workspace.name()}
+		for key, value := range map[string]string{"action": resource.action, "drift": resource.drift, "reason": resource.reason, "resourceType": resource.resourceType, "provider": resource.provider} {
+			if value != "" {
+				metadata[key] = value
+			}
+		}
+		findings = append(findings, Finding{
+			ID:          addr,
+			Type:        "drift",
+			Title:       title,
+			Description: description,
+			Severity:    severity,
+			Path:        workspace.Dir,
+			Location:    workspace.name(),
+			Metadata:    metadata,
+		})
+	}
+	return findings
+}
+
+// destructive reports whether a plan action deletes a resource
+func destructive(action string) bool {
+	return action == "delete" || action == "replace" || action == "remove"
+}
+
+// decodeDriftWorkspaces reads the workspaces of a step, given as
+// directories or as workspace objects
+func decodeDriftWorkspaces(value interface{}) ([]DriftWorkspace, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case []DriftWorkspace:
+		return v, nil
+	case string:
+		return []DriftWorkspace{{Dir: v}}, nil
+	case []interface{}:
+		workspaces := make([]DriftWorkspace, 0, len(v))
+		for _, item := range v {
+			if dir, ok := item.(string); ok {
+				workspaces = append(workspaces, DriftWorkspace{Dir: dir})
+				continue
+			}
+			data, err := json.Marshal(item)
+			if err != nil {
+				return nil, err
+			}
+			var workspace DriftWorkspace
+			if err := json.Unmarshal(data, &workspace); err != nil {
+				return nil, fmt.Errorf("invalid workspaces: %w", err)
+			}
+			workspaces = append(workspaces, workspace)
+		}
+		return workspaces, nil
+	}
+	return nil, fmt.Errorf("invalid workspaces: want a list of directories or workspaces")
+}
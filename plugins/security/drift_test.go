@@ -0,0 +1,154 @@
+package security
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chip/conveyor/core"
+)
+
+const driftPlan = `{"@level":"info","@message":"Terraform 1.6.0","type":"version"}
+{"@level":"info","type":"resource_drift","change":{"resource":{"addr":"aws_security_group.web","resource_type":"aws_security_group","implied_provider":"aws"},"action":"update"}}
+{"@level":"info","type":"planned_change","change":{"resource":{"addr":"aws_security_group.web","resource_type":"aws_security_group","implied_provider":"aws"},"action":"update"}}
+{"@level":"info","type":"planned_change","change":{"resource":{"addr":"aws_instance.api","resource_type":"aws_instance","implied_provider":"aws"},"action":"replace","reason":"cannot_update"}}
+{"@level":"info","type":"planned_change","change":{"resource":{"addr":"data.aws_ami.base","resource_type":"aws_ami"},"action":"read"}}
+{"@level":"info","type":"change_summary","changes":{"add":1,"change":1,"remove":1,"operation":"plan"}}
+`
+
+// exitError returns the error of a command exiting with code
+func exitError(t *testing.T, code string) error {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	return exec.Command("sh", "-c", "exit "+code).Run()
+}
+
+func TestDriftScan_ReportsChangedResources(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "infra"), 0755)
+	changes := exitError(t, "2")
+
+	var calls []string
+	plugin := NewSecurityPlugin()
+	plugin.runTool = func(ctx context.Context, runDir string, env map[string]string, name string, args ...string) ([]byte, []byte, error) {
+		calls = append(calls, name+" "+args[0])
+		if runDir != filepath.Join(dir, "infra") || env["TF_WORKSPACE"] != "prod" {
+			t.Errorf("ran in %s with workspace %q, want infra with prod", runDir, env["TF_WORKSPACE"])
+		}
+		if args[0] != "plan" {
+			return nil, nil, nil
+		}
+		if joined := strings.Join(args, " "); !strings.Contains(joined, "-lock=false") || !strings.Contains(joined, "-var-file=prod.tfvars") {
+			t.Errorf("plan args = %s, want an unlocked plan with the var file", joined)
+		}
+		return []byte(driftPlan), nil, changes
+	}
+
+	step := core.Step{Type: "drift-scan", Config: map[string]interface{}{
+		"targetDir":  dir,
+		"workspaces": []interface{}{map[string]interface{}{"dir": "infra", "workspace": "prod", "varFiles": []interface{}{"prod.tfvars"}}},
+		"failOn":     "high",
+	}}
+	outputs, err := plugin.Execute(context.Background(), step)
+	if err == nil || !strings.Contains(err.Error(), "1 drifted resources at or above high") {
+		t.Fatalf("Execute() error = %v, want the replaced instance to fail the step", err)
+	}
+	if strings.Join(calls, ",") != "terraform init,terraform plan" {
+		t.Errorf("commands = %v", calls)
+	}
+	scan := outputs["scan"].(Scan)
+	if scan.Type != "drift" || len(scan.Findings) != 2 || scan.HighCount != 1 {
+		t.Fatalf("scan = %+v, want two drift findings, one high", scan)
+	}
+	api, web := scan.Findings[0], scan.Findings[1]
+	if api.ID != "aws_instance.api" || api.Severity != "high" || api.Metadata["reason"] != "cannot_update" {
+		t.Errorf("instance finding = %+v", api)
+	}
+	if web.Severity != "medium" || web.Location != "infra:prod" || !strings.Contains(web.Title, "changed outside of Terraform") {
+		t.Errorf("security group finding = %+v", web)
+	}
+	if summary := scan.Metadata["workspaces"].(map[string]interface{})["infra:prod"].(map[string]int); summary["remove"] != 1 {
+		t.Errorf("summary = %v", summary)
+	}
+	if recorded := plugin.History().List(ScanFilter{Type: "drift"}); len(recorded) != 1 {
+		t.Errorf("history has %d drift scans, want the failed scan recorded", len(recorded))
+	}
+}
+
+func TestDriftScan_Errors(t *testing.T) {
+	plugin := NewSecurityPlugin()
+	plugin.runTool = func(ctx context.Context, dir string, env map[string]string, name string, args ...string) ([]byte, []byte, error) {
+		if args[0] == "init" {
+			return nil, nil, nil
+		}
+		diagnostic := `{"@level":"error","type":"diagnostic","diagnostic":{"severity":"error","summary":"No valid credential sources found"}}`
+		return []byte(diagnostic), nil, exitError(t, "1")
+	}
+	step := core.Step{Type: "drift-scan", Config: map[string]interface{}{"targetDir": t.TempDir(), "workspaces": "."}}
+	if _, err := plugin.Execute(context.Background(), step); err == nil || !strings.Contains(err.Error(), "No valid credential sources found") {
+		t.Errorf("Execute() error = %v, want the plan's diagnostic", err)
+	}
+
+	plugin.runTool = func(ctx context.Context, dir string, env map[string]string, name string, args ...string) ([]byte, []byte, error) {
+		return nil, nil, &exec.Error{Name: name, Err: exec.ErrNotFound}
+	}
+	if _, err := plugin.Execute(context.Background(), step); err == nil || !strings.Contains(err.Error(), "not installed") {
+		t.Errorf("Execute() error = %v, want terraform reported missing", err)
+	}
+
+	outputs, err := plugin.Execute(context.Background(), core.Step{Type: "drift-scan", Config: map[string]interface{}{"targetDir": t.TempDir()}})
+	if err != nil || outputs["status"] != "skipped" {
+		t.Errorf("Execute() without workspaces = %v, %v, want skipped", outputs, err)
+	}
+}
+
+func TestValidateDriftWorkspaces(t *testing.T) {
+	if err := ValidateDriftWorkspaces([]DriftWorkspace{{Dir: "infra"}, {Dir: "infra", Workspace: "prod"}}); err != nil {
+		t.Errorf("ValidateDriftWorkspaces() error = %v", err)
+	}
+	invalid := [][]DriftWorkspace{
+		{{Dir: "../elsewhere"}},
+		{{Dir: "/etc"}},
+		{{Dir: "infra", VarFiles: []string{"../../secrets.tfvars"}}},
+		{{Dir: "infra"}, {Dir: "./infra"}},
+	}
+	for _, workspaces := range invalid {
+		if err := ValidateDriftWorkspaces(workspaces); err == nil {
+			t.Errorf("ValidateDriftWorkspaces(%+v) expected error", workspaces)
+		}
+	}
+}
+
+func TestScheduler_AlertsOnFirstDrift(t *testing.T) {
+	changes := exitError(t, "2")
+	plugin := NewSecurityPlugin()
+	plugin.runTool = func(ctx context.Context, dir string, env map[string]string, name string, args ...string) ([]byte, []byte, error) {
+		if args[0] == "init" {
+			return nil, nil, nil
+		}
+		return []byte(driftPlan), nil, changes
+	}
+	var alerts []Regression
+	scheduler, err := NewScheduler(plugin, t.TempDir(), func(r Regression) { alerts = append(alerts, r) })
+	if err != nil {
+		t.Fatalf("NewScheduler() error = %v", err)
+	}
+	schedule, err := scheduler.Create(ScanSchedule{Target: t.TempDir(), Cron: "@hourly", ScanTypes: []string{"drift"}, Workspaces: []DriftWorkspace{{}}})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := scheduler.scan(context.Background(), schedule); err != nil {
+			t.Fatalf("scan() error = %v", err)
+		}
+	}
+	if len(alerts) != 1 || alerts[0].ScanType != "drift" || len(alerts[0].NewFindings) != 2 || alerts[0].PreviousScanID != "" {
+		t.Errorf("alerts = %+v, want the first scan's drift alerted once", alerts)
+	}
+}
@@ -0,0 +1,66 @@
+package security
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/chip/conveyor/core"
+)
+
+// RuleEgressBlocked is the rule of connections a step's network policy
+// blocked
+const RuleEgressBlocked = "EGRESS-BLOCKED"
+
+// EgressFindings reports the connections the network policies of a job's
+// steps blocked, one finding per step and destination. A step reaching
+// out to an unexpected host is how compromised dependencies exfiltrate
+// data, so each is worth a look even though it was stopped.
+func EgressFindings(job *core.Job) []Finding {
+	var findings []Finding
+	for _, step := range job.Steps {
+		if step.Egress == nil {
+			continue
+		}
+		for _, blocked := range step.Egress.Blocked {
+			attempts := strconv.Itoa(blocked.Attempts)
+			findings = append(findings, Finding{
+				ID:          RuleEgressBlocked,
+				Type:        "egress",
+				Title:       "Connection blocked by network policy",
+				Description: fmt.Sprintf("The step tried %s times to connect to %s, which its network policy doesn't allow. Add the destination to its egress if it is needed, or remove the dependency.", attempts, blocked.Destination),
+				Severity:    "medium",
+				Location:    "step " + step.Name,
+				Context:     blocked.Destination,
+				Metadata: map[string]interface{}{
+					"jobId":   job.ID,
+					"stepId":  step.ID,
+					"message": findingMessage{Key: "egress.blocked", Args: []string{blocked.Destination, attempts}},
+				},
+			})
+		}
+	}
+	return findings
+}
+
+// RecordEgress records the connections blocked in a job as a scan of type
+// egress, so they show up with the pipeline's other findings
+func (p *SecurityPlugin) RecordEgress(job *core.Job) (Scan, error) {
+	findings := EgressFindings(job)
+	scan := Scan{
+		ID:            fmt.Sprintf("scan-%d-%d", time.Now().Unix(), atomic.AddUint64(&scanCounter, 1)),
+		Type:          "egress",
+		PipelineID:    job.PipelineID,
+		JobID:         job.ID,
+		Status:        "completed",
+		Timestamp:     time.Now(),
+		FindingsCount: len(findings),
+		Findings:      findings,
+	}
+	countSeverities(&scan)
+	if err := p.history.Record(scan); err != nil {
+		return scan, fmt.Errorf("failed to record egress scan: %w", err)
+	}
+	return scan, nil
+}
@@ -0,0 +1,43 @@
+package security
+
+import (
+	"testing"
+
+	"github.com/chip/conveyor/core"
+)
+
+func TestRecordEgress(t *testing.T) {
+	history, err := NewHistory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := NewSecurityPlugin()
+	plugin.UseHistory(history)
+
+	job := &core.Job{ID: "job-1", PipelineID: "web", Steps: []core.StepStatus{
+		{ID: "build-install", Name: "install", Egress: &core.EgressReport{
+			Allow:   []string{"registry.npmjs.org:443"},
+			Blocked: []core.BlockedConnection{{Destination: "evil.example.com:443", Attempts: 3}},
+		}},
+		{ID: "build-test", Name: "test"},
+	}}
+	scan, err := plugin.RecordEgress(job)
+	if err != nil {
+		t.Fatalf("RecordEgress() error = %v", err)
+	}
+	if scan.Type != "egress" || scan.JobID != "job-1" || scan.FindingsCount != 1 || scan.MediumCount != 1 {
+		t.Fatalf("scan = %+v, want one medium egress finding of job-1", scan)
+	}
+	finding := scan.Findings[0]
+	if finding.ID != RuleEgressBlocked || finding.Location != "step install" || finding.Context != "evil.example.com:443" {
+		t.Errorf("finding = %+v", finding)
+	}
+	if localized := finding.Localize("es"); localized.Description == finding.Description {
+		t.Errorf("Localize(es) kept the English description %q", localized.Description)
+	}
+
+	open := history.Findings(FindingFilter{Scope: "pipeline:web", ScanType: "egress", Status: FindingOpen})
+	if len(open) != 1 {
+		t.Errorf("open egress findings = %+v, want 1", open)
+	}
+}
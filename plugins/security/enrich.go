@@ -0,0 +1,316 @@
+package security
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chip/conveyor/logging"
+)
+
+// Feeds findings are enriched from. The EPSS feed has the scores of every
+// CVE, for database bundles.
+const (
+	DefaultEPSSURL     = "https://api.first.org/data/v1/epss"
+	DefaultEPSSFeedURL = "https://epss.cyentia.com/epss_scores-current.csv.gz"
+	DefaultKEVURL      = "https://www.cisa.gov/sites/default/files/feeds/known_exploited_vulnerabilities.json"
+)
+
+// DefaultEnrichmentTTL is how long fetched scores and the KEV catalog are
+// used before they are fetched again
+const DefaultEnrichmentTTL = 24 * time.Hour
+
+// epssBatchSize is how many CVEs one EPSS request asks for
+const epssBatchSize = 100
+
+// epssScore is a CVE's EPSS score and when it was fetched
+type epssScore struct {
+	Score      float64   `json:"score"`
+	Percentile float64   `json:"percentile"`
+	FetchedAt  time.Time `json:"fetchedAt"`
+}
+
+// kevCatalog is the CVEs of the KEV catalog and when it was fetched
+type kevCatalog struct {
+	CVEs      map[string]bool `json:"cves"`
+	FetchedAt time.Time       `json:"fetchedAt"`
+}
+
+// Enricher adds EPSS scores and CISA KEV flags to CVE findings. Fetched
+// scores and the catalog are cached for TTL, and on disk if the enricher
+// has a directory; when a feed can't be fetched the stale cache is used.
+type Enricher struct {
+	EPSSURL     string
+	EPSSFeedURL string
+	KEVURL      string
+	TTL         time.Duration
+	// Offline enrichers only use their cache, such as a database bundle
+	Offline bool
+
+	dir    string
+	client *http.Client
+
+	mu   sync.Mutex
+	epss map[string]epssScore
+	kev  kevCatalog
+}
+
+// NewEnricher opens the feed cache in dir, creating it if needed. dir may
+// be empty to only cache in memory, and client nil for a default client.
+func NewEnricher(dir string, client *http.Client) (*Enricher, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	e := &Enricher{
+		EPSSURL:     DefaultEPSSURL,
+		EPSSFeedURL: DefaultEPSSFeedURL,
+		KEVURL:      DefaultKEVURL,
+		TTL:         DefaultEnrichmentTTL,
+		dir:         dir,
+		client:      client,
+		epss:        make(map[string]epssScore),
+	}
+	if dir == "" {
+		return e, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create enrichment cache: %w", err)
+	}
+	if err := readCache(filepath.Join(dir, "epss.json"), &e.epss); err != nil {
+		return nil, err
+	}
+	if err := readCache(filepath.Join(dir, "kev.json"), &e.kev); err != nil {
+		return nil, err
+	}
+	if e.epss == nil {
+		e.epss = make(map[string]epssScore)
+	}
+	return e, nil
+}
+
+// Enrich sets the EPSS score, percentile and KEV flag of the findings with
+// CVE IDs, fetching what isn't cached
+func (e *Enricher) Enrich(ctx context.Context, findings []Finding) {
+	var cves []string
+	for _, finding := range findings {
+		if isCVE(finding.ID) {
+			cves = append(cves, strings.ToUpper(finding.ID))
+		}
+	}
+	if len(cves) == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	if e.Offline {
+		e.apply(findings)
+		return
+	}
+	if now.Sub(e.kev.FetchedAt) > e.TTL {
+		if err := e.fetchKEV(ctx, now); err != nil {
+			logging.Warnf("Failed to fetch the KEV catalog, using the cached one: %v", err)
+		}
+	}
+	var stale []string
+	for _, cve := range cves {
+		if score, ok := e.epss[cve]; !ok || now.Sub(score.FetchedAt) > e.TTL {
+			stale = append(stale, cve)
+		}
+	}
+	if len(stale) > 0 {
+		if err := e.fetchEPSS(ctx, stale, now); err != nil {
+			logging.Warnf("Failed to fetch EPSS scores, using cached ones: %v", err)
+		}
+	}
+
+	e.apply(findings)
+}
+
+// apply sets the cached scores and flags of findings. Callers must hold
+// e.mu.
+func (e *Enricher) apply(findings []Finding) {
+	for i := range findings {
+		cve := strings.ToUpper(findings[i].ID)
+		if !isCVE(cve) {
+			continue
+		}
+		if score, ok := e.epss[cve]; ok {
+			findings[i].EPSS = score.Score
+			findings[i].EPSSPercentile = score.Percentile
+		}
+		findings[i].KEV = e.kev.CVEs[cve]
+	}
+}
+
+// fetchKEV replaces the cached KEV catalog. Callers must hold e.mu.
+func (e *Enricher) fetchKEV(ctx context.Context, now time.Time) error {
+	var feed struct {
+		Vulnerabilities []struct {
+			CVEID string `json:"cveID"`
+		} `json:"vulnerabilities"`
+	}
+	if err := e.get(ctx, e.KEVURL, &feed); err != nil {
+		return err
+	}
+	catalog := kevCatalog{CVEs: make(map[string]bool, len(feed.Vulnerabilities)), FetchedAt: now}
+	for _, vulnerability := range feed.Vulnerabilities {
+		catalog.CVEs[strings.ToUpper(vulnerability.CVEID)] = true
+	}
+	e.kev = catalog
+	return e.save("kev.json", e.kev)
+}
+
+// fetchEPSS caches the EPSS scores of cves. CVEs without a score are cached
+// with a score of zero, so they aren't asked for again until the TTL
+// passes. Callers must hold e.mu.
+func (e *Enricher) fetchEPSS(ctx context.Context, cves []string, now time.Time) error {
+	sort.Strings(cves)
+	for start := 0; start < len(cves); start += epssBatchSize {
+		end := start + epssBatchSize
+		if end > len(cves) {
+			end = len(cves)
+		}
+		batch := cves[start:end]
+
+		var feed struct {
+			Data []struct {
+				CVE        string `json:"cve"`
+				EPSS       string `json:"epss"`
+				Percentile string `json:"percentile"`
+			} `json:"data"`
+		}
+		if err := e.get(ctx, e.EPSSURL+"?cve="+url.QueryEscape(strings.Join(batch, ",")), &feed); err != nil {
+			return err
+		}
+		for _, cve := range batch {
+			e.epss[cve] = epssScore{FetchedAt: now}
+		}
+		for _, entry := range feed.Data {
+			score, err := strconv.ParseFloat(entry.EPSS, 64)
+			if err != nil {
+				return fmt.Errorf("invalid EPSS score %q for %s", entry.EPSS, entry.CVE)
+			}
+			percentile, _ := strconv.ParseFloat(entry.Percentile, 64)
+			e.epss[strings.ToUpper(entry.CVE)] = epssScore{Score: score, Percentile: percentile, FetchedAt: now}
+		}
+	}
+	return e.save("epss.json", e.epss)
+}
+
+// get decodes the JSON feed at url into v
+func (e *Enricher) get(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", url, err)
+	}
+	return nil
+}
+
+// save writes a cache file if the enricher has a directory
+func (e *Enricher) save(name string, v interface{}) error {
+	if e.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(e.dir, name)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write enrichment cache: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// readCache decodes a cache file into v, leaving v as it is when the file
+// doesn't exist
+func readCache(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read enrichment cache: %w", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to decode enrichment cache %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+func isCVE(id string) bool {
+	return len(id) > 4 && strings.EqualFold(id[:4], "CVE-")
+}
+
+// ExploitPolicy narrows the findings that fail a scan to those likely to be
+// exploited: known exploited ones with KEV, and those whose EPSS score is
+// above EPSS. A zero policy doesn't narrow them.
+type ExploitPolicy struct {
+	KEV  bool    `json:"kev,omitempty"`
+	EPSS float64 `json:"epss,omitempty"`
+}
+
+// Enabled reports whether the policy narrows findings
+func (p ExploitPolicy) Enabled() bool {
+	return p.KEV || p.EPSS > 0
+}
+
+// Validate checks that the EPSS threshold is a probability
+func (p ExploitPolicy) Validate() error {
+	if p.EPSS < 0 || p.EPSS >= 1 {
+		return fmt.Errorf("EPSS threshold must be at least 0 and below 1, got %v", p.EPSS)
+	}
+	return nil
+}
+
+// Filter returns the findings the policy lets fail a scan
+func (p ExploitPolicy) Filter(findings []Finding) []Finding {
+	if !p.Enabled() {
+		return findings
+	}
+	var exploitable []Finding
+	for _, finding := range findings {
+		if (p.KEV && finding.KEV) || (p.EPSS > 0 && finding.EPSS > p.EPSS) {
+			exploitable = append(exploitable, finding)
+		}
+	}
+	return exploitable
+}
+
+// decodeExploitPolicy reads the exploit policy of a step
+func decodeExploitPolicy(value interface{}) (ExploitPolicy, error) {
+	var policy ExploitPolicy
+	data, err := json.Marshal(value)
+	if err != nil {
+		return policy, err
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return policy, fmt.Errorf("invalid exploit policy: %w", err)
+	}
+	return policy, policy.Validate()
+}
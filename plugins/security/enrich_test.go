@@ -0,0 +1,118 @@
+package security
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chip/conveyor/core"
+)
+
+func TestEnricher_EnrichesAndCaches(t *testing.T) {
+	var requests int32
+	var down int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/kev":
+			fmt.Fprint(w, `{"vulnerabilities": [{"cveID": "CVE-2021-5678"}]}`)
+		case "/epss":
+			var data []string
+			for _, cve := range strings.Split(r.URL.Query().Get("cve"), ",") {
+				if cve == "CVE-2021-1234" {
+					data = append(data, `{"cve": "CVE-2021-1234", "epss": "0.72", "percentile": "0.98"}`)
+				}
+			}
+			fmt.Fprintf(w, `{"data": [%s]}`, strings.Join(data, ","))
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	enricher, err := NewEnricher(dir, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	enricher.EPSSURL, enricher.KEVURL = server.URL+"/epss", server.URL+"/kev"
+
+	findings := []Finding{{ID: "CVE-2021-1234"}, {ID: "cve-2021-5678"}, {ID: "JS-EVAL"}}
+	enricher.Enrich(context.Background(), findings)
+	if findings[0].EPSS != 0.72 || findings[0].EPSSPercentile != 0.98 || findings[0].KEV {
+		t.Errorf("findings[0] = %+v, want its EPSS score", findings[0])
+	}
+	if !findings[1].KEV || findings[1].EPSS != 0 {
+		t.Errorf("findings[1] = %+v, want it known exploited", findings[1])
+	}
+	if requests != 2 {
+		t.Fatalf("requests = %d, want one per feed", requests)
+	}
+
+	// Cached scores are used, from disk too, and when the feeds are down
+	atomic.StoreInt32(&down, 1)
+	reopened, err := NewEnricher(dir, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.EPSSURL, reopened.KEVURL = server.URL+"/epss", server.URL+"/kev"
+	again := []Finding{{ID: "CVE-2021-1234"}, {ID: "CVE-2021-5678"}}
+	reopened.Enrich(context.Background(), again)
+	if requests != 2 || again[0].EPSS != 0.72 || !again[1].KEV {
+		t.Errorf("requests = %d, findings = %+v, want the cache used", requests, again)
+	}
+	reopened.TTL = time.Nanosecond
+	reopened.Enrich(context.Background(), again)
+	if requests != 4 || again[0].EPSS != 0.72 || !again[1].KEV {
+		t.Errorf("requests = %d, findings = %+v, want the stale cache used when the feeds fail", requests, again)
+	}
+}
+
+func TestVulnerabilityScan_ExploitPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/kev" {
+			fmt.Fprint(w, `{"vulnerabilities": []}`)
+			return
+		}
+		fmt.Fprint(w, `{"data": [{"cve": "CVE-2022-1111", "epss": "0.6", "percentile": "0.9"}, {"cve": "CVE-2021-1234", "epss": "0.01", "percentile": "0.2"}]}`)
+	}))
+	defer server.Close()
+	enricher, err := NewEnricher("", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	enricher.EPSSURL, enricher.KEVURL = server.URL+"/epss", server.URL+"/kev"
+	plugin := NewSecurityPlugin()
+	plugin.UseEnricher(enricher)
+
+	step := core.Step{Type: "vulnerability-scan", Config: map[string]interface{}{
+		"pipelineId": "web",
+		"jobId":      "j1",
+		"failOn":     "high",
+		"exploit":    map[string]interface{}{"kev": true, "epss": 0.5},
+	}}
+	if _, err := plugin.Execute(context.Background(), step); err != nil {
+		t.Errorf("Execute() error = %v, want high findings unlikely to be exploited to pass", err)
+	}
+
+	delete(step.Config, "failOn")
+	outputs, err := plugin.Execute(context.Background(), step)
+	if err == nil || !strings.Contains(err.Error(), "1 issues") {
+		t.Errorf("Execute() error = %v, want the medium finding above the EPSS threshold to fail", err)
+	}
+	if scan := outputs["scan"].(Scan); scan.Status != "failed" || scan.Metadata["exploit"] == nil {
+		t.Errorf("scan = %+v, want it failed with its exploit policy", scan)
+	}
+
+	step.Config["exploit"] = map[string]interface{}{"epss": 1.5}
+	if _, err := plugin.Execute(context.Background(), step); err == nil {
+		t.Error("Execute() with an EPSS threshold above 1 expected error")
+	}
+}
@@ -0,0 +1,330 @@
+package security
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chip/conveyor/core"
+)
+
+// Statuses of a tracked finding
+const (
+	FindingOpen  = "open"
+	FindingFixed = "fixed"
+)
+
+// Triage states of a tracked finding. False positives and accepted risks
+// don't fail scans.
+const (
+	TriageAcknowledged  = "acknowledged"
+	TriageFalsePositive = "false_positive"
+	TriageAcceptedRisk  = "accepted_risk"
+)
+
+var triageStates = map[string]bool{
+	TriageAcknowledged:  true,
+	TriageFalsePositive: true,
+	TriageAcceptedRisk:  true,
+}
+
+// TrackedFinding is a finding followed across the scans of a scope, which is
+// the pipeline, schedule or target scanned. A finding no longer reported by
+// a complete scan of its type is fixed, and reopens if it comes back.
+type TrackedFinding struct {
+	ID          string     `json:"id"`
+	Fingerprint string     `json:"fingerprint"`
+	Scope       string     `json:"scope"`
+	ScanType    string     `json:"scanType"`
+	Status      string     `json:"status"`
+	Finding     Finding    `json:"finding"`
+	FirstSeen   time.Time  `json:"firstSeen"`
+	LastSeen    time.Time  `json:"lastSeen"`
+	FirstScanID string     `json:"firstScanId"`
+	LastScanID  string     `json:"lastScanId"`
+	Occurrences int        `json:"occurrences"`
+	FixedAt     *time.Time `json:"fixedAt,omitempty"`
+	Triage      *Triage    `json:"triage,omitempty"`
+}
+
+// Triage is a reviewer's decision on a tracked finding, kept as long as the
+// finding keeps its fingerprint
+type Triage struct {
+	State string    `json:"state"`
+	Note  string    `json:"note,omitempty"`
+	By    string    `json:"by,omitempty"`
+	At    time.Time `json:"at"`
+}
+
+// FindingFilter selects tracked findings. Empty fields match every finding.
+type FindingFilter struct {
+	Scope    string
+	ScanType string
+	Status   string
+}
+
+// Fingerprint identifies a finding across scans by its rule, its normalized
+// path and location, and a hash of its code with whitespace collapsed. Line
+// numbers aren't part of it, so findings keep their identity as code moves.
+func Fingerprint(f Finding) string {
+	code := sha256.Sum256([]byte(strings.Join(strings.Fields(f.Context), " ")))
+	h := sha256.New()
+	for _, part := range []string{f.Type, f.ID, f.Package, normalizePath(f.Path), f.Location, hex.EncodeToString(code[:])} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// normalizePath makes equivalent spellings of a path equal
+func normalizePath(p string) string {
+	if p == "" {
+		return ""
+	}
+	return strings.TrimPrefix(path.Clean(filepath.ToSlash(p)), "./")
+}
+
+// scanScope returns the scope a scan's findings are tracked in
+func scanScope(scan Scan) string {
+	switch {
+	case scan.PipelineID != "":
+		return "pipeline:" + scan.PipelineID
+	case scan.ScheduleID != "":
+		return "schedule:" + scan.ScheduleID
+	case scan.Target != "":
+		return "target:" + scan.Target
+	}
+	return ""
+}
+
+// stepScope returns the scope the scan of a step is tracked in
+func stepScope(step core.Step) string {
+	pipelineID, _ := step.Config["pipelineId"].(string)
+	target, _ := step.Config["targetDir"].(string)
+	return scanScope(Scan{PipelineID: pipelineID, Target: target})
+}
+
+// gate fails a scan in scope whose findings reach failOn and returns how
+// many findings fail it
+func (p *SecurityPlugin) gate(scan *Scan, scope, failOn string, newOnly bool) int {
+	return p.gateFindings(scan, scan.Findings, scope, failOn, newOnly)
+}
+
+// gateFindings is gate counting only findings, a subset of the scan's
+func (p *SecurityPlugin) gateFindings(scan *Scan, findings []Finding, scope, failOn string, newOnly bool) int {
+	if failOn == "" {
+		return 0
+	}
+	if scan.Metadata == nil {
+		scan.Metadata = make(map[string]interface{})
+	}
+	scan.Metadata["failOn"] = failOn
+	if newOnly {
+		scan.Metadata["newOnly"] = true
+	}
+	failing := p.history.failing(scope, findings, failOn, newOnly)
+	if failing > 0 {
+		scan.Status = "failed"
+	}
+	return failing
+}
+
+// trackedID returns the ID of a finding tracked in scope
+func trackedID(scope, fingerprint string) string {
+	sum := sha256.Sum256([]byte(scope + "\x00" + fingerprint))
+	return hex.EncodeToString(sum[:8])
+}
+
+// track fingerprints a scan's findings and updates the findings of its
+// scope. Callers must hold h.mu.
+func (h *History) track(scan Scan) {
+	if h.findings == nil {
+		h.findings = make(map[string]*TrackedFinding)
+	}
+	scope := scanScope(scan)
+	seen := make(map[string]bool, len(scan.Findings))
+	for i := range scan.Findings {
+		finding := &scan.Findings[i]
+		finding.Fingerprint = Fingerprint(*finding)
+		id := trackedID(scope, finding.Fingerprint)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		tracked, ok := h.findings[id]
+		if !ok {
+			tracked = &TrackedFinding{
+				ID:          id,
+				Fingerprint: finding.Fingerprint,
+				Scope:       scope,
+				ScanType:    scan.Type,
+				FirstSeen:   scan.Timestamp,
+				FirstScanID: scan.ID,
+				Triage:      h.triage[id],
+			}
+			h.findings[id] = tracked
+		}
+		tracked.Finding = *finding
+		tracked.Status = FindingOpen
+		tracked.FixedAt = nil
+		tracked.LastSeen = scan.Timestamp
+		tracked.LastScanID = scan.ID
+		tracked.Occurrences++
+	}
+
+	// A canceled scan didn't look everywhere
+	if scan.Status == "canceled" {
+		return
+	}
+	for id, tracked := range h.findings {
+		if tracked.Scope == scope && tracked.ScanType == scan.Type && tracked.Status == FindingOpen && !seen[id] {
+			fixedAt := scan.Timestamp
+			tracked.Status = FindingFixed
+			tracked.FixedAt = &fixedAt
+		}
+	}
+}
+
+// Findings returns the tracked findings matching filter, most recently seen
+// first
+func (h *History) Findings(filter FindingFilter) []TrackedFinding {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	findings := []TrackedFinding{}
+	for _, tracked := range h.findings {
+		if filter.Scope != "" && tracked.Scope != filter.Scope {
+			continue
+		}
+		if filter.ScanType != "" && tracked.ScanType != filter.ScanType {
+			continue
+		}
+		if filter.Status != "" && tracked.Status != filter.Status {
+			continue
+		}
+		findings = append(findings, *tracked)
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		if !findings[i].LastSeen.Equal(findings[j].LastSeen) {
+			return findings[i].LastSeen.After(findings[j].LastSeen)
+		}
+		return findings[i].ID < findings[j].ID
+	})
+	return findings
+}
+
+// Finding returns a tracked finding by ID
+func (h *History) Finding(id string) (TrackedFinding, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	tracked, ok := h.findings[id]
+	if !ok {
+		return TrackedFinding{}, false
+	}
+	return *tracked, true
+}
+
+// SetTriage records a triage decision on a tracked finding, or clears it
+// when triage is nil
+func (h *History) SetTriage(id string, triage *Triage) (TrackedFinding, error) {
+	if triage != nil && !triageStates[triage.State] {
+		return TrackedFinding{}, fmt.Errorf("invalid triage state %q, want acknowledged, false_positive or accepted_risk", triage.State)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	tracked, ok := h.findings[id]
+	if !ok {
+		return TrackedFinding{}, fmt.Errorf("finding %s not found", id)
+	}
+	if triage != nil && triage.At.IsZero() {
+		triage.At = time.Now()
+	}
+	if h.triage == nil {
+		h.triage = make(map[string]*Triage)
+	}
+	if triage == nil {
+		delete(h.triage, id)
+	} else {
+		h.triage[id] = triage
+	}
+	tracked.Triage = triage
+	if err := h.saveTriage(); err != nil {
+		return TrackedFinding{}, err
+	}
+	return *tracked, nil
+}
+
+// failing counts the findings at or above threshold that fail a scan in
+// scope. Findings triaged as false positives or accepted risks don't, and
+// with newOnly, neither do findings the scope has had before.
+func (h *History) failing(scope string, findings []Finding, threshold string, newOnly bool) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	rank := severityRanks[strings.ToLower(threshold)]
+	count := 0
+	for _, finding := range findings {
+		if severityRanks[finding.Severity] < rank {
+			continue
+		}
+		tracked, known := h.findings[trackedID(scope, Fingerprint(finding))]
+		if known && suppressed(*tracked) {
+			continue
+		}
+		if known && newOnly {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// triagePath is where triage decisions are persisted, apart from the scans
+func (h *History) triagePath() string {
+	return filepath.Join(h.dir, "findings", "triage.json")
+}
+
+// loadTriage reads the persisted triage decisions
+func (h *History) loadTriage() error {
+	data, err := os.ReadFile(h.triagePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read finding triage: %w", err)
+	}
+	if err := json.Unmarshal(data, &h.triage); err != nil {
+		return fmt.Errorf("failed to decode finding triage: %w", err)
+	}
+	return nil
+}
+
+// saveTriage persists the triage decisions. Callers must hold h.mu.
+func (h *History) saveTriage() error {
+	if h.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(h.triagePath()), 0755); err != nil {
+		return fmt.Errorf("failed to create finding triage directory: %w", err)
+	}
+	data, err := json.MarshalIndent(h.triage, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode finding triage: %w", err)
+	}
+	tmp := h.triagePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write finding triage: %w", err)
+	}
+	return os.Rename(tmp, h.triagePath())
+}
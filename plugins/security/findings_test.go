@@ -0,0 +1,126 @@
+package security
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chip/conveyor/core"
+)
+
+func TestFingerprint(t *testing.T) {
+	finding := Finding{ID: "JS-EVAL", Type: "code", Path: "src/app.js", LineNumber: 2, Context: "eval(input)"}
+	moved := finding
+	moved.Path = "./src//app.js"
+	moved.LineNumber = 40
+	moved.Context = "  eval(input)\t"
+	if Fingerprint(finding) != Fingerprint(moved) {
+		t.Error("Fingerprint() changed with the line number, path spelling or whitespace")
+	}
+
+	for name, changed := range map[string]Finding{
+		"rule": {ID: "JS-EXEC", Type: "code", Path: "src/app.js", Context: "eval(input)"},
+		"path": {ID: "JS-EVAL", Type: "code", Path: "src/lib.js", Context: "eval(input)"},
+		"code": {ID: "JS-EVAL", Type: "code", Path: "src/app.js", Context: "eval(other)"},
+	} {
+		if Fingerprint(changed) == Fingerprint(finding) {
+			t.Errorf("Fingerprint() ignores the %s", name)
+		}
+	}
+}
+
+func TestHistory_TracksFindings(t *testing.T) {
+	dir := t.TempDir()
+	history, err := NewHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eval := Finding{ID: "JS-EVAL", Type: "code", Severity: "high", Path: "app.js", LineNumber: 2, Context: "eval(input)"}
+	sql := Finding{ID: "SQL", Type: "code", Severity: "medium", Path: "db.go", LineNumber: 9, Context: `"select " + id`}
+	start := time.Now()
+	record := func(id string, at time.Duration, status string, findings ...Finding) {
+		t.Helper()
+		scan := Scan{ID: id, Type: "code", PipelineID: "web", Status: status, Timestamp: start.Add(at), Findings: findings}
+		if err := history.Record(scan); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record("scan-1", 0, "completed", eval, sql)
+	moved := eval
+	moved.LineNumber = 30
+	record("scan-2", time.Hour, "completed", moved)
+
+	open := history.Findings(FindingFilter{Scope: "pipeline:web", Status: FindingOpen})
+	if len(open) != 1 || open[0].Finding.ID != "JS-EVAL" || open[0].Occurrences != 2 || open[0].FirstScanID != "scan-1" || open[0].LastScanID != "scan-2" {
+		t.Fatalf("open findings = %+v, want the moved eval seen by both scans", open)
+	}
+	if open[0].Finding.LineNumber != 30 || !open[0].FirstSeen.Equal(start) {
+		t.Errorf("tracked = %+v, want first seen at the first scan and the latest line", open[0])
+	}
+	fixed := history.Findings(FindingFilter{Status: FindingFixed})
+	if len(fixed) != 1 || fixed[0].Finding.ID != "SQL" || fixed[0].FixedAt == nil {
+		t.Fatalf("fixed findings = %+v, want the SQL finding fixed", fixed)
+	}
+
+	if _, err := history.SetTriage(open[0].ID, &Triage{State: "ignored"}); err == nil {
+		t.Error("SetTriage() with an unknown state expected error")
+	}
+	if _, err := history.SetTriage(open[0].ID, &Triage{State: TriageFalsePositive, Note: "sandboxed", By: "alice"}); err != nil {
+		t.Fatalf("SetTriage() error = %v", err)
+	}
+
+	// A canceled scan doesn't fix what it didn't reach, and a finding that
+	// comes back reopens
+	record("scan-3", 2*time.Hour, "canceled")
+	record("scan-4", 3*time.Hour, "completed", sql, eval)
+
+	reloaded, err := NewHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked, ok := reloaded.Finding(open[0].ID)
+	if !ok || tracked.Status != FindingOpen || tracked.Occurrences != 3 {
+		t.Errorf("reloaded eval = %+v, want it open and seen 3 times", tracked)
+	}
+	if tracked.Triage == nil || tracked.Triage.State != TriageFalsePositive || tracked.Triage.By != "alice" {
+		t.Errorf("Triage = %+v, want the triage kept across scans and restarts", tracked.Triage)
+	}
+	if sqlTracked, _ := reloaded.Finding(fixed[0].ID); sqlTracked.Status != FindingOpen || sqlTracked.FixedAt != nil {
+		t.Errorf("reloaded SQL = %+v, want it reopened", sqlTracked)
+	}
+}
+
+func TestCodeScan_GatesOnNewAndUntriagedFindings(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "app.js"), []byte("eval(input)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	plugin := NewSecurityPlugin()
+	plugin.config.CodeScan.Rules = []CodeRule{{ID: "JS-EVAL", Severity: "high", Pattern: `\beval\(`}}
+	step := core.Step{Type: "code-scan", Config: map[string]interface{}{"targetDir": dir, "pipelineId": "web", "failOn": "high"}}
+
+	outputs, err := plugin.Execute(context.Background(), step)
+	if err == nil {
+		t.Fatal("Execute() error = nil, want the eval to fail the first scan")
+	}
+	if finding := outputs["scan"].(Scan).Findings[0]; finding.Fingerprint == "" {
+		t.Errorf("finding = %+v, want it fingerprinted", finding)
+	}
+
+	step.Config["newOnly"] = true
+	if _, err := plugin.Execute(context.Background(), step); err != nil {
+		t.Errorf("Execute() with newOnly error = %v, want the known eval not to fail the step", err)
+	}
+
+	delete(step.Config, "newOnly")
+	tracked := plugin.History().Findings(FindingFilter{Scope: "pipeline:web"})
+	if _, err := plugin.History().SetTriage(tracked[0].ID, &Triage{State: TriageAcceptedRisk}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plugin.Execute(context.Background(), step); err != nil {
+		t.Errorf("Execute() error = %v, want the accepted risk not to fail the step", err)
+	}
+}
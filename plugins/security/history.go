@@ -0,0 +1,137 @@
+package security
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// History stores completed scans, from pipelines and from scheduled scans
+// alike. Scans are kept in memory and, if the history has a directory,
+// persisted there as one JSON file per scan. Findings are tracked across
+// scans by fingerprint.
+type History struct {
+	dir      string
+	mu       sync.RWMutex
+	scans    []Scan
+	findings map[string]*TrackedFinding
+	triage   map[string]*Triage
+}
+
+// ScanFilter selects scans from the history. Empty fields match every scan.
+type ScanFilter struct {
+	PipelineID string
+	ScheduleID string
+	Type       string
+	Limit      int
+}
+
+// NewHistory opens the scan history persisted in dir, creating it if needed
+func NewHistory(dir string) (*History, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create scan history directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scan history: %w", err)
+	}
+
+	h := &History{dir: dir}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read scan %s: %w", entry.Name(), err)
+		}
+		var scan Scan
+		if err := json.Unmarshal(data, &scan); err != nil {
+			return nil, fmt.Errorf("failed to decode scan %s: %w", entry.Name(), err)
+		}
+		h.scans = append(h.scans, scan)
+	}
+	sort.SliceStable(h.scans, func(i, j int) bool {
+		return h.scans[i].Timestamp.Before(h.scans[j].Timestamp)
+	})
+	if err := h.loadTriage(); err != nil {
+		return nil, err
+	}
+	for _, scan := range h.scans {
+		h.track(scan)
+	}
+
+	return h, nil
+}
+
+// NewMemoryHistory returns a history that is not persisted
+func NewMemoryHistory() *History {
+	return &History{}
+}
+
+// Record adds a scan to the history, fingerprinting its findings and
+// tracking them in the scan's scope
+func (h *History) Record(scan Scan) error {
+	h.mu.Lock()
+	h.track(scan)
+	h.scans = append(h.scans, scan)
+	h.mu.Unlock()
+
+	if h.dir == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(scan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode scan: %w", err)
+	}
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(scan.ID) + ".json"
+	tmp := filepath.Join(h.dir, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write scan: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(h.dir, name))
+}
+
+// List returns the scans matching filter, newest first
+func (h *History) List(filter ScanFilter) []Scan {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	scans := []Scan{}
+	for i := len(h.scans) - 1; i >= 0; i-- {
+		scan := h.scans[i]
+		if filter.PipelineID != "" && scan.PipelineID != filter.PipelineID {
+			continue
+		}
+		if filter.ScheduleID != "" && scan.ScheduleID != filter.ScheduleID {
+			continue
+		}
+		if filter.Type != "" && scan.Type != filter.Type {
+			continue
+		}
+		scans = append(scans, scan)
+		if filter.Limit > 0 && len(scans) == filter.Limit {
+			break
+		}
+	}
+	return scans
+}
+
+// Get returns a scan by ID
+func (h *History) Get(id string) (Scan, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, scan := range h.scans {
+		if scan.ID == id {
+			return scan, true
+		}
+	}
+	return Scan{}, false
+}
@@ -0,0 +1,74 @@
+package security
+
+import (
+	"encoding/json"
+
+	"github.com/chip/conveyor/i18n"
+)
+
+// findingMessage is the message key and arguments a finding's title and
+// description were written from, kept in its metadata so recorded scans
+// can be localized
+type findingMessage struct {
+	Key  string   `json:"key"`
+	Args []string `json:"args,omitempty"`
+}
+
+// message returns the message of a finding. Recorded scans decode it as a
+// map, so it is converted back.
+func (f Finding) message() (findingMessage, bool) {
+	var message findingMessage
+	switch value := f.Metadata["message"].(type) {
+	case findingMessage:
+		return value, true
+	case nil:
+		return message, false
+	default:
+		data, err := json.Marshal(value)
+		if err != nil || json.Unmarshal(data, &message) != nil || message.Key == "" {
+			return message, false
+		}
+		return message, true
+	}
+}
+
+// Localize returns the finding with its title and description in lang.
+// Findings without a message, such as Semgrep's, and languages without a
+// translation keep the English text; IDs, types and severities are never
+// translated.
+func (f Finding) Localize(lang string) Finding {
+	message, ok := f.message()
+	if !ok || lang == i18n.Default {
+		return f
+	}
+	if key := message.Key + ".title"; i18n.Translated(lang, key) {
+		f.Title = i18n.Sprintf(lang, key, f.Title)
+	}
+	if key := message.Key + ".description"; i18n.Translated(lang, key) {
+		args := make([]interface{}, len(message.Args))
+		for i, arg := range message.Args {
+			args[i] = arg
+		}
+		f.Description = i18n.Sprintf(lang, key, f.Description, args...)
+	}
+	return f
+}
+
+// LocalizeFindings returns copies of findings in lang
+func LocalizeFindings(findings []Finding, lang string) []Finding {
+	if findings == nil || lang == i18n.Default {
+		return findings
+	}
+	localized := make([]Finding, len(findings))
+	for i, finding := range findings {
+		localized[i] = finding.Localize(lang)
+	}
+	return localized
+}
+
+// Localize returns a copy of the scan with its findings in lang
+func (s Scan) Localize(lang string) Scan {
+	s.Findings = LocalizeFindings(s.Findings, lang)
+	s.Suppressed = LocalizeFindings(s.Suppressed, lang)
+	return s
+}
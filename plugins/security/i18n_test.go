@@ -0,0 +1,62 @@
+package security
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chip/conveyor/core"
+)
+
+func TestFinding_Localize(t *testing.T) {
+	pipeline := &core.Pipeline{ID: "web", Stages: []core.Stage{{
+		Name:  "build",
+		Steps: []core.Step{{Name: "lint", Image: "golangci/golangci-lint:latest", Command: "make lint"}},
+	}}}
+	findings := AnalyzePipeline(pipeline, "pipelines/web.yaml")
+	if len(findings) != 1 {
+		t.Fatalf("findings = %+v, want the unpinned image", findings)
+	}
+	english := findings[0]
+
+	// Recorded scans decode the message from JSON
+	data, _ := json.Marshal(english)
+	var recorded Finding
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		t.Fatal(err)
+	}
+	for _, finding := range []Finding{english, recorded} {
+		localized := finding.Localize("ja")
+		if localized.Title != "バージョンが固定されていないイメージ" || !strings.Contains(localized.Description, "golangci/golangci-lint:latest") {
+			t.Errorf("Localize(ja) = %q, %q", localized.Title, localized.Description)
+		}
+		if localized.ID != RuleUnpinnedImage || localized.Severity != "medium" {
+			t.Errorf("Localize(ja) changed the rule or severity: %+v", localized)
+		}
+	}
+	if finding := english.Localize("en"); finding.Title != "Unpinned image" {
+		t.Errorf("Localize(en) title = %q", finding.Title)
+	}
+	semgrep := Finding{ID: "python.eval", Title: "eval", Description: "Avoid eval"}
+	if finding := semgrep.Localize("es"); finding.Description != "Avoid eval" {
+		t.Errorf("Localize(es) of a finding without a message = %+v", finding)
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	scan := Scan{ID: "scan-1", Type: "pipeline", Status: "completed", Timestamp: time.Date(2024, 3, 15, 23, 30, 0, 0, time.UTC), Findings: []Finding{
+		{ID: "JS-EVAL", Severity: "high", Title: "<script>eval</script>", Path: "app.js", LineNumber: 3},
+	}}
+	var out bytes.Buffer
+	if err := WriteReport(&out, scan, "es", time.FixedZone("JST", 9*60*60)); err != nil {
+		t.Fatalf("WriteReport() error = %v", err)
+	}
+	report := out.String()
+	for _, want := range []string{`<html lang="es">`, "Informe de seguridad: scan-1", "Alta", "app.js:3", "&lt;script&gt;", "2024-03-16 08:30 JST (&#43;09:00)"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report is missing %q:\n%s", want, report)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package security
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Overview aggregates the security posture across every pipeline. Findings
+// triaged as false positives or accepted risks aren't open; they are only
+// counted as suppressed.
+type Overview struct {
+	GeneratedAt      time.Time         `json:"generatedAt"`
+	OpenFindings     int               `json:"openFindings"`
+	Suppressed       int               `json:"suppressed"`
+	BySeverity       map[string]int    `json:"bySeverity"`
+	ByScope          map[string]int    `json:"byScope"`
+	TopRules         []RuleCount       `json:"topRules"`
+	TopComponents    []ComponentRisk   `json:"topComponents"`
+	FailingPipelines []FailingPipeline `json:"failingPipelines"`
+	SLABreaches      []SLABreach       `json:"slaBreaches"`
+	SLAPolicies      []SLAPolicy       `json:"slaPolicies"`
+}
+
+// RuleCount is how many open findings a rule has
+type RuleCount struct {
+	Rule  string `json:"rule"`
+	Title string `json:"title,omitempty"`
+	Count int    `json:"count"`
+}
+
+// ComponentRisk is a vulnerable dependency across pipelines
+type ComponentRisk struct {
+	Package   string   `json:"package"`
+	Versions  []string `json:"versions"`
+	Findings  int      `json:"findings"`
+	Severity  string   `json:"severity"`
+	Pipelines []string `json:"pipelines"`
+}
+
+// FailingPipeline is a pipeline whose latest scan of some type failed its
+// policy
+type FailingPipeline struct {
+	PipelineID string    `json:"pipelineId"`
+	ScanID     string    `json:"scanId"`
+	ScanType   string    `json:"scanType"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// Overview aggregates the open findings and latest scans of the history,
+// checking finding age against the SLA policies. Lists are limited to the
+// top limit entries; SLA breaches are all listed, oldest first.
+func (h *History) Overview(policies []SLAPolicy, limit int, now time.Time) Overview {
+	overview := Overview{
+		GeneratedAt:      now,
+		BySeverity:       make(map[string]int),
+		ByScope:          make(map[string]int),
+		TopRules:         []RuleCount{},
+		TopComponents:    []ComponentRisk{},
+		FailingPipelines: []FailingPipeline{},
+		SLAPolicies:      policies,
+	}
+
+	rules := make(map[string]*RuleCount)
+	components := make(map[string]*ComponentRisk)
+	for _, tracked := range h.Findings(FindingFilter{Status: FindingOpen}) {
+		if suppressed(tracked) {
+			overview.Suppressed++
+			continue
+		}
+		finding := tracked.Finding
+		severity := strings.ToLower(finding.Severity)
+		overview.OpenFindings++
+		overview.BySeverity[severity]++
+		overview.ByScope[tracked.Scope]++
+
+		rule, ok := rules[finding.ID]
+		if !ok {
+			rule = &RuleCount{Rule: finding.ID, Title: finding.Title}
+			rules[finding.ID] = rule
+		}
+		rule.Count++
+
+		if finding.Package != "" {
+			component, ok := components[finding.Package]
+			if !ok {
+				component = &ComponentRisk{Package: finding.Package, Versions: []string{}, Pipelines: []string{}}
+				components[finding.Package] = component
+			}
+			component.Findings++
+			if severityRanks[severity] > severityRanks[component.Severity] {
+				component.Severity = severity
+			}
+			component.Versions = appendUnique(component.Versions, finding.Version)
+			if pipelineID := strings.TrimPrefix(tracked.Scope, "pipeline:"); pipelineID != tracked.Scope {
+				component.Pipelines = appendUnique(component.Pipelines, pipelineID)
+			}
+		}
+	}
+
+	for _, rule := range rules {
+		overview.TopRules = append(overview.TopRules, *rule)
+	}
+	sort.Slice(overview.TopRules, func(i, j int) bool {
+		a, b := overview.TopRules[i], overview.TopRules[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Rule < b.Rule
+	})
+	for _, component := range components {
+		sort.Strings(component.Versions)
+		sort.Strings(component.Pipelines)
+		overview.TopComponents = append(overview.TopComponents, *component)
+	}
+	sort.Slice(overview.TopComponents, func(i, j int) bool {
+		a, b := overview.TopComponents[i], overview.TopComponents[j]
+		if severityRanks[a.Severity] != severityRanks[b.Severity] {
+			return severityRanks[a.Severity] > severityRanks[b.Severity]
+		}
+		if a.Findings != b.Findings {
+			return a.Findings > b.Findings
+		}
+		return a.Package < b.Package
+	})
+	if limit > 0 {
+		if len(overview.TopRules) > limit {
+			overview.TopRules = overview.TopRules[:limit]
+		}
+		if len(overview.TopComponents) > limit {
+			overview.TopComponents = overview.TopComponents[:limit]
+		}
+	}
+
+	overview.FailingPipelines = h.failingPipelines()
+	overview.SLABreaches = h.SLABreaches(policies, now)
+	return overview
+}
+
+// failingPipelines returns the pipelines whose latest scan of a type failed
+func (h *History) failingPipelines() []FailingPipeline {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	latest := make(map[string]Scan)
+	for _, scan := range h.scans {
+		if scan.PipelineID == "" || scan.Status == "canceled" {
+			continue
+		}
+		latest[scan.PipelineID+"\x00"+scan.Type] = scan
+	}
+	failing := []FailingPipeline{}
+	for _, scan := range latest {
+		if scan.Status == "failed" {
+			failing = append(failing, FailingPipeline{
+				PipelineID: scan.PipelineID,
+				ScanID:     scan.ID,
+				ScanType:   scan.Type,
+				Timestamp:  scan.Timestamp,
+			})
+		}
+	}
+	sort.Slice(failing, func(i, j int) bool {
+		if failing[i].PipelineID != failing[j].PipelineID {
+			return failing[i].PipelineID < failing[j].PipelineID
+		}
+		return failing[i].ScanType < failing[j].ScanType
+	})
+	return failing
+}
+
+// suppressed reports whether a finding is triaged so it doesn't count
+func suppressed(tracked TrackedFinding) bool {
+	return tracked.Triage != nil && (tracked.Triage.State == TriageFalsePositive || tracked.Triage.State == TriageAcceptedRisk)
+}
+
+func appendUnique(values []string, value string) []string {
+	if value == "" {
+		return values
+	}
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
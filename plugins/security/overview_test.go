@@ -0,0 +1,47 @@
+package security
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistory_Overview(t *testing.T) {
+	history := NewMemoryHistory()
+	now := time.Now()
+	lodash := Finding{ID: "CVE-2021-1234", Type: "vulnerability", Severity: "high", Package: "lodash", Version: "4.17.20"}
+	express := Finding{ID: "CVE-2021-5678", Type: "vulnerability", Severity: "medium", Package: "express", Version: "4.17.1"}
+	eval := Finding{ID: "JS-EVAL", Type: "code", Severity: "high", Path: "app.js", Context: "eval(x)"}
+	scans := []Scan{
+		{ID: "s1", Type: "vulnerability", PipelineID: "web", Status: "failed", Timestamp: now.Add(-40 * 24 * time.Hour), Findings: []Finding{lodash, express}},
+		{ID: "s2", Type: "vulnerability", PipelineID: "api", Status: "completed", Timestamp: now.Add(-24 * time.Hour), Findings: []Finding{lodash}},
+		{ID: "s3", Type: "code", PipelineID: "api", Status: "failed", Timestamp: now.Add(-time.Hour), Findings: []Finding{eval}},
+		{ID: "s4", Type: "code", PipelineID: "web", Status: "failed", Timestamp: now.Add(-time.Hour), Findings: []Finding{eval}},
+	}
+	for _, scan := range scans {
+		if err := history.Record(scan); err != nil {
+			t.Fatal(err)
+		}
+	}
+	web := history.Findings(FindingFilter{Scope: "pipeline:web", ScanType: "code"})
+	history.SetTriage(web[0].ID, &Triage{State: TriageFalsePositive})
+
+	overview := history.Overview(DefaultSLAPolicies, 1, now)
+	if overview.OpenFindings != 4 || overview.Suppressed != 1 {
+		t.Errorf("open = %d, suppressed = %d, want 4 and 1", overview.OpenFindings, overview.Suppressed)
+	}
+	if overview.BySeverity["high"] != 3 || overview.ByScope["pipeline:web"] != 2 {
+		t.Errorf("BySeverity = %v, ByScope = %v", overview.BySeverity, overview.ByScope)
+	}
+	if len(overview.TopRules) != 1 || overview.TopRules[0].Rule != "CVE-2021-1234" || overview.TopRules[0].Count != 2 {
+		t.Errorf("TopRules = %+v, want the lodash CVE first and the list limited", overview.TopRules)
+	}
+	if c := overview.TopComponents[0]; c.Package != "lodash" || c.Findings != 2 || len(c.Pipelines) != 2 {
+		t.Errorf("TopComponents = %+v, want lodash in both pipelines", overview.TopComponents)
+	}
+	if len(overview.FailingPipelines) != 3 {
+		t.Errorf("FailingPipelines = %+v, want both code scans and the web vulnerability scan", overview.FailingPipelines)
+	}
+	if len(overview.SLABreaches) != 1 || overview.SLABreaches[0].Rule != "CVE-2021-1234" || overview.SLABreaches[0].AgeDays != 40 {
+		t.Errorf("SLABreaches = %+v, want the 40 day old high finding in web", overview.SLABreaches)
+	}
+}
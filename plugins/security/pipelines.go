@@ -0,0 +1,321 @@
+package security
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/core/loader"
+)
+
+// Pipeline scan rules
+const (
+	RuleRemoteScript    = "PIPELINE-REMOTE-SCRIPT"
+	RulePlaintextSecret = "PIPELINE-PLAINTEXT-SECRET"
+	RuleUnpinnedImage   = "PIPELINE-UNPINNED-IMAGE"
+	RuleUnpinnedPlugin  = "PIPELINE-UNPINNED-PLUGIN"
+	RuleBroadSecrets    = "PIPELINE-BROAD-SECRETS"
+)
+
+// maxStepSecrets is how many secrets a step can list before its exposure
+// is reported as overly broad
+const maxStepSecrets = 5
+
+var (
+	// remoteScript matches a download piped into a shell, as in
+	// "curl -sSL https://get.example.com | sudo bash"
+	remoteScript = regexp.MustCompile(`\b(curl|wget)\b[^|;&\n]*\|\s*(sudo\s+(-\S+\s+)*)?(ba|z|da|k)?sh\b`)
+	// secretName matches environment variable names that hold credentials
+	secretName = regexp.MustCompile(`(?i)(token|secret|passw(or)?d|api_?key|private_?key|credential|access_?key)`)
+	// secretValue matches values that look like well-known credentials
+	secretValue = regexp.MustCompile(`AKIA[0-9A-Z]{16}|gh[pousr]_[A-Za-z0-9]{36}|xox[abpr]-[A-Za-z0-9-]{10,}|-----BEGIN [A-Z ]*PRIVATE KEY-----|glpat-[A-Za-z0-9_-]{20}`)
+	// envReference matches values taken from elsewhere rather than written
+	// out, such as "$TOKEN" or "${{ trigger.token }}"
+	envReference = regexp.MustCompile(`^\$(\{\{.*\}\}|\{?[A-Za-z_][A-Za-z0-9_]*\}?)$`)
+)
+
+// severityRanks orders severities for policy thresholds
+var severityRanks = map[string]int{"info": 0, "low": 1, "medium": 2, "high": 3, "critical": 4}
+
+// PipelineScanConfig configures the scan of pipeline definitions. FailOn is
+// the lowest severity that fails a pipeline-scan step; empty never fails.
+type PipelineScanConfig struct {
+	Enabled bool   `json:"enabled"`
+	FailOn  string `json:"failOn,omitempty"`
+}
+
+// ValidateSeverity checks a severity threshold
+func ValidateSeverity(severity string) error {
+	if _, ok := severityRanks[strings.ToLower(severity)]; !ok {
+		return fmt.Errorf("severity must be info, low, medium, high or critical, got %q", severity)
+	}
+	return nil
+}
+
+// AnalyzePipeline reports risky patterns in a pipeline definition: remote
+// scripts piped into a shell, credentials written out in environment
+// values, images and plugins without a pinned version and steps exposed to
+// more secrets than they use. path names where the definition came from.
+func AnalyzePipeline(pipeline *core.Pipeline, path string) []Finding {
+	a := &pipelineAnalysis{pipeline: pipeline, path: path}
+	a.environment("pipeline", pipeline.Environment)
+	for _, stage := range pipeline.Stages {
+		for _, service := range stage.Services {
+			a.service("stage "+stage.Name, service)
+		}
+		for _, step := range append(append([]core.Step{}, stage.Steps...), stage.Rollback...) {
+			a.step(stage, step)
+		}
+	}
+	return a.findings
+}
+
+// pipelineAnalysis collects the findings of one pipeline
+type pipelineAnalysis struct {
+	pipeline *core.Pipeline
+	path     string
+	findings []Finding
+}
+
+// add records a finding whose title and description are localized with
+// the message key and args
+func (a *pipelineAnalysis) add(rule, severity, location, context, message, title, description string, args ...string) {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg
+	}
+	a.findings = append(a.findings, Finding{
+		ID:          rule,
+		Type:        "pipeline",
+		Title:       title,
+		Description: fmt.Sprintf(description, values...),
+		Severity:    severity,
+		Path:        a.path,
+		Location:    location,
+		Context:     context,
+		Metadata: map[string]interface{}{
+			"pipelineId": a.pipeline.ID,
+			"message":    findingMessage{Key: message, Args: args},
+		},
+	})
+}
+
+func (a *pipelineAnalysis) step(stage core.Stage, step core.Step) {
+	location := fmt.Sprintf("stage %s, step %s", stage.Name, step.Name)
+
+	remote := ""
+	for _, line := range strings.Split(step.Command, "\n") {
+		if remoteScript.MatchString(line) {
+			remote = strings.TrimSpace(line)
+			a.add(RuleRemoteScript, "high", location, remote, "pipeline.remote_script", "Remote script piped into a shell",
+				"The step runs a script downloaded at build time without verifying it. Download it, check its checksum or signature, then run it.")
+		}
+	}
+
+	a.environment(location, step.Environment)
+	if step.Image != "" && !pinnedImage(step.Image) {
+		a.add(RuleUnpinnedImage, "medium", location, step.Image, "pipeline.unpinned_image", "Unpinned image",
+			"Image %s is not pinned to a version or digest, so the step can run different code from one job to the next.", step.Image)
+	}
+	for _, service := range step.Services {
+		a.service(location, service)
+	}
+	if step.Plugin != "" && !pinnedPlugin(step) {
+		a.add(RuleUnpinnedPlugin, "low", location, step.Plugin, "pipeline.unpinned_plugin", "Unpinned plugin",
+			"Plugin %[1]s is not pinned to a version. Reference it as %[1]s@<version> so upgrades of the plugin are deliberate.", step.Plugin)
+	}
+
+	if len(step.Secrets) == 0 {
+		return
+	}
+	names := strings.Join(step.Secrets, ", ")
+	switch {
+	case remote != "":
+		a.add(RuleBroadSecrets, "high", location, remote, "pipeline.secrets_remote_script", "Secrets exposed to a remote script",
+			"The step's secrets (%s) are in the environment of a script downloaded at build time.", names)
+	case len(step.Secrets) > maxStepSecrets:
+		a.add(RuleBroadSecrets, "medium", location, names, "pipeline.secrets_many", "Step exposed to many secrets",
+			"The step lists %s secrets. Split it so each step only gets the secrets it needs.", strconv.Itoa(len(step.Secrets)))
+	}
+	if step.Command != "" {
+		for _, name := range step.Secrets {
+			if !strings.Contains(step.Command, "$"+name) && !strings.Contains(step.Command, "${"+name) {
+				a.add(RuleBroadSecrets, "low", location, name, "pipeline.secret_unused", "Secret not used by the step's command",
+					"Secret %s is exposed to the step but its command doesn't reference it.", name)
+			}
+		}
+	}
+}
+
+func (a *pipelineAnalysis) service(location string, service core.Service) {
+	location += ", service " + service.Name
+	if !pinnedImage(service.Image) {
+		a.add(RuleUnpinnedImage, "medium", location, service.Image, "pipeline.unpinned_service_image", "Unpinned image",
+			"Image %s is not pinned to a version or digest, so the service can change from one job to the next.", service.Image)
+	}
+	a.environment(location, service.Environment)
+}
+
+func (a *pipelineAnalysis) environment(location string, env map[string]string) {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := strings.TrimSpace(env[name])
+		if value == "" || envReference.MatchString(value) {
+			continue
+		}
+		if secretValue.MatchString(value) || secretName.MatchString(name) {
+			a.add(RulePlaintextSecret, "high", location, name, "pipeline.plaintext_secret", "Secret in a plain environment value",
+				"Environment variable %s holds a value that looks like a credential. Store it as a secret and list it in the step's secrets.", name)
+		}
+	}
+}
+
+// pinnedImage reports whether an image names a digest or a tag other than
+// latest
+func pinnedImage(image string) bool {
+	if strings.Contains(image, "@sha256:") {
+		return true
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	i := strings.LastIndex(name, ":")
+	return i >= 0 && name[i+1:] != "" && name[i+1:] != "latest"
+}
+
+// pinnedPlugin reports whether a plugin step names a version other than
+// latest
+func pinnedPlugin(step core.Step) bool {
+	i := strings.LastIndex(step.Plugin, "@")
+	return i >= 0 && step.Plugin[i+1:] != "" && step.Plugin[i+1:] != "latest"
+}
+
+// newPipelineScan builds a scan of pipeline definitions from its findings
+func newPipelineScan(scanID, pipelineID, jobID string, findings []Finding) Scan {
+	scan := Scan{
+		ID:            scanID,
+		Type:          "pipeline",
+		PipelineID:    pipelineID,
+		JobID:         jobID,
+		Status:        "completed",
+		Timestamp:     time.Now(),
+		FindingsCount: len(findings),
+		Findings:      findings,
+	}
+	countSeverities(&scan)
+	return scan
+}
+
+// executePipelineScan scans the pipeline definitions under the step's path,
+// pipelines by default, relative to its target directory. The step fails
+// when findings reach its failOn severity or the plugin's; with newOnly,
+// only findings the scope hasn't had before count.
+func (p *SecurityPlugin) executePipelineScan(ctx context.Context, scanID string, step core.Step) (map[string]interface{}, error) {
+	if !p.config.PipelineScan.Enabled {
+		return map[string]interface{}{
+			"status": "skipped",
+			"reason": "pipeline scan is disabled",
+		}, nil
+	}
+
+	failOn := p.config.PipelineScan.FailOn
+	if value, ok := step.Config["failOn"].(string); ok {
+		if err := ValidateSeverity(value); err != nil {
+			return nil, err
+		}
+		failOn = value
+	}
+	dir, _ := step.Config["targetDir"].(string)
+	if dir == "" {
+		dir, _ = step.Config["workDir"].(string)
+	}
+	path, _ := step.Config["path"].(string)
+	if path == "" {
+		path = "pipelines"
+	}
+
+	files, err := definitionFiles(filepath.Join(dir, path))
+	if err != nil {
+		return nil, err
+	}
+	var findings []Finding
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		yp, err := loader.Parse(data)
+		if err != nil || len(yp.Stages) == 0 {
+			// Not a pipeline definition
+			continue
+		}
+		id := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		pipeline, err := loader.Convert(yp, id)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			rel = file
+		}
+		findings = append(findings, AnalyzePipeline(pipeline, filepath.ToSlash(rel))...)
+	}
+
+	pipelineID, _ := step.Config["pipelineId"].(string)
+	jobID, _ := step.Config["jobId"].(string)
+	scan := newPipelineScan(scanID, pipelineID, jobID, findings)
+	newOnly, _ := step.Config["newOnly"].(bool)
+	failing := p.gate(&scan, stepScope(step), failOn, newOnly)
+	outputs := map[string]interface{}{"scan": scan}
+	if failing > 0 {
+		return outputs, fmt.Errorf("pipeline scan found %d issues at or above %s severity", failing, failOn)
+	}
+	return outputs, nil
+}
+
+// ScanPipeline scans a registered pipeline's definition, records the scan
+// and marks it failed when its findings reach the plugin's failOn severity
+func (p *SecurityPlugin) ScanPipeline(pipeline *core.Pipeline) (Scan, error) {
+	scanID := fmt.Sprintf("scan-%d-%d", time.Now().Unix(), atomic.AddUint64(&scanCounter, 1))
+	scan := newPipelineScan(scanID, pipeline.ID, "", AnalyzePipeline(pipeline, "pipeline:"+pipeline.ID))
+	p.gate(&scan, scanScope(scan), p.config.PipelineScan.FailOn, false)
+	if err := p.history.Record(scan); err != nil {
+		return scan, fmt.Errorf("failed to record pipeline scan: %w", err)
+	}
+	return scan, nil
+}
+
+// definitionFiles returns the YAML files at path, which is a file or a
+// directory. A missing path has none.
+func definitionFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var files []string
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(path, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("failed to glob %s: %w", pattern, err)
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -3,14 +3,33 @@ package security
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/chip/conveyor/config"
 	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/logging"
 )
 
+var scanCounter uint64
+
 // SecurityPlugin implements the Plugin interface for security scanning
 type SecurityPlugin struct {
-	config SecurityConfig
+	config  SecurityConfig
+	history *History
+	// runTool runs external scanners such as semgrep
+	runTool func(ctx context.Context, dir string, env map[string]string, name string, args ...string) ([]byte, []byte, error)
+
+	budgetMu sync.Mutex
+	budget   *memoryBudget
+
+	activeMu sync.Mutex
+	active   map[string]*activeScan
+
+	vex      *VEX
+	enricher *Enricher
 }
 
 // SecurityConfig represents the security plugin configuration
@@ -18,6 +37,17 @@ type SecurityConfig struct {
 	VulnerabilityScan VulnerabilityConfig `json:"vulnerabilityScan"`
 	SecretScan        SecretConfig        `json:"secretScan"`
 	LicenseScan       LicenseConfig       `json:"licenseScan"`
+	PipelineScan      PipelineScanConfig  `json:"pipelineScan"`
+	CodeScan          CodeScanConfig      `json:"codeScan"`
+	DriftScan         DriftScanConfig     `json:"driftScan"`
+	// MemoryBudget is the memory all running scans buffer files in, such
+	// as "256Mi"; DefaultMemoryBudget when empty
+	MemoryBudget string `json:"memoryBudget,omitempty"`
+	// Dependencies are the private registries and proxy scanners resolve
+	// packages through
+	Dependencies config.Dependencies `json:"dependencies,omitempty"`
+	// Offline scans only use local rules and databases
+	Offline bool `json:"offline,omitempty"`
 }
 
 // VulnerabilityConfig represents the vulnerability scan configuration
@@ -42,40 +72,61 @@ type LicenseConfig struct {
 
 // Scan represents a security scan
 type Scan struct {
-	ID            string                 `json:"id"`
-	Type          string                 `json:"type"`
-	PipelineID    string                 `json:"pipelineId"`
-	JobID         string                 `json:"jobId"`
-	Status        string                 `json:"status"`
-	Timestamp     time.Time              `json:"timestamp"`
-	FindingsCount int                    `json:"findingsCount"`
-	HighCount     int                    `json:"highCount,omitempty"`
-	MediumCount   int                    `json:"mediumCount,omitempty"`
-	LowCount      int                    `json:"lowCount,omitempty"`
-	Findings      []Finding              `json:"findings,omitempty"`
-	Metadata      map[string]interface{} `json:"metadata,omitempty"`
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	PipelineID    string    `json:"pipelineId"`
+	JobID         string    `json:"jobId"`
+	Target        string    `json:"target,omitempty"`
+	ScheduleID    string    `json:"scheduleId,omitempty"`
+	Status        string    `json:"status"`
+	Timestamp     time.Time `json:"timestamp"`
+	FindingsCount int       `json:"findingsCount"`
+	HighCount     int       `json:"highCount,omitempty"`
+	MediumCount   int       `json:"mediumCount,omitempty"`
+	LowCount      int       `json:"lowCount,omitempty"`
+	Findings      []Finding `json:"findings,omitempty"`
+	// Suppressed are the findings VEX statements mark as not affected or
+	// fixed; they don't count towards the scan's findings
+	Suppressed []Finding              `json:"suppressed,omitempty"`
+	Metadata   map[string]interface{} `json:"metadata,omitempty"`
 }
 
 // Finding represents a security finding
 type Finding struct {
-	ID          string                 `json:"id"`
-	Type        string                 `json:"type"`
-	Title       string                 `json:"title"`
-	Description string                 `json:"description"`
-	Severity    string                 `json:"severity"`
-	Package     string                 `json:"package,omitempty"`
-	Version     string                 `json:"version,omitempty"`
-	FixVersion  string                 `json:"fixVersion,omitempty"`
-	Path        string                 `json:"path,omitempty"`
-	LineNumber  int                    `json:"lineNumber,omitempty"`
-	Context     string                 `json:"context,omitempty"`
-	License     string                 `json:"license,omitempty"`
-	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Severity    string `json:"severity"`
+	Package     string `json:"package,omitempty"`
+	Ecosystem   string `json:"ecosystem,omitempty"`
+	Version     string `json:"version,omitempty"`
+	FixVersion  string `json:"fixVersion,omitempty"`
+	Path        string `json:"path,omitempty"`
+	// Location is where in the file the finding is, such as a pipeline's
+	// stage and step
+	Location   string `json:"location,omitempty"`
+	LineNumber int    `json:"lineNumber,omitempty"`
+	Context    string `json:"context,omitempty"`
+	// Fingerprint identifies the finding across scans, set when the scan
+	// is recorded
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// EPSS is the probability of the CVE being exploited in the next 30
+	// days, and KEV whether it is known to be exploited
+	EPSS           float64                `json:"epss,omitempty"`
+	EPSSPercentile float64                `json:"epssPercentile,omitempty"`
+	KEV            bool                   `json:"kev,omitempty"`
+	License        string                 `json:"license,omitempty"`
+	Metadata       map[string]interface{} `json:"metadata,omitempty"`
 }
 
-// NewSecurityPlugin creates a new security plugin
+// NewSecurityPlugin creates a new security plugin that records its scans in
+// an in-memory history
 func NewSecurityPlugin() *SecurityPlugin {
 	return &SecurityPlugin{
+		history: NewMemoryHistory(),
+		runTool: runTool,
+		vex:     NewMemoryVEX(),
 		config: SecurityConfig{
 			VulnerabilityScan: VulnerabilityConfig{
 				Enabled:     true,
@@ -91,6 +142,15 @@ func NewSecurityPlugin() *SecurityPlugin {
 				AllowedList: []string{"MIT", "Apache-2.0", "BSD-3-Clause"},
 				BlockedList: []string{"GPL-3.0"},
 			},
+			PipelineScan: PipelineScanConfig{
+				Enabled: true,
+			},
+			CodeScan: CodeScanConfig{
+				Enabled: true,
+			},
+			DriftScan: DriftScanConfig{
+				Enabled: true,
+			},
 		},
 	}
 }
@@ -103,14 +163,42 @@ func (p *SecurityPlugin) GetManifest() core.PluginManifest {
 		Description: "Security scanning plugin for vulnerability, secret, and license scanning",
 		Author:      "Conveyor Team",
 		Type:        "scanner",
-		StepTypes:   []string{"vulnerability-scan", "secret-scan", "license-scan"},
+		StepTypes:   []string{"vulnerability-scan", "secret-scan", "license-scan", "pipeline-scan", "code-scan", "drift-scan"},
 	}
 }
 
-// Execute runs a security scan
+// Execute runs a security scan and records it in the scan history. Scans
+// failing their policy are recorded too.
 func (p *SecurityPlugin) Execute(ctx context.Context, step core.Step) (map[string]interface{}, error) {
-	scanID := fmt.Sprintf("scan-%d", time.Now().Unix())
-	
+	outputs, err := p.run(ctx, step)
+	if outputs == nil {
+		return nil, err
+	}
+
+	if scan, ok := outputs["scan"].(Scan); ok {
+		if target, ok := step.Config["targetDir"].(string); ok {
+			scan.Target = target
+		}
+		if err := p.history.Record(scan); err != nil {
+			logging.Warnf("Failed to record security scan %s: %v", scan.ID, err)
+		}
+	}
+	return outputs, err
+}
+
+// run dispatches a scan by step type without recording it
+func (p *SecurityPlugin) run(ctx context.Context, step core.Step) (map[string]interface{}, error) {
+	scanID := fmt.Sprintf("scan-%d-%d", time.Now().Unix(), atomic.AddUint64(&scanCounter, 1))
+	pipelineID, _ := step.Config["pipelineId"].(string)
+	jobID, _ := step.Config["jobId"].(string)
+	ctx, done := p.startScan(ctx, ScanProgress{
+		ScanID:     scanID,
+		Type:       strings.TrimSuffix(step.Type, "-scan"),
+		PipelineID: pipelineID,
+		JobID:      jobID,
+	})
+	defer done()
+
 	switch step.Type {
 	case "vulnerability-scan":
 		return p.executeVulnerabilityScan(ctx, scanID, step)
@@ -118,12 +206,22 @@ func (p *SecurityPlugin) Execute(ctx context.Context, step core.Step) (map[strin
 		return p.executeSecretScan(ctx, scanID, step)
 	case "license-scan":
 		return p.executeLicenseScan(ctx, scanID, step)
+	case "pipeline-scan":
+		return p.executePipelineScan(ctx, scanID, step)
+	case "code-scan":
+		return p.executeCodeScan(ctx, scanID, step)
+	case "drift-scan":
+		return p.executeDriftScan(ctx, scanID, step)
 	default:
 		return nil, fmt.Errorf("unsupported step type: %s", step.Type)
 	}
 }
 
-// executeVulnerabilityScan runs a vulnerability scan
+// executeVulnerabilityScan runs a vulnerability scan. CVE findings are
+// enriched with EPSS scores and KEV flags, and findings VEX marks as not
+// affected or fixed are suppressed. The scan fails when the rest reach the
+// step's failOn severity, with newOnly only counting new findings and an
+// exploit policy only those likely to be exploited.
 func (p *SecurityPlugin) executeVulnerabilityScan(ctx context.Context, scanID string, step core.Step) (map[string]interface{}, error) {
 	if !p.config.VulnerabilityScan.Enabled {
 		return map[string]interface{}{
@@ -131,10 +229,32 @@ func (p *SecurityPlugin) executeVulnerabilityScan(ctx context.Context, scanID st
 			"reason": "vulnerability scan is disabled",
 		}, nil
 	}
-	
+
+	failOn, _ := step.Config["failOn"].(string)
+	if failOn != "" {
+		if err := ValidateSeverity(failOn); err != nil {
+			return nil, err
+		}
+	}
+	var exploit ExploitPolicy
+	if value, ok := step.Config["exploit"]; ok {
+		policy, err := decodeExploitPolicy(value)
+		if err != nil {
+			return nil, err
+		}
+		exploit = policy
+		if failOn == "" {
+			failOn = "low"
+		}
+	}
+
 	// Simulate scanning for vulnerabilities
-	time.Sleep(1 * time.Second)
-	
+	select {
+	case <-time.After(1 * time.Second):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
 	// Sample findings for demonstration
 	findings := []Finding{
 		{
@@ -144,6 +264,7 @@ func (p *SecurityPlugin) executeVulnerabilityScan(ctx context.Context, scanID st
 			Description: "Prototype pollution vulnerability in lodash",
 			Severity:    "high",
 			Package:     "lodash",
+			Ecosystem:   "npm",
 			Version:     "4.17.20",
 			FixVersion:  "4.17.21",
 		},
@@ -154,6 +275,7 @@ func (p *SecurityPlugin) executeVulnerabilityScan(ctx context.Context, scanID st
 			Description: "Memory leak in Express.js",
 			Severity:    "high",
 			Package:     "express",
+			Ecosystem:   "npm",
 			Version:     "4.17.1",
 			FixVersion:  "4.17.2",
 		},
@@ -164,6 +286,7 @@ func (p *SecurityPlugin) executeVulnerabilityScan(ctx context.Context, scanID st
 			Description: "SQL injection vulnerability in sequelize",
 			Severity:    "medium",
 			Package:     "sequelize",
+			Ecosystem:   "npm",
 			Version:     "6.6.5",
 			FixVersion:  "6.6.6",
 		},
@@ -174,28 +297,37 @@ func (p *SecurityPlugin) executeVulnerabilityScan(ctx context.Context, scanID st
 			Description: "Cross-site scripting vulnerability in react",
 			Severity:    "medium",
 			Package:     "react",
+			Ecosystem:   "npm",
 			Version:     "17.0.1",
 			FixVersion:  "17.0.2",
 		},
 	}
-	
+
 	scan := Scan{
-		ID:            scanID,
-		Type:          "vulnerability",
-		PipelineID:    step.Config["pipelineId"].(string),
-		JobID:         step.Config["jobId"].(string),
-		Status:        "completed",
-		Timestamp:     time.Now(),
-		FindingsCount: len(findings),
-		HighCount:     2,
-		MediumCount:   2,
-		LowCount:      0,
-		Findings:      findings,
+		ID:         scanID,
+		Type:       "vulnerability",
+		PipelineID: step.Config["pipelineId"].(string),
+		JobID:      step.Config["jobId"].(string),
+		Status:     "completed",
+		Timestamp:  time.Now(),
+		Findings:   findings,
 	}
-	
-	return map[string]interface{}{
-		"scan": scan,
-	}, nil
+	resolveFindings(p.config.Dependencies, scan.Findings)
+	if p.enricher != nil {
+		p.enricher.Enrich(ctx, scan.Findings)
+	}
+	applyVEX(p.vex, &scan)
+
+	if exploit.Enabled() {
+		scan.Metadata = map[string]interface{}{"exploit": exploit}
+	}
+	newOnly, _ := step.Config["newOnly"].(bool)
+	failing := p.gateFindings(&scan, exploit.Filter(scan.Findings), stepScope(step), failOn, newOnly)
+	outputs := map[string]interface{}{"scan": scan}
+	if failing > 0 {
+		return outputs, fmt.Errorf("vulnerability scan found %d issues at or above %s severity", failing, failOn)
+	}
+	return outputs, nil
 }
 
 // executeSecretScan runs a secret scan
@@ -206,10 +338,14 @@ func (p *SecurityPlugin) executeSecretScan(ctx context.Context, scanID string, s
 			"reason": "secret scan is disabled",
 		}, nil
 	}
-	
+
 	// Simulate scanning for secrets
-	time.Sleep(1 * time.Second)
-	
+	select {
+	case <-time.After(1 * time.Second):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
 	// Sample findings for demonstration
 	findings := []Finding{
 		{
@@ -223,7 +359,7 @@ func (p *SecurityPlugin) executeSecretScan(ctx context.Context, scanID string, s
 			Context:     "const apiKey = 'abcdef123456';",
 		},
 	}
-	
+
 	scan := Scan{
 		ID:            scanID,
 		Type:          "secret",
@@ -234,7 +370,7 @@ func (p *SecurityPlugin) executeSecretScan(ctx context.Context, scanID string, s
 		FindingsCount: len(findings),
 		Findings:      findings,
 	}
-	
+
 	return map[string]interface{}{
 		"scan": scan,
 	}, nil
@@ -248,10 +384,14 @@ func (p *SecurityPlugin) executeLicenseScan(ctx context.Context, scanID string,
 			"reason": "license scan is disabled",
 		}, nil
 	}
-	
+
 	// Simulate scanning for licenses
-	time.Sleep(1 * time.Second)
-	
+	select {
+	case <-time.After(1 * time.Second):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
 	// Sample findings for demonstration
 	findings := []Finding{
 		{
@@ -275,7 +415,7 @@ func (p *SecurityPlugin) executeLicenseScan(ctx context.Context, scanID string,
 			License:     "UNKNOWN",
 		},
 	}
-	
+
 	scan := Scan{
 		ID:            scanID,
 		Type:          "license",
@@ -289,7 +429,7 @@ func (p *SecurityPlugin) executeLicenseScan(ctx context.Context, scanID string,
 		LowCount:      0,
 		Findings:      findings,
 	}
-	
+
 	return map[string]interface{}{
 		"scan": scan,
 	}, nil
@@ -303,4 +443,32 @@ func (p *SecurityPlugin) GetConfig() SecurityConfig {
 // UpdateConfig updates the plugin configuration
 func (p *SecurityPlugin) UpdateConfig(config SecurityConfig) {
 	p.config = config
-} 
\ No newline at end of file
+	p.budgetMu.Lock()
+	p.budget = nil
+	p.budgetMu.Unlock()
+}
+
+// History returns the history the plugin records scans in
+func (p *SecurityPlugin) History() *History {
+	return p.history
+}
+
+// UseHistory makes the plugin record scans in history
+func (p *SecurityPlugin) UseHistory(history *History) {
+	p.history = history
+}
+
+// VEX returns the VEX documents vulnerability scans honor
+func (p *SecurityPlugin) VEX() *VEX {
+	return p.vex
+}
+
+// UseVEX makes vulnerability scans honor the documents in vex
+func (p *SecurityPlugin) UseVEX(vex *VEX) {
+	p.vex = vex
+}
+
+// UseEnricher makes vulnerability scans enrich CVE findings with enricher
+func (p *SecurityPlugin) UseEnricher(enricher *Enricher) {
+	p.enricher = enricher
+}
@@ -0,0 +1,141 @@
+package security
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Scan phases reported in progress
+const (
+	PhaseStarting = "starting"
+	PhaseListing  = "listing files"
+	PhaseMatching = "matching rules"
+	PhaseSemgrep  = "running semgrep"
+)
+
+// ScanProgress is the progress of a running scan
+type ScanProgress struct {
+	ScanID         string    `json:"scanId"`
+	Type           string    `json:"type"`
+	PipelineID     string    `json:"pipelineId,omitempty"`
+	JobID          string    `json:"jobId,omitempty"`
+	Phase          string    `json:"phase"`
+	FilesScanned   int       `json:"filesScanned"`
+	FilesTotal     int       `json:"filesTotal"`
+	Percent        float64   `json:"percent"`
+	FilesPerSecond float64   `json:"filesPerSecond"`
+	StartedAt      time.Time `json:"startedAt"`
+	Canceled       bool      `json:"canceled,omitempty"`
+}
+
+// activeScan tracks a running scan so it can be watched and canceled
+type activeScan struct {
+	mu       sync.Mutex
+	progress ScanProgress
+	// matchingSince is when files started being matched, which the rate
+	// is measured from
+	matchingSince time.Time
+	cancel        context.CancelFunc
+}
+
+// activeScanKey is the context key of the running scan
+type activeScanKey struct{}
+
+// activeScanFrom returns the scan running with ctx, or nil
+func activeScanFrom(ctx context.Context) *activeScan {
+	scan, _ := ctx.Value(activeScanKey{}).(*activeScan)
+	return scan
+}
+
+// setPhase moves the scan to a phase
+func (s *activeScan) setPhase(phase string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.progress.Phase = phase
+	if phase == PhaseMatching {
+		s.matchingSince = time.Now()
+	}
+}
+
+// setFiles records how many of the files have been scanned. Workers finish
+// files concurrently, so counts never go back.
+func (s *activeScan) setFiles(scanned, total int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if scanned > s.progress.FilesScanned {
+		s.progress.FilesScanned = scanned
+	}
+	s.progress.FilesTotal = total
+}
+
+// snapshot returns the progress with its percentage and rate computed
+func (s *activeScan) snapshot() ScanProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	progress := s.progress
+	if progress.FilesTotal > 0 {
+		progress.Percent = float64(progress.FilesScanned) * 100 / float64(progress.FilesTotal)
+	}
+	if elapsed := time.Since(s.matchingSince).Seconds(); !s.matchingSince.IsZero() && elapsed > 0 {
+		progress.FilesPerSecond = float64(progress.FilesScanned) / elapsed
+	}
+	return progress
+}
+
+// startScan registers a scan as running and returns the context it runs
+// with, which CancelScan cancels, and a function unregistering it
+func (p *SecurityPlugin) startScan(ctx context.Context, progress ScanProgress) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	progress.Phase = PhaseStarting
+	progress.StartedAt = time.Now()
+	scan := &activeScan{progress: progress, cancel: cancel}
+
+	p.activeMu.Lock()
+	if p.active == nil {
+		p.active = make(map[string]*activeScan)
+	}
+	p.active[progress.ScanID] = scan
+	p.activeMu.Unlock()
+
+	return context.WithValue(ctx, activeScanKey{}, scan), func() {
+		cancel()
+		p.activeMu.Lock()
+		delete(p.active, progress.ScanID)
+		p.activeMu.Unlock()
+	}
+}
+
+// ScanProgress returns the progress of a running scan
+func (p *SecurityPlugin) ScanProgress(id string) (ScanProgress, bool) {
+	p.activeMu.Lock()
+	scan, ok := p.active[id]
+	p.activeMu.Unlock()
+	if !ok {
+		return ScanProgress{}, false
+	}
+	return scan.snapshot(), true
+}
+
+// CancelScan aborts a running scan. The scan stops at the next file and is
+// recorded as canceled with the findings made so far.
+func (p *SecurityPlugin) CancelScan(id string) error {
+	p.activeMu.Lock()
+	scan, ok := p.active[id]
+	p.activeMu.Unlock()
+	if !ok {
+		return fmt.Errorf("scan %s is not running", id)
+	}
+	scan.mu.Lock()
+	scan.progress.Canceled = true
+	scan.mu.Unlock()
+	scan.cancel()
+	return nil
+}
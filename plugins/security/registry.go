@@ -0,0 +1,227 @@
+package security
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chip/conveyor/config"
+	"github.com/chip/conveyor/core"
+)
+
+// resolveRegistry returns the registry a package of an ecosystem resolves
+// through: the one with the longest scope the package starts with, or else
+// the ecosystem's registry without scopes. It reports false for packages
+// from public registries.
+func resolveRegistry(deps config.Dependencies, ecosystem, pkg string) (config.Registry, bool) {
+	var resolved config.Registry
+	longest, found := -1, false
+	for _, registry := range deps.Registries {
+		if registry.Ecosystem != ecosystem {
+			continue
+		}
+		if len(registry.Scopes) == 0 && longest < 0 {
+			resolved, found = registry, true
+		}
+		for _, scope := range registry.Scopes {
+			if inScope(pkg, scope) && len(scope) > longest {
+				resolved, longest, found = registry, len(scope), true
+			}
+		}
+	}
+	return resolved, found
+}
+
+// resolveFindings notes in their metadata the private registry the
+// packages of findings resolve through
+func resolveFindings(deps config.Dependencies, findings []Finding) {
+	for i := range findings {
+		if findings[i].Package == "" {
+			continue
+		}
+		registry, ok := resolveRegistry(deps, findings[i].Ecosystem, findings[i].Package)
+		if !ok {
+			continue
+		}
+		if findings[i].Metadata == nil {
+			findings[i].Metadata = make(map[string]interface{})
+		}
+		findings[i].Metadata["registry"] = registry.Name
+	}
+}
+
+// inScope reports whether a package is in scope, an npm scope such as
+// "@acme" or a prefix of package names
+func inScope(pkg, scope string) bool {
+	if strings.HasPrefix(scope, "@") && !strings.HasSuffix(scope, "/") {
+		return strings.HasPrefix(pkg, scope+"/")
+	}
+	return strings.HasPrefix(pkg, scope)
+}
+
+// registryEnv returns the environment that points the npm, pip and go
+// tools scanners run at the private registries and proxy. Tokens are read
+// with lookup from each registry's TokenEnv.
+func registryEnv(deps config.Dependencies, lookup func(string) string) map[string]string {
+	env := make(map[string]string)
+	var pipExtra, goProxies, goNoSum []string
+	goDefault := "https://proxy.golang.org"
+	for _, registry := range deps.Registries {
+		token := ""
+		if registry.TokenEnv != "" {
+			token = lookup(registry.TokenEnv)
+		}
+		switch registry.Ecosystem {
+		case "npm":
+			if len(registry.Scopes) == 0 {
+				env["npm_config_registry"] = registry.URL
+			}
+			for _, scope := range registry.Scopes {
+				if strings.HasPrefix(scope, "@") {
+					env["npm_config_"+strings.TrimSuffix(scope, "/")+":registry"] = registry.URL
+				}
+			}
+			if token != "" {
+				key, value := npmAuth(registry, token)
+				env[key] = value
+			}
+		case "pypi":
+			if len(registry.Scopes) == 0 {
+				env["PIP_INDEX_URL"] = withCredentials(registry, token)
+			} else {
+				pipExtra = append(pipExtra, withCredentials(registry, token))
+			}
+		case "go":
+			if len(registry.Scopes) == 0 {
+				goDefault = withCredentials(registry, token)
+				continue
+			}
+			goProxies = append(goProxies, withCredentials(registry, token))
+			goNoSum = append(goNoSum, registry.Scopes...)
+		}
+	}
+	if len(pipExtra) > 0 {
+		env["PIP_EXTRA_INDEX_URL"] = strings.Join(pipExtra, " ")
+	}
+	if len(goProxies) > 0 || goDefault != "https://proxy.golang.org" {
+		env["GOPROXY"] = strings.Join(append(goProxies, goDefault, "direct"), ",")
+	}
+	if len(goNoSum) > 0 {
+		env["GONOSUMDB"] = strings.Join(goNoSum, ",")
+	}
+
+	for key, value := range map[string]string{
+		"HTTP_PROXY":  deps.Proxy.HTTP,
+		"HTTPS_PROXY": deps.Proxy.HTTPS,
+		"NO_PROXY":    deps.Proxy.NoProxy,
+	} {
+		if value != "" {
+			env[key] = value
+			env[strings.ToLower(key)] = value
+		}
+	}
+	return env
+}
+
+// npmAuth returns the npm setting authenticating to a registry, basic auth
+// with a username or else a bearer token
+func npmAuth(registry config.Registry, token string) (string, string) {
+	prefix := "npm_config_" + strings.TrimPrefix(strings.TrimPrefix(registry.URL, "https:"), "http:")
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if registry.Username != "" {
+		return prefix + ":_auth", base64.StdEncoding.EncodeToString([]byte(registry.Username + ":" + token))
+	}
+	return prefix + ":_authToken", token
+}
+
+// withCredentials returns a registry's URL with its username and token
+func withCredentials(registry config.Registry, token string) string {
+	if token == "" {
+		return registry.URL
+	}
+	u, err := url.Parse(registry.URL)
+	if err != nil {
+		return registry.URL
+	}
+	if registry.Username != "" {
+		u.User = url.UserPassword(registry.Username, token)
+	} else {
+		u.User = url.User(token)
+	}
+	return u.String()
+}
+
+// stepLookup looks up variables in a step's environment, then the server's
+func stepLookup(step core.Step) func(string) string {
+	env, _ := step.Config["env"].(map[string]string)
+	return func(key string) string {
+		if value, ok := env[key]; ok {
+			return value
+		}
+		return os.Getenv(key)
+	}
+}
+
+// HTTPClient returns a client that reaches the network through proxy,
+// connecting directly to the hosts it excludes
+func HTTPClient(proxy config.Proxy) *http.Client {
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		// Offline mode guards the default transport, which must not be
+		// bypassed
+		return &http.Client{Timeout: 30 * time.Second}
+	}
+	transport = transport.Clone()
+	transport.Proxy = proxyFunc(proxy)
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}
+}
+
+// proxyFunc returns the proxy of a request: the HTTPS or HTTP proxy by
+// scheme, falling back to the environment when neither is set
+func proxyFunc(proxy config.Proxy) func(*http.Request) (*url.URL, error) {
+	if proxy.HTTP == "" && proxy.HTTPS == "" {
+		return http.ProxyFromEnvironment
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if noProxy(proxy.NoProxy, req.URL.Hostname()) {
+			return nil, nil
+		}
+		target := proxy.HTTP
+		if req.URL.Scheme == "https" && proxy.HTTPS != "" {
+			target = proxy.HTTPS
+		}
+		if target == "" {
+			return nil, nil
+		}
+		return url.Parse(target)
+	}
+}
+
+// noProxy reports whether host is excluded from the proxy by list, a comma
+// separated list of hosts, domain suffixes and "*"
+func noProxy(list, host string) bool {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		switch {
+		case entry == "":
+		case entry == "*":
+			return true
+		case strings.HasPrefix(entry, "."):
+			if strings.HasSuffix(host, entry) || host == entry[1:] {
+				return true
+			}
+		case host == entry || strings.HasSuffix(host, "."+entry):
+			return true
+		}
+	}
+	return false
+}
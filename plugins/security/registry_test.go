@@ -0,0 +1,103 @@
+package security
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/chip/conveyor/config"
+	"github.com/chip/conveyor/core"
+)
+
+var testDependencies = config.Dependencies{
+	Registries: []config.Registry{
+		{Name: "npm-mirror", Ecosystem: "npm", URL: "https://artifactory.example.com/api/npm/npm/"},
+		{Name: "npm-internal", Ecosystem: "npm", URL: "https://artifactory.example.com/api/npm/internal/", Scopes: []string{"@acme", "lodash"}, Username: "ci", TokenEnv: "ARTIFACTORY_TOKEN"},
+		{Name: "pypi-internal", Ecosystem: "pypi", URL: "https://artifactory.example.com/api/pypi/internal/simple", Scopes: []string{"acme-"}, TokenEnv: "ARTIFACTORY_TOKEN"},
+		{Name: "go-internal", Ecosystem: "go", URL: "https://artifactory.example.com/api/go/internal", Scopes: []string{"github.com/acme/"}},
+	},
+	Proxy: config.Proxy{HTTPS: "http://proxy.example.com:3128", NoProxy: ".example.com, localhost"},
+}
+
+func TestResolveRegistry(t *testing.T) {
+	tests := []struct {
+		ecosystem, pkg, want string
+	}{
+		{"npm", "@acme/ui", "npm-internal"},
+		{"npm", "@acmeco/ui", "npm-mirror"},
+		{"npm", "express", "npm-mirror"},
+		{"pypi", "acme-utils", "pypi-internal"},
+		{"pypi", "requests", ""},
+		{"go", "github.com/acme/api", "go-internal"},
+	}
+	for _, tt := range tests {
+		registry, ok := resolveRegistry(testDependencies, tt.ecosystem, tt.pkg)
+		if (tt.want != "") != ok || registry.Name != tt.want {
+			t.Errorf("resolveRegistry(%s, %s) = %q, %v, want %q", tt.ecosystem, tt.pkg, registry.Name, ok, tt.want)
+		}
+	}
+}
+
+func TestRegistryEnv(t *testing.T) {
+	step := core.Step{Config: map[string]interface{}{"env": map[string]string{"ARTIFACTORY_TOKEN": "s3cret"}}}
+	env := registryEnv(testDependencies, stepLookup(step))
+	want := map[string]string{
+		"npm_config_registry":       "https://artifactory.example.com/api/npm/npm/",
+		"npm_config_@acme:registry": "https://artifactory.example.com/api/npm/internal/",
+		"npm_config_//artifactory.example.com/api/npm/internal/:_auth": "Y2k6czNjcmV0",
+		"PIP_EXTRA_INDEX_URL": "https://s3cret@artifactory.example.com/api/pypi/internal/simple",
+		"GOPROXY":             "https://artifactory.example.com/api/go/internal,https://proxy.golang.org,direct",
+		"GONOSUMDB":           "github.com/acme/",
+		"HTTPS_PROXY":         "http://proxy.example.com:3128",
+		"no_proxy":            ".example.com, localhost",
+	}
+	for key, value := range want {
+		if env[key] != value {
+			t.Errorf("env[%s] = %q, want %q", key, env[key], value)
+		}
+	}
+	if _, ok := env["PIP_INDEX_URL"]; ok {
+		t.Errorf("PIP_INDEX_URL = %q, want pip's public index kept", env["PIP_INDEX_URL"])
+	}
+}
+
+func TestHTTPClient_Proxy(t *testing.T) {
+	proxy := HTTPClient(testDependencies.Proxy).Transport.(*http.Transport).Proxy
+	for target, want := range map[string]string{
+		"https://api.first.org/data/v1/epss":    "http://proxy.example.com:3128",
+		"https://artifactory.example.com/api":   "",
+		"https://localhost:8443/":               "",
+		"http://plain.example.org/without-http": "",
+	} {
+		u, _ := url.Parse(target)
+		got, err := proxy(&http.Request{URL: u})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got == nil && want != "") || (got != nil && got.String() != want) {
+			t.Errorf("proxy(%s) = %v, want %q", target, got, want)
+		}
+	}
+}
+
+func TestVulnerabilityScan_ResolvesPrivatePackages(t *testing.T) {
+	plugin := NewSecurityPlugin()
+	cfg := plugin.GetConfig()
+	cfg.Dependencies = testDependencies
+	plugin.UpdateConfig(cfg)
+
+	outputs, err := plugin.Execute(context.Background(), core.Step{Type: "vulnerability-scan", Config: map[string]interface{}{"pipelineId": "web", "jobId": "j1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, finding := range outputs["scan"].(Scan).Findings {
+		want := "npm-mirror"
+		if finding.Package == "lodash" {
+			want = "npm-internal"
+		}
+		if finding.Metadata["registry"] != want {
+			t.Errorf("%s registry = %v, want %s", finding.Package, finding.Metadata["registry"], want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package security
+
+import (
+	"html/template"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/chip/conveyor/i18n"
+)
+
+// reportTemplate is the HTML report of a scan. It prints to PDF from a
+// browser, with the print styles keeping findings on whole pages.
+const reportTemplate = `<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<title>{{t "report.title" "Security report: %s" .Scan.ID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.4em 0.6em; text-align: left; vertical-align: top; }
+th { background: #f4f4f4; }
+.critical, .high { color: #b00020; font-weight: bold; }
+.medium { color: #b35c00; }
+@media print { body { margin: 0; } tr { page-break-inside: avoid; } }
+</style>
+</head>
+<body>
+<h1>{{t "report.title" "Security report: %s" .Scan.ID}}</h1>
+<table>
+<tr><th>{{t "report.type" "Type"}}</th><td>{{.Scan.Type}}</td></tr>
+{{- if .Scan.PipelineID}}
+<tr><th>{{t "report.pipeline" "Pipeline"}}</th><td>{{.Scan.PipelineID}}</td></tr>
+{{- end}}
+{{- if .Scan.JobID}}
+<tr><th>{{t "report.job" "Job"}}</th><td>{{.Scan.JobID}}</td></tr>
+{{- end}}
+<tr><th>{{t "report.status" "Status"}}</th><td>{{.Scan.Status}}</td></tr>
+<tr><th>{{t "report.date" "Date"}}</th><td>{{.Date}}</td></tr>
+</table>
+{{template "findings" (findings (t "report.findings" "Findings") .Scan.Findings)}}
+{{- if .Scan.Suppressed}}
+{{template "findings" (findings (t "report.suppressed" "Suppressed findings") .Scan.Suppressed)}}
+{{- end}}
+<p>{{t "report.generated" "Generated %s" .Generated}}</p>
+</body>
+</html>
+{{define "findings"}}
+<h2>{{.Heading}} ({{len .Findings}})</h2>
+{{- if .Findings}}
+<table>
+<tr><th>{{t "report.severity" "Severity"}}</th><th>{{t "report.rule" "Rule"}}</th><th>{{t "report.finding" "Finding"}}</th><th>{{t "report.location" "Location"}}</th></tr>
+{{- range .Findings}}
+<tr>
+<td class="{{.Severity}}">{{severity .Severity}}</td>
+<td><code>{{.ID}}</code></td>
+<td><strong>{{.Title}}</strong><br>{{.Description}}</td>
+<td>{{.Path}}{{if .LineNumber}}:{{.LineNumber}}{{end}}{{if .Location}}<br>{{.Location}}{{end}}</td>
+</tr>
+{{- end}}
+</table>
+{{- else}}
+<p>{{t "report.no_findings" "No findings."}}</p>
+{{- end}}
+{{end}}`
+
+// findingsSection is a heading and the findings listed under it
+type findingsSection struct {
+	Heading  string
+	Findings []Finding
+}
+
+// reportTimeFormat shows the zone's abbreviation and its UTC offset, which
+// tells zones sharing an abbreviation apart
+const reportTimeFormat = "2006-01-02 15:04 MST (-07:00)"
+
+// WriteReport writes the HTML report of a scan in lang, with times in loc
+func WriteReport(w io.Writer, scan Scan, lang string, loc *time.Location) error {
+	tmpl, err := template.New("report").Funcs(template.FuncMap{
+		"t": func(key, format string, args ...interface{}) string {
+			return i18n.Sprintf(lang, key, format, args...)
+		},
+		"severity": func(severity string) string {
+			return i18n.Sprintf(lang, "severity."+strings.ToLower(severity), severity)
+		},
+		"findings": func(heading string, findings []Finding) findingsSection {
+			return findingsSection{Heading: heading, Findings: findings}
+		},
+	}).Parse(reportTemplate)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, struct {
+		Lang      string
+		Scan      Scan
+		Date      string
+		Generated string
+	}{lang, scan.Localize(lang), scan.Timestamp.In(loc).Format(reportTimeFormat), time.Now().In(loc).Format(reportTimeFormat)})
+}
@@ -0,0 +1,525 @@
+package security
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/core/cron"
+	"github.com/chip/conveyor/logging"
+)
+
+var scheduleCounter uint64
+
+// scanStepTypes maps scan types to the step types that run them
+var scanStepTypes = map[string]string{
+	"vulnerability": "vulnerability-scan",
+	"secret":        "secret-scan",
+	"license":       "license-scan",
+	"pipeline":      "pipeline-scan",
+	"code":          "code-scan",
+	"drift":         "drift-scan",
+}
+
+// ScanSchedule runs security scans of a target on a cron schedule,
+// independently of any pipeline
+type ScanSchedule struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Target is a git repository URL, which is cloned for every run, or a
+	// directory on the server
+	Target string `json:"target"`
+	Cron   string `json:"cron"`
+	// Timezone is the IANA time zone Cron is read in. Defaults to the
+	// scheduler's time zone.
+	Timezone string `json:"timezone,omitempty"`
+	// ScanTypes limits the scans that run. Defaults to every scan type,
+	// with drift scans only when there are Workspaces.
+	ScanTypes []string `json:"scanTypes,omitempty"`
+	// Workspaces are the Terraform configurations in the target that drift
+	// scans plan
+	Workspaces []DriftWorkspace `json:"workspaces,omitempty"`
+	Paused     bool             `json:"paused,omitempty"`
+	CreatedAt  time.Time        `json:"createdAt"`
+	LastRunAt  time.Time        `json:"lastRunAt,omitempty"`
+	NextRunAt  time.Time        `json:"nextRunAt,omitempty"`
+	LastError  string           `json:"lastError,omitempty"`
+	LastScans  []string         `json:"lastScans,omitempty"`
+}
+
+// Regression describes findings a scheduled scan reported that the previous
+// scan of the same schedule and type did not. The first drift scan of a
+// schedule has no previous scan and reports all of its drift.
+type Regression struct {
+	ScheduleID     string    `json:"scheduleId"`
+	ScheduleName   string    `json:"scheduleName"`
+	Target         string    `json:"target"`
+	ScanID         string    `json:"scanId"`
+	PreviousScanID string    `json:"previousScanId,omitempty"`
+	ScanType       string    `json:"scanType"`
+	NewFindings    []Finding `json:"newFindings"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// Scheduler runs scan schedules and records their scans in the plugin's
+// history. Schedules are persisted to a JSON file.
+type Scheduler struct {
+	plugin *SecurityPlugin
+	path   string
+	alert  func(Regression)
+	// location is the time zone of schedules that do not name one
+	location *time.Location
+	mu       sync.Mutex
+	entries  map[string]*ScanSchedule
+	running  map[string]bool
+}
+
+// NewScheduler loads the schedules persisted in dir. alert is called for
+// every regression a scheduled scan finds and may be nil.
+func NewScheduler(plugin *SecurityPlugin, dir string, alert func(Regression)) (*Scheduler, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create schedule directory: %w", err)
+	}
+
+	s := &Scheduler{
+		plugin:   plugin,
+		path:     filepath.Join(dir, "schedules.json"),
+		alert:    alert,
+		location: time.Local,
+		entries:  make(map[string]*ScanSchedule),
+		running:  make(map[string]bool),
+	}
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schedules: %w", err)
+	}
+
+	var schedules []*ScanSchedule
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return nil, fmt.Errorf("failed to decode schedules: %w", err)
+	}
+	now := time.Now()
+	for _, schedule := range schedules {
+		// Runs missed while the server was down are not caught up
+		if schedule.NextRunAt.Before(now) {
+			if parsed, err := cron.Parse(schedule.Cron); err == nil {
+				schedule.NextRunAt = nextRun(parsed, now, s.zone(schedule.Timezone))
+			}
+		}
+		s.entries[schedule.ID] = schedule
+	}
+
+	return s, nil
+}
+
+// SetLocation sets the time zone of schedules that do not name one and
+// reschedules them in it
+func (s *Scheduler) SetLocation(loc *time.Location) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.location = loc
+	now := time.Now()
+	for _, schedule := range s.entries {
+		if schedule.Timezone != "" || schedule.NextRunAt.IsZero() {
+			continue
+		}
+		if parsed, err := cron.Parse(schedule.Cron); err == nil {
+			schedule.NextRunAt = nextRun(parsed, now, loc)
+		}
+	}
+	return s.save()
+}
+
+// List returns every schedule ordered by creation time
+func (s *Scheduler) List() []ScanSchedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedules := make([]ScanSchedule, 0, len(s.entries))
+	for _, schedule := range s.entries {
+		schedules = append(schedules, *schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].CreatedAt.Before(schedules[j].CreatedAt)
+	})
+	return schedules
+}
+
+// Get returns a schedule by ID
+func (s *Scheduler) Get(id string) (ScanSchedule, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedule, ok := s.entries[id]
+	if !ok {
+		return ScanSchedule{}, false
+	}
+	return *schedule, true
+}
+
+// Create validates and adds a schedule
+func (s *Scheduler) Create(schedule ScanSchedule) (ScanSchedule, error) {
+	next, err := s.validate(schedule)
+	if err != nil {
+		return ScanSchedule{}, err
+	}
+
+	schedule.ID = fmt.Sprintf("schedule-%d-%d", time.Now().Unix(), atomic.AddUint64(&scheduleCounter, 1))
+	schedule.CreatedAt = time.Now()
+	schedule.NextRunAt = next
+	schedule.LastRunAt = time.Time{}
+	schedule.LastError = ""
+	schedule.LastScans = nil
+	if schedule.Name == "" {
+		schedule.Name = schedule.Target
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[schedule.ID] = &schedule
+	return schedule, s.save()
+}
+
+// Update replaces the settings of a schedule, keeping its run history
+func (s *Scheduler) Update(id string, update ScanSchedule) (ScanSchedule, error) {
+	next, err := s.validate(update)
+	if err != nil {
+		return ScanSchedule{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedule, ok := s.entries[id]
+	if !ok {
+		return ScanSchedule{}, fmt.Errorf("schedule %s not found", id)
+	}
+	schedule.Name = update.Name
+	if schedule.Name == "" {
+		schedule.Name = update.Target
+	}
+	schedule.Target = update.Target
+	schedule.Cron = update.Cron
+	schedule.Timezone = update.Timezone
+	schedule.ScanTypes = update.ScanTypes
+	schedule.Workspaces = update.Workspaces
+	schedule.Paused = update.Paused
+	schedule.NextRunAt = next
+
+	return *schedule, s.save()
+}
+
+// Delete removes a schedule. Its scans stay in the history.
+func (s *Scheduler) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[id]; !ok {
+		return fmt.Errorf("schedule %s not found", id)
+	}
+	delete(s.entries, id)
+	return s.save()
+}
+
+// Trigger runs a schedule in the background now, outside its cron schedule
+func (s *Scheduler) Trigger(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[id]; !ok {
+		return fmt.Errorf("schedule %s not found", id)
+	}
+	if s.running[id] {
+		return fmt.Errorf("schedule %s is already running", id)
+	}
+	s.running[id] = true
+	go s.execute(ctx, id)
+	return nil
+}
+
+// Run starts due schedules every interval until ctx is done
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.runDue(ctx, now)
+		}
+	}
+}
+
+// runDue starts every unpaused schedule whose next run is at or before now
+func (s *Scheduler) runDue(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, schedule := range s.entries {
+		if schedule.Paused || schedule.NextRunAt.IsZero() || schedule.NextRunAt.After(now) || s.running[id] {
+			continue
+		}
+		if parsed, err := cron.Parse(schedule.Cron); err == nil {
+			schedule.NextRunAt = nextRun(parsed, now, s.zone(schedule.Timezone))
+		}
+		s.running[id] = true
+		go s.execute(ctx, id)
+	}
+}
+
+// execute scans the target of a schedule, records the results and alerts on
+// regressions
+func (s *Scheduler) execute(ctx context.Context, id string) {
+	s.mu.Lock()
+	schedule, ok := s.entries[id]
+	var snapshot ScanSchedule
+	if ok {
+		snapshot = *schedule
+	}
+	s.mu.Unlock()
+
+	var scans []Scan
+	var err error
+	if ok {
+		logging.Infof("Running scheduled security scan %s of %s", snapshot.ID, snapshot.Target)
+		scans, err = s.scan(ctx, snapshot)
+	}
+
+	s.mu.Lock()
+	delete(s.running, id)
+	if schedule, ok = s.entries[id]; ok {
+		schedule.LastRunAt = time.Now()
+		schedule.LastError = ""
+		if err != nil {
+			schedule.LastError = err.Error()
+		}
+		schedule.LastScans = nil
+		for _, scan := range scans {
+			schedule.LastScans = append(schedule.LastScans, scan.ID)
+		}
+		if saveErr := s.save(); saveErr != nil {
+			logging.Warnf("Failed to save security schedules: %v", saveErr)
+		}
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		logging.Errorf("Scheduled security scan %s failed: %v", id, err)
+	}
+}
+
+// scan runs the schedule's scans against its target and records them
+func (s *Scheduler) scan(ctx context.Context, schedule ScanSchedule) ([]Scan, error) {
+	dir, cleanup, err := prepareTarget(ctx, schedule.Target)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	history := s.plugin.History()
+	var scans []Scan
+	for _, scanType := range scanTypes(schedule) {
+		step := core.Step{
+			ID:   schedule.ID + "-" + scanType,
+			Type: scanStepTypes[scanType],
+			Config: map[string]interface{}{
+				"pipelineId": "",
+				"jobId":      "",
+				"targetDir":  dir,
+				"workspaces": schedule.Workspaces,
+			},
+		}
+		outputs, err := s.plugin.run(ctx, step)
+		if err != nil {
+			return scans, fmt.Errorf("%s scan failed: %w", scanType, err)
+		}
+		scan, ok := outputs["scan"].(Scan)
+		if !ok {
+			// The scan type is disabled in the plugin configuration
+			continue
+		}
+		scan.Target = schedule.Target
+		scan.ScheduleID = schedule.ID
+
+		previous := history.List(ScanFilter{ScheduleID: schedule.ID, Type: scan.Type, Limit: 1})
+		if err := history.Record(scan); err != nil {
+			return scans, fmt.Errorf("failed to record %s scan: %w", scanType, err)
+		}
+		scans = append(scans, scan)
+
+		var findings []Finding
+		previousID := ""
+		switch {
+		case len(previous) == 1:
+			findings = NewFindings(previous[0], scan)
+			previousID = previous[0].ID
+		case scan.Type == "drift":
+			findings = scan.Findings
+		}
+		if len(findings) > 0 && s.alert != nil {
+			s.alert(Regression{
+				ScheduleID:     schedule.ID,
+				ScheduleName:   schedule.Name,
+				Target:         schedule.Target,
+				ScanID:         scan.ID,
+				PreviousScanID: previousID,
+				ScanType:       scan.Type,
+				NewFindings:    findings,
+				Timestamp:      scan.Timestamp,
+			})
+		}
+	}
+	return scans, nil
+}
+
+// save writes the schedules to disk. Callers must hold s.mu.
+func (s *Scheduler) save() error {
+	schedules := make([]*ScanSchedule, 0, len(s.entries))
+	for _, schedule := range s.entries {
+		schedules = append(schedules, schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].CreatedAt.Before(schedules[j].CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(schedules, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode schedules: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write schedules: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// NewFindings returns the findings of current that previous did not report
+func NewFindings(previous, current Scan) []Finding {
+	seen := make(map[string]bool, len(previous.Findings))
+	for _, finding := range previous.Findings {
+		seen[Fingerprint(finding)] = true
+	}
+
+	var findings []Finding
+	for _, finding := range current.Findings {
+		if !seen[Fingerprint(finding)] {
+			findings = append(findings, finding)
+		}
+	}
+	return findings
+}
+
+// zone returns the location of a schedule's time zone, falling back to the
+// scheduler's for an empty or unknown name
+func (s *Scheduler) zone(name string) *time.Location {
+	if name != "" {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+	return s.location
+}
+
+// nextRun returns when a schedule next fires after now, read in loc and
+// stored in UTC
+func nextRun(parsed *cron.Schedule, now time.Time, loc *time.Location) time.Time {
+	next := parsed.Next(now.In(loc))
+	if next.IsZero() {
+		return next
+	}
+	return next.UTC()
+}
+
+// validate checks a schedule and returns its next run time
+func (s *Scheduler) validate(schedule ScanSchedule) (time.Time, error) {
+	if strings.TrimSpace(schedule.Target) == "" {
+		return time.Time{}, fmt.Errorf("target is required")
+	}
+	if !isRepository(schedule.Target) {
+		info, err := os.Stat(schedule.Target)
+		if err != nil || !info.IsDir() {
+			return time.Time{}, fmt.Errorf("target %q is neither a repository URL nor a directory", schedule.Target)
+		}
+	}
+	for _, scanType := range schedule.ScanTypes {
+		if _, ok := scanStepTypes[scanType]; !ok {
+			return time.Time{}, fmt.Errorf("unknown scan type %q", scanType)
+		}
+	}
+	if err := ValidateDriftWorkspaces(schedule.Workspaces); err != nil {
+		return time.Time{}, err
+	}
+
+	parsed, err := cron.Parse(schedule.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if schedule.Timezone != "" {
+		if _, err := time.LoadLocation(schedule.Timezone); err != nil {
+			return time.Time{}, fmt.Errorf("unknown time zone %q", schedule.Timezone)
+		}
+	}
+	s.mu.Lock()
+	loc := s.zone(schedule.Timezone)
+	s.mu.Unlock()
+	next := nextRun(parsed, time.Now(), loc)
+	if next.IsZero() {
+		return time.Time{}, fmt.Errorf("cron expression %q never fires", schedule.Cron)
+	}
+	return next, nil
+}
+
+// scanTypes returns the scan types a schedule runs in a stable order
+func scanTypes(schedule ScanSchedule) []string {
+	if len(schedule.ScanTypes) > 0 {
+		return schedule.ScanTypes
+	}
+	types := []string{"vulnerability", "secret", "license", "pipeline", "code"}
+	if len(schedule.Workspaces) > 0 {
+		types = append(types, "drift")
+	}
+	return types
+}
+
+// isRepository reports whether target looks like a git repository URL
+func isRepository(target string) bool {
+	return strings.Contains(target, "://") || strings.HasPrefix(target, "git@") || strings.HasSuffix(target, ".git")
+}
+
+// prepareTarget returns a directory holding the target, cloning
+// repositories into a temporary directory that cleanup removes
+func prepareTarget(ctx context.Context, target string) (string, func(), error) {
+	if !isRepository(target) {
+		return target, func() {}, nil
+	}
+
+	dir, err := os.MkdirTemp("", "conveyor-scan-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create clone directory: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	cmd := exec.CommandContext(ctx, "git", "clone", "--depth", "1", target, dir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to clone %s: %v: %s", target, err, strings.TrimSpace(string(output)))
+	}
+	return dir, cleanup, nil
+}
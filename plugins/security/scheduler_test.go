@@ -0,0 +1,152 @@
+package security
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHistory_Persists(t *testing.T) {
+	dir := t.TempDir()
+	history, err := NewHistory(dir)
+	if err != nil {
+		t.Fatalf("NewHistory() error = %v", err)
+	}
+
+	now := time.Now()
+	for i, pipelineID := range []string{"web", "api", "web"} {
+		scan := Scan{ID: "scan-" + string(rune('a'+i)), Type: "secret", PipelineID: pipelineID, Timestamp: now.Add(time.Duration(i) * time.Second)}
+		if err := history.Record(scan); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+
+	reopened, err := NewHistory(dir)
+	if err != nil {
+		t.Fatalf("NewHistory() error = %v", err)
+	}
+	scans := reopened.List(ScanFilter{PipelineID: "web"})
+	if len(scans) != 2 || scans[0].ID != "scan-c" {
+		t.Errorf("List(web) = %+v, want scan-c then scan-a", scans)
+	}
+	if _, ok := reopened.Get("scan-b"); !ok {
+		t.Error("Get(scan-b) not found after reopening")
+	}
+}
+
+func TestNewFindings(t *testing.T) {
+	previous := Scan{Findings: []Finding{{ID: "CVE-1", Type: "vulnerability", Package: "lodash"}}}
+	current := Scan{Findings: []Finding{
+		{ID: "CVE-1", Type: "vulnerability", Package: "lodash"},
+		{ID: "CVE-1", Type: "vulnerability", Package: "express"},
+	}}
+
+	findings := NewFindings(previous, current)
+	if len(findings) != 1 || findings[0].Package != "express" {
+		t.Errorf("NewFindings() = %+v, want only the express finding", findings)
+	}
+	if findings := NewFindings(current, previous); len(findings) != 0 {
+		t.Errorf("NewFindings() = %+v, want none when findings were fixed", findings)
+	}
+}
+
+func TestScheduler_CreateValidates(t *testing.T) {
+	scheduler, err := NewScheduler(NewSecurityPlugin(), t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("NewScheduler() error = %v", err)
+	}
+
+	invalid := []ScanSchedule{
+		{Cron: "@daily"},
+		{Target: t.TempDir(), Cron: "every night"},
+		{Target: "/does/not/exist", Cron: "@daily"},
+		{Target: t.TempDir(), Cron: "@daily", ScanTypes: []string{"malware"}},
+		{Target: t.TempDir(), Cron: "@daily", Timezone: "Mars/Olympus_Mons"},
+	}
+	for _, schedule := range invalid {
+		if _, err := scheduler.Create(schedule); err == nil {
+			t.Errorf("Create(%+v) expected error", schedule)
+		}
+	}
+
+	created, err := scheduler.Create(ScanSchedule{Target: "https://example.com/acme/app.git", Cron: "0 2 * * *"})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if created.NextRunAt.In(time.Local).Hour() != 2 || created.Name != created.Target {
+		t.Errorf("Create() = %+v, want next run at 02:00 named after the target", created)
+	}
+
+	tokyo := time.FixedZone("JST", 9*60*60)
+	if err := scheduler.SetLocation(tokyo); err != nil {
+		t.Fatalf("SetLocation() error = %v", err)
+	}
+	if rescheduled, _ := scheduler.Get(created.ID); rescheduled.NextRunAt.In(tokyo).Hour() != 2 || rescheduled.NextRunAt.Location() != time.UTC {
+		t.Errorf("NextRunAt = %v after SetLocation(JST), want 02:00 JST stored in UTC", rescheduled.NextRunAt)
+	}
+	zoned, err := scheduler.Create(ScanSchedule{Target: "https://example.com/acme/app.git", Cron: "0 2 * * *", Timezone: "UTC"})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if zoned.NextRunAt.Hour() != 2 {
+		t.Errorf("NextRunAt = %v, want 02:00 in the schedule's own time zone", zoned.NextRunAt)
+	}
+}
+
+func TestScheduler_RunsDueSchedulesAndAlertsOnRegressions(t *testing.T) {
+	dir := t.TempDir()
+	plugin := NewSecurityPlugin()
+	regressions := make(chan Regression, 1)
+	scheduler, err := NewScheduler(plugin, dir, func(r Regression) { regressions <- r })
+	if err != nil {
+		t.Fatalf("NewScheduler() error = %v", err)
+	}
+
+	schedule, err := scheduler.Create(ScanSchedule{Name: "nightly", Target: t.TempDir(), Cron: "@daily", ScanTypes: []string{"secret"}})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	// A clean previous scan makes every finding of the next one new
+	if err := plugin.History().Record(Scan{ID: "clean", Type: "secret", ScheduleID: schedule.ID, Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler.runDue(context.Background(), schedule.NextRunAt)
+
+	select {
+	case r := <-regressions:
+		if r.ScheduleID != schedule.ID || r.PreviousScanID != "clean" || len(r.NewFindings) == 0 {
+			t.Errorf("Regression = %+v, want new findings against the clean scan", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no regression reported")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, _ := scheduler.Get(schedule.ID)
+		if !got.LastRunAt.IsZero() {
+			if len(got.LastScans) != 1 || !got.NextRunAt.After(schedule.NextRunAt) {
+				t.Errorf("schedule after run = %+v, want one scan and a later next run", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("schedule did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	scans := plugin.History().List(ScanFilter{ScheduleID: schedule.ID})
+	if len(scans) != 2 || scans[0].Target != schedule.Target {
+		t.Errorf("scans = %+v, want the scheduled scan recorded with its target", scans)
+	}
+
+	reloaded, err := NewScheduler(plugin, dir, nil)
+	if err != nil {
+		t.Fatalf("NewScheduler() error = %v", err)
+	}
+	if _, ok := reloaded.Get(schedule.ID); !ok {
+		t.Error("schedule not persisted")
+	}
+}
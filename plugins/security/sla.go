@@ -0,0 +1,333 @@
+package security
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chip/conveyor/logging"
+)
+
+// SLAPolicy is how many days findings of a severity may stay open before
+// they breach their remediation SLA. A policy for a pipeline overrides the
+// policy for every pipeline with the same severity.
+type SLAPolicy struct {
+	Severity string `json:"severity"`
+	Days     int    `json:"days"`
+	Pipeline string `json:"pipeline,omitempty"`
+}
+
+// DefaultSLAPolicies apply until SLA policies are defined
+var DefaultSLAPolicies = []SLAPolicy{
+	{Severity: "critical", Days: 7},
+	{Severity: "high", Days: 30},
+	{Severity: "medium", Days: 90},
+	{Severity: "low", Days: 180},
+}
+
+// SLABreach is a finding open longer than its severity allows
+type SLABreach struct {
+	FindingID  string    `json:"findingId"`
+	Scope      string    `json:"scope"`
+	Rule       string    `json:"rule"`
+	Title      string    `json:"title,omitempty"`
+	Severity   string    `json:"severity"`
+	FirstSeen  time.Time `json:"firstSeen"`
+	AgeDays    int       `json:"ageDays"`
+	TargetDays int       `json:"targetDays"`
+}
+
+// SLACompliance is how well the findings of a pipeline or team meet their
+// SLAs. A finding is compliant while it is open within its SLA or when it
+// was fixed within it.
+type SLACompliance struct {
+	Group     string `json:"group"`
+	Findings  int    `json:"findings"`
+	Compliant int    `json:"compliant"`
+	Breached  int    `json:"breached"`
+	// OpenBreaches are the breached findings still open
+	OpenBreaches int     `json:"openBreaches"`
+	Percent      float64 `json:"percent"`
+}
+
+// ValidateSLAPolicies checks that policies have a known severity, a
+// positive number of days, and that no two apply to the same findings
+func ValidateSLAPolicies(policies []SLAPolicy) error {
+	seen := make(map[string]bool, len(policies))
+	for _, policy := range policies {
+		if err := ValidateSeverity(policy.Severity); err != nil {
+			return err
+		}
+		if policy.Days <= 0 {
+			return fmt.Errorf("SLA for %s findings must be at least a day", policy.Severity)
+		}
+		key := strings.ToLower(policy.Severity) + "\x00" + policy.Pipeline
+		if seen[key] {
+			return fmt.Errorf("duplicate SLA for %s findings of pipeline %q", policy.Severity, policy.Pipeline)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// slaTarget returns how many days a finding of severity in scope may stay
+// open, and whether any policy applies
+func slaTarget(policies []SLAPolicy, scope, severity string) (int, bool) {
+	pipelineID := ""
+	if strings.HasPrefix(scope, "pipeline:") {
+		pipelineID = strings.TrimPrefix(scope, "pipeline:")
+	}
+	days, found := 0, false
+	for _, policy := range policies {
+		if !strings.EqualFold(policy.Severity, severity) {
+			continue
+		}
+		switch policy.Pipeline {
+		case "":
+			days, found = policy.Days, true
+		case pipelineID:
+			return policy.Days, true
+		}
+	}
+	return days, found
+}
+
+// SLABreaches returns the open findings older than their SLA, oldest first.
+// Findings triaged as false positives or accepted risks don't breach.
+func (h *History) SLABreaches(policies []SLAPolicy, now time.Time) []SLABreach {
+	breaches := []SLABreach{}
+	for _, tracked := range h.Findings(FindingFilter{Status: FindingOpen}) {
+		if suppressed(tracked) {
+			continue
+		}
+		severity := strings.ToLower(tracked.Finding.Severity)
+		days, ok := slaTarget(policies, tracked.Scope, severity)
+		if !ok {
+			continue
+		}
+		if age := ageDays(tracked.FirstSeen, now); age > days {
+			breaches = append(breaches, SLABreach{
+				FindingID:  tracked.ID,
+				Scope:      tracked.Scope,
+				Rule:       tracked.Finding.ID,
+				Title:      tracked.Finding.Title,
+				Severity:   severity,
+				FirstSeen:  tracked.FirstSeen,
+				AgeDays:    age,
+				TargetDays: days,
+			})
+		}
+	}
+	sort.Slice(breaches, func(i, j int) bool {
+		return breaches[i].FirstSeen.Before(breaches[j].FirstSeen)
+	})
+	return breaches
+}
+
+func ageDays(since, now time.Time) int {
+	return int(now.Sub(since).Hours() / 24)
+}
+
+// SLAs holds the remediation SLA policies and escalates findings that
+// breach them. Policies and the breaches already escalated are persisted in
+// sla.json, so a breach is escalated once.
+type SLAs struct {
+	path     string
+	history  *History
+	escalate func(SLABreach)
+
+	mu        sync.Mutex
+	policies  []SLAPolicy
+	escalated map[string]time.Time
+}
+
+// slaState is the persisted state of SLAs
+type slaState struct {
+	Policies  []SLAPolicy          `json:"policies"`
+	Escalated map[string]time.Time `json:"escalated,omitempty"`
+}
+
+// NewSLAs opens the SLA policies persisted in dir. escalate is called with
+// every new breach and may be nil.
+func NewSLAs(dir string, history *History, escalate func(SLABreach)) (*SLAs, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create SLA directory: %w", err)
+	}
+	s := &SLAs{
+		path:      filepath.Join(dir, "sla.json"),
+		history:   history,
+		escalate:  escalate,
+		policies:  DefaultSLAPolicies,
+		escalated: make(map[string]time.Time),
+	}
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SLA policies: %w", err)
+	}
+	var state slaState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode SLA policies: %w", err)
+	}
+	if state.Policies != nil {
+		s.policies = state.Policies
+	}
+	if state.Escalated != nil {
+		s.escalated = state.Escalated
+	}
+	return s, nil
+}
+
+// Policies returns the SLA policies
+func (s *SLAs) Policies() []SLAPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SLAPolicy{}, s.policies...)
+}
+
+// SetPolicies replaces the SLA policies
+func (s *SLAs) SetPolicies(policies []SLAPolicy) error {
+	if err := ValidateSLAPolicies(policies); err != nil {
+		return err
+	}
+	for i := range policies {
+		policies[i].Severity = strings.ToLower(policies[i].Severity)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies = append([]SLAPolicy{}, policies...)
+	return s.save()
+}
+
+// Breaches returns the open findings older than their SLA
+func (s *SLAs) Breaches(now time.Time) []SLABreach {
+	return s.history.SLABreaches(s.Policies(), now)
+}
+
+// Check escalates the breaches that haven't been escalated yet. A finding
+// that is fixed or triaged is escalated again if it breaches once more.
+func (s *SLAs) Check(now time.Time) []SLABreach {
+	breaches := s.Breaches(now)
+
+	s.mu.Lock()
+	breaching := make(map[string]bool, len(breaches))
+	var escalate []SLABreach
+	for _, breach := range breaches {
+		breaching[breach.FindingID] = true
+		if _, ok := s.escalated[breach.FindingID]; !ok {
+			s.escalated[breach.FindingID] = now
+			escalate = append(escalate, breach)
+		}
+	}
+	changed := len(escalate) > 0
+	for id := range s.escalated {
+		if !breaching[id] {
+			delete(s.escalated, id)
+			changed = true
+		}
+	}
+	if changed {
+		if err := s.save(); err != nil {
+			logging.Warnf("Failed to save SLA escalations: %v", err)
+		}
+	}
+	s.mu.Unlock()
+
+	if s.escalate != nil {
+		for _, breach := range escalate {
+			s.escalate(breach)
+		}
+	}
+	return escalate
+}
+
+// Run checks for SLA breaches every interval until ctx is done
+func (s *SLAs) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.Check(now)
+		}
+	}
+}
+
+// Compliance returns SLA compliance grouped by group, which maps a finding's
+// scope to its pipeline or team; findings it maps to "" are left out.
+// Groups are ordered from least to most compliant.
+func (s *SLAs) Compliance(now time.Time, group func(scope string) string) []SLACompliance {
+	policies := s.Policies()
+	groups := make(map[string]*SLACompliance)
+	for _, tracked := range s.history.Findings(FindingFilter{}) {
+		if suppressed(tracked) {
+			continue
+		}
+		name := group(tracked.Scope)
+		if name == "" {
+			continue
+		}
+		days, ok := slaTarget(policies, tracked.Scope, strings.ToLower(tracked.Finding.Severity))
+		if !ok {
+			continue
+		}
+		compliance, ok := groups[name]
+		if !ok {
+			compliance = &SLACompliance{Group: name}
+			groups[name] = compliance
+		}
+		compliance.Findings++
+
+		end := now
+		if tracked.Status == FindingFixed && tracked.FixedAt != nil {
+			end = *tracked.FixedAt
+		}
+		if ageDays(tracked.FirstSeen, end) <= days {
+			compliance.Compliant++
+			continue
+		}
+		compliance.Breached++
+		if tracked.Status == FindingOpen {
+			compliance.OpenBreaches++
+		}
+	}
+
+	result := make([]SLACompliance, 0, len(groups))
+	for _, compliance := range groups {
+		compliance.Percent = float64(compliance.Compliant) * 100 / float64(compliance.Findings)
+		result = append(result, *compliance)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Percent != result[j].Percent {
+			return result[i].Percent < result[j].Percent
+		}
+		return result[i].Group < result[j].Group
+	})
+	return result
+}
+
+// save writes the policies and escalations to disk. Callers must hold s.mu.
+func (s *SLAs) save() error {
+	data, err := json.MarshalIndent(slaState{Policies: s.policies, Escalated: s.escalated}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode SLA policies: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write SLA policies: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
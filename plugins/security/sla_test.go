@@ -0,0 +1,64 @@
+package security
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSLAs_EscalatesBreachesOnce(t *testing.T) {
+	dir := t.TempDir()
+	history := NewMemoryHistory()
+	now := time.Now()
+	critical := Finding{ID: "CVE-2021-44228", Type: "vulnerability", Severity: "critical", Package: "log4j-core"}
+	high := Finding{ID: "JS-EVAL", Type: "code", Severity: "high", Path: "app.js", Context: "eval(x)"}
+	for _, scan := range []Scan{
+		{ID: "s1", Type: "vulnerability", PipelineID: "web", Status: "completed", Timestamp: now.Add(-10 * 24 * time.Hour), Findings: []Finding{critical}},
+		{ID: "s2", Type: "code", PipelineID: "api", Status: "completed", Timestamp: now.Add(-10 * 24 * time.Hour), Findings: []Finding{high}},
+	} {
+		history.Record(scan)
+	}
+
+	var escalated []SLABreach
+	slas, err := NewSLAs(dir, history, func(b SLABreach) { escalated = append(escalated, b) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := slas.SetPolicies([]SLAPolicy{{Severity: "critical", Days: 0}}); err == nil {
+		t.Error("SetPolicies() with a zero day SLA expected error")
+	}
+	if err := slas.SetPolicies([]SLAPolicy{{Severity: "CRITICAL", Days: 7}, {Severity: "high", Days: 30}, {Severity: "high", Days: 5, Pipeline: "api"}}); err != nil {
+		t.Fatalf("SetPolicies() error = %v", err)
+	}
+
+	slas.Check(now)
+	if len(escalated) != 2 {
+		t.Fatalf("escalated = %+v, want the critical finding and the high one under api's 5 day SLA", escalated)
+	}
+	if escalated[0].TargetDays+escalated[1].TargetDays != 12 || escalated[0].AgeDays != 10 {
+		t.Errorf("escalated = %+v", escalated)
+	}
+
+	// Reopened SLAs remember what was escalated
+	escalated = nil
+	reopened, err := NewSLAs(dir, history, func(b SLABreach) { escalated = append(escalated, b) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies := reopened.Policies(); len(policies) != 3 || policies[0].Severity != "critical" {
+		t.Errorf("Policies() = %+v, want the saved policies", policies)
+	}
+	if reopened.Check(now.Add(time.Hour)); len(escalated) != 0 {
+		t.Errorf("escalated = %+v, want breaches escalated once", escalated)
+	}
+
+	// A finding fixed after its SLA still counts as breached
+	history.Record(Scan{ID: "s3", Type: "code", PipelineID: "api", Status: "completed", Timestamp: now})
+	compliance := reopened.Compliance(now, func(scope string) string { return strings.TrimPrefix(scope, "pipeline:") })
+	if len(compliance) != 2 || compliance[0].Group != "api" || compliance[0].Breached != 1 || compliance[0].OpenBreaches != 0 {
+		t.Errorf("Compliance() = %+v, want api's late fix breached and listed first", compliance)
+	}
+	if compliance[1].Group != "web" || compliance[1].OpenBreaches != 1 || compliance[1].Percent != 0 {
+		t.Errorf("Compliance() = %+v, want web's open breach", compliance)
+	}
+}
@@ -0,0 +1,246 @@
+package security
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chip/conveyor/core"
+)
+
+const (
+	// DefaultMemoryBudget is the memory scans buffer files in when the
+	// plugin isn't configured with a budget
+	DefaultMemoryBudget = "64Mi"
+	// sniffSize is how much of a file is read to tell binary files apart
+	sniffSize = 8 << 10
+	// maxLineSize is the longest line matched. The rest of a file with a
+	// longer line, such as a minified bundle, isn't scanned.
+	maxLineSize = 1 << 20
+	// fileScanMemory is the most a file being scanned buffers
+	fileScanMemory = sniffSize + maxLineSize
+)
+
+// progressInterval is how often long scans report their progress
+var progressInterval = 5 * time.Second
+
+// memoryBudget bounds the memory all scans of the plugin buffer files in.
+// Each file being scanned holds a slot of fileScanMemory bytes, so the
+// budget caps how many files are scanned at once across concurrent steps.
+type memoryBudget struct {
+	slots chan struct{}
+}
+
+func newMemoryBudget(bytes int64) *memoryBudget {
+	n := int(bytes / fileScanMemory)
+	if n < 1 {
+		n = 1
+	}
+	return &memoryBudget{slots: make(chan struct{}, n)}
+}
+
+// acquire waits for a slot
+func (b *memoryBudget) acquire(ctx context.Context) error {
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *memoryBudget) release() {
+	<-b.slots
+}
+
+// scanBudget returns the memory budget shared by the plugin's scans,
+// creating it from the configured size on first use
+func (p *SecurityPlugin) scanBudget() (*memoryBudget, error) {
+	p.budgetMu.Lock()
+	defer p.budgetMu.Unlock()
+
+	if p.budget != nil {
+		return p.budget, nil
+	}
+	size := p.config.MemoryBudget
+	if size == "" {
+		size = DefaultMemoryBudget
+	}
+	bytes, err := core.ParseMemory(size)
+	if err != nil || bytes <= 0 {
+		return nil, fmt.Errorf("invalid memory budget %q", size)
+	}
+	p.budget = newMemoryBudget(bytes)
+	return p.budget, nil
+}
+
+// lineMatcher is called with each line of a file and its 1-based number
+type lineMatcher func(rel string, n int, line []byte)
+
+// scanFiles streams the files under dir line by line to match, within the
+// memory budget. Version control and dependency directories, ignored paths
+// and binary files are skipped. Progress is reported to the step's job log
+// every progressInterval and once the scan completes.
+func scanFiles(ctx context.Context, budget *memoryBudget, dir string, ignore []string, newMatcher func() lineMatcher) error {
+	scan := activeScanFrom(ctx)
+	scan.setPhase(PhaseListing)
+	files, err := listFiles(dir, ignore)
+	if err != nil {
+		return err
+	}
+	scan.setPhase(PhaseMatching)
+	scan.setFiles(0, len(files))
+
+	var done int64
+	start := time.Now()
+	progress := func() {
+		scanned := int(atomic.LoadInt64(&done))
+		core.ReportStepProgress(ctx, core.StepProgress{
+			Done:  scanned,
+			Total: len(files),
+			Unit:  "files",
+			Rate:  float64(scanned) / time.Since(start).Seconds(),
+		})
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				progress()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	workers := runtime.NumCPU()
+	if workers > len(files) {
+		workers = len(files)
+	}
+	paths := make(chan string)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			match := newMatcher()
+			for rel := range paths {
+				if err := scanFile(ctx, budget, dir, rel, match); err != nil {
+					errs <- err
+					return
+				}
+				scan.setFiles(int(atomic.AddInt64(&done, 1)), len(files))
+			}
+		}()
+	}
+
+	var scanErr error
+feed:
+	for _, rel := range files {
+		select {
+		case paths <- rel:
+		case scanErr = <-errs:
+			break feed
+		case <-ctx.Done():
+			scanErr = ctx.Err()
+			break feed
+		}
+	}
+	close(paths)
+	wg.Wait()
+	close(errs)
+	if scanErr == nil {
+		scanErr = <-errs
+	}
+	if scanErr != nil {
+		return scanErr
+	}
+	progress()
+	return nil
+}
+
+// listFiles returns the regular files under dir to scan, relative to dir
+func listFiles(dir string, ignore []string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			switch info.Name() {
+			case ".git", "node_modules", "vendor":
+				return filepath.SkipDir
+			}
+			if ignored(rel+"/", ignore) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() && !ignored(rel, ignore) {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// scanFile streams a file to match once the budget has room for it
+func scanFile(ctx context.Context, budget *memoryBudget, dir, rel string, match lineMatcher) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := budget.acquire(ctx); err != nil {
+		return err
+	}
+	defer budget.release()
+
+	file, err := os.Open(filepath.Join(dir, filepath.FromSlash(rel)))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", rel, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, sniffSize)
+	head, err := reader.Peek(sniffSize)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read %s: %w", rel, err)
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxLineSize)
+	n := 0
+	for scanner.Scan() {
+		n++
+		match(rel, n, scanner.Bytes())
+		if n%1024 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			core.LogStep(ctx, "warn", fmt.Sprintf("Stopped scanning %s at line %d: line longer than %s", rel, n+1, core.FormatMemory(maxLineSize)))
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %w", rel, err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package security
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chip/conveyor/core"
+)
+
+func TestScanFiles_StreamsWithinBudget(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"bundle.min.js": "eval(a)\n" + strings.Repeat("x", maxLineSize+1) + "\neval(b)\n",
+		"bin/tool":      "eval(\x00)",
+	}
+	for i := 0; i < 20; i++ {
+		files[filepath.Join("src", string(rune('a'+i))+".js")] = "const x = 1\neval(input)\n"
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A budget smaller than one file still scans a file at a time
+	budget := newMemoryBudget(1)
+	var scanning, most int64
+	var mu sync.Mutex
+	lines := make(map[string][]int)
+	err := scanFiles(context.Background(), budget, dir, nil, func() lineMatcher {
+		return func(rel string, n int, line []byte) {
+			if now := atomic.AddInt64(&scanning, 1); now > atomic.LoadInt64(&most) {
+				atomic.StoreInt64(&most, now)
+			}
+			defer atomic.AddInt64(&scanning, -1)
+			if strings.HasPrefix(string(line), "eval") {
+				mu.Lock()
+				lines[rel] = append(lines[rel], n)
+				mu.Unlock()
+			}
+		}
+	})
+	if err != nil {
+		t.Fatalf("scanFiles() error = %v", err)
+	}
+	if most != 1 {
+		t.Errorf("%d files scanned at once, want the budget to allow 1", most)
+	}
+	if len(lines) != 21 || len(lines["bundle.min.js"]) != 1 || len(lines["src/a.js"]) != 1 || lines["src/a.js"][0] != 2 {
+		t.Errorf("matched lines = %v, want the sources and the bundle up to its long line", lines)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := scanFiles(ctx, budget, dir, nil, func() lineMatcher { return func(string, int, []byte) {} }); err != context.Canceled {
+		t.Errorf("scanFiles() with a canceled context error = %v", err)
+	}
+}
+
+func TestScanBudget(t *testing.T) {
+	plugin := NewSecurityPlugin()
+	budget, err := plugin.scanBudget()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cap(budget.slots) != 64<<20/fileScanMemory {
+		t.Errorf("default budget has %d slots", cap(budget.slots))
+	}
+	if again, _ := plugin.scanBudget(); again != budget {
+		t.Error("scanBudget() isn't shared between scans")
+	}
+
+	config := plugin.GetConfig()
+	config.MemoryBudget = "lots"
+	plugin.UpdateConfig(config)
+	if _, err := plugin.scanBudget(); err == nil {
+		t.Error("scanBudget() with an invalid size expected error")
+	}
+}
+
+func TestCodeScan_ProgressAndCancel(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 5; i++ {
+		if err := os.WriteFile(filepath.Join(dir, string(rune('a'+i))+".js"), []byte("eval(input)\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plugin := NewSecurityPlugin()
+	plugin.config.CodeScan.Rules = []CodeRule{{ID: "JS-EVAL", Severity: "high", Pattern: `\beval\(`}}
+	// Hold the budget so the scan waits to read its first file
+	budget, _ := plugin.scanBudget()
+	for i := 0; i < cap(budget.slots); i++ {
+		budget.acquire(context.Background())
+	}
+
+	type result struct {
+		outputs map[string]interface{}
+		err     error
+	}
+	results := make(chan result)
+	go func() {
+		outputs, err := plugin.Execute(context.Background(), core.Step{Type: "code-scan", Config: map[string]interface{}{"targetDir": dir}})
+		results <- result{outputs, err}
+	}()
+
+	var id string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		plugin.activeMu.Lock()
+		for scanID := range plugin.active {
+			id = scanID
+		}
+		plugin.activeMu.Unlock()
+		if progress, ok := plugin.ScanProgress(id); ok && progress.Phase == PhaseMatching {
+			if progress.Type != "code" || progress.FilesTotal != 5 || progress.FilesScanned != 0 {
+				t.Errorf("progress = %+v, want none of 5 files scanned", progress)
+			}
+			break
+		}
+	}
+	if err := plugin.CancelScan(id); err != nil {
+		t.Fatalf("CancelScan() error = %v", err)
+	}
+
+	r := <-results
+	if r.err == nil || !strings.Contains(r.err.Error(), "canceled") {
+		t.Errorf("Execute() error = %v, want the scan canceled", r.err)
+	}
+	if scan := r.outputs["scan"].(Scan); scan.Status != "canceled" || scan.Metadata["partial"] != true {
+		t.Errorf("scan = %+v, want a partial canceled scan", scan)
+	}
+	if recorded, ok := plugin.History().Get(id); !ok || recorded.Status != "canceled" {
+		t.Errorf("History().Get() = %+v, %v, want the canceled scan recorded", recorded, ok)
+	}
+	if _, ok := plugin.ScanProgress(id); ok {
+		t.Error("ScanProgress() found a finished scan")
+	}
+	if err := plugin.CancelScan(id); err == nil {
+		t.Error("CancelScan() of a finished scan expected error")
+	}
+}
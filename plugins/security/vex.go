@@ -0,0 +1,427 @@
+package security
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VEX statuses. Findings of vulnerabilities that are not_affected or fixed
+// for a product are suppressed.
+const (
+	VEXNotAffected        = "not_affected"
+	VEXAffected           = "affected"
+	VEXFixed              = "fixed"
+	VEXUnderInvestigation = "under_investigation"
+)
+
+// openVEXContext is the OpenVEX version documents are served as
+const openVEXContext = "https://openvex.dev/ns/v0.2.0"
+
+var vexStatuses = map[string]bool{
+	VEXNotAffected:        true,
+	VEXAffected:           true,
+	VEXFixed:              true,
+	VEXUnderInvestigation: true,
+}
+
+var vexJustifications = map[string]bool{
+	"component_not_present":                             true,
+	"vulnerable_code_not_present":                       true,
+	"vulnerable_code_not_in_execute_path":               true,
+	"vulnerable_code_cannot_be_controlled_by_adversary": true,
+	"inline_mitigations_already_exist":                  true,
+}
+
+// VEXDocument is an OpenVEX document of statements on whether products are
+// affected by vulnerabilities. Products are pipeline IDs, "*" for every
+// pipeline, or package URLs.
+type VEXDocument struct {
+	Context    string         `json:"@context"`
+	ID         string         `json:"@id"`
+	Author     string         `json:"author"`
+	Timestamp  time.Time      `json:"timestamp"`
+	Version    int            `json:"version"`
+	Statements []VEXStatement `json:"statements"`
+}
+
+// VEXStatement is the status of a vulnerability in products. A statement
+// with subcomponents only applies to findings in those packages.
+type VEXStatement struct {
+	Vulnerability   VEXVulnerability `json:"vulnerability"`
+	Products        []VEXProduct     `json:"products"`
+	Status          string           `json:"status"`
+	Justification   string           `json:"justification,omitempty"`
+	ImpactStatement string           `json:"impact_statement,omitempty"`
+	ActionStatement string           `json:"action_statement,omitempty"`
+	Timestamp       *time.Time       `json:"timestamp,omitempty"`
+}
+
+// VEXVulnerability names a vulnerability, such as a CVE ID, and its aliases
+type VEXVulnerability struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// VEXProduct identifies a product or a subcomponent of one
+type VEXProduct struct {
+	ID            string       `json:"@id"`
+	Subcomponents []VEXProduct `json:"subcomponents,omitempty"`
+}
+
+// VEXEntry is a stored VEX document and the key it is stored under
+type VEXEntry struct {
+	Key      string      `json:"key"`
+	Document VEXDocument `json:"document"`
+}
+
+// VEXDecision is the statement that applies to a finding
+type VEXDecision struct {
+	Document  string
+	Statement VEXStatement
+}
+
+// ValidateVEX checks a document's statements: each names a vulnerability and
+// products, has a known status, a justification or impact statement when
+// not_affected and an action statement when affected
+func ValidateVEX(doc VEXDocument) error {
+	if len(doc.Statements) == 0 {
+		return fmt.Errorf("VEX document has no statements")
+	}
+	for i, statement := range doc.Statements {
+		if statement.Vulnerability.Name == "" {
+			return fmt.Errorf("statement %d names no vulnerability", i+1)
+		}
+		if len(statement.Products) == 0 {
+			return fmt.Errorf("statement %d for %s names no products", i+1, statement.Vulnerability.Name)
+		}
+		if !vexStatuses[statement.Status] {
+			return fmt.Errorf("statement %d has invalid status %q, want not_affected, affected, fixed or under_investigation", i+1, statement.Status)
+		}
+		if statement.Justification != "" && !vexJustifications[statement.Justification] {
+			return fmt.Errorf("statement %d has invalid justification %q", i+1, statement.Justification)
+		}
+		if statement.Status == VEXNotAffected && statement.Justification == "" && statement.ImpactStatement == "" {
+			return fmt.Errorf("statement %d is not_affected without a justification or impact statement", i+1)
+		}
+		if statement.Status == VEXAffected && statement.ActionStatement == "" {
+			return fmt.Errorf("statement %d is affected without an action statement", i+1)
+		}
+	}
+	return nil
+}
+
+// VEX stores VEX documents, in memory and, if it has a directory, as one
+// JSON file per document
+type VEX struct {
+	dir  string
+	mu   sync.RWMutex
+	docs map[string]VEXDocument
+}
+
+// NewVEX opens the VEX documents stored in dir, creating it if needed
+func NewVEX(dir string) (*VEX, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create VEX directory: %w", err)
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	v := &VEX{dir: dir, docs: make(map[string]VEXDocument)}
+	for _, path := range matches {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read VEX document: %w", err)
+		}
+		var doc VEXDocument
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("failed to decode VEX document %s: %w", filepath.Base(path), err)
+		}
+		v.docs[strings.TrimSuffix(filepath.Base(path), ".json")] = doc
+	}
+	return v, nil
+}
+
+// NewMemoryVEX returns VEX documents that are not persisted
+func NewMemoryVEX() *VEX {
+	return &VEX{docs: make(map[string]VEXDocument)}
+}
+
+// vexKey returns the key a document is stored under, from its @id
+func vexKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return "vex-" + hex.EncodeToString(sum[:6])
+}
+
+// Put imports or authors a VEX document. A document with the @id of a
+// stored one replaces it with the next version. Documents without an @id
+// or timestamp are given one.
+func (v *VEX) Put(doc VEXDocument, author string) (VEXEntry, error) {
+	if err := ValidateVEX(doc); err != nil {
+		return VEXEntry{}, err
+	}
+	if doc.Context == "" {
+		doc.Context = openVEXContext
+	}
+	if doc.Timestamp.IsZero() {
+		doc.Timestamp = time.Now().UTC()
+	}
+	if doc.Author == "" {
+		doc.Author = author
+	}
+	if doc.ID == "" {
+		doc.ID = fmt.Sprintf("conveyor:vex:%d", doc.Timestamp.UnixNano())
+	}
+	key := vexKey(doc.ID)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if previous, ok := v.docs[key]; ok && doc.Version <= previous.Version {
+		doc.Version = previous.Version + 1
+	}
+	if doc.Version == 0 {
+		doc.Version = 1
+	}
+	if v.dir != "" {
+		data, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return VEXEntry{}, fmt.Errorf("failed to encode VEX document: %w", err)
+		}
+		path := filepath.Join(v.dir, key+".json")
+		if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+			return VEXEntry{}, fmt.Errorf("failed to write VEX document: %w", err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return VEXEntry{}, err
+		}
+	}
+	v.docs[key] = doc
+	return VEXEntry{Key: key, Document: doc}, nil
+}
+
+// List returns the stored documents, newest first
+func (v *VEX) List() []VEXEntry {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	entries := make([]VEXEntry, 0, len(v.docs))
+	for key, doc := range v.docs {
+		entries = append(entries, VEXEntry{Key: key, Document: doc})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Document.Timestamp.After(entries[j].Document.Timestamp)
+	})
+	return entries
+}
+
+// Get returns a stored document by key
+func (v *VEX) Get(key string) (VEXDocument, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	doc, ok := v.docs[key]
+	return doc, ok
+}
+
+// Delete removes a stored document
+func (v *VEX) Delete(key string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, ok := v.docs[key]; !ok {
+		return fmt.Errorf("VEX document %s not found", key)
+	}
+	if v.dir != "" {
+		if err := os.Remove(filepath.Join(v.dir, key+".json")); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete VEX document: %w", err)
+		}
+	}
+	delete(v.docs, key)
+	return nil
+}
+
+// Decide returns the latest statement on a finding's vulnerability for a
+// pipeline, if any
+func (v *VEX) Decide(pipelineID string, finding Finding) (VEXDecision, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	var decision VEXDecision
+	var latest time.Time
+	found := false
+	for _, doc := range v.docs {
+		for _, statement := range doc.Statements {
+			if !statement.names(finding.ID) || !statement.covers(pipelineID, finding) {
+				continue
+			}
+			at := doc.Timestamp
+			if statement.Timestamp != nil {
+				at = *statement.Timestamp
+			}
+			if !found || at.After(latest) {
+				decision, latest, found = VEXDecision{Document: doc.ID, Statement: statement}, at, true
+			}
+		}
+	}
+	return decision, found
+}
+
+// Document returns the statements that apply to a pipeline as one OpenVEX
+// document, for serving alongside its SBOM
+func (v *VEX) Document(pipelineID string) VEXDocument {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	doc := VEXDocument{
+		Context:    openVEXContext,
+		ID:         "conveyor:vex:pipeline:" + pipelineID,
+		Author:     "Conveyor",
+		Version:    1,
+		Statements: []VEXStatement{},
+	}
+	for _, stored := range v.docs {
+		for _, statement := range stored.Statements {
+			if !statement.forPipeline(pipelineID) {
+				continue
+			}
+			if statement.Timestamp == nil {
+				at := stored.Timestamp
+				statement.Timestamp = &at
+			}
+			doc.Statements = append(doc.Statements, statement)
+			if stored.Timestamp.After(doc.Timestamp) {
+				doc.Timestamp = stored.Timestamp
+			}
+		}
+	}
+	sort.Slice(doc.Statements, func(i, j int) bool {
+		return doc.Statements[i].Timestamp.Before(*doc.Statements[j].Timestamp)
+	})
+	return doc
+}
+
+// names reports whether the statement is about vulnerability id
+func (s VEXStatement) names(id string) bool {
+	if strings.EqualFold(s.Vulnerability.Name, id) {
+		return true
+	}
+	for _, alias := range s.Vulnerability.Aliases {
+		if strings.EqualFold(alias, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// forPipeline reports whether a product of the statement is the pipeline,
+// every pipeline or a package, which is in every pipeline
+func (s VEXStatement) forPipeline(pipelineID string) bool {
+	for _, product := range s.Products {
+		if product.ID == "*" || product.ID == pipelineID || strings.HasPrefix(product.ID, "pkg:") {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether the statement applies to a finding in a pipeline
+func (s VEXStatement) covers(pipelineID string, finding Finding) bool {
+	for _, product := range s.Products {
+		if strings.HasPrefix(product.ID, "pkg:") {
+			if purlMatches(product.ID, finding) {
+				return true
+			}
+			continue
+		}
+		if product.ID != "*" && product.ID != pipelineID {
+			continue
+		}
+		if len(product.Subcomponents) == 0 {
+			return true
+		}
+		for _, component := range product.Subcomponents {
+			if component.ID == finding.Package || purlMatches(component.ID, finding) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// purlMatches reports whether a package URL such as pkg:npm/lodash@4.17.20
+// is a finding's package, at its version when the URL has one
+func purlMatches(purl string, finding Finding) bool {
+	if finding.Package == "" || !strings.HasPrefix(purl, "pkg:") {
+		return false
+	}
+	rest := strings.TrimPrefix(purl, "pkg:")
+	if i := strings.IndexAny(rest, "?#"); i >= 0 {
+		rest = rest[:i]
+	}
+	slash := strings.Index(rest, "/")
+	if slash < 0 {
+		return false
+	}
+	rest = rest[slash+1:]
+	version := ""
+	if at := strings.LastIndex(rest, "@"); at > 0 {
+		rest, version = rest[:at], rest[at+1:]
+	}
+	name, err := url.PathUnescape(rest)
+	if err != nil {
+		return false
+	}
+	if name != finding.Package && name[strings.LastIndex(name, "/")+1:] != finding.Package {
+		return false
+	}
+	return version == "" || version == finding.Version
+}
+
+// applyVEX moves the findings VEX statements mark as not affected or fixed
+// for the scan's pipeline to its suppressed findings, and notes the
+// statement on the findings it leaves
+func applyVEX(vex *VEX, scan *Scan) {
+	if vex == nil {
+		return
+	}
+	var kept []Finding
+	for _, finding := range scan.Findings {
+		decision, ok := vex.Decide(scan.PipelineID, finding)
+		if !ok {
+			kept = append(kept, finding)
+			continue
+		}
+		metadata := make(map[string]interface{}, len(finding.Metadata)+1)
+		for key, value := range finding.Metadata {
+			metadata[key] = value
+		}
+		vexInfo := map[string]interface{}{"status": decision.Statement.Status, "document": decision.Document}
+		if decision.Statement.Justification != "" {
+			vexInfo["justification"] = decision.Statement.Justification
+		}
+		if decision.Statement.ActionStatement != "" {
+			vexInfo["action"] = decision.Statement.ActionStatement
+		}
+		metadata["vex"] = vexInfo
+		finding.Metadata = metadata
+
+		switch decision.Statement.Status {
+		case VEXNotAffected, VEXFixed:
+			scan.Suppressed = append(scan.Suppressed, finding)
+		default:
+			kept = append(kept, finding)
+		}
+	}
+	scan.Findings = kept
+	scan.FindingsCount = len(kept)
+	scan.HighCount, scan.MediumCount, scan.LowCount = 0, 0, 0
+	countSeverities(scan)
+}
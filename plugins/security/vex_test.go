@@ -0,0 +1,110 @@
+package security
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/chip/conveyor/core"
+)
+
+func TestVEX_SuppressesVulnerabilityFindings(t *testing.T) {
+	dir := t.TempDir()
+	vex, err := NewVEX(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vex.Put(VEXDocument{Statements: []VEXStatement{{
+		Vulnerability: VEXVulnerability{Name: "CVE-2021-1234"},
+		Products:      []VEXProduct{{ID: "web"}},
+		Status:        VEXNotAffected,
+	}}}, "alice"); err == nil {
+		t.Error("Put() not_affected without a justification expected error")
+	}
+
+	doc := VEXDocument{
+		ID: "https://example.com/vex/web-1",
+		Statements: []VEXStatement{
+			{
+				Vulnerability: VEXVulnerability{Name: "cve-2021-1234"},
+				Products:      []VEXProduct{{ID: "web", Subcomponents: []VEXProduct{{ID: "pkg:npm/lodash@4.17.20"}}}},
+				Status:        VEXNotAffected,
+				Justification: "vulnerable_code_not_in_execute_path",
+			},
+			{
+				Vulnerability: VEXVulnerability{Name: "GHSA-xxxx", Aliases: []string{"CVE-2022-1111"}},
+				Products:      []VEXProduct{{ID: "pkg:npm/sequelize"}},
+				Status:        VEXFixed,
+			},
+			{
+				Vulnerability:   VEXVulnerability{Name: "CVE-2022-2222"},
+				Products:        []VEXProduct{{ID: "*"}},
+				Status:          VEXAffected,
+				ActionStatement: "Upgrade react to 17.0.2",
+			},
+		},
+	}
+	entry, err := vex.Put(doc, "alice")
+	if err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if entry.Document.Author != "alice" || entry.Document.Version != 1 || entry.Document.Context == "" {
+		t.Errorf("Put() = %+v, want the author, version and context filled in", entry.Document)
+	}
+
+	// Documents are reopened from disk
+	reopened, err := NewVEX(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := reopened.List(); len(entries) != 1 || entries[0].Key != entry.Key {
+		t.Fatalf("List() = %+v, want the saved document", entries)
+	}
+
+	plugin := NewSecurityPlugin()
+	plugin.UseVEX(reopened)
+	step := core.Step{Type: "vulnerability-scan", Config: map[string]interface{}{"pipelineId": "web", "jobId": "j1", "failOn": "medium"}}
+	outputs, err := plugin.Execute(context.Background(), step)
+	if err == nil {
+		t.Error("Execute() expected the affected react finding to fail the scan")
+	}
+	scan := outputs["scan"].(Scan)
+	if scan.FindingsCount != 2 || len(scan.Suppressed) != 2 || scan.HighCount != 1 || scan.MediumCount != 1 {
+		t.Fatalf("scan = %d findings, %d suppressed, %d high, %d medium; want lodash and sequelize suppressed",
+			scan.FindingsCount, len(scan.Suppressed), scan.HighCount, scan.MediumCount)
+	}
+	if info, _ := scan.Findings[1].Metadata["vex"].(map[string]interface{}); info["status"] != VEXAffected {
+		t.Errorf("react finding metadata = %v, want the affected statement noted", scan.Findings[1].Metadata)
+	}
+
+	// The lodash statement only applies to web
+	step.Config["pipelineId"] = "api"
+	outputs, _ = plugin.Execute(context.Background(), step)
+	if scan := outputs["scan"].(Scan); len(scan.Suppressed) != 1 || scan.Suppressed[0].Package != "sequelize" {
+		t.Errorf("api suppressed = %+v, want only the fixed sequelize finding", scan.Suppressed)
+	}
+
+	if statements := reopened.Document("web").Statements; len(statements) != 3 {
+		t.Errorf("Document(web) = %d statements, want 3", len(statements))
+	}
+	if statements := reopened.Document("api").Statements; len(statements) != 2 {
+		t.Errorf("Document(api) = %d statements, want the package and wildcard statements", len(statements))
+	}
+
+	// Reimporting a document replaces it with the next version
+	later := time.Now().Add(time.Hour)
+	doc.Statements = doc.Statements[:1]
+	doc.Timestamp = later
+	if entry, err = reopened.Put(doc, "bob"); err != nil || entry.Document.Version != 2 {
+		t.Fatalf("Put() = %+v, %v, want version 2", entry, err)
+	}
+	if len(reopened.List()) != 1 {
+		t.Errorf("List() = %+v, want the document replaced", reopened.List())
+	}
+	if err := reopened.Delete(entry.Key); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Decide("web", Finding{ID: "CVE-2021-1234", Package: "lodash", Version: "4.17.20"}); ok {
+		t.Error("Decide() after Delete() found a statement")
+	}
+}
@@ -0,0 +1,112 @@
+package signing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/plugins/pluginutil"
+)
+
+// apkSignerDigest matches the certificate digest apksigner prints for a
+// signer
+var apkSignerDigest = regexp.MustCompile(`(?m)^Signer #\d+ certificate SHA-256 digest: ([0-9a-fA-F]+)`)
+
+// signAndroid signs APKs with apksigner and AABs with jarsigner. The
+// passwords are handed to the tools by the names of their secrets in the
+// environment, keeping them off the command line.
+func (p *SigningPlugin) signAndroid(ctx context.Context, cfg *config, tmp string) ([]SignedArtifact, error) {
+	keystore, err := cfg.writeSecret(tmp, "release.keystore", cfg.keystore)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := p.certificateDigest(ctx, cfg, keystore)
+	if err != nil {
+		return nil, err
+	}
+	signer := fmt.Sprintf("%s (SHA-256 %s)", cfg.keyAlias, digest)
+
+	var signed []SignedArtifact
+	for _, file := range cfg.files {
+		rel, _ := filepath.Rel(cfg.dir, file)
+		rel = filepath.ToSlash(rel)
+		if hasExtension(file, []string{".apk"}) {
+			err = p.signAPK(ctx, cfg, keystore, file, digest)
+		} else {
+			err = p.signAAB(ctx, cfg, keystore, file)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rel, err)
+		}
+		artifact, err := cfg.signed(file, signer)
+		if err != nil {
+			return nil, err
+		}
+		core.LogStep(ctx, "info", fmt.Sprintf("Signed and verified %s with %s", rel, signer))
+		signed = append(signed, artifact)
+	}
+	return signed, nil
+}
+
+// certificateDigest returns the SHA-256 digest of the signing key's
+// certificate
+func (p *SigningPlugin) certificateDigest(ctx context.Context, cfg *config, keystore string) (string, error) {
+	stdout, stderr, err := p.run(ctx, cfg.dir, cfg.env, "keytool", "-exportcert",
+		"-keystore", keystore, "-alias", cfg.keyAlias, "-storepass:env", cfg.keystorePassword)
+	if err != nil {
+		return "", toolError("keytool", stderr, err)
+	}
+	if stdout == "" {
+		return "", fmt.Errorf("keystore %s has no certificate for %s", cfg.keystore, cfg.keyAlias)
+	}
+	sum := sha256.Sum256([]byte(stdout))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// signAPK signs an APK in place and checks that it verifies with the
+// certificate of the signing key
+func (p *SigningPlugin) signAPK(ctx context.Context, cfg *config, keystore, file, digest string) error {
+	stdout, stderr, err := p.run(ctx, cfg.dir, cfg.env, "apksigner", "sign",
+		"--ks", keystore, "--ks-key-alias", cfg.keyAlias,
+		"--ks-pass", "env:"+cfg.keystorePassword, "--key-pass", "env:"+cfg.keyPassword, file)
+	pluginutil.LogOutput(ctx, stdout, stderr)
+	if err != nil {
+		return toolError("apksigner sign", stderr, err)
+	}
+
+	stdout, stderr, err = p.run(ctx, cfg.dir, cfg.env, "apksigner", "verify", "--verbose", "--print-certs", file)
+	if err != nil {
+		return toolError("apksigner verify", stderr, err)
+	}
+	for _, match := range apkSignerDigest.FindAllStringSubmatch(stdout, -1) {
+		if strings.EqualFold(match[1], digest) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the signature doesn't verify with the certificate of %s", cfg.keyAlias)
+}
+
+// signAAB signs an app bundle in place and checks that it verifies
+func (p *SigningPlugin) signAAB(ctx context.Context, cfg *config, keystore, file string) error {
+	stdout, stderr, err := p.run(ctx, cfg.dir, cfg.env, "jarsigner",
+		"-keystore", keystore, "-storepass:env", cfg.keystorePassword, "-keypass:env", cfg.keyPassword,
+		file, cfg.keyAlias)
+	pluginutil.LogOutput(ctx, stdout, stderr)
+	if err != nil {
+		return toolError("jarsigner", stderr, err)
+	}
+
+	stdout, stderr, err = p.run(ctx, cfg.dir, cfg.env, "jarsigner", "-verify", "-strict", file)
+	if err != nil {
+		return toolError("jarsigner -verify", stderr, err)
+	}
+	if !strings.Contains(stdout, "jar verified.") {
+		return fmt.Errorf("the signature doesn't verify: %s", strings.TrimSpace(stdout))
+	}
+	return nil
+}
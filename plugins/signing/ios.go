@@ -0,0 +1,161 @@
+package signing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/plugins/pluginutil"
+)
+
+// codesign is the tool the imported key is made available to
+const codesign = "/usr/bin/codesign"
+
+// identityLine matches an identity security find-identity lists
+var identityLine = regexp.MustCompile(`(?m)^\s*\d+\)\s+([0-9A-F]{40})\s+"([^"]+)"`)
+
+// keychain is a temporary keychain holding the step's certificate
+type keychain struct {
+	path     string
+	password string
+	// identity is the hash of the signing identity and name its name
+	identity string
+	name     string
+}
+
+// signIOS re-signs IPAs with the step's certificate and provisioning
+// profile in a temporary keychain, which is deleted afterwards
+func (p *SigningPlugin) signIOS(ctx context.Context, cfg *config, tmp string) ([]SignedArtifact, error) {
+	certificate, err := cfg.writeSecret(tmp, "certificate.p12", cfg.certificate)
+	if err != nil {
+		return nil, err
+	}
+	profile, err := cfg.writeSecret(tmp, "profile.mobileprovision", cfg.profile)
+	if err != nil {
+		return nil, err
+	}
+	kc, err := p.createKeychain(ctx, cfg, tmp, certificate)
+	if kc != nil {
+		defer p.run(context.Background(), cfg.dir, nil, "security", "delete-keychain", kc.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	entitlements, err := p.entitlements(ctx, cfg, tmp, profile)
+	if err != nil {
+		return nil, err
+	}
+	signer := fmt.Sprintf("%s (SHA-1 %s)", kc.name, kc.identity)
+
+	var signed []SignedArtifact
+	for i, file := range cfg.files {
+		rel, _ := filepath.Rel(cfg.dir, file)
+		rel = filepath.ToSlash(rel)
+		if err := p.signIPA(ctx, cfg, kc, file, filepath.Join(tmp, fmt.Sprintf("ipa-%d", i)), profile, entitlements); err != nil {
+			return nil, fmt.Errorf("%s: %w", rel, err)
+		}
+		artifact, err := cfg.signed(file, signer)
+		if err != nil {
+			return nil, err
+		}
+		core.LogStep(ctx, "info", fmt.Sprintf("Signed and verified %s with %s", rel, signer))
+		signed = append(signed, artifact)
+	}
+	return signed, nil
+}
+
+// createKeychain creates a keychain in tmp with a random password, imports
+// the certificate and finds its signing identity. It returns the keychain
+// to delete once it is created, even on errors.
+func (p *SigningPlugin) createKeychain(ctx context.Context, cfg *config, tmp, certificate string) (*keychain, error) {
+	password := make([]byte, 16)
+	if _, err := rand.Read(password); err != nil {
+		return nil, err
+	}
+	kc := &keychain{path: filepath.Join(tmp, "signing.keychain-db"), password: hex.EncodeToString(password)}
+	if _, stderr, err := p.run(ctx, cfg.dir, nil, "security", "create-keychain", "-p", kc.password, kc.path); err != nil {
+		return nil, toolError("security create-keychain", stderr, err)
+	}
+	commands := [][]string{
+		{"unlock-keychain", "-p", kc.password, kc.path},
+		// security only takes the certificate's password as an argument
+		{"import", certificate, "-k", kc.path, "-P", cfg.secret(cfg.certificatePassword), "-T", codesign},
+		{"set-key-partition-list", "-S", "apple-tool:,apple:,codesign:", "-s", "-k", kc.password, kc.path},
+	}
+	for _, args := range commands {
+		if _, stderr, err := p.run(ctx, cfg.dir, nil, "security", args...); err != nil {
+			return kc, toolError("security "+args[0], stderr, err)
+		}
+	}
+
+	stdout, stderr, err := p.run(ctx, cfg.dir, nil, "security", "find-identity", "-v", "-p", "codesigning", kc.path)
+	if err != nil {
+		return kc, toolError("security find-identity", stderr, err)
+	}
+	match := identityLine.FindStringSubmatch(stdout)
+	if match == nil {
+		return kc, fmt.Errorf("certificate %s has no valid code signing identity", cfg.certificate)
+	}
+	kc.identity, kc.name = match[1], match[2]
+	return kc, nil
+}
+
+// entitlements extracts the entitlements of a provisioning profile into a
+// file of tmp
+func (p *SigningPlugin) entitlements(ctx context.Context, cfg *config, tmp, profile string) (string, error) {
+	stdout, stderr, err := p.run(ctx, cfg.dir, nil, "security", "cms", "-D", "-i", profile)
+	if err != nil {
+		return "", toolError("security cms", stderr, err)
+	}
+	plist := filepath.Join(tmp, "profile.plist")
+	if err := os.WriteFile(plist, []byte(stdout), 0600); err != nil {
+		return "", err
+	}
+	entitlements := filepath.Join(tmp, "entitlements.plist")
+	if _, stderr, err := p.run(ctx, cfg.dir, nil, "plutil", "-extract", "Entitlements", "xml1", "-o", entitlements, plist); err != nil {
+		return "", toolError("plutil", stderr, err)
+	}
+	return entitlements, nil
+}
+
+// signIPA unpacks an IPA into dir, embeds the provisioning profile, signs
+// its frameworks and app, verifies the signature and packs it again in
+// place
+func (p *SigningPlugin) signIPA(ctx context.Context, cfg *config, kc *keychain, file, dir, profile, entitlements string) error {
+	if err := unzip(file, dir); err != nil {
+		return err
+	}
+	apps, _ := filepath.Glob(filepath.Join(dir, "Payload", "*.app"))
+	if len(apps) != 1 {
+		return fmt.Errorf("want one app in Payload, found %d", len(apps))
+	}
+	app := apps[0]
+	if err := copyFile(profile, filepath.Join(app, "embedded.mobileprovision")); err != nil {
+		return err
+	}
+
+	sign := []string{"--force", "--sign", kc.identity, "--keychain", kc.path}
+	frameworks, _ := filepath.Glob(filepath.Join(app, "Frameworks", "*"))
+	for _, framework := range frameworks {
+		if !hasExtension(framework, []string{".framework", ".dylib"}) {
+			continue
+		}
+		if _, stderr, err := p.run(ctx, cfg.dir, nil, "codesign", append(sign, framework)...); err != nil {
+			return toolError("codesign "+filepath.Base(framework), stderr, err)
+		}
+	}
+	stdout, stderr, err := p.run(ctx, cfg.dir, nil, "codesign", append(sign, "--entitlements", entitlements, app)...)
+	pluginutil.LogOutput(ctx, stdout, stderr)
+	if err != nil {
+		return toolError("codesign", stderr, err)
+	}
+	if _, stderr, err := p.run(ctx, cfg.dir, nil, "codesign", "--verify", "--deep", "--strict", app); err != nil {
+		return toolError("codesign --verify", stderr, err)
+	}
+	return zipDir(dir, file)
+}
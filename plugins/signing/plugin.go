@@ -0,0 +1,274 @@
+// Package signing provides the android-sign and ios-sign steps, which sign
+// APK, AAB and IPA files with keystores, certificates and provisioning
+// profiles read from the secrets store and verify the signatures. The
+// credentials only exist in a private temporary directory while the step
+// runs, never in the workspace or the job's logs.
+package signing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/chip/conveyor/core"
+	"github.com/chip/conveyor/plugins/pluginutil"
+)
+
+// Step types
+const (
+	StepAndroid = "android-sign"
+	StepIOS     = "ios-sign"
+)
+
+// SigningPlugin implements the Plugin interface for mobile app signing
+type SigningPlugin struct {
+	run pluginutil.RunFunc
+}
+
+// NewSigningPlugin creates a mobile app signing plugin
+func NewSigningPlugin() *SigningPlugin {
+	return &SigningPlugin{run: pluginutil.RunCommand}
+}
+
+// GetManifest returns the plugin manifest
+func (p *SigningPlugin) GetManifest() core.PluginManifest {
+	return core.PluginManifest{
+		Name:        "signing",
+		Version:     "1.0.0",
+		Description: "Signing of Android APK and AAB files and iOS IPA files with credentials from the secrets store",
+		Author:      "Conveyor Team",
+		Type:        "build",
+		StepTypes:   []string{StepAndroid, StepIOS},
+	}
+}
+
+// SignedArtifact is a file a step signed
+type SignedArtifact struct {
+	// Path is relative to the working directory
+	Path string `json:"path"`
+	// SHA256 is the digest of the signed file
+	SHA256 string `json:"sha256"`
+	// Signer describes the certificate the file was signed with
+	Signer string `json:"signer"`
+}
+
+// config is the configuration of a signing step
+type config struct {
+	files []string
+	// The credentials are the names of secrets the step lists
+	keystore            string
+	keystorePassword    string
+	keyAlias            string
+	keyPassword         string
+	certificate         string
+	certificatePassword string
+	profile             string
+	dir                 string
+	env                 map[string]string
+}
+
+// Execute signs the files a step matches and verifies their signatures
+func (p *SigningPlugin) Execute(ctx context.Context, step core.Step) (map[string]interface{}, error) {
+	if step.Type != StepAndroid && step.Type != StepIOS {
+		return nil, fmt.Errorf("unsupported step type: %s", step.Type)
+	}
+	cfg, err := parseConfig(step)
+	if err != nil {
+		return nil, err
+	}
+
+	// Credentials are written to a directory only the server's user can
+	// read, outside the workspace, and removed when the step ends
+	tmp, err := os.MkdirTemp("", "conveyor-signing-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Chmod(tmp, 0700); err != nil {
+		return nil, err
+	}
+
+	var signed []SignedArtifact
+	if step.Type == StepAndroid {
+		signed, err = p.signAndroid(ctx, cfg, tmp)
+	} else {
+		signed, err = p.signIOS(ctx, cfg, tmp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"signed": signed}, nil
+}
+
+// secret returns the value of a secret the step lists
+func (cfg *config) secret(name string) string {
+	return cfg.env[name]
+}
+
+// writeSecret decodes a base64 secret into a file of dir readable only by
+// the server's user
+func (cfg *config) writeSecret(dir, file, name string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(cfg.secret(name)), ""))
+	if err != nil {
+		return "", fmt.Errorf("secret %s is not base64: %v", name, err)
+	}
+	path := filepath.Join(dir, file)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// signed describes a file once it is signed
+func (cfg *config) signed(file, signer string) (SignedArtifact, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return SignedArtifact{}, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return SignedArtifact{}, err
+	}
+	rel, _ := filepath.Rel(cfg.dir, file)
+	return SignedArtifact{Path: filepath.ToSlash(rel), SHA256: hex.EncodeToString(hash.Sum(nil)), Signer: signer}, nil
+}
+
+// parseConfig reads and checks the configuration of a signing step
+func parseConfig(step core.Step) (*config, error) {
+	values := step.Config
+	cfg := &config{
+		keystore:            pluginutil.String(values, "keystore"),
+		keystorePassword:    pluginutil.String(values, "keystorePassword"),
+		keyAlias:            pluginutil.String(values, "keyAlias"),
+		keyPassword:         pluginutil.String(values, "keyPassword"),
+		certificate:         pluginutil.String(values, "certificate"),
+		certificatePassword: pluginutil.String(values, "certificatePassword"),
+		profile:             pluginutil.String(values, "provisioningProfile"),
+		dir:                 pluginutil.String(values, "workDir"),
+	}
+	cfg.env, _ = values["env"].(map[string]string)
+	if cfg.dir == "" {
+		return nil, fmt.Errorf("%s needs a working directory", step.Type)
+	}
+
+	required := map[string]string{"keystore": cfg.keystore, "keystorePassword": cfg.keystorePassword, "keyAlias": cfg.keyAlias}
+	secrets := []string{"keystore", "keystorePassword", "keyPassword"}
+	extensions := []string{".apk", ".aab"}
+	if step.Type == StepIOS {
+		required = map[string]string{"certificate": cfg.certificate, "provisioningProfile": cfg.profile}
+		secrets = []string{"certificate", "certificatePassword", "provisioningProfile"}
+		extensions = []string{".ipa"}
+	}
+	for _, key := range sortedKeys(required) {
+		if required[key] == "" {
+			return nil, fmt.Errorf("%s needs %s", step.Type, key)
+		}
+	}
+	// Credentials must come from the secrets store rather than the
+	// pipeline definition or its environment
+	listed := make(map[string]bool, len(step.Secrets))
+	for _, name := range step.Secrets {
+		listed[name] = true
+	}
+	for _, key := range secrets {
+		name := pluginutil.String(values, key)
+		if name == "" {
+			continue
+		}
+		if !listed[name] {
+			return nil, fmt.Errorf("%s %s must be a secret the step lists in its secrets", key, name)
+		}
+		if cfg.secret(name) == "" {
+			return nil, fmt.Errorf("secret %s is empty", name)
+		}
+	}
+	if cfg.keyPassword == "" {
+		cfg.keyPassword = cfg.keystorePassword
+	}
+
+	patterns, err := pluginutil.ParseStringList(values, "artifacts")
+	if err != nil {
+		return nil, err
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("%s needs the artifacts to sign", step.Type)
+	}
+	files, err := matchFiles(cfg.dir, patterns, extensions)
+	if err != nil {
+		return nil, err
+	}
+	cfg.files = files
+	return cfg, nil
+}
+
+// matchFiles returns the files in dir matching the glob patterns, which
+// must have one of the extensions
+func matchFiles(dir string, patterns, extensions []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var files []string
+	for _, pattern := range patterns {
+		if filepath.IsAbs(pattern) {
+			return nil, fmt.Errorf("artifact pattern %s must be relative to the working directory", pattern)
+		}
+		matches, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(pattern)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid artifact pattern %s: %v", pattern, err)
+		}
+		for _, match := range matches {
+			rel, err := filepath.Rel(dir, match)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return nil, fmt.Errorf("artifact pattern %s matches files outside the working directory", pattern)
+			}
+			if info, err := os.Stat(match); err != nil || !info.Mode().IsRegular() || seen[match] {
+				continue
+			}
+			if !hasExtension(match, extensions) {
+				return nil, fmt.Errorf("can't sign %s, want %s files", filepath.ToSlash(rel), strings.Join(extensions, " or "))
+			}
+			seen[match] = true
+			files = append(files, match)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files match %s", strings.Join(patterns, ", "))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// hasExtension reports whether a file has one of the extensions
+func hasExtension(file string, extensions []string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	for _, want := range extensions {
+		if ext == want {
+			return true
+		}
+	}
+	return false
+}
+
+// toolError describes a failed tool run by its error output, or err
+func toolError(command, stderr string, err error) error {
+	if msg := strings.TrimSpace(stderr); msg != "" {
+		return fmt.Errorf("%s failed: %s", command, msg)
+	}
+	return fmt.Errorf("%s failed: %w", command, err)
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,296 @@
+package signing
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chip/conveyor/core"
+)
+
+const (
+	keystoreData = "keystore-bytes"
+	storePass    = "store-hunter2"
+	certificate  = "DER-certificate"
+)
+
+// fakeTools simulates the signing tools, checking how credentials reach
+// them
+type fakeTools struct {
+	t       *testing.T
+	workDir string
+	calls   []string
+	// credentials are the files credentials were read from
+	credentials []string
+}
+
+func (f *fakeTools) run(ctx context.Context, dir string, env map[string]string, name string, args ...string) (string, string, error) {
+	command := name + " " + strings.Join(args, " ")
+	f.calls = append(f.calls, command)
+	if strings.Contains(command, storePass) {
+		f.t.Errorf("%s has the password on its command line", command)
+	}
+	for i, arg := range args {
+		if arg == "--ks" || arg == "-keystore" || arg == "import" || arg == "-i" {
+			path := args[i+1]
+			f.credentials = append(f.credentials, path)
+			if strings.HasPrefix(path, f.workDir) {
+				f.t.Errorf("%s reads credentials from the workspace", command)
+			}
+			if arg == "--ks" || arg == "-keystore" {
+				if data, _ := os.ReadFile(path); string(data) != keystoreData {
+					f.t.Errorf("keystore = %q, want the decoded secret", data)
+				}
+				if env["KEYSTORE_PASSWORD"] != storePass {
+					f.t.Errorf("%s doesn't get the password in its environment", command)
+				}
+			}
+		}
+	}
+
+	file := args[len(args)-1]
+	switch {
+	case name == "keytool":
+		return certificate, "", nil
+	case name == "apksigner" && args[0] == "sign", name == "jarsigner" && args[0] != "-verify":
+		if name == "jarsigner" {
+			file = args[len(args)-2]
+		}
+		data, _ := os.ReadFile(file)
+		os.WriteFile(file, append(data, " signed"...), 0644)
+	case name == "apksigner":
+		sum := sha256.Sum256([]byte(certificate))
+		return "Verifies\nSigner #1 certificate SHA-256 digest: " + hex.EncodeToString(sum[:]) + "\n", "", nil
+	case name == "jarsigner":
+		return "jar verified.\n", "", nil
+	case name == "security" && args[0] == "find-identity":
+		return `  1) 0123456789ABCDEF0123456789ABCDEF01234567 "Apple Distribution: Acme (TEAM1)"` + "\n     1 valid identities found\n", "", nil
+	case name == "security" && args[0] == "cms":
+		return "<plist/>", "", nil
+	case name == "plutil":
+		os.WriteFile(args[4], []byte("<plist>entitlements</plist>"), 0600)
+	case name == "codesign" && args[0] == "--force":
+		os.MkdirAll(filepath.Join(file, "_CodeSignature"), 0755)
+		os.WriteFile(filepath.Join(file, "_CodeSignature", "CodeResources"), []byte(args[2]), 0644)
+	}
+	return "", "", nil
+}
+
+func newEngine(t *testing.T, plugin *SigningPlugin, workDir string, secrets map[string]string) *core.PipelineEngine {
+	t.Helper()
+	store, err := core.NewFileSecretStore(t.TempDir(), bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := core.NewPipelineEngine(core.WithLogger(log.New(io.Discard, "", 0)), core.WithSecrets(store),
+		core.WithExecutor(&core.ShellExecutor{Dir: workDir}), core.WithPlugins(plugin))
+	for name, value := range secrets {
+		if _, err := engine.SetSecret(core.Secret{Name: name, Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return engine
+}
+
+func TestAndroidSign(t *testing.T) {
+	workDir := t.TempDir()
+	os.MkdirAll(filepath.Join(workDir, "build"), 0755)
+	for _, name := range []string{"app.apk", "app.aab"} {
+		os.WriteFile(filepath.Join(workDir, "build", name), []byte(name), 0644)
+	}
+	fake := &fakeTools{t: t, workDir: workDir}
+	plugin := NewSigningPlugin()
+	plugin.run = fake.run
+	engine := newEngine(t, plugin, workDir, map[string]string{
+		"KEYSTORE":          base64.StdEncoding.EncodeToString([]byte(keystoreData)),
+		"KEYSTORE_PASSWORD": storePass,
+	})
+
+	step := core.Step{ID: "sign", Type: StepAndroid, Secrets: []string{"KEYSTORE", "KEYSTORE_PASSWORD"}, Config: map[string]interface{}{
+		"artifacts":        []interface{}{"build/*.apk", "build/*.aab"},
+		"keystore":         "KEYSTORE",
+		"keystorePassword": "KEYSTORE_PASSWORD",
+		"keyAlias":         "release",
+	}}
+	engine.CreatePipeline(&core.Pipeline{ID: "mobile", Stages: []core.Stage{{ID: "sign", Steps: []core.Step{step}}}})
+	job, err := engine.Run(context.Background(), "mobile")
+	if err != nil || job.Status != core.StatusSuccess {
+		t.Fatalf("Run() = %+v, %v, want success", job, err)
+	}
+
+	var outputs struct {
+		Signed []SignedArtifact `json:"signed"`
+	}
+	json.Unmarshal([]byte(job.Steps[0].Output), &outputs)
+	if len(outputs.Signed) != 2 || outputs.Signed[0].Path != "build/app.aab" || outputs.Signed[1].Path != "build/app.apk" {
+		t.Fatalf("signed = %+v, want both files", outputs.Signed)
+	}
+	data, _ := os.ReadFile(filepath.Join(workDir, "build", "app.apk"))
+	if sum := sha256.Sum256(data); outputs.Signed[1].SHA256 != hex.EncodeToString(sum[:]) || string(data) != "app.apk signed" {
+		t.Errorf("app.apk = %q with digest %s, want the signed file's digest", data, outputs.Signed[1].SHA256)
+	}
+	if !strings.HasPrefix(outputs.Signed[0].Signer, "release (SHA-256 ") {
+		t.Errorf("signer = %q, want the alias and certificate digest", outputs.Signed[0].Signer)
+	}
+
+	for _, path := range fake.credentials {
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("credential file %s was left behind", path)
+		}
+	}
+	entries, _ := os.ReadDir(filepath.Join(workDir, "build"))
+	if len(entries) != 2 {
+		t.Errorf("build has %d files, want only the signed artifacts", len(entries))
+	}
+	for _, entry := range job.Logs {
+		if strings.Contains(entry.Message, storePass) || strings.Contains(entry.Message, keystoreData) {
+			t.Errorf("log %q has credentials", entry.Message)
+		}
+	}
+}
+
+func TestAndroidSign_VerificationFails(t *testing.T) {
+	workDir := t.TempDir()
+	os.WriteFile(filepath.Join(workDir, "app.apk"), []byte("apk"), 0644)
+	fake := &fakeTools{t: t, workDir: workDir}
+	plugin := NewSigningPlugin()
+	plugin.run = func(ctx context.Context, dir string, env map[string]string, name string, args ...string) (string, string, error) {
+		if name == "apksigner" && args[0] == "verify" {
+			return "", "DOES NOT VERIFY\nERROR: APK Signature Scheme v2 signer #1: Malformed list of signers\n", errors.New("exit status 1")
+		}
+		return fake.run(ctx, dir, env, name, args...)
+	}
+	cfg := &config{files: []string{filepath.Join(workDir, "app.apk")}, keystore: "KEYSTORE", keystorePassword: "KEYSTORE_PASSWORD", keyAlias: "release",
+		keyPassword: "KEYSTORE_PASSWORD", dir: workDir, env: map[string]string{"KEYSTORE": base64.StdEncoding.EncodeToString([]byte(keystoreData)), "KEYSTORE_PASSWORD": storePass}}
+	_, err := plugin.signAndroid(context.Background(), cfg, t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "app.apk: apksigner verify failed") {
+		t.Errorf("signAndroid() error = %v, want a verification failure", err)
+	}
+}
+
+func TestIOSSign(t *testing.T) {
+	workDir := t.TempDir()
+	ipa := filepath.Join(workDir, "App.ipa")
+	writeZip(t, ipa, map[string]string{
+		"Payload/App.app/App":                          "binary",
+		"Payload/App.app/Frameworks/Lib.framework/Lib": "library",
+	})
+	fake := &fakeTools{t: t, workDir: workDir}
+	plugin := NewSigningPlugin()
+	plugin.run = fake.run
+	engine := newEngine(t, plugin, workDir, map[string]string{
+		"IOS_CERTIFICATE": base64.StdEncoding.EncodeToString([]byte("p12")),
+		"IOS_CERT_PASS":   "cert-pass",
+		"IOS_PROFILE":     base64.StdEncoding.EncodeToString([]byte("profile")),
+	})
+
+	step := core.Step{ID: "sign", Type: StepIOS, Secrets: []string{"IOS_CERTIFICATE", "IOS_CERT_PASS", "IOS_PROFILE"}, Config: map[string]interface{}{
+		"artifacts":           "*.ipa",
+		"certificate":         "IOS_CERTIFICATE",
+		"certificatePassword": "IOS_CERT_PASS",
+		"provisioningProfile": "IOS_PROFILE",
+	}}
+	engine.CreatePipeline(&core.Pipeline{ID: "mobile", Stages: []core.Stage{{ID: "sign", Steps: []core.Step{step}}}})
+	job, err := engine.Run(context.Background(), "mobile")
+	if err != nil || job.Status != core.StatusSuccess {
+		t.Fatalf("Run() = %+v, %v, want success", job, err)
+	}
+
+	files := readZip(t, ipa)
+	if files["Payload/App.app/embedded.mobileprovision"] != "profile" {
+		t.Errorf("IPA files = %v, want the provisioning profile embedded", files)
+	}
+	for _, name := range []string{"Payload/App.app/_CodeSignature/CodeResources", "Payload/App.app/Frameworks/Lib.framework/_CodeSignature/CodeResources"} {
+		if files[name] != "0123456789ABCDEF0123456789ABCDEF01234567" {
+			t.Errorf("%s = %q, want it signed with the certificate's identity", name, files[name])
+		}
+	}
+	if !strings.Contains(job.Steps[0].Output, "Apple Distribution: Acme (TEAM1)") {
+		t.Errorf("output = %s, want the signer", job.Steps[0].Output)
+	}
+	if last := fake.calls[len(fake.calls)-1]; !strings.HasPrefix(last, "security delete-keychain") {
+		t.Errorf("last call = %s, want the keychain deleted", last)
+	}
+	for _, path := range fake.credentials {
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("credential file %s was left behind", path)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	workDir := t.TempDir()
+	os.WriteFile(filepath.Join(workDir, "app.apk"), []byte("apk"), 0644)
+	os.WriteFile(filepath.Join(workDir, "app.zip"), []byte("zip"), 0644)
+	os.WriteFile(filepath.Join(filepath.Dir(workDir), "other.apk"), []byte("apk"), 0644)
+	env := map[string]string{"KEYSTORE": "a2V5", "KEYSTORE_PASSWORD": storePass}
+	tests := []struct {
+		name    string
+		secrets []string
+		config  map[string]interface{}
+		want    string
+	}{
+		{"valid", []string{"KEYSTORE", "KEYSTORE_PASSWORD"}, nil, ""},
+		{"not a secret", []string{"KEYSTORE"}, nil, "keystorePassword KEYSTORE_PASSWORD must be a secret the step lists"},
+		{"no alias", []string{"KEYSTORE", "KEYSTORE_PASSWORD"}, map[string]interface{}{"keyAlias": ""}, "android-sign needs keyAlias"},
+		{"no match", []string{"KEYSTORE", "KEYSTORE_PASSWORD"}, map[string]interface{}{"artifacts": "*.aab"}, "no files match *.aab"},
+		{"extension", []string{"KEYSTORE", "KEYSTORE_PASSWORD"}, map[string]interface{}{"artifacts": "app.*"}, "can't sign app.zip"},
+		{"outside", []string{"KEYSTORE", "KEYSTORE_PASSWORD"}, map[string]interface{}{"artifacts": "../*.apk"}, "outside the working directory"},
+	}
+	for _, tt := range tests {
+		config := map[string]interface{}{"artifacts": "*.apk", "keystore": "KEYSTORE", "keystorePassword": "KEYSTORE_PASSWORD", "keyAlias": "release", "workDir": workDir, "env": env}
+		for key, value := range tt.config {
+			config[key] = value
+		}
+		cfg, err := parseConfig(core.Step{Type: StepAndroid, Secrets: tt.secrets, Config: config})
+		if tt.want == "" {
+			if err != nil || len(cfg.files) != 1 || cfg.keyPassword != "KEYSTORE_PASSWORD" {
+				t.Errorf("%s: parseConfig() = %+v, %v, want app.apk with the keystore password", tt.name, cfg, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: parseConfig() error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func writeZip(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		entry, _ := w.Create(name)
+		io.WriteString(entry, content)
+	}
+	w.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readZip(t *testing.T, path string) map[string]string {
+	t.Helper()
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	files := make(map[string]string)
+	for _, f := range r.File {
+		rc, _ := f.Open()
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+	return files
+}
@@ -19,7 +19,7 @@ fi
 
 # Start the development server
 echo "Starting Conveyor development server..."
-go run ./cli serve
+go run ./cli server
 
 # Trap SIGINT to clean up
 trap 'echo "Shutting down..."; docker-compose down; exit 0' SIGINT SIGTERM 
\ No newline at end of file